@@ -4,20 +4,33 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // AgentConfig contains configuration for the agent service
 type AgentConfig struct {
-	ClaudeAPIKey string
-	Model        string
-	MaxTokens    int
-	Temperature  float64
-	Streaming    bool
+	ClaudeAPIKey      string
+	Model             string
+	MaxTokens         int
+	Temperature       float64
+	Streaming         bool
+	MaxToolRounds     int            // tool calls Claude may make before it must answer
+	SummaryInterval   int            // messages between updates of a session's summary; 0 disables summaries
+	KBLanguage        string         // ISO 639-1 code of the language the knowledge base is written in
+	InputCostPerMTok  float64        // USD per million input tokens, for conversation costs
+	OutputCostPerMTok float64        // USD per million output tokens
+	RequestTimeout    time.Duration  // per Claude request; for streamed answers, until the response starts
+	MaxRetries        int            // retries of Claude requests that failed, were rate limited, or found Claude overloaded
+	BreakerThreshold  int            // Claude requests failing in a row that open the circuit breaker; 0 disables it
+	BreakerCooldown   time.Duration  // how long the circuit breaker stays open
+	Routing           ModelRouting   // sends simple messages to a cheaper model; tenants may have their own
+	BusinessHours     *BusinessHours // when human agents are working; nil when always. Tenants may have their own
 }
 
 // AgentService handles AI agent operations
@@ -25,24 +38,90 @@ type AgentService struct {
 	config         *AgentConfig
 	sessionManager *SessionManager
 	knowledgeBase  *KnowledgeBase
+	handoffs       *HandoffQueue
+	surveys        *Surveys // nil when surveys are disabled
+	pii            *PIIRedactor
+	translator     Translator     // nil when knowledge base queries are not translated
+	responses      *ResponseCache // nil when answers are not cached
+	intents        *IntentRouter
+	prompts        *PromptStore
+	analytics      *ConversationAnalytics
 	httpClient     *http.Client
-	systemPrompt   string
+	streamClient   *http.Client // streamed answers take longer than httpClient allows
+	breaker        *CircuitBreaker
+	tools          *ToolRegistry
+	tickets        *TicketOpener // nil when escalations open no tickets
+	guardrails     *Guardrails   // nil when messages and answers are not checked
 }
 
-// NewAgentService creates a new agent service
-func NewAgentService(config *AgentConfig, sessionMgr *SessionManager, kb *KnowledgeBase) (*AgentService, error) {
-	return &AgentService{
+// NewAgentService creates a new agent service. Escalated sessions are queued in handoffs, and
+// the agent stops answering them until a human agent resolves the handoff. Answers to surveys
+// are recorded in surveys instead of being answered. Personal data in conversations is replaced
+// with placeholders by pii before it reaches Claude. Messages are routed by intents to the
+// prompt, tools, and knowledge base categories of their intent. The system prompt is the version
+// published in prompts.
+func NewAgentService(config *AgentConfig, sessionMgr *SessionManager, kb *KnowledgeBase, handoffs *HandoffQueue, surveys *Surveys, pii *PIIRedactor, intents *IntentRouter, prompts *PromptStore) (*AgentService, error) {
+	// A stalled stream is given up on, and retried, as soon as the answer is late to start
+	streamTransport := http.DefaultTransport.(*http.Transport).Clone()
+	streamTransport.ResponseHeaderTimeout = config.RequestTimeout
+
+	s := &AgentService{
 		config:         config,
 		sessionManager: sessionMgr,
 		knowledgeBase:  kb,
+		handoffs:       handoffs,
+		surveys:        surveys,
+		pii:            pii,
+		intents:        intents,
+		prompts:        prompts,
+		analytics:      NewConversationAnalytics(sessionMgr.client),
 		httpClient: &http.Client{
-			Timeout: 60 * time.Second,
+			Timeout: 5 * time.Minute, // requests have RequestTimeout as their deadline
 		},
-		systemPrompt: buildSystemPrompt(),
-	}, nil
+		streamClient: &http.Client{
+			Timeout:   5 * time.Minute,
+			Transport: streamTransport,
+		},
+		breaker: NewCircuitBreaker(config.BreakerThreshold, config.BreakerCooldown),
+		tools:   NewToolRegistry(),
+	}
+	s.RegisterTools(s.builtinTools()...)
+
+	return s, nil
+}
+
+// RegisterTools makes tools available to Claude
+func (s *AgentService) RegisterTools(tools ...*Tool) {
+	for _, tool := range tools {
+		s.tools.Register(tool)
+	}
+}
+
+// SetResponseCache has questions that stand on their own answered from the answers Claude gave
+// to near-identical ones
+func (s *AgentService) SetResponseCache(responses *ResponseCache) {
+	s.responses = responses
+}
+
+// SetTicketOpener has a ticket opened for conversations escalated on the opener's channels, and
+// its ID given to the customer
+func (s *AgentService) SetTicketOpener(tickets *TicketOpener) {
+	s.tickets = tickets
 }
 
-// buildSystemPrompt creates the system prompt for the customer service agent
+// SetGuardrails has customer messages moderated and Claude's answers validated before they are
+// answered and sent
+func (s *AgentService) SetGuardrails(guardrails *Guardrails) {
+	s.guardrails = guardrails
+}
+
+// SetTranslator has knowledge base queries in other languages translated into the knowledge
+// base language
+func (s *AgentService) SetTranslator(translator Translator) {
+	s.translator = translator
+}
+
+// buildSystemPrompt creates the system prompt tenants without one of their own start with
 func buildSystemPrompt() string {
 	return `You are an expert customer service representative AI assistant. Your role is to:
 
@@ -78,12 +157,11 @@ func buildSystemPrompt() string {
 - Cite sources when providing information
 - Verify accuracy before responding
 
-You have access to these tools:
-- search_knowledge_base(query): Search for relevant KB articles
-- escalate_to_human(reason, priority): Escalate to human agent
-- get_order_status(order_id): Get order status
-- process_refund(order_id, reason): Process refund requests
-- update_ticket_priority(ticket_id, priority): Change ticket priority`
+**Tools**:
+- Use your tools to look up orders and articles instead of guessing
+- Confirm the order and amount with the customer before processing a refund
+- Use escalate_to_human when the customer asks for a person or you cannot resolve the issue
+- Never claim an action was taken unless a tool reported it succeeded`
 }
 
 // ChatMessageRequest represents an incoming message
@@ -93,6 +171,15 @@ type ChatMessageRequest struct {
 	UserID    string                 `json:"user_id" binding:"required"`
 	Channel   string                 `json:"channel"` // slack, zendesk, web, etc.
 	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+
+	// ZendeskTicketID is the ticket a Zendesk conversation is on. Only the webhook sets it, so
+	// chat clients cannot point ticket tools at other customers' tickets.
+	ZendeskTicketID int `json:"-"`
+
+	// Source is the channel message the request came from, such as a *SlackWebhook. It is kept
+	// with the session so human agents and surveys can reach the customer on the same channel.
+	// Chat requests have none.
+	Source interface{} `json:"-"`
 }
 
 // Validate validates the chat message request
@@ -114,16 +201,20 @@ func (r *ChatMessageRequest) Validate() error {
 
 // ChatMessageResponse represents the agent's response
 type ChatMessageResponse struct {
-	SessionID     string                 `json:"session_id"`
-	Message       string                 `json:"message"`
-	Sentiment     string                 `json:"sentiment"` // positive, neutral, negative, urgent
-	Confidence    float64                `json:"confidence"`
-	ShouldEscalate bool                  `json:"should_escalate"`
-	SuggestedActions []string            `json:"suggested_actions,omitempty"`
-	KBArticles    []KBArticle            `json:"kb_articles,omitempty"`
-	Metadata      map[string]interface{} `json:"metadata,omitempty"`
-	TokensUsed    TokenUsage             `json:"tokens_used"`
-	ProcessingTime float64               `json:"processing_time_ms"`
+	SessionID        string                 `json:"session_id"`
+	Message          string                 `json:"message"`
+	Sentiment        string                 `json:"sentiment"` // positive, neutral, negative, urgent
+	Confidence       float64                `json:"confidence"`
+	ShouldEscalate   bool                   `json:"should_escalate"`
+	SuggestedActions []string               `json:"suggested_actions,omitempty"`
+	KBArticles       []KBArticle            `json:"kb_articles,omitempty"`
+	Metadata         map[string]interface{} `json:"metadata,omitempty"`
+	ToolCalls        []ToolCallRecord       `json:"tool_calls,omitempty"`
+	Language         string                 `json:"language,omitempty"` // ISO 639-1 code, when detected
+	Intent           string                 `json:"intent,omitempty"`
+	PromptVersion    int                    `json:"prompt_version,omitempty"` // system prompt version the answer was written with
+	TokensUsed       TokenUsage             `json:"tokens_used"`
+	ProcessingTime   float64                `json:"processing_time_ms"`
 }
 
 // TokenUsage tracks LLM token consumption
@@ -140,23 +231,349 @@ type KBArticle struct {
 	Content string  `json:"content"`
 	URL     string  `json:"url"`
 	Score   float64 `json:"relevance_score"`
+
+	// How the article was retrieved
+	Strategy    string   `json:"retrieval_strategy,omitempty"` // bm25, vector, or hybrid, with "+rerank" when reranked
+	MatchedBy   []string `json:"matched_by,omitempty"`         // searches that found it: bm25, vector
+	BM25Score   float64  `json:"bm25_score,omitempty"`
+	VectorScore float64  `json:"vector_score,omitempty"` // cosine similarity of the best chunk
+	FusionScore float64  `json:"fusion_score,omitempty"` // reciprocal rank fusion, 0 to 1
+	RerankScore *float64 `json:"rerank_score,omitempty"` // 0 to 1
+}
+
+// chatTurn holds what is gathered for a message before Claude is called
+type chatTurn struct {
+	startTime     time.Time
+	sentiment     string
+	kbArticles    []KBArticle
+	language      string
+	intent        *Intent // nil when the message matches no intent
+	system        string  // the rendered system prompt
+	promptVersion int     // the system prompt version; 0 when the store could not be read
+	messages      []ClaudeMessage
+	toolCalls     []ToolCallRecord
+	escalation    *escalationRequest   // set when Claude calls escalate_to_human
+	answer        *ChatMessageResponse // set when the message is answered without Claude
+	pii           *piiVault            // nil when nothing is redacted
+	cacheVector   []float32            // the question's embedding when the answer can be cached
+	model         string               // the model Claude answers with
+	overBudget    string               // the token budget the message is over, when answered with a cheaper model
+	availability  *agentAvailability   // whether human agents are working; nil without business hours
+	callback      *Callback            // set when Claude calls request_callback
+	notices       []string             // added to Claude's answer, such as the escalation's ticket
 }
 
 // ProcessMessage processes an incoming message through the AI agent
 func (s *AgentService) ProcessMessage(ctx context.Context, req *ChatMessageRequest) (*ChatMessageResponse, error) {
+	turn, err := s.prepareTurn(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if turn.answer != nil {
+		return turn.answer, nil
+	}
+
+	// Call Claude API, running any tools it asks for
+	claudeResponse, err := s.converse(ctx, req, turn, nil)
+	if errors.Is(err, ErrClaudeUnavailable) {
+		return s.fallbackAnswer(ctx, req, turn)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claude api error: %w", err)
+	}
+
+	return s.completeTurn(ctx, req, turn, claudeResponse)
+}
+
+// ProcessMessageStream processes a message like ProcessMessage, passing the answer's text to
+// onToken as Claude generates it. The complete response is returned once the answer is done.
+// When streaming is disabled in the config, the answer is passed to onToken in one piece.
+func (s *AgentService) ProcessMessageStream(ctx context.Context, req *ChatMessageRequest, onToken func(text string) error) (*ChatMessageResponse, error) {
+	turn, err := s.prepareTurn(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if turn.answer != nil {
+		if err := onToken(turn.answer.Message); err != nil {
+			return nil, err
+		}
+		return turn.answer, nil
+	}
+
+	// Answers are checked by the guardrails before any of them is sent
+	if !s.config.Streaming || s.guardrails.checksAnswers(ctx) {
+		claudeResponse, err := s.converse(ctx, req, turn, nil)
+		if errors.Is(err, ErrClaudeUnavailable) {
+			return s.streamFallbackAnswer(ctx, req, turn, onToken)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("claude api error: %w", err)
+		}
+		response, err := s.completeTurn(ctx, req, turn, claudeResponse)
+		if err != nil {
+			return nil, err
+		}
+		if err := onToken(response.Message); err != nil {
+			return nil, err
+		}
+		return response, nil
+	}
+
+	claudeResponse, err := s.converse(ctx, req, turn, onToken)
+	if errors.Is(err, ErrClaudeUnavailable) {
+		return s.streamFallbackAnswer(ctx, req, turn, onToken)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claude api error: %w", err)
+	}
+
+	response, err := s.completeTurn(ctx, req, turn, claudeResponse)
+	if err != nil {
+		return nil, err
+	}
+	// The ticket is opened and the session queued after Claude's answer is streamed
+	for _, notice := range turn.notices {
+		if err := onToken("\n\n" + notice); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// converse calls Claude until it answers without asking for a tool. Requested tools are run and
+// their results sent back, up to MaxToolRounds times. The text Claude writes across calls is
+// joined into the returned response, and usage is summed. With onToken set, responses are
+// streamed.
+func (s *AgentService) converse(ctx context.Context, req *ChatMessageRequest, turn *chatTurn, onToken func(text string) error) (*ClaudeResponse, error) {
+	var answer []string
+	var usage TokenUsage
+	var flush func() error
+	if onToken != nil {
+		// Claude writes placeholders; the customer sees their data
+		onToken, flush = turn.pii.RestoreStream(onToken)
+	}
+
+	for round := 0; ; round++ {
+		var claudeResponse *ClaudeResponse
+		var err error
+		if onToken == nil {
+			claudeResponse, err = s.callClaude(ctx, turn)
+		} else {
+			// Separate text written before a tool call from the text after it
+			separate := len(answer) > 0
+			claudeResponse, err = s.streamClaude(ctx, turn, func(text string) error {
+				if separate {
+					separate = false
+					if err := onToken("\n\n"); err != nil {
+						return err
+					}
+				}
+				return onToken(text)
+			})
+			if err == nil {
+				err = flush()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		usage.InputTokens += claudeResponse.Usage.InputTokens
+		usage.OutputTokens += claudeResponse.Usage.OutputTokens
+		if text := claudeResponse.Text(); text != "" {
+			answer = append(answer, text)
+		}
+
+		if claudeResponse.StopReason != "tool_use" || round >= s.config.MaxToolRounds {
+			if claudeResponse.StopReason == "tool_use" {
+				fmt.Printf("Session %s reached the limit of %d tool rounds\n", req.SessionID, s.config.MaxToolRounds)
+			}
+			claudeResponse.Content = nil
+			if len(answer) > 0 {
+				claudeResponse.Content = []ClaudeContent{{Type: "text", Text: strings.Join(answer, "\n\n")}}
+			}
+			claudeResponse.Usage.InputTokens = usage.InputTokens
+			claudeResponse.Usage.OutputTokens = usage.OutputTokens
+			return claudeResponse, nil
+		}
+
+		// Send Claude's tool requests back with their results
+		var requested, results []ClaudeContent
+		for _, block := range claudeResponse.Content {
+			if block.Type == "text" && block.Text == "" {
+				continue
+			}
+			requested = append(requested, block)
+			if block.Type != "tool_use" {
+				continue
+			}
+
+			// Tools work with the real data; Claude only sees placeholders
+			input := turn.pii.RestoreJSON(block.Input)
+			var result ClaudeContent
+			if turn.intent.allowsTool(block.Name) {
+				result = s.tools.Execute(ctx, &ToolCall{
+					ID:      block.ID,
+					Name:    block.Name,
+					Input:   input,
+					Request: req,
+					turn:    turn,
+				})
+			} else {
+				toolCalls.WithLabelValues(block.Name, "not_allowed").Inc()
+				result = ClaudeContent{Type: "tool_result", ToolUseID: block.ID, IsError: true,
+					Content: fmt.Sprintf("%s is not available for %s requests", block.Name, turn.intent.Name)}
+			}
+			result.Content = turn.pii.Redact(result.Content)
+			results = append(results, result)
+			turn.toolCalls = append(turn.toolCalls, ToolCallRecord{Name: block.Name, Input: input, IsError: result.IsError})
+		}
+		turn.messages = append(turn.messages,
+			ClaudeMessage{Role: "assistant", Blocks: requested},
+			ClaudeMessage{Role: "user", Blocks: results},
+		)
+	}
+}
+
+// prepareTurn loads the session, analyzes sentiment, and builds the context for Claude
+func (s *AgentService) prepareTurn(ctx context.Context, req *ChatMessageRequest) (*chatTurn, error) {
 	startTime := time.Now()
 
+	// The customer is answering the survey sent when their last session ended
+	if s.surveys != nil {
+		survey, ok, err := s.surveys.Answer(ctx, req.SessionID, req.Message)
+		if err != nil {
+			fmt.Printf("Survey answer error: %v\n", err)
+		}
+		if ok {
+			return &chatTurn{answer: &ChatMessageResponse{
+				SessionID:  req.SessionID,
+				Message:    "Thank you for your feedback!",
+				Sentiment:  s.analyzeSentiment(req.Message),
+				Confidence: 1,
+				Metadata:   map[string]interface{}{"survey_score": survey.Score},
+			}}, nil
+		}
+	}
+
 	// Get or create session
 	session, err := s.sessionManager.GetOrCreate(ctx, req.SessionID, req.UserID)
 	if err != nil {
 		return nil, fmt.Errorf("session management error: %w", err)
 	}
 
+	// Remember where the customer wrote from, to reach them outside an answer
+	if req.Source != nil || session.Channel != req.Channel {
+		if err := s.sessionManager.SetSource(ctx, session, req.Channel, req.Source); err != nil {
+			return nil, err
+		}
+	}
+
+	// A human agent is answering; keep the message for them
+	handoff, err := s.handoffs.Get(ctx, req.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if handoff != nil {
+		if err := s.sessionManager.AddMessage(ctx, req.SessionID, "user", req.Message); err != nil {
+			return nil, err
+		}
+		s.analytics.RecordMessage(ctx, req.SessionID)
+		s.refreshSummary(ctx, req.SessionID, false)
+		return nil, ErrHandedOff
+	}
+
+	// Over a token budget, answer with a cheaper model or politely refuse
+	overBudget, err := s.checkTokenBudget(ctx, req.SessionID, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+	model := s.config.Model
+	if overBudget != "" {
+		if model = overBudgetModel(ctx, overBudget); model == "" {
+			answer, err := s.limitAnswer(ctx, req, overBudget)
+			if err != nil {
+				return nil, err
+			}
+			return &chatTurn{answer: answer}, nil
+		}
+	}
+
+	// Detect the customer's language; messages too short to tell keep the conversation's
+	language, _ := session.Metadata["language"].(string)
+	updates := map[string]interface{}{}
+	if detected := detectLanguage(req.Message); detected != "" && detected != language {
+		language = detected
+		updates["language"] = language
+	}
+	// Route the message to its intent
+	intent := s.classifyIntent(ctx, session, req.Message)
+	if intent != nil && session.Metadata["intent"] != intent.Name {
+		updates["intent"] = intent.Name
+	}
+	// Callers of the default tenant may still name their own for personal data policies
+	tenantID := tenantFrom(ctx).ID
+	if tenantID == DefaultTenantID {
+		tenantID, _ = req.Metadata["tenant_id"].(string)
+	}
+	if tenantID != "" && session.Metadata["tenant_id"] != tenantID {
+		updates["tenant_id"] = tenantID
+	}
+	// Tags the caller gives the conversation, for filtering and exporting it once archived
+	if tags, added := addTags(session, req.Metadata); added {
+		updates[tagsMetadataKey] = tags
+	}
+	if len(updates) > 0 {
+		if err := s.sessionManager.SetMetadata(ctx, req.SessionID, req.UserID, updates); err != nil {
+			return nil, err
+		}
+	}
+	if language != "" {
+		messagesByLanguage.WithLabelValues(language).Inc()
+	} else {
+		messagesByLanguage.WithLabelValues("unknown").Inc()
+	}
+
+	// Keep the customer's personal data from Claude
+	pii, err := s.pii.Vault(ctx, req.SessionID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Abusive, harmful, and illegal requests are answered without Claude
+	if violation := s.guardrails.CheckMessage(ctx, pii.Redact(req.Message)); violation != nil {
+		answer, err := s.guardrailAnswer(ctx, req, violation)
+		if err != nil {
+			return nil, err
+		}
+		return &chatTurn{answer: answer}, nil
+	}
+
 	// Analyze sentiment
 	sentiment := s.analyzeSentiment(req.Message)
+	system, promptVersion := s.systemPrompt(ctx, PromptValues{Channel: req.Channel, Language: language, Intent: intent.name()})
+
+	// Answer a first message without personal data from the answer to a near-identical question
+	var cacheVector []float32
+	if s.responses != nil && len(session.Messages) == 0 && pii.Redact(req.Message) == req.Message {
+		scope := ResponseScope{Channel: req.Channel, Language: language, Intent: intent.name(), PromptVersion: promptVersion}
+		cached, vector, err := s.responses.Lookup(ctx, req.Message, scope)
+		if err != nil {
+			fmt.Printf("Response cache lookup error: %v\n", err)
+		}
+		if cached != nil {
+			turn := &chatTurn{startTime: startTime, sentiment: sentiment, language: language, intent: intent}
+			turn.answer, err = s.answerFromCache(ctx, req, turn, cached)
+			if err != nil {
+				return nil, err
+			}
+			return turn, nil
+		}
+		cacheVector = vector
+	}
 
 	// Search knowledge base for relevant articles
-	kbArticles, err := s.searchKnowledgeBase(ctx, req.Message)
+	kbArticles, err := s.searchKnowledgeBaseIn(ctx, pii.Redact(req.Message), language, intent.categories())
 	if err != nil {
 		// Log error but don't fail the request
 		fmt.Printf("Knowledge base search error: %v\n", err)
@@ -164,39 +581,177 @@ func (s *AgentService) ProcessMessage(ctx context.Context, req *ChatMessageReque
 	}
 
 	// Build context for Claude
-	context := s.buildContext(session, req, kbArticles)
+	messages := s.buildContext(session, req, kbArticles, language, pii)
+	if err := pii.Save(ctx); err != nil {
+		return nil, err
+	}
+	turn := &chatTurn{
+		startTime:     startTime,
+		sentiment:     sentiment,
+		kbArticles:    kbArticles,
+		language:      language,
+		intent:        intent,
+		system:        system,
+		promptVersion: promptVersion,
+		messages:      messages,
+		pii:           pii,
+		cacheVector:   cacheVector,
+		model:         model,
+		overBudget:    overBudget,
+		availability:  s.availability(ctx, startTime),
+	}
 
-	// Call Claude API
-	claudeResponse, err := s.callClaude(ctx, context)
-	if err != nil {
-		return nil, fmt.Errorf("claude api error: %w", err)
+	// Simple messages within budget go to the cheaper model
+	if overBudget == "" {
+		turn.model = s.routeModel(ctx, session, req.Message, turn)
 	}
+	return turn, nil
+}
 
+// completeTurn records Claude's answer in the session and builds the response
+func (s *AgentService) completeTurn(ctx context.Context, req *ChatMessageRequest, turn *chatTurn, claudeResponse *ClaudeResponse) (*ChatMessageResponse, error) {
 	// Parse response and extract actions
 	message, actions, shouldEscalate := s.parseResponse(claudeResponse)
+	// Answers promising what Claude cannot are replaced, and a human agent follows up
+	violation := s.guardrails.CheckAnswer(ctx, message, turn.toolCalls)
+	if violation != nil {
+		message, actions = s.guardrails.policyFor(ctx).reply(violation), nil
+		if turn.escalation == nil {
+			turn.escalation = &escalationRequest{Reason: "Guardrails blocked an answer (" + violation.Category + ")", Priority: "normal"}
+		}
+	}
+	message = turn.pii.Restore(message)
+	for i, action := range actions {
+		actions[i] = turn.pii.Restore(action)
+	}
+	if err := turn.pii.Save(ctx); err != nil {
+		return nil, err
+	}
+	var metadata map[string]interface{}
+	if turn.escalation != nil {
+		shouldEscalate = true
+		metadata = map[string]interface{}{
+			"escalation_reason":   turn.escalation.Reason,
+			"escalation_priority": turn.escalation.Priority,
+		}
+	}
+	if violation != nil {
+		metadata["guardrail"] = violation.Category
+		metadata["guardrail_direction"] = violation.Direction
+	}
+	if turn.overBudget != "" {
+		if metadata == nil {
+			metadata = map[string]interface{}{}
+		}
+		metadata["budget_exceeded"] = turn.overBudget
+		metadata["model"] = turn.model
+	}
 
 	// Update session history
 	if err := s.sessionManager.AddMessage(ctx, req.SessionID, "user", req.Message); err != nil {
 		return nil, err
 	}
-	if err := s.sessionManager.AddMessage(ctx, req.SessionID, "assistant", message); err != nil {
+
+	// Queue the session for human agents, with a ticket on channels that get one
+	if shouldEscalate {
+		handoff := &Handoff{
+			SessionID:  req.SessionID,
+			UserID:     req.UserID,
+			Channel:    req.Channel,
+			Sentiment:  turn.sentiment,
+			OutOfHours: turn.availability != nil && !turn.availability.open,
+			Callback:   turn.callback,
+		}
+		if turn.escalation != nil {
+			handoff.Reason = turn.escalation.Reason
+			handoff.Priority = turn.escalation.Priority
+		}
+		session, err := s.sessionManager.Get(ctx, req.SessionID)
+		if err == nil && session != nil {
+			handoff.Summary = handoffSummary(session, handoff.Reason, turn.sentiment, turn.toolCalls)
+		}
+		if metadata == nil {
+			metadata = map[string]interface{}{}
+		}
+		if handoff.TicketID = s.openTicket(ctx, req, turn, session, handoff); handoff.TicketID != "" {
+			turn.notices = append(turn.notices, s.tickets.notice(handoff.TicketID))
+			metadata["ticket_id"] = handoff.TicketID
+		}
+		if err := s.handoffs.Request(ctx, handoff); err != nil {
+			return nil, err
+		}
+		// Tell the customer when to expect a human agent
+		if notice := s.queueNotice(ctx, turn, handoff, metadata); notice != "" {
+			turn.notices = append(turn.notices, notice)
+		}
+		for _, notice := range turn.notices {
+			message += "\n\n" + notice
+		}
+	}
+
+	if err := s.sessionManager.AddAnswer(ctx, req.SessionID, message, turn.promptVersion, turn.model); err != nil {
 		return nil, err
 	}
+	// Conversations that needed tools stay with the configured model
+	if turn.usedTools() {
+		if err := s.sessionManager.SetMetadata(ctx, req.SessionID, req.UserID, map[string]interface{}{usedToolsMetadataKey: true}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep the session summary current; escalated sessions need it now
+	s.refreshSummary(ctx, req.SessionID, shouldEscalate)
+
+	// Keep the answer for the next customer who asks the same
+	if cacheableTurn(turn, shouldEscalate) {
+		cached := &CachedResponse{
+			ResponseScope: ResponseScope{Channel: req.Channel, Language: turn.language, Intent: turn.intent.name(), PromptVersion: turn.promptVersion},
+			Question:      req.Message,
+			Answer:        message,
+			Actions:       actions,
+			KBArticles:    turn.kbArticles,
+			Confidence:    claudeResponse.Confidence,
+		}
+		background := detachContext(ctx)
+		go func() {
+			if err := s.responses.Store(background, turn.cacheVector, cached); err != nil {
+				fmt.Printf("Response cache store error: %v\n", err)
+			}
+		}()
+	}
 
 	// Record metrics
 	llmTokensUsed.WithLabelValues("input").Add(float64(claudeResponse.Usage.InputTokens))
 	llmTokensUsed.WithLabelValues("output").Add(float64(claudeResponse.Usage.OutputTokens))
+	promptResponses.WithLabelValues(strconv.Itoa(turn.promptVersion)).Inc()
+	s.recordTokenUsage(ctx, req.UserID, turn.model, claudeResponse.Usage.InputTokens, claudeResponse.Usage.OutputTokens, turn.overBudget != "")
+	s.analytics.RecordTurn(ctx, &ConversationTurn{
+		SessionID:    req.SessionID,
+		UserID:       req.UserID,
+		Channel:      req.Channel,
+		Intent:       turn.intent.name(),
+		Language:     turn.language,
+		InputTokens:  claudeResponse.Usage.InputTokens,
+		OutputTokens: claudeResponse.Usage.OutputTokens,
+		CostUSD:      s.cost(turn.model, claudeResponse.Usage.InputTokens, claudeResponse.Usage.OutputTokens),
+		Escalated:    shouldEscalate,
+	})
 
-	processingTime := time.Since(startTime).Milliseconds()
+	processingTime := time.Since(turn.startTime).Milliseconds()
 
 	return &ChatMessageResponse{
-		SessionID:      req.SessionID,
-		Message:        message,
-		Sentiment:      sentiment,
-		Confidence:     claudeResponse.Confidence,
-		ShouldEscalate: shouldEscalate,
+		SessionID:        req.SessionID,
+		Message:          message,
+		Sentiment:        turn.sentiment,
+		Confidence:       claudeResponse.Confidence,
+		ShouldEscalate:   shouldEscalate,
 		SuggestedActions: actions,
-		KBArticles:     kbArticles,
+		KBArticles:       turn.kbArticles,
+		Metadata:         metadata,
+		ToolCalls:        turn.toolCalls,
+		Language:         turn.language,
+		Intent:           turn.intent.name(),
+		PromptVersion:    turn.promptVersion,
 		TokensUsed: TokenUsage{
 			InputTokens:  claudeResponse.Usage.InputTokens,
 			OutputTokens: claudeResponse.Usage.OutputTokens,
@@ -241,25 +796,41 @@ func (s *AgentService) analyzeSentiment(message string) string {
 	return "neutral"
 }
 
-// searchKnowledgeBase searches for relevant KB articles
-func (s *AgentService) searchKnowledgeBase(ctx context.Context, query string) ([]KBArticle, error) {
+// searchKnowledgeBase searches for relevant KB articles, in the given categories when they have
+// any, and in the whole knowledge base otherwise
+func (s *AgentService) searchKnowledgeBase(ctx context.Context, query string, categories []string) ([]KBArticle, error) {
+	if len(categories) > 0 {
+		articles, err := s.knowledgeBase.Search(ctx, query, 5, categories...)
+		if err != nil || len(articles) > 0 {
+			return articles, err
+		}
+	}
 	return s.knowledgeBase.Search(ctx, query, 5)
 }
 
-// buildContext builds the conversation context for Claude
-func (s *AgentService) buildContext(session *Session, req *ChatMessageRequest, kbArticles []KBArticle) []ClaudeMessage {
+// buildContext builds the conversation context for Claude, with personal data redacted by pii.
+// Claude is asked to answer in the customer's language when it is not English.
+func (s *AgentService) buildContext(session *Session, req *ChatMessageRequest, kbArticles []KBArticle, language string, pii *piiVault) []ClaudeMessage {
 	messages := []ClaudeMessage{}
 
 	// Add conversation history
 	for _, msg := range session.Messages {
+		if msg.Role == "agent" {
+			// Claude continues where the human agent left off
+			messages = append(messages, ClaudeMessage{
+				Role:    "assistant",
+				Content: "[Human agent] " + pii.Redact(msg.Content),
+			})
+			continue
+		}
 		messages = append(messages, ClaudeMessage{
 			Role:    msg.Role,
-			Content: msg.Content,
+			Content: pii.Redact(msg.Content),
 		})
 	}
 
 	// Build enhanced user message with context
-	userContent := req.Message
+	userContent := pii.Redact(req.Message)
 
 	// Add knowledge base context if available
 	if len(kbArticles) > 0 {
@@ -270,6 +841,11 @@ func (s *AgentService) buildContext(session *Session, req *ChatMessageRequest, k
 		userContent += kbContext
 	}
 
+	// Ask for an answer in the customer's language
+	if language != "" && language != "en" {
+		userContent += languageInstruction(language)
+	}
+
 	// Add current message
 	messages = append(messages, ClaudeMessage{
 		Role:    "user",
@@ -281,8 +857,23 @@ func (s *AgentService) buildContext(session *Session, req *ChatMessageRequest, k
 
 // ClaudeMessage represents a message in Claude's format
 type ClaudeMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role    string          `json:"role"`
+	Content string          `json:"content"`
+	Blocks  []ClaudeContent `json:"-"` // sent instead of Content for tool use and tool results
+}
+
+// MarshalJSON sends Blocks as the message content when the message has them
+func (m ClaudeMessage) MarshalJSON() ([]byte, error) {
+	if len(m.Blocks) == 0 {
+		return json.Marshal(struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		}{m.Role, m.Content})
+	}
+	return json.Marshal(struct {
+		Role    string          `json:"role"`
+		Content []ClaudeContent `json:"content"`
+	}{m.Role, m.Blocks})
 }
 
 // ClaudeRequest represents a request to Claude API
@@ -292,36 +883,72 @@ type ClaudeRequest struct {
 	Temperature float64         `json:"temperature"`
 	System      string          `json:"system"`
 	Messages    []ClaudeMessage `json:"messages"`
+	Tools       []ClaudeTool    `json:"tools,omitempty"`
 	Stream      bool            `json:"stream"`
 }
 
 // ClaudeResponse represents Claude's response
 type ClaudeResponse struct {
-	ID      string `json:"id"`
-	Type    string `json:"type"`
-	Role    string `json:"role"`
-	Content []struct {
-		Type string `json:"type"`
-		Text string `json:"text"`
-	} `json:"content"`
-	Model      string  `json:"model"`
-	StopReason string  `json:"stop_reason"`
-	Confidence float64 `json:"-"` // Calculated
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Role       string          `json:"role"`
+	Content    []ClaudeContent `json:"content"`
+	Model      string          `json:"model"`
+	StopReason string          `json:"stop_reason"`
+	Confidence float64         `json:"-"` // Calculated
 	Usage      struct {
 		InputTokens  int `json:"input_tokens"`
 		OutputTokens int `json:"output_tokens"`
 	} `json:"usage"`
 }
 
-// callClaude makes an API call to Claude
-func (s *AgentService) callClaude(ctx context.Context, messages []ClaudeMessage) (*ClaudeResponse, error) {
+// ClaudeContent is a block of message content: text, a tool_use request, or a tool_result
+type ClaudeContent struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`          // tool_use
+	Name      string          `json:"name,omitempty"`        // tool_use
+	Input     json.RawMessage `json:"input,omitempty"`       // tool_use
+	ToolUseID string          `json:"tool_use_id,omitempty"` // tool_result
+	Content   string          `json:"content,omitempty"`     // tool_result
+	IsError   bool            `json:"is_error,omitempty"`    // tool_result
+}
+
+// Text returns the text blocks of the response joined together
+func (r *ClaudeResponse) Text() string {
+	var text strings.Builder
+	for _, block := range r.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	return text.String()
+}
+
+// newClaudeRequest builds a Messages API request for the conversation, with the prompt and
+// tools of the turn's intent
+func (s *AgentService) newClaudeRequest(ctx context.Context, turn *chatTurn, stream bool) (*http.Request, error) {
+	system := turn.system
+	if turn.intent != nil && turn.intent.Prompt != "" {
+		system += "\n\n**Current Request** (" + turn.intent.Name + "):\n" + turn.intent.Prompt
+	}
+	if availability := turn.availability.prompt(); availability != "" {
+		system += "\n\n" + availability
+	}
+
+	model := s.config.Model
+	if turn.model != "" {
+		model = turn.model
+	}
+
 	reqBody := ClaudeRequest{
-		Model:       s.config.Model,
+		Model:       model,
 		MaxTokens:   s.config.MaxTokens,
 		Temperature: s.config.Temperature,
-		System:      s.systemPrompt,
-		Messages:    messages,
-		Stream:      false, // For simplicity, not using streaming in this example
+		System:      system,
+		Messages:    turn.messages,
+		Tools:       s.tools.Definitions(turn.allowsTool),
+		Stream:      stream,
 	}
 
 	jsonData, err := json.Marshal(reqBody)
@@ -338,20 +965,20 @@ func (s *AgentService) callClaude(ctx context.Context, messages []ClaudeMessage)
 	req.Header.Set("X-API-Key", s.config.ClaudeAPIKey)
 	req.Header.Set("anthropic-version", "2023-06-01")
 
-	resp, err := s.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to call claude api: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("claude api error (status %d): %s", resp.StatusCode, string(body))
-	}
+	return req, nil
+}
 
+// callClaude makes an API call to Claude
+func (s *AgentService) callClaude(ctx context.Context, turn *chatTurn) (*ClaudeResponse, error) {
 	var claudeResp ClaudeResponse
-	if err := json.NewDecoder(resp.Body).Decode(&claudeResp); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	err := s.sendClaude(ctx, turn, false, func(body io.Reader) error {
+		if err := json.NewDecoder(body).Decode(&claudeResp); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// Calculate confidence based on stop reason and response quality
@@ -392,7 +1019,7 @@ func (s *AgentService) parseResponse(resp *ClaudeResponse) (string, []string, bo
 		return "I apologize, but I'm having trouble processing your request. Let me escalate this to a human agent.", []string{}, true
 	}
 
-	message := resp.Content[0].Text
+	message := resp.Text()
 	actions := []string{}
 	shouldEscalate := false
 
@@ -438,10 +1065,14 @@ type SlackWebhook struct {
 	Type      string `json:"type"`
 	Challenge string `json:"challenge,omitempty"` // For verification
 	Event     struct {
-		Type    string `json:"type"`
-		Channel string `json:"channel"`
-		User    string `json:"user"`
-		Text    string `json:"text"`
-		TS      string `json:"ts"`
+		Type        string `json:"type"`              // message or app_mention
+		Subtype     string `json:"subtype,omitempty"` // set for edits, deletions, joins, and bot messages
+		Channel     string `json:"channel"`
+		ChannelType string `json:"channel_type,omitempty"` // im for direct messages
+		User        string `json:"user"`
+		BotID       string `json:"bot_id,omitempty"`
+		Text        string `json:"text"`
+		TS          string `json:"ts"`
+		ThreadTS    string `json:"thread_ts,omitempty"`
 	} `json:"event"`
 }
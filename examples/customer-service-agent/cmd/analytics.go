@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// Conversation record storage
+const (
+	analyticsIndexKey  = "analytics:conversations" // sorted set of session IDs by start time
+	analyticsRetention = 90 * 24 * time.Hour
+	analyticsBatchSize = 500 // records read per round trip when building a report
+)
+
+// ConversationAnalytics keeps a record of each conversation in Redis, for reports on how
+// conversations went. Records are kept for 90 days.
+type ConversationAnalytics struct {
+	client *redis.Client
+}
+
+// NewConversationAnalytics creates the conversation records
+func NewConversationAnalytics(client *redis.Client) *ConversationAnalytics {
+	return &ConversationAnalytics{
+		client: client,
+	}
+}
+
+// ConversationTurn is what is recorded for each message the AI answers
+type ConversationTurn struct {
+	SessionID    string
+	UserID       string
+	Channel      string
+	Intent       string
+	Language     string
+	InputTokens  int
+	OutputTokens int
+	CostUSD      float64 // what the tokens cost, at the price of the model that answered
+	Escalated    bool
+}
+
+// RecordTurn adds an answered message to its conversation's record, starting the record with
+// the conversation's first message
+func (a *ConversationAnalytics) RecordTurn(ctx context.Context, turn *ConversationTurn) {
+	now := time.Now()
+	key := a.key(ctx, turn.SessionID)
+
+	pipe := a.client.TxPipeline()
+	pipe.HSetNX(ctx, key, "started_at", now.Unix())
+	pipe.HSetNX(ctx, key, "user_id", turn.UserID)
+	pipe.HSet(ctx, key, "channel", turn.Channel, "last_activity", now.Unix())
+	if turn.Intent != "" {
+		pipe.HSet(ctx, key, "intent", turn.Intent)
+	}
+	if turn.Language != "" {
+		pipe.HSet(ctx, key, "language", turn.Language)
+	}
+	if turn.Escalated {
+		pipe.HSet(ctx, key, "escalated", 1)
+	}
+	pipe.HIncrBy(ctx, key, "messages", 1)
+	pipe.HIncrBy(ctx, key, "input_tokens", int64(turn.InputTokens))
+	pipe.HIncrBy(ctx, key, "output_tokens", int64(turn.OutputTokens))
+	pipe.HIncrByFloat(ctx, key, "cost_usd", turn.CostUSD)
+	pipe.Expire(ctx, key, analyticsRetention)
+	pipe.ZAddNX(ctx, tenantKey(ctx, analyticsIndexKey), &redis.Z{Score: float64(now.Unix()), Member: turn.SessionID})
+	pipe.ZRemRangeByScore(ctx, tenantKey(ctx, analyticsIndexKey), "-inf", strconv.FormatInt(now.Add(-analyticsRetention).Unix(), 10))
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record conversation %s: %v", turn.SessionID, err)
+	}
+}
+
+// RecordMessage notes a customer message answered by a human agent rather than the AI
+func (a *ConversationAnalytics) RecordMessage(ctx context.Context, sessionID string) {
+	a.update(ctx, sessionID, func(pipe redis.Pipeliner, key string) {
+		pipe.HIncrBy(ctx, key, "messages", 1)
+		pipe.HSet(ctx, key, "last_activity", time.Now().Unix())
+	})
+}
+
+// RecordHumanHandled notes that a human agent took a conversation over
+func (a *ConversationAnalytics) RecordHumanHandled(ctx context.Context, sessionID string) {
+	a.update(ctx, sessionID, func(pipe redis.Pipeliner, key string) {
+		pipe.HSet(ctx, key, "human_handled", 1)
+	})
+}
+
+// RecordResolution records the resolution state of a conversation's latest summary
+func (a *ConversationAnalytics) RecordResolution(ctx context.Context, sessionID, resolution string) {
+	a.update(ctx, sessionID, func(pipe redis.Pipeliner, key string) {
+		pipe.HSet(ctx, key, "resolution", resolution)
+	})
+}
+
+// RecordEnd records that a conversation ended: the session was closed, or a human agent
+// resolved its handoff
+func (a *ConversationAnalytics) RecordEnd(ctx context.Context, sessionID string) {
+	a.update(ctx, sessionID, func(pipe redis.Pipeliner, key string) {
+		pipe.HSet(ctx, key, "ended_at", time.Now().Unix())
+	})
+}
+
+// update changes the record of a conversation, if it has one
+func (a *ConversationAnalytics) update(ctx context.Context, sessionID string, change func(pipe redis.Pipeliner, key string)) {
+	key := a.key(ctx, sessionID)
+	exists, err := a.client.Exists(ctx, key).Result()
+	if err != nil || exists == 0 {
+		return
+	}
+	pipe := a.client.TxPipeline()
+	change(pipe, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record conversation %s: %v", sessionID, err)
+	}
+}
+
+// Usage returns the tokens a conversation used and their USD cost
+func (a *ConversationAnalytics) Usage(ctx context.Context, sessionID string) (TokenUsage, float64, error) {
+	record, err := a.client.HMGet(ctx, a.key(ctx, sessionID), "input_tokens", "output_tokens", "cost_usd").Result()
+	if err != nil {
+		return TokenUsage{}, 0, fmt.Errorf("failed to read conversation %s: %w", sessionID, err)
+	}
+	field := func(i int) string {
+		text, _ := record[i].(string)
+		return text
+	}
+	var usage TokenUsage
+	usage.InputTokens, _ = strconv.Atoi(field(0))
+	usage.OutputTokens, _ = strconv.Atoi(field(1))
+	usage.TotalTokens = usage.InputTokens + usage.OutputTokens
+	cost, _ := strconv.ParseFloat(field(2), 64)
+	return usage, cost, nil
+}
+
+// Record returns the record of a conversation; it is empty when the conversation has none
+func (a *ConversationAnalytics) Record(ctx context.Context, sessionID string) (map[string]string, error) {
+	record, err := a.client.HGetAll(ctx, a.key(ctx, sessionID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read conversation %s: %w", sessionID, err)
+	}
+	return record, nil
+}
+
+// UserRecords returns the records of a customer's conversations by session ID, reading the
+// user of every recorded conversation in batches
+func (a *ConversationAnalytics) UserRecords(ctx context.Context, userID string) (map[string]map[string]string, error) {
+	records := map[string]map[string]string{}
+	for start := int64(0); ; start += analyticsBatchSize {
+		sessionIDs, err := a.client.ZRange(ctx, tenantKey(ctx, analyticsIndexKey), start, start+analyticsBatchSize-1).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list conversations: %w", err)
+		}
+		if len(sessionIDs) == 0 {
+			return records, nil
+		}
+
+		pipe := a.client.Pipeline()
+		users := make([]*redis.StringCmd, len(sessionIDs))
+		for i, sessionID := range sessionIDs {
+			users[i] = pipe.HGet(ctx, a.key(ctx, sessionID), "user_id")
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("failed to read conversations: %w", err)
+		}
+		for i, sessionID := range sessionIDs {
+			if users[i].Val() != userID {
+				continue
+			}
+			record, err := a.Record(ctx, sessionID)
+			if err != nil {
+				return nil, err
+			}
+			records[sessionID] = record
+		}
+	}
+}
+
+// Forget deletes the record of a conversation
+func (a *ConversationAnalytics) Forget(ctx context.Context, sessionID string) error {
+	pipe := a.client.TxPipeline()
+	pipe.Del(ctx, a.key(ctx, sessionID))
+	pipe.ZRem(ctx, tenantKey(ctx, analyticsIndexKey), sessionID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to delete conversation %s: %w", sessionID, err)
+	}
+	return nil
+}
+
+func (a *ConversationAnalytics) key(ctx context.Context, sessionID string) string {
+	return tenantKey(ctx, "analytics:conversation:"+sessionID)
+}
+
+// AnalyticsReport summarizes the conversations started in a time range. Rates are fractions of
+// the conversations.
+type AnalyticsReport struct {
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	Source        string    `json:"source"` // records, kept in Redis for 90 days, or archive
+	Conversations int       `json:"conversations"`
+
+	ResolutionRate float64 `json:"resolution_rate"` // resolved, by the AI or a human agent
+	DeflectionRate float64 `json:"deflection_rate"` // resolved without a human agent
+	EscalationRate float64 `json:"escalation_rate"` // handed to a human agent
+
+	AverageHandleTime float64 `json:"average_handle_time_seconds"` // first message to end, of ended conversations
+	AverageMessages   float64 `json:"average_messages"`
+
+	InputTokens            int64   `json:"input_tokens"`
+	OutputTokens           int64   `json:"output_tokens"`
+	CostUSD                float64 `json:"cost_usd"`
+	CostPerConversationUSD float64 `json:"cost_per_conversation_usd"`
+	TokensPerConversation  float64 `json:"tokens_per_conversation"`
+
+	Topics   map[string]*TopicStats `json:"topics"` // by intent; "none" when no intent matched
+	Channels map[string]int         `json:"channels"`
+}
+
+// TopicStats describes the conversations of one topic
+type TopicStats struct {
+	Conversations  int     `json:"conversations"`
+	Share          float64 `json:"share"`
+	ResolutionRate float64 `json:"resolution_rate"`
+	EscalationRate float64 `json:"escalation_rate"`
+}
+
+// Report summarizes the conversations started between from and to
+func (a *ConversationAnalytics) Report(ctx context.Context, from, to time.Time) (*AnalyticsReport, error) {
+	report := &AnalyticsReport{
+		From:     from,
+		To:       to,
+		Source:   "records",
+		Topics:   map[string]*TopicStats{},
+		Channels: map[string]int{},
+	}
+	sessionIDs, err := a.client.ZRangeByScore(ctx, tenantKey(ctx, analyticsIndexKey), &redis.ZRangeBy{
+		Min: strconv.FormatInt(from.Unix(), 10),
+		Max: strconv.FormatInt(to.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list conversations: %w", err)
+	}
+
+	var resolved, deflected, escalated, ended, messages int
+	var handleTime float64
+	topicResolved := map[string]int{}
+	topicEscalated := map[string]int{}
+	for start := 0; start < len(sessionIDs); start += analyticsBatchSize {
+		end := start + analyticsBatchSize
+		if end > len(sessionIDs) {
+			end = len(sessionIDs)
+		}
+
+		pipe := a.client.Pipeline()
+		cmds := make([]*redis.StringStringMapCmd, 0, end-start)
+		for _, sessionID := range sessionIDs[start:end] {
+			cmds = append(cmds, pipe.HGetAll(ctx, a.key(ctx, sessionID)))
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("failed to read conversations: %w", err)
+		}
+
+		for _, cmd := range cmds {
+			record := cmd.Val()
+			if len(record) == 0 {
+				// Expired
+				continue
+			}
+			report.Conversations++
+
+			isEscalated := record["escalated"] == "1" || record["human_handled"] == "1"
+			isEnded := record["ended_at"] != ""
+			isResolved := isEnded || record["resolution"] == ResolutionResolved
+			if isResolved {
+				resolved++
+				if !isEscalated {
+					deflected++
+				}
+			}
+			if isEscalated {
+				escalated++
+			}
+			if isEnded {
+				startedAt, _ := strconv.ParseInt(record["started_at"], 10, 64)
+				endedAt, _ := strconv.ParseInt(record["ended_at"], 10, 64)
+				if startedAt > 0 && endedAt >= startedAt {
+					ended++
+					handleTime += float64(endedAt - startedAt)
+				}
+			}
+
+			count, _ := strconv.Atoi(record["messages"])
+			messages += count
+			inputTokens, _ := strconv.ParseInt(record["input_tokens"], 10, 64)
+			outputTokens, _ := strconv.ParseInt(record["output_tokens"], 10, 64)
+			cost, _ := strconv.ParseFloat(record["cost_usd"], 64)
+			report.InputTokens += inputTokens
+			report.OutputTokens += outputTokens
+			report.CostUSD += cost
+
+			topic := record["intent"]
+			if topic == "" {
+				topic = "none"
+			}
+			if report.Topics[topic] == nil {
+				report.Topics[topic] = &TopicStats{}
+			}
+			report.Topics[topic].Conversations++
+			if isResolved {
+				topicResolved[topic]++
+			}
+			if isEscalated {
+				topicEscalated[topic]++
+			}
+			report.Channels[record["channel"]]++
+		}
+	}
+
+	if report.Conversations == 0 {
+		return report, nil
+	}
+	total := float64(report.Conversations)
+	report.ResolutionRate = roundTo(float64(resolved)/total, 3)
+	report.DeflectionRate = roundTo(float64(deflected)/total, 3)
+	report.EscalationRate = roundTo(float64(escalated)/total, 3)
+	if ended > 0 {
+		report.AverageHandleTime = roundTo(handleTime/float64(ended), 1)
+	}
+	report.AverageMessages = roundTo(float64(messages)/total, 2)
+	report.CostUSD = roundTo(report.CostUSD, 4)
+	report.CostPerConversationUSD = roundTo(report.CostUSD/total, 4)
+	report.TokensPerConversation = roundTo(float64(report.InputTokens+report.OutputTokens)/total, 1)
+	for topic, stats := range report.Topics {
+		stats.Share = roundTo(float64(stats.Conversations)/total, 3)
+		stats.ResolutionRate = roundTo(float64(topicResolved[topic])/float64(stats.Conversations), 3)
+		stats.EscalationRate = roundTo(float64(topicEscalated[topic])/float64(stats.Conversations), 3)
+	}
+	return report, nil
+}
+
+// roundTo rounds x to the given number of decimal places
+func roundTo(x float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(x*scale) / scale
+}
+
+// analyticsRange reads the report's time range from the query: from and to as RFC 3339 times
+// or dates, or a range such as 24h, 7d, or 30d ending now. The default is the last 7 days.
+func analyticsRange(c *gin.Context) (time.Time, time.Time, error) {
+	to := time.Now()
+	if value := c.Query("to"); value != "" {
+		t, err := parseAnalyticsTime(value)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to: %w", err)
+		}
+		to = t
+	}
+
+	if value := c.Query("from"); value != "" {
+		from, err := parseAnalyticsTime(value)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from: %w", err)
+		}
+		if !from.Before(to) {
+			return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+		}
+		return from, to, nil
+	}
+
+	span := c.DefaultQuery("range", "7d")
+	var length time.Duration
+	if days := strings.TrimSuffix(span, "d"); days != span {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid range %q", span)
+		}
+		length = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err := time.ParseDuration(span)
+		if err != nil || d <= 0 {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid range %q", span)
+		}
+		length = d
+	}
+	return to.Add(-length), to, nil
+}
+
+// parseAnalyticsTime parses an RFC 3339 time or a date
+func parseAnalyticsTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// getAnalytics reports on the conversations started in a time range
+func (app *Application) getAnalytics(c *gin.Context) {
+	from, to, err := analyticsRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Ranges older than the conversation records are reported from the archive
+	source := c.Query("source")
+	if source == "" {
+		source = "records"
+		if app.Archive != nil && from.Before(time.Now().Add(-analyticsRetention)) {
+			source = "archive"
+		}
+	}
+
+	var report *AnalyticsReport
+	switch {
+	case source == "records":
+		report, err = app.AgentService.analytics.Report(c.Request.Context(), from, to)
+	case source == "archive" && app.Archive != nil:
+		report, err = app.Archive.Report(c.Request.Context(), from, to)
+	case source == "archive":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the conversation archive is not configured"})
+		return
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "source must be records or archive"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,747 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Conversation archive settings
+const (
+	archiveSweepInterval = 5 * time.Minute
+	archiveSweptKey      = "archive:swept_until" // last activity up to which idle sessions were archived
+	archiveMaxPage       = 100
+)
+
+// tagsMetadataKey holds the tags of a conversation in its session's metadata
+const tagsMetadataKey = "tags"
+
+// maxConversationTags caps the tags of a conversation
+const maxConversationTags = 20
+
+// archiveSchema keeps each conversation as one row, with its transcript indexed for full-text
+// search. The simple configuration doesn't stem, so conversations in any language are found.
+const archiveSchema = `
+CREATE TABLE IF NOT EXISTS conversations (
+	tenant_id       TEXT NOT NULL,
+	session_id      TEXT NOT NULL,
+	user_id         TEXT NOT NULL DEFAULT '',
+	channel         TEXT NOT NULL DEFAULT '',
+	intent          TEXT NOT NULL DEFAULT '',
+	language        TEXT NOT NULL DEFAULT '',
+	sentiment       TEXT NOT NULL DEFAULT '',
+	resolution      TEXT NOT NULL DEFAULT '',
+	resolved        BOOLEAN NOT NULL DEFAULT FALSE,
+	escalated       BOOLEAN NOT NULL DEFAULT FALSE,
+	human_handled   BOOLEAN NOT NULL DEFAULT FALSE,
+	started_at      TIMESTAMPTZ NOT NULL,
+	last_activity   TIMESTAMPTZ NOT NULL,
+	ended_at        TIMESTAMPTZ,
+	message_count   INTEGER NOT NULL DEFAULT 0,
+	input_tokens    BIGINT NOT NULL DEFAULT 0,
+	output_tokens   BIGINT NOT NULL DEFAULT 0,
+	cost_usd        DOUBLE PRECISION NOT NULL DEFAULT 0,
+	models          TEXT[] NOT NULL DEFAULT '{}',
+	prompt_versions INTEGER[] NOT NULL DEFAULT '{}',
+	summary         TEXT NOT NULL DEFAULT '',
+	tags            TEXT[] NOT NULL DEFAULT '{}',
+	messages        JSONB NOT NULL,
+	transcript      TEXT NOT NULL,
+	search          TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', transcript)) STORED,
+	archived_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (tenant_id, session_id)
+);
+CREATE INDEX IF NOT EXISTS conversations_started ON conversations (tenant_id, started_at DESC);
+CREATE INDEX IF NOT EXISTS conversations_user ON conversations (tenant_id, user_id);
+CREATE INDEX IF NOT EXISTS conversations_search ON conversations USING GIN (search);
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS conversations_tags ON conversations USING GIN (tags);
+CREATE INDEX IF NOT EXISTS conversations_export ON conversations (tenant_id, started_at, session_id);
+`
+
+var conversationsArchived = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_conversations_archived_total",
+		Help: "Conversations written to the Postgres archive, by result",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(conversationsArchived)
+}
+
+// ConversationArchive keeps conversations in Postgres after their Redis session expires, for
+// search, analytics beyond the 90 days of conversation records, and model evaluation. A
+// conversation is archived when it ends, when its handoff is resolved, and once it has been
+// idle for a while; it is archived again if the customer comes back.
+type ConversationArchive struct {
+	db    *sql.DB
+	agent *AgentService
+	idle  time.Duration
+}
+
+// NewConversationArchive creates the archive, creating its table if needed. Sessions are
+// archived once idle for idle.
+func NewConversationArchive(ctx context.Context, databaseURL string, agent *AgentService, idle time.Duration) (*ConversationArchive, error) {
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive database url: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, archiveSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create archive schema: %w", err)
+	}
+	return &ConversationArchive{
+		db:    db,
+		agent: agent,
+		idle:  idle,
+	}, nil
+}
+
+// ArchivedConversation is a conversation as the archive keeps it
+type ArchivedConversation struct {
+	SessionID      string           `json:"session_id"`
+	UserID         string           `json:"user_id"`
+	Channel        string           `json:"channel"`
+	Intent         string           `json:"intent,omitempty"`
+	Language       string           `json:"language,omitempty"`
+	Sentiment      string           `json:"sentiment"` // of the customer's last message
+	Resolution     string           `json:"resolution,omitempty"`
+	Resolved       bool             `json:"resolved"`
+	Escalated      bool             `json:"escalated"`
+	HumanHandled   bool             `json:"human_handled"`
+	StartedAt      time.Time        `json:"started_at"`
+	LastActivity   time.Time        `json:"last_activity"`
+	EndedAt        *time.Time       `json:"ended_at,omitempty"`
+	MessageCount   int              `json:"message_count"` // customer messages
+	InputTokens    int64            `json:"input_tokens"`
+	OutputTokens   int64            `json:"output_tokens"`
+	CostUSD        float64          `json:"cost_usd"`
+	Models         []string         `json:"models"`          // models that wrote the answers
+	PromptVersions []int64          `json:"prompt_versions"` // system prompt versions of the answers
+	Summary        string           `json:"summary,omitempty"`
+	Tags           []string         `json:"tags"`
+	Messages       []SessionMessage `json:"messages,omitempty"`
+	Headline       string           `json:"headline,omitempty"` // where the search matched
+	ArchivedAt     time.Time        `json:"archived_at"`
+}
+
+// Archive writes a session and its conversation record to the archive, replacing what was
+// archived of it before
+func (a *ConversationArchive) Archive(ctx context.Context, session *Session) error {
+	record, err := a.agent.analytics.Record(ctx, session.SessionID)
+	if err != nil {
+		conversationsArchived.WithLabelValues("error").Inc()
+		return err
+	}
+
+	conversation := ArchivedConversation{
+		SessionID:      session.SessionID,
+		UserID:         session.UserID,
+		Channel:        session.Channel,
+		Intent:         record["intent"],
+		Language:       record["language"],
+		Resolution:     record["resolution"],
+		Escalated:      record["escalated"] == "1" || record["human_handled"] == "1",
+		HumanHandled:   record["human_handled"] == "1",
+		StartedAt:      session.StartedAt,
+		LastActivity:   session.LastActivity,
+		Models:         []string{},
+		PromptVersions: []int64{},
+		Tags:           sessionTags(session),
+		Messages:       session.Messages,
+	}
+	if summary := sessionSummary(session); summary != nil {
+		conversation.Summary = summary.Summary
+		if conversation.Resolution == "" {
+			conversation.Resolution = summary.Resolution
+		}
+	}
+	if endedAt, err := strconv.ParseInt(record["ended_at"], 10, 64); err == nil {
+		ended := time.Unix(endedAt, 0)
+		conversation.EndedAt = &ended
+	}
+	conversation.Resolved = conversation.EndedAt != nil || conversation.Resolution == ResolutionResolved
+	conversation.InputTokens, _ = strconv.ParseInt(record["input_tokens"], 10, 64)
+	conversation.OutputTokens, _ = strconv.ParseInt(record["output_tokens"], 10, 64)
+	conversation.CostUSD, _ = strconv.ParseFloat(record["cost_usd"], 64)
+
+	var transcript strings.Builder
+	models := map[string]bool{}
+	versions := map[int]bool{}
+	for _, msg := range session.Messages {
+		fmt.Fprintf(&transcript, "%s: %s\n", msg.Role, msg.Content)
+		if msg.Role == "user" {
+			conversation.MessageCount++
+			conversation.Sentiment = a.agent.analyzeSentiment(msg.Content)
+		}
+		if msg.Model != "" && !models[msg.Model] {
+			models[msg.Model] = true
+			conversation.Models = append(conversation.Models, msg.Model)
+		}
+		if msg.PromptVersion > 0 && !versions[msg.PromptVersion] {
+			versions[msg.PromptVersion] = true
+			conversation.PromptVersions = append(conversation.PromptVersions, int64(msg.PromptVersion))
+		}
+	}
+	if count, err := strconv.Atoi(record["messages"]); err == nil && count > conversation.MessageCount {
+		// Sessions keep the last 50 messages
+		conversation.MessageCount = count
+	}
+	messages, err := json.Marshal(session.Messages)
+	if err != nil {
+		conversationsArchived.WithLabelValues("error").Inc()
+		return fmt.Errorf("failed to marshal messages: %w", err)
+	}
+
+	_, err = a.db.ExecContext(ctx, `
+		INSERT INTO conversations (tenant_id, session_id, user_id, channel, intent, language, sentiment,
+			resolution, resolved, escalated, human_handled, started_at, last_activity, ended_at,
+			message_count, input_tokens, output_tokens, cost_usd, models, prompt_versions, summary,
+			tags, messages, transcript, archived_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19,
+			$20, $21, $22, $23, $24, now())
+		ON CONFLICT (tenant_id, session_id) DO UPDATE SET
+			user_id = EXCLUDED.user_id, channel = EXCLUDED.channel, intent = EXCLUDED.intent,
+			language = EXCLUDED.language, sentiment = EXCLUDED.sentiment,
+			resolution = EXCLUDED.resolution, resolved = EXCLUDED.resolved,
+			escalated = EXCLUDED.escalated, human_handled = EXCLUDED.human_handled,
+			last_activity = EXCLUDED.last_activity, ended_at = EXCLUDED.ended_at,
+			message_count = EXCLUDED.message_count, input_tokens = EXCLUDED.input_tokens,
+			output_tokens = EXCLUDED.output_tokens, cost_usd = EXCLUDED.cost_usd,
+			models = EXCLUDED.models, prompt_versions = EXCLUDED.prompt_versions,
+			summary = EXCLUDED.summary, tags = EXCLUDED.tags, messages = EXCLUDED.messages,
+			transcript = EXCLUDED.transcript, archived_at = now()`,
+		tenantFrom(ctx).ID, conversation.SessionID, conversation.UserID, conversation.Channel,
+		conversation.Intent, conversation.Language, conversation.Sentiment, conversation.Resolution,
+		conversation.Resolved, conversation.Escalated, conversation.HumanHandled,
+		conversation.StartedAt, conversation.LastActivity, conversation.EndedAt,
+		conversation.MessageCount, conversation.InputTokens, conversation.OutputTokens,
+		conversation.CostUSD, pq.Array(conversation.Models), pq.Array(conversation.PromptVersions),
+		conversation.Summary, pq.Array(conversation.Tags), messages, transcript.String())
+	if err != nil {
+		conversationsArchived.WithLabelValues("error").Inc()
+		return fmt.Errorf("failed to archive conversation %s: %w", session.SessionID, err)
+	}
+	conversationsArchived.WithLabelValues("archived").Inc()
+	return nil
+}
+
+// ArchiveSession archives the session with the ID, if it still exists
+func (a *ConversationArchive) ArchiveSession(ctx context.Context, sessionID string) error {
+	session, err := a.agent.sessionManager.Get(ctx, sessionID)
+	if err != nil || session == nil {
+		return err
+	}
+	return a.Archive(ctx, session)
+}
+
+// Sweep archives the tenant's sessions that went idle since the last sweep
+func (a *ConversationArchive) Sweep(ctx context.Context) (int, error) {
+	sessions := a.agent.sessionManager
+	now := time.Now()
+	until := now.Add(-a.idle).Unix()
+	since := now.Add(-sessions.sessionTTL).Unix()
+	if swept, err := sessions.client.Get(ctx, tenantKey(ctx, archiveSweptKey)).Int64(); err == nil && swept > since {
+		since = swept
+	}
+	if since >= until {
+		return 0, nil
+	}
+
+	ids, err := sessions.client.ZRangeByScore(ctx, sessions.indexKey(ctx), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(since, 10),
+		Max: strconv.FormatInt(until, 10),
+	}).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list idle sessions: %w", err)
+	}
+
+	archived := 0
+	for _, id := range ids {
+		session, err := sessions.Get(ctx, id)
+		if err != nil {
+			return archived, err
+		}
+		if session == nil || len(session.Messages) == 0 {
+			continue
+		}
+		if err := a.Archive(ctx, session); err != nil {
+			// Leave the rest for the next sweep
+			return archived, err
+		}
+		archived++
+	}
+
+	if err := sessions.client.Set(ctx, tenantKey(ctx, archiveSweptKey), until, sessions.sessionTTL).Err(); err != nil {
+		return archived, fmt.Errorf("failed to record archive sweep: %w", err)
+	}
+	return archived, nil
+}
+
+// Start archives the tenant's idle sessions every few minutes
+func (a *ConversationArchive) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(archiveSweepInterval)
+		defer ticker.Stop()
+		for {
+			archived, err := a.Sweep(ctx)
+			if err != nil {
+				log.Printf("Failed to archive idle sessions of tenant %s: %v", tenantFrom(ctx).ID, err)
+			} else if archived > 0 {
+				log.Printf("Archived %d idle sessions of tenant %s", archived, tenantFrom(ctx).ID)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// ArchiveFilter selects archived conversations. Zero values match every conversation.
+type ArchiveFilter struct {
+	Query         string // full-text search of the transcript
+	From, To      time.Time
+	UserID        string
+	Channel       string
+	Intent        string
+	Sentiment     string
+	Resolution    string
+	Escalated     *bool
+	Model         string
+	PromptVersion int
+	Tag           string
+	Offset, Count int
+}
+
+// conditions returns the SQL conditions of the filter and their arguments, from $1. The tenant
+// is $1, and the search query $2 when there is one.
+func (f ArchiveFilter) conditions(ctx context.Context) ([]string, []interface{}) {
+	conditions := []string{"tenant_id = $1"}
+	args := []interface{}{tenantFrom(ctx).ID}
+	where := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if f.Query != "" {
+		where("search @@ websearch_to_tsquery('simple', $%d)", f.Query)
+	}
+	if !f.From.IsZero() {
+		where("started_at >= $%d", f.From)
+	}
+	if !f.To.IsZero() {
+		where("started_at < $%d", f.To)
+	}
+	for condition, value := range map[string]string{
+		"user_id = $%d":     f.UserID,
+		"channel = $%d":     f.Channel,
+		"intent = $%d":      f.Intent,
+		"sentiment = $%d":   f.Sentiment,
+		"resolution = $%d":  f.Resolution,
+		"$%d = ANY(models)": f.Model,
+		"$%d = ANY(tags)":   f.Tag,
+	} {
+		if value != "" {
+			where(condition, value)
+		}
+	}
+	if f.Escalated != nil {
+		where("escalated = $%d", *f.Escalated)
+	}
+	if f.PromptVersion > 0 {
+		where("$%d = ANY(prompt_versions)", f.PromptVersion)
+	}
+	return conditions, args
+}
+
+// Search returns a page of the tenant's archived conversations that match the filter, without
+// their messages, and the number that match. Searches are ranked by relevance; other listings
+// are newest first.
+func (a *ConversationArchive) Search(ctx context.Context, filter ArchiveFilter) ([]ArchivedConversation, int, error) {
+	conditions, args := filter.conditions(ctx)
+	headline, order := "''", "started_at DESC"
+	if filter.Query != "" {
+		headline = "ts_headline('simple', transcript, websearch_to_tsquery('simple', $2))"
+		order = "ts_rank(search, websearch_to_tsquery('simple', $2)) DESC, started_at DESC"
+	}
+	args = append(args, filter.Count, filter.Offset)
+
+	rows, err := a.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT session_id, user_id, channel, intent, language, sentiment, resolution, resolved,
+			escalated, human_handled, started_at, last_activity, ended_at, message_count,
+			input_tokens, output_tokens, cost_usd, models, prompt_versions, summary, tags,
+			archived_at, %s, count(*) OVER ()
+		FROM conversations
+		WHERE %s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d`,
+		headline, strings.Join(conditions, " AND "), order, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to search conversations: %w", err)
+	}
+	defer rows.Close()
+
+	conversations := []ArchivedConversation{}
+	total := 0
+	for rows.Next() {
+		var conversation ArchivedConversation
+		var endedAt sql.NullTime
+		if err := rows.Scan(&conversation.SessionID, &conversation.UserID, &conversation.Channel,
+			&conversation.Intent, &conversation.Language, &conversation.Sentiment,
+			&conversation.Resolution, &conversation.Resolved, &conversation.Escalated,
+			&conversation.HumanHandled, &conversation.StartedAt, &conversation.LastActivity, &endedAt,
+			&conversation.MessageCount, &conversation.InputTokens, &conversation.OutputTokens,
+			&conversation.CostUSD, pq.Array(&conversation.Models), pq.Array(&conversation.PromptVersions),
+			&conversation.Summary, pq.Array(&conversation.Tags), &conversation.ArchivedAt,
+			&conversation.Headline, &total); err != nil {
+			return nil, 0, fmt.Errorf("failed to read conversation: %w", err)
+		}
+		if endedAt.Valid {
+			conversation.EndedAt = &endedAt.Time
+		}
+		conversations = append(conversations, conversation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to search conversations: %w", err)
+	}
+	return conversations, total, nil
+}
+
+// Get returns an archived conversation of the tenant with its messages, or nil
+func (a *ConversationArchive) Get(ctx context.Context, sessionID string) (*ArchivedConversation, error) {
+	var conversation ArchivedConversation
+	var endedAt sql.NullTime
+	var messages []byte
+	err := a.db.QueryRowContext(ctx, `
+		SELECT session_id, user_id, channel, intent, language, sentiment, resolution, resolved,
+			escalated, human_handled, started_at, last_activity, ended_at, message_count,
+			input_tokens, output_tokens, cost_usd, models, prompt_versions, summary, tags,
+			archived_at, messages
+		FROM conversations
+		WHERE tenant_id = $1 AND session_id = $2`, tenantFrom(ctx).ID, sessionID).Scan(
+		&conversation.SessionID, &conversation.UserID, &conversation.Channel,
+		&conversation.Intent, &conversation.Language, &conversation.Sentiment,
+		&conversation.Resolution, &conversation.Resolved, &conversation.Escalated,
+		&conversation.HumanHandled, &conversation.StartedAt, &conversation.LastActivity, &endedAt,
+		&conversation.MessageCount, &conversation.InputTokens, &conversation.OutputTokens,
+		&conversation.CostUSD, pq.Array(&conversation.Models), pq.Array(&conversation.PromptVersions),
+		&conversation.Summary, pq.Array(&conversation.Tags), &conversation.ArchivedAt, &messages)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conversation %s: %w", sessionID, err)
+	}
+	if endedAt.Valid {
+		conversation.EndedAt = &endedAt.Time
+	}
+	if err := json.Unmarshal(messages, &conversation.Messages); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal conversation %s: %w", sessionID, err)
+	}
+	return &conversation, nil
+}
+
+// UserSessions returns the session IDs of a customer's archived conversations in the tenant
+func (a *ConversationArchive) UserSessions(ctx context.Context, userID string) ([]string, error) {
+	rows, err := a.db.QueryContext(ctx, `
+		SELECT session_id FROM conversations
+		WHERE tenant_id = $1 AND user_id = $2
+		ORDER BY started_at`, tenantFrom(ctx).ID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list conversations of user: %w", err)
+	}
+	defer rows.Close()
+
+	var sessionIDs []string
+	for rows.Next() {
+		var sessionID string
+		if err := rows.Scan(&sessionID); err != nil {
+			return nil, fmt.Errorf("failed to scan conversation: %w", err)
+		}
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list conversations of user: %w", err)
+	}
+	return sessionIDs, nil
+}
+
+// DeleteUser deletes a customer's archived conversations in the tenant, with their search
+// index entries, and returns how many were deleted
+func (a *ConversationArchive) DeleteUser(ctx context.Context, userID string) (int64, error) {
+	result, err := a.db.ExecContext(ctx, `
+		DELETE FROM conversations WHERE tenant_id = $1 AND user_id = $2`, tenantFrom(ctx).ID, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete conversations of user: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// Report summarizes the tenant's archived conversations started between from and to, like
+// the conversation analytics report
+func (a *ConversationArchive) Report(ctx context.Context, from, to time.Time) (*AnalyticsReport, error) {
+	report := &AnalyticsReport{
+		From:     from,
+		To:       to,
+		Source:   "archive",
+		Topics:   map[string]*TopicStats{},
+		Channels: map[string]int{},
+	}
+	tenantID := tenantFrom(ctx).ID
+
+	var resolved, deflected, escalated int
+	var handleTime sql.NullFloat64
+	var messages int64
+	err := a.db.QueryRowContext(ctx, `
+		SELECT count(*),
+			count(*) FILTER (WHERE resolved),
+			count(*) FILTER (WHERE resolved AND NOT escalated),
+			count(*) FILTER (WHERE escalated),
+			avg(extract(epoch FROM ended_at - started_at)) FILTER (WHERE ended_at >= started_at),
+			coalesce(sum(message_count), 0), coalesce(sum(input_tokens), 0),
+			coalesce(sum(output_tokens), 0), coalesce(sum(cost_usd), 0)
+		FROM conversations
+		WHERE tenant_id = $1 AND started_at >= $2 AND started_at <= $3`, tenantID, from, to).Scan(
+		&report.Conversations, &resolved, &deflected, &escalated, &handleTime, &messages,
+		&report.InputTokens, &report.OutputTokens, &report.CostUSD)
+	if err != nil {
+		return nil, fmt.Errorf("failed to report on conversations: %w", err)
+	}
+	if report.Conversations == 0 {
+		return report, nil
+	}
+
+	rows, err := a.db.QueryContext(ctx, `
+		SELECT coalesce(nullif(intent, ''), 'none'), count(*),
+			count(*) FILTER (WHERE resolved), count(*) FILTER (WHERE escalated)
+		FROM conversations
+		WHERE tenant_id = $1 AND started_at >= $2 AND started_at <= $3
+		GROUP BY 1`, tenantID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to report on topics: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var topic string
+		var count, topicResolved, topicEscalated int
+		if err := rows.Scan(&topic, &count, &topicResolved, &topicEscalated); err != nil {
+			return nil, fmt.Errorf("failed to read topic: %w", err)
+		}
+		report.Topics[topic] = &TopicStats{
+			Conversations:  count,
+			Share:          roundTo(float64(count)/float64(report.Conversations), 3),
+			ResolutionRate: roundTo(float64(topicResolved)/float64(count), 3),
+			EscalationRate: roundTo(float64(topicEscalated)/float64(count), 3),
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to report on topics: %w", err)
+	}
+
+	channels, err := a.db.QueryContext(ctx, `
+		SELECT channel, count(*)
+		FROM conversations
+		WHERE tenant_id = $1 AND started_at >= $2 AND started_at <= $3
+		GROUP BY 1`, tenantID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to report on channels: %w", err)
+	}
+	defer channels.Close()
+	for channels.Next() {
+		var channel string
+		var count int
+		if err := channels.Scan(&channel, &count); err != nil {
+			return nil, fmt.Errorf("failed to read channel: %w", err)
+		}
+		report.Channels[channel] = count
+	}
+	if err := channels.Err(); err != nil {
+		return nil, fmt.Errorf("failed to report on channels: %w", err)
+	}
+
+	total := float64(report.Conversations)
+	report.ResolutionRate = roundTo(float64(resolved)/total, 3)
+	report.DeflectionRate = roundTo(float64(deflected)/total, 3)
+	report.EscalationRate = roundTo(float64(escalated)/total, 3)
+	if handleTime.Valid {
+		report.AverageHandleTime = roundTo(handleTime.Float64, 1)
+	}
+	report.AverageMessages = roundTo(float64(messages)/total, 2)
+	report.CostUSD = roundTo(report.CostUSD, 4)
+	report.CostPerConversationUSD = roundTo(report.CostUSD/total, 4)
+	report.TokensPerConversation = roundTo(float64(report.InputTokens+report.OutputTokens)/total, 1)
+	return report, nil
+}
+
+// Close closes the archive's database connections
+func (a *ConversationArchive) Close() error {
+	return a.db.Close()
+}
+
+// archiveConversation archives a session in the background, so the request that ended it
+// doesn't wait on Postgres
+func (app *Application) archiveConversation(ctx context.Context, session *Session) {
+	if app.Archive == nil || session == nil || len(session.Messages) == 0 {
+		return
+	}
+	background := detachContext(ctx)
+	go func() {
+		if err := app.Archive.Archive(background, session); err != nil {
+			log.Printf("Failed to archive conversation %s: %v", session.SessionID, err)
+		}
+	}()
+}
+
+// sessionTags returns the tags a conversation was given through its messages' metadata
+func sessionTags(session *Session) []string {
+	tags := []string{}
+	values, _ := session.Metadata[tagsMetadataKey].([]interface{})
+	for _, value := range values {
+		if tag, ok := value.(string); ok {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// addTags returns the tags of a session with the tags in a message's metadata, given as a list
+// or separated by commas, and whether any were added
+func addTags(session *Session, metadata map[string]interface{}) ([]interface{}, bool) {
+	var requested []string
+	switch value := metadata[tagsMetadataKey].(type) {
+	case string:
+		requested = strings.Split(value, ",")
+	case []interface{}:
+		for _, tag := range value {
+			if tag, ok := tag.(string); ok {
+				requested = append(requested, tag)
+			}
+		}
+	}
+
+	existing := sessionTags(session)
+	tags := make([]interface{}, 0, len(existing)+len(requested))
+	seen := map[string]bool{}
+	for _, tag := range existing {
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	added := false
+	for _, tag := range requested {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] || len(tags) >= maxConversationTags {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+		added = true
+	}
+	return tags, added
+}
+
+// listConversations searches the tenant's archived conversations
+func (app *Application) listConversations(c *gin.Context) {
+	if app.Archive == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "the conversation archive is not configured"})
+		return
+	}
+
+	filter, ok := archiveFilter(c)
+	if !ok {
+		return
+	}
+	var err error
+	if filter.Count, err = strconv.Atoi(c.DefaultQuery("count", "20")); err != nil || filter.Count < 1 || filter.Count > archiveMaxPage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("count must be between 1 and %d", archiveMaxPage)})
+		return
+	}
+	if filter.Offset, err = strconv.Atoi(c.DefaultQuery("offset", "0")); err != nil || filter.Offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset must not be negative"})
+		return
+	}
+
+	conversations, total, err := app.Archive.Search(c.Request.Context(), filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total":         total,
+		"count":         len(conversations),
+		"conversations": conversations,
+	})
+}
+
+// archiveFilter reads the filter of archived conversations in the query, replying 400 when it is
+// invalid
+func archiveFilter(c *gin.Context) (ArchiveFilter, bool) {
+	filter := ArchiveFilter{
+		Query:      c.Query("q"),
+		UserID:     c.Query("user_id"),
+		Channel:    c.Query("channel"),
+		Intent:     c.Query("intent"),
+		Sentiment:  c.Query("sentiment"),
+		Resolution: c.Query("resolution"),
+		Model:      c.Query("model"),
+		Tag:        c.Query("tag"),
+	}
+	var err error
+	if value := c.Query("prompt_version"); value != "" {
+		if filter.PromptVersion, err = strconv.Atoi(value); err != nil || filter.PromptVersion < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid prompt_version"})
+			return filter, false
+		}
+	}
+	if value := c.Query("escalated"); value != "" {
+		escalated, err := strconv.ParseBool(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid escalated"})
+			return filter, false
+		}
+		filter.Escalated = &escalated
+	}
+	for name, t := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := c.Query(name); value != "" {
+			if *t, err = parseAnalyticsTime(value); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid %s: %v", name, err)})
+				return filter, false
+			}
+		}
+	}
+	return filter, true
+}
+
+// getConversation returns an archived conversation with its messages
+func (app *Application) getConversation(c *gin.Context) {
+	if app.Archive == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "the conversation archive is not configured"})
+		return
+	}
+
+	conversation, err := app.Archive.Get(c.Request.Context(), c.Param("session_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if conversation == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "conversation not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, conversation)
+}
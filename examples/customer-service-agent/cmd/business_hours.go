@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Business hours settings
+const (
+	defaultOfflineMessage = "Our support team is offline right now. Your conversation is in their queue, and an agent will pick it up when we open on {opens_at}."
+	defaultWaitMessage    = "You're number {position} in the queue for a support agent. The estimated wait is about {wait} minutes."
+	defaultQueueMessage   = "You're number {position} in the queue for a support agent."
+	opensAtLayout         = "Monday, January 2 at 15:04 MST"
+	nextOpenSearchDays    = 366 // how far ahead to look for the next opening, past holidays
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+var callbackRequests = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "csr_callback_requests_total",
+		Help: "Callbacks customers asked for outside business hours",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(callbackRequests)
+}
+
+// BusinessHours are when human agents answer handed-off conversations. Outside them the agent
+// tells customers when the team is back, queues their escalations for it, and may offer a
+// callback; within them it tells customers their place in the queue and the estimated wait.
+type BusinessHours struct {
+	Schedule       string   `json:"schedule"`                  // such as "mon-fri 09:00-17:00; sat 10:00-14:00"
+	TimeZone       string   `json:"time_zone,omitempty"`       // IANA name, such as Europe/Berlin; defaults to UTC
+	Holidays       []string `json:"holidays,omitempty"`        // dates closed all day, as YYYY-MM-DD
+	Callbacks      bool     `json:"callbacks,omitempty"`       // offer to call customers back outside hours
+	OfflineMessage string   `json:"offline_message,omitempty"` // added to escalations outside hours; {opens_at} is replaced
+	WaitMessage    string   `json:"wait_message,omitempty"`    // added to escalations within hours; {position} and {wait} are replaced
+
+	location *time.Location
+	days     [7][]openPeriod // by weekday, in order
+	holidays map[string]bool
+}
+
+// openPeriod is a stretch of a day the team is open, in minutes since midnight
+type openPeriod struct {
+	start, end int
+}
+
+// compile parses the schedule, time zone, and holidays
+func (h *BusinessHours) compile() error {
+	zone := h.TimeZone
+	if zone == "" {
+		zone = "UTC"
+	}
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		return fmt.Errorf("invalid time zone %q: %w", h.TimeZone, err)
+	}
+	h.location = location
+
+	h.days = [7][]openPeriod{}
+	for _, entry := range strings.Split(h.Schedule, ";") {
+		fields := strings.Fields(strings.ToLower(entry))
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("schedule entry %q needs days and hours, such as mon-fri 09:00-17:00", strings.TrimSpace(entry))
+		}
+		days, err := parseWeekdays(fields[0])
+		if err != nil {
+			return err
+		}
+		for _, field := range fields[1:] {
+			period, err := parseOpenPeriod(field)
+			if err != nil {
+				return err
+			}
+			for _, day := range days {
+				h.days[day] = append(h.days[day], period)
+			}
+		}
+	}
+	open := false
+	for day := range h.days {
+		periods := h.days[day]
+		sort.Slice(periods, func(i, j int) bool { return periods[i].start < periods[j].start })
+		for i := 1; i < len(periods); i++ {
+			if periods[i].start < periods[i-1].end {
+				return fmt.Errorf("hours overlap on %s", time.Weekday(day))
+			}
+		}
+		open = open || len(periods) > 0
+	}
+	if !open {
+		return fmt.Errorf("schedule has no open hours")
+	}
+
+	h.holidays = make(map[string]bool, len(h.Holidays))
+	for _, holiday := range h.Holidays {
+		if holiday = strings.TrimSpace(holiday); holiday == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", holiday); err != nil {
+			return fmt.Errorf("invalid holiday %q: dates are YYYY-MM-DD", holiday)
+		}
+		h.holidays[holiday] = true
+	}
+	return nil
+}
+
+// parseWeekdays parses days such as "mon", "mon-fri", or "mon,wed,fri"
+func parseWeekdays(value string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, part := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, ok := weekdays[first]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q; days are mon, tue, wed, thu, fri, sat, and sun", first)
+		}
+		if !isRange {
+			days = append(days, from)
+			continue
+		}
+		to, ok := weekdays[last]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q; days are mon, tue, wed, thu, fri, sat, and sun", last)
+		}
+		// Ranges may wrap past Sunday, as in fri-mon
+		for day := from; ; day = (day + 1) % 7 {
+			days = append(days, day)
+			if day == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseOpenPeriod parses hours such as "09:00-17:30"; a period ending at midnight ends at 24:00
+func parseOpenPeriod(value string) (openPeriod, error) {
+	start, end, ok := strings.Cut(value, "-")
+	if !ok {
+		return openPeriod{}, fmt.Errorf("invalid hours %q, such as 09:00-17:00", value)
+	}
+	period := openPeriod{start: parseClock(start), end: parseClock(end)}
+	if period.start < 0 || period.end < 0 || period.start >= period.end {
+		return openPeriod{}, fmt.Errorf("invalid hours %q: times are HH:MM, and periods end after they start on the same day", value)
+	}
+	return period, nil
+}
+
+// parseClock returns the minutes since midnight of a time such as "09:30", or -1 when it is not
+// a time
+func parseClock(value string) int {
+	hours, minutes, ok := strings.Cut(value, ":")
+	h, err := strconv.Atoi(hours)
+	if !ok || err != nil || len(minutes) != 2 {
+		return -1
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return -1
+	}
+	return h*60 + m
+}
+
+// Open reports whether human agents are working at t
+func (h *BusinessHours) Open(t time.Time) bool {
+	local := t.In(h.location)
+	if h.holidays[local.Format("2006-01-02")] {
+		return false
+	}
+	minute := local.Hour()*60 + local.Minute()
+	for _, period := range h.days[local.Weekday()] {
+		if minute >= period.start && minute < period.end {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOpen returns when human agents are next working after t, or t when they are working. It
+// returns the zero time when holidays close every open day of the coming year.
+func (h *BusinessHours) NextOpen(t time.Time) time.Time {
+	if h.Open(t) {
+		return t
+	}
+	local := t.In(h.location)
+	for offset := 0; offset < nextOpenSearchDays; offset++ {
+		day := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, h.location)
+		if h.holidays[day.Format("2006-01-02")] {
+			continue
+		}
+		for _, period := range h.days[day.Weekday()] {
+			opens := time.Date(day.Year(), day.Month(), day.Day(), period.start/60, period.start%60, 0, 0, h.location)
+			if opens.After(local) {
+				return opens
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// offlineNotice tells a customer escalated outside hours when the team is back
+func (h *BusinessHours) offlineNotice(opensAt time.Time) string {
+	message := h.OfflineMessage
+	if message == "" {
+		message = defaultOfflineMessage
+	}
+	return strings.ReplaceAll(message, "{opens_at}", formatOpensAt(opensAt))
+}
+
+// waitNotice tells a customer escalated within hours their place in the queue, with the
+// estimated wait when there is one
+func (h *BusinessHours) waitNotice(position int64, wait time.Duration) string {
+	message := h.WaitMessage
+	if message == "" {
+		message = defaultWaitMessage
+	}
+	if wait <= 0 && strings.Contains(message, "{wait}") {
+		message = defaultQueueMessage
+	}
+	return strings.NewReplacer(
+		"{position}", strconv.FormatInt(position, 10),
+		"{wait}", strconv.Itoa(waitMinutes(wait)),
+	).Replace(message)
+}
+
+// formatOpensAt describes when the team is back
+func formatOpensAt(opensAt time.Time) string {
+	if opensAt.IsZero() {
+		return "the next business day"
+	}
+	return opensAt.Format(opensAtLayout)
+}
+
+// waitMinutes rounds an estimated wait up to whole minutes
+func waitMinutes(wait time.Duration) int {
+	return int(math.Ceil(wait.Minutes()))
+}
+
+// businessHours returns the business hours of the tenant work is done for, or nil when human
+// agents are always working
+func (s *AgentService) businessHours(ctx context.Context) *BusinessHours {
+	if hours := tenantFrom(ctx).BusinessHours; hours != nil {
+		return hours
+	}
+	return s.config.BusinessHours
+}
+
+// agentAvailability is whether human agents are working when a customer writes, for setting
+// their expectations of an escalation
+type agentAvailability struct {
+	hours   *BusinessHours
+	open    bool
+	opensAt time.Time     // when the team is back, while it is offline
+	waiting int64         // sessions queued for the team
+	wait    time.Duration // estimated wait of a session queued now; 0 when unknown
+}
+
+// availability returns whether human agents are working for the tenant, or nil when they are
+// always working
+func (s *AgentService) availability(ctx context.Context, now time.Time) *agentAvailability {
+	hours := s.businessHours(ctx)
+	if hours == nil {
+		return nil
+	}
+	availability := &agentAvailability{hours: hours, open: hours.Open(now)}
+	if !availability.open {
+		availability.opensAt = hours.NextOpen(now)
+		return availability
+	}
+	waiting, err := s.handoffs.Waiting(ctx)
+	if err != nil {
+		log.Printf("Failed to count queued handoffs: %v", err)
+		return availability
+	}
+	availability.waiting = waiting
+	if availability.wait, err = s.handoffs.EstimatedWait(ctx, waiting+1); err != nil {
+		log.Printf("Failed to estimate handoff wait: %v", err)
+	}
+	return availability
+}
+
+// prompt tells Claude whether human agents are working, so it sets the customer's expectations
+// before escalating
+func (a *agentAvailability) prompt() string {
+	if a == nil {
+		return ""
+	}
+	var prompt strings.Builder
+	prompt.WriteString("**Human Agents**: ")
+	if !a.open {
+		fmt.Fprintf(&prompt, "The support team is offline until %s. If the customer needs a person, say so before escalating: escalated conversations are queued for the team, who will pick them up when they are back.", formatOpensAt(a.opensAt))
+		if a.hours.Callbacks {
+			prompt.WriteString(" Offer to have the team call the customer back, and use request_callback if they accept.")
+		}
+		return prompt.String()
+	}
+	fmt.Fprintf(&prompt, "The support team is working. %d customers are waiting for an agent", a.waiting)
+	if a.wait > 0 {
+		fmt.Fprintf(&prompt, "; an escalated customer would wait about %d minutes", waitMinutes(a.wait))
+	}
+	prompt.WriteString(".")
+	return prompt.String()
+}
+
+// allowsTool reports whether a tool suits the team's availability: callbacks are offered only
+// outside hours, where the tenant offers them
+func (a *agentAvailability) allowsTool(name string) bool {
+	if name != "request_callback" {
+		return true
+	}
+	return a != nil && !a.open && a.hours.Callbacks
+}
+
+// Callback is a call a customer asked the support team for, outside business hours
+type Callback struct {
+	Phone         string    `json:"phone"`
+	PreferredTime string    `json:"preferred_time,omitempty"` // in the customer's words
+	RequestedAt   time.Time `json:"requested_at"`
+}
+
+// callbackTool lets Claude book a callback for a customer who accepts one outside hours. The
+// conversation is escalated with the callback, for the team to call when it is back.
+func (s *AgentService) callbackTool() *Tool {
+	return &Tool{
+		Name:        "request_callback",
+		Description: "Ask the support team to call the customer back when they are working again. Use it outside business hours when the customer accepts a callback and has given a phone number.",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"phone":          map[string]interface{}{"type": "string", "description": "The number to call, as the customer gave it"},
+				"preferred_time": map[string]interface{}{"type": "string", "description": "When the customer would like the call, if they said"},
+				"reason":         map[string]interface{}{"type": "string", "description": "What the call is about, for the agent who makes it"},
+			},
+			"required": []string{"phone", "reason"},
+		},
+		Handler: func(ctx context.Context, call *ToolCall) (interface{}, error) {
+			var input struct {
+				Phone         string `json:"phone"`
+				PreferredTime string `json:"preferred_time"`
+				Reason        string `json:"reason"`
+			}
+			if err := call.Decode(&input); err != nil {
+				return nil, err
+			}
+			if !call.turn.availability.allowsTool(call.Name) {
+				return nil, fmt.Errorf("callbacks are only offered outside business hours")
+			}
+			phone := strings.TrimSpace(input.Phone)
+			if phone == "" {
+				return nil, fmt.Errorf("ask the customer for the number to call")
+			}
+
+			call.turn.callback = &Callback{
+				Phone:         phone,
+				PreferredTime: input.PreferredTime,
+				RequestedAt:   time.Now(),
+			}
+			if call.turn.escalation == nil {
+				call.turn.escalation = &escalationRequest{Reason: "Callback requested: " + input.Reason, Priority: "normal"}
+			}
+			callbackRequests.Inc()
+			return map[string]string{
+				"status":   "callback_requested",
+				"opens_at": formatOpensAt(call.turn.availability.opensAt),
+				"message":  "The support team will call the customer when they are back.",
+			}, nil
+		},
+	}
+}
+
+// queueNotice tells an escalated customer when to expect a human agent, and records it in the
+// response metadata. There is no notice without business hours, where agents are always working.
+func (s *AgentService) queueNotice(ctx context.Context, turn *chatTurn, handoff *Handoff, metadata map[string]interface{}) string {
+	if turn.availability == nil {
+		return ""
+	}
+	hours := turn.availability.hours
+	metadata["agents_available"] = turn.availability.open
+	if !turn.availability.open {
+		metadata["agents_available_at"] = turn.availability.opensAt
+		if handoff.Callback != nil {
+			// Claude has told the customer about their callback
+			return ""
+		}
+		return hours.offlineNotice(turn.availability.opensAt)
+	}
+
+	position, err := s.handoffs.Position(ctx, handoff.SessionID)
+	if err != nil || position == 0 {
+		if err != nil {
+			log.Printf("Failed to find queue position of session %s: %v", handoff.SessionID, err)
+		}
+		return ""
+	}
+	wait, err := s.handoffs.EstimatedWait(ctx, position)
+	if err != nil {
+		log.Printf("Failed to estimate handoff wait: %v", err)
+	}
+	metadata["queue_position"] = position
+	if wait > 0 {
+		metadata["estimated_wait_minutes"] = waitMinutes(wait)
+	}
+	return hours.waitNotice(position, wait)
+}
+
+// getChatHandoff tells a chat widget whether its session is waiting for a human agent, its place
+// in the queue, and whether agents are working
+func (app *Application) getChatHandoff(c *gin.Context) {
+	ctx := c.Request.Context()
+	handoff, err := app.Handoffs.Get(ctx, c.Param("session_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if handoff == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session is not handed off"})
+		return
+	}
+
+	status := gin.H{
+		"session_id":   handoff.SessionID,
+		"status":       handoff.Status,
+		"requested_at": handoff.RequestedAt,
+	}
+	if handoff.Callback != nil {
+		status["callback"] = true
+	}
+	open := true
+	if hours := app.AgentService.businessHours(ctx); hours != nil {
+		now := time.Now()
+		if open = hours.Open(now); !open {
+			status["agents_available_at"] = hours.NextOpen(now)
+		}
+		status["agents_available"] = open
+	}
+	if handoff.Status == HandoffQueued {
+		position, err := app.Handoffs.Position(ctx, handoff.SessionID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		status["queue_position"] = position
+		// The claims of the last hour say nothing of the wait until the team is back
+		if open {
+			if wait, err := app.Handoffs.EstimatedWait(ctx, position); err == nil && wait > 0 {
+				status["estimated_wait_minutes"] = waitMinutes(wait)
+			}
+		}
+	}
+	c.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Claude call settings
+const (
+	claudeRetryBackoff  = time.Second      // before the first retry; doubled for each one after
+	claudeMaxRetryAfter = 30 * time.Second // longest retry-after honored before giving up
+)
+
+// claudeFallbackReply answers customers while Claude cannot, so they are not left waiting
+const claudeFallbackReply = "Sorry, I can't answer right now. Please try again in a few minutes, or ask for a person and a member of the team will follow up."
+
+// ErrClaudeUnavailable is returned when Claude calls keep failing, or the circuit breaker is open
+var ErrClaudeUnavailable = errors.New("claude is unavailable")
+
+// Circuit breaker states, as reported by csr_claude_circuit_state
+const (
+	circuitClosed   = 0
+	circuitHalfOpen = 1
+	circuitOpen     = 2
+)
+
+var (
+	claudeRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "csr_claude_requests_total",
+			Help: "Claude API requests by result: success, retried, failed, or rejected by the open circuit breaker",
+		},
+		[]string{"result"},
+	)
+
+	claudeCircuitState = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "csr_claude_circuit_state",
+			Help: "State of the Claude circuit breaker: 0 closed, 1 half-open, 2 open",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(claudeRequests)
+	prometheus.MustRegister(claudeCircuitState)
+}
+
+// CircuitBreaker stops calls to a service that keeps failing. After threshold consecutive
+// failures it opens and rejects calls for cooldown, then lets one trial call through: the circuit
+// closes again if it succeeds, and reopens if it fails.
+type CircuitBreaker struct {
+	threshold int // zero disables the breaker
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	trialAt  time.Time // when the trial call of a half-open circuit started
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow reports whether a call may be made
+func (b *CircuitBreaker) Allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(circuitHalfOpen)
+		b.trialAt = time.Now()
+		return true
+	case circuitHalfOpen:
+		// A trial call whose caller gave up reports nothing; allow another after a cooldown
+		if time.Since(b.trialAt) < b.cooldown {
+			return false
+		}
+		b.trialAt = time.Now()
+		return true
+	default:
+		return true
+	}
+}
+
+// Success records a call that succeeded, closing the circuit
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.setState(circuitClosed)
+}
+
+// Failure records a call that failed, opening the circuit after threshold failures in a row or
+// when a trial call fails
+func (b *CircuitBreaker) Failure() {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(circuitOpen)
+	}
+}
+
+func (b *CircuitBreaker) setState(state int) {
+	b.state = state
+	claudeCircuitState.Set(float64(state))
+}
+
+// claudeAPIError is a Messages API request Claude answered with an error status
+type claudeAPIError struct {
+	status     int
+	retryAfter time.Duration
+	body       string
+}
+
+func (e *claudeAPIError) Error() string {
+	return fmt.Sprintf("claude api error (status %d): %s", e.status, e.body)
+}
+
+// retryable reports whether the request may succeed later: rate limits, overload, and server errors
+func (e *claudeAPIError) retryable() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+// sendClaude sends a Messages API request for the turn and passes the response body to read.
+// Requests that fail, are rate limited, or find Claude overloaded are retried up to MaxRetries
+// times with exponential backoff, or after the retry-after Claude sends when that is longer.
+// Requests that are not streamed must complete within RequestTimeout each. ErrClaudeUnavailable
+// is returned once retries run out, and without a request while the circuit breaker is open.
+func (s *AgentService) sendClaude(ctx context.Context, turn *chatTurn, stream bool, read func(body io.Reader) error) error {
+	if !s.breaker.Allow() {
+		claudeRequests.WithLabelValues("rejected").Inc()
+		return fmt.Errorf("%w: circuit breaker is open", ErrClaudeUnavailable)
+	}
+
+	backoff := claudeRetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.attemptClaude(ctx, turn, stream, read)
+		if err == nil {
+			claudeRequests.WithLabelValues("success").Inc()
+			s.breaker.Success()
+			return nil
+		}
+		if ctx.Err() != nil {
+			// The caller gave up, which says nothing about Claude
+			return err
+		}
+		if !retry {
+			claudeRequests.WithLabelValues("failed").Inc()
+			var apiErr *claudeAPIError
+			if errors.As(err, &apiErr) {
+				// Claude is up, and rejected the request
+				s.breaker.Success()
+			}
+			return err
+		}
+
+		wait := backoff
+		var apiErr *claudeAPIError
+		if errors.As(err, &apiErr) && apiErr.retryAfter > wait {
+			wait = apiErr.retryAfter
+		}
+		if attempt >= s.config.MaxRetries || wait > claudeMaxRetryAfter {
+			claudeRequests.WithLabelValues("failed").Inc()
+			s.breaker.Failure()
+			return fmt.Errorf("%w: %v", ErrClaudeUnavailable, err)
+		}
+
+		claudeRequests.WithLabelValues("retried").Inc()
+		fmt.Printf("Claude request failed, retrying in %s: %v\n", wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// attemptClaude sends a Messages API request once, reporting whether a failed one may be retried.
+// Streamed responses are not retried once read has started passing them on.
+func (s *AgentService) attemptClaude(ctx context.Context, turn *chatTurn, stream bool, read func(body io.Reader) error) (bool, error) {
+	client := s.streamClient
+	if !stream {
+		client = s.httpClient
+	}
+	if !stream && s.config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.RequestTimeout)
+		defer cancel()
+	}
+
+	req, err := s.newClaudeRequest(ctx, turn, stream)
+	if err != nil {
+		return false, err
+	}
+	if stream {
+		req.Header.Set("Accept", "text/event-stream")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("failed to call claude api: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		apiErr := &claudeAPIError{status: resp.StatusCode, body: string(body)}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			apiErr.retryAfter = time.Duration(seconds) * time.Second
+		}
+		return apiErr.retryable(), apiErr
+	}
+
+	if err := read(resp.Body); err != nil {
+		return !stream, err
+	}
+	return false, nil
+}
+
+// fallbackAnswer answers a message Claude could not, with the knowledge base articles found for
+// it. The message and the answer are kept in the session, so the conversation carries on once
+// Claude is back.
+func (s *AgentService) fallbackAnswer(ctx context.Context, req *ChatMessageRequest, turn *chatTurn) (*ChatMessageResponse, error) {
+	message := claudeFallbackReply
+	if len(turn.kbArticles) > 0 {
+		links := []string{message, "", "These articles may help in the meantime:"}
+		for _, article := range turn.kbArticles {
+			if article.URL != "" {
+				links = append(links, fmt.Sprintf("- [%s](%s)", article.Title, article.URL))
+			} else {
+				links = append(links, "- "+article.Title)
+			}
+		}
+		message = strings.Join(links, "\n")
+	}
+
+	if err := s.sessionManager.AddMessage(ctx, req.SessionID, "user", req.Message); err != nil {
+		return nil, err
+	}
+	if err := s.sessionManager.AddAnswer(ctx, req.SessionID, message, turn.promptVersion, ""); err != nil {
+		return nil, err
+	}
+	s.analytics.RecordMessage(ctx, req.SessionID)
+
+	return &ChatMessageResponse{
+		SessionID:      req.SessionID,
+		Message:        message,
+		Sentiment:      turn.sentiment,
+		KBArticles:     turn.kbArticles,
+		Metadata:       map[string]interface{}{"fallback": true},
+		Language:       turn.language,
+		Intent:         turn.intent.name(),
+		ProcessingTime: float64(time.Since(turn.startTime).Milliseconds()),
+	}, nil
+}
+
+// streamFallbackAnswer answers a message Claude could not like fallbackAnswer, passing the answer
+// to onToken
+func (s *AgentService) streamFallbackAnswer(ctx context.Context, req *ChatMessageRequest, turn *chatTurn, onToken func(text string) error) (*ChatMessageResponse, error) {
+	response, err := s.fallbackAnswer(ctx, req, turn)
+	if err != nil {
+		return nil, err
+	}
+	if err := onToken(response.Message); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
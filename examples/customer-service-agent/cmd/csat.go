@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Survey kinds
+const (
+	SurveyCSAT = "csat" // customer satisfaction, scored 1 to 5
+	SurveyNPS  = "nps"  // net promoter score, scored 0 to 10
+)
+
+// surveyResponseTTL is how long individual responses are kept; aggregates are kept forever
+const surveyResponseTTL = 90 * 24 * time.Hour
+
+var (
+	surveyEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "csr_surveys_total",
+			Help: "Satisfaction surveys, by status",
+		},
+		[]string{"status"},
+	)
+
+	surveyScores = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "csr_survey_score",
+			Help:    "Satisfaction survey scores, by survey kind and who resolved the conversation",
+			Buckets: prometheus.LinearBuckets(0, 1, 11),
+		},
+		[]string{"kind", "resolver"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(surveyEvents)
+	prometheus.MustRegister(surveyScores)
+}
+
+// SurveyConfig holds the survey sent when a session ends
+type SurveyConfig struct {
+	Kind           string // csat or nps
+	Prompt         string
+	ResponseWindow time.Duration // how long after the survey a score is accepted
+}
+
+// Surveys asks customers how satisfied they were once their session ends, and records their
+// answers against who resolved the conversation: the AI or a human agent
+type Surveys struct {
+	config SurveyConfig
+	client *redis.Client
+}
+
+// Survey is a survey sent to the customer of a session
+type Survey struct {
+	SessionID string    `json:"session_id"`
+	UserID    string    `json:"user_id"`
+	Channel   string    `json:"channel"`
+	Kind      string    `json:"kind"`
+	Resolver  string    `json:"resolver"`           // ai or human
+	AgentID   string    `json:"agent_id,omitempty"` // the human agent who resolved it
+	SentAt    time.Time `json:"sent_at"`
+}
+
+// SurveyResponse is a customer's answer to a survey
+type SurveyResponse struct {
+	Survey
+	Score       int       `json:"score"`
+	Comment     string    `json:"comment,omitempty"` // anything the customer wrote besides the score
+	RespondedAt time.Time `json:"responded_at"`
+}
+
+// SatisfactionScore aggregates the responses to one kind of survey
+type SatisfactionScore struct {
+	Responses int     `json:"responses"`
+	Average   float64 `json:"average"`
+
+	SatisfiedPercent *float64 `json:"satisfied_percent,omitempty"` // CSAT: share of 4s and 5s
+	NPS              *float64 `json:"nps,omitempty"`               // NPS: % promoters (9-10) minus % detractors (0-6)
+}
+
+// NewSurveys creates the surveys of the given kind, stored in Redis
+func NewSurveys(config SurveyConfig, client *redis.Client) (*Surveys, error) {
+	switch config.Kind {
+	case SurveyCSAT:
+		if config.Prompt == "" {
+			config.Prompt = "Thanks for contacting us! How satisfied were you with the help you received? Reply with a number from 1 (very dissatisfied) to 5 (very satisfied)."
+		}
+	case SurveyNPS:
+		if config.Prompt == "" {
+			config.Prompt = "Thanks for contacting us! How likely are you to recommend us to a friend or colleague? Reply with a number from 0 (not at all likely) to 10 (extremely likely)."
+		}
+	default:
+		return nil, fmt.Errorf("CSAT_SURVEY must be csat or nps, not %q", config.Kind)
+	}
+	if config.ResponseWindow <= 0 {
+		config.ResponseWindow = 48 * time.Hour
+	}
+
+	return &Surveys{config: config, client: client}, nil
+}
+
+// Prompt is the survey question sent to customers
+func (s *Surveys) Prompt() string {
+	return s.config.Prompt
+}
+
+// Start records that a survey is about to be sent for an ended session and returns it. The
+// session's next message is taken as the answer when it holds a score.
+func (s *Surveys) Start(ctx context.Context, session *Session) (*Survey, error) {
+	survey := &Survey{
+		SessionID: session.SessionID,
+		UserID:    session.UserID,
+		Channel:   session.Channel,
+		Kind:      s.config.Kind,
+		Resolver:  "ai",
+		SentAt:    time.Now(),
+	}
+	for _, msg := range session.Messages {
+		if msg.Role == "agent" {
+			survey.Resolver = "human"
+			break
+		}
+	}
+	if survey.Resolver == "human" {
+		survey.AgentID, _ = session.Metadata["human_agent_id"].(string)
+	}
+
+	data, err := json.Marshal(survey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal survey: %w", err)
+	}
+	if err := s.client.Set(ctx, s.pendingKey(ctx, session.SessionID), data, s.config.ResponseWindow).Err(); err != nil {
+		return nil, fmt.Errorf("failed to save survey: %w", err)
+	}
+	return survey, nil
+}
+
+// Cancel withdraws a survey that could not be sent
+func (s *Surveys) Cancel(ctx context.Context, sessionID string) {
+	s.client.Del(ctx, s.pendingKey(ctx, sessionID))
+}
+
+// Answer records a message as the answer to the session's survey. It returns false when no
+// survey is waiting for an answer, or the message is not one; the survey is then dropped, since
+// the customer has moved on.
+func (s *Surveys) Answer(ctx context.Context, sessionID, message string) (*SurveyResponse, bool, error) {
+	data, err := s.client.Get(ctx, s.pendingKey(ctx, sessionID)).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get survey: %w", err)
+	}
+	s.client.Del(ctx, s.pendingKey(ctx, sessionID))
+
+	var survey Survey
+	if err := json.Unmarshal(data, &survey); err != nil {
+		return nil, false, fmt.Errorf("failed to unmarshal survey: %w", err)
+	}
+	score, comment, ok := surveyScore(message, survey.Kind)
+	if !ok {
+		surveyEvents.WithLabelValues("ignored").Inc()
+		return nil, false, nil
+	}
+
+	response := &SurveyResponse{
+		Survey:      survey,
+		Score:       score,
+		Comment:     comment,
+		RespondedAt: time.Now(),
+	}
+	data, err = json.Marshal(response)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal survey response: %w", err)
+	}
+
+	pipe := s.client.TxPipeline()
+	pipe.Set(ctx, s.responseKey(ctx, sessionID), data, surveyResponseTTL)
+	scores := s.scoresKey(ctx, survey.Kind)
+	pipe.HIncrBy(ctx, scores, fmt.Sprintf("%s:%d", survey.Resolver, score), 1)
+	if survey.AgentID != "" {
+		pipe.HIncrBy(ctx, scores, fmt.Sprintf("agent:%s:%d", survey.AgentID, score), 1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, false, fmt.Errorf("failed to record survey response: %w", err)
+	}
+
+	surveyEvents.WithLabelValues("answered").Inc()
+	surveyScores.WithLabelValues(survey.Kind, survey.Resolver).Observe(float64(score))
+	return response, true, nil
+}
+
+// Stats aggregates the responses to the configured survey: overall, for the AI, for human
+// agents, and for each human agent
+func (s *Surveys) Stats(ctx context.Context) (map[string]interface{}, error) {
+	counts, err := s.client.HGetAll(ctx, s.scoresKey(ctx, s.config.Kind)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get survey scores: %w", err)
+	}
+
+	// Scores per group, from fields such as "ai:5" and "agent:dana:4"
+	groups := map[string]map[int]int{"overall": {}, "ai": {}, "human": {}}
+	agents := map[string]map[int]int{}
+	for field, value := range counts {
+		i := strings.LastIndex(field, ":")
+		score, err1 := strconv.Atoi(field[i+1:])
+		count, err2 := strconv.Atoi(value)
+		if i < 0 || err1 != nil || err2 != nil {
+			continue
+		}
+		group := field[:i]
+		if agentID := strings.TrimPrefix(group, "agent:"); agentID != group {
+			if agents[agentID] == nil {
+				agents[agentID] = map[int]int{}
+			}
+			agents[agentID][score] += count
+			continue
+		}
+		if groups[group] == nil {
+			continue
+		}
+		groups[group][score] += count
+		groups["overall"][score] += count
+	}
+
+	stats := map[string]interface{}{"survey": s.config.Kind}
+	for group, scores := range groups {
+		stats[group] = s.aggregate(scores)
+	}
+	byAgent := make(map[string]*SatisfactionScore, len(agents))
+	for agentID, scores := range agents {
+		byAgent[agentID] = s.aggregate(scores)
+	}
+	stats["agents"] = byAgent
+	return stats, nil
+}
+
+// aggregate summarizes the number of responses with each score
+func (s *Surveys) aggregate(scores map[int]int) *SatisfactionScore {
+	result := &SatisfactionScore{}
+	total, high, low := 0, 0, 0
+	for score, count := range scores {
+		result.Responses += count
+		total += score * count
+		switch {
+		case s.config.Kind == SurveyCSAT && score >= 4, s.config.Kind == SurveyNPS && score >= 9:
+			high += count
+		case s.config.Kind == SurveyNPS && score <= 6:
+			low += count
+		}
+	}
+	if result.Responses == 0 {
+		return result
+	}
+
+	percent := func(n int) float64 {
+		return math.Round(float64(n)*1000/float64(result.Responses)) / 10
+	}
+	result.Average = math.Round(float64(total)*100/float64(result.Responses)) / 100
+	if s.config.Kind == SurveyCSAT {
+		satisfied := percent(high)
+		result.SatisfiedPercent = &satisfied
+	} else {
+		nps := percent(high) - percent(low)
+		result.NPS = &nps
+	}
+	return result
+}
+
+// sendSurvey asks the customer of an ended session to rate it, through the channel they wrote from
+func (app *Application) sendSurvey(ctx context.Context, session *Session) {
+	if session.Channel == "voice" {
+		// The call is over
+		return
+	}
+	if _, err := app.Surveys.Start(ctx, session); err != nil {
+		log.Printf("Failed to start survey for session %s: %v", session.SessionID, err)
+		return
+	}
+	if err := app.sendToCustomer(ctx, session, "assistant", app.Surveys.Prompt()); err != nil {
+		log.Printf("Failed to send survey for session %s: %v", session.SessionID, err)
+		app.Surveys.Cancel(ctx, session.SessionID)
+		surveyEvents.WithLabelValues("failed").Inc()
+		return
+	}
+	surveyEvents.WithLabelValues("sent").Inc()
+}
+
+// Response returns the answer to a session's survey, or nil
+func (s *Surveys) Response(ctx context.Context, sessionID string) (*SurveyResponse, error) {
+	data, err := s.client.Get(ctx, s.responseKey(ctx, sessionID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get survey response: %w", err)
+	}
+	var response SurveyResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal survey response: %w", err)
+	}
+	return &response, nil
+}
+
+// Forget deletes a session's pending survey and its answer; the aggregate scores are kept
+func (s *Surveys) Forget(ctx context.Context, sessionID string) error {
+	if err := s.client.Del(ctx, s.pendingKey(ctx, sessionID), s.responseKey(ctx, sessionID)).Err(); err != nil {
+		return fmt.Errorf("failed to delete survey: %w", err)
+	}
+	return nil
+}
+
+func (s *Surveys) responseKey(ctx context.Context, sessionID string) string {
+	return tenantKey(ctx, "survey:response:"+sessionID)
+}
+
+func (s *Surveys) pendingKey(ctx context.Context, sessionID string) string {
+	return tenantKey(ctx, "survey:pending:"+sessionID)
+}
+
+func (s *Surveys) scoresKey(ctx context.Context, kind string) string {
+	return tenantKey(ctx, "survey:scores:"+kind)
+}
+
+var (
+	// surveyNumber matches the score in answers such as "5", "I'd say 9!", or "10 - great"
+	surveyNumber = regexp.MustCompile(`\b(\d{1,2})\b`)
+	// surveyScale matches the scale in answers such as "4/5" or "9 out of 10"
+	surveyScale = regexp.MustCompile(`(?i)\s*(/|out of)\s*(5|10)\b`)
+)
+
+// surveyScore reads the score in a survey answer. Short answers with exactly one number in range
+// count; anything else is taken as the customer moving on.
+func surveyScore(message, kind string) (int, string, bool) {
+	message = strings.TrimSpace(message)
+	if len(message) > 500 {
+		return 0, "", false
+	}
+
+	text := surveyScale.ReplaceAllString(message, "")
+	matches := surveyNumber.FindAllStringIndex(text, -1)
+	if len(matches) != 1 {
+		return 0, "", false
+	}
+	score, _ := strconv.Atoi(text[matches[0][0]:matches[0][1]])
+	min, max := 1, 5
+	if kind == SurveyNPS {
+		min, max = 0, 10
+	}
+	if score < min || score > max {
+		return 0, "", false
+	}
+
+	comment := strings.TrimSpace(text[:matches[0][0]] + text[matches[0][1]:])
+	comment = strings.Trim(comment, " .,!-–—:")
+	return score, comment, true
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dataRequestsKey is the stream of a tenant's data subject requests. Entries are never trimmed:
+// the audit trail outlives the data it records the deletion of.
+const dataRequestsKey = "audit:data_requests"
+
+const dataRequestPageSize = 200
+
+var dataRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_data_requests_total",
+		Help: "Data subject requests by tenant, action (export or delete), and result",
+	},
+	[]string{"tenant", "action", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(dataRequests)
+}
+
+// UserData is everything the tenant keeps about a customer, in the export's format
+type UserData struct {
+	UserID          string                       `json:"user_id"`
+	TenantID        string                       `json:"tenant_id"`
+	ExportedAt      time.Time                    `json:"exported_at"`
+	Sessions        []*Session                   `json:"sessions"`               // conversations in progress
+	Conversations   []*ArchivedConversation      `json:"archived_conversations"` // ended conversations
+	Records         map[string]map[string]string `json:"conversation_records"`   // analytics by session ID
+	Handoffs        []*Handoff                   `json:"handoffs"`
+	SurveyResponses []*SurveyResponse            `json:"survey_responses"`
+	Usage           []DailyUsage                 `json:"usage"`
+}
+
+// DataCounts is how much of a customer's data a request found
+type DataCounts struct {
+	Sessions              int `json:"sessions"`
+	ArchivedConversations int `json:"archived_conversations"`
+	ConversationRecords   int `json:"conversation_records"`
+}
+
+// empty reports whether nothing was found
+func (d DataCounts) empty() bool {
+	return d.Sessions == 0 && d.ArchivedConversations == 0 && d.ConversationRecords == 0
+}
+
+// DataRequest is the audit record of an export or deletion of a customer's data. The customer is
+// recorded by a hash of their user ID, so the trail keeps no identifier of an erased customer.
+type DataRequest struct {
+	ID          string      `json:"id"`
+	Action      string      `json:"action"` // export or delete
+	Subject     string      `json:"subject"`
+	RequestedBy string      `json:"requested_by"` // admin or tenant, by the API key used
+	RequestedAt time.Time   `json:"requested_at"`
+	Found       DataCounts  `json:"found"`
+	Remaining   *DataCounts `json:"remaining,omitempty"` // after a deletion
+	Verified    bool        `json:"verified,omitempty"`  // nothing remained after a deletion
+	Error       string      `json:"error,omitempty"`
+}
+
+// userDataLocation is where a customer's conversations are kept
+type userDataLocation struct {
+	sessions   []*Session
+	records    map[string]map[string]string
+	archived   []string
+	sessionIDs []string // of every conversation, wherever it is kept
+}
+
+func (l *userDataLocation) counts() DataCounts {
+	return DataCounts{
+		Sessions:              len(l.sessions),
+		ArchivedConversations: len(l.archived),
+		ConversationRecords:   len(l.records),
+	}
+}
+
+// dataSubject hashes a user ID for the audit trail
+func dataSubject(userID string) string {
+	sum := sha256.Sum256([]byte(userID))
+	return hex.EncodeToString(sum[:])
+}
+
+// locateUserData finds a customer's conversations in the tenant's sessions, conversation
+// records, and archive
+func (app *Application) locateUserData(ctx context.Context, userID string) (*userDataLocation, error) {
+	location := &userDataLocation{}
+	var err error
+	if location.sessions, err = app.SessionManager.UserSessions(ctx, userID); err != nil {
+		return nil, err
+	}
+	if location.records, err = app.AgentService.analytics.UserRecords(ctx, userID); err != nil {
+		return nil, err
+	}
+	if app.Archive != nil {
+		if location.archived, err = app.Archive.UserSessions(ctx, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	seen := map[string]bool{}
+	add := func(sessionID string) {
+		if !seen[sessionID] {
+			seen[sessionID] = true
+			location.sessionIDs = append(location.sessionIDs, sessionID)
+		}
+	}
+	for _, session := range location.sessions {
+		add(session.SessionID)
+	}
+	for sessionID := range location.records {
+		add(sessionID)
+	}
+	for _, sessionID := range location.archived {
+		add(sessionID)
+	}
+	sort.Strings(location.sessionIDs)
+	return location, nil
+}
+
+// ExportUserData collects everything the tenant keeps about a customer
+func (app *Application) ExportUserData(ctx context.Context, userID string) (*UserData, *userDataLocation, error) {
+	location, err := app.locateUserData(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data := &UserData{
+		UserID:          userID,
+		TenantID:        tenantFrom(ctx).ID,
+		ExportedAt:      time.Now().UTC(),
+		Sessions:        location.sessions,
+		Conversations:   []*ArchivedConversation{},
+		Records:         location.records,
+		Handoffs:        []*Handoff{},
+		SurveyResponses: []*SurveyResponse{},
+	}
+	if data.Sessions == nil {
+		data.Sessions = []*Session{}
+	}
+	for _, sessionID := range location.archived {
+		conversation, err := app.Archive.Get(ctx, sessionID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if conversation != nil {
+			data.Conversations = append(data.Conversations, conversation)
+		}
+	}
+	for _, sessionID := range location.sessionIDs {
+		handoff, err := app.Handoffs.Get(ctx, sessionID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if handoff != nil {
+			data.Handoffs = append(data.Handoffs, handoff)
+		}
+		if app.Surveys == nil {
+			continue
+		}
+		response, err := app.Surveys.Response(ctx, sessionID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if response != nil {
+			data.SurveyResponses = append(data.SurveyResponses, response)
+		}
+	}
+	if data.Usage, err = app.AgentService.userUsage(ctx, userID); err != nil {
+		return nil, nil, err
+	}
+	return data, location, nil
+}
+
+// DeleteUserData deletes everything the tenant keeps about a customer, then looks for it again
+// and returns what was found before and what remains
+func (app *Application) DeleteUserData(ctx context.Context, userID string) (DataCounts, DataCounts, error) {
+	location, err := app.locateUserData(ctx, userID)
+	if err != nil {
+		return DataCounts{}, DataCounts{}, err
+	}
+	found := location.counts()
+
+	for _, sessionID := range location.sessionIDs {
+		if err := app.SessionManager.EndSession(ctx, sessionID); err != nil {
+			return found, DataCounts{}, err
+		}
+		if err := app.AgentService.analytics.Forget(ctx, sessionID); err != nil {
+			return found, DataCounts{}, err
+		}
+		if err := app.Handoffs.Resolve(ctx, sessionID); err != nil {
+			return found, DataCounts{}, err
+		}
+		if err := app.AgentService.pii.Forget(ctx, sessionID); err != nil {
+			return found, DataCounts{}, err
+		}
+		if app.Surveys != nil {
+			if err := app.Surveys.Forget(ctx, sessionID); err != nil {
+				return found, DataCounts{}, err
+			}
+		}
+	}
+	if err := app.AgentService.forgetUserUsage(ctx, userID); err != nil {
+		return found, DataCounts{}, err
+	}
+	if app.Archive != nil {
+		if _, err := app.Archive.DeleteUser(ctx, userID); err != nil {
+			return found, DataCounts{}, err
+		}
+	}
+
+	// A conversation still in progress may have been saved again since it was located
+	remaining, err := app.locateUserData(ctx, userID)
+	if err != nil {
+		return found, DataCounts{}, fmt.Errorf("failed to verify deletion: %w", err)
+	}
+	return found, remaining.counts(), nil
+}
+
+// auditDataRequest adds a data subject request to the tenant's audit trail
+func (app *Application) auditDataRequest(c *gin.Context, request *DataRequest) error {
+	ctx := detachContext(c.Request.Context())
+	request.RequestedBy = "admin"
+	if c.GetHeader("X-API-Key") != os.Getenv("API_KEY") && tenantAPIKey(c) {
+		request.RequestedBy = "tenant"
+	}
+
+	result := "ok"
+	if request.Error != "" || (request.Action == "delete" && !request.Verified) {
+		result = "failed"
+	}
+	dataRequests.WithLabelValues(tenantFrom(ctx).ID, request.Action, result).Inc()
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal data request: %w", err)
+	}
+	id, err := app.SessionManager.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: tenantKey(ctx, dataRequestsKey),
+		Values: map[string]interface{}{"data": data},
+	}).Result()
+	if err != nil {
+		return fmt.Errorf("failed to audit data request: %w", err)
+	}
+	request.ID = id
+	return nil
+}
+
+// DataRequests returns up to count of the tenant's data subject requests, newest first, before
+// the one with the given ID. With a subject, only requests about that customer are returned.
+func (app *Application) DataRequests(ctx context.Context, subject, before string, count int) ([]*DataRequest, error) {
+	end := "+"
+	if before != "" {
+		end = "(" + before
+	}
+
+	requests := []*DataRequest{}
+	for len(requests) < count {
+		entries, err := app.SessionManager.client.XRevRangeN(ctx, tenantKey(ctx, dataRequestsKey), end, "-", dataRequestPageSize).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read data requests: %w", err)
+		}
+		for _, entry := range entries {
+			data, _ := entry.Values["data"].(string)
+			var request DataRequest
+			if err := json.Unmarshal([]byte(data), &request); err != nil {
+				log.Printf("Skipping unreadable data request %s: %v", entry.ID, err)
+				continue
+			}
+			if subject != "" && request.Subject != subject {
+				continue
+			}
+			request.ID = entry.ID
+			requests = append(requests, &request)
+			if len(requests) == count {
+				break
+			}
+		}
+		if len(entries) < dataRequestPageSize {
+			break
+		}
+		end = "(" + entries[len(entries)-1].ID
+	}
+	return requests, nil
+}
+
+// exportUserData returns everything the tenant keeps about the customer in the path, as a JSON
+// file
+func (app *Application) exportUserData(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := c.Param("user_id")
+	request := &DataRequest{Action: "export", Subject: dataSubject(userID), RequestedAt: time.Now().UTC()}
+
+	data, location, err := app.ExportUserData(ctx, userID)
+	if err != nil {
+		request.Error = err.Error()
+		if err := app.auditDataRequest(c, request); err != nil {
+			log.Printf("Failed to audit data export: %v", err)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	request.Found = location.counts()
+	if err := app.auditDataRequest(c, request); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "user-data-"+request.Subject[:12]+".json"))
+	c.Header("X-Data-Request-ID", request.ID)
+	c.JSON(http.StatusOK, data)
+}
+
+// deleteUserData deletes everything the tenant keeps about the customer in the path and checks
+// that none of it is left
+func (app *Application) deleteUserData(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := c.Param("user_id")
+	request := &DataRequest{Action: "delete", Subject: dataSubject(userID), RequestedAt: time.Now().UTC()}
+
+	found, remaining, err := app.DeleteUserData(ctx, userID)
+	request.Found = found
+	if err != nil {
+		request.Error = err.Error()
+	} else {
+		request.Remaining = &remaining
+		request.Verified = remaining.empty()
+	}
+	if err := app.auditDataRequest(c, request); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch {
+	case request.Error != "":
+		c.JSON(http.StatusInternalServerError, gin.H{"error": request.Error, "request": request})
+	case !request.Verified:
+		c.JSON(http.StatusConflict, gin.H{"error": "some of the user's data is still stored; retry the deletion", "request": request})
+	default:
+		c.JSON(http.StatusOK, request)
+	}
+}
+
+// listDataRequests returns the tenant's audit trail of data subject requests
+func (app *Application) listDataRequests(c *gin.Context) {
+	count, err := strconv.Atoi(c.DefaultQuery("count", "50"))
+	if err != nil || count < 1 || count > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "count must be between 1 and 500"})
+		return
+	}
+	subject := c.Query("subject")
+	if userID := c.Query("user_id"); userID != "" {
+		subject = dataSubject(userID)
+	}
+
+	requests, err := app.DataRequests(c.Request.Context(), subject, c.Query("before"), count)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":         len(requests),
+		"data_requests": requests,
+	})
+}
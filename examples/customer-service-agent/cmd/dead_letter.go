@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deadLetterPageSize is how many dead-letter entries are read from Redis at a time
+const deadLetterPageSize = 200
+
+var queueDeadLetters = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_queue_dead_letters_total",
+		Help: "Queued messages moved to the dead-letter stream, by message type",
+	},
+	[]string{"type"},
+)
+
+func init() {
+	prometheus.MustRegister(queueDeadLetters)
+}
+
+// DeadLetter is a queued message that failed every attempt, or could not be decoded
+type DeadLetter struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	TenantID   string          `json:"tenant_id"`
+	Lane       string          `json:"lane"`
+	Attempts   int             `json:"attempts"`
+	Error      string          `json:"error"`
+	EnqueuedAt time.Time       `json:"enqueued_at"`
+	FailedAt   time.Time       `json:"failed_at"`
+	Data       json.RawMessage `json:"data"`
+
+	data string // as queued
+}
+
+// deadLetter moves a message to the dead-letter stream
+func (mq *MessageQueue) deadLetter(ctx context.Context, msg *QueuedMessage, cause error) error {
+	values := msg.values()
+	values["error"] = cause.Error()
+	values["failed_at"] = time.Now().Unix()
+
+	_, err := mq.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: mq.deadLetterName,
+			MaxLen: mq.maxLen,
+			Approx: true,
+			Values: values,
+		})
+		pipe.XAck(ctx, mq.lane(msg.Lane).stream, mq.groupName, msg.ID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to dead-letter message: %w", err)
+	}
+	queueDeadLetters.WithLabelValues(msg.Type).Inc()
+	return nil
+}
+
+// DeadLetters returns up to count dead-letter entries after the one with the given ID, oldest
+// first. With a tenant ID, only that tenant's entries are returned.
+func (mq *MessageQueue) DeadLetters(ctx context.Context, tenantID, after string, count int) ([]*DeadLetter, error) {
+	start := "-"
+	if after != "" {
+		start = "(" + after
+	}
+
+	letters := []*DeadLetter{}
+	for len(letters) < count {
+		entries, err := mq.client.XRangeN(ctx, mq.deadLetterName, start, "+", deadLetterPageSize).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dead letters: %w", err)
+		}
+		for _, entry := range entries {
+			letter := deadLetterEntry(entry)
+			if tenantID != "" && letter.TenantID != tenantID {
+				continue
+			}
+			letters = append(letters, letter)
+			if len(letters) == count {
+				break
+			}
+		}
+		if len(entries) < deadLetterPageSize {
+			break
+		}
+		start = "(" + entries[len(entries)-1].ID
+	}
+	return letters, nil
+}
+
+// DeadLetter returns a dead-letter entry, or nil when there is none by that ID
+func (mq *MessageQueue) DeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+	entries, err := mq.client.XRange(ctx, mq.deadLetterName, id, id).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letter: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return deadLetterEntry(entries[0]), nil
+}
+
+// deadLetterEntry reads an entry of the dead-letter stream
+func deadLetterEntry(entry redis.XMessage) *DeadLetter {
+	msg := queuedMessage(entry)
+	letter := &DeadLetter{
+		ID:         entry.ID,
+		Type:       msg.Type,
+		TenantID:   msg.TenantID,
+		Lane:       msg.Lane,
+		Attempts:   msg.Attempts,
+		EnqueuedAt: msg.Enqueued,
+		Data:       json.RawMessage(msg.Data),
+		data:       msg.Data,
+	}
+	if !json.Valid(letter.Data) {
+		letter.Data, _ = json.Marshal(msg.Data)
+	}
+	letter.Error, _ = entry.Values["error"].(string)
+	failedAt, _ := entry.Values["failed_at"].(string)
+	if unix, err := strconv.ParseInt(failedAt, 10, 64); err == nil {
+		letter.FailedAt = time.Unix(unix, 0)
+	}
+	return letter
+}
+
+// Replay puts a dead-letter entry back in its lane with its attempts reset
+func (mq *MessageQueue) Replay(ctx context.Context, letter *DeadLetter) error {
+	values := map[string]interface{}{
+		"type":     letter.Type,
+		"data":     letter.data,
+		"ts":       letter.EnqueuedAt.Unix(),
+		"tenant":   letter.TenantID,
+		"lane":     letter.Lane,
+		"attempts": 0,
+	}
+	_, err := mq.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: mq.lane(letter.Lane).stream, MaxLen: mq.maxLen, Approx: true, Values: values})
+		pipe.XDel(ctx, mq.deadLetterName, letter.ID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replay dead letter: %w", err)
+	}
+	return nil
+}
+
+// Purge deletes dead-letter entries
+func (mq *MessageQueue) Purge(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := mq.client.XDel(ctx, mq.deadLetterName, ids...).Err(); err != nil {
+		return fmt.Errorf("failed to purge dead letters: %w", err)
+	}
+	return nil
+}
+
+// DeadLetterCount returns the number of entries in the dead-letter stream
+func (mq *MessageQueue) DeadLetterCount(ctx context.Context) (int64, error) {
+	count, err := mq.client.XLen(ctx, mq.deadLetterName).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count dead letters: %w", err)
+	}
+	return count, nil
+}
+
+// deadLetterTenant returns the tenant whose dead letters a caller may see: their own for tenant
+// API keys and callers naming a tenant in X-Tenant-ID, or "" for every tenant's
+func deadLetterTenant(c *gin.Context) string {
+	if tenantAPIKey(c) || c.GetHeader("X-Tenant-ID") != "" {
+		return tenantFrom(c.Request.Context()).ID
+	}
+	return ""
+}
+
+// findDeadLetter returns the dead letter in the path, replying 404 when the caller may not see it
+func (app *Application) findDeadLetter(c *gin.Context) *DeadLetter {
+	letter, err := app.MessageQueue.DeadLetter(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil
+	}
+	if tenantID := deadLetterTenant(c); letter == nil || (tenantID != "" && letter.TenantID != tenantID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "dead letter not found"})
+		return nil
+	}
+	return letter
+}
+
+// listDeadLetters returns dead-letter entries, oldest first. Pass the last ID of a page as after
+// for the next.
+func (app *Application) listDeadLetters(c *gin.Context) {
+	count, err := strconv.Atoi(c.DefaultQuery("count", "50"))
+	if err != nil || count < 1 || count > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "count must be between 1 and 500"})
+		return
+	}
+
+	letters, err := app.MessageQueue.DeadLetters(c.Request.Context(), deadLetterTenant(c), c.Query("after"), count)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":        len(letters),
+		"dead_letters": letters,
+	})
+}
+
+// getDeadLetter returns the dead-letter entry in the path
+func (app *Application) getDeadLetter(c *gin.Context) {
+	if letter := app.findDeadLetter(c); letter != nil {
+		c.JSON(http.StatusOK, letter)
+	}
+}
+
+// replayDeadLetter puts the dead-letter entry in the path back on the queue
+func (app *Application) replayDeadLetter(c *gin.Context) {
+	letter := app.findDeadLetter(c)
+	if letter == nil {
+		return
+	}
+	if err := app.MessageQueue.Replay(c.Request.Context(), letter); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "dead letter replayed"})
+}
+
+// purgeDeadLetter deletes the dead-letter entry in the path
+func (app *Application) purgeDeadLetter(c *gin.Context) {
+	letter := app.findDeadLetter(c)
+	if letter == nil {
+		return
+	}
+	if err := app.MessageQueue.Purge(c.Request.Context(), letter.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "dead letter purged"})
+}
+
+// replayDeadLetters puts every dead-letter entry the caller may see back on the queue
+func (app *Application) replayDeadLetters(c *gin.Context) {
+	app.eachDeadLetter(c, "replayed", func(ctx context.Context, letters []*DeadLetter) error {
+		for _, letter := range letters {
+			if err := app.MessageQueue.Replay(ctx, letter); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// purgeDeadLetters deletes every dead-letter entry the caller may see
+func (app *Application) purgeDeadLetters(c *gin.Context) {
+	app.eachDeadLetter(c, "purged", func(ctx context.Context, letters []*DeadLetter) error {
+		ids := make([]string, len(letters))
+		for i, letter := range letters {
+			ids[i] = letter.ID
+		}
+		return app.MessageQueue.Purge(ctx, ids...)
+	})
+}
+
+// eachDeadLetter passes the dead letters the caller may see to apply a page at a time, replying
+// with how many there were
+func (app *Application) eachDeadLetter(c *gin.Context, done string, apply func(ctx context.Context, letters []*DeadLetter) error) {
+	ctx := c.Request.Context()
+	tenantID := deadLetterTenant(c)
+	total, after := 0, ""
+	for {
+		letters, err := app.MessageQueue.DeadLetters(ctx, tenantID, after, deadLetterPageSize)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), done: total})
+			return
+		}
+		if len(letters) == 0 {
+			break
+		}
+		if err := apply(ctx, letters); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), done: total})
+			return
+		}
+		total += len(letters)
+		after = letters[len(letters)-1].ID
+	}
+
+	c.JSON(http.StatusOK, gin.H{done: total})
+}
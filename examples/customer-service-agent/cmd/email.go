@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/smtp"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	_ "github.com/emersion/go-message/charset" // decode non-UTF-8 mail
+	"github.com/emersion/go-message/mail"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Email polling settings
+const (
+	emailFetchBatch = 50                  // messages fetched per poll
+	emailThreadTTL  = 30 * 24 * time.Hour // how long replies are matched to their thread
+	emailMaxSize    = 10 << 20            // larger messages are skipped
+)
+
+var emailMessages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_email_messages_total",
+		Help: "Support emails received and sent, by direction and status",
+	},
+	[]string{"direction", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(emailMessages)
+}
+
+// EmailConfig holds the support mailbox and how replies are sent
+type EmailConfig struct {
+	IMAPAddr     string // host:port of the IMAP server, over TLS
+	SMTPAddr     string // host:port of the SMTP submission server, with STARTTLS
+	Username     string
+	Password     string
+	Mailbox      string
+	From         string // the address replies come from, e.g. "Acme Support <support@acme.com>"
+	Signature    string
+	EscalationCC string // comma-separated addresses copied on escalated replies
+	PollInterval time.Duration
+}
+
+// EmailConnector answers a support mailbox: it polls for new mail over IMAP, queues each message
+// for the agent, and sends the answers over SMTP
+type EmailConnector struct {
+	config       EmailConfig
+	from         *mail.Address
+	escalationCC []*mail.Address
+	queue        *MessageQueue
+	redis        *redis.Client
+}
+
+// EmailMessage is a customer email, with the session of the thread it belongs to
+type EmailMessage struct {
+	SessionID  string   `json:"session_id"`
+	MessageID  string   `json:"message_id"`
+	References []string `json:"references,omitempty"`
+	From       string   `json:"from"`
+	FromName   string   `json:"from_name,omitempty"`
+	Subject    string   `json:"subject"`
+	Text       string   `json:"text"`
+}
+
+// NewEmailConnector creates a connector for the mailbox in config. Redis maps message IDs to
+// threads and makes sure only one replica polls at a time.
+func NewEmailConnector(config EmailConfig, queue *MessageQueue, redisClient *redis.Client) (*EmailConnector, error) {
+	if config.IMAPAddr == "" || config.SMTPAddr == "" || config.Username == "" {
+		return nil, fmt.Errorf("EMAIL_IMAP_ADDR, EMAIL_SMTP_ADDR, and EMAIL_USERNAME are required")
+	}
+	if config.From == "" {
+		config.From = config.Username
+	}
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EMAIL_FROM: %w", err)
+	}
+	var escalationCC []*mail.Address
+	if strings.TrimSpace(config.EscalationCC) != "" {
+		escalationCC, err = mail.ParseAddressList(config.EscalationCC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EMAIL_ESCALATION_CC: %w", err)
+		}
+	}
+	if config.Mailbox == "" {
+		config.Mailbox = "INBOX"
+	}
+
+	return &EmailConnector{
+		config:       config,
+		from:         from,
+		escalationCC: escalationCC,
+		queue:        queue,
+		redis:        redisClient,
+	}, nil
+}
+
+// Start polls the mailbox in the background until ctx is done
+func (e *EmailConnector) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(e.config.PollInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := e.poll(ctx); err != nil {
+				log.Printf("Email poll failed: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// poll queues the unread messages in the mailbox and marks them read
+func (e *EmailConnector) poll(ctx context.Context) error {
+	// One replica polls at a time, so a message is not answered twice
+	locked, err := e.redis.SetNX(ctx, "email:poll:lock", 1, e.config.PollInterval).Result()
+	if err != nil {
+		return fmt.Errorf("failed to take poll lock: %w", err)
+	}
+	if !locked {
+		return nil
+	}
+	defer e.redis.Del(ctx, "email:poll:lock")
+
+	c, err := client.DialTLS(e.config.IMAPAddr, nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect to imap server: %w", err)
+	}
+	defer c.Logout()
+
+	if err := c.Login(e.config.Username, e.config.Password); err != nil {
+		return fmt.Errorf("imap login failed: %w", err)
+	}
+	if _, err := c.Select(e.config.Mailbox, false); err != nil {
+		return fmt.Errorf("failed to select %s: %w", e.config.Mailbox, err)
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return fmt.Errorf("imap search failed: %w", err)
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+	if len(uids) > emailFetchBatch {
+		uids = uids[:emailFetchBatch]
+	}
+
+	fetchSet := new(imap.SeqSet)
+	fetchSet.AddNum(uids...)
+	section := &imap.BodySectionName{Peek: true}
+	messages := make(chan *imap.Message, emailFetchBatch)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(fetchSet, []imap.FetchItem{section.FetchItem(), imap.FetchUid, imap.FetchRFC822Size}, messages)
+	}()
+
+	handled := new(imap.SeqSet)
+	for msg := range messages {
+		if msg.Size > emailMaxSize {
+			log.Printf("Email: skipping message %d of %d bytes", msg.Uid, msg.Size)
+			handled.AddNum(msg.Uid)
+			continue
+		}
+		body := msg.GetBody(section)
+		if body == nil {
+			continue
+		}
+		if err := e.receive(ctx, body); err != nil {
+			// Left unread, so the next poll tries it again
+			log.Printf("Email: failed to queue message %d: %v", msg.Uid, err)
+			emailMessages.WithLabelValues("inbound", "error").Inc()
+			continue
+		}
+		handled.AddNum(msg.Uid)
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("imap fetch failed: %w", err)
+	}
+
+	if handled.Empty() {
+		return nil
+	}
+	flags := []interface{}{imap.SeenFlag}
+	if err := c.UidStore(handled, imap.FormatFlagsOp(imap.AddFlags, true), flags, nil); err != nil {
+		return fmt.Errorf("failed to mark messages read: %w", err)
+	}
+	return nil
+}
+
+// receive parses a raw message and queues it for the agent. Automatic mail, such as bounces,
+// out-of-office replies, and mailing lists, is dropped so the agent never argues with a robot.
+func (e *EmailConnector) receive(ctx context.Context, raw io.Reader) error {
+	reader, err := mail.CreateReader(raw)
+	if err != nil {
+		emailMessages.WithLabelValues("inbound", "invalid").Inc()
+		log.Printf("Email: skipping unparseable message: %v", err)
+		return nil
+	}
+	header := reader.Header
+
+	from, err := header.AddressList("From")
+	if err != nil || len(from) == 0 {
+		emailMessages.WithLabelValues("inbound", "invalid").Inc()
+		return nil
+	}
+	replyTo, _ := header.AddressList("Reply-To")
+	if len(replyTo) > 0 {
+		from = replyTo
+	}
+	if isAutomaticEmail(header, from[0].Address, e.from.Address) {
+		emailMessages.WithLabelValues("inbound", "automatic").Inc()
+		return nil
+	}
+
+	messageID, _ := header.MessageID()
+	if messageID == "" {
+		messageID = fmt.Sprintf("%s-%d", from[0].Address, time.Now().UnixNano())
+	}
+	// The mailbox can be read by several connectors, or a message copied back to the inbox
+	first, err := e.redis.SetNX(ctx, "email:seen:"+messageID, 1, emailThreadTTL).Result()
+	if err != nil {
+		return fmt.Errorf("failed to record message: %w", err)
+	}
+	if !first {
+		return nil
+	}
+
+	references, _ := header.MsgIDList("References")
+	inReplyTo, _ := header.MsgIDList("In-Reply-To")
+	subject, _ := header.Subject()
+
+	text, err := emailText(reader)
+	if err != nil {
+		return err
+	}
+
+	sessionID, err := e.threadSession(ctx, messageID, append(inReplyTo, references...))
+	if err != nil {
+		return err
+	}
+
+	msg := &EmailMessage{
+		SessionID:  sessionID,
+		MessageID:  messageID,
+		References: append(references, messageID),
+		From:       from[0].Address,
+		FromName:   from[0].Name,
+		Subject:    subject,
+		Text:       stripQuotedReply(text),
+	}
+	if msg.Text == "" {
+		emailMessages.WithLabelValues("inbound", "empty").Inc()
+		return nil
+	}
+
+	if err := e.queue.Enqueue(ctx, msg); err != nil {
+		// Let the next poll try again
+		e.redis.Del(ctx, "email:seen:"+messageID)
+		return err
+	}
+	emailMessages.WithLabelValues("inbound", "success").Inc()
+	return nil
+}
+
+// threadSession returns the session of the thread a message replies to, found through the
+// message IDs it references, or starts a session for a new thread
+func (e *EmailConnector) threadSession(ctx context.Context, messageID string, referenced []string) (string, error) {
+	sessionID := ""
+	for _, id := range referenced {
+		existing, err := e.redis.Get(ctx, "email:thread:"+id).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to look up thread: %w", err)
+		}
+		sessionID = existing
+		break
+	}
+	if sessionID == "" {
+		sessionID = "email-" + sourceID(messageID)
+	}
+
+	if err := e.redis.Set(ctx, "email:thread:"+messageID, sessionID, emailThreadTTL).Err(); err != nil {
+		return "", fmt.Errorf("failed to record thread: %w", err)
+	}
+	return sessionID, nil
+}
+
+// Reply answers a customer email in its thread. Escalated replies copy the escalation list,
+// who can take the conversation over by replying all.
+func (e *EmailConnector) Reply(ctx context.Context, msg *EmailMessage, response *ChatMessageResponse) error {
+	var header mail.Header
+	header.SetDate(time.Now())
+	header.SetAddressList("From", []*mail.Address{e.from})
+	header.SetAddressList("To", []*mail.Address{{Name: msg.FromName, Address: msg.From}})
+	recipients := []string{msg.From}
+
+	body := response.Message
+	if response.ShouldEscalate && len(e.escalationCC) > 0 {
+		header.SetAddressList("Cc", e.escalationCC)
+		for _, address := range e.escalationCC {
+			recipients = append(recipients, address.Address)
+		}
+		body += "\n\nI've copied our support team, who will follow up with you."
+	}
+	if e.config.Signature != "" {
+		body += "\n\n-- \n" + e.config.Signature
+	}
+
+	subject := msg.Subject
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+	header.SetSubject(subject)
+	header.SetMsgIDList("In-Reply-To", []string{msg.MessageID})
+	header.SetMsgIDList("References", msg.References)
+	domain := e.from.Address[strings.LastIndex(e.from.Address, "@")+1:]
+	if err := header.GenerateMessageIDWithHostname(domain); err != nil {
+		return fmt.Errorf("failed to generate message id: %w", err)
+	}
+	header.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	header.Set("Auto-Submitted", "auto-replied")
+
+	var data bytes.Buffer
+	writer, err := mail.CreateSingleInlineWriter(&data, header)
+	if err != nil {
+		return fmt.Errorf("failed to write reply: %w", err)
+	}
+	io.WriteString(writer, body)
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to write reply: %w", err)
+	}
+
+	host := e.config.SMTPAddr
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	auth := smtp.PlainAuth("", e.config.Username, e.config.Password, host)
+	if err := smtp.SendMail(e.config.SMTPAddr, auth, e.from.Address, recipients, data.Bytes()); err != nil {
+		emailMessages.WithLabelValues("outbound", "error").Inc()
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+	emailMessages.WithLabelValues("outbound", "success").Inc()
+
+	// The customer's answer to this reply belongs to the same thread
+	replyID, _ := header.MessageID()
+	if err := e.redis.Set(ctx, "email:thread:"+replyID, msg.SessionID, emailThreadTTL).Err(); err != nil {
+		log.Printf("Email: failed to record thread of reply: %v", err)
+	}
+	return nil
+}
+
+// isAutomaticEmail reports whether a message was sent by a machine rather than a customer
+func isAutomaticEmail(header mail.Header, from, self string) bool {
+	from = strings.ToLower(from)
+	if from == strings.ToLower(self) {
+		return true
+	}
+	for _, prefix := range []string{"mailer-daemon@", "postmaster@", "no-reply@", "noreply@", "do-not-reply@"} {
+		if strings.HasPrefix(from, prefix) {
+			return true
+		}
+	}
+	if auto := strings.ToLower(header.Get("Auto-Submitted")); auto != "" && auto != "no" {
+		return true
+	}
+	switch strings.ToLower(header.Get("Precedence")) {
+	case "bulk", "junk", "list", "auto_reply":
+		return true
+	}
+	return header.Get("List-Id") != "" || header.Get("X-Autoreply") != "" || header.Get("X-Autorespond") != ""
+}
+
+// emailText returns the text of a message: its first text/plain part, or its first text/html
+// part converted to text
+func emailText(reader *mail.Reader) (string, error) {
+	var htmlBody string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read message: %w", err)
+		}
+
+		inline, ok := part.Header.(*mail.InlineHeader)
+		if !ok {
+			continue // attachments
+		}
+		contentType, _, _ := mime.ParseMediaType(inline.Get("Content-Type"))
+		if contentType == "" {
+			contentType = "text/plain"
+		}
+		data, err := io.ReadAll(io.LimitReader(part.Body, emailMaxSize))
+		if err != nil {
+			return "", fmt.Errorf("failed to read message part: %w", err)
+		}
+
+		switch contentType {
+		case "text/plain":
+			return strings.ReplaceAll(string(data), "\r\n", "\n"), nil
+		case "text/html":
+			if htmlBody == "" {
+				htmlBody = string(data)
+			}
+		}
+	}
+	return htmlText(htmlBody), nil
+}
+
+var (
+	// Lines that introduce the quoted message in a reply
+	emailQuoteHeader = regexp.MustCompile(`(?i)^(on .+ wrote:|-+ ?original message ?-+|_{10,}|from: .+|le .+ a écrit ?:|am .+ schrieb .+:|el .+ escribió:)$`)
+	// Mobile and webmail signatures
+	emailSentFrom = regexp.MustCompile(`(?i)^(sent from my .+|get outlook for .+)$`)
+)
+
+// stripQuotedReply removes the quoted history and signature from a reply, leaving what the
+// customer just wrote
+func stripQuotedReply(text string) string {
+	lines := strings.Split(text, "\n")
+	var kept []string
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		if trimmed == "--" || emailSentFrom.MatchString(trimmed) {
+			break
+		}
+		if emailQuoteHeader.MatchString(trimmed) {
+			break
+		}
+		// Clients wrap long "On <date>, <name> wrote:" lines
+		if strings.HasPrefix(strings.ToLower(trimmed), "on ") && i+1 < len(lines) &&
+			emailQuoteHeader.MatchString(trimmed+" "+strings.TrimSpace(lines[i+1])) {
+			break
+		}
+		kept = append(kept, line)
+	}
+	return normalizeText(strings.Join(kept, "\n"))
+}
+
+// processEmailMessage answers a customer email in its thread
+func (app *Application) processEmailMessage(ctx context.Context, msg *EmailMessage) error {
+	// Convert to chat message
+	req := &ChatMessageRequest{
+		SessionID: msg.SessionID,
+		Message:   msg.Text,
+		UserID:    msg.From,
+		Channel:   "email",
+		Metadata: map[string]interface{}{
+			"subject":    msg.Subject,
+			"message_id": msg.MessageID,
+			"from_name":  msg.FromName,
+		},
+		Source: msg,
+	}
+	if len(req.Message) > 4000 {
+		// Long emails are mostly pasted logs; the start carries the question
+		cut := 4000
+		for !utf8.RuneStart(req.Message[cut]) {
+			cut--
+		}
+		req.Message = req.Message[:cut]
+	}
+	if err := req.Validate(); err != nil {
+		return err
+	}
+
+	// Process with agent
+	startTime := time.Now()
+	response, err := app.AgentService.ProcessMessage(ctx, req)
+	messageLatency.WithLabelValues(req.Channel).Observe(time.Since(startTime).Seconds())
+	if errors.Is(err, ErrHandedOff) {
+		// A human agent answers from the console
+		return nil
+	}
+	if err != nil {
+		messagesProcessed.WithLabelValues("error", req.Channel).Inc()
+		return err
+	}
+	messagesProcessed.WithLabelValues("success", req.Channel).Inc()
+	sentimentDistribution.WithLabelValues(response.Sentiment).Inc()
+
+	// Send response back by email
+	return app.Email.Reply(ctx, msg, response)
+}
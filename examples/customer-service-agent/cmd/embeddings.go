@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Embedding input types; some providers embed queries and documents differently
+const (
+	EmbedDocument = "document"
+	EmbedQuery    = "query"
+)
+
+// Chunking settings for article content, in characters
+const (
+	chunkSize    = 1200
+	chunkOverlap = 200
+)
+
+var (
+	kbChunksEmbedded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "csr_kb_chunks_embedded_total",
+			Help: "Knowledge base chunks embedded and stored, by status",
+		},
+		[]string{"status"},
+	)
+
+	embeddingRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "csr_embedding_requests_total",
+			Help: "Requests to the embedding provider, by provider and status",
+		},
+		[]string{"provider", "status"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(kbChunksEmbedded)
+	prometheus.MustRegister(embeddingRequests)
+}
+
+// Embedder turns text into vectors
+type Embedder interface {
+	// Name identifies the provider in logs and metrics
+	Name() string
+	// Embed returns one vector per text, in order
+	Embed(ctx context.Context, texts []string, inputType string) ([][]float32, error)
+}
+
+// NewEmbedder creates the embedder for a provider: "voyage", "openai", or "local" for a
+// self-hosted text-embeddings-inference server at url. An empty provider disables embeddings.
+func NewEmbedder(provider, apiKey, model, url string) (Embedder, error) {
+	client := &http.Client{Timeout: 60 * time.Second}
+
+	switch provider {
+	case "":
+		return nil, nil
+	case "voyage":
+		if model == "" {
+			model = "voyage-3"
+		}
+		return &voyageEmbedder{apiKey: apiKey, model: model, httpClient: client}, nil
+	case "openai":
+		if model == "" {
+			model = "text-embedding-3-small"
+		}
+		return &openAIEmbedder{apiKey: apiKey, model: model, httpClient: client}, nil
+	case "local":
+		if url == "" {
+			return nil, fmt.Errorf("EMBEDDING_URL is required for the local embedding provider")
+		}
+		return &localEmbedder{url: strings.TrimSuffix(url, "/"), httpClient: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown embedding provider %q", provider)
+	}
+}
+
+// providerError is a failed embedding or rerank request; rate limits and server errors are retried
+type providerError struct {
+	status     int
+	retryAfter time.Duration
+	body       string
+}
+
+func (e *providerError) Error() string {
+	return fmt.Sprintf("provider request failed (status %d): %s", e.status, e.body)
+}
+
+func (e *providerError) retryable() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+// postProvider sends a request to an embedding or rerank API and decodes the JSON response into out
+func postProvider(ctx context.Context, client *http.Client, url, apiKey string, body interface{}, out interface{}) error {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		provErr := &providerError{status: resp.StatusCode, body: string(data)}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			provErr.retryAfter = time.Duration(seconds) * time.Second
+		}
+		return provErr
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// voyageEmbedder uses the Voyage AI embeddings API
+type voyageEmbedder struct {
+	apiKey     string
+	model      string
+	httpClient *http.Client
+}
+
+func (e *voyageEmbedder) Name() string { return "voyage" }
+
+func (e *voyageEmbedder) Embed(ctx context.Context, texts []string, inputType string) ([][]float32, error) {
+	var resp struct {
+		Data []struct {
+			Embedding []float32 `json:"embedding"`
+			Index     int       `json:"index"`
+		} `json:"data"`
+	}
+	body := map[string]interface{}{"input": texts, "model": e.model, "input_type": inputType}
+	if err := postProvider(ctx, e.httpClient, "https://api.voyageai.com/v1/embeddings", e.apiKey, body, &resp); err != nil {
+		return nil, err
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, item := range resp.Data {
+		if item.Index >= 0 && item.Index < len(vectors) {
+			vectors[item.Index] = item.Embedding
+		}
+	}
+	return vectors, checkVectors(vectors)
+}
+
+// openAIEmbedder uses the OpenAI embeddings API
+type openAIEmbedder struct {
+	apiKey     string
+	model      string
+	httpClient *http.Client
+}
+
+func (e *openAIEmbedder) Name() string { return "openai" }
+
+func (e *openAIEmbedder) Embed(ctx context.Context, texts []string, inputType string) ([][]float32, error) {
+	var resp struct {
+		Data []struct {
+			Embedding []float32 `json:"embedding"`
+			Index     int       `json:"index"`
+		} `json:"data"`
+	}
+	body := map[string]interface{}{"input": texts, "model": e.model}
+	if err := postProvider(ctx, e.httpClient, "https://api.openai.com/v1/embeddings", e.apiKey, body, &resp); err != nil {
+		return nil, err
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, item := range resp.Data {
+		if item.Index >= 0 && item.Index < len(vectors) {
+			vectors[item.Index] = item.Embedding
+		}
+	}
+	return vectors, checkVectors(vectors)
+}
+
+// localEmbedder uses a self-hosted Hugging Face text-embeddings-inference server
+type localEmbedder struct {
+	url        string
+	httpClient *http.Client
+}
+
+func (e *localEmbedder) Name() string { return "local" }
+
+func (e *localEmbedder) Embed(ctx context.Context, texts []string, inputType string) ([][]float32, error) {
+	var vectors [][]float32
+	body := map[string]interface{}{"inputs": texts, "truncate": true}
+	if err := postProvider(ctx, e.httpClient, e.url+"/embed", "", body, &vectors); err != nil {
+		return nil, err
+	}
+	if len(vectors) != len(texts) {
+		return nil, fmt.Errorf("embedding server returned %d vectors for %d texts", len(vectors), len(texts))
+	}
+	return vectors, checkVectors(vectors)
+}
+
+// checkVectors reports a provider response that left texts without a vector
+func checkVectors(vectors [][]float32) error {
+	for i, vector := range vectors {
+		if len(vector) == 0 {
+			return fmt.Errorf("no embedding returned for text %d", i)
+		}
+	}
+	return nil
+}
+
+// ArticleChunk is a piece of an article that is embedded on its own
+type ArticleChunk struct {
+	ArticleID string
+	Index     int
+	Title     string
+	Category  string
+	URL       string
+	Text      string
+}
+
+// chunkArticle splits an article into overlapping chunks, breaking at paragraph or sentence ends
+// where possible so each chunk reads on its own
+func chunkArticle(article *KBArticleDocument) []ArticleChunk {
+	content := strings.TrimSpace(article.Content)
+	if content == "" {
+		content = article.Title
+	}
+
+	var chunks []ArticleChunk
+	for start := 0; start < len(content); {
+		end := start + chunkSize
+		if end >= len(content) {
+			end = len(content)
+		} else {
+			end = chunkBreak(content, start, end)
+		}
+
+		chunks = append(chunks, ArticleChunk{
+			ArticleID: article.ID,
+			Index:     len(chunks),
+			Title:     article.Title,
+			Category:  article.Category,
+			URL:       article.URL,
+			Text:      strings.TrimSpace(content[start:end]),
+		})
+		if end == len(content) {
+			break
+		}
+
+		// Start the next chunk a little before this one ended, at a word boundary
+		next := end - chunkOverlap
+		for next > start && next < end && !unicode.IsSpace(rune(content[next])) {
+			next++
+		}
+		if next <= start || next >= end {
+			next = end
+		}
+		start = next
+	}
+	return chunks
+}
+
+// chunkBreak finds where to end a chunk between start and limit: the last paragraph break, else
+// the last sentence end, else the last space in the second half of the chunk
+func chunkBreak(content string, start, limit int) int {
+	window := content[start:limit]
+	half := len(window) / 2
+
+	if i := strings.LastIndex(window, "\n\n"); i > half {
+		return start + i + 2
+	}
+	for _, end := range []string{". ", "? ", "! ", ".\n"} {
+		if i := strings.LastIndex(window, end); i > half {
+			return start + i + len(end)
+		}
+	}
+	if i := strings.LastIndexByte(window, ' '); i > half {
+		return start + i + 1
+	}
+	return limit
+}
+
+// embeddingText is what is embedded for a chunk; the title gives short chunks their context
+func (c *ArticleChunk) embeddingText() string {
+	return c.Title + "\n\n" + c.Text
+}
+
+// EmbeddingPipeline chunks articles, embeds the chunks in batches, and stores the vectors
+type EmbeddingPipeline struct {
+	embedder   Embedder
+	store      *VectorStore
+	batchSize  int
+	maxRetries int
+}
+
+// NewEmbeddingPipeline creates a pipeline that embeds batchSize chunks per request
+func NewEmbeddingPipeline(embedder Embedder, store *VectorStore, batchSize int) *EmbeddingPipeline {
+	if batchSize < 1 {
+		batchSize = 64
+	}
+	return &EmbeddingPipeline{
+		embedder:   embedder,
+		store:      store,
+		batchSize:  batchSize,
+		maxRetries: 5,
+	}
+}
+
+// Embedder returns the pipeline's embedder
+func (p *EmbeddingPipeline) Embedder() Embedder {
+	return p.embedder
+}
+
+// Store returns the vector store the pipeline writes to
+func (p *EmbeddingPipeline) Store() *VectorStore {
+	return p.store
+}
+
+// Process embeds the articles and replaces their stored chunks, calling onBatch with the number
+// of chunks embedded or failed after each batch. A batch that still fails after retries is
+// skipped so one bad batch does not stop a large import; the error returned reports how many
+// chunks were lost.
+func (p *EmbeddingPipeline) Process(ctx context.Context, articles []KBArticleDocument, onBatch func(embedded, failed int)) error {
+	var chunks []ArticleChunk
+	for i := range articles {
+		chunks = append(chunks, chunkArticle(&articles[i])...)
+	}
+
+	// Drop the old chunks first; an edited article may now have fewer
+	articleIDs := make([]string, len(articles))
+	for i, article := range articles {
+		articleIDs[i] = article.ID
+	}
+	if err := p.store.DeleteArticles(ctx, articleIDs); err != nil {
+		return fmt.Errorf("failed to remove old chunks: %w", err)
+	}
+
+	failed := 0
+	for start := 0; start < len(chunks); start += p.batchSize {
+		end := start + p.batchSize
+		if end > len(chunks) {
+			end = len(chunks)
+		}
+		batch := chunks[start:end]
+
+		if err := p.processBatch(ctx, batch); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Embedding batch of %d chunks failed: %v", len(batch), err)
+			failed += len(batch)
+			kbChunksEmbedded.WithLabelValues("error").Add(float64(len(batch)))
+			onBatch(0, len(batch))
+			continue
+		}
+
+		kbChunksEmbedded.WithLabelValues("success").Add(float64(len(batch)))
+		onBatch(len(batch), 0)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d chunks could not be embedded", failed, len(chunks))
+	}
+	return nil
+}
+
+// processBatch embeds one batch, retrying with exponential backoff, and stores the vectors
+func (p *EmbeddingPipeline) processBatch(ctx context.Context, batch []ArticleChunk) error {
+	texts := make([]string, len(batch))
+	for i := range batch {
+		texts[i] = batch[i].embeddingText()
+	}
+
+	var vectors [][]float32
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		var err error
+		vectors, err = p.embedder.Embed(ctx, texts, EmbedDocument)
+		if err == nil {
+			embeddingRequests.WithLabelValues(p.embedder.Name(), "success").Inc()
+			break
+		}
+		embeddingRequests.WithLabelValues(p.embedder.Name(), "error").Inc()
+
+		wait := backoff
+		if provErr, ok := err.(*providerError); ok {
+			if !provErr.retryable() {
+				return err
+			}
+			if provErr.retryAfter > wait {
+				wait = provErr.retryAfter
+			}
+		}
+		if attempt >= p.maxRetries {
+			return err
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+
+	return p.store.Upsert(ctx, batch, vectors)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Escalation ticket settings
+const (
+	ticketTimeout            = 10 * time.Second // the customer's answer waits on the ticket
+	ticketMetadataKey        = "escalation_ticket_id"
+	defaultTicketMessage     = "I've opened ticket {ticket_id} for you, and our support team will follow up there."
+	ticketSubjectMaxRunes    = 120
+	ticketTranscriptMessages = 20 // latest messages included in a ticket
+)
+
+var escalationTickets = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_escalation_tickets_total",
+		Help: "Tickets opened for escalated conversations, by backend and result",
+	},
+	[]string{"backend", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(escalationTickets)
+}
+
+// EscalationTicket is a ticket opened for an escalated conversation
+type EscalationTicket struct {
+	SessionID  string           `json:"session_id"`
+	TenantID   string           `json:"tenant_id"`
+	Channel    string           `json:"channel"`
+	Customer   TicketCustomer   `json:"customer"`
+	Subject    string           `json:"subject"`
+	Summary    string           `json:"summary"` // the escalation summary human agents see
+	Issue      string           `json:"issue,omitempty"`
+	Reason     string           `json:"reason,omitempty"`
+	Sentiment  string           `json:"sentiment"`
+	Priority   string           `json:"priority"` // low, normal, high, or urgent
+	Intent     string           `json:"intent,omitempty"`
+	Tags       []string         `json:"tags,omitempty"`
+	Transcript []SessionMessage `json:"transcript"`
+}
+
+// TicketCustomer is who an escalation ticket is for
+type TicketCustomer struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name,omitempty"`
+	Email  string `json:"email,omitempty"`
+}
+
+// TicketBackend opens tickets in a ticketing system
+type TicketBackend interface {
+	// CreateTicket opens a ticket and returns the ID the customer refers to it by
+	CreateTicket(ctx context.Context, ticket *EscalationTicket) (string, error)
+}
+
+// TicketConfig configures the tickets opened when the agent escalates
+type TicketConfig struct {
+	Backend  string   // zendesk or webhook
+	Channels []string // channels whose escalations get a ticket
+	Message  string   // added to the answer; {ticket_id} is replaced with the ticket's ID
+}
+
+// TicketOpener opens a ticket when a conversation on one of its channels is escalated, through
+// the tenant's Zendesk account or the deployment's ticketing backend
+type TicketOpener struct {
+	backend  string
+	zendesk  *ZendeskClient // the deployment's account, when the backend is zendesk
+	webhook  *TicketWebhook // when the backend is webhook
+	channels map[string]bool
+	message  string
+}
+
+// NewTicketOpener creates an opener for the backend in config. Tenants with their own Zendesk
+// account get tickets there when the backend is zendesk; zendesk may be nil when every tenant
+// that escalates has one.
+func NewTicketOpener(config TicketConfig, zendesk *ZendeskClient, webhook *TicketWebhook) (*TicketOpener, error) {
+	switch config.Backend {
+	case "zendesk":
+	case "webhook":
+		if webhook == nil {
+			return nil, fmt.Errorf("ESCALATION_TICKET_WEBHOOK_URL is required for webhook tickets")
+		}
+	default:
+		return nil, fmt.Errorf("unknown ticket backend %q", config.Backend)
+	}
+
+	o := &TicketOpener{
+		backend:  config.Backend,
+		zendesk:  zendesk,
+		webhook:  webhook,
+		channels: map[string]bool{},
+		message:  config.Message,
+	}
+	for _, channel := range config.Channels {
+		if channel = strings.TrimSpace(channel); channel != "" {
+			o.channels[channel] = true
+		}
+	}
+	if o.message == "" {
+		o.message = defaultTicketMessage
+	}
+	return o, nil
+}
+
+// backendFor returns the backend that opens the tenant's tickets, or nil when it has none
+func (o *TicketOpener) backendFor(ctx context.Context) TicketBackend {
+	if o.backend == "webhook" {
+		return o.webhook
+	}
+	if client := tenantFrom(ctx).zendesk; client != nil {
+		return client
+	}
+	if o.zendesk != nil {
+		return o.zendesk
+	}
+	return nil
+}
+
+// covers reports whether escalations on a channel get a ticket
+func (o *TicketOpener) covers(channel string) bool {
+	return o.channels[channelName(channel)]
+}
+
+// notice is what the answer tells the customer about their ticket
+func (o *TicketOpener) notice(ticketID string) string {
+	return strings.ReplaceAll(o.message, "{ticket_id}", ticketID)
+}
+
+// openTicket opens a ticket for an escalated conversation, unless it has one, and returns its
+// ID. It returns "" when the channel gets no tickets or the ticket could not be opened; the
+// escalation goes on without one.
+func (s *AgentService) openTicket(ctx context.Context, req *ChatMessageRequest, turn *chatTurn, session *Session, handoff *Handoff) string {
+	if s.tickets == nil || session == nil || !s.tickets.covers(req.Channel) {
+		return ""
+	}
+	if ticketID, _ := session.Metadata[ticketMetadataKey].(string); ticketID != "" {
+		return ticketID
+	}
+	backend := s.tickets.backendFor(ctx)
+	if backend == nil {
+		return ""
+	}
+
+	ticket := &EscalationTicket{
+		SessionID: req.SessionID,
+		TenantID:  tenantFrom(ctx).ID,
+		Channel:   channelName(req.Channel),
+		Customer:  TicketCustomer{UserID: req.UserID},
+		Summary:   handoff.Summary,
+		Reason:    handoff.Reason,
+		Sentiment: turn.sentiment,
+		Priority:  suggestedPriority(handoff.Priority, turn.sentiment),
+		Intent:    turn.intent.name(),
+		Tags:      sessionTags(session),
+	}
+	ticket.Customer.Name, _ = req.Metadata["user_name"].(string)
+	ticket.Customer.Email, _ = req.Metadata["user_email"].(string)
+	if summary := sessionSummary(session); summary != nil {
+		ticket.Issue = summary.Issue
+	}
+	ticket.Subject = ticket.Issue
+	if ticket.Subject == "" {
+		ticket.Subject = req.Message
+	}
+	ticket.Subject = truncateText(strings.Join(strings.Fields(ticket.Subject), " "), ticketSubjectMaxRunes)
+	ticket.Transcript = session.Messages
+	if len(ticket.Transcript) > ticketTranscriptMessages {
+		ticket.Transcript = ticket.Transcript[len(ticket.Transcript)-ticketTranscriptMessages:]
+	}
+
+	ticketCtx, cancel := context.WithTimeout(ctx, ticketTimeout)
+	defer cancel()
+	ticketID, err := backend.CreateTicket(ticketCtx, ticket)
+	if err != nil {
+		escalationTickets.WithLabelValues(s.tickets.backend, "error").Inc()
+		log.Printf("Failed to open ticket for session %s: %v", req.SessionID, err)
+		return ""
+	}
+	escalationTickets.WithLabelValues(s.tickets.backend, "opened").Inc()
+
+	if err := s.sessionManager.SetMetadata(ctx, req.SessionID, req.UserID, map[string]interface{}{ticketMetadataKey: ticketID}); err != nil {
+		log.Printf("Failed to record ticket %s of session %s: %v", ticketID, req.SessionID, err)
+	}
+	return ticketID
+}
+
+// suggestedPriority is the priority Claude asked for, or one suited to the customer's sentiment
+func suggestedPriority(priority, sentiment string) string {
+	if zendeskPriorities[priority] {
+		return priority
+	}
+	switch sentiment {
+	case "urgent":
+		return "urgent"
+	case "negative":
+		return "high"
+	}
+	return "normal"
+}
+
+// CreateTicket opens a Zendesk ticket for an escalated conversation, with the escalation summary
+// and transcript as an internal note, in the escalation group
+func (c *ZendeskClient) CreateTicket(ctx context.Context, ticket *EscalationTicket) (string, error) {
+	var body strings.Builder
+	fmt.Fprintf(&body, "Escalated by the AI agent from a %s conversation (session %s).\n", ticket.Channel, ticket.SessionID)
+	fmt.Fprintf(&body, "Customer: %s", ticket.Customer.UserID)
+	if ticket.Customer.Email != "" {
+		fmt.Fprintf(&body, " <%s>", ticket.Customer.Email)
+	}
+	fmt.Fprintf(&body, "\nSentiment: %s. Suggested priority: %s.\n\n%s\n\nTranscript:\n", ticket.Sentiment, ticket.Priority, ticket.Summary)
+	for _, msg := range ticket.Transcript {
+		fmt.Fprintf(&body, "%s: %s\n", msg.Role, msg.Content)
+	}
+
+	requester := &ZendeskRequester{Name: ticket.Customer.Name, Email: ticket.Customer.Email}
+	if requester.Name == "" {
+		requester.Name = ticket.Customer.UserID
+	}
+	tags := append([]string{}, ticket.Tags...)
+	if c.config.EscalationTag != "" {
+		tags = append(tags, c.config.EscalationTag)
+	}
+
+	id, err := c.OpenTicket(ctx, &ZendeskNewTicket{
+		Subject:    ticket.Subject,
+		Comment:    ZendeskComment{Body: body.String(), Public: false},
+		Requester:  requester,
+		Priority:   ticket.Priority,
+		GroupID:    c.config.EscalationGroupID,
+		Tags:       tags,
+		ExternalID: ticket.SessionID,
+	})
+	if err != nil {
+		return "", err
+	}
+	return "#" + strconv.FormatInt(id, 10), nil
+}
+
+// channelName is the channel of a conversation; chat API callers that name none are web chats
+func channelName(channel string) string {
+	if channel == "" {
+		return "web"
+	}
+	return channel
+}
+
+// TicketWebhook opens tickets by posting them to a URL, for ticketing systems without a built-in
+// backend. The endpoint answers with the ticket's ID: {"id": "..."}.
+type TicketWebhook struct {
+	url        string
+	token      string
+	httpClient *http.Client
+}
+
+// NewTicketWebhook creates a backend posting tickets to url, with token as a bearer token when
+// it is set
+func NewTicketWebhook(url, token string) *TicketWebhook {
+	return &TicketWebhook{
+		url:   url,
+		token: token,
+		httpClient: &http.Client{
+			Timeout: ticketTimeout,
+		},
+	}
+}
+
+// CreateTicket posts the ticket and returns the ID in the response
+func (w *TicketWebhook) CreateTicket(ctx context.Context, ticket *EscalationTicket) (string, error) {
+	data, err := json.Marshal(ticket)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal ticket: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to call ticket webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("ticket webhook error (status %d): %s", resp.StatusCode, string(data))
+	}
+
+	var created struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", fmt.Errorf("failed to decode ticket webhook response: %w", err)
+	}
+	// IDs may be strings or numbers
+	var id string
+	if err := json.Unmarshal(created.ID, &id); err != nil {
+		id = string(created.ID)
+	}
+	if id == "" || id == "null" {
+		return "", fmt.Errorf("ticket webhook returned no ticket id")
+	}
+	return id, nil
+}
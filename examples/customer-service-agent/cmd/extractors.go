@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/html"
+)
+
+// pdfSectionSize is roughly how much PDF text goes into one article, in characters
+const pdfSectionSize = 6000
+
+// extractedDocument is text extracted from a page or file, before it becomes an article
+type extractedDocument struct {
+	Key     string // stable within the source: the page URL or the file section
+	Title   string
+	Content string
+	URL     string
+}
+
+// htmlSkipped are elements whose text is page chrome or code rather than content
+var htmlSkipped = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true, "svg": true,
+	"nav": true, "header": true, "footer": true, "aside": true, "form": true,
+	"button": true, "iframe": true,
+}
+
+// htmlBlocks are elements that end a line of text
+var htmlBlocks = map[string]bool{
+	"p": true, "div": true, "section": true, "article": true, "main": true, "li": true,
+	"ul": true, "ol": true, "table": true, "tr": true, "br": true, "hr": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"pre": true, "blockquote": true, "dd": true, "dt": true,
+}
+
+// extractHTML returns a page's title, its main text, and the links on it resolved against base.
+// The text comes from <main> or <article> when the page has one, so navigation and footers
+// repeated on every page of a help center are not indexed.
+func extractHTML(data []byte, base *url.URL) (string, string, []string, error) {
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to parse html: %w", err)
+	}
+
+	var title, heading string
+	var main, body *html.Node
+	var links []string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "title":
+				if title == "" {
+					title = nodeText(n)
+				}
+			case "h1":
+				if heading == "" {
+					heading = nodeText(n)
+				}
+			case "main", "article":
+				if main == nil {
+					main = n
+				}
+			case "body":
+				body = n
+			case "a":
+				for _, attr := range n.Attr {
+					if attr.Key != "href" {
+						continue
+					}
+					if link, err := base.Parse(attr.Val); err == nil {
+						links = append(links, link.String())
+					}
+				}
+			}
+			for _, attr := range n.Attr {
+				if attr.Key == "role" && attr.Val == "main" && main == nil {
+					main = n
+				}
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(doc)
+
+	root := main
+	if root == nil {
+		root = body
+	}
+	if root == nil {
+		root = doc
+	}
+
+	var text strings.Builder
+	writeHTMLText(&text, root)
+
+	// Page titles usually carry the site name too; the page's own heading is cleaner
+	if heading != "" {
+		title = heading
+	}
+	return strings.TrimSpace(title), normalizeText(text.String()), links, nil
+}
+
+// htmlText returns the plain text of an HTML fragment, such as a message body
+func htmlText(body string) string {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return strings.TrimSpace(body)
+	}
+	var text strings.Builder
+	writeHTMLText(&text, doc)
+	return normalizeText(text.String())
+}
+
+// writeHTMLText writes the text under n, breaking lines at block elements
+func writeHTMLText(text *strings.Builder, n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		text.WriteString(n.Data)
+		return
+	case html.ElementNode:
+		if htmlSkipped[n.Data] {
+			return
+		}
+		if htmlBlocks[n.Data] {
+			text.WriteString("\n")
+			defer text.WriteString("\n")
+		}
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		writeHTMLText(text, child)
+	}
+}
+
+// nodeText returns the text under n on one line
+func nodeText(n *html.Node) string {
+	var text strings.Builder
+	writeHTMLText(&text, n)
+	return strings.Join(strings.Fields(text.String()), " ")
+}
+
+// normalizeText collapses runs of spaces within lines and keeps at most one blank line between
+// paragraphs
+func normalizeText(text string) string {
+	var paragraphs []string
+	var current []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" {
+			if len(current) > 0 {
+				paragraphs = append(paragraphs, strings.Join(current, "\n"))
+				current = nil
+			}
+			continue
+		}
+		current = append(current, line)
+	}
+	if len(current) > 0 {
+		paragraphs = append(paragraphs, strings.Join(current, "\n"))
+	}
+	return strings.Join(paragraphs, "\n\n")
+}
+
+// sitemap is a sitemap or a sitemap index
+type sitemap struct {
+	XMLName xml.Name
+	URLs    []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// parseSitemap returns the page URLs of a sitemap and the sitemaps listed by a sitemap index
+func parseSitemap(data []byte) ([]string, []string, error) {
+	var sm sitemap
+	if err := xml.Unmarshal(data, &sm); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse sitemap: %w", err)
+	}
+
+	var pages, sitemaps []string
+	for _, entry := range sm.URLs {
+		if loc := strings.TrimSpace(entry.Loc); loc != "" {
+			pages = append(pages, loc)
+		}
+	}
+	for _, entry := range sm.Sitemaps {
+		if loc := strings.TrimSpace(entry.Loc); loc != "" {
+			sitemaps = append(sitemaps, loc)
+		}
+	}
+	return pages, sitemaps, nil
+}
+
+// extractPDF returns a PDF's text in sections of a few pages each
+func extractPDF(data []byte, fileName string) (docs []extractedDocument, err error) {
+	// The PDF reader panics on some malformed files
+	defer func() {
+		if r := recover(); r != nil {
+			docs, err = nil, fmt.Errorf("failed to read pdf: %v", r)
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pdf: %w", err)
+	}
+
+	title := strings.TrimSuffix(fileName, path.Ext(fileName))
+	var section strings.Builder
+	firstPage := 1
+	flush := func(lastPage int) {
+		content := normalizeText(section.String())
+		section.Reset()
+		if content == "" {
+			return
+		}
+		sectionTitle := fmt.Sprintf("%s (page %d)", title, firstPage)
+		if lastPage > firstPage {
+			sectionTitle = fmt.Sprintf("%s (pages %d-%d)", title, firstPage, lastPage)
+		}
+		docs = append(docs, extractedDocument{
+			Key:     fmt.Sprintf("%s#%d", fileName, firstPage),
+			Title:   sectionTitle,
+			Content: content,
+		})
+	}
+
+	pages := reader.NumPage()
+	for i := 1; i <= pages; i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		text, err := page.GetPlainText(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read page %d: %w", i, err)
+		}
+		if section.Len() == 0 {
+			firstPage = i
+		}
+		section.WriteString(text)
+		section.WriteString("\n\n")
+		if section.Len() >= pdfSectionSize {
+			flush(i)
+		}
+	}
+	flush(pages)
+
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("no text found in pdf; scanned documents need OCR first")
+	}
+	return docs, nil
+}
+
+var (
+	mdFrontMatterTitle = regexp.MustCompile(`(?m)^title:\s*["']?(.+?)["']?\s*$`)
+	mdHeading          = regexp.MustCompile(`^(#{1,2})\s+(.+?)\s*#*\s*$`)
+	mdImage            = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	mdLink             = regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`)
+	mdEmphasis         = regexp.MustCompile("(\\*\\*|__|\\*|`)")
+	mdHTMLTag          = regexp.MustCompile(`</?[a-zA-Z][^>]*>`)
+)
+
+// extractMarkdown splits a Markdown document into one section per top-level heading, with the
+// formatting removed. Documents without such headings become a single section.
+func extractMarkdown(data []byte, fileName string) ([]extractedDocument, error) {
+	content := strings.ReplaceAll(string(data), "\r\n", "\n")
+
+	title := strings.TrimSuffix(fileName, path.Ext(fileName))
+	if strings.HasPrefix(content, "---\n") {
+		if end := strings.Index(content[4:], "\n---"); end >= 0 {
+			if match := mdFrontMatterTitle.FindStringSubmatch(content[4 : 4+end]); match != nil {
+				title = match[1]
+			}
+			content = content[4+end+4:]
+		}
+	}
+
+	type section struct {
+		title string
+		lines []string
+	}
+	sections := []section{{title: title}}
+	inCode := false
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCode = !inCode
+			continue
+		}
+		if !inCode {
+			if match := mdHeading.FindStringSubmatch(line); match != nil {
+				heading := stripMarkdown(match[2])
+				if len(match[1]) == 1 && len(sections) == 1 && len(strings.TrimSpace(strings.Join(sections[0].lines, ""))) == 0 {
+					// A leading H1 names the document
+					title = heading
+					sections[0].title = heading
+					continue
+				}
+				sections = append(sections, section{title: title + ": " + heading})
+				continue
+			}
+			line = stripMarkdown(line)
+		}
+		last := &sections[len(sections)-1]
+		last.lines = append(last.lines, line)
+	}
+
+	var docs []extractedDocument
+	for i, s := range sections {
+		text := normalizeText(strings.Join(s.lines, "\n"))
+		if text == "" {
+			continue
+		}
+		docs = append(docs, extractedDocument{
+			Key:     fmt.Sprintf("%s#%d", fileName, i),
+			Title:   s.title,
+			Content: text,
+		})
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("no text found in markdown file")
+	}
+	return docs, nil
+}
+
+// stripMarkdown removes inline Markdown formatting from a line
+func stripMarkdown(line string) string {
+	trimmed := strings.TrimLeft(line, " ")
+	for _, bullet := range []string{"* ", "+ "} {
+		if strings.HasPrefix(trimmed, bullet) {
+			line = "- " + trimmed[len(bullet):]
+		}
+	}
+	for _, prefix := range []string{"> ", "###### ", "##### ", "#### ", "### "} {
+		if strings.HasPrefix(trimmed, prefix) {
+			line = trimmed[len(prefix):]
+		}
+	}
+
+	line = mdImage.ReplaceAllString(line, "$1")
+	line = mdLink.ReplaceAllString(line, "$1")
+	line = mdHTMLTag.ReplaceAllString(line, "")
+	return mdEmphasis.ReplaceAllString(line, "")
+}
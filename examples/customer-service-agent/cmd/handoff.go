@@ -0,0 +1,575 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Handoff statuses
+const (
+	HandoffQueued  = "queued"  // waiting for a human agent
+	HandoffClaimed = "claimed" // a human agent is answering
+)
+
+// Handoff storage settings
+const (
+	handoffQueueKey  = "handoff:queue"  // sorted set of queued sessions, most urgent first
+	handoffActiveKey = "handoff:active" // set of queued and claimed sessions
+	handoffClaimsKey = "handoff:claims" // sorted set of recent claims by time, for estimating waits
+	handoffTTL       = 24 * time.Hour   // same as sessions
+	claimRateWindow  = time.Hour        // claims that estimate how fast the queue moves
+)
+
+// handoffPriorities orders the queue; unknown priorities count as normal
+var handoffPriorities = map[string]int{"urgent": 0, "high": 1, "normal": 2, "low": 3}
+
+var (
+	// ErrHandedOff is returned for messages in sessions a human agent is answering. The message is
+	// kept in the session history for the agent, and the AI does not answer.
+	ErrHandedOff = errors.New("session is handed off to a human agent")
+
+	errHandoffTaken = errors.New("handoff is already claimed")
+)
+
+var (
+	handoffEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "csr_handoffs_total",
+			Help: "Handoffs to human agents, by event",
+		},
+		[]string{"event"},
+	)
+
+	handoffWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "csr_handoff_wait_seconds",
+			Help:    "Time handed-off sessions wait for a human agent to claim them",
+			Buckets: prometheus.ExponentialBuckets(15, 2, 10),
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(handoffEvents)
+	prometheus.MustRegister(handoffWait)
+}
+
+// Handoff is a session handed from the AI to human agents
+type Handoff struct {
+	SessionID   string     `json:"session_id"`
+	UserID      string     `json:"user_id"`
+	Channel     string     `json:"channel"`
+	Status      string     `json:"status"`
+	Reason      string     `json:"reason,omitempty"`
+	Priority    string     `json:"priority"`
+	Sentiment   string     `json:"sentiment"`
+	Summary     string     `json:"summary"`                // context for the agent who picks it up
+	TicketID    string     `json:"ticket_id,omitempty"`    // opened for the escalation, when its channel gets tickets
+	OutOfHours  bool       `json:"out_of_hours,omitempty"` // requested while human agents were offline
+	Callback    *Callback  `json:"callback,omitempty"`     // the customer asked to be called back
+	RequestedAt time.Time  `json:"requested_at"`
+	AgentID     string     `json:"agent_id,omitempty"`
+	ClaimedAt   *time.Time `json:"claimed_at,omitempty"`
+
+	Conversation *SessionSummary `json:"conversation,omitempty"` // the session's summary, filled in from the session when returned
+}
+
+// HandoffQueue holds the sessions handed to human agents, shared by every replica through Redis
+type HandoffQueue struct {
+	client *redis.Client
+}
+
+// NewHandoffQueue creates a queue stored in Redis
+func NewHandoffQueue(client *redis.Client) *HandoffQueue {
+	return &HandoffQueue{client: client}
+}
+
+// Request queues a session for human agents. A session already handed off stays where it is in
+// the queue.
+func (q *HandoffQueue) Request(ctx context.Context, handoff *Handoff) error {
+	handoff.Status = HandoffQueued
+	handoff.RequestedAt = time.Now()
+	if _, ok := handoffPriorities[handoff.Priority]; !ok {
+		handoff.Priority = "normal"
+	}
+
+	data, err := json.Marshal(handoff)
+	if err != nil {
+		return fmt.Errorf("failed to marshal handoff: %w", err)
+	}
+	created, err := q.client.SetNX(ctx, q.key(ctx, handoff.SessionID), data, handoffTTL).Result()
+	if err != nil {
+		return fmt.Errorf("failed to save handoff: %w", err)
+	}
+	if !created {
+		return nil
+	}
+
+	// Most urgent first, then longest waiting
+	score := float64(handoffPriorities[handoff.Priority])*1e13 + float64(handoff.RequestedAt.UnixMilli())
+	pipe := q.client.TxPipeline()
+	pipe.ZAdd(ctx, tenantKey(ctx, handoffQueueKey), &redis.Z{Score: score, Member: handoff.SessionID})
+	pipe.SAdd(ctx, tenantKey(ctx, handoffActiveKey), handoff.SessionID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to queue handoff: %w", err)
+	}
+
+	handoffEvents.WithLabelValues("requested").Inc()
+	return nil
+}
+
+// List returns the queued handoffs, most urgent first, followed by the claimed ones
+func (q *HandoffQueue) List(ctx context.Context) ([]*Handoff, error) {
+	sessionIDs, err := q.client.SMembers(ctx, tenantKey(ctx, handoffActiveKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list handoffs: %w", err)
+	}
+
+	handoffs := make([]*Handoff, 0, len(sessionIDs))
+	for _, sessionID := range sessionIDs {
+		handoff, err := q.Get(ctx, sessionID)
+		if err != nil {
+			return nil, err
+		}
+		if handoff == nil {
+			// Expired with its session
+			q.client.SRem(ctx, tenantKey(ctx, handoffActiveKey), sessionID)
+			q.client.ZRem(ctx, tenantKey(ctx, handoffQueueKey), sessionID)
+			continue
+		}
+		handoffs = append(handoffs, handoff)
+	}
+
+	sort.Slice(handoffs, func(i, j int) bool {
+		a, b := handoffs[i], handoffs[j]
+		if a.Status != b.Status {
+			return a.Status == HandoffQueued
+		}
+		if a.Priority != b.Priority {
+			return handoffPriorities[a.Priority] < handoffPriorities[b.Priority]
+		}
+		return a.RequestedAt.Before(b.RequestedAt)
+	})
+	return handoffs, nil
+}
+
+// Claim assigns a queued session to a human agent. Only one agent can claim a session; the
+// others get errHandoffTaken.
+func (q *HandoffQueue) Claim(ctx context.Context, sessionID, agentID string) (*Handoff, error) {
+	handoff, err := q.Get(ctx, sessionID)
+	if err != nil || handoff == nil {
+		return nil, err
+	}
+	removed, err := q.client.ZRem(ctx, tenantKey(ctx, handoffQueueKey), sessionID).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim handoff: %w", err)
+	}
+	if removed == 0 {
+		return nil, errHandoffTaken
+	}
+	return q.claimed(ctx, handoff, agentID)
+}
+
+// ClaimNext assigns the most urgent queued session to a human agent, or returns nil when the
+// queue is empty
+func (q *HandoffQueue) ClaimNext(ctx context.Context, agentID string) (*Handoff, error) {
+	for {
+		popped, err := q.client.ZPopMin(ctx, tenantKey(ctx, handoffQueueKey)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to claim handoff: %w", err)
+		}
+		if len(popped) == 0 {
+			return nil, nil
+		}
+		sessionID, _ := popped[0].Member.(string)
+		handoff, err := q.Get(ctx, sessionID)
+		if err != nil {
+			return nil, err
+		}
+		if handoff == nil {
+			// Expired with its session
+			q.client.SRem(ctx, tenantKey(ctx, handoffActiveKey), sessionID)
+			continue
+		}
+		return q.claimed(ctx, handoff, agentID)
+	}
+}
+
+// claimed records that an agent claimed a handoff taken off the queue
+func (q *HandoffQueue) claimed(ctx context.Context, handoff *Handoff, agentID string) (*Handoff, error) {
+	now := time.Now()
+	handoff.Status = HandoffClaimed
+	handoff.AgentID = agentID
+	handoff.ClaimedAt = &now
+	if err := q.save(ctx, handoff); err != nil {
+		return nil, err
+	}
+
+	handoffEvents.WithLabelValues("claimed").Inc()
+	handoffWait.Observe(now.Sub(handoff.RequestedAt).Seconds())
+
+	pipe := q.client.TxPipeline()
+	pipe.ZAdd(ctx, tenantKey(ctx, handoffClaimsKey), &redis.Z{
+		Score:  float64(now.UnixMilli()),
+		Member: fmt.Sprintf("%s:%d", handoff.SessionID, now.UnixMilli()),
+	})
+	pipe.ZRemRangeByScore(ctx, tenantKey(ctx, handoffClaimsKey), "-inf", fmt.Sprintf("(%d", now.Add(-claimRateWindow).UnixMilli()))
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record claim of session %s: %v", handoff.SessionID, err)
+	}
+	return handoff, nil
+}
+
+// Waiting returns how many sessions are queued for human agents
+func (q *HandoffQueue) Waiting(ctx context.Context) (int64, error) {
+	waiting, err := q.client.ZCard(ctx, tenantKey(ctx, handoffQueueKey)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count handoffs: %w", err)
+	}
+	return waiting, nil
+}
+
+// Position returns a queued session's place in the queue, counting from 1, or 0 when it is not
+// queued
+func (q *HandoffQueue) Position(ctx context.Context, sessionID string) (int64, error) {
+	rank, err := q.client.ZRank(ctx, tenantKey(ctx, handoffQueueKey), sessionID).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to find handoff: %w", err)
+	}
+	return rank + 1, nil
+}
+
+// EstimatedWait estimates how long the session at a place in the queue waits for an agent, from
+// how many sessions agents claimed in the last hour. It returns 0 when none were claimed.
+func (q *HandoffQueue) EstimatedWait(ctx context.Context, position int64) (time.Duration, error) {
+	since := time.Now().Add(-claimRateWindow).UnixMilli()
+	claims, err := q.client.ZCount(ctx, tenantKey(ctx, handoffClaimsKey), strconv.FormatInt(since, 10), "+inf").Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count claims: %w", err)
+	}
+	if claims == 0 || position <= 0 {
+		return 0, nil
+	}
+	return claimRateWindow * time.Duration(position) / time.Duration(claims), nil
+}
+
+// Resolve ends a session's handoff, if it has one; the AI answers the session's next message
+func (q *HandoffQueue) Resolve(ctx context.Context, sessionID string) error {
+	pipe := q.client.TxPipeline()
+	deleted := pipe.Del(ctx, q.key(ctx, sessionID))
+	pipe.ZRem(ctx, tenantKey(ctx, handoffQueueKey), sessionID)
+	pipe.SRem(ctx, tenantKey(ctx, handoffActiveKey), sessionID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to resolve handoff: %w", err)
+	}
+
+	if deleted.Val() > 0 {
+		handoffEvents.WithLabelValues("resolved").Inc()
+	}
+	return nil
+}
+
+// Get returns the handoff of a session, or nil when the AI is answering it
+func (q *HandoffQueue) Get(ctx context.Context, sessionID string) (*Handoff, error) {
+	data, err := q.client.Get(ctx, q.key(ctx, sessionID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get handoff: %w", err)
+	}
+
+	var handoff Handoff
+	if err := json.Unmarshal(data, &handoff); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal handoff: %w", err)
+	}
+	return &handoff, nil
+}
+
+func (q *HandoffQueue) save(ctx context.Context, handoff *Handoff) error {
+	data, err := json.Marshal(handoff)
+	if err != nil {
+		return fmt.Errorf("failed to marshal handoff: %w", err)
+	}
+	if err := q.client.Set(ctx, q.key(ctx, handoff.SessionID), data, handoffTTL).Err(); err != nil {
+		return fmt.Errorf("failed to save handoff: %w", err)
+	}
+	return nil
+}
+
+func (q *HandoffQueue) key(ctx context.Context, sessionID string) string {
+	return tenantKey(ctx, "handoff:"+sessionID)
+}
+
+// handoffSummary describes a session for the human agent who picks it up
+func handoffSummary(session *Session, reason, sentiment string, toolCalls []ToolCallRecord) string {
+	var summary strings.Builder
+	if reason == "" {
+		reason = "not given"
+	}
+	fmt.Fprintf(&summary, "Escalation reason: %s. Customer sentiment: %s.", strings.TrimSuffix(reason, "."), sentiment)
+
+	var customer []string
+	for _, msg := range session.Messages {
+		if msg.Role == "user" {
+			customer = append(customer, msg.Content)
+		}
+	}
+	if len(customer) > 0 {
+		fmt.Fprintf(&summary, " %d customer messages since %s.", len(customer), session.StartedAt.Format(time.RFC1123))
+		fmt.Fprintf(&summary, " First: %q.", truncateText(customer[0], 300))
+		if len(customer) > 1 {
+			fmt.Fprintf(&summary, " Latest: %q.", truncateText(customer[len(customer)-1], 300))
+		}
+	}
+
+	if len(toolCalls) > 0 {
+		var names []string
+		for _, call := range toolCalls {
+			if call.Name != "escalate_to_human" {
+				names = append(names, call.Name)
+			}
+		}
+		if len(names) > 0 {
+			fmt.Fprintf(&summary, " Tools used: %s.", strings.Join(names, ", "))
+		}
+	}
+	return summary.String()
+}
+
+// truncateText shortens text to at most limit runes
+func truncateText(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit]) + "…"
+}
+
+// HandoffAgentRequest identifies the human agent making a console request
+type HandoffAgentRequest struct {
+	AgentID string `json:"agent_id" binding:"required"`
+	Message string `json:"message"`
+}
+
+// listHandoffs returns the queued and claimed handoffs
+func (app *Application) listHandoffs(c *gin.Context) {
+	handoffs, err := app.Handoffs.List(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	app.attachConversations(c.Request.Context(), handoffs...)
+
+	queued := 0
+	for _, handoff := range handoffs {
+		if handoff.Status == HandoffQueued {
+			queued++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"handoffs": handoffs,
+		"queued":   queued,
+		"claimed":  len(handoffs) - queued,
+	})
+}
+
+// claimNextHandoff assigns the most urgent queued session to the requesting agent
+func (app *Application) claimNextHandoff(c *gin.Context) {
+	var req HandoffAgentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "agent_id is required"})
+		return
+	}
+
+	handoff, err := app.Handoffs.ClaimNext(c.Request.Context(), req.AgentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if handoff == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no sessions are waiting"})
+		return
+	}
+	app.recordHandoffAgent(c.Request.Context(), handoff)
+	app.attachConversations(c.Request.Context(), handoff)
+
+	c.JSON(http.StatusOK, handoff)
+}
+
+// recordHandoffAgent notes in the session which human agent claimed it, so satisfaction survey
+// answers are credited to them
+func (app *Application) recordHandoffAgent(ctx context.Context, handoff *Handoff) {
+	values := map[string]interface{}{"human_agent_id": handoff.AgentID}
+	if err := app.SessionManager.SetMetadata(ctx, handoff.SessionID, handoff.UserID, values); err != nil {
+		log.Printf("Failed to record agent of session %s: %v", handoff.SessionID, err)
+	}
+	app.AgentService.analytics.RecordHumanHandled(ctx, handoff.SessionID)
+}
+
+// attachConversations adds the sessions' summaries to handoffs, for the agents deciding which to
+// take and picking them up
+func (app *Application) attachConversations(ctx context.Context, handoffs ...*Handoff) {
+	for _, handoff := range handoffs {
+		if session, err := app.SessionManager.Get(ctx, handoff.SessionID); err == nil && session != nil {
+			handoff.Conversation = sessionSummary(session)
+		}
+	}
+}
+
+// getHandoff returns a handoff with the session's full history
+func (app *Application) getHandoff(c *gin.Context) {
+	ctx := c.Request.Context()
+	sessionID := c.Param("session_id")
+
+	handoff, err := app.Handoffs.Get(ctx, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if handoff == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session is not handed off"})
+		return
+	}
+	session, err := app.SessionManager.Get(ctx, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if session == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	handoff.Conversation = sessionSummary(session)
+
+	c.JSON(http.StatusOK, gin.H{
+		"handoff":  handoff,
+		"messages": session.Messages,
+		"metadata": session.Metadata,
+	})
+}
+
+// claimHandoff assigns a queued session to the requesting agent
+func (app *Application) claimHandoff(c *gin.Context) {
+	var req HandoffAgentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "agent_id is required"})
+		return
+	}
+
+	handoff, err := app.Handoffs.Claim(c.Request.Context(), c.Param("session_id"), req.AgentID)
+	if err == errHandoffTaken {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if handoff == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session is not handed off"})
+		return
+	}
+	app.recordHandoffAgent(c.Request.Context(), handoff)
+	app.attachConversations(c.Request.Context(), handoff)
+
+	c.JSON(http.StatusOK, handoff)
+}
+
+// sendHandoffMessage sends the claiming agent's message to the customer
+func (app *Application) sendHandoffMessage(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req HandoffAgentRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Message) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "agent_id and message are required"})
+		return
+	}
+
+	handoff, err := app.Handoffs.Get(ctx, c.Param("session_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if handoff == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session is not handed off"})
+		return
+	}
+	if handoff.Status != HandoffClaimed || handoff.AgentID != req.AgentID {
+		c.JSON(http.StatusConflict, gin.H{"error": "claim the session before messaging the customer"})
+		return
+	}
+	session, err := app.SessionManager.Get(ctx, handoff.SessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if session == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+
+	if err := app.SessionManager.AddMessage(ctx, session.SessionID, "agent", req.Message); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	app.AgentService.refreshSummary(ctx, session.SessionID, false)
+	if err := app.sendToCustomer(ctx, session, "agent", req.Message); err != nil {
+		log.Printf("Failed to deliver agent message in session %s: %v", session.SessionID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to deliver message: %v", err)})
+		return
+	}
+
+	handoffEvents.WithLabelValues("agent_message").Inc()
+	c.JSON(http.StatusOK, gin.H{"status": "sent"})
+}
+
+// resolveHandoff ends a handoff, handing the session back to the AI
+func (app *Application) resolveHandoff(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req HandoffAgentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "agent_id is required"})
+		return
+	}
+
+	handoff, err := app.Handoffs.Get(ctx, c.Param("session_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if handoff == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session is not handed off"})
+		return
+	}
+	if handoff.Status == HandoffClaimed && handoff.AgentID != req.AgentID {
+		c.JSON(http.StatusConflict, gin.H{"error": "session is claimed by another agent"})
+		return
+	}
+
+	if err := app.Handoffs.Resolve(ctx, handoff.SessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	app.AgentService.analytics.RecordEnd(ctx, handoff.SessionID)
+	if session, err := app.SessionManager.Get(ctx, handoff.SessionID); err == nil {
+		app.archiveConversation(ctx, session)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "resolved"})
+}
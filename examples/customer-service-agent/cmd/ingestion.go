@@ -0,0 +1,746 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Ingestion source types
+const (
+	SourceURL      = "url"      // a help-center page, crawled within its site and path
+	SourceSitemap  = "sitemap"  // every page listed in a sitemap or sitemap index
+	SourcePDF      = "pdf"      // an uploaded PDF
+	SourceMarkdown = "markdown" // an uploaded Markdown file
+)
+
+// Ingestion settings
+const (
+	ingestionSourcesKey = "kb:sources" // Redis hash of source ID to IngestionSource
+	defaultMaxPages     = 200
+	maxPagesLimit       = 5000
+	maxPageSize         = 5 << 20
+	maxUploadSize       = 20 << 20
+	crawlDelay          = 250 * time.Millisecond // between page fetches, to be polite to the site
+	maxStatusErrors     = 10
+)
+
+var errFetchBlocked = errors.New("refusing to fetch a private or reserved address")
+
+var kbIngestedDocuments = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_kb_ingested_documents_total",
+		Help: "Pages and files read by knowledge base ingestion, by source type and status",
+	},
+	[]string{"type", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(kbIngestedDocuments)
+}
+
+// IngestionSource is a place knowledge base articles come from
+type IngestionSource struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	URL       string          `json:"url,omitempty"`       // url and sitemap sources
+	FileName  string          `json:"file_name,omitempty"` // uploaded files
+	Category  string          `json:"category,omitempty"`
+	Tags      []string        `json:"tags,omitempty"`
+	MaxPages  int             `json:"max_pages,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	Status    IngestionStatus `json:"status"`
+}
+
+// IngestionStatus reports the last ingestion of a source
+type IngestionStatus struct {
+	State      string     `json:"state"`     // pending, running, completed, or failed
+	Documents  int        `json:"documents"` // pages or file sections read
+	Articles   int        `json:"articles"`  // articles indexed
+	Failed     int        `json:"failed"`    // pages that could not be fetched or read
+	Removed    int        `json:"removed"`   // articles gone from the source since the last run
+	Errors     []string   `json:"errors,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// addError records a page failure, keeping the first few messages
+func (s *IngestionStatus) addError(err error) {
+	s.Failed++
+	if len(s.Errors) < maxStatusErrors {
+		s.Errors = append(s.Errors, err.Error())
+	}
+}
+
+// Ingestor fills the knowledge base from help-center sites, sitemaps, and uploaded files
+type Ingestor struct {
+	kb         *KnowledgeBase
+	client     *redis.Client
+	httpClient *http.Client
+	interval   time.Duration
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+// NewIngestor creates an ingestor that keeps its sources in Redis and re-crawls url and sitemap
+// sources every interval; zero disables re-crawling
+func NewIngestor(kb *KnowledgeBase, client *redis.Client, interval time.Duration) *Ingestor {
+	// Addresses are checked as each connection is dialed, so every page, sitemap, and redirect hop
+	// is covered, and a name can't resolve to a public address when checked and a private one when
+	// fetched
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicAddress(host) {
+				return errFetchBlocked
+			}
+			return nil
+		},
+	}
+	return &Ingestor{
+		kb:     kb,
+		client: client,
+		httpClient: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 10 * time.Second},
+		},
+		interval: interval,
+		running:  make(map[string]bool),
+	}
+}
+
+// Start re-crawls url and sitemap sources periodically
+func (in *Ingestor) Start(ctx context.Context) {
+	if in.interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(in.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sources, err := in.Sources(ctx)
+				if err != nil {
+					log.Printf("Failed to list ingestion sources: %v", err)
+					continue
+				}
+				for _, source := range sources {
+					if source.Type == SourceURL || source.Type == SourceSitemap {
+						in.Ingest(ctx, source.ID)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// AddSource validates and saves a url or sitemap source, then starts ingesting it
+func (in *Ingestor) AddSource(ctx context.Context, source *IngestionSource) error {
+	if source.Type != SourceURL && source.Type != SourceSitemap {
+		return fmt.Errorf("type must be %q or %q; upload files instead", SourceURL, SourceSitemap)
+	}
+	u, err := url.Parse(source.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https url")
+	}
+	if err := checkPublicHost(ctx, u.Hostname()); err != nil {
+		return err
+	}
+	if source.MaxPages <= 0 {
+		source.MaxPages = defaultMaxPages
+	}
+	if source.MaxPages > maxPagesLimit {
+		return fmt.Errorf("max_pages cannot exceed %d", maxPagesLimit)
+	}
+
+	// Adding a url again replaces its settings and re-crawls it
+	source.ID = sourceID(source.Type + ":" + u.String())
+	source.CreatedAt = time.Now()
+	source.Status = IngestionStatus{State: "pending"}
+	if !in.claim(ctx, source.ID) {
+		return fmt.Errorf("%s is already being ingested", source.URL)
+	}
+	if err := in.save(ctx, source); err != nil {
+		in.release(ctx, source.ID)
+		return err
+	}
+
+	in.crawl(detachContext(ctx), source)
+	return nil
+}
+
+// AddFile saves a source for an uploaded PDF or Markdown file and starts ingesting it. Files are
+// not kept, so re-ingesting one means uploading it again.
+func (in *Ingestor) AddFile(ctx context.Context, source *IngestionSource, data []byte) error {
+	var extract func(data []byte, fileName string) ([]extractedDocument, error)
+	switch strings.ToLower(path.Ext(source.FileName)) {
+	case ".pdf":
+		source.Type, extract = SourcePDF, extractPDF
+	case ".md", ".markdown":
+		source.Type, extract = SourceMarkdown, extractMarkdown
+	default:
+		return fmt.Errorf("only .pdf and .md files can be uploaded")
+	}
+
+	// Uploading a file of the same name replaces its articles
+	source.ID = sourceID(source.Type + ":" + source.FileName)
+	source.CreatedAt = time.Now()
+	source.Status = IngestionStatus{State: "pending"}
+	if !in.claim(ctx, source.ID) {
+		return fmt.Errorf("%s is already being ingested", source.FileName)
+	}
+	if err := in.save(ctx, source); err != nil {
+		in.release(ctx, source.ID)
+		return err
+	}
+
+	go func() {
+		defer in.release(ctx, source.ID)
+		in.run(detachContext(ctx), source, func(status *IngestionStatus) ([]extractedDocument, error) {
+			docs, err := extract(data, source.FileName)
+			if err != nil {
+				kbIngestedDocuments.WithLabelValues(source.Type, "error").Inc()
+				return nil, err
+			}
+			kbIngestedDocuments.WithLabelValues(source.Type, "success").Inc()
+			status.Documents = len(docs)
+			return docs, nil
+		})
+	}()
+	return nil
+}
+
+// Ingest starts ingesting a url or sitemap source in the background. It returns false if the
+// source is already being ingested or does not exist.
+func (in *Ingestor) Ingest(ctx context.Context, id string) bool {
+	if !in.claim(ctx, id) {
+		return false
+	}
+
+	source, err := in.Source(ctx, id)
+	if err != nil || source == nil {
+		log.Printf("Ingestion source %s not found: %v", id, err)
+		in.release(ctx, id)
+		return false
+	}
+
+	in.crawl(ctx, source)
+	return true
+}
+
+// crawl ingests a claimed url or sitemap source in the background
+func (in *Ingestor) crawl(ctx context.Context, source *IngestionSource) {
+	go func() {
+		defer in.release(ctx, source.ID)
+
+		in.run(ctx, source, func(status *IngestionStatus) ([]extractedDocument, error) {
+			if source.Type == SourceSitemap {
+				return in.crawlSitemap(ctx, source, status)
+			}
+			return in.crawlSite(ctx, source, status)
+		})
+	}()
+}
+
+// claim marks a source of the tenant as being ingested, or returns false if it already is
+func (in *Ingestor) claim(ctx context.Context, id string) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	key := tenantKey(ctx, id)
+	if in.running[key] {
+		return false
+	}
+	in.running[key] = true
+	return true
+}
+
+func (in *Ingestor) release(ctx context.Context, id string) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	delete(in.running, tenantKey(ctx, id))
+}
+
+// run collects a source's documents, indexes them as articles, and removes articles the source
+// no longer has, recording progress in the source's status
+func (in *Ingestor) run(ctx context.Context, source *IngestionSource, collect func(status *IngestionStatus) ([]extractedDocument, error)) {
+	started := time.Now()
+	source.Status = IngestionStatus{State: "running", StartedAt: &started}
+	in.save(ctx, source)
+
+	err := func() error {
+		docs, err := collect(&source.Status)
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return fmt.Errorf("no content found")
+		}
+
+		articles := make([]KBArticleDocument, 0, len(docs))
+		keep := make(map[string]bool, len(docs))
+		for _, doc := range docs {
+			article := KBArticleDocument{
+				ID:        source.ID + "-" + sourceID(doc.Key),
+				SourceID:  source.ID,
+				Title:     doc.Title,
+				Content:   doc.Content,
+				Category:  source.Category,
+				Tags:      source.Tags,
+				URL:       doc.URL,
+				CreatedAt: started,
+				UpdatedAt: started,
+			}
+			if article.Title == "" {
+				article.Title = doc.Key
+			}
+			articles = append(articles, article)
+			keep[article.ID] = true
+		}
+
+		if err := in.kb.BulkIndex(ctx, articles); err != nil {
+			return fmt.Errorf("failed to index articles: %w", err)
+		}
+		source.Status.Articles = len(articles)
+
+		removed, err := in.kb.DeleteSourceArticles(ctx, source.ID, keep)
+		if err != nil {
+			return fmt.Errorf("failed to remove old articles: %w", err)
+		}
+		source.Status.Removed = removed
+		return nil
+	}()
+
+	finished := time.Now()
+	source.Status.FinishedAt = &finished
+	source.Status.State = "completed"
+	if err != nil {
+		source.Status.State = "failed"
+		source.Status.Error = err.Error()
+		log.Printf("Ingestion of source %s failed: %v", source.ID, err)
+	} else {
+		log.Printf("Ingested %d articles from %s source %s", source.Status.Articles, source.Type, source.ID)
+	}
+	in.save(detachContext(ctx), source)
+}
+
+// crawlSite fetches the source page and the pages it links to on the same site under the same
+// path, breadth first, up to MaxPages
+func (in *Ingestor) crawlSite(ctx context.Context, source *IngestionSource, status *IngestionStatus) ([]extractedDocument, error) {
+	start, err := url.Parse(source.URL)
+	if err != nil {
+		return nil, err
+	}
+	prefix := start.Path
+	if !strings.HasSuffix(prefix, "/") {
+		prefix = path.Dir(prefix)
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var docs []extractedDocument
+	startURL := normalizeURL(start)
+	queue := []string{startURL}
+	seen := map[string]bool{startURL: true}
+	for len(queue) > 0 && status.Documents+status.Failed < source.MaxPages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		page := queue[0]
+		queue = queue[1:]
+
+		doc, links, err := in.fetchPage(ctx, page)
+		if err != nil {
+			kbIngestedDocuments.WithLabelValues(source.Type, "error").Inc()
+			status.addError(err)
+			// Without the start page there is nothing to crawl
+			if page == startURL {
+				return nil, err
+			}
+			continue
+		}
+		kbIngestedDocuments.WithLabelValues(source.Type, "success").Inc()
+		status.Documents++
+		if doc.Content != "" {
+			docs = append(docs, *doc)
+		}
+
+		for _, link := range links {
+			u, err := url.Parse(link)
+			if err != nil || u.Host != start.Host || !strings.HasPrefix(u.Path, prefix) {
+				continue
+			}
+			next := normalizeURL(u)
+			if !seen[next] {
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+
+		if status.Documents%20 == 0 {
+			in.saveProgress(ctx, source)
+		}
+		time.Sleep(crawlDelay)
+	}
+
+	return docs, nil
+}
+
+// crawlSitemap fetches the pages listed in the source sitemap, following sitemap indexes, up to
+// MaxPages
+func (in *Ingestor) crawlSitemap(ctx context.Context, source *IngestionSource, status *IngestionStatus) ([]extractedDocument, error) {
+	var pages []string
+	sitemaps := []string{source.URL}
+	seen := map[string]bool{source.URL: true}
+	for len(sitemaps) > 0 && len(pages) < source.MaxPages {
+		data, _, err := in.fetch(ctx, sitemaps[0])
+		sitemaps = sitemaps[1:]
+		if err != nil {
+			if len(pages) == 0 && len(sitemaps) == 0 {
+				return nil, err
+			}
+			status.addError(err)
+			continue
+		}
+
+		listed, nested, err := parseSitemap(data)
+		if err != nil {
+			status.addError(err)
+			continue
+		}
+		pages = append(pages, listed...)
+		for _, sm := range nested {
+			if !seen[sm] {
+				seen[sm] = true
+				sitemaps = append(sitemaps, sm)
+			}
+		}
+	}
+	if len(pages) > source.MaxPages {
+		pages = pages[:source.MaxPages]
+	}
+
+	var docs []extractedDocument
+	for _, page := range pages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		doc, _, err := in.fetchPage(ctx, page)
+		if err != nil {
+			kbIngestedDocuments.WithLabelValues(source.Type, "error").Inc()
+			status.addError(err)
+			continue
+		}
+		kbIngestedDocuments.WithLabelValues(source.Type, "success").Inc()
+		status.Documents++
+		if doc.Content != "" {
+			docs = append(docs, *doc)
+		}
+
+		if status.Documents%20 == 0 {
+			in.saveProgress(ctx, source)
+		}
+		time.Sleep(crawlDelay)
+	}
+
+	return docs, nil
+}
+
+// fetchPage fetches an HTML page and extracts its text and links
+func (in *Ingestor) fetchPage(ctx context.Context, page string) (*extractedDocument, []string, error) {
+	data, contentType, err := in.fetch(ctx, page)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.Contains(contentType, "html") {
+		return nil, nil, fmt.Errorf("%s: not an html page (%s)", page, contentType)
+	}
+
+	base, _ := url.Parse(page)
+	title, text, links, err := extractHTML(data, base)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", page, err)
+	}
+	return &extractedDocument{Key: page, Title: title, Content: text, URL: page}, links, nil
+}
+
+// fetch downloads a URL, returning its body and content type
+func (in *Ingestor) fetch(ctx context.Context, target string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", target, err)
+	}
+	req.Header.Set("User-Agent", "csr-agent-ingest/1.0")
+
+	resp, err := in.httpClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", target, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s: status %d", target, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPageSize))
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", target, err)
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// publicAddress reports whether an IP address is reachable on the internet; crawls must not reach
+// internal services
+func publicAddress(address string) bool {
+	ip := net.ParseIP(address)
+	return ip != nil && !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// checkPublicHost refuses a source whose host resolves to a private or reserved address, so it is
+// rejected when added rather than failing on every crawl
+func checkPublicHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("cannot resolve %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if !publicAddress(addr.IP.String()) {
+			return fmt.Errorf("%s: %w", host, errFetchBlocked)
+		}
+	}
+	return nil
+}
+
+// normalizeURL drops the fragment and query so the same page is crawled once
+func normalizeURL(u *url.URL) string {
+	normalized := *u
+	normalized.Fragment = ""
+	normalized.RawQuery = ""
+	return normalized.String()
+}
+
+// sourceID derives a short stable ID from a key
+func sourceID(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return fmt.Sprintf("%x", sum[:6])
+}
+
+// Sources returns every ingestion source, newest first
+func (in *Ingestor) Sources(ctx context.Context) ([]IngestionSource, error) {
+	values, err := in.client.HGetAll(ctx, tenantKey(ctx, ingestionSourcesKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sources: %w", err)
+	}
+
+	sources := make([]IngestionSource, 0, len(values))
+	for _, value := range values {
+		var source IngestionSource
+		if err := json.Unmarshal([]byte(value), &source); err != nil {
+			continue
+		}
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].CreatedAt.After(sources[j].CreatedAt)
+	})
+	return sources, nil
+}
+
+// Source returns a source, or nil if it does not exist
+func (in *Ingestor) Source(ctx context.Context, id string) (*IngestionSource, error) {
+	value, err := in.client.HGet(ctx, tenantKey(ctx, ingestionSourcesKey), id).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get source: %w", err)
+	}
+
+	var source IngestionSource
+	if err := json.Unmarshal([]byte(value), &source); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal source: %w", err)
+	}
+	return &source, nil
+}
+
+// DeleteSource removes a source and the articles ingested from it
+func (in *Ingestor) DeleteSource(ctx context.Context, id string) error {
+	if _, err := in.kb.DeleteSourceArticles(ctx, id, nil); err != nil {
+		return fmt.Errorf("failed to remove articles: %w", err)
+	}
+	if err := in.client.HDel(ctx, tenantKey(ctx, ingestionSourcesKey), id).Err(); err != nil {
+		return fmt.Errorf("failed to delete source: %w", err)
+	}
+	return nil
+}
+
+func (in *Ingestor) save(ctx context.Context, source *IngestionSource) error {
+	data, err := json.Marshal(source)
+	if err != nil {
+		return fmt.Errorf("failed to marshal source: %w", err)
+	}
+	if err := in.client.HSet(ctx, tenantKey(ctx, ingestionSourcesKey), source.ID, data).Err(); err != nil {
+		return fmt.Errorf("failed to save source: %w", err)
+	}
+	return nil
+}
+
+// saveProgress saves a running source's status so the admin API can follow a long crawl
+func (in *Ingestor) saveProgress(ctx context.Context, source *IngestionSource) {
+	if err := in.save(ctx, source); err != nil {
+		log.Printf("Failed to save ingestion progress for %s: %v", source.ID, err)
+	}
+}
+
+// listSources returns the knowledge base ingestion sources and their status
+func (app *Application) listSources(c *gin.Context) {
+	sources, err := app.Ingestor.Sources(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":   len(sources),
+		"sources": sources,
+	})
+}
+
+// addSource adds a help-center url or sitemap and starts ingesting it
+func (app *Application) addSource(c *gin.Context) {
+	var source IngestionSource
+	if err := c.ShouldBindJSON(&source); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+
+	if err := app.Ingestor.AddSource(c.Request.Context(), &source); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, source)
+}
+
+// uploadSource ingests an uploaded PDF or Markdown file
+func (app *Application) uploadSource(c *gin.Context) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	if file.Size > maxUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("file too large (max %d MB)", maxUploadSize>>20)})
+		return
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read file"})
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxUploadSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read file"})
+		return
+	}
+
+	source := IngestionSource{
+		FileName: path.Base(file.Filename),
+		Category: c.PostForm("category"),
+	}
+	if tags := c.PostForm("tags"); tags != "" {
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				source.Tags = append(source.Tags, tag)
+			}
+		}
+	}
+
+	if err := app.Ingestor.AddFile(c.Request.Context(), &source, data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, source)
+}
+
+// getSource returns an ingestion source and its status
+func (app *Application) getSource(c *gin.Context) {
+	source, err := app.Ingestor.Source(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if source == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "source not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, source)
+}
+
+// ingestSource re-crawls a url or sitemap source
+func (app *Application) ingestSource(c *gin.Context) {
+	source, err := app.Ingestor.Source(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if source == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "source not found"})
+		return
+	}
+	if source.Type != SourceURL && source.Type != SourceSitemap {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "uploaded files are re-ingested by uploading them again"})
+		return
+	}
+
+	if !app.Ingestor.Ingest(detachContext(c.Request.Context()), source.ID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "source is already being ingested"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"status": "ingestion started", "source_id": source.ID})
+}
+
+// deleteSource removes an ingestion source and its articles
+func (app *Application) deleteSource(c *gin.Context) {
+	if err := app.Ingestor.DeleteSource(c.Request.Context(), c.Param("id")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "source deleted"})
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Intent taxonomy storage
+const (
+	intentsKey       = "intents"        // hash of intent name to intent
+	intentsSeededKey = "intents:seeded" // set once the default taxonomy has been stored
+	intentCacheTTL   = 30 * time.Second // how long other replicas take to see taxonomy changes
+)
+
+var intentsClassified = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_intents_total",
+		Help: "Customer messages by the intent they were routed to",
+	},
+	[]string{"intent"},
+)
+
+func init() {
+	prometheus.MustRegister(intentsClassified)
+}
+
+// alwaysAvailableTools can be used whatever the intent
+var alwaysAvailableTools = map[string]bool{
+	"search_knowledge_base": true,
+	"escalate_to_human":     true,
+	"request_callback":      true,
+}
+
+// intentName is a valid intent name, such as "billing" or "account-security"
+var intentName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,39}$`)
+
+// Intent is a kind of request customers make, and how the agent handles it
+type Intent struct {
+	Name         string    `json:"name"`
+	Description  string    `json:"description"`
+	Keywords     []string  `json:"keywords"`                // words and phrases that point to the intent
+	Prompt       string    `json:"prompt,omitempty"`        // instructions added to the system prompt
+	Tools        []string  `json:"tools,omitempty"`         // tools Claude may use besides the built-in ones; empty allows all
+	KBCategories []string  `json:"kb_categories,omitempty"` // knowledge base categories searched; empty searches all
+	UpdatedAt    time.Time `json:"updated_at"`
+
+	pattern *regexp.Regexp // matches the keywords
+}
+
+// allowsTool reports whether Claude may use a tool for the intent. Without an intent, every
+// tool is allowed.
+func (i *Intent) allowsTool(name string) bool {
+	if i == nil || len(i.Tools) == 0 || alwaysAvailableTools[name] {
+		return true
+	}
+	for _, tool := range i.Tools {
+		if tool == name {
+			return true
+		}
+	}
+	return false
+}
+
+// name returns the intent's name, or "" without an intent
+func (i *Intent) name() string {
+	if i == nil {
+		return ""
+	}
+	return i.Name
+}
+
+// categories returns the knowledge base categories searched for the intent
+func (i *Intent) categories() []string {
+	if i == nil {
+		return nil
+	}
+	return i.KBCategories
+}
+
+// defaultIntents is the taxonomy stored on first start
+func defaultIntents() []*Intent {
+	return []*Intent{
+		{
+			Name:         "billing",
+			Description:  "Charges, invoices, payment methods, and subscriptions",
+			Keywords:     []string{"bill", "billing", "charge", "charged", "double charged", "invoice", "payment", "paid", "pay", "subscription", "receipt", "credit card", "price", "overcharged"},
+			Prompt:       "The customer has a billing question. Check charges against the order before discussing them, and never share full card numbers.",
+			Tools:        []string{"get_order_status", "process_refund"},
+			KBCategories: []string{"billing"},
+		},
+		{
+			Name:         "shipping",
+			Description:  "Delivery status, tracking, and delays",
+			Keywords:     []string{"shipping", "shipped", "delivery", "deliver", "delivered", "tracking", "track", "package", "parcel", "courier", "arrive", "arrived", "delayed", "where is my order", "lost"},
+			Prompt:       "The customer is asking about a delivery. Look up the order for its shipping status and tracking before answering.",
+			Tools:        []string{"get_order_status"},
+			KBCategories: []string{"shipping"},
+		},
+		{
+			Name:         "returns",
+			Description:  "Returns, exchanges, and refunds for items",
+			Keywords:     []string{"return", "returns", "returning", "exchange", "refund", "damaged", "defective", "wrong item", "send back", "send it back", "replacement"},
+			Prompt:       "The customer wants to return or exchange an item. Check the order and the return policy before offering a refund or replacement.",
+			Tools:        []string{"get_order_status", "process_refund"},
+			KBCategories: []string{"returns"},
+		},
+		{
+			Name:         "technical",
+			Description:  "Problems with the website, app, or account access",
+			Keywords:     []string{"error", "bug", "crash", "crashes", "login", "log in", "password", "app", "website", "not working", "install", "reset", "locked out", "loading"},
+			Prompt:       "The customer has a technical problem. Ask for the device, browser or app version, and exact error message if they have not given them, and give one troubleshooting step at a time.",
+			Tools:        []string{"update_ticket_priority"},
+			KBCategories: []string{"technical"},
+		},
+	}
+}
+
+// IntentRouter classifies customer messages into intents from a taxonomy kept in Redis, shared
+// by every replica. Each tenant has its own taxonomy.
+type IntentRouter struct {
+	client *redis.Client
+
+	mu     sync.Mutex
+	loaded map[string]*loadedIntents // by tenant
+}
+
+// loadedIntents is a tenant's cached taxonomy
+type loadedIntents struct {
+	intents  []*Intent // sorted by name
+	loadedAt time.Time
+}
+
+// NewIntentRouter creates a router, storing the default taxonomy on first start
+func NewIntentRouter(ctx context.Context, client *redis.Client) (*IntentRouter, error) {
+	r := &IntentRouter{client: client, loaded: map[string]*loadedIntents{}}
+	if err := r.Seed(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Seed stores the default taxonomy for the tenant the first time it starts
+func (r *IntentRouter) Seed(ctx context.Context) error {
+	seed, err := r.client.SetNX(ctx, tenantKey(ctx, intentsSeededKey), time.Now().Format(time.RFC3339), 0).Result()
+	if err != nil {
+		return fmt.Errorf("failed to check intent taxonomy: %w", err)
+	}
+	if seed {
+		for _, intent := range defaultIntents() {
+			if err := r.Save(ctx, intent); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Intents returns the taxonomy, sorted by name
+func (r *IntentRouter) Intents(ctx context.Context) ([]*Intent, error) {
+	tenant := tenantFrom(ctx).ID
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cached := r.loaded[tenant]; cached != nil && time.Since(cached.loadedAt) < intentCacheTTL {
+		return cached.intents, nil
+	}
+
+	stored, err := r.client.HGetAll(ctx, tenantKey(ctx, intentsKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load intents: %w", err)
+	}
+	intents := make([]*Intent, 0, len(stored))
+	for _, data := range stored {
+		var intent Intent
+		if err := json.Unmarshal([]byte(data), &intent); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal intent: %w", err)
+		}
+		intent.pattern = keywordPattern(intent.Keywords)
+		intents = append(intents, &intent)
+	}
+	sort.Slice(intents, func(i, j int) bool { return intents[i].Name < intents[j].Name })
+
+	r.loaded[tenant] = &loadedIntents{intents: intents, loadedAt: time.Now()}
+	return intents, nil
+}
+
+// Get returns an intent, or nil when there is none by that name
+func (r *IntentRouter) Get(ctx context.Context, name string) (*Intent, error) {
+	intents, err := r.Intents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, intent := range intents {
+		if intent.Name == name {
+			return intent, nil
+		}
+	}
+	return nil, nil
+}
+
+// Save creates or replaces an intent
+func (r *IntentRouter) Save(ctx context.Context, intent *Intent) error {
+	if !intentName.MatchString(intent.Name) {
+		return fmt.Errorf("name must be lowercase letters, digits, hyphens, and underscores")
+	}
+	var keywords []string
+	for _, keyword := range intent.Keywords {
+		if keyword = strings.ToLower(strings.TrimSpace(keyword)); keyword != "" {
+			keywords = append(keywords, keyword)
+		}
+	}
+	if len(keywords) == 0 {
+		return fmt.Errorf("at least one keyword is required")
+	}
+	intent.Keywords = keywords
+	intent.UpdatedAt = time.Now()
+
+	data, err := json.Marshal(intent)
+	if err != nil {
+		return fmt.Errorf("failed to marshal intent: %w", err)
+	}
+	if err := r.client.HSet(ctx, tenantKey(ctx, intentsKey), intent.Name, data).Err(); err != nil {
+		return fmt.Errorf("failed to save intent: %w", err)
+	}
+	r.invalidate(ctx)
+	return nil
+}
+
+// Delete removes an intent, returning false when there was none by that name
+func (r *IntentRouter) Delete(ctx context.Context, name string) (bool, error) {
+	deleted, err := r.client.HDel(ctx, tenantKey(ctx, intentsKey), name).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete intent: %w", err)
+	}
+	r.invalidate(ctx)
+	return deleted > 0, nil
+}
+
+func (r *IntentRouter) invalidate(ctx context.Context) {
+	r.mu.Lock()
+	delete(r.loaded, tenantFrom(ctx).ID)
+	r.mu.Unlock()
+}
+
+// Classify returns the intent whose keywords a message matches most, or nil when it matches
+// none. Ties go to the conversation's current intent, so a conversation stays with its intent
+// until the customer clearly moves on.
+func (r *IntentRouter) Classify(ctx context.Context, message, current string) (*Intent, error) {
+	intents, err := r.Intents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *Intent
+	bestScore := 0
+	for _, intent := range intents {
+		if intent.pattern == nil {
+			continue
+		}
+		score := len(intent.pattern.FindAllStringIndex(message, -1))
+		if score > bestScore || (score == bestScore && score > 0 && intent.Name == current) {
+			best, bestScore = intent, score
+		}
+	}
+	return best, nil
+}
+
+// keywordPattern matches any of the keywords as whole words, ignoring case
+func keywordPattern(keywords []string) *regexp.Regexp {
+	if len(keywords) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(keywords))
+	for i, keyword := range keywords {
+		quoted[i] = regexp.QuoteMeta(keyword)
+	}
+	return regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+}
+
+// classifyIntent routes a message to an intent. Messages matching no intent stay with the
+// conversation's current one.
+func (s *AgentService) classifyIntent(ctx context.Context, session *Session, message string) *Intent {
+	current, _ := session.Metadata["intent"].(string)
+	intent, err := s.intents.Classify(ctx, message, current)
+	if err != nil {
+		fmt.Printf("Intent classification error: %v\n", err)
+	}
+	if intent == nil && current != "" {
+		intent, _ = s.intents.Get(ctx, current)
+	}
+
+	if intent != nil {
+		intentsClassified.WithLabelValues(intent.Name).Inc()
+	} else {
+		intentsClassified.WithLabelValues("none").Inc()
+	}
+	return intent
+}
+
+// listIntents returns the intent taxonomy
+func (app *Application) listIntents(c *gin.Context) {
+	intents, err := app.Intents.Intents(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":   len(intents),
+		"intents": intents,
+	})
+}
+
+// saveIntent creates or replaces the intent named in the path
+func (app *Application) saveIntent(c *gin.Context) {
+	var intent Intent
+	if err := c.ShouldBindJSON(&intent); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	intent.Name = c.Param("name")
+
+	for _, tool := range intent.Tools {
+		if !app.AgentService.tools.Has(tool) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown tool %q", tool)})
+			return
+		}
+	}
+	if err := app.Intents.Save(c.Request.Context(), &intent); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, intent)
+}
+
+// deleteIntent removes the intent named in the path
+func (app *Application) deleteIntent(c *gin.Context) {
+	deleted, err := app.Intents.Delete(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "intent not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "intent deleted"})
+}
+
+// classifyMessage shows which intent a message would be routed to, for tuning keywords
+func (app *Application) classifyMessage(c *gin.Context) {
+	var req struct {
+		Message string `json:"message" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "message is required"})
+		return
+	}
+
+	intent, err := app.Intents.Classify(c.Request.Context(), req.Message, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if intent == nil {
+		c.JSON(http.StatusOK, gin.H{"intent": nil, "matched": []string{}})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"intent":  intent.Name,
+		"matched": intent.pattern.FindAllString(req.Message, -1),
+	})
+}
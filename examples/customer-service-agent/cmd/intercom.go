@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Intercom API settings
+const (
+	intercomAPIURL        = "https://api.intercom.io"
+	intercomAPIVersion    = "2.11"
+	intercomMaxRetries    = 3
+	intercomMaxRetryAfter = 60 * time.Second
+	intercomMaxBodySize   = 1 << 20
+)
+
+var intercomRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_intercom_requests_total",
+		Help: "Intercom API requests, by operation and status",
+	},
+	[]string{"operation", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(intercomRequests)
+}
+
+// IntercomConfig holds the Intercom workspace and how escalations are routed in it
+type IntercomConfig struct {
+	AccessToken  string
+	ClientSecret string // the app's client secret, which signs webhooks
+	AdminID      string // the admin the agent replies as
+	AssigneeID   string // admin or team escalated conversations are assigned to
+}
+
+// IntercomClient replies to and assigns conversations through the Intercom API
+type IntercomClient struct {
+	config     IntercomConfig
+	baseURL    string
+	httpClient *http.Client
+}
+
+// IntercomMessage is a customer message from an Intercom webhook
+type IntercomMessage struct {
+	ConversationID string `json:"conversation_id"`
+	ContactID      string `json:"contact_id"`
+	PartID         string `json:"part_id,omitempty"`
+	Text           string `json:"text"`
+}
+
+// IntercomContact is the contact a conversation is with, as kept in session metadata
+type IntercomContact struct {
+	ID               string                 `json:"id"`
+	ExternalID       string                 `json:"external_id,omitempty"`
+	Role             string                 `json:"role"` // user or lead
+	Email            string                 `json:"email,omitempty"`
+	Name             string                 `json:"name,omitempty"`
+	Phone            string                 `json:"phone,omitempty"`
+	Location         map[string]interface{} `json:"location,omitempty"`
+	CustomAttributes map[string]interface{} `json:"custom_attributes,omitempty"`
+}
+
+// intercomWebhook is a webhook notification about a conversation
+type intercomWebhook struct {
+	Topic string `json:"topic"`
+	Data  struct {
+		Item struct {
+			ID     string `json:"id"`
+			Source struct {
+				ID     string         `json:"id"`
+				Body   string         `json:"body"`
+				Author intercomAuthor `json:"author"`
+			} `json:"source"`
+			Contacts struct {
+				Contacts []struct {
+					ID string `json:"id"`
+				} `json:"contacts"`
+			} `json:"contacts"`
+			ConversationParts struct {
+				ConversationParts []struct {
+					ID       string         `json:"id"`
+					PartType string         `json:"part_type"`
+					Body     string         `json:"body"`
+					Author   intercomAuthor `json:"author"`
+				} `json:"conversation_parts"`
+			} `json:"conversation_parts"`
+		} `json:"item"`
+	} `json:"data"`
+}
+
+// intercomAuthor is who wrote a conversation part
+type intercomAuthor struct {
+	ID   string `json:"id"`
+	Type string `json:"type"` // user, lead, admin, or bot
+}
+
+// NewIntercomClient creates a client for the workspace in config
+func NewIntercomClient(config IntercomConfig) (*IntercomClient, error) {
+	if config.AccessToken == "" || config.AdminID == "" {
+		return nil, fmt.Errorf("INTERCOM_ACCESS_TOKEN and INTERCOM_ADMIN_ID are required")
+	}
+
+	return &IntercomClient{
+		config:  config,
+		baseURL: intercomAPIURL,
+		httpClient: &http.Client{
+			Timeout: 15 * time.Second,
+		},
+	}, nil
+}
+
+// GetContact fetches a contact's attributes
+func (c *IntercomClient) GetContact(ctx context.Context, contactID string) (*IntercomContact, error) {
+	var contact IntercomContact
+	if err := c.do(ctx, "get_contact", "GET", "/contacts/"+url.PathEscape(contactID), nil, &contact); err != nil {
+		return nil, err
+	}
+	return &contact, nil
+}
+
+// Reply posts the agent's answer in a conversation. Escalated conversations also get an internal
+// note with the reason and are assigned to the escalation admin or team.
+func (c *IntercomClient) Reply(ctx context.Context, conversationID string, response *ChatMessageResponse) error {
+	path := "/conversations/" + url.PathEscape(conversationID)
+	reply := map[string]interface{}{
+		"message_type": "comment",
+		"type":         "admin",
+		"admin_id":     c.config.AdminID,
+		"body":         intercomHTML(response.Message),
+	}
+	if err := c.do(ctx, "reply", "POST", path+"/reply", reply, nil); err != nil {
+		return err
+	}
+	if !response.ShouldEscalate {
+		return nil
+	}
+
+	reason, _ := response.Metadata["escalation_reason"].(string)
+	if reason == "" {
+		reason = "The customer asked for a person, or the AI agent could not resolve the request."
+	}
+	note := map[string]interface{}{
+		"message_type": "note",
+		"type":         "admin",
+		"admin_id":     c.config.AdminID,
+		"body":         intercomHTML(fmt.Sprintf("Escalated by the AI agent (sentiment: %s).\nReason: %s", response.Sentiment, reason)),
+	}
+	if err := c.do(ctx, "reply", "POST", path+"/reply", note, nil); err != nil {
+		return err
+	}
+	return c.Assign(ctx, conversationID)
+}
+
+// Assign hands a conversation to the escalation admin or team, if one is configured
+func (c *IntercomClient) Assign(ctx context.Context, conversationID string) error {
+	if c.config.AssigneeID == "" {
+		return nil
+	}
+	assignment := map[string]interface{}{
+		"message_type": "assignment",
+		"type":         "admin",
+		"admin_id":     c.config.AdminID,
+		"assignee_id":  c.config.AssigneeID,
+	}
+	return c.do(ctx, "assign", "POST", "/conversations/"+url.PathEscape(conversationID)+"/parts", assignment, nil)
+}
+
+// do sends a request to the Intercom API and decodes the JSON response into out when it is set.
+// Rate limited requests are retried once the limit resets.
+func (c *IntercomClient) do(ctx context.Context, operation, method, path string, body interface{}, out interface{}) error {
+	var jsonData []byte
+	if body != nil {
+		var err error
+		if jsonData, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(jsonData))
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+c.config.AccessToken)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Intercom-Version", intercomAPIVersion)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			intercomRequests.WithLabelValues(operation, "error").Inc()
+			return fmt.Errorf("failed to call intercom api: %w", err)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, intercomMaxBodySize))
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read response: %w", err)
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < intercomMaxRetries {
+			intercomRequests.WithLabelValues(operation, "rate_limited").Inc()
+			wait := time.Duration(attempt+1) * time.Second
+			if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+				wait = time.Until(time.Unix(reset, 0))
+			}
+			if wait > intercomMaxRetryAfter {
+				return fmt.Errorf("intercom rate limit: retry after %s", wait)
+			}
+			log.Printf("Intercom %s rate limited, retrying in %s", operation, wait)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			intercomRequests.WithLabelValues(operation, "error").Inc()
+			return fmt.Errorf("intercom api error (status %d): %s", resp.StatusCode, string(data))
+		}
+
+		intercomRequests.WithLabelValues(operation, "success").Inc()
+		if out == nil {
+			return nil
+		}
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+		return nil
+	}
+}
+
+// verifySignature checks Intercom's X-Hub-Signature: "sha1=" and a hex HMAC-SHA1 of the body,
+// keyed by the app's client secret. Without a client secret no webhook is accepted.
+func (c *IntercomClient) verifySignature(body []byte, signature string) bool {
+	if c.config.ClientSecret == "" {
+		return false
+	}
+	mac := hmac.New(sha1.New, []byte(c.config.ClientSecret))
+	mac.Write(body)
+	expected := "sha1=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// intercomHTML formats text as the HTML Intercom expects in message bodies, one paragraph per
+// blank-line separated block
+func intercomHTML(text string) string {
+	var body strings.Builder
+	for _, paragraph := range strings.Split(strings.TrimSpace(text), "\n\n") {
+		if paragraph = strings.TrimSpace(paragraph); paragraph == "" {
+			continue
+		}
+		body.WriteString("<p>")
+		body.WriteString(strings.ReplaceAll(html.EscapeString(paragraph), "\n", "<br>"))
+		body.WriteString("</p>")
+	}
+	return body.String()
+}
+
+// message returns the customer's message a webhook is about: the conversation's first message
+// when it was just created, or the latest customer reply
+func (w *intercomWebhook) message() *IntercomMessage {
+	item := &w.Data.Item
+	msg := &IntercomMessage{ConversationID: item.ID}
+	if len(item.Contacts.Contacts) > 0 {
+		msg.ContactID = item.Contacts.Contacts[0].ID
+	}
+
+	switch w.Topic {
+	case "conversation.user.created":
+		msg.PartID, msg.Text = item.Source.ID, htmlText(item.Source.Body)
+	case "conversation.user.replied":
+		parts := item.ConversationParts.ConversationParts
+		for i := len(parts) - 1; i >= 0; i-- {
+			part := parts[i]
+			if part.PartType == "comment" && (part.Author.Type == "user" || part.Author.Type == "lead") {
+				msg.PartID, msg.Text = part.ID, htmlText(part.Body)
+				break
+			}
+		}
+	}
+	if msg.ConversationID == "" || msg.Text == "" {
+		return nil
+	}
+	return msg
+}
+
+// handleIntercomWebhook receives conversation webhooks from Intercom and queues customer messages
+// for the agent. Subscribe to conversation.user.created and conversation.user.replied.
+func (app *Application) handleIntercomWebhook(c *gin.Context) {
+	intercom := app.intercomFor(c.Request.Context())
+	if intercom == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "intercom is not configured"})
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, intercomMaxBodySize))
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request too large"})
+		return
+	}
+	if !intercom.verifySignature(body, c.GetHeader("X-Hub-Signature")) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid signature"})
+		return
+	}
+
+	var webhook intercomWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook"})
+		return
+	}
+
+	// Pings and other topics have no customer message
+	msg := webhook.message()
+	if msg == nil {
+		c.JSON(http.StatusOK, gin.H{"status": "ignored"})
+		return
+	}
+
+	// Intercom retries webhooks it did not see acknowledged in time
+	ctx := c.Request.Context()
+	first, err := app.Webhooks.First(ctx, "intercom", msg.fingerprint())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !first {
+		c.JSON(http.StatusOK, gin.H{"status": "duplicate"})
+		return
+	}
+
+	// Enqueue for async processing
+	if err := app.MessageQueue.Enqueue(ctx, msg); err != nil {
+		app.Webhooks.Release(ctx, "intercom", msg.fingerprint())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "queued"})
+}
+
+// processIntercomMessage answers an Intercom conversation. The contact's attributes are copied
+// into the session's metadata first, so they stay current with Intercom.
+func (app *Application) processIntercomMessage(ctx context.Context, msg *IntercomMessage) error {
+	sessionID := "intercom-" + msg.ConversationID
+	userID := msg.ContactID
+
+	var contact *IntercomContact
+	if msg.ContactID != "" {
+		var err error
+		if contact, err = app.intercomFor(ctx).GetContact(ctx, msg.ContactID); err != nil {
+			log.Printf("Intercom: failed to sync contact %s: %v", msg.ContactID, err)
+		} else {
+			// The app's own user ID, so tools such as the order tools recognize the customer
+			if contact.ExternalID != "" {
+				userID = contact.ExternalID
+			}
+			if err := app.SessionManager.SetMetadata(ctx, sessionID, userID, map[string]interface{}{"intercom_contact": contact}); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Convert to chat message
+	req := &ChatMessageRequest{
+		SessionID: sessionID,
+		Message:   msg.Text,
+		UserID:    userID,
+		Channel:   "intercom",
+		Metadata: map[string]interface{}{
+			"conversation_id": msg.ConversationID,
+			"contact_id":      msg.ContactID,
+		},
+		Source: msg,
+	}
+	if contact != nil {
+		req.Metadata["contact"] = contact
+	}
+
+	// Messages the agent cannot take, or fails to answer, go to the team rather than waiting
+	if err := req.Validate(); err != nil {
+		if assignErr := app.intercomFor(ctx).Assign(ctx, msg.ConversationID); assignErr != nil {
+			log.Printf("Failed to assign intercom conversation %s: %v", msg.ConversationID, assignErr)
+		}
+		return fmt.Errorf("invalid intercom message in conversation %s: %w", msg.ConversationID, err)
+	}
+
+	// Process with agent
+	startTime := time.Now()
+	response, err := app.AgentService.ProcessMessage(ctx, req)
+	messageLatency.WithLabelValues(req.Channel).Observe(time.Since(startTime).Seconds())
+	if errors.Is(err, ErrHandedOff) {
+		// A human agent answers from the console
+		return nil
+	}
+	if err != nil {
+		messagesProcessed.WithLabelValues("error", req.Channel).Inc()
+		if assignErr := app.intercomFor(ctx).Assign(ctx, msg.ConversationID); assignErr != nil {
+			log.Printf("Failed to assign intercom conversation %s: %v", msg.ConversationID, assignErr)
+		}
+		return err
+	}
+	messagesProcessed.WithLabelValues("success", req.Channel).Inc()
+	sentimentDistribution.WithLabelValues(response.Sentiment).Inc()
+
+	// Send response back to Intercom
+	if err := app.intercomFor(ctx).Reply(ctx, msg.ConversationID, response); err != nil {
+		return fmt.Errorf("failed to reply to intercom conversation %s: %w", msg.ConversationID, err)
+	}
+	return nil
+}
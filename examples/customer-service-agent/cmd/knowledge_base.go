@@ -6,38 +6,85 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
+// bulkBatchSize is how many articles BulkIndex writes per Elasticsearch bulk request
+const bulkBatchSize = 500
+
 // KnowledgeBase handles Elasticsearch operations
 type KnowledgeBase struct {
 	url        string
 	indexName  string
 	httpClient *http.Client
+	embeddings *EmbeddingPipeline // nil when embeddings are disabled
+	reranker   Reranker           // nil when reranking is disabled
+
+	minRerankScore float64
+
+	importMu sync.Mutex // one bulk import at a time
+	mu       sync.Mutex
+	progress IndexProgress
 }
 
-// NewKnowledgeBase creates a new knowledge base instance
-func NewKnowledgeBase(elasticsearchURL string) (*KnowledgeBase, error) {
+// IndexProgress reports how far the current or last bulk import has got
+type IndexProgress struct {
+	Running        bool       `json:"running"`
+	Articles       int        `json:"articles"`
+	ArticlesStored int        `json:"articles_stored"`
+	ChunksEmbedded int        `json:"chunks_embedded"`
+	ChunksFailed   int        `json:"chunks_failed"`
+	StartedAt      time.Time  `json:"started_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// NewKnowledgeBase creates a new knowledge base instance. When embeddings is set, indexed
+// articles are also chunked, embedded, and stored as vectors, and searches combine keyword and
+// vector results. When reranker is set, search results are reranked and those scoring below
+// minRerankScore dropped.
+func NewKnowledgeBase(elasticsearchURL string, embeddings *EmbeddingPipeline, reranker Reranker, minRerankScore float64) (*KnowledgeBase, error) {
 	kb := &KnowledgeBase{
-		url:       elasticsearchURL,
-		indexName: "kb_articles",
+		url:            elasticsearchURL,
+		indexName:      "kb_articles",
+		embeddings:     embeddings,
+		reranker:       reranker,
+		minRerankScore: minRerankScore,
 		httpClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
 	}
 
 	// Create index if it doesn't exist
-	if err := kb.createIndex(); err != nil {
+	if err := kb.createIndex(kb.indexName); err != nil {
 		return nil, err
 	}
 
 	return kb, nil
 }
 
+// AddTenant creates the index of a tenant's articles if it doesn't exist
+func (kb *KnowledgeBase) AddTenant(tenant *Tenant) error {
+	if tenant.KBIndex == "" {
+		return nil
+	}
+	return kb.createIndex(tenant.KBIndex)
+}
+
+// index returns the index of the articles of the tenant work is done for
+func (kb *KnowledgeBase) index(ctx context.Context) string {
+	if index := tenantFrom(ctx).KBIndex; index != "" {
+		return index
+	}
+	return kb.indexName
+}
+
 // createIndex creates the Elasticsearch index with mapping
-func (kb *KnowledgeBase) createIndex() error {
+func (kb *KnowledgeBase) createIndex(name string) error {
 	mapping := map[string]interface{}{
 		"mappings": map[string]interface{}{
 			"properties": map[string]interface{}{
@@ -59,6 +106,9 @@ func (kb *KnowledgeBase) createIndex() error {
 				"category": map[string]string{
 					"type": "keyword",
 				},
+				"source_id": map[string]string{
+					"type": "keyword",
+				},
 				"tags": map[string]string{
 					"type": "keyword",
 				},
@@ -84,7 +134,7 @@ func (kb *KnowledgeBase) createIndex() error {
 
 	jsonData, _ := json.Marshal(mapping)
 
-	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/%s", kb.url, kb.indexName), bytes.NewBuffer(jsonData))
+	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/%s", kb.url, name), bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
 	}
@@ -106,17 +156,27 @@ func (kb *KnowledgeBase) createIndex() error {
 	return nil
 }
 
-// Search searches the knowledge base
-func (kb *KnowledgeBase) Search(ctx context.Context, query string, limit int) ([]KBArticle, error) {
+// searchBM25 searches the knowledge base by keyword, in the given categories if any
+func (kb *KnowledgeBase) searchBM25(ctx context.Context, query string, limit int, categories []string) ([]KBArticle, error) {
+	match := map[string]interface{}{
+		"multi_match": map[string]interface{}{
+			"query":  query,
+			"fields": []string{"title^3", "content^1", "tags^2"},
+			"type":   "best_fields",
+		},
+	}
+	if len(categories) > 0 {
+		match = map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must":   match,
+				"filter": map[string]interface{}{"terms": map[string]interface{}{"category": categories}},
+			},
+		}
+	}
+
 	// Build Elasticsearch query
 	searchQuery := map[string]interface{}{
-		"query": map[string]interface{}{
-			"multi_match": map[string]interface{}{
-				"query":  query,
-				"fields": []string{"title^3", "content^1", "tags^2"},
-				"type":   "best_fields",
-			},
-		},
+		"query": match,
 		"size": limit,
 		"_source": []string{"id", "title", "content", "url"},
 	}
@@ -124,7 +184,7 @@ func (kb *KnowledgeBase) Search(ctx context.Context, query string, limit int) ([
 	jsonData, _ := json.Marshal(searchQuery)
 
 	req, err := http.NewRequestWithContext(ctx, "POST",
-		fmt.Sprintf("%s/%s/_search", kb.url, kb.indexName),
+		fmt.Sprintf("%s/%s/_search", kb.url, kb.index(ctx)),
 		bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, err
@@ -157,6 +217,9 @@ func (kb *KnowledgeBase) Search(ctx context.Context, query string, limit int) ([
 			Content: truncateContent(hit.Source.Content, 500),
 			URL:     hit.Source.URL,
 			Score:   hit.Score,
+
+			MatchedBy: []string{StrategyBM25},
+			BM25Score: hit.Score,
 		}
 		articles = append(articles, article)
 	}
@@ -180,7 +243,7 @@ func (kb *KnowledgeBase) Index(ctx context.Context, article *KBArticleDocument)
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "PUT",
-		fmt.Sprintf("%s/%s/_doc/%s", kb.url, kb.indexName, article.ID),
+		fmt.Sprintf("%s/%s/_doc/%s", kb.url, kb.index(ctx), article.ID),
 		bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
@@ -199,22 +262,112 @@ func (kb *KnowledgeBase) Index(ctx context.Context, article *KBArticleDocument)
 		return fmt.Errorf("index failed (status %d): %s", resp.StatusCode, string(body))
 	}
 
+	// Embed the article's chunks
+	if kb.embeddings != nil {
+		if err := kb.embeddings.Process(ctx, []KBArticleDocument{*article}, func(int, int) {}); err != nil {
+			return fmt.Errorf("failed to embed article %s: %w", article.ID, err)
+		}
+	}
+
 	return nil
 }
 
-// BulkIndex indexes multiple documents at once
+// BulkIndex indexes multiple documents, in batches so large imports are not sent in one
+// request. Progress is reported by IndexProgress; concurrent imports run one after another.
 func (kb *KnowledgeBase) BulkIndex(ctx context.Context, articles []KBArticleDocument) error {
 	if len(articles) == 0 {
 		return nil
 	}
 
+	kb.importMu.Lock()
+	defer kb.importMu.Unlock()
+
+	kb.updateProgress(func(progress *IndexProgress) {
+		*progress = IndexProgress{Running: true, Articles: len(articles), StartedAt: time.Now()}
+	})
+
+	err := kb.bulkImport(ctx, articles)
+
+	kb.updateProgress(func(progress *IndexProgress) {
+		now := time.Now()
+		progress.Running = false
+		progress.FinishedAt = &now
+		if err != nil {
+			progress.Error = err.Error()
+		}
+	})
+	if err == nil {
+		log.Printf("Indexed %d knowledge base articles", len(articles))
+	}
+
+	return err
+}
+
+// bulkImport writes the articles batch by batch, embedding each batch once it is stored. Failed
+// embeddings are reported after the whole import so one bad batch does not stop it.
+func (kb *KnowledgeBase) bulkImport(ctx context.Context, articles []KBArticleDocument) error {
+	var embedErr error
+	for start := 0; start < len(articles); start += bulkBatchSize {
+		end := start + bulkBatchSize
+		if end > len(articles) {
+			end = len(articles)
+		}
+		batch := articles[start:end]
+
+		if err := kb.bulkWrite(ctx, batch); err != nil {
+			return err
+		}
+		kb.updateProgress(func(progress *IndexProgress) {
+			progress.ArticlesStored += len(batch)
+		})
+
+		if kb.embeddings == nil {
+			continue
+		}
+		err := kb.embeddings.Process(ctx, batch, func(embedded, failed int) {
+			kb.updateProgress(func(progress *IndexProgress) {
+				progress.ChunksEmbedded += embedded
+				progress.ChunksFailed += failed
+			})
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			log.Printf("Embedding articles %d-%d failed: %v", start+1, end, err)
+			embedErr = err
+		}
+	}
+
+	if embedErr != nil {
+		return fmt.Errorf("articles stored but some embeddings failed: %w", embedErr)
+	}
+	return nil
+}
+
+// IndexProgress returns the state of the current or last bulk import
+func (kb *KnowledgeBase) IndexProgress() IndexProgress {
+	kb.mu.Lock()
+	defer kb.mu.Unlock()
+	return kb.progress
+}
+
+// updateProgress changes the import state under the lock
+func (kb *KnowledgeBase) updateProgress(update func(progress *IndexProgress)) {
+	kb.mu.Lock()
+	defer kb.mu.Unlock()
+	update(&kb.progress)
+}
+
+// bulkWrite stores documents with one Elasticsearch bulk request
+func (kb *KnowledgeBase) bulkWrite(ctx context.Context, articles []KBArticleDocument) error {
 	// Build bulk request body
 	var bulkBody strings.Builder
 	for _, article := range articles {
 		// Action line
 		action := map[string]interface{}{
 			"index": map[string]string{
-				"_index": kb.indexName,
+				"_index": kb.index(ctx),
 				"_id":    article.ID,
 			},
 		}
@@ -248,9 +401,121 @@ func (kb *KnowledgeBase) BulkIndex(ctx context.Context, articles []KBArticleDocu
 		return fmt.Errorf("bulk index failed (status %d): %s", resp.StatusCode, string(body))
 	}
 
+	// Documents can fail individually while the request succeeds
+	var bulkResp struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Error json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&bulkResp); err != nil {
+		return fmt.Errorf("failed to decode bulk response: %w", err)
+	}
+	if bulkResp.Errors {
+		failed, firstError := 0, ""
+		for _, item := range bulkResp.Items {
+			for _, result := range item {
+				if len(result.Error) > 0 {
+					if failed == 0 {
+						firstError = string(result.Error)
+					}
+					failed++
+				}
+			}
+		}
+		return fmt.Errorf("bulk index failed for %d of %d articles: %s", failed, len(articles), firstError)
+	}
+
 	return nil
 }
 
+// DeleteSourceArticles removes the articles ingested from a source, except those in keep, and
+// returns how many were removed
+func (kb *KnowledgeBase) DeleteSourceArticles(ctx context.Context, sourceID string, keep map[string]bool) (int, error) {
+	// Find the source's articles
+	query := map[string]interface{}{
+		"query":   map[string]interface{}{"term": map[string]interface{}{"source_id": sourceID}},
+		"_source": false,
+		"size":    10000,
+	}
+	jsonData, _ := json.Marshal(query)
+
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		fmt.Sprintf("%s/%s/_search", kb.url, kb.index(ctx)),
+		bytes.NewBuffer(jsonData))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := kb.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("search failed (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var searchResp struct {
+		Hits struct {
+			Hits []struct {
+				ID string `json:"_id"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&searchResp); err != nil {
+		return 0, err
+	}
+
+	var stale []string
+	for _, hit := range searchResp.Hits.Hits {
+		if !keep[hit.ID] {
+			stale = append(stale, hit.ID)
+		}
+	}
+	if len(stale) == 0 {
+		return 0, nil
+	}
+
+	// Delete them from the index and the vector store
+	var bulkBody strings.Builder
+	for _, id := range stale {
+		action, _ := json.Marshal(map[string]interface{}{
+			"delete": map[string]string{"_index": kb.index(ctx), "_id": id},
+		})
+		bulkBody.Write(action)
+		bulkBody.WriteString("\n")
+	}
+
+	req, err = http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/_bulk", kb.url), strings.NewReader(bulkBody.String()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err = kb.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("bulk delete failed (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	if kb.embeddings != nil {
+		if err := kb.embeddings.Store().DeleteArticles(ctx, stale); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(stale), nil
+}
+
 // RebuildIndex rebuilds the entire knowledge base index
 func (kb *KnowledgeBase) RebuildIndex(ctx context.Context) error {
 	// In a real implementation, this would:
@@ -340,6 +605,7 @@ func (kb *KnowledgeBase) Close() error {
 // KBArticleDocument represents a knowledge base article for indexing
 type KBArticleDocument struct {
 	ID        string    `json:"id"`
+	SourceID  string    `json:"source_id,omitempty"` // the ingestion source it came from
 	Title     string    `json:"title"`
 	Content   string    `json:"content"`
 	Category  string    `json:"category"`
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	messagesByLanguage = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "csr_messages_by_language_total",
+			Help: "Customer messages answered, by the language of the conversation",
+		},
+		[]string{"language"},
+	)
+
+	translationRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "csr_translation_requests_total",
+			Help: "Knowledge base queries translated to the knowledge base language, by provider and status",
+		},
+		[]string{"provider", "status"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(messagesByLanguage)
+	prometheus.MustRegister(translationRequests)
+}
+
+// languageNames are the languages that can be detected, by ISO 639-1 code
+var languageNames = map[string]string{
+	"en": "English",
+	"es": "Spanish",
+	"fr": "French",
+	"de": "German",
+	"pt": "Portuguese",
+	"it": "Italian",
+	"nl": "Dutch",
+	"ru": "Russian",
+	"ar": "Arabic",
+	"he": "Hebrew",
+	"el": "Greek",
+	"hi": "Hindi",
+	"th": "Thai",
+	"zh": "Chinese",
+	"ja": "Japanese",
+	"ko": "Korean",
+}
+
+// languageScripts identifies languages written in their own script
+var languageScripts = []struct {
+	language string
+	table    *unicode.RangeTable
+}{
+	{"ja", unicode.Hiragana},
+	{"ja", unicode.Katakana},
+	{"ko", unicode.Hangul},
+	{"zh", unicode.Han},
+	{"ru", unicode.Cyrillic},
+	{"ar", unicode.Arabic},
+	{"he", unicode.Hebrew},
+	{"el", unicode.Greek},
+	{"hi", unicode.Devanagari},
+	{"th", unicode.Thai},
+}
+
+// languageWords are common words that tell languages written in Latin script apart
+var languageWords = map[string][]string{
+	"en": {"the", "and", "is", "are", "was", "my", "i", "you", "it", "to", "have", "not", "with", "for", "this", "what", "can", "please", "order", "hello", "thanks"},
+	"es": {"el", "la", "los", "las", "es", "y", "mi", "que", "no", "por", "para", "con", "una", "un", "está", "pedido", "hola", "gracias", "puedo", "cómo", "qué", "tengo"},
+	"fr": {"le", "la", "les", "est", "et", "je", "mon", "ma", "que", "pas", "pour", "avec", "une", "un", "commande", "bonjour", "merci", "vous", "ne", "suis", "comment"},
+	"de": {"der", "die", "das", "und", "ist", "ich", "mein", "meine", "nicht", "mit", "für", "ein", "eine", "bestellung", "hallo", "danke", "sie", "wie", "habe", "kann"},
+	"pt": {"o", "os", "as", "é", "e", "meu", "minha", "que", "não", "por", "para", "com", "uma", "um", "pedido", "olá", "obrigado", "obrigada", "você", "está", "tenho"},
+	"it": {"il", "lo", "gli", "è", "e", "mio", "mia", "che", "non", "per", "con", "una", "un", "ordine", "ciao", "grazie", "sono", "come", "ho", "posso"},
+	"nl": {"de", "het", "een", "en", "is", "ik", "mijn", "niet", "met", "voor", "bestelling", "hallo", "bedankt", "dank", "u", "jij", "hoe", "heb", "kan", "wat"},
+}
+
+// languageMarks are letters used by only some Latin-script languages
+var languageMarks = map[rune][]string{
+	'ñ': {"es"}, '¿': {"es"}, '¡': {"es"},
+	'ã': {"pt"}, 'õ': {"pt"},
+	'ß': {"de"}, 'ä': {"de"}, 'ö': {"de"}, 'ü': {"de"},
+	'ç': {"fr", "pt"}, 'è': {"fr", "it"}, 'ê': {"fr", "pt"}, 'ù': {"fr"}, 'œ': {"fr"}, 'ò': {"it"}, 'ì': {"it"},
+}
+
+// detectLanguage returns the ISO 639-1 code of the language a message is written in, or "" when
+// the message is too short or ambiguous to tell, such as "ok" or an order number
+func detectLanguage(text string) string {
+	// Languages with their own script
+	letters := 0
+	scripts := map[string]int{}
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for _, script := range languageScripts {
+			if unicode.Is(script.table, r) {
+				scripts[script.language]++
+				break
+			}
+		}
+	}
+	if letters == 0 {
+		return ""
+	}
+	if scripts["ja"] > 0 {
+		// Japanese mixes kana with Chinese characters
+		scripts["ja"] += scripts["zh"]
+		delete(scripts, "zh")
+	}
+	for language, count := range scripts {
+		if count*2 > letters {
+			return language
+		}
+	}
+
+	// Latin script: count common words and distinctive letters
+	scores := map[string]int{}
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+	for _, word := range words {
+		for language, common := range languageWords {
+			for _, w := range common {
+				if word == w {
+					scores[language]++
+					break
+				}
+			}
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		for _, language := range languageMarks[r] {
+			scores[language]++
+		}
+	}
+
+	best, bestScore, secondScore := "", 0, 0
+	for language, score := range scores {
+		switch {
+		case score > bestScore:
+			best, bestScore, secondScore = language, score, bestScore
+		case score > secondScore:
+			secondScore = score
+		}
+	}
+	if bestScore < 2 || bestScore == secondScore {
+		return ""
+	}
+	return best
+}
+
+// languageInstruction tells Claude which language to answer in
+func languageInstruction(language string) string {
+	name := languageNames[language]
+	if name == "" {
+		return ""
+	}
+	return fmt.Sprintf("\n\n**Language:** The customer is writing in %s. Reply in %s, translating anything you use from the knowledge base.", name, name)
+}
+
+// Translator translates knowledge base queries into the language the knowledge base is written in
+type Translator interface {
+	// Name identifies the provider in logs and metrics
+	Name() string
+	// Translate translates text from the source language to the target language, both ISO 639-1 codes
+	Translate(ctx context.Context, text, source, target string) (string, error)
+}
+
+// NewTranslator creates the translator for a provider: "deepl", "google" for Google Cloud
+// Translation, or "claude". An empty provider disables translation.
+func NewTranslator(provider, apiKey string) (Translator, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	switch provider {
+	case "":
+		return nil, nil
+	case "deepl":
+		// Free API keys end in ":fx" and use their own host
+		endpoint := "https://api.deepl.com/v2/translate"
+		if strings.HasSuffix(apiKey, ":fx") {
+			endpoint = "https://api-free.deepl.com/v2/translate"
+		}
+		return &deeplTranslator{apiKey: apiKey, endpoint: endpoint, httpClient: client}, nil
+	case "google":
+		return &googleTranslator{apiKey: apiKey, httpClient: client}, nil
+	case "claude":
+		return &claudeTranslator{apiKey: apiKey, model: "claude-3-5-haiku-20241022", httpClient: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown translation provider %q", provider)
+	}
+}
+
+// deeplTranslator uses the DeepL API
+type deeplTranslator struct {
+	apiKey     string
+	endpoint   string
+	httpClient *http.Client
+}
+
+func (t *deeplTranslator) Name() string { return "deepl" }
+
+func (t *deeplTranslator) Translate(ctx context.Context, text, source, target string) (string, error) {
+	body := map[string]interface{}{
+		"text":        []string{text},
+		"source_lang": strings.ToUpper(source),
+		"target_lang": strings.ToUpper(target),
+	}
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.endpoint, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "DeepL-Auth-Key "+t.apiKey)
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to call deepl: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("deepl error (status %d): %s", resp.StatusCode, string(data))
+	}
+
+	var result struct {
+		Translations []struct {
+			Text string `json:"text"`
+		} `json:"translations"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	if len(result.Translations) == 0 {
+		return "", fmt.Errorf("deepl returned no translation")
+	}
+	return result.Translations[0].Text, nil
+}
+
+// googleTranslator uses the Google Cloud Translation API (v2)
+type googleTranslator struct {
+	apiKey     string
+	httpClient *http.Client
+}
+
+func (t *googleTranslator) Name() string { return "google" }
+
+func (t *googleTranslator) Translate(ctx context.Context, text, source, target string) (string, error) {
+	var resp struct {
+		Data struct {
+			Translations []struct {
+				TranslatedText string `json:"translatedText"`
+			} `json:"translations"`
+		} `json:"data"`
+	}
+	body := map[string]interface{}{"q": text, "source": source, "target": target, "format": "text"}
+	endpoint := "https://translation.googleapis.com/language/translate/v2?key=" + url.QueryEscape(t.apiKey)
+	if err := postProvider(ctx, t.httpClient, endpoint, "", body, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Data.Translations) == 0 {
+		return "", fmt.Errorf("google translate returned no translation")
+	}
+	return resp.Data.Translations[0].TranslatedText, nil
+}
+
+// claudeTranslator has Claude translate, for deployments without a translation API
+type claudeTranslator struct {
+	apiKey     string
+	model      string
+	httpClient *http.Client
+}
+
+func (t *claudeTranslator) Name() string { return "claude" }
+
+func (t *claudeTranslator) Translate(ctx context.Context, text, source, target string) (string, error) {
+	reqBody := ClaudeRequest{
+		Model:       t.model,
+		MaxTokens:   1024,
+		Temperature: 0,
+		System:      "You translate customer support questions. Reply with only the translation.",
+		Messages: []ClaudeMessage{{
+			Role:    "user",
+			Content: fmt.Sprintf("Translate from %s to %s:\n\n%s", languageNames[source], languageNames[target], text),
+		}},
+	}
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.anthropic.com/v1/messages", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", t.apiKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to call claude api: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("claude api error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var claudeResp ClaudeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&claudeResp); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	llmTokensUsed.WithLabelValues("input").Add(float64(claudeResp.Usage.InputTokens))
+	llmTokensUsed.WithLabelValues("output").Add(float64(claudeResp.Usage.OutputTokens))
+
+	translation := strings.TrimSpace(claudeResp.Text())
+	if translation == "" {
+		return "", fmt.Errorf("claude returned no translation")
+	}
+	return translation, nil
+}
+
+// searchKnowledgeBaseIn searches the knowledge base for a query in the customer's language.
+// Articles written in that language match the query as it is; when a translator is configured,
+// the query is also translated into the knowledge base language and the two result lists are
+// interleaved.
+func (s *AgentService) searchKnowledgeBaseIn(ctx context.Context, query, language string, categories []string) ([]KBArticle, error) {
+	articles, err := s.searchKnowledgeBase(ctx, query, categories)
+	if language == "" || language == s.config.KBLanguage || s.translator == nil {
+		return articles, err
+	}
+
+	translated, terr := s.translator.Translate(ctx, query, language, s.config.KBLanguage)
+	if terr != nil {
+		translationRequests.WithLabelValues(s.translator.Name(), "error").Inc()
+		fmt.Printf("Query translation error: %v\n", terr)
+		return articles, err
+	}
+	translationRequests.WithLabelValues(s.translator.Name(), "success").Inc()
+
+	pivot, perr := s.searchKnowledgeBase(ctx, translated, categories)
+	if perr != nil {
+		return articles, err
+	}
+
+	// Alternate between the two, since their scores are not comparable
+	var merged []KBArticle
+	for i := 0; i < len(pivot) || i < len(articles); i++ {
+		if i < len(pivot) {
+			merged = appendArticles(merged, pivot[i:i+1])
+		}
+		if i < len(articles) {
+			merged = appendArticles(merged, articles[i:i+1])
+		}
+	}
+	if len(merged) > 5 {
+		merged = merged[:5]
+	}
+	return merged, nil
+}
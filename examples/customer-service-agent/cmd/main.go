@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -20,35 +23,235 @@ import (
 
 // Configuration holds all service configuration
 type Configuration struct {
-	Port                string
-	RedisURL            string
-	QdrantURL           string
-	ElasticsearchURL    string
-	ClaudeAPIKey        string
-	ZendeskAPIKey       string
-	SlackBotToken       string
-	MaxConcurrentChats  int
-	MessageQueueSize    int
-	WorkerPoolSize      int
-	EnableTracing       bool
-	LogLevel            string
+	Port                         string
+	RedisURL                     string
+	QdrantURL                    string
+	QdrantCollection             string
+	EmbeddingProvider            string
+	EmbeddingAPIKey              string
+	EmbeddingModel               string
+	EmbeddingURL                 string
+	EmbeddingBatchSize           int
+	RerankProvider               string
+	RerankAPIKey                 string
+	RerankModel                  string
+	RerankURL                    string
+	RerankMinScore               float64
+	KBIngestInterval             int // hours between re-crawls of knowledge base sources
+	ElasticsearchURL             string
+	ClaudeAPIKey                 string
+	ClaudeTimeout                int // seconds per request
+	ClaudeMaxRetries             int
+	ClaudeBreakerThreshold       int
+	ClaudeBreakerCooldown        int // seconds
+	ModelRoutingEnabled          bool
+	SimpleModel                  string
+	SimpleMaxWords               int
+	SimpleMaxTurns               int
+	SimpleMaxContext             int // estimated tokens
+	ZendeskSubdomain             string
+	ZendeskEmail                 string
+	ZendeskAPIKey                string
+	ZendeskOAuthClientID         string
+	ZendeskOAuthClientSecret     string
+	ZendeskEscalationGroupID     int
+	ZendeskEscalationTag         string
+	EscalationTickets            string // zendesk or webhook; empty opens no tickets
+	EscalationTicketChannels     string
+	EscalationTicketMessage      string
+	EscalationTicketWebhookURL   string
+	EscalationTicketWebhookToken string
+	BusinessHours                string // weekly schedule; empty when human agents are always working
+	BusinessHoursTimeZone        string
+	BusinessHoursHolidays        string
+	BusinessHoursCallbacks       bool
+	BusinessHoursOfflineMessage  string
+	BusinessHoursWaitMessage     string
+	SlackBotToken                string
+	SlackSigningSecret           string
+	TwilioAccountSID             string
+	TwilioAuthToken              string
+	TwilioWhatsAppNumber         string
+	TwilioWebhookURL             string
+	TwilioTemplateSID            string
+	TeamsAppID                   string
+	TeamsAppPassword             string
+	TeamsTenantID                string
+	IntercomAccessToken          string
+	IntercomClientSecret         string
+	IntercomAdminID              string
+	IntercomAssigneeID           string
+	EmailIMAPAddr                string
+	EmailSMTPAddr                string
+	EmailUsername                string
+	EmailPassword                string
+	EmailMailbox                 string
+	EmailFrom                    string
+	EmailSignature               string
+	EmailEscalationCC            string
+	EmailPollInterval            int
+	VoiceEnabled                 bool
+	VoicePublicURL               string
+	VoiceName                    string
+	VoiceLanguage                string
+	VoiceGreeting                string
+	VoiceEscalationDigit         string
+	VoiceEscalationNumber        string
+	VoiceEscalationQueue         string
+	CSATEnabled                  bool
+	CSATSurvey                   string
+	CSATPrompt                   string
+	CSATResponseWindow           int
+	SummaryInterval              int
+	PIIRedaction                 string
+	GuardrailsEnabled            bool
+	GuardrailsInbound            string
+	GuardrailsOutbound           string
+	GuardrailsModeration         string // claude or openai; empty leaves guardrails to their rules
+	GuardrailsModerationAPIKey   string
+	GuardrailsModerationModel    string
+	PIITenantPolicies            string
+	KBLanguage                   string
+	TranslationProvider          string
+	TranslationAPIKey            string
+	InputCostPerMTok             float64
+	OutputCostPerMTok            float64
+	TenantsFile                  string
+	ResponseCacheEnabled         bool
+	ResponseCacheThreshold       float64
+	ResponseCacheTTL             int // hours answers are reused
+	OrderAPIURL                  string
+	OrderAPIKey                  string
+	MaxConcurrentChats           int
+	WSAllowedOrigins             string
+	MessageQueueSize             int
+	QueueMaxAttempts             int
+	QueueRetryDelay              int // seconds before a failed message's first retry
+	QueueLaneWeights             string
+	VIPCustomers                 string
+	WebhookDedupWindow           int // minutes webhooks are remembered
+	ArchiveDatabaseURL           string
+	ArchiveIdle                  int // minutes
+	WorkerPoolSize               int
+	EnableTracing                bool
+	LogLevel                     string
 }
 
 // LoadConfig loads configuration from environment
 func LoadConfig() *Configuration {
 	return &Configuration{
-		Port:                getEnv("PORT", "8080"),
-		RedisURL:            getEnv("REDIS_URL", "redis://localhost:6379"),
-		QdrantURL:           getEnv("QDRANT_URL", "http://localhost:6333"),
-		ElasticsearchURL:    getEnv("ELASTICSEARCH_URL", "http://localhost:9200"),
-		ClaudeAPIKey:        getEnv("CLAUDE_API_KEY", ""),
-		ZendeskAPIKey:       getEnv("ZENDESK_API_KEY", ""),
-		SlackBotToken:       getEnv("SLACK_BOT_TOKEN", ""),
-		MaxConcurrentChats:  getEnvInt("MAX_CONCURRENT_CHATS", 10000),
-		MessageQueueSize:    getEnvInt("MESSAGE_QUEUE_SIZE", 100000),
-		WorkerPoolSize:      getEnvInt("WORKER_POOL_SIZE", 100),
-		EnableTracing:       getEnvBool("ENABLE_TRACING", true),
-		LogLevel:            getEnv("LOG_LEVEL", "info"),
+		Port:                         getEnv("PORT", "8080"),
+		RedisURL:                     getEnv("REDIS_URL", "redis://localhost:6379"),
+		QdrantURL:                    getEnv("QDRANT_URL", "http://localhost:6333"),
+		QdrantCollection:             getEnv("QDRANT_COLLECTION", "kb_chunks"),
+		EmbeddingProvider:            getEnv("EMBEDDING_PROVIDER", ""),
+		EmbeddingAPIKey:              getEnv("EMBEDDING_API_KEY", ""),
+		EmbeddingModel:               getEnv("EMBEDDING_MODEL", ""),
+		EmbeddingURL:                 getEnv("EMBEDDING_URL", ""),
+		EmbeddingBatchSize:           getEnvInt("EMBEDDING_BATCH_SIZE", 64),
+		RerankProvider:               getEnv("RERANK_PROVIDER", ""),
+		RerankAPIKey:                 getEnv("RERANK_API_KEY", ""),
+		RerankModel:                  getEnv("RERANK_MODEL", ""),
+		RerankURL:                    getEnv("RERANK_URL", ""),
+		RerankMinScore:               getEnvFloat("RERANK_MIN_SCORE", 0.2),
+		KBIngestInterval:             getEnvInt("KB_INGEST_INTERVAL_HOURS", 24),
+		ElasticsearchURL:             getEnv("ELASTICSEARCH_URL", "http://localhost:9200"),
+		ClaudeAPIKey:                 getEnv("CLAUDE_API_KEY", ""),
+		ClaudeTimeout:                getEnvInt("CLAUDE_TIMEOUT_SECONDS", 60),
+		ClaudeMaxRetries:             getEnvInt("CLAUDE_MAX_RETRIES", 3),
+		ClaudeBreakerThreshold:       getEnvInt("CLAUDE_BREAKER_THRESHOLD", 5),
+		ClaudeBreakerCooldown:        getEnvInt("CLAUDE_BREAKER_COOLDOWN_SECONDS", 30),
+		ModelRoutingEnabled:          getEnvBool("MODEL_ROUTING_ENABLED", false),
+		SimpleModel:                  getEnv("MODEL_ROUTING_SIMPLE_MODEL", defaultSimpleModel),
+		SimpleMaxWords:               getEnvInt("MODEL_ROUTING_MAX_WORDS", defaultMaxSimpleWords),
+		SimpleMaxTurns:               getEnvInt("MODEL_ROUTING_MAX_TURNS", defaultMaxSimpleTurns),
+		SimpleMaxContext:             getEnvInt("MODEL_ROUTING_MAX_CONTEXT_TOKENS", defaultMaxSimpleContext),
+		ZendeskSubdomain:             getEnv("ZENDESK_SUBDOMAIN", ""),
+		ZendeskEmail:                 getEnv("ZENDESK_EMAIL", ""),
+		ZendeskAPIKey:                getEnv("ZENDESK_API_KEY", ""),
+		ZendeskOAuthClientID:         getEnv("ZENDESK_OAUTH_CLIENT_ID", ""),
+		ZendeskOAuthClientSecret:     getEnv("ZENDESK_OAUTH_CLIENT_SECRET", ""),
+		ZendeskEscalationGroupID:     getEnvInt("ZENDESK_ESCALATION_GROUP_ID", 0),
+		ZendeskEscalationTag:         getEnv("ZENDESK_ESCALATION_TAG", "ai_escalated"),
+		EscalationTickets:            getEnv("ESCALATION_TICKETS", ""),
+		EscalationTicketChannels:     getEnv("ESCALATION_TICKET_CHANNELS", "web,slack"),
+		EscalationTicketMessage:      getEnv("ESCALATION_TICKET_MESSAGE", ""),
+		EscalationTicketWebhookURL:   getEnv("ESCALATION_TICKET_WEBHOOK_URL", ""),
+		EscalationTicketWebhookToken: getEnv("ESCALATION_TICKET_WEBHOOK_TOKEN", ""),
+		BusinessHours:                getEnv("BUSINESS_HOURS", ""),
+		BusinessHoursTimeZone:        getEnv("BUSINESS_HOURS_TIMEZONE", "UTC"),
+		BusinessHoursHolidays:        getEnv("BUSINESS_HOURS_HOLIDAYS", ""),
+		BusinessHoursCallbacks:       getEnvBool("BUSINESS_HOURS_CALLBACKS", false),
+		BusinessHoursOfflineMessage:  getEnv("BUSINESS_HOURS_OFFLINE_MESSAGE", ""),
+		BusinessHoursWaitMessage:     getEnv("BUSINESS_HOURS_WAIT_MESSAGE", ""),
+		SlackBotToken:                getEnv("SLACK_BOT_TOKEN", ""),
+		SlackSigningSecret:           getEnv("SLACK_SIGNING_SECRET", ""),
+		TwilioAccountSID:             getEnv("TWILIO_ACCOUNT_SID", ""),
+		TwilioAuthToken:              getEnv("TWILIO_AUTH_TOKEN", ""),
+		TwilioWhatsAppNumber:         getEnv("TWILIO_WHATSAPP_NUMBER", ""),
+		TwilioWebhookURL:             getEnv("TWILIO_WEBHOOK_URL", ""),
+		TwilioTemplateSID:            getEnv("TWILIO_TEMPLATE_SID", ""),
+		TeamsAppID:                   getEnv("TEAMS_APP_ID", ""),
+		TeamsAppPassword:             getEnv("TEAMS_APP_PASSWORD", ""),
+		TeamsTenantID:                getEnv("TEAMS_TENANT_ID", ""),
+		IntercomAccessToken:          getEnv("INTERCOM_ACCESS_TOKEN", ""),
+		IntercomClientSecret:         getEnv("INTERCOM_CLIENT_SECRET", ""),
+		IntercomAdminID:              getEnv("INTERCOM_ADMIN_ID", ""),
+		IntercomAssigneeID:           getEnv("INTERCOM_ESCALATION_ASSIGNEE_ID", ""),
+		EmailIMAPAddr:                getEnv("EMAIL_IMAP_ADDR", ""),
+		EmailSMTPAddr:                getEnv("EMAIL_SMTP_ADDR", ""),
+		EmailUsername:                getEnv("EMAIL_USERNAME", ""),
+		EmailPassword:                getEnv("EMAIL_PASSWORD", ""),
+		EmailMailbox:                 getEnv("EMAIL_MAILBOX", "INBOX"),
+		EmailFrom:                    getEnv("EMAIL_FROM", ""),
+		EmailSignature:               getEnv("EMAIL_SIGNATURE", ""),
+		EmailEscalationCC:            getEnv("EMAIL_ESCALATION_CC", ""),
+		EmailPollInterval:            getEnvInt("EMAIL_POLL_INTERVAL_SECONDS", 60),
+		VoiceEnabled:                 getEnvBool("VOICE_ENABLED", false),
+		VoicePublicURL:               getEnv("VOICE_PUBLIC_URL", ""),
+		VoiceName:                    getEnv("VOICE_NAME", "Polly.Joanna-Neural"),
+		VoiceLanguage:                getEnv("VOICE_LANGUAGE", "en-US"),
+		VoiceGreeting:                getEnv("VOICE_GREETING", ""),
+		VoiceEscalationDigit:         getEnv("VOICE_ESCALATION_DIGIT", "0"),
+		VoiceEscalationNumber:        getEnv("VOICE_ESCALATION_NUMBER", ""),
+		VoiceEscalationQueue:         getEnv("VOICE_ESCALATION_QUEUE", "support"),
+		CSATEnabled:                  getEnvBool("CSAT_ENABLED", false),
+		CSATSurvey:                   getEnv("CSAT_SURVEY", "csat"),
+		CSATPrompt:                   getEnv("CSAT_PROMPT", ""),
+		CSATResponseWindow:           getEnvInt("CSAT_RESPONSE_WINDOW_HOURS", 48),
+		SummaryInterval:              getEnvInt("SUMMARY_INTERVAL_MESSAGES", 6),
+		PIIRedaction:                 getEnv("PII_REDACTION", "email,phone,card,address"),
+		GuardrailsEnabled:            getEnvBool("GUARDRAILS_ENABLED", true),
+		GuardrailsInbound:            getEnv("GUARDRAILS_INBOUND", "abuse,self_harm,illegal"),
+		GuardrailsOutbound:           getEnv("GUARDRAILS_OUTBOUND", "refund_promise,commitment"),
+		GuardrailsModeration:         getEnv("GUARDRAILS_MODERATION", ""),
+		GuardrailsModerationAPIKey:   getEnv("GUARDRAILS_MODERATION_API_KEY", ""),
+		GuardrailsModerationModel:    getEnv("GUARDRAILS_MODERATION_MODEL", ""),
+		PIITenantPolicies:            getEnv("PII_TENANT_POLICIES", ""),
+		KBLanguage:                   getEnv("KB_LANGUAGE", "en"),
+		TranslationProvider:          getEnv("TRANSLATION_PROVIDER", ""),
+		TranslationAPIKey:            getEnv("TRANSLATION_API_KEY", ""),
+		InputCostPerMTok:             getEnvFloat("CLAUDE_INPUT_COST_PER_MTOK", 3),
+		OutputCostPerMTok:            getEnvFloat("CLAUDE_OUTPUT_COST_PER_MTOK", 15),
+		TenantsFile:                  getEnv("TENANTS_FILE", ""),
+		ResponseCacheEnabled:         getEnvBool("RESPONSE_CACHE_ENABLED", false),
+		ResponseCacheThreshold:       getEnvFloat("RESPONSE_CACHE_THRESHOLD", 0.95),
+		ResponseCacheTTL:             getEnvInt("RESPONSE_CACHE_TTL_HOURS", 24),
+		OrderAPIURL:                  getEnv("ORDER_API_URL", ""),
+		OrderAPIKey:                  getEnv("ORDER_API_KEY", ""),
+		MaxConcurrentChats:           getEnvInt("MAX_CONCURRENT_CHATS", 10000),
+		WSAllowedOrigins:             getEnv("WS_ALLOWED_ORIGINS", ""),
+		MessageQueueSize:             getEnvInt("MESSAGE_QUEUE_SIZE", 100000),
+		QueueMaxAttempts:             getEnvInt("QUEUE_MAX_ATTEMPTS", 5),
+		QueueRetryDelay:              getEnvInt("QUEUE_RETRY_DELAY_SECONDS", 30),
+		QueueLaneWeights:             getEnv("QUEUE_LANE_WEIGHTS", "urgent=6,high=3,normal=1"),
+		VIPCustomers:                 getEnv("VIP_CUSTOMERS", ""),
+		WebhookDedupWindow:           getEnvInt("WEBHOOK_DEDUP_WINDOW_MINUTES", 60),
+		ArchiveDatabaseURL:           getEnv("ARCHIVE_DATABASE_URL", ""),
+		ArchiveIdle:                  getEnvInt("ARCHIVE_IDLE_MINUTES", 30),
+		WorkerPoolSize:               getEnvInt("WORKER_POOL_SIZE", 100),
+		EnableTracing:                getEnvBool("ENABLE_TRACING", true),
+		LogLevel:                     getEnv("LOG_LEVEL", "info"),
 	}
 }
 
@@ -68,6 +271,15 @@ func getEnvInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		var floatValue float64
+		fmt.Sscanf(value, "%g", &floatValue)
+		return floatValue
+	}
+	return defaultValue
+}
+
 func getEnvBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		return value == "true"
@@ -129,14 +341,31 @@ func init() {
 
 // Application is the main application struct
 type Application struct {
-	Config          *Configuration
-	Router          *gin.Engine
-	AgentService    *AgentService
-	SessionManager  *SessionManager
-	MessageQueue    *MessageQueue
-	KnowledgeBase   *KnowledgeBase
-	Tracer          trace.Tracer
-	ShutdownSignal  chan os.Signal
+	Config         *Configuration
+	Router         *gin.Engine
+	AgentService   *AgentService
+	SessionManager *SessionManager
+	MessageQueue   *MessageQueue
+	KnowledgeBase  *KnowledgeBase
+	VectorStore    *VectorStore // nil when embeddings are disabled
+	Ingestor       *Ingestor
+	ChatSockets    *ChatSockets
+	Handoffs       *HandoffQueue
+	Webhooks       *WebhookDeduplicator
+	Surveys        *Surveys // nil when surveys are disabled
+	Intents        *IntentRouter
+	Prompts        *PromptStore
+	Archive        *ConversationArchive // nil when the archive is not configured
+	Tenants        *TenantRegistry
+	Zendesk        *ZendeskClient  // nil when Zendesk is not configured
+	Slack          *SlackClient    // nil when Slack is not configured
+	WhatsApp       *WhatsAppClient // nil when Twilio is not configured
+	Teams          *TeamsClient    // nil when Teams is not configured
+	Intercom       *IntercomClient // nil when Intercom is not configured
+	Email          *EmailConnector // nil when email is not configured
+	Voice          *VoiceConnector // nil when voice is disabled
+	Tracer         trace.Tracer
+	ShutdownSignal chan os.Signal
 }
 
 // NewApplication creates a new application instance
@@ -158,15 +387,49 @@ func NewApplication(config *Configuration) (*Application, error) {
 	}
 	app.SessionManager = sessionMgr
 
+	// Load tenants
+	tenants, err := LoadTenants(config.TenantsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tenants: %w", err)
+	}
+	app.Tenants = tenants
+
+	// Initialize embeddings for the knowledge base
+	embedder, err := NewEmbedder(config.EmbeddingProvider, config.EmbeddingAPIKey, config.EmbeddingModel, config.EmbeddingURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize embeddings: %w", err)
+	}
+	var embeddings *EmbeddingPipeline
+	if embedder != nil {
+		app.VectorStore = NewVectorStore(config.QdrantURL, config.QdrantCollection)
+		embeddings = NewEmbeddingPipeline(embedder, app.VectorStore, config.EmbeddingBatchSize)
+	}
+
+	// Initialize search result reranking; Claude reranks with the agent's key unless given another
+	rerankKey := config.RerankAPIKey
+	if rerankKey == "" && config.RerankProvider == "claude" {
+		rerankKey = config.ClaudeAPIKey
+	}
+	reranker, err := NewReranker(config.RerankProvider, rerankKey, config.RerankModel, config.RerankURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize reranker: %w", err)
+	}
+
 	// Initialize knowledge base
-	kb, err := NewKnowledgeBase(config.ElasticsearchURL)
+	kb, err := NewKnowledgeBase(config.ElasticsearchURL, embeddings, reranker, config.RerankMinScore)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize knowledge base: %w", err)
 	}
+	for _, tenant := range tenants.All() {
+		if err := kb.AddTenant(tenant); err != nil {
+			return nil, fmt.Errorf("failed to create knowledge base index of tenant %s: %w", tenant.ID, err)
+		}
+	}
 	app.KnowledgeBase = kb
+	app.Ingestor = NewIngestor(kb, sessionMgr.client, time.Duration(config.KBIngestInterval)*time.Hour)
 
 	// Initialize message queue
-	queue, err := NewMessageQueue(config.RedisURL, config.MessageQueueSize)
+	queue, err := NewMessageQueue(config.RedisURL, config.MessageQueueSize, config.QueueMaxAttempts, time.Duration(config.QueueRetryDelay)*time.Second, config.QueueLaneWeights)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize message queue: %w", err)
 	}
@@ -174,17 +437,270 @@ func NewApplication(config *Configuration) (*Application, error) {
 
 	// Initialize agent service
 	agentConfig := &AgentConfig{
-		ClaudeAPIKey: config.ClaudeAPIKey,
-		Model:        "claude-3-5-sonnet-20241022",
-		MaxTokens:    4000,
-		Temperature:  0.7,
-		Streaming:    true,
+		ClaudeAPIKey:      config.ClaudeAPIKey,
+		Model:             "claude-3-5-sonnet-20241022",
+		MaxTokens:         4000,
+		Temperature:       0.7,
+		Streaming:         true,
+		MaxToolRounds:     5,
+		SummaryInterval:   config.SummaryInterval,
+		KBLanguage:        config.KBLanguage,
+		InputCostPerMTok:  config.InputCostPerMTok,
+		OutputCostPerMTok: config.OutputCostPerMTok,
+		RequestTimeout:    time.Duration(config.ClaudeTimeout) * time.Second,
+		MaxRetries:        config.ClaudeMaxRetries,
+		BreakerThreshold:  config.ClaudeBreakerThreshold,
+		BreakerCooldown:   time.Duration(config.ClaudeBreakerCooldown) * time.Second,
+		Routing: ModelRouting{
+			Enabled:          config.ModelRoutingEnabled,
+			SimpleModel:      config.SimpleModel,
+			MaxWords:         config.SimpleMaxWords,
+			MaxTurns:         config.SimpleMaxTurns,
+			MaxContextTokens: config.SimpleMaxContext,
+		},
+	}
+	if config.BusinessHours != "" {
+		hours := &BusinessHours{
+			Schedule:       config.BusinessHours,
+			TimeZone:       config.BusinessHoursTimeZone,
+			Holidays:       strings.Split(config.BusinessHoursHolidays, ","),
+			Callbacks:      config.BusinessHoursCallbacks,
+			OfflineMessage: config.BusinessHoursOfflineMessage,
+			WaitMessage:    config.BusinessHoursWaitMessage,
+		}
+		if err := hours.compile(); err != nil {
+			return nil, fmt.Errorf("invalid business hours: %w", err)
+		}
+		agentConfig.BusinessHours = hours
+	}
+	// Initialize human handoff queue
+	app.Handoffs = NewHandoffQueue(sessionMgr.client)
+	app.Webhooks = NewWebhookDeduplicator(sessionMgr.client, time.Duration(config.WebhookDedupWindow)*time.Minute)
+
+	// Initialize satisfaction surveys
+	if config.CSATEnabled {
+		surveys, err := NewSurveys(SurveyConfig{
+			Kind:           config.CSATSurvey,
+			Prompt:         config.CSATPrompt,
+			ResponseWindow: time.Duration(config.CSATResponseWindow) * time.Hour,
+		}, sessionMgr.client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize surveys: %w", err)
+		}
+		app.Surveys = surveys
+	}
+
+	// Initialize personal data redaction
+	pii, err := NewPIIRedactor(PIIConfig{
+		Kinds:          config.PIIRedaction,
+		TenantPolicies: config.PIITenantPolicies,
+	}, sessionMgr.client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize pii redaction: %w", err)
 	}
-	agentService, err := NewAgentService(agentConfig, sessionMgr, kb)
+
+	// Initialize intent routing
+	intents, err := NewIntentRouter(context.Background(), sessionMgr.client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize intent routing: %w", err)
+	}
+	for _, tenant := range tenants.All() {
+		if err := intents.Seed(withTenant(context.Background(), tenant)); err != nil {
+			return nil, fmt.Errorf("failed to initialize intents of tenant %s: %w", tenant.ID, err)
+		}
+	}
+	app.Intents = intents
+
+	// Initialize the system prompt store
+	prompts := NewPromptStore(sessionMgr.client)
+	for _, tenant := range tenants.All() {
+		if err := prompts.Seed(withTenant(context.Background(), tenant)); err != nil {
+			return nil, fmt.Errorf("failed to initialize system prompt of tenant %s: %w", tenant.ID, err)
+		}
+	}
+	app.Prompts = prompts
+
+	agentService, err := NewAgentService(agentConfig, sessionMgr, kb, app.Handoffs, app.Surveys, pii, intents, prompts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize agent service: %w", err)
 	}
+
+	// Initialize query translation; Claude translates with the agent's key unless given another
+	translationKey := config.TranslationAPIKey
+	if translationKey == "" && config.TranslationProvider == "claude" {
+		translationKey = config.ClaudeAPIKey
+	}
+	translator, err := NewTranslator(config.TranslationProvider, translationKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize translator: %w", err)
+	}
+	agentService.SetTranslator(translator)
+
+	// Initialize the response cache; questions are matched by embedding
+	if config.ResponseCacheEnabled {
+		if embedder == nil {
+			return nil, fmt.Errorf("the response cache requires EMBEDDING_PROVIDER")
+		}
+		agentService.SetResponseCache(NewResponseCache(embedder, app.VectorStore, config.ResponseCacheThreshold, time.Duration(config.ResponseCacheTTL)*time.Hour))
+	}
+
+	if config.OrderAPIURL != "" {
+		agentService.RegisterTools(NewOrderClient(config.OrderAPIURL, config.OrderAPIKey).Tools()...)
+	}
+	if config.ZendeskSubdomain != "" {
+		zendesk, err := NewZendeskClient(ZendeskConfig{
+			Subdomain:         config.ZendeskSubdomain,
+			Email:             config.ZendeskEmail,
+			APIKey:            config.ZendeskAPIKey,
+			OAuthClientID:     config.ZendeskOAuthClientID,
+			OAuthClientSecret: config.ZendeskOAuthClientSecret,
+			EscalationGroupID: int64(config.ZendeskEscalationGroupID),
+			EscalationTag:     config.ZendeskEscalationTag,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize zendesk client: %w", err)
+		}
+		app.Zendesk = zendesk
+		agentService.RegisterTools(zendesk.Tools()...)
+	}
 	app.AgentService = agentService
+	queue.SetPrioritizer(app.messageLane)
+
+	// Initialize the conversation archive
+	if config.ArchiveDatabaseURL != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		archive, err := NewConversationArchive(ctx, config.ArchiveDatabaseURL, agentService, time.Duration(config.ArchiveIdle)*time.Minute)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize conversation archive: %w", err)
+		}
+		app.Archive = archive
+	}
+
+	if config.SlackBotToken != "" {
+		app.Slack = NewSlackClient(config.SlackBotToken)
+	}
+	if config.TwilioAccountSID != "" {
+		whatsapp, err := NewWhatsAppClient(WhatsAppConfig{
+			AccountSID:  config.TwilioAccountSID,
+			AuthToken:   config.TwilioAuthToken,
+			From:        config.TwilioWhatsAppNumber,
+			WebhookURL:  config.TwilioWebhookURL,
+			TemplateSID: config.TwilioTemplateSID,
+		}, sessionMgr.client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize whatsapp client: %w", err)
+		}
+		app.WhatsApp = whatsapp
+	}
+	if config.TeamsAppID != "" {
+		teams, err := NewTeamsClient(TeamsConfig{
+			AppID:       config.TeamsAppID,
+			AppPassword: config.TeamsAppPassword,
+			TenantID:    config.TeamsTenantID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize teams client: %w", err)
+		}
+		app.Teams = teams
+	}
+	if config.IntercomAccessToken != "" {
+		intercom, err := NewIntercomClient(IntercomConfig{
+			AccessToken:  config.IntercomAccessToken,
+			ClientSecret: config.IntercomClientSecret,
+			AdminID:      config.IntercomAdminID,
+			AssigneeID:   config.IntercomAssigneeID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize intercom client: %w", err)
+		}
+		app.Intercom = intercom
+	}
+
+	// Connect tenants' own channel accounts
+	if err := tenants.connectChannels(sessionMgr.client); err != nil {
+		return nil, err
+	}
+	if app.Zendesk == nil {
+		// The Zendesk tools act through whichever tenant account the conversation has
+		for _, tenant := range tenants.All() {
+			if tenant.zendesk != nil {
+				agentService.RegisterTools(tenant.zendesk.Tools()...)
+				break
+			}
+		}
+	}
+	if config.EscalationTickets != "" {
+		var webhook *TicketWebhook
+		if config.EscalationTicketWebhookURL != "" {
+			webhook = NewTicketWebhook(config.EscalationTicketWebhookURL, config.EscalationTicketWebhookToken)
+		}
+		tickets, err := NewTicketOpener(TicketConfig{
+			Backend:  config.EscalationTickets,
+			Channels: strings.Split(config.EscalationTicketChannels, ","),
+			Message:  config.EscalationTicketMessage,
+		}, app.Zendesk, webhook)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize escalation tickets: %w", err)
+		}
+		agentService.SetTicketOpener(tickets)
+	}
+
+	// Initialize guardrails; tenants may enable them with their own policy
+	moderationKey := config.GuardrailsModerationAPIKey
+	if config.GuardrailsModeration == "claude" && moderationKey == "" {
+		moderationKey = config.ClaudeAPIKey
+	}
+	moderator, err := NewModerator(config.GuardrailsModeration, moderationKey, config.GuardrailsModerationModel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize moderation: %w", err)
+	}
+	guardrails, err := NewGuardrails(&GuardrailPolicy{
+		Enabled:    config.GuardrailsEnabled,
+		Inbound:    strings.Split(config.GuardrailsInbound, ","),
+		Outbound:   strings.Split(config.GuardrailsOutbound, ","),
+		Moderation: moderator != nil,
+	}, moderator)
+	if err != nil {
+		return nil, fmt.Errorf("invalid guardrails: %w", err)
+	}
+	agentService.SetGuardrails(guardrails)
+	if config.EmailIMAPAddr != "" {
+		email, err := NewEmailConnector(EmailConfig{
+			IMAPAddr:     config.EmailIMAPAddr,
+			SMTPAddr:     config.EmailSMTPAddr,
+			Username:     config.EmailUsername,
+			Password:     config.EmailPassword,
+			Mailbox:      config.EmailMailbox,
+			From:         config.EmailFrom,
+			Signature:    config.EmailSignature,
+			EscalationCC: config.EmailEscalationCC,
+			PollInterval: time.Duration(config.EmailPollInterval) * time.Second,
+		}, queue, sessionMgr.client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize email connector: %w", err)
+		}
+		app.Email = email
+	}
+	if config.VoiceEnabled {
+		voice, err := NewVoiceConnector(VoiceConfig{
+			AuthToken:        config.TwilioAuthToken,
+			PublicURL:        config.VoicePublicURL,
+			Voice:            config.VoiceName,
+			Language:         config.VoiceLanguage,
+			Greeting:         config.VoiceGreeting,
+			EscalationDigit:  config.VoiceEscalationDigit,
+			EscalationNumber: config.VoiceEscalationNumber,
+			EscalationQueue:  config.VoiceEscalationQueue,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize voice connector: %w", err)
+		}
+		app.Voice = voice
+	}
+
+	// Initialize WebSocket chat
+	app.ChatSockets = NewChatSockets(agentService, sessionMgr.client, config.WSAllowedOrigins, config.MaxConcurrentChats)
 
 	// Initialize HTTP router
 	app.setupRouter()
@@ -211,23 +727,81 @@ func (app *Application) setupRouter() {
 
 	// API endpoints
 	api := router.Group("/api/v1")
+	api.Use(tenantMiddleware(app.Tenants))
 	{
 		// Chat endpoints
 		api.POST("/chat", app.handleChatMessage)
+		api.POST("/chat/stream", app.handleChatStream)
 		api.GET("/chat/:session_id", app.getChatHistory)
+		api.GET("/chat/:session_id/summary", app.getChatSummary)
+		api.GET("/chat/:session_id/handoff", app.getChatHandoff)
+		api.GET("/ws", app.handleWebSocket)
 		api.DELETE("/chat/:session_id", app.endChatSession)
 
 		// Webhook endpoints
 		api.POST("/webhooks/zendesk", app.handleZendeskWebhook)
-		api.POST("/webhooks/slack", app.handleSlackWebhook)
+		api.POST("/webhooks/slack", slackSignatureMiddleware(app.Config.SlackSigningSecret), app.handleSlackWebhook)
+		api.POST("/webhooks/whatsapp", app.handleWhatsAppWebhook)
+		api.POST("/webhooks/teams", app.handleTeamsWebhook)
+		api.POST("/webhooks/intercom", app.handleIntercomWebhook)
+		api.POST("/webhooks/voice", app.handleVoiceCall)
+		api.POST("/webhooks/voice/gather", app.handleVoiceGather)
+
+		// Data subject endpoints
+		users := api.Group("/users")
+		users.Use(authMiddleware(app.Config))
+		{
+			users.GET("/:user_id/export", app.exportUserData)
+			users.DELETE("/:user_id/data", app.deleteUserData)
+		}
 
 		// Admin endpoints
 		admin := api.Group("/admin")
 		admin.Use(authMiddleware(app.Config)) // Add authentication
 		{
 			admin.GET("/stats", app.getStatistics)
+			admin.GET("/analytics", app.getAnalytics)
+			admin.GET("/costs", app.getCostReport)
+			admin.GET("/costs/users/:user_id", app.getUserCost)
+			admin.GET("/costs/sessions/:session_id", app.getSessionCost)
+			admin.GET("/conversations", app.listConversations)
+			admin.GET("/conversations/export", app.exportConversations)
+			admin.GET("/conversations/:session_id", app.getConversation)
+			admin.GET("/tenants", app.listTenants)
+			admin.GET("/handoffs", app.listHandoffs)
+			admin.POST("/handoffs/claim", app.claimNextHandoff)
+			admin.GET("/handoffs/:session_id", app.getHandoff)
+			admin.POST("/handoffs/:session_id/claim", app.claimHandoff)
+			admin.POST("/handoffs/:session_id/messages", app.sendHandoffMessage)
+			admin.POST("/handoffs/:session_id/resolve", app.resolveHandoff)
 			admin.POST("/knowledge-base/index", app.indexKnowledgeBase)
+			admin.GET("/knowledge-base/index", app.getIndexProgress)
+			admin.GET("/intents", app.listIntents)
+			admin.PUT("/intents/:name", app.saveIntent)
+			admin.DELETE("/intents/:name", app.deleteIntent)
+			admin.POST("/intents/classify", app.classifyMessage)
+			admin.GET("/prompts", app.listPrompts)
+			admin.GET("/prompts/versions/:version", app.getPromptVersion)
+			admin.POST("/prompts/versions/:version/publish", app.rollbackPrompt)
+			admin.PUT("/prompts/draft", app.savePromptDraft)
+			admin.DELETE("/prompts/draft", app.discardPromptDraft)
+			admin.POST("/prompts/draft/publish", app.publishPromptDraft)
+			admin.POST("/prompts/preview", app.previewPrompt)
+			admin.DELETE("/response-cache", app.purgeResponseCache)
+			admin.GET("/queue/dead-letters", app.listDeadLetters)
+			admin.POST("/queue/dead-letters/replay", app.replayDeadLetters)
+			admin.DELETE("/queue/dead-letters", app.purgeDeadLetters)
+			admin.GET("/queue/dead-letters/:id", app.getDeadLetter)
+			admin.POST("/queue/dead-letters/:id/replay", app.replayDeadLetter)
+			admin.DELETE("/queue/dead-letters/:id", app.purgeDeadLetter)
+			admin.GET("/knowledge-base/sources", app.listSources)
+			admin.POST("/knowledge-base/sources", app.addSource)
+			admin.POST("/knowledge-base/sources/upload", app.uploadSource)
+			admin.GET("/knowledge-base/sources/:id", app.getSource)
+			admin.POST("/knowledge-base/sources/:id/ingest", app.ingestSource)
+			admin.DELETE("/knowledge-base/sources/:id", app.deleteSource)
 			admin.GET("/sessions/active", app.getActiveSessions)
+			admin.GET("/data-requests", app.listDataRequests)
 		}
 	}
 
@@ -252,6 +826,9 @@ func (app *Application) readinessCheck(c *gin.Context) {
 		"elasticsearch": app.KnowledgeBase.HealthCheck(),
 		"message_queue": app.MessageQueue.HealthCheck(),
 	}
+	if app.VectorStore != nil {
+		checks["qdrant"] = app.VectorStore.HealthCheck()
+	}
 
 	allHealthy := true
 	for _, healthy := range checks {
@@ -302,6 +879,11 @@ func (app *Application) handleChatMessage(c *gin.Context) {
 	// Record metrics
 	messageLatency.WithLabelValues(req.Channel).Observe(duration)
 
+	if errors.Is(err, ErrHandedOff) {
+		// A human agent answers through the WebSocket
+		c.JSON(http.StatusAccepted, gin.H{"session_id": req.SessionID, "handed_off": true})
+		return
+	}
 	if err != nil {
 		messagesProcessed.WithLabelValues("error", req.Channel).Inc()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -332,15 +914,32 @@ func (app *Application) getChatHistory(c *gin.Context) {
 
 // endChatSession terminates a chat session
 func (app *Application) endChatSession(c *gin.Context) {
+	ctx := c.Request.Context()
 	sessionID := c.Param("session_id")
 
-	if err := app.SessionManager.EndSession(c.Request.Context(), sessionID); err != nil {
+	session, err := app.SessionManager.Get(ctx, sessionID)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	if err := app.SessionManager.EndSession(ctx, sessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := app.Handoffs.Resolve(ctx, sessionID); err != nil {
+		log.Printf("Failed to resolve handoff of ended session %s: %v", sessionID, err)
+	}
+	app.AgentService.analytics.RecordEnd(ctx, sessionID)
+	app.archiveConversation(ctx, session)
+
 	activeConcurrentChats.Dec()
 
+	// Ask the customer how it went
+	if app.Surveys != nil && session != nil && len(session.Messages) > 0 {
+		app.sendSurvey(ctx, session)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "session ended",
 		"session_id": sessionID,
@@ -355,8 +954,22 @@ func (app *Application) handleZendeskWebhook(c *gin.Context) {
 		return
 	}
 
+	// Zendesk retries webhooks it did not see acknowledged in time
+	ctx := c.Request.Context()
+	fingerprint := webhook.fingerprint()
+	first, err := app.Webhooks.First(ctx, "zendesk", fingerprint)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !first {
+		c.JSON(http.StatusOK, gin.H{"status": "duplicate"})
+		return
+	}
+
 	// Enqueue for async processing
-	if err := app.MessageQueue.Enqueue(c.Request.Context(), &webhook); err != nil {
+	if err := app.MessageQueue.Enqueue(ctx, &webhook); err != nil {
+		app.Webhooks.Release(ctx, "zendesk", fingerprint)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -378,8 +991,22 @@ func (app *Application) handleSlackWebhook(c *gin.Context) {
 		return
 	}
 
+	// Slack redelivers events it did not see acknowledged in time
+	ctx := c.Request.Context()
+	fingerprint := webhook.fingerprint()
+	first, err := app.Webhooks.First(ctx, "slack", fingerprint)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !first {
+		c.JSON(http.StatusOK, gin.H{"status": "duplicate"})
+		return
+	}
+
 	// Enqueue for async processing
-	if err := app.MessageQueue.Enqueue(c.Request.Context(), &webhook); err != nil {
+	if err := app.MessageQueue.Enqueue(ctx, &webhook); err != nil {
+		app.Webhooks.Release(ctx, "slack", fingerprint)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -389,35 +1016,89 @@ func (app *Application) handleSlackWebhook(c *gin.Context) {
 
 // getStatistics returns system statistics
 func (app *Application) getStatistics(c *gin.Context) {
+	activeSessions, err := app.SessionManager.GetActiveCount(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	deadLetters, err := app.MessageQueue.DeadLetterCount(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	stats := map[string]interface{}{
-		"active_sessions":    app.SessionManager.GetActiveCount(),
+		"active_sessions":    activeSessions,
 		"messages_processed": messagesProcessed,
 		"queue_depth":        app.MessageQueue.Depth(),
+		"queue_lanes":        app.MessageQueue.LaneDepths(),
+		"dead_letters":       deadLetters,
 		"uptime_seconds":     time.Since(startTime).Seconds(),
 	}
+	if app.Surveys != nil {
+		satisfaction, err := app.Surveys.Stats(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		stats["satisfaction"] = satisfaction
+	}
+	if app.AgentService.responses != nil {
+		stats["response_cache"] = app.AgentService.responses.Stats()
+	}
 
 	c.JSON(http.StatusOK, stats)
 }
 
-// indexKnowledgeBase rebuilds the knowledge base index
+// indexKnowledgeBase starts rebuilding the knowledge base index. Embedding a large knowledge
+// base outlasts a request, so the rebuild runs in the background; getIndexProgress follows it.
 func (app *Application) indexKnowledgeBase(c *gin.Context) {
-	if err := app.KnowledgeBase.RebuildIndex(c.Request.Context()); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if app.KnowledgeBase.IndexProgress().Running {
+		c.JSON(http.StatusConflict, gin.H{"error": "an import is already running"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "index rebuilt"})
+	go func() {
+		if err := app.KnowledgeBase.RebuildIndex(detachContext(c.Request.Context())); err != nil {
+			log.Printf("Knowledge base rebuild failed: %v", err)
+		}
+	}()
+
+	c.JSON(http.StatusAccepted, gin.H{"status": "index rebuild started"})
 }
 
-// getActiveSessions returns all active sessions
+// getIndexProgress returns the progress of the current or last knowledge base import
+func (app *Application) getIndexProgress(c *gin.Context) {
+	c.JSON(http.StatusOK, app.KnowledgeBase.IndexProgress())
+}
+
+// getActiveSessions returns a page of the tenant's active sessions, most recently active first,
+// with the number of active sessions
 func (app *Application) getActiveSessions(c *gin.Context) {
-	sessions, err := app.SessionManager.GetActiveSessions(c.Request.Context())
+	count, err := strconv.Atoi(c.DefaultQuery("count", "100"))
+	if err != nil || count < 1 || count > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "count must be between 1 and 1000"})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset must not be negative"})
+		return
+	}
+
+	total, err := app.SessionManager.GetActiveCount(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sessions, err := app.SessionManager.GetActiveSessions(c.Request.Context(), offset, count)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
+		"total":    total,
 		"count":    len(sessions),
 		"sessions": sessions,
 	})
@@ -431,6 +1112,41 @@ func (app *Application) Start() error {
 		go app.worker(i)
 	}
 
+	// Start WebSocket event relay
+	app.ChatSockets.Start(context.Background())
+
+	// Index sessions saved before the active session index; clean up and archive each tenant's
+	for _, tenant := range app.Tenants.All() {
+		ctx := withTenant(context.Background(), tenant)
+		indexed, err := app.SessionManager.IndexSessions(ctx)
+		if err != nil {
+			log.Printf("Failed to index sessions of tenant %s: %v", tenant.ID, err)
+		} else if indexed > 0 {
+			log.Printf("Indexed %d sessions of tenant %s", indexed, tenant.ID)
+		}
+		app.SessionManager.StartCleanupRoutine(ctx, sessionCleanupInterval, app.SessionManager.sessionTTL)
+		if app.Archive != nil {
+			app.Archive.Start(ctx)
+		}
+	}
+
+	// Start knowledge base re-crawls, of each tenant's sources
+	for _, tenant := range app.Tenants.All() {
+		app.Ingestor.Start(withTenant(context.Background(), tenant))
+	}
+
+	// Start deleting expired cached answers, of each tenant
+	if app.AgentService.responses != nil {
+		for _, tenant := range app.Tenants.All() {
+			app.AgentService.responses.Start(withTenant(context.Background(), tenant))
+		}
+	}
+
+	// Start polling the support mailbox
+	if app.Email != nil {
+		app.Email.Start(context.Background())
+	}
+
 	// Start HTTP server
 	log.Printf("Starting HTTP server on port %s...", app.Config.Port)
 	srv := &http.Server{
@@ -440,6 +1156,8 @@ func (app *Application) Start() error {
 		WriteTimeout: 30 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
+	// Shutdown does not wait for WebSocket connections, so close them as it begins
+	srv.RegisterOnShutdown(app.ChatSockets.Close)
 
 	// Handle graceful shutdown
 	signal.Notify(app.ShutdownSignal, os.Interrupt, syscall.SIGTERM)
@@ -458,6 +1176,9 @@ func (app *Application) Start() error {
 		app.SessionManager.Close()
 		app.MessageQueue.Close()
 		app.KnowledgeBase.Close()
+		if app.Archive != nil {
+			app.Archive.Close()
+		}
 	}()
 
 	return srv.ListenAndServe()
@@ -468,22 +1189,29 @@ func (app *Application) worker(id int) {
 	log.Printf("Worker %d started", id)
 
 	for {
-		ctx := context.Background()
-		message, err := app.MessageQueue.Dequeue(ctx)
+		msg, err := app.MessageQueue.Dequeue(context.Background())
 		if err != nil {
 			log.Printf("Worker %d: dequeue error: %v", id, err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
-		if message == nil {
+		if msg == nil {
 			time.Sleep(100 * time.Millisecond)
 			continue
 		}
 
-		// Process message based on type
-		if err := app.processQueuedMessage(ctx, message); err != nil {
-			log.Printf("Worker %d: processing error: %v", id, err)
+		// Process message based on type, for the tenant it was received for
+		ctx := withTenant(context.Background(), app.Tenants.Get(msg.TenantID))
+		if err := app.processQueuedMessage(ctx, msg.Message); err != nil {
+			log.Printf("Worker %d: processing error (attempt %d): %v", id, msg.Attempts, err)
+			if err := app.MessageQueue.Fail(context.Background(), msg, err); err != nil {
+				log.Printf("Worker %d: %v", id, err)
+			}
+			continue
+		}
+		if err := app.MessageQueue.Ack(context.Background(), msg); err != nil {
+			log.Printf("Worker %d: %v", id, err)
 		}
 	}
 }
@@ -495,11 +1223,104 @@ func (app *Application) processQueuedMessage(ctx context.Context, message interf
 		return app.processZendeskMessage(ctx, msg)
 	case *SlackWebhook:
 		return app.processSlackMessage(ctx, msg)
+	case *WhatsAppMessage:
+		return app.processWhatsAppMessage(ctx, msg)
+	case *TeamsActivity:
+		return app.processTeamsMessage(ctx, msg)
+	case *IntercomMessage:
+		return app.processIntercomMessage(ctx, msg)
+	case *EmailMessage:
+		return app.processEmailMessage(ctx, msg)
 	default:
 		return fmt.Errorf("unknown message type: %T", message)
 	}
 }
 
+// sendToCustomer writes to a session's customer outside an answer, through the channel they last
+// wrote from: role is agent for human agents' messages, or assistant. Chat clients receive the
+// message over their WebSockets.
+func (app *Application) sendToCustomer(ctx context.Context, session *Session, role, text string) error {
+	if err := app.ChatSockets.Publish(ctx, &ChatEvent{Type: ChatEventMessage, SessionID: session.SessionID, Role: role, Text: text}); err != nil {
+		log.Printf("WebSocket event for session %s not delivered: %v", session.SessionID, err)
+	}
+	if session.Source == nil {
+		// Chat API sessions
+		return nil
+	}
+
+	source := session.Source
+	response := &ChatMessageResponse{SessionID: session.SessionID, Message: text}
+	switch source.Type {
+
+	case "*main.ZendeskWebhook":
+		var webhook ZendeskWebhook
+		if err := json.Unmarshal(source.Data, &webhook); err != nil {
+			return fmt.Errorf("failed to unmarshal zendesk source: %w", err)
+		}
+		if app.zendeskFor(ctx) == nil {
+			return fmt.Errorf("zendesk is not configured")
+		}
+		return app.zendeskFor(ctx).AddComment(ctx, webhook.TicketID, text, true)
+
+	case "*main.SlackWebhook":
+		var webhook SlackWebhook
+		if err := json.Unmarshal(source.Data, &webhook); err != nil {
+			return fmt.Errorf("failed to unmarshal slack source: %w", err)
+		}
+		if app.slackFor(ctx) == nil {
+			return fmt.Errorf("slack is not configured")
+		}
+		threadTS := webhook.Event.ThreadTS
+		if threadTS == "" {
+			threadTS = webhook.Event.TS
+		}
+		return app.slackFor(ctx).Reply(ctx, webhook.Event.Channel, threadTS, text)
+
+	case "*main.WhatsAppMessage":
+		var msg WhatsAppMessage
+		if err := json.Unmarshal(source.Data, &msg); err != nil {
+			return fmt.Errorf("failed to unmarshal whatsapp source: %w", err)
+		}
+		if app.whatsAppFor(ctx) == nil {
+			return fmt.Errorf("whatsapp is not configured")
+		}
+		return app.whatsAppFor(ctx).Send(ctx, msg.From, text)
+
+	case "*main.TeamsActivity":
+		var activity TeamsActivity
+		if err := json.Unmarshal(source.Data, &activity); err != nil {
+			return fmt.Errorf("failed to unmarshal teams source: %w", err)
+		}
+		if app.Teams == nil {
+			return fmt.Errorf("teams is not configured")
+		}
+		return app.Teams.ReplyText(ctx, &activity, text)
+
+	case "*main.IntercomMessage":
+		var msg IntercomMessage
+		if err := json.Unmarshal(source.Data, &msg); err != nil {
+			return fmt.Errorf("failed to unmarshal intercom source: %w", err)
+		}
+		if app.intercomFor(ctx) == nil {
+			return fmt.Errorf("intercom is not configured")
+		}
+		return app.intercomFor(ctx).Reply(ctx, msg.ConversationID, response)
+
+	case "*main.EmailMessage":
+		var msg EmailMessage
+		if err := json.Unmarshal(source.Data, &msg); err != nil {
+			return fmt.Errorf("failed to unmarshal email source: %w", err)
+		}
+		if app.Email == nil {
+			return fmt.Errorf("email is not configured")
+		}
+		return app.Email.Reply(ctx, &msg, response)
+
+	default:
+		return fmt.Errorf("cannot send messages through %s", session.Channel)
+	}
+}
+
 // processZendeskMessage processes Zendesk ticket updates
 func (app *Application) processZendeskMessage(ctx context.Context, webhook *ZendeskWebhook) error {
 	// Convert to chat message
@@ -512,38 +1333,117 @@ func (app *Application) processZendeskMessage(ctx context.Context, webhook *Zend
 			"ticket_id": webhook.TicketID,
 			"priority":  webhook.Priority,
 		},
+		ZendeskTicketID: webhook.TicketID,
+		Source:          webhook,
 	}
 
 	// Process with agent
 	response, err := app.AgentService.ProcessMessage(ctx, req)
+	if errors.Is(err, ErrHandedOff) {
+		// A human agent answers from the console
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
 	// Send response back to Zendesk
-	return app.sendZendeskResponse(ctx, webhook.TicketID, response.Message)
+	return app.sendZendeskResponse(ctx, webhook.TicketID, response)
 }
 
-// processSlackMessage processes Slack messages
+// processSlackMessage answers a Slack message in its thread. Each thread is a conversation. The
+// agent answers direct messages and mentions, and follows up in threads it is already part of.
 func (app *Application) processSlackMessage(ctx context.Context, webhook *SlackWebhook) error {
-	// Implement Slack message processing
-	// Similar to Zendesk but with Slack API
+	event := webhook.Event
+
+	// Skip the bot's own replies, edits, deletions, and other message subtypes
+	if event.BotID != "" || event.Subtype != "" || event.User == "" {
+		return nil
+	}
+	if event.Type != "message" && event.Type != "app_mention" {
+		return nil
+	}
+	text := slackMessageText(event.Text)
+	if text == "" {
+		return nil
+	}
+	if app.slackFor(ctx) == nil {
+		log.Printf("Slack is not configured; dropping message %s in %s", event.TS, event.Channel)
+		return nil
+	}
+
+	threadTS := event.ThreadTS
+	if threadTS == "" {
+		threadTS = event.TS
+	}
+	sessionID := fmt.Sprintf("slack-%s-%s", event.Channel, threadTS)
+
+	// In channels, only mentions start a conversation
+	if event.Type == "message" && event.ChannelType != "im" {
+		session, err := app.SessionManager.Get(ctx, sessionID)
+		if err != nil {
+			return err
+		}
+		if session == nil {
+			return nil
+		}
+	}
+
+	// Convert to chat message
+	req := &ChatMessageRequest{
+		SessionID: sessionID,
+		Message:   text,
+		UserID:    event.User,
+		Channel:   "slack",
+		Metadata: map[string]interface{}{
+			"slack_channel": event.Channel,
+			"thread_ts":     threadTS,
+		},
+		Source: webhook,
+	}
+	if err := req.Validate(); err != nil {
+		return app.slackFor(ctx).Reply(ctx, event.Channel, threadTS, "Sorry, "+err.Error()+".")
+	}
+
+	// Process with agent
+	response, err := app.AgentService.ProcessMessage(ctx, req)
+	if errors.Is(err, ErrHandedOff) {
+		// A human agent answers from the console
+		return nil
+	}
+	if err != nil {
+		if replyErr := app.slackFor(ctx).Reply(ctx, event.Channel, threadTS, slackFallbackReply); replyErr != nil {
+			log.Printf("Failed to post fallback reply to Slack: %v", replyErr)
+		}
+		return err
+	}
+
+	// Send response back to Slack
+	if err := app.slackFor(ctx).Reply(ctx, event.Channel, threadTS, response.Message); err != nil {
+		return fmt.Errorf("failed to reply in slack thread %s: %w", threadTS, err)
+	}
 	return nil
 }
 
-// sendZendeskResponse sends a response to Zendesk
-func (app *Application) sendZendeskResponse(ctx context.Context, ticketID int, message string) error {
-	// Implement Zendesk API call to add comment
-	// This is a placeholder
-	log.Printf("Sending to Zendesk ticket %d: %s", ticketID, message)
+// sendZendeskResponse posts the agent's answer on the ticket, assigning it to a human when the
+// agent escalated
+func (app *Application) sendZendeskResponse(ctx context.Context, ticketID int, response *ChatMessageResponse) error {
+	if app.zendeskFor(ctx) == nil {
+		log.Printf("Zendesk is not configured; dropping reply to ticket %d", ticketID)
+		return nil
+	}
+	if err := app.zendeskFor(ctx).Reply(ctx, ticketID, response); err != nil {
+		return fmt.Errorf("failed to reply to zendesk ticket %d: %w", ticketID, err)
+	}
 	return nil
 }
 
 // authMiddleware provides API authentication
 func authMiddleware(config *Configuration) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// Tenants' own keys only reach their own data
 		apiKey := c.GetHeader("X-API-Key")
-		if apiKey == "" || apiKey != os.Getenv("API_KEY") {
+		if (apiKey == "" || apiKey != os.Getenv("API_KEY")) && !tenantAPIKey(c) {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			c.Abort()
 			return
@@ -4,21 +4,101 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-// MessageQueue handles async message processing using Redis Streams
+// retryPollInterval is how often each replica moves retries that are due back onto the stream
+const retryPollInterval = time.Second
+
+// Lanes of the message queue, most urgent first
+const (
+	LaneUrgent = "urgent"
+	LaneHigh   = "high"
+	LaneNormal = "normal"
+)
+
+var (
+	queueMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "csr_queue_messages_total",
+			Help: "Messages queued, by lane",
+		},
+		[]string{"lane"},
+	)
+
+	queueRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "csr_queue_retries_total",
+			Help: "Queued messages scheduled for another attempt after failing, by message type",
+		},
+		[]string{"type"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(queueMessages)
+	prometheus.MustRegister(queueRetries)
+}
+
+// MessageQueue handles async message processing using Redis Streams. Messages are queued in
+// priority lanes, a stream each, which workers read in proportion to their weights. Messages that
+// fail are retried with exponential backoff, and moved to a dead-letter stream once they have
+// failed maxAttempts times.
 type MessageQueue struct {
-	client     *redis.Client
-	streamName string
-	groupName  string
-	maxLen     int64
+	client      *redis.Client
+	lanes       []*queueLane // most urgent first
+	groupName   string
+	consumer    string
+	maxLen      int64
+	maxAttempts int
+	retryDelay  time.Duration // before the first retry; doubled for each one after
+	prioritize  func(ctx context.Context, message interface{}) string
+
+	retriesKey     string // sorted set of messages waiting to be retried, by when they are due
+	deadLetterName string
+
+	mu            sync.Mutex
+	lastRetryPoll time.Time
+	held          []*QueuedMessage // read together with another message while waiting
+}
+
+// queueLane is a stream of the queue
+type queueLane struct {
+	name   string
+	stream string
+	weight int
+	credit int // for smooth weighted round-robin between the lanes
 }
 
-// NewMessageQueue creates a new message queue
-func NewMessageQueue(redisURL string, maxLen int) (*MessageQueue, error) {
+// QueuedMessage is a message taken from the queue, to be acknowledged with Ack once processed
+// or handed back with Fail
+type QueuedMessage struct {
+	ID       string
+	Type     string
+	Data     string
+	TenantID string // the tenant the message was received for
+	Lane     string
+	Attempts int // this one included
+	Enqueued time.Time
+	Message  interface{} // e.g. *SlackWebhook
+}
+
+// NewMessageQueue creates a new message queue. Messages are attempted up to maxAttempts times,
+// waiting retryDelay before the first retry. laneWeights is a comma list of lane=weight pairs.
+func NewMessageQueue(redisURL string, maxLen, maxAttempts int, retryDelay time.Duration, laneWeights string) (*MessageQueue, error) {
+	weights, err := parseLaneWeights(laneWeights)
+	if err != nil {
+		return nil, fmt.Errorf("invalid QUEUE_LANE_WEIGHTS: %w", err)
+	}
+
 	opts, err := redis.ParseURL(redisURL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid redis url: %w", err)
@@ -34,11 +114,22 @@ func NewMessageQueue(redisURL string, maxLen int) (*MessageQueue, error) {
 		return nil, fmt.Errorf("redis connection failed: %w", err)
 	}
 
+	hostname, _ := os.Hostname()
 	mq := &MessageQueue{
-		client:     client,
-		streamName: "agent_messages",
-		groupName:  "workers",
-		maxLen:     int64(maxLen),
+		client: client,
+		// The normal lane keeps the stream messages were queued on before lanes
+		lanes: []*queueLane{
+			{name: LaneUrgent, stream: "agent_messages:urgent", weight: weights[LaneUrgent]},
+			{name: LaneHigh, stream: "agent_messages:high", weight: weights[LaneHigh]},
+			{name: LaneNormal, stream: "agent_messages", weight: weights[LaneNormal]},
+		},
+		groupName:      "workers",
+		consumer:       fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		maxLen:         int64(maxLen),
+		maxAttempts:    maxAttempts,
+		retryDelay:     retryDelay,
+		retriesKey:     "agent_messages:retries",
+		deadLetterName: "agent_messages:dead",
 	}
 
 	// Create consumer group if it doesn't exist
@@ -49,20 +140,59 @@ func NewMessageQueue(redisURL string, maxLen int) (*MessageQueue, error) {
 	return mq, nil
 }
 
-// createConsumerGroup creates the consumer group for the stream
+// parseLaneWeights parses a comma list of lane=weight pairs. Lanes left out have a weight of 1.
+func parseLaneWeights(list string) (map[string]int, error) {
+	weights := map[string]int{LaneUrgent: 1, LaneHigh: 1, LaneNormal: 1}
+	for _, pair := range strings.Split(list, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, known := weights[name]; !known {
+			return nil, fmt.Errorf("unknown lane %q", name)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || weight < 1 {
+			return nil, fmt.Errorf("weight of lane %s must be a positive integer", name)
+		}
+		weights[name] = weight
+	}
+	return weights, nil
+}
+
+// SetPrioritizer has messages queued in the lane prioritize picks for them, instead of the normal
+// lane
+func (mq *MessageQueue) SetPrioritizer(prioritize func(ctx context.Context, message interface{}) string) {
+	mq.prioritize = prioritize
+}
+
+// lane returns a lane by name. Messages queued before lanes have none, and are normal.
+func (mq *MessageQueue) lane(name string) *queueLane {
+	for _, lane := range mq.lanes {
+		if lane.name == name {
+			return lane
+		}
+	}
+	return mq.lanes[len(mq.lanes)-1]
+}
+
+// createConsumerGroup creates the consumer group for each lane's stream
 func (mq *MessageQueue) createConsumerGroup() error {
 	ctx := context.Background()
 
-	// Try to create the group
-	err := mq.client.XGroupCreateMkStream(ctx, mq.streamName, mq.groupName, "0").Err()
-	if err != nil && err.Error() != "BUSYGROUP Consumer Group name already exists" {
-		return fmt.Errorf("failed to create consumer group: %w", err)
+	for _, lane := range mq.lanes {
+		// Try to create the group
+		err := mq.client.XGroupCreateMkStream(ctx, lane.stream, mq.groupName, "0").Err()
+		if err != nil && err.Error() != "BUSYGROUP Consumer Group name already exists" {
+			return fmt.Errorf("failed to create consumer group: %w", err)
+		}
 	}
 
 	return nil
 }
 
-// Enqueue adds a message to the queue
+// Enqueue adds a message to the queue, in the lane the prioritizer picks for it
 func (mq *MessageQueue) Enqueue(ctx context.Context, message interface{}) error {
 	// Serialize message
 	data, err := json.Marshal(message)
@@ -73,34 +203,110 @@ func (mq *MessageQueue) Enqueue(ctx context.Context, message interface{}) error
 	// Determine message type
 	msgType := fmt.Sprintf("%T", message)
 
+	lane := mq.lane(LaneNormal)
+	if mq.prioritize != nil {
+		lane = mq.lane(mq.prioritize(ctx, message))
+	}
+
 	// Add to stream with maxlen to prevent unbounded growth
 	args := &redis.XAddArgs{
-		Stream: mq.streamName,
+		Stream: lane.stream,
 		MaxLen: mq.maxLen,
 		Approx: true, // Use approximate trimming for better performance
 		Values: map[string]interface{}{
-			"type": msgType,
-			"data": string(data),
-			"ts":   time.Now().Unix(),
+			"type":   msgType,
+			"data":   string(data),
+			"ts":     time.Now().Unix(),
+			"tenant": tenantFrom(ctx).ID,
+			"lane":   lane.name,
 		},
 	}
 
 	if err := mq.client.XAdd(ctx, args).Err(); err != nil {
 		return fmt.Errorf("failed to enqueue message: %w", err)
 	}
+	queueMessages.WithLabelValues(lane.name).Inc()
 
 	return nil
 }
 
-// Dequeue retrieves and processes a message from the queue
-func (mq *MessageQueue) Dequeue(ctx context.Context) (interface{}, error) {
+// Dequeue takes the next message from the queue, or returns nil when there is none. The lanes
+// are tried in weighted turn, so that busy lanes take most of the workers' time without starving
+// the others. Messages that cannot be decoded are moved to the dead-letter stream instead of
+// being returned.
+func (mq *MessageQueue) Dequeue(ctx context.Context) (*QueuedMessage, error) {
+	// Put retries that are due back on their streams
+	if err := mq.pollRetries(ctx); err != nil {
+		return nil, err
+	}
+
+	if msg := mq.takeHeld(); msg != nil {
+		return mq.decode(ctx, msg)
+	}
+
+	for _, lane := range mq.laneOrder() {
+		msgs, err := mq.read(ctx, []*queueLane{lane}, -1)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) > 0 {
+			return mq.decode(ctx, msgs[0])
+		}
+	}
+
+	// Every lane is empty: wait for a message on any of them
+	msgs, err := mq.read(ctx, mq.lanes, time.Second)
+	if err != nil || len(msgs) == 0 {
+		return nil, err
+	}
+	mq.hold(msgs[1:])
+	return mq.decode(ctx, msgs[0])
+}
+
+// laneOrder returns the lanes in the order to try them: the lane whose turn it is by smooth
+// weighted round-robin, then the others, most urgent first
+func (mq *MessageQueue) laneOrder() []*queueLane {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	var next *queueLane
+	total := 0
+	for _, lane := range mq.lanes {
+		lane.credit += lane.weight
+		total += lane.weight
+		if next == nil || lane.credit > next.credit {
+			next = lane
+		}
+	}
+	next.credit -= total
+
+	order := []*queueLane{next}
+	for _, lane := range mq.lanes {
+		if lane != next {
+			order = append(order, lane)
+		}
+	}
+	return order
+}
+
+// read reads up to one new message from each lane's stream, waiting up to block for one when
+// block is not negative
+func (mq *MessageQueue) read(ctx context.Context, lanes []*queueLane, block time.Duration) ([]*QueuedMessage, error) {
+	streams := make([]string, 0, 2*len(lanes))
+	for _, lane := range lanes {
+		streams = append(streams, lane.stream)
+	}
+	for range lanes {
+		streams = append(streams, ">")
+	}
+
 	// Read from stream with consumer group
-	streams, err := mq.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+	results, err := mq.client.XReadGroup(ctx, &redis.XReadGroupArgs{
 		Group:    mq.groupName,
-		Consumer: "worker", // In production, use unique consumer ID
-		Streams:  []string{mq.streamName, ">"},
+		Consumer: mq.consumer,
+		Streams:  streams,
 		Count:    1,
-		Block:    time.Second,
+		Block:    block,
 	}).Result()
 
 	if err == redis.Nil {
@@ -110,24 +316,94 @@ func (mq *MessageQueue) Dequeue(ctx context.Context) (interface{}, error) {
 		return nil, fmt.Errorf("failed to dequeue message: %w", err)
 	}
 
-	if len(streams) == 0 || len(streams[0].Messages) == 0 {
-		return nil, nil
+	var msgs []*QueuedMessage
+	for _, lane := range lanes {
+		for _, result := range results {
+			if result.Stream != lane.stream {
+				continue
+			}
+			for _, entry := range result.Messages {
+				msg := queuedMessage(entry)
+				msg.Lane = lane.name
+				msgs = append(msgs, msg)
+			}
+		}
+	}
+	return msgs, nil
+}
+
+// hold keeps messages read while waiting for the next Dequeue calls
+func (mq *MessageQueue) hold(msgs []*QueuedMessage) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	mq.held = append(mq.held, msgs...)
+}
+
+// takeHeld returns the most urgent held message, or nil when none are held
+func (mq *MessageQueue) takeHeld() *QueuedMessage {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	for _, lane := range mq.lanes {
+		for i, msg := range mq.held {
+			if msg.Lane == lane.name {
+				mq.held = append(mq.held[:i], mq.held[i+1:]...)
+				return msg
+			}
+		}
 	}
+	return nil
+}
 
-	msg := streams[0].Messages[0]
+// decode counts an attempt at a message read from a stream and decodes it
+func (mq *MessageQueue) decode(ctx context.Context, msg *QueuedMessage) (*QueuedMessage, error) {
+	var err error
+	msg.Attempts++
+	if msg.Message, err = decodeMessage(msg.Type, msg.Data); err != nil {
+		return nil, mq.deadLetter(ctx, msg, err)
+	}
+	return msg, nil
+}
+
+// queuedMessage reads a stream entry of the queue or the dead-letter stream
+func queuedMessage(entry redis.XMessage) *QueuedMessage {
+	msg := &QueuedMessage{ID: entry.ID}
+	msg.Type, _ = entry.Values["type"].(string)
+	msg.Data, _ = entry.Values["data"].(string)
 
-	// Extract message data
-	msgType, ok := msg.Values["type"].(string)
-	if !ok {
-		return nil, fmt.Errorf("invalid message type")
+	// Messages queued before tenants were introduced belong to the default tenant
+	msg.TenantID, _ = entry.Values["tenant"].(string)
+	if msg.TenantID == "" {
+		msg.TenantID = DefaultTenantID
+	}
+	// Messages queued before lanes were introduced are normal
+	msg.Lane, _ = entry.Values["lane"].(string)
+	if msg.Lane == "" {
+		msg.Lane = LaneNormal
+	}
+	// Messages queued before retries were introduced have not been attempted
+	attempts, _ := entry.Values["attempts"].(string)
+	msg.Attempts, _ = strconv.Atoi(attempts)
+	ts, _ := entry.Values["ts"].(string)
+	if unix, err := strconv.ParseInt(ts, 10, 64); err == nil {
+		msg.Enqueued = time.Unix(unix, 0)
 	}
+	return msg
+}
 
-	data, ok := msg.Values["data"].(string)
-	if !ok {
-		return nil, fmt.Errorf("invalid message data")
+// values returns the stream fields of a message with the attempts made so far
+func (msg *QueuedMessage) values() map[string]interface{} {
+	return map[string]interface{}{
+		"type":     msg.Type,
+		"data":     msg.Data,
+		"ts":       msg.Enqueued.Unix(),
+		"tenant":   msg.TenantID,
+		"lane":     msg.Lane,
+		"attempts": msg.Attempts,
 	}
+}
 
-	// Deserialize based on type
+// decodeMessage deserializes a queued message of the given type
+func decodeMessage(msgType, data string) (interface{}, error) {
 	var message interface{}
 	switch msgType {
 	case "*main.ZendeskWebhook":
@@ -144,28 +420,137 @@ func (mq *MessageQueue) Dequeue(ctx context.Context) (interface{}, error) {
 		}
 		message = &webhook
 
+	case "*main.WhatsAppMessage":
+		var msg WhatsAppMessage
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal whatsapp message: %w", err)
+		}
+		message = &msg
+
+	case "*main.TeamsActivity":
+		var activity TeamsActivity
+		if err := json.Unmarshal([]byte(data), &activity); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal teams activity: %w", err)
+		}
+		message = &activity
+
+	case "*main.IntercomMessage":
+		var msg IntercomMessage
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal intercom message: %w", err)
+		}
+		message = &msg
+
+	case "*main.EmailMessage":
+		var msg EmailMessage
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal email message: %w", err)
+		}
+		message = &msg
+
 	default:
 		return nil, fmt.Errorf("unknown message type: %s", msgType)
 	}
 
-	// Acknowledge message processing
-	if err := mq.client.XAck(ctx, mq.streamName, mq.groupName, msg.ID).Err(); err != nil {
-		return nil, fmt.Errorf("failed to ack message: %w", err)
+	return message, nil
+}
+
+// Ack acknowledges a message once it is processed
+func (mq *MessageQueue) Ack(ctx context.Context, msg *QueuedMessage) error {
+	if err := mq.client.XAck(ctx, mq.lane(msg.Lane).stream, mq.groupName, msg.ID).Err(); err != nil {
+		return fmt.Errorf("failed to ack message: %w", err)
 	}
+	return nil
+}
 
-	return message, nil
+// Fail hands back a message that could not be processed. It is retried after a backoff, or
+// moved to the dead-letter stream once it has failed maxAttempts times.
+func (mq *MessageQueue) Fail(ctx context.Context, msg *QueuedMessage, cause error) error {
+	if msg.Attempts >= mq.maxAttempts {
+		return mq.deadLetter(ctx, msg, cause)
+	}
+
+	retry := msg.values()
+	retry["error"] = cause.Error()
+	data, err := json.Marshal(retry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal retry: %w", err)
+	}
+	delay := time.Duration(float64(mq.retryDelay) * math.Pow(2, float64(msg.Attempts-1)))
+	_, err = mq.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, mq.retriesKey, &redis.Z{Score: float64(time.Now().Add(delay).Unix()), Member: data})
+		pipe.XAck(ctx, mq.lane(msg.Lane).stream, mq.groupName, msg.ID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to schedule retry: %w", err)
+	}
+	queueRetries.WithLabelValues(msg.Type).Inc()
+	return nil
 }
 
-// Depth returns the approximate queue depth
-func (mq *MessageQueue) Depth() int64 {
-	ctx := context.Background()
+// pollRetries puts the retries that are due back on their lane's stream. Each replica polls at
+// most once per retryPollInterval, and a retry is taken by whichever replica removes it first.
+func (mq *MessageQueue) pollRetries(ctx context.Context) error {
+	mq.mu.Lock()
+	if time.Since(mq.lastRetryPoll) < retryPollInterval {
+		mq.mu.Unlock()
+		return nil
+	}
+	mq.lastRetryPoll = time.Now()
+	mq.mu.Unlock()
 
-	info, err := mq.client.XInfoStream(ctx, mq.streamName).Result()
+	due, err := mq.client.ZRangeByScore(ctx, mq.retriesKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().Unix(), 10),
+		Count: 100,
+	}).Result()
 	if err != nil {
-		return 0
+		return fmt.Errorf("failed to list retries: %w", err)
+	}
+	for _, data := range due {
+		taken, err := mq.client.ZRem(ctx, mq.retriesKey, data).Result()
+		if err != nil {
+			return fmt.Errorf("failed to take retry: %w", err)
+		}
+		if taken == 0 {
+			continue
+		}
+		var values map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &values); err != nil {
+			return fmt.Errorf("failed to unmarshal retry: %w", err)
+		}
+		lane, _ := values["lane"].(string)
+		if err := mq.client.XAdd(ctx, &redis.XAddArgs{Stream: mq.lane(lane).stream, Values: values}).Err(); err != nil {
+			return fmt.Errorf("failed to requeue retry: %w", err)
+		}
 	}
+	return nil
+}
+
+// Depth returns the approximate queue depth, of all lanes
+func (mq *MessageQueue) Depth() int64 {
+	var depth int64
+	for _, laneDepth := range mq.LaneDepths() {
+		depth += laneDepth
+	}
+	return depth
+}
+
+// LaneDepths returns the approximate depth of each lane
+func (mq *MessageQueue) LaneDepths() map[string]int64 {
+	ctx := context.Background()
 
-	return info.Length
+	depths := map[string]int64{}
+	for _, lane := range mq.lanes {
+		info, err := mq.client.XInfoStream(ctx, lane.stream).Result()
+		if err != nil {
+			depths[lane.name] = 0
+			continue
+		}
+		depths[lane.name] = info.Length
+	}
+	return depths
 }
 
 // HealthCheck checks if the message queue is available
@@ -184,12 +569,16 @@ func (mq *MessageQueue) Close() error {
 
 // GetPendingCount returns the number of pending (unacknowledged) messages
 func (mq *MessageQueue) GetPendingCount(ctx context.Context) (int64, error) {
-	pending, err := mq.client.XPending(ctx, mq.streamName, mq.groupName).Result()
-	if err != nil {
-		return 0, err
+	var count int64
+	for _, lane := range mq.lanes {
+		pending, err := mq.client.XPending(ctx, lane.stream, mq.groupName).Result()
+		if err != nil {
+			return 0, err
+		}
+		count += pending.Count
 	}
 
-	return pending.Count, nil
+	return count, nil
 }
 
 // CleanupOldMessages removes messages older than the specified duration
@@ -198,10 +587,12 @@ func (mq *MessageQueue) CleanupOldMessages(ctx context.Context, maxAge time.Dura
 	cutoff := time.Now().Add(-maxAge).Unix()
 	cutoffID := fmt.Sprintf("%d-0", cutoff*1000) // Convert to stream ID format
 
-	// Trim stream to remove old messages
-	err := mq.client.XTrimMinID(ctx, mq.streamName, cutoffID).Err()
-	if err != nil {
-		return fmt.Errorf("failed to cleanup old messages: %w", err)
+	// Trim streams to remove old messages
+	for _, lane := range mq.lanes {
+		err := mq.client.XTrimMinID(ctx, lane.stream, cutoffID).Err()
+		if err != nil {
+			return fmt.Errorf("failed to cleanup old messages: %w", err)
+		}
 	}
 
 	return nil
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Model routing defaults
+const (
+	defaultSimpleModel      = "claude-3-5-haiku-20241022"
+	defaultMaxSimpleWords   = 40
+	defaultMaxSimpleTurns   = 3
+	defaultMaxSimpleContext = 4000 // estimated tokens
+)
+
+// usedToolsMetadataKey marks sessions in which Claude used a tool beyond the built-in ones
+const usedToolsMetadataKey = "used_tools"
+
+// complexKeywords point to questions that need reasoning rather than a lookup
+var complexKeywords = []string{
+	"why", "explain", "compare", "difference between", "troubleshoot", "step by step",
+	"configure", "integrat", "migrat", "not working", "doesn't work", "still",
+}
+
+var modelRoutes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_model_routes_total",
+		Help: "Messages routed to a model, by model and the reason: simple, or what made the message complex",
+	},
+	[]string{"model", "reason"},
+)
+
+func init() {
+	prometheus.MustRegister(modelRoutes)
+}
+
+// ModelRouting sends simple messages to a cheaper model: short, standalone questions early in a
+// conversation, without much context, that need no tools. Other messages are answered by the
+// agent's model. Limits of zero take the defaults.
+type ModelRouting struct {
+	Enabled          bool   `json:"enabled"`
+	SimpleModel      string `json:"simple_model,omitempty"`       // defaults to Claude 3.5 Haiku
+	MaxWords         int    `json:"max_words,omitempty"`          // longest simple message
+	MaxTurns         int    `json:"max_turns,omitempty"`          // customer messages before a simple one
+	MaxContextTokens int    `json:"max_context_tokens,omitempty"` // estimated tokens of the prompt and conversation
+}
+
+// withDefaults fills in the limits that are not set
+func (r ModelRouting) withDefaults() ModelRouting {
+	if r.SimpleModel == "" {
+		r.SimpleModel = defaultSimpleModel
+	}
+	if r.MaxWords <= 0 {
+		r.MaxWords = defaultMaxSimpleWords
+	}
+	if r.MaxTurns <= 0 {
+		r.MaxTurns = defaultMaxSimpleTurns
+	}
+	if r.MaxContextTokens <= 0 {
+		r.MaxContextTokens = defaultMaxSimpleContext
+	}
+	return r
+}
+
+// routeModel picks the model that answers a turn: the simple model when routing is on for the
+// tenant and the message is simple, and the configured model otherwise
+func (s *AgentService) routeModel(ctx context.Context, session *Session, message string, turn *chatTurn) string {
+	routing := s.config.Routing
+	if tenant := tenantFrom(ctx); tenant.ModelRouting != nil {
+		routing = *tenant.ModelRouting
+	}
+	if !routing.Enabled {
+		return s.config.Model
+	}
+	routing = routing.withDefaults()
+
+	reason := routing.complexity(session, message, turn)
+	model := s.config.Model
+	if reason == "" {
+		model, reason = routing.SimpleModel, "simple"
+	}
+	modelRoutes.WithLabelValues(model, reason).Inc()
+	return model
+}
+
+// complexity returns what makes a turn complex: its intent's tools, tools used earlier in the
+// conversation, a long conversation or context, an upset customer, or a long or involved
+// message. It returns "" for simple turns.
+func (r ModelRouting) complexity(session *Session, message string, turn *chatTurn) string {
+	if turn.intent != nil {
+		for _, tool := range turn.intent.Tools {
+			if !alwaysAvailableTools[tool] {
+				return "tools"
+			}
+		}
+	}
+	if used, _ := session.Metadata[usedToolsMetadataKey].(bool); used {
+		return "tools"
+	}
+
+	turns := 0
+	for _, msg := range session.Messages {
+		if msg.Role == "user" {
+			turns++
+		}
+	}
+	if turns >= r.MaxTurns {
+		return "history"
+	}
+
+	// About four characters to a token
+	length := len(turn.system)
+	for _, msg := range turn.messages {
+		length += len(msg.Content)
+	}
+	if length/4 > r.MaxContextTokens {
+		return "context"
+	}
+
+	if turn.sentiment == "urgent" || turn.sentiment == "negative" {
+		return "sentiment"
+	}
+
+	lower := strings.ToLower(message)
+	if len(strings.Fields(message)) > r.MaxWords || strings.Count(message, "?") > 1 {
+		return "message"
+	}
+	for _, keyword := range complexKeywords {
+		if strings.Contains(lower, keyword) {
+			return "message"
+		}
+	}
+	return ""
+}
+
+// usedTools reports whether Claude used a tool beyond the built-in ones in a turn
+func (t *chatTurn) usedTools() bool {
+	for _, call := range t.toolCalls {
+		if !alwaysAvailableTools[call.Name] {
+			return true
+		}
+	}
+	return false
+}
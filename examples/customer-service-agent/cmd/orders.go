@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// errOrderNotFound is reported to Claude for orders that do not exist or belong to someone else
+var errOrderNotFound = fmt.Errorf("order not found")
+
+// OrderClient looks up and refunds orders through the store's order API
+type OrderClient struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+// Order is an order as returned by the order API
+type Order struct {
+	ID                string     `json:"id"`
+	CustomerID        string     `json:"customer_id"`
+	Status            string     `json:"status"`
+	Total             float64    `json:"total"`
+	Currency          string     `json:"currency"`
+	Carrier           string     `json:"carrier,omitempty"`
+	TrackingNumber    string     `json:"tracking_number,omitempty"`
+	EstimatedDelivery *time.Time `json:"estimated_delivery,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+// Refund is a refund created through the order API
+type Refund struct {
+	ID       string  `json:"id"`
+	OrderID  string  `json:"order_id"`
+	Status   string  `json:"status"`
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+}
+
+// NewOrderClient creates a client for the order API at baseURL
+func NewOrderClient(baseURL, apiKey string) *OrderClient {
+	return &OrderClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// GetOrder fetches an order by ID
+func (c *OrderClient) GetOrder(ctx context.Context, orderID string) (*Order, error) {
+	var order Order
+	if err := c.do(ctx, "GET", "/orders/"+url.PathEscape(orderID), nil, &order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// Refund refunds an order. A zero amount refunds the order in full.
+func (c *OrderClient) Refund(ctx context.Context, orderID, reason string, amount float64) (*Refund, error) {
+	body := map[string]interface{}{"reason": reason}
+	if amount > 0 {
+		body["amount"] = amount
+	}
+
+	var refund Refund
+	if err := c.do(ctx, "POST", "/orders/"+url.PathEscape(orderID)+"/refunds", body, &refund); err != nil {
+		return nil, err
+	}
+	return &refund, nil
+}
+
+// do sends a request to the order API and decodes the JSON response into out
+func (c *OrderClient) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call order api: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errOrderNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("order api error (status %d): %s", resp.StatusCode, string(data))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// customerOrder fetches an order and checks it belongs to the customer in the conversation, so a
+// customer cannot look up or refund someone else's order by guessing IDs
+func (c *OrderClient) customerOrder(ctx context.Context, call *ToolCall, orderID string) (*Order, error) {
+	order, err := c.GetOrder(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.CustomerID != call.Request.UserID {
+		return nil, errOrderNotFound
+	}
+	return order, nil
+}
+
+// Tools returns the order tools for the agent
+func (c *OrderClient) Tools() []*Tool {
+	orderID := map[string]interface{}{"type": "string", "description": "The order number the customer gave"}
+
+	return []*Tool{
+		{
+			Name:        "get_order_status",
+			Description: "Look up one of the customer's orders: status, total, carrier, tracking number, and estimated delivery.",
+			InputSchema: map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{"order_id": orderID},
+				"required":   []string{"order_id"},
+			},
+			Handler: func(ctx context.Context, call *ToolCall) (interface{}, error) {
+				var input struct {
+					OrderID string `json:"order_id"`
+				}
+				if err := call.Decode(&input); err != nil {
+					return nil, err
+				}
+				return c.customerOrder(ctx, call, input.OrderID)
+			},
+		},
+		{
+			Name:        "process_refund",
+			Description: "Refund one of the customer's orders, in full or in part. Only use it after the customer has confirmed the order and the amount.",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"order_id": orderID,
+					"reason":   map[string]interface{}{"type": "string", "description": "Why the customer is being refunded"},
+					"amount":   map[string]interface{}{"type": "number", "description": "Amount to refund; omit to refund the full order"},
+				},
+				"required": []string{"order_id", "reason"},
+			},
+			Handler: func(ctx context.Context, call *ToolCall) (interface{}, error) {
+				var input struct {
+					OrderID string  `json:"order_id"`
+					Reason  string  `json:"reason"`
+					Amount  float64 `json:"amount"`
+				}
+				if err := call.Decode(&input); err != nil {
+					return nil, err
+				}
+				order, err := c.customerOrder(ctx, call, input.OrderID)
+				if err != nil {
+					return nil, err
+				}
+				if input.Amount < 0 || input.Amount > order.Total {
+					return nil, fmt.Errorf("refund amount must be between 0 and the order total of %.2f %s", order.Total, order.Currency)
+				}
+				return c.Refund(ctx, order.ID, input.Reason, input.Amount)
+			},
+		},
+	}
+}
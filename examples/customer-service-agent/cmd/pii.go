@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of personal data that can be redacted
+const (
+	PIIEmail   = "email"
+	PIIPhone   = "phone"
+	PIICard    = "card"
+	PIIAddress = "address"
+)
+
+// piiVaultTTL matches the session TTL, so placeholders live as long as the conversation
+const piiVaultTTL = 24 * time.Hour
+
+var piiRedactions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_pii_redactions_total",
+		Help: "Personal data replaced with placeholders before calling Claude, by kind",
+	},
+	[]string{"kind"},
+)
+
+func init() {
+	prometheus.MustRegister(piiRedactions)
+}
+
+var (
+	piiEmailPattern   = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	piiCardPattern    = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+	piiPhonePattern   = regexp.MustCompile(`(?:\+\d{1,3}[\s.-]?)?(?:\(\d{1,4}\)[\s.-]?)?\d[\d\s.-]{6,}\d`)
+	piiAddressPattern = regexp.MustCompile(`\b\d{1,6}\s+(?:[A-Z][A-Za-z0-9.'-]*\s+){1,4}(?:Street|St|Avenue|Ave|Road|Rd|Boulevard|Blvd|Lane|Ln|Drive|Dr|Court|Ct|Way|Place|Pl|Terrace|Ter|Parkway|Pkwy|Circle|Cir|Highway|Hwy)\b\.?(?:,?\s+(?:Apt|Apartment|Suite|Ste|Unit|#)\.?\s*[A-Za-z0-9-]+)?`)
+
+	// piiPlaceholder matches the placeholders data is replaced with, such as [EMAIL_1]
+	piiPlaceholder = regexp.MustCompile(`\[(?:EMAIL|PHONE|CARD|ADDRESS)_\d+\]`)
+)
+
+// piiKinds lists the kinds in the order they are redacted; card numbers go before phone
+// numbers so long digit runs are checked as cards first
+var piiKinds = []string{PIIEmail, PIICard, PIIPhone, PIIAddress}
+
+// PIIConfig holds which personal data is redacted
+type PIIConfig struct {
+	Kinds          string // comma list of email, phone, card, and address; empty disables redaction
+	TenantPolicies string // JSON object of tenant ID to comma list of kinds, overriding Kinds
+}
+
+// PIIRedactor replaces customers' personal data with placeholders before conversations are
+// sent to Claude. The placeholders are kept per session in Redis, so the same value gets the
+// same placeholder throughout a conversation and Claude's answers can be restored.
+type PIIRedactor struct {
+	kinds   map[string]bool
+	tenants map[string]map[string]bool
+	client  *redis.Client
+}
+
+// NewPIIRedactor creates a redactor with the configured policies
+func NewPIIRedactor(config PIIConfig, client *redis.Client) (*PIIRedactor, error) {
+	kinds, err := parsePIIKinds(config.Kinds)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PII_REDACTION: %w", err)
+	}
+	r := &PIIRedactor{kinds: kinds, tenants: map[string]map[string]bool{}, client: client}
+
+	if config.TenantPolicies != "" {
+		var policies map[string]string
+		if err := json.Unmarshal([]byte(config.TenantPolicies), &policies); err != nil {
+			return nil, fmt.Errorf("invalid PII_TENANT_POLICIES: %w", err)
+		}
+		for tenant, list := range policies {
+			if r.tenants[tenant], err = parsePIIKinds(list); err != nil {
+				return nil, fmt.Errorf("invalid PII_TENANT_POLICIES for %s: %w", tenant, err)
+			}
+		}
+	}
+	return r, nil
+}
+
+// parsePIIKinds parses a comma list of kinds of personal data
+func parsePIIKinds(list string) (map[string]bool, error) {
+	kinds := map[string]bool{}
+	for _, kind := range strings.Split(list, ",") {
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		switch kind {
+		case "", "none":
+		case PIIEmail, PIIPhone, PIICard, PIIAddress:
+			kinds[kind] = true
+		default:
+			return nil, fmt.Errorf("unknown kind %q", kind)
+		}
+	}
+	return kinds, nil
+}
+
+// Forget deletes the placeholders of a session, and with them the personal data they stand for
+func (r *PIIRedactor) Forget(ctx context.Context, sessionID string) error {
+	if r == nil {
+		return nil
+	}
+	if err := r.client.Del(ctx, tenantKey(ctx, "pii:"+sessionID)).Err(); err != nil {
+		return fmt.Errorf("failed to delete pii placeholders: %w", err)
+	}
+	return nil
+}
+
+// Vault loads the placeholders of a session, redacting the kinds of data in the tenant's policy.
+// It returns nil when the policy redacts nothing; a nil vault leaves text as it is.
+func (r *PIIRedactor) Vault(ctx context.Context, sessionID, tenantID string) (*piiVault, error) {
+	if r == nil {
+		return nil, nil
+	}
+	kinds, ok := r.tenants[tenantID]
+	if !ok {
+		kinds = r.kinds
+	}
+	if len(kinds) == 0 {
+		return nil, nil
+	}
+
+	v := &piiVault{
+		client:       r.client,
+		key:          tenantKey(ctx, "pii:"+sessionID),
+		kinds:        kinds,
+		values:       map[string]string{},
+		placeholders: map[string]string{},
+		counts:       map[string]int{},
+		added:        map[string]interface{}{},
+	}
+	stored, err := r.client.HGetAll(ctx, v.key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pii placeholders: %w", err)
+	}
+	for placeholder, value := range stored {
+		v.values[placeholder] = value
+		v.placeholders[value] = placeholder
+		kind := strings.ToLower(placeholder[1:strings.LastIndex(placeholder, "_")])
+		v.counts[kind]++
+	}
+	return v, nil
+}
+
+// piiVault holds the placeholders of one session's personal data
+type piiVault struct {
+	client       *redis.Client
+	key          string
+	kinds        map[string]bool
+	values       map[string]string      // placeholder to value
+	placeholders map[string]string      // value to placeholder
+	counts       map[string]int         // placeholders of each kind
+	added        map[string]interface{} // placeholders not yet saved
+}
+
+// Redact replaces the personal data in text with placeholders
+func (v *piiVault) Redact(text string) string {
+	if v == nil {
+		return text
+	}
+	for _, kind := range piiKinds {
+		if !v.kinds[kind] {
+			continue
+		}
+		text = piiPatterns[kind].ReplaceAllStringFunc(text, func(match string) string {
+			value := strings.TrimSpace(match)
+			if !piiValid(kind, value) {
+				return match
+			}
+			return strings.Replace(match, value, v.placeholder(kind, value), 1)
+		})
+	}
+	return text
+}
+
+// Restore puts the personal data back in place of its placeholders
+func (v *piiVault) Restore(text string) string {
+	if v == nil {
+		return text
+	}
+	return piiPlaceholder.ReplaceAllStringFunc(text, func(placeholder string) string {
+		if value, ok := v.values[placeholder]; ok {
+			return value
+		}
+		return placeholder
+	})
+}
+
+// RestoreJSON puts the personal data back in a JSON document, such as a tool input
+func (v *piiVault) RestoreJSON(data json.RawMessage) json.RawMessage {
+	if v == nil {
+		return data
+	}
+	return json.RawMessage(piiPlaceholder.ReplaceAllStringFunc(string(data), func(placeholder string) string {
+		value, ok := v.values[placeholder]
+		if !ok {
+			return placeholder
+		}
+		// Placeholders only appear inside strings; escape the value for one
+		quoted, _ := json.Marshal(value)
+		return string(quoted[1 : len(quoted)-1])
+	}))
+}
+
+// RestoreStream wraps onToken to restore placeholders in streamed text. Text that may be the
+// start of a placeholder is held back until it is complete; flush sends whatever is left.
+func (v *piiVault) RestoreStream(onToken func(text string) error) (stream func(text string) error, flush func() error) {
+	if v == nil {
+		return onToken, func() error { return nil }
+	}
+	var pending string
+	stream = func(text string) error {
+		pending += text
+		if i := strings.LastIndex(pending, "["); i >= 0 && !strings.Contains(pending[i:], "]") && len(pending)-i < 16 {
+			ready := pending[:i]
+			pending = pending[i:]
+			if ready == "" {
+				return nil
+			}
+			return onToken(v.Restore(ready))
+		}
+		ready := pending
+		pending = ""
+		return onToken(v.Restore(ready))
+	}
+	flush = func() error {
+		if pending == "" {
+			return nil
+		}
+		ready := pending
+		pending = ""
+		return onToken(v.Restore(ready))
+	}
+	return stream, flush
+}
+
+// Save stores the placeholders added since the vault was loaded
+func (v *piiVault) Save(ctx context.Context) error {
+	if v == nil || len(v.added) == 0 {
+		return nil
+	}
+	pipe := v.client.TxPipeline()
+	pipe.HSet(ctx, v.key, v.added)
+	pipe.Expire(ctx, v.key, piiVaultTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to save pii placeholders: %w", err)
+	}
+	v.added = map[string]interface{}{}
+	return nil
+}
+
+// placeholder returns the placeholder of a value, adding one if the value is new
+func (v *piiVault) placeholder(kind, value string) string {
+	if placeholder, ok := v.placeholders[value]; ok {
+		return placeholder
+	}
+	v.counts[kind]++
+	placeholder := fmt.Sprintf("[%s_%d]", strings.ToUpper(kind), v.counts[kind])
+	v.values[placeholder] = value
+	v.placeholders[value] = placeholder
+	v.added[placeholder] = value
+	piiRedactions.WithLabelValues(kind).Inc()
+	return placeholder
+}
+
+var piiPatterns = map[string]*regexp.Regexp{
+	PIIEmail:   piiEmailPattern,
+	PIICard:    piiCardPattern,
+	PIIPhone:   piiPhonePattern,
+	PIIAddress: piiAddressPattern,
+}
+
+// piiValid checks a match further than its pattern can: card numbers must pass the Luhn check,
+// and phone numbers need 10 to 15 digits written as a phone number, with a country code or
+// separators, so order numbers and other IDs are left alone
+func piiValid(kind, value string) bool {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, value)
+
+	switch kind {
+	case PIICard:
+		return len(digits) >= 13 && len(digits) <= 19 && luhnValid(digits)
+	case PIIPhone:
+		if len(digits) < 10 || len(digits) > 15 {
+			return false
+		}
+		return strings.HasPrefix(value, "+") || strings.HasPrefix(value, "(") ||
+			len(strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(" .-()", r) })) >= 3
+	}
+	return true
+}
+
+// luhnValid checks the Luhn checksum of a card number
+func luhnValid(digits string) bool {
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// messageLane picks the queue lane of a channel message. Urgent sentiment and urgent tickets go
+// in the urgent lane; VIP customers, negative sentiment, and high priority tickets in the high
+// lane.
+func (app *Application) messageLane(ctx context.Context, message interface{}) string {
+	var text, priority string
+	var customer []string
+	switch msg := message.(type) {
+	case *ZendeskWebhook:
+		// Zendesk's SLA targets are tightest for urgent and high priority tickets
+		text, priority, customer = msg.Comment, strings.ToLower(msg.Priority), []string{msg.RequesterID}
+	case *SlackWebhook:
+		text, customer = msg.Event.Text, []string{msg.Event.User}
+	case *WhatsAppMessage:
+		text, customer = msg.text(), []string{msg.WaID, strings.TrimPrefix(msg.From, "whatsapp:")}
+	case *TeamsActivity:
+		text, customer = teamsMessageText(msg.Text), []string{msg.From.ID, msg.From.AADObjectID}
+	case *IntercomMessage:
+		text, customer = msg.Text, []string{msg.ContactID}
+	case *EmailMessage:
+		text, customer = msg.Subject+"\n"+msg.Text, []string{msg.From}
+	}
+
+	sentiment := app.AgentService.analyzeSentiment(text)
+	switch {
+	case sentiment == "urgent" || priority == "urgent":
+		return LaneUrgent
+	case sentiment == "negative" || priority == "high" || app.vipCustomer(ctx, customer...):
+		return LaneHigh
+	default:
+		return LaneNormal
+	}
+}
+
+// vipCustomer reports whether any of a customer's IDs, such as their Slack user ID, phone number,
+// or email address, is on the deployment's or the tenant's VIP list
+func (app *Application) vipCustomer(ctx context.Context, ids ...string) bool {
+	vips := append(strings.Split(app.Config.VIPCustomers, ","), tenantFrom(ctx).VIPCustomers...)
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		for _, vip := range vips {
+			if strings.EqualFold(strings.TrimSpace(vip), id) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// System prompt storage
+const (
+	promptVersionsKey  = "prompts:system:versions"  // hash of version number to published version
+	promptPublishedKey = "prompts:system:published" // version number answers are written with
+	promptDraftKey     = "prompts:system:draft"     // the version being edited
+	promptNextKey      = "prompts:system:next"      // counter numbering versions
+	promptCacheTTL     = 30 * time.Second           // how long other replicas take to see a publish
+)
+
+// ErrNoDraft is returned when publishing without a draft
+var ErrNoDraft = errors.New("there is no draft to publish")
+
+var promptResponses = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_prompt_responses_total",
+		Help: "Claude answers by the system prompt version they were written with",
+	},
+	[]string{"version"},
+)
+
+func init() {
+	prometheus.MustRegister(promptResponses)
+}
+
+// promptVariable matches {{name}} in templates
+var promptVariable = regexp.MustCompile(`\{\{\s*([a-z][a-z0-9_]*)\s*\}\}`)
+
+// builtinPromptVariables are filled in for each message
+var builtinPromptVariables = map[string]bool{
+	"channel":  true, // e.g. web, slack, whatsapp
+	"language": true, // the conversation's language, e.g. Spanish; empty until detected
+	"intent":   true, // the message's intent; empty when it matches none
+	"date":     true, // today, e.g. Monday, January 2, 2006
+}
+
+// PromptVersion is a version of the system prompt. Published versions never change; the draft
+// is edited until it is published as the next version.
+type PromptVersion struct {
+	Version   int               `json:"version"` // 0 for the draft
+	Template  string            `json:"template"`
+	Variables map[string]string `json:"variables,omitempty"` // values of the template's own variables
+	Notes     string            `json:"notes,omitempty"`     // what changed, for whoever reads the history
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// PromptValues are the built-in variables of a message
+type PromptValues struct {
+	Channel  string `json:"channel"`
+	Language string `json:"language"` // ISO 639-1 code
+	Intent   string `json:"intent"`
+}
+
+// Validate checks that every variable the template uses has a value
+func (v *PromptVersion) Validate() error {
+	if strings.TrimSpace(v.Template) == "" {
+		return fmt.Errorf("template is required")
+	}
+	for name := range v.Variables {
+		if builtinPromptVariables[name] {
+			return fmt.Errorf("variable %q is built in", name)
+		}
+	}
+	var unknown []string
+	for _, match := range promptVariable.FindAllStringSubmatch(v.Template, -1) {
+		name := match[1]
+		if _, ok := v.Variables[name]; !ok && !builtinPromptVariables[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("template uses variables without a value: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// Render fills in the template's variables
+func (v *PromptVersion) Render(values PromptValues, now time.Time) string {
+	return promptVariable.ReplaceAllStringFunc(v.Template, func(match string) string {
+		name := promptVariable.FindStringSubmatch(match)[1]
+		switch name {
+		case "channel":
+			return values.Channel
+		case "language":
+			return languageNames[values.Language]
+		case "intent":
+			return values.Intent
+		case "date":
+			return now.Format("Monday, January 2, 2006")
+		}
+		return v.Variables[name]
+	})
+}
+
+// PromptStore keeps the versions of the system prompt in Redis, shared by every replica. Each
+// tenant has its own prompt.
+type PromptStore struct {
+	client *redis.Client
+
+	mu        sync.Mutex
+	published map[string]*loadedPrompt // by tenant
+}
+
+// loadedPrompt is a tenant's cached published version
+type loadedPrompt struct {
+	version  *PromptVersion
+	loadedAt time.Time
+}
+
+// NewPromptStore creates a prompt store. Each tenant is seeded with its initial prompt before
+// answering.
+func NewPromptStore(client *redis.Client) *PromptStore {
+	return &PromptStore{client: client, published: map[string]*loadedPrompt{}}
+}
+
+// Seed publishes the tenant's configured prompt, or the built-in one, as version 1 the first
+// time the tenant starts
+func (p *PromptStore) Seed(ctx context.Context) error {
+	exists, err := p.client.Exists(ctx, tenantKey(ctx, promptPublishedKey)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to check system prompt: %w", err)
+	}
+	if exists > 0 {
+		return nil
+	}
+	if _, err := p.publish(ctx, fallbackPrompt(ctx)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// fallbackPrompt is the prompt a tenant starts with, and answers are written with when the
+// store cannot be read
+func fallbackPrompt(ctx context.Context) *PromptVersion {
+	template := tenantFrom(ctx).SystemPrompt
+	if template == "" {
+		template = buildSystemPrompt()
+	}
+	return &PromptVersion{Template: template, Notes: "Initial prompt", CreatedAt: time.Now()}
+}
+
+// Published returns the version answers are written with
+func (p *PromptStore) Published(ctx context.Context) (*PromptVersion, error) {
+	tenant := tenantFrom(ctx).ID
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cached := p.published[tenant]; cached != nil && time.Since(cached.loadedAt) < promptCacheTTL {
+		return cached.version, nil
+	}
+
+	number, err := p.PublishedNumber(ctx)
+	if err != nil {
+		return nil, err
+	}
+	version, err := p.Version(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	if version == nil {
+		return nil, fmt.Errorf("published prompt version %d not found", number)
+	}
+
+	p.published[tenant] = &loadedPrompt{version: version, loadedAt: time.Now()}
+	return version, nil
+}
+
+// Version returns a published version, or nil when there is none by that number
+func (p *PromptStore) Version(ctx context.Context, number int) (*PromptVersion, error) {
+	data, err := p.client.HGet(ctx, tenantKey(ctx, promptVersionsKey), strconv.Itoa(number)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get prompt version: %w", err)
+	}
+	var version PromptVersion
+	if err := json.Unmarshal([]byte(data), &version); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal prompt version: %w", err)
+	}
+	return &version, nil
+}
+
+// Versions returns every published version, newest first
+func (p *PromptStore) Versions(ctx context.Context) ([]*PromptVersion, error) {
+	stored, err := p.client.HGetAll(ctx, tenantKey(ctx, promptVersionsKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load prompt versions: %w", err)
+	}
+	versions := make([]*PromptVersion, 0, len(stored))
+	for _, data := range stored {
+		var version PromptVersion
+		if err := json.Unmarshal([]byte(data), &version); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal prompt version: %w", err)
+		}
+		versions = append(versions, &version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version > versions[j].Version })
+	return versions, nil
+}
+
+// PublishedNumber returns the number of the version answers are written with
+func (p *PromptStore) PublishedNumber(ctx context.Context) (int, error) {
+	number, err := p.client.Get(ctx, tenantKey(ctx, promptPublishedKey)).Int()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get published prompt: %w", err)
+	}
+	return number, nil
+}
+
+// Draft returns the draft, or nil when there is none
+func (p *PromptStore) Draft(ctx context.Context) (*PromptVersion, error) {
+	data, err := p.client.Get(ctx, tenantKey(ctx, promptDraftKey)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get prompt draft: %w", err)
+	}
+	var draft PromptVersion
+	if err := json.Unmarshal([]byte(data), &draft); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal prompt draft: %w", err)
+	}
+	return &draft, nil
+}
+
+// SaveDraft creates or replaces the draft
+func (p *PromptStore) SaveDraft(ctx context.Context, draft *PromptVersion) error {
+	if err := draft.Validate(); err != nil {
+		return err
+	}
+	draft.Version = 0
+	draft.CreatedAt = time.Now()
+
+	data, err := json.Marshal(draft)
+	if err != nil {
+		return fmt.Errorf("failed to marshal prompt draft: %w", err)
+	}
+	if err := p.client.Set(ctx, tenantKey(ctx, promptDraftKey), data, 0).Err(); err != nil {
+		return fmt.Errorf("failed to save prompt draft: %w", err)
+	}
+	return nil
+}
+
+// DiscardDraft removes the draft, returning false when there was none
+func (p *PromptStore) DiscardDraft(ctx context.Context) (bool, error) {
+	deleted, err := p.client.Del(ctx, tenantKey(ctx, promptDraftKey)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to discard prompt draft: %w", err)
+	}
+	return deleted > 0, nil
+}
+
+// PublishDraft publishes the draft as the next version, which answers are written with from
+// then on
+func (p *PromptStore) PublishDraft(ctx context.Context) (*PromptVersion, error) {
+	draft, err := p.Draft(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if draft == nil {
+		return nil, ErrNoDraft
+	}
+	return p.publish(ctx, draft)
+}
+
+// publish stores a version under the next number and publishes it
+func (p *PromptStore) publish(ctx context.Context, version *PromptVersion) (*PromptVersion, error) {
+	number, err := p.client.Incr(ctx, tenantKey(ctx, promptNextKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to number prompt version: %w", err)
+	}
+	version.Version = int(number)
+	version.CreatedAt = time.Now()
+
+	data, err := json.Marshal(version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal prompt version: %w", err)
+	}
+	_, err = p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, tenantKey(ctx, promptVersionsKey), strconv.Itoa(version.Version), data)
+		pipe.Set(ctx, tenantKey(ctx, promptPublishedKey), version.Version, 0)
+		pipe.Del(ctx, tenantKey(ctx, promptDraftKey))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish prompt version: %w", err)
+	}
+	p.invalidate(ctx)
+	return version, nil
+}
+
+// Rollback publishes an earlier version again, returning nil when there is none by that number
+func (p *PromptStore) Rollback(ctx context.Context, number int) (*PromptVersion, error) {
+	version, err := p.Version(ctx, number)
+	if err != nil || version == nil {
+		return nil, err
+	}
+	if err := p.client.Set(ctx, tenantKey(ctx, promptPublishedKey), number, 0).Err(); err != nil {
+		return nil, fmt.Errorf("failed to publish prompt version: %w", err)
+	}
+	p.invalidate(ctx)
+	return version, nil
+}
+
+func (p *PromptStore) invalidate(ctx context.Context) {
+	p.mu.Lock()
+	delete(p.published, tenantFrom(ctx).ID)
+	p.mu.Unlock()
+}
+
+// systemPrompt renders the published system prompt for a message, with its version. When the
+// store cannot be read, the tenant's initial prompt is used as version 0.
+func (s *AgentService) systemPrompt(ctx context.Context, values PromptValues) (string, int) {
+	version, err := s.prompts.Published(ctx)
+	if err != nil {
+		fmt.Printf("System prompt error: %v\n", err)
+		version = fallbackPrompt(ctx)
+	}
+	return version.Render(values, time.Now()), version.Version
+}
+
+// listPrompts returns the published version number, the draft, and every version
+func (app *Application) listPrompts(c *gin.Context) {
+	ctx := c.Request.Context()
+	published, err := app.Prompts.PublishedNumber(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	draft, err := app.Prompts.Draft(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	versions, err := app.Prompts.Versions(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"published": published,
+		"draft":     draft,
+		"versions":  versions,
+	})
+}
+
+// getPromptVersion returns the version numbered in the path
+func (app *Application) getPromptVersion(c *gin.Context) {
+	number, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+		return
+	}
+	version, err := app.Prompts.Version(c.Request.Context(), number)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if version == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "prompt version not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, version)
+}
+
+// savePromptDraft creates or replaces the draft
+func (app *Application) savePromptDraft(c *gin.Context) {
+	var draft PromptVersion
+	if err := c.ShouldBindJSON(&draft); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if err := app.Prompts.SaveDraft(c.Request.Context(), &draft); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, draft)
+}
+
+// discardPromptDraft removes the draft
+func (app *Application) discardPromptDraft(c *gin.Context) {
+	deleted, err := app.Prompts.DiscardDraft(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "prompt draft not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "prompt draft discarded"})
+}
+
+// publishPromptDraft publishes the draft as the next version
+func (app *Application) publishPromptDraft(c *gin.Context) {
+	version, err := app.Prompts.PublishDraft(c.Request.Context())
+	if errors.Is(err, ErrNoDraft) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, version)
+}
+
+// rollbackPrompt publishes the version numbered in the path again
+func (app *Application) rollbackPrompt(c *gin.Context) {
+	number, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+		return
+	}
+	version, err := app.Prompts.Rollback(c.Request.Context(), number)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if version == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "prompt version not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, version)
+}
+
+// previewPrompt renders the draft, or a version, with sample built-in variables
+func (app *Application) previewPrompt(c *gin.Context) {
+	var req struct {
+		Version int `json:"version"` // 0 for the draft
+		PromptValues
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var version *PromptVersion
+	var err error
+	if req.Version == 0 {
+		version, err = app.Prompts.Draft(ctx)
+	} else {
+		version, err = app.Prompts.Version(ctx, req.Version)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if version == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "prompt version not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"version": version.Version,
+		"prompt":  version.Render(req.PromptValues, time.Now()),
+	})
+}
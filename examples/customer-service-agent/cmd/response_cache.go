@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// responseCacheCleanupInterval is how often expired answers are deleted
+const responseCacheCleanupInterval = time.Hour
+
+var (
+	responseCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "csr_response_cache_lookups_total",
+			Help: "Response cache lookups, by result (hit, miss, error)",
+		},
+		[]string{"result"},
+	)
+
+	responseCacheSimilarity = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "csr_response_cache_similarity",
+			Help:    "Similarity of questions to the nearest cached question, for tuning the threshold",
+			Buckets: []float64{0.5, 0.6, 0.7, 0.8, 0.85, 0.9, 0.925, 0.95, 0.975, 0.99, 1},
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(responseCacheLookups)
+	prometheus.MustRegister(responseCacheSimilarity)
+}
+
+// ResponseScope is what a cached answer must share with a question to answer it: answers are
+// written for a channel, in a language, for an intent, with a system prompt version
+type ResponseScope struct {
+	Channel       string `json:"channel"`
+	Language      string `json:"language"`
+	Intent        string `json:"intent"`
+	PromptVersion int    `json:"prompt_version"`
+}
+
+// CachedResponse is Claude's answer to a question that stands on its own
+type CachedResponse struct {
+	ResponseScope
+	Question   string      `json:"question"`
+	Answer     string      `json:"answer"`
+	Actions    []string    `json:"actions,omitempty"`
+	KBArticles []KBArticle `json:"kb_articles,omitempty"`
+	Confidence float64     `json:"confidence"`
+	CreatedAt  int64       `json:"created_at"` // Unix seconds
+	ExpiresAt  int64       `json:"expires_at"` // Unix seconds
+
+	Similarity float64 `json:"-"` // to the question looked up
+}
+
+// ResponseCache answers questions from the answers Claude gave to near-identical ones, without
+// calling Claude. Questions are embedded and matched in a Qdrant collection next to each
+// tenant's knowledge base collection.
+type ResponseCache struct {
+	embedder  Embedder
+	store     *VectorStore
+	threshold float64       // minimum cosine similarity of a hit
+	ttl       time.Duration // how long answers are reused
+
+	mu    sync.Mutex
+	ready map[string]bool // collections known to exist
+
+	hits   int64 // since start, for statistics
+	misses int64
+}
+
+// NewResponseCache creates a cache that reuses answers for ttl, for questions at least threshold
+// similar to the one answered
+func NewResponseCache(embedder Embedder, store *VectorStore, threshold float64, ttl time.Duration) *ResponseCache {
+	return &ResponseCache{
+		embedder:  embedder,
+		store:     store,
+		threshold: threshold,
+		ttl:       ttl,
+		ready:     make(map[string]bool),
+	}
+}
+
+// collection returns the tenant's cache collection
+func (rc *ResponseCache) collection(ctx context.Context) string {
+	return rc.store.collectionFor(ctx) + "_responses"
+}
+
+// responsePointID derives a stable Qdrant point ID for a question, so answering it again
+// overwrites the cached answer
+func responsePointID(scope ResponseScope, question string) string {
+	key := fmt.Sprintf("%s|%s|%s|%d|%s", scope.Channel, scope.Language, scope.Intent, scope.PromptVersion, strings.ToLower(strings.TrimSpace(question)))
+	sum := sha1.Sum([]byte(key))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// Lookup returns the cached answer to the question nearest it in the scope, or nil when none
+// is similar enough. The question's vector is returned to store Claude's answer on a miss.
+func (rc *ResponseCache) Lookup(ctx context.Context, question string, scope ResponseScope) (*CachedResponse, []float32, error) {
+	vectors, err := rc.embedder.Embed(ctx, []string{question}, EmbedQuery)
+	if err != nil {
+		responseCacheLookups.WithLabelValues("error").Inc()
+		return nil, nil, fmt.Errorf("failed to embed question: %w", err)
+	}
+	vector := vectors[0]
+
+	body := map[string]interface{}{
+		"vector":       vector,
+		"limit":        1,
+		"with_payload": true,
+		"filter": map[string]interface{}{
+			"must": []map[string]interface{}{
+				{"key": "channel", "match": map[string]interface{}{"value": scope.Channel}},
+				{"key": "language", "match": map[string]interface{}{"value": scope.Language}},
+				{"key": "intent", "match": map[string]interface{}{"value": scope.Intent}},
+				{"key": "prompt_version", "match": map[string]interface{}{"value": scope.PromptVersion}},
+				{"key": "expires_at", "range": map[string]interface{}{"gt": time.Now().Unix()}},
+			},
+		},
+	}
+	status, data, err := rc.store.do(ctx, "POST", "/collections/"+rc.collection(ctx)+"/points/search", body)
+	if err != nil {
+		responseCacheLookups.WithLabelValues("error").Inc()
+		return nil, vector, err
+	}
+	// Nothing is cached yet
+	if status == http.StatusNotFound {
+		rc.miss()
+		return nil, vector, nil
+	}
+	if status != http.StatusOK {
+		responseCacheLookups.WithLabelValues("error").Inc()
+		return nil, vector, fmt.Errorf("response cache search failed (status %d): %s", status, data)
+	}
+
+	var searchResp struct {
+		Result []struct {
+			Score   float64        `json:"score"`
+			Payload CachedResponse `json:"payload"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(data, &searchResp); err != nil {
+		responseCacheLookups.WithLabelValues("error").Inc()
+		return nil, vector, fmt.Errorf("failed to decode search response: %w", err)
+	}
+	if len(searchResp.Result) == 0 {
+		rc.miss()
+		return nil, vector, nil
+	}
+
+	nearest := searchResp.Result[0]
+	responseCacheSimilarity.Observe(nearest.Score)
+	if nearest.Score < rc.threshold {
+		rc.miss()
+		return nil, vector, nil
+	}
+	atomic.AddInt64(&rc.hits, 1)
+	responseCacheLookups.WithLabelValues("hit").Inc()
+	response := nearest.Payload
+	response.Similarity = nearest.Score
+	return &response, vector, nil
+}
+
+func (rc *ResponseCache) miss() {
+	atomic.AddInt64(&rc.misses, 1)
+	responseCacheLookups.WithLabelValues("miss").Inc()
+}
+
+// Store caches an answer to the question embedded as vector
+func (rc *ResponseCache) Store(ctx context.Context, vector []float32, response *CachedResponse) error {
+	if err := rc.ensureCollection(ctx, len(vector)); err != nil {
+		return err
+	}
+	now := time.Now()
+	response.CreatedAt = now.Unix()
+	response.ExpiresAt = now.Add(rc.ttl).Unix()
+
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cached response: %w", err)
+	}
+	point := map[string]interface{}{
+		"id":      responsePointID(response.ResponseScope, response.Question),
+		"vector":  vector,
+		"payload": json.RawMessage(payload),
+	}
+	status, data, err := rc.store.do(ctx, "PUT", "/collections/"+rc.collection(ctx)+"/points", map[string]interface{}{"points": []interface{}{point}})
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("failed to cache response (status %d): %s", status, data)
+	}
+	return nil
+}
+
+// ensureCollection creates the tenant's cache collection for vectors of the given size if it
+// does not exist
+func (rc *ResponseCache) ensureCollection(ctx context.Context, size int) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	collection := rc.collection(ctx)
+	if rc.ready[collection] {
+		return nil
+	}
+
+	status, _, err := rc.store.do(ctx, "GET", "/collections/"+collection, nil)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		body := map[string]interface{}{
+			"vectors": map[string]interface{}{"size": size, "distance": "Cosine"},
+		}
+		status, data, err := rc.store.do(ctx, "PUT", "/collections/"+collection, body)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("failed to create collection (status %d): %s", status, data)
+		}
+
+		// Index the fields every lookup filters on
+		for field, schema := range map[string]string{"prompt_version": "integer", "expires_at": "integer", "intent": "keyword"} {
+			body := map[string]interface{}{"field_name": field, "field_schema": schema}
+			if status, data, err := rc.store.do(ctx, "PUT", "/collections/"+collection+"/index", body); err != nil {
+				return err
+			} else if status != http.StatusOK {
+				return fmt.Errorf("failed to index %s (status %d): %s", field, status, data)
+			}
+		}
+	} else if status != http.StatusOK {
+		return fmt.Errorf("failed to get collection (status %d)", status)
+	}
+
+	rc.ready[collection] = true
+	return nil
+}
+
+// DeleteExpired removes the tenant's answers that are past their TTL
+func (rc *ResponseCache) DeleteExpired(ctx context.Context) error {
+	body := map[string]interface{}{
+		"filter": map[string]interface{}{
+			"must": []map[string]interface{}{
+				{"key": "expires_at", "range": map[string]interface{}{"lte": time.Now().Unix()}},
+			},
+		},
+	}
+	status, data, err := rc.store.do(ctx, "POST", "/collections/"+rc.collection(ctx)+"/points/delete", body)
+	if err != nil {
+		return err
+	}
+	// Nothing to delete before the first answer is cached
+	if status != http.StatusOK && status != http.StatusNotFound {
+		return fmt.Errorf("failed to delete expired responses (status %d): %s", status, data)
+	}
+	return nil
+}
+
+// Purge removes every answer the tenant has cached, such as after a knowledge base change that
+// makes them wrong
+func (rc *ResponseCache) Purge(ctx context.Context) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	collection := rc.collection(ctx)
+	status, data, err := rc.store.do(ctx, "DELETE", "/collections/"+collection, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusNotFound {
+		return fmt.Errorf("failed to purge response cache (status %d): %s", status, data)
+	}
+	delete(rc.ready, collection)
+	return nil
+}
+
+// Start deletes the tenant's expired answers periodically until ctx is done
+func (rc *ResponseCache) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(responseCacheCleanupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := rc.DeleteExpired(ctx); err != nil {
+					log.Printf("Response cache cleanup failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stats returns the lookups since start and the share that were hits
+func (rc *ResponseCache) Stats() map[string]interface{} {
+	hits := atomic.LoadInt64(&rc.hits)
+	misses := atomic.LoadInt64(&rc.misses)
+	hitRate := 0.0
+	if hits+misses > 0 {
+		hitRate = roundTo(float64(hits)/float64(hits+misses), 4)
+	}
+	return map[string]interface{}{
+		"hits":     hits,
+		"misses":   misses,
+		"hit_rate": hitRate,
+	}
+}
+
+// cacheableTurn reports whether Claude's answer to a turn can be given to other customers: the
+// customer's first message, with no personal data, answered without escalating or using tools
+// that look up anything but the knowledge base, while human agents are working
+func cacheableTurn(turn *chatTurn, escalated bool) bool {
+	if turn.cacheVector == nil || escalated {
+		return false
+	}
+	// Answers given while the team is offline may say so
+	if turn.availability != nil && !turn.availability.open {
+		return false
+	}
+	for _, call := range turn.toolCalls {
+		if call.Name != "search_knowledge_base" || call.IsError {
+			return false
+		}
+	}
+	return true
+}
+
+// answerFromCache answers a turn with a cached answer, recording it in the session as Claude's
+// answers are
+func (s *AgentService) answerFromCache(ctx context.Context, req *ChatMessageRequest, turn *chatTurn, cached *CachedResponse) (*ChatMessageResponse, error) {
+	if err := s.sessionManager.AddMessage(ctx, req.SessionID, "user", req.Message); err != nil {
+		return nil, err
+	}
+	if err := s.sessionManager.AddAnswer(ctx, req.SessionID, cached.Answer, cached.PromptVersion, ""); err != nil {
+		return nil, err
+	}
+	s.refreshSummary(ctx, req.SessionID, false)
+
+	promptResponses.WithLabelValues(strconv.Itoa(cached.PromptVersion)).Inc()
+	s.analytics.RecordTurn(ctx, &ConversationTurn{
+		SessionID: req.SessionID,
+		UserID:    req.UserID,
+		Channel:   req.Channel,
+		Intent:    turn.intent.name(),
+		Language:  turn.language,
+	})
+
+	return &ChatMessageResponse{
+		SessionID:        req.SessionID,
+		Message:          cached.Answer,
+		Sentiment:        turn.sentiment,
+		Confidence:       cached.Confidence,
+		SuggestedActions: cached.Actions,
+		KBArticles:       cached.KBArticles,
+		Metadata: map[string]interface{}{
+			"cached":           true,
+			"cache_similarity": roundTo(cached.Similarity, 4),
+		},
+		Language:       turn.language,
+		Intent:         turn.intent.name(),
+		PromptVersion:  cached.PromptVersion,
+		ProcessingTime: float64(time.Since(turn.startTime).Milliseconds()),
+	}, nil
+}
+
+// purgeResponseCache removes every cached answer of the caller's tenant
+func (app *Application) purgeResponseCache(c *gin.Context) {
+	if app.AgentService.responses == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "response cache is disabled"})
+		return
+	}
+	if err := app.AgentService.responses.Purge(c.Request.Context()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "response cache purged"})
+}
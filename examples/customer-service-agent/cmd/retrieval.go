@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Retrieval settings
+const (
+	rrfK             = 60 // reciprocal rank fusion constant; damps the weight of top ranks
+	searchCandidates = 20 // results taken from each search before fusion and reranking
+)
+
+// Retrieval strategies reported in KBArticle.Strategy; "+rerank" is appended when results were
+// reranked. Searches are also named in KBArticle.MatchedBy.
+const (
+	StrategyBM25   = "bm25"
+	StrategyVector = "vector"
+	StrategyHybrid = "hybrid"
+)
+
+var kbSearches = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_kb_searches_total",
+		Help: "Knowledge base searches, by retrieval strategy",
+	},
+	[]string{"strategy"},
+)
+
+func init() {
+	prometheus.MustRegister(kbSearches)
+}
+
+// fuseResults merges ranked BM25 and vector results by reciprocal rank fusion. Each list adds
+// 1/(rrfK+rank) for an article, so articles both searches rank highly come first. Scores are
+// scaled so an article ranked first by both searches scores 1.
+func fuseResults(bm25, vector []KBArticle) []KBArticle {
+	fused := make(map[string]*KBArticle)
+	var order []string
+
+	add := func(results []KBArticle, source string) {
+		for rank, article := range results {
+			entry, ok := fused[article.ID]
+			if !ok {
+				copied := article
+				copied.MatchedBy = nil
+				entry = &copied
+				fused[article.ID] = entry
+				order = append(order, article.ID)
+			}
+			entry.FusionScore += 1 / float64(rrfK+rank+1)
+			entry.MatchedBy = append(entry.MatchedBy, source)
+
+			switch source {
+			case StrategyBM25:
+				entry.BM25Score = article.BM25Score
+			case StrategyVector:
+				// The matching chunk is a better excerpt than the article's opening
+				entry.VectorScore = article.VectorScore
+				entry.Content = article.Content
+			}
+		}
+	}
+	add(bm25, StrategyBM25)
+	add(vector, StrategyVector)
+
+	articles := make([]KBArticle, 0, len(order))
+	for _, id := range order {
+		article := fused[id]
+		article.FusionScore *= float64(rrfK+1) / 2
+		article.Score = article.FusionScore
+		articles = append(articles, *article)
+	}
+	sort.SliceStable(articles, func(i, j int) bool {
+		return articles[i].FusionScore > articles[j].FusionScore
+	})
+	return articles
+}
+
+// Search finds the articles most relevant to a query. BM25 results from Elasticsearch are fused
+// with vector results from Qdrant when embeddings are enabled, and the candidates are reranked
+// when a reranker is configured. Reranked articles scoring below the minimum are dropped so the
+// agent is not handed articles that merely share words with the question. If the vector search
+// or reranker fails, the search degrades to the results it has. With categories, only articles
+// in one of them are searched.
+func (kb *KnowledgeBase) Search(ctx context.Context, query string, limit int, categories ...string) ([]KBArticle, error) {
+	candidates := limit
+	if kb.embeddings != nil || kb.reranker != nil {
+		candidates = searchCandidates
+		if limit > candidates {
+			candidates = limit
+		}
+	}
+
+	strategy := StrategyBM25
+	articles, err := kb.searchBM25(ctx, query, candidates, categories)
+	if err != nil {
+		if kb.embeddings == nil {
+			return nil, err
+		}
+		log.Printf("BM25 search failed, using vector results only: %v", err)
+	}
+
+	if kb.embeddings != nil {
+		vector, vectorErr := kb.searchVectors(ctx, query, candidates, categories)
+		switch {
+		case vectorErr != nil && err != nil:
+			return nil, err
+		case vectorErr != nil:
+			log.Printf("Vector search failed, using BM25 results only: %v", vectorErr)
+		case err != nil:
+			articles, strategy = fuseResults(nil, vector), StrategyVector
+		default:
+			articles, strategy = fuseResults(articles, vector), StrategyHybrid
+		}
+	}
+
+	if kb.reranker != nil && len(articles) > 0 {
+		reranked, err := kb.rerank(ctx, query, articles)
+		if err != nil {
+			log.Printf("Rerank with %s failed, using %s order: %v", kb.reranker.Name(), strategy, err)
+		} else {
+			articles, strategy = reranked, strategy+"+rerank"
+		}
+	}
+
+	if len(articles) > limit {
+		articles = articles[:limit]
+	}
+	for i := range articles {
+		articles[i].Strategy = strategy
+	}
+	kbSearches.WithLabelValues(strategy).Inc()
+
+	return articles, nil
+}
+
+// searchVectors embeds the query and finds the nearest article chunks
+func (kb *KnowledgeBase) searchVectors(ctx context.Context, query string, limit int, categories []string) ([]KBArticle, error) {
+	embedder := kb.embeddings.Embedder()
+	vectors, err := embedder.Embed(ctx, []string{query}, EmbedQuery)
+	if err != nil {
+		embeddingRequests.WithLabelValues(embedder.Name(), "error").Inc()
+		return nil, fmt.Errorf("failed to embed query: %w", err)
+	}
+	embeddingRequests.WithLabelValues(embedder.Name(), "success").Inc()
+
+	return kb.embeddings.Store().Search(ctx, vectors[0], limit, categories)
+}
+
+// rerank scores the candidates against the query, best first, dropping those below the minimum
+func (kb *KnowledgeBase) rerank(ctx context.Context, query string, articles []KBArticle) ([]KBArticle, error) {
+	documents := make([]string, len(articles))
+	for i, article := range articles {
+		documents[i] = article.Title + "\n" + article.Content
+	}
+
+	scores, err := kb.reranker.Rerank(ctx, query, documents)
+	if err != nil {
+		return nil, err
+	}
+
+	reranked := make([]KBArticle, 0, len(articles))
+	for i, article := range articles {
+		if scores[i] < kb.minRerankScore {
+			continue
+		}
+		score := scores[i]
+		article.RerankScore = &score
+		article.Score = score
+		reranked = append(reranked, article)
+	}
+	sort.SliceStable(reranked, func(i, j int) bool {
+		return reranked[i].Score > reranked[j].Score
+	})
+	return reranked, nil
+}
+
+// Reranker scores how well documents answer a query
+type Reranker interface {
+	// Name identifies the reranker in logs
+	Name() string
+	// Rerank returns a relevance score between 0 and 1 for each document, in order
+	Rerank(ctx context.Context, query string, documents []string) ([]float64, error)
+}
+
+// NewReranker creates the reranker for a provider: "voyage" for the Voyage rerank API, "local"
+// for a cross-encoder served by text-embeddings-inference at url, or "claude" to have Claude
+// grade the candidates. An empty provider disables reranking.
+func NewReranker(provider, apiKey, model, url string) (Reranker, error) {
+	client := &http.Client{Timeout: 15 * time.Second}
+
+	switch provider {
+	case "":
+		return nil, nil
+	case "voyage":
+		if model == "" {
+			model = "rerank-2"
+		}
+		return &voyageReranker{apiKey: apiKey, model: model, httpClient: client}, nil
+	case "local":
+		if url == "" {
+			return nil, fmt.Errorf("RERANK_URL is required for the local rerank provider")
+		}
+		return &crossEncoderReranker{url: strings.TrimSuffix(url, "/"), httpClient: client}, nil
+	case "claude":
+		if model == "" {
+			model = "claude-3-5-haiku-20241022"
+		}
+		return &claudeReranker{apiKey: apiKey, model: model, httpClient: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown rerank provider %q", provider)
+	}
+}
+
+// voyageReranker uses the Voyage AI rerank API
+type voyageReranker struct {
+	apiKey     string
+	model      string
+	httpClient *http.Client
+}
+
+func (r *voyageReranker) Name() string { return "voyage" }
+
+func (r *voyageReranker) Rerank(ctx context.Context, query string, documents []string) ([]float64, error) {
+	var resp struct {
+		Data []struct {
+			Index          int     `json:"index"`
+			RelevanceScore float64 `json:"relevance_score"`
+		} `json:"data"`
+	}
+	body := map[string]interface{}{"query": query, "documents": documents, "model": r.model}
+	if err := postProvider(ctx, r.httpClient, "https://api.voyageai.com/v1/rerank", r.apiKey, body, &resp); err != nil {
+		return nil, err
+	}
+
+	scores := make([]float64, len(documents))
+	for _, item := range resp.Data {
+		if item.Index >= 0 && item.Index < len(scores) {
+			scores[item.Index] = item.RelevanceScore
+		}
+	}
+	return scores, nil
+}
+
+// crossEncoderReranker uses a cross-encoder served by Hugging Face text-embeddings-inference
+type crossEncoderReranker struct {
+	url        string
+	httpClient *http.Client
+}
+
+func (r *crossEncoderReranker) Name() string { return "local" }
+
+func (r *crossEncoderReranker) Rerank(ctx context.Context, query string, documents []string) ([]float64, error) {
+	var resp []struct {
+		Index int     `json:"index"`
+		Score float64 `json:"score"`
+	}
+	body := map[string]interface{}{"query": query, "texts": documents, "truncate": true}
+	if err := postProvider(ctx, r.httpClient, r.url+"/rerank", "", body, &resp); err != nil {
+		return nil, err
+	}
+
+	scores := make([]float64, len(documents))
+	for _, item := range resp {
+		if item.Index >= 0 && item.Index < len(scores) {
+			scores[item.Index] = item.Score
+		}
+	}
+	return scores, nil
+}
+
+// claudeReranker has Claude grade each candidate's relevance
+type claudeReranker struct {
+	apiKey     string
+	model      string
+	httpClient *http.Client
+}
+
+func (r *claudeReranker) Name() string { return "claude" }
+
+func (r *claudeReranker) Rerank(ctx context.Context, query string, documents []string) ([]float64, error) {
+	var prompt strings.Builder
+	fmt.Fprintf(&prompt, "Grade how well each help center excerpt answers the customer's question, from 0 (irrelevant) to 10 (answers it fully).\n\nQuestion: %s\n\n", query)
+	for i, document := range documents {
+		fmt.Fprintf(&prompt, "<excerpt index=\"%d\">\n%s\n</excerpt>\n\n", i, document)
+	}
+	fmt.Fprintf(&prompt, "Reply with only a JSON array of %d numbers, one grade per excerpt in order.", len(documents))
+
+	reqBody := ClaudeRequest{
+		Model:       r.model,
+		MaxTokens:   256,
+		Temperature: 0,
+		System:      "You grade search results for a customer support knowledge base.",
+		Messages:    []ClaudeMessage{{Role: "user", Content: prompt.String()}},
+	}
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.anthropic.com/v1/messages", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", r.apiKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call claude api: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("claude api error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var claudeResp ClaudeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&claudeResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	llmTokensUsed.WithLabelValues("input").Add(float64(claudeResp.Usage.InputTokens))
+	llmTokensUsed.WithLabelValues("output").Add(float64(claudeResp.Usage.OutputTokens))
+
+	// Take the array even if Claude wrapped it in prose
+	text := claudeResp.Text()
+	start, end := strings.Index(text, "["), strings.LastIndex(text, "]")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no grades in rerank response: %q", text)
+	}
+	var grades []float64
+	if err := json.Unmarshal([]byte(text[start:end+1]), &grades); err != nil {
+		return nil, fmt.Errorf("invalid grades in rerank response: %w", err)
+	}
+	if len(grades) != len(documents) {
+		return nil, fmt.Errorf("got %d grades for %d excerpts", len(grades), len(documents))
+	}
+
+	scores := make([]float64, len(grades))
+	for i, grade := range grades {
+		scores[i] = grade / 10
+	}
+	return scores, nil
+}
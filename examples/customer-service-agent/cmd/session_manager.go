@@ -4,12 +4,22 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
-// SessionManager handles chat session state
+// Active session index
+const (
+	activeSessionsKey = "sessions:active" // sorted set of session IDs by last activity
+	sessionBatchSize  = 500               // sessions read or keys scanned per round trip
+
+	sessionCleanupInterval = 10 * time.Minute
+)
+
+// SessionManager handles chat session state. Sessions are indexed by last activity, so they
+// are counted and listed without scanning the keyspace.
 type SessionManager struct {
 	client          *redis.Client
 	maxConcurrent   int
@@ -25,13 +35,25 @@ type Session struct {
 	LastActivity time.Time       `json:"last_activity"`
 	Messages    []SessionMessage `json:"messages"`
 	Metadata    map[string]interface{} `json:"metadata"`
+
+	// Source is the channel message the customer last sent, so they can be written to through
+	// the same channel outside an answer. Chat API sessions have none.
+	Source *MessageSource `json:"source,omitempty"`
+}
+
+// MessageSource is a channel message with its type, as the message queue stores them
+type MessageSource struct {
+	Type string          `json:"type"` // e.g. *main.SlackWebhook
+	Data json.RawMessage `json:"data"`
 }
 
 // SessionMessage represents a message in the session
 type SessionMessage struct {
-	Role      string    `json:"role"` // user or assistant
+	Role      string    `json:"role"` // user, assistant, or agent (a human agent)
 	Content   string    `json:"content"`
 	Timestamp time.Time `json:"timestamp"`
+	PromptVersion int   `json:"prompt_version,omitempty"` // system prompt version an assistant message was written with
+	Model     string    `json:"model,omitempty"`          // Claude model that wrote an assistant message
 }
 
 // NewSessionManager creates a new session manager
@@ -72,7 +94,7 @@ func (sm *SessionManager) GetOrCreate(ctx context.Context, sessionID, userID str
 	}
 
 	// Check concurrent session limit
-	activeCount, err := sm.GetActiveCount()
+	activeCount, err := sm.GetActiveCount(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -103,7 +125,7 @@ func (sm *SessionManager) GetOrCreate(ctx context.Context, sessionID, userID str
 
 // Get retrieves a session by ID
 func (sm *SessionManager) Get(ctx context.Context, sessionID string) (*Session, error) {
-	key := sm.sessionKey(sessionID)
+	key := sm.sessionKey(ctx, sessionID)
 
 	data, err := sm.client.Get(ctx, key).Bytes()
 	if err == redis.Nil {
@@ -123,34 +145,83 @@ func (sm *SessionManager) Get(ctx context.Context, sessionID string) (*Session,
 
 // Save saves a session
 func (sm *SessionManager) Save(ctx context.Context, session *Session) error {
-	key := sm.sessionKey(session.SessionID)
+	key := sm.sessionKey(ctx, session.SessionID)
 
 	data, err := json.Marshal(session)
 	if err != nil {
 		return fmt.Errorf("failed to marshal session: %w", err)
 	}
 
-	if err := sm.client.Set(ctx, key, data, sm.sessionTTL).Err(); err != nil {
+	pipe := sm.client.TxPipeline()
+	pipe.Set(ctx, key, data, sm.sessionTTL)
+	// Saving restarts the session's expiry, so it stays in the index as long as its key lives
+	pipe.ZAdd(ctx, sm.indexKey(ctx), &redis.Z{Score: float64(time.Now().Unix()), Member: session.SessionID})
+	if _, err := pipe.Exec(ctx); err != nil {
 		return fmt.Errorf("failed to save session: %w", err)
 	}
 
 	return nil
 }
 
-// AddMessage adds a message to the session
-func (sm *SessionManager) AddMessage(ctx context.Context, sessionID, role, content string) error {
-	session, err := sm.Get(ctx, sessionID)
+// SetMetadata sets values in a session's metadata, creating the session if needed
+func (sm *SessionManager) SetMetadata(ctx context.Context, sessionID, userID string, values map[string]interface{}) error {
+	session, err := sm.GetOrCreate(ctx, sessionID, userID)
 	if err != nil {
 		return err
 	}
-	if session == nil {
-		return fmt.Errorf("session not found: %s", sessionID)
+
+	if session.Metadata == nil {
+		session.Metadata = make(map[string]interface{})
+	}
+	for key, value := range values {
+		session.Metadata[key] = value
+	}
+
+	return sm.Save(ctx, session)
+}
+
+// SetSource records the channel a session's customer wrote from and the message they sent
+func (sm *SessionManager) SetSource(ctx context.Context, session *Session, channel string, message interface{}) error {
+	session.Channel = channel
+	if message != nil {
+		data, err := json.Marshal(message)
+		if err != nil {
+			return fmt.Errorf("failed to marshal message source: %w", err)
+		}
+		session.Source = &MessageSource{Type: fmt.Sprintf("%T", message), Data: data}
 	}
 
-	message := SessionMessage{
+	return sm.Save(ctx, session)
+}
+
+// AddMessage adds a message to the session
+func (sm *SessionManager) AddMessage(ctx context.Context, sessionID, role, content string) error {
+	return sm.appendMessage(ctx, sessionID, SessionMessage{
 		Role:      role,
 		Content:   content,
 		Timestamp: time.Now(),
+	})
+}
+
+// AddAnswer adds the agent's answer to the session, with the system prompt version and the
+// Claude model it was written with. Answers written without Claude have no model.
+func (sm *SessionManager) AddAnswer(ctx context.Context, sessionID, content string, promptVersion int, model string) error {
+	return sm.appendMessage(ctx, sessionID, SessionMessage{
+		Role:          "assistant",
+		Content:       content,
+		Timestamp:     time.Now(),
+		PromptVersion: promptVersion,
+		Model:         model,
+	})
+}
+
+func (sm *SessionManager) appendMessage(ctx context.Context, sessionID string, message SessionMessage) error {
+	session, err := sm.Get(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	if session == nil {
+		return fmt.Errorf("session not found: %s", sessionID)
 	}
 
 	session.Messages = append(session.Messages, message)
@@ -179,75 +250,187 @@ func (sm *SessionManager) GetHistory(ctx context.Context, sessionID string) ([]S
 
 // EndSession terminates a session
 func (sm *SessionManager) EndSession(ctx context.Context, sessionID string) error {
-	key := sm.sessionKey(sessionID)
-
-	if err := sm.client.Del(ctx, key).Err(); err != nil {
+	pipe := sm.client.TxPipeline()
+	pipe.Del(ctx, sm.sessionKey(ctx, sessionID))
+	pipe.ZRem(ctx, sm.indexKey(ctx), sessionID)
+	if _, err := pipe.Exec(ctx); err != nil {
 		return fmt.Errorf("failed to delete session: %w", err)
 	}
 
 	return nil
 }
 
-// GetActiveCount returns the number of active sessions
-func (sm *SessionManager) GetActiveCount() (int, error) {
-	ctx := context.Background()
-
-	// Count keys matching the session pattern
-	keys, err := sm.client.Keys(ctx, "session:*").Result()
+// GetActiveCount returns the number of active sessions of the tenant
+func (sm *SessionManager) GetActiveCount(ctx context.Context) (int, error) {
+	count, err := sm.client.ZCount(ctx, sm.indexKey(ctx), sm.activeSince(), "+inf").Result()
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("failed to count sessions: %w", err)
 	}
 
-	return len(keys), nil
+	return int(count), nil
 }
 
-// GetActiveSessions returns all active sessions
-func (sm *SessionManager) GetActiveSessions(ctx context.Context) ([]*Session, error) {
-	keys, err := sm.client.Keys(ctx, "session:*").Result()
+// GetActiveSessions returns active sessions of the tenant, most recently active first,
+// skipping offset sessions and returning up to limit. A limit of zero returns all of them.
+func (sm *SessionManager) GetActiveSessions(ctx context.Context, offset, limit int) ([]*Session, error) {
+	count := int64(limit)
+	if limit <= 0 {
+		count = -1
+	}
+	ids, err := sm.client.ZRevRangeByScore(ctx, sm.indexKey(ctx), &redis.ZRangeBy{
+		Min:    sm.activeSince(),
+		Max:    "+inf",
+		Offset: int64(offset),
+		Count:  count,
+	}).Result()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
 	}
 
-	sessions := make([]*Session, 0, len(keys))
-	for _, key := range keys {
-		data, err := sm.client.Get(ctx, key).Bytes()
+	sessions := make([]*Session, 0, len(ids))
+	for start := 0; start < len(ids); start += sessionBatchSize {
+		batch := ids[start:min(start+sessionBatchSize, len(ids))]
+		keys := make([]string, len(batch))
+		for i, id := range batch {
+			keys[i] = sm.sessionKey(ctx, id)
+		}
+		values, err := sm.client.MGet(ctx, keys...).Result()
 		if err != nil {
-			continue
+			return nil, fmt.Errorf("failed to get sessions: %w", err)
 		}
 
-		var session Session
-		if err := json.Unmarshal(data, &session); err != nil {
-			continue
+		for _, value := range values {
+			// Sessions can expire or end between reads
+			data, ok := value.(string)
+			if !ok {
+				continue
+			}
+			var session Session
+			if err := json.Unmarshal([]byte(data), &session); err != nil {
+				continue
+			}
+			sessions = append(sessions, &session)
 		}
-
-		sessions = append(sessions, &session)
 	}
 
 	return sessions, nil
 }
 
-// CleanupInactive removes inactive sessions
+// UserSessions returns the tenant's active sessions of a customer, reading every indexed
+// session in batches
+func (sm *SessionManager) UserSessions(ctx context.Context, userID string) ([]*Session, error) {
+	var sessions []*Session
+	for start := int64(0); ; start += sessionBatchSize {
+		ids, err := sm.client.ZRange(ctx, sm.indexKey(ctx), start, start+sessionBatchSize-1).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list sessions: %w", err)
+		}
+		if len(ids) == 0 {
+			return sessions, nil
+		}
+
+		keys := make([]string, len(ids))
+		for i, id := range ids {
+			keys[i] = sm.sessionKey(ctx, id)
+		}
+		values, err := sm.client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get sessions: %w", err)
+		}
+		for _, value := range values {
+			data, ok := value.(string)
+			if !ok {
+				continue
+			}
+			var session Session
+			if err := json.Unmarshal([]byte(data), &session); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal session: %w", err)
+			}
+			if session.UserID == userID {
+				sessions = append(sessions, &session)
+			}
+		}
+	}
+}
+
+// CleanupInactive removes sessions inactive for inactiveDuration, and the index entries of
+// sessions that expired
 func (sm *SessionManager) CleanupInactive(ctx context.Context, inactiveDuration time.Duration) (int, error) {
-	sessions, err := sm.GetActiveSessions(ctx)
+	cutoff := strconv.FormatInt(time.Now().Add(-inactiveDuration).Unix(), 10)
+	ids, err := sm.client.ZRangeByScore(ctx, sm.indexKey(ctx), &redis.ZRangeBy{Min: "-inf", Max: cutoff}).Result()
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("failed to list inactive sessions: %w", err)
 	}
 
 	cleaned := 0
-	cutoff := time.Now().Add(-inactiveDuration)
+	for start := 0; start < len(ids); start += sessionBatchSize {
+		batch := ids[start:min(start+sessionBatchSize, len(ids))]
+		keys := make([]string, len(batch))
+		members := make([]interface{}, len(batch))
+		for i, id := range batch {
+			keys[i] = sm.sessionKey(ctx, id)
+			members[i] = id
+		}
 
-	for _, session := range sessions {
-		if session.LastActivity.Before(cutoff) {
-			if err := sm.EndSession(ctx, session.SessionID); err != nil {
-				continue
-			}
-			cleaned++
+		pipe := sm.client.TxPipeline()
+		deleted := pipe.Del(ctx, keys...)
+		pipe.ZRem(ctx, sm.indexKey(ctx), members...)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return cleaned, fmt.Errorf("failed to delete inactive sessions: %w", err)
 		}
+		cleaned += int(deleted.Val())
 	}
 
 	return cleaned, nil
 }
 
+// IndexSessions adds the tenant's sessions saved before the active session index to it,
+// scanning their keys in batches. Each is scored by when it was last saved, worked out from
+// the time its key has left. It returns the number of sessions added.
+func (sm *SessionManager) IndexSessions(ctx context.Context) (int, error) {
+	prefix := sm.sessionKey(ctx, "")
+	now := time.Now()
+	indexed := 0
+
+	var cursor uint64
+	for {
+		keys, next, err := sm.client.Scan(ctx, cursor, prefix+"*", sessionBatchSize).Result()
+		if err != nil {
+			return indexed, fmt.Errorf("failed to scan sessions: %w", err)
+		}
+
+		if len(keys) > 0 {
+			pipe := sm.client.Pipeline()
+			ttls := make([]*redis.DurationCmd, len(keys))
+			for i, key := range keys {
+				ttls[i] = pipe.TTL(ctx, key)
+			}
+			if _, err := pipe.Exec(ctx); err != nil {
+				return indexed, fmt.Errorf("failed to read session expiry: %w", err)
+			}
+
+			members := make([]*redis.Z, 0, len(keys))
+			for i, key := range keys {
+				saved := now
+				if ttl := ttls[i].Val(); ttl > 0 && ttl < sm.sessionTTL {
+					saved = now.Add(ttl - sm.sessionTTL)
+				}
+				members = append(members, &redis.Z{Score: float64(saved.Unix()), Member: key[len(prefix):]})
+			}
+			added, err := sm.client.ZAddNX(ctx, sm.indexKey(ctx), members...).Result()
+			if err != nil {
+				return indexed, fmt.Errorf("failed to index sessions: %w", err)
+			}
+			indexed += int(added)
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return indexed, nil
+		}
+	}
+}
+
 // HealthCheck checks if Redis is available
 func (sm *SessionManager) HealthCheck() bool {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
@@ -262,17 +445,26 @@ func (sm *SessionManager) Close() error {
 	return sm.client.Close()
 }
 
-// sessionKey generates the Redis key for a session
-func (sm *SessionManager) sessionKey(sessionID string) string {
-	return fmt.Sprintf("session:%s", sessionID)
+// sessionKey generates the Redis key for a session of the tenant
+func (sm *SessionManager) sessionKey(ctx context.Context, sessionID string) string {
+	return tenantKey(ctx, fmt.Sprintf("session:%s", sessionID))
+}
+
+// indexKey is the tenant's active session index
+func (sm *SessionManager) indexKey(ctx context.Context) string {
+	return tenantKey(ctx, activeSessionsKey)
+}
+
+// activeSince is the index score of the sessions saved as long ago as sessions live
+func (sm *SessionManager) activeSince() string {
+	return strconv.FormatInt(time.Now().Add(-sm.sessionTTL).Unix(), 10)
 }
 
-// StartCleanupRoutine starts a background routine to clean up inactive sessions
-func (sm *SessionManager) StartCleanupRoutine(interval, inactiveDuration time.Duration) {
+// StartCleanupRoutine starts a background routine to clean up the tenant's inactive sessions
+func (sm *SessionManager) StartCleanupRoutine(ctx context.Context, interval, inactiveDuration time.Duration) {
 	ticker := time.NewTicker(interval)
 	go func() {
 		for range ticker.C {
-			ctx := context.Background()
 			cleaned, err := sm.CleanupInactive(ctx, inactiveDuration)
 			if err != nil {
 				fmt.Printf("Session cleanup error: %v\n", err)
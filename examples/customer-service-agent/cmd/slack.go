@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Slack delivery settings
+const (
+	slackMaxRetries      = 3 // retries of a rate limited chat.postMessage
+	slackMaxRetryAfter   = 30 * time.Second
+	slackMaxMessageChars = 39000 // Slack truncates message text at 40,000 characters
+	slackMaxRequestAge   = 5 * time.Minute
+	slackMaxRequestSize  = 1 << 20
+)
+
+// slackFallbackReply is posted when the agent cannot answer, so the user is not left waiting
+const slackFallbackReply = "Sorry, I'm having trouble answering right now. A member of the team will follow up in this thread."
+
+var slackRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_slack_requests_total",
+		Help: "Slack Web API requests, by method and status",
+	},
+	[]string{"method", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(slackRequests)
+}
+
+// SlackClient posts replies through the Slack Web API
+type SlackClient struct {
+	botToken   string
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewSlackClient creates a client posting as the bot the token belongs to
+func NewSlackClient(botToken string) *SlackClient {
+	return &SlackClient{
+		botToken: botToken,
+		baseURL:  "https://slack.com/api",
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// slackError is an error reported by the Slack Web API
+type slackError struct {
+	method string
+	code   string
+}
+
+func (e *slackError) Error() string {
+	return fmt.Sprintf("slack %s failed: %s", e.method, e.code)
+}
+
+// PostMessage posts text in a channel, in the thread of threadTS when it is set. The text is
+// formatted as Slack mrkdwn.
+func (c *SlackClient) PostMessage(ctx context.Context, channel, threadTS, text string) error {
+	if len(text) > slackMaxMessageChars {
+		text = text[:slackMaxMessageChars] + "…"
+	}
+	body := map[string]interface{}{
+		"channel": channel,
+		"text":    text,
+		"mrkdwn":  true,
+	}
+	if threadTS != "" {
+		body["thread_ts"] = threadTS
+	}
+	return c.call(ctx, "chat.postMessage", body)
+}
+
+// Reply posts the agent's answer in the thread of the message it answers. If the thread is gone,
+// the answer is posted in the channel instead.
+func (c *SlackClient) Reply(ctx context.Context, channel, threadTS, message string) error {
+	err := c.PostMessage(ctx, channel, threadTS, toSlackMarkdown(message))
+	if slackErr, ok := err.(*slackError); ok && slackErr.code == "thread_not_found" {
+		log.Printf("Slack thread %s in %s not found, replying in the channel", threadTS, channel)
+		return c.PostMessage(ctx, channel, "", toSlackMarkdown(message))
+	}
+	return err
+}
+
+// call sends a Web API request, retrying after the Retry-After Slack sends when rate limited
+func (c *SlackClient) call(ctx context.Context, method string, body interface{}) error {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/"+method, bytes.NewReader(jsonData))
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		req.Header.Set("Authorization", "Bearer "+c.botToken)
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			slackRequests.WithLabelValues(method, "error").Inc()
+			return fmt.Errorf("failed to call slack api: %w", err)
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < slackMaxRetries {
+			slackRequests.WithLabelValues(method, "rate_limited").Inc()
+			wait := time.Second
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				wait = time.Duration(seconds) * time.Second
+			}
+			if wait > slackMaxRetryAfter {
+				return fmt.Errorf("slack rate limit: retry after %s", wait)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			slackRequests.WithLabelValues(method, "error").Inc()
+			return fmt.Errorf("slack api error (status %d): %s", resp.StatusCode, string(data))
+		}
+
+		// The Web API reports failures in the body of a 200 response
+		var result struct {
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(data, &result); err != nil {
+			slackRequests.WithLabelValues(method, "error").Inc()
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+		if !result.OK {
+			slackRequests.WithLabelValues(method, "error").Inc()
+			return &slackError{method: method, code: result.Error}
+		}
+
+		slackRequests.WithLabelValues(method, "success").Inc()
+		return nil
+	}
+}
+
+// slackSignatureMiddleware rejects requests not signed with the Slack app's signing secret, or
+// signed more than five minutes ago, so nobody else can queue events for the agent to answer or
+// replay ones they captured. Tenants with their own Slack app are checked against its secret.
+// Without a signing secret every request is rejected.
+func slackSignatureMiddleware(defaultSecret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		signingSecret := defaultSecret
+		if tenant := tenantFrom(c.Request.Context()); tenant.Slack != nil {
+			signingSecret = tenant.Slack.SigningSecret
+		}
+		if signingSecret == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "slack signing secret not configured"})
+			c.Abort()
+			return
+		}
+
+		timestamp := c.GetHeader("X-Slack-Request-Timestamp")
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid request timestamp"})
+			c.Abort()
+			return
+		}
+		age := time.Since(time.Unix(seconds, 0))
+		if age > slackMaxRequestAge || age < -slackMaxRequestAge {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "stale request"})
+			c.Abort()
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, slackMaxRequestSize))
+		if err != nil {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request too large"})
+			c.Abort()
+			return
+		}
+
+		// The signature is an HMAC-SHA256 of "v0:<timestamp>:<body>"
+		mac := hmac.New(sha256.New, []byte(signingSecret))
+		fmt.Fprintf(mac, "v0:%s:", timestamp)
+		mac.Write(body)
+		expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(expected), []byte(c.GetHeader("X-Slack-Signature"))) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid signature"})
+			c.Abort()
+			return
+		}
+
+		// The handler reads the body again
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Next()
+	}
+}
+
+var (
+	slackMention     = regexp.MustCompile(`<@[A-Z0-9]+(\|[^>]*)?>`)
+	mdHeadingLine    = regexp.MustCompile(`(?m)^#{1,6}\s+(.+?)\s*#*\s*$`)
+	mdBold           = regexp.MustCompile(`\*\*(.+?)\*\*|__(.+?)__`)
+	mdStrikethrough  = regexp.MustCompile(`~~(.+?)~~`)
+	mdInlineLink     = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^)\s]+)\)`)
+	mdBulletAsterisk = regexp.MustCompile(`(?m)^(\s*)[*+]\s+`)
+)
+
+// slackMessageText returns the text of a Slack message without mentions of the bot
+func slackMessageText(text string) string {
+	return strings.TrimSpace(slackMention.ReplaceAllString(text, ""))
+}
+
+// toSlackMarkdown converts the Markdown Claude writes to Slack mrkdwn: bold is *text*, links are
+// <url|text>, and there are no headings. Code blocks and inline code are the same in both.
+func toSlackMarkdown(text string) string {
+	// Slack reads &, <, and > as control characters
+	text = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+
+	text = mdInlineLink.ReplaceAllString(text, "<$2|$1>")
+	text = mdBulletAsterisk.ReplaceAllString(text, "$1• ")
+	text = mdHeadingLine.ReplaceAllString(text, "**$1**")
+	text = mdBold.ReplaceAllStringFunc(text, func(match string) string {
+		return "*" + match[2:len(match)-2] + "*"
+	})
+	return mdStrikethrough.ReplaceAllString(text, "~$1~")
+}
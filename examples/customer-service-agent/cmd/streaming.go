@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxStreamEventSize bounds one server-sent event from the Claude API
+const maxStreamEventSize = 1 << 20
+
+// claudeStreamEvent is one event of a streamed Claude response
+type claudeStreamEvent struct {
+	Type         string          `json:"type"`
+	Message      *ClaudeResponse `json:"message,omitempty"`       // message_start
+	Index        int             `json:"index"`                   // content_block_*
+	ContentBlock *ClaudeContent  `json:"content_block,omitempty"` // content_block_start
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`         // content_block_delta
+		PartialJSON string `json:"partial_json"` // content_block_delta of a tool_use block
+		StopReason  string `json:"stop_reason"`  // message_delta
+	} `json:"delta"`
+	Usage *struct {
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage,omitempty"` // message_delta
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// streamClaude calls Claude with streaming enabled and passes each text delta to onToken as it
+// arrives. The deltas are assembled into the same response callClaude returns, including the
+// input of any tool_use blocks.
+func (s *AgentService) streamClaude(ctx context.Context, turn *chatTurn, onToken func(text string) error) (*ClaudeResponse, error) {
+	var claudeResp *ClaudeResponse
+	err := s.sendClaude(ctx, turn, true, func(body io.Reader) error {
+		var err error
+		claudeResp, err = s.readClaudeStream(body, onToken)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claudeResp, nil
+}
+
+// readClaudeStream reads the server-sent events of a streamed response
+func (s *AgentService) readClaudeStream(body io.Reader, onToken func(text string) error) (*ClaudeResponse, error) {
+	claudeResp := &ClaudeResponse{}
+	var blocks []ClaudeContent
+	var inputs []string // tool_use input JSON, by block index
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamEventSize)
+
+	// Events are "event:" and "data:" lines ended by a blank line; the data carries the type too
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		var event claudeStreamEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &event); err != nil {
+			return nil, fmt.Errorf("failed to decode stream event: %w", err)
+		}
+
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil {
+				claudeResp.ID = event.Message.ID
+				claudeResp.Type = event.Message.Type
+				claudeResp.Role = event.Message.Role
+				claudeResp.Model = event.Message.Model
+				claudeResp.Usage = event.Message.Usage
+			}
+		case "content_block_start":
+			if event.ContentBlock == nil || event.Index != len(blocks) {
+				return nil, fmt.Errorf("unexpected content block %d in stream", event.Index)
+			}
+			block := *event.ContentBlock
+			block.Input = nil // streamed as input_json_delta
+			blocks = append(blocks, block)
+			inputs = append(inputs, "")
+		case "content_block_delta":
+			if event.Index < 0 || event.Index >= len(blocks) {
+				return nil, fmt.Errorf("delta for unknown content block %d in stream", event.Index)
+			}
+			switch event.Delta.Type {
+			case "input_json_delta":
+				inputs[event.Index] += event.Delta.PartialJSON
+			case "text_delta":
+				if event.Delta.Text == "" {
+					continue
+				}
+				blocks[event.Index].Text += event.Delta.Text
+				if err := onToken(event.Delta.Text); err != nil {
+					return nil, err
+				}
+			}
+		case "message_delta":
+			claudeResp.StopReason = event.Delta.StopReason
+			if event.Usage != nil {
+				claudeResp.Usage.OutputTokens = event.Usage.OutputTokens
+			}
+		case "message_stop":
+			for i := range blocks {
+				if blocks[i].Type != "tool_use" {
+					continue
+				}
+				if inputs[i] == "" {
+					inputs[i] = "{}"
+				}
+				if !json.Valid([]byte(inputs[i])) {
+					return nil, fmt.Errorf("invalid input streamed for tool %s", blocks[i].Name)
+				}
+				blocks[i].Input = json.RawMessage(inputs[i])
+			}
+			claudeResp.Content = blocks
+			claudeResp.Confidence = s.calculateConfidence(claudeResp)
+			return claudeResp, nil
+		case "error":
+			if event.Error != nil {
+				return nil, fmt.Errorf("claude stream error (%s): %s", event.Error.Type, event.Error.Message)
+			}
+			return nil, fmt.Errorf("claude stream error")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read stream: %w", err)
+	}
+
+	return nil, fmt.Errorf("claude stream ended before the message was complete")
+}
+
+// handleChatStream processes a chat message like handleChatMessage but answers with server-sent
+// events: a "token" event for each piece of text as Claude writes it, then a "done" event with
+// the complete response, or an "error" event if the answer fails partway
+func (app *Application) handleChatStream(c *gin.Context) {
+	var req ChatMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+
+	// Validate input
+	if err := req.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Start tracing span
+	ctx := c.Request.Context()
+	if app.Config.EnableTracing {
+		var span trace.Span
+		ctx, span = app.Tracer.Start(ctx, "handle_chat_stream")
+		defer span.End()
+	}
+
+	// Long answers outlast the server's write timeout
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "streaming not supported"})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // keep proxies such as NGINX from buffering the stream
+
+	// Process message
+	startTime := time.Now()
+	response, err := app.AgentService.ProcessMessageStream(ctx, &req, func(text string) error {
+		c.SSEvent("token", gin.H{"text": text})
+		c.Writer.Flush()
+		return ctx.Err()
+	})
+	duration := time.Since(startTime).Seconds()
+
+	// Record metrics
+	messageLatency.WithLabelValues(req.Channel).Observe(duration)
+
+	if errors.Is(err, ErrHandedOff) {
+		// A human agent answers through the WebSocket
+		c.SSEvent("handoff", gin.H{"session_id": req.SessionID, "handed_off": true})
+		c.Writer.Flush()
+		return
+	}
+	if err != nil {
+		messagesProcessed.WithLabelValues("error", req.Channel).Inc()
+		if ctx.Err() == nil {
+			c.SSEvent("error", gin.H{"error": err.Error()})
+			c.Writer.Flush()
+		}
+		return
+	}
+
+	messagesProcessed.WithLabelValues("success", req.Channel).Inc()
+	sentimentDistribution.WithLabelValues(response.Sentiment).Inc()
+
+	c.SSEvent("done", response)
+	c.Writer.Flush()
+}
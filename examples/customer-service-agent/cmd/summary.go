@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Session summary settings
+const (
+	summaryMetadataKey = "summary"
+	summaryTimeout     = time.Minute
+	summaryMaxTokens   = 600
+)
+
+// Resolution states of a session summary
+const (
+	ResolutionResolved   = "resolved"
+	ResolutionInProgress = "in_progress"
+	ResolutionEscalated  = "escalated"
+	ResolutionUnresolved = "unresolved"
+)
+
+var sessionSummaries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_session_summaries_total",
+		Help: "Session summary updates, by status",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(sessionSummaries)
+}
+
+// SessionSummary is Claude's running summary of a conversation, kept in the session's metadata
+type SessionSummary struct {
+	Issue        string    `json:"issue"`
+	ActionsTaken []string  `json:"actions_taken"`
+	Resolution   string    `json:"resolution"` // resolved, in_progress, escalated, or unresolved
+	Summary      string    `json:"summary"`
+	Through      time.Time `json:"through"` // time of the last message summarized
+	Messages     int       `json:"messages"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// sessionSummary returns the summary stored in a session, or nil
+func sessionSummary(session *Session) *SessionSummary {
+	value, ok := session.Metadata[summaryMetadataKey]
+	if !ok {
+		return nil
+	}
+	// Metadata comes back from Redis as a generic map
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	var summary SessionSummary
+	if err := json.Unmarshal(data, &summary); err != nil || summary.UpdatedAt.IsZero() {
+		return nil
+	}
+	return &summary
+}
+
+// Summarize brings a session's summary up to date with its messages and returns it. Only the
+// messages since the last summary are sent to Claude, with that summary.
+func (s *AgentService) Summarize(ctx context.Context, sessionID string) (*SessionSummary, error) {
+	session, err := s.sessionManager.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil || len(session.Messages) == 0 {
+		return nil, nil
+	}
+
+	previous := sessionSummary(session)
+	var unsummarized []SessionMessage
+	for _, msg := range session.Messages {
+		if previous == nil || msg.Timestamp.After(previous.Through) {
+			unsummarized = append(unsummarized, msg)
+		}
+	}
+	if len(unsummarized) == 0 {
+		return previous, nil
+	}
+
+	// Claude sees placeholders for the customer's personal data; the stored summary has the data
+	tenantID, _ := session.Metadata["tenant_id"].(string)
+	pii, err := s.pii.Vault(ctx, sessionID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	summary, err := s.callSummarizer(ctx, previous, unsummarized, pii)
+	if err != nil {
+		sessionSummaries.WithLabelValues("failed").Inc()
+		return nil, err
+	}
+	if err := pii.Save(ctx); err != nil {
+		return nil, err
+	}
+	summary.Through = unsummarized[len(unsummarized)-1].Timestamp
+	summary.Messages = len(unsummarized)
+	if previous != nil {
+		summary.Messages += previous.Messages
+	}
+	summary.UpdatedAt = time.Now()
+
+	if err := s.sessionManager.SetMetadata(ctx, sessionID, session.UserID, map[string]interface{}{summaryMetadataKey: summary}); err != nil {
+		return nil, err
+	}
+	sessionSummaries.WithLabelValues("updated").Inc()
+	s.analytics.RecordResolution(ctx, sessionID, summary.Resolution)
+	return summary, nil
+}
+
+// refreshSummary updates a session's summary in the background once SummaryInterval messages
+// have been added since the last one, or right away when force is set
+func (s *AgentService) refreshSummary(ctx context.Context, sessionID string, force bool) {
+	if s.config.SummaryInterval <= 0 {
+		return
+	}
+
+	background := detachContext(ctx)
+	go func() {
+		ctx, cancel := context.WithTimeout(background, summaryTimeout)
+		defer cancel()
+
+		if !force {
+			session, err := s.sessionManager.Get(ctx, sessionID)
+			if err != nil || session == nil {
+				return
+			}
+			unsummarized := len(session.Messages)
+			if previous := sessionSummary(session); previous != nil {
+				unsummarized = 0
+				for _, msg := range session.Messages {
+					if msg.Timestamp.After(previous.Through) {
+						unsummarized++
+					}
+				}
+			}
+			if unsummarized < s.config.SummaryInterval {
+				return
+			}
+		}
+
+		// One summary at a time per session, across replicas
+		lock := tenantKey(ctx, "summary:lock:"+sessionID)
+		locked, err := s.sessionManager.client.SetNX(ctx, lock, 1, summaryTimeout).Result()
+		if err != nil || !locked {
+			return
+		}
+		defer s.sessionManager.client.Del(background, lock)
+
+		if _, err := s.Summarize(ctx, sessionID); err != nil {
+			log.Printf("Failed to summarize session %s: %v", sessionID, err)
+		}
+	}()
+}
+
+// callSummarizer has Claude update the previous summary, if any, with the new messages.
+// Personal data is redacted by pii in what is sent and restored in the summary returned.
+func (s *AgentService) callSummarizer(ctx context.Context, previous *SessionSummary, messages []SessionMessage, pii *piiVault) (*SessionSummary, error) {
+	var prompt strings.Builder
+	if previous != nil {
+		previousJSON, _ := json.Marshal(map[string]interface{}{
+			"issue":         previous.Issue,
+			"actions_taken": previous.ActionsTaken,
+			"resolution":    previous.Resolution,
+			"summary":       previous.Summary,
+		})
+		fmt.Fprintf(&prompt, "Summary of the conversation so far:\n%s\n\nNew messages:\n", pii.Redact(string(previousJSON)))
+	} else {
+		prompt.WriteString("Conversation:\n")
+	}
+	speakers := map[string]string{"user": "Customer", "assistant": "AI agent", "agent": "Human agent"}
+	for _, msg := range messages {
+		speaker := speakers[msg.Role]
+		if speaker == "" {
+			speaker = msg.Role
+		}
+		fmt.Fprintf(&prompt, "%s: %s\n", speaker, pii.Redact(msg.Content))
+	}
+	prompt.WriteString(`
+Reply with only a JSON object summarizing the whole conversation for a support agent taking it over:
+{"issue": "the customer's problem in one sentence",
+ "actions_taken": ["each thing the AI or human agent did or told the customer, briefly"],
+ "resolution": "resolved, in_progress, escalated, or unresolved",
+ "summary": "two or three sentences of context the next agent needs"}`)
+
+	reqBody := ClaudeRequest{
+		Model:       s.config.Model,
+		MaxTokens:   summaryMaxTokens,
+		Temperature: 0,
+		System:      "You summarize customer support conversations for the support team. Be factual and brief.",
+		Messages:    []ClaudeMessage{{Role: "user", Content: prompt.String()}},
+	}
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.anthropic.com/v1/messages", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", s.config.ClaudeAPIKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call claude api: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("claude api error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var claudeResp ClaudeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&claudeResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	llmTokensUsed.WithLabelValues("input").Add(float64(claudeResp.Usage.InputTokens))
+	llmTokensUsed.WithLabelValues("output").Add(float64(claudeResp.Usage.OutputTokens))
+
+	// Take the object even if Claude wrapped it in prose
+	text := claudeResp.Text()
+	start, end := strings.Index(text, "{"), strings.LastIndex(text, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no summary in response: %q", text)
+	}
+	var summary SessionSummary
+	if err := json.Unmarshal([]byte(text[start:end+1]), &summary); err != nil {
+		return nil, fmt.Errorf("invalid summary in response: %w", err)
+	}
+	summary.Issue = pii.Restore(summary.Issue)
+	for i, action := range summary.ActionsTaken {
+		summary.ActionsTaken[i] = pii.Restore(action)
+	}
+	summary.Summary = pii.Restore(summary.Summary)
+	switch summary.Resolution {
+	case ResolutionResolved, ResolutionInProgress, ResolutionEscalated, ResolutionUnresolved:
+	default:
+		summary.Resolution = ResolutionInProgress
+	}
+	return &summary, nil
+}
+
+// getChatSummary returns a session's summary, bringing it up to date first
+func (app *Application) getChatSummary(c *gin.Context) {
+	sessionID := c.Param("session_id")
+
+	summary, err := app.AgentService.Summarize(c.Request.Context(), sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if summary == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found or has no messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session_id": sessionID,
+		"summary":    summary,
+	})
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Bot Framework endpoints and settings
+const (
+	botFrameworkIssuer  = "https://api.botframework.com"
+	botFrameworkKeysURL = "https://login.botframework.com/v1/.well-known/keys"
+	botFrameworkScope   = "https://api.botframework.com/.default"
+	botKeysTTL          = 24 * time.Hour
+	botClockSkew        = 5 * time.Minute
+	teamsMaxCardActions = 3 // knowledge base articles linked from a reply
+)
+
+// teamsFallbackReply is posted when the agent cannot answer, so the user is not left waiting
+const teamsFallbackReply = "Sorry, I'm having trouble answering right now. Someone from the helpdesk will follow up."
+
+var teamsRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_teams_requests_total",
+		Help: "Bot Framework API requests, by operation and status",
+	},
+	[]string{"operation", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(teamsRequests)
+}
+
+// TeamsConfig holds the Azure bot registration the agent answers as
+type TeamsConfig struct {
+	AppID       string
+	AppPassword string
+	TenantID    string // for single-tenant bots; multi-tenant bots get tokens from botframework.com
+}
+
+// TeamsClient receives Teams messages through the Bot Framework and replies with adaptive cards
+type TeamsClient struct {
+	config     TeamsConfig
+	tokenURL   string
+	httpClient *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	tokenExpiry time.Time
+	keys        map[string]*botSigningKey // Bot Framework signing keys by key ID
+	keysFetched time.Time
+}
+
+// botSigningKey is a key the Bot Framework signs tokens with, and the channels it is valid for
+type botSigningKey struct {
+	key          *rsa.PublicKey
+	endorsements []string
+}
+
+// TeamsActivity is a Bot Framework activity. Only the fields the agent uses are kept.
+type TeamsActivity struct {
+	Type       string `json:"type"`
+	ID         string `json:"id"`
+	ChannelID  string `json:"channelId"`
+	ServiceURL string `json:"serviceUrl"`
+	Text       string `json:"text"`
+	From       struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		AADObjectID string `json:"aadObjectId"`
+	} `json:"from"`
+	Conversation struct {
+		ID               string `json:"id"`
+		ConversationType string `json:"conversationType"` // personal, channel, or groupChat
+		TenantID         string `json:"tenantId"`
+	} `json:"conversation"`
+	Recipient struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"recipient"`
+}
+
+// NewTeamsClient creates a client for the bot registration in config
+func NewTeamsClient(config TeamsConfig) (*TeamsClient, error) {
+	if config.AppID == "" || config.AppPassword == "" {
+		return nil, fmt.Errorf("TEAMS_APP_ID and TEAMS_APP_PASSWORD are required")
+	}
+
+	tenant := config.TenantID
+	if tenant == "" {
+		tenant = "botframework.com"
+	}
+	return &TeamsClient{
+		config:   config,
+		tokenURL: "https://login.microsoftonline.com/" + url.PathEscape(tenant) + "/oauth2/v2.0/token",
+		httpClient: &http.Client{
+			Timeout: 15 * time.Second,
+		},
+	}, nil
+}
+
+// Reply answers an activity in its conversation with an adaptive card holding the agent's
+// answer, links to the articles it used, and a note when a human will follow up
+func (c *TeamsClient) Reply(ctx context.Context, activity *TeamsActivity, response *ChatMessageResponse) error {
+	body := []map[string]interface{}{
+		{"type": "TextBlock", "text": response.Message, "wrap": true},
+	}
+	if response.ShouldEscalate {
+		body = append(body, map[string]interface{}{
+			"type": "TextBlock", "text": "A member of the helpdesk team will follow up.",
+			"wrap": true, "isSubtle": true, "spacing": "Medium",
+		})
+	}
+
+	var actions []map[string]interface{}
+	for _, article := range response.KBArticles {
+		if article.URL == "" {
+			continue
+		}
+		actions = append(actions, map[string]interface{}{"type": "Action.OpenUrl", "title": article.Title, "url": article.URL})
+		if len(actions) == teamsMaxCardActions {
+			break
+		}
+	}
+
+	card := map[string]interface{}{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body":    body,
+	}
+	if len(actions) > 0 {
+		card["actions"] = actions
+	}
+	return c.send(ctx, activity, map[string]interface{}{
+		"type":        "message",
+		"text":        response.Message, // shown in notifications and clients without cards
+		"attachments": []map[string]interface{}{{"contentType": "application/vnd.microsoft.card.adaptive", "content": card}},
+	})
+}
+
+// ReplyText answers an activity with plain text
+func (c *TeamsClient) ReplyText(ctx context.Context, activity *TeamsActivity, text string) error {
+	return c.send(ctx, activity, map[string]interface{}{"type": "message", "text": text})
+}
+
+// send posts a reply to an activity through the Bot Connector of the activity's service URL
+func (c *TeamsClient) send(ctx context.Context, activity *TeamsActivity, reply map[string]interface{}) error {
+	reply["from"] = activity.Recipient
+	reply["conversation"] = map[string]string{"id": activity.Conversation.ID}
+	reply["recipient"] = activity.From
+	reply["replyToId"] = activity.ID
+
+	jsonData, err := json.Marshal(reply)
+	if err != nil {
+		return fmt.Errorf("failed to marshal reply: %w", err)
+	}
+
+	token, err := c.token(ctx)
+	if err != nil {
+		teamsRequests.WithLabelValues("reply", "error").Inc()
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/v3/conversations/%s/activities/%s", strings.TrimSuffix(activity.ServiceURL, "/"),
+		url.PathEscape(activity.Conversation.ID), url.PathEscape(activity.ID))
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		teamsRequests.WithLabelValues("reply", "error").Inc()
+		return fmt.Errorf("failed to call bot connector: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		teamsRequests.WithLabelValues("reply", "error").Inc()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("bot connector error (status %d): %s", resp.StatusCode, string(data))
+	}
+
+	teamsRequests.WithLabelValues("reply", "success").Inc()
+	return nil
+}
+
+// token returns an access token for the Bot Connector, exchanging the app's credentials for a
+// new one when there is none or it is about to expire
+func (c *TeamsClient) token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.accessToken != "" && time.Now().Before(c.tokenExpiry) {
+		return c.accessToken, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {c.config.AppID},
+		"client_secret": {c.config.AppPassword},
+		"scope":         {botFrameworkScope},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		teamsRequests.WithLabelValues("token", "error").Inc()
+		return "", fmt.Errorf("failed to request bot token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		teamsRequests.WithLabelValues("token", "error").Inc()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("bot token error (status %d): %s", resp.StatusCode, string(data))
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+	teamsRequests.WithLabelValues("token", "success").Inc()
+
+	// Renew a few minutes early so requests in flight do not carry an expired token
+	c.accessToken = tokenResp.AccessToken
+	c.tokenExpiry = time.Now().Add(time.Duration(tokenResp.ExpiresIn)*time.Second - 5*time.Minute)
+	return c.accessToken, nil
+}
+
+// Authenticate checks the token the Bot Framework sends with an activity: signed with one of its
+// keys endorsed for the activity's channel, issued by the Bot Framework to this bot, unexpired,
+// and for the activity's service URL, so replies are never sent to an address a caller chose
+func (c *TeamsClient) Authenticate(ctx context.Context, authorization string, activity *TeamsActivity) error {
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	parts := strings.Split(token, ".")
+	if token == authorization || len(parts) != 3 {
+		return fmt.Errorf("missing bearer token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return err
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("unexpected token algorithm %q", header.Alg)
+	}
+
+	key, err := c.signingKey(ctx, header.Kid)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid token signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key.key, crypto.SHA256, digest[:], signature); err != nil {
+		return fmt.Errorf("invalid token signature")
+	}
+
+	endorsed := false
+	for _, endorsement := range key.endorsements {
+		if endorsement == activity.ChannelID {
+			endorsed = true
+		}
+	}
+	if !endorsed {
+		return fmt.Errorf("signing key is not endorsed for channel %q", activity.ChannelID)
+	}
+
+	var claims struct {
+		Issuer     string `json:"iss"`
+		Audience   string `json:"aud"`
+		Expires    int64  `json:"exp"`
+		NotBefore  int64  `json:"nbf"`
+		ServiceURL string `json:"serviceurl"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return err
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != botFrameworkIssuer:
+		return fmt.Errorf("unexpected token issuer %q", claims.Issuer)
+	case claims.Audience != c.config.AppID:
+		return fmt.Errorf("token is for another bot")
+	case now.After(time.Unix(claims.Expires, 0).Add(botClockSkew)):
+		return fmt.Errorf("token expired")
+	case claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-botClockSkew)):
+		return fmt.Errorf("token not yet valid")
+	case claims.ServiceURL != activity.ServiceURL:
+		return fmt.Errorf("token is for another service url")
+	}
+	return nil
+}
+
+// signingKey returns a Bot Framework signing key, refreshing the keys daily and when a token is
+// signed with one not seen yet
+func (c *TeamsClient) signingKey(ctx context.Context, kid string) (*botSigningKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if key, ok := c.keys[kid]; ok && time.Since(c.keysFetched) < botKeysTTL {
+		return key, nil
+	}
+	// Do not let a stream of unknown key IDs hammer the key endpoint
+	if c.keys != nil && time.Since(c.keysFetched) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", botFrameworkKeysURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create keys request: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch bot framework keys: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch bot framework keys (status %d)", resp.StatusCode)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty          string   `json:"kty"`
+			Kid          string   `json:"kid"`
+			N            string   `json:"n"`
+			E            string   `json:"e"`
+			Endorsements []string `json:"endorsements"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("failed to decode bot framework keys: %w", err)
+	}
+
+	keys := make(map[string]*botSigningKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[jwk.Kid] = &botSigningKey{
+			key:          &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())},
+			endorsements: jwk.Endorsements,
+		}
+	}
+	c.keys, c.keysFetched = keys, time.Now()
+
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// decodeJWTPart decodes a base64url JSON part of a JWT into v
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("invalid token: %w", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid token: %w", err)
+	}
+	return nil
+}
+
+var teamsMention = regexp.MustCompile(`<at>[^<]*</at>`)
+
+// teamsMessageText returns the text of a Teams message without mentions of the bot
+func teamsMessageText(text string) string {
+	return strings.TrimSpace(teamsMention.ReplaceAllString(text, ""))
+}
+
+// teamsSessionID keys a Teams conversation by the user's Azure AD ID and the conversation, so each
+// user has their own session in a channel thread and in their chat with the bot
+func teamsSessionID(activity *TeamsActivity) string {
+	return "teams-" + teamsUserID(activity) + "-" + sourceID(activity.Conversation.ID)
+}
+
+// teamsUserID returns the user's Azure AD object ID, or their Teams ID if there is none
+func teamsUserID(activity *TeamsActivity) string {
+	if activity.From.AADObjectID != "" {
+		return activity.From.AADObjectID
+	}
+	return activity.From.ID
+}
+
+// handleTeamsWebhook is the bot's messaging endpoint. Messages are queued for the agent; other
+// activities, such as members joining, are acknowledged and ignored.
+func (app *Application) handleTeamsWebhook(c *gin.Context) {
+	if app.Teams == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "teams is not configured"})
+		return
+	}
+
+	var activity TeamsActivity
+	if err := c.ShouldBindJSON(&activity); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid activity"})
+		return
+	}
+	if err := app.Teams.Authenticate(c.Request.Context(), c.GetHeader("Authorization"), &activity); err != nil {
+		log.Printf("Teams: rejected activity: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	if activity.Type != "message" || teamsMessageText(activity.Text) == "" {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	// The Bot Framework retries activities the bot did not acknowledge in time
+	ctx := c.Request.Context()
+	first, err := app.Webhooks.First(ctx, "teams", activity.fingerprint())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !first {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	// Enqueue for async processing
+	if err := app.MessageQueue.Enqueue(ctx, &activity); err != nil {
+		app.Webhooks.Release(ctx, "teams", activity.fingerprint())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+// processTeamsMessage answers a Teams message in its conversation
+func (app *Application) processTeamsMessage(ctx context.Context, activity *TeamsActivity) error {
+	// Convert to chat message
+	req := &ChatMessageRequest{
+		SessionID: teamsSessionID(activity),
+		Message:   teamsMessageText(activity.Text),
+		UserID:    teamsUserID(activity),
+		Channel:   "teams",
+		Metadata: map[string]interface{}{
+			"user_name":         activity.From.Name,
+			"tenant_id":         activity.Conversation.TenantID,
+			"conversation_type": activity.Conversation.ConversationType,
+		},
+		Source: activity,
+	}
+	if err := req.Validate(); err != nil {
+		return app.Teams.ReplyText(ctx, activity, "Sorry, "+err.Error()+".")
+	}
+
+	// Process with agent
+	startTime := time.Now()
+	response, err := app.AgentService.ProcessMessage(ctx, req)
+	messageLatency.WithLabelValues(req.Channel).Observe(time.Since(startTime).Seconds())
+	if errors.Is(err, ErrHandedOff) {
+		// A human agent answers from the console
+		return nil
+	}
+	if err != nil {
+		messagesProcessed.WithLabelValues("error", req.Channel).Inc()
+		if replyErr := app.Teams.ReplyText(ctx, activity, teamsFallbackReply); replyErr != nil {
+			log.Printf("Failed to post fallback reply to Teams: %v", replyErr)
+		}
+		return err
+	}
+	messagesProcessed.WithLabelValues("success", req.Channel).Inc()
+	sentimentDistribution.WithLabelValues(response.Sentiment).Inc()
+
+	// Send response back to Teams
+	if err := app.Teams.Reply(ctx, activity, response); err != nil {
+		return fmt.Errorf("failed to reply in teams: %w", err)
+	}
+	return nil
+}
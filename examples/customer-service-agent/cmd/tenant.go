@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultTenantID is the tenant of requests that no tenant's API key or hostname matches. It
+// keeps the deployment's Redis keys and knowledge base index, so a single-brand deployment's
+// data stays where it is.
+const DefaultTenantID = "default"
+
+var (
+	tenantRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "csr_tenant_requests_total",
+			Help: "API requests by the tenant they were resolved to",
+		},
+		[]string{"tenant"},
+	)
+
+	tokenBudgetRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "csr_token_budget_rejections_total",
+			Help: "Messages refused because a token budget was used, by tenant and budget",
+		},
+		[]string{"tenant", "period"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(tenantRequests)
+	prometheus.MustRegister(tokenBudgetRejections)
+}
+
+var tenantID = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Tenant is a brand served by the deployment, with its own system prompt, knowledge base,
+// channel accounts, token budget, and Redis keys
+type Tenant struct {
+	ID            string           `json:"id"`
+	Name          string           `json:"name,omitempty"`
+	Hostnames     []string         `json:"hostnames,omitempty"`     // hosts the tenant's chat widget and webhooks are served on
+	APIKeys       []string         `json:"api_keys,omitempty"`      // identify the tenant on API calls and authorize its admin calls
+	SystemPrompt  string           `json:"system_prompt,omitempty"` // first version of the tenant's system prompt
+	KBIndex       string           `json:"kb_index,omitempty"`      // Elasticsearch index and Qdrant collection; defaults to kb_<id>
+	KeyPrefix     string           `json:"key_prefix,omitempty"`    // prepended to the tenant's Redis keys; defaults to tenant:<id>:
+	TokenBudget   TokenBudget      `json:"token_budget"`
+	ModelRouting  *ModelRouting    `json:"model_routing,omitempty"`  // replaces the deployment's model routing
+	VIPCustomers  []string         `json:"vip_customers,omitempty"`  // customer IDs whose messages are queued in the high lane
+	BusinessHours *BusinessHours   `json:"business_hours,omitempty"` // replaces the deployment's business hours
+	Guardrails    *GuardrailPolicy `json:"guardrails,omitempty"`     // replaces the deployment's guardrail policy
+
+	// Channel accounts; the deployment's are used for channels a tenant has none for
+	Slack    *TenantSlack    `json:"slack,omitempty"`
+	WhatsApp *TenantWhatsApp `json:"whatsapp,omitempty"`
+	Zendesk  *TenantZendesk  `json:"zendesk,omitempty"`
+	Intercom *TenantIntercom `json:"intercom,omitempty"`
+
+	slack    *SlackClient
+	whatsApp *WhatsAppClient
+	zendesk  *ZendeskClient
+	intercom *IntercomClient
+}
+
+// TokenBudget limits the Claude tokens a tenant's conversations use; zero is unlimited. Messages
+// over a budget are refused with LimitMessage, or answered with DowngradeModel.
+type TokenBudget struct {
+	Daily          int64  `json:"daily"`                     // per UTC day
+	Monthly        int64  `json:"monthly"`                   // per UTC calendar month
+	UserDaily      int64  `json:"user_daily,omitempty"`      // per customer and UTC day
+	UserMonthly    int64  `json:"user_monthly,omitempty"`    // per customer and UTC calendar month
+	Session        int64  `json:"session,omitempty"`         // per conversation
+	OverBudget     string `json:"over_budget,omitempty"`     // refuse (the default) or downgrade
+	DowngradeModel string `json:"downgrade_model,omitempty"` // defaults to Claude 3.5 Haiku
+	LimitMessage   string `json:"limit_message,omitempty"`   // answers refused messages
+}
+
+// TenantSlack is a tenant's Slack app
+type TenantSlack struct {
+	BotToken      string `json:"bot_token"`
+	SigningSecret string `json:"signing_secret"`
+}
+
+// TenantWhatsApp is a tenant's Twilio WhatsApp sender
+type TenantWhatsApp struct {
+	AccountSID  string `json:"account_sid"`
+	AuthToken   string `json:"auth_token"`
+	From        string `json:"from"`
+	WebhookURL  string `json:"webhook_url"`
+	TemplateSID string `json:"template_sid,omitempty"`
+}
+
+// TenantZendesk is a tenant's Zendesk account
+type TenantZendesk struct {
+	Subdomain         string `json:"subdomain"`
+	Email             string `json:"email,omitempty"`
+	APIKey            string `json:"api_key,omitempty"`
+	OAuthClientID     string `json:"oauth_client_id,omitempty"`
+	OAuthClientSecret string `json:"oauth_client_secret,omitempty"`
+	EscalationGroupID int64  `json:"escalation_group_id,omitempty"`
+	EscalationTag     string `json:"escalation_tag,omitempty"`
+}
+
+// TenantIntercom is a tenant's Intercom app
+type TenantIntercom struct {
+	AccessToken  string `json:"access_token"`
+	ClientSecret string `json:"client_secret"`
+	AdminID      string `json:"admin_id"`
+	AssigneeID   string `json:"assignee_id,omitempty"`
+}
+
+// unscopedTenant is the tenant of work not started by a request or a queued message, such as
+// startup; it has the default tenant's keys and index
+var unscopedTenant = &Tenant{ID: DefaultTenantID}
+
+type tenantContextKey struct{}
+
+// withTenant returns a context for work done for a tenant
+func withTenant(ctx context.Context, tenant *Tenant) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// tenantFrom returns the tenant work is done for
+func tenantFrom(ctx context.Context) *Tenant {
+	if tenant, ok := ctx.Value(tenantContextKey{}).(*Tenant); ok && tenant != nil {
+		return tenant
+	}
+	return unscopedTenant
+}
+
+// detachContext returns a background context for the same tenant, for work that outlives a
+// request
+func detachContext(ctx context.Context) context.Context {
+	return withTenant(context.Background(), tenantFrom(ctx))
+}
+
+// tenantKey scopes a Redis key to the tenant work is done for
+func tenantKey(ctx context.Context, key string) string {
+	return tenantFrom(ctx).KeyPrefix + key
+}
+
+// TenantRegistry holds the tenants of the deployment
+type TenantRegistry struct {
+	tenants  map[string]*Tenant
+	byAPIKey map[string]*Tenant
+	byHost   map[string]*Tenant
+}
+
+// LoadTenants reads the tenants from a JSON file holding an array of them. Without a file, or
+// when the file does not configure it, the default tenant has the deployment's settings.
+func LoadTenants(path string) (*TenantRegistry, error) {
+	var tenants []*Tenant
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tenants file: %w", err)
+		}
+		if err := json.Unmarshal(data, &tenants); err != nil {
+			return nil, fmt.Errorf("invalid tenants file: %w", err)
+		}
+	}
+
+	r := &TenantRegistry{
+		tenants:  map[string]*Tenant{},
+		byAPIKey: map[string]*Tenant{},
+		byHost:   map[string]*Tenant{},
+	}
+	for _, tenant := range tenants {
+		if !tenantID.MatchString(tenant.ID) {
+			return nil, fmt.Errorf("tenant id %q must be lowercase letters, digits, hyphens, and underscores", tenant.ID)
+		}
+		if r.tenants[tenant.ID] != nil {
+			return nil, fmt.Errorf("tenant %s is configured twice", tenant.ID)
+		}
+		if tenant.ID == DefaultTenantID {
+			// Existing single-tenant data stays readable
+			tenant.KeyPrefix, tenant.KBIndex = "", ""
+		} else {
+			if tenant.KeyPrefix == "" {
+				tenant.KeyPrefix = "tenant:" + tenant.ID + ":"
+			}
+			if tenant.KBIndex == "" {
+				tenant.KBIndex = "kb_" + tenant.ID
+			}
+		}
+		if tenant.BusinessHours != nil {
+			if err := tenant.BusinessHours.compile(); err != nil {
+				return nil, fmt.Errorf("invalid business hours of tenant %s: %w", tenant.ID, err)
+			}
+		}
+		if tenant.Guardrails != nil {
+			if err := tenant.Guardrails.compile(); err != nil {
+				return nil, fmt.Errorf("invalid guardrails of tenant %s: %w", tenant.ID, err)
+			}
+		}
+		for _, key := range tenant.APIKeys {
+			if r.byAPIKey[key] != nil {
+				return nil, fmt.Errorf("api key of tenant %s is also used by tenant %s", tenant.ID, r.byAPIKey[key].ID)
+			}
+			r.byAPIKey[key] = tenant
+		}
+		for _, host := range tenant.Hostnames {
+			host = strings.ToLower(host)
+			if r.byHost[host] != nil {
+				return nil, fmt.Errorf("hostname %s is used by tenants %s and %s", host, r.byHost[host].ID, tenant.ID)
+			}
+			r.byHost[host] = tenant
+		}
+		r.tenants[tenant.ID] = tenant
+	}
+	if r.tenants[DefaultTenantID] == nil {
+		r.tenants[DefaultTenantID] = &Tenant{ID: DefaultTenantID}
+	}
+	return r, nil
+}
+
+// All returns the tenants, the default tenant first
+func (r *TenantRegistry) All() []*Tenant {
+	tenants := make([]*Tenant, 0, len(r.tenants))
+	for _, tenant := range r.tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Slice(tenants, func(i, j int) bool {
+		if tenants[i].ID == DefaultTenantID || tenants[j].ID == DefaultTenantID {
+			return tenants[i].ID == DefaultTenantID
+		}
+		return tenants[i].ID < tenants[j].ID
+	})
+	return tenants
+}
+
+// Get returns a tenant, falling back to the default tenant for unknown IDs, such as those of
+// tenants removed while their messages were queued
+func (r *TenantRegistry) Get(id string) *Tenant {
+	if tenant := r.tenants[id]; tenant != nil {
+		return tenant
+	}
+	return r.tenants[DefaultTenantID]
+}
+
+// Resolve returns the tenant of a request: the tenant whose API key it carries, or the tenant
+// served on its hostname, or the default tenant
+func (r *TenantRegistry) Resolve(apiKey, host string) *Tenant {
+	if tenant := r.byAPIKey[apiKey]; apiKey != "" && tenant != nil {
+		return tenant
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if tenant := r.byHost[strings.ToLower(host)]; tenant != nil {
+		return tenant
+	}
+	return r.tenants[DefaultTenantID]
+}
+
+// connectChannels creates the clients of the tenants' own channel accounts
+func (r *TenantRegistry) connectChannels(client *redis.Client) error {
+	for _, tenant := range r.tenants {
+		if tenant.Slack != nil {
+			tenant.slack = NewSlackClient(tenant.Slack.BotToken)
+		}
+		if tenant.WhatsApp != nil {
+			whatsapp, err := NewWhatsAppClient(WhatsAppConfig{
+				AccountSID:  tenant.WhatsApp.AccountSID,
+				AuthToken:   tenant.WhatsApp.AuthToken,
+				From:        tenant.WhatsApp.From,
+				WebhookURL:  tenant.WhatsApp.WebhookURL,
+				TemplateSID: tenant.WhatsApp.TemplateSID,
+			}, client)
+			if err != nil {
+				return fmt.Errorf("failed to initialize whatsapp client of tenant %s: %w", tenant.ID, err)
+			}
+			tenant.whatsApp = whatsapp
+		}
+		if tenant.Zendesk != nil {
+			zendesk, err := NewZendeskClient(ZendeskConfig{
+				Subdomain:         tenant.Zendesk.Subdomain,
+				Email:             tenant.Zendesk.Email,
+				APIKey:            tenant.Zendesk.APIKey,
+				OAuthClientID:     tenant.Zendesk.OAuthClientID,
+				OAuthClientSecret: tenant.Zendesk.OAuthClientSecret,
+				EscalationGroupID: tenant.Zendesk.EscalationGroupID,
+				EscalationTag:     tenant.Zendesk.EscalationTag,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to initialize zendesk client of tenant %s: %w", tenant.ID, err)
+			}
+			tenant.zendesk = zendesk
+		}
+		if tenant.Intercom != nil {
+			intercom, err := NewIntercomClient(IntercomConfig{
+				AccessToken:  tenant.Intercom.AccessToken,
+				ClientSecret: tenant.Intercom.ClientSecret,
+				AdminID:      tenant.Intercom.AdminID,
+				AssigneeID:   tenant.Intercom.AssigneeID,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to initialize intercom client of tenant %s: %w", tenant.ID, err)
+			}
+			tenant.intercom = intercom
+		}
+	}
+	return nil
+}
+
+// slackFor returns the Slack client of the tenant work is done for
+func (app *Application) slackFor(ctx context.Context) *SlackClient {
+	if client := tenantFrom(ctx).slack; client != nil {
+		return client
+	}
+	return app.Slack
+}
+
+// whatsAppFor returns the WhatsApp client of the tenant work is done for
+func (app *Application) whatsAppFor(ctx context.Context) *WhatsAppClient {
+	if client := tenantFrom(ctx).whatsApp; client != nil {
+		return client
+	}
+	return app.WhatsApp
+}
+
+// zendeskFor returns the Zendesk client of the tenant work is done for
+func (app *Application) zendeskFor(ctx context.Context) *ZendeskClient {
+	if client := tenantFrom(ctx).zendesk; client != nil {
+		return client
+	}
+	return app.Zendesk
+}
+
+// intercomFor returns the Intercom client of the tenant work is done for
+func (app *Application) intercomFor(ctx context.Context) *IntercomClient {
+	if client := tenantFrom(ctx).intercom; client != nil {
+		return client
+	}
+	return app.Intercom
+}
+
+// tenantMiddleware resolves the tenant of each request. Callers with the admin API key may act
+// for any tenant by naming it in X-Tenant-ID.
+func tenantMiddleware(tenants *TenantRegistry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiKey := c.GetHeader("X-API-Key")
+		tenant := tenants.Resolve(apiKey, c.Request.Host)
+		if id := c.GetHeader("X-Tenant-ID"); id != "" && apiKey != "" && apiKey == os.Getenv("API_KEY") {
+			if tenant = tenants.tenants[id]; tenant == nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "unknown tenant " + id})
+				c.Abort()
+				return
+			}
+		}
+
+		tenantRequests.WithLabelValues(tenant.ID).Inc()
+		c.Request = c.Request.WithContext(withTenant(c.Request.Context(), tenant))
+		c.Next()
+	}
+}
+
+// tenantAPIKey reports whether a request carries an API key of its tenant
+func tenantAPIKey(c *gin.Context) bool {
+	apiKey := c.GetHeader("X-API-Key")
+	if apiKey == "" {
+		return false
+	}
+	for _, key := range tenantFrom(c.Request.Context()).APIKeys {
+		if key == apiKey {
+			return true
+		}
+	}
+	return false
+}
+
+// listTenants returns the tenants the caller may see: all of them for the admin API key, or the
+// caller's own
+func (app *Application) listTenants(c *gin.Context) {
+	type tenantInfo struct {
+		ID          string      `json:"id"`
+		Name        string      `json:"name,omitempty"`
+		Hostnames   []string    `json:"hostnames,omitempty"`
+		KBIndex     string      `json:"kb_index"`
+		KeyPrefix   string      `json:"key_prefix"`
+		TokenBudget TokenBudget `json:"token_budget"`
+		Channels    []string    `json:"channels,omitempty"` // channels with the tenant's own accounts
+		TokensToday int64       `json:"tokens_today"`
+		TokensMonth int64       `json:"tokens_month"`
+	}
+
+	tenants := app.Tenants.All()
+	if tenantAPIKey(c) {
+		tenants = []*Tenant{tenantFrom(c.Request.Context())}
+	}
+
+	infos := make([]tenantInfo, 0, len(tenants))
+	for _, tenant := range tenants {
+		ctx := withTenant(c.Request.Context(), tenant)
+		info := tenantInfo{
+			ID:          tenant.ID,
+			Name:        tenant.Name,
+			Hostnames:   tenant.Hostnames,
+			KBIndex:     app.KnowledgeBase.index(ctx),
+			KeyPrefix:   tenant.KeyPrefix,
+			TokenBudget: tenant.TokenBudget,
+		}
+		for name, configured := range map[string]bool{
+			"slack": tenant.slack != nil, "whatsapp": tenant.whatsApp != nil,
+			"zendesk": tenant.zendesk != nil, "intercom": tenant.intercom != nil,
+		} {
+			if configured {
+				info.Channels = append(info.Channels, name)
+			}
+		}
+		sort.Strings(info.Channels)
+
+		day, month := tokenUsageKeys(ctx, time.Now())
+		info.TokensToday, _ = app.SessionManager.client.Get(ctx, day).Int64()
+		info.TokensMonth, _ = app.SessionManager.client.Get(ctx, month).Int64()
+		infos = append(infos, info)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tenants": infos})
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Token usage storage
+const (
+	usageRetention     = 400 * 24 * time.Hour // daily totals, for cost reports
+	userUsageRetention = 90 * 24 * time.Hour  // each user's daily usage
+	costReportTopUsers = 20
+)
+
+// Over-budget actions
+const (
+	OverBudgetRefuse    = "refuse"
+	OverBudgetDowngrade = "downgrade"
+)
+
+// defaultDowngradeModel answers over-budget messages of tenants that downgrade without naming a model
+const defaultDowngradeModel = "claude-3-5-haiku-20241022"
+
+// defaultLimitMessage answers over-budget messages of tenants that refuse them without their own message
+const defaultLimitMessage = "Sorry, we've reached the limit of messages our assistant can answer for now. Please try again later, or ask for a person and a member of the team will follow up."
+
+// ModelPrice is what Claude charges for a model, in USD per million tokens
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// claudeModelPrices are the list prices of models the agent may switch to. The configured model
+// is priced at CLAUDE_INPUT_COST_PER_MTOK and CLAUDE_OUTPUT_COST_PER_MTOK.
+var claudeModelPrices = map[string]ModelPrice{
+	"claude-3-5-sonnet-20241022": {Input: 3, Output: 15},
+	"claude-3-5-haiku-20241022":  {Input: 0.8, Output: 4},
+	"claude-3-haiku-20240307":    {Input: 0.25, Output: 1.25},
+}
+
+var (
+	tokenBudgetDowngrades = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "csr_token_budget_downgrades_total",
+			Help: "Messages answered with a cheaper model because a token budget was used, by tenant and budget",
+		},
+		[]string{"tenant", "period"},
+	)
+
+	claudeCost = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "csr_claude_cost_usd_total",
+			Help: "USD spent on Claude tokens, by tenant and model",
+		},
+		[]string{"tenant", "model"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(tokenBudgetDowngrades)
+	prometheus.MustRegister(claudeCost)
+}
+
+// price returns what a model costs, the configured model's price for models without a list price
+func (s *AgentService) price(model string) ModelPrice {
+	if price, ok := claudeModelPrices[model]; ok && model != s.config.Model {
+		return price
+	}
+	return ModelPrice{Input: s.config.InputCostPerMTok, Output: s.config.OutputCostPerMTok}
+}
+
+// cost returns the USD cost of tokens of a model
+func (s *AgentService) cost(model string, inputTokens, outputTokens int) float64 {
+	price := s.price(model)
+	return (float64(inputTokens)*price.Input + float64(outputTokens)*price.Output) / 1e6
+}
+
+// tokenUsageKeys returns the keys counting the tenant's tokens today and this month
+func tokenUsageKeys(ctx context.Context, now time.Time) (day, month string) {
+	now = now.UTC()
+	return tenantKey(ctx, "tokens:day:"+now.Format("2006-01-02")), tenantKey(ctx, "tokens:month:"+now.Format("2006-01"))
+}
+
+// usageKeys returns the keys of the tenant's token and cost totals of a day, and of its users'
+// tokens that day and month and costs that day
+func usageKeys(ctx context.Context, now time.Time) (day, userDay, userMonth, userCosts string) {
+	now = now.UTC()
+	date, month := now.Format("2006-01-02"), now.Format("2006-01")
+	return tenantKey(ctx, "usage:day:"+date), tenantKey(ctx, "usage:day:"+date+":users"),
+		tenantKey(ctx, "usage:month:"+month+":users"), tenantKey(ctx, "usage:day:"+date+":user_costs")
+}
+
+// checkTokenBudget returns the budget a message is over: the tenant's daily or monthly budget,
+// its user's, or its session's. It returns "" while the message is within every budget.
+func (s *AgentService) checkTokenBudget(ctx context.Context, sessionID, userID string) (string, error) {
+	budget := tenantFrom(ctx).TokenBudget
+	now := time.Now()
+	client := s.sessionManager.client
+
+	if budget.Daily > 0 || budget.Monthly > 0 {
+		day, month := tokenUsageKeys(ctx, now)
+		used, err := client.MGet(ctx, day, month).Result()
+		if err != nil {
+			return "", fmt.Errorf("failed to check token budget: %w", err)
+		}
+		tokens := func(value interface{}) int64 {
+			text, _ := value.(string)
+			n, _ := strconv.ParseInt(text, 10, 64)
+			return n
+		}
+		if budget.Daily > 0 && tokens(used[0]) >= budget.Daily {
+			return "daily", nil
+		}
+		if budget.Monthly > 0 && tokens(used[1]) >= budget.Monthly {
+			return "monthly", nil
+		}
+	}
+
+	if userID != "" && (budget.UserDaily > 0 || budget.UserMonthly > 0) {
+		_, userDay, userMonth, _ := usageKeys(ctx, now)
+		pipe := client.Pipeline()
+		daily := pipe.ZScore(ctx, userDay, userID)
+		monthly := pipe.ZScore(ctx, userMonth, userID)
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return "", fmt.Errorf("failed to check token budget: %w", err)
+		}
+		if budget.UserDaily > 0 && int64(daily.Val()) >= budget.UserDaily {
+			return "user_daily", nil
+		}
+		if budget.UserMonthly > 0 && int64(monthly.Val()) >= budget.UserMonthly {
+			return "user_monthly", nil
+		}
+	}
+
+	if budget.Session > 0 {
+		usage, _, err := s.analytics.Usage(ctx, sessionID)
+		if err != nil {
+			return "", fmt.Errorf("failed to check token budget: %w", err)
+		}
+		if int64(usage.TotalTokens) >= budget.Session {
+			return "session", nil
+		}
+	}
+	return "", nil
+}
+
+// overBudgetModel returns the model to answer a message over a budget with, or "" when the tenant
+// refuses such messages
+func overBudgetModel(ctx context.Context, period string) string {
+	tenant := tenantFrom(ctx)
+	if tenant.TokenBudget.OverBudget != OverBudgetDowngrade {
+		tokenBudgetRejections.WithLabelValues(tenant.ID, period).Inc()
+		return ""
+	}
+	tokenBudgetDowngrades.WithLabelValues(tenant.ID, period).Inc()
+	if tenant.TokenBudget.DowngradeModel != "" {
+		return tenant.TokenBudget.DowngradeModel
+	}
+	return defaultDowngradeModel
+}
+
+// recordTokenUsage counts tokens of a model against the tenant's and the user's budgets, and adds
+// them and their cost to the tenant's daily totals. downgraded marks messages answered with a
+// cheaper model because a budget was used.
+func (s *AgentService) recordTokenUsage(ctx context.Context, userID, model string, inputTokens, outputTokens int, downgraded bool) {
+	now := time.Now()
+	tokens := int64(inputTokens + outputTokens)
+	cost := s.cost(model, inputTokens, outputTokens)
+	day, month := tokenUsageKeys(ctx, now)
+	usageDay, userDay, userMonth, userCosts := usageKeys(ctx, now)
+
+	pipe := s.sessionManager.client.TxPipeline()
+	pipe.IncrBy(ctx, day, tokens)
+	pipe.Expire(ctx, day, 48*time.Hour)
+	pipe.IncrBy(ctx, month, tokens)
+	pipe.Expire(ctx, month, 32*24*time.Hour)
+	pipe.HIncrBy(ctx, usageDay, "input_tokens", int64(inputTokens))
+	pipe.HIncrBy(ctx, usageDay, "output_tokens", int64(outputTokens))
+	pipe.HIncrByFloat(ctx, usageDay, "cost_usd", cost)
+	if downgraded {
+		pipe.HIncrBy(ctx, usageDay, "downgraded_messages", 1)
+	}
+	pipe.Expire(ctx, usageDay, usageRetention)
+	if userID != "" {
+		pipe.ZIncrBy(ctx, userDay, float64(tokens), userID)
+		pipe.Expire(ctx, userDay, userUsageRetention)
+		pipe.ZIncrBy(ctx, userMonth, float64(tokens), userID)
+		pipe.Expire(ctx, userMonth, 32*24*time.Hour)
+		pipe.ZIncrBy(ctx, userCosts, cost, userID)
+		pipe.Expire(ctx, userCosts, userUsageRetention)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record token usage of tenant %s: %v", tenantFrom(ctx).ID, err)
+	}
+	claudeCost.WithLabelValues(tenantFrom(ctx).ID, model).Add(cost)
+}
+
+// DailyUsage is a customer's tokens and cost on a day
+type DailyUsage struct {
+	Date    string  `json:"date"`
+	Tokens  int64   `json:"tokens"`
+	CostUSD float64 `json:"cost_usd"`
+}
+
+// userUsage returns a customer's usage on each day it is kept for, oldest first, skipping days
+// without any
+func (s *AgentService) userUsage(ctx context.Context, userID string) ([]DailyUsage, error) {
+	days := int(userUsageRetention / (24 * time.Hour))
+	now := time.Now()
+	pipe := s.sessionManager.client.Pipeline()
+	tokens := make([]*redis.FloatCmd, days)
+	costs := make([]*redis.FloatCmd, days)
+	for i := range tokens {
+		_, userDay, _, userCosts := usageKeys(ctx, now.AddDate(0, 0, i-days+1))
+		tokens[i] = pipe.ZScore(ctx, userDay, userID)
+		costs[i] = pipe.ZScore(ctx, userCosts, userID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get usage of user: %w", err)
+	}
+
+	usage := []DailyUsage{}
+	for i := range tokens {
+		if tokens[i].Err() == redis.Nil && costs[i].Err() == redis.Nil {
+			continue
+		}
+		usage = append(usage, DailyUsage{
+			Date:    now.AddDate(0, 0, i-days+1).UTC().Format("2006-01-02"),
+			Tokens:  int64(tokens[i].Val()),
+			CostUSD: roundTo(costs[i].Val(), 4),
+		})
+	}
+	return usage, nil
+}
+
+// forgetUserUsage removes a customer from the tenant's daily and monthly usage by user. The
+// tenant's totals keep what the customer used.
+func (s *AgentService) forgetUserUsage(ctx context.Context, userID string) error {
+	days := int(userUsageRetention / (24 * time.Hour))
+	now := time.Now()
+	pipe := s.sessionManager.client.TxPipeline()
+	for i := 0; i < days; i++ {
+		_, userDay, userMonth, userCosts := usageKeys(ctx, now.AddDate(0, 0, -i))
+		pipe.ZRem(ctx, userDay, userID)
+		pipe.ZRem(ctx, userCosts, userID)
+		pipe.ZRem(ctx, userMonth, userID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to delete usage of user: %w", err)
+	}
+	return nil
+}
+
+// recordRefusal counts a message refused because a budget was used in the tenant's daily totals
+func (s *AgentService) recordRefusal(ctx context.Context) {
+	usageDay, _, _, _ := usageKeys(ctx, time.Now())
+	pipe := s.sessionManager.client.TxPipeline()
+	pipe.HIncrBy(ctx, usageDay, "refused_messages", 1)
+	pipe.Expire(ctx, usageDay, usageRetention)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record refused message of tenant %s: %v", tenantFrom(ctx).ID, err)
+	}
+}
+
+// limitAnswer answers a message over a budget of a tenant that refuses such messages. The message
+// and the answer are kept in the session for human agents.
+func (s *AgentService) limitAnswer(ctx context.Context, req *ChatMessageRequest, period string) (*ChatMessageResponse, error) {
+	message := tenantFrom(ctx).TokenBudget.LimitMessage
+	if message == "" {
+		message = defaultLimitMessage
+	}
+	if err := s.sessionManager.AddMessage(ctx, req.SessionID, "user", req.Message); err != nil {
+		return nil, err
+	}
+	if err := s.sessionManager.AddAnswer(ctx, req.SessionID, message, 0, ""); err != nil {
+		return nil, err
+	}
+	s.analytics.RecordMessage(ctx, req.SessionID)
+	s.recordRefusal(ctx)
+
+	return &ChatMessageResponse{
+		SessionID: req.SessionID,
+		Message:   message,
+		Sentiment: s.analyzeSentiment(req.Message),
+		Metadata:  map[string]interface{}{"budget_exceeded": period},
+	}, nil
+}
+
+// DailyCost is a tenant's Claude usage on one UTC day
+type DailyCost struct {
+	Date               string  `json:"date,omitempty"`
+	InputTokens        int64   `json:"input_tokens"`
+	OutputTokens       int64   `json:"output_tokens"`
+	CostUSD            float64 `json:"cost_usd"`
+	DowngradedMessages int64   `json:"downgraded_messages"`
+	RefusedMessages    int64   `json:"refused_messages"`
+}
+
+// UserCost is a user's Claude usage over a report's days
+type UserCost struct {
+	UserID  string  `json:"user_id"`
+	Tokens  int64   `json:"tokens"`
+	CostUSD float64 `json:"cost_usd"`
+}
+
+// CostReport is a tenant's Claude usage over the UTC days of a time range
+type CostReport struct {
+	From     string      `json:"from"`
+	To       string      `json:"to"`
+	Total    DailyCost   `json:"total"`
+	Days     []DailyCost `json:"days"`
+	TopUsers []UserCost  `json:"top_users"`
+}
+
+// CostReport adds up the tenant's Claude usage on the UTC days from and to fall on, and those
+// between. Days older than the usage retention are left out.
+func (s *AgentService) CostReport(ctx context.Context, from, to time.Time) (*CostReport, error) {
+	from, to = from.UTC(), to.UTC()
+	if oldest := to.Add(-usageRetention); from.Before(oldest) {
+		from = oldest
+	}
+	report := &CostReport{From: from.Format("2006-01-02"), To: to.Format("2006-01-02"), Days: []DailyCost{}}
+
+	pipe := s.sessionManager.client.Pipeline()
+	var totals []*redis.StringStringMapCmd
+	var tokens, costs []*redis.ZSliceCmd
+	for day := from; day.Format("2006-01-02") <= report.To; day = day.AddDate(0, 0, 1) {
+		usageDay, userDay, _, userCosts := usageKeys(ctx, day)
+		totals = append(totals, pipe.HGetAll(ctx, usageDay))
+		tokens = append(tokens, pipe.ZRangeWithScores(ctx, userDay, 0, -1))
+		costs = append(costs, pipe.ZRangeWithScores(ctx, userCosts, 0, -1))
+		report.Days = append(report.Days, DailyCost{Date: day.Format("2006-01-02")})
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to read token usage: %w", err)
+	}
+
+	users := map[string]*UserCost{}
+	user := func(id string) *UserCost {
+		if users[id] == nil {
+			users[id] = &UserCost{UserID: id}
+		}
+		return users[id]
+	}
+	for i := range report.Days {
+		day := &report.Days[i]
+		fields := totals[i].Val()
+		day.InputTokens, _ = strconv.ParseInt(fields["input_tokens"], 10, 64)
+		day.OutputTokens, _ = strconv.ParseInt(fields["output_tokens"], 10, 64)
+		day.CostUSD, _ = strconv.ParseFloat(fields["cost_usd"], 64)
+		day.CostUSD = roundTo(day.CostUSD, 4)
+		day.DowngradedMessages, _ = strconv.ParseInt(fields["downgraded_messages"], 10, 64)
+		day.RefusedMessages, _ = strconv.ParseInt(fields["refused_messages"], 10, 64)
+
+		report.Total.InputTokens += day.InputTokens
+		report.Total.OutputTokens += day.OutputTokens
+		report.Total.CostUSD += day.CostUSD
+		report.Total.DowngradedMessages += day.DowngradedMessages
+		report.Total.RefusedMessages += day.RefusedMessages
+
+		for _, z := range tokens[i].Val() {
+			user(z.Member.(string)).Tokens += int64(z.Score)
+		}
+		for _, z := range costs[i].Val() {
+			user(z.Member.(string)).CostUSD += z.Score
+		}
+	}
+	report.Total.CostUSD = roundTo(report.Total.CostUSD, 4)
+
+	report.TopUsers = make([]UserCost, 0, len(users))
+	for _, u := range users {
+		u.CostUSD = roundTo(u.CostUSD, 4)
+		report.TopUsers = append(report.TopUsers, *u)
+	}
+	sort.Slice(report.TopUsers, func(i, j int) bool {
+		if report.TopUsers[i].CostUSD != report.TopUsers[j].CostUSD {
+			return report.TopUsers[i].CostUSD > report.TopUsers[j].CostUSD
+		}
+		return report.TopUsers[i].UserID < report.TopUsers[j].UserID
+	})
+	if len(report.TopUsers) > costReportTopUsers {
+		report.TopUsers = report.TopUsers[:costReportTopUsers]
+	}
+	return report, nil
+}
+
+// getCostReport reports the tenant's Claude usage and cost by day, with the users who cost most
+func (app *Application) getCostReport(c *gin.Context) {
+	from, to, err := analyticsRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	report, err := app.AgentService.CostReport(c.Request.Context(), from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// getUserCost returns a user's tokens today and this month, against the tenant's user budgets
+func (app *Application) getUserCost(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := c.Param("user_id")
+	now := time.Now()
+	_, userDay, userMonth, userCosts := usageKeys(ctx, now)
+
+	pipe := app.SessionManager.client.Pipeline()
+	daily := pipe.ZScore(ctx, userDay, userID)
+	monthly := pipe.ZScore(ctx, userMonth, userID)
+	cost := pipe.ZScore(ctx, userCosts, userID)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	budget := tenantFrom(ctx).TokenBudget
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":        userID,
+		"tokens_today":   int64(daily.Val()),
+		"tokens_month":   int64(monthly.Val()),
+		"cost_usd_today": roundTo(cost.Val(), 4),
+		"budget": gin.H{
+			"daily":   budget.UserDaily,
+			"monthly": budget.UserMonthly,
+		},
+	})
+}
+
+// getSessionCost returns a conversation's tokens and cost, against the tenant's session budget
+func (app *Application) getSessionCost(c *gin.Context) {
+	sessionID := c.Param("session_id")
+	usage, cost, err := app.AgentService.analytics.Usage(c.Request.Context(), sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session_id":  sessionID,
+		"tokens_used": usage,
+		"cost_usd":    roundTo(cost, 4),
+		"budget":      tenantFrom(c.Request.Context()).TokenBudget.Session,
+	})
+}
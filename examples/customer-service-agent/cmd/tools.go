@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// toolTimeout bounds a single tool execution
+const toolTimeout = 15 * time.Second
+
+var toolCalls = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_tool_calls_total",
+		Help: "Tools run for Claude, by tool and status",
+	},
+	[]string{"tool", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(toolCalls)
+}
+
+// ToolHandler runs a tool and returns a result that is sent to Claude as JSON
+type ToolHandler func(ctx context.Context, call *ToolCall) (interface{}, error)
+
+// Tool is a function Claude may call while answering
+type Tool struct {
+	Name        string
+	Description string
+	InputSchema map[string]interface{} // JSON schema of the input object
+	Handler     ToolHandler
+}
+
+// ToolCall is one tool_use request from Claude, with the conversation it was made in
+type ToolCall struct {
+	ID      string
+	Name    string
+	Input   json.RawMessage
+	Request *ChatMessageRequest
+	turn    *chatTurn
+}
+
+// Decode unmarshals the tool input into v
+func (c *ToolCall) Decode(v interface{}) error {
+	if err := json.Unmarshal(c.Input, v); err != nil {
+		return fmt.Errorf("invalid input for %s: %w", c.Name, err)
+	}
+	return nil
+}
+
+// ToolCallRecord describes a tool run during a turn
+type ToolCallRecord struct {
+	Name    string          `json:"name"`
+	Input   json.RawMessage `json:"input"`
+	IsError bool            `json:"is_error,omitempty"`
+}
+
+// ClaudeTool is a tool definition in Claude's format
+type ClaudeTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"input_schema"`
+}
+
+// ToolRegistry holds the tools offered to Claude
+type ToolRegistry struct {
+	mu    sync.RWMutex
+	tools map[string]*Tool
+	order []string
+}
+
+// NewToolRegistry creates an empty tool registry
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{
+		tools: make(map[string]*Tool),
+	}
+}
+
+// Register adds a tool, replacing any tool of the same name
+func (r *ToolRegistry) Register(tool *Tool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.tools[tool.Name]; !exists {
+		r.order = append(r.order, tool.Name)
+	}
+	r.tools[tool.Name] = tool
+}
+
+// Has reports whether a tool is registered
+func (r *ToolRegistry) Has(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.tools[name]
+	return ok
+}
+
+// Definitions returns the definitions of the tools allowed, sent with each Claude request. A
+// nil allowed offers every tool.
+func (r *ToolRegistry) Definitions(allowed func(name string) bool) []ClaudeTool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	definitions := make([]ClaudeTool, 0, len(r.order))
+	for _, name := range r.order {
+		if allowed != nil && !allowed(name) {
+			continue
+		}
+		tool := r.tools[name]
+		definitions = append(definitions, ClaudeTool{
+			Name:        tool.Name,
+			Description: tool.Description,
+			InputSchema: tool.InputSchema,
+		})
+	}
+	return definitions
+}
+
+// Execute runs a tool call and returns its tool_result block. Failures are reported to Claude
+// as error results so it can recover, for example by asking the customer for a correct order ID.
+func (r *ToolRegistry) Execute(ctx context.Context, call *ToolCall) ClaudeContent {
+	r.mu.RLock()
+	tool, ok := r.tools[call.Name]
+	r.mu.RUnlock()
+
+	result := ClaudeContent{Type: "tool_result", ToolUseID: call.ID}
+	if !ok {
+		toolCalls.WithLabelValues("unknown", "error").Inc()
+		result.Content, result.IsError = fmt.Sprintf("unknown tool %q", call.Name), true
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, toolTimeout)
+	defer cancel()
+
+	output, err := tool.Handler(ctx, call)
+	if err == nil {
+		var data []byte
+		if data, err = json.Marshal(output); err == nil {
+			result.Content = string(data)
+		}
+	}
+	if err != nil {
+		log.Printf("Tool %s failed for session %s: %v", call.Name, call.Request.SessionID, err)
+		toolCalls.WithLabelValues(call.Name, "error").Inc()
+		result.Content, result.IsError = err.Error(), true
+		return result
+	}
+
+	toolCalls.WithLabelValues(call.Name, "success").Inc()
+	return result
+}
+
+// builtinTools returns the tools every agent has
+func (s *AgentService) builtinTools() []*Tool {
+	return []*Tool{
+		{
+			Name:        "search_knowledge_base",
+			Description: "Search the help center for articles relevant to a query. Use it when the articles provided with the customer's message do not answer the question.",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"query": map[string]interface{}{"type": "string", "description": "What to search for"},
+				},
+				"required": []string{"query"},
+			},
+			Handler: func(ctx context.Context, call *ToolCall) (interface{}, error) {
+				var input struct {
+					Query string `json:"query"`
+				}
+				if err := call.Decode(&input); err != nil {
+					return nil, err
+				}
+				articles, err := s.searchKnowledgeBase(ctx, input.Query, call.turn.intent.categories())
+				if err != nil {
+					return nil, err
+				}
+				call.turn.kbArticles = appendArticles(call.turn.kbArticles, articles)
+				return articles, nil
+			},
+		},
+		{
+			Name:        "escalate_to_human",
+			Description: "Hand the conversation to a human agent. Use it when the customer asks for a person, or the issue needs judgement or permissions you do not have.",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"reason":   map[string]interface{}{"type": "string", "description": "Why a human is needed, for the agent who picks it up"},
+					"priority": map[string]interface{}{"type": "string", "enum": []string{"low", "normal", "high", "urgent"}},
+				},
+				"required": []string{"reason", "priority"},
+			},
+			Handler: func(ctx context.Context, call *ToolCall) (interface{}, error) {
+				var input struct {
+					Reason   string `json:"reason"`
+					Priority string `json:"priority"`
+				}
+				if err := call.Decode(&input); err != nil {
+					return nil, err
+				}
+				call.turn.escalation = &escalationRequest{Reason: input.Reason, Priority: input.Priority}
+				if availability := call.turn.availability; availability != nil && !availability.open {
+					return map[string]string{
+						"status":   "queued",
+						"opens_at": formatOpensAt(availability.opensAt),
+						"message":  "Human agents are offline. The conversation is queued for them, and they will take it over when they are back.",
+					}, nil
+				}
+				return map[string]string{"status": "escalated", "message": "A human agent will take over this conversation."}, nil
+			},
+		},
+		s.callbackTool(),
+	}
+}
+
+// allowsTool reports whether Claude may use a tool in a turn: the turn's intent allows it, and
+// it suits whether human agents are working
+func (t *chatTurn) allowsTool(name string) bool {
+	return t.intent.allowsTool(name) && t.availability.allowsTool(name)
+}
+
+// escalationRequest is an escalation Claude asked for through escalate_to_human
+type escalationRequest struct {
+	Reason   string
+	Priority string
+}
+
+// appendArticles adds articles not already in the list
+func appendArticles(articles []KBArticle, more []KBArticle) []KBArticle {
+	seen := make(map[string]bool, len(articles))
+	for _, article := range articles {
+		seen[article.ID] = true
+	}
+	for _, article := range more {
+		if !seen[article.ID] {
+			seen[article.ID] = true
+			articles = append(articles, article)
+		}
+	}
+	return articles
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Transcript export settings
+const (
+	exportDefaultPage = 1000
+	exportMaxPage     = 10000
+	exportFlushEvery  = 100 // conversations written between flushes
+)
+
+// exportCSVHeader is the header of CSV exports, which have a row per message
+var exportCSVHeader = []string{
+	"session_id", "user_id", "channel", "intent", "language", "sentiment", "resolution",
+	"escalated", "human_handled", "tags", "started_at", "message_index", "role", "timestamp",
+	"model", "prompt_version", "content",
+}
+
+var conversationsExported = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_conversations_exported_total",
+		Help: "Archived conversations exported, by format",
+	},
+	[]string{"format"},
+)
+
+func init() {
+	prometheus.MustRegister(conversationsExported)
+}
+
+// ExportCursor is where a page of exported conversations ends: conversations are exported in
+// the order they started, with ties broken by session ID
+type ExportCursor struct {
+	StartedAt time.Time
+	SessionID string
+}
+
+// String encodes the cursor for the next page's request
+func (c ExportCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.StartedAt.UTC().Format(time.RFC3339Nano) + "|" + c.SessionID))
+}
+
+// parseExportCursor decodes a cursor from a page's response
+func parseExportCursor(value string) (*ExportCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	startedAt, sessionID, ok := strings.Cut(string(data), "|")
+	if !ok {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, startedAt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &ExportCursor{StartedAt: t, SessionID: sessionID}, nil
+}
+
+// ExportPage finds the page of the tenant's archived conversations that match the filter after
+// the cursor, up to count conversations. It returns the cursor of the page's last conversation,
+// nil for an empty page, and whether more conversations follow the page.
+func (a *ConversationArchive) ExportPage(ctx context.Context, filter ArchiveFilter, after *ExportCursor, count int) (*ExportCursor, bool, error) {
+	conditions, args := exportConditions(ctx, filter, after, nil)
+	args = append(args, count+1)
+
+	// The last two of the page and the one after it, with how many there are
+	rows, err := a.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT started_at, session_id, count(*) OVER ()
+		FROM (
+			SELECT started_at, session_id
+			FROM conversations
+			WHERE %s
+			ORDER BY started_at, session_id
+			LIMIT $%d
+		) page
+		ORDER BY started_at DESC, session_id DESC
+		LIMIT 2`, strings.Join(conditions, " AND "), len(args)), args...)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to page conversations: %w", err)
+	}
+	defer rows.Close()
+
+	var cursors []ExportCursor
+	found := 0
+	for rows.Next() {
+		var cursor ExportCursor
+		if err := rows.Scan(&cursor.StartedAt, &cursor.SessionID, &found); err != nil {
+			return nil, false, fmt.Errorf("failed to read conversation: %w", err)
+		}
+		cursors = append(cursors, cursor)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("failed to page conversations: %w", err)
+	}
+	switch {
+	case found == 0:
+		return nil, false, nil
+	case found > count:
+		return &cursors[1], true, nil
+	default:
+		return &cursors[0], false, nil
+	}
+}
+
+// Export calls fn with each of the tenant's archived conversations that match the filter, with
+// their messages, after one cursor and up to another, in the order they started. Rows are read
+// as they are exported, so pages of any size are exported without holding them in memory.
+func (a *ConversationArchive) Export(ctx context.Context, filter ArchiveFilter, after, until *ExportCursor, fn func(*ArchivedConversation) error) error {
+	conditions, args := exportConditions(ctx, filter, after, until)
+	rows, err := a.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT session_id, user_id, channel, intent, language, sentiment, resolution, resolved,
+			escalated, human_handled, started_at, last_activity, ended_at, message_count,
+			input_tokens, output_tokens, cost_usd, models, prompt_versions, summary, tags,
+			archived_at, messages
+		FROM conversations
+		WHERE %s
+		ORDER BY started_at, session_id`, strings.Join(conditions, " AND ")), args...)
+	if err != nil {
+		return fmt.Errorf("failed to export conversations: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var conversation ArchivedConversation
+		var endedAt sql.NullTime
+		var messages []byte
+		if err := rows.Scan(&conversation.SessionID, &conversation.UserID, &conversation.Channel,
+			&conversation.Intent, &conversation.Language, &conversation.Sentiment,
+			&conversation.Resolution, &conversation.Resolved, &conversation.Escalated,
+			&conversation.HumanHandled, &conversation.StartedAt, &conversation.LastActivity, &endedAt,
+			&conversation.MessageCount, &conversation.InputTokens, &conversation.OutputTokens,
+			&conversation.CostUSD, pq.Array(&conversation.Models), pq.Array(&conversation.PromptVersions),
+			&conversation.Summary, pq.Array(&conversation.Tags), &conversation.ArchivedAt,
+			&messages); err != nil {
+			return fmt.Errorf("failed to read conversation: %w", err)
+		}
+		if endedAt.Valid {
+			conversation.EndedAt = &endedAt.Time
+		}
+		if err := json.Unmarshal(messages, &conversation.Messages); err != nil {
+			return fmt.Errorf("failed to unmarshal conversation %s: %w", conversation.SessionID, err)
+		}
+		if err := fn(&conversation); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to export conversations: %w", err)
+	}
+	return nil
+}
+
+// exportConditions adds the bounds of a page to the conditions of a filter
+func exportConditions(ctx context.Context, filter ArchiveFilter, after, until *ExportCursor) ([]string, []interface{}) {
+	conditions, args := filter.conditions(ctx)
+	if after != nil {
+		args = append(args, after.StartedAt, after.SessionID)
+		conditions = append(conditions, fmt.Sprintf("(started_at, session_id) > ($%d, $%d)", len(args)-1, len(args)))
+	}
+	if until != nil {
+		args = append(args, until.StartedAt, until.SessionID)
+		conditions = append(conditions, fmt.Sprintf("(started_at, session_id) <= ($%d, $%d)", len(args)-1, len(args)))
+	}
+	return conditions, args
+}
+
+// exportCSVRows returns the rows of a conversation in CSV exports, one per message
+func exportCSVRows(conversation *ArchivedConversation) [][]string {
+	rows := make([][]string, 0, len(conversation.Messages))
+	for i, msg := range conversation.Messages {
+		promptVersion := ""
+		if msg.PromptVersion > 0 {
+			promptVersion = strconv.Itoa(msg.PromptVersion)
+		}
+		rows = append(rows, []string{
+			conversation.SessionID, conversation.UserID, conversation.Channel, conversation.Intent,
+			conversation.Language, conversation.Sentiment, conversation.Resolution,
+			strconv.FormatBool(conversation.Escalated), strconv.FormatBool(conversation.HumanHandled),
+			strings.Join(conversation.Tags, ";"), conversation.StartedAt.UTC().Format(time.RFC3339),
+			strconv.Itoa(i), msg.Role, msg.Timestamp.UTC().Format(time.RFC3339), msg.Model,
+			promptVersion, msg.Content,
+		})
+	}
+	return rows
+}
+
+// exportConversations streams a page of the tenant's archived conversations as JSON lines or
+// CSV. The cursor of the next page is in the X-Next-Cursor header, and X-Has-More tells whether
+// it has conversations yet.
+func (app *Application) exportConversations(c *gin.Context) {
+	if app.Archive == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "the conversation archive is not configured"})
+		return
+	}
+
+	filter, ok := archiveFilter(c)
+	if !ok {
+		return
+	}
+	format := c.DefaultQuery("format", "jsonl")
+	if format != "jsonl" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be jsonl or csv"})
+		return
+	}
+	count, err := strconv.Atoi(c.DefaultQuery("count", strconv.Itoa(exportDefaultPage)))
+	if err != nil || count < 1 || count > exportMaxPage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("count must be between 1 and %d", exportMaxPage)})
+		return
+	}
+	var after *ExportCursor
+	if value := c.Query("cursor"); value != "" {
+		if after, err = parseExportCursor(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// The page ends where it ended when it was found, so conversations archived meanwhile move
+	// to the next page instead of being skipped
+	ctx := c.Request.Context()
+	until, more, err := app.Archive.ExportPage(ctx, filter, after, count)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := "conversations." + format
+	if format == "jsonl" {
+		c.Header("Content-Type", "application/x-ndjson")
+	} else {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	// An empty page leaves the cursor where it was, for polling for newly archived conversations
+	if next := until; next != nil || after != nil {
+		if next == nil {
+			next = after
+		}
+		c.Header("X-Next-Cursor", next.String())
+	}
+	c.Header("X-Has-More", strconv.FormatBool(more))
+	c.Status(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Writer)
+	writer := csv.NewWriter(c.Writer)
+	if format == "csv" {
+		writer.Write(exportCSVHeader)
+	}
+	if until == nil {
+		writer.Flush()
+		return
+	}
+	exported := 0
+	err = app.Archive.Export(ctx, filter, after, until, func(conversation *ArchivedConversation) error {
+		if format == "csv" {
+			if err := writer.WriteAll(exportCSVRows(conversation)); err != nil {
+				return err
+			}
+		} else if err := encoder.Encode(conversation); err != nil {
+			return err
+		}
+		exported++
+		conversationsExported.WithLabelValues(format).Inc()
+		if exported%exportFlushEvery == 0 {
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	writer.Flush()
+	if err == nil {
+		err = writer.Error()
+	}
+	if err != nil {
+		// The status is sent; the client sees a page cut short
+		log.Printf("Failed to export conversations of tenant %s after %d: %v", tenantFrom(ctx).ID, exported, err)
+		c.Abort()
+	}
+}
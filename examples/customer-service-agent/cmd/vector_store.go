@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VectorStore keeps knowledge base chunk embeddings in a Qdrant collection
+type VectorStore struct {
+	url        string
+	collection string
+	httpClient *http.Client
+
+	mu    sync.Mutex
+	ready map[string]bool // collections known to exist
+}
+
+// NewVectorStore creates a store for the collection at qdrantURL. The collection is created on
+// first write, sized to the embedder's vectors.
+func NewVectorStore(qdrantURL, collection string) *VectorStore {
+	return &VectorStore{
+		url:        strings.TrimSuffix(qdrantURL, "/"),
+		collection: collection,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		ready: make(map[string]bool),
+	}
+}
+
+// collectionFor returns the collection of the tenant work is done for; tenants with their own
+// knowledge base index have a collection of the same name
+func (vs *VectorStore) collectionFor(ctx context.Context) string {
+	if index := tenantFrom(ctx).KBIndex; index != "" {
+		return index
+	}
+	return vs.collection
+}
+
+// chunkPointID derives a stable Qdrant point ID for a chunk, so re-indexing overwrites it
+func chunkPointID(articleID string, index int) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s#%d", articleID, index)))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// ensureCollection creates the collection for vectors of the given size if it does not exist
+func (vs *VectorStore) ensureCollection(ctx context.Context, size int) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	collection := vs.collectionFor(ctx)
+	if vs.ready[collection] {
+		return nil
+	}
+
+	status, _, err := vs.do(ctx, "GET", "/collections/"+collection, nil)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		body := map[string]interface{}{
+			"vectors": map[string]interface{}{"size": size, "distance": "Cosine"},
+		}
+		status, data, err := vs.do(ctx, "PUT", "/collections/"+collection, body)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("failed to create collection (status %d): %s", status, data)
+		}
+
+		// Index article IDs so chunks of an article can be deleted together
+		body = map[string]interface{}{"field_name": "article_id", "field_schema": "keyword"}
+		if status, data, err := vs.do(ctx, "PUT", "/collections/"+collection+"/index", body); err != nil {
+			return err
+		} else if status != http.StatusOK {
+			return fmt.Errorf("failed to index article_id (status %d): %s", status, data)
+		}
+	} else if status != http.StatusOK {
+		return fmt.Errorf("failed to get collection (status %d)", status)
+	}
+
+	vs.ready[collection] = true
+	return nil
+}
+
+// Upsert stores the chunks with their vectors
+func (vs *VectorStore) Upsert(ctx context.Context, chunks []ArticleChunk, vectors [][]float32) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	if len(vectors) != len(chunks) {
+		return fmt.Errorf("got %d vectors for %d chunks", len(vectors), len(chunks))
+	}
+	if err := vs.ensureCollection(ctx, len(vectors[0])); err != nil {
+		return err
+	}
+
+	points := make([]map[string]interface{}, len(chunks))
+	for i, chunk := range chunks {
+		points[i] = map[string]interface{}{
+			"id":     chunkPointID(chunk.ArticleID, chunk.Index),
+			"vector": vectors[i],
+			"payload": map[string]interface{}{
+				"article_id": chunk.ArticleID,
+				"chunk":      chunk.Index,
+				"title":      chunk.Title,
+				"category":   chunk.Category,
+				"url":        chunk.URL,
+				"text":       chunk.Text,
+			},
+		}
+	}
+
+	status, data, err := vs.do(ctx, "PUT", "/collections/"+vs.collectionFor(ctx)+"/points?wait=true", map[string]interface{}{"points": points})
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("upsert failed (status %d): %s", status, data)
+	}
+	return nil
+}
+
+// Search returns the chunks nearest to the vector, best first, as articles with the chunk as
+// their content. Only the best chunk of each article is kept. With categories, only articles in
+// one of them are searched.
+func (vs *VectorStore) Search(ctx context.Context, vector []float32, limit int, categories []string) ([]KBArticle, error) {
+	body := map[string]interface{}{
+		"vector":       vector,
+		"limit":        limit * 3, // articles often match in several chunks
+		"with_payload": true,
+	}
+	if len(categories) > 0 {
+		body["filter"] = map[string]interface{}{
+			"must": []map[string]interface{}{
+				{"key": "category", "match": map[string]interface{}{"any": categories}},
+			},
+		}
+	}
+	status, data, err := vs.do(ctx, "POST", "/collections/"+vs.collectionFor(ctx)+"/points/search", body)
+	if err != nil {
+		return nil, err
+	}
+	// Nothing is embedded yet
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("vector search failed (status %d): %s", status, data)
+	}
+
+	var searchResp struct {
+		Result []struct {
+			Score   float64 `json:"score"`
+			Payload struct {
+				ArticleID string `json:"article_id"`
+				Title     string `json:"title"`
+				URL       string `json:"url"`
+				Text      string `json:"text"`
+			} `json:"payload"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(data, &searchResp); err != nil {
+		return nil, fmt.Errorf("failed to decode search response: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	articles := make([]KBArticle, 0, limit)
+	for _, hit := range searchResp.Result {
+		if seen[hit.Payload.ArticleID] {
+			continue
+		}
+		seen[hit.Payload.ArticleID] = true
+		articles = append(articles, KBArticle{
+			ID:          hit.Payload.ArticleID,
+			Title:       hit.Payload.Title,
+			Content:     truncateContent(hit.Payload.Text, 500),
+			URL:         hit.Payload.URL,
+			Score:       hit.Score,
+			VectorScore: hit.Score,
+			MatchedBy:   []string{"vector"},
+		})
+		if len(articles) == limit {
+			break
+		}
+	}
+	return articles, nil
+}
+
+// DeleteArticles removes every chunk of the articles
+func (vs *VectorStore) DeleteArticles(ctx context.Context, articleIDs []string) error {
+	if len(articleIDs) == 0 {
+		return nil
+	}
+
+	body := map[string]interface{}{
+		"filter": map[string]interface{}{
+			"must": []interface{}{
+				map[string]interface{}{
+					"key":   "article_id",
+					"match": map[string]interface{}{"any": articleIDs},
+				},
+			},
+		},
+	}
+	status, data, err := vs.do(ctx, "POST", "/collections/"+vs.collectionFor(ctx)+"/points/delete?wait=true", body)
+	if err != nil {
+		return err
+	}
+	// Nothing to delete before the collection's first write
+	if status != http.StatusOK && status != http.StatusNotFound {
+		return fmt.Errorf("delete failed (status %d): %s", status, data)
+	}
+	return nil
+}
+
+// HealthCheck checks if Qdrant is available
+func (vs *VectorStore) HealthCheck() bool {
+	resp, err := vs.httpClient.Get(vs.url + "/readyz")
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK
+}
+
+// do sends a request to Qdrant and returns the status and body
+func (vs *VectorStore) do(ctx context.Context, method, path string, body interface{}) (int, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reader = bytes.NewBuffer(jsonData)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, vs.url+path, reader)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := vs.httpClient.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to call qdrant: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	return resp.StatusCode, data, nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Voice call settings
+const (
+	voiceAnswerTimeout = 12 * time.Second // Twilio gives up on a webhook after 15 seconds
+	voiceMaxSilences   = 2                // prompts without an answer before hanging up
+	voiceMaxSpeechLen  = 3000             // characters of an answer read out
+)
+
+var voiceCalls = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_voice_calls_total",
+		Help: "Voice call events, by event",
+	},
+	[]string{"event"},
+)
+
+func init() {
+	prometheus.MustRegister(voiceCalls)
+}
+
+// VoiceConfig holds how calls are answered and where they are transferred
+type VoiceConfig struct {
+	AuthToken        string // Twilio auth token, used to check webhook signatures
+	PublicURL        string // the API's public base URL, e.g. https://support.example.com
+	Voice            string // Twilio text-to-speech voice, e.g. Polly.Joanna-Neural
+	Language         string // speech recognition and synthesis language, e.g. en-US
+	Greeting         string
+	EscalationDigit  string // key the caller presses for a person
+	EscalationNumber string // number calls are transferred to
+	EscalationQueue  string // Twilio queue calls wait in when there is no EscalationNumber
+}
+
+// VoiceConnector answers phone calls through Twilio Programmable Voice. Twilio transcribes the
+// caller's speech and reads out the agent's answers; the connector answers each webhook with
+// TwiML. Calls are answered synchronously rather than through the message queue, since the
+// caller is on the line waiting.
+type VoiceConnector struct {
+	config VoiceConfig
+}
+
+// NewVoiceConnector creates a connector for calls to the Twilio account the auth token belongs to
+func NewVoiceConnector(config VoiceConfig) (*VoiceConnector, error) {
+	if config.AuthToken == "" {
+		return nil, fmt.Errorf("TWILIO_AUTH_TOKEN is required")
+	}
+	if config.EscalationNumber == "" && config.EscalationQueue == "" {
+		return nil, fmt.Errorf("VOICE_ESCALATION_NUMBER or VOICE_ESCALATION_QUEUE is required")
+	}
+	if config.Language == "" {
+		config.Language = "en-US"
+	}
+	if config.EscalationDigit == "" {
+		config.EscalationDigit = "0"
+	}
+	if config.Greeting == "" {
+		config.Greeting = "Hi, thanks for calling. How can I help you today?"
+	}
+	config.Greeting += fmt.Sprintf(" You can press %s at any time to speak to a person.", config.EscalationDigit)
+
+	return &VoiceConnector{config: config}, nil
+}
+
+// TwiML verbs
+type (
+	twimlResponse struct {
+		XMLName xml.Name `xml:"Response"`
+		Verbs   []interface{}
+	}
+	twimlSay struct {
+		XMLName  xml.Name `xml:"Say"`
+		Voice    string   `xml:"voice,attr,omitempty"`
+		Language string   `xml:"language,attr,omitempty"`
+		Text     string   `xml:",chardata"`
+	}
+	twimlGather struct {
+		XMLName             xml.Name `xml:"Gather"`
+		Input               string   `xml:"input,attr"`
+		Action              string   `xml:"action,attr"`
+		Language            string   `xml:"language,attr,omitempty"`
+		SpeechTimeout       string   `xml:"speechTimeout,attr"`
+		SpeechModel         string   `xml:"speechModel,attr,omitempty"`
+		Timeout             int      `xml:"timeout,attr"`
+		NumDigits           int      `xml:"numDigits,attr"`
+		BargeIn             bool     `xml:"bargeIn,attr"`
+		ActionOnEmptyResult bool     `xml:"actionOnEmptyResult,attr"`
+		Say                 *twimlSay
+	}
+	twimlDial struct {
+		XMLName xml.Name `xml:"Dial"`
+		Number  string   `xml:",chardata"`
+	}
+	twimlEnqueue struct {
+		XMLName xml.Name `xml:"Enqueue"`
+		Queue   string   `xml:",chardata"`
+	}
+	twimlHangup struct {
+		XMLName xml.Name `xml:"Hangup"`
+	}
+)
+
+// say reads text out in the configured voice
+func (v *VoiceConnector) say(text string) *twimlSay {
+	return &twimlSay{Voice: v.config.Voice, Language: v.config.Language, Text: text}
+}
+
+// listen reads text out and waits for the caller's answer, spoken or keyed. The caller can
+// interrupt: speaking or pressing a key stops the text being read. silences counts the prompts
+// in a row the caller has not answered.
+func (v *VoiceConnector) listen(text string, silences int) []interface{} {
+	return []interface{}{&twimlGather{
+		Input:               "speech dtmf",
+		Action:              "/api/v1/webhooks/voice/gather?silences=" + strconv.Itoa(silences),
+		Language:            v.config.Language,
+		SpeechTimeout:       "auto",
+		SpeechModel:         "phone_call",
+		Timeout:             5,
+		NumDigits:           1,
+		BargeIn:             true,
+		ActionOnEmptyResult: true,
+		Say:                 v.say(text),
+	}}
+}
+
+// transfer reads text out and connects the caller to a person
+func (v *VoiceConnector) transfer(text string) []interface{} {
+	voiceCalls.WithLabelValues("transferred").Inc()
+	if v.config.EscalationNumber != "" {
+		return []interface{}{v.say(text), &twimlDial{Number: v.config.EscalationNumber}}
+	}
+	return []interface{}{v.say(text), &twimlEnqueue{Queue: v.config.EscalationQueue}}
+}
+
+// verify checks the Twilio signature of a voice webhook
+func (v *VoiceConnector) verify(c *gin.Context) bool {
+	// Twilio signs the URL it called, query string included
+	webhookURL := ""
+	if v.config.PublicURL != "" {
+		webhookURL = strings.TrimSuffix(v.config.PublicURL, "/") + c.Request.URL.RequestURI()
+	}
+	return verifyTwilioRequest(c, v.config.AuthToken, webhookURL)
+}
+
+// twiml writes TwiML verbs as the webhook response
+func twiml(c *gin.Context, verbs []interface{}) {
+	data, err := xml.Marshal(twimlResponse{Verbs: verbs})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "text/xml", append([]byte(xml.Header), data...))
+}
+
+// handleVoiceCall answers an incoming call with the greeting
+func (app *Application) handleVoiceCall(c *gin.Context) {
+	if app.Voice == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "voice is not configured"})
+		return
+	}
+	if !app.Voice.verify(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid signature"})
+		return
+	}
+
+	voiceCalls.WithLabelValues("answered").Inc()
+	twiml(c, app.Voice.listen(app.Voice.config.Greeting, 0))
+}
+
+// handleVoiceGather answers what the caller said or keyed
+func (app *Application) handleVoiceGather(c *gin.Context) {
+	if app.Voice == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "voice is not configured"})
+		return
+	}
+	if !app.Voice.verify(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid signature"})
+		return
+	}
+	form := c.Request.PostForm
+
+	// The caller asked for a person
+	if form.Get("Digits") == app.Voice.config.EscalationDigit {
+		voiceCalls.WithLabelValues("escalation_key").Inc()
+		twiml(c, app.Voice.transfer("Connecting you to a member of our team. Please hold."))
+		return
+	}
+
+	speech := strings.TrimSpace(form.Get("SpeechResult"))
+	if speech == "" {
+		silences, _ := strconv.Atoi(c.Query("silences"))
+		if silences >= voiceMaxSilences {
+			voiceCalls.WithLabelValues("silent_hangup").Inc()
+			twiml(c, []interface{}{app.Voice.say("I haven't heard anything, so I'll end the call here. Goodbye."), &twimlHangup{}})
+			return
+		}
+		twiml(c, app.Voice.listen("Sorry, I didn't catch that. Could you say it again?", silences+1))
+		return
+	}
+
+	// Convert to chat message
+	req := &ChatMessageRequest{
+		SessionID: "voice-" + form.Get("CallSid"),
+		Message:   speech,
+		UserID:    form.Get("From"),
+		Channel:   "voice",
+		Metadata: map[string]interface{}{
+			"call_sid":          form.Get("CallSid"),
+			"speech_confidence": form.Get("Confidence"),
+		},
+	}
+	if req.UserID == "" {
+		// Calls from withheld numbers
+		req.UserID = req.SessionID
+	}
+	if err := req.Validate(); err != nil {
+		twiml(c, app.Voice.listen("Sorry, that was a bit long for me. Could you say it more briefly?", 0))
+		return
+	}
+
+	// Process with agent
+	ctx, cancel := context.WithTimeout(c.Request.Context(), voiceAnswerTimeout)
+	defer cancel()
+	startTime := time.Now()
+	response, err := app.AgentService.ProcessMessage(ctx, req)
+	messageLatency.WithLabelValues(req.Channel).Observe(time.Since(startTime).Seconds())
+	if errors.Is(err, ErrHandedOff) {
+		twiml(c, app.Voice.transfer("Connecting you to a member of our team. Please hold."))
+		return
+	}
+	if err != nil {
+		log.Printf("Voice: failed to answer call %s: %v", form.Get("CallSid"), err)
+		messagesProcessed.WithLabelValues("error", req.Channel).Inc()
+		twiml(c, app.Voice.transfer("Sorry, I'm having trouble answering right now. Let me connect you to a member of our team."))
+		return
+	}
+	messagesProcessed.WithLabelValues("success", req.Channel).Inc()
+	sentimentDistribution.WithLabelValues(response.Sentiment).Inc()
+
+	// Send response back as speech
+	answer := speechText(response.Message)
+	if response.ShouldEscalate {
+		twiml(c, app.Voice.transfer(answer+" I'm connecting you to a member of our team now."))
+		return
+	}
+	twiml(c, app.Voice.listen(answer, 0))
+}
+
+var (
+	speechCodeBlock = regexp.MustCompile("(?s)```.*?```")
+	speechURL       = regexp.MustCompile(`\(?https?://[^\s)]+\)?`)
+	speechListItem  = regexp.MustCompile(`(?m)^\s*(?:[-*+•]|\d+[.)]|#{1,6})\s+(.+?)[.!?:]?\s*$`)
+	speechMarkup    = regexp.MustCompile("[*_#`~>|]")
+)
+
+// speechText turns the Markdown Claude writes into text that reads well aloud: links keep only
+// their text, headings and list items become sentences, and formatting characters are dropped
+func speechText(text string) string {
+	text = speechCodeBlock.ReplaceAllString(text, "")
+	text = mdInlineLink.ReplaceAllString(text, "$1")
+	text = speechURL.ReplaceAllString(text, "")
+	text = speechListItem.ReplaceAllString(text, "$1.")
+	text = speechMarkup.ReplaceAllString(text, "")
+	text = strings.Join(strings.Fields(text), " ")
+
+	if len(text) > voiceMaxSpeechLen {
+		cut := voiceMaxSpeechLen
+		for !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut]
+		// End on a whole sentence
+		if i := strings.LastIndexAny(text, ".!?"); i > 0 {
+			text = text[:i+1]
+		}
+	}
+	return text
+}
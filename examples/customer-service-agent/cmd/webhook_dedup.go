@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var webhookDeliveries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_webhook_deliveries_total",
+		Help: "Webhook deliveries by source, and whether they were new or a redelivery",
+	},
+	[]string{"source", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(webhookDeliveries)
+}
+
+// WebhookDeduplicator remembers the webhooks that were queued, so deliveries a platform retries
+// are not answered twice
+type WebhookDeduplicator struct {
+	client *redis.Client
+	window time.Duration
+}
+
+// NewWebhookDeduplicator creates a deduplicator that remembers webhooks for window. A window of
+// zero turns deduplication off.
+func NewWebhookDeduplicator(client *redis.Client, window time.Duration) *WebhookDeduplicator {
+	return &WebhookDeduplicator{
+		client: client,
+		window: window,
+	}
+}
+
+// First records a webhook as received and reports whether it is new. Webhooks without a
+// fingerprint cannot be told apart, and are always new.
+func (d *WebhookDeduplicator) First(ctx context.Context, source, fingerprint string) (bool, error) {
+	if fingerprint == "" || d.window <= 0 {
+		webhookDeliveries.WithLabelValues(source, "new").Inc()
+		return true, nil
+	}
+
+	first, err := d.client.SetNX(ctx, d.key(ctx, source, fingerprint), 1, d.window).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to record webhook: %w", err)
+	}
+	if first {
+		webhookDeliveries.WithLabelValues(source, "new").Inc()
+	} else {
+		webhookDeliveries.WithLabelValues(source, "duplicate").Inc()
+	}
+	return first, nil
+}
+
+// Release forgets a webhook, so that its redelivery is handled. It is called when a webhook
+// could not be queued.
+func (d *WebhookDeduplicator) Release(ctx context.Context, source, fingerprint string) {
+	if fingerprint == "" || d.window <= 0 {
+		return
+	}
+	d.client.Del(ctx, d.key(ctx, source, fingerprint))
+}
+
+func (d *WebhookDeduplicator) key(ctx context.Context, source, fingerprint string) string {
+	return tenantKey(ctx, "webhook:seen:"+source+":"+fingerprint)
+}
+
+// fingerprint identifies the comment a webhook is for. The payload has no comment ID, so a hash
+// of the comment stands in for it.
+func (w *ZendeskWebhook) fingerprint() string {
+	if w.TicketID == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(w.Comment))
+	return fmt.Sprintf("%d:%x", w.TicketID, sum[:16])
+}
+
+// fingerprint identifies the message an event is for. Slack sends both a message and an
+// app_mention event, with different event IDs, for a mention, so the message's channel and
+// timestamp are used instead.
+func (w *SlackWebhook) fingerprint() string {
+	if w.Event.TS == "" {
+		return ""
+	}
+	return w.Event.Channel + ":" + w.Event.TS
+}
+
+// fingerprint identifies a WhatsApp message by its Twilio SID
+func (m *WhatsAppMessage) fingerprint() string {
+	return m.MessageSID
+}
+
+// fingerprint identifies a Teams activity by its ID
+func (a *TeamsActivity) fingerprint() string {
+	return a.ID
+}
+
+// fingerprint identifies an Intercom message by its conversation part
+func (m *IntercomMessage) fingerprint() string {
+	if m.PartID == "" {
+		return ""
+	}
+	return m.ConversationID + ":" + m.PartID
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WebSocket chat settings
+const (
+	wsEventChannelPrefix = "chat:events:" // Redis pub/sub channel per session
+	wsMaxMessageSize     = 16 << 10
+	wsSendQueue          = 256 // events buffered per socket before it is closed as too slow
+	wsPendingMessages    = 8   // messages a socket may queue while the agent answers
+	wsPingInterval       = 30 * time.Second
+	wsPongWait           = 60 * time.Second
+	wsWriteWait          = 10 * time.Second
+)
+
+// Chat event types sent to WebSocket clients
+const (
+	ChatEventAck        = "ack"        // a client message was accepted
+	ChatEventMessage    = "message"    // a complete user or assistant message
+	ChatEventToken      = "token"      // a piece of the assistant's answer as it is written
+	ChatEventTyping     = "typing"     // a participant started or stopped typing
+	ChatEventEscalation = "escalation" // the conversation is being handed to a human agent
+	ChatEventError      = "error"
+)
+
+var wsConnections = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "csr_websocket_connections",
+		Help: "Open WebSocket chat connections",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(wsConnections)
+}
+
+// ChatEvent is sent to every socket open on a session, on any replica
+type ChatEvent struct {
+	Type      string               `json:"type"`
+	SessionID string               `json:"session_id"`
+	ID        string               `json:"id,omitempty"`    // the client message the event belongs to
+	Role      string               `json:"role,omitempty"`  // user, assistant, or agent (a human agent)
+	State     string               `json:"state,omitempty"` // typing: started or stopped
+	Text      string               `json:"text,omitempty"`
+	Response  *ChatMessageResponse `json:"response,omitempty"` // assistant messages
+	Error     string               `json:"error,omitempty"`
+	Timestamp time.Time            `json:"timestamp"`
+}
+
+// ClientMessage is sent by WebSocket clients
+type ClientMessage struct {
+	Type     string                 `json:"type"`         // "message" or "typing"
+	ID       string                 `json:"id,omitempty"` // echoed in the events that answer it
+	Message  string                 `json:"message,omitempty"`
+	State    string                 `json:"state,omitempty"` // typing: started or stopped
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// ChatSockets serves WebSocket chat connections. Every socket belongs to one session, and a
+// session may have several sockets, such as one per browser tab. Events are published through
+// Redis so sockets of the same session on other replicas receive them too.
+type ChatSockets struct {
+	agent    *AgentService
+	client   *redis.Client
+	upgrader websocket.Upgrader
+	slots    chan struct{}
+
+	mu       sync.Mutex
+	sessions map[string]map[*chatSocket]struct{} // by tenant-scoped session key
+	pubsub   *redis.PubSub
+	closed   bool
+}
+
+// chatSocket is one client connection
+type chatSocket struct {
+	conn      *websocket.Conn
+	sessionID string
+	key       string // the session ID scoped to its tenant, as events are published
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (cs *chatSocket) close() {
+	cs.closeOnce.Do(func() { close(cs.done) })
+}
+
+// NewChatSockets accepts up to maxConnections sockets on this replica. Browsers may connect from
+// the API's own origin and from allowedOrigins, a comma-separated list such as
+// "https://www.example.com"; "*" allows any origin.
+func NewChatSockets(agent *AgentService, client *redis.Client, allowedOrigins string, maxConnections int) *ChatSockets {
+	origins := make(map[string]bool)
+	for _, origin := range strings.Split(allowedOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+		}
+	}
+	if maxConnections < 1 {
+		maxConnections = 1
+	}
+
+	return &ChatSockets{
+		agent:  agent,
+		client: client,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+			CheckOrigin: func(r *http.Request) bool {
+				origin := r.Header.Get("Origin")
+				if origin == "" || origins["*"] || origins[strings.ToLower(origin)] {
+					return true
+				}
+				u, err := url.Parse(origin)
+				return err == nil && strings.EqualFold(u.Host, r.Host)
+			},
+		},
+		slots:    make(chan struct{}, maxConnections),
+		sessions: make(map[string]map[*chatSocket]struct{}),
+	}
+}
+
+// Start relays published events to the sockets on this replica until Close
+func (ws *ChatSockets) Start(ctx context.Context) {
+	ws.mu.Lock()
+	ws.pubsub = ws.client.PSubscribe(ctx, wsEventChannelPrefix+"*")
+	channel := ws.pubsub.Channel()
+	ws.mu.Unlock()
+
+	go func() {
+		for msg := range channel {
+			key := strings.TrimPrefix(msg.Channel, wsEventChannelPrefix)
+			ws.deliver(key, []byte(msg.Payload))
+		}
+	}()
+}
+
+// Close disconnects every socket, telling clients the server is going away
+func (ws *ChatSockets) Close() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	ws.closed = true
+	if ws.pubsub != nil {
+		ws.pubsub.Close()
+	}
+	for _, sockets := range ws.sessions {
+		for socket := range sockets {
+			socket.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+				time.Now().Add(wsWriteWait))
+			socket.close()
+		}
+	}
+}
+
+// Publish sends an event to every socket open on its session
+func (ws *ChatSockets) Publish(ctx context.Context, event *ChatEvent) error {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal chat event: %w", err)
+	}
+
+	if err := ws.client.Publish(ctx, wsEventChannelPrefix+tenantKey(ctx, event.SessionID), data).Err(); err != nil {
+		return fmt.Errorf("failed to publish chat event: %w", err)
+	}
+	return nil
+}
+
+// deliver queues an event for the session's sockets; a socket too slow to keep up is closed
+func (ws *ChatSockets) deliver(key string, data []byte) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for socket := range ws.sessions[key] {
+		select {
+		case socket.send <- data:
+		default:
+			log.Printf("Closing slow WebSocket for session %s", socket.sessionID)
+			socket.close()
+		}
+	}
+}
+
+func (ws *ChatSockets) register(socket *chatSocket) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.closed {
+		return false
+	}
+	if ws.sessions[socket.key] == nil {
+		ws.sessions[socket.key] = make(map[*chatSocket]struct{})
+	}
+	ws.sessions[socket.key][socket] = struct{}{}
+	wsConnections.Inc()
+	return true
+}
+
+func (ws *ChatSockets) unregister(socket *chatSocket) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if _, ok := ws.sessions[socket.key][socket]; !ok {
+		return
+	}
+	delete(ws.sessions[socket.key], socket)
+	if len(ws.sessions[socket.key]) == 0 {
+		delete(ws.sessions, socket.key)
+	}
+	wsConnections.Dec()
+}
+
+// handleWebSocket upgrades a connection for the session in the session_id query parameter. The
+// user_id and channel parameters identify the customer as in POST /api/v1/chat.
+func (app *Application) handleWebSocket(c *gin.Context) {
+	sessionID := c.Query("session_id")
+	userID := c.Query("user_id")
+	channel := c.DefaultQuery("channel", "web")
+	if sessionID == "" || userID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "session_id and user_id are required"})
+		return
+	}
+
+	ws := app.ChatSockets
+	select {
+	case ws.slots <- struct{}{}:
+	default:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "too many open connections"})
+		return
+	}
+	defer func() { <-ws.slots }()
+
+	conn, err := ws.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already replied with an error
+		return
+	}
+	defer conn.Close()
+
+	socket := &chatSocket{
+		conn:      conn,
+		sessionID: sessionID,
+		key:       tenantKey(c.Request.Context(), sessionID),
+		send:      make(chan []byte, wsSendQueue),
+		done:      make(chan struct{}),
+	}
+	if !ws.register(socket) {
+		return
+	}
+	defer ws.unregister(socket)
+
+	ctx, cancel := context.WithCancel(detachContext(c.Request.Context()))
+	defer cancel()
+
+	// Messages are answered one at a time, in order, while the socket keeps reading
+	pending := make(chan ClientMessage, wsPendingMessages)
+	go func() {
+		for msg := range pending {
+			app.answerSocketMessage(ctx, sessionID, userID, channel, msg)
+		}
+	}()
+	defer close(pending)
+
+	go ws.writeLoop(socket)
+	ws.readLoop(ctx, socket, userID, pending)
+	socket.close()
+}
+
+// readLoop reads client messages until the socket closes
+func (ws *ChatSockets) readLoop(ctx context.Context, socket *chatSocket, userID string, pending chan<- ClientMessage) {
+	conn := socket.conn
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var msg ClientMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("WebSocket read error for session %s: %v", socket.sessionID, err)
+			}
+			return
+		}
+
+		switch msg.Type {
+		case "message":
+			req := ChatMessageRequest{SessionID: socket.sessionID, Message: msg.Message, UserID: userID}
+			if err := req.Validate(); err != nil {
+				ws.reply(socket, &ChatEvent{Type: ChatEventError, SessionID: socket.sessionID, ID: msg.ID, Error: err.Error()})
+				continue
+			}
+			select {
+			case pending <- msg:
+				ws.reply(socket, &ChatEvent{Type: ChatEventAck, SessionID: socket.sessionID, ID: msg.ID})
+			default:
+				ws.reply(socket, &ChatEvent{Type: ChatEventError, SessionID: socket.sessionID, ID: msg.ID, Error: "too many messages waiting for an answer"})
+			}
+		case "typing":
+			ws.Publish(ctx, &ChatEvent{Type: ChatEventTyping, SessionID: socket.sessionID, Role: "user", State: msg.State})
+		default:
+			ws.reply(socket, &ChatEvent{Type: ChatEventError, SessionID: socket.sessionID, ID: msg.ID, Error: fmt.Sprintf("unknown message type %q", msg.Type)})
+		}
+	}
+}
+
+// writeLoop sends queued events and keepalive pings until the socket closes
+func (ws *ChatSockets) writeLoop(socket *chatSocket) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	defer socket.conn.Close()
+
+	for {
+		select {
+		case data := <-socket.send:
+			socket.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := socket.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := socket.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-socket.done:
+			return
+		}
+	}
+}
+
+// reply sends an event to one socket only
+func (ws *ChatSockets) reply(socket *chatSocket, event *ChatEvent) {
+	event.Timestamp = time.Now()
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	select {
+	case socket.send <- data:
+	default:
+		socket.close()
+	}
+}
+
+// answerSocketMessage runs a client message through the agent and publishes the conversation to
+// every socket of the session: the user's message, the assistant typing, its tokens, the complete
+// answer, and an escalation notice when the agent hands off
+func (app *Application) answerSocketMessage(ctx context.Context, sessionID, userID, channel string, msg ClientMessage) {
+	ws := app.ChatSockets
+	publish := func(event *ChatEvent) {
+		event.SessionID, event.ID = sessionID, msg.ID
+		if err := ws.Publish(ctx, event); err != nil {
+			log.Printf("WebSocket event for session %s not delivered: %v", sessionID, err)
+		}
+	}
+
+	req := &ChatMessageRequest{
+		SessionID: sessionID,
+		Message:   msg.Message,
+		UserID:    userID,
+		Channel:   channel,
+		Metadata:  msg.Metadata,
+	}
+	publish(&ChatEvent{Type: ChatEventMessage, Role: "user", Text: msg.Message})
+	publish(&ChatEvent{Type: ChatEventTyping, Role: "assistant", State: "started"})
+
+	startTime := time.Now()
+	response, err := app.AgentService.ProcessMessageStream(ctx, req, func(text string) error {
+		publish(&ChatEvent{Type: ChatEventToken, Role: "assistant", Text: text})
+		return ctx.Err()
+	})
+	messageLatency.WithLabelValues(channel).Observe(time.Since(startTime).Seconds())
+	publish(&ChatEvent{Type: ChatEventTyping, Role: "assistant", State: "stopped"})
+
+	if errors.Is(err, ErrHandedOff) {
+		// A human agent answers from the console
+		return
+	}
+	if err != nil {
+		messagesProcessed.WithLabelValues("error", channel).Inc()
+		publish(&ChatEvent{Type: ChatEventError, Error: err.Error()})
+		return
+	}
+	messagesProcessed.WithLabelValues("success", channel).Inc()
+	sentimentDistribution.WithLabelValues(response.Sentiment).Inc()
+
+	publish(&ChatEvent{Type: ChatEventMessage, Role: "assistant", Text: response.Message, Response: response})
+	if response.ShouldEscalate {
+		publish(&ChatEvent{Type: ChatEventEscalation, Text: "Your conversation is being transferred to a human agent."})
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WhatsApp delivery settings
+const (
+	// whatsappWindow is how long after a customer's last message WhatsApp allows free-form
+	// replies; later messages must use an approved template
+	whatsappWindow = 24 * time.Hour
+
+	// whatsappMaxBodyChars is the longest message body Twilio sends to WhatsApp
+	whatsappMaxBodyChars = 1600
+
+	// twilioErrOutsideWindow is Twilio's error code for a free-form message outside the window
+	twilioErrOutsideWindow = 63016
+)
+
+// whatsappFallbackReply is sent when the agent cannot answer, so the customer is not left waiting
+const whatsappFallbackReply = "Sorry, I'm having trouble answering right now. A member of our team will get back to you here."
+
+var whatsappMessagesSent = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_whatsapp_messages_sent_total",
+		Help: "WhatsApp messages sent through Twilio, by kind (freeform, template) and status",
+	},
+	[]string{"kind", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(whatsappMessagesSent)
+}
+
+// WhatsAppConfig holds the Twilio account WhatsApp messages are sent from
+type WhatsAppConfig struct {
+	AccountSID  string
+	AuthToken   string
+	From        string // the WhatsApp sender's number, e.g. +14155238886
+	WebhookURL  string // the public URL Twilio calls, used to check its signatures
+	TemplateSID string // approved content template for replies outside the 24-hour window
+}
+
+// WhatsAppClient sends WhatsApp messages through the Twilio Messaging API
+type WhatsAppClient struct {
+	config     WhatsAppConfig
+	baseURL    string
+	redis      *redis.Client
+	httpClient *http.Client
+}
+
+// WhatsAppMessage is an inbound WhatsApp message, as Twilio posts it to the webhook
+type WhatsAppMessage struct {
+	MessageSID  string          `json:"message_sid"`
+	From        string          `json:"from"` // whatsapp:+15551234567
+	WaID        string          `json:"wa_id"`
+	ProfileName string          `json:"profile_name,omitempty"`
+	Body        string          `json:"body"`
+	Media       []WhatsAppMedia `json:"media,omitempty"`
+}
+
+// WhatsAppMedia is a file attached to a WhatsApp message. The URL needs the Twilio credentials.
+type WhatsAppMedia struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+}
+
+// twilioError is an error reported by the Twilio API
+type twilioError struct {
+	status  int
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *twilioError) Error() string {
+	return fmt.Sprintf("twilio api error %d (status %d): %s", e.Code, e.status, e.Message)
+}
+
+// NewWhatsAppClient creates a client for the Twilio account in config. Redis tracks when each
+// customer last wrote, across replicas.
+func NewWhatsAppClient(config WhatsAppConfig, redisClient *redis.Client) (*WhatsAppClient, error) {
+	if config.AccountSID == "" || config.AuthToken == "" {
+		return nil, fmt.Errorf("TWILIO_ACCOUNT_SID and TWILIO_AUTH_TOKEN are required")
+	}
+	if config.From == "" {
+		return nil, fmt.Errorf("TWILIO_WHATSAPP_NUMBER is required")
+	}
+
+	return &WhatsAppClient{
+		config:  config,
+		baseURL: "https://api.twilio.com/2010-04-01/Accounts/" + config.AccountSID,
+		redis:   redisClient,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+// text returns the message as the agent reads it. The agent cannot open attachments, so each is
+// described, letting it ask the customer what they sent.
+func (m *WhatsAppMessage) text() string {
+	lines := []string{}
+	if body := strings.TrimSpace(m.Body); body != "" {
+		lines = append(lines, body)
+	}
+	for _, media := range m.Media {
+		kind := "a file"
+		switch {
+		case strings.HasPrefix(media.ContentType, "image/"):
+			kind = "an image"
+		case strings.HasPrefix(media.ContentType, "audio/"):
+			kind = "a voice message"
+		case strings.HasPrefix(media.ContentType, "video/"):
+			kind = "a video"
+		case media.ContentType == "application/pdf":
+			kind = "a PDF document"
+		}
+		lines = append(lines, fmt.Sprintf("[The customer attached %s (%s) that you cannot view.]", kind, media.ContentType))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// RecordInbound notes that a customer wrote, opening the window for free-form replies
+func (c *WhatsAppClient) RecordInbound(ctx context.Context, to string) error {
+	if err := c.redis.Set(ctx, "whatsapp:inbound:"+to, time.Now().Unix(), whatsappWindow).Err(); err != nil {
+		return fmt.Errorf("failed to record whatsapp message: %w", err)
+	}
+	return nil
+}
+
+// inWindow reports whether the customer wrote within the last 24 hours
+func (c *WhatsAppClient) inWindow(ctx context.Context, to string) (bool, error) {
+	n, err := c.redis.Exists(ctx, "whatsapp:inbound:"+to).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check whatsapp window: %w", err)
+	}
+	return n > 0, nil
+}
+
+// Send sends text to a WhatsApp number, split into several messages when it is too long for one.
+// Outside the 24-hour window the text is sent through the approved template instead.
+func (c *WhatsAppClient) Send(ctx context.Context, to, text string) error {
+	open, err := c.inWindow(ctx, to)
+	if err != nil {
+		return err
+	}
+	if !open {
+		return c.sendTemplate(ctx, to, text)
+	}
+
+	for _, part := range splitMessage(text, whatsappMaxBodyChars) {
+		err := c.send(ctx, "freeform", url.Values{"Body": {part}}, to)
+		if twErr, ok := err.(*twilioError); ok && twErr.Code == twilioErrOutsideWindow {
+			// The window closed since the check
+			return c.sendTemplate(ctx, to, text)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendTemplate sends text as the variable of the approved template. The template should read
+// like "We have an update on your support request: {{1}}".
+func (c *WhatsAppClient) sendTemplate(ctx context.Context, to, text string) error {
+	if c.config.TemplateSID == "" {
+		whatsappMessagesSent.WithLabelValues("template", "error").Inc()
+		return fmt.Errorf("cannot message %s: more than 24 hours since their last message and no template is configured", to)
+	}
+
+	// Template variables cannot contain newlines
+	variable := strings.Join(strings.Fields(text), " ")
+	if len(variable) > 1000 {
+		cut := 1000
+		for cut > 0 && !utf8.RuneStart(variable[cut]) {
+			cut--
+		}
+		variable = variable[:cut] + "…"
+	}
+	variables, err := json.Marshal(map[string]string{"1": variable})
+	if err != nil {
+		return fmt.Errorf("failed to marshal template variables: %w", err)
+	}
+
+	form := url.Values{
+		"ContentSid":       {c.config.TemplateSID},
+		"ContentVariables": {string(variables)},
+	}
+	return c.send(ctx, "template", form, to)
+}
+
+// send creates a message through the Twilio API
+func (c *WhatsAppClient) send(ctx context.Context, kind string, form url.Values, to string) error {
+	form.Set("From", "whatsapp:"+strings.TrimPrefix(c.config.From, "whatsapp:"))
+	form.Set("To", to)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/Messages.json", strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(c.config.AccountSID, c.config.AuthToken)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		whatsappMessagesSent.WithLabelValues(kind, "error").Inc()
+		return fmt.Errorf("failed to call twilio api: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		whatsappMessagesSent.WithLabelValues(kind, "error").Inc()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		twErr := &twilioError{status: resp.StatusCode}
+		if json.Unmarshal(data, twErr) != nil || twErr.Message == "" {
+			twErr.Message = string(data)
+		}
+		return twErr
+	}
+
+	whatsappMessagesSent.WithLabelValues(kind, "success").Inc()
+	return nil
+}
+
+// verifyTwilioRequest parses a Twilio webhook's form and checks its X-Twilio-Signature.
+// webhookURL is the public URL Twilio called; when empty it is rebuilt from the request, which
+// only works when no proxy rewrites the URL.
+func verifyTwilioRequest(c *gin.Context, authToken, webhookURL string) bool {
+	if err := c.Request.ParseForm(); err != nil {
+		return false
+	}
+	if webhookURL == "" {
+		scheme := "https"
+		if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+			scheme = proto
+		} else if c.Request.TLS == nil {
+			scheme = "http"
+		}
+		webhookURL = scheme + "://" + c.Request.Host + c.Request.URL.RequestURI()
+	}
+	return verifyTwilioSignature(authToken, webhookURL, c.Request.PostForm, c.GetHeader("X-Twilio-Signature"))
+}
+
+// verifyTwilioSignature checks Twilio's X-Twilio-Signature: a base64 HMAC-SHA1, keyed by the
+// auth token, of the webhook URL followed by each POST parameter name and value in name order
+func verifyTwilioSignature(authToken, webhookURL string, form url.Values, signature string) bool {
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(webhookURL))
+	for _, key := range keys {
+		for _, value := range form[key] {
+			mac.Write([]byte(key + value))
+		}
+	}
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// splitMessage splits text into parts of at most limit characters, at paragraph or line breaks
+// where it can
+func splitMessage(text string, limit int) []string {
+	var parts []string
+	for len(text) > limit {
+		cut := strings.LastIndex(text[:limit], "\n\n")
+		if cut <= 0 {
+			cut = strings.LastIndex(text[:limit], "\n")
+		}
+		if cut <= 0 {
+			cut = strings.LastIndex(text[:limit], " ")
+		}
+		if cut <= 0 {
+			cut = limit
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+		}
+		parts = append(parts, strings.TrimSpace(text[:cut]))
+		text = strings.TrimSpace(text[cut:])
+	}
+	if text != "" {
+		parts = append(parts, text)
+	}
+	return parts
+}
+
+// handleWhatsAppWebhook receives WhatsApp messages from Twilio and queues them for the agent
+func (app *Application) handleWhatsAppWebhook(c *gin.Context) {
+	whatsapp := app.whatsAppFor(c.Request.Context())
+	if whatsapp == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "whatsapp is not configured"})
+		return
+	}
+	// Behind a proxy the request URL differs from the one Twilio signed
+	if !verifyTwilioRequest(c, whatsapp.config.AuthToken, whatsapp.config.WebhookURL) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid signature"})
+		return
+	}
+
+	form := c.Request.PostForm
+	msg := &WhatsAppMessage{
+		MessageSID:  form.Get("MessageSid"),
+		From:        form.Get("From"),
+		WaID:        form.Get("WaId"),
+		ProfileName: form.Get("ProfileName"),
+		Body:        form.Get("Body"),
+	}
+	if msg.WaID == "" {
+		msg.WaID = strings.TrimPrefix(strings.TrimPrefix(msg.From, "whatsapp:"), "+")
+	}
+	numMedia, _ := strconv.Atoi(form.Get("NumMedia"))
+	for i := 0; i < numMedia; i++ {
+		msg.Media = append(msg.Media, WhatsAppMedia{
+			URL:         form.Get(fmt.Sprintf("MediaUrl%d", i)),
+			ContentType: form.Get(fmt.Sprintf("MediaContentType%d", i)),
+		})
+	}
+
+	// Status callbacks and reactions carry neither text nor media
+	if msg.From == "" || msg.text() == "" {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	// Twilio retries webhooks that time out
+	ctx := c.Request.Context()
+	first, err := app.Webhooks.First(ctx, "whatsapp", msg.fingerprint())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !first {
+		c.Data(http.StatusOK, "text/xml", []byte("<Response></Response>"))
+		return
+	}
+
+	if err := whatsapp.RecordInbound(ctx, msg.From); err != nil {
+		log.Printf("WhatsApp: %v", err)
+	}
+
+	// Enqueue for async processing
+	if err := app.MessageQueue.Enqueue(ctx, msg); err != nil {
+		app.Webhooks.Release(ctx, "whatsapp", msg.fingerprint())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// An empty TwiML response; the answer is sent through the API once the agent has it
+	c.Data(http.StatusOK, "text/xml", []byte("<Response></Response>"))
+}
+
+// processWhatsAppMessage answers a WhatsApp message. Each customer's number is one conversation.
+func (app *Application) processWhatsAppMessage(ctx context.Context, msg *WhatsAppMessage) error {
+	// Convert to chat message
+	req := &ChatMessageRequest{
+		SessionID: "whatsapp-" + msg.WaID,
+		Message:   msg.text(),
+		UserID:    msg.WaID,
+		Channel:   "whatsapp",
+		Metadata: map[string]interface{}{
+			"message_sid":  msg.MessageSID,
+			"profile_name": msg.ProfileName,
+		},
+		Source: msg,
+	}
+	if len(msg.Media) > 0 {
+		req.Metadata["media"] = msg.Media
+	}
+	if err := req.Validate(); err != nil {
+		return app.whatsAppFor(ctx).Send(ctx, msg.From, "Sorry, "+err.Error()+".")
+	}
+
+	// Process with agent
+	startTime := time.Now()
+	response, err := app.AgentService.ProcessMessage(ctx, req)
+	messageLatency.WithLabelValues(req.Channel).Observe(time.Since(startTime).Seconds())
+	if errors.Is(err, ErrHandedOff) {
+		// A human agent answers from the console
+		return nil
+	}
+	if err != nil {
+		messagesProcessed.WithLabelValues("error", req.Channel).Inc()
+		if sendErr := app.whatsAppFor(ctx).Send(ctx, msg.From, whatsappFallbackReply); sendErr != nil {
+			log.Printf("Failed to send fallback reply on WhatsApp: %v", sendErr)
+		}
+		return err
+	}
+	messagesProcessed.WithLabelValues("success", req.Channel).Inc()
+	sentimentDistribution.WithLabelValues(response.Sentiment).Inc()
+
+	// Send response back on WhatsApp
+	if err := app.whatsAppFor(ctx).Send(ctx, msg.From, response.Message); err != nil {
+		return fmt.Errorf("failed to reply on whatsapp: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Zendesk API limits
+const (
+	zendeskMaxRetries    = 3                // retries of a rate limited or unavailable request
+	zendeskMaxRetryAfter = 60 * time.Second // longest Retry-After honored before giving up
+	zendeskMaxResponse   = 1 << 20          // bytes of a response read
+)
+
+// zendeskPriorities are the ticket priorities Zendesk accepts
+var zendeskPriorities = map[string]bool{"low": true, "normal": true, "high": true, "urgent": true}
+
+var zendeskRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csr_zendesk_requests_total",
+		Help: "Zendesk API requests, by operation and status",
+	},
+	[]string{"operation", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(zendeskRequests)
+}
+
+// ZendeskConfig holds the Zendesk account and how escalations are routed in it
+type ZendeskConfig struct {
+	Subdomain string // the account's <subdomain>.zendesk.com
+
+	// Credentials: an API token with the email of the agent it belongs to, an OAuth client
+	// that is granted tokens with client credentials, or an OAuth access token as APIKey
+	Email             string
+	APIKey            string
+	OAuthClientID     string
+	OAuthClientSecret string
+
+	EscalationGroupID int64  // group escalated tickets are assigned to; 0 leaves the group as is
+	EscalationTag     string // tag added to escalated tickets
+}
+
+// ZendeskClient replies to and updates tickets through the Zendesk Support API
+type ZendeskClient struct {
+	config     ZendeskConfig
+	baseURL    string
+	httpClient *http.Client
+
+	mu          sync.Mutex
+	accessToken string // OAuth token granted to the client
+	tokenExpiry time.Time
+}
+
+// ZendeskTicketUpdate is a change to a ticket. Empty fields are left as they are.
+type ZendeskTicketUpdate struct {
+	Comment        *ZendeskComment `json:"comment,omitempty"`
+	Status         string          `json:"status,omitempty"`   // new, open, pending, hold, solved
+	Priority       string          `json:"priority,omitempty"` // low, normal, high, urgent
+	GroupID        int64           `json:"group_id,omitempty"`
+	AssigneeID     int64           `json:"assignee_id,omitempty"`
+	AdditionalTags []string        `json:"additional_tags,omitempty"`
+}
+
+// ZendeskComment is a comment on a ticket. Private comments are internal notes for agents.
+type ZendeskComment struct {
+	Body   string `json:"body"`
+	Public bool   `json:"public"`
+}
+
+// NewZendeskClient creates a client for the account in config
+func NewZendeskClient(config ZendeskConfig) (*ZendeskClient, error) {
+	if config.Subdomain == "" {
+		return nil, fmt.Errorf("ZENDESK_SUBDOMAIN is required")
+	}
+	if config.APIKey == "" && (config.OAuthClientID == "" || config.OAuthClientSecret == "") {
+		return nil, fmt.Errorf("ZENDESK_API_KEY or a Zendesk OAuth client is required")
+	}
+
+	return &ZendeskClient{
+		config:  config,
+		baseURL: fmt.Sprintf("https://%s.zendesk.com", config.Subdomain),
+		httpClient: &http.Client{
+			Timeout: 15 * time.Second,
+		},
+	}, nil
+}
+
+// UpdateTicket applies an update to a ticket
+func (c *ZendeskClient) UpdateTicket(ctx context.Context, ticketID int, update *ZendeskTicketUpdate) error {
+	body := map[string]interface{}{"ticket": update}
+	return c.do(ctx, "update_ticket", "PUT", fmt.Sprintf("/api/v2/tickets/%d.json", ticketID), body, nil)
+}
+
+// AddComment adds a public reply or an internal note to a ticket
+func (c *ZendeskClient) AddComment(ctx context.Context, ticketID int, body string, public bool) error {
+	return c.UpdateTicket(ctx, ticketID, &ZendeskTicketUpdate{
+		Comment: &ZendeskComment{Body: body, Public: public},
+	})
+}
+
+// ZendeskNewTicket is a ticket to create
+type ZendeskNewTicket struct {
+	Subject    string            `json:"subject"`
+	Comment    ZendeskComment    `json:"comment"`
+	Requester  *ZendeskRequester `json:"requester,omitempty"`
+	Priority   string            `json:"priority,omitempty"`
+	GroupID    int64             `json:"group_id,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+	ExternalID string            `json:"external_id,omitempty"`
+}
+
+// ZendeskRequester is the customer a new ticket is for. Zendesk finds them by email, or adds
+// them as a user.
+type ZendeskRequester struct {
+	Name  string `json:"name"`
+	Email string `json:"email,omitempty"`
+}
+
+// OpenTicket creates a ticket and returns its ID
+func (c *ZendeskClient) OpenTicket(ctx context.Context, ticket *ZendeskNewTicket) (int64, error) {
+	var created struct {
+		Ticket struct {
+			ID int64 `json:"id"`
+		} `json:"ticket"`
+	}
+	if err := c.do(ctx, "create_ticket", "POST", "/api/v2/tickets.json", map[string]interface{}{"ticket": ticket}, &created); err != nil {
+		return 0, err
+	}
+	return created.Ticket.ID, nil
+}
+
+// Reply posts the agent's answer on a ticket. Answered tickets are set to pending, waiting on
+// the customer. Escalated tickets are opened, assigned to the escalation group, tagged, given
+// the priority the agent chose, and get an internal note saying why a human is needed.
+func (c *ZendeskClient) Reply(ctx context.Context, ticketID int, response *ChatMessageResponse) error {
+	update := &ZendeskTicketUpdate{
+		Comment: &ZendeskComment{Body: response.Message, Public: true},
+		Status:  "pending",
+	}
+	if !response.ShouldEscalate {
+		return c.UpdateTicket(ctx, ticketID, update)
+	}
+
+	update.Status = "open"
+	update.GroupID = c.config.EscalationGroupID
+	if c.config.EscalationTag != "" {
+		update.AdditionalTags = []string{c.config.EscalationTag}
+	}
+	reason, _ := response.Metadata["escalation_reason"].(string)
+	priority, _ := response.Metadata["escalation_priority"].(string)
+	if priority == "" && response.Sentiment == "urgent" {
+		priority = "urgent"
+	}
+	if zendeskPriorities[priority] {
+		update.Priority = priority
+	}
+	if err := c.UpdateTicket(ctx, ticketID, update); err != nil {
+		return err
+	}
+
+	// Zendesk takes one comment per update, so the note for the assignee is a second update
+	if reason == "" {
+		reason = "The customer asked for a person, or the AI agent could not resolve the request."
+	}
+	note := fmt.Sprintf("Escalated by the AI agent (sentiment: %s, confidence: %.2f).\nReason: %s", response.Sentiment, response.Confidence, reason)
+	return c.AddComment(ctx, ticketID, note, false)
+}
+
+// Tools returns the Zendesk tools for the agent. They act through the Zendesk account of the
+// conversation's tenant when it has one.
+func (c *ZendeskClient) Tools() []*Tool {
+	return []*Tool{
+		{
+			Name:        "update_ticket_priority",
+			Description: "Change the priority of the customer's support ticket, for example when they report an outage or a payment problem. Only works for conversations on a Zendesk ticket.",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"priority": map[string]interface{}{"type": "string", "enum": []string{"low", "normal", "high", "urgent"}},
+					"reason":   map[string]interface{}{"type": "string", "description": "Why the priority changed, for the support team"},
+				},
+				"required": []string{"priority", "reason"},
+			},
+			Handler: func(ctx context.Context, call *ToolCall) (interface{}, error) {
+				var input struct {
+					Priority string `json:"priority"`
+					Reason   string `json:"reason"`
+				}
+				if err := call.Decode(&input); err != nil {
+					return nil, err
+				}
+				if call.Request.ZendeskTicketID == 0 {
+					return nil, fmt.Errorf("this conversation is not on a Zendesk ticket")
+				}
+				if !zendeskPriorities[input.Priority] {
+					return nil, fmt.Errorf("priority must be low, normal, high, or urgent")
+				}
+
+				update := &ZendeskTicketUpdate{
+					Comment:  &ZendeskComment{Body: "Priority set to " + input.Priority + " by the AI agent: " + input.Reason},
+					Priority: input.Priority,
+				}
+				client := c
+				if tenantClient := tenantFrom(ctx).zendesk; tenantClient != nil {
+					client = tenantClient
+				}
+				if err := client.UpdateTicket(ctx, call.Request.ZendeskTicketID, update); err != nil {
+					return nil, err
+				}
+				return map[string]interface{}{"ticket_id": call.Request.ZendeskTicketID, "priority": input.Priority}, nil
+			},
+		},
+	}
+}
+
+// do sends a request to the Zendesk API, decoding the response into out when it is not nil. Rate
+// limited and unavailable requests are retried after the Retry-After Zendesk sends, and a
+// rejected OAuth token is replaced once.
+func (c *ZendeskClient) do(ctx context.Context, operation, method, path string, body, out interface{}) error {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(jsonData))
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if err := c.authorize(ctx, req); err != nil {
+			zendeskRequests.WithLabelValues(operation, "error").Inc()
+			return err
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			zendeskRequests.WithLabelValues(operation, "error").Inc()
+			return fmt.Errorf("failed to call zendesk api: %w", err)
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, zendeskMaxResponse))
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			zendeskRequests.WithLabelValues(operation, "success").Inc()
+			if out != nil {
+				if err := json.Unmarshal(data, out); err != nil {
+					return fmt.Errorf("failed to decode zendesk response: %w", err)
+				}
+			}
+			return nil
+
+		case resp.StatusCode == http.StatusUnauthorized && c.usesOAuthClient() && !refreshed:
+			// The token was revoked or expired early
+			c.mu.Lock()
+			c.accessToken = ""
+			c.mu.Unlock()
+			refreshed = true
+			continue
+
+		case (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) && attempt < zendeskMaxRetries:
+			zendeskRequests.WithLabelValues(operation, "rate_limited").Inc()
+			wait := time.Duration(attempt+1) * time.Second
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				wait = time.Duration(seconds) * time.Second
+			}
+			if wait > zendeskMaxRetryAfter {
+				return fmt.Errorf("zendesk rate limit: retry after %s", wait)
+			}
+			log.Printf("Zendesk %s rate limited, retrying in %s", operation, wait)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		zendeskRequests.WithLabelValues(operation, "error").Inc()
+		return fmt.Errorf("zendesk api error (status %d): %s", resp.StatusCode, truncateText(string(data), 4096))
+	}
+}
+
+// usesOAuthClient reports whether the client gets its own OAuth tokens
+func (c *ZendeskClient) usesOAuthClient() bool {
+	return c.config.OAuthClientID != "" && c.config.OAuthClientSecret != ""
+}
+
+// authorize sets the request's credentials
+func (c *ZendeskClient) authorize(ctx context.Context, req *http.Request) error {
+	switch {
+	case c.usesOAuthClient():
+		token, err := c.token(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case c.config.Email != "":
+		req.SetBasicAuth(c.config.Email+"/token", c.config.APIKey)
+	default:
+		req.Header.Set("Authorization", "Bearer "+c.config.APIKey)
+	}
+	return nil
+}
+
+// token returns the OAuth access token, requesting a new one with client credentials when there
+// is none or it is about to expire
+func (c *ZendeskClient) token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.accessToken != "" && time.Now().Before(c.tokenExpiry) {
+		return c.accessToken, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {c.config.OAuthClientID},
+		"client_secret": {c.config.OAuthClientSecret},
+		"scope":         {"tickets:write read"},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/oauth/tokens", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request zendesk token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("zendesk token error (status %d): %s", resp.StatusCode, string(data))
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+
+	c.accessToken = tokenResp.AccessToken
+	c.tokenExpiry = time.Now().Add(24 * time.Hour)
+	if tokenResp.ExpiresIn > 0 {
+		// Renew a minute early so requests in flight do not carry an expired token
+		c.tokenExpiry = time.Now().Add(time.Duration(tokenResp.ExpiresIn)*time.Second - time.Minute)
+	}
+	return c.accessToken, nil
+}
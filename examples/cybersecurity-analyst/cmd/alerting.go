@@ -0,0 +1,1064 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Alert routing (PagerDuty, Opsgenie, email, webhooks) with deduplication and escalation
+const (
+	alertKeyPrefix         = "alerts:"            // alert ID -> Alert JSON
+	alertIndexKey          = "alerts:index"       // sorted set of alert IDs by creation time
+	alertDedupKeyPrefix    = "alerts:dedup:"      // fingerprint -> ID of the alert absorbing repeats
+	alertEscalationsKey    = "alerts:escalations" // sorted set of alert IDs by next escalation time
+	alertThrottleKeyPrefix = "alerts:throttle:"   // notifications per channel per hour
+	alertRetention         = 30 * 24 * time.Hour
+	alertQueueSize         = 1000
+	alertNotificationsMax  = 50
+	alertEscalationCheck   = 30 * time.Second
+	alertRequestTimeout    = 10 * time.Second
+	alertShutdownTimeout   = 10 * time.Second
+
+	alertActionTrigger     = "trigger"
+	alertActionEscalate    = "escalate"
+	alertActionAcknowledge = "acknowledge"
+	alertActionResolve     = "resolve"
+)
+
+type AlertStatus string
+
+const (
+	AlertTriggered    AlertStatus = "triggered"
+	AlertAcknowledged AlertStatus = "acknowledged"
+	AlertResolved     AlertStatus = "resolved"
+)
+
+var (
+	errAlertNotFound = errors.New("alert not found")
+	errAlertResolved = errors.New("alert is already resolved")
+)
+
+var (
+	alertsRouted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_alerts_total",
+			Help: "Indicators routed as alerts by result (created, deduplicated)",
+		},
+		[]string{"result"},
+	)
+
+	alertNotifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_alert_notifications_total",
+			Help: "Alert notifications per channel by status (sent, failed, throttled, dropped)",
+		},
+		[]string{"channel", "status"},
+	)
+
+	alertEscalations = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_alert_escalations_total",
+			Help: "Escalation steps taken for unacknowledged alerts",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(alertsRouted)
+	prometheus.MustRegister(alertNotifications)
+	prometheus.MustRegister(alertEscalations)
+}
+
+// AlertNotification records one delivery attempt to a channel
+type AlertNotification struct {
+	Channel   string    `json:"channel"`
+	Action    string    `json:"action"` // "trigger", "escalate", "acknowledge", or "resolve"
+	Status    string    `json:"status"` // "sent", "failed", "throttled", or "dropped"
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Alert is a high-severity indicator routed to on-call channels; repeats of the same indicator
+// within the deduplication window are counted on it instead of paging again
+type Alert struct {
+	ID              string              `json:"id"`
+	Fingerprint     string              `json:"fingerprint"`
+	Status          AlertStatus         `json:"status"`
+	Severity        ThreatLevel         `json:"severity"`
+	Summary         string              `json:"summary"`
+	Origin          string              `json:"origin"`           // scan type, "capture", "flow", "stream", "grpc", or "cve_watchlist"
+	Tenant          string              `json:"tenant,omitempty"` // only visible to this tenant; empty for the default tenant
+	Indicator       ThreatIndicator     `json:"indicator"`
+	Occurrences     int                 `json:"occurrences"`
+	FirstSeen       time.Time           `json:"first_seen"`
+	LastSeen        time.Time           `json:"last_seen"`
+	EscalationLevel int                 `json:"escalation_level"` // escalation steps taken
+	AcknowledgedBy  string              `json:"acknowledged_by,omitempty"`
+	AcknowledgedAt  *time.Time          `json:"acknowledged_at,omitempty"`
+	ResolvedBy      string              `json:"resolved_by,omitempty"`
+	ResolvedAt      *time.Time          `json:"resolved_at,omitempty"`
+	Notifications   []AlertNotification `json:"notifications"`
+}
+
+// notified lists the channels that were sent the alert, so acknowledgements and resolutions
+// reach them too
+func (a *Alert) notified() map[string]bool {
+	channels := make(map[string]bool)
+	for _, notification := range a.Notifications {
+		if notification.Status == "sent" && (notification.Action == alertActionTrigger || notification.Action == alertActionEscalate) {
+			channels[notification.Channel] = true
+		}
+	}
+	return channels
+}
+
+// alertFingerprint identifies an indicator for deduplication; descriptions, confidence, and
+// evidence vary between detections of the same activity, so they are left out. Tenants never
+// share an alert.
+func alertFingerprint(threat ThreatIndicator) string {
+	fields := []string{string(threat.Type), threat.MITREAttack, threat.SourceIP, threat.DestIP}
+	if threat.CVE != "" {
+		fields = append(fields, threat.CVE)
+	}
+	if threat.Tenant != "" {
+		fields = append(fields, threat.Tenant)
+	}
+	sum := sha1.Sum([]byte(strings.Join(fields, "|")))
+	return hex.EncodeToString(sum[:])
+}
+
+// alertChannel delivers alert notifications. Channels that cannot act on an action ignore it.
+type alertChannel interface {
+	Name() string
+	Send(ctx context.Context, alert *Alert, action string) error
+}
+
+// alertRoute notifies a channel of new alerts at or above its minimum severity
+type alertRoute struct {
+	channel     alertChannel
+	minSeverity ThreatLevel
+}
+
+// EscalationStep notifies channels about alerts still unacknowledged After their creation
+type EscalationStep struct {
+	After    time.Duration `json:"-"`
+	Minutes  int           `json:"after_minutes"`
+	Channels []string      `json:"channels"`
+}
+
+// parseEscalationPolicy reads steps of the form "15:opsgenie,45:pagerduty+email"
+func parseEscalationPolicy(policy string, channels map[string]alertChannel) ([]EscalationStep, error) {
+	steps := make([]EscalationStep, 0)
+	if strings.TrimSpace(policy) == "" {
+		return steps, nil
+	}
+	for _, part := range strings.Split(policy, ",") {
+		delay, names, ok := strings.Cut(strings.TrimSpace(part), ":")
+		minutes, err := strconv.Atoi(delay)
+		if !ok || err != nil || minutes < 1 {
+			return nil, fmt.Errorf("escalation step %q must be <minutes>:<channel>[+<channel>...]", part)
+		}
+		step := EscalationStep{After: time.Duration(minutes) * time.Minute, Minutes: minutes}
+		for _, name := range strings.Split(names, "+") {
+			name = strings.TrimSpace(name)
+			if _, ok := channels[name]; !ok {
+				return nil, fmt.Errorf("escalation step %q names channel %q, which is not configured", part, name)
+			}
+			step.Channels = append(step.Channels, name)
+		}
+		if len(steps) > 0 && step.After <= steps[len(steps)-1].After {
+			return nil, fmt.Errorf("escalation steps must be in increasing order of minutes")
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+func parseSeverity(value string) (ThreatLevel, error) {
+	level := ThreatLevel(strings.ToLower(strings.TrimSpace(value)))
+	if _, ok := severityRank[level]; !ok {
+		return "", fmt.Errorf("severity %q must be low, medium, high, or critical", value)
+	}
+	return level, nil
+}
+
+// alertRoutesFromConfig builds the channels that have been configured
+func alertRoutesFromConfig() ([]alertRoute, error) {
+	client := &http.Client{Timeout: alertRequestTimeout}
+	routes := make([]alertRoute, 0)
+	add := func(channel alertChannel, minSeverity string) error {
+		level, err := parseSeverity(minSeverity)
+		if err != nil {
+			return fmt.Errorf("%s: %w", channel.Name(), err)
+		}
+		routes = append(routes, alertRoute{channel: channel, minSeverity: level})
+		return nil
+	}
+
+	if config.PagerDutyRoutingKey != "" {
+		if err := add(&pagerDutyChannel{url: config.PagerDutyEventsURL, routingKey: config.PagerDutyRoutingKey, client: client}, config.PagerDutyMinSeverity); err != nil {
+			return nil, err
+		}
+	}
+	if config.OpsgenieAPIKey != "" {
+		if err := add(&opsgenieChannel{baseURL: strings.TrimRight(config.OpsgenieAPIURL, "/"), apiKey: config.OpsgenieAPIKey, client: client}, config.OpsgenieMinSeverity); err != nil {
+			return nil, err
+		}
+	}
+	if config.AlertSMTPAddr != "" && config.AlertEmailTo != "" {
+		recipients := make([]string, 0)
+		for _, recipient := range strings.Split(config.AlertEmailTo, ",") {
+			if recipient = strings.TrimSpace(recipient); recipient != "" {
+				recipients = append(recipients, recipient)
+			}
+		}
+		email := &emailChannel{addr: config.AlertSMTPAddr, from: config.AlertEmailFrom, to: recipients}
+		if config.AlertSMTPUsername != "" {
+			host, _, _ := strings.Cut(config.AlertSMTPAddr, ":")
+			email.auth = smtp.PlainAuth("", config.AlertSMTPUsername, config.AlertSMTPPassword, host)
+		}
+		if err := add(email, config.AlertEmailMinSeverity); err != nil {
+			return nil, err
+		}
+	}
+	if config.AlertWebhookURL != "" {
+		if err := add(&webhookChannel{url: config.AlertWebhookURL, client: client}, config.AlertWebhookMinSeverity); err != nil {
+			return nil, err
+		}
+	}
+	return routes, nil
+}
+
+type alertJob struct {
+	alertID string
+	channel alertChannel
+	action  string
+}
+
+// AlertRouter turns high-severity indicators into alerts, notifies the channels whose thresholds
+// they meet, and escalates alerts nobody acknowledges. Alert state lives in Redis, so replicas
+// share deduplication and escalation.
+type AlertRouter struct {
+	redis       *redis.Client
+	tenants     *TenantRegistry
+	routes      []alertRoute
+	channels    map[string]alertChannel
+	escalation  []EscalationStep
+	minSeverity ThreatLevel
+	dedupWindow time.Duration
+	maxPerHour  int
+	queue       chan alertJob
+
+	mu sync.Mutex // serializes read-modify-write of alerts within this process
+}
+
+func NewAlertRouter(redisClient *redis.Client, tenants *TenantRegistry, routes []alertRoute, policy string, minSeverity string, dedupWindow time.Duration, maxPerHour int) (*AlertRouter, error) {
+	level, err := parseSeverity(minSeverity)
+	if err != nil {
+		return nil, fmt.Errorf("ALERT_MIN_SEVERITY: %w", err)
+	}
+	ar := &AlertRouter{
+		redis:       redisClient,
+		tenants:     tenants,
+		routes:      routes,
+		channels:    make(map[string]alertChannel, len(routes)),
+		minSeverity: level,
+		dedupWindow: dedupWindow,
+		maxPerHour:  maxPerHour,
+		queue:       make(chan alertJob, alertQueueSize),
+	}
+	for _, route := range routes {
+		ar.channels[route.channel.Name()] = route.channel
+	}
+	if ar.escalation, err = parseEscalationPolicy(policy, ar.channels); err != nil {
+		return nil, fmt.Errorf("ALERT_ESCALATION_POLICY: %w", err)
+	}
+	if ar.dedupWindow <= 0 {
+		ar.dedupWindow = time.Hour
+	}
+	return ar, nil
+}
+
+// Enabled reports whether any channel is configured
+func (ar *AlertRouter) Enabled() bool {
+	return ar != nil && len(ar.routes) > 0
+}
+
+// Start delivers notifications and escalates unacknowledged alerts until ctx is cancelled;
+// queued notifications are then delivered for up to alertShutdownTimeout
+func (ar *AlertRouter) Start(ctx context.Context) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	if !ar.Enabled() {
+		return &wg
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case job := <-ar.queue:
+				ar.deliver(ctx, job)
+			case <-ctx.Done():
+				flushCtx, cancel := context.WithTimeout(context.Background(), alertShutdownTimeout)
+				defer cancel()
+				for {
+					select {
+					case job := <-ar.queue:
+						ar.deliver(flushCtx, job)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(alertEscalationCheck)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				ar.escalate(ctx)
+			}
+		}
+	}()
+	return &wg
+}
+
+// Route raises alerts for indicators at or above ALERT_MIN_SEVERITY, or the context tenant's own
+// alert threshold
+func (ar *AlertRouter) Route(ctx context.Context, origin string, threats []ThreatIndicator) {
+	if !ar.Enabled() {
+		return
+	}
+	minSeverity := ar.minSeverity
+	if tenant := ar.tenants.state(ctx); tenant != nil && tenant.AlertMinSeverity != "" {
+		minSeverity = tenant.AlertMinSeverity
+	}
+	for _, threat := range threats {
+		if severityRank[threat.Severity] < severityRank[minSeverity] {
+			continue
+		}
+		if err := ar.raise(ctx, origin, threat, nil); err != nil {
+			log.Printf("Failed to route alert for %s indicator: %v", threat.Type, err)
+		}
+	}
+}
+
+// Notify raises an alert for an indicator that subscribers asked for, such as a CVE on a
+// watchlist, regardless of ALERT_MIN_SEVERITY. The named channels are notified, or those routed
+// by severity when none are named.
+func (ar *AlertRouter) Notify(ctx context.Context, origin string, threat ThreatIndicator, channels []string) error {
+	if !ar.Enabled() {
+		return nil
+	}
+	return ar.raise(ctx, origin, threat, channels)
+}
+
+// HasChannel reports whether a channel of that name is configured
+func (ar *AlertRouter) HasChannel(name string) bool {
+	if !ar.Enabled() {
+		return false
+	}
+	_, ok := ar.channels[name]
+	return ok
+}
+
+func (ar *AlertRouter) raise(ctx context.Context, origin string, threat ThreatIndicator, channels []string) error {
+	now := time.Now().UTC()
+	fingerprint := alertFingerprint(threat)
+	dedupKey := alertDedupKeyPrefix + fingerprint
+	id := fmt.Sprintf("alert_%d", now.UnixNano())
+
+	claimed, err := ar.redis.SetNX(ctx, dedupKey, id, ar.dedupWindow).Result()
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		existing, err := ar.redis.Get(ctx, dedupKey).Result()
+		if err == nil {
+			_, err = ar.update(ctx, existing, func(alert *Alert) error {
+				alert.Occurrences++
+				alert.LastSeen = now
+				if severityRank[threat.Severity] > severityRank[alert.Severity] {
+					alert.Severity = threat.Severity
+				}
+				return nil
+			})
+		}
+		if err == nil {
+			ar.redis.Expire(ctx, dedupKey, ar.dedupWindow)
+			alertsRouted.WithLabelValues("deduplicated").Inc()
+			return nil
+		}
+		// The window closed or the alert expired in between; raise a new alert
+		if err := ar.redis.Set(ctx, dedupKey, id, ar.dedupWindow).Err(); err != nil {
+			return err
+		}
+	}
+
+	alert := &Alert{
+		ID:            id,
+		Fingerprint:   fingerprint,
+		Status:        AlertTriggered,
+		Severity:      threat.Severity,
+		Summary:       alertSummary(threat),
+		Origin:        origin,
+		Tenant:        threat.Tenant,
+		Indicator:     threat,
+		Occurrences:   1,
+		FirstSeen:     now,
+		LastSeen:      now,
+		Notifications: make([]AlertNotification, 0),
+	}
+	if err := ar.save(ctx, alert); err != nil {
+		return err
+	}
+	pipe := ar.redis.TxPipeline()
+	pipe.ZAdd(ctx, alertIndexKey, &redis.Z{Score: float64(now.Unix()), Member: id})
+	pipe.ZRemRangeByScore(ctx, alertIndexKey, "-inf", strconv.FormatInt(now.Add(-alertRetention).Unix(), 10))
+	if len(ar.escalation) > 0 {
+		pipe.ZAdd(ctx, alertEscalationsKey, &redis.Z{Score: float64(now.Add(ar.escalation[0].After).Unix()), Member: id})
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	alertsRouted.WithLabelValues("created").Inc()
+
+	if len(channels) > 0 {
+		for _, name := range channels {
+			if channel, ok := ar.channels[name]; ok {
+				ar.enqueue(alert.ID, channel, alertActionTrigger)
+			}
+		}
+		return nil
+	}
+	for _, route := range ar.routes {
+		if severityRank[alert.Severity] >= severityRank[route.minSeverity] {
+			ar.enqueue(alert.ID, route.channel, alertActionTrigger)
+		}
+	}
+	return nil
+}
+
+func alertSummary(threat ThreatIndicator) string {
+	summary := fmt.Sprintf("[%s] %s", strings.ToUpper(string(threat.Severity)), threat.Description)
+	switch {
+	case threat.SourceIP != "" && threat.DestIP != "":
+		summary += fmt.Sprintf(" from %s to %s", threat.SourceIP, threat.DestIP)
+	case threat.SourceIP != "":
+		summary += " from " + threat.SourceIP
+	}
+	if threat.Asset != "" {
+		summary += " (asset " + threat.Asset + ")"
+	}
+	if threat.Tenant != "" {
+		summary += " for tenant " + threat.Tenant
+	}
+	return summary
+}
+
+// enqueue hands a notification to the delivery loop, dropping it when the queue is full
+func (ar *AlertRouter) enqueue(alertID string, channel alertChannel, action string) {
+	select {
+	case ar.queue <- alertJob{alertID: alertID, channel: channel, action: action}:
+	default:
+		ar.recordNotification(context.Background(), alertID, AlertNotification{Channel: channel.Name(), Action: action, Status: "dropped", Error: "notification queue full"})
+	}
+}
+
+// deliver sends one notification unless the channel is over ALERT_MAX_PER_HOUR. Acknowledgements
+// and resolutions are not throttled, so paging services never keep stale incidents open.
+func (ar *AlertRouter) deliver(ctx context.Context, job alertJob) {
+	notification := AlertNotification{Channel: job.channel.Name(), Action: job.action}
+
+	alert, err := ar.load(ctx, job.alertID)
+	if err != nil {
+		return
+	}
+	if job.action == alertActionTrigger || job.action == alertActionEscalate {
+		if alert.Status != AlertTriggered {
+			return // acknowledged or resolved while queued
+		}
+		if ar.maxPerHour > 0 {
+			key := alertThrottleKeyPrefix + job.channel.Name() + ":" + time.Now().UTC().Format("2006010215")
+			pipe := ar.redis.TxPipeline()
+			count := pipe.Incr(ctx, key)
+			pipe.Expire(ctx, key, time.Hour)
+			if _, err := pipe.Exec(ctx); err == nil && count.Val() > int64(ar.maxPerHour) {
+				notification.Status = "throttled"
+				ar.recordNotification(ctx, job.alertID, notification)
+				return
+			}
+		}
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, alertRequestTimeout)
+	defer cancel()
+	if err := job.channel.Send(sendCtx, alert, job.action); err != nil {
+		notification.Status, notification.Error = "failed", err.Error()
+		log.Printf("Alert %s: %s notification to %s failed: %v", alert.ID, job.action, job.channel.Name(), err)
+	} else {
+		notification.Status = "sent"
+	}
+	ar.recordNotification(ctx, job.alertID, notification)
+}
+
+func (ar *AlertRouter) recordNotification(ctx context.Context, alertID string, notification AlertNotification) {
+	notification.Timestamp = time.Now().UTC()
+	alertNotifications.WithLabelValues(notification.Channel, notification.Status).Inc()
+	ar.update(ctx, alertID, func(alert *Alert) error {
+		alert.Notifications = append(alert.Notifications, notification)
+		if len(alert.Notifications) > alertNotificationsMax {
+			alert.Notifications = alert.Notifications[len(alert.Notifications)-alertNotificationsMax:]
+		}
+		return nil
+	})
+}
+
+// escalate notifies the next step's channels about alerts whose escalation is due. Removing an
+// alert from the escalation set claims it, so each step runs on one replica.
+func (ar *AlertRouter) escalate(ctx context.Context) {
+	now := time.Now().UTC()
+	due, err := ar.redis.ZRangeByScore(ctx, alertEscalationsKey, &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(now.Unix(), 10)}).Result()
+	if err != nil {
+		log.Printf("Failed to load alert escalations: %v", err)
+		return
+	}
+
+	for _, id := range due {
+		if claimed, err := ar.redis.ZRem(ctx, alertEscalationsKey, id).Result(); err != nil || claimed == 0 {
+			continue
+		}
+		var step EscalationStep
+		alert, err := ar.update(ctx, id, func(alert *Alert) error {
+			if alert.Status != AlertTriggered || alert.EscalationLevel >= len(ar.escalation) {
+				return errAlertResolved
+			}
+			step = ar.escalation[alert.EscalationLevel]
+			alert.EscalationLevel++
+			return nil
+		})
+		if err != nil {
+			continue
+		}
+
+		alertEscalations.Inc()
+		log.Printf("Escalating unacknowledged alert %s to %s", id, strings.Join(step.Channels, ", "))
+		for _, name := range step.Channels {
+			ar.enqueue(id, ar.channels[name], alertActionEscalate)
+		}
+		if alert.EscalationLevel < len(ar.escalation) {
+			next := alert.FirstSeen.Add(ar.escalation[alert.EscalationLevel].After)
+			ar.redis.ZAdd(ctx, alertEscalationsKey, &redis.Z{Score: float64(next.Unix()), Member: id})
+		}
+	}
+}
+
+// Acknowledge stops escalation of an alert; channels already notified are told
+func (ar *AlertRouter) Acknowledge(ctx context.Context, id, by string) (*Alert, error) {
+	now := time.Now().UTC()
+	alert, err := ar.update(ctx, id, func(alert *Alert) error {
+		if alert.Tenant != tenantField(ctx) {
+			return errAlertNotFound
+		}
+		if alert.Status == AlertResolved {
+			return errAlertResolved
+		}
+		alert.Status = AlertAcknowledged
+		alert.AcknowledgedBy = by
+		alert.AcknowledgedAt = &now
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ar.redis.ZRem(ctx, alertEscalationsKey, id)
+	ar.notifyNotified(alert, alertActionAcknowledge)
+	return alert, nil
+}
+
+// Resolve closes an alert; the next occurrence of its indicator raises a new one
+func (ar *AlertRouter) Resolve(ctx context.Context, id, by string) (*Alert, error) {
+	now := time.Now().UTC()
+	alert, err := ar.update(ctx, id, func(alert *Alert) error {
+		if alert.Tenant != tenantField(ctx) {
+			return errAlertNotFound
+		}
+		if alert.Status == AlertResolved {
+			return errAlertResolved
+		}
+		alert.Status = AlertResolved
+		alert.ResolvedBy = by
+		alert.ResolvedAt = &now
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := ar.redis.TxPipeline()
+	pipe.ZRem(ctx, alertEscalationsKey, id)
+	dedupKey := alertDedupKeyPrefix + alert.Fingerprint
+	if current, err := ar.redis.Get(ctx, dedupKey).Result(); err == nil && current == id {
+		pipe.Del(ctx, dedupKey)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to clear alert %s: %v", id, err)
+	}
+	ar.notifyNotified(alert, alertActionResolve)
+	return alert, nil
+}
+
+func (ar *AlertRouter) notifyNotified(alert *Alert, action string) {
+	for name := range alert.notified() {
+		if channel, ok := ar.channels[name]; ok {
+			ar.enqueue(alert.ID, channel, action)
+		}
+	}
+}
+
+// Alert returns one of the context tenant's alerts
+func (ar *AlertRouter) Alert(ctx context.Context, id string) (*Alert, error) {
+	alert, err := ar.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if alert.Tenant != tenantField(ctx) {
+		return nil, errAlertNotFound
+	}
+	return alert, nil
+}
+
+// load returns an alert of any tenant
+func (ar *AlertRouter) load(ctx context.Context, id string) (*Alert, error) {
+	data, err := ar.redis.Get(ctx, alertKeyPrefix+id).Result()
+	if err == redis.Nil {
+		return nil, errAlertNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load alert: %w", err)
+	}
+	var alert Alert
+	if err := json.Unmarshal([]byte(data), &alert); err != nil {
+		return nil, fmt.Errorf("failed to decode alert: %w", err)
+	}
+	return &alert, nil
+}
+
+// Alerts lists the context tenant's newest alerts, optionally with one status
+func (ar *AlertRouter) Alerts(ctx context.Context, status AlertStatus, limit int) ([]Alert, error) {
+	alerts := make([]Alert, 0)
+	if ar == nil {
+		return alerts, nil
+	}
+	ids, err := ar.redis.ZRevRange(ctx, alertIndexKey, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load alerts: %w", err)
+	}
+	for start := 0; start < len(ids) && len(alerts) < limit; start += 100 {
+		batch := ids[start:min(start+100, len(ids))]
+		keys := make([]string, len(batch))
+		for i, id := range batch {
+			keys[i] = alertKeyPrefix + id
+		}
+		values, err := ar.redis.MGet(ctx, keys...).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load alerts: %w", err)
+		}
+		for _, value := range values {
+			data, ok := value.(string)
+			if !ok {
+				continue
+			}
+			var alert Alert
+			if err := json.Unmarshal([]byte(data), &alert); err != nil {
+				continue
+			}
+			if alert.Tenant == tenantField(ctx) && (status == "" || alert.Status == status) && len(alerts) < limit {
+				alerts = append(alerts, alert)
+			}
+		}
+	}
+	return alerts, nil
+}
+
+// purgeTenant deletes a deleted tenant's alerts
+func (ar *AlertRouter) purgeTenant(ctx context.Context, tenant string) error {
+	if ar == nil {
+		return nil
+	}
+	ids, err := ar.redis.ZRange(ctx, alertIndexKey, 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("failed to load alerts: %w", err)
+	}
+	for start := 0; start < len(ids); start += 100 {
+		batch := ids[start:min(start+100, len(ids))]
+		keys := make([]string, len(batch))
+		for i, id := range batch {
+			keys[i] = alertKeyPrefix + id
+		}
+		values, err := ar.redis.MGet(ctx, keys...).Result()
+		if err != nil {
+			return fmt.Errorf("failed to load alerts: %w", err)
+		}
+		pipe := ar.redis.TxPipeline()
+		for i, value := range values {
+			data, ok := value.(string)
+			if !ok {
+				continue
+			}
+			var alert Alert
+			if err := json.Unmarshal([]byte(data), &alert); err != nil || alert.Tenant != tenant {
+				continue
+			}
+			pipe.Del(ctx, keys[i], alertDedupKeyPrefix+alert.Fingerprint)
+			pipe.ZRem(ctx, alertIndexKey, alert.ID)
+			pipe.ZRem(ctx, alertEscalationsKey, alert.ID)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return fmt.Errorf("failed to delete alerts: %w", err)
+		}
+	}
+	return nil
+}
+
+func (ar *AlertRouter) save(ctx context.Context, alert *Alert) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	return ar.redis.Set(ctx, alertKeyPrefix+alert.ID, data, alertRetention).Err()
+}
+
+func (ar *AlertRouter) update(ctx context.Context, id string, change func(*Alert) error) (*Alert, error) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+
+	alert, err := ar.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := change(alert); err != nil {
+		return nil, err
+	}
+	if err := ar.save(ctx, alert); err != nil {
+		return nil, fmt.Errorf("failed to store alert: %w", err)
+	}
+	return alert, nil
+}
+
+// AlertRoutingInfo describes the configured channels and escalation policy
+type AlertRoutingInfo struct {
+	MinSeverity        ThreatLevel        `json:"min_severity"`
+	DedupWindowMinutes int                `json:"dedup_window_minutes"`
+	MaxPerHour         int                `json:"max_per_hour"` // per channel; 0 is unlimited
+	Channels           []AlertChannelInfo `json:"channels"`
+	Escalation         []EscalationStep   `json:"escalation"`
+}
+
+type AlertChannelInfo struct {
+	Name        string      `json:"name"`
+	MinSeverity ThreatLevel `json:"min_severity"`
+}
+
+func (ar *AlertRouter) Routing() AlertRoutingInfo {
+	info := AlertRoutingInfo{
+		MinSeverity:        ar.minSeverity,
+		DedupWindowMinutes: int(ar.dedupWindow / time.Minute),
+		MaxPerHour:         ar.maxPerHour,
+		Channels:           make([]AlertChannelInfo, 0, len(ar.routes)),
+		Escalation:         ar.escalation,
+	}
+	for _, route := range ar.routes {
+		info.Channels = append(info.Channels, AlertChannelInfo{Name: route.channel.Name(), MinSeverity: route.minSeverity})
+	}
+	sort.Slice(info.Channels, func(i, j int) bool { return info.Channels[i].Name < info.Channels[j].Name })
+	return info
+}
+
+// Channels
+
+// postAlertJSON posts a JSON body and fails on any status outside 2xx
+func postAlertJSON(ctx context.Context, client *http.Client, endpoint string, headers map[string]string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+func alertDetails(alert *Alert) map[string]interface{} {
+	return map[string]interface{}{
+		"alert_id":     alert.ID,
+		"tenant":       alert.Tenant,
+		"type":         alert.Indicator.Type,
+		"origin":       alert.Origin,
+		"source_ip":    alert.Indicator.SourceIP,
+		"dest_ip":      alert.Indicator.DestIP,
+		"mitre_attack": alert.Indicator.MITREAttack,
+		"asset":        alert.Indicator.Asset,
+		"confidence":   alert.Indicator.Confidence,
+		"occurrences":  alert.Occurrences,
+		"evidence":     alert.Indicator.Evidence,
+	}
+}
+
+// pagerDutyChannel sends Events API v2 events; the alert ID is the dedup key, so acknowledging or
+// resolving the alert here does the same to the PagerDuty incident
+type pagerDutyChannel struct {
+	url        string
+	routingKey string
+	client     *http.Client
+}
+
+func (p *pagerDutyChannel) Name() string { return "pagerduty" }
+
+func (p *pagerDutyChannel) Send(ctx context.Context, alert *Alert, action string) error {
+	event := map[string]interface{}{
+		"routing_key":  p.routingKey,
+		"event_action": action,
+		"dedup_key":    alert.ID,
+	}
+	if action == alertActionTrigger || action == alertActionEscalate {
+		severity := map[ThreatLevel]string{Critical: "critical", High: "error", Medium: "warning", Low: "info"}[alert.Severity]
+		source := alert.Indicator.SourceIP
+		if source == "" {
+			source = config.AppName
+		}
+		event["event_action"] = alertActionTrigger
+		event["payload"] = map[string]interface{}{
+			"summary":        truncate(alert.Summary, 1024),
+			"source":         source,
+			"severity":       severity,
+			"timestamp":      alert.FirstSeen.Format(time.RFC3339),
+			"component":      alert.Indicator.Asset,
+			"class":          string(alert.Indicator.Type),
+			"custom_details": alertDetails(alert),
+		}
+	}
+	return postAlertJSON(ctx, p.client, p.url, nil, event)
+}
+
+// opsgenieChannel uses the Alert API; the alert ID is the Opsgenie alias
+type opsgenieChannel struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func (o *opsgenieChannel) Name() string { return "opsgenie" }
+
+func (o *opsgenieChannel) Send(ctx context.Context, alert *Alert, action string) error {
+	headers := map[string]string{"Authorization": "GenieKey " + o.apiKey}
+	alias := url.PathEscape(alert.ID)
+	switch action {
+	case alertActionAcknowledge:
+		return postAlertJSON(ctx, o.client, o.baseURL+"/v2/alerts/"+alias+"/acknowledge?identifierType=alias", headers,
+			map[string]string{"user": alert.AcknowledgedBy, "source": config.AppName})
+	case alertActionResolve:
+		return postAlertJSON(ctx, o.client, o.baseURL+"/v2/alerts/"+alias+"/close?identifierType=alias", headers,
+			map[string]string{"user": alert.ResolvedBy, "source": config.AppName})
+	}
+
+	priority := map[ThreatLevel]string{Critical: "P1", High: "P2", Medium: "P3", Low: "P4"}[alert.Severity]
+	details := make(map[string]string)
+	for key, value := range alertDetails(alert) {
+		details[key] = fmt.Sprint(value)
+	}
+	tags := []string{string(alert.Indicator.Type), string(alert.Severity)}
+	if action == alertActionEscalate {
+		tags = append(tags, "escalated")
+	}
+	return postAlertJSON(ctx, o.client, o.baseURL+"/v2/alerts", headers, map[string]interface{}{
+		"message":     truncate(alert.Summary, 130),
+		"alias":       alert.ID,
+		"description": strings.Join(alert.Indicator.Evidence, "\n"),
+		"priority":    priority,
+		"tags":        tags,
+		"details":     details,
+		"source":      config.AppName,
+	})
+}
+
+// emailChannel sends plain-text mail over SMTP, with STARTTLS when the server offers it
+type emailChannel struct {
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+}
+
+func (e *emailChannel) Name() string { return "email" }
+
+func (e *emailChannel) Send(ctx context.Context, alert *Alert, action string) error {
+	var subject string
+	switch action {
+	case alertActionTrigger:
+		subject = alert.Summary
+	case alertActionEscalate:
+		subject = "ESCALATED: " + alert.Summary
+	case alertActionResolve:
+		subject = "RESOLVED: " + alert.Summary
+	default:
+		return nil // acknowledgements are not mailed
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", e.from, strings.Join(e.to, ", "),
+		strings.NewReplacer("\r", " ", "\n", " ").Replace(subject), time.Now().Format(time.RFC1123Z))
+	body.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&body, "Alert:       %s\r\nStatus:      %s\r\nSeverity:    %s\r\nFirst seen:  %s\r\nOccurrences: %d\r\n\r\n",
+		alert.ID, alert.Status, alert.Severity, alert.FirstSeen.Format(time.RFC3339), alert.Occurrences)
+	for key, value := range alertDetails(alert) {
+		if key != "evidence" && fmt.Sprint(value) != "" {
+			fmt.Fprintf(&body, "%s: %v\r\n", key, value)
+		}
+	}
+	for _, evidence := range alert.Indicator.Evidence {
+		fmt.Fprintf(&body, "- %s\r\n", evidence)
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		fmt.Fprintf(&body, "\r\nSent by %s on %s\r\n", config.AppName, hostname)
+	}
+
+	// net/smtp has no context support; the send runs until it completes or fails
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(e.addr, e.auth, e.from, e.to, []byte(body.String())) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// webhookChannel posts every action as JSON; "text" makes it usable with Slack and Teams
+// incoming webhooks as is
+type webhookChannel struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhookChannel) Name() string { return "webhook" }
+
+func (w *webhookChannel) Send(ctx context.Context, alert *Alert, action string) error {
+	text := alert.Summary
+	if action != alertActionTrigger {
+		text = strings.ToUpper(action) + ": " + text
+	}
+	return postAlertJSON(ctx, w.client, w.url, nil, map[string]interface{}{
+		"text":   text,
+		"action": action,
+		"alert":  alert,
+	})
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+// HTTP Handlers
+func (s *APIServer) listAlertsHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+		return
+	}
+	alerts, err := s.threatDetector.alerts.Alerts(c.Request.Context(), AlertStatus(c.Query("status")), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"alerts": alerts})
+}
+
+func (s *APIServer) getAlertHandler(c *gin.Context) {
+	alert, err := s.threatDetector.alerts.Alert(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, errAlertNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, alert)
+	}
+}
+
+func (s *APIServer) alertRoutingHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, s.threatDetector.alerts.Routing())
+}
+
+func (s *APIServer) acknowledgeAlertHandler(c *gin.Context) {
+	s.changeAlert(c, s.threatDetector.alerts.Acknowledge)
+}
+
+func (s *APIServer) resolveAlertHandler(c *gin.Context) {
+	s.changeAlert(c, s.threatDetector.alerts.Resolve)
+}
+
+func (s *APIServer) changeAlert(c *gin.Context, change func(ctx context.Context, id, by string) (*Alert, error)) {
+	var body struct {
+		By string `json:"by"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || strings.TrimSpace(body.By) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": `"by" must name who is responding`})
+		return
+	}
+
+	alert, err := change(c.Request.Context(), c.Param("id"), body.By)
+	switch {
+	case errors.Is(err, errAlertNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errAlertResolved):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, alert)
+	}
+}
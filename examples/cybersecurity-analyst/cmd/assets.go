@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// Asset inventory and business criticality
+const assetsKey = "assets" // hash of asset ID -> Asset JSON
+
+var (
+	errInvalidAsset  = errors.New("invalid asset")
+	errAssetNotFound = errors.New("asset not found")
+	errAssetConflict = errors.New("asset already exists")
+
+	assetIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+)
+
+type AssetCriticality string
+
+const (
+	CriticalityLow      AssetCriticality = "low"
+	CriticalityMedium   AssetCriticality = "medium"
+	CriticalityHigh     AssetCriticality = "high"
+	CriticalityCritical AssetCriticality = "critical"
+)
+
+// criticalityWeights scale the risk that findings on an asset contribute; findings on
+// unregistered systems count as medium
+var criticalityWeights = map[AssetCriticality]float64{
+	CriticalityLow:      0.5,
+	CriticalityMedium:   1.0,
+	CriticalityHigh:     1.5,
+	CriticalityCritical: 2.0,
+}
+
+// Asset is a registered host or network. Vulnerability scans cover registered assets only: their
+// hostname and addresses are scanned with nmap, and the services found replace Services.
+type Asset struct {
+	ID          string                `json:"id"`
+	Name        string                `json:"name,omitempty"`
+	Hostname    string                `json:"hostname,omitempty"`
+	Addresses   []string              `json:"addresses,omitempty"` // IP addresses or CIDR networks
+	Owner       string                `json:"owner,omitempty"`
+	Criticality AssetCriticality      `json:"criticality"`
+	Ports       string                `json:"ports,omitempty"`    // nmap port list; top 1000 ports when empty
+	Software    []SoftwareFingerprint `json:"software,omitempty"` // installed software checked for CVEs
+	Services    []DiscoveredService   `json:"services,omitempty"` // from the last scan, or registered by hand
+	Tags        []string              `json:"tags,omitempty"`
+	LastScanned *time.Time            `json:"last_scanned,omitempty"`
+	CreatedAt   time.Time             `json:"created_at"`
+	UpdatedAt   time.Time             `json:"updated_at"`
+}
+
+// targets returns what nmap scans for the asset
+func (a Asset) targets() []string {
+	targets := make([]string, 0, len(a.Addresses)+1)
+	if len(a.Addresses) == 0 && a.Hostname != "" {
+		targets = append(targets, a.Hostname)
+	}
+	return append(targets, a.Addresses...)
+}
+
+func (a Asset) weight() float64 {
+	if weight, ok := criticalityWeights[a.Criticality]; ok {
+		return weight
+	}
+	return 1.0
+}
+
+// assetIndex finds the registered asset an address or name belongs to
+type assetIndex struct {
+	byID     map[string]*Asset
+	byName   map[string]*Asset // hostnames, lowercased
+	byIP     map[string]*Asset
+	networks []assetNetwork
+}
+
+type assetNetwork struct {
+	network *net.IPNet
+	asset   *Asset
+}
+
+func newAssetIndex(assets []Asset) *assetIndex {
+	index := &assetIndex{
+		byID:   make(map[string]*Asset, len(assets)),
+		byName: make(map[string]*Asset),
+		byIP:   make(map[string]*Asset),
+	}
+	for i := range assets {
+		asset := &assets[i]
+		index.byID[asset.ID] = asset
+		if asset.Hostname != "" {
+			index.byName[strings.ToLower(asset.Hostname)] = asset
+		}
+		for _, address := range asset.Addresses {
+			if ip := net.ParseIP(address); ip != nil {
+				index.byIP[ip.String()] = asset
+			} else if _, network, err := net.ParseCIDR(address); err == nil {
+				index.networks = append(index.networks, assetNetwork{network: network, asset: asset})
+			}
+		}
+	}
+	// The most specific network wins
+	sort.Slice(index.networks, func(i, j int) bool {
+		a, _ := index.networks[i].network.Mask.Size()
+		b, _ := index.networks[j].network.Mask.Size()
+		return a > b
+	})
+	return index
+}
+
+// lookup returns the asset whose address, network, or hostname matches value
+func (ai *assetIndex) lookup(value string) *Asset {
+	if ai == nil || value == "" {
+		return nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return ai.byName[strings.ToLower(value)]
+	}
+	if asset, ok := ai.byIP[ip.String()]; ok {
+		return asset
+	}
+	for _, entry := range ai.networks {
+		if entry.network.Contains(ip) {
+			return entry.asset
+		}
+	}
+	return nil
+}
+
+// annotate names the most critical registered asset each indicator involves
+func (ai *assetIndex) annotate(threats []ThreatIndicator) {
+	if ai == nil {
+		return
+	}
+	for i := range threats {
+		var involved *Asset
+		for _, address := range []string{threats[i].SourceIP, threats[i].DestIP} {
+			if asset := ai.lookup(address); asset != nil && (involved == nil || asset.weight() > involved.weight()) {
+				involved = asset
+			}
+		}
+		if involved != nil {
+			threats[i].Asset = involved.ID
+		}
+	}
+}
+
+// weight returns the highest criticality weight among the assets, or 1 when none is registered
+func (ai *assetIndex) weight(ids ...string) float64 {
+	if ai == nil {
+		return 1.0
+	}
+	weight := 0.0
+	for _, id := range ids {
+		if asset, ok := ai.byID[id]; ok && asset.weight() > weight {
+			weight = asset.weight()
+		}
+	}
+	if weight == 0 {
+		return 1.0
+	}
+	return weight
+}
+
+// AssetRegistry stores assets in Redis
+type AssetRegistry struct {
+	redis *redis.Client
+}
+
+func NewAssetRegistry(redisClient *redis.Client) *AssetRegistry {
+	return &AssetRegistry{redis: redisClient}
+}
+
+func (ar *AssetRegistry) Assets(ctx context.Context) ([]Asset, error) {
+	entries, err := ar.redis.HGetAll(ctx, tenantKey(ctx, assetsKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load assets: %w", err)
+	}
+
+	assets := make([]Asset, 0, len(entries))
+	for id, data := range entries {
+		var asset Asset
+		if err := json.Unmarshal([]byte(data), &asset); err != nil {
+			log.Printf("Skipping invalid asset %s: %v", id, err)
+			continue
+		}
+		assets = append(assets, asset)
+	}
+	sort.Slice(assets, func(i, j int) bool { return assets[i].ID < assets[j].ID })
+	return assets, nil
+}
+
+func (ar *AssetRegistry) Asset(ctx context.Context, id string) (*Asset, error) {
+	data, err := ar.redis.HGet(ctx, tenantKey(ctx, assetsKey), id).Result()
+	if err == redis.Nil {
+		return nil, errAssetNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load asset: %w", err)
+	}
+
+	var asset Asset
+	if err := json.Unmarshal([]byte(data), &asset); err != nil {
+		return nil, fmt.Errorf("invalid asset %s: %w", id, err)
+	}
+	return &asset, nil
+}
+
+// index loads every asset for matching scan findings
+func (ar *AssetRegistry) index(ctx context.Context) (*assetIndex, error) {
+	assets, err := ar.Assets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newAssetIndex(assets), nil
+}
+
+// SaveAsset validates and stores an asset. Creating assigns an ID when none is given; updating
+// keeps the creation time, and keeps the discovered services when the update lists none.
+func (ar *AssetRegistry) SaveAsset(ctx context.Context, asset Asset, create bool) (*Asset, error) {
+	now := time.Now().UTC()
+	if create && asset.ID == "" {
+		asset.ID = fmt.Sprintf("asset_%d", now.UnixNano())
+	}
+	if asset.Criticality == "" {
+		asset.Criticality = CriticalityMedium
+	}
+	if err := validateAsset(&asset); err != nil {
+		return nil, err
+	}
+	asset.UpdatedAt = now
+
+	if create {
+		asset.CreatedAt = now
+		asset.LastScanned = nil
+		data, err := json.Marshal(asset)
+		if err != nil {
+			return nil, err
+		}
+		created, err := ar.redis.HSetNX(ctx, tenantKey(ctx, assetsKey), asset.ID, data).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to store asset: %w", err)
+		}
+		if !created {
+			return nil, fmt.Errorf("%w: %s", errAssetConflict, asset.ID)
+		}
+		return &asset, nil
+	}
+
+	existing, err := ar.Asset(ctx, asset.ID)
+	if err != nil {
+		return nil, err
+	}
+	asset.CreatedAt = existing.CreatedAt
+	asset.LastScanned = existing.LastScanned
+	if asset.Services == nil {
+		asset.Services = existing.Services
+	}
+	data, err := json.Marshal(asset)
+	if err != nil {
+		return nil, err
+	}
+	if err := ar.redis.HSet(ctx, tenantKey(ctx, assetsKey), asset.ID, data).Err(); err != nil {
+		return nil, fmt.Errorf("failed to store asset: %w", err)
+	}
+	return &asset, nil
+}
+
+func validateAsset(asset *Asset) error {
+	if !assetIDPattern.MatchString(asset.ID) {
+		return fmt.Errorf("%w: id must be 1-128 letters, digits, '_', '.', or '-'", errInvalidAsset)
+	}
+	if _, ok := criticalityWeights[asset.Criticality]; !ok {
+		return fmt.Errorf("%w: criticality must be low, medium, high, or critical", errInvalidAsset)
+	}
+	if asset.Hostname != "" && !hostnamePattern.MatchString(asset.Hostname) {
+		return fmt.Errorf("%w: invalid hostname %q", errInvalidAsset, asset.Hostname)
+	}
+	for i, address := range asset.Addresses {
+		if ip := net.ParseIP(address); ip != nil {
+			asset.Addresses[i] = ip.String()
+			continue
+		}
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return fmt.Errorf("%w: %q is not an IP address or CIDR network", errInvalidAsset, address)
+		}
+		asset.Addresses[i] = network.String()
+	}
+	if asset.Hostname == "" && len(asset.Addresses) == 0 && len(asset.Software) == 0 {
+		return fmt.Errorf("%w: assets need a hostname, addresses, or software", errInvalidAsset)
+	}
+	if asset.Ports != "" && !nmapPortsPattern.MatchString(asset.Ports) {
+		return fmt.Errorf("%w: ports must be an nmap port list such as 22,80,443 or 1-1024", errInvalidAsset)
+	}
+	for _, software := range asset.Software {
+		if software.CPE == "" && software.Product == "" {
+			return fmt.Errorf("%w: software entries need a cpe or product", errInvalidAsset)
+		}
+	}
+	return nil
+}
+
+// DeleteAsset removes an asset from the registry
+func (ar *AssetRegistry) DeleteAsset(ctx context.Context, id string) (bool, error) {
+	removed, err := ar.redis.HDel(ctx, tenantKey(ctx, assetsKey), id).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete asset: %w", err)
+	}
+	return removed > 0, nil
+}
+
+// resolve returns the assets a vulnerability scan covers: those listed in assets, the one target
+// names by ID, hostname, or address, or every registered asset when the scan names neither and
+// lists no software
+func (ar *AssetRegistry) resolve(ctx context.Context, req *ThreatDetectionRequest) ([]Asset, error) {
+	if req.Target == "" && len(req.Assets) == 0 && len(req.Software) > 0 {
+		return nil, nil
+	}
+	registered, err := ar.Assets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Target == "" && len(req.Assets) == 0 {
+		return registered, nil
+	}
+
+	index := newAssetIndex(registered)
+	selected := make([]Asset, 0, len(req.Assets)+1)
+	seen := make(map[string]bool)
+	add := func(asset *Asset) {
+		if !seen[asset.ID] {
+			seen[asset.ID] = true
+			selected = append(selected, *asset)
+		}
+	}
+	for _, id := range req.Assets {
+		asset, ok := index.byID[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown asset %q", errInvalidScanTarget, id)
+		}
+		add(asset)
+	}
+	if req.Target != "" {
+		asset, ok := index.byID[req.Target]
+		if !ok {
+			asset = index.lookup(req.Target)
+		}
+		if asset == nil {
+			return nil, fmt.Errorf("%w: %q is not a registered asset; register it under /api/v1/assets", errInvalidScanTarget, req.Target)
+		}
+		add(asset)
+	}
+	return selected, nil
+}
+
+// recordServices stores the services a scan found on an asset
+func (ar *AssetRegistry) recordServices(ctx context.Context, id string, services []DiscoveredService, scanned time.Time) error {
+	asset, err := ar.Asset(ctx, id)
+	if err != nil {
+		return err
+	}
+	asset.Services = services
+	asset.LastScanned = &scanned
+	data, err := json.Marshal(asset)
+	if err != nil {
+		return err
+	}
+	return ar.redis.HSet(ctx, tenantKey(ctx, assetsKey), id, data).Err()
+}
+
+// discoverAssets scans the assets' hostnames and addresses with nmap concurrently, up to the
+// scanner's concurrency, and returns the services found on each. An asset scanned too recently
+// to scan again, or scanned while nmap is unavailable, keeps the services from its last scan.
+func (td *ThreatDetector) discoverAssets(ctx context.Context, assets []Asset, ports string) (map[string][]DiscoveredService, error) {
+	discovered := make(map[string][]DiscoveredService, len(assets))
+	for _, asset := range assets {
+		discovered[asset.ID] = asset.Services
+	}
+	if td.scanner == nil {
+		return discovered, nil
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	for _, asset := range assets {
+		targets := asset.targets()
+		if len(targets) == 0 {
+			continue
+		}
+		assetPorts := ports
+		if assetPorts == "" {
+			assetPorts = asset.Ports
+		}
+
+		wg.Add(1)
+		go func(asset Asset, targets []string) {
+			defer wg.Done()
+			services := make([]DiscoveredService, 0)
+			for _, target := range targets {
+				found, err := td.scanner.Scan(ctx, target, assetPorts)
+				if errors.Is(err, errScanRateLimited) {
+					log.Printf("Using last known services of asset %s: %v", asset.ID, err)
+					return
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("asset %s: %w", asset.ID, err)
+					}
+					mu.Unlock()
+					return
+				}
+				services = append(services, found...)
+			}
+
+			if err := td.assets.recordServices(ctx, asset.ID, services, time.Now().UTC()); err != nil {
+				log.Printf("Failed to record services of asset %s: %v", asset.ID, err)
+			}
+			mu.Lock()
+			discovered[asset.ID] = services
+			mu.Unlock()
+		}(asset, targets)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return discovered, nil
+}
+
+// HTTP Handlers
+func (s *APIServer) listAssetsHandler(c *gin.Context) {
+	assets, err := s.threatDetector.assets.Assets(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if criticality := c.Query("criticality"); criticality != "" {
+		filtered := make([]Asset, 0, len(assets))
+		for _, asset := range assets {
+			if string(asset.Criticality) == criticality {
+				filtered = append(filtered, asset)
+			}
+		}
+		assets = filtered
+	}
+	c.JSON(http.StatusOK, gin.H{"assets": assets, "count": len(assets)})
+}
+
+func (s *APIServer) getAssetHandler(c *gin.Context) {
+	asset, err := s.threatDetector.assets.Asset(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, errAssetNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Asset not found"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, asset)
+	}
+}
+
+func (s *APIServer) createAssetHandler(c *gin.Context) {
+	var asset Asset
+	if err := c.ShouldBindJSON(&asset); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.saveAsset(c, asset, true, http.StatusCreated)
+}
+
+func (s *APIServer) updateAssetHandler(c *gin.Context) {
+	var asset Asset
+	if err := c.ShouldBindJSON(&asset); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if asset.ID != "" && asset.ID != c.Param("id") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "asset id does not match the URL"})
+		return
+	}
+	asset.ID = c.Param("id")
+
+	s.saveAsset(c, asset, false, http.StatusOK)
+}
+
+func (s *APIServer) saveAsset(c *gin.Context, asset Asset, create bool, status int) {
+	saved, err := s.threatDetector.assets.SaveAsset(c.Request.Context(), asset, create)
+	switch {
+	case errors.Is(err, errInvalidAsset):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errAssetNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Asset not found"})
+	case errors.Is(err, errAssetConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(status, saved)
+	}
+}
+
+func (s *APIServer) deleteAssetHandler(c *gin.Context) {
+	found, err := s.threatDetector.assets.DeleteAsset(c.Request.Context(), c.Param("id"))
+	switch {
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case !found:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Asset not found"})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
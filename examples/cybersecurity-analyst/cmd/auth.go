@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// API authentication (API keys, JWT), tenant resolution, and per-client rate limiting
+const (
+	rateLimitKeyPrefix = "ratelimit:" // requests per client per minute
+	clientContextKey   = "client"     // gin context key holding the authenticated APIClient
+	jwtClockSkew       = time.Minute
+)
+
+var (
+	errUnauthenticated = errors.New("a valid API key or bearer token is required")
+	errInvalidToken    = errors.New("invalid bearer token")
+	errTenantForbidden = errors.New("credential is not valid for the requested tenant")
+)
+
+var (
+	apiRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_api_requests_total",
+			Help: "Authenticated API requests by client, route, and status code",
+		},
+		[]string{"client", "route", "code"},
+	)
+
+	apiRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_api_rejections_total",
+			Help: "API requests rejected by client and reason (unauthenticated, tenant, rate_limited, concurrency, payload_too_large)",
+		},
+		[]string{"client", "reason"},
+	)
+
+	apiInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cybersecurity_api_in_flight_requests",
+			Help: "Rate-limited API requests in progress per client",
+		},
+		[]string{"client"},
+	)
+
+	apiRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "cybersecurity_api_request_duration_seconds",
+			Help:    "Rate-limited API request duration per client",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"client"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(apiRequests)
+	prometheus.MustRegister(apiRejections)
+	prometheus.MustRegister(apiInFlight)
+	prometheus.MustRegister(apiRequestDuration)
+}
+
+// APIClient is the caller of a request, identified by its API key or token subject. Without
+// authentication configured, callers are identified by address.
+type APIClient struct {
+	ID        string `json:"id"`
+	Method    string `json:"method"`           // "api_key", "jwt", or "anonymous"
+	RateLimit int    `json:"rate_limit"`       // requests per minute; 0 uses the default
+	Tenant    string `json:"tenant,omitempty"` // tenant the credential is bound to; unbound credentials choose one with X-Tenant-ID
+}
+
+// clientFromContext returns the client set by Authenticate
+func clientFromContext(c *gin.Context) APIClient {
+	if value, ok := c.Get(clientContextKey); ok {
+		if client, ok := value.(APIClient); ok {
+			return client
+		}
+	}
+	return APIClient{ID: "ip:" + c.ClientIP(), Method: "anonymous"}
+}
+
+type apiKeyClient struct {
+	id        string
+	rateLimit int
+	tenant    string
+}
+
+// APIAuth authenticates API clients and limits each client's request rate, concurrency, and
+// payload size. Rate counters live in Redis, so the limit holds across replicas; concurrency is
+// limited per replica.
+type APIAuth struct {
+	redis         *redis.Client
+	tenants       *TenantRegistry
+	keys          map[string]apiKeyClient // SHA-256 of the key -> client
+	jwtSecret     []byte
+	jwtIssuer     string
+	jwtAudience   string
+	rateLimit     int
+	maxConcurrent int
+	maxBodyBytes  int64
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+// parseAPIKeys reads "<client>:<key>[:<requests per minute>]" entries separated by commas
+func parseAPIKeys(value string) (map[string]apiKeyClient, error) {
+	keys := make(map[string]apiKeyClient)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("API key entry for %q must be <client>:<key>[:<requests per minute>]", parts[0])
+		}
+		client := apiKeyClient{id: parts[0]}
+		if len(parts) == 3 {
+			limit, err := strconv.Atoi(parts[2])
+			if err != nil || limit < 1 {
+				return nil, fmt.Errorf("API key entry for %q has an invalid rate limit %q", parts[0], parts[2])
+			}
+			client.rateLimit = limit
+		}
+		sum := sha256.Sum256([]byte(parts[1]))
+		keys[hex.EncodeToString(sum[:])] = client
+	}
+	return keys, nil
+}
+
+// parseAPIKeyTenants reads "<client>=<tenant>" entries separated by commas
+func parseAPIKeyTenants(value string) (map[string]string, error) {
+	tenants := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		client, tenant, ok := strings.Cut(entry, "=")
+		if !ok || client == "" || !tenantIDPattern.MatchString(tenant) {
+			return nil, fmt.Errorf("API key tenant entry %q must be <client>=<tenant>", entry)
+		}
+		tenants[client] = tenant
+	}
+	return tenants, nil
+}
+
+func NewAPIAuth(redisClient *redis.Client, tenants *TenantRegistry, apiKeys, apiKeyTenants, jwtSecret, jwtIssuer, jwtAudience string, rateLimit, maxConcurrent, maxBodyMB int) (*APIAuth, error) {
+	keys, err := parseAPIKeys(apiKeys)
+	if err != nil {
+		return nil, err
+	}
+	bindings, err := parseAPIKeyTenants(apiKeyTenants)
+	if err != nil {
+		return nil, err
+	}
+	clients := make(map[string]bool)
+	for hash, client := range keys {
+		client.tenant = bindings[client.id]
+		keys[hash] = client
+		clients[client.id] = true
+	}
+	for client := range bindings {
+		if !clients[client] {
+			return nil, fmt.Errorf("API_KEY_TENANTS names %q, which has no API key", client)
+		}
+	}
+
+	auth := &APIAuth{
+		redis:         redisClient,
+		tenants:       tenants,
+		keys:          keys,
+		jwtSecret:     []byte(jwtSecret),
+		jwtIssuer:     jwtIssuer,
+		jwtAudience:   jwtAudience,
+		rateLimit:     rateLimit,
+		maxConcurrent: maxConcurrent,
+		maxBodyBytes:  int64(maxBodyMB) << 20,
+		inFlight:      make(map[string]int),
+	}
+	if !auth.Enabled() {
+		log.Printf("Warning: API_KEYS and JWT_SECRET are unset; API clients are not authenticated")
+	}
+	return auth, nil
+}
+
+// Enabled reports whether API keys or JWT validation are configured
+func (a *APIAuth) Enabled() bool {
+	return len(a.keys) > 0 || len(a.jwtSecret) > 0
+}
+
+// Authenticate identifies the client from an X-API-Key header or an Authorization bearer token,
+// which is either an API key or an HS256 JWT, and scopes the request to its tenant. Requests are
+// let through anonymously while authentication is not configured.
+func (a *APIAuth) Authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, err := a.identify(c.Request.Header)
+		if err != nil {
+			apiRejections.WithLabelValues("unknown", "unauthenticated").Inc()
+			c.Header("WWW-Authenticate", `Bearer realm="`+config.AppName+`"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		label := client.ID
+		if client.Method == "anonymous" {
+			client.ID = "ip:" + c.ClientIP()
+			label = "anonymous"
+		}
+
+		tenant, err := a.tenant(c.Request.Header, client)
+		if err != nil {
+			apiRejections.WithLabelValues(label, "tenant").Inc()
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(clientContextKey, client)
+		c.Request = c.Request.WithContext(withTenant(c.Request.Context(), tenant))
+		c.Next()
+	}
+}
+
+// tenant resolves the request's tenant: the one the credential is bound to, otherwise the
+// X-Tenant-ID header, otherwise the default tenant
+func (a *APIAuth) tenant(header http.Header, client APIClient) (string, error) {
+	requested := strings.TrimSpace(header.Get(tenantHeader))
+	tenant := client.Tenant
+	switch {
+	case tenant != "" && requested != "" && requested != tenant:
+		return "", errTenantForbidden
+	case tenant == "" && requested != "":
+		tenant = requested
+	case tenant == "":
+		tenant = defaultTenant
+	}
+	if !a.tenants.Exists(tenant) {
+		return "", fmt.Errorf("%w: %s", errTenantNotFound, tenant)
+	}
+	return tenant, nil
+}
+
+func (a *APIAuth) identify(header http.Header) (APIClient, error) {
+	if !a.Enabled() {
+		return APIClient{Method: "anonymous"}, nil
+	}
+
+	credential := header.Get("X-API-Key")
+	if credential == "" {
+		scheme, token, ok := strings.Cut(header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return APIClient{}, errUnauthenticated
+		}
+		credential = strings.TrimSpace(token)
+	}
+
+	sum := sha256.Sum256([]byte(credential))
+	if client, ok := a.keys[hex.EncodeToString(sum[:])]; ok {
+		return APIClient{ID: client.id, Method: "api_key", RateLimit: client.rateLimit, Tenant: client.tenant}, nil
+	}
+	if len(a.jwtSecret) > 0 && strings.Count(credential, ".") == 2 {
+		return a.verifyJWT(credential, time.Now())
+	}
+	return APIClient{}, errUnauthenticated
+}
+
+// jwtClaims holds the registered claims checked here, plus an optional per-client rate limit and
+// the tenant the token is bound to
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"` // a string or an array of strings
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	RateLimit int             `json:"rate_limit"`
+	Tenant    string          `json:"tenant"`
+}
+
+// verifyJWT checks an HS256 token's signature, expiry, issuer, and audience. The subject names
+// the client; a tenant claim binds the token to that tenant.
+func (a *APIAuth) verifyJWT(token string, now time.Time) (APIClient, error) {
+	parts := strings.Split(token, ".")
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return APIClient{}, errInvalidToken
+	}
+	var head struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &head); err != nil || head.Alg != "HS256" {
+		return APIClient{}, fmt.Errorf("%w: only HS256 tokens are accepted", errInvalidToken)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return APIClient{}, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, a.jwtSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if subtle.ConstantTimeCompare(signature, mac.Sum(nil)) != 1 {
+		return APIClient{}, fmt.Errorf("%w: bad signature", errInvalidToken)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return APIClient{}, errInvalidToken
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return APIClient{}, errInvalidToken
+	}
+	switch {
+	case claims.Subject == "":
+		return APIClient{}, fmt.Errorf("%w: sub claim is required", errInvalidToken)
+	case claims.ExpiresAt == nil:
+		return APIClient{}, fmt.Errorf("%w: exp claim is required", errInvalidToken)
+	case now.Add(-jwtClockSkew).After(time.Unix(int64(*claims.ExpiresAt), 0)):
+		return APIClient{}, fmt.Errorf("%w: token expired", errInvalidToken)
+	case claims.NotBefore != nil && now.Add(jwtClockSkew).Before(time.Unix(int64(*claims.NotBefore), 0)):
+		return APIClient{}, fmt.Errorf("%w: token not yet valid", errInvalidToken)
+	case a.jwtIssuer != "" && claims.Issuer != a.jwtIssuer:
+		return APIClient{}, fmt.Errorf("%w: unexpected issuer", errInvalidToken)
+	case a.jwtAudience != "" && !jwtAudienceContains(claims.Audience, a.jwtAudience):
+		return APIClient{}, fmt.Errorf("%w: unexpected audience", errInvalidToken)
+	case claims.Tenant != "" && !tenantIDPattern.MatchString(claims.Tenant):
+		return APIClient{}, fmt.Errorf("%w: invalid tenant claim", errInvalidToken)
+	}
+	return APIClient{ID: claims.Subject, Method: "jwt", RateLimit: claims.RateLimit, Tenant: claims.Tenant}, nil
+}
+
+func jwtAudienceContains(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		for _, value := range list {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Limit enforces the client's per-minute rate, its concurrent requests, and the body size, and
+// records per-client metrics. It must run after Authenticate.
+func (a *APIAuth) Limit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := clientFromContext(c)
+		label := client.ID // anonymous callers are limited by address but share a metrics label
+		if client.Method == "anonymous" {
+			label = "anonymous"
+		}
+
+		if c.Request.ContentLength > a.maxBodyBytes {
+			apiRejections.WithLabelValues(label, "payload_too_large").Inc()
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("request body exceeds %d MB", a.maxBodyBytes>>20)})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, a.maxBodyBytes)
+
+		limit := client.RateLimit
+		if limit <= 0 {
+			limit = a.rateLimit
+		}
+		if limit > 0 {
+			count, reset := a.count(c.Request.Context(), client.ID)
+			c.Header("X-RateLimit-Limit", strconv.Itoa(limit))
+			c.Header("X-RateLimit-Remaining", strconv.Itoa(max(limit-int(count), 0)))
+			c.Header("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+			if count > int64(limit) {
+				apiRejections.WithLabelValues(label, "rate_limited").Inc()
+				c.Header("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+				c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("rate limit of %d requests per minute exceeded", limit)})
+				return
+			}
+		}
+
+		if !a.acquire(client.ID, label) {
+			apiRejections.WithLabelValues(label, "concurrency").Inc()
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("at most %d concurrent requests per client", a.maxConcurrent)})
+			return
+		}
+		defer a.release(client.ID, label)
+
+		start := time.Now()
+		c.Next()
+		apiRequestDuration.WithLabelValues(label).Observe(time.Since(start).Seconds())
+		apiRequests.WithLabelValues(label, c.FullPath(), strconv.Itoa(c.Writer.Status())).Inc()
+	}
+}
+
+// count increments the client's counter for the current minute and returns it with the time
+// the window resets. Requests are let through when Redis is unavailable.
+func (a *APIAuth) count(ctx context.Context, clientID string) (int64, time.Time) {
+	now := time.Now().UTC()
+	window := now.Truncate(time.Minute)
+	key := rateLimitKeyPrefix + clientID + ":" + window.Format("200601021504")
+
+	pipe := a.redis.TxPipeline()
+	count := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, 2*time.Minute)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Rate limit not enforced for %s: %v", clientID, err)
+		return 0, window.Add(time.Minute)
+	}
+	return count.Val(), window.Add(time.Minute)
+}
+
+func (a *APIAuth) acquire(clientID, label string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.maxConcurrent > 0 && a.inFlight[clientID] >= a.maxConcurrent {
+		return false
+	}
+	a.inFlight[clientID]++
+	apiInFlight.WithLabelValues(label).Add(1)
+	return true
+}
+
+func (a *APIAuth) release(clientID, label string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inFlight[clientID]--
+	apiInFlight.WithLabelValues(label).Sub(1)
+	if a.inFlight[clientID] <= 0 {
+		delete(a.inFlight, clientID)
+	}
+}
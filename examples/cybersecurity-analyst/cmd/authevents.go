@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Authentication event analysis: brute force and credential stuffing over sliding windows
+const (
+	authFailuresKeyPrefix   = "auth:failures:" // sorted set of failed logins per source IP and username, scored by time
+	authAccountsKeyPrefix   = "auth:accounts:" // sorted set of usernames failing from a source IP, scored by latest failure
+	authRaisedKeyPrefix     = "auth:raised:"   // marks a window that has already raised an indicator
+	maxAuthFailures         = 1000             // failures kept per source IP and username
+	maxAuthAccounts         = 10000            // usernames kept per source IP
+	maxAuthEvidenceAccounts = 10
+	maxAuthLogEvents        = 10000 // events per request in a log source's own format
+)
+
+var errInvalidAuthLog = errors.New("invalid auth log")
+
+var authEventsProcessed = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cybersecurity_auth_events_processed_total",
+		Help: "Total authentication events evaluated for brute force, by outcome",
+	},
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(authEventsProcessed)
+}
+
+// AuthEvent is one login attempt reported by an identity provider, VPN, or host
+type AuthEvent struct {
+	Timestamp  time.Time `json:"timestamp"`
+	SourceIP   string    `json:"source_ip" binding:"required"`
+	Username   string    `json:"username" binding:"required"`
+	Success    bool      `json:"success"`
+	Service    string    `json:"service,omitempty"` // e.g. "ssh", "vpn", "okta"
+	DestIP     string    `json:"dest_ip,omitempty"`
+	Device     string    `json:"device,omitempty"`     // device ID, hostname, or client OS and browser
+	Privileged bool      `json:"privileged,omitempty"` // the session was granted administrative rights
+}
+
+// windowsSecurityEvent is a Windows Security log record as JSON, e.g. from Winlogbeat or
+// NXLog, with the event's data fields under EventData
+type windowsSecurityEvent struct {
+	EventID     int       `json:"EventID"`
+	TimeCreated time.Time `json:"TimeCreated"`
+	EventData   struct {
+		TargetUserName   string `json:"TargetUserName"`
+		TargetDomainName string `json:"TargetDomainName"`
+		TargetLogonID    string `json:"TargetLogonId"`
+		SubjectUserName  string `json:"SubjectUserName"`
+		SubjectLogonID   string `json:"SubjectLogonId"`
+		IPAddress        string `json:"IpAddress"`
+		WorkstationName  string `json:"WorkstationName"`
+		LogonType        string `json:"LogonType"`
+	} `json:"EventData"`
+}
+
+// oktaSystemLogEvent is an event of the Okta System Log API
+type oktaSystemLogEvent struct {
+	Published time.Time `json:"published"`
+	EventType string    `json:"eventType"`
+	Actor     struct {
+		AlternateID string `json:"alternateId"`
+	} `json:"actor"`
+	Client struct {
+		IPAddress string `json:"ipAddress"`
+		Device    string `json:"device"`
+		UserAgent struct {
+			OS      string `json:"os"`
+			Browser string `json:"browser"`
+		} `json:"userAgent"`
+	} `json:"client"`
+	Outcome struct {
+		Result string `json:"result"`
+	} `json:"outcome"`
+}
+
+// Interactive, network, unlock, RDP, and cached logons; batch and service logons are not users
+var windowsLogonTypes = map[string]bool{"2": true, "3": true, "7": true, "10": true, "11": true}
+
+// parseWindowsEvents reads successful (4624) and failed (4625) logons. A 4672 record, special
+// privileges assigned, marks the logon with the same logon ID as privileged.
+func parseWindowsEvents(records []windowsSecurityEvent) []AuthEvent {
+	events := make([]AuthEvent, 0, len(records))
+	logons := make(map[string]int) // logon ID -> index into events
+	privileged := make(map[string]bool)
+	for _, record := range records {
+		data := record.EventData
+		switch record.EventID {
+		case 4624, 4625:
+			user := data.TargetUserName
+			if user == "" || user == "-" || strings.HasSuffix(user, "$") || !windowsLogonTypes[data.LogonType] {
+				continue
+			}
+			if data.TargetDomainName != "" && data.TargetDomainName != "-" {
+				user = data.TargetDomainName + `\` + user
+			}
+			source := data.IPAddress
+			if source == "-" || source == "::1" {
+				source = "127.0.0.1"
+			}
+			event := AuthEvent{
+				Timestamp: record.TimeCreated,
+				SourceIP:  source,
+				Username:  user,
+				Success:   record.EventID == 4624,
+				Service:   "windows",
+				Device:    data.WorkstationName,
+			}
+			if event.Device == "-" {
+				event.Device = ""
+			}
+			if event.Success && data.TargetLogonID != "" {
+				logons[data.TargetLogonID] = len(events)
+			}
+			events = append(events, event)
+		case 4672:
+			if data.SubjectLogonID != "" {
+				privileged[data.SubjectLogonID] = true
+			}
+		}
+	}
+	for id := range privileged {
+		if i, ok := logons[id]; ok {
+			events[i].Privileged = true
+		}
+	}
+	return events
+}
+
+// parseOktaEvents reads sign-ins (user.session.start) and administrator console access
+// (user.session.access_admin_app), which counts as a privileged login
+func parseOktaEvents(records []oktaSystemLogEvent) []AuthEvent {
+	events := make([]AuthEvent, 0, len(records))
+	for _, record := range records {
+		if record.EventType != "user.session.start" && record.EventType != "user.session.access_admin_app" {
+			continue
+		}
+		device := strings.TrimSpace(strings.Join([]string{record.Client.Device, record.Client.UserAgent.OS, record.Client.UserAgent.Browser}, " "))
+		events = append(events, AuthEvent{
+			Timestamp:  record.Published,
+			SourceIP:   record.Client.IPAddress,
+			Username:   record.Actor.AlternateID,
+			Success:    record.Outcome.Result == "SUCCESS",
+			Service:    "okta",
+			Device:     device,
+			Privileged: record.EventType == "user.session.access_admin_app",
+		})
+	}
+	return events
+}
+
+// parseAuthLog normalizes a JSON array or JSON lines of a log source's own records
+func parseAuthLog(source string, data []byte) ([]AuthEvent, error) {
+	records, err := jsonRecords(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidAuthLog, err)
+	}
+	var events []AuthEvent
+	switch source {
+	case "windows":
+		parsed := make([]windowsSecurityEvent, len(records))
+		for i, record := range records {
+			if err := json.Unmarshal(record, &parsed[i]); err != nil {
+				return nil, fmt.Errorf("%w: record %d: %v", errInvalidAuthLog, i+1, err)
+			}
+		}
+		events = parseWindowsEvents(parsed)
+	case "okta":
+		parsed := make([]oktaSystemLogEvent, len(records))
+		for i, record := range records {
+			if err := json.Unmarshal(record, &parsed[i]); err != nil {
+				return nil, fmt.Errorf("%w: record %d: %v", errInvalidAuthLog, i+1, err)
+			}
+		}
+		events = parseOktaEvents(parsed)
+	default:
+		return nil, fmt.Errorf("%w: unknown source %q", errInvalidAuthLog, source)
+	}
+
+	valid := events[:0]
+	for _, event := range events {
+		if strings.TrimSpace(event.Username) == "" || net.ParseIP(event.SourceIP) == nil {
+			continue
+		}
+		if event.Timestamp.IsZero() {
+			event.Timestamp = time.Now().UTC()
+		}
+		valid = append(valid, event)
+	}
+	return valid, nil
+}
+
+// AuthWindows counts failed logins in Redis so windows span batches, replicas, and restarts
+type AuthWindows struct {
+	redis               *redis.Client
+	window              time.Duration
+	bruteForceThreshold int // failures for one username from one source IP
+	stuffingThreshold   int // distinct usernames failing from one source IP
+	sequence            atomic.Uint64
+}
+
+func NewAuthWindows(redisClient *redis.Client, window time.Duration, bruteForceThreshold, stuffingThreshold int) *AuthWindows {
+	return &AuthWindows{
+		redis:               redisClient,
+		window:              window,
+		bruteForceThreshold: bruteForceThreshold,
+		stuffingThreshold:   stuffingThreshold,
+	}
+}
+
+type authPair struct {
+	ip   string
+	user string
+}
+
+type authCandidate struct {
+	marker    string
+	indicator ThreatIndicator
+}
+
+// Scores are Unix milliseconds; nanoseconds exceed float64 precision
+func authScore(t time.Time) float64 {
+	return float64(t.UnixMilli())
+}
+
+func authTime(score float64) time.Time {
+	return time.UnixMilli(int64(score)).UTC()
+}
+
+func authScoreString(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+func (aw *AuthWindows) failuresKey(ctx context.Context, pair authPair) string {
+	return tenantKey(ctx, authFailuresKeyPrefix+pair.ip+":"+pair.user)
+}
+
+func (aw *AuthWindows) accountsKey(ctx context.Context, ip string) string {
+	return tenantKey(ctx, authAccountsKeyPrefix+ip)
+}
+
+// densestWindow returns the inclusive index range of the most entries that fit within the
+// window; times must be sorted. The range is empty (end < start) when there are no entries.
+func densestWindow(times []time.Time, window time.Duration) (int, int) {
+	bestStart, bestEnd := 0, -1
+	start := 0
+	for end := range times {
+		for times[end].Sub(times[start]) > window {
+			start++
+		}
+		if end-start > bestEnd-bestStart {
+			bestStart, bestEnd = start, end
+		}
+	}
+	return bestStart, bestEnd
+}
+
+func authSpan(first, last time.Time) string {
+	return last.Sub(first).Round(time.Second).String()
+}
+
+// Evaluate records failed logins and returns indicators for source IPs that crossed a threshold
+// within the window. Each source, account, and kind raises at most one indicator per window.
+func (aw *AuthWindows) Evaluate(ctx context.Context, events []AuthEvent) ([]ThreatIndicator, error) {
+	threats := make([]ThreatIndicator, 0)
+
+	sorted := make([]AuthEvent, 0, len(events))
+	for _, event := range events {
+		event.SourceIP = strings.TrimSpace(event.SourceIP)
+		event.Username = strings.ToLower(strings.TrimSpace(event.Username))
+		if event.SourceIP == "" || event.Username == "" {
+			continue
+		}
+		sorted = append(sorted, event)
+	}
+	if len(sorted) == 0 {
+		return threats, nil
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Timestamp.Before(sorted[j].Timestamp) })
+
+	// Record failures, then trim each window to the newest failure and read it back
+	pipe := aw.redis.Pipeline()
+	latest := make(map[authPair]AuthEvent)   // newest failure per source IP and username
+	latestByIP := make(map[string]time.Time) // newest failure per source IP
+	logins := make([]AuthEvent, 0)
+	for _, event := range sorted {
+		if event.Success {
+			logins = append(logins, event)
+			authEventsProcessed.WithLabelValues("success").Inc()
+			continue
+		}
+		authEventsProcessed.WithLabelValues("failure").Inc()
+
+		pair := authPair{ip: event.SourceIP, user: event.Username}
+		member := fmt.Sprintf("%d-%d", event.Timestamp.UnixNano(), aw.sequence.Add(1))
+		pipe.ZAdd(ctx, aw.failuresKey(ctx, pair), &redis.Z{Score: authScore(event.Timestamp), Member: member})
+		pipe.ZAdd(ctx, aw.accountsKey(ctx, event.SourceIP), &redis.Z{Score: authScore(event.Timestamp), Member: event.Username})
+		latest[pair] = event
+		latestByIP[event.SourceIP] = event.Timestamp
+	}
+
+	failures := make(map[authPair]*redis.ZSliceCmd)
+	for pair, event := range latest {
+		key := aw.failuresKey(ctx, pair)
+		pipe.ZRemRangeByScore(ctx, key, "-inf", "("+authScoreString(event.Timestamp.Add(-aw.window)))
+		pipe.ZRemRangeByRank(ctx, key, 0, -(maxAuthFailures + 1))
+		pipe.Expire(ctx, key, aw.window)
+		failures[pair] = pipe.ZRangeWithScores(ctx, key, 0, -1)
+	}
+	accounts := make(map[string]*redis.ZSliceCmd)
+	for ip, at := range latestByIP {
+		key := aw.accountsKey(ctx, ip)
+		pipe.ZRemRangeByScore(ctx, key, "-inf", "("+authScoreString(at.Add(-aw.window)))
+		pipe.ZRemRangeByRank(ctx, key, 0, -(maxAuthAccounts + 1))
+		pipe.Expire(ctx, key, aw.window)
+		accounts[ip] = pipe.ZRangeWithScores(ctx, key, 0, -1)
+	}
+	// Successful logins are checked against the failures that preceded them
+	for _, event := range logins {
+		pair := authPair{ip: event.SourceIP, user: event.Username}
+		if _, ok := failures[pair]; !ok {
+			failures[pair] = pipe.ZRangeWithScores(ctx, aw.failuresKey(ctx, pair), 0, -1)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	candidates := make([]authCandidate, 0)
+	failureTimes := make(map[authPair][]time.Time, len(failures))
+	for pair, cmd := range failures {
+		entries := cmd.Val()
+		times := make([]time.Time, len(entries))
+		for i, entry := range entries {
+			times[i] = authTime(entry.Score)
+		}
+		failureTimes[pair] = times
+	}
+
+	// Brute force: repeated failures for one account from one source
+	for pair, event := range latest {
+		times := failureTimes[pair]
+		start, end := densestWindow(times, aw.window)
+		count := end - start + 1
+		if count < aw.bruteForceThreshold {
+			continue
+		}
+		first, last := times[start], times[end]
+		evidence := []string{
+			fmt.Sprintf("%d failed logins as %s from %s within %s", count, pair.user, pair.ip, authSpan(first, last)),
+			fmt.Sprintf("First failure %s, last failure %s", first.Format(time.RFC3339), last.Format(time.RFC3339)),
+		}
+		if event.Service != "" {
+			evidence = append(evidence, "Service: "+event.Service)
+		}
+		candidates = append(candidates, authCandidate{
+			marker: "brute:" + pair.ip + ":" + pair.user,
+			indicator: ThreatIndicator{
+				Type:        Brute,
+				Severity:    High,
+				Confidence:  0.85,
+				Description: "Brute force authentication",
+				SourceIP:    pair.ip,
+				DestIP:      event.DestIP,
+				MITREAttack: "T1110.001",
+				Evidence:    evidence,
+			},
+		})
+	}
+
+	// Credential stuffing: many accounts failing from one source
+	for ip, cmd := range accounts {
+		entries := cmd.Val()
+		times := make([]time.Time, len(entries))
+		for i, entry := range entries {
+			times[i] = authTime(entry.Score)
+		}
+		start, end := densestWindow(times, aw.window)
+		count := end - start + 1
+		if count < aw.stuffingThreshold {
+			continue
+		}
+		first, last := times[start], times[end]
+		users := make([]string, 0, maxAuthEvidenceAccounts)
+		for _, entry := range entries[start : start+min(count, maxAuthEvidenceAccounts)] {
+			users = append(users, fmt.Sprint(entry.Member))
+		}
+		listed := "Accounts: " + strings.Join(users, ", ")
+		if count > len(users) {
+			listed += fmt.Sprintf(" and %d more", count-len(users))
+		}
+		candidates = append(candidates, authCandidate{
+			marker: "stuffing:" + ip,
+			indicator: ThreatIndicator{
+				Type:        Brute,
+				Severity:    High,
+				Confidence:  0.8,
+				Description: "Credential stuffing",
+				SourceIP:    ip,
+				MITREAttack: "T1110.004",
+				Evidence: []string{
+					fmt.Sprintf("%d accounts failed to log in from %s within %s", count, ip, authSpan(first, last)),
+					fmt.Sprintf("First failure %s, last failure %s", first.Format(time.RFC3339), last.Format(time.RFC3339)),
+					listed,
+				},
+			},
+		})
+	}
+
+	// A success following a brute-force run suggests the password was guessed
+	for _, event := range logins {
+		pair := authPair{ip: event.SourceIP, user: event.Username}
+		count := 0
+		var first time.Time
+		for _, at := range failureTimes[pair] {
+			if at.After(event.Timestamp) || event.Timestamp.Sub(at) > aw.window {
+				continue
+			}
+			if count == 0 {
+				first = at
+			}
+			count++
+		}
+		if count < aw.bruteForceThreshold {
+			continue
+		}
+		evidence := []string{
+			fmt.Sprintf("Login as %s from %s succeeded at %s after %d failures within %s", pair.user, pair.ip, event.Timestamp.Format(time.RFC3339), count, authSpan(first, event.Timestamp)),
+		}
+		if event.Service != "" {
+			evidence = append(evidence, "Service: "+event.Service)
+		}
+		candidates = append(candidates, authCandidate{
+			marker: "compromise:" + pair.ip + ":" + pair.user,
+			indicator: ThreatIndicator{
+				Type:        Brute,
+				Severity:    Critical,
+				Confidence:  0.9,
+				Description: "Successful login after brute force",
+				SourceIP:    pair.ip,
+				DestIP:      event.DestIP,
+				MITREAttack: "T1078",
+				Evidence:    evidence,
+			},
+		})
+	}
+
+	if len(candidates) == 0 {
+		return threats, nil
+	}
+
+	// Claim each window so later batches extending it do not raise it again
+	pipe = aw.redis.Pipeline()
+	claims := make([]*redis.BoolCmd, len(candidates))
+	for i, candidate := range candidates {
+		claims[i] = pipe.SetNX(ctx, tenantKey(ctx, authRaisedKeyPrefix+candidate.marker), time.Now().Unix(), aw.window)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	for i, candidate := range candidates {
+		if claims[i].Val() {
+			threats = append(threats, candidate.indicator)
+		}
+	}
+
+	return threats, nil
+}
+
+// HTTP Handlers
+type AuthIngestRequest struct {
+	ScanID       string      `json:"scan_id"`
+	Target       string      `json:"target"`
+	Events       []AuthEvent `json:"events" binding:"required,min=1,dive"`
+	DeepAnalysis bool        `json:"deep_analysis"`
+}
+
+func (s *APIServer) ingestAuthHandler(c *gin.Context) {
+	var body AuthIngestRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req := ThreatDetectionRequest{
+		ScanID:       body.ScanID,
+		ScanType:     "auth",
+		Target:       body.Target,
+		AuthEvents:   body.Events,
+		DeepAnalysis: body.DeepAnalysis,
+	}
+	if req.ScanID == "" {
+		req.ScanID = fmt.Sprintf("auth_%d", time.Now().UnixNano())
+	}
+	for i := range req.AuthEvents {
+		if req.AuthEvents[i].Timestamp.IsZero() {
+			req.AuthEvents[i].Timestamp = time.Now().UTC()
+		}
+	}
+
+	response, err := s.threatDetector.AnalyzeTraffic(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *APIServer) ingestAuthLogHandler(c *gin.Context) {
+	source := c.Param("source")
+	if source != "windows" && source != "okta" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "source must be windows or okta"})
+		return
+	}
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	events, err := parseAuthLog(source, data)
+	switch {
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case len(events) > maxAuthLogEvents:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d events per request", maxAuthLogEvents)})
+		return
+	}
+
+	req := ThreatDetectionRequest{
+		ScanID:       c.Query("scan_id"),
+		ScanType:     "auth",
+		AuthEvents:   events,
+		DeepAnalysis: c.Query("deep_analysis") == "true",
+	}
+	if req.ScanID == "" {
+		req.ScanID = fmt.Sprintf("auth_%d", time.Now().UnixNano())
+	}
+
+	response, err := s.threatDetector.AnalyzeTraffic(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
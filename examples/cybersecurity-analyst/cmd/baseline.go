@@ -0,0 +1,602 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Behavioral baselines (per-host traffic profiles)
+const (
+	baselineKeyPrefix      = "baseline:" // HostBaseline JSON per host
+	baselineTTL            = 30 * 24 * time.Hour
+	baselineFlushInterval  = time.Minute
+	baselineIdleEviction   = 2 * time.Hour // profiles idle this long are dropped from memory once saved
+	maxBaselineHosts       = 10000
+	maxBaselinePorts       = 256
+	baselineMemory         = 14      // samples per slot; older hours fade out with weight 1/14
+	baselineMinHours       = 24      // hours observed before anomalies are raised
+	baselineMinSlotSamples = 7       // samples before an hour-of-day slot is trusted over the overall profile
+	baselineMaxBackfill    = 7 * 24  // idle hours recorded as zero traffic when a host reappears
+	baselineMinBytes       = 5 << 20 // volume anomalies need at least this much traffic in the hour
+	baselineQuietBytes     = 1 << 20 // traffic during a normally idle hour that counts as activity
+	baselineQuietRate      = 0.05    // hour-of-day slots active less often than this are normally idle
+	baselineEphemeralPorts = 49152   // destination ports from here up are ephemeral and not learned
+)
+
+var (
+	baselineHosts = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cybersecurity_baseline_hosts",
+			Help: "Host baselines held in memory",
+		},
+	)
+
+	baselineAnomalies = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_baseline_anomalies_total",
+			Help: "Deviations from host baselines by kind (volume, new_port, unusual_hour)",
+		},
+		[]string{"kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(baselineHosts)
+	prometheus.MustRegister(baselineAnomalies)
+}
+
+// HostBaseline is the learned traffic profile of one host. Hourly byte counts feed an
+// exponentially weighted mean and variance per UTC hour of day, so the profile follows gradual
+// change while a sudden deviation stands out.
+type HostBaseline struct {
+	Host          string           `json:"host"`
+	HoursObserved int              `json:"hours_observed"`
+	Overall       BaselineSlot     `json:"overall"`
+	Hours         [24]BaselineSlot `json:"hours"` // by UTC hour of day
+	Ports         map[int]int64    `json:"ports"` // destination port -> last seen, Unix seconds
+
+	// The hour being accumulated; it is learned from once the next hour begins
+	CurrentHour          int64            `json:"current_hour"`
+	CurrentBytes         uint64           `json:"current_bytes"`
+	CurrentExternalBytes uint64           `json:"current_external_bytes"`
+	Alerted              map[string]int64 `json:"alerted,omitempty"` // anomaly kind -> hour it was last raised
+
+	dirty    bool
+	lastSeen time.Time
+}
+
+type BaselineSlot struct {
+	Samples    int     `json:"samples"`
+	MeanBytes  float64 `json:"mean_bytes"`
+	VarBytes   float64 `json:"var_bytes"`
+	ActiveRate float64 `json:"active_rate"` // share of hours with any traffic
+}
+
+func (s *BaselineSlot) add(bytes float64) {
+	s.Samples++
+	alpha := math.Max(1/float64(s.Samples), 1.0/baselineMemory)
+	delta := bytes - s.MeanBytes
+	s.MeanBytes += alpha * delta
+	s.VarBytes = (1 - alpha) * (s.VarBytes + alpha*delta*delta)
+
+	active := 0.0
+	if bytes > 0 {
+		active = 1
+	}
+	s.ActiveRate += alpha * (active - s.ActiveRate)
+}
+
+func newHostBaseline(host string) *HostBaseline {
+	return &HostBaseline{Host: host, Ports: make(map[int]int64), Alerted: make(map[string]int64)}
+}
+
+// roll learns from the hours completed before now, counting hours without traffic as zero
+func (b *HostBaseline) roll(now time.Time) {
+	hour := now.Truncate(time.Hour).Unix()
+	if b.CurrentHour == 0 {
+		b.CurrentHour = hour
+		return
+	}
+	if hour <= b.CurrentHour {
+		return
+	}
+
+	b.learn(b.CurrentHour, float64(b.CurrentBytes))
+	idle := int((hour-b.CurrentHour)/3600) - 1
+	if idle > baselineMaxBackfill {
+		idle = baselineMaxBackfill
+	}
+	for i := idle; i > 0; i-- {
+		b.learn(hour-int64(i)*3600, 0)
+	}
+
+	b.CurrentHour = hour
+	b.CurrentBytes = 0
+	b.CurrentExternalBytes = 0
+}
+
+func (b *HostBaseline) learn(hour int64, bytes float64) {
+	b.Overall.add(bytes)
+	b.Hours[time.Unix(hour, 0).UTC().Hour()].add(bytes)
+	b.HoursObserved++
+}
+
+// hostActivity is what one host sent during an observation window
+type hostActivity struct {
+	bytes         uint64
+	externalBytes uint64 // sent to public addresses
+	ports         map[int]struct{}
+}
+
+// packetActivity summarizes packets by private source address. Replies from well-known ports
+// and connections to ephemeral ports say nothing about the services a host uses, so their
+// ports are not counted.
+func packetActivity(packets []NetworkPacket) map[string]*hostActivity {
+	activity := make(map[string]*hostActivity)
+	for _, packet := range packets {
+		if !isPrivateIP(packet.SourceIP) {
+			continue
+		}
+		act, ok := activity[packet.SourceIP]
+		if !ok {
+			act = &hostActivity{ports: make(map[int]struct{})}
+			activity[packet.SourceIP] = act
+		}
+
+		act.bytes += uint64(packet.PayloadSize)
+		if packet.DestIP != "" && !isPrivateIP(packet.DestIP) {
+			act.externalBytes += uint64(packet.PayloadSize)
+		}
+		if packet.DestPort > 0 && packet.DestPort < baselineEphemeralPorts && !(packet.SourcePort < 1024 && packet.DestPort >= 1024) {
+			act.ports[packet.DestPort] = struct{}{}
+		}
+	}
+	return activity
+}
+
+// activity summarizes the window's flows by private source address
+func (a *flowAggregate) activity() map[string]*hostActivity {
+	activity := make(map[string]*hostActivity)
+	for ip, src := range a.sources {
+		if src.external {
+			continue
+		}
+		act := &hostActivity{ports: make(map[int]struct{})}
+		for dest, bytes := range src.bytesTo {
+			act.bytes += bytes
+			if !isPrivateIP(dest) {
+				act.externalBytes += bytes
+			}
+		}
+		for port := range src.ports {
+			if port > 0 && port < baselineEphemeralPorts {
+				act.ports[port] = struct{}{}
+			}
+		}
+		activity[ip] = act
+	}
+	return activity
+}
+
+// BaselineEngine learns host baselines from live capture and flow collection and flags traffic
+// that deviates from them. Profiles are kept in memory and saved to Redis every minute, so they
+// survive restarts; replicas sharing a Redis instance each learn from the traffic they see.
+type BaselineEngine struct {
+	redis       *redis.Client
+	sensitivity float64 // standard deviations above the mean before volume is anomalous
+
+	mu       sync.Mutex
+	profiles map[string]*HostBaseline
+	full     bool // maxBaselineHosts was reached; logged once
+}
+
+func NewBaselineEngine(redisClient *redis.Client, sensitivity float64) *BaselineEngine {
+	if sensitivity <= 0 {
+		sensitivity = 3
+	}
+	return &BaselineEngine{
+		redis:       redisClient,
+		sensitivity: sensitivity,
+		profiles:    make(map[string]*HostBaseline),
+	}
+}
+
+// Start saves changed profiles every minute until ctx is cancelled, then saves them once more
+func (be *BaselineEngine) Start(ctx context.Context) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(baselineFlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				be.flush(flushCtx)
+				cancel()
+				return
+			case <-ticker.C:
+				be.flush(ctx)
+			}
+		}
+	}()
+	return &wg
+}
+
+// Observe learns from a window of activity and returns the anomalies it contains. Each kind of
+// anomaly is raised at most once per host and hour; each new port is raised once.
+func (be *BaselineEngine) Observe(ctx context.Context, activity map[string]*hostActivity) []ThreatIndicator {
+	threats := make([]ThreatIndicator, 0)
+	if len(activity) == 0 {
+		return threats
+	}
+	be.load(ctx, activity)
+	now := time.Now()
+
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	for host, act := range activity {
+		profile, ok := be.profiles[host]
+		if !ok {
+			continue
+		}
+		profile.roll(now)
+		profile.CurrentBytes += act.bytes
+		profile.CurrentExternalBytes += act.externalBytes
+
+		for _, threat := range be.check(profile, now, profile.CurrentBytes, profile.CurrentExternalBytes, act.ports) {
+			kind := threat.Evidence[0]
+			if kind != "new_port" && profile.Alerted[kind] == profile.CurrentHour {
+				continue
+			}
+			profile.Alerted[kind] = profile.CurrentHour
+			baselineAnomalies.WithLabelValues(kind).Inc()
+			threat.Evidence = threat.Evidence[1:]
+			threats = append(threats, threat)
+		}
+
+		for port := range act.ports {
+			profile.Ports[port] = now.Unix()
+		}
+		prunePorts(profile.Ports)
+		profile.dirty = true
+		profile.lastSeen = now
+	}
+	return threats
+}
+
+// Evaluate compares packets submitted for analysis with the baselines of their senders without
+// learning from them; the packets are treated as one hour of traffic
+func (be *BaselineEngine) Evaluate(ctx context.Context, packets []NetworkPacket) []ThreatIndicator {
+	threats := make([]ThreatIndicator, 0)
+	activity := packetActivity(packets)
+	if len(activity) == 0 {
+		return threats
+	}
+
+	at := time.Time{}
+	for _, packet := range packets {
+		if packet.Timestamp.After(at) {
+			at = packet.Timestamp
+		}
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	profiles, err := be.fetch(ctx, activity)
+	if err != nil {
+		log.Printf("Baseline evaluation skipped: %v", err)
+		return threats
+	}
+	for host, act := range activity {
+		profile, ok := profiles[host]
+		if !ok {
+			continue
+		}
+		for _, threat := range be.check(profile, at, act.bytes, act.externalBytes, act.ports) {
+			baselineAnomalies.WithLabelValues(threat.Evidence[0]).Inc()
+			threat.Evidence = threat.Evidence[1:]
+			threats = append(threats, threat)
+		}
+	}
+	return threats
+}
+
+// check compares an hour's traffic with the profile. The first evidence entry of each indicator
+// is the anomaly kind, which callers strip.
+func (be *BaselineEngine) check(profile *HostBaseline, at time.Time, bytes, externalBytes uint64, ports map[int]struct{}) []ThreatIndicator {
+	threats := make([]ThreatIndicator, 0)
+	if profile.HoursObserved < baselineMinHours {
+		return threats
+	}
+
+	hour := at.UTC().Hour()
+	slot := profile.Hours[hour]
+	stats := slot
+	if stats.Samples < baselineMinSlotSamples {
+		stats = profile.Overall
+	}
+
+	stddev := math.Sqrt(stats.VarBytes)
+	threshold := math.Max(stats.MeanBytes+be.sensitivity*stddev, 2*stats.MeanBytes)
+	if bytes >= baselineMinBytes && float64(bytes) > threshold {
+		z := (float64(bytes) - stats.MeanBytes) / math.Max(stddev, 1)
+		severity := Medium
+		if float64(bytes) > 2*threshold {
+			severity = High
+		}
+		threat := ThreatIndicator{
+			Type:        Anomaly,
+			Severity:    severity,
+			Confidence:  math.Min(0.95, 0.6+z/100),
+			Description: "Traffic volume far above host baseline",
+			SourceIP:    profile.Host,
+			Evidence: []string{
+				"volume",
+				fmt.Sprintf("Sent %.1f MB this hour; baseline for %02d:00 UTC is %.1f MB ± %.1f MB", mb(bytes), hour, stats.MeanBytes/(1<<20), stddev/(1<<20)),
+			},
+		}
+		// Most of it leaving the network looks like exfiltration rather than a busy hour
+		if externalBytes*2 > bytes {
+			threat.MITREAttack = "T1048"
+			threat.Evidence = append(threat.Evidence, fmt.Sprintf("%.1f MB went to external hosts", mb(externalBytes)))
+		}
+		threats = append(threats, threat)
+	}
+
+	if slot.Samples >= baselineMinSlotSamples && slot.ActiveRate < baselineQuietRate && bytes >= baselineQuietBytes {
+		threats = append(threats, ThreatIndicator{
+			Type:        Anomaly,
+			Severity:    Medium,
+			Confidence:  0.6,
+			Description: "Host active at an unusual time of day",
+			SourceIP:    profile.Host,
+			Evidence: []string{
+				"unusual_hour",
+				fmt.Sprintf("Sent %.1f MB at %02d:00 UTC; active in %.0f%% of past hours at this time", mb(bytes), hour, slot.ActiveRate*100),
+			},
+		})
+	}
+
+	if len(profile.Ports) > 0 {
+		newPorts := make([]int, 0)
+		for port := range ports {
+			if _, ok := profile.Ports[port]; !ok {
+				newPorts = append(newPorts, port)
+			}
+		}
+		sort.Ints(newPorts)
+		if len(newPorts) > 0 {
+			threats = append(threats, ThreatIndicator{
+				Type:        Anomaly,
+				Severity:    Low,
+				Confidence:  0.5,
+				Description: "Host contacted ports outside its baseline",
+				SourceIP:    profile.Host,
+				MITREAttack: "T1571",
+				Evidence:    []string{"new_port", fmt.Sprintf("New destination ports: %v", newPorts)},
+			})
+		}
+	}
+	return threats
+}
+
+func mb(bytes uint64) float64 {
+	return float64(bytes) / (1 << 20)
+}
+
+// prunePorts keeps the most recently used ports
+func prunePorts(ports map[int]int64) {
+	if len(ports) <= maxBaselinePorts {
+		return
+	}
+	byAge := make([]int, 0, len(ports))
+	for port := range ports {
+		byAge = append(byAge, port)
+	}
+	sort.Slice(byAge, func(i, j int) bool { return ports[byAge[i]] < ports[byAge[j]] })
+	for _, port := range byAge[:len(byAge)-maxBaselinePorts] {
+		delete(ports, port)
+	}
+}
+
+// load brings the profiles of hosts not yet in memory in from Redis, starting new ones for
+// hosts without a saved profile
+func (be *BaselineEngine) load(ctx context.Context, activity map[string]*hostActivity) {
+	be.mu.Lock()
+	missing := make(map[string]*hostActivity)
+	for host, act := range activity {
+		if _, ok := be.profiles[host]; !ok {
+			missing[host] = act
+		}
+	}
+	be.mu.Unlock()
+	if len(missing) == 0 {
+		return
+	}
+
+	saved, err := be.fetch(ctx, missing)
+	if err != nil {
+		// Starting over would lose the learned profiles; retry on the next window instead
+		log.Printf("Failed to load host baselines: %v", err)
+		return
+	}
+
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	for host := range missing {
+		if _, ok := be.profiles[host]; ok {
+			continue
+		}
+		if len(be.profiles) >= maxBaselineHosts {
+			if !be.full {
+				log.Printf("Host baseline limit of %d reached; new hosts are not profiled", maxBaselineHosts)
+				be.full = true
+			}
+			break
+		}
+		profile, ok := saved[host]
+		if !ok {
+			profile = newHostBaseline(host)
+		}
+		be.profiles[host] = profile
+	}
+	baselineHosts.Set(float64(len(be.profiles)))
+}
+
+// fetch reads saved profiles from Redis; hosts without one are left out
+func (be *BaselineEngine) fetch(ctx context.Context, hosts map[string]*hostActivity) (map[string]*HostBaseline, error) {
+	names := make([]string, 0, len(hosts))
+	keys := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+		keys = append(keys, baselineKeyPrefix+host)
+	}
+
+	values, err := be.redis.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	profiles := make(map[string]*HostBaseline, len(values))
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		profile := newHostBaseline(names[i])
+		if err := json.Unmarshal([]byte(data), profile); err != nil {
+			log.Printf("Ignoring invalid baseline for %s: %v", names[i], err)
+			continue
+		}
+		profiles[names[i]] = profile
+	}
+	return profiles, nil
+}
+
+// flush saves changed profiles and drops idle ones from memory
+func (be *BaselineEngine) flush(ctx context.Context) {
+	be.mu.Lock()
+	saved := make(map[string][]byte)
+	for host, profile := range be.profiles {
+		if !profile.dirty {
+			continue
+		}
+		data, err := json.Marshal(profile)
+		if err != nil {
+			continue
+		}
+		saved[host] = data
+		profile.dirty = false
+	}
+	be.mu.Unlock()
+
+	if len(saved) > 0 {
+		pipe := be.redis.Pipeline()
+		for host, data := range saved {
+			pipe.Set(ctx, baselineKeyPrefix+host, data, baselineTTL)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Printf("Failed to save host baselines: %v", err)
+			be.mu.Lock()
+			for host := range saved {
+				if profile, ok := be.profiles[host]; ok {
+					profile.dirty = true
+				}
+			}
+			be.mu.Unlock()
+			return
+		}
+	}
+
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	for host, profile := range be.profiles {
+		if !profile.dirty && time.Since(profile.lastSeen) > baselineIdleEviction {
+			delete(be.profiles, host)
+		}
+	}
+	be.full = len(be.profiles) >= maxBaselineHosts
+	baselineHosts.Set(float64(len(be.profiles)))
+}
+
+// Baseline returns a host's profile, from memory when it is being learned and otherwise from Redis
+func (be *BaselineEngine) Baseline(ctx context.Context, host string) (*HostBaseline, error) {
+	be.mu.Lock()
+	if profile, ok := be.profiles[host]; ok {
+		data, err := json.Marshal(profile)
+		be.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		copied := newHostBaseline(host)
+		return copied, json.Unmarshal(data, copied)
+	}
+	be.mu.Unlock()
+
+	profiles, err := be.fetch(ctx, map[string]*hostActivity{host: nil})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load baseline: %w", err)
+	}
+	return profiles[host], nil
+}
+
+// Reset forgets a host's profile, for example after a legitimate change in its role
+func (be *BaselineEngine) Reset(ctx context.Context, host string) (bool, error) {
+	be.mu.Lock()
+	_, inMemory := be.profiles[host]
+	delete(be.profiles, host)
+	baselineHosts.Set(float64(len(be.profiles)))
+	be.mu.Unlock()
+
+	removed, err := be.redis.Del(ctx, baselineKeyPrefix+host).Result()
+	if err != nil {
+		return inMemory, fmt.Errorf("failed to delete baseline: %w", err)
+	}
+	return inMemory || removed > 0, nil
+}
+
+// HTTP Handlers
+func (s *APIServer) getBaselineHandler(c *gin.Context) {
+	host := c.Param("host")
+	if net.ParseIP(host) == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "host must be an IP address"})
+		return
+	}
+
+	baseline, err := s.threatDetector.baselines.Baseline(c.Request.Context(), host)
+	switch {
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case baseline == nil:
+		c.JSON(http.StatusNotFound, gin.H{"error": "No baseline for this host"})
+	default:
+		c.JSON(http.StatusOK, baseline)
+	}
+}
+
+func (s *APIServer) resetBaselineHandler(c *gin.Context) {
+	found, err := s.threatDetector.baselines.Reset(c.Request.Context(), c.Param("host"))
+	switch {
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case !found:
+		c.JSON(http.StatusNotFound, gin.H{"error": "No baseline for this host"})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Attack campaign correlation across scans, capture, flows, and streams
+const (
+	campaignIndicatorsKey = "campaigns:indicators" // sorted set of campaignEvent JSON by time
+	maxCampaignIndicators = 20000                  // newest indicators kept for correlation
+	maxCampaignNodes      = 500                    // indicator nodes per campaign graph
+)
+
+var errCampaignNotFound = errors.New("campaign not found")
+
+var campaignIndicators = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "cybersecurity_campaign_indicators_total",
+		Help: "Indicators recorded for campaign correlation",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(campaignIndicators)
+}
+
+// campaignTypeTactics places indicators without a cataloged ATT&CK technique in the kill chain
+var campaignTypeTactics = map[ThreatType]string{
+	Intrusion:    "initial-access",
+	SQLInjection: "initial-access",
+	XSS:          "initial-access",
+	Malware:      "execution",
+	Brute:        "credential-access",
+	Anomaly:      "discovery",
+	DataExfil:    "exfiltration",
+	DDoS:         "impact",
+}
+
+// campaignSeverityPoints is the score contributed by the campaign's most severe indicator
+var campaignSeverityPoints = map[ThreatLevel]float64{Critical: 30, High: 22, Medium: 12, Low: 5}
+
+// campaignEvent is an indicator as recorded for correlation
+type campaignEvent struct {
+	ID          string      `json:"id"`
+	Timestamp   time.Time   `json:"timestamp"`
+	Origin      string      `json:"origin"` // scan type, "capture", "flow", or "stream"
+	ScanID      string      `json:"scan_id,omitempty"`
+	Type        ThreatType  `json:"type"`
+	Severity    ThreatLevel `json:"severity"`
+	Confidence  float64     `json:"confidence"`
+	Description string      `json:"description"`
+	SourceIP    string      `json:"source_ip"`
+	DestIP      string      `json:"dest_ip,omitempty"`
+	MITREAttack string      `json:"mitre_attack,omitempty"`
+	Tactic      string      `json:"tactic,omitempty"`
+	Asset       string      `json:"asset,omitempty"`
+}
+
+// campaignTactic returns the kill-chain stage of an indicator: the first tactic of its technique,
+// or the usual stage of its type
+func campaignTactic(threat ThreatIndicator) string {
+	if technique, ok := attackCatalog[attackParent(threat.MITREAttack)]; ok && len(technique.Tactics) > 0 {
+		return technique.Tactics[0]
+	}
+	return campaignTypeTactics[threat.Type]
+}
+
+// campaignStageRank orders tactics along the kill chain
+var campaignStageRank = func() map[string]int {
+	rank := make(map[string]int, len(attackTactics))
+	for i, tactic := range attackTactics {
+		rank[tactic.ID] = i
+	}
+	return rank
+}()
+
+// CampaignStage is one kill-chain stage a campaign reached
+type CampaignStage struct {
+	Tactic     string    `json:"tactic"`
+	Name       string    `json:"name"`
+	Indicators int       `json:"indicators"`
+	FirstSeen  time.Time `json:"first_seen"`
+}
+
+// CampaignNode is a host or an indicator in a campaign graph
+type CampaignNode struct {
+	ID          string      `json:"id"`   // "host:<address>" or the indicator ID
+	Kind        string      `json:"kind"` // "host" or "indicator"
+	Label       string      `json:"label"`
+	Role        string      `json:"role,omitempty"` // hosts: "attacker", "pivot" (targeted, then a source), or "target"
+	Asset       string      `json:"asset,omitempty"`
+	Type        ThreatType  `json:"type,omitempty"`
+	Severity    ThreatLevel `json:"severity,omitempty"`
+	Confidence  float64     `json:"confidence,omitempty"`
+	MITREAttack string      `json:"mitre_attack,omitempty"`
+	Tactic      string      `json:"tactic,omitempty"`
+	Origin      string      `json:"origin,omitempty"`
+	ScanID      string      `json:"scan_id,omitempty"`
+	Timestamp   *time.Time  `json:"timestamp,omitempty"`
+}
+
+// CampaignEdge links a source host to an indicator, an indicator to its target host, or an
+// indicator to the next one in time
+type CampaignEdge struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Relation string `json:"relation"` // "source", "target", or "next"
+}
+
+// Campaign is a set of indicators that together look like one attack
+type Campaign struct {
+	ID          string          `json:"id"`
+	Score       float64         `json:"score"` // 0-100
+	Severity    ThreatLevel     `json:"severity"`
+	FirstSeen   time.Time       `json:"first_seen"`
+	LastSeen    time.Time       `json:"last_seen"`
+	Indicators  int             `json:"indicators"`
+	Sources     []string        `json:"sources"`          // external addresses the campaign started from
+	Pivots      []string        `json:"pivots,omitempty"` // internal hosts that were targeted and then attacked others
+	Targets     []string        `json:"targets"`
+	Stages      []CampaignStage `json:"stages"`      // in kill-chain order
+	Progression float64         `json:"progression"` // share of steps in time order that advance or hold the kill-chain stage
+	Scans       []string        `json:"scans,omitempty"`
+	Nodes       []CampaignNode  `json:"nodes"`
+	Edges       []CampaignEdge  `json:"edges"`
+	Truncated   bool            `json:"truncated,omitempty"`
+}
+
+// CampaignSummary is a campaign without its graph, for listings
+type CampaignSummary struct {
+	ID          string          `json:"id"`
+	Score       float64         `json:"score"`
+	Severity    ThreatLevel     `json:"severity"`
+	FirstSeen   time.Time       `json:"first_seen"`
+	LastSeen    time.Time       `json:"last_seen"`
+	Indicators  int             `json:"indicators"`
+	Sources     []string        `json:"sources"`
+	Pivots      []string        `json:"pivots,omitempty"`
+	Targets     []string        `json:"targets"`
+	Stages      []CampaignStage `json:"stages"`
+	Progression float64         `json:"progression"`
+}
+
+func (c *Campaign) summary() CampaignSummary {
+	return CampaignSummary{
+		ID:          c.ID,
+		Score:       c.Score,
+		Severity:    c.Severity,
+		FirstSeen:   c.FirstSeen,
+		LastSeen:    c.LastSeen,
+		Indicators:  c.Indicators,
+		Sources:     c.Sources,
+		Pivots:      c.Pivots,
+		Targets:     c.Targets,
+		Stages:      c.Stages,
+		Progression: c.Progression,
+	}
+}
+
+// CampaignCorrelator links indicators from every pipeline into campaigns: indicators from the same
+// source address, and indicators from internal hosts after they were targeted (lateral movement)
+type CampaignCorrelator struct {
+	redis    *redis.Client
+	window   time.Duration
+	sequence atomic.Uint64
+}
+
+func NewCampaignCorrelator(redisClient *redis.Client, window time.Duration) *CampaignCorrelator {
+	return &CampaignCorrelator{redis: redisClient, window: window}
+}
+
+// Record keeps indicators with a source address for correlation over the campaign window
+func (cc *CampaignCorrelator) Record(ctx context.Context, origin, scanID string, threats []ThreatIndicator) {
+	now := time.Now().UTC()
+	members := make([]*redis.Z, 0, len(threats))
+	for _, threat := range threats {
+		if net.ParseIP(threat.SourceIP) == nil {
+			continue
+		}
+		event := campaignEvent{
+			ID:          fmt.Sprintf("ind_%d_%d", now.UnixNano(), cc.sequence.Add(1)),
+			Timestamp:   now,
+			Origin:      origin,
+			ScanID:      scanID,
+			Type:        threat.Type,
+			Severity:    threat.Severity,
+			Confidence:  threat.Confidence,
+			Description: threat.Description,
+			SourceIP:    threat.SourceIP,
+			DestIP:      threat.DestIP,
+			MITREAttack: threat.MITREAttack,
+			Tactic:      campaignTactic(threat),
+			Asset:       threat.Asset,
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		members = append(members, &redis.Z{Score: float64(now.UnixMilli()), Member: data})
+	}
+	if len(members) == 0 {
+		return
+	}
+
+	key := tenantKey(ctx, campaignIndicatorsKey)
+	pipe := cc.redis.Pipeline()
+	pipe.ZAdd(ctx, key, members...)
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.Add(-cc.window).UnixMilli(), 10))
+	pipe.ZRemRangeByRank(ctx, key, 0, -maxCampaignIndicators-1)
+	pipe.Expire(ctx, key, cc.window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record indicators for campaign correlation: %v", err)
+		return
+	}
+	campaignIndicators.Add(float64(len(members)))
+}
+
+func (cc *CampaignCorrelator) events(ctx context.Context) ([]campaignEvent, error) {
+	since := time.Now().UTC().Add(-cc.window).UnixMilli()
+	items, err := cc.redis.ZRangeByScore(ctx, tenantKey(ctx, campaignIndicatorsKey), &redis.ZRangeBy{Min: strconv.FormatInt(since, 10), Max: "+inf"}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load indicators: %w", err)
+	}
+	events := make([]campaignEvent, 0, len(items))
+	for _, item := range items {
+		var event campaignEvent
+		if json.Unmarshal([]byte(item), &event) == nil {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// Campaigns correlates the indicators in the window, strongest campaign first
+func (cc *CampaignCorrelator) Campaigns(ctx context.Context) ([]*Campaign, error) {
+	events, err := cc.events(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return correlateCampaigns(events), nil
+}
+
+// Campaign returns one campaign by ID
+func (cc *CampaignCorrelator) Campaign(ctx context.Context, id string) (*Campaign, error) {
+	campaigns, err := cc.Campaigns(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, campaign := range campaigns {
+		if campaign.ID == id {
+			return campaign, nil
+		}
+	}
+	return nil, errCampaignNotFound
+}
+
+// correlateCampaigns groups time-ordered indicators into campaigns. Indicators join their source
+// host's group. A private host joins the group of the indicator that first targeted it once it is
+// itself the source of an indicator. Groups that span at least two kill-chain stages, or that
+// moved laterally, are campaigns.
+func correlateCampaigns(events []campaignEvent) []*Campaign {
+	parent := make(map[string]string)
+	var find func(string) string
+	find = func(x string) string {
+		if parent[x] == "" || parent[x] == x {
+			parent[x] = x
+			return x
+		}
+		root := find(parent[x])
+		parent[x] = root
+		return root
+	}
+	union := func(a, b string) {
+		ra, rb := find(a), find(b)
+		if ra != rb {
+			parent[rb] = ra
+		}
+	}
+
+	targetedBy := make(map[string]string) // private address -> first indicator that targeted it
+	pivots := make(map[string]bool)
+	for _, event := range events {
+		source := "host:" + event.SourceIP
+		union(source, event.ID)
+		if first, ok := targetedBy[event.SourceIP]; ok {
+			union(first, source)
+			pivots[event.SourceIP] = true
+		}
+		if ip := net.ParseIP(event.DestIP); ip != nil && ip.IsPrivate() && event.DestIP != event.SourceIP {
+			if _, ok := targetedBy[event.DestIP]; !ok {
+				targetedBy[event.DestIP] = event.ID
+			}
+		}
+	}
+
+	groups := make(map[string][]campaignEvent)
+	roots := make([]string, 0)
+	for _, event := range events {
+		root := find(event.ID)
+		if _, ok := groups[root]; !ok {
+			roots = append(roots, root)
+		}
+		groups[root] = append(groups[root], event)
+	}
+
+	campaigns := make([]*Campaign, 0)
+	for _, root := range roots {
+		if campaign := buildCampaign(groups[root], pivots); campaign != nil {
+			campaigns = append(campaigns, campaign)
+		}
+	}
+	sort.SliceStable(campaigns, func(i, j int) bool {
+		if campaigns[i].Score != campaigns[j].Score {
+			return campaigns[i].Score > campaigns[j].Score
+		}
+		return campaigns[i].LastSeen.After(campaigns[j].LastSeen)
+	})
+	return campaigns
+}
+
+// buildCampaign scores a group of time-ordered indicators and lays them out as a graph; it
+// returns nil when the group is not a campaign
+func buildCampaign(events []campaignEvent, pivots map[string]bool) *Campaign {
+	stages := make(map[string]*CampaignStage)
+	sources := make(map[string]bool)
+	targets := make(map[string]bool)
+	scans := make(map[string]bool)
+	campaign := &Campaign{
+		ID:         "campaign_" + events[0].ID,
+		FirstSeen:  events[0].Timestamp,
+		LastSeen:   events[len(events)-1].Timestamp,
+		Pivots:     make([]string, 0),
+		Indicators: len(events),
+	}
+
+	var maxSeverity ThreatLevel = Low
+	missed := 1.0 // probability that every indicator is a false positive
+	advancing, steps := 0, 0
+	lastRank := -1
+	for _, event := range events {
+		if severityRank[event.Severity] > severityRank[maxSeverity] {
+			maxSeverity = event.Severity
+		}
+		missed *= 1 - min(max(event.Confidence, 0), 1)
+		if event.ScanID != "" {
+			scans[event.ScanID] = true
+		}
+		if pivots[event.SourceIP] && !sources[event.SourceIP] {
+			campaign.Pivots = append(campaign.Pivots, event.SourceIP)
+		}
+		sources[event.SourceIP] = true
+		if event.DestIP != "" {
+			targets[event.DestIP] = true
+		}
+
+		if event.Tactic == "" {
+			continue
+		}
+		rank := campaignStageRank[event.Tactic]
+		if lastRank >= 0 {
+			steps++
+			if rank >= lastRank {
+				advancing++
+			}
+		}
+		lastRank = rank
+		stage := stages[event.Tactic]
+		if stage == nil {
+			stage = &CampaignStage{Tactic: event.Tactic, FirstSeen: event.Timestamp}
+			for _, tactic := range attackTactics {
+				if tactic.ID == event.Tactic {
+					stage.Name = tactic.Name
+				}
+			}
+			stages[event.Tactic] = stage
+		}
+		stage.Indicators++
+	}
+	if len(stages) < 2 && len(campaign.Pivots) == 0 {
+		return nil
+	}
+
+	for _, stage := range stages {
+		campaign.Stages = append(campaign.Stages, *stage)
+	}
+	sort.Slice(campaign.Stages, func(i, j int) bool {
+		return campaignStageRank[campaign.Stages[i].Tactic] < campaignStageRank[campaign.Stages[j].Tactic]
+	})
+	campaign.Progression = 1
+	if steps > 0 {
+		campaign.Progression = float64(advancing) / float64(steps)
+	}
+
+	// Corroborating indicators, severity, breadth across the kill chain, orderly progression,
+	// and lateral movement each raise the score
+	score := 30*(1-missed) + campaignSeverityPoints[maxSeverity] +
+		5*float64(min(len(stages), 5)) + 10*campaign.Progression + 5*float64(min(len(campaign.Pivots), 3))
+	campaign.Score = float64(int(min(score, 100)*10)) / 10
+	switch {
+	case campaign.Score >= 80:
+		campaign.Severity = Critical
+	case campaign.Score >= 60:
+		campaign.Severity = High
+	case campaign.Score >= 40:
+		campaign.Severity = Medium
+	default:
+		campaign.Severity = Low
+	}
+
+	for source := range sources {
+		if !pivots[source] {
+			campaign.Sources = append(campaign.Sources, source)
+		}
+	}
+	for target := range targets {
+		if !pivots[target] {
+			campaign.Targets = append(campaign.Targets, target)
+		}
+	}
+	for scan := range scans {
+		campaign.Scans = append(campaign.Scans, scan)
+	}
+	sort.Strings(campaign.Sources)
+	sort.Strings(campaign.Targets)
+	sort.Strings(campaign.Scans)
+
+	campaign.graph(events, pivots)
+	return campaign
+}
+
+// graph lays out the campaign's hosts and newest indicators as nodes, linked by the indicators'
+// sources and targets and by time order
+func (c *Campaign) graph(events []campaignEvent, pivots map[string]bool) {
+	if len(events) > maxCampaignNodes {
+		events = events[len(events)-maxCampaignNodes:]
+		c.Truncated = true
+	}
+	c.Nodes = make([]CampaignNode, 0)
+	c.Edges = make([]CampaignEdge, 0)
+
+	attackers := make(map[string]bool, len(c.Sources))
+	for _, source := range c.Sources {
+		attackers[source] = true
+	}
+	hosts := make(map[string]int) // address -> index into Nodes
+	host := func(address, asset string) string {
+		id := "host:" + address
+		if i, ok := hosts[address]; ok {
+			if c.Nodes[i].Asset == "" {
+				c.Nodes[i].Asset = asset
+			}
+			return id
+		}
+		role := "target"
+		switch {
+		case pivots[address]:
+			role = "pivot"
+		case attackers[address]:
+			role = "attacker"
+		}
+		hosts[address] = len(c.Nodes)
+		c.Nodes = append(c.Nodes, CampaignNode{ID: id, Kind: "host", Label: address, Role: role, Asset: asset})
+		return id
+	}
+
+	previous := ""
+	for _, event := range events {
+		at := event.Timestamp
+		c.Nodes = append(c.Nodes, CampaignNode{
+			ID:          event.ID,
+			Kind:        "indicator",
+			Label:       event.Description,
+			Type:        event.Type,
+			Severity:    event.Severity,
+			Confidence:  event.Confidence,
+			MITREAttack: event.MITREAttack,
+			Tactic:      event.Tactic,
+			Origin:      event.Origin,
+			ScanID:      event.ScanID,
+			Timestamp:   &at,
+		})
+		c.Edges = append(c.Edges, CampaignEdge{From: host(event.SourceIP, ""), To: event.ID, Relation: "source"})
+		if event.DestIP != "" {
+			c.Edges = append(c.Edges, CampaignEdge{From: event.ID, To: host(event.DestIP, event.Asset), Relation: "target"})
+		}
+		if previous != "" {
+			c.Edges = append(c.Edges, CampaignEdge{From: previous, To: event.ID, Relation: "next"})
+		}
+		previous = event.ID
+	}
+}
+
+// HTTP Handlers
+func (s *APIServer) listCampaignsHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+		return
+	}
+	minScore, err := strconv.ParseFloat(c.DefaultQuery("min_score", "0"), 64)
+	if err != nil || minScore < 0 || minScore > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "min_score must be between 0 and 100"})
+		return
+	}
+
+	campaigns, err := s.threatDetector.campaigns.Campaigns(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	selected := make([]*Campaign, 0)
+	for _, campaign := range campaigns {
+		if campaign.Score >= minScore && len(selected) < limit {
+			selected = append(selected, campaign)
+		}
+	}
+	if c.Query("graph") == "false" {
+		summaries := make([]CampaignSummary, 0, len(selected))
+		for _, campaign := range selected {
+			summaries = append(summaries, campaign.summary())
+		}
+		c.JSON(http.StatusOK, gin.H{"campaigns": summaries, "count": len(summaries)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"campaigns": selected, "count": len(selected)})
+}
+
+func (s *APIServer) getCampaignHandler(c *gin.Context) {
+	campaign, err := s.threatDetector.campaigns.Campaign(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, errCampaignNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, campaign)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Live packet capture
+const (
+	captureSnaplen       = 65535
+	captureReadTimeout   = 500 * time.Millisecond
+	captureWindow        = time.Second // detection runs over each window of captured packets
+	captureIndicatorsKey = "capture:indicators"
+	recentIndicatorsMax  = 10000 // indicators kept per recent-indicator list
+)
+
+var (
+	packetsCaptured = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_packets_captured_total",
+			Help: "Total packets captured from live interfaces",
+		},
+		[]string{"interface"},
+	)
+
+	packetsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_capture_packets_dropped_total",
+			Help: "Captured packets overwritten in the ring buffer before detection read them",
+		},
+	)
+
+	captureBuffered = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cybersecurity_capture_buffered_packets",
+			Help: "Captured packets in the ring buffer at the last detection window",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(packetsCaptured)
+	prometheus.MustRegister(packetsDropped)
+	prometheus.MustRegister(captureBuffered)
+}
+
+// PacketRing is a fixed-size buffer between the capture goroutines and detection. When detection
+// falls behind, the oldest packets are overwritten so the newest traffic is always analyzed.
+type PacketRing struct {
+	mu      sync.Mutex
+	packets []NetworkPacket
+	head    int // index of the oldest packet
+	size    int
+	dropped uint64
+}
+
+func NewPacketRing(capacity int) *PacketRing {
+	return &PacketRing{packets: make([]NetworkPacket, capacity)}
+}
+
+func (r *PacketRing) Push(packet NetworkPacket) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size == len(r.packets) {
+		r.packets[r.head] = packet
+		r.head = (r.head + 1) % len(r.packets)
+		r.dropped++
+		packetsDropped.Inc()
+		return
+	}
+	r.packets[(r.head+r.size)%len(r.packets)] = packet
+	r.size++
+}
+
+// Drain removes and returns every buffered packet, oldest first
+func (r *PacketRing) Drain() []NetworkPacket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	drained := make([]NetworkPacket, r.size)
+	for i := range drained {
+		idx := (r.head + i) % len(r.packets)
+		drained[i] = r.packets[idx]
+		r.packets[idx] = NetworkPacket{}
+	}
+	r.head, r.size = 0, 0
+	return drained
+}
+
+func (r *PacketRing) Stats() (buffered, capacity int, dropped uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.size, len(r.packets), r.dropped
+}
+
+type InterfaceStatus struct {
+	Name     string `json:"name"`
+	Filter   string `json:"filter,omitempty"`
+	Packets  uint64 `json:"packets"`
+	Running  bool   `json:"running"`
+	Error    string `json:"error,omitempty"`
+	Received int    `json:"kernel_received"`
+	Dropped  int    `json:"kernel_dropped"`
+}
+
+type CaptureStatus struct {
+	Enabled    bool              `json:"enabled"`
+	Interfaces []InterfaceStatus `json:"interfaces"`
+	Buffered   int               `json:"buffered"`
+	Capacity   int               `json:"capacity"`
+	Dropped    uint64            `json:"dropped"`
+	Indicators []ThreatIndicator `json:"recent_indicators"`
+}
+
+// PacketCapture sniffs the configured interfaces and continuously runs packet detection over the
+// captured traffic, one window at a time
+type PacketCapture struct {
+	redis    *redis.Client
+	detector *ThreatDetector
+	ring     *PacketRing
+	filter   string
+
+	mu         sync.Mutex
+	interfaces map[string]*InterfaceStatus
+	handles    map[string]*pcap.Handle
+}
+
+func NewPacketCapture(redisClient *redis.Client, detector *ThreatDetector, interfaces []string, filter string, bufferSize int) *PacketCapture {
+	pc := &PacketCapture{
+		redis:      redisClient,
+		detector:   detector,
+		ring:       NewPacketRing(bufferSize),
+		filter:     filter,
+		interfaces: make(map[string]*InterfaceStatus),
+		handles:    make(map[string]*pcap.Handle),
+	}
+	for _, name := range interfaces {
+		pc.interfaces[name] = &InterfaceStatus{Name: name, Filter: filter}
+	}
+	return pc
+}
+
+// Start opens every interface and runs capture and detection until ctx is cancelled. An interface
+// that cannot be opened is reported in the status without stopping the others.
+func (pc *PacketCapture) Start(ctx context.Context) *sync.WaitGroup {
+	var wg sync.WaitGroup
+
+	for name := range pc.interfaces {
+		handle, err := pc.open(name)
+		if err != nil {
+			log.Printf("Packet capture on %s unavailable: %v", name, err)
+			pc.setError(name, err)
+			continue
+		}
+
+		wg.Add(1)
+		go func(name string, handle *pcap.Handle) {
+			defer wg.Done()
+			defer handle.Close()
+			pc.capture(ctx, name, handle)
+		}(name, handle)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pc.detect(ctx)
+	}()
+
+	log.Printf("Capturing on %d interface(s) with filter %q", len(pc.interfaces), pc.filter)
+	return &wg
+}
+
+func (pc *PacketCapture) open(name string) (*pcap.Handle, error) {
+	handle, err := pcap.OpenLive(name, captureSnaplen, true, captureReadTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if pc.filter != "" {
+		if err := handle.SetBPFFilter(pc.filter); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("invalid BPF filter %q: %w", pc.filter, err)
+		}
+	}
+
+	pc.mu.Lock()
+	pc.handles[name] = handle
+	pc.interfaces[name].Running = true
+	pc.mu.Unlock()
+	return handle, nil
+}
+
+func (pc *PacketCapture) capture(ctx context.Context, name string, handle *pcap.Handle) {
+	linkType := handle.LinkType()
+	counter := packetsCaptured.WithLabelValues(name)
+
+	for ctx.Err() == nil {
+		data, ci, err := handle.ReadPacketData()
+		if errors.Is(err, pcap.NextErrorTimeoutExpired) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Packet capture on %s stopped: %v", name, err)
+			pc.setError(name, err)
+			return
+		}
+
+		counter.Inc()
+		pc.mu.Lock()
+		pc.interfaces[name].Packets++
+		pc.mu.Unlock()
+
+		packet, ok := decodePacket(gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true}), ci.Timestamp)
+		if ok {
+			pc.ring.Push(packet)
+		}
+	}
+}
+
+// detect evaluates each window of captured packets; windows keep per-source aggregations such as
+// port scan detection meaningful without holding an unbounded history
+func (pc *PacketCapture) detect(ctx context.Context) {
+	ticker := time.NewTicker(captureWindow)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		packets := pc.ring.Drain()
+		captureBuffered.Set(float64(len(packets)))
+		if len(packets) == 0 {
+			continue
+		}
+
+		packetsProcessed.Add(float64(len(packets)))
+		threats := pc.detector.detectPacketThreats(ctx, packets)
+		threats = append(threats, pc.detector.ddos.Observe(ctx, packets)...)
+		threats = append(threats, pc.detector.baselines.Observe(ctx, packetActivity(packets))...)
+		threats = pc.detector.lists.Apply(ctx, threats)
+		for _, threat := range threats {
+			threatsDetected.WithLabelValues(string(threat.Severity), string(threat.Type)).Inc()
+		}
+		pc.detector.recordDetections(ctx, threats)
+		pc.detector.campaigns.Record(ctx, "capture", "", threats)
+		pc.detector.history.RecordIndicators(ctx, "capture", "", threats)
+		pc.detector.geo.Enrich(threats)
+		pc.detector.endpoints.Annotate(ctx, threats)
+		pushIndicators(ctx, pc.redis, captureIndicatorsKey, threats)
+		pc.detector.siem.ForwardIndicators("capture", threats)
+		pc.detector.alerts.Route(ctx, "capture", threats)
+	}
+}
+
+// pushIndicators prepends threats to a capped Redis list of recent indicators
+func pushIndicators(ctx context.Context, redisClient *redis.Client, key string, threats []ThreatIndicator) {
+	if len(threats) == 0 {
+		return
+	}
+
+	pipe := redisClient.TxPipeline()
+	for _, threat := range threats {
+		data, err := json.Marshal(threat)
+		if err != nil {
+			continue
+		}
+		pipe.LPush(ctx, key, data)
+	}
+	pipe.LTrim(ctx, key, 0, recentIndicatorsMax-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record indicators in %s: %v", key, err)
+	}
+}
+
+// recentIndicators loads the newest indicators pushed to key
+func recentIndicators(ctx context.Context, redisClient *redis.Client, key string, limit int) ([]ThreatIndicator, error) {
+	items, err := redisClient.LRange(ctx, key, 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load indicators: %w", err)
+	}
+
+	indicators := make([]ThreatIndicator, 0, len(items))
+	for _, item := range items {
+		var threat ThreatIndicator
+		if err := json.Unmarshal([]byte(item), &threat); err == nil {
+			indicators = append(indicators, threat)
+		}
+	}
+	return indicators, nil
+}
+
+func (pc *PacketCapture) setError(name string, err error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.interfaces[name].Running = false
+	pc.interfaces[name].Error = err.Error()
+}
+
+// Status reports per-interface counters and the most recent indicators
+func (pc *PacketCapture) Status(ctx context.Context, limit int) (*CaptureStatus, error) {
+	status := &CaptureStatus{
+		Enabled:    len(pc.interfaces) > 0,
+		Interfaces: make([]InterfaceStatus, 0, len(pc.interfaces)),
+	}
+	status.Buffered, status.Capacity, status.Dropped = pc.ring.Stats()
+
+	pc.mu.Lock()
+	for name, iface := range pc.interfaces {
+		s := *iface
+		if handle, ok := pc.handles[name]; ok && s.Running {
+			if stats, err := handle.Stats(); err == nil {
+				s.Received = stats.PacketsReceived
+				s.Dropped = stats.PacketsDropped + stats.PacketsIfDropped
+			}
+		}
+		status.Interfaces = append(status.Interfaces, s)
+	}
+	pc.mu.Unlock()
+	sort.Slice(status.Interfaces, func(i, j int) bool { return status.Interfaces[i].Name < status.Interfaces[j].Name })
+
+	indicators, err := recentIndicators(ctx, pc.redis, captureIndicatorsKey, limit)
+	if err != nil {
+		return nil, err
+	}
+	status.Indicators = indicators
+	return status, nil
+}
+
+// parseInterfaces splits a comma-separated interface list
+func parseInterfaces(value string) []string {
+	interfaces := make([]string, 0)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			interfaces = append(interfaces, name)
+		}
+	}
+	return interfaces
+}
+
+// HTTP Handlers
+func (s *APIServer) captureStatusHandler(c *gin.Context) {
+	status, err := s.packetCapture.Status(c.Request.Context(), 100)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,704 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pdf/fpdf"
+	"github.com/go-redis/redis/v8"
+)
+
+// Compliance reporting (PCI DSS, SOC 2, ISO 27001)
+const (
+	complianceEvidenceKey    = "compliance:evidence" // hash of evidence ID -> ComplianceEvidence JSON
+	complianceEvidenceMax    = 10000
+	complianceDefaultRange   = 90 * 24 * time.Hour // a quarter, the PCI DSS internal scan interval
+	complianceFindingsListed = 25                  // active findings listed per control, most severe first
+)
+
+var (
+	errFrameworkNotFound = errors.New("compliance framework not found")
+	errInvalidEvidence   = errors.New("invalid evidence")
+)
+
+type ControlStatus string
+
+const (
+	ControlCompliant    ControlStatus = "compliant"     // evidence in the period and no active findings
+	ControlAtRisk       ControlStatus = "at_risk"       // active findings, none past their deadline
+	ControlNonCompliant ControlStatus = "non_compliant" // findings past their remediation deadline
+	ControlNoEvidence   ControlStatus = "no_evidence"
+)
+
+// Automatic evidence sources
+const (
+	evidenceVulnerabilityScans = "vulnerability_scans"
+	evidenceThreatMonitoring   = "threat_monitoring"
+	evidenceLogForwarding      = "log_forwarding"
+	evidenceIncidentResponse   = "incident_response"
+	evidenceAssetInventory     = "asset_inventory"
+	evidenceRemediation        = "remediation"
+)
+
+// ComplianceControl maps findings and evidence onto a control. Finding selectors are a kind
+// ("vulnerability", "threat"), optionally narrowed by severity or threat type, such as
+// "vulnerability:critical" or "threat:brute_force".
+type ComplianceControl struct {
+	ID       string   `json:"id"`
+	Title    string   `json:"title"`
+	Findings []string `json:"findings,omitempty"`
+	Evidence []string `json:"evidence,omitempty"` // automatic evidence sources
+}
+
+type ComplianceFramework struct {
+	ID       string              `json:"id"`
+	Name     string              `json:"name"`
+	Version  string              `json:"version"`
+	Controls []ComplianceControl `json:"controls"`
+}
+
+// complianceFrameworks covers the controls this service produces findings or evidence for; the
+// rest of each framework has to be assessed with manual evidence
+var complianceFrameworks = []ComplianceFramework{
+	{
+		ID: "pci-dss", Name: "PCI DSS", Version: "4.0",
+		Controls: []ComplianceControl{
+			{ID: "5.2.1", Title: "An anti-malware solution is deployed", Findings: []string{"threat:malware"}, Evidence: []string{evidenceThreatMonitoring}},
+			{ID: "6.3.1", Title: "Security vulnerabilities are identified and managed", Findings: []string{"vulnerability"}, Evidence: []string{evidenceVulnerabilityScans}},
+			{ID: "6.3.3", Title: "Critical and high security patches are installed within one month", Findings: []string{"vulnerability:critical", "vulnerability:high"}, Evidence: []string{evidenceRemediation}},
+			{ID: "6.4.1", Title: "Public-facing web applications are protected against attacks", Findings: []string{"threat:sql_injection", "threat:xss"}, Evidence: []string{evidenceThreatMonitoring}},
+			{ID: "8.3.4", Title: "Invalid authentication attempts are limited", Findings: []string{"threat:brute_force"}, Evidence: []string{evidenceThreatMonitoring}},
+			{ID: "10.4.1", Title: "Audit logs are reviewed at least once daily", Evidence: []string{evidenceLogForwarding, evidenceThreatMonitoring}},
+			{ID: "11.3.1", Title: "Internal vulnerability scans are performed at least once every three months", Findings: []string{"vulnerability"}, Evidence: []string{evidenceVulnerabilityScans}},
+			{ID: "11.5.1", Title: "Intrusion-detection or intrusion-prevention techniques detect and prevent intrusions", Findings: []string{"threat:intrusion", "threat:anomaly", "threat:data_exfiltration"}, Evidence: []string{evidenceThreatMonitoring}},
+			{ID: "12.5.1", Title: "An inventory of system components in scope is maintained", Evidence: []string{evidenceAssetInventory}},
+			{ID: "12.10.1", Title: "An incident response plan exists and is ready to be activated", Evidence: []string{evidenceIncidentResponse}},
+		},
+	},
+	{
+		ID: "soc2", Name: "SOC 2", Version: "2017 Trust Services Criteria",
+		Controls: []ComplianceControl{
+			{ID: "CC6.1", Title: "Logical access security over protected information assets", Findings: []string{"threat:brute_force"}, Evidence: []string{evidenceAssetInventory}},
+			{ID: "CC6.6", Title: "Security measures against threats from outside system boundaries", Findings: []string{"threat:intrusion", "threat:sql_injection", "threat:xss", "threat:ddos"}, Evidence: []string{evidenceThreatMonitoring}},
+			{ID: "CC6.7", Title: "Transmission and movement of information is restricted", Findings: []string{"threat:data_exfiltration"}, Evidence: []string{evidenceThreatMonitoring}},
+			{ID: "CC6.8", Title: "Unauthorized or malicious software is prevented or detected", Findings: []string{"threat:malware"}, Evidence: []string{evidenceThreatMonitoring}},
+			{ID: "CC7.1", Title: "Detection and monitoring procedures identify vulnerabilities", Findings: []string{"vulnerability"}, Evidence: []string{evidenceVulnerabilityScans}},
+			{ID: "CC7.2", Title: "System components are monitored for anomalies indicative of malicious acts", Findings: []string{"threat"}, Evidence: []string{evidenceThreatMonitoring, evidenceLogForwarding}},
+			{ID: "CC7.3", Title: "Security events are evaluated to determine whether they are incidents", Findings: []string{"threat:critical", "threat:high"}, Evidence: []string{evidenceRemediation}},
+			{ID: "CC7.4", Title: "Security incidents are responded to", Evidence: []string{evidenceIncidentResponse}},
+		},
+	},
+	{
+		ID: "iso27001", Name: "ISO/IEC 27001", Version: "2022 Annex A",
+		Controls: []ComplianceControl{
+			{ID: "A.5.9", Title: "Inventory of information and other associated assets", Evidence: []string{evidenceAssetInventory}},
+			{ID: "A.5.25", Title: "Assessment and decision on information security events", Findings: []string{"threat:critical", "threat:high"}, Evidence: []string{evidenceRemediation}},
+			{ID: "A.5.26", Title: "Response to information security incidents", Evidence: []string{evidenceIncidentResponse}},
+			{ID: "A.8.5", Title: "Secure authentication", Findings: []string{"threat:brute_force"}, Evidence: []string{evidenceThreatMonitoring}},
+			{ID: "A.8.7", Title: "Protection against malware", Findings: []string{"threat:malware"}, Evidence: []string{evidenceThreatMonitoring}},
+			{ID: "A.8.8", Title: "Management of technical vulnerabilities", Findings: []string{"vulnerability"}, Evidence: []string{evidenceVulnerabilityScans, evidenceRemediation}},
+			{ID: "A.8.12", Title: "Data leakage prevention", Findings: []string{"threat:data_exfiltration"}, Evidence: []string{evidenceThreatMonitoring}},
+			{ID: "A.8.15", Title: "Logging", Evidence: []string{evidenceLogForwarding}},
+			{ID: "A.8.16", Title: "Monitoring activities", Findings: []string{"threat"}, Evidence: []string{evidenceThreatMonitoring}},
+			{ID: "A.8.20", Title: "Networks security", Findings: []string{"threat:intrusion", "threat:ddos", "threat:anomaly"}, Evidence: []string{evidenceThreatMonitoring}},
+		},
+	},
+}
+
+func complianceFramework(id string) (*ComplianceFramework, bool) {
+	for i := range complianceFrameworks {
+		if complianceFrameworks[i].ID == id {
+			return &complianceFrameworks[i], true
+		}
+	}
+	return nil, false
+}
+
+func (c *ComplianceControl) covers(finding *Finding) bool {
+	for _, selector := range c.Findings {
+		kind, qualifier, _ := strings.Cut(selector, ":")
+		if finding.Kind == kind && (qualifier == "" || qualifier == string(finding.Severity) || qualifier == string(finding.ThreatType)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ComplianceEvidence supports a control: documents and attestations added through the API, or
+// activity collected when a report is generated
+type ComplianceEvidence struct {
+	ID          string    `json:"id"`
+	Framework   string    `json:"framework"`
+	Control     string    `json:"control"`
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	Reference   string    `json:"reference,omitempty"` // document URL or ticket
+	Source      string    `json:"source"`              // "manual" or the automatic evidence source
+	CollectedAt time.Time `json:"collected_at"`
+}
+
+type ControlReport struct {
+	ID                 string               `json:"id"`
+	Title              string               `json:"title"`
+	Status             ControlStatus        `json:"status"`
+	OpenFindings       int                  `json:"open_findings"`
+	OverdueFindings    int                  `json:"overdue_findings"`
+	RemediatedFindings int                  `json:"remediated_findings"` // remediated during the period
+	AcceptedFindings   int                  `json:"accepted_findings"`
+	Findings           []Finding            `json:"findings,omitempty"`
+	Evidence           []ComplianceEvidence `json:"evidence"`
+}
+
+type ComplianceSummary struct {
+	Controls           int `json:"controls"`
+	Compliant          int `json:"compliant"`
+	AtRisk             int `json:"at_risk"`
+	NonCompliant       int `json:"non_compliant"`
+	NoEvidence         int `json:"no_evidence"`
+	OpenFindings       int `json:"open_findings"`
+	OverdueFindings    int `json:"overdue_findings"`
+	RemediatedFindings int `json:"remediated_findings"`
+}
+
+type ComplianceReport struct {
+	Framework        string            `json:"framework"`
+	FrameworkName    string            `json:"framework_name"`
+	Version          string            `json:"version"`
+	From             time.Time         `json:"from"`
+	To               time.Time         `json:"to"`
+	GeneratedAt      time.Time         `json:"generated_at"`
+	ExecutiveSummary string            `json:"executive_summary,omitempty"`
+	Summary          ComplianceSummary `json:"summary"`
+	Controls         []ControlReport   `json:"controls"`
+}
+
+// ComplianceReporter maps stored findings and evidence onto control frameworks
+type ComplianceReporter struct {
+	redis     *redis.Client
+	detector  *ThreatDetector
+	responder *IncidentResponder
+	claude    *ClaudeClient
+}
+
+func NewComplianceReporter(redisClient *redis.Client, detector *ThreatDetector, responder *IncidentResponder, claudeClient *ClaudeClient) *ComplianceReporter {
+	return &ComplianceReporter{redis: redisClient, detector: detector, responder: responder, claude: claudeClient}
+}
+
+// Report assesses each control of a framework over a period. Finding statuses are current; the
+// period selects the findings seen, remediations, and evidence that count.
+func (cr *ComplianceReporter) Report(ctx context.Context, frameworkID string, from, to time.Time, summarize bool) (*ComplianceReport, error) {
+	framework, ok := complianceFramework(frameworkID)
+	if !ok {
+		return nil, errFrameworkNotFound
+	}
+
+	now := time.Now().UTC()
+	at := to
+	if at.After(now) {
+		at = now
+	}
+
+	findings, err := cr.detector.findings.Findings(ctx, FindingFilter{})
+	if err != nil {
+		return nil, err
+	}
+	inPeriod := func(t time.Time) bool { return !t.Before(from) && !t.After(to) }
+	relevant := findings[:0]
+	for _, finding := range findings {
+		if finding.FirstSeen.After(to) {
+			continue
+		}
+		if finding.active() || !finding.LastSeen.Before(from) || (finding.RemediatedAt != nil && inPeriod(*finding.RemediatedAt)) {
+			relevant = append(relevant, finding)
+		}
+	}
+
+	automatic, err := cr.automaticEvidence(ctx, from, to, relevant, now)
+	if err != nil {
+		return nil, err
+	}
+	manual, err := cr.Evidence(ctx, framework.ID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ComplianceReport{
+		Framework:     framework.ID,
+		FrameworkName: framework.Name,
+		Version:       framework.Version,
+		From:          from,
+		To:            to,
+		GeneratedAt:   now,
+		Controls:      make([]ControlReport, 0, len(framework.Controls)),
+	}
+	for _, control := range framework.Controls {
+		entry := ControlReport{ID: control.ID, Title: control.Title, Evidence: make([]ComplianceEvidence, 0)}
+		for i := range relevant {
+			finding := &relevant[i]
+			if !control.covers(finding) {
+				continue
+			}
+			switch {
+			case finding.active():
+				entry.OpenFindings++
+				if finding.overdue(at) {
+					entry.OverdueFindings++
+				}
+				if len(entry.Findings) < complianceFindingsListed {
+					entry.Findings = append(entry.Findings, *finding)
+				}
+			case finding.Status == FindingRiskAccepted:
+				entry.AcceptedFindings++
+			case finding.RemediatedAt != nil && inPeriod(*finding.RemediatedAt):
+				entry.RemediatedFindings++
+			}
+		}
+
+		for _, source := range control.Evidence {
+			for _, evidence := range automatic[source] {
+				evidence.Framework, evidence.Control = framework.ID, control.ID
+				entry.Evidence = append(entry.Evidence, evidence)
+			}
+		}
+		for _, evidence := range manual {
+			if evidence.Control == control.ID && inPeriod(evidence.CollectedAt) {
+				entry.Evidence = append(entry.Evidence, evidence)
+			}
+		}
+
+		switch {
+		case entry.OverdueFindings > 0:
+			entry.Status = ControlNonCompliant
+		case entry.OpenFindings > 0:
+			entry.Status = ControlAtRisk
+		case len(entry.Evidence) > 0:
+			entry.Status = ControlCompliant
+		default:
+			entry.Status = ControlNoEvidence
+		}
+		report.Controls = append(report.Controls, entry)
+	}
+
+	report.Summary.Controls = len(report.Controls)
+	for _, control := range report.Controls {
+		switch control.Status {
+		case ControlCompliant:
+			report.Summary.Compliant++
+		case ControlAtRisk:
+			report.Summary.AtRisk++
+		case ControlNonCompliant:
+			report.Summary.NonCompliant++
+		default:
+			report.Summary.NoEvidence++
+		}
+	}
+	for i := range relevant {
+		finding := &relevant[i]
+		switch {
+		case finding.active():
+			report.Summary.OpenFindings++
+			if finding.overdue(at) {
+				report.Summary.OverdueFindings++
+			}
+		case finding.RemediatedAt != nil && inPeriod(*finding.RemediatedAt):
+			report.Summary.RemediatedFindings++
+		}
+	}
+
+	if summarize {
+		summary, err := cr.claude.SummarizeCompliance(ctx, report)
+		if err != nil {
+			log.Printf("Claude compliance summary failed: %v", err)
+		} else {
+			report.ExecutiveSummary = summary
+		}
+	}
+	return report, nil
+}
+
+// automaticEvidence collects the period's activity by evidence source
+func (cr *ComplianceReporter) automaticEvidence(ctx context.Context, from, to time.Time, findings []Finding, now time.Time) (map[string][]ComplianceEvidence, error) {
+	evidence := make(map[string][]ComplianceEvidence)
+	add := func(source, title, description string) {
+		evidence[source] = append(evidence[source], ComplianceEvidence{
+			ID:          fmt.Sprintf("auto:%s:%d", source, len(evidence[source])+1),
+			Title:       title,
+			Description: description,
+			Source:      source,
+			CollectedAt: now,
+		})
+	}
+
+	activity, err := cr.detector.findings.ScanActivity(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if scans := activity["vulnerability"]; scans > 0 {
+		add(evidenceVulnerabilityScans, fmt.Sprintf("%d vulnerability scans completed", scans), "Registered assets scanned with nmap and checked against the CVE database")
+	}
+	var detectionScans int64
+	for scanType, scans := range activity {
+		if scanType != "vulnerability" {
+			detectionScans += scans
+		}
+	}
+	if detectionScans > 0 {
+		add(evidenceThreatMonitoring, fmt.Sprintf("%d threat detection scans completed", detectionScans), "Traffic and log events analyzed against signatures, Sigma rules, and host baselines")
+	}
+
+	// Sensors, SIEM forwarding, and incident response are the operator's and only evidence its
+	// own compliance
+	operator := tenantFromContext(ctx) == defaultTenant
+	if operator && len(config.CaptureInterfaces) > 0 {
+		add(evidenceThreatMonitoring, "Live packet capture enabled", "Interfaces: "+strings.Join(config.CaptureInterfaces, ", "))
+	}
+	if operator && config.FlowListenAddr != "" {
+		add(evidenceThreatMonitoring, "Flow collection enabled", "NetFlow/IPFIX/sFlow exports received on "+config.FlowListenAddr)
+	}
+	if operator {
+		for _, destination := range cr.detector.siem.Status() {
+			add(evidenceLogForwarding, "Security events forwarded to "+destination.Name, fmt.Sprintf("%d events delivered since the service started", destination.Delivered))
+		}
+	}
+
+	if operator && cr.responder != nil {
+		audit, err := cr.responder.AuditLog(ctx, responseAuditMax)
+		if err != nil {
+			return nil, err
+		}
+		var responses, completed int
+		for _, entry := range audit {
+			if entry.Timestamp.Before(from) || entry.Timestamp.After(to) {
+				continue
+			}
+			responses++
+			if entry.Status == "completed" {
+				completed++
+			}
+		}
+		if responses > 0 {
+			add(evidenceIncidentResponse, fmt.Sprintf("%d incident responses recorded", responses), fmt.Sprintf("%d completed; see /api/v1/incidents/audit", completed))
+		}
+	}
+
+	assets, err := cr.detector.assets.Assets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(assets) > 0 {
+		var scanned int
+		for _, asset := range assets {
+			if asset.LastScanned != nil && !asset.LastScanned.Before(from) {
+				scanned++
+			}
+		}
+		add(evidenceAssetInventory, fmt.Sprintf("%d assets registered", len(assets)), fmt.Sprintf("%d scanned during the period", scanned))
+	}
+
+	var remediated int
+	for _, finding := range findings {
+		if finding.RemediatedAt != nil && !finding.RemediatedAt.Before(from) && !finding.RemediatedAt.After(to) {
+			remediated++
+		}
+	}
+	if remediated > 0 {
+		add(evidenceRemediation, fmt.Sprintf("%d findings remediated", remediated), "Remediated findings are listed under /api/v1/findings?status=remediated")
+	}
+	return evidence, nil
+}
+
+// Evidence lists manual evidence, optionally for one framework or control, newest first
+func (cr *ComplianceReporter) Evidence(ctx context.Context, framework, control string) ([]ComplianceEvidence, error) {
+	entries, err := cr.redis.HGetAll(ctx, tenantKey(ctx, complianceEvidenceKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load evidence: %w", err)
+	}
+
+	evidence := make([]ComplianceEvidence, 0, len(entries))
+	for _, data := range entries {
+		var entry ComplianceEvidence
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			continue
+		}
+		if (framework == "" || entry.Framework == framework) && (control == "" || entry.Control == control) {
+			evidence = append(evidence, entry)
+		}
+	}
+	sort.Slice(evidence, func(i, j int) bool { return evidence[i].CollectedAt.After(evidence[j].CollectedAt) })
+	return evidence, nil
+}
+
+// AddEvidence stores manual evidence for a control of a known framework
+func (cr *ComplianceReporter) AddEvidence(ctx context.Context, evidence ComplianceEvidence) (*ComplianceEvidence, error) {
+	framework, ok := complianceFramework(evidence.Framework)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown framework %q", errInvalidEvidence, evidence.Framework)
+	}
+	known := false
+	for _, control := range framework.Controls {
+		known = known || control.ID == evidence.Control
+	}
+	if !known {
+		return nil, fmt.Errorf("%w: %s has no control %q", errInvalidEvidence, framework.Name, evidence.Control)
+	}
+	if strings.TrimSpace(evidence.Title) == "" {
+		return nil, fmt.Errorf("%w: title is required", errInvalidEvidence)
+	}
+
+	count, err := cr.redis.HLen(ctx, tenantKey(ctx, complianceEvidenceKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to store evidence: %w", err)
+	}
+	if count >= complianceEvidenceMax {
+		return nil, fmt.Errorf("%w: at most %d evidence items are kept", errInvalidEvidence, complianceEvidenceMax)
+	}
+
+	evidence.ID = fmt.Sprintf("evd_%d", time.Now().UnixNano())
+	evidence.Source = "manual"
+	if evidence.CollectedAt.IsZero() {
+		evidence.CollectedAt = time.Now().UTC()
+	}
+	data, err := json.Marshal(evidence)
+	if err != nil {
+		return nil, err
+	}
+	if err := cr.redis.HSet(ctx, tenantKey(ctx, complianceEvidenceKey), evidence.ID, data).Err(); err != nil {
+		return nil, fmt.Errorf("failed to store evidence: %w", err)
+	}
+	return &evidence, nil
+}
+
+func (cr *ComplianceReporter) DeleteEvidence(ctx context.Context, id string) (bool, error) {
+	removed, err := cr.redis.HDel(ctx, tenantKey(ctx, complianceEvidenceKey), id).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete evidence: %w", err)
+	}
+	return removed > 0, nil
+}
+
+// SummarizeCompliance writes an executive summary of a compliance report
+func (c *ClaudeClient) SummarizeCompliance(ctx context.Context, report *ComplianceReport) (string, error) {
+	type control struct {
+		ID      string        `json:"id"`
+		Title   string        `json:"title"`
+		Status  ControlStatus `json:"status"`
+		Open    int           `json:"open_findings"`
+		Overdue int           `json:"overdue_findings"`
+	}
+	controls := make([]control, 0, len(report.Controls))
+	for _, entry := range report.Controls {
+		controls = append(controls, control{entry.ID, entry.Title, entry.Status, entry.OpenFindings, entry.OverdueFindings})
+	}
+	controlsJSON, _ := json.MarshalIndent(controls, "", "  ")
+
+	prompt := fmt.Sprintf(`Write a one-paragraph executive summary of this %s %s compliance assessment
+for %s to %s, for a non-technical audience:
+
+CONTROLS:
+%s
+
+Lead with the overall posture, name the controls that need attention and why, and end with the
+most important next step.`, report.FrameworkName, report.Version,
+		report.From.Format("2006-01-02"), report.To.Format("2006-01-02"), string(controlsJSON))
+
+	// Simulate Claude API call (in production, use actual Anthropic SDK)
+	_ = prompt
+	summary := report.Summary
+	var attention []string
+	for _, entry := range report.Controls {
+		if entry.Status == ControlNonCompliant {
+			attention = append(attention, entry.ID)
+		}
+	}
+
+	text := fmt.Sprintf("During this period %d of %d assessed %s controls were compliant, %d were at risk, %d were non-compliant, and %d lacked evidence.",
+		summary.Compliant, summary.Controls, report.FrameworkName, summary.AtRisk, summary.NonCompliant, summary.NoEvidence)
+	text += fmt.Sprintf(" %d findings remain open, %d of them past their remediation deadline, and %d were remediated.",
+		summary.OpenFindings, summary.OverdueFindings, summary.RemediatedFindings)
+	switch {
+	case len(attention) > 0:
+		text += fmt.Sprintf(" Controls %s need immediate attention: remediating their overdue findings is the most important next step.", strings.Join(attention, ", "))
+	case summary.NoEvidence > 0:
+		text += " The priority is collecting evidence for the unassessed controls before the next audit."
+	default:
+		text += " The organization is well positioned; continue regular scanning and timely remediation."
+	}
+
+	log.Printf("Claude compliance summary completed for %s", report.Framework)
+
+	return text, nil
+}
+
+// writePDF renders the report for auditors: a summary, then each control with its findings and evidence
+func (r *ComplianceReport) writePDF(w io.Writer) error {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("") // core fonts are cp1252
+	pdf.SetTitle(fmt.Sprintf("%s %s compliance report", r.FrameworkName, r.Version), true)
+	pdf.SetCreator(config.AppName+" "+config.Version, true)
+	pdf.SetMargins(15, 15, 15)
+	pdf.SetAutoPageBreak(true, 15)
+	pdf.AliasNbPages("")
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-12)
+		pdf.SetFont("Helvetica", "I", 8)
+		pdf.CellFormat(0, 8, fmt.Sprintf("Generated %s - page %d of {nb}", r.GeneratedAt.Format(time.RFC3339), pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 18)
+	pdf.CellFormat(0, 10, tr(fmt.Sprintf("%s %s compliance report", r.FrameworkName, r.Version)), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.CellFormat(0, 6, fmt.Sprintf("Period: %s to %s", r.From.Format("2006-01-02 15:04 MST"), r.To.Format("2006-01-02 15:04 MST")), "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+
+	if r.ExecutiveSummary != "" {
+		pdf.SetFont("Helvetica", "B", 12)
+		pdf.CellFormat(0, 8, "Executive summary", "", 1, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 10)
+		pdf.MultiCell(0, 5, tr(r.ExecutiveSummary), "", "L", false)
+		pdf.Ln(4)
+	}
+
+	pdf.SetFont("Helvetica", "B", 12)
+	pdf.CellFormat(0, 8, "Controls", "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "B", 9)
+	pdf.SetFillColor(230, 230, 230)
+	for _, header := range []struct {
+		text  string
+		width float64
+	}{{"Control", 20}, {"Title", 100}, {"Status", 30}, {"Open", 15}, {"Overdue", 15}} {
+		pdf.CellFormat(header.width, 7, header.text, "1", 0, "L", true, 0, "")
+	}
+	pdf.Ln(-1)
+	pdf.SetFont("Helvetica", "", 9)
+	for _, control := range r.Controls {
+		title := control.Title
+		if len(title) > 60 {
+			title = title[:57] + "..."
+		}
+		pdf.CellFormat(20, 6, control.ID, "1", 0, "L", false, 0, "")
+		pdf.CellFormat(100, 6, tr(title), "1", 0, "L", false, 0, "")
+		pdf.CellFormat(30, 6, strings.ReplaceAll(string(control.Status), "_", " "), "1", 0, "L", false, 0, "")
+		pdf.CellFormat(15, 6, fmt.Sprint(control.OpenFindings), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(15, 6, fmt.Sprint(control.OverdueFindings), "1", 1, "R", false, 0, "")
+	}
+
+	for _, control := range r.Controls {
+		pdf.Ln(6)
+		pdf.SetFont("Helvetica", "B", 11)
+		pdf.MultiCell(0, 6, tr(fmt.Sprintf("%s %s", control.ID, control.Title)), "", "L", false)
+		pdf.SetFont("Helvetica", "", 9)
+		pdf.CellFormat(0, 5, fmt.Sprintf("Status: %s; %d open, %d overdue, %d remediated, %d risk accepted",
+			strings.ReplaceAll(string(control.Status), "_", " "), control.OpenFindings, control.OverdueFindings,
+			control.RemediatedFindings, control.AcceptedFindings), "", 1, "L", false, 0, "")
+
+		for _, finding := range control.Findings {
+			pdf.MultiCell(0, 5, tr(fmt.Sprintf("- [%s] %s (%s, due %s)", finding.Severity, finding.Title,
+				strings.ReplaceAll(string(finding.Status), "_", " "), finding.DueAt.Format("2006-01-02"))), "", "L", false)
+		}
+		if len(control.Evidence) == 0 {
+			pdf.CellFormat(0, 5, "No evidence collected in the period.", "", 1, "L", false, 0, "")
+		}
+		for _, evidence := range control.Evidence {
+			line := fmt.Sprintf("Evidence: %s", evidence.Title)
+			if evidence.Description != "" {
+				line += " - " + evidence.Description
+			}
+			if evidence.Reference != "" {
+				line += " (" + evidence.Reference + ")"
+			}
+			pdf.MultiCell(0, 5, tr(line), "", "L", false)
+		}
+	}
+
+	return pdf.Output(w)
+}
+
+// HTTP Handlers
+func (s *APIServer) listFrameworksHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"frameworks": complianceFrameworks})
+}
+
+func (s *APIServer) complianceReportHandler(c *gin.Context) {
+	from, to, err := parseReportRange(c, complianceDefaultRange, scanActivityRetention)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "pdf" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": `format must be "json" or "pdf"`})
+		return
+	}
+
+	report, err := s.compliance.Report(c.Request.Context(), c.Param("framework"), from, to, c.DefaultQuery("summary", "true") != "false")
+	switch {
+	case errors.Is(err, errFrameworkNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if format == "json" {
+		c.JSON(http.StatusOK, report)
+		return
+	}
+	var document bytes.Buffer
+	if err := report.writePDF(&document); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to render PDF: " + err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.pdf"`, report.Framework, report.To.Format("2006-01-02")))
+	c.Data(http.StatusOK, "application/pdf", document.Bytes())
+}
+
+func (s *APIServer) listEvidenceHandler(c *gin.Context) {
+	evidence, err := s.compliance.Evidence(c.Request.Context(), c.Query("framework"), c.Query("control"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"evidence": evidence})
+}
+
+func (s *APIServer) addEvidenceHandler(c *gin.Context) {
+	var evidence ComplianceEvidence
+	if err := c.ShouldBindJSON(&evidence); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	stored, err := s.compliance.AddEvidence(c.Request.Context(), evidence)
+	switch {
+	case errors.Is(err, errInvalidEvidence):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusCreated, stored)
+	}
+}
+
+func (s *APIServer) deleteEvidenceHandler(c *gin.Context) {
+	found, err := s.compliance.DeleteEvidence(c.Request.Context(), c.Param("id"))
+	switch {
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case !found:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Evidence not found"})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
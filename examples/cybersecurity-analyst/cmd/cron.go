@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // the runtime image has no zoneinfo; schedules may name any IANA time zone
+)
+
+// Cron expressions for scheduled scans: five fields (minute hour day-of-month month day-of-week)
+// with lists, ranges, steps, and month/day names, plus the @hourly, @daily, @weekly, @monthly,
+// and @yearly macros. As in Vixie cron, when both day fields are restricted a day matching
+// either one is a match.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 // bit n set when value n is allowed
+	domStar, dowStar              bool
+}
+
+// cronSearchLimit bounds the search for the next run, so expressions like "0 0 30 2 *" that
+// never fire do not loop forever
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var cronFields = [5]cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}},
+	{name: "day of week", min: 0, max: 7, names: map[string]int{ // 0 and 7 are both Sunday
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}},
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields: minute hour day-of-month month day-of-week", expr)
+	}
+
+	var bits [5]uint64
+	for i, part := range parts {
+		value, err := parseCronField(part, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+		bits[i] = value
+	}
+	// Sunday may be written as 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] = bits[4]&^(1<<7) | 1
+	}
+
+	return &cronSchedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: strings.HasPrefix(parts[2], "*"),
+		dowStar: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+// parseCronField parses a comma-separated list of "*", "n", "n-m", each optionally followed by "/step"
+func parseCronField(spec string, field cronField) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(spec, ",") {
+		rangeSpec, stepSpec, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepSpec)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q in %s field", stepSpec, field.name)
+			}
+			step = n
+		}
+
+		low, high := field.min, field.max
+		switch {
+		case rangeSpec == "*":
+		case strings.Contains(rangeSpec, "-"):
+			lowSpec, highSpec, _ := strings.Cut(rangeSpec, "-")
+			var err error
+			if low, err = cronValue(lowSpec, field); err != nil {
+				return 0, err
+			}
+			if high, err = cronValue(highSpec, field); err != nil {
+				return 0, err
+			}
+			if low > high {
+				return 0, fmt.Errorf("invalid range %q in %s field", rangeSpec, field.name)
+			}
+		default:
+			value, err := cronValue(rangeSpec, field)
+			if err != nil {
+				return 0, err
+			}
+			low, high = value, value
+			// "n/step" runs from n to the end of the field
+			if hasStep {
+				high = field.max
+			}
+		}
+
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(spec string, field cronField) (int, error) {
+	if value, ok := field.names[strings.ToLower(spec)]; ok {
+		return value, nil
+	}
+	value, err := strconv.Atoi(spec)
+	if err != nil || value < field.min || value > field.max {
+		return 0, fmt.Errorf("invalid value %q in %s field (allowed %d-%d)", spec, field.name, field.min, field.max)
+	}
+	return value, nil
+}
+
+// next returns the first matching minute after t, in t's location, or the zero time when the
+// expression never matches
+func (c *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	// Truncate works on absolute time, so this cannot move back across a DST change
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronSearchLimit)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = skipTo(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = skipTo(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = skipTo(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc))
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// skipTo returns candidate, or the next minute when candidate falls in a DST gap that
+// time.Date normalized back to t or earlier
+func skipTo(t, candidate time.Time) time.Time {
+	if candidate.After(t) {
+		return candidate
+	}
+	return t.Add(time.Minute)
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// CVE database backed by Postgres, populated from the NVD and CISA KEV feeds
+const maxCVEMatches = 100 // CVEs returned per fingerprint
+
+const cveSchema = `
+CREATE TABLE IF NOT EXISTS cves (
+	id            TEXT PRIMARY KEY,
+	description   TEXT NOT NULL,
+	severity      TEXT NOT NULL,
+	cvss_score    DOUBLE PRECISION NOT NULL,
+	cvss_vector   TEXT NOT NULL DEFAULT '',
+	published     TIMESTAMPTZ,
+	last_modified TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS cve_cpe_matches (
+	cve_id                  TEXT NOT NULL REFERENCES cves(id) ON DELETE CASCADE,
+	criteria                TEXT NOT NULL,
+	vendor                  TEXT NOT NULL,
+	product                 TEXT NOT NULL,
+	version                 TEXT NOT NULL,
+	version_start_including TEXT NOT NULL DEFAULT '',
+	version_start_excluding TEXT NOT NULL DEFAULT '',
+	version_end_including   TEXT NOT NULL DEFAULT '',
+	version_end_excluding   TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS cve_cpe_matches_product ON cve_cpe_matches (product, vendor);
+CREATE INDEX IF NOT EXISTS cve_cpe_matches_cve ON cve_cpe_matches (cve_id);
+
+CREATE TABLE IF NOT EXISTS kev_entries (
+	cve_id          TEXT PRIMARY KEY,
+	vulnerability   TEXT NOT NULL,
+	required_action TEXT NOT NULL,
+	date_added      DATE,
+	due_date        DATE,
+	ransomware_use  BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS cve_sync_state (
+	feed          TEXT PRIMARY KEY,
+	watermark     TIMESTAMPTZ,
+	last_success  TIMESTAMPTZ,
+	last_error    TEXT NOT NULL DEFAULT '',
+	entries       INTEGER NOT NULL DEFAULT 0
+);
+`
+
+// productAliases maps names seen in service banners to their NVD vendor and product
+var productAliases = map[string][2]string{
+	"apache":        {"apache", "http_server"},
+	"httpd":         {"apache", "http_server"},
+	"microsoft_iis": {"microsoft", "internet_information_services"},
+	"iis":           {"microsoft", "internet_information_services"},
+	"openssh":       {"openbsd", "openssh"},
+	"openssl":       {"openssl", "openssl"},
+	"mysql":         {"oracle", "mysql"},
+	"postgresql":    {"postgresql", "postgresql"},
+	"tomcat":        {"apache", "tomcat"},
+}
+
+type CVEDatabase struct {
+	db *sql.DB
+}
+
+type CVEEntry struct {
+	ID             string
+	Severity       ThreatLevel
+	CVSSScore      float64
+	Description    string
+	Remediation    string
+	KnownExploited bool
+}
+
+func (e CVEEntry) vulnerability(affectedSystems []string) Vulnerability {
+	if affectedSystems == nil {
+		affectedSystems = make([]string, 0)
+	}
+	return Vulnerability{
+		CVE:             e.ID,
+		Severity:        e.Severity,
+		Score:           e.CVSSScore,
+		Description:     e.Description,
+		Remediation:     e.Remediation,
+		AffectedSystems: affectedSystems,
+		KnownExploited:  e.KnownExploited,
+	}
+}
+
+// SoftwareFingerprint identifies software found on a target, either as a CPE 2.3 name or as
+// vendor, product, and version
+type SoftwareFingerprint struct {
+	CPE     string `json:"cpe,omitempty"`
+	Vendor  string `json:"vendor,omitempty"`
+	Product string `json:"product,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// cpeMatch is a vulnerable-software criterion of a CVE; ranges apply when the criteria version is *
+type cpeMatch struct {
+	Criteria       string
+	Version        string
+	StartIncluding string
+	StartExcluding string
+	EndIncluding   string
+	EndExcluding   string
+}
+
+func NewCVEDatabase(db *sql.DB) *CVEDatabase {
+	return &CVEDatabase{db: db}
+}
+
+func (cdb *CVEDatabase) EnsureSchema(ctx context.Context) error {
+	if _, err := cdb.db.ExecContext(ctx, cveSchema); err != nil {
+		return fmt.Errorf("failed to create CVE schema: %w", err)
+	}
+	return nil
+}
+
+// Search returns the CVEs whose vulnerable configurations include the fingerprinted software,
+// known exploited CVEs first and then by CVSS score
+func (cdb *CVEDatabase) Search(ctx context.Context, fingerprint SoftwareFingerprint) ([]CVEEntry, error) {
+	fingerprint = normalizeFingerprint(fingerprint)
+	if fingerprint.Product == "" {
+		return nil, fmt.Errorf("fingerprint needs a product or CPE")
+	}
+
+	rows, err := cdb.db.QueryContext(ctx, `
+		SELECT c.id, c.severity, c.cvss_score, c.description,
+		       COALESCE(k.required_action, ''), k.cve_id IS NOT NULL,
+		       m.criteria, m.version, m.version_start_including, m.version_start_excluding,
+		       m.version_end_including, m.version_end_excluding
+		FROM cve_cpe_matches m
+		JOIN cves c ON c.id = m.cve_id
+		LEFT JOIN kev_entries k ON k.cve_id = c.id
+		WHERE m.product = $1 AND ($2 = '' OR m.vendor = $2)`,
+		fingerprint.Product, fingerprint.Vendor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query CVEs: %w", err)
+	}
+	defer rows.Close()
+
+	found := make(map[string]CVEEntry)
+	for rows.Next() {
+		var entry CVEEntry
+		var severity, kevAction string
+		var match cpeMatch
+		if err := rows.Scan(&entry.ID, &severity, &entry.CVSSScore, &entry.Description, &kevAction, &entry.KnownExploited,
+			&match.Criteria, &match.Version, &match.StartIncluding, &match.StartExcluding, &match.EndIncluding, &match.EndExcluding); err != nil {
+			return nil, fmt.Errorf("failed to read CVE: %w", err)
+		}
+		if _, ok := found[entry.ID]; ok || !match.affects(fingerprint.Version) {
+			continue
+		}
+
+		entry.Severity = ThreatLevel(severity)
+		entry.Remediation = match.remediation(fingerprint)
+		if kevAction != "" {
+			entry.Remediation = kevAction + " (CISA KEV: exploited in the wild)"
+		}
+		found[entry.ID] = entry
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read CVEs: %w", err)
+	}
+
+	entries := make([]CVEEntry, 0, len(found))
+	for _, entry := range found {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].KnownExploited != entries[j].KnownExploited {
+			return entries[i].KnownExploited
+		}
+		if entries[i].CVSSScore != entries[j].CVSSScore {
+			return entries[i].CVSSScore > entries[j].CVSSScore
+		}
+		return entries[i].ID > entries[j].ID
+	})
+	if len(entries) > maxCVEMatches {
+		entries = entries[:maxCVEMatches]
+	}
+	return entries, nil
+}
+
+// CVEDetail is a CVE with its KEV listing and vulnerable software criteria, for matching CVEs
+// against watchlists as they are synchronized
+type CVEDetail struct {
+	CVEEntry
+	Published     time.Time
+	KEVAction     string // action CISA requires of federal agencies
+	KEVAdded      *time.Time
+	KEVDueDate    *time.Time
+	RansomwareUse bool
+	Criteria      []cpeCriterion
+}
+
+type cpeCriterion struct {
+	Vendor  string
+	Product string
+	cpeMatch
+}
+
+// match returns the criterion under which the CVE covers the normalized fingerprint, or nil. A
+// fingerprint without a version is covered by every CVE of its product.
+func (d CVEDetail) match(fingerprint SoftwareFingerprint) *cpeCriterion {
+	for i, criterion := range d.Criteria {
+		if criterion.Product != fingerprint.Product || (fingerprint.Vendor != "" && criterion.Vendor != fingerprint.Vendor) {
+			continue
+		}
+		if fingerprint.Version == "" || criterion.affects(fingerprint.Version) {
+			return &d.Criteria[i]
+		}
+	}
+	return nil
+}
+
+// Details loads the given CVEs with their criteria; unknown IDs are skipped
+func (cdb *CVEDatabase) Details(ctx context.Context, ids []string) ([]CVEDetail, error) {
+	rows, err := cdb.db.QueryContext(ctx, `
+		SELECT c.id, c.severity, c.cvss_score, c.description, c.published,
+		       COALESCE(k.required_action, ''), k.cve_id IS NOT NULL, k.date_added, k.due_date, COALESCE(k.ransomware_use, FALSE),
+		       COALESCE(m.vendor, ''), COALESCE(m.product, ''), COALESCE(m.criteria, ''), COALESCE(m.version, ''),
+		       COALESCE(m.version_start_including, ''), COALESCE(m.version_start_excluding, ''),
+		       COALESCE(m.version_end_including, ''), COALESCE(m.version_end_excluding, '')
+		FROM cves c
+		LEFT JOIN kev_entries k ON k.cve_id = c.id
+		LEFT JOIN cve_cpe_matches m ON m.cve_id = c.id
+		WHERE c.id = ANY($1)
+		ORDER BY c.id`, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query CVEs: %w", err)
+	}
+	defer rows.Close()
+
+	details := make([]CVEDetail, 0, len(ids))
+	for rows.Next() {
+		var detail CVEDetail
+		var severity string
+		var published, kevAdded, kevDue sql.NullTime
+		var criterion cpeCriterion
+		if err := rows.Scan(&detail.ID, &severity, &detail.CVSSScore, &detail.Description, &published,
+			&detail.KEVAction, &detail.KnownExploited, &kevAdded, &kevDue, &detail.RansomwareUse,
+			&criterion.Vendor, &criterion.Product, &criterion.Criteria, &criterion.Version,
+			&criterion.StartIncluding, &criterion.StartExcluding, &criterion.EndIncluding, &criterion.EndExcluding); err != nil {
+			return nil, fmt.Errorf("failed to read CVE: %w", err)
+		}
+		if len(details) == 0 || details[len(details)-1].ID != detail.ID {
+			detail.Severity = ThreatLevel(severity)
+			detail.Published = published.Time
+			if kevAdded.Valid {
+				detail.KEVAdded = &kevAdded.Time
+			}
+			if kevDue.Valid {
+				detail.KEVDueDate = &kevDue.Time
+			}
+			details = append(details, detail)
+		}
+		if criterion.Product != "" {
+			last := &details[len(details)-1]
+			last.Criteria = append(last.Criteria, criterion)
+		}
+	}
+	return details, rows.Err()
+}
+
+// affects reports whether the criterion covers version. Without a known version only criteria
+// covering every version match.
+func (m cpeMatch) affects(version string) bool {
+	ranged := m.StartIncluding != "" || m.StartExcluding != "" || m.EndIncluding != "" || m.EndExcluding != ""
+
+	switch m.Version {
+	case "*", "":
+		if !ranged {
+			return true
+		}
+	case "-":
+		return false
+	default:
+		return version != "" && compareVersions(version, m.Version) == 0
+	}
+
+	if version == "" {
+		return false
+	}
+	if m.StartIncluding != "" && compareVersions(version, m.StartIncluding) < 0 {
+		return false
+	}
+	if m.StartExcluding != "" && compareVersions(version, m.StartExcluding) <= 0 {
+		return false
+	}
+	if m.EndIncluding != "" && compareVersions(version, m.EndIncluding) > 0 {
+		return false
+	}
+	if m.EndExcluding != "" && compareVersions(version, m.EndExcluding) >= 0 {
+		return false
+	}
+	return true
+}
+
+func (m cpeMatch) remediation(fingerprint SoftwareFingerprint) string {
+	switch {
+	case m.EndExcluding != "":
+		return fmt.Sprintf("Upgrade %s to %s or later", fingerprint.Product, m.EndExcluding)
+	case m.EndIncluding != "":
+		return fmt.Sprintf("Upgrade %s to a version later than %s", fingerprint.Product, m.EndIncluding)
+	default:
+		return fmt.Sprintf("Apply the vendor fix for %s %s", fingerprint.Product, fingerprint.Version)
+	}
+}
+
+// parseFingerprint reads a CPE 2.3 name or a "product/version" / "product_version" banner
+func parseFingerprint(target string) (SoftwareFingerprint, bool) {
+	target = strings.TrimSpace(target)
+	if strings.HasPrefix(target, "cpe:2.3:") {
+		return SoftwareFingerprint{CPE: target}, true
+	}
+	if net.ParseIP(target) != nil {
+		return SoftwareFingerprint{}, false
+	}
+	if _, _, err := net.ParseCIDR(target); err == nil {
+		return SoftwareFingerprint{}, false
+	}
+
+	// Banners look like "nginx/1.18.0", "Apache/2.4.49 (Unix)", or "OpenSSH_8.2p1"
+	banner := strings.Fields(target)
+	if len(banner) == 0 {
+		return SoftwareFingerprint{}, false
+	}
+	for _, sep := range []string{"/", "_"} {
+		if i := strings.LastIndex(banner[0], sep); i > 0 && i < len(banner[0])-1 && unicode.IsDigit(rune(banner[0][i+1])) {
+			return SoftwareFingerprint{Product: banner[0][:i], Version: banner[0][i+1:]}, true
+		}
+	}
+	return SoftwareFingerprint{}, false
+}
+
+// normalizeFingerprint expands a CPE and maps product names onto NVD's naming
+func normalizeFingerprint(fp SoftwareFingerprint) SoftwareFingerprint {
+	if fp.CPE != "" {
+		if parts := splitCPE(fp.CPE); len(parts) >= 6 {
+			fp.Vendor, fp.Product, fp.Version = parts[3], parts[4], parts[5]
+		}
+	}
+	if fp.Version == "*" || fp.Version == "-" {
+		fp.Version = ""
+	}
+
+	normalize := func(s string) string {
+		return strings.NewReplacer(" ", "_", "-", "_").Replace(strings.ToLower(strings.TrimSpace(s)))
+	}
+	fp.Vendor, fp.Product = normalize(fp.Vendor), normalize(fp.Product)
+	if fp.Vendor == "*" {
+		fp.Vendor = ""
+	}
+	if alias, ok := productAliases[fp.Product]; ok && (fp.Vendor == "" || fp.Vendor == alias[0]) {
+		fp.Vendor, fp.Product = alias[0], alias[1]
+	}
+	return fp
+}
+
+// splitCPE splits a CPE 2.3 formatted string on unescaped colons
+func splitCPE(cpe string) []string {
+	parts := make([]string, 0, 13)
+	var current strings.Builder
+	escaped := false
+	for _, r := range cpe {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ':':
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	return append(parts, current.String())
+}
+
+// compareVersions orders dotted versions segment by segment, numerically where both segments
+// are numbers ("2.4.9" < "2.4.49") and lexically otherwise ("8.2p1" < "8.2p2")
+func compareVersions(a, b string) int {
+	as, bs := versionSegments(a), versionSegments(b)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y string
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		// A missing segment equals zero ("1.18" == "1.18.0") but sorts after a pre-release label
+		// ("1.0" > "1.0rc1")
+		if x == "" {
+			if _, err := strconv.ParseUint(y, 10, 64); err != nil {
+				return 1
+			}
+			x = "0"
+		}
+		if y == "" {
+			if _, err := strconv.ParseUint(x, 10, 64); err != nil {
+				return -1
+			}
+			y = "0"
+		}
+
+		xn, xerr := strconv.ParseUint(x, 10, 64)
+		yn, yerr := strconv.ParseUint(y, 10, 64)
+		switch {
+		case xerr == nil && yerr == nil:
+			if xn == yn {
+				continue
+			}
+			if xn < yn {
+				return -1
+			}
+			return 1
+		case x == y:
+			continue
+		case xerr == nil:
+			return 1 // release segments sort after pre-release labels ("1.0" > "1.0rc1")
+		case yerr == nil:
+			return -1
+		case x < y:
+			return -1
+		default:
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionSegments splits "8.2p1" into ["8", "2", "p", "1"]
+func versionSegments(version string) []string {
+	segments := make([]string, 0)
+	var current strings.Builder
+	digits := false
+	flush := func() {
+		if current.Len() > 0 {
+			segments = append(segments, current.String())
+			current.Reset()
+		}
+	}
+	for _, r := range strings.ToLower(version) {
+		switch {
+		case r == '.' || r == '-' || r == '_' || r == '+' || r == ':':
+			flush()
+		case unicode.IsDigit(r) != digits && current.Len() > 0:
+			flush()
+			fallthrough
+		default:
+			digits = unicode.IsDigit(r)
+			current.WriteRune(r)
+		}
+	}
+	flush()
+	return segments
+}
+
+// SyncStatus reports the state of each feed
+func (cdb *CVEDatabase) SyncStatus(ctx context.Context) ([]FeedSyncStatus, error) {
+	rows, err := cdb.db.QueryContext(ctx, `SELECT feed, watermark, last_success, last_error, entries FROM cve_sync_state ORDER BY feed`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sync state: %w", err)
+	}
+	defer rows.Close()
+
+	feeds := make([]FeedSyncStatus, 0)
+	for rows.Next() {
+		var feed FeedSyncStatus
+		var watermark, lastSuccess sql.NullTime
+		if err := rows.Scan(&feed.Feed, &watermark, &lastSuccess, &feed.LastError, &feed.Entries); err != nil {
+			return nil, fmt.Errorf("failed to read sync state: %w", err)
+		}
+		if watermark.Valid {
+			feed.Watermark = &watermark.Time
+		}
+		if lastSuccess.Valid {
+			feed.LastSuccess = &lastSuccess.Time
+		}
+		feeds = append(feeds, feed)
+	}
+	return feeds, rows.Err()
+}
+
+type FeedSyncStatus struct {
+	Feed        string     `json:"feed"`
+	Watermark   *time.Time `json:"watermark,omitempty"` // NVD lastModified already synced
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	Entries     int        `json:"entries"`
+}
+
+// HTTP Handlers
+func (s *APIServer) searchCVEsHandler(c *gin.Context) {
+	fingerprint := SoftwareFingerprint{
+		CPE:     c.Query("cpe"),
+		Vendor:  c.Query("vendor"),
+		Product: c.Query("product"),
+		Version: c.Query("version"),
+	}
+	if banner := c.Query("banner"); banner != "" {
+		parsed, ok := parseFingerprint(banner)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("cannot read a product and version from banner %q", banner)})
+			return
+		}
+		fingerprint = parsed
+	}
+	if fingerprint.CPE == "" && fingerprint.Product == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "one of cpe, product, or banner is required"})
+		return
+	}
+
+	entries, err := s.threatDetector.cveDatabase.Search(c.Request.Context(), fingerprint)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	vulns := make([]Vulnerability, 0, len(entries))
+	for _, entry := range entries {
+		vulns = append(vulns, entry.vulnerability(nil))
+	}
+	c.JSON(http.StatusOK, gin.H{"fingerprint": normalizeFingerprint(fingerprint), "vulnerabilities": vulns})
+}
+
+func (s *APIServer) cveSyncStatusHandler(c *gin.Context) {
+	feeds, err := s.threatDetector.cveDatabase.SyncStatus(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"feeds": feeds})
+}
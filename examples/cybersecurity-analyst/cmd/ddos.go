@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stateful DoS detection: traffic towards each destination is counted in one-second buckets, and
+// a sliding window of them is compared with thresholds that adapt to what the destination
+// normally receives. TCP handshakes are followed so SYN floods show as SYNs that clients never
+// complete, rather than as SYNs alone.
+const (
+	ddosWindowSeconds     = 10               // sliding detection window
+	ddosMemory            = 600              // samples of the adaptive thresholds; older seconds fade out with weight 1/600
+	ddosMinSamples        = 60               // seconds observed before a destination's own rates are trusted
+	ddosMaxBackfill       = 300              // idle seconds learned as zero traffic when a destination reappears
+	ddosMinPacketRate     = 5000             // packets/sec before volume can count as a flood
+	ddosMinSYNRate        = 200              // SYNs/sec before they can count as a flood
+	ddosMaxCompletion     = 0.5              // share of SYNs completed by clients below which SYNs look like a flood
+	ddosMinSources        = 10               // sources needed before a flood counts as distributed
+	ddosSurgeFactor       = 3                // adaptive thresholds are at least this multiple of the mean rate
+	ddosAlertCooldown     = 5 * time.Minute  // each kind of flood is raised once per destination in this time
+	ddosIdleEviction      = 10 * time.Minute // destinations idle this long are dropped from memory
+	ddosEvictionInterval  = time.Minute
+	maxDDoSTargets        = 10000
+	maxDDoSSources        = 100000              // sources tracked per destination
+	maxDDoSHalfOpen       = 100000              // unanswered handshakes tracked per destination
+	ddosHandshakeTimeout  = ddosWindowSeconds   // seconds a client has to complete a handshake
+	ddosCriticalExcess    = 10                  // rate over threshold that makes a flood critical
+	ddosHighExcess        = 3                   // rate over threshold that makes a flood high severity
+	ddosConfidenceExcess  = 16                  // rate over threshold that earns full confidence for magnitude
+	ddosConfidenceSources = 10 * ddosMinSources // sources that earn full confidence for distribution
+)
+
+var (
+	ddosTargets = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cybersecurity_ddos_targets",
+			Help: "Destinations whose traffic is tracked for DoS detection",
+		},
+	)
+
+	ddosDetections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_ddos_detections_total",
+			Help: "DoS floods detected by kind (syn_flood, volumetric)",
+		},
+		[]string{"kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(ddosTargets)
+	prometheus.MustRegister(ddosDetections)
+}
+
+// rateStats is an exponentially weighted mean and variance of a per-second rate
+type rateStats struct {
+	Samples  int     `json:"samples"`
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+}
+
+func (s *rateStats) add(rate float64) {
+	s.Samples++
+	alpha := math.Max(1/float64(s.Samples), 1.0/ddosMemory)
+	delta := rate - s.Mean
+	s.Mean += alpha * delta
+	s.Variance = (1 - alpha) * (s.Variance + alpha*delta*delta)
+}
+
+// threshold is the rate above which traffic is a flood: the floor, raised for destinations that
+// normally receive more once enough of their traffic has been seen
+func (s rateStats) threshold(floor, sensitivity float64) float64 {
+	if s.Samples < ddosMinSamples {
+		return floor
+	}
+	return math.Max(floor, math.Max(s.Mean+sensitivity*math.Sqrt(s.Variance), ddosSurgeFactor*s.Mean))
+}
+
+func (s rateStats) String() string {
+	return fmt.Sprintf("%.0f/s ± %.0f", s.Mean, math.Sqrt(s.Variance))
+}
+
+// ddosBucket counts one second of traffic towards a destination
+type ddosBucket struct {
+	second    int64
+	packets   uint64
+	bytes     uint64
+	sources   uint64 // distinct sources seen in this second
+	syns      uint64 // connection attempts received
+	synAcks   uint64 // connection attempts the destination answered
+	completed uint64 // handshakes clients completed with an ACK
+}
+
+// ddosTarget is the traffic state of one destination
+type ddosTarget struct {
+	address  string
+	current  int64 // latest second seen
+	buckets  [ddosWindowSeconds]ddosBucket
+	sources  map[string]int64     // source -> last second seen
+	halfOpen map[string]int64     // "source:port>port" -> second the SYN arrived
+	alerted  map[string]ddosAlert // flood kind -> when it was last raised
+	pruned   int64                // second expired sources and handshakes were last forgotten
+
+	packetRate rateStats
+	synRate    rateStats
+	sourceRate rateStats
+	lastSeen   time.Time
+}
+
+func newDDoSTarget(address string) *ddosTarget {
+	return &ddosTarget{
+		address:  address,
+		sources:  make(map[string]int64),
+		halfOpen: make(map[string]int64),
+		alerted:  make(map[string]ddosAlert),
+	}
+}
+
+// ddosAlert is the last flood of a kind raised for a destination
+type ddosAlert struct {
+	second   int64
+	severity ThreatLevel
+}
+
+// bucket returns the bucket of a second within the window, starting it when the second is new;
+// seconds older than the window are not counted
+func (t *ddosTarget) bucket(second int64) *ddosBucket {
+	if second <= t.current-ddosWindowSeconds {
+		return nil
+	}
+	b := &t.buckets[second%ddosWindowSeconds]
+	if b.second != second {
+		*b = ddosBucket{second: second}
+	}
+	return b
+}
+
+// windowTotals sums the buckets of the window ending at the current second
+type windowTotals struct {
+	seconds   int64
+	packets   uint64
+	bytes     uint64
+	syns      uint64
+	synAcks   uint64
+	completed uint64
+}
+
+func (t *ddosTarget) window() windowTotals {
+	var w windowTotals
+	first := t.current
+	for _, b := range t.buckets {
+		if b.second == 0 || b.second <= t.current-ddosWindowSeconds || b.second > t.current {
+			continue
+		}
+		first = min(first, b.second)
+		w.packets += b.packets
+		w.bytes += b.bytes
+		w.syns += b.syns
+		w.synAcks += b.synAcks
+		w.completed += b.completed
+	}
+	w.seconds = t.current - first + 1
+	return w
+}
+
+// activeSources counts the sources seen within the window, forgetting older ones
+func (t *ddosTarget) activeSources() int {
+	for source, seen := range t.sources {
+		if seen <= t.current-ddosWindowSeconds {
+			delete(t.sources, source)
+		}
+	}
+	return len(t.sources)
+}
+
+// DDoSDetector tracks traffic per destination for each tenant. Live capture and streams update
+// the state and its adaptive thresholds; packets submitted for analysis are evaluated on their
+// own against the learned thresholds.
+type DDoSDetector struct {
+	sensitivity float64 // standard deviations above a destination's mean rate before it is a flood
+
+	mu      sync.Mutex
+	targets map[string]*ddosTarget // tenant + "|" + destination
+	evicted time.Time
+	full    bool // maxDDoSTargets was reached; logged once
+}
+
+func NewDDoSDetector(sensitivity float64) *DDoSDetector {
+	if sensitivity <= 0 {
+		sensitivity = 4
+	}
+	return &DDoSDetector{sensitivity: sensitivity, targets: make(map[string]*ddosTarget)}
+}
+
+// Observe adds live packets to the tenant's state and returns the floods they complete. Each kind
+// of flood is raised once per destination per ddosAlertCooldown, and again within it only when
+// the flood grows more severe.
+func (dd *DDoSDetector) Observe(ctx context.Context, packets []NetworkPacket) []ThreatIndicator {
+	threats := make([]ThreatIndicator, 0)
+	if len(packets) == 0 {
+		return threats
+	}
+	tenant := tenantFromContext(ctx)
+	now := time.Now()
+
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	dd.evict(now)
+	lookup := func(address string, create bool) *ddosTarget {
+		key := tenant + "|" + address
+		target, ok := dd.targets[key]
+		if !ok && create {
+			if len(dd.targets) >= maxDDoSTargets {
+				if !dd.full {
+					log.Printf("DoS tracking limit of %d destinations reached; new destinations are not tracked", maxDDoSTargets)
+					dd.full = true
+				}
+				return nil
+			}
+			target = newDDoSTarget(address)
+			dd.targets[key] = target
+		}
+		if target != nil {
+			target.lastSeen = now
+		}
+		return target
+	}
+
+	for _, threat := range dd.replay(packets, now, lookup, true) {
+		target := dd.targets[tenant+"|"+threat.DestIP]
+		kind := threat.Evidence[0]
+		last, ok := target.alerted[kind]
+		if ok && target.current-last.second < int64(ddosAlertCooldown/time.Second) && severityRank[threat.Severity] <= severityRank[last.severity] {
+			continue
+		}
+		target.alerted[kind] = ddosAlert{second: target.current, severity: threat.Severity}
+		ddosDetections.WithLabelValues(kind).Inc()
+		threat.Evidence = threat.Evidence[1:]
+		threats = append(threats, threat)
+	}
+	ddosTargets.Set(float64(len(dd.targets)))
+	return threats
+}
+
+// Evaluate looks for floods within packets submitted for analysis without adding them to the
+// live state. The strongest flood of each kind per destination is reported, and destinations the
+// tenant's sensors have learned keep their adaptive thresholds.
+func (dd *DDoSDetector) Evaluate(ctx context.Context, packets []NetworkPacket) []ThreatIndicator {
+	threats := make([]ThreatIndicator, 0)
+	if len(packets) == 0 {
+		return threats
+	}
+	tenant := tenantFromContext(ctx)
+	now := time.Now()
+
+	scratch := make(map[string]*ddosTarget)
+	lookup := func(address string, create bool) *ddosTarget {
+		if target, ok := scratch[address]; ok {
+			return target
+		}
+		if !create || len(scratch) >= maxDDoSTargets {
+			return nil
+		}
+		target := newDDoSTarget(address)
+		dd.mu.Lock()
+		if learned, ok := dd.targets[tenant+"|"+address]; ok {
+			target.packetRate, target.synRate, target.sourceRate = learned.packetRate, learned.synRate, learned.sourceRate
+		}
+		dd.mu.Unlock()
+		scratch[address] = target
+		return target
+	}
+
+	strongest := make(map[string]ThreatIndicator)
+	for _, threat := range dd.replay(packets, now, lookup, false) {
+		key := threat.DestIP + "|" + threat.Evidence[0]
+		if previous, ok := strongest[key]; !ok || threat.Confidence > previous.Confidence {
+			strongest[key] = threat
+		}
+	}
+	keys := make([]string, 0, len(strongest))
+	for key := range strongest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		threat := strongest[key]
+		ddosDetections.WithLabelValues(threat.Evidence[0]).Inc()
+		threat.Evidence = threat.Evidence[1:]
+		threats = append(threats, threat)
+	}
+	return threats
+}
+
+// replay feeds packets to their destinations in time order, checking each destination for floods
+// whenever a second closes and once more after the last packet. Packets without a timestamp count
+// as arriving now. When learn is set, each closed second trains the adaptive thresholds unless it
+// was part of a flood. The first evidence entry of each indicator is the flood kind, which
+// callers strip.
+func (dd *DDoSDetector) replay(packets []NetworkPacket, now time.Time, lookup func(address string, create bool) *ddosTarget, learn bool) []ThreatIndicator {
+	order := make([]int, len(packets))
+	for i := range order {
+		order[i] = i
+	}
+	at := func(i int) int64 {
+		if packets[i].Timestamp.IsZero() {
+			return now.Unix()
+		}
+		return packets[i].Timestamp.Unix()
+	}
+	sort.SliceStable(order, func(i, j int) bool { return at(order[i]) < at(order[j]) })
+
+	threats := make([]ThreatIndicator, 0)
+	touched := make(map[*ddosTarget]bool)
+	for _, i := range order {
+		packet := &packets[i]
+		second := at(i)
+		syn, ack := packet.Flags["SYN"], packet.Flags["ACK"]
+
+		// A SYN/ACK is the destination of an earlier SYN answering it
+		if syn && ack {
+			if target := lookup(packet.SourceIP, false); target != nil {
+				threats = append(threats, dd.advance(target, second, learn)...)
+				if b := target.bucket(second); b != nil {
+					b.synAcks++
+				}
+			}
+			continue
+		}
+		if packet.DestIP == "" {
+			continue
+		}
+		target := lookup(packet.DestIP, true)
+		if target == nil {
+			continue
+		}
+		touched[target] = true
+		threats = append(threats, dd.advance(target, second, learn)...)
+		b := target.bucket(second)
+		if b == nil {
+			continue
+		}
+
+		b.packets++
+		b.bytes += uint64(packet.PayloadSize)
+		if seen, ok := target.sources[packet.SourceIP]; ok || len(target.sources) < maxDDoSSources {
+			if !ok || seen != second {
+				target.sources[packet.SourceIP] = second
+				b.sources++
+			}
+		}
+		if !isTCP(packet) {
+			continue
+		}
+		connection := packet.SourceIP + ":" + strconv.Itoa(packet.SourcePort) + ">" + strconv.Itoa(packet.DestPort)
+		switch {
+		case syn:
+			b.syns++
+			if len(target.halfOpen) < maxDDoSHalfOpen {
+				target.halfOpen[connection] = second
+			}
+		case ack:
+			if opened, ok := target.halfOpen[connection]; ok {
+				delete(target.halfOpen, connection)
+				if opened > target.current-ddosWindowSeconds {
+					if b := target.bucket(opened); b != nil {
+						b.completed++
+					}
+				}
+			}
+		}
+	}
+
+	targets := make([]*ddosTarget, 0, len(touched))
+	for target := range touched {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].address < targets[j].address })
+	for _, target := range targets {
+		threats = append(threats, dd.check(target)...)
+	}
+	return threats
+}
+
+func isTCP(packet *NetworkPacket) bool {
+	return packet.Protocol == "" || packet.Protocol == "TCP" || packet.Protocol == "tcp"
+}
+
+// advance moves a destination to a later second. The window ending at the closing second is
+// checked first; then, when learning, the closed and idle seconds train the thresholds.
+func (dd *DDoSDetector) advance(target *ddosTarget, second int64, learn bool) []ThreatIndicator {
+	if target.current == 0 {
+		target.current = second
+		return nil
+	}
+	if second <= target.current {
+		return nil
+	}
+
+	threats := dd.check(target)
+	if learn {
+		closed := target.buckets[target.current%ddosWindowSeconds]
+		if closed.second == target.current && len(threats) == 0 {
+			target.packetRate.add(float64(closed.packets))
+			target.synRate.add(float64(closed.syns))
+			target.sourceRate.add(float64(closed.sources))
+		}
+		for idle := min(second-target.current-1, ddosMaxBackfill); idle > 0; idle-- {
+			target.packetRate.add(0)
+			target.synRate.add(0)
+			target.sourceRate.add(0)
+		}
+	}
+	target.current = second
+
+	// Sources outside the window no longer count, and handshakes not completed within the
+	// timeout will not be; forget them
+	if second-target.pruned >= ddosWindowSeconds {
+		target.pruned = second
+		target.activeSources()
+		for connection, opened := range target.halfOpen {
+			if opened <= second-ddosHandshakeTimeout {
+				delete(target.halfOpen, connection)
+			}
+		}
+	}
+	return threats
+}
+
+// check compares the window ending at the destination's current second with its thresholds
+func (dd *DDoSDetector) check(target *ddosTarget) []ThreatIndicator {
+	threats := make([]ThreatIndicator, 0)
+	w := target.window()
+	seconds := float64(max(w.seconds, 1))
+	packetRate := float64(w.packets) / seconds
+	synRate := float64(w.syns) / seconds
+	packetThreshold := target.packetRate.threshold(ddosMinPacketRate, dd.sensitivity)
+	synThreshold := target.synRate.threshold(ddosMinSYNRate, dd.sensitivity)
+	if packetRate <= packetThreshold && synRate <= synThreshold {
+		return threats
+	}
+
+	sources := target.activeSources()
+	distributed := sources >= ddosMinSources
+	learned := target.packetRate.Samples >= ddosMinSamples
+	windowText := fmt.Sprintf("%ds", w.seconds)
+	sourceEvidence := fmt.Sprintf("%d distinct sources within %s", sources, windowText)
+	if learned {
+		sourceEvidence += fmt.Sprintf(" (normally %s)", target.sourceRate)
+	}
+
+	completion := 1.0
+	if w.syns > 0 {
+		completion = float64(w.completed) / float64(w.syns)
+	}
+	if synRate > synThreshold && completion < ddosMaxCompletion {
+		excess := synRate / synThreshold
+		confidence := 0.5 + 0.2*math.Min(1, math.Log2(excess)/math.Log2(ddosConfidenceExcess)) + 0.2*(1-completion/ddosMaxCompletion)
+		if distributed {
+			confidence += 0.05
+		}
+		if learned {
+			confidence += 0.05
+		}
+		thresholdText := fmt.Sprintf("threshold %.0f/s", synThreshold)
+		if target.synRate.Samples >= ddosMinSamples {
+			thresholdText += fmt.Sprintf(", normally %s", target.synRate)
+		}
+		description := "SYN flood"
+		if distributed {
+			description = "Distributed SYN flood"
+		}
+		threats = append(threats, ThreatIndicator{
+			Type:        DDoS,
+			Severity:    ddosSeverity(excess),
+			Confidence:  math.Round(math.Min(confidence, 0.99)*100) / 100,
+			Description: description + " detected",
+			DestIP:      target.address,
+			MITREAttack: "T1498",
+			Evidence: []string{
+				"syn_flood",
+				fmt.Sprintf("%.0f SYNs/sec over %s (%s)", synRate, windowText, thresholdText),
+				fmt.Sprintf("Clients completed %.1f%% of handshakes (%d of %d SYNs); the target answered %d with SYN/ACK", completion*100, w.completed, w.syns, w.synAcks),
+				sourceEvidence,
+			},
+		})
+	}
+
+	if packetRate > packetThreshold && distributed {
+		excess := packetRate / packetThreshold
+		confidence := 0.5 + 0.25*math.Min(1, math.Log2(excess)/math.Log2(ddosConfidenceExcess)) + 0.15*math.Min(1, float64(sources)/ddosConfidenceSources)
+		if learned {
+			confidence += 0.05
+		}
+		thresholdText := fmt.Sprintf("threshold %.0f/s", packetThreshold)
+		if learned {
+			thresholdText += fmt.Sprintf(", normally %s", target.packetRate)
+		}
+		threats = append(threats, ThreatIndicator{
+			Type:        DDoS,
+			Severity:    ddosSeverity(excess),
+			Confidence:  math.Round(math.Min(confidence, 0.99)*100) / 100,
+			Description: "Volumetric DDoS attack detected",
+			DestIP:      target.address,
+			MITREAttack: "T1498",
+			Evidence: []string{
+				"volumetric",
+				fmt.Sprintf("%.0f packets/sec (%.1f Mbps) over %s (%s)", packetRate, float64(w.bytes)*8/seconds/1e6, windowText, thresholdText),
+				sourceEvidence,
+			},
+		})
+	}
+	return threats
+}
+
+func ddosSeverity(excess float64) ThreatLevel {
+	switch {
+	case excess >= ddosCriticalExcess:
+		return Critical
+	case excess >= ddosHighExcess:
+		return High
+	default:
+		return Medium
+	}
+}
+
+// evict drops destinations that have been idle, at most once per ddosEvictionInterval
+func (dd *DDoSDetector) evict(now time.Time) {
+	if now.Sub(dd.evicted) < ddosEvictionInterval {
+		return
+	}
+	dd.evicted = now
+	for key, target := range dd.targets {
+		if now.Sub(target.lastSeen) > ddosIdleEviction {
+			delete(dd.targets, key)
+		}
+	}
+	if len(dd.targets) < maxDDoSTargets {
+		dd.full = false
+	}
+}
@@ -0,0 +1,761 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Endpoint (EDR) telemetry: process trees and network activity reported by endpoint agents
+const (
+	endpointHostsKey          = "endpoint:hosts" // hash of host name -> EndpointHostInfo JSON
+	endpointIPsKey            = "endpoint:ips"   // hash of host address -> host name
+	endpointKeyPrefix         = "endpoint:"      // "endpoint:<host>:processes" and "endpoint:<host>:remote:<address>"
+	maxEndpointEvents         = 10000            // events per request
+	maxProcessDepth           = 16               // ancestors followed from a process
+	maxProcessTreeNodes       = 1000             // descendants returned by the tree API
+	maxEndpointAnnotations    = 25               // indicators linked to processes per batch
+	endpointProcessStopAction = "end"
+)
+
+var errProcessNotFound = errors.New("process not found")
+
+var endpointEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cybersecurity_endpoint_events_total",
+		Help: "Endpoint telemetry events ingested by category",
+	},
+	[]string{"category"},
+)
+
+func init() {
+	prometheus.MustRegister(endpointEvents)
+}
+
+// EndpointEvent is one event from an endpoint agent. Field names follow the Elastic Common Schema.
+type EndpointEvent struct {
+	Timestamp   time.Time         `json:"@timestamp"`
+	Event       EndpointEventMeta `json:"event"`
+	Host        EndpointHost      `json:"host"`
+	User        *EndpointUser     `json:"user,omitempty"`
+	Process     *EndpointProcess  `json:"process,omitempty"`
+	Source      *EndpointAddress  `json:"source,omitempty"`
+	Destination *EndpointAddress  `json:"destination,omitempty"`
+	Network     *EndpointNetwork  `json:"network,omitempty"`
+	File        *EndpointFile     `json:"file,omitempty"`
+}
+
+type EndpointEventMeta struct {
+	Category string `json:"category" binding:"required,oneof=process network file"`
+	Action   string `json:"action,omitempty"` // e.g. "start" or "end" for processes, "creation" or "deletion" for files
+}
+
+type EndpointHost struct {
+	Name string     `json:"name" binding:"required"`
+	ID   string     `json:"id,omitempty"`
+	IP   []string   `json:"ip,omitempty"`
+	OS   EndpointOS `json:"os"`
+}
+
+type EndpointOS struct {
+	Type string `json:"type,omitempty"` // "windows", "linux", or "macos"
+	Name string `json:"name,omitempty"`
+}
+
+type EndpointUser struct {
+	Name   string `json:"name"`
+	Domain string `json:"domain,omitempty"`
+}
+
+type EndpointProcess struct {
+	EntityID         string          `json:"entity_id,omitempty"` // unique across PID reuse; "pid:<pid>" when the agent sends none
+	PID              int             `json:"pid"`
+	Name             string          `json:"name,omitempty"`
+	Executable       string          `json:"executable,omitempty"`
+	CommandLine      string          `json:"command_line,omitempty"`
+	WorkingDirectory string          `json:"working_directory,omitempty"`
+	Hash             EndpointHash    `json:"hash"`
+	Parent           *EndpointParent `json:"parent,omitempty"`
+}
+
+type EndpointParent struct {
+	EntityID    string `json:"entity_id,omitempty"`
+	PID         int    `json:"pid"`
+	Name        string `json:"name,omitempty"`
+	Executable  string `json:"executable,omitempty"`
+	CommandLine string `json:"command_line,omitempty"`
+}
+
+type EndpointHash struct {
+	MD5    string `json:"md5,omitempty"`
+	SHA1   string `json:"sha1,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type EndpointAddress struct {
+	IP   string `json:"ip"`
+	Port int    `json:"port,omitempty"`
+}
+
+type EndpointNetwork struct {
+	Transport string `json:"transport,omitempty"`
+	Direction string `json:"direction,omitempty"` // "egress"/"outbound" or "ingress"/"inbound"
+}
+
+type EndpointFile struct {
+	Path string       `json:"path"`
+	Name string       `json:"name,omitempty"`
+	Hash EndpointHash `json:"hash"`
+}
+
+// EndpointHostInfo is the latest description of an endpoint that sent telemetry
+type EndpointHostInfo struct {
+	Name     string    `json:"name"`
+	ID       string    `json:"id,omitempty"`
+	IPs      []string  `json:"ips"`
+	OS       string    `json:"os,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// ProcessNode is a process in an endpoint's process tree
+type ProcessNode struct {
+	EntityID       string         `json:"entity_id"`
+	PID            int            `json:"pid"`
+	ParentEntityID string         `json:"parent_entity_id,omitempty"`
+	ParentPID      int            `json:"parent_pid,omitempty"`
+	Name           string         `json:"name,omitempty"`
+	Executable     string         `json:"executable,omitempty"`
+	CommandLine    string         `json:"command_line,omitempty"`
+	User           string         `json:"user,omitempty"`
+	SHA256         string         `json:"sha256,omitempty"`
+	StartedAt      *time.Time     `json:"started_at,omitempty"` // unset for parents known only from their children's events
+	EndedAt        *time.Time     `json:"ended_at,omitempty"`
+	Children       []*ProcessNode `json:"children,omitempty"` // set by the tree API only
+}
+
+func (p *ProcessNode) label() string {
+	name := p.Name
+	if name == "" {
+		name = p.Executable
+	}
+	if name == "" {
+		name = "unknown"
+	}
+	return fmt.Sprintf("%s[%d]", name, p.PID)
+}
+
+// EndpointContext ties an indicator to the process on an endpoint behind it
+type EndpointContext struct {
+	Host     string        `json:"host"`
+	Process  ProcessNode   `json:"process"`
+	Ancestry []ProcessNode `json:"ancestry,omitempty"` // parent first, up to the oldest known ancestor
+}
+
+// chain describes the process tree from the oldest known ancestor down to the process
+func (ec *EndpointContext) chain() string {
+	labels := make([]string, 0, len(ec.Ancestry)+1)
+	for i := len(ec.Ancestry) - 1; i >= 0; i-- {
+		labels = append(labels, ec.Ancestry[i].label())
+	}
+	labels = append(labels, ec.Process.label())
+	return strings.Join(labels, " > ")
+}
+
+// ProcessTree is a process with its ancestors and descendants
+type ProcessTree struct {
+	Host      string        `json:"host"`
+	Ancestry  []ProcessNode `json:"ancestry"` // parent first
+	Process   *ProcessNode  `json:"process"`  // with its descendants under children
+	Truncated bool          `json:"truncated,omitempty"`
+}
+
+func processEntityID(entityID string, pid int) string {
+	if entityID != "" {
+		return entityID
+	}
+	return "pid:" + strconv.Itoa(pid)
+}
+
+func isProcessStop(action string) bool {
+	switch strings.ToLower(action) {
+	case endpointProcessStopAction, "stop", "exit", "process_stopped", "termination":
+		return true
+	}
+	return false
+}
+
+// remoteAddress returns the far end of a network event: the destination of outbound connections
+// and the source of inbound ones
+func (e *EndpointEvent) remoteAddress() string {
+	inbound := e.Network != nil && (strings.EqualFold(e.Network.Direction, "ingress") || strings.EqualFold(e.Network.Direction, "inbound"))
+	address := e.Destination
+	if inbound {
+		address = e.Source
+	}
+	if address == nil {
+		return ""
+	}
+	if ip := net.ParseIP(address.IP); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+func (e *EndpointEvent) processNode() *ProcessNode {
+	process := e.Process
+	node := &ProcessNode{
+		EntityID:    processEntityID(process.EntityID, process.PID),
+		PID:         process.PID,
+		Name:        process.Name,
+		Executable:  process.Executable,
+		CommandLine: process.CommandLine,
+		SHA256:      strings.ToLower(process.Hash.SHA256),
+	}
+	if node.Name == "" && node.Executable != "" {
+		node.Name = node.Executable[strings.LastIndexAny(node.Executable, `/\`)+1:]
+	}
+	if e.User != nil {
+		node.User = e.User.Name
+		if e.User.Domain != "" {
+			node.User = e.User.Domain + `\` + e.User.Name
+		}
+	}
+	if process.Parent != nil {
+		node.ParentEntityID = processEntityID(process.Parent.EntityID, process.Parent.PID)
+		node.ParentPID = process.Parent.PID
+	}
+	return node
+}
+
+// parentNode describes the parent from what a child's event says about it
+func (e *EndpointEvent) parentNode() *ProcessNode {
+	parent := e.Process.Parent
+	node := &ProcessNode{
+		EntityID:    processEntityID(parent.EntityID, parent.PID),
+		PID:         parent.PID,
+		Name:        parent.Name,
+		Executable:  parent.Executable,
+		CommandLine: parent.CommandLine,
+	}
+	if node.Name == "" && node.Executable != "" {
+		node.Name = node.Executable[strings.LastIndexAny(node.Executable, `/\`)+1:]
+	}
+	return node
+}
+
+// logEvent converts the event to the Sysmon field names Sigma rules are written against
+func (e *EndpointEvent) logEvent() LogEvent {
+	event := LogEvent{
+		Timestamp: e.Timestamp,
+		LogSource: LogSource{Product: strings.ToLower(e.Host.OS.Type)},
+		Fields:    map[string]interface{}{"Computer": e.Host.Name},
+	}
+	switch e.Event.Category {
+	case "process":
+		event.LogSource.Category = "process_creation"
+	case "network":
+		event.LogSource.Category = "network_connection"
+	case "file":
+		event.LogSource.Category = "file_event"
+		if strings.EqualFold(e.Event.Action, "deletion") {
+			event.LogSource.Category = "file_delete"
+		}
+	}
+
+	fields := event.Fields
+	set := func(name, value string) {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+	hashes := func(hash EndpointHash) string {
+		parts := make([]string, 0, 3)
+		for _, pair := range [][2]string{{"MD5", hash.MD5}, {"SHA1", hash.SHA1}, {"SHA256", hash.SHA256}} {
+			if pair[1] != "" {
+				parts = append(parts, pair[0]+"="+strings.ToUpper(pair[1]))
+			}
+		}
+		return strings.Join(parts, ",")
+	}
+
+	if e.User != nil {
+		set("User", e.User.Name)
+		if e.User.Domain != "" {
+			set("User", e.User.Domain+`\`+e.User.Name)
+		}
+	}
+	if p := e.Process; p != nil {
+		set("ProcessGuid", processEntityID(p.EntityID, p.PID))
+		fields["ProcessId"] = p.PID
+		set("Image", p.Executable)
+		set("CommandLine", p.CommandLine)
+		set("CurrentDirectory", p.WorkingDirectory)
+		if e.Event.Category == "process" {
+			set("Hashes", hashes(p.Hash))
+		}
+		if parent := p.Parent; parent != nil {
+			set("ParentProcessGuid", processEntityID(parent.EntityID, parent.PID))
+			fields["ParentProcessId"] = parent.PID
+			set("ParentImage", parent.Executable)
+			set("ParentCommandLine", parent.CommandLine)
+		}
+	}
+	if e.Source != nil {
+		set("SourceIp", e.Source.IP)
+		if e.Source.Port > 0 {
+			fields["SourcePort"] = e.Source.Port
+		}
+	}
+	if e.Destination != nil {
+		set("DestinationIp", e.Destination.IP)
+		if e.Destination.Port > 0 {
+			fields["DestinationPort"] = e.Destination.Port
+		}
+	}
+	if e.Network != nil {
+		set("Protocol", strings.ToLower(e.Network.Transport))
+		direction := strings.ToLower(e.Network.Direction)
+		if direction != "" {
+			fields["Initiated"] = strconv.FormatBool(direction == "egress" || direction == "outbound")
+		}
+	}
+	if e.File != nil {
+		set("TargetFilename", e.File.Path)
+		if e.Event.Category == "file" {
+			set("Hashes", hashes(e.File.Hash))
+		}
+	}
+	return event
+}
+
+// EndpointTelemetry keeps each endpoint's process tree and the processes behind its connections
+// for the retention period, so network detections can be traced to a process
+type EndpointTelemetry struct {
+	redis     *redis.Client
+	detector  *ThreatDetector
+	retention time.Duration
+}
+
+func NewEndpointTelemetry(redisClient *redis.Client, detector *ThreatDetector, retention time.Duration) *EndpointTelemetry {
+	return &EndpointTelemetry{redis: redisClient, detector: detector, retention: retention}
+}
+
+func (et *EndpointTelemetry) processesKey(ctx context.Context, host string) string {
+	return tenantKey(ctx, endpointKeyPrefix+host+":processes")
+}
+
+func (et *EndpointTelemetry) remoteKey(ctx context.Context, host, address string) string {
+	return tenantKey(ctx, endpointKeyPrefix+host+":remote:"+address)
+}
+
+// Record stores the processes the events describe and the remote addresses each one contacted
+func (et *EndpointTelemetry) Record(ctx context.Context, events []EndpointEvent) error {
+	hosts := make(map[string]*EndpointHostInfo)
+	started := make(map[string]map[string]*ProcessNode) // host -> entity ID -> process
+	stopped := make(map[string]map[string]time.Time)
+
+	pipe := et.redis.TxPipeline()
+	for i := range events {
+		event := &events[i]
+		host := event.Host.Name
+		endpointEvents.WithLabelValues(event.Event.Category).Inc()
+
+		info := hosts[host]
+		if info == nil {
+			info = &EndpointHostInfo{Name: host}
+			hosts[host] = info
+		}
+		info.ID = event.Host.ID
+		info.OS = event.Host.OS.Name
+		if info.OS == "" {
+			info.OS = event.Host.OS.Type
+		}
+		if len(event.Host.IP) > 0 {
+			info.IPs = event.Host.IP
+		}
+		if event.Timestamp.After(info.LastSeen) {
+			info.LastSeen = event.Timestamp
+		}
+
+		if event.Process == nil {
+			continue
+		}
+		node := event.processNode()
+		processes := et.processesKey(ctx, host)
+		if event.Process.Parent != nil {
+			parent := event.parentNode()
+			if data, err := json.Marshal(parent); err == nil {
+				pipe.HSetNX(ctx, processes, parent.EntityID, data)
+			}
+		}
+
+		switch {
+		case event.Event.Category == "process" && isProcessStop(event.Event.Action):
+			if stopped[host] == nil {
+				stopped[host] = make(map[string]time.Time)
+			}
+			stopped[host][node.EntityID] = event.Timestamp
+		case event.Event.Category == "process":
+			at := event.Timestamp
+			node.StartedAt = &at
+			if started[host] == nil {
+				started[host] = make(map[string]*ProcessNode)
+			}
+			started[host][node.EntityID] = node
+		default:
+			// Processes first seen through their network or file activity
+			if data, err := json.Marshal(node); err == nil {
+				pipe.HSetNX(ctx, processes, node.EntityID, data)
+			}
+		}
+
+		if event.Event.Category == "network" {
+			if remote := event.remoteAddress(); remote != "" {
+				key := et.remoteKey(ctx, host, remote)
+				pipe.ZAdd(ctx, key, &redis.Z{Score: float64(event.Timestamp.Unix()), Member: node.EntityID})
+				pipe.Expire(ctx, key, et.retention)
+			}
+		}
+	}
+
+	for host, processes := range started {
+		key := et.processesKey(ctx, host)
+		for id, node := range processes {
+			if at, ok := stopped[host][id]; ok {
+				node.EndedAt = &at
+				delete(stopped[host], id)
+			}
+			data, err := json.Marshal(node)
+			if err != nil {
+				return err
+			}
+			pipe.HSet(ctx, key, id, data)
+		}
+	}
+	for host, info := range hosts {
+		data, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		pipe.HSet(ctx, tenantKey(ctx, endpointHostsKey), host, data)
+		for _, ip := range info.IPs {
+			if parsed := net.ParseIP(ip); parsed != nil {
+				pipe.HSet(ctx, tenantKey(ctx, endpointIPsKey), parsed.String(), host)
+			}
+		}
+		pipe.Expire(ctx, et.processesKey(ctx, host), et.retention)
+	}
+	pipe.Expire(ctx, tenantKey(ctx, endpointHostsKey), et.retention)
+	pipe.Expire(ctx, tenantKey(ctx, endpointIPsKey), et.retention)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record endpoint telemetry: %w", err)
+	}
+
+	// Processes that ended in an earlier batch are updated in place
+	for host, ended := range stopped {
+		for id, at := range ended {
+			node, err := et.process(ctx, host, id)
+			if err != nil || node == nil {
+				continue
+			}
+			node.EndedAt = &at
+			if data, err := json.Marshal(node); err == nil {
+				et.redis.HSet(ctx, et.processesKey(ctx, host), id, data)
+			}
+		}
+	}
+	return nil
+}
+
+func (et *EndpointTelemetry) process(ctx context.Context, host, id string) (*ProcessNode, error) {
+	data, err := et.redis.HGet(ctx, et.processesKey(ctx, host), id).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var node ProcessNode
+	if err := json.Unmarshal([]byte(data), &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// context returns a process with its ancestors, or nil when the process is unknown
+func (et *EndpointTelemetry) context(ctx context.Context, host, id string) *EndpointContext {
+	node, err := et.process(ctx, host, id)
+	if err != nil || node == nil {
+		return nil
+	}
+	ec := &EndpointContext{Host: host, Process: *node}
+	seen := map[string]bool{node.EntityID: true}
+	for parentID := node.ParentEntityID; parentID != "" && !seen[parentID] && len(ec.Ancestry) < maxProcessDepth; {
+		parent, err := et.process(ctx, host, parentID)
+		if err != nil || parent == nil {
+			break
+		}
+		seen[parentID] = true
+		ec.Ancestry = append(ec.Ancestry, *parent)
+		parentID = parent.ParentEntityID
+	}
+	return ec
+}
+
+// Evaluate matches the events against Sigma rules, one endpoint at a time, and attaches the
+// process tree of the first matching process to each indicator
+func (et *EndpointTelemetry) Evaluate(ctx context.Context, events []EndpointEvent) []ThreatIndicator {
+	byHost := make(map[string][]LogEvent)
+	addresses := make(map[string]string)
+	hosts := make([]string, 0)
+	for i := range events {
+		host := events[i].Host.Name
+		if _, ok := byHost[host]; !ok {
+			hosts = append(hosts, host)
+		}
+		byHost[host] = append(byHost[host], events[i].logEvent())
+		if addresses[host] == "" && len(events[i].Host.IP) > 0 {
+			addresses[host] = events[i].Host.IP[0]
+		}
+	}
+
+	threats := make([]ThreatIndicator, 0)
+	for _, host := range hosts {
+		logEvents := byHost[host]
+		et.detector.geo.EnrichEvents(logEvents)
+		logEventsProcessed.Add(float64(len(logEvents)))
+
+		for _, hit := range et.detector.sigma.match(logEvents) {
+			threat := hit.indicator()
+			if threat.SourceIP == "" {
+				threat.SourceIP = addresses[host]
+			}
+			threat.Evidence = append(threat.Evidence, "Host: "+host)
+			if id, ok := hit.events[0].Fields["ProcessGuid"].(string); ok {
+				if ec := et.context(ctx, host, id); ec != nil {
+					threat.Endpoint = ec
+					threat.Evidence = append(threat.Evidence, "Process tree: "+ec.chain())
+				}
+			}
+			threats = append(threats, threat)
+		}
+	}
+	return threats
+}
+
+// Annotate links indicators involving an endpoint to the process on it that contacted the other
+// address most recently
+func (et *EndpointTelemetry) Annotate(ctx context.Context, threats []ThreatIndicator) {
+	addresses := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, threat := range threats {
+		for _, ip := range []string{threat.SourceIP, threat.DestIP} {
+			if ip != "" && !seen[ip] && threat.Endpoint == nil {
+				seen[ip] = true
+				addresses = append(addresses, ip)
+			}
+		}
+	}
+	if len(addresses) == 0 {
+		return
+	}
+	names, err := et.redis.HMGet(ctx, tenantKey(ctx, endpointIPsKey), addresses...).Result()
+	if err != nil {
+		return
+	}
+	hosts := make(map[string]string)
+	for i, name := range names {
+		if name != nil {
+			hosts[addresses[i]] = fmt.Sprint(name)
+		}
+	}
+	if len(hosts) == 0 {
+		return
+	}
+
+	annotated := 0
+	for i := range threats {
+		threat := &threats[i]
+		if threat.Endpoint != nil || annotated >= maxEndpointAnnotations {
+			continue
+		}
+		for _, pair := range [][2]string{{threat.SourceIP, threat.DestIP}, {threat.DestIP, threat.SourceIP}} {
+			host, remote := hosts[pair[0]], pair[1]
+			if host == "" || remote == "" {
+				continue
+			}
+			ids, err := et.redis.ZRevRange(ctx, et.remoteKey(ctx, host, remote), 0, 0).Result()
+			if err != nil || len(ids) == 0 {
+				continue
+			}
+			if ec := et.context(ctx, host, ids[0]); ec != nil {
+				threat.Endpoint = ec
+				threat.Evidence = append(threat.Evidence, fmt.Sprintf("Process on %s that contacted %s: %s", host, remote, ec.chain()))
+				annotated++
+				break
+			}
+		}
+	}
+}
+
+// Hosts lists the endpoints that sent telemetry within the retention period
+func (et *EndpointTelemetry) Hosts(ctx context.Context) ([]EndpointHostInfo, error) {
+	stored, err := et.redis.HGetAll(ctx, tenantKey(ctx, endpointHostsKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load endpoints: %w", err)
+	}
+	hosts := make([]EndpointHostInfo, 0, len(stored))
+	for _, data := range stored {
+		var host EndpointHostInfo
+		if json.Unmarshal([]byte(data), &host) == nil {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return hosts, nil
+}
+
+// Tree reconstructs a process's ancestors and descendants from the endpoint's process table
+func (et *EndpointTelemetry) Tree(ctx context.Context, host, id string) (*ProcessTree, error) {
+	stored, err := et.redis.HGetAll(ctx, et.processesKey(ctx, host)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load processes: %w", err)
+	}
+	nodes := make(map[string]*ProcessNode, len(stored))
+	children := make(map[string][]*ProcessNode)
+	for entityID, data := range stored {
+		var node ProcessNode
+		if json.Unmarshal([]byte(data), &node) != nil {
+			continue
+		}
+		nodes[entityID] = &node
+		if node.ParentEntityID != "" {
+			children[node.ParentEntityID] = append(children[node.ParentEntityID], &node)
+		}
+	}
+	root, ok := nodes[id]
+	if !ok {
+		return nil, errProcessNotFound
+	}
+
+	tree := &ProcessTree{Host: host, Ancestry: make([]ProcessNode, 0), Process: root}
+	seen := map[string]bool{id: true}
+	for parentID := root.ParentEntityID; parentID != "" && !seen[parentID] && len(tree.Ancestry) < maxProcessDepth; {
+		parent, ok := nodes[parentID]
+		if !ok {
+			break
+		}
+		seen[parentID] = true
+		tree.Ancestry = append(tree.Ancestry, *parent)
+		parentID = parent.ParentEntityID
+	}
+
+	// Attach descendants breadth first, oldest child first, until the node limit
+	count := 1
+	queue := []*ProcessNode{root}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		kids := children[node.EntityID]
+		sort.Slice(kids, func(i, j int) bool {
+			if kids[i].StartedAt == nil || kids[j].StartedAt == nil {
+				return kids[i].StartedAt != nil
+			}
+			return kids[i].StartedAt.Before(*kids[j].StartedAt)
+		})
+		for _, child := range kids {
+			if seen[child.EntityID] {
+				continue
+			}
+			if count >= maxProcessTreeNodes {
+				tree.Truncated = true
+				break
+			}
+			seen[child.EntityID] = true
+			count++
+			node.Children = append(node.Children, child)
+			queue = append(queue, child)
+		}
+	}
+	return tree, nil
+}
+
+// HTTP Handlers
+type EndpointIngestRequest struct {
+	ScanID       string          `json:"scan_id"`
+	Events       []EndpointEvent `json:"events" binding:"required,min=1,dive"`
+	DeepAnalysis bool            `json:"deep_analysis"`
+}
+
+func (s *APIServer) ingestEndpointHandler(c *gin.Context) {
+	var body EndpointIngestRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(body.Events) > maxEndpointEvents {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d events per request", maxEndpointEvents)})
+		return
+	}
+
+	req := ThreatDetectionRequest{
+		ScanID:         body.ScanID,
+		ScanType:       "endpoint",
+		EndpointEvents: body.Events,
+		DeepAnalysis:   body.DeepAnalysis,
+	}
+	if req.ScanID == "" {
+		req.ScanID = fmt.Sprintf("endpoint_%d", time.Now().UnixNano())
+	}
+	for i := range req.EndpointEvents {
+		if req.EndpointEvents[i].Timestamp.IsZero() {
+			req.EndpointEvents[i].Timestamp = time.Now().UTC()
+		}
+	}
+
+	response, err := s.threatDetector.AnalyzeTraffic(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *APIServer) listEndpointsHandler(c *gin.Context) {
+	hosts, err := s.threatDetector.endpoints.Hosts(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"endpoints": hosts, "count": len(hosts)})
+}
+
+func (s *APIServer) processTreeHandler(c *gin.Context) {
+	id := c.Query("entity_id")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "entity_id is required"})
+		return
+	}
+
+	tree, err := s.threatDetector.endpoints.Tree(c.Request.Context(), c.Param("host"), id)
+	switch {
+	case errors.Is(err, errProcessNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Process not found"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, tree)
+	}
+}
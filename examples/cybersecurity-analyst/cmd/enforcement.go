@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// Enforcement rules: the blocks a scan's indicators call for, rendered as rule files for
+// firewalls, WAFs, and IDSs instead of free-text recommendations
+const (
+	maxEnforcementBlocks = 500     // addresses and domains rendered per scan
+	suricataLocalSIDBase = 1000000 // start of the SID range reserved for local rules
+	suricataLocalSIDs    = 999999
+)
+
+var errScanNotFound = errors.New("scan not found")
+
+// EnforcementFormat is a rule artifact format
+type EnforcementFormat string
+
+const (
+	FormatIPTables   EnforcementFormat = "iptables"
+	FormatAWS        EnforcementFormat = "aws"
+	FormatCloudflare EnforcementFormat = "cloudflare"
+	FormatSuricata   EnforcementFormat = "suricata"
+)
+
+var enforcementFormats = []EnforcementFormat{FormatIPTables, FormatAWS, FormatCloudflare, FormatSuricata}
+
+// enforcementFiles holds the file name suffix and content type of each format's download
+var enforcementFiles = map[EnforcementFormat][2]string{
+	FormatIPTables:   {"iptables.sh", "text/x-shellscript; charset=utf-8"},
+	FormatAWS:        {"aws-network-acl.json", "application/json"},
+	FormatCloudflare: {"cloudflare-rules.json", "application/json"},
+	FormatSuricata:   {"suricata.rules", "text/plain; charset=utf-8"},
+}
+
+// Inbound indicators are blocked by their source; outbound ones by the destination the monitored
+// host reached
+var (
+	inboundThreatTypes  = map[ThreatType]bool{Intrusion: true, Brute: true, DDoS: true, SQLInjection: true, XSS: true}
+	outboundThreatTypes = map[ThreatType]bool{Malware: true, DataExfil: true}
+)
+
+var suricataClasstypes = map[ThreatType]string{
+	Intrusion:    "attempted-admin",
+	Brute:        "attempted-user",
+	DDoS:         "attempted-dos",
+	SQLInjection: "web-application-attack",
+	XSS:          "web-application-attack",
+	Malware:      "trojan-activity",
+	DataExfil:    "policy-violation",
+}
+
+// EnforcementBlock is an address to drop traffic from (inbound) or to (outbound)
+type EnforcementBlock struct {
+	CIDR        string       `json:"cidr"`
+	Direction   string       `json:"direction"` // "inbound" or "outbound"
+	Severity    ThreatLevel  `json:"severity"`
+	Types       []ThreatType `json:"types"`
+	MITREAttack []string     `json:"mitre_attack,omitempty"`
+}
+
+// EnforcementDomain is a domain malware or exfiltration reached, blocked at DNS and TLS
+type EnforcementDomain struct {
+	Domain   string       `json:"domain"`
+	Severity ThreatLevel  `json:"severity"`
+	Types    []ThreatType `json:"types"`
+}
+
+// EnforcementRules are a scan's blocks and the rule files enforcing them
+type EnforcementRules struct {
+	ScanID      string                       `json:"scan_id"`
+	ScannedAt   time.Time                    `json:"scanned_at"`
+	GeneratedAt time.Time                    `json:"generated_at"`
+	Blocks      []EnforcementBlock           `json:"blocks"`
+	Domains     []EnforcementDomain          `json:"domains"`
+	Artifacts   map[EnforcementFormat]string `json:"artifacts"`
+}
+
+// LoadScan returns a completed analysis of the context's tenant, from the result cache or, once
+// that has expired, from history
+func (td *ThreatDetector) LoadScan(ctx context.Context, scanID string) (*ThreatDetectionResponse, error) {
+	var response ThreatDetectionResponse
+	data, err := td.redis.Get(ctx, tenantKey(ctx, "scan:"+scanID)).Bytes()
+	if err == nil && json.Unmarshal(data, &response) == nil {
+		return &response, nil
+	}
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to load scan: %w", err)
+	}
+
+	result, err := td.history.Query(ctx, "scans", HistoryQuery{
+		To:      time.Now().UTC(),
+		Filters: map[string]string{"scan_id": scanID},
+		Limit:   1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Records) == 0 {
+		return nil, errScanNotFound
+	}
+	record := result.Records[0].(ScanRecord)
+	if err := json.Unmarshal(record.Result, &response); err != nil {
+		return nil, fmt.Errorf("invalid stored scan %s: %w", scanID, err)
+	}
+	return &response, nil
+}
+
+// EnforcementRules renders the blocks a scan calls for. Only public addresses are blocked;
+// allowlisted sources were already dropped from the scan's indicators.
+func (td *ThreatDetector) EnforcementRules(ctx context.Context, scanID string) (*EnforcementRules, error) {
+	response, err := td.LoadScan(ctx, scanID)
+	if err != nil {
+		return nil, err
+	}
+	rules := &EnforcementRules{
+		ScanID:      response.ScanID,
+		ScannedAt:   response.Timestamp,
+		GeneratedAt: time.Now().UTC(),
+		Blocks:      enforcementBlocks(response.ThreatIndicators),
+		Domains:     enforcementDomains(response.ThreatIndicators),
+		Artifacts:   make(map[EnforcementFormat]string, len(enforcementFormats)),
+	}
+	for _, format := range enforcementFormats {
+		artifact, err := rules.render(format)
+		if err != nil {
+			return nil, err
+		}
+		rules.Artifacts[format] = artifact
+	}
+	return rules, nil
+}
+
+func enforcementBlocks(threats []ThreatIndicator) []EnforcementBlock {
+	blocks := make([]EnforcementBlock, 0)
+	index := make(map[string]int)
+	for _, threat := range threats {
+		address, direction := threat.SourceIP, "inbound"
+		if outboundThreatTypes[threat.Type] {
+			address, direction = threat.DestIP, "outbound"
+		} else if !inboundThreatTypes[threat.Type] {
+			continue
+		}
+		if !publicAddress(address) {
+			continue
+		}
+		cidr, err := parseResponseIP(address)
+		if err != nil {
+			continue
+		}
+		key := direction + "|" + cidr
+		i, ok := index[key]
+		if !ok {
+			if len(blocks) == maxEnforcementBlocks {
+				continue
+			}
+			index[key] = len(blocks)
+			blocks = append(blocks, EnforcementBlock{CIDR: cidr, Direction: direction, Severity: threat.Severity})
+			i = len(blocks) - 1
+		}
+		block := &blocks[i]
+		if severityRank[threat.Severity] > severityRank[block.Severity] {
+			block.Severity = threat.Severity
+		}
+		block.Types = appendThreatType(block.Types, threat.Type)
+		if threat.MITREAttack != "" {
+			block.MITREAttack = appendUnique(block.MITREAttack, maxEnforcementBlocks, threat.MITREAttack)
+		}
+	}
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return severityRank[blocks[i].Severity] > severityRank[blocks[j].Severity]
+	})
+	return blocks
+}
+
+// enforcementDomains collects the domains among outbound indicators' observables; the rest are
+// file hashes
+func enforcementDomains(threats []ThreatIndicator) []EnforcementDomain {
+	domains := make([]EnforcementDomain, 0)
+	index := make(map[string]int)
+	for _, threat := range threats {
+		if !outboundThreatTypes[threat.Type] {
+			continue
+		}
+		for _, observable := range threat.Observables {
+			domain := strings.TrimSuffix(strings.ToLower(observable), ".")
+			if !strings.Contains(domain, ".") || strings.Trim(domain, "abcdefghijklmnopqrstuvwxyz0123456789.-") != "" {
+				continue
+			}
+			i, ok := index[domain]
+			if !ok {
+				if len(domains) == maxEnforcementBlocks {
+					continue
+				}
+				index[domain] = len(domains)
+				domains = append(domains, EnforcementDomain{Domain: domain, Severity: threat.Severity})
+				i = len(domains) - 1
+			}
+			if severityRank[threat.Severity] > severityRank[domains[i].Severity] {
+				domains[i].Severity = threat.Severity
+			}
+			domains[i].Types = appendThreatType(domains[i].Types, threat.Type)
+		}
+	}
+	sort.SliceStable(domains, func(i, j int) bool {
+		return severityRank[domains[i].Severity] > severityRank[domains[j].Severity]
+	})
+	return domains
+}
+
+func appendThreatType(types []ThreatType, threatType ThreatType) []ThreatType {
+	for _, existing := range types {
+		if existing == threatType {
+			return types
+		}
+	}
+	return append(types, threatType)
+}
+
+// ruleText keeps the characters that are safe in rule comments and messages of every format
+func ruleText(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x80 && (r == '-' || r == '_' || r == '.' || r == ':' || r == ',' || r == ' ' ||
+			'0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, value)
+}
+
+func (r *EnforcementRules) render(format EnforcementFormat) (string, error) {
+	switch format {
+	case FormatIPTables:
+		return r.iptables(), nil
+	case FormatAWS:
+		return r.awsNetworkACL()
+	case FormatCloudflare:
+		return r.cloudflare()
+	case FormatSuricata:
+		return r.suricata(), nil
+	}
+	return "", fmt.Errorf("unknown enforcement format %q", format)
+}
+
+func (r *EnforcementRules) comment(block EnforcementBlock) string {
+	types := make([]string, len(block.Types))
+	for i, threatType := range block.Types {
+		types[i] = string(threatType)
+	}
+	return ruleText(fmt.Sprintf("scan %s: %s %s", r.ScanID, block.Severity, strings.Join(types, ",")))
+}
+
+// iptables writes a script that loads the blocks into a chain of their own, jumped to from INPUT,
+// OUTPUT, and FORWARD, so rerunning it replaces the previous rules
+func (r *EnforcementRules) iptables() string {
+	var script strings.Builder
+	fmt.Fprintf(&script, "#!/bin/sh\n# Enforcement rules for scan %s, generated %s\nset -e\n", ruleText(r.ScanID), r.GeneratedAt.Format(time.RFC3339))
+	for _, family := range []struct {
+		command string
+		v6      bool
+	}{{"iptables", false}, {"ip6tables", true}} {
+		fmt.Fprintf(&script, "\n%s -N CYBERSEC-BLOCK 2>/dev/null || %s -F CYBERSEC-BLOCK\n", family.command, family.command)
+		for _, block := range r.Blocks {
+			if strings.Contains(block.CIDR, ":") != family.v6 {
+				continue
+			}
+			match := "-s"
+			if block.Direction == "outbound" {
+				match = "-d"
+			}
+			fmt.Fprintf(&script, "%s -A CYBERSEC-BLOCK %s %s -m comment --comment '%s' -j DROP\n",
+				family.command, match, block.CIDR, r.comment(block))
+		}
+		for _, chain := range []string{"INPUT", "OUTPUT", "FORWARD"} {
+			fmt.Fprintf(&script, "%s -C %s -j CYBERSEC-BLOCK 2>/dev/null || %s -I %s -j CYBERSEC-BLOCK\n",
+				family.command, chain, family.command, chain)
+		}
+	}
+	return script.String()
+}
+
+// awsNetworkACL renders create-network-acl-entry inputs (aws ec2 create-network-acl-entry
+// --cli-input-json). Security groups only allow traffic, so like the aws_nacl responder the
+// blocks are network ACL deny entries, numbered from AWS_NACL_RULE_START; the ACL ID is left to
+// fill in.
+func (r *EnforcementRules) awsNetworkACL() (string, error) {
+	type naclEntry struct {
+		NetworkAclId  string `json:"NetworkAclId"`
+		RuleNumber    int    `json:"RuleNumber"`
+		Protocol      string `json:"Protocol"`
+		RuleAction    string `json:"RuleAction"`
+		Egress        bool   `json:"Egress"`
+		CidrBlock     string `json:"CidrBlock,omitempty"`
+		Ipv6CidrBlock string `json:"Ipv6CidrBlock,omitempty"`
+	}
+	entries := make([]naclEntry, 0, len(r.Blocks))
+	for i, block := range r.Blocks {
+		entry := naclEntry{
+			NetworkAclId: "${NETWORK_ACL_ID}",
+			RuleNumber:   config.AWSNACLRuleStart + i,
+			Protocol:     "-1",
+			RuleAction:   "deny",
+			Egress:       block.Direction == "outbound",
+		}
+		if strings.Contains(block.CIDR, ":") {
+			entry.Ipv6CidrBlock = block.CIDR
+		} else {
+			entry.CidrBlock = block.CIDR
+		}
+		entries = append(entries, entry)
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"Description":       fmt.Sprintf("Enforcement rules for scan %s", r.ScanID),
+		"NetworkAclEntries": entries,
+	}, "", "  ")
+	return string(data), err
+}
+
+// cloudflare renders WAF custom rules for the zone's rulesets API, one per severity; only inbound
+// blocks apply at the edge
+func (r *EnforcementRules) cloudflare() (string, error) {
+	type customRule struct {
+		Action      string `json:"action"`
+		Expression  string `json:"expression"`
+		Description string `json:"description"`
+		Enabled     bool   `json:"enabled"`
+	}
+	rules := make([]customRule, 0)
+	bySeverity := make(map[ThreatLevel][]string)
+	severities := make([]ThreatLevel, 0)
+	for _, block := range r.Blocks {
+		if block.Direction != "inbound" {
+			continue
+		}
+		if _, ok := bySeverity[block.Severity]; !ok {
+			severities = append(severities, block.Severity)
+		}
+		bySeverity[block.Severity] = append(bySeverity[block.Severity], block.CIDR)
+	}
+	for _, severity := range severities {
+		rules = append(rules, customRule{
+			Action:      "block",
+			Expression:  fmt.Sprintf("(ip.src in {%s})", strings.Join(bySeverity[severity], " ")),
+			Description: ruleText(fmt.Sprintf("scan %s: %s severity sources", r.ScanID, severity)),
+			Enabled:     true,
+		})
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{"rules": rules}, "", "  ")
+	return string(data), err
+}
+
+// suricata renders drop rules with SIDs in the local range, derived from what they block so the
+// same block keeps its SID across scans
+func (r *EnforcementRules) suricata() string {
+	var rules strings.Builder
+	fmt.Fprintf(&rules, "# Enforcement rules for scan %s, generated %s\n", ruleText(r.ScanID), r.GeneratedAt.Format(time.RFC3339))
+	for _, block := range r.Blocks {
+		header := fmt.Sprintf("drop ip %s any -> $HOME_NET any", block.CIDR)
+		if block.Direction == "outbound" {
+			header = fmt.Sprintf("drop ip $HOME_NET any -> %s any", block.CIDR)
+		}
+		fmt.Fprintf(&rules, "%s (msg:\"%s %s\"; classtype:%s; sid:%d; rev:1;)\n",
+			header, block.Direction, r.comment(block), suricataClasstypes[block.Types[0]], suricataSID(block.Direction+block.CIDR))
+	}
+	for _, domain := range r.Domains {
+		msg := ruleText(fmt.Sprintf("scan %s: %s %s domain %s", r.ScanID, domain.Severity, domain.Types[0], domain.Domain))
+		classtype := suricataClasstypes[domain.Types[0]]
+		fmt.Fprintf(&rules, "drop dns $HOME_NET any -> any any (msg:\"%s\"; dns.query; content:\"%s\"; nocase; endswith; classtype:%s; sid:%d; rev:1;)\n",
+			msg, domain.Domain, classtype, suricataSID("dns"+domain.Domain))
+		fmt.Fprintf(&rules, "drop tls $HOME_NET any -> any any (msg:\"%s\"; tls.sni; content:\"%s\"; nocase; endswith; classtype:%s; sid:%d; rev:1;)\n",
+			msg, domain.Domain, classtype, suricataSID("tls"+domain.Domain))
+	}
+	return rules.String()
+}
+
+func suricataSID(key string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return suricataLocalSIDBase + hash.Sum32()%suricataLocalSIDs
+}
+
+func (s *APIServer) enforcementRulesHandler(c *gin.Context) {
+	format := EnforcementFormat(c.DefaultQuery("format", "json"))
+	file, ok := enforcementFiles[format]
+	if format != "json" && !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": `format must be "json", "iptables", "aws", "cloudflare", or "suricata"`})
+		return
+	}
+
+	rules, err := s.threatDetector.EnforcementRules(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, errScanNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if format == "json" {
+		c.JSON(http.StatusOK, rules)
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s"`, ruleText(rules.ScanID), file[0]))
+	c.Data(http.StatusOK, file[1], []byte(rules.Artifacts[format]))
+}
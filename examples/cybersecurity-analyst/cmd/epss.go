@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// EPSS (Exploit Prediction Scoring System) scores from FIRST
+const (
+	epssKeyPrefix = "epss:"        // CVE ID -> EPSSScore JSON
+	epssCacheTTL  = 24 * time.Hour // FIRST publishes new scores daily
+	epssBatchSize = 100
+)
+
+// EPSSScore is the probability that a CVE is exploited in the next 30 days, and its percentile
+// among all scored CVEs
+type EPSSScore struct {
+	CVE         string  `json:"cve"`
+	Probability float64 `json:"probability"`
+	Percentile  float64 `json:"percentile"`
+	Date        string  `json:"date"`
+}
+
+func (s EPSSScore) String() string {
+	return fmt.Sprintf("EPSS %.3f (%.0fth percentile) on %s", s.Probability, s.Percentile*100, s.Date)
+}
+
+type EPSSClient struct {
+	redis  *redis.Client
+	client *http.Client
+	url    string
+}
+
+func NewEPSSClient(redisClient *redis.Client, apiURL string) *EPSSClient {
+	return &EPSSClient{
+		redis:  redisClient,
+		client: &http.Client{Timeout: 30 * time.Second},
+		url:    apiURL,
+	}
+}
+
+// Scores returns the scores of the CVEs FIRST has scored; new CVEs often have none yet. Scores
+// are cached for a day.
+func (ec *EPSSClient) Scores(ctx context.Context, cves []string) (map[string]EPSSScore, error) {
+	scores := make(map[string]EPSSScore, len(cves))
+	if len(cves) == 0 {
+		return scores, nil
+	}
+
+	keys := make([]string, len(cves))
+	for i, cve := range cves {
+		keys[i] = epssKeyPrefix + cve
+	}
+	missing := make([]string, 0)
+	values, err := ec.redis.MGet(ctx, keys...).Result()
+	if err != nil {
+		missing = cves
+	} else {
+		for i, value := range values {
+			var score EPSSScore
+			if data, ok := value.(string); ok && json.Unmarshal([]byte(data), &score) == nil {
+				scores[cves[i]] = score
+				continue
+			}
+			missing = append(missing, cves[i])
+		}
+	}
+
+	for start := 0; start < len(missing); start += epssBatchSize {
+		batch := missing[start:min(start+epssBatchSize, len(missing))]
+		fetched, err := ec.fetch(ctx, batch)
+		if err != nil {
+			return scores, err
+		}
+		pipe := ec.redis.Pipeline()
+		for _, score := range fetched {
+			scores[score.CVE] = score
+			if data, err := json.Marshal(score); err == nil {
+				pipe.Set(ctx, epssKeyPrefix+score.CVE, data, epssCacheTTL)
+			}
+		}
+		pipe.Exec(ctx)
+	}
+	return scores, nil
+}
+
+// fetch queries the FIRST API, which returns probabilities and percentiles as strings
+func (ec *EPSSClient) fetch(ctx context.Context, cves []string) ([]EPSSScore, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ec.url+"?cve="+url.QueryEscape(strings.Join(cves, ",")), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ec.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("EPSS request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("EPSS API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var page struct {
+		Data []struct {
+			CVE        string `json:"cve"`
+			EPSS       string `json:"epss"`
+			Percentile string `json:"percentile"`
+			Date       string `json:"date"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("invalid EPSS response: %w", err)
+	}
+	scores := make([]EPSSScore, 0, len(page.Data))
+	for _, entry := range page.Data {
+		probability, err := strconv.ParseFloat(entry.EPSS, 64)
+		if err != nil {
+			continue
+		}
+		percentile, _ := strconv.ParseFloat(entry.Percentile, 64)
+		scores = append(scores, EPSSScore{CVE: entry.CVE, Probability: probability, Percentile: percentile, Date: entry.Date})
+	}
+	return scores, nil
+}
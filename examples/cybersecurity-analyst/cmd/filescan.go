@@ -0,0 +1,725 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// File and hash scanning
+const (
+	fileIntelKey          = "file_intel"        // hash of MD5/SHA-1/SHA-256 -> FileIntel JSON
+	fileIntelSSDeepKey    = "file_intel:ssdeep" // hash of ssdeep digest -> FileIntel JSON, compared by similarity
+	fileScanKeyPrefix     = "filescan:"         // cached FileScanResult JSON per SHA-256
+	fileScanTTL           = 7 * 24 * time.Hour
+	fileIntelRefresh      = 30 * time.Second
+	maxFileScanHashes     = 100
+	maxFileIntelEntries   = 10000 // entries added per request
+	ssdeepMaliciousScore  = 80    // similarity to a known sample at which a file is malicious
+	ssdeepSuspiciousScore = 50
+)
+
+type FileVerdict string
+
+const (
+	VerdictMalicious  FileVerdict = "malicious"
+	VerdictSuspicious FileVerdict = "suspicious"
+	VerdictUnknown    FileVerdict = "unknown" // nothing matched; not a statement that the file is safe
+)
+
+var (
+	errInvalidFileIntel = errors.New("invalid file intel entry")
+	errFileTooLarge     = errors.New("file too large")
+
+	yaraMetaPattern = regexp.MustCompile(`(\w+)=("(?:[^"\\]|\\.)*"|[^,\]]*)`)
+)
+
+var fileScans = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cybersecurity_file_scans_total",
+		Help: "Files and hashes scanned by verdict",
+	},
+	[]string{"verdict"},
+)
+
+func init() {
+	prometheus.MustRegister(fileScans)
+}
+
+// FileIntel is a known sample: a cryptographic hash matched exactly or an ssdeep hash matched by
+// similarity
+type FileIntel struct {
+	Hash        string      `json:"hash"`
+	Kind        string      `json:"kind"` // "md5", "sha1", "sha256", or "ssdeep"
+	Family      string      `json:"family,omitempty"`
+	Severity    ThreatLevel `json:"severity"`
+	Description string      `json:"description,omitempty"`
+	Source      string      `json:"source,omitempty"`
+	AddedAt     time.Time   `json:"added_at"`
+}
+
+// FileScanMatch is one reason for a verdict
+type FileScanMatch struct {
+	Source   string      `json:"source"` // "intel", "ssdeep", "signature", "yara", or "reputation"
+	ID       string      `json:"id"`     // the matching hash, signature ID, YARA rule, or reputation source
+	Family   string      `json:"family,omitempty"`
+	Severity ThreatLevel `json:"severity,omitempty"`
+	Score    int         `json:"score"` // 0-100; ssdeep similarity for ssdeep matches
+	Detail   string      `json:"detail,omitempty"`
+	verdict  FileVerdict
+}
+
+type FileScanResult struct {
+	Name       string          `json:"name,omitempty"`
+	Size       int64           `json:"size,omitempty"`
+	MD5        string          `json:"md5,omitempty"`
+	SHA1       string          `json:"sha1,omitempty"`
+	SHA256     string          `json:"sha256,omitempty"`
+	SSDeep     string          `json:"ssdeep,omitempty"`
+	Verdict    FileVerdict     `json:"verdict"`
+	Family     string          `json:"family,omitempty"`
+	Score      int             `json:"score"` // highest match score
+	Matches    []FileScanMatch `json:"matches"`
+	Scanned    []string        `json:"scanned"` // the checks that ran, e.g. "intel", "yara"
+	ScannedAt  time.Time       `json:"scanned_at"`
+	Detonating bool            `json:"detonating,omitempty"` // queued for sandbox detonation
+}
+
+// normalizeFileHash classifies an MD5, SHA-1, SHA-256, or ssdeep hash
+func normalizeFileHash(value string) (string, string, error) {
+	value = strings.TrimSpace(value)
+	if ssdeepPattern.MatchString(value) {
+		return value, "ssdeep", nil
+	}
+	if hashPattern.MatchString(value) {
+		value = strings.ToLower(value)
+		switch len(value) {
+		case 32:
+			return value, "md5", nil
+		case 40:
+			return value, "sha1", nil
+		default:
+			return value, "sha256", nil
+		}
+	}
+	return "", "", fmt.Errorf("%w: %q is not an MD5, SHA-1, SHA-256, or ssdeep hash", errInvalidFileIntel, value)
+}
+
+// FileScanner matches files and hashes against the file intel store, payload signatures, YARA
+// rules, and reputation sources. The intel store is shared by all tenants; results are cached
+// per tenant.
+type FileScanner struct {
+	redis    *redis.Client
+	detector *ThreatDetector
+	yara     *YARAScanner
+	maxBytes int64
+
+	mu        sync.Mutex
+	ssdeep    []FileIntel
+	refreshed time.Time
+}
+
+func NewFileScanner(redisClient *redis.Client, detector *ThreatDetector, yara *YARAScanner, maxBytes int64) *FileScanner {
+	return &FileScanner{redis: redisClient, detector: detector, yara: yara, maxBytes: maxBytes}
+}
+
+// ssdeepIntel returns the ssdeep entries, reloaded at most every fileIntelRefresh
+func (fs *FileScanner) ssdeepIntel(ctx context.Context) ([]FileIntel, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if time.Since(fs.refreshed) < fileIntelRefresh {
+		return fs.ssdeep, nil
+	}
+
+	stored, err := fs.redis.HGetAll(ctx, fileIntelSSDeepKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ssdeep intel: %w", err)
+	}
+	entries := make([]FileIntel, 0, len(stored))
+	for _, data := range stored {
+		var entry FileIntel
+		if json.Unmarshal([]byte(data), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	fs.ssdeep, fs.refreshed = entries, time.Now()
+	return entries, nil
+}
+
+// Intel lists the stored entries, sorted by family and hash
+func (fs *FileScanner) Intel(ctx context.Context) ([]FileIntel, error) {
+	entries := make([]FileIntel, 0)
+	for _, key := range []string{fileIntelKey, fileIntelSSDeepKey} {
+		stored, err := fs.redis.HGetAll(ctx, key).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load file intel: %w", err)
+		}
+		for _, data := range stored {
+			var entry FileIntel
+			if json.Unmarshal([]byte(data), &entry) == nil {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Family != entries[j].Family {
+			return entries[i].Family < entries[j].Family
+		}
+		return entries[i].Hash < entries[j].Hash
+	})
+	return entries, nil
+}
+
+// AddIntel validates and stores entries, replacing any with the same hash
+func (fs *FileScanner) AddIntel(ctx context.Context, entries []FileIntel) ([]FileIntel, error) {
+	now := time.Now().UTC()
+	pipe := fs.redis.TxPipeline()
+	for i := range entries {
+		entry := &entries[i]
+		hash, kind, err := normalizeFileHash(entry.Hash)
+		if err != nil {
+			return nil, err
+		}
+		entry.Hash, entry.Kind, entry.AddedAt = hash, kind, now
+		entry.Family = strings.TrimSpace(entry.Family)
+		if entry.Severity == "" {
+			entry.Severity = High
+		}
+		if !validThreatLevels[entry.Severity] {
+			return nil, fmt.Errorf("%w: unknown severity %q", errInvalidFileIntel, entry.Severity)
+		}
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		key := fileIntelKey
+		if kind == "ssdeep" {
+			key = fileIntelSSDeepKey
+		}
+		pipe.HSet(ctx, key, hash, data)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to store file intel: %w", err)
+	}
+
+	fs.mu.Lock()
+	fs.refreshed = time.Time{}
+	fs.mu.Unlock()
+	return entries, nil
+}
+
+func (fs *FileScanner) RemoveIntel(ctx context.Context, value string) (bool, error) {
+	hash, kind, err := normalizeFileHash(value)
+	if err != nil {
+		return false, nil
+	}
+	key := fileIntelKey
+	if kind == "ssdeep" {
+		key = fileIntelSSDeepKey
+	}
+	removed, err := fs.redis.HDel(ctx, key, hash).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete file intel: %w", err)
+	}
+
+	fs.mu.Lock()
+	fs.refreshed = time.Time{}
+	fs.mu.Unlock()
+	return removed > 0, nil
+}
+
+// matchIntel looks up the cryptographic hashes exactly and compares the ssdeep hash with the
+// known samples' ssdeep hashes
+func (fs *FileScanner) matchIntel(ctx context.Context, result *FileScanResult) error {
+	hashes := make([]string, 0, 3)
+	for _, hash := range []string{result.SHA256, result.SHA1, result.MD5} {
+		if hash != "" {
+			hashes = append(hashes, hash)
+		}
+	}
+	if len(hashes) > 0 {
+		stored, err := fs.redis.HMGet(ctx, fileIntelKey, hashes...).Result()
+		if err != nil {
+			return fmt.Errorf("failed to look up file intel: %w", err)
+		}
+		for _, data := range stored {
+			var entry FileIntel
+			if data == nil || json.Unmarshal([]byte(fmt.Sprint(data)), &entry) != nil {
+				continue
+			}
+			result.Matches = append(result.Matches, FileScanMatch{
+				Source:   "intel",
+				ID:       entry.Hash,
+				Family:   entry.Family,
+				Severity: entry.Severity,
+				Score:    100,
+				Detail:   entry.Description,
+				verdict:  VerdictMalicious,
+			})
+		}
+	}
+
+	if result.SSDeep == "" {
+		return nil
+	}
+	known, err := fs.ssdeepIntel(ctx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range known {
+		similarity := ssdeepCompare(result.SSDeep, entry.Hash)
+		if similarity < ssdeepSuspiciousScore {
+			continue
+		}
+		verdict := VerdictSuspicious
+		if similarity >= ssdeepMaliciousScore {
+			verdict = VerdictMalicious
+		}
+		result.Matches = append(result.Matches, FileScanMatch{
+			Source:   "ssdeep",
+			ID:       entry.Hash,
+			Family:   entry.Family,
+			Severity: entry.Severity,
+			Score:    similarity,
+			Detail:   fmt.Sprintf("%d%% similar to a known sample", similarity),
+			verdict:  verdict,
+		})
+	}
+	return nil
+}
+
+// matchSignatures applies the payload signatures the context's tenant uses to the file content
+func (fs *FileScanner) matchSignatures(ctx context.Context, content []byte, result *FileScanResult) {
+	tenant := fs.detector.tenants.state(ctx)
+	indexes := make([]*signatureIndex, 0, 2)
+	if idx := fs.detector.packetSignatures.Load(); idx != nil {
+		indexes = append(indexes, idx)
+	}
+	if tenant != nil {
+		indexes = append(indexes, tenant.index)
+	}
+	for _, idx := range indexes {
+		for _, sig := range idx.anyPort {
+			if sig.Scope != ScopePayload || tenant != nil && tenant.disabled[sig.ID] || !sig.pattern.Match(content) {
+				continue
+			}
+			result.Matches = append(result.Matches, FileScanMatch{
+				Source:   "signature",
+				ID:       sig.ID,
+				Severity: sig.Severity,
+				Score:    60,
+				Detail:   sig.Description,
+				verdict:  VerdictSuspicious,
+			})
+		}
+	}
+}
+
+// matchReputation asks the reputation sources about the SHA-256, or the strongest hash given
+func (fs *FileScanner) matchReputation(ctx context.Context, result *FileScanResult) {
+	hash := result.SHA256
+	for _, candidate := range []string{result.SHA1, result.MD5} {
+		if hash == "" {
+			hash = candidate
+		}
+	}
+	if hash == "" {
+		return
+	}
+	report, err := fs.detector.reputation.Lookup(ctx, hash)
+	if err != nil {
+		log.Printf("Reputation lookup of %s failed: %v", hash, err)
+		return
+	}
+	for _, source := range report.Sources {
+		if source.Score == 0 {
+			continue
+		}
+		verdict := VerdictSuspicious
+		if source.Malicious {
+			verdict = VerdictMalicious
+		}
+		result.Matches = append(result.Matches, FileScanMatch{
+			Source:  "reputation",
+			ID:      source.Source,
+			Score:   int(source.Score),
+			Detail:  source.Detail,
+			verdict: verdict,
+		})
+	}
+}
+
+// decide sets the verdict from the strongest match and attributes the family of the highest
+// scoring match that names one
+func (result *FileScanResult) decide() {
+	result.Verdict = VerdictUnknown
+	sort.SliceStable(result.Matches, func(i, j int) bool { return result.Matches[i].Score > result.Matches[j].Score })
+	for _, match := range result.Matches {
+		switch {
+		case match.verdict == VerdictMalicious:
+			result.Verdict = VerdictMalicious
+		case match.verdict == VerdictSuspicious && result.Verdict == VerdictUnknown:
+			result.Verdict = VerdictSuspicious
+		}
+		if result.Family == "" {
+			result.Family = match.Family
+		}
+		result.Score = max(result.Score, match.Score)
+	}
+	fileScans.WithLabelValues(string(result.Verdict)).Inc()
+}
+
+// ScanFile hashes content and runs every check; the result is cached for the tenant under its
+// SHA-256
+func (fs *FileScanner) ScanFile(ctx context.Context, name string, content []byte, reputation bool) (*FileScanResult, error) {
+	md5Sum, sha1Sum, sha256Sum := md5.Sum(content), sha1.Sum(content), sha256.Sum256(content)
+	result := &FileScanResult{
+		Name:      name,
+		Size:      int64(len(content)),
+		MD5:       hex.EncodeToString(md5Sum[:]),
+		SHA1:      hex.EncodeToString(sha1Sum[:]),
+		SHA256:    hex.EncodeToString(sha256Sum[:]),
+		SSDeep:    ssdeepDigest(content),
+		Matches:   make([]FileScanMatch, 0),
+		Scanned:   []string{"intel", "ssdeep", "signatures"},
+		ScannedAt: time.Now().UTC(),
+	}
+
+	if err := fs.matchIntel(ctx, result); err != nil {
+		return nil, err
+	}
+	fs.matchSignatures(ctx, content, result)
+	if fs.yara != nil {
+		matches, err := fs.yara.Scan(ctx, content)
+		if err != nil {
+			return nil, err
+		}
+		result.Matches = append(result.Matches, matches...)
+		result.Scanned = append(result.Scanned, "yara")
+	}
+	if reputation && fs.detector.reputation.Enabled() {
+		fs.matchReputation(ctx, result)
+		result.Scanned = append(result.Scanned, "reputation")
+	}
+	result.decide()
+
+	if data, err := json.Marshal(result); err == nil {
+		if err := fs.redis.Set(ctx, tenantKey(ctx, fileScanKeyPrefix+result.SHA256), data, fileScanTTL).Err(); err != nil {
+			log.Printf("Failed to cache scan of %s: %v", result.SHA256, err)
+		}
+	}
+	return result, nil
+}
+
+// ScanHash checks a hash without its file. A SHA-256 the tenant has scanned as a file returns
+// that result; other hashes are looked up in the intel store and, optionally, reputation sources.
+func (fs *FileScanner) ScanHash(ctx context.Context, value string, reputation bool) (*FileScanResult, error) {
+	hash, kind, err := normalizeFileHash(value)
+	if err != nil {
+		return nil, err
+	}
+	if kind == "sha256" {
+		if cached, err := fs.Result(ctx, hash); err != nil || cached != nil {
+			return cached, err
+		}
+	}
+
+	result := &FileScanResult{Matches: make([]FileScanMatch, 0), Scanned: []string{"intel"}, ScannedAt: time.Now().UTC()}
+	switch kind {
+	case "md5":
+		result.MD5 = hash
+	case "sha1":
+		result.SHA1 = hash
+	case "sha256":
+		result.SHA256 = hash
+	case "ssdeep":
+		result.SSDeep = hash
+		result.Scanned = []string{"ssdeep"}
+	}
+	if err := fs.matchIntel(ctx, result); err != nil {
+		return nil, err
+	}
+	if reputation && kind != "ssdeep" && fs.detector.reputation.Enabled() {
+		fs.matchReputation(ctx, result)
+		result.Scanned = append(result.Scanned, "reputation")
+	}
+	result.decide()
+	return result, nil
+}
+
+// Result returns the tenant's cached scan of a file, or nil
+func (fs *FileScanner) Result(ctx context.Context, sha256 string) (*FileScanResult, error) {
+	data, err := fs.redis.Get(ctx, tenantKey(ctx, fileScanKeyPrefix+strings.ToLower(sha256))).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load scan result: %w", err)
+	}
+	var result FileScanResult
+	if err := json.Unmarshal([]byte(data), &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// YARAScanner runs the yara command-line scanner with a rules file. Rules compiled with yarac
+// are recognized by their .yarc extension.
+type YARAScanner struct {
+	binary  string
+	rules   string
+	timeout time.Duration
+	slots   chan struct{}
+}
+
+// NewYARAScanner returns nil when no rules are configured or the yara binary cannot be found,
+// which disables YARA scanning
+func NewYARAScanner(binary, rules string, timeout time.Duration, concurrency int) (*YARAScanner, error) {
+	if rules == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(rules); err != nil {
+		return nil, fmt.Errorf("YARA rules: %w", err)
+	}
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		log.Printf("yara not found (%v); YARA scanning is disabled", err)
+		return nil, nil
+	}
+	return &YARAScanner{binary: path, rules: rules, timeout: timeout, slots: make(chan struct{}, max(concurrency, 1))}, nil
+}
+
+// Scan writes content to a temporary file and reports the rules that match it. Rule metadata
+// sets the family ("malware_family", "family", or "malware") and the severity.
+func (ys *YARAScanner) Scan(ctx context.Context, content []byte) ([]FileScanMatch, error) {
+	select {
+	case ys.slots <- struct{}{}:
+		defer func() { <-ys.slots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	file, err := os.CreateTemp("", "filescan-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scanCtx, cancel := context.WithTimeout(ctx, ys.timeout)
+	defer cancel()
+
+	args := []string{"-w", "-m", "-a", fmt.Sprint(int(ys.timeout.Seconds()))}
+	if strings.HasSuffix(ys.rules, ".yarc") {
+		args = append(args, "-C")
+	}
+	args = append(args, ys.rules, file.Name())
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(scanCtx, ys.binary, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if scanCtx.Err() != nil {
+			return nil, fmt.Errorf("YARA scan timed out after %s", ys.timeout)
+		}
+		return nil, fmt.Errorf("YARA scan failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parseYARAOutput(stdout.String(), file.Name()), nil
+}
+
+// parseYARAOutput reads "rule [meta] path" lines as printed by yara -m
+func parseYARAOutput(output, path string) []FileScanMatch {
+	matches := make([]FileScanMatch, 0)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSuffix(strings.TrimSpace(scanner.Text()), path)
+		rule, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+		if rule == "" {
+			continue
+		}
+
+		meta := make(map[string]string)
+		if start, end := strings.Index(rest, "["), strings.LastIndex(rest, "]"); start >= 0 && end > start {
+			for _, pair := range yaraMetaPattern.FindAllStringSubmatch(rest[start+1:end], -1) {
+				meta[strings.ToLower(pair[1])] = strings.Trim(pair[2], `"`)
+			}
+		}
+
+		match := FileScanMatch{Source: "yara", ID: rule, Severity: High, Score: 90, Detail: meta["description"], verdict: VerdictMalicious}
+		for _, key := range []string{"malware_family", "family", "malware"} {
+			if family := meta[key]; family != "" {
+				match.Family = family
+				break
+			}
+		}
+		if severity := ThreatLevel(strings.ToLower(meta["severity"])); validThreatLevels[severity] {
+			match.Severity = severity
+		}
+		if match.Severity == Medium || match.Severity == Low {
+			match.Score, match.verdict = 70, VerdictSuspicious
+		}
+		matches = append(matches, match)
+	}
+	return matches
+}
+
+// HTTP Handlers
+type HashScanRequest struct {
+	Hashes     []string `json:"hashes" binding:"required,min=1"`
+	Reputation bool     `json:"reputation"` // also ask the reputation sources
+}
+
+// scanFileHandler scans an uploaded file (multipart field "file") or a JSON list of hashes
+func (s *APIServer) scanFileHandler(c *gin.Context) {
+	scanner := s.threatDetector.files
+	if c.ContentType() != "multipart/form-data" {
+		var req HashScanRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "upload a file as multipart field \"file\" or send {\"hashes\": [...]}: " + err.Error()})
+			return
+		}
+		if len(req.Hashes) > maxFileScanHashes {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d hashes per request", maxFileScanHashes)})
+			return
+		}
+
+		results := make([]*FileScanResult, 0, len(req.Hashes))
+		for _, hash := range req.Hashes {
+			result, err := scanner.ScanHash(c.Request.Context(), hash, req.Reputation)
+			switch {
+			case errors.Is(err, errInvalidFileIntel):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			case err != nil:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			results = append(results, result)
+		}
+		c.JSON(http.StatusOK, gin.H{"results": results})
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, scanner.maxBytes+1<<20)
+	fileHeader, err := c.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || err == nil && fileHeader.Size > scanner.maxBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("%v: files are limited to %d MB", errFileTooLarge, scanner.maxBytes>>20)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "multipart field \"file\" is required"})
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+	content, err := io.ReadAll(io.LimitReader(file, scanner.maxBytes))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := scanner.ScanFile(c.Request.Context(), fileHeader.Filename, content, c.PostForm("reputation") == "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// Suspicious files are detonated; the report is merged into the scan named by scan_id
+	result.Detonating = s.threatDetector.sandbox.DetonateFile(c.Request.Context(), c.PostForm("scan_id"), result, content)
+	c.JSON(http.StatusOK, result)
+}
+
+func (s *APIServer) getFileScanHandler(c *gin.Context) {
+	result, err := s.threatDetector.files.Result(c.Request.Context(), c.Param("sha256"))
+	switch {
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case result == nil:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scan not found"})
+	default:
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+func (s *APIServer) listFileIntelHandler(c *gin.Context) {
+	entries, err := s.threatDetector.files.Intel(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries, "count": len(entries)})
+}
+
+func (s *APIServer) addFileIntelHandler(c *gin.Context) {
+	var req struct {
+		Entries []FileIntel `json:"entries" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Entries) > maxFileIntelEntries {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d entries per request", maxFileIntelEntries)})
+		return
+	}
+
+	entries, err := s.threatDetector.files.AddIntel(c.Request.Context(), req.Entries)
+	switch {
+	case errors.Is(err, errInvalidFileIntel):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusCreated, gin.H{"entries": entries, "count": len(entries)})
+	}
+}
+
+func (s *APIServer) removeFileIntelHandler(c *gin.Context) {
+	hash := c.Query("hash")
+	if hash == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "hash is required"})
+		return
+	}
+
+	found, err := s.threatDetector.files.RemoveIntel(c.Request.Context(), hash)
+	switch {
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case !found:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Entry not found"})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
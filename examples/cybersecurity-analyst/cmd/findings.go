@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Findings and remediation tracking
+const (
+	findingsKey              = "findings"           // hash of finding ID -> Finding JSON
+	findingsAssetKeyPrefix   = "findings:asset:"    // set of vulnerability finding IDs per asset
+	scanActivityKeyPrefix    = "findings:activity:" // hash per UTC day: scan type -> completed scans
+	scanActivityLayout       = "20060102"
+	scanActivityRetention    = 400 * 24 * time.Hour // a year of audit history, plus a month's grace
+	findingsMax              = 50000
+	findingHistoryMax        = 50
+	findingKindVulnerability = "vulnerability"
+	findingKindThreat        = "threat"
+)
+
+type FindingStatus string
+
+const (
+	FindingOpen         FindingStatus = "open"
+	FindingInProgress   FindingStatus = "in_progress"
+	FindingRemediated   FindingStatus = "remediated"
+	FindingRiskAccepted FindingStatus = "risk_accepted"
+)
+
+var (
+	errFindingNotFound = errors.New("finding not found")
+	errInvalidFinding  = errors.New("invalid finding update")
+
+	findingStatuses = map[FindingStatus]bool{FindingOpen: true, FindingInProgress: true, FindingRemediated: true, FindingRiskAccepted: true}
+
+	// remediationSLA is how long a finding may stay open after it is reported or reopened
+	remediationSLA = map[ThreatLevel]time.Duration{
+		Critical: 15 * 24 * time.Hour,
+		High:     30 * 24 * time.Hour,
+		Medium:   90 * 24 * time.Hour,
+		Low:      180 * 24 * time.Hour,
+	}
+
+	severityRank = map[ThreatLevel]int{Low: 0, Medium: 1, High: 2, Critical: 3}
+)
+
+var findingsOpen = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cybersecurity_findings_open",
+		Help: "Findings that are open or in progress, by kind and severity, as of the last scan",
+	},
+	[]string{"kind", "severity"},
+)
+
+func init() {
+	prometheus.MustRegister(findingsOpen)
+}
+
+// FindingEvent is a change in a finding's status
+type FindingEvent struct {
+	Status    FindingStatus `json:"status"`
+	Note      string        `json:"note,omitempty"`
+	Timestamp time.Time     `json:"timestamp"`
+}
+
+// Finding is a vulnerability on one system, or a threat indicator, tracked across scans until it
+// is remediated
+type Finding struct {
+	ID           string         `json:"id"`
+	Kind         string         `json:"kind"` // "vulnerability" or "threat"
+	Title        string         `json:"title"`
+	Severity     ThreatLevel    `json:"severity"`
+	CVE          string         `json:"cve,omitempty"`
+	ThreatType   ThreatType     `json:"threat_type,omitempty"`
+	MITREAttack  string         `json:"mitre_attack,omitempty"`
+	System       string         `json:"system,omitempty"` // affected host:port, asset, or "software"; the source address of threats
+	Asset        string         `json:"asset,omitempty"`
+	Remediation  string         `json:"remediation,omitempty"`
+	Status       FindingStatus  `json:"status"`
+	FirstSeen    time.Time      `json:"first_seen"`
+	LastSeen     time.Time      `json:"last_seen"`
+	LastScanID   string         `json:"last_scan_id"`
+	Occurrences  int            `json:"occurrences"` // scans that reported it
+	DueAt        time.Time      `json:"due_at"`      // remediation deadline for its severity
+	RemediatedAt *time.Time     `json:"remediated_at,omitempty"`
+	History      []FindingEvent `json:"history"`
+}
+
+// active reports whether the finding still needs remediation
+func (f *Finding) active() bool {
+	return f.Status == FindingOpen || f.Status == FindingInProgress
+}
+
+// overdue reports whether the finding was still active past its deadline at the given time
+func (f *Finding) overdue(at time.Time) bool {
+	return f.active() && at.After(f.DueAt)
+}
+
+func (f *Finding) setStatus(status FindingStatus, note string, at time.Time) {
+	f.Status = status
+	if status == FindingRemediated {
+		f.RemediatedAt = &at
+	} else {
+		f.RemediatedAt = nil
+	}
+	f.History = append(f.History, FindingEvent{Status: status, Note: note, Timestamp: at})
+	if len(f.History) > findingHistoryMax {
+		f.History = f.History[len(f.History)-findingHistoryMax:]
+	}
+}
+
+func findingID(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return "fnd_" + hex.EncodeToString(sum[:8])
+}
+
+type FindingFilter struct {
+	Status   FindingStatus
+	Kind     string
+	Severity ThreatLevel
+	Asset    string
+}
+
+// FindingStore records the findings of analyze scans, including scheduled ones, and counts
+// completed scans per day as compliance evidence
+type FindingStore struct {
+	redis *redis.Client
+	mu    sync.Mutex // serializes read-modify-write of findings within this process
+}
+
+func NewFindingStore(redisClient *redis.Client) *FindingStore {
+	return &FindingStore{redis: redisClient}
+}
+
+// Record merges a scan's findings into the store. Vulnerability findings on the scanned assets
+// that the scan no longer reports are marked remediated; those reported again after remediation
+// are reopened. Threat findings only change status through the API.
+func (fs *FindingStore) Record(ctx context.Context, req *ThreatDetectionRequest, response *ThreatDetectionResponse, scanned []Asset, assets *assetIndex) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	now := response.Timestamp.UTC()
+	current := make(map[string]*Finding)
+	order := make([]string, 0)
+	add := func(finding *Finding) {
+		if _, ok := current[finding.ID]; !ok {
+			current[finding.ID] = finding
+			order = append(order, finding.ID)
+		}
+	}
+
+	for _, vuln := range response.Vulnerabilities {
+		for _, system := range vuln.AffectedSystems {
+			finding := &Finding{
+				ID:          findingID(strings.Join([]string{"cve", vuln.CVE, system}, "|")),
+				Kind:        findingKindVulnerability,
+				Title:       fmt.Sprintf("%s on %s", vuln.CVE, system),
+				Severity:    vuln.Severity,
+				CVE:         vuln.CVE,
+				System:      system,
+				Remediation: vuln.Remediation,
+			}
+			host, _, err := net.SplitHostPort(system)
+			if err != nil {
+				host = system
+			}
+			if asset := assets.lookup(host); asset != nil {
+				finding.Asset = asset.ID
+			}
+			add(finding)
+		}
+	}
+	for _, threat := range response.ThreatIndicators {
+		add(&Finding{
+			ID:          findingID(threatFindingKey(threat)),
+			Kind:        findingKindThreat,
+			Title:       threat.Description,
+			Severity:    threat.Severity,
+			ThreatType:  threat.Type,
+			MITREAttack: threat.MITREAttack,
+			System:      threat.SourceIP,
+			Asset:       threat.Asset,
+		})
+	}
+
+	// Findings previously seen on the scanned assets may have been fixed since
+	var resolved []string
+	for _, asset := range scanned {
+		ids, err := fs.redis.SMembers(ctx, tenantKey(ctx, findingsAssetKeyPrefix+asset.ID)).Result()
+		if err != nil {
+			log.Printf("Failed to load findings for asset %s: %v", asset.ID, err)
+			continue
+		}
+		for _, id := range ids {
+			if _, ok := current[id]; !ok {
+				resolved = append(resolved, id)
+			}
+		}
+	}
+
+	ids := append(append([]string{}, order...), resolved...)
+	existing, err := fs.load(ctx, ids)
+	if err != nil {
+		log.Printf("Findings of scan %s not recorded: %v", req.ScanID, err)
+		return
+	}
+	stored, err := fs.redis.HLen(ctx, tenantKey(ctx, findingsKey)).Result()
+	if err != nil {
+		log.Printf("Findings of scan %s not recorded: %v", req.ScanID, err)
+		return
+	}
+
+	pipe := fs.redis.TxPipeline()
+	untracked := 0
+	for _, id := range order {
+		finding := current[id]
+		if previous, ok := existing[id]; ok {
+			previous.Title, previous.Severity, previous.Remediation = finding.Title, finding.Severity, finding.Remediation
+			if finding.Asset != "" {
+				previous.Asset = finding.Asset
+			}
+			if previous.Status == FindingRemediated {
+				previous.setStatus(FindingOpen, "reopened: reported again by scan "+req.ScanID, now)
+				previous.DueAt = now.Add(remediationSLA[previous.Severity])
+			}
+			finding = previous
+		} else {
+			if stored >= findingsMax {
+				untracked++
+				continue
+			}
+			stored++
+			finding.Status = FindingOpen
+			finding.FirstSeen = now
+			finding.DueAt = now.Add(remediationSLA[finding.Severity])
+			finding.History = []FindingEvent{{Status: FindingOpen, Note: "reported by scan " + req.ScanID, Timestamp: now}}
+		}
+		finding.LastSeen = now
+		finding.LastScanID = req.ScanID
+		finding.Occurrences++
+		fs.queue(ctx, pipe, finding)
+	}
+	for _, id := range resolved {
+		finding, ok := existing[id]
+		if !ok {
+			continue
+		}
+		if finding.active() {
+			finding.setStatus(FindingRemediated, "no longer reported by scan "+req.ScanID, now)
+			fs.queue(ctx, pipe, finding)
+		}
+	}
+
+	day := tenantKey(ctx, scanActivityKeyPrefix+now.Format(scanActivityLayout))
+	pipe.HIncrBy(ctx, day, req.ScanType, 1)
+	pipe.Expire(ctx, day, scanActivityRetention)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record findings of scan %s: %v", req.ScanID, err)
+		return
+	}
+	if untracked > 0 {
+		log.Printf("Finding store is full (%d findings); %d findings of scan %s are not tracked", findingsMax, untracked, req.ScanID)
+	}
+	fs.updateGauge(ctx)
+}
+
+// Open records a vulnerability reported outside a scan, such as a CVE matching a watchlist. A
+// finding already being tracked is left as it is, except that a remediated one is reopened.
+func (fs *FindingStore) Open(ctx context.Context, finding *Finding, note string) (*Finding, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	now := time.Now().UTC()
+	existing, err := fs.load(ctx, []string{finding.ID})
+	if err != nil {
+		return nil, err
+	}
+	if previous, ok := existing[finding.ID]; ok {
+		if previous.Status != FindingRemediated {
+			return previous, nil
+		}
+		previous.setStatus(FindingOpen, "reopened: "+note, now)
+		previous.DueAt = now.Add(remediationSLA[previous.Severity])
+		finding = previous
+	} else {
+		finding.Status = FindingOpen
+		finding.FirstSeen = now
+		finding.DueAt = now.Add(remediationSLA[finding.Severity])
+		finding.History = []FindingEvent{{Status: FindingOpen, Note: note, Timestamp: now}}
+	}
+	finding.LastSeen = now
+
+	pipe := fs.redis.TxPipeline()
+	fs.queue(ctx, pipe, finding)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to store finding: %w", err)
+	}
+	fs.updateGauge(ctx)
+	return finding, nil
+}
+
+func (fs *FindingStore) queue(ctx context.Context, pipe redis.Pipeliner, finding *Finding) {
+	data, err := json.Marshal(finding)
+	if err != nil {
+		return
+	}
+	pipe.HSet(ctx, tenantKey(ctx, findingsKey), finding.ID, data)
+	if finding.Kind == findingKindVulnerability && finding.Asset != "" {
+		pipe.SAdd(ctx, tenantKey(ctx, findingsAssetKeyPrefix+finding.Asset), finding.ID)
+	}
+}
+
+func (fs *FindingStore) load(ctx context.Context, ids []string) (map[string]*Finding, error) {
+	findings := make(map[string]*Finding, len(ids))
+	if len(ids) == 0 {
+		return findings, nil
+	}
+	values, err := fs.redis.HMGet(ctx, tenantKey(ctx, findingsKey), ids...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load findings: %w", err)
+	}
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var finding Finding
+		if err := json.Unmarshal([]byte(data), &finding); err != nil {
+			continue
+		}
+		findings[finding.ID] = &finding
+	}
+	return findings, nil
+}
+
+func (fs *FindingStore) updateGauge(ctx context.Context) {
+	findings, err := fs.Findings(ctx, FindingFilter{})
+	if err != nil {
+		return
+	}
+	findingsOpen.Reset()
+	for _, finding := range findings {
+		if finding.active() {
+			findingsOpen.WithLabelValues(finding.Kind, string(finding.Severity)).Inc()
+		}
+	}
+}
+
+// Findings lists stored findings by severity, most severe first, then most recently seen
+func (fs *FindingStore) Findings(ctx context.Context, filter FindingFilter) ([]Finding, error) {
+	entries, err := fs.redis.HGetAll(ctx, tenantKey(ctx, findingsKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load findings: %w", err)
+	}
+
+	findings := make([]Finding, 0, len(entries))
+	for _, data := range entries {
+		var finding Finding
+		if err := json.Unmarshal([]byte(data), &finding); err != nil {
+			continue
+		}
+		if (filter.Status == "" || finding.Status == filter.Status) &&
+			(filter.Kind == "" || finding.Kind == filter.Kind) &&
+			(filter.Severity == "" || finding.Severity == filter.Severity) &&
+			(filter.Asset == "" || finding.Asset == filter.Asset) {
+			findings = append(findings, finding)
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		if ri, rj := severityRank[findings[i].Severity], severityRank[findings[j].Severity]; ri != rj {
+			return ri > rj
+		}
+		if !findings[i].LastSeen.Equal(findings[j].LastSeen) {
+			return findings[i].LastSeen.After(findings[j].LastSeen)
+		}
+		return findings[i].ID < findings[j].ID
+	})
+	return findings, nil
+}
+
+func (fs *FindingStore) Finding(ctx context.Context, id string) (*Finding, error) {
+	findings, err := fs.load(ctx, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	finding, ok := findings[id]
+	if !ok {
+		return nil, errFindingNotFound
+	}
+	return finding, nil
+}
+
+// UpdateStatus records an analyst's decision on a finding
+func (fs *FindingStore) UpdateStatus(ctx context.Context, id string, status FindingStatus, note string) (*Finding, error) {
+	if !findingStatuses[status] {
+		return nil, fmt.Errorf("%w: status must be open, in_progress, remediated, or risk_accepted", errInvalidFinding)
+	}
+	if status == FindingRiskAccepted && strings.TrimSpace(note) == "" {
+		return nil, fmt.Errorf("%w: accepting a risk needs a note giving the reason", errInvalidFinding)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	finding, err := fs.Finding(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if finding.Status == status && note == "" {
+		return finding, nil
+	}
+	finding.setStatus(status, note, time.Now().UTC())
+
+	pipe := fs.redis.TxPipeline()
+	fs.queue(ctx, pipe, finding)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to store finding: %w", err)
+	}
+	fs.updateGauge(ctx)
+	return finding, nil
+}
+
+// ScanActivity counts completed scans by type between two days, inclusive
+func (fs *FindingStore) ScanActivity(ctx context.Context, from, to time.Time) (map[string]int64, error) {
+	pipe := fs.redis.Pipeline()
+	var cmds []*redis.StringStringMapCmd
+	for day := from.UTC().Truncate(24 * time.Hour); !day.After(to.UTC()); day = day.Add(24 * time.Hour) {
+		cmds = append(cmds, pipe.HGetAll(ctx, tenantKey(ctx, scanActivityKeyPrefix+day.Format(scanActivityLayout))))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to load scan activity: %w", err)
+	}
+
+	activity := make(map[string]int64)
+	for _, cmd := range cmds {
+		counts, _ := cmd.Result()
+		for scanType, value := range counts {
+			if count, err := strconv.ParseInt(value, 10, 64); err == nil {
+				activity[scanType] += count
+			}
+		}
+	}
+	return activity, nil
+}
+
+// HTTP Handlers
+func (s *APIServer) listFindingsHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+		return
+	}
+
+	findings, err := s.threatDetector.findings.Findings(c.Request.Context(), FindingFilter{
+		Status:   FindingStatus(c.Query("status")),
+		Kind:     c.Query("kind"),
+		Severity: ThreatLevel(c.Query("severity")),
+		Asset:    c.Query("asset"),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	total := len(findings)
+	if len(findings) > limit {
+		findings = findings[:limit]
+	}
+	c.JSON(http.StatusOK, gin.H{"findings": findings, "total": total})
+}
+
+func (s *APIServer) getFindingHandler(c *gin.Context) {
+	finding, err := s.threatDetector.findings.Finding(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, errFindingNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, finding)
+	}
+}
+
+func (s *APIServer) updateFindingStatusHandler(c *gin.Context) {
+	var update struct {
+		Status FindingStatus `json:"status"`
+		Note   string        `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	finding, err := s.threatDetector.findings.UpdateStatus(c.Request.Context(), c.Param("id"), update.Status, update.Note)
+	switch {
+	case errors.Is(err, errInvalidFinding):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errFindingNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, finding)
+	}
+}
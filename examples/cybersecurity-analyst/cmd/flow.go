@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Flow collection (NetFlow/IPFIX/sFlow)
+const (
+	flowWindow        = time.Minute // matches the usual active timeout of flow exporters
+	flowIndicatorsKey = "flow:indicators"
+
+	// Aggregation limits keep a flood of spoofed sources from exhausting memory
+	maxFlowEndpoints = 100000 // sources and targets tracked per window
+	maxFlowSetSize   = 1024   // members kept per port, host, or peer set
+
+	flowScanPorts      = 20      // distinct destination ports from one source
+	flowSweepHosts     = 50      // distinct hosts sent unanswered SYNs on one port
+	flowDDoSPacketRate = 100000  // packets/sec towards one target
+	flowSYNFloodFlows  = 1000    // unanswered SYN flows towards one target
+	flowDDoSMinSources = 10      // sources needed before volume counts as distributed
+	flowExfilBytes     = 1 << 30 // bytes from an internal host to one external host per window
+)
+
+var (
+	flowsReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_flows_received_total",
+			Help: "Total flow records decoded by export protocol",
+		},
+		[]string{"protocol"},
+	)
+
+	flowDecodeErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_flow_decode_errors_total",
+			Help: "Total flow export datagrams that could not be decoded",
+		},
+		[]string{"protocol"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(flowsReceived)
+	prometheus.MustRegister(flowDecodeErrors)
+}
+
+type ExporterStatus struct {
+	Address   string    `json:"address"`
+	Protocol  string    `json:"protocol"`
+	Datagrams uint64    `json:"datagrams"`
+	Flows     uint64    `json:"flows"`
+	Errors    uint64    `json:"errors"`
+	LastError string    `json:"last_error,omitempty"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type FlowStatus struct {
+	Enabled     bool              `json:"enabled"`
+	Listen      string            `json:"listen,omitempty"`
+	Exporters   []ExporterStatus  `json:"exporters"`
+	WindowFlows uint64            `json:"window_flows"` // flows aggregated in the current window
+	Indicators  []ThreatIndicator `json:"recent_indicators"`
+}
+
+// flowSource aggregates the flows one host sent during a window
+type flowSource struct {
+	ports    map[int]struct{}            // destination ports, excluding replies
+	sweeps   map[int]map[string]struct{} // port -> hosts sent unanswered SYNs
+	bytesTo  map[string]uint64           // destination -> bytes
+	external bool                        // source is not a private address
+}
+
+// flowTarget aggregates the flows one host received during a window
+type flowTarget struct {
+	packets  uint64
+	synFlows uint64
+	sources  map[string]struct{}
+}
+
+type flowAggregate struct {
+	mu        sync.Mutex
+	flows     uint64
+	untracked uint64 // flows whose endpoints exceeded maxFlowEndpoints
+	sources   map[string]*flowSource
+	targets   map[string]*flowTarget
+}
+
+func newFlowAggregate() *flowAggregate {
+	return &flowAggregate{
+		sources: make(map[string]*flowSource),
+		targets: make(map[string]*flowTarget),
+	}
+}
+
+func (a *flowAggregate) add(records []FlowRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, r := range records {
+		a.flows++
+		if r.SourceIP == "" || r.DestIP == "" {
+			continue
+		}
+
+		src, ok := a.sources[r.SourceIP]
+		if !ok && len(a.sources) < maxFlowEndpoints {
+			src = &flowSource{
+				ports:    make(map[int]struct{}),
+				sweeps:   make(map[int]map[string]struct{}),
+				bytesTo:  make(map[string]uint64),
+				external: !isPrivateIP(r.SourceIP),
+			}
+			a.sources[r.SourceIP] = src
+		}
+		dst, ok := a.targets[r.DestIP]
+		if !ok && len(a.targets) < maxFlowEndpoints {
+			dst = &flowTarget{sources: make(map[string]struct{})}
+			a.targets[r.DestIP] = dst
+		}
+		if src == nil || dst == nil {
+			a.untracked++
+			continue
+		}
+
+		unansweredSYN := r.Protocol == "TCP" && r.TCPFlags&tcpFlagSYN != 0 && r.TCPFlags&tcpFlagACK == 0
+
+		// A flow from a well-known port to an ephemeral one is most likely a server reply
+		if !(r.SourcePort < 1024 && r.DestPort >= 1024) {
+			addToSet(src.ports, r.DestPort)
+		}
+		if unansweredSYN {
+			hosts := src.sweeps[r.DestPort]
+			if hosts == nil {
+				hosts = make(map[string]struct{})
+				src.sweeps[r.DestPort] = hosts
+			}
+			addToSet(hosts, r.DestIP)
+			dst.synFlows++
+		}
+		if _, ok := src.bytesTo[r.DestIP]; ok || len(src.bytesTo) < maxFlowSetSize {
+			src.bytesTo[r.DestIP] += r.Bytes
+		}
+
+		dst.packets += r.Packets
+		addToSet(dst.sources, r.SourceIP)
+	}
+}
+
+func addToSet[K comparable](set map[K]struct{}, key K) {
+	if len(set) < maxFlowSetSize {
+		set[key] = struct{}{}
+	}
+}
+
+// FlowCollector receives flow exports on a UDP socket and runs flow detection over each window
+type FlowCollector struct {
+	redis     *redis.Client
+	detector  *ThreatDetector
+	addr      string
+	templates *templateCache
+
+	mu        sync.Mutex
+	aggregate *flowAggregate
+	exporters map[string]*ExporterStatus
+}
+
+func NewFlowCollector(redisClient *redis.Client, detector *ThreatDetector, addr string) *FlowCollector {
+	return &FlowCollector{
+		redis:     redisClient,
+		detector:  detector,
+		addr:      addr,
+		templates: newTemplateCache(),
+		aggregate: newFlowAggregate(),
+		exporters: make(map[string]*ExporterStatus),
+	}
+}
+
+// Start listens for flow exports until ctx is cancelled. NetFlow, IPFIX, and sFlow share the
+// socket; each datagram is decoded according to its version header.
+func (fc *FlowCollector) Start(ctx context.Context) (*sync.WaitGroup, error) {
+	conn, err := net.ListenPacket("udp", fc.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for flows on %s: %w", fc.addr, err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		fc.receive(ctx, conn)
+	}()
+	go func() {
+		defer wg.Done()
+		fc.detect(ctx)
+	}()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	log.Printf("Collecting NetFlow/IPFIX/sFlow on udp %s", conn.LocalAddr())
+	return &wg, nil
+}
+
+func (fc *FlowCollector) receive(ctx context.Context, conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, remote, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Flow collector read failed: %v", err)
+			continue
+		}
+
+		exporter := remote.String()
+		if udpAddr, ok := remote.(*net.UDPAddr); ok {
+			exporter = udpAddr.IP.String()
+		}
+
+		protocol, records, err := DecodeFlowDatagram(buf[:n], exporter, fc.templates)
+		fc.recordExporter(exporter, protocol, len(records), err)
+		if err != nil {
+			label := protocol
+			if label == "" {
+				label = "unknown"
+			}
+			flowDecodeErrors.WithLabelValues(label).Inc()
+		}
+		if len(records) == 0 {
+			continue
+		}
+
+		flowsReceived.WithLabelValues(protocol).Add(float64(len(records)))
+		fc.mu.Lock()
+		aggregate := fc.aggregate
+		fc.mu.Unlock()
+		aggregate.add(records)
+	}
+}
+
+func (fc *FlowCollector) recordExporter(exporter, protocol string, flows int, err error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	status, ok := fc.exporters[exporter]
+	if !ok {
+		status = &ExporterStatus{Address: exporter}
+		fc.exporters[exporter] = status
+	}
+	if protocol != "" {
+		status.Protocol = protocol
+	}
+	status.Datagrams++
+	status.Flows += uint64(flows)
+	status.LastSeen = time.Now()
+	if err != nil {
+		status.Errors++
+		status.LastError = err.Error()
+	}
+}
+
+// detect swaps in a fresh aggregate every window and evaluates the completed one
+func (fc *FlowCollector) detect(ctx context.Context) {
+	ticker := time.NewTicker(flowWindow)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fc.mu.Lock()
+		aggregate := fc.aggregate
+		fc.aggregate = newFlowAggregate()
+		fc.mu.Unlock()
+
+		aggregate.mu.Lock()
+		if aggregate.untracked > 0 {
+			log.Printf("Flow window exceeded %d endpoints; %d flows were not aggregated", maxFlowEndpoints, aggregate.untracked)
+		}
+		threats := fc.detector.detectFlowThreats(aggregate, flowWindow)
+		activity := aggregate.activity()
+		aggregate.mu.Unlock()
+		threats = append(threats, fc.detector.baselines.Observe(ctx, activity)...)
+		threats = fc.detector.lists.Apply(ctx, threats)
+
+		for _, threat := range threats {
+			threatsDetected.WithLabelValues(string(threat.Severity), string(threat.Type)).Inc()
+		}
+		fc.detector.recordDetections(ctx, threats)
+		fc.detector.campaigns.Record(ctx, "flow", "", threats)
+		fc.detector.history.RecordIndicators(ctx, "flow", "", threats)
+		fc.detector.geo.Enrich(threats)
+		fc.detector.endpoints.Annotate(ctx, threats)
+		pushIndicators(ctx, fc.redis, flowIndicatorsKey, threats)
+		fc.detector.siem.ForwardIndicators("flow", threats)
+		fc.detector.alerts.Route(ctx, "flow", threats)
+	}
+}
+
+// detectFlowThreats applies scan, DDoS, and exfiltration detection to a window of flows. Flows
+// carry no payload, so detection relies on volumes, fan-out, and TCP flags.
+func (td *ThreatDetector) detectFlowThreats(aggregate *flowAggregate, window time.Duration) []ThreatIndicator {
+	threats := make([]ThreatIndicator, 0)
+
+	for ip, src := range aggregate.sources {
+		if len(src.ports) > flowScanPorts {
+			threats = append(threats, ThreatIndicator{
+				Type:        Intrusion,
+				Severity:    High,
+				Confidence:  0.85,
+				Description: "Port scan detected in flow records",
+				SourceIP:    ip,
+				MITREAttack: "T1046",
+				Evidence:    []string{fmt.Sprintf("Contacted %d different ports within %s", len(src.ports), window)},
+			})
+		}
+
+		for port, hosts := range src.sweeps {
+			if len(hosts) > flowSweepHosts {
+				threats = append(threats, ThreatIndicator{
+					Type:        Intrusion,
+					Severity:    Medium,
+					Confidence:  0.8,
+					Description: "Network sweep detected in flow records",
+					SourceIP:    ip,
+					MITREAttack: "T1046",
+					Evidence:    []string{fmt.Sprintf("Sent unanswered SYNs to %d hosts on port %d within %s", len(hosts), port, window)},
+				})
+			}
+		}
+
+		if src.external {
+			continue
+		}
+		for dest, bytes := range src.bytesTo {
+			if bytes > flowExfilBytes && !isPrivateIP(dest) {
+				threats = append(threats, ThreatIndicator{
+					Type:        DataExfil,
+					Severity:    High,
+					Confidence:  0.7,
+					Description: "Large outbound transfer to an external host",
+					SourceIP:    ip,
+					DestIP:      dest,
+					MITREAttack: "T1048",
+					Evidence:    []string{fmt.Sprintf("Sent %d MB within %s", bytes>>20, window)},
+				})
+			}
+		}
+	}
+
+	for ip, dst := range aggregate.targets {
+		if len(dst.sources) < flowDDoSMinSources {
+			continue
+		}
+
+		rate := float64(dst.packets) / window.Seconds()
+		if rate > flowDDoSPacketRate {
+			threats = append(threats, ThreatIndicator{
+				Type:        DDoS,
+				Severity:    Critical,
+				Confidence:  0.8,
+				Description: "Volumetric DDoS attack detected in flow records",
+				DestIP:      ip,
+				MITREAttack: "T1498",
+				Evidence:    []string{fmt.Sprintf("%.0f packets/sec from %d sources", rate, len(dst.sources))},
+			})
+		}
+		if dst.synFlows > flowSYNFloodFlows {
+			threats = append(threats, ThreatIndicator{
+				Type:        DDoS,
+				Severity:    High,
+				Confidence:  0.78,
+				Description: "SYN flood detected in flow records",
+				DestIP:      ip,
+				MITREAttack: "T1498",
+				Evidence:    []string{fmt.Sprintf("%d unanswered SYN flows from %d sources within %s", dst.synFlows, len(dst.sources), window)},
+			})
+		}
+	}
+
+	return threats
+}
+
+// Status reports exporters, the current window, and the most recent indicators
+func (fc *FlowCollector) Status(ctx context.Context, limit int) (*FlowStatus, error) {
+	status := &FlowStatus{
+		Enabled:   fc.addr != "",
+		Listen:    fc.addr,
+		Exporters: make([]ExporterStatus, 0),
+	}
+
+	fc.mu.Lock()
+	for _, exporter := range fc.exporters {
+		status.Exporters = append(status.Exporters, *exporter)
+	}
+	aggregate := fc.aggregate
+	fc.mu.Unlock()
+	sort.Slice(status.Exporters, func(i, j int) bool { return status.Exporters[i].Address < status.Exporters[j].Address })
+
+	aggregate.mu.Lock()
+	status.WindowFlows = aggregate.flows
+	aggregate.mu.Unlock()
+
+	indicators, err := recentIndicators(ctx, fc.redis, flowIndicatorsKey, limit)
+	if err != nil {
+		return nil, err
+	}
+	status.Indicators = indicators
+	return status, nil
+}
+
+func isPrivateIP(value string) bool {
+	ip := net.ParseIP(value)
+	return ip != nil && (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast())
+}
+
+// HTTP Handlers
+func (s *APIServer) flowStatusHandler(c *gin.Context) {
+	status, err := s.flowCollector.Status(c.Request.Context(), 100)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GeoIP and ASN enrichment (MaxMind GeoLite2)
+const geoIPReloadInterval = time.Hour // geoipupdate replaces the databases weekly
+
+var threatsByCountry = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cybersecurity_threats_by_country_total",
+		Help: "Threat indicators by source country (ISO code)",
+	},
+	[]string{"country"},
+)
+
+func init() {
+	prometheus.MustRegister(threatsByCountry)
+}
+
+// GeoInfo locates a public IP address
+type GeoInfo struct {
+	Country     string  `json:"country,omitempty"` // ISO 3166-1 alpha-2
+	CountryName string  `json:"country_name,omitempty"`
+	City        string  `json:"city,omitempty"`
+	Latitude    float64 `json:"latitude,omitempty"`
+	Longitude   float64 `json:"longitude,omitempty"`
+	ASN         uint    `json:"asn,omitempty"`
+	ASOrg       string  `json:"as_org,omitempty"`
+}
+
+// fields is the form added to log events, so Sigma rules can match on source_geo.country
+func (g *GeoInfo) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"country":      g.Country,
+		"country_name": g.CountryName,
+		"city":         g.City,
+		"asn":          g.ASN,
+		"as_org":       g.ASOrg,
+	}
+}
+
+type geoIPDatabase struct {
+	path     string
+	reader   *geoip2.Reader
+	modified time.Time
+}
+
+// GeoIP looks addresses up in GeoLite2 City and ASN databases. Either database is optional;
+// without both, lookups return nothing and enrichment is skipped.
+type GeoIP struct {
+	mu   sync.RWMutex // readers are memory-mapped, so they are closed only when no lookup is using them
+	city *geoIPDatabase
+	asn  *geoIPDatabase
+}
+
+func NewGeoIP(cityPath, asnPath string) (*GeoIP, error) {
+	g := &GeoIP{}
+	for _, db := range []struct {
+		path   string
+		target **geoIPDatabase
+	}{{cityPath, &g.city}, {asnPath, &g.asn}} {
+		if db.path == "" {
+			continue
+		}
+		database := &geoIPDatabase{path: db.path}
+		if err := database.open(); err != nil {
+			return nil, err
+		}
+		*db.target = database
+	}
+	return g, nil
+}
+
+func (d *geoIPDatabase) open() error {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return fmt.Errorf("GeoIP database: %w", err)
+	}
+	reader, err := geoip2.Open(d.path)
+	if err != nil {
+		return fmt.Errorf("failed to open GeoIP database %s: %w", d.path, err)
+	}
+	d.reader = reader
+	d.modified = info.ModTime()
+	return nil
+}
+
+// Enabled reports whether any database is loaded
+func (g *GeoIP) Enabled() bool {
+	return g.city != nil || g.asn != nil
+}
+
+// Start reopens databases that were replaced on disk, such as by geoipupdate, until ctx is cancelled
+func (g *GeoIP) Start(ctx context.Context) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	if !g.Enabled() {
+		return &wg
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(geoIPReloadInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				g.reload()
+			}
+		}
+	}()
+	return &wg
+}
+
+func (g *GeoIP) reload() {
+	for _, current := range []*geoIPDatabase{g.city, g.asn} {
+		if current == nil {
+			continue
+		}
+		info, err := os.Stat(current.path)
+		if err != nil || !info.ModTime().After(current.modified) {
+			continue
+		}
+
+		replacement := &geoIPDatabase{path: current.path}
+		if err := replacement.open(); err != nil {
+			log.Printf("Keeping previous GeoIP database: %v", err)
+			continue
+		}
+		g.mu.Lock()
+		old := current.reader
+		current.reader, current.modified = replacement.reader, replacement.modified
+		g.mu.Unlock()
+		old.Close()
+		log.Printf("Reloaded GeoIP database %s", current.path)
+	}
+}
+
+// Lookup locates a public address; private, reserved, and unknown addresses return nil
+func (g *GeoIP) Lookup(address string) *GeoInfo {
+	if !g.Enabled() {
+		return nil
+	}
+	ip := net.ParseIP(address)
+	if ip == nil || isPrivateIP(address) || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return nil
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	info := &GeoInfo{}
+	if g.city != nil {
+		if record, err := g.city.reader.City(ip); err == nil {
+			info.Country = record.Country.IsoCode
+			info.CountryName = record.Country.Names["en"]
+			info.City = record.City.Names["en"]
+			info.Latitude = record.Location.Latitude
+			info.Longitude = record.Location.Longitude
+		}
+	}
+	if g.asn != nil {
+		if record, err := g.asn.reader.ASN(ip); err == nil {
+			info.ASN = record.AutonomousSystemNumber
+			info.ASOrg = record.AutonomousSystemOrganization
+		}
+	}
+
+	if *info == (GeoInfo{}) {
+		return nil
+	}
+	return info
+}
+
+// Enrich locates the source and destination of each indicator
+func (g *GeoIP) Enrich(threats []ThreatIndicator) {
+	if !g.Enabled() {
+		return
+	}
+	cache := make(map[string]*GeoInfo)
+	lookup := func(address string) *GeoInfo {
+		if address == "" {
+			return nil
+		}
+		info, ok := cache[address]
+		if !ok {
+			info = g.Lookup(address)
+			cache[address] = info
+		}
+		return info
+	}
+
+	for i := range threats {
+		threats[i].SourceGeo = lookup(threats[i].SourceIP)
+		threats[i].DestGeo = lookup(threats[i].DestIP)
+		if threats[i].SourceGeo != nil && threats[i].SourceGeo.Country != "" {
+			threatsByCountry.WithLabelValues(threats[i].SourceGeo.Country).Inc()
+		}
+	}
+}
+
+// Endpoints locates every public address in packets
+func (g *GeoIP) Endpoints(packets []NetworkPacket) map[string]*GeoInfo {
+	if !g.Enabled() || len(packets) == 0 {
+		return nil
+	}
+	endpoints := make(map[string]*GeoInfo)
+	seen := make(map[string]bool)
+	for _, packet := range packets {
+		for _, address := range []string{packet.SourceIP, packet.DestIP} {
+			if address == "" || seen[address] {
+				continue
+			}
+			seen[address] = true
+			if info := g.Lookup(address); info != nil {
+				endpoints[address] = info
+			}
+		}
+	}
+	return endpoints
+}
+
+// EnrichEvents adds a source_geo field to log events whose source address can be located,
+// unless the event already has one
+func (g *GeoIP) EnrichEvents(events []LogEvent) {
+	if !g.Enabled() {
+		return
+	}
+	for _, event := range events {
+		if _, ok := lookupField(event.Fields, "source_geo"); ok {
+			continue
+		}
+		if info := g.Lookup(eventSourceIP(event)); info != nil {
+			event.Fields["source_geo"] = info.fields()
+		}
+	}
+}
+
+func (g *GeoIP) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, db := range []*geoIPDatabase{g.city, g.asn} {
+		if db != nil {
+			db.reader.Close()
+		}
+	}
+}
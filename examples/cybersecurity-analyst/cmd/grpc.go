@@ -0,0 +1,683 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// gRPC ingestion: sensors stream packets and log events over client-streaming RPCs and subscribe to
+// detections over a server-streaming RPC. Messages follow proto/cybersecurity/v1/ingest.proto and
+// are encoded here with protowire, so clients generate stubs from the schema and the server needs
+// no generated code.
+const (
+	grpcServiceName     = "cybersecurity.v1.Ingest"
+	grpcMaxMessage      = 4 << 20
+	grpcMaxStreams      = 100 // concurrent RPCs per connection
+	grpcSubscriberQueue = 256 // detections held for a slow subscriber before newer ones are dropped
+	grpcShutdownTimeout = 5 * time.Second
+	grpcOrigin          = "grpc"
+)
+
+var (
+	grpcStreams = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cybersecurity_grpc_streams",
+			Help: "Open gRPC ingestion and subscription streams by RPC",
+		},
+		[]string{"rpc"},
+	)
+
+	grpcItems = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_grpc_items_total",
+			Help: "Packets and log events received over gRPC streams by kind",
+		},
+		[]string{"kind"},
+	)
+
+	grpcDetectionsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_grpc_detections_dropped_total",
+			Help: "Detections not delivered to gRPC subscribers that fell behind",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(grpcStreams)
+	prometheus.MustRegister(grpcItems)
+	prometheus.MustRegister(grpcDetectionsDropped)
+}
+
+// Detection is an indicator as streamed to subscribers
+type Detection struct {
+	Origin     string
+	DetectedAt time.Time
+	Indicator  ThreatIndicator
+}
+
+// IngestSummary answers a client stream once the client closes it
+type IngestSummary struct {
+	Accepted   uint64
+	Indicators uint64
+}
+
+type subscribeRequest struct {
+	MinSeverity string
+	Origins     []string
+}
+
+// DetectionHub fans indicators out to the subscribers of their tenant. Subscribers that fall
+// behind lose detections rather than slowing detection down.
+type DetectionHub struct {
+	mu          sync.RWMutex
+	subscribers map[*detectionSubscriber]struct{}
+}
+
+type detectionSubscriber struct {
+	tenant      string
+	minSeverity ThreatLevel
+	origins     map[string]bool // every origin when empty
+	detections  chan Detection
+}
+
+func NewDetectionHub() *DetectionHub {
+	return &DetectionHub{subscribers: make(map[*detectionSubscriber]struct{})}
+}
+
+func (h *DetectionHub) Subscribe(tenant string, minSeverity ThreatLevel, origins []string) *detectionSubscriber {
+	sub := &detectionSubscriber{
+		tenant:      tenant,
+		minSeverity: minSeverity,
+		origins:     make(map[string]bool),
+		detections:  make(chan Detection, grpcSubscriberQueue),
+	}
+	for _, origin := range origins {
+		sub.origins[origin] = true
+	}
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *DetectionHub) Unsubscribe(sub *detectionSubscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, sub)
+	h.mu.Unlock()
+}
+
+// Publish offers the context's tenant's indicators to its subscribers without blocking
+func (h *DetectionHub) Publish(ctx context.Context, origin string, threats []ThreatIndicator) {
+	if len(threats) == 0 {
+		return
+	}
+	tenant := tenantFromContext(ctx)
+	now := time.Now().UTC()
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for sub := range h.subscribers {
+		if sub.tenant != tenant || (len(sub.origins) > 0 && !sub.origins[origin]) {
+			continue
+		}
+		for _, threat := range threats {
+			if severityRank[threat.Severity] < severityRank[sub.minSeverity] {
+				continue
+			}
+			select {
+			case sub.detections <- Detection{Origin: origin, DetectedAt: now, Indicator: threat}:
+			default:
+				grpcDetectionsDropped.Inc()
+			}
+		}
+	}
+}
+
+// ingestServer is implemented by GRPCIngest; it is the handler type of ingestServiceDesc
+type ingestServer interface {
+	StreamPackets(stream grpc.ServerStream) error
+	StreamEvents(stream grpc.ServerStream) error
+	SubscribeDetections(stream grpc.ServerStream) error
+}
+
+var ingestServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcServiceName,
+	HandlerType: (*ingestServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "StreamPackets",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(ingestServer).StreamPackets(stream)
+			},
+			ClientStreams: true,
+		},
+		{
+			StreamName: "StreamEvents",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(ingestServer).StreamEvents(stream)
+			},
+			ClientStreams: true,
+		},
+		{
+			StreamName: "SubscribeDetections",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(ingestServer).SubscribeDetections(stream)
+			},
+			ServerStreams: true,
+		},
+	},
+	Metadata: "cybersecurity/v1/ingest.proto",
+}
+
+// GRPCIngest serves the Ingest service. Callers authenticate with the same API keys and tokens as
+// the HTTP API, sent as x-api-key or authorization metadata, and choose a tenant with x-tenant-id.
+type GRPCIngest struct {
+	detector *ThreatDetector
+	auth     *APIAuth
+	addr     string
+	server   *grpc.Server
+	stopped  chan struct{} // closed on shutdown, which ends subscriptions
+	handlers sync.WaitGroup
+}
+
+func NewGRPCIngest(detector *ThreatDetector, auth *APIAuth, addr string) *GRPCIngest {
+	gi := &GRPCIngest{detector: detector, auth: auth, addr: addr, stopped: make(chan struct{})}
+	gi.server = grpc.NewServer(
+		grpc.ForceServerCodec(ingestCodec{}),
+		grpc.MaxRecvMsgSize(grpcMaxMessage),
+		grpc.MaxConcurrentStreams(grpcMaxStreams),
+		grpc.StreamInterceptor(gi.authenticate),
+	)
+	gi.server.RegisterService(&ingestServiceDesc, gi)
+	return gi
+}
+
+// Start serves until ctx is cancelled. Open client streams get grpcShutdownTimeout to finish, and
+// what they had sent is evaluated before it returns.
+func (gi *GRPCIngest) Start(ctx context.Context) (*sync.WaitGroup, error) {
+	listener, err := net.Listen("tcp", gi.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for gRPC ingestion on %s: %w", gi.addr, err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := gi.server.Serve(listener); err != nil {
+			log.Printf("gRPC ingestion stopped: %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		close(gi.stopped)
+		timer := time.AfterFunc(grpcShutdownTimeout, gi.server.Stop)
+		gi.server.GracefulStop()
+		timer.Stop()
+		gi.handlers.Wait()
+	}()
+
+	log.Printf("Serving gRPC ingestion on tcp %s", listener.Addr())
+	return &wg, nil
+}
+
+// tenantStream carries the authenticated tenant in the stream's context
+type tenantStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ts *tenantStream) Context() context.Context {
+	return ts.ctx
+}
+
+// authenticate identifies the caller from its metadata as Authenticate does for HTTP requests
+func (gi *GRPCIngest) authenticate(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	header := make(http.Header)
+	for _, name := range []string{"X-API-Key", "Authorization", tenantHeader} {
+		if values := md.Get(name); len(values) > 0 {
+			header.Set(name, values[0])
+		}
+	}
+
+	client, err := gi.auth.identify(header)
+	if err != nil {
+		apiRejections.WithLabelValues("unknown", "unauthenticated").Inc()
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	label := client.ID
+	if client.Method == "anonymous" {
+		label = "anonymous"
+		if p, ok := peer.FromContext(stream.Context()); ok {
+			client.ID = "grpc:" + p.Addr.String()
+		}
+	}
+	tenant, err := gi.auth.tenant(header, client)
+	if err != nil {
+		apiRejections.WithLabelValues(label, "tenant").Inc()
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	gi.handlers.Add(1)
+	defer gi.handlers.Done()
+	return handler(srv, &tenantStream{ServerStream: stream, ctx: withTenant(stream.Context(), tenant)})
+}
+
+func (gi *GRPCIngest) StreamPackets(stream grpc.ServerStream) error {
+	return gi.ingest(stream, streamMessagePackets, func(buffer *ingestBuffer) error {
+		var packet NetworkPacket
+		if err := stream.RecvMsg(&packet); err != nil {
+			return err
+		}
+		buffer.mu.Lock()
+		buffer.packets = append(buffer.packets, packet)
+		buffer.mu.Unlock()
+		return nil
+	})
+}
+
+func (gi *GRPCIngest) StreamEvents(stream grpc.ServerStream) error {
+	return gi.ingest(stream, streamMessageEvents, func(buffer *ingestBuffer) error {
+		var event LogEvent
+		if err := stream.RecvMsg(&event); err != nil {
+			return err
+		}
+		if event.Timestamp.IsZero() {
+			event.Timestamp = time.Now().UTC()
+		}
+		buffer.mu.Lock()
+		buffer.events = append(buffer.events, event)
+		buffer.mu.Unlock()
+		return nil
+	})
+}
+
+// ingestBuffer holds what one client stream sent since its last window was evaluated
+type ingestBuffer struct {
+	detector *ThreatDetector
+	kind     string
+
+	mu      sync.Mutex
+	packets []NetworkPacket
+	events  []LogEvent
+
+	evaluating sync.Mutex // windows of a stream are evaluated one at a time, and guards the counts
+	accepted   uint64
+	indicators uint64
+}
+
+func (b *ingestBuffer) full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.packets)+len(b.events) >= streamMaxBuffered
+}
+
+func (b *ingestBuffer) evaluate(ctx context.Context) {
+	b.evaluating.Lock()
+	defer b.evaluating.Unlock()
+
+	b.mu.Lock()
+	packets, events := b.packets, b.events
+	b.packets, b.events = nil, nil
+	b.mu.Unlock()
+	if len(packets)+len(events) == 0 {
+		return
+	}
+
+	threats := b.detector.analyzeStream(ctx, grpcOrigin, packets, events)
+	grpcItems.WithLabelValues(b.kind).Add(float64(len(packets) + len(events)))
+	b.accepted += uint64(len(packets) + len(events))
+	b.indicators += uint64(len(threats))
+}
+
+// ingest receives a client stream, evaluating it every streamWindow like the WebSocket stream. A
+// full buffer is evaluated before the next message is read, so fast senders are slowed by flow
+// control instead of losing items.
+func (gi *GRPCIngest) ingest(stream grpc.ServerStream, kind string, receive func(*ingestBuffer) error) error {
+	ctx := stream.Context()
+	grpcStreams.WithLabelValues(kind).Inc()
+	defer grpcStreams.WithLabelValues(kind).Dec()
+
+	buffer := &ingestBuffer{detector: gi.detector, kind: kind}
+	done := make(chan struct{})
+	var windows sync.WaitGroup
+	windows.Add(1)
+	go func() {
+		defer windows.Done()
+		ticker := time.NewTicker(streamWindow)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				buffer.evaluate(ctx)
+			}
+		}
+	}()
+
+	var err error
+	for {
+		if err = receive(buffer); err != nil {
+			break
+		}
+		if buffer.full() {
+			buffer.evaluate(ctx)
+		}
+	}
+	close(done)
+	windows.Wait()
+
+	// What was received is evaluated even when the client went away, so its indicators reach the SIEMs
+	flushCtx, cancel := context.WithTimeout(withTenant(context.Background(), tenantFromContext(ctx)), streamFlushTimeout)
+	defer cancel()
+	buffer.evaluate(flushCtx)
+
+	if !errors.Is(err, io.EOF) {
+		return err
+	}
+	return stream.SendMsg(&IngestSummary{Accepted: buffer.accepted, Indicators: buffer.indicators})
+}
+
+// SubscribeDetections streams the tenant's indicators, from every origin, until the client
+// cancels or the server shuts down
+func (gi *GRPCIngest) SubscribeDetections(stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	var req subscribeRequest
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	minSeverity := Low
+	if req.MinSeverity != "" {
+		level, err := parseSeverity(req.MinSeverity)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		minSeverity = level
+	}
+
+	grpcStreams.WithLabelValues("subscribe").Inc()
+	defer grpcStreams.WithLabelValues("subscribe").Dec()
+	sub := gi.detector.detections.Subscribe(tenantFromContext(ctx), minSeverity, req.Origins)
+	defer gi.detector.detections.Unsubscribe(sub)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-gi.stopped:
+			return status.Error(codes.Unavailable, "server shutting down")
+		case detection := <-sub.detections:
+			if err := stream.SendMsg(&detection); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ingestCodec encodes the Ingest service's messages in the protobuf wire format
+type ingestCodec struct{}
+
+func (ingestCodec) Name() string {
+	return "proto"
+}
+
+func (ingestCodec) Marshal(v interface{}) ([]byte, error) {
+	switch message := v.(type) {
+	case *IngestSummary:
+		return message.marshal(), nil
+	case *Detection:
+		return message.marshal(), nil
+	}
+	return nil, fmt.Errorf("cannot encode %T", v)
+}
+
+func (ingestCodec) Unmarshal(data []byte, v interface{}) error {
+	switch message := v.(type) {
+	case *NetworkPacket:
+		return message.unmarshal(data)
+	case *LogEvent:
+		return message.unmarshal(data)
+	case *subscribeRequest:
+		return message.unmarshal(data)
+	}
+	return fmt.Errorf("cannot decode %T", v)
+}
+
+// decodeFields calls field with each field of a message: the bytes of length-delimited fields or
+// the value of scalar ones
+func decodeFields(data []byte, field func(num protowire.Number, value []byte, scalar uint64) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		var value []byte
+		var scalar uint64
+		switch typ {
+		case protowire.VarintType:
+			scalar, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed64Type:
+			scalar, n = protowire.ConsumeFixed64(data)
+		case protowire.Fixed32Type:
+			var fixed uint32
+			fixed, n = protowire.ConsumeFixed32(data)
+			scalar = uint64(fixed)
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if err := field(num, value, scalar); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeTimestamp reads a google.protobuf.Timestamp
+func decodeTimestamp(data []byte) (time.Time, error) {
+	var seconds, nanos int64
+	err := decodeFields(data, func(num protowire.Number, _ []byte, scalar uint64) error {
+		switch num {
+		case 1:
+			seconds = int64(scalar)
+		case 2:
+			nanos = int64(int32(scalar))
+		}
+		return nil
+	})
+	return time.Unix(seconds, nanos).UTC(), err
+}
+
+// decodeMapEntry reads a map field entry, whose key is field 1 and value field 2
+func decodeMapEntry(data []byte) (key string, value []byte, scalar uint64, err error) {
+	err = decodeFields(data, func(num protowire.Number, bytes []byte, number uint64) error {
+		switch num {
+		case 1:
+			key = string(bytes)
+		case 2:
+			value, scalar = bytes, number
+		}
+		return nil
+	})
+	return key, value, scalar, err
+}
+
+func (p *NetworkPacket) unmarshal(data []byte) error {
+	*p = NetworkPacket{}
+	return decodeFields(data, func(num protowire.Number, value []byte, scalar uint64) error {
+		var err error
+		switch num {
+		case 1:
+			p.Timestamp, err = decodeTimestamp(value)
+		case 2:
+			p.SourceIP = string(value)
+		case 3:
+			p.DestIP = string(value)
+		case 4:
+			p.SourcePort = int(scalar)
+		case 5:
+			p.DestPort = int(scalar)
+		case 6:
+			p.Protocol = string(value)
+		case 7:
+			p.PayloadSize = int(scalar)
+		case 8:
+			flag, _, set, entryErr := decodeMapEntry(value)
+			if p.Flags == nil {
+				p.Flags = make(map[string]bool)
+			}
+			p.Flags[flag] = set != 0
+			err = entryErr
+		case 9:
+			p.Payload = append([]byte(nil), value...)
+		}
+		return err
+	})
+}
+
+func (e *LogEvent) unmarshal(data []byte) error {
+	*e = LogEvent{Fields: make(map[string]interface{})}
+	return decodeFields(data, func(num protowire.Number, value []byte, _ uint64) error {
+		var err error
+		switch num {
+		case 1:
+			e.Timestamp, err = decodeTimestamp(value)
+		case 2:
+			err = decodeFields(value, func(num protowire.Number, value []byte, _ uint64) error {
+				switch num {
+				case 1:
+					e.LogSource.Category = string(value)
+				case 2:
+					e.LogSource.Product = string(value)
+				case 3:
+					e.LogSource.Service = string(value)
+				}
+				return nil
+			})
+		case 3:
+			var key string
+			key, value, _, err = decodeMapEntry(value)
+			e.Fields[key] = string(value)
+		}
+		return err
+	})
+}
+
+func (r *subscribeRequest) unmarshal(data []byte) error {
+	*r = subscribeRequest{}
+	return decodeFields(data, func(num protowire.Number, value []byte, _ uint64) error {
+		switch num {
+		case 1:
+			r.MinSeverity = string(value)
+		case 2:
+			r.Origins = append(r.Origins, string(value))
+		}
+		return nil
+	})
+}
+
+func appendString(b []byte, num protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func appendVarint(b []byte, num protowire.Number, value uint64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, value)
+}
+
+func appendDouble(b []byte, num protowire.Number, value float64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(value))
+}
+
+func appendMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+func encodeTimestamp(t time.Time) []byte {
+	b := appendVarint(nil, 1, uint64(t.Unix()))
+	return appendVarint(b, 2, uint64(t.Nanosecond()))
+}
+
+func encodeGeo(geo *GeoInfo) []byte {
+	b := appendString(nil, 1, geo.Country)
+	b = appendString(b, 2, geo.CountryName)
+	b = appendString(b, 3, geo.City)
+	b = appendDouble(b, 4, geo.Latitude)
+	b = appendDouble(b, 5, geo.Longitude)
+	b = appendVarint(b, 6, uint64(geo.ASN))
+	return appendString(b, 7, geo.ASOrg)
+}
+
+func encodeIndicator(threat *ThreatIndicator) []byte {
+	b := appendString(nil, 1, string(threat.Type))
+	b = appendString(b, 2, string(threat.Severity))
+	b = appendDouble(b, 3, threat.Confidence)
+	b = appendString(b, 4, threat.Description)
+	b = appendString(b, 5, threat.SourceIP)
+	b = appendString(b, 6, threat.DestIP)
+	b = appendString(b, 7, threat.MITREAttack)
+	for _, evidence := range threat.Evidence {
+		b = appendMessage(b, 8, []byte(evidence))
+	}
+	if threat.SourceGeo != nil {
+		b = appendMessage(b, 9, encodeGeo(threat.SourceGeo))
+	}
+	if threat.DestGeo != nil {
+		b = appendMessage(b, 10, encodeGeo(threat.DestGeo))
+	}
+	for _, observable := range threat.Observables {
+		b = appendMessage(b, 11, []byte(observable))
+	}
+	b = appendString(b, 12, threat.Asset)
+	return appendString(b, 13, threat.Tenant)
+}
+
+func (d *Detection) marshal() []byte {
+	b := appendString(nil, 1, d.Origin)
+	b = appendMessage(b, 2, encodeTimestamp(d.DetectedAt))
+	return appendMessage(b, 3, encodeIndicator(&d.Indicator))
+}
+
+func (s *IngestSummary) marshal() []byte {
+	b := appendVarint(nil, 1, s.Accepted)
+	return appendVarint(b, 2, s.Indicators)
+}
@@ -0,0 +1,853 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Honeypot integration (Cowrie, Dionaea): decoys have no legitimate users, so every interaction
+// is a high-confidence indicator
+const (
+	honeypotAttackersKey  = "honeypot:attackers" // hash of source address -> HoneypotAttacker JSON
+	honeypotConfidence    = 0.95
+	maxHoneypotEvents     = 10000 // events per request
+	maxHoneypotLineBytes  = 1 << 20
+	honeypotFlushInterval = 5 * time.Second // listener batches are analyzed at least this often
+	maxAttackerCommands   = 50              // newest commands kept per attacker
+	maxAttackerValues     = 20              // usernames, downloads, and ports kept per attacker
+)
+
+const (
+	HoneypotConnect  = "connect"
+	HoneypotLogin    = "login"
+	HoneypotCommand  = "command"
+	HoneypotDownload = "download"
+	HoneypotUpload   = "upload"
+	HoneypotTunnel   = "tunnel"
+)
+
+var errInvalidHoneypotEvent = errors.New("invalid honeypot event")
+
+var honeypotEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cybersecurity_honeypot_events_total",
+		Help: "Honeypot interactions ingested by honeypot and action",
+	},
+	[]string{"honeypot", "action"},
+)
+
+func init() {
+	prometheus.MustRegister(honeypotEvents)
+}
+
+// HoneypotEvent is one interaction with a decoy, normalized from the honeypot's own log format
+type HoneypotEvent struct {
+	Honeypot   string    `json:"honeypot"` // "cowrie" or "dionaea"
+	Sensor     string    `json:"sensor,omitempty"`
+	Session    string    `json:"session,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+	Action     string    `json:"action" binding:"required,oneof=connect login command download upload tunnel"`
+	SourceIP   string    `json:"source_ip" binding:"required,ip"`
+	SourcePort int       `json:"source_port,omitempty"`
+	DestIP     string    `json:"dest_ip,omitempty"`
+	DestPort   int       `json:"dest_port,omitempty"`
+	Protocol   string    `json:"protocol,omitempty"` // e.g. "ssh", "telnet", "smbd", "ftpd"
+	Username   string    `json:"username,omitempty"`
+	Password   string    `json:"password,omitempty"`
+	Success    bool      `json:"success,omitempty"` // logins only; Dionaea does not report the outcome
+	Command    string    `json:"command,omitempty"`
+	URL        string    `json:"url,omitempty"`    // downloads
+	Hash       string    `json:"hash,omitempty"`   // SHA-256 from Cowrie, MD5 from Dionaea
+	Target     string    `json:"target,omitempty"` // "host:port" a tunnel was requested to
+}
+
+// cowrieEvent is a record of Cowrie's JSON log (output_jsonlog and output_socketlog)
+type cowrieEvent struct {
+	EventID   string    `json:"eventid"`
+	Timestamp time.Time `json:"timestamp"`
+	SrcIP     string    `json:"src_ip"`
+	SrcPort   int       `json:"src_port"`
+	DstIP     string    `json:"dst_ip"`
+	DstPort   int       `json:"dst_port"`
+	Session   string    `json:"session"`
+	Sensor    string    `json:"sensor"`
+	Protocol  string    `json:"protocol"`
+	Username  string    `json:"username"`
+	Password  string    `json:"password"`
+	Input     string    `json:"input"`
+	URL       string    `json:"url"`
+	Shasum    string    `json:"shasum"`
+}
+
+// dionaeaEvent is a record of Dionaea's log_json ihandler; one connection carries its
+// credentials, FTP commands, and downloads
+type dionaeaEvent struct {
+	Timestamp  string `json:"timestamp"`
+	SrcIP      string `json:"src_ip"`
+	SrcPort    int    `json:"src_port"`
+	DstIP      string `json:"dst_ip"`
+	DstPort    int    `json:"dst_port"`
+	Connection struct {
+		Protocol  string `json:"protocol"`
+		Transport string `json:"transport"`
+	} `json:"connection"`
+	Credentials []struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"credentials"`
+	FTP struct {
+		Commands []struct {
+			Command   string   `json:"command"`
+			Arguments []string `json:"arguments"`
+		} `json:"commands"`
+	} `json:"ftp"`
+	Downloads []struct {
+		URL     string `json:"url"`
+		MD5Hash string `json:"md5_hash"`
+	} `json:"downloads"`
+}
+
+var cowrieActions = map[string]string{
+	"cowrie.session.connect":       HoneypotConnect,
+	"cowrie.login.failed":          HoneypotLogin,
+	"cowrie.login.success":         HoneypotLogin,
+	"cowrie.command.input":         HoneypotCommand,
+	"cowrie.command.failed":        HoneypotCommand,
+	"cowrie.session.file_download": HoneypotDownload,
+	"cowrie.session.file_upload":   HoneypotUpload,
+	"cowrie.direct-tcpip.request":  HoneypotTunnel,
+}
+
+func (e *cowrieEvent) normalize() (HoneypotEvent, bool) {
+	action, ok := cowrieActions[e.EventID]
+	if !ok {
+		return HoneypotEvent{}, false
+	}
+	event := HoneypotEvent{
+		Honeypot:   "cowrie",
+		Sensor:     e.Sensor,
+		Session:    e.Session,
+		Timestamp:  e.Timestamp,
+		Action:     action,
+		SourceIP:   e.SrcIP,
+		SourcePort: e.SrcPort,
+		DestIP:     e.DstIP,
+		DestPort:   e.DstPort,
+		Protocol:   e.Protocol,
+		Username:   e.Username,
+		Password:   e.Password,
+		Success:    e.EventID == "cowrie.login.success",
+		Command:    e.Input,
+		URL:        e.URL,
+		Hash:       strings.ToLower(e.Shasum),
+	}
+	if action == HoneypotTunnel {
+		// dst_ip and dst_port are where the attacker asked the decoy to connect
+		event.Target = net.JoinHostPort(e.DstIP, strconv.Itoa(e.DstPort))
+		event.DestIP, event.DestPort = "", 0
+	}
+	if event.Protocol == "" {
+		event.Protocol = "ssh"
+	}
+	return event, true
+}
+
+func (e *dionaeaEvent) normalize() []HoneypotEvent {
+	at, err := time.Parse(time.RFC3339Nano, e.Timestamp)
+	if err != nil {
+		// Dionaea writes local time without a zone
+		at, _ = time.ParseInLocation("2006-01-02T15:04:05.999999", e.Timestamp, time.Local)
+	}
+	base := HoneypotEvent{
+		Honeypot:   "dionaea",
+		Timestamp:  at.UTC(),
+		SourceIP:   e.SrcIP,
+		SourcePort: e.SrcPort,
+		DestIP:     e.DstIP,
+		DestPort:   e.DstPort,
+		Protocol:   e.Connection.Protocol,
+	}
+
+	connect := base
+	connect.Action = HoneypotConnect
+	events := []HoneypotEvent{connect}
+	for _, credential := range e.Credentials {
+		login := base
+		login.Action = HoneypotLogin
+		login.Username, login.Password = credential.Username, credential.Password
+		events = append(events, login)
+	}
+	for _, command := range e.FTP.Commands {
+		input := base
+		input.Action = HoneypotCommand
+		input.Command = strings.TrimSpace(command.Command + " " + strings.Join(command.Arguments, " "))
+		events = append(events, input)
+	}
+	for _, download := range e.Downloads {
+		file := base
+		file.Action = HoneypotDownload
+		file.URL, file.Hash = download.URL, strings.ToLower(download.MD5Hash)
+		events = append(events, file)
+	}
+	return events
+}
+
+// parseHoneypotLog reads a JSON array or JSON lines of native honeypot records. The honeypot is
+// detected per record when it is empty: Cowrie records have an eventid. Records of other Cowrie
+// event types are skipped.
+// jsonRecords splits a JSON array or JSON lines into records
+func jsonRecords(data []byte) ([]json.RawMessage, error) {
+	records := make([]json.RawMessage, 0)
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &records); err != nil {
+			return nil, err
+		}
+		return records, nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxHoneypotLineBytes)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			records = append(records, json.RawMessage(append([]byte(nil), line...)))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func parseHoneypotLog(honeypot string, data []byte) ([]HoneypotEvent, error) {
+	records, err := jsonRecords(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidHoneypotEvent, err)
+	}
+
+	events := make([]HoneypotEvent, 0, len(records))
+	for i, record := range records {
+		kind := honeypot
+		if kind == "" {
+			var probe struct {
+				EventID string `json:"eventid"`
+			}
+			json.Unmarshal(record, &probe)
+			kind = "dionaea"
+			if probe.EventID != "" {
+				kind = "cowrie"
+			}
+		}
+
+		switch kind {
+		case "cowrie":
+			var raw cowrieEvent
+			if err := json.Unmarshal(record, &raw); err != nil {
+				return nil, fmt.Errorf("%w: record %d: %v", errInvalidHoneypotEvent, i+1, err)
+			}
+			if event, ok := raw.normalize(); ok {
+				events = append(events, event)
+			}
+		case "dionaea":
+			var raw dionaeaEvent
+			if err := json.Unmarshal(record, &raw); err != nil {
+				return nil, fmt.Errorf("%w: record %d: %v", errInvalidHoneypotEvent, i+1, err)
+			}
+			events = append(events, raw.normalize()...)
+		default:
+			return nil, fmt.Errorf("%w: unknown honeypot %q", errInvalidHoneypotEvent, kind)
+		}
+	}
+
+	valid := events[:0]
+	for _, event := range events {
+		if ip := net.ParseIP(event.SourceIP); ip != nil {
+			event.SourceIP = ip.String()
+			if event.Timestamp.IsZero() {
+				event.Timestamp = time.Now().UTC()
+			}
+			valid = append(valid, event)
+		}
+	}
+	return valid, nil
+}
+
+// HoneypotAttacker is what the honeypots have seen a source address do
+type HoneypotAttacker struct {
+	IP             string    `json:"ip"`
+	FirstSeen      time.Time `json:"first_seen"`
+	LastSeen       time.Time `json:"last_seen"`
+	Honeypots      []string  `json:"honeypots"`
+	Sensors        []string  `json:"sensors,omitempty"`
+	Protocols      []string  `json:"protocols,omitempty"`
+	Ports          []int     `json:"ports,omitempty"`
+	Sessions       int       `json:"sessions"`
+	LoginAttempts  int       `json:"login_attempts"`
+	LoginSuccesses int       `json:"login_successes"`
+	Usernames      []string  `json:"usernames,omitempty"`
+	Commands       []string  `json:"commands,omitempty"`  // newest last
+	Downloads      []string  `json:"downloads,omitempty"` // URLs, or hashes of uploads
+	Tunnels        []string  `json:"tunnels,omitempty"`
+	Techniques     []string  `json:"techniques"`
+	Blocklisted    bool      `json:"blocklisted"`
+}
+
+// Summary describes the attacker's tactics, techniques, and procedures in one line
+func (a *HoneypotAttacker) Summary() string {
+	parts := []string{fmt.Sprintf("%s hit %s honeypot(s) over %s", a.IP, strings.Join(a.Honeypots, "/"), strings.Join(a.Protocols, ", "))}
+	if a.LoginAttempts > 0 {
+		login := fmt.Sprintf("%d login attempt(s), %d successful", a.LoginAttempts, a.LoginSuccesses)
+		if len(a.Usernames) > 0 {
+			login += " (usernames " + strings.Join(a.Usernames[:min(len(a.Usernames), 5)], ", ") + ")"
+		}
+		parts = append(parts, login)
+	}
+	if len(a.Commands) > 0 {
+		parts = append(parts, fmt.Sprintf("ran commands such as %q", strings.Join(a.Commands[max(len(a.Commands)-3, 0):], "; ")))
+	}
+	if len(a.Downloads) > 0 {
+		parts = append(parts, fmt.Sprintf("transferred %d file(s)", len(a.Downloads)))
+	}
+	if len(a.Tunnels) > 0 {
+		parts = append(parts, "tunneled to "+strings.Join(a.Tunnels[:min(len(a.Tunnels), 3)], ", "))
+	}
+	parts = append(parts, "techniques "+strings.Join(a.Techniques, ", "))
+	return strings.Join(parts, "; ")
+}
+
+// appendUnique adds values not yet present, keeping at most limit values
+func appendUnique(values []string, limit int, added ...string) []string {
+	for _, value := range added {
+		if value == "" || len(values) >= limit {
+			continue
+		}
+		found := false
+		for _, existing := range values {
+			if existing == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// HoneypotMonitor turns honeypot interactions into indicators, keeps a profile of each attacker,
+// and puts attackers on the blocklist
+type HoneypotMonitor struct {
+	redis     *redis.Client
+	detector  *ThreatDetector
+	autoBlock bool
+	retention time.Duration
+}
+
+func NewHoneypotMonitor(redisClient *redis.Client, detector *ThreatDetector, autoBlock bool, retention time.Duration) *HoneypotMonitor {
+	return &HoneypotMonitor{redis: redisClient, detector: detector, autoBlock: autoBlock, retention: retention}
+}
+
+// Evaluate raises indicators for each attacking address by what it did on the decoys, updates
+// the attackers' profiles, and blocklists them unless they are allowlisted
+func (hm *HoneypotMonitor) Evaluate(ctx context.Context, events []HoneypotEvent) ([]ThreatIndicator, error) {
+	bySource := make(map[string][]HoneypotEvent)
+	sources := make([]string, 0)
+	for _, event := range events {
+		honeypotEvents.WithLabelValues(event.Honeypot, event.Action).Inc()
+		if _, ok := bySource[event.SourceIP]; !ok {
+			sources = append(sources, event.SourceIP)
+		}
+		bySource[event.SourceIP] = append(bySource[event.SourceIP], event)
+	}
+
+	profiles, err := hm.Attackers(ctx, sources)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]*HoneypotAttacker, len(profiles))
+	for i := range profiles {
+		known[profiles[i].IP] = &profiles[i]
+	}
+	allowlist := hm.detector.lists.lists(ctx).allowlist.Load()
+
+	threats := make([]ThreatIndicator, 0)
+	pipe := hm.redis.TxPipeline()
+	for _, source := range sources {
+		attacker := known[source]
+		if attacker == nil {
+			attacker = &HoneypotAttacker{IP: source, Techniques: make([]string, 0)}
+		}
+		indicators := hm.observe(attacker, bySource[source])
+		threats = append(threats, indicators...)
+
+		if hm.autoBlock && !attacker.Blocklisted && allowlist.matchIP(source) == nil {
+			if _, err := hm.detector.lists.Add(ctx, Blocklist, source, "honeypot: "+truncate(attacker.Summary(), 200)); err != nil {
+				log.Printf("Failed to blocklist honeypot attacker %s: %v", source, err)
+			} else {
+				attacker.Blocklisted = true
+			}
+		}
+
+		data, err := json.Marshal(attacker)
+		if err != nil {
+			return nil, err
+		}
+		pipe.HSet(ctx, tenantKey(ctx, honeypotAttackersKey), source, data)
+	}
+	pipe.Expire(ctx, tenantKey(ctx, honeypotAttackersKey), hm.retention)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to store honeypot attackers: %w", err)
+	}
+	return threats, nil
+}
+
+// observe merges one source's events into its profile and returns an indicator for each stage of
+// attack they show; bare connections are reported only when nothing more happened
+func (hm *HoneypotMonitor) observe(attacker *HoneypotAttacker, events []HoneypotEvent) []ThreatIndicator {
+	sessions := make(map[string]bool)
+	var logins, successes, commands, transfers, tunnels []HoneypotEvent
+	var destIP string
+	for _, event := range events {
+		if attacker.FirstSeen.IsZero() || event.Timestamp.Before(attacker.FirstSeen) {
+			attacker.FirstSeen = event.Timestamp
+		}
+		if event.Timestamp.After(attacker.LastSeen) {
+			attacker.LastSeen = event.Timestamp
+		}
+		attacker.Honeypots = appendUnique(attacker.Honeypots, maxAttackerValues, event.Honeypot)
+		attacker.Sensors = appendUnique(attacker.Sensors, maxAttackerValues, event.Sensor)
+		attacker.Protocols = appendUnique(attacker.Protocols, maxAttackerValues, event.Protocol)
+		if event.DestPort > 0 && len(attacker.Ports) < maxAttackerValues && !containsPort(attacker.Ports, event.DestPort) {
+			attacker.Ports = append(attacker.Ports, event.DestPort)
+		}
+		if event.DestIP != "" {
+			destIP = event.DestIP
+		}
+		session := event.Session
+		if session == "" {
+			session = fmt.Sprintf("%s:%d", event.Honeypot, event.SourcePort)
+		}
+		sessions[session] = true
+
+		switch event.Action {
+		case HoneypotLogin:
+			logins = append(logins, event)
+			attacker.LoginAttempts++
+			attacker.Usernames = appendUnique(attacker.Usernames, maxAttackerValues, event.Username)
+			if event.Success {
+				successes = append(successes, event)
+				attacker.LoginSuccesses++
+			}
+		case HoneypotCommand:
+			commands = append(commands, event)
+			attacker.Commands = append(attacker.Commands, event.Command)
+			if len(attacker.Commands) > maxAttackerCommands {
+				attacker.Commands = attacker.Commands[len(attacker.Commands)-maxAttackerCommands:]
+			}
+		case HoneypotDownload, HoneypotUpload:
+			transfers = append(transfers, event)
+			attacker.Downloads = appendUnique(attacker.Downloads, maxAttackerValues, valueOr(event.URL, event.Hash))
+		case HoneypotTunnel:
+			tunnels = append(tunnels, event)
+			attacker.Tunnels = appendUnique(attacker.Tunnels, maxAttackerValues, event.Target)
+		}
+	}
+	attacker.Sessions += len(sessions)
+
+	decoy := fmt.Sprintf("Decoy interaction on %s (%s), %d session(s)", strings.Join(attacker.Honeypots, "/"),
+		strings.Join(attacker.Protocols, ", "), len(sessions))
+	indicator := func(threatType ThreatType, severity ThreatLevel, technique, description string, evidence ...string) ThreatIndicator {
+		attacker.Techniques = appendUnique(attacker.Techniques, maxAttackerValues, technique)
+		return ThreatIndicator{
+			Type:        threatType,
+			Severity:    severity,
+			Confidence:  honeypotConfidence,
+			Description: description,
+			SourceIP:    attacker.IP,
+			DestIP:      destIP,
+			MITREAttack: technique,
+			Evidence:    append([]string{decoy}, evidence...),
+		}
+	}
+
+	threats := make([]ThreatIndicator, 0)
+	if len(logins) > 0 {
+		usernames := appendUnique(nil, 10, honeypotValues(logins, func(e HoneypotEvent) string { return e.Username })...)
+		threats = append(threats, indicator(Brute, Medium, "T1110", "Password guessing against a honeypot",
+			fmt.Sprintf("%d login attempt(s) with usernames %s", len(logins), strings.Join(usernames, ", "))))
+	}
+	if len(successes) > 0 {
+		first := successes[0]
+		threats = append(threats, indicator(Intrusion, High, "T1078", "Logged in to a honeypot with guessed credentials",
+			fmt.Sprintf("Accepted %s/%s at %s", first.Username, first.Password, first.Timestamp.UTC().Format(time.RFC3339))))
+	}
+	if len(commands) > 0 {
+		technique := "T1059"
+		if commands[0].Honeypot == "cowrie" {
+			technique = "T1059.004" // Unix shell
+		}
+		shown := honeypotValues(commands, func(e HoneypotEvent) string { return e.Command })
+		threats = append(threats, indicator(Intrusion, High, technique, "Commands run on a honeypot",
+			fmt.Sprintf("%d command(s): %s", len(commands), truncate(strings.Join(shown[:min(len(shown), 10)], "; "), 500))))
+	}
+	if len(transfers) > 0 {
+		threat := indicator(Malware, High, "T1105", "Tool transfer to a honeypot")
+		for _, transfer := range transfers[:min(len(transfers), 10)] {
+			threat.Evidence = append(threat.Evidence, fmt.Sprintf("%s %s %s", transfer.Action, valueOr(transfer.URL, "(upload)"), transfer.Hash))
+			if transfer.Hash != "" {
+				threat.Observables = appendUnique(threat.Observables, maxAttackerValues, transfer.Hash)
+			}
+			if parsed, err := url.Parse(transfer.URL); err == nil && parsed.Hostname() != "" && net.ParseIP(parsed.Hostname()) == nil {
+				threat.Observables = appendUnique(threat.Observables, maxAttackerValues, strings.ToLower(parsed.Hostname()))
+			}
+		}
+		threats = append(threats, threat)
+	}
+	if len(tunnels) > 0 {
+		targets := appendUnique(nil, 10, honeypotValues(tunnels, func(e HoneypotEvent) string { return e.Target })...)
+		threats = append(threats, indicator(Intrusion, Medium, "T1090", "Honeypot used as a proxy",
+			"Tunnel requested to "+strings.Join(targets, ", ")))
+	}
+	if len(threats) == 0 {
+		threats = append(threats, indicator(Intrusion, Low, "T1595", "Connection to a honeypot",
+			fmt.Sprintf("Ports %s", joinPorts(attacker.Ports))))
+	}
+	return threats
+}
+
+func honeypotValues(events []HoneypotEvent, value func(HoneypotEvent) string) []string {
+	values := make([]string, 0, len(events))
+	for _, event := range events {
+		values = append(values, value(event))
+	}
+	return values
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func joinPorts(ports []int) string {
+	values := make([]string, len(ports))
+	for i, port := range ports {
+		values[i] = strconv.Itoa(port)
+	}
+	return strings.Join(values, ", ")
+}
+
+// Attackers returns the profiles of those addresses the honeypots have seen
+func (hm *HoneypotMonitor) Attackers(ctx context.Context, addresses []string) ([]HoneypotAttacker, error) {
+	attackers := make([]HoneypotAttacker, 0)
+	if len(addresses) == 0 {
+		return attackers, nil
+	}
+	values, err := hm.redis.HMGet(ctx, tenantKey(ctx, honeypotAttackersKey), addresses...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load honeypot attackers: %w", err)
+	}
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var attacker HoneypotAttacker
+		if json.Unmarshal([]byte(data), &attacker) == nil {
+			attackers = append(attackers, attacker)
+		}
+	}
+	return attackers, nil
+}
+
+// AllAttackers lists every attacker profile, most recently seen first
+func (hm *HoneypotMonitor) AllAttackers(ctx context.Context) ([]HoneypotAttacker, error) {
+	stored, err := hm.redis.HGetAll(ctx, tenantKey(ctx, honeypotAttackersKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load honeypot attackers: %w", err)
+	}
+	attackers := make([]HoneypotAttacker, 0, len(stored))
+	for _, data := range stored {
+		var attacker HoneypotAttacker
+		if json.Unmarshal([]byte(data), &attacker) == nil {
+			attackers = append(attackers, attacker)
+		}
+	}
+	sort.Slice(attackers, func(i, j int) bool { return attackers[i].LastSeen.After(attackers[j].LastSeen) })
+	return attackers, nil
+}
+
+// ttpContext returns the TTP summaries of the indicators' sources that hit the honeypots, for the
+// Claude analysis prompt
+func (hm *HoneypotMonitor) ttpContext(ctx context.Context, threats []ThreatIndicator) []string {
+	seen := make(map[string]bool)
+	sources := make([]string, 0)
+	for _, threat := range threats {
+		if threat.SourceIP != "" && !seen[threat.SourceIP] {
+			seen[threat.SourceIP] = true
+			sources = append(sources, threat.SourceIP)
+		}
+	}
+	attackers, err := hm.Attackers(ctx, sources)
+	if err != nil {
+		log.Printf("Honeypot context unavailable for analysis: %v", err)
+		return nil
+	}
+	summaries := make([]string, 0, len(attackers))
+	for i := range attackers {
+		summaries = append(summaries, attackers[i].Summary())
+	}
+	return summaries
+}
+
+// HoneypotListener receives Cowrie socketlog and other JSON-lines feeds over TCP from the
+// configured sensor addresses and analyzes them in batches for the default tenant
+type HoneypotListener struct {
+	detector *ThreatDetector
+	addr     string
+	sensors  []*net.IPNet
+
+	mu      sync.Mutex
+	pending []HoneypotEvent
+}
+
+func NewHoneypotListener(detector *ThreatDetector, addr, sensors string) (*HoneypotListener, error) {
+	allowed := make([]*net.IPNet, 0)
+	for _, sensor := range strings.Split(sensors, ",") {
+		sensor = strings.TrimSpace(sensor)
+		if sensor == "" {
+			continue
+		}
+		if ip := net.ParseIP(sensor); ip != nil {
+			sensor = ip.String() + "/32"
+			if ip.To4() == nil {
+				sensor = ip.String() + "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(sensor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HONEYPOT_SENSORS entry %q: %w", sensor, err)
+		}
+		allowed = append(allowed, network)
+	}
+	if len(allowed) == 0 {
+		return nil, errors.New("HONEYPOT_SENSORS must list the sensor addresses allowed to connect")
+	}
+	return &HoneypotListener{detector: detector, addr: addr, sensors: allowed}, nil
+}
+
+func (hl *HoneypotListener) allowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range hl.sensors {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start accepts sensor connections until ctx is cancelled; events still pending are analyzed
+// before it returns
+func (hl *HoneypotListener) Start(ctx context.Context) (*sync.WaitGroup, error) {
+	listener, err := net.Listen("tcp", hl.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for honeypot events on %s: %w", hl.addr, err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Printf("Honeypot listener accept failed: %v", err)
+				continue
+			}
+			if !hl.allowed(conn.RemoteAddr()) {
+				log.Printf("Rejected honeypot connection from %s", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				hl.receive(ctx, conn)
+			}()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(honeypotFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				hl.flush(context.Background())
+				return
+			case <-ticker.C:
+				hl.flush(ctx)
+			}
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	log.Printf("Receiving honeypot events on tcp %s", listener.Addr())
+	return &wg, nil
+}
+
+func (hl *HoneypotListener) receive(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 && len(line) <= maxHoneypotLineBytes {
+			events, parseErr := parseHoneypotLog("", line)
+			if parseErr != nil {
+				log.Printf("Skipping honeypot record from %s: %v", conn.RemoteAddr(), parseErr)
+			} else {
+				hl.mu.Lock()
+				hl.pending = append(hl.pending, events...)
+				full := len(hl.pending) >= maxHoneypotEvents
+				hl.mu.Unlock()
+				if full {
+					hl.flush(ctx)
+				}
+			}
+		}
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Honeypot connection from %s failed: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+func (hl *HoneypotListener) flush(ctx context.Context) {
+	hl.mu.Lock()
+	events := hl.pending
+	hl.pending = nil
+	hl.mu.Unlock()
+	if len(events) == 0 {
+		return
+	}
+
+	req := ThreatDetectionRequest{
+		ScanID:         fmt.Sprintf("honeypot_%d", time.Now().UnixNano()),
+		ScanType:       "honeypot",
+		HoneypotEvents: events,
+	}
+	if _, err := hl.detector.AnalyzeTraffic(ctx, &req); err != nil {
+		log.Printf("Failed to analyze %d honeypot events: %v", len(events), err)
+	}
+}
+
+// HTTP Handlers
+func (s *APIServer) ingestHoneypotHandler(c *gin.Context) {
+	honeypot := c.Param("honeypot")
+	if honeypot != "cowrie" && honeypot != "dionaea" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "honeypot must be cowrie or dionaea"})
+		return
+	}
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	events, err := parseHoneypotLog(honeypot, data)
+	switch {
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case len(events) > maxHoneypotEvents:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d events per request", maxHoneypotEvents)})
+		return
+	}
+
+	req := ThreatDetectionRequest{
+		ScanID:         c.Query("scan_id"),
+		ScanType:       "honeypot",
+		HoneypotEvents: events,
+		DeepAnalysis:   c.Query("deep_analysis") == "true",
+	}
+	if req.ScanID == "" {
+		req.ScanID = fmt.Sprintf("honeypot_%d", time.Now().UnixNano())
+	}
+
+	response, err := s.threatDetector.AnalyzeTraffic(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *APIServer) listHoneypotAttackersHandler(c *gin.Context) {
+	attackers, err := s.threatDetector.honeypots.AllAttackers(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"attackers": attackers, "count": len(attackers)})
+}
+
+func (s *APIServer) getHoneypotAttackerHandler(c *gin.Context) {
+	ip := net.ParseIP(c.Param("ip"))
+	if ip == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid IP address"})
+		return
+	}
+
+	attackers, err := s.threatDetector.honeypots.Attackers(c.Request.Context(), []string{ip.String()})
+	switch {
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case len(attackers) == 0:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attacker not found"})
+	default:
+		c.JSON(http.StatusOK, gin.H{"attacker": attackers[0], "summary": attackers[0].Summary()})
+	}
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Snort/Suricata rule import
+const (
+	threatSignaturesKey   = "threat_signatures" // hash of signature ID -> ThreatSignature JSON
+	maxRuleImportBytes    = 64 << 20
+	maxRuleLineBytes      = 1 << 20
+	maxReportedRuleErrors = 100
+)
+
+// Options that only describe a rule, or only tune how an engine evaluates it
+var idsMetadataOptions = map[string]bool{
+	"msg": true, "sid": true, "rev": true, "gid": true, "classtype": true, "reference": true,
+	"metadata": true, "priority": true, "target": true, "fast_pattern": true, "rawbytes": true,
+}
+
+// Options that narrow where or how often a rule matches; they are dropped, so the imported
+// signature matches a superset of what the original rule would
+var idsApproximatedOptions = map[string]bool{
+	"uricontent": true, "file_data": true, "pkt_data": true, "threshold": true, "detection_filter": true,
+	"tag": true, "isdataat": true, "bsize": true, "urilen": true,
+}
+
+// Sticky buffers and content modifiers that select part of an application-layer transaction
+var idsApproximatedPrefixes = []string{
+	"http_", "http.", "tls.", "tls_", "dns.", "dns_", "file.", "ssh.", "ssh_", "smtp.", "smb.", "ja3", "ja4", "krb5_", "sip.",
+}
+
+// Application-layer protocols in rule headers and the transport they run over; empty means any
+var idsProtocols = map[string]string{
+	"ip": "", "pkthdr": "", "tcp": "TCP", "udp": "UDP", "icmp": "ICMP",
+	"tcp-pkt": "TCP", "tcp-stream": "TCP",
+	"http": "TCP", "http1": "TCP", "http2": "TCP", "tls": "TCP", "ssh": "TCP", "smtp": "TCP", "ftp": "TCP",
+	"ftp-data": "TCP", "smb": "TCP", "dcerpc": "TCP", "imap": "TCP", "pop3": "TCP", "rdp": "TCP", "mqtt": "TCP",
+	"ldap": "TCP", "modbus": "TCP", "dnp3": "TCP", "enip": "", "dns": "", "krb5": "", "nfs": "",
+	"sip": "UDP", "snmp": "UDP", "dhcp": "UDP", "ntp": "UDP", "tftp": "UDP", "ike": "UDP", "quic": "UDP",
+}
+
+// Default priorities from Suricata's classification.config, used when a rule has no priority option
+var idsClasstypePriority = map[string]int{
+	"attempted-admin": 1, "attempted-user": 1, "inappropriate-content": 1, "policy-violation": 1,
+	"shellcode-detect": 1, "successful-admin": 1, "successful-user": 1, "trojan-activity": 1,
+	"unsuccessful-user": 1, "web-application-attack": 1, "command-and-control": 1, "exploit-kit": 1,
+	"domain-c2": 1, "credential-theft": 1, "targeted-activity": 1,
+	"attempted-dos": 2, "attempted-recon": 2, "bad-unknown": 2, "default-login-attempt": 2,
+	"denial-of-service": 2, "misc-attack": 2, "non-standard-protocol": 2, "rpc-portmap-decode": 2,
+	"successful-dos": 2, "successful-recon-largescale": 2, "successful-recon-limited": 2,
+	"suspicious-filename-detect": 2, "suspicious-login": 2, "system-call-detect": 2,
+	"unusual-client-port-connection": 2, "web-application-activity": 2, "social-engineering": 2,
+	"coin-mining": 2, "pup-activity": 2, "external-ip-check": 2,
+	"icmp-event": 3, "misc-activity": 3, "network-scan": 3, "not-suspicious": 3,
+	"protocol-command-decode": 3, "string-detect": 3, "unknown": 3, "tcp-connection": 4,
+}
+
+var idsRuleActions = regexp.MustCompile(`^(alert|drop|reject|rejectsrc|rejectdst|rejectboth|pass|log|sdrop|activate|dynamic|config)\s`)
+
+// RuleImportReport summarizes an import; options are counted once per rule
+type RuleImportReport struct {
+	RulesParsed         int               `json:"rules_parsed"`
+	Imported            int               `json:"imported"`
+	Duplicates          int               `json:"duplicates"`
+	Disabled            int               `json:"disabled"`    // commented out in the rule file
+	Skipped             int               `json:"skipped"`     // actions that do not alert, e.g. pass
+	Unsupported         int               `json:"unsupported"` // rules using options the detector cannot evaluate
+	UnsupportedOptions  map[string]int    `json:"unsupported_options"`
+	ApproximatedOptions map[string]int    `json:"approximated_options"`
+	ErrorCount          int               `json:"error_count"`
+	Errors              []RuleImportError `json:"errors"`
+}
+
+type RuleImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+func (r *RuleImportReport) addError(line int, err error) {
+	r.ErrorCount++
+	if len(r.Errors) < maxReportedRuleErrors {
+		r.Errors = append(r.Errors, RuleImportError{Line: line, Error: err.Error()})
+	}
+}
+
+// unsupportedRuleError lists the options that keep a rule from being imported
+type unsupportedRuleError struct {
+	options []string
+}
+
+func (e *unsupportedRuleError) Error() string {
+	return "unsupported options: " + strings.Join(e.options, ", ")
+}
+
+type parsedIDSRule struct {
+	signature    ThreatSignature
+	approximated []string
+	line         int
+}
+
+// ImportRules parses a Snort/Suricata rule file and stores the alerting rules as threat signatures.
+// Within a file the highest revision of each sid wins; a rule whose match criteria repeat an earlier
+// rule's, or whose revision is older than the stored one, is counted as a duplicate.
+func (td *ThreatDetector) ImportRules(ctx context.Context, r io.Reader) (*RuleImportReport, error) {
+	report := &RuleImportReport{
+		UnsupportedOptions:  make(map[string]int),
+		ApproximatedOptions: make(map[string]int),
+		Errors:              make([]RuleImportError, 0),
+	}
+
+	rules := make(map[string]*parsedIDSRule)
+	order := make([]string, 0)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxRuleLineBytes)
+	lineNumber, ruleLine := 0, 0
+	var pending strings.Builder
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if pending.Len() == 0 {
+			ruleLine = lineNumber
+		}
+		if strings.HasSuffix(line, "\\") {
+			pending.WriteString(strings.TrimSuffix(line, "\\"))
+			continue
+		}
+		pending.WriteString(line)
+		text := pending.String()
+		pending.Reset()
+
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "#") {
+			if idsRuleActions.MatchString(strings.TrimSpace(strings.TrimLeft(text, "#"))) {
+				report.Disabled++
+			}
+			continue
+		}
+
+		report.RulesParsed++
+		rule, err := parseIDSRule(text)
+		if unsupported, ok := err.(*unsupportedRuleError); ok {
+			report.Unsupported++
+			for _, option := range unsupported.options {
+				report.UnsupportedOptions[option]++
+			}
+			continue
+		}
+		if err != nil {
+			report.addError(ruleLine, err)
+			continue
+		}
+		if rule == nil {
+			report.Skipped++
+			continue
+		}
+		rule.line = ruleLine
+
+		if existing, ok := rules[rule.signature.ID]; ok {
+			report.Duplicates++
+			if rule.signature.Revision > existing.signature.Revision {
+				rules[rule.signature.ID] = rule
+			}
+			continue
+		}
+		rules[rule.signature.ID] = rule
+		order = append(order, rule.signature.ID)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+
+	td.mu.RLock()
+	existing := make(map[string]ThreatSignature, len(td.signatures))
+	criteria := make(map[string]string)
+	for id, sig := range td.signatures {
+		existing[id] = sig
+		if sig.Match != nil {
+			key, _ := json.Marshal(sig.Match)
+			criteria[string(key)] = id
+		}
+	}
+	td.mu.RUnlock()
+
+	imported := make([]ThreatSignature, 0, len(order))
+	pipe := td.redis.TxPipeline()
+	for _, id := range order {
+		rule := rules[id]
+		if stored, ok := existing[id]; ok && stored.Revision > rule.signature.Revision {
+			report.Duplicates++
+			continue
+		}
+		key, _ := json.Marshal(rule.signature.Match)
+		if other, ok := criteria[string(key)]; ok && other != id {
+			report.Duplicates++
+			continue
+		}
+		criteria[string(key)] = id
+
+		data, err := json.Marshal(rule.signature)
+		if err != nil {
+			report.addError(rule.line, err)
+			continue
+		}
+		for _, option := range rule.approximated {
+			report.ApproximatedOptions[option]++
+		}
+		pipe.HSet(ctx, threatSignaturesKey, id, data)
+		imported = append(imported, rule.signature)
+	}
+	if len(imported) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to store signatures: %w", err)
+		}
+	}
+	report.Imported = len(imported)
+
+	td.mu.Lock()
+	for _, sig := range imported {
+		td.signatures[sig.ID] = sig
+	}
+	td.mu.Unlock()
+	td.rebuildSignatureIndex()
+
+	log.Printf("Imported %d IDS signatures (%d duplicates, %d unsupported, %d errors)",
+		report.Imported, report.Duplicates, report.Unsupported, report.ErrorCount)
+	return report, nil
+}
+
+// parseIDSRule converts one rule into a signature. It returns nil for rules that do not alert and an
+// *unsupportedRuleError when the rule relies on options the detector cannot evaluate.
+func parseIDSRule(text string) (*parsedIDSRule, error) {
+	open := strings.Index(text, "(")
+	if open < 0 || !strings.HasSuffix(text, ")") {
+		return nil, fmt.Errorf("rule options must be enclosed in parentheses")
+	}
+	header := strings.Fields(text[:open])
+	if len(header) != 7 {
+		return nil, fmt.Errorf("rule header must be: action protocol source ports direction destination ports")
+	}
+
+	switch strings.ToLower(header[0]) {
+	case "alert", "drop", "reject", "rejectsrc", "rejectdst", "rejectboth":
+	case "pass", "log", "sdrop", "activate", "dynamic":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown action %q", header[0])
+	}
+
+	protocol, ok := idsProtocols[strings.ToLower(header[1])]
+	if !ok {
+		return nil, &unsupportedRuleError{options: []string{"protocol " + strings.ToLower(header[1])}}
+	}
+	if header[4] != "->" && header[4] != "<>" {
+		return nil, fmt.Errorf("invalid direction %q", header[4])
+	}
+
+	match := &PacketMatch{
+		Protocol:      protocol,
+		Source:        header[2],
+		SourcePorts:   header[3],
+		Bidirectional: header[4] == "<>",
+		Destination:   header[5],
+		DestPorts:     header[6],
+	}
+	sig := ThreatSignature{Scope: ScopePacket, Source: "ids", Match: match}
+	gid, sid, priority, classtype := 1, "", 0, ""
+	metadata := make(map[string]string)
+	unsupported := make([]string, 0)
+	approximated := make([]string, 0)
+	flagged := make(map[string]bool)
+	approximate := func(option string) {
+		if !flagged[option] {
+			flagged[option] = true
+			approximated = append(approximated, option)
+		}
+	}
+
+	for _, option := range splitRuleOptions(text[open+1 : len(text)-1]) {
+		name, value, _ := strings.Cut(option, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		last := len(match.Contents) - 1
+
+		switch name {
+		case "msg":
+			sig.Description = unquoteRuleValue(value)
+		case "sid":
+			sid = value
+		case "rev":
+			sig.Revision, _ = strconv.Atoi(value)
+		case "gid":
+			if n, err := strconv.Atoi(value); err == nil {
+				gid = n
+			}
+		case "classtype":
+			classtype = value
+		case "priority":
+			priority, _ = strconv.Atoi(value)
+		case "metadata":
+			for _, entry := range strings.Split(value, ",") {
+				key, v, _ := strings.Cut(strings.TrimSpace(entry), " ")
+				if _, seen := metadata[key]; !seen {
+					metadata[key] = strings.TrimSpace(v)
+				}
+			}
+
+		case "content", "uricontent":
+			negated := strings.HasPrefix(value, "!")
+			content, rest := splitQuoted(strings.TrimSpace(strings.TrimPrefix(value, "!")))
+			if rest != "" {
+				unsupported = append(unsupported, name+" with inline modifiers")
+				continue
+			}
+			if _, err := decodeRuleContent(content); err != nil {
+				return nil, err
+			}
+			match.Contents = append(match.Contents, ContentMatch{Content: content, Negated: negated})
+			if name == "uricontent" {
+				approximate(name)
+			}
+		case "nocase", "startswith", "endswith", "offset", "depth", "distance", "within":
+			if last < 0 {
+				return nil, fmt.Errorf("%s must follow a content option", name)
+			}
+			c := &match.Contents[last]
+			switch name {
+			case "nocase":
+				c.Nocase = true
+			case "startswith":
+				c.StartsWith = true
+			case "endswith":
+				c.EndsWith = true
+			default:
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					// Values taken from byte_extract variables
+					unsupported = append(unsupported, name+" variable")
+					continue
+				}
+				switch name {
+				case "offset":
+					c.Offset = &n
+				case "depth":
+					c.Depth = &n
+				case "distance":
+					c.Distance = &n
+				case "within":
+					c.Within = &n
+				}
+			}
+
+		case "pcre":
+			negated := strings.HasPrefix(value, "!")
+			pattern, notes, err := convertPCRE(unquoteRuleValue(strings.TrimPrefix(value, "!")))
+			if err != nil {
+				unsupported = append(unsupported, "pcre "+err.Error())
+				continue
+			}
+			for _, note := range notes {
+				approximate(note)
+			}
+			if negated {
+				match.NegatedPatterns = append(match.NegatedPatterns, pattern)
+			} else {
+				match.Patterns = append(match.Patterns, pattern)
+			}
+
+		case "flow":
+			for _, setting := range strings.Split(value, ",") {
+				switch setting = strings.TrimSpace(setting); setting {
+				case "established":
+					established := true
+					match.Established = &established
+				case "not_established":
+					established := false
+					match.Established = &established
+				case "to_server", "to_client", "from_server", "from_client", "stateless",
+					"no_stream", "only_stream", "no_frag", "only_frag":
+				default:
+					unsupported = append(unsupported, "flow:"+setting)
+				}
+			}
+		case "flags":
+			if _, err := parseTCPFlags(value); err != nil {
+				return nil, err
+			}
+			match.Flags = value
+		case "dsize":
+			if _, err := parseSizeSpec(value); err != nil {
+				return nil, err
+			}
+			match.PayloadSize = value
+
+		default:
+			switch {
+			case idsMetadataOptions[name]:
+			case idsApproximatedOptions[name] || hasAnyPrefix(name, idsApproximatedPrefixes):
+				approximate(name)
+			default:
+				unsupported = append(unsupported, name)
+			}
+		}
+	}
+
+	if sid == "" {
+		return nil, fmt.Errorf("rule has no sid")
+	}
+	if len(unsupported) > 0 {
+		return nil, &unsupportedRuleError{options: unsupported}
+	}
+	if len(match.Contents) == 0 && len(match.Patterns) == 0 && match.Flags == "" && match.PayloadSize == "" {
+		// A header-only rule would alert on every packet of the protocol
+		return nil, &unsupportedRuleError{options: []string{"no payload or packet criteria"}}
+	}
+	if _, err := compilePacketMatch(match); err != nil {
+		return nil, err
+	}
+
+	sig.ID = fmt.Sprintf("sid:%d:%s", gid, sid)
+	sig.Severity = idsSeverity(metadata["signature_severity"], priority, classtype)
+	sig.Type = idsThreatType(classtype, sig.Description)
+	sig.MITREAttack = metadata["mitre_technique_id"]
+	return &parsedIDSRule{signature: sig, approximated: approximated}, nil
+}
+
+// splitRuleOptions splits a rule body on semicolons outside quoted strings
+func splitRuleOptions(body string) []string {
+	options := make([]string, 0)
+	var current strings.Builder
+	quoted, escaped := false, false
+	for _, r := range body {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == ';' && !quoted:
+			if option := strings.TrimSpace(current.String()); option != "" {
+				options = append(options, option)
+			}
+			current.Reset()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	if option := strings.TrimSpace(current.String()); option != "" {
+		options = append(options, option)
+	}
+	return options
+}
+
+// splitQuoted returns the contents of a leading quoted string, escapes intact, and whatever follows it
+func splitQuoted(value string) (string, string) {
+	if !strings.HasPrefix(value, `"`) {
+		return value, ""
+	}
+	for i := 1; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case '"':
+			return value[1:i], strings.TrimSpace(value[i+1:])
+		}
+	}
+	return value[1:], ""
+}
+
+func unquoteRuleValue(value string) string {
+	content, _ := splitQuoted(value)
+	replacer := strings.NewReplacer(`\"`, `"`, `\;`, `;`, `\\`, `\`)
+	return replacer.Replace(content)
+}
+
+// convertPCRE turns "/pattern/flags" into a Go regular expression. It reports modifiers that are
+// approximated and fails on syntax RE2 cannot express, such as backreferences and lookarounds.
+func convertPCRE(value string) (string, []string, error) {
+	end := strings.LastIndex(value, "/")
+	if !strings.HasPrefix(value, "/") || end < 1 {
+		return "", nil, fmt.Errorf("must be /pattern/flags")
+	}
+	pattern, modifiers := value[1:end], value[end+1:]
+
+	flags, prefix := "", ""
+	notes := make([]string, 0)
+	for _, modifier := range modifiers {
+		switch modifier {
+		case 'i', 's', 'm':
+			flags += string(modifier)
+		case 'G':
+			flags += "U"
+		case 'A':
+			prefix = `\A`
+		case 'E', 'O':
+		case 'R':
+			notes = append(notes, "pcre relative match")
+		case 'U', 'I', 'P', 'H', 'D', 'M', 'C', 'K', 'S', 'Y', 'B', 'V', 'W', 'Q':
+			notes = append(notes, "pcre buffer modifier")
+		default:
+			return "", nil, fmt.Errorf("modifier %q", modifier)
+		}
+	}
+
+	converted := prefix + "(?:" + pattern + ")"
+	if flags != "" {
+		converted = "(?" + flags + ")" + converted
+	}
+	if _, err := regexp.Compile(converted); err != nil {
+		return "", nil, fmt.Errorf("syntax not supported by RE2")
+	}
+	return converted, notes, nil
+}
+
+// idsSeverity prefers ET's signature_severity metadata, then the rule or classtype priority
+func idsSeverity(signatureSeverity string, priority int, classtype string) ThreatLevel {
+	switch strings.ToLower(signatureSeverity) {
+	case "critical":
+		return Critical
+	case "major":
+		return High
+	case "minor":
+		return Medium
+	case "informational", "audit":
+		return Low
+	}
+
+	if priority == 0 {
+		priority = idsClasstypePriority[classtype]
+	}
+	switch priority {
+	case 1:
+		return High
+	case 0, 2:
+		return Medium
+	default:
+		return Low
+	}
+}
+
+func idsThreatType(classtype, msg string) ThreatType {
+	msg = strings.ToLower(msg)
+	switch {
+	case strings.Contains(msg, "sql injection"), strings.Contains(msg, "sqli"):
+		return SQLInjection
+	case strings.Contains(msg, "xss"), strings.Contains(msg, "cross site scripting"), strings.Contains(msg, "cross-site scripting"):
+		return XSS
+	case strings.Contains(msg, "brute"):
+		return Brute
+	case strings.Contains(msg, "exfil"):
+		return DataExfil
+	}
+
+	switch classtype {
+	case "trojan-activity", "command-and-control", "exploit-kit", "domain-c2", "coin-mining", "pup-activity":
+		return Malware
+	case "attempted-dos", "denial-of-service", "successful-dos":
+		return DDoS
+	case "default-login-attempt", "suspicious-login", "credential-theft":
+		return Brute
+	}
+	return Intrusion
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTP Handlers
+func (s *APIServer) importSignaturesHandler(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxRuleImportBytes)
+
+	var rules io.Reader = c.Request.Body
+	if c.ContentType() == "multipart/form-data" {
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "multipart field \"file\" with a Snort/Suricata rules file (max 64 MB) is required"})
+			return
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer file.Close()
+		rules = file
+	}
+
+	report, err := s.threatDetector.ImportRules(c.Request.Context(), rules)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "rule files are limited to 64 MB"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pdf/fpdf"
+)
+
+// Incident reports: an alert with the related alerts, its timeline, and the response actions taken,
+// written up by Claude
+const (
+	incidentRelatedWindow = time.Hour // related alerts raised this close to the incident's first or last occurrence
+	maxIncidentIndicators = 50
+	maxIncidentAlerts     = 1000 // newest alerts searched for related ones
+)
+
+// IncidentTimelineEntry is one event in the life of an incident
+type IncidentTimelineEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Event     string    `json:"event"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// Incident is an alert with everything known about it: the indicators of its related alerts,
+// what happened when, and the SOAR responses recorded under its ID
+type Incident struct {
+	ID         string                  `json:"id"`
+	Status     AlertStatus             `json:"status"`
+	Severity   ThreatLevel             `json:"severity"`
+	Summary    string                  `json:"summary"`
+	Origin     string                  `json:"origin"`
+	FirstSeen  time.Time               `json:"first_seen"`
+	LastSeen   time.Time               `json:"last_seen"`
+	Indicators []ThreatIndicator       `json:"indicators"` // the alert's first
+	Timeline   []IncidentTimelineEntry `json:"timeline"`
+	Responses  []IncidentResponse      `json:"responses"`
+}
+
+// IncidentIOC is an indicator of compromise named in the incident
+type IncidentIOC struct {
+	Type    string `json:"type"` // "ip", "domain", or "hash"
+	Value   string `json:"value"`
+	Context string `json:"context"`
+}
+
+// IncidentReport is the written-up incident for responders and management
+type IncidentReport struct {
+	IncidentID       string                  `json:"incident_id"`
+	Title            string                  `json:"title"`
+	Severity         ThreatLevel             `json:"severity"`
+	Status           AlertStatus             `json:"status"`
+	FirstSeen        time.Time               `json:"first_seen"`
+	LastSeen         time.Time               `json:"last_seen"`
+	GeneratedAt      time.Time               `json:"generated_at"`
+	ExecutiveSummary string                  `json:"executive_summary"`
+	TechnicalDetail  []string                `json:"technical_detail"` // one paragraph per indicator
+	IOCs             []IncidentIOC           `json:"iocs"`
+	Remediation      []string                `json:"remediation"`
+	Timeline         []IncidentTimelineEntry `json:"timeline"`
+	Responses        []IncidentResponse      `json:"responses"`
+}
+
+// IncidentReporter assembles incidents from alerts and the SOAR audit log
+type IncidentReporter struct {
+	detector  *ThreatDetector
+	responder *IncidentResponder
+	claude    *ClaudeClient
+}
+
+func NewIncidentReporter(detector *ThreatDetector, responder *IncidentResponder, claudeClient *ClaudeClient) *IncidentReporter {
+	return &IncidentReporter{detector: detector, responder: responder, claude: claudeClient}
+}
+
+// Incident returns one of the context tenant's incidents by alert ID
+func (ir *IncidentReporter) Incident(ctx context.Context, id string) (*Incident, error) {
+	alert, err := ir.detector.alerts.Alert(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	incident := &Incident{
+		ID:         alert.ID,
+		Status:     alert.Status,
+		Severity:   alert.Severity,
+		Summary:    alert.Summary,
+		Origin:     alert.Origin,
+		FirstSeen:  alert.FirstSeen,
+		LastSeen:   alert.LastSeen,
+		Indicators: []ThreatIndicator{alert.Indicator},
+		Timeline:   alertTimeline(alert),
+		Responses:  make([]IncidentResponse, 0),
+	}
+
+	// Alerts from the same source around the same time are part of the same incident
+	if source := alert.Indicator.SourceIP; source != "" {
+		alerts, err := ir.detector.alerts.Alerts(ctx, "", maxIncidentAlerts)
+		if err != nil {
+			return nil, err
+		}
+		from, to := alert.FirstSeen.Add(-incidentRelatedWindow), alert.LastSeen.Add(incidentRelatedWindow)
+		for i := len(alerts) - 1; i >= 0 && len(incident.Indicators) < maxIncidentIndicators; i-- {
+			related := alerts[i]
+			if related.ID == alert.ID || related.Indicator.SourceIP != source ||
+				related.LastSeen.Before(from) || related.FirstSeen.After(to) {
+				continue
+			}
+			incident.Indicators = append(incident.Indicators, related.Indicator)
+			incident.Timeline = append(incident.Timeline, IncidentTimelineEntry{
+				Timestamp: related.FirstSeen,
+				Event:     "related alert",
+				Detail:    fmt.Sprintf("%s (%s, %d occurrence(s))", related.Summary, related.ID, related.Occurrences),
+			})
+			if severityRank[related.Severity] > severityRank[incident.Severity] {
+				incident.Severity = related.Severity
+			}
+		}
+	}
+
+	entries, err := ir.responder.AuditLog(ctx, responseAuditMax)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.IncidentID != alert.ID {
+			continue
+		}
+		incident.Responses = append(incident.Responses, entry)
+		incident.Timeline = append(incident.Timeline, IncidentTimelineEntry{
+			Timestamp: entry.Timestamp,
+			Event:     "response " + entry.Status,
+			Detail:    fmt.Sprintf("%s %s (%s mode): %s", entry.Action, entry.Target, entry.Mode, entry.Reason),
+		})
+	}
+
+	sort.SliceStable(incident.Timeline, func(i, j int) bool {
+		return incident.Timeline[i].Timestamp.Before(incident.Timeline[j].Timestamp)
+	})
+	return incident, nil
+}
+
+// alertTimeline lists an alert's lifecycle: raised, notified, escalated, acknowledged, resolved
+func alertTimeline(alert *Alert) []IncidentTimelineEntry {
+	timeline := []IncidentTimelineEntry{{Timestamp: alert.FirstSeen, Event: "alert raised", Detail: alert.Summary}}
+	for _, notification := range alert.Notifications {
+		detail := fmt.Sprintf("%s %s", notification.Channel, notification.Status)
+		if notification.Error != "" {
+			detail += ": " + notification.Error
+		}
+		timeline = append(timeline, IncidentTimelineEntry{Timestamp: notification.Timestamp, Event: "notification " + notification.Action, Detail: detail})
+	}
+	if alert.Occurrences > 1 {
+		timeline = append(timeline, IncidentTimelineEntry{Timestamp: alert.LastSeen, Event: "last occurrence", Detail: fmt.Sprintf("%d occurrences in total", alert.Occurrences)})
+	}
+	if alert.AcknowledgedAt != nil {
+		timeline = append(timeline, IncidentTimelineEntry{Timestamp: *alert.AcknowledgedAt, Event: "acknowledged", Detail: "by " + alert.AcknowledgedBy})
+	}
+	if alert.ResolvedAt != nil {
+		timeline = append(timeline, IncidentTimelineEntry{Timestamp: *alert.ResolvedAt, Event: "resolved", Detail: "by " + alert.ResolvedBy})
+	}
+	return timeline
+}
+
+// Report writes up an incident
+func (ir *IncidentReporter) Report(ctx context.Context, id string) (*IncidentReport, error) {
+	incident, err := ir.Incident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return ir.claude.GenerateIncidentReport(ctx, incident)
+}
+
+// incidentIOCs collects the addresses, domains, and file hashes the incident's indicators name
+func incidentIOCs(indicators []ThreatIndicator) []IncidentIOC {
+	iocs := make([]IncidentIOC, 0)
+	seen := make(map[string]bool)
+	add := func(kind, value, context string) {
+		if value == "" || seen[value] {
+			return
+		}
+		seen[value] = true
+		iocs = append(iocs, IncidentIOC{Type: kind, Value: value, Context: context})
+	}
+	for _, threat := range indicators {
+		add("ip", threat.SourceIP, "source of "+threat.Description)
+		// Destinations are usually the defended hosts; only public ones are indicators
+		if ip := net.ParseIP(threat.DestIP); ip != nil && !ip.IsPrivate() && !ip.IsLoopback() {
+			add("ip", threat.DestIP, "destination of "+threat.Description)
+		}
+		for _, observable := range threat.Observables {
+			kind := "domain"
+			if _, _, err := normalizeFileHash(observable); err == nil {
+				kind = "hash"
+			}
+			add(kind, observable, "observed in "+threat.Description)
+		}
+	}
+	return iocs
+}
+
+// incidentRemediation recommends steps for each kind of threat in the incident
+var incidentRemediation = map[ThreatType]string{
+	Malware:      "Isolate affected hosts, collect forensic images, and reimage them from known-good media.",
+	Intrusion:    "Review the affected hosts for persistence and patch the services that were targeted.",
+	DDoS:         "Engage upstream DDoS scrubbing and rate limit the targeted services.",
+	DataExfil:    "Identify the data transferred, revoke credentials on the affected hosts, and assess notification obligations.",
+	Brute:        "Reset passwords of targeted accounts, enforce multi-factor authentication, and enable account lockout.",
+	SQLInjection: "Fix the vulnerable queries with parameterized statements and review database logs for data access.",
+	XSS:          "Encode output in the affected pages and deploy a restrictive Content Security Policy.",
+	Anomaly:      "Confirm the unusual activity with the host owner and update the baseline if it is legitimate.",
+}
+
+// GenerateIncidentReport writes up an incident: an executive summary, technical detail per indicator,
+// the IOCs, and remediation steps
+func (c *ClaudeClient) GenerateIncidentReport(ctx context.Context, incident *Incident) (*IncidentReport, error) {
+	incidentJSON, _ := json.MarshalIndent(incident, "", "  ")
+
+	prompt := fmt.Sprintf(`Write an incident report for this security incident:
+
+INCIDENT (indicators, timeline, and response actions):
+%s
+
+Provide a JSON response with:
+{
+  "executive_summary": "One paragraph for management: what happened, the impact, and the current state",
+  "technical_detail": ["one paragraph per indicator: what was detected, how, and the ATT&CK technique"],
+  "remediation": ["remaining step 1", "remaining step 2", ...]
+}
+
+Only recommend steps the response actions have not already completed.`, string(incidentJSON))
+
+	// Simulate Claude API call (in production, use actual Anthropic SDK)
+	_ = prompt
+	report := &IncidentReport{
+		IncidentID:      incident.ID,
+		Title:           incident.Summary,
+		Severity:        incident.Severity,
+		Status:          incident.Status,
+		FirstSeen:       incident.FirstSeen,
+		LastSeen:        incident.LastSeen,
+		GeneratedAt:     time.Now().UTC(),
+		TechnicalDetail: make([]string, 0, len(incident.Indicators)),
+		IOCs:            incidentIOCs(incident.Indicators),
+		Remediation:     make([]string, 0),
+		Timeline:        incident.Timeline,
+		Responses:       incident.Responses,
+	}
+
+	primary := incident.Indicators[0]
+	text := fmt.Sprintf("Between %s and %s, %d %s-severity indicator(s) of %s were detected",
+		incident.FirstSeen.Format("2006-01-02 15:04 MST"), incident.LastSeen.Format("2006-01-02 15:04 MST"),
+		len(incident.Indicators), incident.Severity, strings.ReplaceAll(string(primary.Type), "_", " "))
+	if primary.SourceIP != "" {
+		text += " from " + primary.SourceIP
+	}
+	if primary.Asset != "" {
+		text += ", affecting " + primary.Asset
+	}
+	text += "."
+
+	executed := make(map[string]bool) // "action target" of responses that completed
+	for _, response := range incident.Responses {
+		if response.Status == "completed" || response.Status == "partial" {
+			executed[response.Action+" "+response.Target] = true
+		}
+	}
+	switch {
+	case len(incident.Responses) == 0:
+		text += " No response actions have been recorded yet."
+	case len(executed) == 0:
+		text += fmt.Sprintf(" %d response action(s) were planned or audited, but none have been executed.", len(incident.Responses))
+	default:
+		text += fmt.Sprintf(" %d response action(s) were recorded and %d were executed.", len(incident.Responses), len(executed))
+	}
+	switch incident.Status {
+	case AlertResolved:
+		text += " The incident has been resolved."
+	case AlertAcknowledged:
+		text += " Responders have acknowledged the incident and it remains open."
+	default:
+		text += " The incident has not been acknowledged and needs immediate attention."
+	}
+	report.ExecutiveSummary = text
+
+	types := make(map[ThreatType]bool)
+	for _, threat := range incident.Indicators {
+		paragraph := fmt.Sprintf("[%s] %s", strings.ToUpper(string(threat.Severity)), threat.Description)
+		if threat.SourceIP != "" || threat.DestIP != "" {
+			paragraph += fmt.Sprintf(" (%s -> %s)", valueOr(threat.SourceIP, "unknown"), valueOr(threat.DestIP, "unknown"))
+		}
+		paragraph += fmt.Sprintf(", confidence %.2f.", threat.Confidence)
+		if threat.MITREAttack != "" {
+			technique := threat.MITREAttack
+			if entry, ok := attackCatalog[attackParent(technique)]; ok {
+				technique += " " + entry.Name
+			}
+			paragraph += " MITRE ATT&CK: " + technique + "."
+		}
+		if len(threat.Evidence) > 0 {
+			paragraph += " Evidence: " + strings.Join(threat.Evidence, "; ") + "."
+		}
+		report.TechnicalDetail = append(report.TechnicalDetail, paragraph)
+
+		if !types[threat.Type] {
+			types[threat.Type] = true
+			if step, ok := incidentRemediation[threat.Type]; ok {
+				report.Remediation = append(report.Remediation, step)
+			}
+		}
+	}
+	if primary.SourceIP != "" && !executed["block "+primary.SourceIP] {
+		report.Remediation = append([]string{fmt.Sprintf("Block %s at the perimeter firewall.", primary.SourceIP)}, report.Remediation...)
+	}
+	if incident.Status != AlertResolved {
+		report.Remediation = append(report.Remediation, "Resolve the alert once remediation is confirmed.")
+	}
+
+	log.Printf("Claude incident report completed for %s", incident.ID)
+
+	return report, nil
+}
+
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// markdownEscape keeps text from being read as Markdown table or emphasis syntax
+var markdownEscape = strings.NewReplacer("|", `\|`, "*", `\*`, "_", `\_`, "`", "\\`")
+
+// Markdown renders the report as a Markdown document
+func (r *IncidentReport) Markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Incident report: %s\n\n", markdownEscape.Replace(r.Title))
+	fmt.Fprintf(&b, "| | |\n|---|---|\n")
+	fmt.Fprintf(&b, "| Incident | `%s` |\n", r.IncidentID)
+	fmt.Fprintf(&b, "| Severity | %s |\n", r.Severity)
+	fmt.Fprintf(&b, "| Status | %s |\n", r.Status)
+	fmt.Fprintf(&b, "| First seen | %s |\n", r.FirstSeen.Format(time.RFC3339))
+	fmt.Fprintf(&b, "| Last seen | %s |\n", r.LastSeen.Format(time.RFC3339))
+	fmt.Fprintf(&b, "| Generated | %s |\n\n", r.GeneratedAt.Format(time.RFC3339))
+
+	fmt.Fprintf(&b, "## Executive summary\n\n%s\n\n", markdownEscape.Replace(r.ExecutiveSummary))
+
+	b.WriteString("## Technical detail\n\n")
+	for _, paragraph := range r.TechnicalDetail {
+		fmt.Fprintf(&b, "- %s\n", markdownEscape.Replace(paragraph))
+	}
+
+	b.WriteString("\n## Indicators of compromise\n\n")
+	if len(r.IOCs) == 0 {
+		b.WriteString("None identified.\n")
+	} else {
+		b.WriteString("| Type | Value | Context |\n|------|-------|---------|\n")
+		for _, ioc := range r.IOCs {
+			fmt.Fprintf(&b, "| %s | `%s` | %s |\n", ioc.Type, ioc.Value, markdownEscape.Replace(ioc.Context))
+		}
+	}
+
+	b.WriteString("\n## Timeline\n\n| Time | Event | Detail |\n|------|-------|--------|\n")
+	for _, entry := range r.Timeline {
+		fmt.Fprintf(&b, "| %s | %s | %s |\n", entry.Timestamp.Format(time.RFC3339), entry.Event, markdownEscape.Replace(entry.Detail))
+	}
+
+	b.WriteString("\n## Response actions\n\n")
+	if len(r.Responses) == 0 {
+		b.WriteString("None recorded.\n")
+	}
+	for _, response := range r.Responses {
+		fmt.Fprintf(&b, "- **%s** `%s` (%s, %s): %s\n", response.Action, response.Target, response.Mode, response.Status, markdownEscape.Replace(response.Reason))
+		for _, step := range response.Steps {
+			fmt.Fprintf(&b, "  - [%s] %s: %s\n", step.Status, step.Executor, markdownEscape.Replace(step.Description))
+		}
+	}
+
+	b.WriteString("\n## Remediation\n\n")
+	for i, step := range r.Remediation {
+		fmt.Fprintf(&b, "%d. %s\n", i+1, markdownEscape.Replace(step))
+	}
+	return b.String()
+}
+
+// writePDF renders the report with the same sections as the Markdown document
+func (r *IncidentReport) writePDF(w io.Writer) error {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("") // core fonts are cp1252
+	pdf.SetTitle("Incident report "+r.IncidentID, true)
+	pdf.SetCreator(config.AppName+" "+config.Version, true)
+	pdf.SetMargins(15, 15, 15)
+	pdf.SetAutoPageBreak(true, 15)
+	pdf.AliasNbPages("")
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-12)
+		pdf.SetFont("Helvetica", "I", 8)
+		pdf.CellFormat(0, 8, fmt.Sprintf("%s - generated %s - page %d of {nb}", r.IncidentID, r.GeneratedAt.Format(time.RFC3339), pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 18)
+	pdf.MultiCell(0, 9, tr("Incident report: "+r.Title), "", "L", false)
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.CellFormat(0, 6, fmt.Sprintf("Severity: %s    Status: %s", r.Severity, r.Status), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 6, fmt.Sprintf("First seen %s, last seen %s", r.FirstSeen.Format("2006-01-02 15:04 MST"), r.LastSeen.Format("2006-01-02 15:04 MST")), "", 1, "L", false, 0, "")
+
+	section := func(title string) {
+		pdf.Ln(4)
+		pdf.SetFont("Helvetica", "B", 12)
+		pdf.CellFormat(0, 8, title, "", 1, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 9)
+	}
+
+	section("Executive summary")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.MultiCell(0, 5, tr(r.ExecutiveSummary), "", "L", false)
+
+	section("Technical detail")
+	for _, paragraph := range r.TechnicalDetail {
+		pdf.MultiCell(0, 5, tr("- "+paragraph), "", "L", false)
+		pdf.Ln(1)
+	}
+
+	section("Indicators of compromise")
+	if len(r.IOCs) == 0 {
+		pdf.CellFormat(0, 5, "None identified.", "", 1, "L", false, 0, "")
+	}
+	for _, ioc := range r.IOCs {
+		pdf.MultiCell(0, 5, tr(fmt.Sprintf("%s  %s - %s", ioc.Type, ioc.Value, ioc.Context)), "", "L", false)
+	}
+
+	section("Timeline")
+	for _, entry := range r.Timeline {
+		line := fmt.Sprintf("%s  %s", entry.Timestamp.Format("2006-01-02 15:04:05"), entry.Event)
+		if entry.Detail != "" {
+			line += " - " + entry.Detail
+		}
+		pdf.MultiCell(0, 5, tr(line), "", "L", false)
+	}
+
+	section("Response actions")
+	if len(r.Responses) == 0 {
+		pdf.CellFormat(0, 5, "None recorded.", "", 1, "L", false, 0, "")
+	}
+	for _, response := range r.Responses {
+		pdf.MultiCell(0, 5, tr(fmt.Sprintf("%s %s (%s, %s): %s", response.Action, response.Target, response.Mode, response.Status, response.Reason)), "", "L", false)
+		for _, step := range response.Steps {
+			pdf.MultiCell(0, 5, tr(fmt.Sprintf("    [%s] %s: %s", step.Status, step.Executor, step.Description)), "", "L", false)
+		}
+	}
+
+	section("Remediation")
+	for i, step := range r.Remediation {
+		pdf.MultiCell(0, 5, tr(fmt.Sprintf("%d. %s", i+1, step)), "", "L", false)
+	}
+
+	return pdf.Output(w)
+}
+
+// HTTP Handlers
+func (s *APIServer) incidentReportHandler(c *gin.Context) {
+	format := c.DefaultQuery("format", "markdown")
+	if format != "markdown" && format != "pdf" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": `format must be "markdown", "pdf", or "json"`})
+		return
+	}
+
+	report, err := s.incidents.Report(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, errAlertNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Incident not found"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch format {
+	case "json":
+		c.JSON(http.StatusOK, report)
+	case "markdown":
+		c.Header("Content-Disposition", fmt.Sprintf(`inline; filename="%s.md"`, report.IncidentID))
+		c.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(report.Markdown()))
+	default:
+		var document bytes.Buffer
+		if err := report.writePDF(&document); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to render PDF: " + err.Error()})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, report.IncidentID))
+		c.Data(http.StatusOK, "application/pdf", document.Bytes())
+	}
+}
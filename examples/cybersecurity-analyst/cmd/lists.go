@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// IP, CIDR, and domain allowlists and blocklists
+type ListName string
+
+const (
+	Allowlist ListName = "allowlist"
+	Blocklist ListName = "blocklist"
+)
+
+const (
+	listKeyPrefix       = "lists:" // set of entry values per list; "lists:<list>:entries" holds their details
+	listEntriesMax      = 100000
+	listRefreshInterval = 30 * time.Second
+)
+
+var (
+	errUnknownList      = errors.New("list must be allowlist or blocklist")
+	errInvalidListEntry = errors.New("invalid list entry")
+)
+
+var listMatches = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cybersecurity_list_matches_total",
+		Help: "Indicators suppressed by the allowlist or raised in severity by the blocklist",
+	},
+	[]string{"list"},
+)
+
+func init() {
+	prometheus.MustRegister(listMatches)
+}
+
+// ListEntry is an IP address, CIDR, or domain on a list. A domain also covers its subdomains.
+type ListEntry struct {
+	Value     string    `json:"value"`
+	Kind      string    `json:"kind"` // "ip", "cidr", or "domain"
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func parseListName(name string) (ListName, error) {
+	switch list := ListName(name); list {
+	case Allowlist, Blocklist:
+		return list, nil
+	}
+	return "", errUnknownList
+}
+
+// normalizeListValue classifies an entry and returns its canonical form
+func normalizeListValue(value string) (string, string, error) {
+	value = strings.TrimSpace(value)
+	if ip := net.ParseIP(value); ip != nil {
+		return ip.String(), "ip", nil
+	}
+	if _, network, err := net.ParseCIDR(value); err == nil {
+		return network.String(), "cidr", nil
+	}
+	domain := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(value, "*."), "."))
+	if strings.Contains(domain, ".") && hostnamePattern.MatchString(domain) {
+		return domain, "domain", nil
+	}
+	return "", "", fmt.Errorf("%w: %q is not an IP address, CIDR, or domain", errInvalidListEntry, value)
+}
+
+// listSnapshot indexes one list for matching
+type listSnapshot struct {
+	ips      map[string]*ListEntry
+	networks []listNetwork
+	domains  map[string]*ListEntry
+}
+
+type listNetwork struct {
+	network *net.IPNet
+	entry   *ListEntry
+}
+
+func newListSnapshot(entries []ListEntry) *listSnapshot {
+	snapshot := &listSnapshot{ips: make(map[string]*ListEntry), domains: make(map[string]*ListEntry)}
+	for i := range entries {
+		entry := &entries[i]
+		switch entry.Kind {
+		case "ip":
+			snapshot.ips[entry.Value] = entry
+		case "cidr":
+			if _, network, err := net.ParseCIDR(entry.Value); err == nil {
+				snapshot.networks = append(snapshot.networks, listNetwork{network: network, entry: entry})
+			}
+		case "domain":
+			snapshot.domains[entry.Value] = entry
+		}
+	}
+	return snapshot
+}
+
+func (s *listSnapshot) matchIP(value string) *ListEntry {
+	ip := net.ParseIP(value)
+	if s == nil || ip == nil {
+		return nil
+	}
+	if entry, ok := s.ips[ip.String()]; ok {
+		return entry
+	}
+	for _, candidate := range s.networks {
+		if candidate.network.Contains(ip) {
+			return candidate.entry
+		}
+	}
+	return nil
+}
+
+// matchTarget matches a response target: an address, a network overlapping any listed address or
+// network, or a host name
+func (s *listSnapshot) matchTarget(value string) *ListEntry {
+	if s == nil {
+		return nil
+	}
+	_, target, err := net.ParseCIDR(value)
+	if err != nil {
+		if net.ParseIP(value) != nil {
+			return s.matchIP(value)
+		}
+		return s.matchDomain(value)
+	}
+	for _, entry := range s.ips {
+		if target.Contains(net.ParseIP(entry.Value)) {
+			return entry
+		}
+	}
+	for _, candidate := range s.networks {
+		if candidate.network.Contains(target.IP) || target.Contains(candidate.network.IP) {
+			return candidate.entry
+		}
+	}
+	return nil
+}
+
+// matchDomain matches a domain or any of its parent domains
+func (s *listSnapshot) matchDomain(value string) *ListEntry {
+	if s == nil {
+		return nil
+	}
+	domain := strings.ToLower(strings.TrimSuffix(value, "."))
+	for {
+		if entry, ok := s.domains[domain]; ok {
+			return entry
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok || !strings.Contains(parent, ".") {
+			return nil
+		}
+		domain = parent
+	}
+}
+
+// AccessLists keeps each tenant's allowlist and blocklist in Redis sets. Matching uses in-memory
+// snapshots, reloaded after every change and every listRefreshInterval to pick up changes made
+// through other replicas.
+type AccessLists struct {
+	redis     *redis.Client
+	snapshots sync.Map // tenant ID -> *tenantLists, loaded on first use
+}
+
+type tenantLists struct {
+	allowlist atomic.Pointer[listSnapshot]
+	blocklist atomic.Pointer[listSnapshot]
+}
+
+func (t *tenantLists) snapshot(list ListName) *atomic.Pointer[listSnapshot] {
+	if list == Allowlist {
+		return &t.allowlist
+	}
+	return &t.blocklist
+}
+
+func NewAccessLists(redisClient *redis.Client) *AccessLists {
+	return &AccessLists{redis: redisClient}
+}
+
+// Start reloads the lists of every tenant in use periodically until ctx is cancelled
+func (l *AccessLists) Start(ctx context.Context) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(listRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				l.snapshots.Range(func(tenant, _ interface{}) bool {
+					if err := l.Load(withTenant(ctx, tenant.(string))); err != nil {
+						log.Printf("Keeping previous allowlist and blocklist of tenant %s: %v", tenant, err)
+					}
+					return true
+				})
+			}
+		}
+	}()
+	return &wg
+}
+
+// Load replaces the context tenant's snapshots with its lists stored in Redis
+func (l *AccessLists) Load(ctx context.Context) error {
+	value, _ := l.snapshots.LoadOrStore(tenantFromContext(ctx), &tenantLists{})
+	lists := value.(*tenantLists)
+	for _, list := range []ListName{Allowlist, Blocklist} {
+		entries, err := l.Entries(ctx, list)
+		if err != nil {
+			return err
+		}
+		lists.snapshot(list).Store(newListSnapshot(entries))
+	}
+	return nil
+}
+
+// lists returns the context tenant's snapshots, loading them on the tenant's first detection
+func (l *AccessLists) lists(ctx context.Context) *tenantLists {
+	if value, ok := l.snapshots.Load(tenantFromContext(ctx)); ok {
+		return value.(*tenantLists)
+	}
+	if err := l.Load(ctx); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	value, _ := l.snapshots.Load(tenantFromContext(ctx))
+	return value.(*tenantLists)
+}
+
+// forget drops a deleted tenant's snapshots
+func (l *AccessLists) forget(tenant string) {
+	l.snapshots.Delete(tenant)
+}
+
+// Entries returns a list's entries, sorted by value
+func (l *AccessLists) Entries(ctx context.Context, list ListName) ([]ListEntry, error) {
+	values, err := l.redis.SMembers(ctx, tenantKey(ctx, listKeyPrefix+string(list))).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", list, err)
+	}
+	entries := make([]ListEntry, 0, len(values))
+	if len(values) == 0 {
+		return entries, nil
+	}
+
+	details, err := l.redis.HMGet(ctx, tenantKey(ctx, listKeyPrefix+string(list)+":entries"), values...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", list, err)
+	}
+	for i, value := range values {
+		entry := ListEntry{Value: value}
+		if data, ok := details[i].(string); ok {
+			json.Unmarshal([]byte(data), &entry)
+		}
+		if entry.Kind == "" {
+			_, entry.Kind, _ = normalizeListValue(value)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Value < entries[j].Value })
+	return entries, nil
+}
+
+// Add puts an entry on a list, replacing the reason of an existing one
+func (l *AccessLists) Add(ctx context.Context, list ListName, value, reason string) (*ListEntry, error) {
+	value, kind, err := normalizeListValue(value)
+	if err != nil {
+		return nil, err
+	}
+	key := tenantKey(ctx, listKeyPrefix+string(list))
+	size, err := l.redis.SCard(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check %s size: %w", list, err)
+	}
+	if size >= listEntriesMax {
+		if exists, err := l.redis.SIsMember(ctx, key, value).Result(); err != nil || !exists {
+			return nil, fmt.Errorf("%w: %s is limited to %d entries", errInvalidListEntry, list, listEntriesMax)
+		}
+	}
+
+	entry := &ListEntry{Value: value, Kind: kind, Reason: reason, CreatedAt: time.Now().UTC()}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	pipe := l.redis.TxPipeline()
+	pipe.SAdd(ctx, key, value)
+	pipe.HSet(ctx, key+":entries", value, data)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to store %s entry: %w", list, err)
+	}
+	if err := l.Load(ctx); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return entry, nil
+}
+
+// Remove takes an entry off a list and reports whether it was there
+func (l *AccessLists) Remove(ctx context.Context, list ListName, value string) (bool, error) {
+	if normalized, _, err := normalizeListValue(value); err == nil {
+		value = normalized
+	}
+	key := tenantKey(ctx, listKeyPrefix+string(list))
+	pipe := l.redis.TxPipeline()
+	removed := pipe.SRem(ctx, key, value)
+	pipe.HDel(ctx, key+":entries", value)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, fmt.Errorf("failed to remove %s entry: %w", list, err)
+	}
+	if removed.Val() == 0 {
+		return false, nil
+	}
+	if err := l.Load(ctx); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return true, nil
+}
+
+// Apply checks indicators against the context tenant's lists: it suppresses indicators from
+// allowlisted sources and raises the severity of indicators involving blocklisted addresses or
+// domains by one level. The blocklist is checked first, so an allowlisted host talking to a
+// blocklisted one is still reported.
+func (l *AccessLists) Apply(ctx context.Context, threats []ThreatIndicator) []ThreatIndicator {
+	lists := l.lists(ctx)
+	allowlist, blocklist := lists.allowlist.Load(), lists.blocklist.Load()
+	kept := threats[:0]
+	for _, threat := range threats {
+		if entry, value := blocklistMatch(blocklist, threat); entry != nil {
+			threat.Severity = raiseSeverity(threat.Severity)
+			evidence := fmt.Sprintf("%s is on the blocklist (%s)", value, entry.Value)
+			if entry.Reason != "" {
+				evidence = fmt.Sprintf("%s is on the blocklist (%s: %s)", value, entry.Value, entry.Reason)
+			}
+			threat.Evidence = append(threat.Evidence, evidence)
+			listMatches.WithLabelValues(string(Blocklist)).Inc()
+		} else if allowlisted(allowlist, threat) {
+			listMatches.WithLabelValues(string(Allowlist)).Inc()
+			continue
+		}
+		kept = append(kept, threat)
+	}
+	return kept
+}
+
+func blocklistMatch(blocklist *listSnapshot, threat ThreatIndicator) (*ListEntry, string) {
+	for _, ip := range []string{threat.SourceIP, threat.DestIP} {
+		if entry := blocklist.matchIP(ip); entry != nil {
+			return entry, ip
+		}
+	}
+	for _, observable := range threat.Observables {
+		if entry := blocklist.matchDomain(observable); entry != nil {
+			return entry, observable
+		}
+	}
+	return nil, ""
+}
+
+// allowlisted reports whether an indicator's source address is allowlisted, or, for indicators
+// from log events, whether every domain it names is
+func allowlisted(allowlist *listSnapshot, threat ThreatIndicator) bool {
+	if threat.SourceIP != "" {
+		return allowlist.matchIP(threat.SourceIP) != nil
+	}
+	domains := 0
+	for _, observable := range threat.Observables {
+		if kind, _, ok := classifyIOC(observable); ok && kind == IOCDomain {
+			if allowlist.matchDomain(observable) == nil {
+				return false
+			}
+			domains++
+		}
+	}
+	return domains > 0
+}
+
+func raiseSeverity(severity ThreatLevel) ThreatLevel {
+	switch severity {
+	case Low:
+		return Medium
+	case Medium:
+		return High
+	default:
+		return Critical
+	}
+}
+
+// enforceBlocklist pushes blocklist entries to the SOAR block executors. Domains are skipped;
+// no executor blocks them.
+func enforceBlocklist(ctx context.Context, responder *IncidentResponder, entries []ListEntry, mode ResponseMode, executors []string, by string) ([]*IncidentResponse, error) {
+	responses := make([]*IncidentResponse, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Kind == "domain" {
+			continue
+		}
+		reason := entry.Reason
+		if reason == "" {
+			reason = "Blocklisted"
+		}
+		response, err := responder.Respond(ctx, IncidentResponseRequest{
+			IncidentID:  "blocklist",
+			Action:      "block",
+			Target:      entry.Value,
+			Reason:      reason,
+			Mode:        mode,
+			Executors:   executors,
+			RequestedBy: by,
+		})
+		if err != nil {
+			return responses, fmt.Errorf("%s: %w", entry.Value, err)
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+// HTTP Handlers
+func (s *APIServer) listEntriesHandler(c *gin.Context) {
+	list, err := parseListName(c.Param("list"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	entries, err := s.threatDetector.lists.Entries(c.Request.Context(), list)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"list": list, "entries": entries, "count": len(entries)})
+}
+
+func (s *APIServer) addListEntryHandler(c *gin.Context) {
+	list, err := parseListName(c.Param("list"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	var req struct {
+		Value     string       `json:"value" binding:"required"`
+		Reason    string       `json:"reason"`
+		Enforce   bool         `json:"enforce"`   // blocklist only: push the entry to block executors
+		Mode      ResponseMode `json:"mode"`      // response mode for enforce; defaults to SOAR_MODE
+		Executors []string     `json:"executors"` // limit enforcement to these executors
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Enforce && list != Blocklist {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "only blocklist entries can be enforced"})
+		return
+	}
+
+	entry, err := s.threatDetector.lists.Add(c.Request.Context(), list, req.Value, req.Reason)
+	switch {
+	case errors.Is(err, errInvalidListEntry):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.Enforce {
+		c.JSON(http.StatusCreated, gin.H{"entry": entry})
+		return
+	}
+	if entry.Kind == "domain" {
+		c.JSON(http.StatusCreated, gin.H{"entry": entry, "enforcement_error": "no executor blocks domains"})
+		return
+	}
+
+	// The entry stays on the blocklist when enforcement is refused
+	responses, err := enforceBlocklist(c.Request.Context(), s.responder, []ListEntry{*entry}, req.Mode, req.Executors, clientFromContext(c).ID)
+	if err != nil {
+		c.JSON(http.StatusCreated, gin.H{"entry": entry, "enforcement_error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"entry": entry, "enforcement": responses[0]})
+}
+
+func (s *APIServer) removeListEntryHandler(c *gin.Context) {
+	list, err := parseListName(c.Param("list"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	value := c.Query("value")
+	if value == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "value is required"})
+		return
+	}
+
+	found, err := s.threatDetector.lists.Remove(c.Request.Context(), list, value)
+	switch {
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case !found:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Entry not found"})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// enforceListHandler pushes every IP and CIDR on the blocklist to the block executors
+func (s *APIServer) enforceListHandler(c *gin.Context) {
+	if list, err := parseListName(c.Param("list")); err != nil || list != Blocklist {
+		c.JSON(http.StatusNotFound, gin.H{"error": "only the blocklist can be enforced"})
+		return
+	}
+	var req struct {
+		Mode      ResponseMode `json:"mode"`
+		Executors []string     `json:"executors"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	entries, err := s.threatDetector.lists.Entries(c.Request.Context(), Blocklist)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	responses, err := enforceBlocklist(c.Request.Context(), s.responder, entries, req.Mode, req.Executors, clientFromContext(c).ID)
+	switch {
+	case errors.Is(err, errResponseModeNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "responses": responses})
+	default:
+		c.JSON(http.StatusOK, gin.H{"responses": responses, "count": len(responses), "skipped_domains": len(entries) - len(responses)})
+	}
+}
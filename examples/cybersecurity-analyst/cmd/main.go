@@ -10,47 +10,325 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
+	_ "github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Configuration
 type Config struct {
-	AppName               string
-	Version               string
-	Port                  string
-	RedisURL              string
-	DatabaseURL           string
-	ClaudeAPIKey          string
-	ClaudeModel           string
-	MaxConcurrentScans    int
-	PacketBufferSize      int
-	ThreatThreshold       float64
+	AppName                     string
+	Version                     string
+	Port                        string
+	RedisURL                    string
+	DatabaseURL                 string
+	ClaudeAPIKey                string
+	ClaudeModel                 string
+	MaxConcurrentScans          int // nmap scans running at once
+	PacketBufferSize            int
+	PacketWorkers               int // workers inspecting packet chunks of analyze requests
+	PacketChunkSize             int
+	PacketQueueSize             int           // chunks waiting for a worker before requests wait
+	PacketQueueTimeout          time.Duration // how long a request waits for queue space before failing
+	ThreatThreshold             float64
+	MaxCaptureUploadMB          int
+	CaptureInterfaces           []string // live capture is disabled when empty
+	CaptureFilter               string   // BPF filter expression applied to every interface
+	FlowListenAddr              string   // UDP address for NetFlow/IPFIX/sFlow exports; disabled when empty
+	HoneypotListenAddr          string   // TCP address for Cowrie socketlog JSON lines; disabled when empty
+	HoneypotSensors             string   // comma-separated sensor addresses or CIDRs allowed to connect to the honeypot listener
+	HoneypotAutoBlock           bool     // blocklist every address that interacts with a honeypot
+	HoneypotRetention           time.Duration
+	SyslogUDPAddr               string // syslog listeners are disabled when their address is empty
+	SyslogTCPAddr               string
+	SyslogTLSAddr               string
+	SyslogTLSCert               string
+	SyslogTLSKey                string
+	SyslogTLSClientCA           string // require client certificates signed by this CA when set
+	GRPCListenAddr              string // TCP address for the gRPC ingestion service; disabled when empty
+	NVDAPIKey                   string
+	NVDURL                      string
+	KEVURL                      string
+	EPSSURL                     string
+	CVESyncInterval             time.Duration
+	SigmaRulesDir               string
+	IDSHomeNet                  string // HOME_NET for imported Snort/Suricata rules; RFC 1918 ranges when empty
+	SplunkHECURL                string // SIEM destinations are enabled by setting their URL or address
+	SplunkHECToken              string
+	SplunkIndex                 string
+	ElasticsearchURL            string
+	ElasticsearchIndex          string
+	ElasticsearchAPIKey         string
+	QRadarSyslogAddr            string
+	QRadarSyslogProtocol        string
+	SIEMBatchSize               int
+	SIEMFlushInterval           time.Duration
+	SIEMMinRiskScore            float64      // scan results at or above this risk score are forwarded
+	SOARMode                    ResponseMode // most enforcing response mode allowed: dry_run, audit, or enforce
+	FirewallAPIURL              string
+	FirewallAPIToken            string
+	AWSRegion                   string
+	AWSNetworkACLID             string
+	AWSNACLRuleStart            int
+	KubernetesQuarantine        bool
+	CrowdStrikeBaseURL          string
+	CrowdStrikeClientID         string
+	CrowdStrikeClientSecret     string
+	OktaOrgURL                  string
+	OktaAPIToken                string
+	QuarantineMinSeverity       string // indicators at or above this severity and confidence propose a quarantine
+	QuarantineMinConfidence     float64
+	QuarantineApprovalTTL       time.Duration // proposals expire without a decision after this long
+	QuarantineReleaseAfter      time.Duration // approved quarantines are released after this long unless the analyst sets another time
+	ScanAlertWebhookURL         string        // receives new findings from scheduled scans
+	ScheduledScanConcurrency    int
+	NmapPath                    string
+	NmapTimeout                 time.Duration
+	NmapMaxRate                 int           // packets per second sent by each scan
+	NmapTargetInterval          time.Duration // minimum time between scans of the same target
+	ScanAllowedNetworks         string        // CIDRs nmap may scan; private ranges when empty
+	BaselineSensitivity         float64       // standard deviations above a host's baseline before traffic volume is anomalous
+	DDoSSensitivity             float64       // standard deviations above a destination's usual packet and SYN rates before they are a flood
+	AuthFailureWindow           time.Duration // sliding window for brute-force and credential-stuffing counts
+	BruteForceThreshold         int           // failed logins for one account from one source within the window
+	CredentialStuffingThreshold int           // accounts failing from one source within the window
+	UEBADormantAfter            time.Duration // an account without logins this long is dormant
+	UEBAMaxTravelKmh            float64       // faster travel between consecutive logins is impossible
+	UEBAMinLogins               int           // logins learned before privilege use and novelty are judged
+	CampaignWindow              time.Duration // indicators correlated into campaigns
+	EndpointRetention           time.Duration // how long endpoint process trees and connections are kept for correlation
+	FileScanMaxMB               int
+	YARAPath                    string
+	YARARules                   string // rules file for file scans, compiled with yarac when it ends in .yarc; YARA is disabled when empty
+	YARATimeout                 time.Duration
+	SandboxBackend              string // "cape", "cuckoo", or "hybrid-analysis"
+	SandboxURL                  string // sandbox API base URL; detonation is disabled when empty
+	SandboxAPIKey               string
+	SandboxEnvironment          string // CAPE or Cuckoo machine, or Hybrid Analysis environment ID
+	SandboxMinScore             int    // file scan score (0-100) at which payloads and files are detonated
+	SandboxMinPayloadBytes      int    // smaller packet payloads are not screened
+	SandboxPollInterval         time.Duration
+	SandboxTimeout              time.Duration // detonations without a report after this long are abandoned
+	GeoIPCityDB                 string        // GeoLite2-City.mmdb
+	GeoIPASNDB                  string        // GeoLite2-ASN.mmdb
+	VirusTotalAPIKey            string
+	VirusTotalPerMinute         int
+	VirusTotalPerDay            int
+	AbuseIPDBAPIKey             string
+	AbuseIPDBPerDay             int
+	ReputationCacheTTL          time.Duration
+	RDAPURL                     string // domain registration lookups for phishing analysis
+	ScreenshotServiceURL        string // Browserless-compatible /screenshot endpoint; screenshots are off when empty
+	ScreenshotProxyAddr         string // TCP address the screenshot proxy listens on; disabled when empty
+	ScreenshotProxyURL          string // screenshot proxy as the headless browser reaches it; screenshots need it
+	PhishingBrands              string // brand=domain|domain, ...; brands whose look-alikes are flagged
+	StreamMaxConnections        int
+	MitreRetention              time.Duration // how long ATT&CK detection counts are kept for reports
+	ScanCacheTTL                time.Duration // how long scan results stay in Redis
+	ScanVersionsKept            int           // vulnerability scans kept per target for diffs
+	Retention                   RetentionPolicy
+	RetentionInterval           time.Duration
+	ArchiveS3Endpoint           string // S3-compatible endpoint; AWS S3 in ArchiveS3Region when empty
+	ArchiveS3Bucket             string // archival is disabled, and expired history deleted, when empty
+	ArchiveS3Region             string
+	ArchiveS3Prefix             string
+	AlertMinSeverity            string        // indicators below this severity never alert
+	AlertDedupWindow            time.Duration // repeats of an indicator within this window join its open alert
+	AlertMaxPerHour             int           // notifications per channel per hour; 0 is unlimited
+	AlertEscalationPolicy       string        // e.g. "15:opsgenie,45:pagerduty+email"
+	PagerDutyRoutingKey         string        // alert channels are enabled by setting their key or address
+	PagerDutyEventsURL          string
+	PagerDutyMinSeverity        string
+	OpsgenieAPIKey              string
+	OpsgenieAPIURL              string
+	OpsgenieMinSeverity         string
+	AlertSMTPAddr               string
+	AlertSMTPUsername           string
+	AlertSMTPPassword           string
+	AlertEmailFrom              string
+	AlertEmailTo                string // comma-separated
+	AlertEmailMinSeverity       string
+	AlertWebhookURL             string
+	AlertWebhookMinSeverity     string
+	APIKeys                     string // "<client>:<key>[:<requests per minute>]", comma-separated
+	APIKeyTenants               string // "<client>=<tenant>", comma-separated; unbound keys may act for any tenant
+	JWTSecret                   string // HS256 secret for bearer tokens
+	JWTIssuer                   string
+	JWTAudience                 string
+	AnalyzeRateLimit            int // requests per minute per client; 0 is unlimited
+	AnalyzeMaxConcurrent        int // analyze requests in progress per client on each replica
+	AnalyzeMaxBodyMB            int
 }
 
 var config = Config{
-	AppName:               "cybersecurity-analyst",
-	Version:               "1.0.0",
-	Port:                  "8086",
-	RedisURL:              getEnv("REDIS_URL", "redis://localhost:6379"),
-	DatabaseURL:           getEnv("DATABASE_URL", "postgres://localhost:5432/cybersecurity"),
-	ClaudeAPIKey:          getEnv("CLAUDE_API_KEY", "your-api-key-here"),
-	ClaudeModel:           "claude-3-5-sonnet-20241022",
-	MaxConcurrentScans:    1000,
-	PacketBufferSize:      100000,
-	ThreatThreshold:       0.75,
+	AppName:                     "cybersecurity-analyst",
+	Version:                     "1.0.0",
+	Port:                        "8086",
+	RedisURL:                    getEnv("REDIS_URL", "redis://localhost:6379"),
+	DatabaseURL:                 getEnv("DATABASE_URL", "postgres://localhost:5432/cybersecurity"),
+	ClaudeAPIKey:                getEnv("CLAUDE_API_KEY", "your-api-key-here"),
+	ClaudeModel:                 "claude-3-5-sonnet-20241022",
+	MaxConcurrentScans:          getEnvInt("MAX_CONCURRENT_SCANS", 16),
+	PacketBufferSize:            100000,
+	PacketWorkers:               getEnvInt("PACKET_WORKERS", runtime.NumCPU()),
+	PacketChunkSize:             getEnvInt("PACKET_CHUNK_SIZE", 5000),
+	PacketQueueSize:             getEnvInt("PACKET_QUEUE_SIZE", 256),
+	PacketQueueTimeout:          time.Duration(getEnvInt("PACKET_QUEUE_TIMEOUT_MS", 5000)) * time.Millisecond,
+	ThreatThreshold:             0.75,
+	MaxCaptureUploadMB:          getEnvInt("MAX_CAPTURE_UPLOAD_MB", 100),
+	CaptureInterfaces:           parseInterfaces(getEnv("CAPTURE_INTERFACES", "")),
+	CaptureFilter:               getEnv("CAPTURE_FILTER", ""),
+	FlowListenAddr:              getEnv("FLOW_LISTEN_ADDR", ""),
+	HoneypotListenAddr:          getEnv("HONEYPOT_LISTEN_ADDR", ""),
+	HoneypotSensors:             getEnv("HONEYPOT_SENSORS", ""),
+	HoneypotAutoBlock:           getEnv("HONEYPOT_AUTO_BLOCK", "true") == "true",
+	HoneypotRetention:           time.Duration(getEnvInt("HONEYPOT_RETENTION_DAYS", 30)) * 24 * time.Hour,
+	SyslogUDPAddr:               getEnv("SYSLOG_UDP_ADDR", ""),
+	SyslogTCPAddr:               getEnv("SYSLOG_TCP_ADDR", ""),
+	SyslogTLSAddr:               getEnv("SYSLOG_TLS_ADDR", ""),
+	SyslogTLSCert:               getEnv("SYSLOG_TLS_CERT", ""),
+	SyslogTLSKey:                getEnv("SYSLOG_TLS_KEY", ""),
+	SyslogTLSClientCA:           getEnv("SYSLOG_TLS_CLIENT_CA", ""),
+	GRPCListenAddr:              getEnv("GRPC_LISTEN_ADDR", ""),
+	NVDAPIKey:                   getEnv("NVD_API_KEY", ""),
+	NVDURL:                      getEnv("NVD_URL", "https://services.nvd.nist.gov/rest/json/cves/2.0"),
+	KEVURL:                      getEnv("KEV_URL", "https://www.cisa.gov/sites/default/files/feeds/known_exploited_vulnerabilities.json"),
+	EPSSURL:                     getEnv("EPSS_URL", "https://api.first.org/data/v1/epss"),
+	CVESyncInterval:             time.Duration(getEnvInt("CVE_SYNC_INTERVAL_MINUTES", 120)) * time.Minute,
+	SigmaRulesDir:               getEnv("SIGMA_RULES_DIR", ""),
+	IDSHomeNet:                  getEnv("IDS_HOME_NET", ""),
+	SplunkHECURL:                getEnv("SPLUNK_HEC_URL", ""),
+	SplunkHECToken:              getEnv("SPLUNK_HEC_TOKEN", ""),
+	SplunkIndex:                 getEnv("SPLUNK_INDEX", ""),
+	ElasticsearchURL:            getEnv("ELASTICSEARCH_URL", ""),
+	ElasticsearchIndex:          getEnv("ELASTICSEARCH_INDEX", "cybersecurity-threats"),
+	ElasticsearchAPIKey:         getEnv("ELASTICSEARCH_API_KEY", ""),
+	QRadarSyslogAddr:            getEnv("QRADAR_SYSLOG_ADDR", ""),
+	QRadarSyslogProtocol:        getEnv("QRADAR_SYSLOG_PROTOCOL", "tcp"),
+	SIEMBatchSize:               getEnvInt("SIEM_BATCH_SIZE", 100),
+	SIEMFlushInterval:           time.Duration(getEnvInt("SIEM_FLUSH_INTERVAL_SECONDS", 5)) * time.Second,
+	SIEMMinRiskScore:            float64(getEnvInt("SIEM_MIN_RISK_SCORE", 70)),
+	SOARMode:                    ResponseMode(getEnv("SOAR_MODE", string(ModeAudit))),
+	FirewallAPIURL:              getEnv("FIREWALL_API_URL", ""),
+	FirewallAPIToken:            getEnv("FIREWALL_API_TOKEN", ""),
+	AWSRegion:                   getEnv("AWS_REGION", "us-east-1"),
+	AWSNetworkACLID:             getEnv("AWS_NETWORK_ACL_ID", ""),
+	AWSNACLRuleStart:            getEnvInt("AWS_NACL_RULE_START", 100),
+	KubernetesQuarantine:        getEnv("KUBERNETES_QUARANTINE", "false") == "true",
+	CrowdStrikeBaseURL:          getEnv("CROWDSTRIKE_BASE_URL", "https://api.crowdstrike.com"),
+	CrowdStrikeClientID:         getEnv("CROWDSTRIKE_CLIENT_ID", ""),
+	CrowdStrikeClientSecret:     getEnv("CROWDSTRIKE_CLIENT_SECRET", ""),
+	OktaOrgURL:                  getEnv("OKTA_ORG_URL", ""),
+	OktaAPIToken:                getEnv("OKTA_API_TOKEN", ""),
+	QuarantineMinSeverity:       getEnv("QUARANTINE_MIN_SEVERITY", "critical"),
+	QuarantineMinConfidence:     float64(getEnvInt("QUARANTINE_MIN_CONFIDENCE_PCT", 90)) / 100,
+	QuarantineApprovalTTL:       time.Duration(getEnvInt("QUARANTINE_APPROVAL_HOURS", 4)) * time.Hour,
+	QuarantineReleaseAfter:      time.Duration(getEnvInt("QUARANTINE_RELEASE_HOURS", 24)) * time.Hour,
+	ScanAlertWebhookURL:         getEnv("SCAN_ALERT_WEBHOOK_URL", ""),
+	ScheduledScanConcurrency:    getEnvInt("SCHEDULED_SCAN_CONCURRENCY", 4),
+	NmapPath:                    getEnv("NMAP_PATH", "nmap"),
+	NmapTimeout:                 time.Duration(getEnvInt("NMAP_TIMEOUT_SECONDS", 120)) * time.Second,
+	NmapMaxRate:                 getEnvInt("NMAP_MAX_RATE", 100),
+	NmapTargetInterval:          time.Duration(getEnvInt("NMAP_TARGET_INTERVAL_SECONDS", 300)) * time.Second,
+	ScanAllowedNetworks:         getEnv("SCAN_ALLOWED_NETWORKS", ""),
+	BaselineSensitivity:         float64(getEnvInt("BASELINE_SENSITIVITY", 3)),
+	DDoSSensitivity:             float64(getEnvInt("DDOS_SENSITIVITY", 4)),
+	AuthFailureWindow:           time.Duration(getEnvInt("AUTH_FAILURE_WINDOW_MINUTES", 10)) * time.Minute,
+	BruteForceThreshold:         getEnvInt("BRUTE_FORCE_THRESHOLD", 10),
+	CredentialStuffingThreshold: getEnvInt("CREDENTIAL_STUFFING_THRESHOLD", 20),
+	UEBADormantAfter:            time.Duration(getEnvInt("UEBA_DORMANT_DAYS", 90)) * 24 * time.Hour,
+	UEBAMaxTravelKmh:            float64(getEnvInt("UEBA_MAX_TRAVEL_KMH", 1000)),
+	UEBAMinLogins:               getEnvInt("UEBA_MIN_LOGINS", 10),
+	CampaignWindow:              time.Duration(getEnvInt("CAMPAIGN_WINDOW_HOURS", 72)) * time.Hour,
+	EndpointRetention:           time.Duration(getEnvInt("ENDPOINT_RETENTION_HOURS", 72)) * time.Hour,
+	FileScanMaxMB:               getEnvInt("FILE_SCAN_MAX_MB", 32),
+	YARAPath:                    getEnv("YARA_PATH", "yara"),
+	YARARules:                   getEnv("YARA_RULES", ""),
+	YARATimeout:                 time.Duration(getEnvInt("YARA_TIMEOUT_SECONDS", 30)) * time.Second,
+	SandboxBackend:              getEnv("SANDBOX_BACKEND", "cape"),
+	SandboxURL:                  getEnv("SANDBOX_URL", ""),
+	SandboxAPIKey:               getEnv("SANDBOX_API_KEY", ""),
+	SandboxEnvironment:          getEnv("SANDBOX_ENVIRONMENT", ""),
+	SandboxMinScore:             getEnvInt("SANDBOX_MIN_SCORE", 50),
+	SandboxMinPayloadBytes:      getEnvInt("SANDBOX_MIN_PAYLOAD_BYTES", 512),
+	SandboxPollInterval:         time.Duration(getEnvInt("SANDBOX_POLL_SECONDS", 30)) * time.Second,
+	SandboxTimeout:              time.Duration(getEnvInt("SANDBOX_TIMEOUT_MINUTES", 30)) * time.Minute,
+	GeoIPCityDB:                 getEnv("GEOIP_CITY_DB", ""),
+	GeoIPASNDB:                  getEnv("GEOIP_ASN_DB", ""),
+	VirusTotalAPIKey:            getEnv("VIRUSTOTAL_API_KEY", ""),
+	VirusTotalPerMinute:         getEnvInt("VIRUSTOTAL_REQUESTS_PER_MINUTE", 4), // public API limits
+	VirusTotalPerDay:            getEnvInt("VIRUSTOTAL_REQUESTS_PER_DAY", 500),
+	AbuseIPDBAPIKey:             getEnv("ABUSEIPDB_API_KEY", ""),
+	AbuseIPDBPerDay:             getEnvInt("ABUSEIPDB_REQUESTS_PER_DAY", 1000),
+	ReputationCacheTTL:          time.Duration(getEnvInt("REPUTATION_CACHE_HOURS", 24)) * time.Hour,
+	RDAPURL:                     getEnv("RDAP_URL", "https://rdap.org/domain/"),
+	ScreenshotServiceURL:        getEnv("SCREENSHOT_SERVICE_URL", ""),
+	ScreenshotProxyAddr:         getEnv("SCREENSHOT_PROXY_ADDR", ""),
+	ScreenshotProxyURL:          getEnv("SCREENSHOT_PROXY_URL", ""),
+	PhishingBrands: getEnv("PHISHING_BRANDS", "paypal=paypal.com,microsoft=microsoft.com|live.com|office.com|microsoftonline.com|outlook.com,"+
+		"office365=office.com|microsoftonline.com,apple=apple.com|icloud.com,google=google.com|gmail.com|youtube.com,amazon=amazon.com|amazon.co.uk,"+
+		"netflix=netflix.com,facebook=facebook.com|fb.com,instagram=instagram.com,linkedin=linkedin.com,dropbox=dropbox.com,docusign=docusign.com|docusign.net,"+
+		"chase=chase.com,wellsfargo=wellsfargo.com,bankofamerica=bankofamerica.com,dhl=dhl.com,fedex=fedex.com,adobe=adobe.com"),
+	StreamMaxConnections: getEnvInt("STREAM_MAX_CONNECTIONS", 100),
+	MitreRetention:       time.Duration(getEnvInt("MITRE_RETENTION_DAYS", 90)) * 24 * time.Hour,
+	ScanCacheTTL:         time.Duration(getEnvInt("SCAN_CACHE_HOURS", 24)) * time.Hour,
+	ScanVersionsKept:     getEnvInt("SCAN_VERSIONS_KEPT", 100),
+	Retention: RetentionPolicy{
+		Scans:      time.Duration(getEnvInt("RETENTION_SCANS_DAYS", 30)) * 24 * time.Hour,
+		Packets:    time.Duration(getEnvInt("RETENTION_PACKETS_DAYS", 7)) * 24 * time.Hour,
+		Indicators: time.Duration(getEnvInt("RETENTION_INDICATORS_DAYS", 90)) * 24 * time.Hour,
+		Archive:    time.Duration(getEnvInt("ARCHIVE_RETENTION_DAYS", 365)) * 24 * time.Hour,
+	},
+	RetentionInterval:       time.Duration(getEnvInt("RETENTION_INTERVAL_MINUTES", 60)) * time.Minute,
+	ArchiveS3Endpoint:       getEnv("ARCHIVE_S3_ENDPOINT", ""),
+	ArchiveS3Bucket:         getEnv("ARCHIVE_S3_BUCKET", ""),
+	ArchiveS3Region:         getEnv("ARCHIVE_S3_REGION", "us-east-1"),
+	ArchiveS3Prefix:         getEnv("ARCHIVE_S3_PREFIX", "cybersecurity-analyst"),
+	AlertMinSeverity:        getEnv("ALERT_MIN_SEVERITY", "high"),
+	AlertDedupWindow:        time.Duration(getEnvInt("ALERT_DEDUP_WINDOW_MINUTES", 60)) * time.Minute,
+	AlertMaxPerHour:         getEnvInt("ALERT_MAX_PER_HOUR", 30),
+	AlertEscalationPolicy:   getEnv("ALERT_ESCALATION_POLICY", ""),
+	PagerDutyRoutingKey:     getEnv("PAGERDUTY_ROUTING_KEY", ""),
+	PagerDutyEventsURL:      getEnv("PAGERDUTY_EVENTS_URL", "https://events.pagerduty.com/v2/enqueue"),
+	PagerDutyMinSeverity:    getEnv("PAGERDUTY_MIN_SEVERITY", "critical"),
+	OpsgenieAPIKey:          getEnv("OPSGENIE_API_KEY", ""),
+	OpsgenieAPIURL:          getEnv("OPSGENIE_API_URL", "https://api.opsgenie.com"),
+	OpsgenieMinSeverity:     getEnv("OPSGENIE_MIN_SEVERITY", "high"),
+	AlertSMTPAddr:           getEnv("ALERT_SMTP_ADDR", ""),
+	AlertSMTPUsername:       getEnv("ALERT_SMTP_USERNAME", ""),
+	AlertSMTPPassword:       getEnv("ALERT_SMTP_PASSWORD", ""),
+	AlertEmailFrom:          getEnv("ALERT_EMAIL_FROM", "cybersecurity-analyst@localhost"),
+	AlertEmailTo:            getEnv("ALERT_EMAIL_TO", ""),
+	AlertEmailMinSeverity:   getEnv("ALERT_EMAIL_MIN_SEVERITY", "high"),
+	AlertWebhookURL:         getEnv("ALERT_WEBHOOK_URL", ""),
+	AlertWebhookMinSeverity: getEnv("ALERT_WEBHOOK_MIN_SEVERITY", "high"),
+	APIKeys:                 getEnv("API_KEYS", ""),
+	APIKeyTenants:           getEnv("API_KEY_TENANTS", ""),
+	JWTSecret:               getEnv("JWT_SECRET", ""),
+	JWTIssuer:               getEnv("JWT_ISSUER", ""),
+	JWTAudience:             getEnv("JWT_AUDIENCE", ""),
+	AnalyzeRateLimit:        getEnvInt("ANALYZE_RATE_LIMIT", 120),
+	AnalyzeMaxConcurrent:    getEnvInt("ANALYZE_MAX_CONCURRENT", 50),
+	AnalyzeMaxBodyMB:        getEnvInt("ANALYZE_MAX_BODY_MB", 10),
 }
 
 // Metrics
@@ -114,6 +392,8 @@ const (
 	Brute        ThreatType = "brute_force"
 	SQLInjection ThreatType = "sql_injection"
 	XSS          ThreatType = "xss"
+	Anomaly      ThreatType = "anomaly"
+	Exposure     ThreatType = "vulnerability" // a watched CVE affecting registered software
 )
 
 type NetworkPacket struct {
@@ -129,49 +409,76 @@ type NetworkPacket struct {
 }
 
 type ThreatDetectionRequest struct {
-	ScanID      string           `json:"scan_id"`
-	ScanType    string           `json:"scan_type"` // "network", "vulnerability", "behavioral"
-	Target      string           `json:"target"`
-	Packets     []NetworkPacket  `json:"packets,omitempty"`
-	DeepAnalysis bool            `json:"deep_analysis"`
+	ScanID         string                `json:"scan_id"`
+	ScanType       string                `json:"scan_type"`        // "network", "vulnerability", "behavioral"
+	Target         string                `json:"target"`           // host or network; for vulnerability scans, a registered asset's ID, hostname, or address
+	Assets         []string              `json:"assets,omitempty"` // registered asset IDs for vulnerability scans
+	Ports          string                `json:"ports,omitempty"`  // nmap port list for host targets; top 1000 ports when empty
+	Packets        []NetworkPacket       `json:"packets,omitempty"`
+	Software       []SoftwareFingerprint `json:"software,omitempty"`        // installed software checked for CVEs
+	LogEvents      []LogEvent            `json:"log_events,omitempty"`      // evaluated against Sigma rules
+	AuthEvents     []AuthEvent           `json:"auth_events,omitempty"`     // counted for brute force and credential stuffing
+	EndpointEvents []EndpointEvent       `json:"endpoint_events,omitempty"` // endpoint agent telemetry, recorded and evaluated against Sigma rules
+	HoneypotEvents []HoneypotEvent       `json:"honeypot_events,omitempty"` // decoy interactions; their sources are profiled and blocklisted
+	DeepAnalysis   bool                  `json:"deep_analysis"`
 }
 
 type Vulnerability struct {
-	CVE         string      `json:"cve"`
-	Severity    ThreatLevel `json:"severity"`
-	Score       float64     `json:"score"` // CVSS score
-	Description string      `json:"description"`
-	Remediation string      `json:"remediation"`
-	AffectedSystems []string `json:"affected_systems"`
+	CVE             string      `json:"cve"`
+	Severity        ThreatLevel `json:"severity"`
+	Score           float64     `json:"score"` // CVSS score
+	Description     string      `json:"description"`
+	Remediation     string      `json:"remediation"`
+	AffectedSystems []string    `json:"affected_systems"`
+	Assets          []string    `json:"assets,omitempty"`          // registered assets affected
+	KnownExploited  bool        `json:"known_exploited,omitempty"` // listed in the CISA KEV catalog
+	EPSS            float64     `json:"epss,omitempty"`            // FIRST probability of exploitation in the next 30 days
+	EPSSPercentile  float64     `json:"epss_percentile,omitempty"`
 }
 
 type ThreatIndicator struct {
-	Type        ThreatType  `json:"type"`
-	Severity    ThreatLevel `json:"severity"`
-	Confidence  float64     `json:"confidence"`
-	Description string      `json:"description"`
-	SourceIP    string      `json:"source_ip,omitempty"`
-	DestIP      string      `json:"dest_ip,omitempty"`
-	MITREAttack string      `json:"mitre_attack,omitempty"` // MITRE ATT&CK ID
-	Evidence    []string    `json:"evidence"`
+	Type        ThreatType       `json:"type"`
+	Severity    ThreatLevel      `json:"severity"`
+	Confidence  float64          `json:"confidence"`
+	Description string           `json:"description"`
+	SourceIP    string           `json:"source_ip,omitempty"`
+	DestIP      string           `json:"dest_ip,omitempty"`
+	MITREAttack string           `json:"mitre_attack,omitempty"` // MITRE ATT&CK ID
+	Evidence    []string         `json:"evidence"`
+	SourceGeo   *GeoInfo         `json:"source_geo,omitempty"`
+	DestGeo     *GeoInfo         `json:"dest_geo,omitempty"`
+	Observables []string         `json:"observables,omitempty"` // domains and file hashes from the evidence
+	Asset       string           `json:"asset,omitempty"`       // most critical registered asset involved
+	Tenant      string           `json:"tenant,omitempty"`      // set for tenants other than the default
+	Endpoint    *EndpointContext `json:"endpoint,omitempty"`    // process on a monitored endpoint behind the indicator
+	CVE         string           `json:"cve,omitempty"`         // vulnerability the indicator reports exposure to
 }
 
 type ThreatDetectionResponse struct {
-	ScanID          string             `json:"scan_id"`
-	Timestamp       time.Time          `json:"timestamp"`
-	ThreatIndicators []ThreatIndicator `json:"threat_indicators"`
-	Vulnerabilities  []Vulnerability   `json:"vulnerabilities"`
+	ScanID           string              `json:"scan_id"`
+	Timestamp        time.Time           `json:"timestamp"`
+	ThreatIndicators []ThreatIndicator   `json:"threat_indicators"`
+	Vulnerabilities  []Vulnerability     `json:"vulnerabilities"`
+	Services         []DiscoveredService `json:"services,omitempty"`   // open ports found on host targets
+	Endpoints        map[string]*GeoInfo `json:"endpoints,omitempty"`  // location of public addresses in the packets
+	TLS              []TLSClientHello    `json:"tls,omitempty"`        // fingerprinted TLS ClientHellos in the packets
+	Reputation       []ReputationReport  `json:"reputation,omitempty"` // external verdicts on indicator IOCs
 	RiskScore        float64           `json:"risk_score"` // 0-100
 	Recommendations  []string          `json:"recommendations"`
 	ProcessingTimeMS int64             `json:"processing_time_ms"`
 }
 
 type IncidentResponse struct {
-	IncidentID    string      `json:"incident_id"`
-	Action        string      `json:"action"` // "block", "alert", "quarantine", "investigate"
-	Reason        string      `json:"reason"`
-	Timestamp     time.Time   `json:"timestamp"`
-	AutomatedSteps []string   `json:"automated_steps"`
+	IncidentID     string         `json:"incident_id"`
+	Action         string         `json:"action"` // "block", "alert", "quarantine", "investigate", "disable_account", "release"
+	Target         string         `json:"target"`
+	Reason         string         `json:"reason"`
+	Mode           ResponseMode   `json:"mode"`
+	RequestedBy    string         `json:"requested_by,omitempty"` // client or analyst that asked for the response; "system" for automatic ones
+	Status         string         `json:"status"`                 // "planned", "audited", "completed", "partial", "failed"
+	Timestamp      time.Time      `json:"timestamp"`
+	AutomatedSteps []string       `json:"automated_steps"`
+	Steps          []ResponseStep `json:"steps"`
 }
 
 // Services
@@ -179,59 +486,189 @@ type ThreatDetector struct {
 	redis        *redis.Client
 	claudeClient *ClaudeClient
 	cveDatabase  *CVEDatabase
+	scanner      *NmapScanner
+	geo          *GeoIP
+	reputation   *ReputationEnricher
+	assets       *AssetRegistry
+	findings     *FindingStore
+	baselines    *BaselineEngine
+	ddos         *DDoSDetector
+	authWindows  *AuthWindows
+	ueba         *UserBehaviorAnalytics
+	phishing     *PhishingAnalyzer
+	files        *FileScanner
+	sandbox      *Sandbox
+	endpoints    *EndpointTelemetry
+	honeypots    *HoneypotMonitor
+	history      *HistoryStore
+	scanVersions *ScanVersions
+	packetPool   *PacketPool
+	campaigns    *CampaignCorrelator
+	sigma        *SigmaEngine
+	siem         *SIEMForwarder
+	alerts       *AlertRouter
+	lists        *AccessLists
+	tenants      *TenantRegistry
+	detections   *DetectionHub
+	watchlists   *CVEWatchlists
+	epss         *EPSSClient
+	quarantine   *QuarantineQueue
 	mu           sync.RWMutex
 	signatures   map[string]ThreatSignature
+
+	indexMu          sync.Mutex // serializes index rebuilds so the newest signature set wins
+	packetSignatures atomic.Pointer[signatureIndex]
 }
 
 type ThreatSignature struct {
-	ID          string
-	Type        ThreatType
-	Pattern     string
-	Severity    ThreatLevel
-	MITREAttack string
+	ID          string         `json:"id"`
+	Type        ThreatType     `json:"type"`
+	Pattern     string         `json:"pattern,omitempty"`
+	Scope       SignatureScope `json:"scope"`
+	Severity    ThreatLevel    `json:"severity"`
+	MITREAttack string         `json:"mitre_attack,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Source      string         `json:"source"` // "builtin", "custom", "sigma", "ids" for imported Snort/Suricata rules, or "intel" for imported TLS fingerprints
+	Revision    int            `json:"revision,omitempty"`
+	Match       *PacketMatch   `json:"match,omitempty"`
 }
 
-func NewThreatDetector(redisClient *redis.Client, claudeClient *ClaudeClient) *ThreatDetector {
+func NewThreatDetector(redisClient *redis.Client, claudeClient *ClaudeClient, cveDatabase *CVEDatabase, scanner *NmapScanner, geo *GeoIP, siemForwarder *SIEMForwarder, alertRouter *AlertRouter, tenants *TenantRegistry, yara *YARAScanner, history *HistoryStore, scanVersions *ScanVersions) *ThreatDetector {
 	td := &ThreatDetector{
 		redis:        redisClient,
 		claudeClient: claudeClient,
-		cveDatabase:  NewCVEDatabase(),
-		signatures:   make(map[string]ThreatSignature),
+		cveDatabase:  cveDatabase,
+		scanner:      scanner,
+		geo:          geo,
+		reputation:   NewReputationEnricher(redisClient, reputationSourcesFromConfig(), config.ReputationCacheTTL),
+		assets:       NewAssetRegistry(redisClient),
+		findings:     NewFindingStore(redisClient),
+		baselines:    NewBaselineEngine(redisClient, config.BaselineSensitivity),
+		ddos:         NewDDoSDetector(config.DDoSSensitivity),
+		campaigns:    NewCampaignCorrelator(redisClient, config.CampaignWindow),
+		authWindows:  NewAuthWindows(redisClient, config.AuthFailureWindow, config.BruteForceThreshold, config.CredentialStuffingThreshold),
+		ueba:         NewUserBehaviorAnalytics(redisClient, geo, config.UEBADormantAfter, config.UEBAMaxTravelKmh, config.UEBAMinLogins),
+		siem:         siemForwarder,
+		alerts:       alertRouter,
+		lists:        NewAccessLists(redisClient),
+		tenants:      tenants,
+		history:      history,
+		scanVersions: scanVersions,
+		epss:         NewEPSSClient(redisClient, config.EPSSURL),
+		detections:   NewDetectionHub(),
+		signatures:   builtinSignatures(),
 	}
+	td.sigma = NewSigmaEngine(redisClient, td)
+	td.files = NewFileScanner(redisClient, td, yara, int64(config.FileScanMaxMB)<<20)
+	td.sandbox = NewSandbox(redisClient, td, sandboxBackendFromConfig(), config.SandboxMinScore, config.SandboxMinPayloadBytes, config.SandboxPollInterval, config.SandboxTimeout)
+	td.endpoints = NewEndpointTelemetry(redisClient, td, config.EndpointRetention)
+	td.honeypots = NewHoneypotMonitor(redisClient, td, config.HoneypotAutoBlock, config.HoneypotRetention)
+	td.phishing = NewPhishingAnalyzer(redisClient, td, config.RDAPURL, config.ScreenshotServiceURL, config.ScreenshotProxyURL, config.PhishingBrands)
+	td.watchlists = NewCVEWatchlists(redisClient, td, td.epss)
+	td.packetPool = NewPacketPool(td, config.PacketWorkers, config.PacketChunkSize, config.PacketQueueSize, config.PacketQueueTimeout)
 
 	// Load threat signatures
-	td.loadThreatSignatures()
+	td.rebuildSignatureIndex()
+	log.Printf("Loaded %d threat signatures", len(td.signatures))
 
 	return td
 }
 
-func (td *ThreatDetector) loadThreatSignatures() {
+// builtinSignatures returns the default signatures, keyed by ID. Pattern signatures can be
+// overridden through the API; behavioral ones name a detector implemented in code and are read-only.
+func builtinSignatures() map[string]ThreatSignature {
+	signatures := make(map[string]ThreatSignature)
+
 	// Common threat signatures (simplified for example)
-	td.signatures["sql_injection"] = ThreatSignature{
+	signatures["sig_001"] = ThreatSignature{
 		ID:          "sig_001",
 		Type:        SQLInjection,
 		Pattern:     "(?i)(union.*select|insert.*into|delete.*from|drop.*table)",
+		Scope:       ScopeURI,
 		Severity:    High,
 		MITREAttack: "T1190",
+		Description: "SQL injection in request URI",
+		Source:      "builtin",
 	}
 
-	td.signatures["port_scan"] = ThreatSignature{
+	signatures["sig_002"] = ThreatSignature{
 		ID:          "sig_002",
 		Type:        Intrusion,
 		Pattern:     "multiple_ports_short_time",
+		Scope:       ScopeBehavioral,
 		Severity:    Medium,
 		MITREAttack: "T1046",
+		Description: "Port scan",
+		Source:      "builtin",
 	}
 
-	td.signatures["brute_force"] = ThreatSignature{
+	signatures["sig_003"] = ThreatSignature{
 		ID:          "sig_003",
 		Type:        Brute,
-		Pattern:     "repeated_failed_auth",
+		Pattern:     "failed_auth_per_account_window",
+		Scope:       ScopeBehavioral,
 		Severity:    High,
-		MITREAttack: "T1110",
+		MITREAttack: "T1110.001",
+		Description: "Brute force authentication",
+		Source:      "builtin",
 	}
 
-	log.Printf("Loaded %d threat signatures", len(td.signatures))
+	signatures["sig_004"] = ThreatSignature{
+		ID:          "sig_004",
+		Type:        Brute,
+		Pattern:     "failed_auth_distinct_accounts_window",
+		Scope:       ScopeBehavioral,
+		Severity:    High,
+		MITREAttack: "T1110.004",
+		Description: "Credential stuffing",
+		Source:      "builtin",
+	}
+
+	signatures["sig_005"] = ThreatSignature{
+		ID:          "sig_005",
+		Type:        Brute,
+		Pattern:     "auth_success_after_failures",
+		Scope:       ScopeBehavioral,
+		Severity:    Critical,
+		MITREAttack: "T1078",
+		Description: "Successful login after brute force",
+		Source:      "builtin",
+	}
+
+	signatures["sig_006"] = ThreatSignature{
+		ID:          "sig_006",
+		Type:        Anomaly,
+		Pattern:     "ueba_impossible_travel",
+		Scope:       ScopeBehavioral,
+		Severity:    High,
+		MITREAttack: "T1078",
+		Description: "Impossible travel",
+		Source:      "builtin",
+	}
+
+	signatures["sig_007"] = ThreatSignature{
+		ID:          "sig_007",
+		Type:        Anomaly,
+		Pattern:     "ueba_dormant_account",
+		Scope:       ScopeBehavioral,
+		Severity:    High,
+		MITREAttack: "T1078",
+		Description: "Dormant account reactivated",
+		Source:      "builtin",
+	}
+
+	signatures["sig_008"] = ThreatSignature{
+		ID:          "sig_008",
+		Type:        Anomaly,
+		Pattern:     "ueba_unusual_privilege",
+		Scope:       ScopeBehavioral,
+		Severity:    High,
+		MITREAttack: "T1078.002",
+		Description: "Unusual privilege use",
+		Source:      "builtin",
+	}
+
+	return signatures
 }
 
 func (td *ThreatDetector) AnalyzeTraffic(ctx context.Context, req *ThreatDetectionRequest) (*ThreatDetectionResponse, error) {
@@ -251,21 +688,129 @@ func (td *ThreatDetector) AnalyzeTraffic(ctx context.Context, req *ThreatDetecti
 
 	// Analyze packets for threats
 	if len(req.Packets) > 0 {
-		threats := td.detectPacketThreats(req.Packets)
+		threats, err := td.packetPool.Detect(ctx, req.Packets)
+		if err != nil {
+			return nil, err
+		}
 		response.ThreatIndicators = append(response.ThreatIndicators, threats...)
+		response.ThreatIndicators = append(response.ThreatIndicators, td.ddos.Evaluate(ctx, req.Packets)...)
+
+		// Compare senders with their learned traffic profiles; baselines are trained by the
+		// operator's sensors, so other tenants' traffic is not compared with them
+		if tenantFromContext(ctx) == defaultTenant {
+			anomalies := td.baselines.Evaluate(ctx, req.Packets)
+			response.ThreatIndicators = append(response.ThreatIndicators, anomalies...)
+		}
 
 		packetsProcessed.Add(float64(len(req.Packets)))
 	}
 
-	// Perform vulnerability scan
+	// Match log events against Sigma rules; located sources let rules match on source_geo
+	if len(req.LogEvents) > 0 {
+		td.geo.EnrichEvents(req.LogEvents)
+		threats := td.sigma.Evaluate(req.LogEvents)
+		response.ThreatIndicators = append(response.ThreatIndicators, threats...)
+
+		logEventsProcessed.Add(float64(len(req.LogEvents)))
+	}
+
+	// Count failed logins per source and account over sliding windows, and compare successful
+	// ones with the accounts' login profiles
+	if len(req.AuthEvents) > 0 {
+		threats, err := td.authWindows.Evaluate(ctx, req.AuthEvents)
+		if err != nil {
+			return nil, err
+		}
+		response.ThreatIndicators = append(response.ThreatIndicators, threats...)
+
+		anomalies, err := td.ueba.Evaluate(ctx, req.AuthEvents)
+		if err != nil {
+			return nil, err
+		}
+		response.ThreatIndicators = append(response.ThreatIndicators, anomalies...)
+	}
+
+	// Record endpoint process trees and connections, then evaluate the events against Sigma rules
+	if len(req.EndpointEvents) > 0 {
+		if err := td.endpoints.Record(ctx, req.EndpointEvents); err != nil {
+			return nil, err
+		}
+		threats := td.endpoints.Evaluate(ctx, req.EndpointEvents)
+		response.ThreatIndicators = append(response.ThreatIndicators, threats...)
+	}
+
+	// Profile and blocklist honeypot attackers; blocklisting them here also escalates these indicators
+	if len(req.HoneypotEvents) > 0 {
+		threats, err := td.honeypots.Evaluate(ctx, req.HoneypotEvents)
+		if err != nil {
+			return nil, err
+		}
+		response.ThreatIndicators = append(response.ThreatIndicators, threats...)
+	}
+
+	// Discover services on host and network targets
+	if td.scanner.applies(req) {
+		services, err := td.scanner.Scan(ctx, req.Target, req.Ports)
+		if err != nil {
+			return nil, err
+		}
+		response.Services = services
+	}
+
+	// Perform vulnerability scan of registered assets
+	var scanned []Asset
 	if req.ScanType == "vulnerability" {
-		vulns := td.scanVulnerabilities(req.Target)
+		assets, err := td.assets.resolve(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		scanned = assets
+		services, err := td.discoverAssets(ctx, assets, req.Ports)
+		if err != nil {
+			return nil, err
+		}
+		for _, asset := range assets {
+			response.Services = append(response.Services, services[asset.ID]...)
+		}
+
+		vulns, err := td.scanVulnerabilities(ctx, req, assets, services)
+		if err != nil {
+			return nil, err
+		}
+		td.enrichEPSS(ctx, vulns)
 		response.Vulnerabilities = append(response.Vulnerabilities, vulns...)
 	}
 
+	// Drop indicators from allowlisted sources and escalate those involving blocklisted ones
+	response.ThreatIndicators = td.lists.Apply(ctx, response.ThreatIndicators)
+
+	// Apply the tenant's confidence threshold
+	response.ThreatIndicators = td.tenants.Apply(ctx, response.ThreatIndicators)
+
+	// Attribute findings to registered assets, whose criticality weights the risk score
+	assetIndex, err := td.assets.index(ctx)
+	if err != nil {
+		log.Printf("Risk score not weighted by asset criticality: %v", err)
+	}
+	assetIndex.annotate(response.ThreatIndicators)
+
+	// Locate indicators and packet endpoints
+	td.geo.Enrich(response.ThreatIndicators)
+	response.Endpoints = td.geo.Endpoints(req.Packets)
+
+	// Trace indicators involving monitored endpoints to the process behind the connection
+	td.endpoints.Annotate(ctx, response.ThreatIndicators)
+
+	// Fingerprint TLS clients, which identifies them even when the payloads are encrypted
+	response.TLS = tlsClientHellos(req.Packets)
+
+	// Check indicator IOCs against reputation services; corroborated indicators gain confidence
+	response.Reputation = td.reputation.Enrich(ctx, response.ThreatIndicators)
+
 	// Deep analysis using Claude AI
 	if req.DeepAnalysis && len(response.ThreatIndicators) > 0 {
-		aiInsights, err := td.claudeClient.AnalyzeThreat(ctx, response.ThreatIndicators)
+		ttps := td.honeypots.ttpContext(ctx, response.ThreatIndicators)
+		aiInsights, err := td.claudeClient.AnalyzeThreat(ctx, response.ThreatIndicators, ttps)
 		if err != nil {
 			log.Printf("Claude analysis failed: %v", err)
 		} else {
@@ -274,7 +819,7 @@ func (td *ThreatDetector) AnalyzeTraffic(ctx context.Context, req *ThreatDetecti
 	}
 
 	// Calculate risk score
-	response.RiskScore = td.calculateRiskScore(response)
+	response.RiskScore = td.calculateRiskScore(response, assetIndex)
 
 	// Add default recommendations
 	if len(response.Recommendations) == 0 {
@@ -285,6 +830,8 @@ func (td *ThreatDetector) AnalyzeTraffic(ctx context.Context, req *ThreatDetecti
 	for _, threat := range response.ThreatIndicators {
 		threatsDetected.WithLabelValues(string(threat.Severity), string(threat.Type)).Inc()
 	}
+	td.recordDetections(ctx, response.ThreatIndicators)
+	td.campaigns.Record(ctx, req.ScanType, req.ScanID, response.ThreatIndicators)
 
 	for _, vuln := range response.Vulnerabilities {
 		vulnerabilitiesFound.WithLabelValues(string(vuln.Severity), vuln.CVE).Inc()
@@ -292,95 +839,91 @@ func (td *ThreatDetector) AnalyzeTraffic(ctx context.Context, req *ThreatDetecti
 
 	response.ProcessingTimeMS = time.Since(start).Milliseconds()
 
-	// Cache results
+	// Cache results, and keep them with the scan's packets and indicators for investigations;
+	// vulnerability scans are also versioned per target for diffs
 	td.cacheResults(ctx, req.ScanID, response)
+	td.history.RecordScan(ctx, req, response)
+	td.scanVersions.Record(ctx, req, response)
 
-	return response, nil
-}
+	// Track findings until they are remediated
+	td.findings.Record(ctx, req, response, scanned, assetIndex)
 
-func (td *ThreatDetector) detectPacketThreats(packets []NetworkPacket) []ThreatIndicator {
-	threats := make([]ThreatIndicator, 0)
+	// Forward to configured SIEMs
+	td.siem.ForwardScan(ctx, req, response)
 
-	// Port scan detection
-	portAccessMap := make(map[string]map[int]int) // IP -> port -> count
+	// Page on-call for high-severity indicators
+	td.alerts.Route(ctx, req.ScanType, response.ThreatIndicators)
 
-	for _, packet := range packets {
-		if portAccessMap[packet.SourceIP] == nil {
-			portAccessMap[packet.SourceIP] = make(map[int]int)
-		}
-		portAccessMap[packet.SourceIP][packet.DestPort]++
-
-		// Check for suspicious patterns
-		if packet.PayloadSize > 10000 && packet.Protocol == "TCP" {
-			threats = append(threats, ThreatIndicator{
-				Type:        DataExfil,
-				Severity:    Medium,
-				Confidence:  0.65,
-				Description: "Large data transfer detected",
-				SourceIP:    packet.SourceIP,
-				DestIP:      packet.DestIP,
-				MITREAttack: "T1048",
-				Evidence:    []string{fmt.Sprintf("Payload size: %d bytes", packet.PayloadSize)},
-			})
-		}
+	// Propose quarantining hosts implicated by the most severe indicators, for analyst approval
+	td.quarantine.Propose(ctx, req.ScanID, response.ThreatIndicators)
+
+	// Detonate suspicious payloads in the sandbox; their reports are merged into this scan when ready
+	td.sandbox.ScreenPayloads(ctx, req.ScanID, req.Packets)
 
-		// SYN flood detection
-		if packet.Flags["SYN"] && !packet.Flags["ACK"] {
-			// Simplified: would need more sophisticated detection
-			if packet.SourcePort < 1024 && packet.DestPort == 80 {
-				threats = append(threats, ThreatIndicator{
-					Type:        DDoS,
-					Severity:    High,
-					Confidence:  0.72,
-					Description: "Potential SYN flood attack",
-					SourceIP:    packet.SourceIP,
-					DestIP:      packet.DestIP,
-					MITREAttack: "T1498",
-					Evidence:    []string{"Multiple SYN packets without ACK"},
-				})
+	// Stream the indicators to gRPC subscribers
+	td.detections.Publish(ctx, req.ScanType, response.ThreatIndicators)
+
+	return response, nil
+}
+
+// detectPacketThreats inspects packets in one pass on the calling goroutine, for the small batches
+// of live capture and streams; AnalyzeTraffic spreads large sets over the packet pool
+func (td *ThreatDetector) detectPacketThreats(ctx context.Context, packets []NetworkPacket) []ThreatIndicator {
+	return td.inspectPackets(td.packetMatcher(ctx), packets).indicators()
+}
+
+func (td *ThreatDetector) scanVulnerabilities(ctx context.Context, req *ThreatDetectionRequest, assets []Asset, services map[string][]DiscoveredService) ([]Vulnerability, error) {
+	vulns := make([]Vulnerability, 0)
+	index := make(map[string]int)
+	add := func(entries []CVEEntry, system, asset string) {
+		for _, cve := range entries {
+			i, ok := index[cve.ID]
+			if !ok {
+				index[cve.ID] = len(vulns)
+				vulns = append(vulns, cve.vulnerability([]string{system}))
+				i = len(vulns) - 1
+			} else if affected := vulns[i].AffectedSystems; affected[len(affected)-1] != system {
+				vulns[i].AffectedSystems = append(affected, system)
+			}
+			if asset != "" && (len(vulns[i].Assets) == 0 || vulns[i].Assets[len(vulns[i].Assets)-1] != asset) {
+				vulns[i].Assets = append(vulns[i].Assets, asset)
 			}
 		}
 	}
-
-	// Detect port scans
-	for ip, ports := range portAccessMap {
-		if len(ports) > 20 {
-			threats = append(threats, ThreatIndicator{
-				Type:        Intrusion,
-				Severity:    High,
-				Confidence:  0.88,
-				Description: "Port scan detected",
-				SourceIP:    ip,
-				MITREAttack: "T1046",
-				Evidence:    []string{fmt.Sprintf("Accessed %d different ports", len(ports))},
-			})
+	search := func(fingerprints []SoftwareFingerprint, system, asset string) error {
+		for _, fingerprint := range fingerprints {
+			entries, err := td.cveDatabase.Search(ctx, fingerprint)
+			if err != nil {
+				return err
+			}
+			add(entries, system, asset)
 		}
+		return nil
 	}
 
-	return threats
-}
-
-func (td *ThreatDetector) scanVulnerabilities(target string) []Vulnerability {
-	vulns := make([]Vulnerability, 0)
+	// Software listed in the request is checked on its own
+	if err := search(req.Software, "software", ""); err != nil {
+		return nil, err
+	}
 
-	// Simulate CVE database lookup
-	knownVulns := td.cveDatabase.SearchByTarget(target)
-
-	for _, cve := range knownVulns {
-		vulns = append(vulns, Vulnerability{
-			CVE:         cve.ID,
-			Severity:    cve.Severity,
-			Score:       cve.CVSSScore,
-			Description: cve.Description,
-			Remediation: cve.Remediation,
-			AffectedSystems: []string{target},
-		})
+	// Registered software affects the asset; services affect the host and port they run on
+	for _, asset := range assets {
+		if err := search(asset.Software, asset.ID, asset.ID); err != nil {
+			return nil, err
+		}
+		for _, service := range services[asset.ID] {
+			system := net.JoinHostPort(service.Host, strconv.Itoa(service.Port))
+			if err := search(service.fingerprints(), system, asset.ID); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	return vulns
+	return vulns, nil
 }
 
-func (td *ThreatDetector) calculateRiskScore(response *ThreatDetectionResponse) float64 {
+// calculateRiskScore sums finding weights, scaled by the criticality of the assets involved
+func (td *ThreatDetector) calculateRiskScore(response *ThreatDetectionResponse, assets *assetIndex) float64 {
 	score := 0.0
 
 	// Threat indicators contribute to score
@@ -396,12 +939,12 @@ func (td *ThreatDetector) calculateRiskScore(response *ThreatDetectionResponse)
 		case Low:
 			weight = 3.0
 		}
-		score += weight * threat.Confidence
+		score += weight * threat.Confidence * assets.weight(threat.Asset)
 	}
 
 	// Vulnerabilities contribute to score
 	for _, vuln := range response.Vulnerabilities {
-		score += vuln.Score // CVSS score 0-10
+		score += vuln.Score * assets.weight(vuln.Assets...) // CVSS score 0-10
 	}
 
 	// Normalize to 0-100
@@ -429,6 +972,8 @@ func (td *ThreatDetector) generateRecommendations(response *ThreatDetectionRespo
 			recommendations = append(recommendations, "Enable DDoS mitigation (rate limiting, traffic filtering)")
 		case DataExfil:
 			recommendations = append(recommendations, "Monitor outbound traffic and enable DLP policies")
+		case Anomaly:
+			recommendations = append(recommendations, fmt.Sprintf("Verify recent activity of %s with its owner; reset its baseline if the change is expected", threat.SourceIP))
 		}
 	}
 
@@ -452,57 +997,13 @@ func (td *ThreatDetector) cacheResults(ctx context.Context, scanID string, respo
 		return
 	}
 
-	cacheKey := fmt.Sprintf("scan:%s", scanID)
-	err = td.redis.Set(ctx, cacheKey, data, 24*time.Hour).Err()
+	cacheKey := tenantKey(ctx, fmt.Sprintf("scan:%s", scanID))
+	err = td.redis.Set(ctx, cacheKey, data, config.ScanCacheTTL).Err()
 	if err != nil {
 		log.Printf("Failed to cache results: %v", err)
 	}
 }
 
-// CVE Database (simplified)
-type CVEDatabase struct {
-	vulnerabilities map[string][]CVEEntry
-}
-
-type CVEEntry struct {
-	ID          string
-	Severity    ThreatLevel
-	CVSSScore   float64
-	Description string
-	Remediation string
-}
-
-func NewCVEDatabase() *CVEDatabase {
-	db := &CVEDatabase{
-		vulnerabilities: make(map[string][]CVEEntry),
-	}
-
-	// Populate with sample CVEs
-	db.vulnerabilities["*"] = []CVEEntry{
-		{
-			ID:          "CVE-2024-1234",
-			Severity:    Critical,
-			CVSSScore:   9.8,
-			Description: "Remote code execution vulnerability in web server",
-			Remediation: "Update to version 2.4.58 or later",
-		},
-		{
-			ID:          "CVE-2024-5678",
-			Severity:    High,
-			CVSSScore:   8.1,
-			Description: "SQL injection vulnerability in authentication module",
-			Remediation: "Apply security patch SP-2024-01",
-		},
-	}
-
-	return db
-}
-
-func (db *CVEDatabase) SearchByTarget(target string) []CVEEntry {
-	// Simplified: return all vulnerabilities
-	return db.vulnerabilities["*"]
-}
-
 // Claude AI Integration
 type ClaudeClient struct {
 	apiKey string
@@ -522,15 +1023,21 @@ type ThreatAnalysisInsights struct {
 	Recommendations []string    `json:"recommendations"`
 }
 
-func (c *ClaudeClient) AnalyzeThreat(ctx context.Context, threats []ThreatIndicator) (*ThreatAnalysisInsights, error) {
+// AnalyzeThreat asks Claude for recommendations; ttps summarize what the threats' sources did on
+// the honeypots, which shows their intent better than the indicators alone
+func (c *ClaudeClient) AnalyzeThreat(ctx context.Context, threats []ThreatIndicator, ttps []string) (*ThreatAnalysisInsights, error) {
 	// Build prompt
 	threatsJSON, _ := json.MarshalIndent(threats, "", "  ")
+	honeypotSection := ""
+	if len(ttps) > 0 {
+		honeypotSection = "\nATTACKER TTPs OBSERVED ON HONEYPOTS:\n- " + strings.Join(ttps, "\n- ") + "\n"
+	}
 
 	prompt := fmt.Sprintf(`Analyze these security threats and provide expert recommendations:
 
 THREATS DETECTED:
 %s
-
+%s
 Provide a JSON response with:
 {
   "severity": "critical|high|medium|low",
@@ -542,9 +1049,10 @@ Focus on:
 1. Most critical threats requiring immediate action
 2. Potential attack chains
 3. Specific remediation steps
-4. Prevention strategies`, string(threatsJSON))
+4. Prevention strategies`, string(threatsJSON), honeypotSection)
 
 	// Simulate Claude API call (in production, use actual Anthropic SDK)
+	_ = prompt
 	insights := &ThreatAnalysisInsights{
 		Severity: High,
 		Summary:  "Multiple high-severity threats detected requiring immediate attention",
@@ -556,6 +1064,10 @@ Focus on:
 			"Review and update incident response playbooks",
 		},
 	}
+	if len(ttps) > 0 {
+		insights.Recommendations = append(insights.Recommendations,
+			"Hunt for the honeypot attackers' commands and credentials on production hosts")
+	}
 
 	log.Printf("Claude analysis completed for %d threats", len(threats))
 
@@ -565,11 +1077,27 @@ Focus on:
 // HTTP Handlers
 type APIServer struct {
 	threatDetector *ThreatDetector
+	packetCapture  *PacketCapture
+	flowCollector  *FlowCollector
+	syslog         *SyslogListener
+	responder      *IncidentResponder
+	scheduler      *ScanScheduler
+	streams        *AnalysisStreams
+	compliance     *ComplianceReporter
+	incidents      *IncidentReporter
 }
 
-func NewAPIServer(threatDetector *ThreatDetector) *APIServer {
+func NewAPIServer(threatDetector *ThreatDetector, packetCapture *PacketCapture, flowCollector *FlowCollector, syslog *SyslogListener, responder *IncidentResponder, scheduler *ScanScheduler, streams *AnalysisStreams, compliance *ComplianceReporter, incidents *IncidentReporter) *APIServer {
 	return &APIServer{
 		threatDetector: threatDetector,
+		packetCapture:  packetCapture,
+		flowCollector:  flowCollector,
+		syslog:         syslog,
+		responder:      responder,
+		scheduler:      scheduler,
+		streams:        streams,
+		compliance:     compliance,
+		incidents:      incidents,
 	}
 }
 
@@ -577,6 +1105,11 @@ func (s *APIServer) analyzeThreatHandler(c *gin.Context) {
 	var req ThreatDetectionRequest
 
 	if err := c.ShouldBindJSON(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
@@ -587,12 +1120,21 @@ func (s *APIServer) analyzeThreatHandler(c *gin.Context) {
 	}
 
 	response, err := s.threatDetector.AnalyzeTraffic(c.Request.Context(), &req)
-	if err != nil {
+	switch {
+	case errors.Is(err, errInvalidScanTarget):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errScanTargetNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, errScanRateLimited):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	case errors.Is(err, errPacketPoolBusy), errors.Is(err, errPacketPoolStopped):
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	case err != nil:
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	default:
+		c.JSON(http.StatusOK, response)
 	}
-
-	c.JSON(http.StatusOK, response)
 }
 
 func (s *APIServer) healthCheckHandler(c *gin.Context) {
@@ -626,14 +1168,202 @@ func main() {
 		log.Println("Connected to Redis")
 	}
 
+	// Initialize Postgres
+	db, err := sql.Open("postgres", config.DatabaseURL)
+	if err != nil {
+		log.Fatalf("Invalid database URL: %v", err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		log.Printf("Warning: Database not available: %v", err)
+	} else {
+		log.Println("Connected to database")
+	}
+
 	// Initialize Claude client
 	claudeClient := NewClaudeClient(config.ClaudeAPIKey, config.ClaudeModel)
 
+	// Initialize CVE database
+	cveDatabase := NewCVEDatabase(db)
+
+	// Load the tenants served by this instance, and keep them in step with other replicas
+	tenants := NewTenantRegistry(redisClient)
+	if err := tenants.Load(ctx); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	tenantCtx, stopTenants := context.WithCancel(context.Background())
+	tenantRefreshing := tenants.Start(tenantCtx)
+
+	// Forward threat events to configured SIEMs
+	siemForwarder := NewSIEMForwarder(siemDestinationsFromConfig(), config.SIEMBatchSize, config.SIEMFlushInterval, config.SIEMMinRiskScore)
+	forwardCtx, stopForwarding := context.WithCancel(context.Background())
+	forwarding := siemForwarder.Start(forwardCtx)
+
+	// Keep scan, packet, and indicator history, archiving it to object storage as it ages
+	archive, err := NewObjectStore(config.ArchiveS3Endpoint, config.ArchiveS3Bucket, config.ArchiveS3Region)
+	if err != nil {
+		log.Fatalf("Invalid archive configuration: %v", err)
+	}
+	history := NewHistoryStore(db, archive, config.ArchiveS3Prefix, config.Retention, config.RetentionInterval)
+	historyCtx, stopHistory := context.WithCancel(context.Background())
+	historyWriting := history.Start(historyCtx)
+
+	// Route high-severity indicators to on-call channels
+	alertRoutes, err := alertRoutesFromConfig()
+	if err != nil {
+		log.Fatalf("Invalid alert channel configuration: %v", err)
+	}
+	alertRouter, err := NewAlertRouter(redisClient, tenants, alertRoutes, config.AlertEscalationPolicy, config.AlertMinSeverity, config.AlertDedupWindow, config.AlertMaxPerHour)
+	if err != nil {
+		log.Fatalf("Invalid alert routing configuration: %v", err)
+	}
+	alertCtx, stopAlerting := context.WithCancel(context.Background())
+	alerting := alertRouter.Start(alertCtx)
+
 	// Initialize threat detector
-	threatDetector := NewThreatDetector(redisClient, claudeClient)
+	scanner, err := NewNmapScanner(redisClient, tenants, config.NmapPath, config.MaxConcurrentScans, config.NmapTargetInterval, config.NmapMaxRate, config.NmapTimeout, config.ScanAllowedNetworks)
+	if err != nil {
+		log.Fatalf("Invalid scanner configuration: %v", err)
+	}
+	geo, err := NewGeoIP(config.GeoIPCityDB, config.GeoIPASNDB)
+	if err != nil {
+		log.Fatalf("Invalid GeoIP configuration: %v", err)
+	}
+	geoCtx, stopGeo := context.WithCancel(context.Background())
+	geoReloading := geo.Start(geoCtx)
+	yara, err := NewYARAScanner(config.YARAPath, config.YARARules, config.YARATimeout, config.MaxConcurrentScans)
+	if err != nil {
+		log.Fatalf("Invalid YARA configuration: %v", err)
+	}
+
+	// Initialize incident response executors
+	responder := NewIncidentResponder(redisClient, responseExecutorsFromConfig(redisClient), config.SOARMode)
+
+	threatDetector := NewThreatDetector(redisClient, claudeClient, cveDatabase, scanner, geo, siemForwarder, alertRouter, tenants, yara, history, NewScanVersions(db, config.ScanVersionsKept))
+	responder.lists = threatDetector.lists
+
+	// Hold quarantines of implicated hosts for analyst approval, expiring and releasing them on time
+	threatDetector.quarantine = NewQuarantineQueue(redisClient, responder, config.QuarantineMinSeverity, config.QuarantineMinConfidence, config.QuarantineApprovalTTL, config.QuarantineReleaseAfter)
+	quarantineCtx, stopQuarantine := context.WithCancel(context.Background())
+	quarantining := threatDetector.quarantine.Start(quarantineCtx)
+
+	// Submit suspicious payloads and files to the sandbox and merge its reports into their scans
+	sandboxCtx, stopSandbox := context.WithCancel(context.Background())
+	detonating := threatDetector.sandbox.Start(sandboxCtx)
+
+	packetCtx, stopPacketWorkers := context.WithCancel(context.Background())
+	packetWorking := threatDetector.packetPool.Start(packetCtx)
+
+	// Keep the CVE database synchronized with NVD and CISA KEV, checking new CVEs against watchlists
+	syncCtx, stopSync := context.WithCancel(context.Background())
+	NewCVESync(db, cveDatabase, threatDetector.watchlists, config.NVDAPIKey, config.NVDURL, config.KEVURL, config.CVESyncInterval).Start(syncCtx)
+
+	// Load Sigma rules from disk and those added through the API
+	if config.SigmaRulesDir != "" {
+		if err := threatDetector.sigma.LoadDir(config.SigmaRulesDir); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	if err := threatDetector.sigma.Load(ctx); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	// Load the allowlist and blocklist, and keep them in step with other replicas
+	if err := threatDetector.lists.Load(ctx); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	listCtx, stopLists := context.WithCancel(context.Background())
+	listRefreshing := threatDetector.lists.Start(listCtx)
+
+	// Load custom signatures and those imported from Snort/Suricata rules
+	if _, err := threatDetector.ReloadSignatures(ctx); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	// Start live capture and flow collection when configured; both train host baselines
+	baselineCtx, stopBaselines := context.WithCancel(context.Background())
+	baselining := threatDetector.baselines.Start(baselineCtx)
+
+	collectCtx, stopCollectors := context.WithCancel(context.Background())
+	collectors := make([]*sync.WaitGroup, 0)
+
+	packetCapture := NewPacketCapture(redisClient, threatDetector, config.CaptureInterfaces, config.CaptureFilter, config.PacketBufferSize)
+	if len(config.CaptureInterfaces) > 0 {
+		collectors = append(collectors, packetCapture.Start(collectCtx))
+	}
+
+	flowCollector := NewFlowCollector(redisClient, threatDetector, config.FlowListenAddr)
+	if config.FlowListenAddr != "" {
+		flows, err := flowCollector.Start(collectCtx)
+		if err != nil {
+			log.Fatalf("Flow collector failed to start: %v", err)
+		}
+		collectors = append(collectors, flows)
+	}
+
+	if config.HoneypotListenAddr != "" {
+		honeypotListener, err := NewHoneypotListener(threatDetector, config.HoneypotListenAddr, config.HoneypotSensors)
+		if err != nil {
+			log.Fatalf("Honeypot listener misconfigured: %v", err)
+		}
+		honeypots, err := honeypotListener.Start(collectCtx)
+		if err != nil {
+			log.Fatalf("Honeypot listener failed to start: %v", err)
+		}
+		collectors = append(collectors, honeypots)
+	}
+
+	if config.ScreenshotProxyAddr != "" {
+		proxies, err := NewScreenshotProxy(config.ScreenshotProxyAddr).Start(collectCtx)
+		if err != nil {
+			log.Fatalf("Screenshot proxy failed to start: %v", err)
+		}
+		collectors = append(collectors, proxies)
+	}
+
+	syslogListener, err := NewSyslogListener(redisClient, threatDetector, config.SyslogUDPAddr, config.SyslogTCPAddr, config.SyslogTLSAddr, config.SyslogTLSCert, config.SyslogTLSKey, config.SyslogTLSClientCA)
+	if err != nil {
+		log.Fatalf("Syslog listener misconfigured: %v", err)
+	}
+	if syslogListener.Enabled() {
+		syslogs, err := syslogListener.Start(collectCtx)
+		if err != nil {
+			log.Fatalf("Syslog listener failed to start: %v", err)
+		}
+		collectors = append(collectors, syslogs)
+	}
+
+	// Run scheduled scans
+	scheduler := NewScanScheduler(redisClient, threatDetector, config.ScanAlertWebhookURL, config.ScheduledScanConcurrency)
+	scheduleCtx, stopScheduler := context.WithCancel(context.Background())
+	scheduling := scheduler.Start(scheduleCtx)
+
+	// Accept streaming analysis connections
+	streams := NewAnalysisStreams(threatDetector, config.StreamMaxConnections)
+
+	// Map findings and evidence onto compliance frameworks
+	compliance := NewComplianceReporter(redisClient, threatDetector, responder, claudeClient)
 
 	// Initialize API server
-	apiServer := NewAPIServer(threatDetector)
+	incidents := NewIncidentReporter(threatDetector, responder, claudeClient)
+	apiServer := NewAPIServer(threatDetector, packetCapture, flowCollector, syslogListener, responder, scheduler, streams, compliance, incidents)
+
+	// Authenticate and rate limit API clients
+	auth, err := NewAPIAuth(redisClient, tenants, config.APIKeys, config.APIKeyTenants, config.JWTSecret, config.JWTIssuer, config.JWTAudience, config.AnalyzeRateLimit, config.AnalyzeMaxConcurrent, config.AnalyzeMaxBodyMB)
+	if err != nil {
+		log.Fatalf("Invalid API authentication configuration: %v", err)
+	}
+	if config.SOARMode == ModeEnforce && !auth.Enabled() {
+		log.Fatalf("SOAR_MODE=enforce needs API_KEYS or JWT_SECRET; anonymous callers must not execute responses")
+	}
+
+	// Accept gRPC ingestion streams from sensors, authenticated like the HTTP API
+	if config.GRPCListenAddr != "" {
+		ingest, err := NewGRPCIngest(threatDetector, auth, config.GRPCListenAddr).Start(collectCtx)
+		if err != nil {
+			log.Fatalf("gRPC ingestion failed to start: %v", err)
+		}
+		collectors = append(collectors, ingest)
+	}
 
 	// Setup Gin router
 	router := gin.Default()
@@ -641,7 +1371,117 @@ func main() {
 	// Routes
 	router.GET("/health", apiServer.healthCheckHandler)
 	router.GET("/metrics", apiServer.metricsHandler)
-	router.POST("/api/v1/analyze", apiServer.analyzeThreatHandler)
+
+	// API routes are scoped to the caller's tenant; sensors, integrations, shared signatures, and
+	// tenant management are limited to the operator (default tenant)
+	api := router.Group("/api/v1", auth.Authenticate())
+	operator := api.Group("", requireOperator())
+	api.POST("/analyze", auth.Limit(), apiServer.analyzeThreatHandler)
+	api.POST("/analyze/url", auth.Limit(), apiServer.analyzeURLHandler)
+	api.POST("/analyze/email", auth.Limit(), apiServer.analyzeEmailHandler)
+	api.GET("/analyze/url/screenshots/:id", apiServer.getScreenshotHandler)
+	api.GET("/stream", apiServer.streamHandler)
+	api.POST("/ingest/pcap", apiServer.ingestPcapHandler)
+	operator.GET("/capture", apiServer.captureStatusHandler)
+	operator.GET("/flows", apiServer.flowStatusHandler)
+	operator.GET("/syslog", apiServer.syslogStatusHandler)
+	operator.GET("/syslog/sources", apiServer.listSyslogSourcesHandler)
+	operator.PUT("/syslog/sources/:id", apiServer.saveSyslogSourceHandler)
+	operator.DELETE("/syslog/sources/:id", apiServer.deleteSyslogSourceHandler)
+	operator.POST("/syslog/parse", apiServer.parseSyslogHandler)
+	operator.GET("/siem", apiServer.siemStatusHandler)
+	api.GET("/cves", apiServer.searchCVEsHandler)
+	api.GET("/cves/sync", apiServer.cveSyncStatusHandler)
+	api.GET("/cves/watchlists", apiServer.listWatchlistsHandler)
+	api.POST("/cves/watchlists", apiServer.createWatchlistHandler)
+	api.GET("/cves/watchlists/:id", apiServer.getWatchlistHandler)
+	api.PUT("/cves/watchlists/:id", apiServer.updateWatchlistHandler)
+	api.DELETE("/cves/watchlists/:id", apiServer.deleteWatchlistHandler)
+	api.POST("/ingest/logs", apiServer.ingestLogsHandler)
+	api.POST("/ingest/auth", apiServer.ingestAuthHandler)
+	api.POST("/ingest/auth/:source", apiServer.ingestAuthLogHandler)
+	api.GET("/ueba/users/:username", apiServer.getUserProfileHandler)
+	api.DELETE("/ueba/users/:username", apiServer.resetUserProfileHandler)
+	api.POST("/ingest/endpoint", apiServer.ingestEndpointHandler)
+	api.GET("/endpoints", apiServer.listEndpointsHandler)
+	api.GET("/endpoints/:host/tree", apiServer.processTreeHandler)
+	api.POST("/ingest/honeypot/:honeypot", apiServer.ingestHoneypotHandler)
+	api.GET("/honeypot/attackers", apiServer.listHoneypotAttackersHandler)
+	api.GET("/honeypot/attackers/:ip", apiServer.getHoneypotAttackerHandler)
+	api.GET("/sigma/rules", apiServer.listSigmaRulesHandler)
+	operator.POST("/sigma/rules", apiServer.addSigmaRulesHandler)
+	operator.DELETE("/sigma/rules/:id", apiServer.deleteSigmaRuleHandler)
+	api.GET("/signatures", apiServer.listSignaturesHandler)
+	operator.POST("/signatures", apiServer.createSignatureHandler)
+	operator.POST("/signatures/import", apiServer.importSignaturesHandler)
+	operator.POST("/signatures/import/tls", apiServer.importTLSFingerprintsHandler)
+	operator.POST("/signatures/reload", apiServer.reloadSignaturesHandler)
+	api.GET("/signatures/:id", apiServer.getSignatureHandler)
+	operator.PUT("/signatures/:id", apiServer.updateSignatureHandler)
+	operator.DELETE("/signatures/:id", apiServer.deleteSignatureHandler)
+	operator.POST("/incidents/respond", apiServer.respondHandler)
+	operator.GET("/incidents/audit", apiServer.responseAuditHandler)
+	operator.GET("/incidents/executors", apiServer.responseExecutorsHandler)
+	operator.GET("/quarantine", apiServer.listQuarantineHandler)
+	operator.GET("/quarantine/:id", apiServer.getQuarantineHandler)
+	operator.POST("/quarantine/:id/approve", apiServer.approveQuarantineHandler)
+	operator.POST("/quarantine/:id/reject", apiServer.rejectQuarantineHandler)
+	operator.POST("/quarantine/:id/release", apiServer.releaseQuarantineHandler)
+	api.GET("/incidents/:id/report", apiServer.incidentReportHandler)
+	api.GET("/campaigns", apiServer.listCampaignsHandler)
+	api.GET("/campaigns/:id", apiServer.getCampaignHandler)
+	api.GET("/history/:kind", apiServer.queryHistoryHandler)
+	api.GET("/scans", apiServer.listScansHandler)
+	api.GET("/scans/diff", apiServer.scanDiffHandler)
+	api.GET("/scans/versions", apiServer.scanVersionsHandler)
+	api.GET("/scans/:id", apiServer.getScanHandler)
+	api.GET("/scans/:id/enforcement", apiServer.enforcementRulesHandler)
+	operator.GET("/retention", apiServer.retentionStatusHandler)
+	api.GET("/schedules", apiServer.listSchedulesHandler)
+	api.POST("/schedules", apiServer.createScheduleHandler)
+	api.GET("/schedules/:id", apiServer.getScheduleHandler)
+	api.PUT("/schedules/:id", apiServer.updateScheduleHandler)
+	api.DELETE("/schedules/:id", apiServer.deleteScheduleHandler)
+	api.GET("/schedules/:id/runs", apiServer.scheduleRunsHandler)
+	operator.GET("/baselines/:host", apiServer.getBaselineHandler)
+	operator.DELETE("/baselines/:host", apiServer.resetBaselineHandler)
+	api.GET("/reputation/:ioc", apiServer.reputationHandler)
+	api.POST("/scan/file", apiServer.scanFileHandler)
+	api.GET("/scan/file/:sha256", apiServer.getFileScanHandler)
+	api.GET("/sandbox/detonations", apiServer.listDetonationsHandler)
+	api.GET("/sandbox/detonations/:id", apiServer.getDetonationHandler)
+	api.GET("/scan/intel", apiServer.listFileIntelHandler)
+	operator.POST("/scan/intel", apiServer.addFileIntelHandler)
+	operator.DELETE("/scan/intel", apiServer.removeFileIntelHandler)
+	api.GET("/assets", apiServer.listAssetsHandler)
+	api.POST("/assets", apiServer.createAssetHandler)
+	api.GET("/assets/:id", apiServer.getAssetHandler)
+	api.PUT("/assets/:id", apiServer.updateAssetHandler)
+	api.DELETE("/assets/:id", apiServer.deleteAssetHandler)
+	api.GET("/reports/mitre", apiServer.mitreReportHandler)
+	api.GET("/findings", apiServer.listFindingsHandler)
+	api.GET("/findings/queue", apiServer.remediationQueueHandler)
+	api.GET("/findings/:id", apiServer.getFindingHandler)
+	api.PUT("/findings/:id/status", apiServer.updateFindingStatusHandler)
+	api.GET("/compliance/frameworks", apiServer.listFrameworksHandler)
+	api.GET("/compliance/reports/:framework", apiServer.complianceReportHandler)
+	api.GET("/compliance/evidence", apiServer.listEvidenceHandler)
+	api.POST("/compliance/evidence", apiServer.addEvidenceHandler)
+	api.DELETE("/compliance/evidence/:id", apiServer.deleteEvidenceHandler)
+	api.GET("/alerts", apiServer.listAlertsHandler)
+	operator.GET("/alerts/routing", apiServer.alertRoutingHandler)
+	api.GET("/alerts/:id", apiServer.getAlertHandler)
+	api.POST("/alerts/:id/acknowledge", apiServer.acknowledgeAlertHandler)
+	api.POST("/alerts/:id/resolve", apiServer.resolveAlertHandler)
+	api.GET("/lists/:list", apiServer.listEntriesHandler)
+	api.POST("/lists/:list", apiServer.addListEntryHandler)
+	api.DELETE("/lists/:list", apiServer.removeListEntryHandler)
+	operator.POST("/lists/:list/enforce", apiServer.enforceListHandler)
+	operator.GET("/tenants", apiServer.listTenantsHandler)
+	operator.POST("/tenants", apiServer.createTenantHandler)
+	operator.GET("/tenants/:id", apiServer.getTenantHandler)
+	operator.PUT("/tenants/:id", apiServer.updateTenantHandler)
+	operator.DELETE("/tenants/:id", apiServer.deleteTenantHandler)
 	router.GET("/", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"service":       config.AppName,
@@ -656,7 +1496,7 @@ func main() {
 		Addr:         ":" + config.Port,
 		Handler:      router,
 		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
+		WriteTimeout: 15*time.Second + config.NmapTimeout, // synchronous scans may run nmap
 		IdleTimeout:  60 * time.Second,
 	}
 
@@ -674,8 +1514,42 @@ func main() {
 		if err := srv.Shutdown(ctx); err != nil {
 			log.Printf("Server shutdown error: %v", err)
 		}
+		// Shutdown does not wait for upgraded connections
+		streams.Close()
 
+		stopCollectors()
+		for _, collector := range collectors {
+			collector.Wait()
+		}
+		stopBaselines()
+		baselining.Wait()
+		stopScheduler()
+		scheduling.Wait()
+		stopQuarantine()
+		quarantining.Wait()
+		stopSandbox()
+		detonating.Wait()
+		stopPacketWorkers()
+		packetWorking.Wait()
+		stopLists()
+		listRefreshing.Wait()
+		stopTenants()
+		tenantRefreshing.Wait()
+
+		// Flush indicators raised during shutdown before stopping
+		stopForwarding()
+		forwarding.Wait()
+		stopHistory()
+		historyWriting.Wait()
+		stopAlerting()
+		alerting.Wait()
+
+		stopSync()
+		stopGeo()
+		geoReloading.Wait()
+		geo.Close()
 		redisClient.Close()
+		db.Close()
 		log.Println("Server stopped")
 	}()
 
@@ -692,3 +1566,10 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
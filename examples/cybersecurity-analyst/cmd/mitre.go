@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// MITRE ATT&CK coverage reporting
+const (
+	attackDetectionsKeyPrefix = "mitre:detections:" // one hash per UTC hour: technique -> indicators
+	attackUnmapped            = "unmapped"          // field counting indicators without a technique
+	attackBucketLayout        = "2006010215"
+	attackDefaultRange        = 7 * 24 * time.Hour
+
+	navigatorAttackVersion = "15"
+	navigatorVersion       = "4.9.1"
+	navigatorLayerVersion  = "4.5"
+	navigatorUncovered     = "#bdbdbd"
+)
+
+var (
+	errInvalidReportRange = errors.New("invalid report range")
+
+	attackTechniqueID = regexp.MustCompile(`^T\d{4}(?:\.\d{3})?$`)
+)
+
+type attackTactic struct {
+	ID   string // Navigator short name
+	Name string
+}
+
+// attackTactics are the Enterprise tactics in kill chain order
+var attackTactics = []attackTactic{
+	{"reconnaissance", "Reconnaissance"},
+	{"resource-development", "Resource Development"},
+	{"initial-access", "Initial Access"},
+	{"execution", "Execution"},
+	{"persistence", "Persistence"},
+	{"privilege-escalation", "Privilege Escalation"},
+	{"defense-evasion", "Defense Evasion"},
+	{"credential-access", "Credential Access"},
+	{"discovery", "Discovery"},
+	{"lateral-movement", "Lateral Movement"},
+	{"collection", "Collection"},
+	{"command-and-control", "Command and Control"},
+	{"exfiltration", "Exfiltration"},
+	{"impact", "Impact"},
+}
+
+type attackTechnique struct {
+	Name    string
+	Tactics []string
+}
+
+// attackCatalog holds the Enterprise techniques that network and log detection can be expected to
+// cover. Coverage gaps are reported against it; techniques outside it are still reported when a
+// detector covers them or an indicator names them.
+var attackCatalog = map[string]attackTechnique{
+	"T1595": {"Active Scanning", []string{"reconnaissance"}},
+	"T1590": {"Gather Victim Network Information", []string{"reconnaissance"}},
+	"T1592": {"Gather Victim Host Information", []string{"reconnaissance"}},
+	"T1583": {"Acquire Infrastructure", []string{"resource-development"}},
+	"T1588": {"Obtain Capabilities", []string{"resource-development"}},
+	"T1190": {"Exploit Public-Facing Application", []string{"initial-access"}},
+	"T1133": {"External Remote Services", []string{"initial-access", "persistence"}},
+	"T1566": {"Phishing", []string{"initial-access"}},
+	"T1078": {"Valid Accounts", []string{"initial-access", "persistence", "privilege-escalation", "defense-evasion"}},
+	"T1189": {"Drive-by Compromise", []string{"initial-access"}},
+	"T1195": {"Supply Chain Compromise", []string{"initial-access"}},
+	"T1199": {"Trusted Relationship", []string{"initial-access"}},
+	"T1059": {"Command and Scripting Interpreter", []string{"execution"}},
+	"T1203": {"Exploitation for Client Execution", []string{"execution"}},
+	"T1204": {"User Execution", []string{"execution"}},
+	"T1047": {"Windows Management Instrumentation", []string{"execution"}},
+	"T1053": {"Scheduled Task/Job", []string{"execution", "persistence", "privilege-escalation"}},
+	"T1569": {"System Services", []string{"execution"}},
+	"T1098": {"Account Manipulation", []string{"persistence", "privilege-escalation"}},
+	"T1136": {"Create Account", []string{"persistence"}},
+	"T1505": {"Server Software Component", []string{"persistence"}},
+	"T1543": {"Create or Modify System Process", []string{"persistence", "privilege-escalation"}},
+	"T1547": {"Boot or Logon Autostart Execution", []string{"persistence", "privilege-escalation"}},
+	"T1068": {"Exploitation for Privilege Escalation", []string{"privilege-escalation"}},
+	"T1548": {"Abuse Elevation Control Mechanism", []string{"privilege-escalation", "defense-evasion"}},
+	"T1055": {"Process Injection", []string{"privilege-escalation", "defense-evasion"}},
+	"T1070": {"Indicator Removal", []string{"defense-evasion"}},
+	"T1562": {"Impair Defenses", []string{"defense-evasion"}},
+	"T1027": {"Obfuscated Files or Information", []string{"defense-evasion"}},
+	"T1036": {"Masquerading", []string{"defense-evasion"}},
+	"T1218": {"System Binary Proxy Execution", []string{"defense-evasion"}},
+	"T1112": {"Modify Registry", []string{"defense-evasion"}},
+	"T1110": {"Brute Force", []string{"credential-access"}},
+	"T1003": {"OS Credential Dumping", []string{"credential-access"}},
+	"T1557": {"Adversary-in-the-Middle", []string{"credential-access", "collection"}},
+	"T1558": {"Steal or Forge Kerberos Tickets", []string{"credential-access"}},
+	"T1552": {"Unsecured Credentials", []string{"credential-access"}},
+	"T1040": {"Network Sniffing", []string{"credential-access", "discovery"}},
+	"T1556": {"Modify Authentication Process", []string{"credential-access", "defense-evasion", "persistence"}},
+	"T1046": {"Network Service Discovery", []string{"discovery"}},
+	"T1018": {"Remote System Discovery", []string{"discovery"}},
+	"T1087": {"Account Discovery", []string{"discovery"}},
+	"T1082": {"System Information Discovery", []string{"discovery"}},
+	"T1083": {"File and Directory Discovery", []string{"discovery"}},
+	"T1135": {"Network Share Discovery", []string{"discovery"}},
+	"T1016": {"System Network Configuration Discovery", []string{"discovery"}},
+	"T1021": {"Remote Services", []string{"lateral-movement"}},
+	"T1210": {"Exploitation of Remote Services", []string{"lateral-movement"}},
+	"T1570": {"Lateral Tool Transfer", []string{"lateral-movement"}},
+	"T1550": {"Use Alternate Authentication Material", []string{"defense-evasion", "lateral-movement"}},
+	"T1534": {"Internal Spearphishing", []string{"lateral-movement"}},
+	"T1005": {"Data from Local System", []string{"collection"}},
+	"T1039": {"Data from Network Shared Drive", []string{"collection"}},
+	"T1074": {"Data Staged", []string{"collection"}},
+	"T1560": {"Archive Collected Data", []string{"collection"}},
+	"T1114": {"Email Collection", []string{"collection"}},
+	"T1213": {"Data from Information Repositories", []string{"collection"}},
+	"T1071": {"Application Layer Protocol", []string{"command-and-control"}},
+	"T1090": {"Proxy", []string{"command-and-control"}},
+	"T1095": {"Non-Application Layer Protocol", []string{"command-and-control"}},
+	"T1105": {"Ingress Tool Transfer", []string{"command-and-control"}},
+	"T1571": {"Non-Standard Port", []string{"command-and-control"}},
+	"T1572": {"Protocol Tunneling", []string{"command-and-control"}},
+	"T1573": {"Encrypted Channel", []string{"command-and-control"}},
+	"T1568": {"Dynamic Resolution", []string{"command-and-control"}},
+	"T1219": {"Remote Access Software", []string{"command-and-control"}},
+	"T1132": {"Data Encoding", []string{"command-and-control"}},
+	"T1008": {"Fallback Channels", []string{"command-and-control"}},
+	"T1048": {"Exfiltration Over Alternative Protocol", []string{"exfiltration"}},
+	"T1041": {"Exfiltration Over C2 Channel", []string{"exfiltration"}},
+	"T1567": {"Exfiltration Over Web Service", []string{"exfiltration"}},
+	"T1030": {"Data Transfer Size Limits", []string{"exfiltration"}},
+	"T1029": {"Scheduled Transfer", []string{"exfiltration"}},
+	"T1020": {"Automated Exfiltration", []string{"exfiltration"}},
+	"T1498": {"Network Denial of Service", []string{"impact"}},
+	"T1499": {"Endpoint Denial of Service", []string{"impact"}},
+	"T1486": {"Data Encrypted for Impact", []string{"impact"}},
+	"T1485": {"Data Destruction", []string{"impact"}},
+	"T1489": {"Service Stop", []string{"impact"}},
+	"T1490": {"Inhibit System Recovery", []string{"impact"}},
+	"T1491": {"Defacement", []string{"impact"}},
+	"T1496": {"Resource Hijacking", []string{"impact"}},
+	"T1531": {"Account Access Removal", []string{"impact"}},
+}
+
+// attackDetectors are the detections implemented in code rather than as signatures
+var attackDetectors = map[string][]string{
+	"detector:packets":  {"T1498"},                   // SYN floods and volumetric DDoS
+	"detector:flow":     {"T1046", "T1048", "T1498"}, // flow scans, exfiltration, and floods
+	"detector:baseline": {"T1048", "T1571"},          // volume anomalies and new ports
+}
+
+// attackParent reduces a sub-technique to its technique; sub-techniques are reported under it
+func attackParent(id string) string {
+	id = strings.ToUpper(strings.TrimSpace(id))
+	if !attackTechniqueID.MatchString(id) {
+		return ""
+	}
+	parent, _, _ := strings.Cut(id, ".")
+	return parent
+}
+
+// AttackTechniqueReport summarizes one technique over the report range
+type AttackTechniqueReport struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name,omitempty"`
+	Tactics      []string   `json:"tactics"`
+	Detections   int64      `json:"detections"`
+	LastDetected *time.Time `json:"last_detected,omitempty"` // start of the last hour with detections
+	Covered      bool       `json:"covered"`                 // a deployed signature, rule, or detector reports it
+	Detectors    []string   `json:"detectors,omitempty"`
+}
+
+// AttackTacticReport summarizes one tactic; techniques under several tactics count toward each
+type AttackTacticReport struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Detections int64    `json:"detections"`
+	Techniques int      `json:"techniques"`
+	Covered    int      `json:"covered"`
+	Detected   []string `json:"detected,omitempty"` // techniques with detections
+}
+
+type AttackCoverage struct {
+	Techniques int      `json:"techniques"` // cataloged techniques
+	Covered    []string `json:"covered"`
+	Uncovered  []string `json:"uncovered"`
+	Percent    float64  `json:"percent"`
+}
+
+type AttackReport struct {
+	From       time.Time               `json:"from"`
+	To         time.Time               `json:"to"`
+	Detections int64                   `json:"detections"`
+	Unmapped   int64                   `json:"unmapped"` // indicators without a technique
+	Tactics    []AttackTacticReport    `json:"tactics"`
+	Techniques []AttackTechniqueReport `json:"techniques"`
+	Coverage   AttackCoverage          `json:"coverage"`
+}
+
+// recordDetections counts indicators by technique in hourly buckets kept for MITRE_RETENTION_DAYS
+func (td *ThreatDetector) recordDetections(ctx context.Context, threats []ThreatIndicator) {
+	if len(threats) == 0 {
+		return
+	}
+	key := tenantKey(ctx, attackDetectionsKeyPrefix+time.Now().UTC().Format(attackBucketLayout))
+
+	pipe := td.redis.Pipeline()
+	for _, threat := range threats {
+		technique := attackParent(threat.MITREAttack)
+		if technique == "" {
+			technique = attackUnmapped
+		}
+		pipe.HIncrBy(ctx, key, technique, 1)
+	}
+	// Buckets outlive retention by an hour so a full range always finds its first bucket
+	pipe.Expire(ctx, key, config.MitreRetention+time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record ATT&CK detections: %v", err)
+	}
+}
+
+// attackCoverage maps each technique to the signatures applied to the context's tenant, the Sigma
+// rules, and the detectors that report it. Sigma rules cover every technique they are tagged with.
+func (td *ThreatDetector) attackCoverage(ctx context.Context) map[string][]string {
+	coverage := make(map[string][]string)
+	add := func(technique, detector string) {
+		if technique = attackParent(technique); technique != "" {
+			coverage[technique] = append(coverage[technique], detector)
+		}
+	}
+
+	for _, sig := range td.Signatures(ctx, "", "") {
+		if sig.Source != "sigma" {
+			add(sig.MITREAttack, sig.ID)
+		}
+	}
+	for _, rule := range td.sigma.Rules() {
+		seen := make(map[string]bool)
+		for _, tag := range rule.Tags {
+			m := attackTechniqueTag.FindStringSubmatch(strings.ToLower(tag))
+			if m == nil {
+				continue
+			}
+			if technique := attackParent(m[1]); !seen[technique] {
+				seen[technique] = true
+				add(technique, rule.Signature.ID)
+			}
+		}
+	}
+	for detector, techniques := range attackDetectors {
+		for _, technique := range techniques {
+			add(technique, detector)
+		}
+	}
+
+	for technique := range coverage {
+		sort.Strings(coverage[technique])
+	}
+	return coverage
+}
+
+// AttackReport aggregates detections between from and to, rounded out to whole hours, and sets
+// them against what the deployed detections cover
+func (td *ThreatDetector) AttackReport(ctx context.Context, from, to time.Time) (*AttackReport, error) {
+	first := from.UTC().Truncate(time.Hour)
+	last := to.UTC().Truncate(time.Hour)
+
+	var hours []time.Time
+	for hour := first; !hour.After(last); hour = hour.Add(time.Hour) {
+		hours = append(hours, hour)
+	}
+	pipe := td.redis.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(hours))
+	for i, hour := range hours {
+		cmds[i] = pipe.HGetAll(ctx, tenantKey(ctx, attackDetectionsKeyPrefix+hour.Format(attackBucketLayout)))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to load ATT&CK detections: %w", err)
+	}
+
+	report := &AttackReport{From: first, To: last.Add(time.Hour)}
+	techniques := make(map[string]*AttackTechniqueReport)
+	technique := func(id string) *AttackTechniqueReport {
+		entry, ok := techniques[id]
+		if !ok {
+			entry = &AttackTechniqueReport{ID: id, Tactics: []string{}}
+			if cataloged, ok := attackCatalog[id]; ok {
+				entry.Name, entry.Tactics = cataloged.Name, cataloged.Tactics
+			}
+			techniques[id] = entry
+		}
+		return entry
+	}
+
+	for i, hour := range hours {
+		counts, _ := cmds[i].Result()
+		for field, value := range counts {
+			count, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || count <= 0 {
+				continue
+			}
+			if field == attackUnmapped {
+				report.Unmapped += count
+				continue
+			}
+			entry := technique(field)
+			entry.Detections += count
+			if entry.LastDetected == nil || hour.After(*entry.LastDetected) {
+				detected := hour
+				entry.LastDetected = &detected
+			}
+			report.Detections += count
+		}
+	}
+
+	for id := range attackCatalog {
+		technique(id)
+	}
+	for id, detectors := range td.attackCoverage(ctx) {
+		entry := technique(id)
+		entry.Covered, entry.Detectors = true, detectors
+	}
+
+	report.Techniques = make([]AttackTechniqueReport, 0, len(techniques))
+	for _, entry := range techniques {
+		report.Techniques = append(report.Techniques, *entry)
+	}
+	sort.Slice(report.Techniques, func(i, j int) bool { return report.Techniques[i].ID < report.Techniques[j].ID })
+
+	report.Coverage = AttackCoverage{Techniques: len(attackCatalog), Covered: []string{}, Uncovered: []string{}}
+	tactics := make(map[string]*AttackTacticReport, len(attackTactics))
+	report.Tactics = make([]AttackTacticReport, len(attackTactics))
+	for i, tactic := range attackTactics {
+		report.Tactics[i] = AttackTacticReport{ID: tactic.ID, Name: tactic.Name}
+		tactics[tactic.ID] = &report.Tactics[i]
+	}
+	for _, entry := range report.Techniques {
+		if _, cataloged := attackCatalog[entry.ID]; cataloged {
+			if entry.Covered {
+				report.Coverage.Covered = append(report.Coverage.Covered, entry.ID)
+			} else {
+				report.Coverage.Uncovered = append(report.Coverage.Uncovered, entry.ID)
+			}
+		}
+		for _, id := range entry.Tactics {
+			tactic := tactics[id]
+			tactic.Techniques++
+			tactic.Detections += entry.Detections
+			if entry.Covered {
+				tactic.Covered++
+			}
+			if entry.Detections > 0 {
+				tactic.Detected = append(tactic.Detected, entry.ID)
+			}
+		}
+	}
+	report.Coverage.Percent = float64(len(report.Coverage.Covered)) / float64(len(attackCatalog)) * 100
+	return report, nil
+}
+
+// NavigatorLayer is an ATT&CK Navigator layer (format 4.5)
+type NavigatorLayer struct {
+	Name        string                `json:"name"`
+	Versions    NavigatorVersions     `json:"versions"`
+	Domain      string                `json:"domain"`
+	Description string                `json:"description"`
+	Techniques  []NavigatorTechnique  `json:"techniques"`
+	Gradient    NavigatorGradient     `json:"gradient"`
+	LegendItems []NavigatorLegendItem `json:"legendItems"`
+}
+
+type NavigatorVersions struct {
+	Attack    string `json:"attack"`
+	Navigator string `json:"navigator"`
+	Layer     string `json:"layer"`
+}
+
+type NavigatorTechnique struct {
+	TechniqueID string              `json:"techniqueID"`
+	Score       int64               `json:"score"`
+	Color       string              `json:"color,omitempty"`
+	Comment     string              `json:"comment,omitempty"`
+	Enabled     bool                `json:"enabled"`
+	Metadata    []NavigatorMetadata `json:"metadata,omitempty"`
+}
+
+type NavigatorMetadata struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type NavigatorGradient struct {
+	Colors   []string `json:"colors"`
+	MinValue int64    `json:"minValue"`
+	MaxValue int64    `json:"maxValue"`
+}
+
+type NavigatorLegendItem struct {
+	Label string `json:"label"`
+	Color string `json:"color"`
+}
+
+// Navigator scores techniques by detections; cataloged techniques nothing covers are greyed out
+func (r *AttackReport) Navigator() NavigatorLayer {
+	layer := NavigatorLayer{
+		Name:     "Cybersecurity Analyst detections",
+		Versions: NavigatorVersions{Attack: navigatorAttackVersion, Navigator: navigatorVersion, Layer: navigatorLayerVersion},
+		Domain:   "enterprise-attack",
+		Description: fmt.Sprintf("Detections from %s to %s; %.0f%% of cataloged techniques covered",
+			r.From.Format(time.RFC3339), r.To.Format(time.RFC3339), r.Coverage.Percent),
+		Techniques:  make([]NavigatorTechnique, 0, len(r.Techniques)),
+		Gradient:    NavigatorGradient{Colors: []string{"#ffffff", "#ff6666"}, MaxValue: 1},
+		LegendItems: []NavigatorLegendItem{{Label: "Not covered by deployed detections", Color: navigatorUncovered}},
+	}
+
+	for _, technique := range r.Techniques {
+		entry := NavigatorTechnique{
+			TechniqueID: technique.ID,
+			Score:       technique.Detections,
+			Comment:     fmt.Sprintf("%d detections", technique.Detections),
+			Enabled:     true,
+		}
+		if technique.Covered {
+			entry.Metadata = []NavigatorMetadata{{Name: "detectors", Value: strings.Join(technique.Detectors, ", ")}}
+		} else if technique.Detections == 0 {
+			entry.Color = navigatorUncovered
+			entry.Comment = "Not covered"
+		}
+		layer.Gradient.MaxValue = max(layer.Gradient.MaxValue, technique.Detections)
+		layer.Techniques = append(layer.Techniques, entry)
+	}
+	return layer
+}
+
+// parseReportRange reads from and to (RFC 3339); to defaults to now and from to defaultRange
+// before it
+func parseReportRange(c *gin.Context, defaultRange, maxRange time.Duration) (time.Time, time.Time, error) {
+	to := time.Now().UTC()
+	if value := c.Query("to"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return to, to, fmt.Errorf("%w: to must be an RFC 3339 time", errInvalidReportRange)
+		}
+		to = parsed
+	}
+	from := to.Add(-defaultRange)
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return from, to, fmt.Errorf("%w: from must be an RFC 3339 time", errInvalidReportRange)
+		}
+		from = parsed
+	}
+
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("%w: from must be before to", errInvalidReportRange)
+	}
+	if to.Sub(from) > maxRange {
+		return from, to, fmt.Errorf("%w: ranges may span at most %d days", errInvalidReportRange, int(maxRange/(24*time.Hour)))
+	}
+	return from, to, nil
+}
+
+// HTTP Handlers
+func (s *APIServer) mitreReportHandler(c *gin.Context) {
+	from, to, err := parseReportRange(c, attackDefaultRange, config.MitreRetention)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	report, err := s.threatDetector.AttackReport(c.Request.Context(), from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.JSON(http.StatusOK, report)
+	case "navigator":
+		c.Header("Content-Disposition", `attachment; filename="attack-layer.json"`)
+		c.JSON(http.StatusOK, report.Navigator())
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": `format must be "json" or "navigator"`})
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// NetFlow v5/v9, IPFIX, and sFlow v5 decoding
+const (
+	FlowProtocolNetFlowV5 = "netflow_v5"
+	FlowProtocolNetFlowV9 = "netflow_v9"
+	FlowProtocolIPFIX     = "ipfix"
+	FlowProtocolSFlow     = "sflow"
+)
+
+// Information elements shared by NetFlow v9 and IPFIX
+const (
+	fieldInBytes      = 1
+	fieldInPackets    = 2
+	fieldProtocol     = 4
+	fieldTCPFlags     = 6
+	fieldSourcePort   = 7
+	fieldSourceIPv4   = 8
+	fieldDestPort     = 11
+	fieldDestIPv4     = 12
+	fieldSourceIPv6   = 27
+	fieldDestIPv6     = 28
+	ipfixVarLength    = 65535
+	ipfixEnterpriseID = 0x8000
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+var tcpFlagBits = map[string]uint8{"FIN": tcpFlagFIN, "SYN": tcpFlagSYN, "RST": tcpFlagRST, "ACK": tcpFlagACK}
+
+var errNoTemplate = errors.New("data set received before its template")
+
+// FlowRecord is one unidirectional flow reported by an exporter. For sFlow, a record is a single
+// sampled packet with its counters scaled by the sampling rate.
+type FlowRecord struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Exporter   string    `json:"exporter"`
+	SourceIP   string    `json:"source_ip"`
+	DestIP     string    `json:"dest_ip"`
+	SourcePort int       `json:"source_port"`
+	DestPort   int       `json:"dest_port"`
+	Protocol   string    `json:"protocol"`
+	Packets    uint64    `json:"packets"`
+	Bytes      uint64    `json:"bytes"`
+	TCPFlags   uint8     `json:"tcp_flags"`
+}
+
+// flowTemplate is a NetFlow v9 or IPFIX template; a field length of ipfixVarLength marks a
+// variable-length IPFIX field
+type flowTemplate struct {
+	fields []templateField
+}
+
+type templateField struct {
+	id     uint16
+	length uint16
+}
+
+// templateCache holds the templates announced by each exporter, keyed by exporter address,
+// observation domain (source ID in v9), and template ID
+type templateCache struct {
+	mu        sync.RWMutex
+	templates map[string]flowTemplate
+}
+
+func newTemplateCache() *templateCache {
+	return &templateCache{templates: make(map[string]flowTemplate)}
+}
+
+func (tc *templateCache) key(exporter string, domain uint32, id uint16) string {
+	return fmt.Sprintf("%s/%d/%d", exporter, domain, id)
+}
+
+func (tc *templateCache) get(exporter string, domain uint32, id uint16) (flowTemplate, bool) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	t, ok := tc.templates[tc.key(exporter, domain, id)]
+	return t, ok
+}
+
+func (tc *templateCache) put(exporter string, domain uint32, id uint16, t flowTemplate) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.templates[tc.key(exporter, domain, id)] = t
+}
+
+// DecodeFlowDatagram detects the export protocol of a datagram and decodes its flow records.
+// NetFlow and IPFIX carry a 16-bit version first; sFlow carries a 32-bit version, so its first
+// two bytes are zero.
+func DecodeFlowDatagram(data []byte, exporter string, templates *templateCache) (string, []FlowRecord, error) {
+	if len(data) < 4 {
+		return "", nil, fmt.Errorf("datagram too short (%d bytes)", len(data))
+	}
+
+	switch binary.BigEndian.Uint16(data) {
+	case 5:
+		records, err := decodeNetFlowV5(data, exporter)
+		return FlowProtocolNetFlowV5, records, err
+	case 9:
+		records, err := decodeNetFlowV9(data, exporter, templates)
+		return FlowProtocolNetFlowV9, records, err
+	case 10:
+		records, err := decodeIPFIX(data, exporter, templates)
+		return FlowProtocolIPFIX, records, err
+	case 0:
+		if binary.BigEndian.Uint32(data) == 5 {
+			records, err := decodeSFlow(data, exporter)
+			return FlowProtocolSFlow, records, err
+		}
+	}
+	return "", nil, fmt.Errorf("unsupported flow export version %d", binary.BigEndian.Uint16(data))
+}
+
+func decodeNetFlowV5(data []byte, exporter string) ([]FlowRecord, error) {
+	const headerLen, recordLen = 24, 48
+	if len(data) < headerLen {
+		return nil, fmt.Errorf("netflow v5 header truncated")
+	}
+
+	count := int(binary.BigEndian.Uint16(data[2:]))
+	if len(data) < headerLen+count*recordLen {
+		return nil, fmt.Errorf("netflow v5 datagram announces %d records but holds %d bytes", count, len(data))
+	}
+	timestamp := time.Unix(int64(binary.BigEndian.Uint32(data[8:])), int64(binary.BigEndian.Uint32(data[12:])))
+
+	// The low 14 bits hold the sampling interval; counters are scaled back up when sampled
+	sampling := uint64(binary.BigEndian.Uint16(data[22:]) & 0x3fff)
+	if sampling == 0 {
+		sampling = 1
+	}
+
+	records := make([]FlowRecord, 0, count)
+	for i := 0; i < count; i++ {
+		r := data[headerLen+i*recordLen:]
+		records = append(records, FlowRecord{
+			Timestamp:  timestamp,
+			Exporter:   exporter,
+			SourceIP:   net.IP(r[0:4]).String(),
+			DestIP:     net.IP(r[4:8]).String(),
+			SourcePort: int(binary.BigEndian.Uint16(r[32:])),
+			DestPort:   int(binary.BigEndian.Uint16(r[34:])),
+			Protocol:   ipProtocolName(r[38]),
+			Packets:    uint64(binary.BigEndian.Uint32(r[16:])) * sampling,
+			Bytes:      uint64(binary.BigEndian.Uint32(r[20:])) * sampling,
+			TCPFlags:   r[37],
+		})
+	}
+	return records, nil
+}
+
+func decodeNetFlowV9(data []byte, exporter string, templates *templateCache) ([]FlowRecord, error) {
+	const headerLen = 20
+	if len(data) < headerLen {
+		return nil, fmt.Errorf("netflow v9 header truncated")
+	}
+	timestamp := time.Unix(int64(binary.BigEndian.Uint32(data[8:])), 0)
+	sourceID := binary.BigEndian.Uint32(data[16:])
+
+	// Template flowsets use ID 0, options templates ID 1, and data flowsets the template ID
+	return decodeFlowSets(data[headerLen:], exporter, sourceID, timestamp, templates, 0, false)
+}
+
+func decodeIPFIX(data []byte, exporter string, templates *templateCache) ([]FlowRecord, error) {
+	const headerLen = 16
+	if len(data) < headerLen {
+		return nil, fmt.Errorf("ipfix header truncated")
+	}
+	length := int(binary.BigEndian.Uint16(data[2:]))
+	if length < headerLen || length > len(data) {
+		return nil, fmt.Errorf("ipfix message length %d does not match datagram (%d bytes)", length, len(data))
+	}
+	timestamp := time.Unix(int64(binary.BigEndian.Uint32(data[4:])), 0)
+	domainID := binary.BigEndian.Uint32(data[12:])
+
+	// Template sets use ID 2, options templates ID 3, and data sets the template ID
+	return decodeFlowSets(data[headerLen:length], exporter, domainID, timestamp, templates, 2, true)
+}
+
+// decodeFlowSets walks the sets of a NetFlow v9 or IPFIX message, learning templates and decoding
+// data sets. A data set without a known template is skipped; the exporter resends templates
+// periodically, so the error is reported only when nothing in the message could be decoded.
+func decodeFlowSets(data []byte, exporter string, domain uint32, timestamp time.Time, templates *templateCache, templateSetID uint16, ipfix bool) ([]FlowRecord, error) {
+	records := make([]FlowRecord, 0)
+	var missing error
+
+	for len(data) >= 4 {
+		setID := binary.BigEndian.Uint16(data)
+		setLen := int(binary.BigEndian.Uint16(data[2:]))
+		if setLen < 4 || setLen > len(data) {
+			return records, fmt.Errorf("set %d has invalid length %d", setID, setLen)
+		}
+		body := data[4:setLen]
+		data = data[setLen:]
+
+		switch {
+		case setID == templateSetID:
+			if err := parseTemplates(body, exporter, domain, templates, ipfix); err != nil {
+				return records, err
+			}
+		case setID < 256:
+			// Options templates describe exporter metadata, not flows
+		default:
+			template, ok := templates.get(exporter, domain, setID)
+			if !ok {
+				missing = fmt.Errorf("template %d from %s: %w", setID, exporter, errNoTemplate)
+				continue
+			}
+			decoded, err := decodeDataSet(body, template, exporter, timestamp)
+			if err != nil {
+				return records, err
+			}
+			records = append(records, decoded...)
+		}
+	}
+
+	if len(records) == 0 && missing != nil {
+		return records, missing
+	}
+	return records, nil
+}
+
+func parseTemplates(body []byte, exporter string, domain uint32, templates *templateCache, ipfix bool) error {
+	for len(body) >= 4 {
+		id := binary.BigEndian.Uint16(body)
+		count := int(binary.BigEndian.Uint16(body[2:]))
+		body = body[4:]
+		if id < 256 {
+			// Padding at the end of the set
+			return nil
+		}
+
+		template := flowTemplate{fields: make([]templateField, 0, count)}
+		for i := 0; i < count; i++ {
+			if len(body) < 4 {
+				return fmt.Errorf("template %d truncated", id)
+			}
+			field := templateField{id: binary.BigEndian.Uint16(body), length: binary.BigEndian.Uint16(body[2:])}
+			body = body[4:]
+			if ipfix && field.id&ipfixEnterpriseID != 0 {
+				// Enterprise-specific element: the enterprise number follows and no standard decoder applies
+				if len(body) < 4 {
+					return fmt.Errorf("template %d truncated", id)
+				}
+				body = body[4:]
+				field.id = 0
+			}
+			template.fields = append(template.fields, field)
+		}
+		templates.put(exporter, domain, id, template)
+	}
+	return nil
+}
+
+func decodeDataSet(body []byte, template flowTemplate, exporter string, timestamp time.Time) ([]FlowRecord, error) {
+	records := make([]FlowRecord, 0)
+
+	for len(body) > 0 {
+		record := FlowRecord{Timestamp: timestamp, Exporter: exporter, Protocol: "UNKNOWN"}
+		offset := 0
+		for _, field := range template.fields {
+			length := int(field.length)
+			if field.length == ipfixVarLength {
+				if offset >= len(body) {
+					return records, nil
+				}
+				length = int(body[offset])
+				offset++
+				if length == 255 {
+					if offset+2 > len(body) {
+						return records, nil
+					}
+					length = int(binary.BigEndian.Uint16(body[offset:]))
+					offset += 2
+				}
+			}
+			if offset+length > len(body) {
+				// What remains is set padding
+				return records, nil
+			}
+			setFlowField(&record, field.id, body[offset:offset+length])
+			offset += length
+		}
+		if offset == 0 {
+			return records, fmt.Errorf("template has no fields")
+		}
+		body = body[offset:]
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func setFlowField(record *FlowRecord, id uint16, value []byte) {
+	switch id {
+	case fieldInBytes:
+		record.Bytes = readUint(value)
+	case fieldInPackets:
+		record.Packets = readUint(value)
+	case fieldProtocol:
+		record.Protocol = ipProtocolName(uint8(readUint(value)))
+	case fieldTCPFlags:
+		record.TCPFlags = uint8(readUint(value))
+	case fieldSourcePort:
+		record.SourcePort = int(readUint(value))
+	case fieldDestPort:
+		record.DestPort = int(readUint(value))
+	case fieldSourceIPv4, fieldSourceIPv6:
+		if len(value) == net.IPv4len || len(value) == net.IPv6len {
+			record.SourceIP = net.IP(value).String()
+		}
+	case fieldDestIPv4, fieldDestIPv6:
+		if len(value) == net.IPv4len || len(value) == net.IPv6len {
+			record.DestIP = net.IP(value).String()
+		}
+	}
+}
+
+// readUint decodes a big-endian unsigned integer of up to eight bytes; exporters may shorten
+// counters with reduced-size encoding
+func readUint(value []byte) uint64 {
+	var n uint64
+	for i, b := range value {
+		if i == 8 {
+			break
+		}
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
+
+// decodeSFlow extracts the sampled packet headers of an sFlow v5 datagram. Counter samples carry
+// no addresses and are skipped.
+func decodeSFlow(data []byte, exporter string) ([]FlowRecord, error) {
+	r := &xdrReader{data: data}
+	r.uint32() // version
+	switch r.uint32() {
+	case 1:
+		r.skip(net.IPv4len)
+	case 2:
+		r.skip(net.IPv6len)
+	default:
+		return nil, fmt.Errorf("sflow agent address type unsupported")
+	}
+	r.skip(12) // sub-agent ID, sequence number, uptime
+	samples := r.uint32()
+	if r.err != nil {
+		return nil, fmt.Errorf("sflow header truncated")
+	}
+
+	timestamp := time.Now()
+	records := make([]FlowRecord, 0)
+	for i := uint32(0); i < samples; i++ {
+		format := r.uint32() & 0xfff // enterprise 0 formats only
+		sample := &xdrReader{data: r.bytes(int(r.uint32()))}
+		if r.err != nil {
+			return records, fmt.Errorf("sflow sample %d truncated", i+1)
+		}
+
+		var rate uint32
+		switch format {
+		case 1: // flow sample
+			sample.skip(8)
+			rate = sample.uint32()
+			sample.skip(16)
+		case 3: // expanded flow sample
+			sample.skip(12)
+			rate = sample.uint32()
+			sample.skip(24)
+		default:
+			continue
+		}
+		if rate == 0 {
+			rate = 1
+		}
+
+		flowRecords := sample.uint32()
+		for j := uint32(0); j < flowRecords && sample.err == nil; j++ {
+			recordFormat := sample.uint32() & 0xfff
+			record := &xdrReader{data: sample.bytes(int(sample.uint32()))}
+			if recordFormat != 1 { // raw packet header
+				continue
+			}
+
+			headerProtocol := record.uint32()
+			frameLength := record.uint32()
+			record.skip(4) // bytes stripped
+			header := record.bytes(int(record.uint32()))
+			if record.err != nil || headerProtocol != 1 { // ethernet
+				continue
+			}
+
+			packet, ok := decodePacket(gopacket.NewPacket(header, layers.LinkTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true}), timestamp)
+			if !ok {
+				continue
+			}
+			flow := FlowRecord{
+				Timestamp:  timestamp,
+				Exporter:   exporter,
+				SourceIP:   packet.SourceIP,
+				DestIP:     packet.DestIP,
+				SourcePort: packet.SourcePort,
+				DestPort:   packet.DestPort,
+				Protocol:   packet.Protocol,
+				Packets:    uint64(rate),
+				Bytes:      uint64(frameLength) * uint64(rate),
+			}
+			for flag, bit := range tcpFlagBits {
+				if packet.Flags[flag] {
+					flow.TCPFlags |= bit
+				}
+			}
+			records = append(records, flow)
+		}
+		if sample.err != nil {
+			return records, fmt.Errorf("sflow sample %d truncated", i+1)
+		}
+	}
+	return records, nil
+}
+
+// xdrReader reads the 4-byte aligned fields of sFlow datagrams, remembering the first overrun
+type xdrReader struct {
+	data []byte
+	err  error
+}
+
+func (x *xdrReader) uint32() uint32 {
+	b := x.bytes(4)
+	if x.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// bytes returns the next n bytes and skips the padding that aligns them to four bytes
+func (x *xdrReader) bytes(n int) []byte {
+	padded := (n + 3) &^ 3
+	if x.err != nil || n < 0 || padded > len(x.data) {
+		if x.err == nil {
+			x.err = errors.New("xdr data truncated")
+		}
+		return nil
+	}
+	b := x.data[:n]
+	x.data = x.data[padded:]
+	return b
+}
+
+func (x *xdrReader) skip(n int) {
+	x.bytes(n)
+}
+
+// ipProtocolName names protocols the way decodePacket does for captured packets
+func ipProtocolName(protocol uint8) string {
+	return layers.IPProtocol(protocol).String()
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Service discovery with nmap (TCP connect scans with version detection)
+const (
+	nmapRateLimitPrefix    = "nmap:target:" // set while a target is within its rate limit window
+	maxScanHostBits        = 8              // networks may hold at most 2^8 = 256 addresses
+	defaultAllowedNetworks = "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7"
+)
+
+var (
+	errScanTargetNotAllowed = errors.New("scan target is outside the allowed networks")
+	errInvalidScanTarget    = errors.New("invalid scan target")
+	errScanRateLimited      = errors.New("scan target was scanned recently")
+
+	hostnamePattern  = regexp.MustCompile(`^(?i)[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*\.?$`)
+	nmapPortsPattern = regexp.MustCompile(`^[TU:0-9,-]{1,512}$`)
+)
+
+var nmapScans = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cybersecurity_nmap_scans_total",
+		Help: "nmap service scans by outcome (completed, failed, rate_limited)",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(nmapScans)
+}
+
+// DiscoveredService is an open port found by nmap, with the software version detection identified
+type DiscoveredService struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	Protocol string   `json:"protocol"`
+	Name     string   `json:"name,omitempty"` // nmap service name, e.g. "ssh"
+	Product  string   `json:"product,omitempty"`
+	Version  string   `json:"version,omitempty"`
+	CPE      []string `json:"cpe,omitempty"` // CPE 2.3 names
+}
+
+// fingerprints returns what the CVE database can search for: the service's application and OS
+// CPEs, or its product and version when nmap reported no CPE
+func (s DiscoveredService) fingerprints() []SoftwareFingerprint {
+	fingerprints := make([]SoftwareFingerprint, 0, len(s.CPE))
+	for _, cpe := range s.CPE {
+		fingerprints = append(fingerprints, SoftwareFingerprint{CPE: cpe})
+	}
+	if len(fingerprints) == 0 && s.Product != "" {
+		fingerprints = append(fingerprints, SoftwareFingerprint{Product: s.Product, Version: s.Version})
+	}
+	return fingerprints
+}
+
+// NmapScanner runs nmap against hosts and networks inside the allowed networks: SCAN_ALLOWED_NETWORKS
+// for the default tenant, and for other tenants the part of it their scan_allowed_networks cover.
+// Scans share a MaxConcurrentScans limit, and each target may be scanned once per interval across
+// replicas.
+type NmapScanner struct {
+	binary   string
+	redis    *redis.Client
+	tenants  *TenantRegistry
+	slots    chan struct{}
+	interval time.Duration
+	maxRate  int
+	timeout  time.Duration
+	allowed  []*net.IPNet
+}
+
+// NewNmapScanner returns nil when the nmap binary cannot be found, which disables service discovery
+func NewNmapScanner(redisClient *redis.Client, tenants *TenantRegistry, binary string, concurrency int, interval time.Duration, maxRate int, timeout time.Duration, allowedNetworks string) (*NmapScanner, error) {
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		log.Printf("nmap not found (%v); service discovery is disabled", err)
+		return nil, nil
+	}
+
+	if strings.TrimSpace(allowedNetworks) == "" {
+		allowedNetworks = defaultAllowedNetworks
+	}
+	allowed, err := parseScanNetworks(strings.Split(allowedNetworks, ","))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SCAN_ALLOWED_NETWORKS: %w", err)
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &NmapScanner{
+		binary:   path,
+		redis:    redisClient,
+		tenants:  tenants,
+		slots:    make(chan struct{}, concurrency),
+		interval: interval,
+		maxRate:  maxRate,
+		timeout:  timeout,
+		allowed:  allowed,
+	}, nil
+}
+
+// applies reports whether a request should scan its target directly: network scans of hosts and
+// networks that carry no captured packets. Vulnerability scans scan registered assets instead.
+func (ns *NmapScanner) applies(req *ThreatDetectionRequest) bool {
+	if ns == nil || !isHostTarget(req.Target) {
+		return false
+	}
+	return req.ScanType == "network" && len(req.Packets) == 0
+}
+
+// isHostTarget reports whether target names a host or network rather than a software fingerprint
+func isHostTarget(target string) bool {
+	target = strings.TrimSpace(target)
+	if net.ParseIP(target) != nil {
+		return true
+	}
+	if _, _, err := net.ParseCIDR(target); err == nil {
+		return true
+	}
+	if _, ok := parseFingerprint(target); ok {
+		return false
+	}
+	return hostnamePattern.MatchString(target) && strings.Contains(target, ".")
+}
+
+// Scan discovers open ports and service versions on target, an IP address, CIDR network, or
+// hostname. ports is an nmap port list such as "22,80,443" or "1-1024"; nmap's top 1000 ports
+// are scanned when it is empty.
+func (ns *NmapScanner) Scan(ctx context.Context, target, ports string) ([]DiscoveredService, error) {
+	if ports != "" && !nmapPortsPattern.MatchString(ports) {
+		return nil, fmt.Errorf("%w: ports must be an nmap port list such as 22,80,443 or 1-1024", errInvalidScanTarget)
+	}
+	addresses, key, err := ns.resolve(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ns.claim(ctx, key); err != nil {
+		return nil, err
+	}
+
+	select {
+	case ns.slots <- struct{}{}:
+		defer func() { <-ns.slots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	scanCtx, cancel := context.WithTimeout(ctx, ns.timeout)
+	defer cancel()
+
+	args := []string{"-sT", "-sV", "-n", "-oX", "-", "--host-timeout", fmt.Sprintf("%ds", int(ns.timeout.Seconds()))}
+	if ns.maxRate > 0 {
+		args = append(args, "--max-rate", strconv.Itoa(ns.maxRate))
+	}
+	if ports != "" {
+		args = append(args, "-p", ports)
+	}
+	if strings.Contains(strings.Join(addresses, " "), ":") {
+		args = append(args, "-6")
+	}
+	args = append(args, addresses...)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(scanCtx, ns.binary, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		nmapScans.WithLabelValues("failed").Inc()
+		if scanCtx.Err() != nil {
+			return nil, fmt.Errorf("nmap scan of %s timed out after %s", target, ns.timeout)
+		}
+		return nil, fmt.Errorf("nmap scan of %s failed: %v: %s", target, err, strings.TrimSpace(stderr.String()))
+	}
+
+	services, err := parseNmapXML(stdout.Bytes())
+	if err != nil {
+		nmapScans.WithLabelValues("failed").Inc()
+		return nil, err
+	}
+	nmapScans.WithLabelValues("completed").Inc()
+	return services, nil
+}
+
+// resolve checks target against the allowed networks and returns the addresses to hand to nmap,
+// along with the key it is rate limited under. Hostnames are resolved here, and nmap is given
+// the checked addresses, so DNS cannot point a scan elsewhere afterwards.
+func (ns *NmapScanner) resolve(ctx context.Context, target string) ([]string, string, error) {
+	target = strings.TrimSpace(target)
+	tenantNetworks, err := ns.tenantNetworks(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, network, err := net.ParseCIDR(target); err == nil {
+		ones, bits := network.Mask.Size()
+		if bits-ones > maxScanHostBits {
+			return nil, "", fmt.Errorf("%w: %s has more than %d addresses", errInvalidScanTarget, target, 1<<maxScanHostBits)
+		}
+		if !containsNetwork(ns.allowed, network) || (tenantNetworks != nil && !containsNetwork(tenantNetworks, network)) {
+			return nil, "", fmt.Errorf("%w: %s", errScanTargetNotAllowed, target)
+		}
+		return []string{network.String()}, network.String(), nil
+	}
+
+	if ip := net.ParseIP(target); ip != nil {
+		if !ns.allowsIP(tenantNetworks, ip) {
+			return nil, "", fmt.Errorf("%w: %s", errScanTargetNotAllowed, target)
+		}
+		return []string{ip.String()}, ip.String(), nil
+	}
+
+	if !hostnamePattern.MatchString(target) {
+		return nil, "", fmt.Errorf("%w: %q is not an IP address, CIDR network, or hostname", errInvalidScanTarget, target)
+	}
+	resolved, err := net.DefaultResolver.LookupIPAddr(ctx, target)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errInvalidScanTarget, err)
+	}
+	// nmap scans one address family per run; IPv4 is preferred
+	ipv4, ipv6 := make([]string, 0), make([]string, 0)
+	for _, addr := range resolved {
+		if !ns.allowsIP(tenantNetworks, addr.IP) {
+			return nil, "", fmt.Errorf("%w: %s resolves to %s", errScanTargetNotAllowed, target, addr.IP)
+		}
+		if addr.IP.To4() != nil {
+			ipv4 = append(ipv4, addr.IP.String())
+		} else {
+			ipv6 = append(ipv6, addr.IP.String())
+		}
+	}
+	addresses := ipv4
+	if len(addresses) == 0 {
+		addresses = ipv6
+	}
+	if len(addresses) == 0 {
+		return nil, "", fmt.Errorf("%w: %s has no addresses", errInvalidScanTarget, target)
+	}
+	return addresses, strings.ToLower(strings.TrimSuffix(target, ".")), nil
+}
+
+// tenantNetworks returns the networks the context's tenant may scan, or nil for the default
+// tenant, which is limited by SCAN_ALLOWED_NETWORKS alone. Other tenants scan nothing until
+// their scan_allowed_networks are set.
+func (ns *NmapScanner) tenantNetworks(ctx context.Context) ([]*net.IPNet, error) {
+	tenant := tenantFromContext(ctx)
+	if tenant == defaultTenant {
+		return nil, nil
+	}
+	state := ns.tenants.state(ctx)
+	if state == nil || len(state.scanNetworks) == 0 {
+		return nil, fmt.Errorf("%w: tenant %s has no scan_allowed_networks", errScanTargetNotAllowed, tenant)
+	}
+	return state.scanNetworks, nil
+}
+
+func (ns *NmapScanner) allowsIP(tenantNetworks []*net.IPNet, ip net.IP) bool {
+	return containsIP(ns.allowed, ip) && (tenantNetworks == nil || containsIP(tenantNetworks, ip))
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsNetwork(networks []*net.IPNet, network *net.IPNet) bool {
+	ones, _ := network.Mask.Size()
+	for _, allowed := range networks {
+		allowedOnes, _ := allowed.Mask.Size()
+		if allowed.Contains(network.IP) && allowedOnes <= ones {
+			return true
+		}
+	}
+	return false
+}
+
+// parseScanNetworks parses a list of CIDRs, skipping blank entries
+func parseScanNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("entry %q: %w", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// claim starts the target's rate limit window, failing if one is already open. Redis errors do
+// not block scans.
+func (ns *NmapScanner) claim(ctx context.Context, key string) error {
+	if ns.interval <= 0 {
+		return nil
+	}
+	claimed, err := ns.redis.SetNX(ctx, nmapRateLimitPrefix+key, time.Now().Unix(), ns.interval).Result()
+	if err != nil {
+		log.Printf("nmap rate limit check for %s failed: %v", key, err)
+		return nil
+	}
+	if !claimed {
+		nmapScans.WithLabelValues("rate_limited").Inc()
+		wait := ns.interval
+		if ttl, err := ns.redis.TTL(ctx, nmapRateLimitPrefix+key).Result(); err == nil && ttl > 0 {
+			wait = ttl
+		}
+		return fmt.Errorf("%w: %s can be scanned again in %s", errScanRateLimited, key, wait.Round(time.Second))
+	}
+	return nil
+}
+
+type nmapRun struct {
+	Hosts []struct {
+		Status struct {
+			State string `xml:"state,attr"`
+		} `xml:"status"`
+		Addresses []struct {
+			Addr string `xml:"addr,attr"`
+			Type string `xml:"addrtype,attr"`
+		} `xml:"address"`
+		Ports []struct {
+			Protocol string `xml:"protocol,attr"`
+			PortID   int    `xml:"portid,attr"`
+			State    struct {
+				State string `xml:"state,attr"`
+			} `xml:"state"`
+			Service struct {
+				Name    string   `xml:"name,attr"`
+				Product string   `xml:"product,attr"`
+				Version string   `xml:"version,attr"`
+				CPE     []string `xml:"cpe"`
+			} `xml:"service"`
+		} `xml:"ports>port"`
+	} `xml:"host"`
+}
+
+func parseNmapXML(data []byte) ([]DiscoveredService, error) {
+	var run nmapRun
+	if err := xml.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("failed to parse nmap output: %w", err)
+	}
+
+	services := make([]DiscoveredService, 0)
+	for _, host := range run.Hosts {
+		if host.Status.State != "up" {
+			continue
+		}
+		address := ""
+		for _, addr := range host.Addresses {
+			if addr.Type == "ipv4" || addr.Type == "ipv6" {
+				address = addr.Addr
+				break
+			}
+		}
+
+		for _, port := range host.Ports {
+			if port.State.State != "open" {
+				continue
+			}
+			// nmap versions often carry distribution details: "8.2p1 Ubuntu 4ubuntu0.5"
+			version := ""
+			if fields := strings.Fields(port.Service.Version); len(fields) > 0 {
+				version = fields[0]
+			}
+			service := DiscoveredService{
+				Host:     address,
+				Port:     port.PortID,
+				Protocol: port.Protocol,
+				Name:     port.Service.Name,
+				Product:  port.Service.Product,
+				Version:  version,
+			}
+			for _, cpe := range port.Service.CPE {
+				if converted, ok := nmapCPE23(cpe, version); ok {
+					service.CPE = append(service.CPE, converted)
+				}
+			}
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+// nmapCPE23 converts the CPE 2.2 URIs nmap reports ("cpe:/a:openbsd:openssh:8.2p1") to CPE 2.3
+// names, filling in the detected version when an application URI has none. Hardware CPEs are
+// dropped.
+func nmapCPE23(uri, version string) (string, bool) {
+	if !strings.HasPrefix(uri, "cpe:/") {
+		return "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(uri, "cpe:/"), ":")
+	if len(parts) < 3 || (parts[0] != "a" && parts[0] != "o") {
+		return "", false
+	}
+	for len(parts) < 4 {
+		parts = append(parts, "")
+	}
+	// The detected version belongs to the application, not the OS it runs on
+	if parts[3] == "" && parts[0] == "a" {
+		parts[3] = version
+	}
+
+	fields := []string{"cpe", "2.3", parts[0], parts[1], parts[2], parts[3]}
+	for i := 3; i < len(fields); i++ {
+		if fields[i] == "" {
+			fields[i] = "*"
+		}
+	}
+	for len(fields) < 13 {
+		fields = append(fields, "*")
+	}
+	return strings.Join(fields, ":"), true
+}
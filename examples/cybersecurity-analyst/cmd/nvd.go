@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NVD CVE API 2.0 and CISA KEV synchronization
+const (
+	nvdFeed = "nvd"
+	kevFeed = "cisa_kev"
+
+	nvdPageSize     = 2000                 // maximum resultsPerPage of the CVE API
+	nvdMaxDateRange = 120 * 24 * time.Hour // maximum lastModStartDate..lastModEndDate span
+	nvdMaxRetries   = 5
+	nvdDateFormat   = "2006-01-02T15:04:05.000Z"
+)
+
+var (
+	cveSyncRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_cve_sync_total",
+			Help: "CVE feed synchronizations by feed and status",
+		},
+		[]string{"feed", "status"},
+	)
+
+	cveSyncLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cybersecurity_cve_sync_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful synchronization by feed",
+		},
+		[]string{"feed"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cveSyncRuns)
+	prometheus.MustRegister(cveSyncLastSuccess)
+}
+
+// CVESync keeps the CVE database current. The first NVD run downloads every CVE; later runs
+// fetch only CVEs modified since the stored watermark. The KEV catalog is small and replaced whole.
+// Every CVE stored is checked against the CVE watchlists.
+type CVESync struct {
+	db         *sql.DB
+	cves       *CVEDatabase
+	watchlists *CVEWatchlists
+	client     *http.Client
+	apiKey     string
+	nvdURL     string
+	kevURL     string
+	interval   time.Duration
+}
+
+func NewCVESync(db *sql.DB, cves *CVEDatabase, watchlists *CVEWatchlists, apiKey, nvdURL, kevURL string, interval time.Duration) *CVESync {
+	return &CVESync{
+		db:         db,
+		cves:       cves,
+		watchlists: watchlists,
+		client:     &http.Client{Timeout: 2 * time.Minute},
+		apiKey:     apiKey,
+		nvdURL:     nvdURL,
+		kevURL:     kevURL,
+		interval:   interval,
+	}
+}
+
+// Start synchronizes immediately and then on every interval until ctx is cancelled
+func (s *CVESync) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			s.SyncAll(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (s *CVESync) SyncAll(ctx context.Context) {
+	if err := s.cves.EnsureSchema(ctx); err != nil {
+		log.Printf("CVE sync skipped: %v", err)
+		return
+	}
+
+	for _, feed := range []struct {
+		name string
+		sync func(context.Context) (int, error)
+	}{
+		{nvdFeed, s.syncNVD},
+		{kevFeed, s.syncKEV},
+	} {
+		count, err := feed.sync(ctx)
+		if err != nil {
+			log.Printf("CVE sync of %s failed: %v", feed.name, err)
+			cveSyncRuns.WithLabelValues(feed.name, "failure").Inc()
+			s.recordFailure(ctx, feed.name, err)
+			continue
+		}
+		log.Printf("CVE sync of %s updated %d entries", feed.name, count)
+		cveSyncRuns.WithLabelValues(feed.name, "success").Inc()
+		cveSyncLastSuccess.WithLabelValues(feed.name).SetToCurrentTime()
+	}
+}
+
+// syncNVD pages through CVEs modified since the watermark, in windows no longer than the API
+// allows, advancing the watermark after each completed window
+func (s *CVESync) syncNVD(ctx context.Context) (int, error) {
+	var watermark sql.NullTime
+	err := s.db.QueryRowContext(ctx, `SELECT watermark FROM cve_sync_state WHERE feed = $1`, nvdFeed).Scan(&watermark)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to load watermark: %w", err)
+	}
+
+	updated := 0
+	now := time.Now().UTC()
+	if !watermark.Valid {
+		// Initial load: everything, then continue incrementally from the time it started
+		count, err := s.fetchNVD(ctx, url.Values{})
+		if err != nil {
+			return updated, err
+		}
+		updated += count
+		return updated, s.recordSuccess(ctx, nvdFeed, now, updated)
+	}
+
+	for start := watermark.Time; start.Before(now); {
+		end := start.Add(nvdMaxDateRange)
+		if end.After(now) {
+			end = now
+		}
+
+		params := url.Values{}
+		params.Set("lastModStartDate", start.UTC().Format(nvdDateFormat))
+		params.Set("lastModEndDate", end.UTC().Format(nvdDateFormat))
+		count, err := s.fetchNVD(ctx, params)
+		if err != nil {
+			return updated, err
+		}
+		updated += count
+
+		if err := s.recordSuccess(ctx, nvdFeed, end, updated); err != nil {
+			return updated, err
+		}
+		start = end
+	}
+	return updated, nil
+}
+
+func (s *CVESync) fetchNVD(ctx context.Context, params url.Values) (int, error) {
+	// Without an API key the NVD allows 5 requests per 30 seconds, with one 50
+	pause := 6 * time.Second
+	if s.apiKey != "" {
+		pause = 600 * time.Millisecond
+	}
+
+	updated := 0
+	for startIndex := 0; ; {
+		params.Set("resultsPerPage", strconv.Itoa(nvdPageSize))
+		params.Set("startIndex", strconv.Itoa(startIndex))
+
+		var page nvdResponse
+		if err := s.getJSON(ctx, s.nvdURL+"?"+params.Encode(), &page); err != nil {
+			return updated, fmt.Errorf("page at %d: %w", startIndex, err)
+		}
+		if err := s.storeCVEs(ctx, page.Vulnerabilities); err != nil {
+			return updated, err
+		}
+		updated += len(page.Vulnerabilities)
+
+		startIndex += len(page.Vulnerabilities)
+		if len(page.Vulnerabilities) == 0 || startIndex >= page.TotalResults {
+			return updated, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return updated, ctx.Err()
+		case <-time.After(pause):
+		}
+	}
+}
+
+// storeCVEs upserts one page of CVEs and replaces their CPE criteria in a single transaction
+func (s *CVESync) storeCVEs(ctx context.Context, items []nvdItem) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin CVE transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stored := make([]string, 0, len(items))
+	for _, item := range items {
+		cve := item.CVE
+		if cve.VulnStatus == "Rejected" {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM cves WHERE id = $1`, cve.ID); err != nil {
+				return fmt.Errorf("failed to delete rejected %s: %w", cve.ID, err)
+			}
+			continue
+		}
+
+		score, severity, vector := cve.Metrics.primary()
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO cves (id, description, severity, cvss_score, cvss_vector, published, last_modified)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (id) DO UPDATE SET
+				description = EXCLUDED.description, severity = EXCLUDED.severity,
+				cvss_score = EXCLUDED.cvss_score, cvss_vector = EXCLUDED.cvss_vector,
+				published = EXCLUDED.published, last_modified = EXCLUDED.last_modified`,
+			cve.ID, cve.description(), string(severity), score, vector, cve.Published.Time, cve.LastModified.Time); err != nil {
+			return fmt.Errorf("failed to store %s: %w", cve.ID, err)
+		}
+		stored = append(stored, cve.ID)
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM cve_cpe_matches WHERE cve_id = $1`, cve.ID); err != nil {
+			return fmt.Errorf("failed to replace CPE matches of %s: %w", cve.ID, err)
+		}
+		// Each vulnerable criterion is matched on its own; AND nodes such as "application running
+		// on platform" are not evaluated, so matches can over-report on the platform side
+		for _, configuration := range cve.Configurations {
+			for _, node := range configuration.Nodes {
+				for _, match := range node.CPEMatch {
+					parts := splitCPE(match.Criteria)
+					if !match.Vulnerable || len(parts) < 6 {
+						continue
+					}
+					if _, err := tx.ExecContext(ctx, `
+						INSERT INTO cve_cpe_matches (cve_id, criteria, vendor, product, version,
+							version_start_including, version_start_excluding, version_end_including, version_end_excluding)
+						VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+						cve.ID, match.Criteria, parts[3], parts[4], parts[5],
+						match.VersionStartIncluding, match.VersionStartExcluding, match.VersionEndIncluding, match.VersionEndExcluding); err != nil {
+						return fmt.Errorf("failed to store CPE match of %s: %w", cve.ID, err)
+					}
+				}
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit CVEs: %w", err)
+	}
+
+	// New CVEs, and those whose affected software NVD has analyzed since, may match a watchlist
+	s.watchlists.Check(ctx, stored)
+	return nil
+}
+
+// syncKEV replaces the Known Exploited Vulnerabilities catalog
+func (s *CVESync) syncKEV(ctx context.Context) (int, error) {
+	var catalog kevCatalog
+	if err := s.getJSON(ctx, s.kevURL, &catalog); err != nil {
+		return 0, err
+	}
+	if len(catalog.Vulnerabilities) == 0 {
+		return 0, fmt.Errorf("KEV catalog is empty")
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin KEV transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM kev_entries`); err != nil {
+		return 0, fmt.Errorf("failed to clear KEV entries: %w", err)
+	}
+	for _, v := range catalog.Vulnerabilities {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO kev_entries (cve_id, vulnerability, required_action, date_added, due_date, ransomware_use)
+			VALUES ($1, $2, $3, NULLIF($4, '')::date, NULLIF($5, '')::date, $6)
+			ON CONFLICT (cve_id) DO NOTHING`,
+			v.CVEID, v.VulnerabilityName, v.RequiredAction, v.DateAdded, v.DueDate,
+			strings.EqualFold(v.KnownRansomwareCampaignUse, "Known")); err != nil {
+			return 0, fmt.Errorf("failed to store KEV entry %s: %w", v.CVEID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit KEV entries: %w", err)
+	}
+
+	return len(catalog.Vulnerabilities), s.recordSuccess(ctx, kevFeed, time.Now().UTC(), len(catalog.Vulnerabilities))
+}
+
+// getJSON fetches a feed document, retrying rate limiting and server errors with backoff
+func (s *CVESync) getJSON(ctx context.Context, target string, out interface{}) error {
+	backoff := 10 * time.Second
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return err
+		}
+		if s.apiKey != "" && strings.HasPrefix(target, s.nvdURL) {
+			req.Header.Set("apiKey", s.apiKey)
+		}
+
+		resp, err := s.client.Do(req)
+		if err == nil {
+			if resp.StatusCode == http.StatusOK {
+				err = json.NewDecoder(resp.Body).Decode(out)
+				resp.Body.Close()
+				if err != nil {
+					return fmt.Errorf("invalid feed response: %w", err)
+				}
+				return nil
+			}
+
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			err = fmt.Errorf("feed returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+
+			retryable := resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+			if !retryable {
+				return err
+			}
+		}
+		if attempt == nvdMaxRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (s *CVESync) recordSuccess(ctx context.Context, feed string, watermark time.Time, entries int) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO cve_sync_state (feed, watermark, last_success, last_error, entries)
+		VALUES ($1, $2, NOW(), '', $3)
+		ON CONFLICT (feed) DO UPDATE SET
+			watermark = EXCLUDED.watermark, last_success = NOW(), last_error = '', entries = EXCLUDED.entries`,
+		feed, watermark, entries)
+	if err != nil {
+		return fmt.Errorf("failed to record %s sync: %w", feed, err)
+	}
+	return nil
+}
+
+func (s *CVESync) recordFailure(ctx context.Context, feed string, syncErr error) {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO cve_sync_state (feed, last_error) VALUES ($1, $2)
+		ON CONFLICT (feed) DO UPDATE SET last_error = EXCLUDED.last_error`,
+		feed, syncErr.Error())
+	if err != nil {
+		log.Printf("Failed to record %s sync failure: %v", feed, err)
+	}
+}
+
+// NVD CVE API 2.0 response, reduced to the fields the database keeps
+type nvdResponse struct {
+	TotalResults    int       `json:"totalResults"`
+	Vulnerabilities []nvdItem `json:"vulnerabilities"`
+}
+
+type nvdItem struct {
+	CVE nvdCVE `json:"cve"`
+}
+
+type nvdCVE struct {
+	ID           string  `json:"id"`
+	VulnStatus   string  `json:"vulnStatus"`
+	Published    nvdTime `json:"published"`
+	LastModified nvdTime `json:"lastModified"`
+	Descriptions []struct {
+		Lang  string `json:"lang"`
+		Value string `json:"value"`
+	} `json:"descriptions"`
+	Metrics        nvdMetrics `json:"metrics"`
+	Configurations []struct {
+		Nodes []struct {
+			CPEMatch []struct {
+				Vulnerable            bool   `json:"vulnerable"`
+				Criteria              string `json:"criteria"`
+				VersionStartIncluding string `json:"versionStartIncluding"`
+				VersionStartExcluding string `json:"versionStartExcluding"`
+				VersionEndIncluding   string `json:"versionEndIncluding"`
+				VersionEndExcluding   string `json:"versionEndExcluding"`
+			} `json:"cpeMatch"`
+		} `json:"nodes"`
+	} `json:"configurations"`
+}
+
+func (c nvdCVE) description() string {
+	for _, d := range c.Descriptions {
+		if d.Lang == "en" {
+			return d.Value
+		}
+	}
+	if len(c.Descriptions) > 0 {
+		return c.Descriptions[0].Value
+	}
+	return ""
+}
+
+type nvdMetric struct {
+	Type         string `json:"type"`         // "Primary" (NVD) or "Secondary" (CNA)
+	BaseSeverity string `json:"baseSeverity"` // CVSS v2 only
+	CVSSData     struct {
+		BaseScore    float64 `json:"baseScore"`
+		BaseSeverity string  `json:"baseSeverity"`
+		VectorString string  `json:"vectorString"`
+	} `json:"cvssData"`
+}
+
+type nvdMetrics struct {
+	V40 []nvdMetric `json:"cvssMetricV40"`
+	V31 []nvdMetric `json:"cvssMetricV31"`
+	V30 []nvdMetric `json:"cvssMetricV30"`
+	V2  []nvdMetric `json:"cvssMetricV2"`
+}
+
+// primary picks the CVSS v3.1 score, falling back to v3.0, v4.0, then v2, and prefers NVD's own
+// score over the CNA's
+func (m nvdMetrics) primary() (float64, ThreatLevel, string) {
+	for _, metrics := range [][]nvdMetric{m.V31, m.V30, m.V40, m.V2} {
+		if len(metrics) == 0 {
+			continue
+		}
+		chosen := metrics[0]
+		for _, metric := range metrics {
+			if metric.Type == "Primary" {
+				chosen = metric
+				break
+			}
+		}
+
+		severity := chosen.CVSSData.BaseSeverity
+		if severity == "" {
+			severity = chosen.BaseSeverity
+		}
+		return chosen.CVSSData.BaseScore, threatLevelFromCVSS(severity), chosen.CVSSData.VectorString
+	}
+	return 0, Low, ""
+}
+
+func threatLevelFromCVSS(severity string) ThreatLevel {
+	switch strings.ToUpper(severity) {
+	case "CRITICAL":
+		return Critical
+	case "HIGH":
+		return High
+	case "MEDIUM":
+		return Medium
+	default:
+		return Low
+	}
+}
+
+// nvdTime parses the API's timestamps, which carry no zone and are UTC
+type nvdTime struct {
+	time.Time
+}
+
+func (t *nvdTime) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil || value == "" {
+		return err
+	}
+	parsed, err := time.Parse("2006-01-02T15:04:05.999", value)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed
+	return nil
+}
+
+// CISA Known Exploited Vulnerabilities catalog
+type kevCatalog struct {
+	Vulnerabilities []struct {
+		CVEID                      string `json:"cveID"`
+		VulnerabilityName          string `json:"vulnerabilityName"`
+		DateAdded                  string `json:"dateAdded"`
+		RequiredAction             string `json:"requiredAction"`
+		DueDate                    string `json:"dueDate"`
+		KnownRansomwareCampaignUse string `json:"knownRansomwareCampaignUse"`
+	} `json:"vulnerabilities"`
+}
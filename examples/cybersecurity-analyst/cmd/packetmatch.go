@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Packet criteria for signatures imported from IDS rules
+const maxIndexedPorts = 64 // rules with larger destination port sets are checked for every packet
+
+// Suricata's default address and port groups; HOME_NET can be overridden with IDS_HOME_NET
+var idsVariableDefaults = map[string]string{
+	"HOME_NET":        "[192.168.0.0/16,10.0.0.0/8,172.16.0.0/12]",
+	"EXTERNAL_NET":    "!$HOME_NET",
+	"HTTP_SERVERS":    "$HOME_NET",
+	"SMTP_SERVERS":    "$HOME_NET",
+	"SQL_SERVERS":     "$HOME_NET",
+	"DNS_SERVERS":     "$HOME_NET",
+	"TELNET_SERVERS":  "$HOME_NET",
+	"AIM_SERVERS":     "$EXTERNAL_NET",
+	"DC_SERVERS":      "$HOME_NET",
+	"DNP3_SERVER":     "$HOME_NET",
+	"DNP3_CLIENT":     "$HOME_NET",
+	"MODBUS_CLIENT":   "$HOME_NET",
+	"MODBUS_SERVER":   "$HOME_NET",
+	"ENIP_CLIENT":     "$HOME_NET",
+	"ENIP_SERVER":     "$HOME_NET",
+	"HTTP_PORTS":      "80",
+	"SHELLCODE_PORTS": "!80",
+	"ORACLE_PORTS":    "1521",
+	"SSH_PORTS":       "22",
+	"DNP3_PORTS":      "20000",
+	"MODBUS_PORTS":    "502",
+	"FILE_DATA_PORTS": "[$HTTP_PORTS,110,143]",
+	"FTP_PORTS":       "21",
+	"GENEVE_PORTS":    "6081",
+	"VXLAN_PORTS":     "4789",
+	"TEREDO_PORTS":    "3544",
+}
+
+// PacketMatch holds the packet criteria of a signature imported from a Snort/Suricata rule, in
+// rule syntax so it stays readable; it is compiled when the signature index is built
+type PacketMatch struct {
+	Protocol        string         `json:"protocol,omitempty"` // TCP, UDP, ICMP; empty matches any
+	Source          string         `json:"source"`
+	SourcePorts     string         `json:"source_ports"`
+	Destination     string         `json:"destination"`
+	DestPorts       string         `json:"dest_ports"`
+	Bidirectional   bool           `json:"bidirectional,omitempty"`
+	Established     *bool          `json:"established,omitempty"` // approximated by the ACK flag
+	Flags           string         `json:"flags,omitempty"`
+	PayloadSize     string         `json:"dsize,omitempty"`
+	Contents        []ContentMatch `json:"contents,omitempty"`
+	Patterns        []string       `json:"patterns,omitempty"`         // Go regular expressions converted from pcre
+	NegatedPatterns []string       `json:"negated_patterns,omitempty"` // must not match
+}
+
+// ContentMatch is a content option with its modifiers. Offset and depth anchor a match in the
+// payload; distance and within position it after the previous content match.
+type ContentMatch struct {
+	Content    string `json:"content"` // rule syntax, with |hex| bytes
+	Negated    bool   `json:"negated,omitempty"`
+	Nocase     bool   `json:"nocase,omitempty"`
+	Offset     *int   `json:"offset,omitempty"`
+	Depth      *int   `json:"depth,omitempty"`
+	Distance   *int   `json:"distance,omitempty"`
+	Within     *int   `json:"within,omitempty"`
+	StartsWith bool   `json:"startswith,omitempty"`
+	EndsWith   bool   `json:"endswith,omitempty"`
+}
+
+type compiledPacketMatch struct {
+	protocol        string
+	src, dst        func(net.IP) bool
+	srcPorts        func(int) bool
+	dstPorts        func(int) bool
+	dstPortList     []int // finite destination ports, used to index the rule
+	bidirectional   bool
+	established     *bool
+	flags           func(map[string]bool) bool
+	payloadSize     func(int) bool
+	contents        []compiledContent
+	patterns        []*regexp.Regexp
+	negatedPatterns []*regexp.Regexp
+}
+
+type compiledContent struct {
+	ContentMatch
+	bytes []byte
+}
+
+func (m *compiledPacketMatch) matches(packet NetworkPacket) bool {
+	if m.protocol != "" && !strings.EqualFold(m.protocol, packet.Protocol) {
+		return false
+	}
+	if !m.matchesEndpoints(packet.SourceIP, packet.SourcePort, packet.DestIP, packet.DestPort) &&
+		!(m.bidirectional && m.matchesEndpoints(packet.DestIP, packet.DestPort, packet.SourceIP, packet.SourcePort)) {
+		return false
+	}
+	if m.established != nil && packet.Protocol == "TCP" && packet.Flags["ACK"] != *m.established {
+		return false
+	}
+	if m.flags != nil && !m.flags(packet.Flags) {
+		return false
+	}
+	if m.payloadSize != nil && !m.payloadSize(packet.PayloadSize) {
+		return false
+	}
+	if !matchContents(m.contents, packet.Payload) {
+		return false
+	}
+	for _, re := range m.patterns {
+		if !re.Match(packet.Payload) {
+			return false
+		}
+	}
+	for _, re := range m.negatedPatterns {
+		if re.Match(packet.Payload) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *compiledPacketMatch) matchesEndpoints(srcIP string, srcPort int, dstIP string, dstPort int) bool {
+	src, dst := net.ParseIP(srcIP), net.ParseIP(dstIP)
+	return m.src(src) && m.srcPorts(srcPort) && m.dst(dst) && m.dstPorts(dstPort)
+}
+
+// matchContents checks the content matches in order. Relative matches are anchored on the first
+// occurrence of the previous content; the search does not backtrack to later occurrences.
+func matchContents(contents []compiledContent, payload []byte) bool {
+	if len(contents) == 0 {
+		return true
+	}
+
+	var lower []byte
+	prevEnd := 0
+	for _, c := range contents {
+		data := payload
+		if c.Nocase {
+			if lower == nil {
+				lower = bytes.ToLower(payload)
+			}
+			data = lower
+		}
+
+		start, end := 0, len(data)
+		if c.Distance != nil || c.Within != nil {
+			if c.Distance != nil {
+				start = prevEnd + *c.Distance
+			} else {
+				start = prevEnd
+			}
+			if c.Within != nil {
+				end = prevEnd + *c.Within
+			}
+		} else {
+			if c.Offset != nil {
+				start = *c.Offset
+			}
+			if c.Depth != nil {
+				end = start + *c.Depth
+			}
+		}
+		if c.StartsWith {
+			start, end = 0, len(c.bytes)
+		}
+		if start < 0 {
+			start = 0
+		}
+		if end > len(data) {
+			end = len(data)
+		}
+
+		found := -1
+		if start <= end {
+			window := data[start:end]
+			if c.EndsWith {
+				if end == len(data) && bytes.HasSuffix(window, c.bytes) {
+					found = len(window) - len(c.bytes)
+				}
+			} else {
+				found = bytes.Index(window, c.bytes)
+			}
+		}
+
+		if c.Negated {
+			if found >= 0 {
+				return false
+			}
+			continue
+		}
+		if found < 0 {
+			return false
+		}
+		prevEnd = start + found + len(c.bytes)
+	}
+	return true
+}
+
+func compilePacketMatch(pm *PacketMatch) (*compiledPacketMatch, error) {
+	m := &compiledPacketMatch{
+		protocol:      pm.Protocol,
+		bidirectional: pm.Bidirectional,
+		established:   pm.Established,
+	}
+
+	var err error
+	if m.src, err = parseAddressSpec(pm.Source, 0); err != nil {
+		return nil, fmt.Errorf("source %q: %w", pm.Source, err)
+	}
+	if m.dst, err = parseAddressSpec(pm.Destination, 0); err != nil {
+		return nil, fmt.Errorf("destination %q: %w", pm.Destination, err)
+	}
+	if m.srcPorts, _, err = parsePortSpec(pm.SourcePorts, 0); err != nil {
+		return nil, fmt.Errorf("source ports %q: %w", pm.SourcePorts, err)
+	}
+	var dstPorts []int
+	if m.dstPorts, dstPorts, err = parsePortSpec(pm.DestPorts, 0); err != nil {
+		return nil, fmt.Errorf("destination ports %q: %w", pm.DestPorts, err)
+	}
+	if dstPorts != nil && len(dstPorts) <= maxIndexedPorts {
+		m.dstPortList = dstPorts
+	}
+
+	if pm.Flags != "" {
+		if m.flags, err = parseTCPFlags(pm.Flags); err != nil {
+			return nil, err
+		}
+	}
+	if pm.PayloadSize != "" {
+		if m.payloadSize, err = parseSizeSpec(pm.PayloadSize); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, content := range pm.Contents {
+		decoded, err := decodeRuleContent(content.Content)
+		if err != nil {
+			return nil, err
+		}
+		if content.Nocase {
+			decoded = bytes.ToLower(decoded)
+		}
+		m.contents = append(m.contents, compiledContent{ContentMatch: content, bytes: decoded})
+	}
+	for _, pattern := range pm.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		m.patterns = append(m.patterns, re)
+	}
+	for _, pattern := range pm.NegatedPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		m.negatedPatterns = append(m.negatedPatterns, re)
+	}
+	return m, nil
+}
+
+// idsVariable resolves a $VARIABLE, preferring IDS_HOME_NET for HOME_NET
+func idsVariable(name string) (string, bool) {
+	if name == "HOME_NET" && config.IDSHomeNet != "" {
+		return config.IDSHomeNet, true
+	}
+	value, ok := idsVariableDefaults[name]
+	return value, ok
+}
+
+// splitRuleList splits "[a,[b,c],!d]" into its top-level elements
+func splitRuleList(spec string) []string {
+	inner := strings.TrimSuffix(strings.TrimPrefix(spec, "["), "]")
+	elements := make([]string, 0)
+	depth, start := 0, 0
+	for i, r := range inner {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				elements = append(elements, strings.TrimSpace(inner[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(elements, strings.TrimSpace(inner[start:]))
+}
+
+// parseAddressSpec compiles rule address syntax: any, $VAR, addresses, CIDRs, [lists], and !negation.
+// A list matches when a positive element matches and no negated element does.
+func parseAddressSpec(spec string, depth int) (func(net.IP) bool, error) {
+	spec = strings.TrimSpace(spec)
+	if depth > 8 {
+		return nil, fmt.Errorf("variables nest too deeply")
+	}
+
+	switch {
+	case spec == "" || strings.EqualFold(spec, "any"):
+		return func(net.IP) bool { return true }, nil
+	case strings.HasPrefix(spec, "!"):
+		inner, err := parseAddressSpec(spec[1:], depth)
+		if err != nil {
+			return nil, err
+		}
+		return func(ip net.IP) bool { return ip != nil && !inner(ip) }, nil
+	case strings.HasPrefix(spec, "$"):
+		value, ok := idsVariable(spec[1:])
+		if !ok {
+			return nil, fmt.Errorf("unknown variable %s", spec)
+		}
+		return parseAddressSpec(value, depth+1)
+	case strings.HasPrefix(spec, "["):
+		var positive, negative []func(net.IP) bool
+		for _, element := range splitRuleList(spec) {
+			negated := strings.HasPrefix(element, "!")
+			matcher, err := parseAddressSpec(strings.TrimPrefix(element, "!"), depth)
+			if err != nil {
+				return nil, err
+			}
+			if negated {
+				negative = append(negative, matcher)
+			} else {
+				positive = append(positive, matcher)
+			}
+		}
+		return func(ip net.IP) bool {
+			for _, matcher := range negative {
+				if matcher(ip) {
+					return false
+				}
+			}
+			if len(positive) == 0 {
+				return true
+			}
+			for _, matcher := range positive {
+				if matcher(ip) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	if !strings.Contains(spec, "/") {
+		ip := net.ParseIP(spec)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", spec)
+		}
+		return func(candidate net.IP) bool { return ip.Equal(candidate) }, nil
+	}
+	_, network, err := net.ParseCIDR(spec)
+	if err != nil {
+		return nil, err
+	}
+	return func(ip net.IP) bool { return ip != nil && network.Contains(ip) }, nil
+}
+
+// parsePortSpec compiles rule port syntax: any, $VAR, N, N:M, N:, :M, [lists], and !negation. It
+// also returns the matched ports when they form a finite set without negation.
+func parsePortSpec(spec string, depth int) (func(int) bool, []int, error) {
+	spec = strings.TrimSpace(spec)
+	if depth > 8 {
+		return nil, nil, fmt.Errorf("variables nest too deeply")
+	}
+
+	switch {
+	case spec == "" || strings.EqualFold(spec, "any"):
+		return func(int) bool { return true }, nil, nil
+	case strings.HasPrefix(spec, "!"):
+		inner, _, err := parsePortSpec(spec[1:], depth)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(port int) bool { return !inner(port) }, nil, nil
+	case strings.HasPrefix(spec, "$"):
+		value, ok := idsVariable(spec[1:])
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown variable %s", spec)
+		}
+		return parsePortSpec(value, depth+1)
+	case strings.HasPrefix(spec, "["):
+		var positive, negative []func(int) bool
+		ports := make([]int, 0)
+		finite := true
+		for _, element := range splitRuleList(spec) {
+			negated := strings.HasPrefix(element, "!")
+			matcher, list, err := parsePortSpec(strings.TrimPrefix(element, "!"), depth)
+			if err != nil {
+				return nil, nil, err
+			}
+			if negated {
+				negative = append(negative, matcher)
+				finite = false
+				continue
+			}
+			positive = append(positive, matcher)
+			if list == nil {
+				finite = false
+			}
+			ports = append(ports, list...)
+		}
+		if !finite || len(positive) == 0 {
+			ports = nil
+		}
+		return func(port int) bool {
+			for _, matcher := range negative {
+				if matcher(port) {
+					return false
+				}
+			}
+			if len(positive) == 0 {
+				return true
+			}
+			for _, matcher := range positive {
+				if matcher(port) {
+					return true
+				}
+			}
+			return false
+		}, ports, nil
+	}
+
+	if low, high, ok := strings.Cut(spec, ":"); ok {
+		min, max := 0, 65535
+		var err error
+		if low != "" {
+			if min, err = strconv.Atoi(low); err != nil {
+				return nil, nil, fmt.Errorf("invalid port range %q", spec)
+			}
+		}
+		if high != "" {
+			if max, err = strconv.Atoi(high); err != nil {
+				return nil, nil, fmt.Errorf("invalid port range %q", spec)
+			}
+		}
+		var ports []int
+		if max-min < maxIndexedPorts {
+			for port := min; port <= max; port++ {
+				ports = append(ports, port)
+			}
+		}
+		return func(port int) bool { return port >= min && port <= max }, ports, nil
+	}
+
+	port, err := strconv.Atoi(spec)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, nil, fmt.Errorf("invalid port %q", spec)
+	}
+	return func(candidate int) bool { return candidate == port }, []int{port}, nil
+}
+
+// parseTCPFlags compiles the flags option: letters FSRPAU (0 for none), optionally prefixed by
+// + (at least these), * (any of these), or ! (none of these); a ",mask" suffix is ignored
+func parseTCPFlags(spec string) (func(map[string]bool) bool, error) {
+	spec, _, _ = strings.Cut(strings.TrimSpace(spec), ",")
+	names := map[rune]string{'F': "FIN", 'S': "SYN", 'R': "RST", 'P': "PSH", 'A': "ACK", 'U': "URG"}
+
+	mode := byte('=')
+	if spec != "" && strings.ContainsRune("+*!", rune(spec[0])) {
+		mode = spec[0]
+		spec = spec[1:]
+	} else if spec != "" && strings.ContainsRune("+*!", rune(spec[len(spec)-1])) {
+		mode = spec[len(spec)-1]
+		spec = spec[:len(spec)-1]
+	}
+
+	wanted := make(map[string]bool)
+	for _, r := range strings.ToUpper(spec) {
+		switch {
+		case r == '0':
+		case r == '1' || r == '2' || r == 'C' || r == 'E':
+			// Reserved/ECN bits are not decoded; they neither satisfy nor block a match
+		case names[r] != "":
+			wanted[names[r]] = true
+		default:
+			return nil, fmt.Errorf("invalid TCP flag %q", r)
+		}
+	}
+
+	return func(flags map[string]bool) bool {
+		switch mode {
+		case '+':
+			for name := range wanted {
+				if !flags[name] {
+					return false
+				}
+			}
+			return true
+		case '*':
+			for name := range wanted {
+				if flags[name] {
+					return true
+				}
+			}
+			return len(wanted) == 0
+		case '!':
+			for name := range wanted {
+				if flags[name] {
+					return false
+				}
+			}
+			return true
+		default:
+			for _, name := range names {
+				if flags[name] != wanted[name] {
+					return false
+				}
+			}
+			return true
+		}
+	}, nil
+}
+
+// parseSizeSpec compiles dsize: N, >N, <N, and N<>M
+func parseSizeSpec(spec string) (func(int) bool, error) {
+	spec = strings.ReplaceAll(spec, " ", "")
+	number := func(s string) (int, error) {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid dsize %q", spec)
+		}
+		return n, nil
+	}
+
+	if low, high, ok := strings.Cut(spec, "<>"); ok {
+		min, err := number(low)
+		if err != nil {
+			return nil, err
+		}
+		max, err := number(high)
+		if err != nil {
+			return nil, err
+		}
+		return func(size int) bool { return size > min && size < max }, nil
+	}
+	switch {
+	case strings.HasPrefix(spec, ">"):
+		min, err := number(spec[1:])
+		if err != nil {
+			return nil, err
+		}
+		return func(size int) bool { return size > min }, nil
+	case strings.HasPrefix(spec, "<"):
+		max, err := number(spec[1:])
+		if err != nil {
+			return nil, err
+		}
+		return func(size int) bool { return size < max }, nil
+	default:
+		exact, err := number(strings.TrimPrefix(spec, "="))
+		if err != nil {
+			return nil, err
+		}
+		return func(size int) bool { return size == exact }, nil
+	}
+}
+
+// decodeRuleContent decodes content syntax: literal text with \" \; \\ escapes and |hex| byte blocks
+func decodeRuleContent(content string) ([]byte, error) {
+	decoded := make([]byte, 0, len(content))
+	inHex := false
+	hex := ""
+	for i := 0; i < len(content); i++ {
+		ch := content[i]
+		switch {
+		case ch == '|':
+			if inHex {
+				for _, b := range strings.Fields(hex) {
+					if len(b)%2 != 0 {
+						return nil, fmt.Errorf("invalid hex bytes %q in content", hex)
+					}
+					for j := 0; j < len(b); j += 2 {
+						v, err := strconv.ParseUint(b[j:j+2], 16, 8)
+						if err != nil {
+							return nil, fmt.Errorf("invalid hex bytes %q in content", hex)
+						}
+						decoded = append(decoded, byte(v))
+					}
+				}
+				hex = ""
+			}
+			inHex = !inHex
+		case inHex:
+			hex += string(ch)
+		case ch == '\\' && i+1 < len(content):
+			i++
+			decoded = append(decoded, content[i])
+		default:
+			decoded = append(decoded, ch)
+		}
+	}
+	if inHex {
+		return nil, fmt.Errorf("unterminated hex block in content")
+	}
+	if len(decoded) == 0 {
+		return nil, fmt.Errorf("empty content")
+	}
+	return decoded, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Packet analysis worker pool: large packet sets are split into chunks that a bounded set of
+// workers inspect in parallel, and the per-chunk findings are merged as they complete
+var (
+	errPacketPoolBusy    = errors.New("packet analysis queue is full")
+	errPacketPoolStopped = errors.New("packet analysis is shutting down")
+)
+
+var (
+	packetQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cybersecurity_packet_queue_depth",
+		Help: "Packet chunks waiting for a worker",
+	})
+	packetWorkersBusy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cybersecurity_packet_workers_busy",
+		Help: "Packet workers inspecting a chunk",
+	})
+	packetQueueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cybersecurity_packet_queue_wait_seconds",
+		Help:    "Time packet chunks wait for a worker",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 4, 8),
+	})
+	packetChunks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_packet_chunks_total",
+			Help: "Packet chunks by outcome (inspected, rejected when the queue stayed full)",
+		},
+		[]string{"outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(packetQueueDepth)
+	prometheus.MustRegister(packetWorkersBusy)
+	prometheus.MustRegister(packetQueueWait)
+	prometheus.MustRegister(packetChunks)
+}
+
+// packetFindings is what inspecting a run of packets found. Findings of consecutive runs merge
+// into those of the whole set; port scans are judged only on the merged counts. Floods span
+// requests and need packet timing, so DDoSDetector judges them separately.
+type packetFindings struct {
+	ports map[string]map[int]int // source -> destination port -> packets
+	hits  *signatureHits
+}
+
+func (td *ThreatDetector) inspectPackets(matcher *packetMatcher, packets []NetworkPacket) *packetFindings {
+	findings := &packetFindings{ports: make(map[string]map[int]int)}
+
+	for _, packet := range packets {
+		if findings.ports[packet.SourceIP] == nil {
+			findings.ports[packet.SourceIP] = make(map[int]int)
+		}
+		findings.ports[packet.SourceIP][packet.DestPort]++
+	}
+
+	// Imported IDS rules
+	if matcher != nil {
+		findings.hits = matcher.match(packets)
+	}
+	return findings
+}
+
+// merge adds the findings of the packets that followed f's
+func (f *packetFindings) merge(other *packetFindings) {
+	for source, ports := range other.ports {
+		if f.ports[source] == nil {
+			f.ports[source] = ports
+			continue
+		}
+		for port, count := range ports {
+			f.ports[source][port] += count
+		}
+	}
+	switch {
+	case f.hits == nil:
+		f.hits = other.hits
+	case other.hits != nil:
+		f.hits.merge(other.hits)
+	}
+}
+
+func (f *packetFindings) indicators() []ThreatIndicator {
+	threats := make([]ThreatIndicator, 0)
+
+	// Detect port scans
+	for ip, ports := range f.ports {
+		if len(ports) > 20 {
+			threats = append(threats, ThreatIndicator{
+				Type:        Intrusion,
+				Severity:    High,
+				Confidence:  0.88,
+				Description: "Port scan detected",
+				SourceIP:    ip,
+				MITREAttack: "T1046",
+				Evidence:    []string{fmt.Sprintf("Accessed %d different ports", len(ports))},
+			})
+		}
+	}
+
+	if f.hits != nil {
+		threats = append(threats, f.hits.indicators()...)
+	}
+	return threats
+}
+
+type packetChunk struct {
+	index    int
+	packets  []NetworkPacket
+	matcher  *packetMatcher
+	queued   time.Time
+	findings chan<- chunkFindings
+}
+
+type chunkFindings struct {
+	index    int
+	findings *packetFindings
+}
+
+// PacketPool inspects packet chunks on a fixed number of workers. The queue is bounded, so a
+// burst larger than the workers can absorb waits for space, and fails after queueTimeout.
+type PacketPool struct {
+	detector     *ThreatDetector
+	workers      int
+	chunkSize    int
+	queueTimeout time.Duration
+	queue        chan packetChunk
+	stopped      chan struct{}
+}
+
+func NewPacketPool(detector *ThreatDetector, workers, chunkSize, queueSize int, queueTimeout time.Duration) *PacketPool {
+	return &PacketPool{
+		detector:     detector,
+		workers:      max(workers, 1),
+		chunkSize:    max(chunkSize, 1),
+		queueTimeout: queueTimeout,
+		queue:        make(chan packetChunk, max(queueSize, 1)),
+		stopped:      make(chan struct{}),
+	}
+}
+
+// Start runs the workers until ctx is cancelled; chunks already queued are inspected first
+func (p *PacketPool) Start(ctx context.Context) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case chunk := <-p.queue:
+					p.inspect(chunk)
+				case <-ctx.Done():
+					for {
+						select {
+						case chunk := <-p.queue:
+							p.inspect(chunk)
+						default:
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		close(p.stopped)
+	}()
+
+	log.Printf("Inspecting packets on %d workers in chunks of %d", p.workers, p.chunkSize)
+	return &wg
+}
+
+func (p *PacketPool) inspect(chunk packetChunk) {
+	packetQueueDepth.Set(float64(len(p.queue)))
+	packetQueueWait.Observe(time.Since(chunk.queued).Seconds())
+	packetWorkersBusy.Inc()
+	defer packetWorkersBusy.Dec()
+
+	chunk.findings <- chunkFindings{index: chunk.index, findings: p.detector.inspectPackets(chunk.matcher, chunk.packets)}
+	packetChunks.WithLabelValues("inspected").Inc()
+}
+
+// Detect inspects the packets on the pool and returns the same indicators as inspecting them in
+// one pass. Findings are merged in packet order as soon as each chunk and those before it are in,
+// so only out-of-order chunks are held.
+func (p *PacketPool) Detect(ctx context.Context, packets []NetworkPacket) ([]ThreatIndicator, error) {
+	matcher := p.detector.packetMatcher(ctx)
+	chunks := (len(packets) + p.chunkSize - 1) / p.chunkSize
+	// Buffered for every chunk, so workers never block on a request that gave up
+	results := make(chan chunkFindings, chunks)
+
+	submitted := 0
+	var timeout <-chan time.Time
+	if p.queueTimeout > 0 {
+		timer := time.NewTimer(p.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for start := 0; start < len(packets); start += p.chunkSize {
+		chunk := packetChunk{
+			index:    submitted,
+			packets:  packets[start:min(start+p.chunkSize, len(packets))],
+			matcher:  matcher,
+			queued:   time.Now(),
+			findings: results,
+		}
+		select {
+		case p.queue <- chunk:
+			submitted++
+			packetQueueDepth.Set(float64(len(p.queue)))
+		case <-timeout:
+			packetChunks.WithLabelValues("rejected").Add(float64(chunks - submitted))
+			return nil, fmt.Errorf("%w: %d of %d chunks queued", errPacketPoolBusy, submitted, chunks)
+		case <-p.stopped:
+			return nil, errPacketPoolStopped
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	var merged *packetFindings
+	pending := make(map[int]*packetFindings)
+	for next := 0; next < chunks; {
+		select {
+		case result := <-results:
+			pending[result.index] = result.findings
+			for pending[next] != nil {
+				if merged == nil {
+					merged = pending[next]
+				} else {
+					merged.merge(pending[next])
+				}
+				delete(pending, next)
+				next++
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if merged == nil {
+		return make([]ThreatIndicator, 0), nil
+	}
+	return merged.indicators(), nil
+}
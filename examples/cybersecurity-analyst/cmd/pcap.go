@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// PCAP/PCAPNG capture ingestion
+const maxPayloadCapture = 4096 // payload bytes kept per packet for signature matching
+
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+type CaptureSummary struct {
+	Filename  string `json:"filename"`
+	Format    string `json:"format"` // "pcap" or "pcapng"
+	LinkType  string `json:"link_type"`
+	Packets   int    `json:"packets"`   // IP packets analyzed
+	Skipped   int    `json:"skipped"`   // frames without an IPv4/IPv6 layer
+	Truncated bool   `json:"truncated"` // capture exceeded PacketBufferSize packets
+}
+
+type PcapIngestResponse struct {
+	*ThreatDetectionResponse
+	Capture CaptureSummary `json:"capture"`
+}
+
+// captureReader is implemented by both pcapgo readers
+type captureReader interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// ReadCapture decodes a pcap or pcapng stream into NetworkPackets, stopping after maxPackets
+func ReadCapture(r io.Reader, maxPackets int) ([]NetworkPacket, CaptureSummary, error) {
+	summary := CaptureSummary{}
+
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(4)
+	if err != nil {
+		return nil, summary, fmt.Errorf("capture too short: %w", err)
+	}
+
+	var reader captureReader
+	if bytes.Equal(magic, pcapngMagic) {
+		summary.Format = "pcapng"
+		reader, err = pcapgo.NewNgReader(buffered, pcapgo.DefaultNgReaderOptions)
+	} else {
+		summary.Format = "pcap"
+		reader, err = pcapgo.NewReader(buffered)
+	}
+	if err != nil {
+		return nil, summary, fmt.Errorf("not a pcap or pcapng capture: %w", err)
+	}
+	summary.LinkType = reader.LinkType().String()
+
+	packets := make([]NetworkPacket, 0)
+	for {
+		data, ci, err := reader.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// A capture cut off mid-record still yields the packets before it
+			if len(packets) > 0 && errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return nil, summary, fmt.Errorf("failed to read packet %d: %w", len(packets)+summary.Skipped+1, err)
+		}
+
+		if len(packets) >= maxPackets {
+			summary.Truncated = true
+			break
+		}
+
+		packet, ok := decodePacket(gopacket.NewPacket(data, reader.LinkType(), gopacket.DecodeOptions{Lazy: true, NoCopy: true}), ci.Timestamp)
+		if !ok {
+			summary.Skipped++
+			continue
+		}
+		packets = append(packets, packet)
+	}
+
+	summary.Packets = len(packets)
+	return packets, summary, nil
+}
+
+// decodePacket maps a decoded frame onto a NetworkPacket; frames without an IP layer are skipped
+func decodePacket(p gopacket.Packet, timestamp time.Time) (NetworkPacket, bool) {
+	packet := NetworkPacket{
+		Timestamp: timestamp,
+		Flags:     make(map[string]bool),
+	}
+
+	switch ip := p.NetworkLayer().(type) {
+	case *layers.IPv4:
+		packet.SourceIP = ip.SrcIP.String()
+		packet.DestIP = ip.DstIP.String()
+		packet.Protocol = ip.Protocol.String()
+	case *layers.IPv6:
+		packet.SourceIP = ip.SrcIP.String()
+		packet.DestIP = ip.DstIP.String()
+		packet.Protocol = ip.NextHeader.String()
+	default:
+		return packet, false
+	}
+
+	switch transport := p.TransportLayer().(type) {
+	case *layers.TCP:
+		packet.Protocol = "TCP"
+		packet.SourcePort = int(transport.SrcPort)
+		packet.DestPort = int(transport.DstPort)
+		packet.Flags["SYN"] = transport.SYN
+		packet.Flags["ACK"] = transport.ACK
+		packet.Flags["FIN"] = transport.FIN
+		packet.Flags["RST"] = transport.RST
+		packet.Flags["PSH"] = transport.PSH
+		packet.Flags["URG"] = transport.URG
+	case *layers.UDP:
+		packet.Protocol = "UDP"
+		packet.SourcePort = int(transport.SrcPort)
+		packet.DestPort = int(transport.DstPort)
+	}
+
+	if app := p.ApplicationLayer(); app != nil {
+		payload := app.Payload()
+		packet.PayloadSize = len(payload)
+		if len(payload) > maxPayloadCapture {
+			payload = payload[:maxPayloadCapture]
+		}
+		packet.Payload = append([]byte(nil), payload...)
+	}
+
+	return packet, true
+}
+
+// HTTP Handlers
+func (s *APIServer) ingestPcapHandler(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(config.MaxCaptureUploadMB)<<20)
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("multipart field \"file\" with a pcap or pcapng capture (max %d MB) is required", config.MaxCaptureUploadMB)})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	packets, summary, err := ReadCapture(file, config.PacketBufferSize)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	summary.Filename = fileHeader.Filename
+
+	req := ThreatDetectionRequest{
+		ScanID:       c.PostForm("scan_id"),
+		ScanType:     "network",
+		Target:       c.DefaultPostForm("target", fileHeader.Filename),
+		Packets:      packets,
+		DeepAnalysis: c.PostForm("deep_analysis") == "true",
+	}
+	if req.ScanID == "" {
+		req.ScanID = fmt.Sprintf("pcap_%d", time.Now().UnixNano())
+	}
+
+	response, err := s.threatDetector.AnalyzeTraffic(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, PcapIngestResponse{ThreatDetectionResponse: response, Capture: summary})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Remediation priority: open vulnerability findings ordered by a composite of CVSS severity,
+// exploitation likelihood (EPSS, CISA KEV), asset criticality, and internet exposure
+const (
+	internetFacingTag = "internet-facing" // asset tag marking hosts reachable from the internet
+	maxQueueLength    = 1000
+)
+
+// exposureWeights scale priority by how reachable the affected system is
+var exposureWeights = map[string]float64{"internet": 1.5, "internal": 1.0}
+
+// maxPriorityWeight is the largest criticality and exposure multiplier, which scores 100
+var maxPriorityWeight = criticalityWeights[CriticalityCritical] * exposureWeights["internet"]
+
+// fallbackCVSS stands in for the score of CVEs missing from the local database
+var fallbackCVSS = map[ThreatLevel]float64{Critical: 9.5, High: 8.0, Medium: 5.5, Low: 2.5}
+
+// RemediationItem is a vulnerability finding with the factors of its priority
+type RemediationItem struct {
+	Priority         float64          `json:"priority"` // 0-100
+	FindingID        string           `json:"finding_id"`
+	CVE              string           `json:"cve"`
+	System           string           `json:"system"`
+	Asset            string           `json:"asset,omitempty"`
+	Severity         ThreatLevel      `json:"severity"`
+	Status           FindingStatus    `json:"status"`
+	CVSS             float64          `json:"cvss"`
+	EPSS             float64          `json:"epss"`
+	EPSSPercentile   float64          `json:"epss_percentile"`
+	KnownExploited   bool             `json:"known_exploited"`
+	RansomwareUse    bool             `json:"ransomware_use,omitempty"`
+	AssetCriticality AssetCriticality `json:"asset_criticality"`
+	Exposure         string           `json:"exposure"` // "internet" or "internal"
+	DueAt            time.Time        `json:"due_at"`
+	Overdue          bool             `json:"overdue"`
+	Remediation      string           `json:"remediation,omitempty"`
+}
+
+// RemediationQueue is the prioritized list of vulnerability findings to fix
+type RemediationQueue struct {
+	Items         []RemediationItem `json:"items"`
+	Total         int               `json:"total"`
+	EPSSAvailable bool              `json:"epss_available"` // false when FIRST could not be reached and uncached scores are 0
+}
+
+// remediationPriority combines the factors into a score out of 100. Severity and exploitation
+// likelihood count equally; a KEV listing is certain exploitation. The result is scaled by the
+// asset's criticality and its exposure.
+func remediationPriority(cvss, epssPercentile float64, knownExploited bool, criticality, exposure float64) float64 {
+	exploitation := epssPercentile
+	if knownExploited {
+		exploitation = 1
+	}
+	base := 0.5*cvss/10 + 0.5*exploitation
+	return math.Round(1000*base*criticality*exposure/maxPriorityWeight) / 10
+}
+
+// exposure reports whether a system is reachable from the internet: a public address, or an
+// asset tagged internet-facing or with a public address
+func exposure(system string, asset *Asset) string {
+	host, _, err := net.SplitHostPort(system)
+	if err != nil {
+		host = system
+	}
+	if publicAddress(host) {
+		return "internet"
+	}
+	if asset != nil {
+		for _, tag := range asset.Tags {
+			if tag == internetFacingTag {
+				return "internet"
+			}
+		}
+		for _, address := range asset.Addresses {
+			if ip, _, _ := strings.Cut(address, "/"); publicAddress(ip) {
+				return "internet"
+			}
+		}
+	}
+	return "internal"
+}
+
+// enrichEPSS adds EPSS scores to a scan's vulnerabilities; they are left out when FIRST cannot
+// be reached
+func (td *ThreatDetector) enrichEPSS(ctx context.Context, vulns []Vulnerability) {
+	if len(vulns) == 0 {
+		return
+	}
+	cves := make([]string, len(vulns))
+	for i, vuln := range vulns {
+		cves[i] = vuln.CVE
+	}
+	scores, err := td.epss.Scores(ctx, cves)
+	if err != nil {
+		log.Printf("Vulnerabilities reported without some EPSS scores: %v", err)
+	}
+	for i := range vulns {
+		if score, ok := scores[vulns[i].CVE]; ok {
+			vulns[i].EPSS, vulns[i].EPSSPercentile = score.Probability, score.Percentile
+		}
+	}
+}
+
+// RemediationQueue orders the context tenant's open and in-progress vulnerability findings by
+// priority, highest first, using current CVSS, KEV, and EPSS data
+func (td *ThreatDetector) RemediationQueue(ctx context.Context, asset string, minPriority float64) (*RemediationQueue, error) {
+	findings, err := td.findings.Findings(ctx, FindingFilter{Kind: findingKindVulnerability, Asset: asset})
+	if err != nil {
+		return nil, err
+	}
+	active := make([]Finding, 0, len(findings))
+	cves := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, finding := range findings {
+		if !finding.active() {
+			continue
+		}
+		active = append(active, finding)
+		if !seen[finding.CVE] {
+			seen[finding.CVE] = true
+			cves = append(cves, finding.CVE)
+		}
+	}
+
+	details, err := td.cveDatabase.Details(ctx, cves)
+	if err != nil {
+		return nil, err
+	}
+	byCVE := make(map[string]CVEDetail, len(details))
+	for _, detail := range details {
+		byCVE[detail.ID] = detail
+	}
+	queue := &RemediationQueue{Items: make([]RemediationItem, 0, len(active)), EPSSAvailable: true}
+	scores, err := td.epss.Scores(ctx, cves)
+	if err != nil {
+		log.Printf("Remediation queue ranked without some EPSS scores: %v", err)
+		queue.EPSSAvailable = false
+	}
+	assets, err := td.assets.index(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	for _, finding := range active {
+		item := RemediationItem{
+			FindingID:   finding.ID,
+			CVE:         finding.CVE,
+			System:      finding.System,
+			Asset:       finding.Asset,
+			Severity:    finding.Severity,
+			Status:      finding.Status,
+			CVSS:        fallbackCVSS[finding.Severity],
+			DueAt:       finding.DueAt,
+			Overdue:     finding.overdue(now),
+			Remediation: finding.Remediation,
+		}
+		if detail, ok := byCVE[finding.CVE]; ok {
+			item.CVSS, item.KnownExploited, item.RansomwareUse = detail.CVSSScore, detail.KnownExploited, detail.RansomwareUse
+		}
+		if score, ok := scores[finding.CVE]; ok {
+			item.EPSS, item.EPSSPercentile = score.Probability, score.Percentile
+		}
+		registered := assets.byID[finding.Asset]
+		criticality := 1.0
+		item.AssetCriticality = CriticalityMedium // unregistered systems count as medium
+		if registered != nil {
+			item.AssetCriticality, criticality = registered.Criticality, registered.weight()
+		}
+		item.Exposure = exposure(finding.System, registered)
+		item.Priority = remediationPriority(item.CVSS, item.EPSSPercentile, item.KnownExploited, criticality, exposureWeights[item.Exposure])
+		if item.Priority >= minPriority {
+			queue.Items = append(queue.Items, item)
+		}
+	}
+
+	sort.SliceStable(queue.Items, func(i, j int) bool {
+		a, b := queue.Items[i], queue.Items[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if a.Overdue != b.Overdue {
+			return a.Overdue
+		}
+		return a.DueAt.Before(b.DueAt)
+	})
+	queue.Total = len(queue.Items)
+	return queue, nil
+}
+
+func (s *APIServer) remediationQueueHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > maxQueueLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxQueueLength)})
+		return
+	}
+	minPriority, err := strconv.ParseFloat(c.DefaultQuery("min_priority", "0"), 64)
+	if err != nil || minPriority < 0 || minPriority > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "min_priority must be between 0 and 100"})
+		return
+	}
+
+	queue, err := s.threatDetector.RemediationQueue(c.Request.Context(), c.Query("asset"), minPriority)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(queue.Items) > limit {
+		queue.Items = queue.Items[:limit]
+	}
+	c.JSON(http.StatusOK, queue)
+}
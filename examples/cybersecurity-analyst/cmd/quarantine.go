@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Quarantine workflow: indicators at or above the quarantine threshold propose isolating the
+// internal host involved. An analyst approves or rejects each proposal before it expires; approved
+// quarantines are carried out by the SOAR quarantine executors and released when their time is up.
+const (
+	quarantineKeyPrefix       = "quarantine:action:"  // ID -> QuarantineAction JSON
+	quarantineIndexKey        = "quarantine:index"    // sorted set of IDs by creation time
+	quarantineTargetKeyPrefix = "quarantine:target:"  // target -> ID of its open action
+	quarantinePendingKey      = "quarantine:pending"  // sorted set of pending IDs by approval deadline
+	quarantineReleasesKey     = "quarantine:releases" // sorted set of active IDs by release time
+	quarantineRetention       = 90 * 24 * time.Hour
+	quarantineCheck           = time.Minute
+	maxQuarantineListed       = 1000
+)
+
+type QuarantineStatus string
+
+const (
+	QuarantinePending  QuarantineStatus = "pending"
+	QuarantineRejected QuarantineStatus = "rejected"
+	QuarantineExpired  QuarantineStatus = "expired" // nobody decided before the approval deadline
+	QuarantineActive   QuarantineStatus = "active"  // executed; isolated until released
+	QuarantineAudited  QuarantineStatus = "audited" // approved while SOAR_MODE only records actions
+	QuarantineFailed   QuarantineStatus = "failed"
+	QuarantineReleased QuarantineStatus = "released"
+)
+
+var (
+	errQuarantineNotFound  = errors.New("quarantine action not found")
+	errQuarantineDecided   = errors.New("quarantine action is no longer pending")
+	errQuarantineNotActive = errors.New("quarantine is not active")
+	errQuarantineRelease   = errors.New("release_after_hours must not be negative")
+)
+
+var quarantineActions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cybersecurity_quarantine_actions_total",
+		Help: "Quarantine workflow transitions by status (pending, rejected, expired, active, audited, failed, released)",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(quarantineActions)
+}
+
+// QuarantineAction is a proposed quarantine of a host and its decision trail
+type QuarantineAction struct {
+	ID         string             `json:"id"`
+	Status     QuarantineStatus   `json:"status"`
+	Target     string             `json:"target"` // host IP or name handed to the quarantine executors
+	Reason     string             `json:"reason"`
+	Tenant     string             `json:"tenant,omitempty"`
+	ScanID     string             `json:"scan_id,omitempty"`
+	Indicator  ThreatIndicator    `json:"indicator"`
+	CreatedAt  time.Time          `json:"created_at"`
+	ExpiresAt  time.Time          `json:"expires_at"` // approval deadline
+	DecidedBy  string             `json:"decided_by,omitempty"`
+	DecidedAt  *time.Time         `json:"decided_at,omitempty"`
+	Comment    string             `json:"comment,omitempty"`
+	Executors  []string           `json:"executors"`            // executors that accept the target; those that isolated it once active
+	ReleaseAt  *time.Time         `json:"release_at,omitempty"` // automatic release; none holds it until released by hand
+	ReleasedBy string             `json:"released_by,omitempty"`
+	ReleasedAt *time.Time         `json:"released_at,omitempty"`
+	Responses  []IncidentResponse `json:"responses"` // quarantine and release responses, also in the SOAR audit log
+	History    []QuarantineEvent  `json:"history"`
+}
+
+// QuarantineEvent is one step of an action's audit trail
+type QuarantineEvent struct {
+	At     time.Time        `json:"at"`
+	Status QuarantineStatus `json:"status"`
+	By     string           `json:"by"`
+	Detail string           `json:"detail,omitempty"`
+}
+
+func (qa *QuarantineAction) record(status QuarantineStatus, by, detail string) {
+	qa.Status = status
+	qa.History = append(qa.History, QuarantineEvent{At: time.Now().UTC(), Status: status, By: by, Detail: detail})
+	quarantineActions.WithLabelValues(string(status)).Inc()
+}
+
+// QuarantineApproval is an analyst's approval; ReleaseAfterHours overrides QUARANTINE_RELEASE_HOURS,
+// and 0 keeps the host isolated until it is released by hand
+type QuarantineApproval struct {
+	Comment           string `json:"comment"`
+	ReleaseAfterHours *int   `json:"release_after_hours"`
+}
+
+type QuarantineQueue struct {
+	redis         *redis.Client
+	responder     *IncidentResponder
+	minSeverity   ThreatLevel
+	minConfidence float64
+	approvalTTL   time.Duration
+	releaseAfter  time.Duration
+}
+
+func NewQuarantineQueue(redisClient *redis.Client, responder *IncidentResponder, severity string, minConfidence float64, approvalTTL, releaseAfter time.Duration) *QuarantineQueue {
+	minSeverity := ThreatLevel(strings.ToLower(severity))
+	if !validThreatLevels[minSeverity] {
+		log.Printf("Unknown QUARANTINE_MIN_SEVERITY %q; using %s", minSeverity, Critical)
+		minSeverity = Critical
+	}
+	return &QuarantineQueue{
+		redis:         redisClient,
+		responder:     responder,
+		minSeverity:   minSeverity,
+		minConfidence: minConfidence,
+		approvalTTL:   approvalTTL,
+		releaseAfter:  releaseAfter,
+	}
+}
+
+// Start expires undecided proposals and releases quarantines that are due until ctx is cancelled
+func (qq *QuarantineQueue) Start(ctx context.Context) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	if qq == nil {
+		return &wg
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(quarantineCheck)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				qq.expire(ctx)
+				qq.releaseDue(ctx)
+			}
+		}
+	}()
+	return &wg
+}
+
+// quarantineTarget is the internal host an indicator implicates: the endpoint it was seen on, or
+// its private source, or its private destination
+func quarantineTarget(threat ThreatIndicator) string {
+	if threat.Endpoint != nil && threat.Endpoint.Host != "" {
+		return threat.Endpoint.Host
+	}
+	for _, address := range []string{threat.SourceIP, threat.DestIP} {
+		if isPrivateIP(address) {
+			return address
+		}
+	}
+	return ""
+}
+
+// Propose opens a pending quarantine for each host implicated by an indicator at or above the
+// threshold that a quarantine executor can act on. A host has one open action at a time.
+func (qq *QuarantineQueue) Propose(ctx context.Context, scanID string, threats []ThreatIndicator) {
+	if qq == nil {
+		return
+	}
+	for _, threat := range threats {
+		if severityRank[threat.Severity] < severityRank[qq.minSeverity] || threat.Confidence < qq.minConfidence {
+			continue
+		}
+		target := quarantineTarget(threat)
+		if target == "" {
+			continue
+		}
+		executors := qq.responder.Accepting("quarantine", target)
+		if len(executors) == 0 {
+			continue
+		}
+
+		now := time.Now().UTC()
+		action := &QuarantineAction{
+			ID:        fmt.Sprintf("qtn_%d", now.UnixNano()),
+			Target:    target,
+			Reason:    fmt.Sprintf("%s %s (%.0f%% confidence): %s", threat.Severity, threat.Type, threat.Confidence*100, threat.Description),
+			Tenant:    tenantFromContext(ctx),
+			ScanID:    scanID,
+			Indicator: threat,
+			CreatedAt: now,
+			ExpiresAt: now.Add(qq.approvalTTL),
+			Executors: executors,
+			Responses: make([]IncidentResponse, 0),
+			History:   make([]QuarantineEvent, 0),
+		}
+		claimed, err := qq.redis.SetNX(ctx, quarantineTargetKeyPrefix+target, action.ID, quarantineRetention).Result()
+		if err != nil {
+			log.Printf("Failed to propose quarantine of %s: %v", target, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		action.record(QuarantinePending, "system", fmt.Sprintf("proposed for %s indicator from scan %s", threat.Type, scanID))
+
+		pipe := qq.redis.TxPipeline()
+		qq.queueSave(ctx, pipe, action)
+		pipe.ZAdd(ctx, quarantineIndexKey, &redis.Z{Score: float64(now.UnixNano()), Member: action.ID})
+		pipe.ZAdd(ctx, quarantinePendingKey, &redis.Z{Score: float64(action.ExpiresAt.Unix()), Member: action.ID})
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Printf("Failed to store quarantine proposal for %s: %v", target, err)
+			qq.redis.Del(ctx, quarantineTargetKeyPrefix+target)
+			continue
+		}
+		log.Printf("Quarantine of %s proposed as %s, awaiting approval until %s", target, action.ID, action.ExpiresAt.Format(time.RFC3339))
+	}
+}
+
+// Approve executes a pending quarantine with the executors that accepted its target, on behalf of
+// the authenticated client by. The action becomes active, audited when SOAR_MODE only records
+// actions, or failed.
+func (qq *QuarantineQueue) Approve(ctx context.Context, id, by string, approval QuarantineApproval) (*QuarantineAction, error) {
+	if approval.ReleaseAfterHours != nil && *approval.ReleaseAfterHours < 0 {
+		return nil, errQuarantineRelease
+	}
+	action, err := qq.claimPending(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	action.DecidedBy, action.DecidedAt, action.Comment = by, &now, approval.Comment
+	if now.After(action.ExpiresAt) {
+		action.record(QuarantineExpired, "system", "approval deadline passed")
+		return action, qq.close(ctx, action)
+	}
+
+	releaseAfter := qq.releaseAfter
+	if approval.ReleaseAfterHours != nil {
+		releaseAfter = time.Duration(*approval.ReleaseAfterHours) * time.Hour
+	}
+	response, err := qq.responder.Respond(ctx, IncidentResponseRequest{
+		IncidentID:  action.ID,
+		Action:      "quarantine",
+		Target:      action.Target,
+		Reason:      fmt.Sprintf("%s (approved by %s)", action.Reason, by),
+		Executors:   action.Executors,
+		RequestedBy: by,
+	})
+	if err != nil {
+		action.record(QuarantineFailed, by, "approved; "+err.Error())
+		return action, qq.close(ctx, action)
+	}
+	action.Responses = append(action.Responses, *response)
+
+	switch response.Status {
+	case "completed", "partial":
+		executed := make([]string, 0, len(response.Steps))
+		for _, step := range response.Steps {
+			if step.Status == "executed" {
+				executed = append(executed, step.Executor)
+			}
+		}
+		action.Executors = executed
+		detail := "approved; isolated by " + strings.Join(executed, ", ")
+		if releaseAfter > 0 {
+			releaseAt := now.Add(releaseAfter)
+			action.ReleaseAt = &releaseAt
+			detail += "; release at " + releaseAt.Format(time.RFC3339)
+		}
+		action.record(QuarantineActive, by, detail)
+		if err := qq.save(ctx, action); err != nil {
+			return nil, err
+		}
+		if action.ReleaseAt != nil {
+			qq.redis.ZAdd(ctx, quarantineReleasesKey, &redis.Z{Score: float64(action.ReleaseAt.Unix()), Member: action.ID})
+		}
+		return action, nil
+	case "failed":
+		action.record(QuarantineFailed, by, "approved; every executor failed")
+	default:
+		action.record(QuarantineAudited, by, fmt.Sprintf("approved; recorded only, SOAR_MODE is %s", response.Mode))
+	}
+	return action, qq.close(ctx, action)
+}
+
+// Reject closes a pending quarantine without acting on it
+func (qq *QuarantineQueue) Reject(ctx context.Context, id, by, comment string) (*QuarantineAction, error) {
+	action, err := qq.claimPending(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	action.DecidedBy, action.DecidedAt, action.Comment = by, &now, comment
+	action.record(QuarantineRejected, by, comment)
+	return action, qq.close(ctx, action)
+}
+
+// Release lifts an active quarantine before its release time, or one held until released by hand
+func (qq *QuarantineQueue) Release(ctx context.Context, id, by, comment string) (*QuarantineAction, error) {
+	action, err := qq.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if action.Status != QuarantineActive {
+		return nil, errQuarantineNotActive
+	}
+	// The release loop claims scheduled releases the same way
+	if action.ReleaseAt != nil {
+		claimed, err := qq.redis.ZRem(ctx, quarantineReleasesKey, id).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to claim release: %w", err)
+		}
+		if claimed == 0 {
+			return nil, errQuarantineNotActive
+		}
+	}
+	return action, qq.release(ctx, action, by, comment)
+}
+
+func (qq *QuarantineQueue) release(ctx context.Context, action *QuarantineAction, by, comment string) error {
+	reason := fmt.Sprintf("quarantine %s released by %s", action.ID, by)
+	if comment != "" {
+		reason += ": " + comment
+	}
+	response := qq.responder.Release(ctx, action.ID, "quarantine", action.Target, reason, by, action.Executors)
+	action.Responses = append(action.Responses, *response)
+
+	now := time.Now().UTC()
+	action.ReleasedBy, action.ReleasedAt = by, &now
+	detail := comment
+	if response.Status != "completed" {
+		detail = strings.TrimSpace(fmt.Sprintf("%s (release %s; check the executors)", comment, response.Status))
+	}
+	action.record(QuarantineReleased, by, detail)
+	return qq.close(ctx, action)
+}
+
+// claimPending takes a pending action off the approval queue, so only one decision or expiry wins
+func (qq *QuarantineQueue) claimPending(ctx context.Context, id string) (*QuarantineAction, error) {
+	action, err := qq.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if action.Status != QuarantinePending {
+		return nil, errQuarantineDecided
+	}
+	claimed, err := qq.redis.ZRem(ctx, quarantinePendingKey, id).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim quarantine action: %w", err)
+	}
+	if claimed == 0 {
+		return nil, errQuarantineDecided
+	}
+	return action, nil
+}
+
+func (qq *QuarantineQueue) expire(ctx context.Context) {
+	due, err := qq.redis.ZRangeByScore(ctx, quarantinePendingKey, &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(time.Now().Unix(), 10)}).Result()
+	if err != nil {
+		log.Printf("Failed to load pending quarantines: %v", err)
+		return
+	}
+	for _, id := range due {
+		action, err := qq.claimPending(ctx, id)
+		if err != nil {
+			continue
+		}
+		action.record(QuarantineExpired, "system", fmt.Sprintf("no decision within %s", qq.approvalTTL))
+		if err := qq.close(ctx, action); err != nil {
+			log.Printf("Failed to expire quarantine %s: %v", id, err)
+		}
+	}
+}
+
+func (qq *QuarantineQueue) releaseDue(ctx context.Context) {
+	due, err := qq.redis.ZRangeByScore(ctx, quarantineReleasesKey, &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(time.Now().Unix(), 10)}).Result()
+	if err != nil {
+		log.Printf("Failed to load due quarantine releases: %v", err)
+		return
+	}
+	for _, id := range due {
+		if claimed, err := qq.redis.ZRem(ctx, quarantineReleasesKey, id).Result(); err != nil || claimed == 0 {
+			continue
+		}
+		action, err := qq.load(ctx, id)
+		if err != nil || action.Status != QuarantineActive {
+			continue
+		}
+		log.Printf("Releasing quarantine %s of %s", id, action.Target)
+		if err := qq.release(ctx, action, "auto-release", "release time reached"); err != nil {
+			log.Printf("Failed to record release of quarantine %s: %v", id, err)
+		}
+	}
+}
+
+// close stores a final action and frees its target for new proposals
+func (qq *QuarantineQueue) close(ctx context.Context, action *QuarantineAction) error {
+	if err := qq.save(ctx, action); err != nil {
+		return err
+	}
+	key := quarantineTargetKeyPrefix + action.Target
+	if owner, err := qq.redis.Get(ctx, key).Result(); err == nil && owner == action.ID {
+		qq.redis.Del(ctx, key)
+	}
+	return nil
+}
+
+func (qq *QuarantineQueue) queueSave(ctx context.Context, pipe redis.Pipeliner, action *QuarantineAction) {
+	data, err := json.Marshal(action)
+	if err != nil {
+		return
+	}
+	pipe.Set(ctx, quarantineKeyPrefix+action.ID, data, quarantineRetention)
+}
+
+func (qq *QuarantineQueue) save(ctx context.Context, action *QuarantineAction) error {
+	data, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+	if err := qq.redis.Set(ctx, quarantineKeyPrefix+action.ID, data, quarantineRetention).Err(); err != nil {
+		return fmt.Errorf("failed to store quarantine action: %w", err)
+	}
+	return nil
+}
+
+func (qq *QuarantineQueue) load(ctx context.Context, id string) (*QuarantineAction, error) {
+	if qq == nil {
+		return nil, errQuarantineNotFound
+	}
+	data, err := qq.redis.Get(ctx, quarantineKeyPrefix+id).Result()
+	if err == redis.Nil {
+		return nil, errQuarantineNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load quarantine action: %w", err)
+	}
+	var action QuarantineAction
+	if err := json.Unmarshal([]byte(data), &action); err != nil {
+		return nil, fmt.Errorf("failed to decode quarantine action: %w", err)
+	}
+	return &action, nil
+}
+
+func (qq *QuarantineQueue) Get(ctx context.Context, id string) (*QuarantineAction, error) {
+	return qq.load(ctx, id)
+}
+
+// Actions lists the newest actions, optionally with one status
+func (qq *QuarantineQueue) Actions(ctx context.Context, status QuarantineStatus, limit int) ([]QuarantineAction, error) {
+	actions := make([]QuarantineAction, 0)
+	if qq == nil {
+		return actions, nil
+	}
+	ids, err := qq.redis.ZRevRange(ctx, quarantineIndexKey, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load quarantine actions: %w", err)
+	}
+	for start := 0; start < len(ids) && len(actions) < limit; start += 100 {
+		batch := ids[start:min(start+100, len(ids))]
+		keys := make([]string, len(batch))
+		for i, id := range batch {
+			keys[i] = quarantineKeyPrefix + id
+		}
+		values, err := qq.redis.MGet(ctx, keys...).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load quarantine actions: %w", err)
+		}
+		for i, value := range values {
+			data, ok := value.(string)
+			if !ok {
+				qq.redis.ZRem(ctx, quarantineIndexKey, batch[i]) // expired
+				continue
+			}
+			var action QuarantineAction
+			if json.Unmarshal([]byte(data), &action) != nil || (status != "" && action.Status != status) {
+				continue
+			}
+			actions = append(actions, action)
+			if len(actions) == limit {
+				break
+			}
+		}
+	}
+	return actions, nil
+}
+
+// HTTP Handlers
+func (s *APIServer) listQuarantineHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > maxQuarantineListed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxQuarantineListed)})
+		return
+	}
+	actions, err := s.threatDetector.quarantine.Actions(c.Request.Context(), QuarantineStatus(c.Query("status")), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"actions": actions, "count": len(actions)})
+}
+
+func (s *APIServer) getQuarantineHandler(c *gin.Context) {
+	action, err := s.threatDetector.quarantine.Get(c.Request.Context(), c.Param("id"))
+	s.quarantineResult(c, action, err)
+}
+
+// Decisions are recorded against the authenticated client, not a name in the request body, which
+// may be empty
+func (s *APIServer) approveQuarantineHandler(c *gin.Context) {
+	var approval QuarantineApproval
+	if err := c.ShouldBindJSON(&approval); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	action, err := s.threatDetector.quarantine.Approve(c.Request.Context(), c.Param("id"), clientFromContext(c).ID, approval)
+	s.quarantineResult(c, action, err)
+}
+
+func (s *APIServer) rejectQuarantineHandler(c *gin.Context) {
+	s.decideQuarantine(c, s.threatDetector.quarantine.Reject)
+}
+
+func (s *APIServer) releaseQuarantineHandler(c *gin.Context) {
+	s.decideQuarantine(c, s.threatDetector.quarantine.Release)
+}
+
+func (s *APIServer) decideQuarantine(c *gin.Context, decide func(ctx context.Context, id, by, comment string) (*QuarantineAction, error)) {
+	var body struct {
+		Comment string `json:"comment"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	action, err := decide(c.Request.Context(), c.Param("id"), clientFromContext(c).ID, body.Comment)
+	s.quarantineResult(c, action, err)
+}
+
+func (s *APIServer) quarantineResult(c *gin.Context, action *QuarantineAction, err error) {
+	switch {
+	case errors.Is(err, errQuarantineRelease):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errQuarantineNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errQuarantineDecided), errors.Is(err, errQuarantineNotActive):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, action)
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// IOC reputation enrichment (VirusTotal, AbuseIPDB)
+const (
+	reputationKeyPrefix      = "reputation:"       // cached ReputationScore JSON per source and IOC
+	reputationQuotaPrefix    = "reputation:quota:" // request counters per source and minute or day
+	reputationBackoffPrefix  = "reputation:backoff:"
+	reputationBackoff        = time.Minute // pause after a source answers 429
+	reputationTimeout        = 10 * time.Second
+	maxReputationLookups     = 25 // IOCs checked per scan; the rest are skipped
+	maxObservables           = 10 // domains and hashes kept per indicator
+	reputationMaliciousScore = 50
+	virusTotalFullScore      = 5 // engines flagging an IOC for a score of 100
+)
+
+var (
+	reputationLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_reputation_lookups_total",
+			Help: "Reputation lookups by source and result (cached, queried, rate_limited, failed)",
+		},
+		[]string{"source", "result"},
+	)
+
+	errUnknownIOC          = errors.New("not an IP address, domain, or file hash")
+	errNoReputationSources = errors.New("no reputation sources are configured")
+
+	hashPattern = regexp.MustCompile(`^[0-9a-fA-F]{32}$|^[0-9a-fA-F]{40}$|^[0-9a-fA-F]{64}$`)
+)
+
+func init() {
+	prometheus.MustRegister(reputationLookups)
+}
+
+// Field names that commonly carry domains and file hashes in DNS, proxy, EDR, and Sysmon logs
+var (
+	domainFields = []string{"domain", "query", "QueryName", "dns.question.name", "url.domain", "DestinationHostname", "server_name", "sni"}
+	hashFields   = []string{"hash", "md5", "sha1", "sha256", "Hashes", "file.hash.md5", "file.hash.sha1", "file.hash.sha256", "process.hash.sha256"}
+)
+
+type IOCKind string
+
+const (
+	IOCIP     IOCKind = "ip"
+	IOCDomain IOCKind = "domain"
+	IOCHash   IOCKind = "hash"
+)
+
+// classifyIOC normalizes an IP address, domain, or MD5/SHA-1/SHA-256 hash. Private addresses
+// are not worth asking about and are rejected.
+func classifyIOC(value string) (IOCKind, string, bool) {
+	value = strings.TrimSpace(value)
+	if ip := net.ParseIP(value); ip != nil {
+		if isPrivateIP(value) || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() {
+			return "", "", false
+		}
+		return IOCIP, ip.String(), true
+	}
+	if hashPattern.MatchString(value) {
+		return IOCHash, strings.ToLower(value), true
+	}
+	domain := strings.ToLower(strings.TrimSuffix(value, "."))
+	if strings.Contains(domain, ".") && hostnamePattern.MatchString(domain) && !strings.HasSuffix(domain, ".local") {
+		return IOCDomain, domain, true
+	}
+	return "", "", false
+}
+
+// eventObservables collects the domains and file hashes in log events. Sysmon's Hashes field
+// lists "ALGORITHM=value" pairs.
+func eventObservables(events []LogEvent) []string {
+	seen := make(map[string]bool)
+	observables := make([]string, 0)
+	add := func(value string) {
+		if _, normalized, ok := classifyIOC(value); ok && !seen[normalized] && len(observables) < maxObservables {
+			seen[normalized] = true
+			observables = append(observables, normalized)
+		}
+	}
+
+	for _, event := range events {
+		for _, field := range domainFields {
+			if value, ok := lookupField(event.Fields, field); ok {
+				add(fmt.Sprint(value))
+			}
+		}
+		for _, field := range hashFields {
+			value, ok := lookupField(event.Fields, field)
+			if !ok {
+				continue
+			}
+			for _, part := range strings.Split(fmt.Sprint(value), ",") {
+				if _, hash, ok := strings.Cut(part, "="); ok {
+					part = hash
+				}
+				add(part)
+			}
+		}
+	}
+	return observables
+}
+
+// ReputationScore is one source's verdict on an IOC
+type ReputationScore struct {
+	Source    string    `json:"source"`
+	Score     float64   `json:"score"` // 0-100
+	Malicious bool      `json:"malicious"`
+	Detail    string    `json:"detail,omitempty"`
+	Link      string    `json:"link,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// ReputationReport combines the verdicts of every source that knows an IOC
+type ReputationReport struct {
+	IOC       string            `json:"ioc"`
+	Kind      IOCKind           `json:"kind"`
+	Score     float64           `json:"score"` // highest source score
+	Malicious bool              `json:"malicious"`
+	Sources   []ReputationScore `json:"sources"`
+}
+
+// ReputationSource looks IOCs up in an external reputation service
+type ReputationSource interface {
+	Name() string
+	Supports(kind IOCKind) bool
+	// Limits returns the requests allowed per minute and per day; zero means unlimited
+	Limits() (perMinute, perDay int)
+	Lookup(ctx context.Context, kind IOCKind, value string) (*ReputationScore, error)
+}
+
+// reputationSourcesFromConfig builds the sources that have API keys
+func reputationSourcesFromConfig() []ReputationSource {
+	sources := make([]ReputationSource, 0)
+	client := &http.Client{Timeout: reputationTimeout}
+
+	if config.VirusTotalAPIKey != "" {
+		sources = append(sources, &virusTotalSource{
+			apiKey:    config.VirusTotalAPIKey,
+			perMinute: config.VirusTotalPerMinute,
+			perDay:    config.VirusTotalPerDay,
+			client:    client,
+		})
+	}
+	if config.AbuseIPDBAPIKey != "" {
+		sources = append(sources, &abuseIPDBSource{apiKey: config.AbuseIPDBAPIKey, perDay: config.AbuseIPDBPerDay, client: client})
+	}
+	return sources
+}
+
+// ReputationEnricher checks indicators against reputation sources. Verdicts are cached in Redis,
+// and requests are counted against each source's quota there, so replicas share both.
+type ReputationEnricher struct {
+	redis    *redis.Client
+	sources  []ReputationSource
+	cacheTTL time.Duration
+}
+
+func NewReputationEnricher(redisClient *redis.Client, sources []ReputationSource, cacheTTL time.Duration) *ReputationEnricher {
+	return &ReputationEnricher{redis: redisClient, sources: sources, cacheTTL: cacheTTL}
+}
+
+func (re *ReputationEnricher) Enabled() bool {
+	return len(re.sources) > 0
+}
+
+// Enrich looks up the public addresses, domains, and hashes of threats. When a source rates an
+// IOC malicious, the indicators carrying it gain confidence and evidence naming the source.
+func (re *ReputationEnricher) Enrich(ctx context.Context, threats []ThreatIndicator) []ReputationReport {
+	if !re.Enabled() || len(threats) == 0 {
+		return nil
+	}
+
+	type ioc struct {
+		kind    IOCKind
+		threats []int
+	}
+	iocs := make(map[string]*ioc)
+	order := make([]string, 0)
+	for i, threat := range threats {
+		for _, value := range append([]string{threat.SourceIP, threat.DestIP}, threat.Observables...) {
+			kind, normalized, ok := classifyIOC(value)
+			if !ok {
+				continue
+			}
+			if entry, seen := iocs[normalized]; seen {
+				if entry.threats[len(entry.threats)-1] != i {
+					entry.threats = append(entry.threats, i)
+				}
+				continue
+			}
+			if len(order) == maxReputationLookups {
+				continue
+			}
+			iocs[normalized] = &ioc{kind: kind, threats: []int{i}}
+			order = append(order, normalized)
+		}
+	}
+	if len(order) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, reputationTimeout)
+	defer cancel()
+	results := make([]*ReputationReport, len(order))
+	var wg sync.WaitGroup
+	for i, value := range order {
+		wg.Add(1)
+		go func(i int, value string) {
+			defer wg.Done()
+			results[i] = re.report(ctx, iocs[value].kind, value)
+		}(i, value)
+	}
+	wg.Wait()
+
+	reports := make([]ReputationReport, 0, len(results))
+	for _, report := range results {
+		if len(report.Sources) == 0 {
+			continue
+		}
+		reports = append(reports, *report)
+
+		for _, score := range report.Sources {
+			if !score.Malicious {
+				continue
+			}
+			for _, i := range iocs[report.IOC].threats {
+				// A score of 100 halves the remaining doubt
+				threats[i].Confidence += (1 - threats[i].Confidence) * score.Score / 200
+				threats[i].Evidence = append(threats[i].Evidence, fmt.Sprintf("%s rates %s malicious: %s", score.Source, report.IOC, score.Detail))
+			}
+		}
+	}
+	sort.SliceStable(reports, func(i, j int) bool { return reports[i].Score > reports[j].Score })
+	return reports
+}
+
+// Lookup returns every source's verdict on one IOC
+func (re *ReputationEnricher) Lookup(ctx context.Context, value string) (*ReputationReport, error) {
+	if !re.Enabled() {
+		return nil, errNoReputationSources
+	}
+	kind, normalized, ok := classifyIOC(value)
+	if !ok {
+		return nil, errUnknownIOC
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, reputationTimeout)
+	defer cancel()
+	return re.report(ctx, kind, normalized), nil
+}
+
+// report queries the sources that support kind concurrently
+func (re *ReputationEnricher) report(ctx context.Context, kind IOCKind, value string) *ReputationReport {
+	report := &ReputationReport{IOC: value, Kind: kind, Sources: make([]ReputationScore, 0)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, source := range re.sources {
+		if !source.Supports(kind) {
+			continue
+		}
+		wg.Add(1)
+		go func(source ReputationSource) {
+			defer wg.Done()
+			score := re.lookup(ctx, source, kind, value)
+			if score == nil {
+				return
+			}
+			mu.Lock()
+			report.Sources = append(report.Sources, *score)
+			mu.Unlock()
+		}(source)
+	}
+	wg.Wait()
+
+	sort.Slice(report.Sources, func(i, j int) bool { return report.Sources[i].Source < report.Sources[j].Source })
+	for _, score := range report.Sources {
+		report.Score = math.Max(report.Score, score.Score)
+		report.Malicious = report.Malicious || score.Malicious
+	}
+	return report
+}
+
+// lookup returns a cached verdict, or asks the source when its quota allows. Failures and
+// exhausted quotas return nil; the scan goes on without that source.
+func (re *ReputationEnricher) lookup(ctx context.Context, source ReputationSource, kind IOCKind, value string) *ReputationScore {
+	cacheKey := reputationKeyPrefix + source.Name() + ":" + string(kind) + ":" + value
+	if data, err := re.redis.Get(ctx, cacheKey).Result(); err == nil {
+		var score ReputationScore
+		if json.Unmarshal([]byte(data), &score) == nil {
+			reputationLookups.WithLabelValues(source.Name(), "cached").Inc()
+			return &score
+		}
+	}
+
+	if !re.allow(ctx, source) {
+		reputationLookups.WithLabelValues(source.Name(), "rate_limited").Inc()
+		return nil
+	}
+
+	score, err := source.Lookup(ctx, kind, value)
+	if err != nil {
+		var apiErr *responderAPIError
+		if errors.As(err, &apiErr) && apiErr.status == http.StatusTooManyRequests {
+			re.redis.Set(ctx, reputationBackoffPrefix+source.Name(), "1", reputationBackoff)
+			reputationLookups.WithLabelValues(source.Name(), "rate_limited").Inc()
+			return nil
+		}
+		log.Printf("Reputation lookup of %s in %s failed: %v", value, source.Name(), err)
+		reputationLookups.WithLabelValues(source.Name(), "failed").Inc()
+		return nil
+	}
+	reputationLookups.WithLabelValues(source.Name(), "queried").Inc()
+
+	score.Source = source.Name()
+	score.Malicious = score.Score >= reputationMaliciousScore
+	score.CheckedAt = time.Now().UTC()
+	if data, err := json.Marshal(score); err == nil {
+		re.redis.Set(ctx, cacheKey, data, re.cacheTTL)
+	}
+	return score
+}
+
+// allow counts a request against the source's per-minute and per-day quotas, and refuses it
+// while either is used up or the source recently answered 429. When Redis is unavailable the
+// request is allowed; the source's own limits still apply.
+func (re *ReputationEnricher) allow(ctx context.Context, source ReputationSource) bool {
+	if backoff, err := re.redis.Exists(ctx, reputationBackoffPrefix+source.Name()).Result(); err == nil && backoff > 0 {
+		return false
+	}
+
+	now := time.Now().UTC()
+	perMinute, perDay := source.Limits()
+	for _, window := range []struct {
+		limit  int
+		key    string
+		period time.Duration
+	}{
+		{perMinute, now.Format("200601021504"), time.Minute},
+		{perDay, now.Format("20060102"), 24 * time.Hour},
+	} {
+		if window.limit <= 0 {
+			continue
+		}
+		key := reputationQuotaPrefix + source.Name() + ":" + window.key
+		pipe := re.redis.TxPipeline()
+		count := pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, window.period)
+		if _, err := pipe.Exec(ctx); err != nil {
+			continue
+		}
+		if count.Val() > int64(window.limit) {
+			return false
+		}
+	}
+	return true
+}
+
+// virusTotalSource queries the VirusTotal v3 API. The score scales with the number of engines
+// flagging the IOC malicious (suspicious counts half), reaching 100 at five.
+type virusTotalSource struct {
+	apiKey            string
+	perMinute, perDay int
+	client            *http.Client
+}
+
+func (vt *virusTotalSource) Name() string                    { return "virustotal" }
+func (vt *virusTotalSource) Supports(kind IOCKind) bool      { return true }
+func (vt *virusTotalSource) Limits() (perMinute, perDay int) { return vt.perMinute, vt.perDay }
+
+func (vt *virusTotalSource) Lookup(ctx context.Context, kind IOCKind, value string) (*ReputationScore, error) {
+	collection, page := "files", "file"
+	switch kind {
+	case IOCIP:
+		collection, page = "ip_addresses", "ip-address"
+	case IOCDomain:
+		collection, page = "domains", "domain"
+	}
+
+	var body struct {
+		Data struct {
+			Attributes struct {
+				Stats struct {
+					Malicious  int `json:"malicious"`
+					Suspicious int `json:"suspicious"`
+					Harmless   int `json:"harmless"`
+					Undetected int `json:"undetected"`
+				} `json:"last_analysis_stats"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	endpoint := "https://www.virustotal.com/api/v3/" + collection + "/" + url.PathEscape(value)
+	link := "https://www.virustotal.com/gui/" + page + "/" + url.PathEscape(value)
+	err := callJSON(ctx, vt.client, http.MethodGet, endpoint, map[string]string{"x-apikey": vt.apiKey}, nil, &body)
+	var apiErr *responderAPIError
+	if errors.As(err, &apiErr) && apiErr.status == http.StatusNotFound {
+		return &ReputationScore{Detail: "not seen by VirusTotal", Link: link}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stats := body.Data.Attributes.Stats
+	engines := stats.Malicious + stats.Suspicious + stats.Harmless + stats.Undetected
+	flagged := float64(stats.Malicious) + float64(stats.Suspicious)/2
+	return &ReputationScore{
+		Score:  math.Min(100, 100*flagged/virusTotalFullScore),
+		Detail: fmt.Sprintf("%d/%d engines malicious, %d suspicious", stats.Malicious, engines, stats.Suspicious),
+		Link:   link,
+	}, nil
+}
+
+// abuseIPDBSource queries the AbuseIPDB v2 check endpoint; its abuse confidence is the score
+type abuseIPDBSource struct {
+	apiKey string
+	perDay int
+	client *http.Client
+}
+
+func (a *abuseIPDBSource) Name() string                    { return "abuseipdb" }
+func (a *abuseIPDBSource) Supports(kind IOCKind) bool      { return kind == IOCIP }
+func (a *abuseIPDBSource) Limits() (perMinute, perDay int) { return 0, a.perDay }
+
+func (a *abuseIPDBSource) Lookup(ctx context.Context, kind IOCKind, value string) (*ReputationScore, error) {
+	var body struct {
+		Data struct {
+			AbuseConfidenceScore float64 `json:"abuseConfidenceScore"`
+			TotalReports         int     `json:"totalReports"`
+			IsWhitelisted        bool    `json:"isWhitelisted"`
+			UsageType            string  `json:"usageType"`
+		} `json:"data"`
+	}
+	query := url.Values{"ipAddress": {value}, "maxAgeInDays": {"90"}}
+	endpoint := "https://api.abuseipdb.com/api/v2/check?" + query.Encode()
+	if err := callJSON(ctx, a.client, http.MethodGet, endpoint, map[string]string{"Key": a.apiKey}, nil, &body); err != nil {
+		return nil, err
+	}
+
+	data := body.Data
+	score := data.AbuseConfidenceScore
+	detail := fmt.Sprintf("abuse confidence %.0f%%, %d reports in 90 days", score, data.TotalReports)
+	if data.UsageType != "" {
+		detail += " (" + data.UsageType + ")"
+	}
+	if data.IsWhitelisted {
+		score = 0
+		detail += ", allowlisted"
+	}
+	return &ReputationScore{Score: score, Detail: detail, Link: "https://www.abuseipdb.com/check/" + value}, nil
+}
+
+// HTTP Handlers
+func (s *APIServer) reputationHandler(c *gin.Context) {
+	report, err := s.threatDetector.reputation.Lookup(c.Request.Context(), c.Param("ioc"))
+	switch {
+	case errors.Is(err, errUnknownIOC):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errNoReputationSources):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, report)
+	}
+}
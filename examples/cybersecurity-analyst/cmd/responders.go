@@ -0,0 +1,683 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Response executors for firewalls, cloud network ACLs, Kubernetes, CrowdStrike, and Okta
+const (
+	responderTimeout     = 30 * time.Second
+	awsNACLRulesKey      = "soar:aws_nacl_rules" // hash of blocked CIDR -> network ACL rule number
+	awsNACLMaxRules      = 100
+	quarantineLabel      = "security.ai-agents.io/quarantine"
+	quarantinePolicyName = "security-quarantine"
+	serviceAccountDir    = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// responseExecutorsFromConfig builds the executors that have been configured
+func responseExecutorsFromConfig(redisClient *redis.Client) []ResponseExecutor {
+	executors := make([]ResponseExecutor, 0)
+	client := &http.Client{Timeout: responderTimeout}
+
+	if config.FirewallAPIURL != "" {
+		executors = append(executors, &firewallBlocker{url: config.FirewallAPIURL, token: config.FirewallAPIToken, client: client})
+	}
+	if config.AWSNetworkACLID != "" {
+		executors = append(executors, &awsNACLBlocker{
+			redis:     redisClient,
+			region:    config.AWSRegion,
+			aclID:     config.AWSNetworkACLID,
+			ruleStart: config.AWSNACLRuleStart,
+			client:    client,
+		})
+	}
+	if config.KubernetesQuarantine {
+		quarantine, err := newKubernetesQuarantine()
+		if err != nil {
+			log.Printf("Kubernetes quarantine unavailable: %v", err)
+		} else {
+			executors = append(executors, quarantine)
+		}
+	}
+	if config.CrowdStrikeClientID != "" {
+		executors = append(executors, &crowdStrikeContainment{
+			baseURL:      strings.TrimRight(config.CrowdStrikeBaseURL, "/"),
+			clientID:     config.CrowdStrikeClientID,
+			clientSecret: config.CrowdStrikeClientSecret,
+			client:       client,
+		})
+	}
+	if config.OktaOrgURL != "" {
+		executors = append(executors, &oktaSuspender{orgURL: strings.TrimRight(config.OktaOrgURL, "/"), token: config.OktaAPIToken, client: client})
+	}
+	return executors
+}
+
+// Narrowest prefixes a block may use; wider networks take out far more than one attacker
+const (
+	minResponsePrefixV4 = 24
+	minResponsePrefixV6 = 64
+)
+
+// parseResponseIP accepts an address or CIDR and returns it as a CIDR. Networks wider than
+// minResponsePrefixV4 or minResponsePrefixV6, and networks covering loopback, unspecified, or this
+// host's own addresses, are refused.
+func parseResponseIP(target string) (string, error) {
+	_, network, err := net.ParseCIDR(target)
+	if err != nil {
+		ip := net.ParseIP(target)
+		if ip == nil {
+			return "", fmt.Errorf("target %q is not an IP address or CIDR", target)
+		}
+		bits := 8 * net.IPv6len
+		if v4 := ip.To4(); v4 != nil {
+			ip, bits = v4, 8*net.IPv4len
+		}
+		network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+
+	ones, bits := network.Mask.Size()
+	minimum := minResponsePrefixV6
+	if bits == 8*net.IPv4len {
+		minimum = minResponsePrefixV4
+	}
+	if ones < minimum {
+		return "", fmt.Errorf("%w: %s is wider than /%d", errResponseTargetRefused, network, minimum)
+	}
+	if network.IP.IsLoopback() || network.Contains(net.IPv6loopback) {
+		return "", fmt.Errorf("%w: %s is a loopback address", errResponseTargetRefused, network)
+	}
+	if network.Contains(net.IPv4zero) || network.Contains(net.IPv6unspecified) {
+		return "", fmt.Errorf("%w: %s is the unspecified address", errResponseTargetRefused, network)
+	}
+	if addresses, err := net.InterfaceAddrs(); err == nil {
+		for _, address := range addresses {
+			if own, ok := address.(*net.IPNet); ok && network.Contains(own.IP) {
+				return "", fmt.Errorf("%w: %s covers this host's address %s", errResponseTargetRefused, network, own.IP)
+			}
+		}
+	}
+	return network.String(), nil
+}
+
+// responderAPIError reports a non-2xx response from an executor's API
+type responderAPIError struct {
+	status int
+	body   string
+}
+
+func (e *responderAPIError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.status, e.body)
+}
+
+// callJSON sends a JSON request and decodes a JSON response into out when it is non-nil
+func callJSON(ctx context.Context, client *http.Client, method, endpoint string, headers map[string]string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &responderAPIError{status: resp.StatusCode, body: strings.TrimSpace(string(respBody))}
+	}
+	if out != nil && len(respBody) > 0 {
+		return json.Unmarshal(respBody, out)
+	}
+	return nil
+}
+
+// firewallBlocker posts block requests to a firewall manager's webhook
+type firewallBlocker struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (f *firewallBlocker) Name() string   { return "firewall" }
+func (f *firewallBlocker) Action() string { return "block" }
+
+func (f *firewallBlocker) Plan(target string) (string, error) {
+	cidr, err := parseResponseIP(target)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Request a block of %s from the firewall at %s", cidr, f.url), nil
+}
+
+func (f *firewallBlocker) Execute(ctx context.Context, target, reason string) (string, error) {
+	cidr, err := parseResponseIP(target)
+	if err != nil {
+		return "", err
+	}
+
+	headers := map[string]string{}
+	if f.token != "" {
+		headers["Authorization"] = "Bearer " + f.token
+	}
+	body := map[string]string{"action": "block", "cidr": cidr, "reason": reason, "source": config.AppName}
+	if err := callJSON(ctx, f.client, http.MethodPost, f.url, headers, body, nil); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Firewall blocked %s", cidr), nil
+}
+
+// awsNACLBlocker adds inbound deny entries to an AWS network ACL. Security groups only allow
+// traffic, so network ACLs are where AWS can deny a source. Rule numbers are allocated from
+// AWS_NACL_RULE_START upwards and tracked in Redis.
+type awsNACLBlocker struct {
+	redis     *redis.Client
+	region    string
+	aclID     string
+	ruleStart int
+	client    *http.Client
+}
+
+type awsErrorResponse struct {
+	Errors []struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Errors>Error"`
+}
+
+func (a *awsNACLBlocker) Name() string   { return "aws_nacl" }
+func (a *awsNACLBlocker) Action() string { return "block" }
+
+func (a *awsNACLBlocker) Plan(target string) (string, error) {
+	cidr, err := parseResponseIP(target)
+	if err != nil {
+		return "", err
+	}
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
+		return "", fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+	return fmt.Sprintf("Add an inbound deny entry for %s to network ACL %s in %s", cidr, a.aclID, a.region), nil
+}
+
+func (a *awsNACLBlocker) Execute(ctx context.Context, target, reason string) (string, error) {
+	cidr, err := parseResponseIP(target)
+	if err != nil {
+		return "", err
+	}
+
+	used, err := a.redis.HGetAll(ctx, awsNACLRulesKey).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to load network ACL rules: %w", err)
+	}
+	if rule, ok := used[cidr]; ok {
+		return fmt.Sprintf("%s is already denied by network ACL %s rule %s", cidr, a.aclID, rule), nil
+	}
+	taken := make(map[string]bool, len(used))
+	for _, rule := range used {
+		taken[rule] = true
+	}
+	ruleNumber := -1
+	for n := a.ruleStart; n < a.ruleStart+awsNACLMaxRules; n++ {
+		if !taken[strconv.Itoa(n)] {
+			ruleNumber = n
+			break
+		}
+	}
+	if ruleNumber < 0 {
+		return "", fmt.Errorf("all %d network ACL rules from %d are in use", awsNACLMaxRules, a.ruleStart)
+	}
+
+	params := url.Values{
+		"Action":       {"CreateNetworkAclEntry"},
+		"Version":      {"2016-11-15"},
+		"NetworkAclId": {a.aclID},
+		"RuleNumber":   {strconv.Itoa(ruleNumber)},
+		"Protocol":     {"-1"},
+		"RuleAction":   {"deny"},
+		"Egress":       {"false"},
+	}
+	if strings.Contains(cidr, ":") {
+		params.Set("Ipv6CidrBlock", cidr)
+	} else {
+		params.Set("CidrBlock", cidr)
+	}
+	body := []byte(params.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("https://ec2.%s.amazonaws.com/", a.region), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, body, "ec2", a.region, time.Now())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		var awsErr awsErrorResponse
+		if xml.Unmarshal(respBody, &awsErr) == nil && len(awsErr.Errors) > 0 {
+			return "", fmt.Errorf("%s: %s", awsErr.Errors[0].Code, awsErr.Errors[0].Message)
+		}
+		return "", &responderAPIError{status: resp.StatusCode, body: strings.TrimSpace(string(respBody))}
+	}
+
+	if err := a.redis.HSet(ctx, awsNACLRulesKey, cidr, ruleNumber).Err(); err != nil {
+		return "", fmt.Errorf("denied %s with rule %d but failed to record it: %w", cidr, ruleNumber, err)
+	}
+	return fmt.Sprintf("Network ACL %s rule %d denies inbound traffic from %s", a.aclID, ruleNumber, cidr), nil
+}
+
+// signAWSRequest adds a Signature Version 4 Authorization header, using credentials from the
+// standard AWS environment variables
+func signAWSRequest(req *http.Request, body []byte, service, region string, now time.Time) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	sessionToken := os.Getenv("AWS_SESSION_TOKEN")
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	payloadHash := sha256.Sum256(body)
+	if service == "s3" {
+		// S3 requires the payload hash as a header as well
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	}
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	// Signed headers in sorted order
+	headers := make([]string, 0, 5)
+	for _, name := range []string{"Content-Type", "Host", "X-Amz-Content-Sha256", "X-Amz-Date", "X-Amz-Security-Token"} {
+		if name == "Host" || req.Header.Get(name) != "" {
+			headers = append(headers, strings.ToLower(name))
+		}
+	}
+	canonicalHeaders := ""
+	for _, name := range headers {
+		value := req.URL.Host
+		if name != "host" {
+			value = req.Header.Get(name)
+		}
+		canonicalHeaders += name + ":" + strings.TrimSpace(value) + "\n"
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	path := awsCanonicalPath(req.URL.Path)
+	// Query parameters are sorted by Encode; SigV4 wants spaces as %20
+	query := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+	canonicalRequest := strings.Join([]string{req.Method, path, query, canonicalHeaders, signedHeaders, hex.EncodeToString(payloadHash[:])}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// awsCanonicalPath percent-encodes each path segment as SigV4 requires: everything except
+// unreserved characters, so S3 keys such as "tenant=acme/..." sign correctly
+func awsCanonicalPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// kubernetesQuarantine isolates a pod by labeling it and applying a NetworkPolicy in its namespace
+// that selects the label and allows no traffic. It uses the in-cluster service account, which needs
+// to list and patch pods and to create NetworkPolicies.
+type kubernetesQuarantine struct {
+	apiURL string
+	client *http.Client
+}
+
+type kubernetesPodList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+		Status struct {
+			Phase string `json:"phase"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+func newKubernetesQuarantine() (*kubernetesQuarantine, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster")
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid service account CA certificate")
+	}
+
+	return &kubernetesQuarantine{
+		apiURL: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Timeout:   responderTimeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}},
+		},
+	}, nil
+}
+
+func (k *kubernetesQuarantine) Name() string   { return "kubernetes" }
+func (k *kubernetesQuarantine) Action() string { return "quarantine" }
+
+func (k *kubernetesQuarantine) Plan(target string) (string, error) {
+	if net.ParseIP(target) == nil {
+		return "", fmt.Errorf("target %q is not a pod IP address", target)
+	}
+	return fmt.Sprintf("Label the pod with IP %s %s=true and deny all of its traffic with NetworkPolicy %s", target, quarantineLabel, quarantinePolicyName), nil
+}
+
+func (k *kubernetesQuarantine) Execute(ctx context.Context, target, reason string) (string, error) {
+	headers, namespace, name, err := k.findPod(ctx, target)
+	if err != nil {
+		return "", err
+	}
+
+	policy := map[string]interface{}{
+		"apiVersion": "networking.k8s.io/v1",
+		"kind":       "NetworkPolicy",
+		"metadata":   map[string]interface{}{"name": quarantinePolicyName, "namespace": namespace},
+		"spec": map[string]interface{}{
+			"podSelector": map[string]interface{}{"matchLabels": map[string]string{quarantineLabel: "true"}},
+			"policyTypes": []string{"Ingress", "Egress"},
+		},
+	}
+	err = callJSON(ctx, k.client, http.MethodPost, fmt.Sprintf("%s/apis/networking.k8s.io/v1/namespaces/%s/networkpolicies", k.apiURL, namespace), headers, policy, nil)
+	var apiErr *responderAPIError
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.status == http.StatusConflict) {
+		return "", fmt.Errorf("failed to apply NetworkPolicy: %w", err)
+	}
+
+	// The policy is in place before the label, so the pod is isolated as soon as it is labeled
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]string{quarantineLabel: "true"},
+			"annotations": map[string]string{quarantineLabel + "-reason": reason},
+		},
+	}
+	headers["Content-Type"] = "application/merge-patch+json"
+	if err := callJSON(ctx, k.client, http.MethodPatch, fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s", k.apiURL, namespace, name), headers, patch, nil); err != nil {
+		return "", fmt.Errorf("failed to label pod %s/%s: %w", namespace, name, err)
+	}
+	return fmt.Sprintf("Pod %s/%s quarantined by NetworkPolicy %s", namespace, name, quarantinePolicyName), nil
+}
+
+// Release removes the quarantine label; the NetworkPolicy stays for other quarantined pods
+func (k *kubernetesQuarantine) Release(ctx context.Context, target, reason string) (string, error) {
+	headers, namespace, name, err := k.findPod(ctx, target)
+	if err != nil {
+		return "", err
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]interface{}{quarantineLabel: nil},
+			"annotations": map[string]interface{}{quarantineLabel + "-reason": nil},
+		},
+	}
+	headers["Content-Type"] = "application/merge-patch+json"
+	if err := callJSON(ctx, k.client, http.MethodPatch, fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s", k.apiURL, namespace, name), headers, patch, nil); err != nil {
+		return "", fmt.Errorf("failed to unlabel pod %s/%s: %w", namespace, name, err)
+	}
+	return fmt.Sprintf("Pod %s/%s released from quarantine", namespace, name), nil
+}
+
+// findPod returns the API headers and the pod with the target IP, preferring a running one
+func (k *kubernetesQuarantine) findPod(ctx context.Context, target string) (map[string]string, string, string, error) {
+	if net.ParseIP(target) == nil {
+		return nil, "", "", fmt.Errorf("target %q is not a pod IP address", target)
+	}
+	// Projected service account tokens rotate, so read it for every call
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, "", "", err
+	}
+	headers := map[string]string{"Authorization": "Bearer " + strings.TrimSpace(string(token))}
+
+	var pods kubernetesPodList
+	query := url.Values{"fieldSelector": {"status.podIP=" + target}}
+	if err := callJSON(ctx, k.client, http.MethodGet, k.apiURL+"/api/v1/pods?"+query.Encode(), headers, nil, &pods); err != nil {
+		return nil, "", "", fmt.Errorf("failed to find pod: %w", err)
+	}
+	namespace, name := "", ""
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == "Running" || name == "" {
+			namespace, name = pod.Metadata.Namespace, pod.Metadata.Name
+		}
+	}
+	if name == "" {
+		return nil, "", "", fmt.Errorf("no pod has IP %s", target)
+	}
+	return headers, namespace, name, nil
+}
+
+// crowdStrikeContainment network-contains a host through the CrowdStrike Falcon API
+type crowdStrikeContainment struct {
+	baseURL      string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+func (cs *crowdStrikeContainment) Name() string   { return "crowdstrike" }
+func (cs *crowdStrikeContainment) Action() string { return "quarantine" }
+
+func (cs *crowdStrikeContainment) Plan(target string) (string, error) {
+	if strings.ContainsAny(target, "'\"\\") {
+		return "", fmt.Errorf("target %q is not a hostname or IP address", target)
+	}
+	return fmt.Sprintf("Network-contain the Falcon host with %s %s", cs.filterField(target), target), nil
+}
+
+func (cs *crowdStrikeContainment) filterField(target string) string {
+	if net.ParseIP(target) != nil {
+		return "local_ip"
+	}
+	return "hostname"
+}
+
+func (cs *crowdStrikeContainment) Execute(ctx context.Context, target, reason string) (string, error) {
+	devices, err := cs.deviceAction(ctx, target, "contain")
+	if err != nil {
+		return "", fmt.Errorf("failed to contain host: %w", err)
+	}
+	return fmt.Sprintf("Falcon contained %d host(s) matching %s: %s", len(devices), target, strings.Join(devices, ", ")), nil
+}
+
+func (cs *crowdStrikeContainment) Release(ctx context.Context, target, reason string) (string, error) {
+	devices, err := cs.deviceAction(ctx, target, "lift_containment")
+	if err != nil {
+		return "", fmt.Errorf("failed to lift containment: %w", err)
+	}
+	return fmt.Sprintf("Falcon lifted containment of %d host(s) matching %s: %s", len(devices), target, strings.Join(devices, ", ")), nil
+}
+
+// deviceAction runs a host action on the Falcon hosts matching the target and returns their IDs
+func (cs *crowdStrikeContainment) deviceAction(ctx context.Context, target, action string) ([]string, error) {
+	if _, err := cs.Plan(target); err != nil {
+		return nil, err
+	}
+	token, err := cs.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{"Authorization": "Bearer " + token}
+
+	var devices struct {
+		Resources []string `json:"resources"`
+	}
+	query := url.Values{"filter": {fmt.Sprintf("%s:'%s'", cs.filterField(target), target)}}
+	if err := callJSON(ctx, cs.client, http.MethodGet, cs.baseURL+"/devices/queries/devices/v1?"+query.Encode(), headers, nil, &devices); err != nil {
+		return nil, fmt.Errorf("failed to find host: %w", err)
+	}
+	if len(devices.Resources) == 0 {
+		return nil, fmt.Errorf("no Falcon host matches %s", target)
+	}
+
+	body := map[string][]string{"ids": devices.Resources}
+	if err := callJSON(ctx, cs.client, http.MethodPost, cs.baseURL+"/devices/entities/devices-actions/v2?action_name="+action, headers, body, nil); err != nil {
+		return nil, err
+	}
+	return devices.Resources, nil
+}
+
+// accessToken returns a cached OAuth2 token, requesting a new one shortly before it expires
+func (cs *crowdStrikeContainment) accessToken(ctx context.Context) (string, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.token != "" && time.Now().Before(cs.tokenExpiry) {
+		return cs.token, nil
+	}
+
+	form := url.Values{"client_id": {cs.clientID}, "client_secret": {cs.clientSecret}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cs.baseURL+"/oauth2/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := cs.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("CrowdStrike authentication failed with status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	cs.token = result.AccessToken
+	cs.tokenExpiry = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+	return cs.token, nil
+}
+
+// oktaSuspender suspends an Okta user and clears their sessions
+type oktaSuspender struct {
+	orgURL string
+	token  string
+	client *http.Client
+}
+
+func (o *oktaSuspender) Name() string   { return "okta" }
+func (o *oktaSuspender) Action() string { return "disable_account" }
+
+func (o *oktaSuspender) Plan(target string) (string, error) {
+	if strings.TrimSpace(target) == "" || strings.ContainsAny(target, "/?#") {
+		return "", fmt.Errorf("target %q is not an Okta login", target)
+	}
+	return fmt.Sprintf("Suspend Okta user %s and revoke their sessions", target), nil
+}
+
+func (o *oktaSuspender) Execute(ctx context.Context, target, reason string) (string, error) {
+	if _, err := o.Plan(target); err != nil {
+		return "", err
+	}
+	headers := map[string]string{"Authorization": "SSWS " + o.token}
+
+	var user struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := callJSON(ctx, o.client, http.MethodGet, o.orgURL+"/api/v1/users/"+url.PathEscape(target), headers, nil, &user); err != nil {
+		return "", fmt.Errorf("failed to find user: %w", err)
+	}
+
+	result := fmt.Sprintf("Okta user %s suspended", target)
+	switch user.Status {
+	case "SUSPENDED", "DEPROVISIONED":
+		result = fmt.Sprintf("Okta user %s was already %s", target, strings.ToLower(user.Status))
+	default:
+		if err := callJSON(ctx, o.client, http.MethodPost, o.orgURL+"/api/v1/users/"+user.ID+"/lifecycle/suspend", headers, nil, nil); err != nil {
+			return "", fmt.Errorf("failed to suspend user: %w", err)
+		}
+	}
+
+	if err := callJSON(ctx, o.client, http.MethodDelete, o.orgURL+"/api/v1/users/"+user.ID+"/sessions", headers, nil, nil); err != nil {
+		return "", fmt.Errorf("%s, but revoking sessions failed: %w", result, err)
+	}
+	return result + "; sessions revoked", nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Automated incident response (SOAR)
+type ResponseMode string
+
+const (
+	ModeDryRun  ResponseMode = "dry_run" // validate and plan actions; nothing is executed or recorded
+	ModeAudit   ResponseMode = "audit"   // record the planned actions in the audit log without executing them
+	ModeEnforce ResponseMode = "enforce" // execute the actions and record the outcome
+)
+
+var responseModeRank = map[ResponseMode]int{ModeDryRun: 0, ModeAudit: 1, ModeEnforce: 2}
+
+const (
+	responseAuditKey = "soar:audit" // capped list of IncidentResponse JSON, newest first
+	responseAuditMax = 10000
+)
+
+var (
+	errResponseModeNotAllowed = errors.New("response mode exceeds SOAR_MODE")
+	errNoResponseExecutor     = errors.New("no response executor is configured for this action")
+	errResponseTargetRefused  = errors.New("response target refused")
+)
+
+var responseActions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cybersecurity_response_actions_total",
+		Help: "Incident response steps by action, executor, and status (executed, failed, audited, planned)",
+	},
+	[]string{"action", "executor", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(responseActions)
+}
+
+// ResponseExecutor carries out one kind of response action against an external system
+type ResponseExecutor interface {
+	Name() string
+	Action() string // "block", "quarantine", or "disable_account"
+	// Plan validates the target and describes the change Execute would make
+	Plan(target string) (string, error)
+	Execute(ctx context.Context, target, reason string) (string, error)
+}
+
+// ResponseReleaser is implemented by executors that can undo their action, such as lifting a
+// quarantine
+type ResponseReleaser interface {
+	Release(ctx context.Context, target, reason string) (string, error)
+}
+
+type IncidentResponseRequest struct {
+	IncidentID string       `json:"incident_id"`
+	Action     string       `json:"action" binding:"required,oneof=block quarantine disable_account alert investigate"`
+	Target     string       `json:"target" binding:"required"` // IP for block, IP or hostname for quarantine, login for disable_account
+	Reason     string       `json:"reason" binding:"required"`
+	Mode       ResponseMode `json:"mode"`      // defaults to SOAR_MODE
+	Executors  []string     `json:"executors"` // limit the response to these executors
+	// RequestedBy is the authenticated client or analyst the response is recorded against
+	RequestedBy string `json:"-"`
+}
+
+type ResponseStep struct {
+	Executor    string `json:"executor"`
+	Description string `json:"description"`
+	Status      string `json:"status"` // "planned", "audited", "executed", or "failed"
+	Error       string `json:"error,omitempty"`
+}
+
+type ResponseExecutorInfo struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+}
+
+// IncidentResponder runs response executors under the configured mode and keeps an audit log.
+// Blocks and quarantines of targets on the tenant's allowlist are refused.
+type IncidentResponder struct {
+	redis     *redis.Client
+	executors []ResponseExecutor
+	mode      ResponseMode
+	lists     *AccessLists
+}
+
+func NewIncidentResponder(redisClient *redis.Client, executors []ResponseExecutor, mode ResponseMode) *IncidentResponder {
+	if _, ok := responseModeRank[mode]; !ok {
+		log.Printf("Unknown SOAR_MODE %q; using %s", mode, ModeAudit)
+		mode = ModeAudit
+	}
+	return &IncidentResponder{redis: redisClient, executors: executors, mode: mode}
+}
+
+func (ir *IncidentResponder) Executors() []ResponseExecutorInfo {
+	executors := make([]ResponseExecutorInfo, 0, len(ir.executors))
+	for _, executor := range ir.executors {
+		executors = append(executors, ResponseExecutorInfo{Name: executor.Name(), Action: executor.Action()})
+	}
+	return executors
+}
+
+// Respond plans the action with every matching executor and, depending on the mode, records or
+// executes it. A plan that fails validation stops the response before anything is executed.
+func (ir *IncidentResponder) Respond(ctx context.Context, req IncidentResponseRequest) (*IncidentResponse, error) {
+	mode := req.Mode
+	if mode == "" {
+		mode = ir.mode
+	}
+	rank, ok := responseModeRank[mode]
+	if !ok {
+		return nil, fmt.Errorf("unknown mode %q", mode)
+	}
+	if rank > responseModeRank[ir.mode] {
+		return nil, fmt.Errorf("%w: %s is not allowed while SOAR_MODE is %s", errResponseModeNotAllowed, mode, ir.mode)
+	}
+	if ir.lists != nil && (req.Action == "block" || req.Action == "quarantine") {
+		if entry := ir.lists.lists(ctx).allowlist.Load().matchTarget(req.Target); entry != nil {
+			return nil, fmt.Errorf("%w: %s is allowlisted by %s", errResponseTargetRefused, req.Target, entry.Value)
+		}
+	}
+
+	response := &IncidentResponse{
+		IncidentID:     req.IncidentID,
+		Action:         req.Action,
+		Target:         req.Target,
+		Reason:         req.Reason,
+		Mode:           mode,
+		RequestedBy:    req.RequestedBy,
+		Timestamp:      time.Now().UTC(),
+		AutomatedSteps: make([]string, 0),
+		Steps:          make([]ResponseStep, 0),
+	}
+	if response.IncidentID == "" {
+		response.IncidentID = fmt.Sprintf("incident_%d", time.Now().UnixNano())
+	}
+
+	executors := ir.selectExecutors(req.Action, req.Executors)
+	if len(executors) == 0 && req.Action != "alert" && req.Action != "investigate" {
+		return nil, fmt.Errorf("%w: %s", errNoResponseExecutor, req.Action)
+	}
+
+	plans := make([]string, len(executors))
+	for i, executor := range executors {
+		plan, err := executor.Plan(req.Target)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", executor.Name(), err)
+		}
+		plans[i] = plan
+	}
+
+	for i, executor := range executors {
+		step := ResponseStep{Executor: executor.Name(), Description: plans[i]}
+		switch mode {
+		case ModeDryRun:
+			step.Status = "planned"
+		case ModeAudit:
+			step.Status = "audited"
+		case ModeEnforce:
+			result, err := executor.Execute(ctx, req.Target, req.Reason)
+			if err != nil {
+				step.Status = "failed"
+				step.Error = err.Error()
+				log.Printf("Response %s by %s on %s failed: %v", req.Action, executor.Name(), req.Target, err)
+			} else {
+				step.Status = "executed"
+				step.Description = result
+			}
+		}
+		responseActions.WithLabelValues(req.Action, executor.Name(), step.Status).Inc()
+		response.Steps = append(response.Steps, step)
+		response.AutomatedSteps = append(response.AutomatedSteps, fmt.Sprintf("[%s] %s: %s", step.Status, step.Executor, step.Description))
+	}
+	response.Status = responseStatus(mode, response.Steps)
+
+	if mode != ModeDryRun {
+		ir.audit(ctx, response)
+	}
+	return response, nil
+}
+
+// Accepting returns the executors of an action whose plan accepts the target
+func (ir *IncidentResponder) Accepting(action, target string) []string {
+	names := make([]string, 0)
+	for _, executor := range ir.selectExecutors(action, nil) {
+		if _, err := executor.Plan(target); err == nil {
+			names = append(names, executor.Name())
+		}
+	}
+	return names
+}
+
+// Release undoes an action on the target with the named executors, under SOAR_MODE, and records
+// it in the audit log as a "release" response requested by by. Executors that cannot undo their
+// action fail their step.
+func (ir *IncidentResponder) Release(ctx context.Context, incidentID, action, target, reason, by string, names []string) *IncidentResponse {
+	response := &IncidentResponse{
+		IncidentID:     incidentID,
+		Action:         "release",
+		Target:         target,
+		Reason:         reason,
+		Mode:           ir.mode,
+		RequestedBy:    by,
+		Timestamp:      time.Now().UTC(),
+		AutomatedSteps: make([]string, 0),
+		Steps:          make([]ResponseStep, 0),
+	}
+	for _, executor := range ir.selectExecutors(action, names) {
+		step := ResponseStep{Executor: executor.Name(), Description: fmt.Sprintf("Undo %s of %s", action, target)}
+		releaser, ok := executor.(ResponseReleaser)
+		switch {
+		case !ok:
+			step.Status = "failed"
+			step.Error = fmt.Sprintf("%s cannot undo %s; lift it in the target system", executor.Name(), action)
+		case ir.mode == ModeDryRun:
+			step.Status = "planned"
+		case ir.mode == ModeAudit:
+			step.Status = "audited"
+		default:
+			result, err := releaser.Release(ctx, target, reason)
+			if err != nil {
+				step.Status = "failed"
+				step.Error = err.Error()
+				log.Printf("Release of %s by %s on %s failed: %v", action, executor.Name(), target, err)
+			} else {
+				step.Status = "executed"
+				step.Description = result
+			}
+		}
+		responseActions.WithLabelValues("release", executor.Name(), step.Status).Inc()
+		response.Steps = append(response.Steps, step)
+		response.AutomatedSteps = append(response.AutomatedSteps, fmt.Sprintf("[%s] %s: %s", step.Status, step.Executor, step.Description))
+	}
+	response.Status = responseStatus(ir.mode, response.Steps)
+
+	if ir.mode != ModeDryRun {
+		ir.audit(ctx, response)
+	}
+	return response
+}
+
+func (ir *IncidentResponder) selectExecutors(action string, names []string) []ResponseExecutor {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	executors := make([]ResponseExecutor, 0)
+	for _, executor := range ir.executors {
+		if executor.Action() == action && (len(wanted) == 0 || wanted[executor.Name()]) {
+			executors = append(executors, executor)
+		}
+	}
+	return executors
+}
+
+func responseStatus(mode ResponseMode, steps []ResponseStep) string {
+	switch mode {
+	case ModeDryRun:
+		return "planned"
+	case ModeAudit:
+		return "audited"
+	}
+
+	failed := 0
+	for _, step := range steps {
+		if step.Status == "failed" {
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		return "completed"
+	case failed == len(steps):
+		return "failed"
+	default:
+		return "partial"
+	}
+}
+
+func (ir *IncidentResponder) audit(ctx context.Context, response *IncidentResponse) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return
+	}
+
+	pipe := ir.redis.TxPipeline()
+	pipe.LPush(ctx, responseAuditKey, data)
+	pipe.LTrim(ctx, responseAuditKey, 0, responseAuditMax-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record incident response %s in audit log: %v", response.IncidentID, err)
+	}
+}
+
+// AuditLog returns the newest audit entries
+func (ir *IncidentResponder) AuditLog(ctx context.Context, limit int) ([]IncidentResponse, error) {
+	items, err := ir.redis.LRange(ctx, responseAuditKey, 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load audit log: %w", err)
+	}
+
+	entries := make([]IncidentResponse, 0, len(items))
+	for _, item := range items {
+		var entry IncidentResponse
+		if err := json.Unmarshal([]byte(item), &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// HTTP Handlers
+func (s *APIServer) respondHandler(c *gin.Context) {
+	var req IncidentResponseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.RequestedBy = clientFromContext(c).ID
+
+	response, err := s.responder.Respond(c.Request.Context(), req)
+	switch {
+	case errors.Is(err, errResponseModeNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func (s *APIServer) responseAuditHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > responseAuditMax {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", responseAuditMax)})
+		return
+	}
+
+	entries, err := s.responder.AuditLog(c.Request.Context(), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"entries": entries, "count": len(entries)})
+}
+
+func (s *APIServer) responseExecutorsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"mode": s.responder.mode, "executors": s.responder.Executors()})
+}
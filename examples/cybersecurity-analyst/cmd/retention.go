@@ -0,0 +1,1094 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parquet-go/parquet-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Data retention: scan results, packets, and indicators are kept hot in Postgres (TimescaleDB
+// hypertables when the extension is installed), then archived to S3-compatible storage as Parquet
+const historySchema = `
+CREATE TABLE IF NOT EXISTS scan_history (
+	id              BIGSERIAL,
+	tenant          TEXT NOT NULL,
+	scan_id         TEXT NOT NULL,
+	scan_type       TEXT NOT NULL,
+	target          TEXT NOT NULL DEFAULT '',
+	risk_score      DOUBLE PRECISION NOT NULL,
+	indicators      INTEGER NOT NULL,
+	vulnerabilities INTEGER NOT NULL,
+	observed_at     TIMESTAMPTZ NOT NULL,
+	result          JSONB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS scan_history_time ON scan_history (tenant, observed_at);
+CREATE INDEX IF NOT EXISTS scan_history_scan ON scan_history (tenant, scan_id);
+
+CREATE TABLE IF NOT EXISTS packet_history (
+	id           BIGSERIAL,
+	tenant       TEXT NOT NULL,
+	scan_id      TEXT NOT NULL,
+	observed_at  TIMESTAMPTZ NOT NULL,
+	source_ip    TEXT NOT NULL,
+	dest_ip      TEXT NOT NULL,
+	source_port  INTEGER NOT NULL,
+	dest_port    INTEGER NOT NULL,
+	protocol     TEXT NOT NULL,
+	payload_size INTEGER NOT NULL,
+	flags        TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS packet_history_time ON packet_history (tenant, observed_at);
+
+CREATE TABLE IF NOT EXISTS indicator_history (
+	id           BIGSERIAL,
+	tenant       TEXT NOT NULL,
+	origin       TEXT NOT NULL,
+	scan_id      TEXT NOT NULL DEFAULT '',
+	observed_at  TIMESTAMPTZ NOT NULL,
+	type         TEXT NOT NULL,
+	severity     TEXT NOT NULL,
+	confidence   DOUBLE PRECISION NOT NULL,
+	source_ip    TEXT NOT NULL DEFAULT '',
+	dest_ip      TEXT NOT NULL DEFAULT '',
+	mitre_attack TEXT NOT NULL DEFAULT '',
+	description  TEXT NOT NULL,
+	indicator    JSONB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS indicator_history_time ON indicator_history (tenant, observed_at);
+CREATE INDEX IF NOT EXISTS indicator_history_source ON indicator_history (tenant, source_ip, observed_at);
+CREATE INDEX IF NOT EXISTS indicator_history_scan ON indicator_history (tenant, scan_id);
+
+CREATE TABLE IF NOT EXISTS archive_objects (
+	object_key  TEXT PRIMARY KEY,
+	kind        TEXT NOT NULL,
+	tenant      TEXT NOT NULL,
+	rows        INTEGER NOT NULL,
+	size_bytes  BIGINT NOT NULL,
+	min_at      TIMESTAMPTZ NOT NULL,
+	max_at      TIMESTAMPTZ NOT NULL,
+	archived_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS archive_objects_range ON archive_objects (tenant, kind, max_at);
+
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb') THEN
+		PERFORM create_hypertable('scan_history', 'observed_at', if_not_exists => TRUE, migrate_data => TRUE);
+		PERFORM create_hypertable('packet_history', 'observed_at', if_not_exists => TRUE, migrate_data => TRUE);
+		PERFORM create_hypertable('indicator_history', 'observed_at', if_not_exists => TRUE, migrate_data => TRUE);
+	END IF;
+END $$;
+`
+
+const (
+	historyQueueSize       = 50000
+	historyBatchSize       = 500
+	historyFlushInterval   = 2 * time.Second
+	maxHistoryPackets      = 10000  // packets recorded per scan
+	maxArchiveRows         = 100000 // rows per Parquet object
+	maxArchivePartitions   = 100    // tenant-days archived per table and pass
+	maxArchivesPerQuery    = 20     // Parquet objects read to answer one query
+	maxHistoryQueryLimit   = 1000
+	archiveExpiryBatch     = 1000
+	historyShutdownFlush   = 10 * time.Second
+	defaultHistoryLookback = 24 * time.Hour
+)
+
+var errUnknownHistoryKind = errors.New("unknown history kind")
+
+var (
+	historyRows = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_history_rows_total",
+			Help: "Scan, packet, and indicator history rows by kind and outcome (stored, dropped, archived, expired)",
+		},
+		[]string{"kind", "outcome"},
+	)
+	archiveObjects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_archive_objects_total",
+			Help: "Parquet archive objects by kind and operation (written, read, deleted)",
+		},
+		[]string{"kind", "operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(historyRows)
+	prometheus.MustRegister(archiveObjects)
+}
+
+// ScanRecord is a completed analysis as kept in history
+type ScanRecord struct {
+	Tenant          string          `json:"-" parquet:"tenant"`
+	ScanID          string          `json:"scan_id" parquet:"scan_id"`
+	ScanType        string          `json:"scan_type" parquet:"scan_type"`
+	Target          string          `json:"target,omitempty" parquet:"target"`
+	RiskScore       float64         `json:"risk_score" parquet:"risk_score"`
+	Indicators      int32           `json:"indicators" parquet:"indicators"`
+	Vulnerabilities int32           `json:"vulnerabilities" parquet:"vulnerabilities"`
+	ObservedAt      time.Time       `json:"timestamp" parquet:"observed_at,timestamp(millisecond)"`
+	Result          json.RawMessage `json:"result" parquet:"result"` // the analyze response
+}
+
+// PacketRecord is the header of a packet submitted for analysis; payloads are not retained
+type PacketRecord struct {
+	Tenant      string    `json:"-" parquet:"tenant"`
+	ScanID      string    `json:"scan_id" parquet:"scan_id"`
+	ObservedAt  time.Time `json:"timestamp" parquet:"observed_at,timestamp(millisecond)"`
+	SourceIP    string    `json:"source_ip" parquet:"source_ip"`
+	DestIP      string    `json:"dest_ip" parquet:"dest_ip"`
+	SourcePort  int32     `json:"source_port" parquet:"source_port"`
+	DestPort    int32     `json:"dest_port" parquet:"dest_port"`
+	Protocol    string    `json:"protocol" parquet:"protocol"`
+	PayloadSize int32     `json:"payload_size" parquet:"payload_size"`
+	Flags       string    `json:"flags,omitempty" parquet:"flags"` // set TCP flags, comma-separated
+}
+
+// IndicatorRecord is a threat indicator from any source, as kept in history
+type IndicatorRecord struct {
+	Tenant      string          `json:"-" parquet:"tenant"`
+	Origin      string          `json:"origin" parquet:"origin"` // scan type, or "capture", "flow", "stream"
+	ScanID      string          `json:"scan_id,omitempty" parquet:"scan_id"`
+	ObservedAt  time.Time       `json:"timestamp" parquet:"observed_at,timestamp(millisecond)"`
+	Type        string          `json:"type" parquet:"type"`
+	Severity    string          `json:"severity" parquet:"severity"`
+	Confidence  float64         `json:"confidence" parquet:"confidence"`
+	SourceIP    string          `json:"source_ip,omitempty" parquet:"source_ip"`
+	DestIP      string          `json:"dest_ip,omitempty" parquet:"dest_ip"`
+	MITREAttack string          `json:"mitre_attack,omitempty" parquet:"mitre_attack"`
+	Description string          `json:"description" parquet:"description"`
+	Indicator   json.RawMessage `json:"indicator" parquet:"indicator"` // the full indicator with evidence and enrichment
+}
+
+// historyRow is a record of any history table; values are in the order of the table's columns
+type historyRow interface {
+	kind() string
+	observed() time.Time
+	values() []interface{}
+	field(name string) string // value of a query filter; empty when the kind lacks it
+}
+
+func (r ScanRecord) kind() string             { return "scans" }
+func (r ScanRecord) observed() time.Time      { return r.ObservedAt }
+func (r PacketRecord) kind() string           { return "packets" }
+func (r PacketRecord) observed() time.Time    { return r.ObservedAt }
+func (r IndicatorRecord) kind() string        { return "indicators" }
+func (r IndicatorRecord) observed() time.Time { return r.ObservedAt }
+
+func (r ScanRecord) values() []interface{} {
+	return []interface{}{r.Tenant, r.ScanID, r.ScanType, r.Target, r.RiskScore, r.Indicators, r.Vulnerabilities, r.ObservedAt, string(r.Result)}
+}
+
+func (r PacketRecord) values() []interface{} {
+	return []interface{}{r.Tenant, r.ScanID, r.ObservedAt, r.SourceIP, r.DestIP, r.SourcePort, r.DestPort, r.Protocol, r.PayloadSize, r.Flags}
+}
+
+func (r IndicatorRecord) values() []interface{} {
+	return []interface{}{r.Tenant, r.Origin, r.ScanID, r.ObservedAt, r.Type, r.Severity, r.Confidence, r.SourceIP, r.DestIP, r.MITREAttack, r.Description, string(r.Indicator)}
+}
+
+func (r ScanRecord) field(name string) string {
+	if name == "scan_id" {
+		return r.ScanID
+	}
+	return ""
+}
+
+func (r PacketRecord) field(name string) string {
+	switch name {
+	case "scan_id":
+		return r.ScanID
+	case "source_ip":
+		return r.SourceIP
+	case "dest_ip":
+		return r.DestIP
+	}
+	return ""
+}
+
+func (r IndicatorRecord) field(name string) string {
+	switch name {
+	case "scan_id":
+		return r.ScanID
+	case "source_ip":
+		return r.SourceIP
+	case "dest_ip":
+		return r.DestIP
+	case "severity":
+		return r.Severity
+	}
+	return ""
+}
+
+// historyTable describes how one kind of history is stored, archived, and read back
+type historyTable struct {
+	kind    string
+	name    string
+	columns []string
+	filters []string // query filters, each a column of the table
+	scan    func(rows *sql.Rows, prefix ...interface{}) (historyRow, error)
+	encode  func(rows []historyRow) ([]byte, error)
+	decode  func(data []byte) ([]historyRow, error)
+}
+
+var historyTables = map[string]*historyTable{
+	"scans": {
+		kind:    "scans",
+		name:    "scan_history",
+		columns: []string{"tenant", "scan_id", "scan_type", "target", "risk_score", "indicators", "vulnerabilities", "observed_at", "result"},
+		filters: []string{"scan_id"},
+		scan: func(rows *sql.Rows, prefix ...interface{}) (historyRow, error) {
+			var r ScanRecord
+			var result []byte
+			err := rows.Scan(append(prefix, &r.Tenant, &r.ScanID, &r.ScanType, &r.Target, &r.RiskScore, &r.Indicators, &r.Vulnerabilities, &r.ObservedAt, &result)...)
+			r.ObservedAt, r.Result = r.ObservedAt.UTC(), result
+			return r, err
+		},
+		encode: encodeParquet[ScanRecord],
+		decode: decodeParquet[ScanRecord],
+	},
+	"packets": {
+		kind:    "packets",
+		name:    "packet_history",
+		columns: []string{"tenant", "scan_id", "observed_at", "source_ip", "dest_ip", "source_port", "dest_port", "protocol", "payload_size", "flags"},
+		filters: []string{"scan_id", "source_ip", "dest_ip"},
+		scan: func(rows *sql.Rows, prefix ...interface{}) (historyRow, error) {
+			var r PacketRecord
+			err := rows.Scan(append(prefix, &r.Tenant, &r.ScanID, &r.ObservedAt, &r.SourceIP, &r.DestIP, &r.SourcePort, &r.DestPort, &r.Protocol, &r.PayloadSize, &r.Flags)...)
+			r.ObservedAt = r.ObservedAt.UTC()
+			return r, err
+		},
+		encode: encodeParquet[PacketRecord],
+		decode: decodeParquet[PacketRecord],
+	},
+	"indicators": {
+		kind:    "indicators",
+		name:    "indicator_history",
+		columns: []string{"tenant", "origin", "scan_id", "observed_at", "type", "severity", "confidence", "source_ip", "dest_ip", "mitre_attack", "description", "indicator"},
+		filters: []string{"scan_id", "source_ip", "dest_ip", "severity"},
+		scan: func(rows *sql.Rows, prefix ...interface{}) (historyRow, error) {
+			var r IndicatorRecord
+			var indicator []byte
+			err := rows.Scan(append(prefix, &r.Tenant, &r.Origin, &r.ScanID, &r.ObservedAt, &r.Type, &r.Severity, &r.Confidence, &r.SourceIP, &r.DestIP, &r.MITREAttack, &r.Description, &indicator)...)
+			r.ObservedAt, r.Indicator = r.ObservedAt.UTC(), indicator
+			return r, err
+		},
+		encode: encodeParquet[IndicatorRecord],
+		decode: decodeParquet[IndicatorRecord],
+	},
+}
+
+// historyKinds lists the kinds in a fixed order for retention passes and status
+var historyKinds = []string{"scans", "packets", "indicators"}
+
+func encodeParquet[T historyRow](rows []historyRow) ([]byte, error) {
+	records := make([]T, len(rows))
+	for i, row := range rows {
+		records[i] = row.(T)
+	}
+	var buf bytes.Buffer
+	writer := parquet.NewGenericWriter[T](&buf, parquet.Compression(&parquet.Zstd))
+	if _, err := writer.Write(records); err != nil {
+		return nil, fmt.Errorf("failed to encode Parquet: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode Parquet: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeParquet[T historyRow](data []byte) ([]historyRow, error) {
+	records, err := parquet.Read[T](bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode Parquet: %w", err)
+	}
+	rows := make([]historyRow, len(records))
+	for i := range records {
+		rows[i] = records[i]
+	}
+	return rows, nil
+}
+
+// ObjectStore is an S3-compatible bucket addressed path-style, which AWS S3, MinIO, Ceph, and
+// R2 all accept. Requests are signed with the standard AWS environment credentials.
+type ObjectStore struct {
+	endpoint *url.URL
+	bucket   string
+	region   string
+	client   *http.Client
+}
+
+// NewObjectStore returns nil when no bucket is configured, which disables archival
+func NewObjectStore(endpoint, bucket, region string) (*ObjectStore, error) {
+	if bucket == "" {
+		return nil, nil
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid ARCHIVE_S3_ENDPOINT %q", endpoint)
+	}
+	return &ObjectStore{endpoint: parsed, bucket: bucket, region: region, client: &http.Client{Timeout: 5 * time.Minute}}, nil
+}
+
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (o *ObjectStore) do(ctx context.Context, method, key string, body []byte, contentType string) ([]byte, error) {
+	target := *o.endpoint
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + o.bucket + "/" + key
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	signAWSRequest(req, body, "s3", o.region, time.Now())
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var s3Err s3ErrorResponse
+		if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+			return nil, fmt.Errorf("%s %s: %s: %s", method, key, s3Err.Code, s3Err.Message)
+		}
+		return nil, fmt.Errorf("%s %s: status %d", method, key, resp.StatusCode)
+	}
+	return data, nil
+}
+
+func (o *ObjectStore) Put(ctx context.Context, key string, data []byte) error {
+	_, err := o.do(ctx, http.MethodPut, key, data, "application/vnd.apache.parquet")
+	return err
+}
+
+func (o *ObjectStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return o.do(ctx, http.MethodGet, key, nil, "")
+}
+
+func (o *ObjectStore) Delete(ctx context.Context, key string) error {
+	_, err := o.do(ctx, http.MethodDelete, key, nil, "")
+	return err
+}
+
+// RetentionPolicy is how long each kind of history stays hot before it is archived
+type RetentionPolicy struct {
+	Scans      time.Duration
+	Packets    time.Duration
+	Indicators time.Duration
+	Archive    time.Duration // archived objects are deleted after this long; zero keeps them
+}
+
+func (p RetentionPolicy) hot(kind string) time.Duration {
+	switch kind {
+	case "scans":
+		return p.Scans
+	case "packets":
+		return p.Packets
+	default:
+		return p.Indicators
+	}
+}
+
+// RetentionStatus describes the last retention pass over one kind of history
+type RetentionStatus struct {
+	Kind         string     `json:"kind"`
+	HotRetention string     `json:"hot_retention"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	Archived     int        `json:"archived_rows"` // in the last pass
+	Deleted      int        `json:"deleted_rows"`  // in the last pass, without archiving
+	Objects      int        `json:"objects"`       // written in the last pass
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+// HistoryStore records scan results, packets, and indicators in Postgres, moves them to the
+// object store once they pass their hot retention, and answers queries from both
+type HistoryStore struct {
+	db       *sql.DB
+	objects  *ObjectStore
+	prefix   string
+	policy   RetentionPolicy
+	interval time.Duration
+	queue    chan historyRow
+
+	schemaReady atomic.Bool
+	mu          sync.Mutex
+	status      map[string]*RetentionStatus
+}
+
+func NewHistoryStore(db *sql.DB, objects *ObjectStore, prefix string, policy RetentionPolicy, interval time.Duration) *HistoryStore {
+	status := make(map[string]*RetentionStatus, len(historyKinds))
+	for _, kind := range historyKinds {
+		status[kind] = &RetentionStatus{Kind: kind, HotRetention: policy.hot(kind).String()}
+	}
+	return &HistoryStore{
+		db:       db,
+		objects:  objects,
+		prefix:   strings.Trim(prefix, "/"),
+		policy:   policy,
+		interval: interval,
+		queue:    make(chan historyRow, historyQueueSize),
+		status:   status,
+	}
+}
+
+func (hs *HistoryStore) ensureSchema(ctx context.Context) error {
+	if hs.schemaReady.Load() {
+		return nil
+	}
+	if _, err := hs.db.ExecContext(ctx, historySchema); err != nil {
+		return fmt.Errorf("failed to create history schema: %w", err)
+	}
+	hs.schemaReady.Store(true)
+	return nil
+}
+
+// RecordScan queues a completed analysis with its packets and indicators
+func (hs *HistoryStore) RecordScan(ctx context.Context, req *ThreatDetectionRequest, response *ThreatDetectionResponse) {
+	result, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Failed to marshal scan %s for history: %v", response.ScanID, err)
+		return
+	}
+	tenant := tenantFromContext(ctx)
+	hs.enqueue(ScanRecord{
+		Tenant:          tenant,
+		ScanID:          response.ScanID,
+		ScanType:        req.ScanType,
+		Target:          req.Target,
+		RiskScore:       response.RiskScore,
+		Indicators:      int32(len(response.ThreatIndicators)),
+		Vulnerabilities: int32(len(response.Vulnerabilities)),
+		ObservedAt:      response.Timestamp.UTC(),
+		Result:          result,
+	})
+
+	for _, packet := range req.Packets[:min(len(req.Packets), maxHistoryPackets)] {
+		flags := make([]string, 0, len(packet.Flags))
+		for flag, set := range packet.Flags {
+			if set {
+				flags = append(flags, flag)
+			}
+		}
+		sort.Strings(flags)
+		observed := packet.Timestamp
+		if observed.IsZero() {
+			observed = response.Timestamp
+		}
+		hs.enqueue(PacketRecord{
+			Tenant:      tenant,
+			ScanID:      response.ScanID,
+			ObservedAt:  observed.UTC(),
+			SourceIP:    packet.SourceIP,
+			DestIP:      packet.DestIP,
+			SourcePort:  int32(packet.SourcePort),
+			DestPort:    int32(packet.DestPort),
+			Protocol:    packet.Protocol,
+			PayloadSize: int32(packet.PayloadSize),
+			Flags:       strings.Join(flags, ","),
+		})
+	}
+
+	hs.RecordIndicators(ctx, req.ScanType, response.ScanID, response.ThreatIndicators)
+}
+
+// UpdateScan rewrites a stored scan after indicators are merged into it, as sandbox reports are.
+// Scans already archived, or not yet written, are left as they are.
+func (hs *HistoryStore) UpdateScan(ctx context.Context, response *ThreatDetectionResponse) error {
+	if err := hs.ensureSchema(ctx); err != nil {
+		return err
+	}
+	result, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	updated, err := hs.db.ExecContext(ctx,
+		`UPDATE scan_history SET result = $3, risk_score = $4, indicators = $5 WHERE tenant = $1 AND scan_id = $2`,
+		tenantFromContext(ctx), response.ScanID, result, response.RiskScore, len(response.ThreatIndicators))
+	if err != nil {
+		return fmt.Errorf("failed to update scan: %w", err)
+	}
+	if rows, err := updated.RowsAffected(); err == nil && rows == 0 {
+		return errScanNotFound
+	}
+	return nil
+}
+
+// RecordIndicators queues indicators, including those raised outside a scan by live capture,
+// flow collection, or analysis streams
+func (hs *HistoryStore) RecordIndicators(ctx context.Context, origin, scanID string, threats []ThreatIndicator) {
+	tenant := tenantFromContext(ctx)
+	now := time.Now().UTC()
+	for i := range threats {
+		data, err := json.Marshal(&threats[i])
+		if err != nil {
+			continue
+		}
+		hs.enqueue(IndicatorRecord{
+			Tenant:      tenant,
+			Origin:      origin,
+			ScanID:      scanID,
+			ObservedAt:  now,
+			Type:        string(threats[i].Type),
+			Severity:    string(threats[i].Severity),
+			Confidence:  threats[i].Confidence,
+			SourceIP:    threats[i].SourceIP,
+			DestIP:      threats[i].DestIP,
+			MITREAttack: threats[i].MITREAttack,
+			Description: threats[i].Description,
+			Indicator:   data,
+		})
+	}
+}
+
+// enqueue drops the row when the queue is full rather than slowing detection down
+func (hs *HistoryStore) enqueue(row historyRow) {
+	select {
+	case hs.queue <- row:
+	default:
+		historyRows.WithLabelValues(row.kind(), "dropped").Inc()
+	}
+}
+
+// Start writes queued rows in batches and runs a retention pass on every interval until ctx is
+// cancelled; rows still queued are written before it returns
+func (hs *HistoryStore) Start(ctx context.Context) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		hs.write(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(hs.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				hs.Enforce(ctx)
+			}
+		}
+	}()
+
+	archive := "disabled"
+	if hs.objects != nil {
+		archive = "s3://" + hs.objects.bucket + "/" + hs.prefix
+	}
+	log.Printf("Keeping history hot for scans %s, packets %s, indicators %s; archive %s",
+		hs.policy.Scans, hs.policy.Packets, hs.policy.Indicators, archive)
+	return &wg
+}
+
+func (hs *HistoryStore) write(ctx context.Context) {
+	ticker := time.NewTicker(historyFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]historyRow, 0, historyBatchSize)
+	flush := func(ctx context.Context) {
+		if len(batch) > 0 {
+			hs.insert(ctx, batch)
+			batch = make([]historyRow, 0, historyBatchSize)
+		}
+	}
+
+	for {
+		select {
+		case row := <-hs.queue:
+			batch = append(batch, row)
+			if len(batch) >= historyBatchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		case <-ctx.Done():
+			drainCtx, cancel := context.WithTimeout(context.Background(), historyShutdownFlush)
+			defer cancel()
+			for len(hs.queue) > 0 {
+				batch = append(batch, <-hs.queue)
+				if len(batch) >= historyBatchSize {
+					flush(drainCtx)
+				}
+			}
+			flush(drainCtx)
+			return
+		}
+	}
+}
+
+// insert writes a batch with one multi-row INSERT per table
+func (hs *HistoryStore) insert(ctx context.Context, batch []historyRow) {
+	byKind := make(map[string][]historyRow)
+	for _, row := range batch {
+		byKind[row.kind()] = append(byKind[row.kind()], row)
+	}
+
+	if err := hs.ensureSchema(ctx); err != nil {
+		log.Printf("Dropped %d history rows: %v", len(batch), err)
+		for kind, rows := range byKind {
+			historyRows.WithLabelValues(kind, "dropped").Add(float64(len(rows)))
+		}
+		return
+	}
+
+	for kind, rows := range byKind {
+		table := historyTables[kind]
+		placeholders := make([]string, 0, len(rows))
+		args := make([]interface{}, 0, len(rows)*len(table.columns))
+		for _, row := range rows {
+			values := row.values()
+			marks := make([]string, len(values))
+			for i := range values {
+				marks[i] = "$" + strconv.Itoa(len(args)+i+1)
+			}
+			placeholders = append(placeholders, "("+strings.Join(marks, ", ")+")")
+			args = append(args, values...)
+		}
+		query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", table.name, strings.Join(table.columns, ", "), strings.Join(placeholders, ", "))
+		if _, err := hs.db.ExecContext(ctx, query, args...); err != nil {
+			log.Printf("Dropped %d %s history rows: %v", len(rows), kind, err)
+			historyRows.WithLabelValues(kind, "dropped").Add(float64(len(rows)))
+			continue
+		}
+		historyRows.WithLabelValues(kind, "stored").Add(float64(len(rows)))
+	}
+}
+
+// Enforce archives, or deletes when archival is disabled, every row past its kind's hot
+// retention, and deletes archives past the archive retention
+func (hs *HistoryStore) Enforce(ctx context.Context) {
+	if err := hs.ensureSchema(ctx); err != nil {
+		log.Printf("Retention pass skipped: %v", err)
+		return
+	}
+
+	for _, kind := range historyKinds {
+		table := historyTables[kind]
+		cutoff := time.Now().UTC().Add(-hs.policy.hot(kind))
+		var archived, deleted, objects int
+		var err error
+		if hs.objects != nil {
+			archived, objects, err = hs.archive(ctx, table, cutoff)
+		} else {
+			deleted, err = hs.expire(ctx, table, cutoff)
+		}
+		if err == nil && hs.objects != nil && hs.policy.Archive > 0 {
+			err = hs.expireArchives(ctx, kind, time.Now().UTC().Add(-hs.policy.Archive))
+		}
+
+		now := time.Now().UTC()
+		hs.mu.Lock()
+		status := hs.status[kind]
+		status.LastRun, status.Archived, status.Deleted, status.Objects, status.LastError = &now, archived, deleted, objects, ""
+		if err != nil {
+			status.LastError = err.Error()
+		}
+		hs.mu.Unlock()
+
+		if err != nil {
+			log.Printf("Retention of %s history failed: %v", kind, err)
+		} else if archived > 0 || deleted > 0 {
+			log.Printf("Retention of %s history archived %d rows in %d objects, deleted %d", kind, archived, objects, deleted)
+		}
+	}
+}
+
+// archive moves the rows before cutoff to the object store, one Parquet object per tenant and UTC
+// day (split at maxArchiveRows). Each object is listed in archive_objects in the same transaction
+// that deletes its rows, so queries see every row exactly once.
+func (hs *HistoryStore) archive(ctx context.Context, table *historyTable, cutoff time.Time) (int, int, error) {
+	type partition struct {
+		tenant string
+		day    time.Time
+	}
+	rows, err := hs.db.QueryContext(ctx, fmt.Sprintf(
+		`SELECT tenant, date_trunc('day', observed_at AT TIME ZONE 'UTC') AS day FROM %s WHERE observed_at < $1 GROUP BY tenant, day ORDER BY day LIMIT %d`,
+		table.name, maxArchivePartitions), cutoff)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list partitions: %w", err)
+	}
+	partitions := make([]partition, 0)
+	for rows.Next() {
+		var p partition
+		if err := rows.Scan(&p.tenant, &p.day); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		p.day = time.Date(p.day.Year(), p.day.Month(), p.day.Day(), 0, 0, 0, 0, time.UTC)
+		partitions = append(partitions, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	archived, objects := 0, 0
+	for _, p := range partitions {
+		from, to := p.day, p.day.Add(24*time.Hour)
+		if to.After(cutoff) {
+			to = cutoff
+		}
+		for {
+			count, err := hs.archiveBatch(ctx, table, p.tenant, from, to)
+			if err != nil {
+				return archived, objects, err
+			}
+			if count == 0 {
+				break
+			}
+			archived += count
+			objects++
+			if count < maxArchiveRows {
+				break
+			}
+		}
+	}
+	return archived, objects, nil
+}
+
+func (hs *HistoryStore) archiveBatch(ctx context.Context, table *historyTable, tenant string, from, to time.Time) (int, error) {
+	rows, err := hs.db.QueryContext(ctx, fmt.Sprintf(
+		`SELECT id, %s FROM %s WHERE tenant = $1 AND observed_at >= $2 AND observed_at < $3 ORDER BY id LIMIT %d`,
+		strings.Join(table.columns, ", "), table.name, maxArchiveRows), tenant, from, to)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read rows to archive: %w", err)
+	}
+	records := make([]historyRow, 0)
+	var maxID int64
+	minAt, maxAt := to, from
+	for rows.Next() {
+		var id int64
+		record, err := table.scan(rows, &id)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		maxID = max(maxID, id)
+		if at := record.observed(); at.Before(minAt) {
+			minAt = at
+		}
+		if at := record.observed(); at.After(maxAt) {
+			maxAt = at
+		}
+		records = append(records, record)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(records) == 0 {
+		return 0, err
+	}
+
+	data, err := table.encode(records)
+	if err != nil {
+		return 0, err
+	}
+	key := fmt.Sprintf("%s/%s/tenant=%s/date=%s/%s-%d.parquet", hs.prefix, table.kind, url.PathEscape(tenant),
+		from.Format("2006-01-02"), table.kind, time.Now().UnixNano())
+	key = strings.TrimPrefix(key, "/")
+	if err := hs.objects.Put(ctx, key, data); err != nil {
+		return 0, fmt.Errorf("failed to upload archive: %w", err)
+	}
+	archiveObjects.WithLabelValues(table.kind, "written").Inc()
+
+	tx, err := hs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO archive_objects (object_key, kind, tenant, rows, size_bytes, min_at, max_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		key, table.kind, tenant, len(records), len(data), minAt, maxAt); err != nil {
+		return 0, fmt.Errorf("failed to record archive %s: %w", key, err)
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+		`DELETE FROM %s WHERE tenant = $1 AND observed_at >= $2 AND observed_at < $3 AND id <= $4`, table.name),
+		tenant, from, to, maxID); err != nil {
+		return 0, fmt.Errorf("failed to delete archived rows: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	historyRows.WithLabelValues(table.kind, "archived").Add(float64(len(records)))
+	return len(records), nil
+}
+
+// expire deletes the rows before cutoff when there is nowhere to archive them
+func (hs *HistoryStore) expire(ctx context.Context, table *historyTable, cutoff time.Time) (int, error) {
+	result, err := hs.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE observed_at < $1`, table.name), cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired rows: %w", err)
+	}
+	deleted, _ := result.RowsAffected()
+	historyRows.WithLabelValues(table.kind, "expired").Add(float64(deleted))
+	return int(deleted), nil
+}
+
+// expireArchives deletes archived objects whose newest row is before cutoff
+func (hs *HistoryStore) expireArchives(ctx context.Context, kind string, cutoff time.Time) error {
+	rows, err := hs.db.QueryContext(ctx,
+		`SELECT object_key FROM archive_objects WHERE kind = $1 AND max_at < $2 ORDER BY max_at LIMIT $3`,
+		kind, cutoff, archiveExpiryBatch)
+	if err != nil {
+		return fmt.Errorf("failed to list expired archives: %w", err)
+	}
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := hs.objects.Delete(ctx, key); err != nil {
+			return fmt.Errorf("failed to delete archive: %w", err)
+		}
+		if _, err := hs.db.ExecContext(ctx, `DELETE FROM archive_objects WHERE object_key = $1`, key); err != nil {
+			return fmt.Errorf("failed to forget archive %s: %w", key, err)
+		}
+		archiveObjects.WithLabelValues(kind, "deleted").Inc()
+	}
+	return nil
+}
+
+// HistoryQuery selects history records of the context's tenant; empty filters match everything
+type HistoryQuery struct {
+	From    time.Time
+	To      time.Time
+	Filters map[string]string // column -> exact value
+	Limit   int
+}
+
+// HistoryResult holds the newest matching records, from the hot tables and the archives
+type HistoryResult struct {
+	Kind         string       `json:"kind"`
+	From         time.Time    `json:"from"`
+	To           time.Time    `json:"to"`
+	Records      []historyRow `json:"records"`
+	Count        int          `json:"count"`
+	ArchivesRead int          `json:"archives_read"`
+	Truncated    bool         `json:"truncated"` // more archives overlapped the range than one query reads
+}
+
+// Query reads matching records from the hot table, then from the archives overlapping the range,
+// newest first, until the limit is reached
+func (hs *HistoryStore) Query(ctx context.Context, kind string, q HistoryQuery) (*HistoryResult, error) {
+	table, ok := historyTables[kind]
+	if !ok {
+		return nil, errUnknownHistoryKind
+	}
+	if err := hs.ensureSchema(ctx); err != nil {
+		return nil, err
+	}
+	tenant := tenantFromContext(ctx)
+	result := &HistoryResult{Kind: kind, From: q.From, To: q.To, Records: make([]historyRow, 0)}
+
+	conditions := []string{"tenant = $1", "observed_at >= $2", "observed_at < $3"}
+	args := []interface{}{tenant, q.From, q.To}
+	for _, column := range table.filters {
+		if value := q.Filters[column]; value != "" {
+			args = append(args, value)
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", column, len(args)))
+		}
+	}
+	rows, err := hs.db.QueryContext(ctx, fmt.Sprintf(`SELECT %s FROM %s WHERE %s ORDER BY observed_at DESC LIMIT %d`,
+		strings.Join(table.columns, ", "), table.name, strings.Join(conditions, " AND "), q.Limit), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s history: %w", kind, err)
+	}
+	for rows.Next() {
+		record, err := table.scan(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		result.Records = append(result.Records, record)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(result.Records) < q.Limit && hs.objects != nil {
+		if err := hs.queryArchives(ctx, table, tenant, q, result); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(result.Records, func(i, j int) bool {
+		return result.Records[i].observed().After(result.Records[j].observed())
+	})
+	if len(result.Records) > q.Limit {
+		result.Records = result.Records[:q.Limit]
+	}
+	result.Count = len(result.Records)
+	return result, nil
+}
+
+func (hs *HistoryStore) queryArchives(ctx context.Context, table *historyTable, tenant string, q HistoryQuery, result *HistoryResult) error {
+	rows, err := hs.db.QueryContext(ctx,
+		`SELECT object_key FROM archive_objects WHERE tenant = $1 AND kind = $2 AND max_at >= $3 AND min_at < $4 ORDER BY max_at DESC LIMIT $5`,
+		tenant, table.kind, q.From, q.To, maxArchivesPerQuery+1)
+	if err != nil {
+		return fmt.Errorf("failed to list archives: %w", err)
+	}
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(keys) > maxArchivesPerQuery {
+		keys = keys[:maxArchivesPerQuery]
+		result.Truncated = true
+	}
+
+	for _, key := range keys {
+		if len(result.Records) >= q.Limit {
+			result.Truncated = true
+			break
+		}
+		data, err := hs.objects.Get(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		archiveObjects.WithLabelValues(table.kind, "read").Inc()
+		records, err := table.decode(data)
+		if err != nil {
+			return fmt.Errorf("archive %s: %w", key, err)
+		}
+		result.ArchivesRead++
+
+	records:
+		for _, record := range records {
+			if at := record.observed(); at.Before(q.From) || !at.Before(q.To) {
+				continue
+			}
+			for column, value := range q.Filters {
+				if value != "" && record.field(column) != value {
+					continue records
+				}
+			}
+			result.Records = append(result.Records, record)
+		}
+	}
+	return nil
+}
+
+// Status reports the retention policy and the outcome of the last pass for each kind
+func (hs *HistoryStore) Status() []RetentionStatus {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	statuses := make([]RetentionStatus, 0, len(historyKinds))
+	for _, kind := range historyKinds {
+		statuses = append(statuses, *hs.status[kind])
+	}
+	return statuses
+}
+
+// HTTP Handlers
+func (s *APIServer) queryHistoryHandler(c *gin.Context) {
+	kind := c.Param("kind")
+	table, ok := historyTables[kind]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "kind must be scans, packets, or indicators"})
+		return
+	}
+
+	q := HistoryQuery{To: time.Now().UTC(), Filters: make(map[string]string), Limit: 100}
+	if to := c.Query("to"); to != "" {
+		parsed, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be an RFC 3339 time"})
+			return
+		}
+		q.To = parsed.UTC()
+	}
+	q.From = q.To.Add(-defaultHistoryLookback)
+	if from := c.Query("from"); from != "" {
+		parsed, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 time"})
+			return
+		}
+		q.From = parsed.UTC()
+	}
+	if !q.From.Before(q.To) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+	if limit := c.Query("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 || parsed > maxHistoryQueryLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxHistoryQueryLimit)})
+			return
+		}
+		q.Limit = parsed
+	}
+	for _, column := range table.filters {
+		q.Filters[column] = c.Query(column)
+	}
+
+	result, err := s.threatDetector.history.Query(c.Request.Context(), kind, q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func (s *APIServer) retentionStatusHandler(c *gin.Context) {
+	history := s.threatDetector.history
+	archive := gin.H{"enabled": history.objects != nil}
+	if history.objects != nil {
+		archive["bucket"] = history.objects.bucket
+		archive["prefix"] = history.prefix
+		archive["retention"] = history.policy.Archive.String()
+	}
+	c.JSON(http.StatusOK, gin.H{"history": history.Status(), "archive": archive})
+}
@@ -0,0 +1,1043 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sandbox detonation: packet payloads and uploaded files that score at or above the suspicion
+// threshold are submitted to a sandbox (Cuckoo, CAPE, or Hybrid Analysis). The IOCs and ATT&CK
+// techniques of its behavioral report are merged into the scans the sample was seen in.
+const (
+	sandboxKeyPrefix       = "sandbox:detonation:" // ID -> Detonation JSON; ID + ":scans" is the set of scans awaiting its report
+	sandboxIndexKey        = "sandbox:detonations" // per tenant: sorted set of IDs by submission time
+	sandboxSampleKeyPrefix = "sandbox:sha256:"     // per tenant: SHA-256 -> ID of the sample's detonation
+	sandboxPendingKey      = "sandbox:pending"     // sorted set of submitted IDs by next poll time
+	sandboxRetention       = 30 * 24 * time.Hour
+	sandboxQueueSize       = 64
+	sandboxSubmitTimeout   = 2 * time.Minute
+	sandboxMaxReport       = 256 << 20 // CAPE reports of busy samples run to tens of megabytes
+	maxSandboxPayloads     = 20        // distinct payloads screened per scan
+	maxSandboxAddresses    = 20        // contacted addresses merged as indicators
+	maxSandboxReportValues = 200       // techniques, addresses, domains, URLs, and dropped files kept from a report
+	maxSandboxListed       = 1000
+)
+
+type DetonationStatus string
+
+const (
+	DetonationSubmitted DetonationStatus = "submitted" // running in the sandbox
+	DetonationReported  DetonationStatus = "reported"
+	DetonationFailed    DetonationStatus = "failed"
+	DetonationTimedOut  DetonationStatus = "timed_out"
+)
+
+var (
+	errSandboxDisabled    = errors.New("sandbox detonation is not configured")
+	errDetonationNotFound = errors.New("detonation not found")
+	errSandboxTaskFailed  = errors.New("sandbox analysis failed")
+)
+
+var sandboxDetonations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cybersecurity_sandbox_detonations_total",
+		Help: "Sandbox detonations by outcome (submitted, reported, failed, timed_out, reused, dropped)",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(sandboxDetonations)
+}
+
+// SandboxSignature is a behavior the sandbox observed
+type SandboxSignature struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Severity    int      `json:"severity,omitempty"` // the sandbox's own scale
+	Techniques  []string `json:"mitre_attack,omitempty"`
+}
+
+// SandboxReport is the part of a behavioral report merged into scans
+type SandboxReport struct {
+	Score      int                `json:"score"` // 0-100
+	Family     string             `json:"family,omitempty"`
+	Signatures []SandboxSignature `json:"signatures"`
+	Techniques []string           `json:"mitre_attack"`
+	Addresses  []string           `json:"addresses"` // hosts the sample contacted
+	Domains    []string           `json:"domains"`
+	URLs       []string           `json:"urls"`
+	Dropped    []string           `json:"dropped"` // SHA-256 of files the sample wrote
+}
+
+// SandboxBackend submits samples to a sandbox and fetches their reports
+type SandboxBackend interface {
+	Name() string
+	Submit(ctx context.Context, name string, content []byte) (string, error)
+	// Report returns nil while the task is still running
+	Report(ctx context.Context, taskID string) (*SandboxReport, error)
+}
+
+// Detonation is a sample's run in the sandbox. A tenant's sample is detonated once; later scans
+// that carry it receive the same report.
+type Detonation struct {
+	ID          string           `json:"id"`
+	Status      DetonationStatus `json:"status"`
+	Tenant      string           `json:"tenant,omitempty"`
+	ScanIDs     []string         `json:"scan_ids"` // scans the report is merged into
+	Source      string           `json:"source"`   // "payload" or "file"
+	Name        string           `json:"name,omitempty"`
+	SHA256      string           `json:"sha256"`
+	Size        int64            `json:"size"`
+	Screening   int              `json:"screening_score"` // file scan score that sent it to the sandbox
+	SourceIP    string           `json:"source_ip,omitempty"`
+	DestIP      string           `json:"dest_ip,omitempty"`
+	Backend     string           `json:"backend"`
+	TaskID      string           `json:"task_id,omitempty"`
+	SubmittedAt time.Time        `json:"submitted_at"`
+	CompletedAt *time.Time       `json:"completed_at,omitempty"`
+	Verdict     FileVerdict      `json:"verdict,omitempty"`
+	Report      *SandboxReport   `json:"report,omitempty"`
+	Error       string           `json:"error,omitempty"`
+}
+
+// sandboxJob is a sample waiting to be screened or submitted
+type sandboxJob struct {
+	tenant   string
+	scanID   string
+	source   string
+	name     string
+	content  []byte
+	sourceIP string
+	destIP   string
+	result   *FileScanResult // the screening of uploaded files; payloads are screened by the worker
+}
+
+type Sandbox struct {
+	redis      *redis.Client
+	detector   *ThreatDetector
+	backend    SandboxBackend
+	minScore   int
+	minPayload int
+	pollEvery  time.Duration
+	timeout    time.Duration
+	jobs       chan sandboxJob
+}
+
+// NewSandbox returns nil when no backend is configured, which disables detonation
+func NewSandbox(redisClient *redis.Client, detector *ThreatDetector, backend SandboxBackend, minScore, minPayload int, pollEvery, timeout time.Duration) *Sandbox {
+	if backend == nil {
+		return nil
+	}
+	return &Sandbox{
+		redis:      redisClient,
+		detector:   detector,
+		backend:    backend,
+		minScore:   minScore,
+		minPayload: minPayload,
+		pollEvery:  pollEvery,
+		timeout:    timeout,
+		jobs:       make(chan sandboxJob, sandboxQueueSize),
+	}
+}
+
+// sandboxBackendFromConfig builds the configured backend; detonation is off without SANDBOX_URL
+func sandboxBackendFromConfig() SandboxBackend {
+	if config.SandboxURL == "" {
+		return nil
+	}
+	client := &http.Client{Timeout: sandboxSubmitTimeout}
+	base := strings.TrimSuffix(config.SandboxURL, "/")
+	switch config.SandboxBackend {
+	case "cape", "cuckoo":
+		return &cuckooSandbox{url: base, token: config.SandboxAPIKey, machine: config.SandboxEnvironment, cape: config.SandboxBackend == "cape", client: client}
+	case "hybrid-analysis":
+		environment := config.SandboxEnvironment
+		if environment == "" {
+			environment = "160" // Windows 10 64-bit
+		}
+		return &hybridAnalysisSandbox{url: base, apiKey: config.SandboxAPIKey, environment: environment, client: client}
+	default:
+		log.Printf("Unknown SANDBOX_BACKEND %q; sandbox detonation is disabled", config.SandboxBackend)
+		return nil
+	}
+}
+
+// Start submits queued samples and polls for reports until ctx is cancelled
+func (sb *Sandbox) Start(ctx context.Context) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	if sb == nil {
+		return &wg
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case job := <-sb.jobs:
+				sb.handle(ctx, job)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(sb.pollEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sb.poll(ctx)
+			}
+		}
+	}()
+	return &wg
+}
+
+// enqueue drops the sample when the queue is full rather than slowing detection down
+func (sb *Sandbox) enqueue(job sandboxJob) bool {
+	select {
+	case sb.jobs <- job:
+		return true
+	default:
+		sandboxDetonations.WithLabelValues("dropped").Inc()
+		log.Printf("Sandbox queue full; %s %q of scan %s not detonated", job.source, job.name, job.scanID)
+		return false
+	}
+}
+
+// ScreenPayloads queues a scan's distinct payloads of at least SANDBOX_MIN_PAYLOAD_BYTES for
+// screening; those scoring at or above the threshold are detonated
+func (sb *Sandbox) ScreenPayloads(ctx context.Context, scanID string, packets []NetworkPacket) {
+	if sb == nil {
+		return
+	}
+	seen := make(map[[32]byte]bool)
+	for _, packet := range packets {
+		if len(packet.Payload) < sb.minPayload {
+			continue
+		}
+		sum := sha256.Sum256(packet.Payload)
+		if seen[sum] {
+			continue
+		}
+		if len(seen) == maxSandboxPayloads {
+			return
+		}
+		seen[sum] = true
+		sb.enqueue(sandboxJob{
+			tenant:   tenantFromContext(ctx),
+			scanID:   scanID,
+			source:   "payload",
+			name:     fmt.Sprintf("payload_%s_%d.bin", packet.SourceIP, packet.SourcePort),
+			content:  packet.Payload,
+			sourceIP: packet.SourceIP,
+			destIP:   packet.DestIP,
+		})
+	}
+}
+
+// DetonateFile queues an uploaded file whose scan scored at or above the threshold, merging the
+// report into scanID when it is set. It reports whether the file was queued.
+func (sb *Sandbox) DetonateFile(ctx context.Context, scanID string, result *FileScanResult, content []byte) bool {
+	if sb == nil || result.Score < sb.minScore {
+		return false
+	}
+	return sb.enqueue(sandboxJob{
+		tenant:  tenantFromContext(ctx),
+		scanID:  scanID,
+		source:  "file",
+		name:    result.Name,
+		content: content,
+		result:  result,
+	})
+}
+
+// handle screens a payload, then submits the sample or attaches the scan to the tenant's earlier
+// detonation of it
+func (sb *Sandbox) handle(ctx context.Context, job sandboxJob) {
+	ctx, cancel := context.WithTimeout(withTenant(ctx, job.tenant), sandboxSubmitTimeout)
+	defer cancel()
+
+	result := job.result
+	if result == nil {
+		screened, err := sb.detector.files.ScanFile(ctx, job.name, job.content, false)
+		if err != nil {
+			log.Printf("Failed to screen %s of scan %s for the sandbox: %v", job.name, job.scanID, err)
+			return
+		}
+		if screened.Score < sb.minScore {
+			return
+		}
+		result = screened
+	}
+
+	if id, err := sb.redis.Get(ctx, tenantKey(ctx, sandboxSampleKeyPrefix+result.SHA256)).Result(); err == nil {
+		if detonation, err := sb.load(ctx, id); err == nil {
+			sandboxDetonations.WithLabelValues("reused").Inc()
+			sb.attach(ctx, detonation, job.scanID)
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	detonation := &Detonation{
+		ID:          fmt.Sprintf("sbx_%d", now.UnixNano()),
+		Status:      DetonationSubmitted,
+		Tenant:      job.tenant,
+		Source:      job.source,
+		Name:        job.name,
+		SHA256:      result.SHA256,
+		Size:        int64(len(job.content)),
+		Screening:   result.Score,
+		SourceIP:    job.sourceIP,
+		DestIP:      job.destIP,
+		Backend:     sb.backend.Name(),
+		SubmittedAt: now,
+	}
+	taskID, err := sb.backend.Submit(ctx, job.name, job.content)
+	if err != nil {
+		log.Printf("Failed to submit %s to the %s sandbox: %v", result.SHA256, sb.backend.Name(), err)
+		detonation.Status, detonation.Error, detonation.CompletedAt = DetonationFailed, err.Error(), &now
+	}
+	detonation.TaskID = taskID
+	sandboxDetonations.WithLabelValues(string(detonation.Status)).Inc()
+
+	data, err := json.Marshal(detonation)
+	if err != nil {
+		return
+	}
+	pipe := sb.redis.TxPipeline()
+	pipe.Set(ctx, sandboxKeyPrefix+detonation.ID, data, sandboxRetention)
+	pipe.ZAdd(ctx, tenantKey(ctx, sandboxIndexKey), &redis.Z{Score: float64(now.Unix()), Member: detonation.ID})
+	pipe.ZRemRangeByScore(ctx, tenantKey(ctx, sandboxIndexKey), "-inf", strconv.FormatInt(now.Add(-sandboxRetention).Unix(), 10))
+	if detonation.Status == DetonationSubmitted {
+		// Failed submissions are retried when the sample is seen again
+		pipe.Set(ctx, tenantKey(ctx, sandboxSampleKeyPrefix+result.SHA256), detonation.ID, sandboxRetention)
+		pipe.ZAdd(ctx, sandboxPendingKey, &redis.Z{Score: float64(now.Add(sb.pollEvery).Unix()), Member: detonation.ID})
+		if job.scanID != "" {
+			pipe.SAdd(ctx, sandboxKeyPrefix+detonation.ID+":scans", job.scanID)
+			pipe.Expire(ctx, sandboxKeyPrefix+detonation.ID+":scans", sandboxRetention)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to store detonation %s: %v", detonation.ID, err)
+	}
+}
+
+// attach adds a scan to a detonation, merging the report right away when it is ready
+func (sb *Sandbox) attach(ctx context.Context, detonation *Detonation, scanID string) {
+	if scanID == "" {
+		return
+	}
+	if err := sb.redis.SAdd(ctx, sandboxKeyPrefix+detonation.ID+":scans", scanID).Err(); err != nil {
+		log.Printf("Failed to attach scan %s to detonation %s: %v", scanID, detonation.ID, err)
+		return
+	}
+	if detonation.Status == DetonationReported {
+		if err := sb.merge(ctx, detonation, scanID); err != nil {
+			log.Printf("Failed to merge detonation %s into scan %s: %v", detonation.ID, scanID, err)
+		}
+	}
+}
+
+// poll fetches the reports of detonations that are due, merging finished ones into their scans
+func (sb *Sandbox) poll(ctx context.Context) {
+	now := time.Now().UTC()
+	due, err := sb.redis.ZRangeByScore(ctx, sandboxPendingKey, &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(now.Unix(), 10)}).Result()
+	if err != nil {
+		log.Printf("Failed to load pending detonations: %v", err)
+		return
+	}
+	for _, id := range due {
+		if claimed, err := sb.redis.ZRem(ctx, sandboxPendingKey, id).Result(); err != nil || claimed == 0 {
+			continue
+		}
+		detonation, err := sb.load(ctx, id)
+		if err != nil || detonation.Status != DetonationSubmitted {
+			continue
+		}
+		tenantCtx := withTenant(ctx, detonation.Tenant)
+
+		report, err := sb.backend.Report(tenantCtx, detonation.TaskID)
+		switch {
+		case errors.Is(err, errSandboxTaskFailed):
+			detonation.Status, detonation.Error = DetonationFailed, err.Error()
+		case err == nil && report != nil:
+			detonation.Status, detonation.Report, detonation.Verdict = DetonationReported, report, VerdictUnknown
+			if report.Score >= sb.minScore {
+				detonation.Verdict = VerdictMalicious
+			}
+		case now.Sub(detonation.SubmittedAt) >= sb.timeout:
+			detonation.Status, detonation.Error = DetonationTimedOut, fmt.Sprintf("no report within %s", sb.timeout)
+		default:
+			// Still running, or the sandbox could not be reached; ask again later
+			if err != nil {
+				log.Printf("Failed to fetch report of detonation %s: %v", id, err)
+			}
+			sb.redis.ZAdd(ctx, sandboxPendingKey, &redis.Z{Score: float64(now.Add(sb.pollEvery).Unix()), Member: id})
+			continue
+		}
+
+		detonation.CompletedAt = &now
+		sandboxDetonations.WithLabelValues(string(detonation.Status)).Inc()
+		if err := sb.save(ctx, detonation); err != nil {
+			log.Printf("Failed to store detonation %s: %v", id, err)
+			continue
+		}
+		if detonation.Status != DetonationReported {
+			sb.redis.Del(tenantCtx, tenantKey(tenantCtx, sandboxSampleKeyPrefix+detonation.SHA256))
+			continue
+		}
+		scans, err := sb.redis.SMembers(ctx, sandboxKeyPrefix+id+":scans").Result()
+		if err != nil {
+			log.Printf("Failed to load scans of detonation %s: %v", id, err)
+			continue
+		}
+		for _, scanID := range scans {
+			if err := sb.merge(tenantCtx, detonation, scanID); err != nil {
+				log.Printf("Failed to merge detonation %s into scan %s: %v", id, scanID, err)
+			}
+		}
+	}
+}
+
+// evidence is the first evidence line of a detonation's indicators, which marks them as merged
+func (d *Detonation) evidence() string {
+	return fmt.Sprintf("Sandbox detonation %s (%s task %s)", d.ID, d.Backend, d.TaskID)
+}
+
+// indicators turns a malicious report into one indicator per ATT&CK technique and one per public
+// address the sample contacted. Benign reports add nothing.
+func (d *Detonation) indicators() []ThreatIndicator {
+	report := d.Report
+	if report == nil || d.Verdict != VerdictMalicious {
+		return nil
+	}
+	severity, confidence := Medium, float64(report.Score)/100
+	switch {
+	case report.Score >= 90:
+		severity = Critical
+	case report.Score >= 70:
+		severity = High
+	}
+	sample := d.Name
+	if sample == "" {
+		sample = d.SHA256[:12]
+	}
+	if report.Family != "" {
+		sample += " (" + report.Family + ")"
+	}
+	evidence := []string{d.evidence(), fmt.Sprintf("SHA-256 %s scored %d/100", d.SHA256, report.Score)}
+	for _, signature := range report.Signatures[:min(len(report.Signatures), 10)] {
+		evidence = append(evidence, "Signature: "+signature.Name)
+	}
+	observables := append([]string{d.SHA256}, report.Domains...)
+	observables = append(observables, report.Dropped...)
+
+	threat := ThreatIndicator{
+		Type:        Malware,
+		Severity:    severity,
+		Confidence:  confidence,
+		SourceIP:    d.SourceIP,
+		DestIP:      d.DestIP,
+		Evidence:    evidence,
+		Observables: observables,
+	}
+	threats := make([]ThreatIndicator, 0, len(report.Techniques)+1)
+	for _, technique := range report.Techniques {
+		behavior := "technique " + technique
+		for _, signature := range report.Signatures {
+			if containsString(signature.Techniques, technique) {
+				behavior = signature.Description
+				if behavior == "" {
+					behavior = signature.Name
+				}
+				break
+			}
+		}
+		indicator := threat
+		indicator.MITREAttack = technique
+		indicator.Description = fmt.Sprintf("Sandbox: %s %s", sample, behavior)
+		threats = append(threats, indicator)
+	}
+	if len(threats) == 0 {
+		indicator := threat
+		indicator.Description = fmt.Sprintf("Sandbox: %s detonated as malicious", sample)
+		threats = append(threats, indicator)
+	}
+
+	contacted := 0
+	for _, address := range report.Addresses {
+		if !publicAddress(address) || contacted == maxSandboxAddresses {
+			continue
+		}
+		contacted++
+		indicator := threat
+		indicator.SourceIP, indicator.DestIP = "", address
+		indicator.MITREAttack = "T1071" // Application Layer Protocol
+		indicator.Description = fmt.Sprintf("Sandbox: %s contacted %s", sample, address)
+		threats = append(threats, indicator)
+	}
+	return threats
+}
+
+// merge adds a detonation's indicators to a scan, once, and rescores it. The indicators are
+// recorded, forwarded, and alerted on like those of the scan itself.
+func (sb *Sandbox) merge(ctx context.Context, detonation *Detonation, scanID string) error {
+	threats := detonation.indicators()
+	if len(threats) == 0 {
+		return nil
+	}
+	td := sb.detector
+	response, err := td.LoadScan(ctx, scanID)
+	if err != nil {
+		return err
+	}
+	marker := detonation.evidence()
+	for _, threat := range response.ThreatIndicators {
+		if len(threat.Evidence) > 0 && threat.Evidence[0] == marker {
+			return nil
+		}
+	}
+
+	threats = td.lists.Apply(ctx, threats)
+	threats = td.tenants.Apply(ctx, threats)
+	if len(threats) == 0 {
+		return nil
+	}
+	assetIndex, err := td.assets.index(ctx)
+	if err != nil {
+		log.Printf("Risk score not weighted by asset criticality: %v", err)
+	}
+	assetIndex.annotate(threats)
+	td.geo.Enrich(threats)
+
+	response.ThreatIndicators = append(response.ThreatIndicators, threats...)
+	response.RiskScore = td.calculateRiskScore(response, assetIndex)
+	td.cacheResults(ctx, scanID, response)
+	if err := td.history.UpdateScan(ctx, response); err != nil {
+		log.Printf("Stored scan %s not updated with detonation %s: %v", scanID, detonation.ID, err)
+	}
+
+	for _, threat := range threats {
+		threatsDetected.WithLabelValues(string(threat.Severity), string(threat.Type)).Inc()
+	}
+	td.recordDetections(ctx, threats)
+	td.campaigns.Record(ctx, "sandbox", scanID, threats)
+	td.history.RecordIndicators(ctx, "sandbox", scanID, threats)
+	td.siem.ForwardIndicators("sandbox", threats)
+	td.alerts.Route(ctx, "sandbox", threats)
+	td.detections.Publish(ctx, "sandbox", threats)
+	log.Printf("Merged %d indicators of detonation %s into scan %s", len(threats), detonation.ID, scanID)
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (sb *Sandbox) load(ctx context.Context, id string) (*Detonation, error) {
+	data, err := sb.redis.Get(ctx, sandboxKeyPrefix+id).Bytes()
+	if err == redis.Nil {
+		return nil, errDetonationNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load detonation: %w", err)
+	}
+	var detonation Detonation
+	if err := json.Unmarshal(data, &detonation); err != nil {
+		return nil, err
+	}
+	return &detonation, nil
+}
+
+func (sb *Sandbox) save(ctx context.Context, detonation *Detonation) error {
+	data, err := json.Marshal(detonation)
+	if err != nil {
+		return err
+	}
+	return sb.redis.Set(ctx, sandboxKeyPrefix+detonation.ID, data, sandboxRetention).Err()
+}
+
+// Detonation returns one of the context tenant's detonations with the scans it was merged into
+func (sb *Sandbox) Detonation(ctx context.Context, id string) (*Detonation, error) {
+	if sb == nil {
+		return nil, errSandboxDisabled
+	}
+	detonation, err := sb.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if detonation.Tenant != tenantFromContext(ctx) {
+		return nil, errDetonationNotFound
+	}
+	detonation.ScanIDs, err = sb.redis.SMembers(ctx, sandboxKeyPrefix+id+":scans").Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load scans of detonation: %w", err)
+	}
+	sort.Strings(detonation.ScanIDs)
+	return detonation, nil
+}
+
+// Detonations lists the context tenant's detonations, newest first, optionally of one sample or
+// merged into one scan
+func (sb *Sandbox) Detonations(ctx context.Context, sha256, scanID string, limit int) ([]*Detonation, error) {
+	if sb == nil {
+		return nil, errSandboxDisabled
+	}
+	ids, err := sb.redis.ZRevRange(ctx, tenantKey(ctx, sandboxIndexKey), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list detonations: %w", err)
+	}
+	detonations := make([]*Detonation, 0)
+	for _, id := range ids {
+		if len(detonations) == limit {
+			break
+		}
+		detonation, err := sb.Detonation(ctx, id)
+		if errors.Is(err, errDetonationNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if sha256 != "" && detonation.SHA256 != sha256 || scanID != "" && !containsString(detonation.ScanIDs, scanID) {
+			continue
+		}
+		detonations = append(detonations, detonation)
+	}
+	return detonations, nil
+}
+
+// cuckooSandbox submits to the Cuckoo REST API or CAPE's API v2, which share a report format
+type cuckooSandbox struct {
+	url     string
+	token   string
+	machine string // analysis VM; the sandbox picks one when empty
+	cape    bool
+	client  *http.Client
+}
+
+func (cs *cuckooSandbox) Name() string {
+	if cs.cape {
+		return "cape"
+	}
+	return "cuckoo"
+}
+
+func (cs *cuckooSandbox) headers() map[string]string {
+	if cs.token == "" {
+		return nil
+	}
+	if cs.cape {
+		return map[string]string{"Authorization": "Token " + cs.token}
+	}
+	return map[string]string{"Authorization": "Bearer " + cs.token}
+}
+
+func (cs *cuckooSandbox) Submit(ctx context.Context, name string, content []byte) (string, error) {
+	endpoint := cs.url + "/tasks/create/file"
+	if cs.cape {
+		endpoint = cs.url + "/apiv2/tasks/create/file/"
+	}
+	fields := map[string]string{}
+	if cs.machine != "" {
+		fields["machine"] = cs.machine
+	}
+	var created struct {
+		TaskID     int             `json:"task_id"` // Cuckoo
+		Error      bool            `json:"error"`   // CAPE
+		ErrorValue string          `json:"error_value"`
+		Data       json.RawMessage `json:"data"`
+	}
+	if err := postSample(ctx, cs.client, endpoint, cs.headers(), name, content, fields, &created); err != nil {
+		return "", err
+	}
+	if !cs.cape {
+		return strconv.Itoa(created.TaskID), nil
+	}
+	var data struct {
+		TaskIDs []int `json:"task_ids"`
+	}
+	if created.Error || json.Unmarshal(created.Data, &data) != nil || len(data.TaskIDs) == 0 {
+		return "", fmt.Errorf("CAPE rejected the sample: %s", created.ErrorValue)
+	}
+	return strconv.Itoa(data.TaskIDs[0]), nil
+}
+
+func (cs *cuckooSandbox) Report(ctx context.Context, taskID string) (*SandboxReport, error) {
+	var status string
+	if cs.cape {
+		var view struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := callJSON(ctx, cs.client, http.MethodGet, cs.url+"/apiv2/tasks/status/"+url.PathEscape(taskID)+"/", cs.headers(), nil, &view); err != nil {
+			return nil, err
+		}
+		json.Unmarshal(view.Data, &status)
+	} else {
+		var view struct {
+			Task struct {
+				Status string `json:"status"`
+			} `json:"task"`
+		}
+		if err := callJSON(ctx, cs.client, http.MethodGet, cs.url+"/tasks/view/"+url.PathEscape(taskID), cs.headers(), nil, &view); err != nil {
+			return nil, err
+		}
+		status = view.Task.Status
+	}
+	switch {
+	case strings.HasPrefix(status, "failed"):
+		return nil, fmt.Errorf("%w: task %s is %s", errSandboxTaskFailed, taskID, status)
+	case status != "reported":
+		return nil, nil
+	}
+
+	endpoint := cs.url + "/tasks/report/" + url.PathEscape(taskID)
+	if cs.cape {
+		endpoint = cs.url + "/apiv2/tasks/get/report/" + url.PathEscape(taskID) + "/json/"
+	}
+	var raw struct {
+		Info struct {
+			Score float64 `json:"score"`
+		} `json:"info"`
+		Malscore   float64         `json:"malscore"`
+		Detections json.RawMessage `json:"detections"` // CAPE: a family name, or a list of {"family": ...}
+		Signatures []struct {
+			Name        string          `json:"name"`
+			Description string          `json:"description"`
+			Severity    int             `json:"severity"`
+			TTP         json.RawMessage `json:"ttp"` // Cuckoo: technique -> details; CAPE: a list
+		} `json:"signatures"`
+		TTPs []struct {
+			Signature string   `json:"signature"`
+			TTP       string   `json:"ttp"`
+			TTPs      []string `json:"ttps"`
+		} `json:"ttps"`
+		Network struct {
+			Hosts   json.RawMessage `json:"hosts"` // Cuckoo: addresses; CAPE: a list of {"ip": ...}
+			Domains []struct {
+				Domain string `json:"domain"`
+			} `json:"domains"`
+			HTTP []struct {
+				URI string `json:"uri"`
+			} `json:"http"`
+		} `json:"network"`
+		Dropped []struct {
+			SHA256 string `json:"sha256"`
+		} `json:"dropped"`
+	}
+	if err := getLargeJSON(ctx, cs.client, endpoint, cs.headers(), &raw); err != nil {
+		return nil, err
+	}
+
+	score := raw.Info.Score
+	if cs.cape && raw.Malscore > 0 {
+		score = raw.Malscore
+	}
+	report := newSandboxReport(int(score * 10))
+	if families := jsonStrings(raw.Detections, "family"); len(families) > 0 {
+		report.Family = families[0]
+	}
+	for _, entry := range raw.Signatures {
+		signature := SandboxSignature{Name: entry.Name, Description: entry.Description, Severity: entry.Severity}
+		signature.Techniques = report.addTechniques(jsonStrings(entry.TTP, "ttp")...)
+		for _, mapping := range raw.TTPs {
+			if mapping.Signature == entry.Name {
+				signature.Techniques = appendUnique(signature.Techniques, maxSandboxReportValues, report.addTechniques(append(mapping.TTPs, mapping.TTP)...)...)
+			}
+		}
+		report.Signatures = append(report.Signatures, signature)
+	}
+	report.Addresses = appendUnique(report.Addresses, maxSandboxReportValues, jsonStrings(raw.Network.Hosts, "ip")...)
+	for _, domain := range raw.Network.Domains {
+		report.Domains = appendUnique(report.Domains, maxSandboxReportValues, domain.Domain)
+	}
+	for _, request := range raw.Network.HTTP {
+		report.URLs = appendUnique(report.URLs, maxSandboxReportValues, request.URI)
+	}
+	for _, file := range raw.Dropped {
+		report.Dropped = appendUnique(report.Dropped, maxSandboxReportValues, file.SHA256)
+	}
+	return report, nil
+}
+
+// hybridAnalysisSandbox submits to the Hybrid Analysis (Falcon Sandbox) API v2
+type hybridAnalysisSandbox struct {
+	url         string
+	apiKey      string
+	environment string
+	client      *http.Client
+}
+
+func (ha *hybridAnalysisSandbox) Name() string { return "hybrid-analysis" }
+
+func (ha *hybridAnalysisSandbox) headers() map[string]string {
+	return map[string]string{"api-key": ha.apiKey, "User-Agent": "Falcon Sandbox"}
+}
+
+func (ha *hybridAnalysisSandbox) Submit(ctx context.Context, name string, content []byte) (string, error) {
+	var submitted struct {
+		JobID string `json:"job_id"`
+	}
+	if err := postSample(ctx, ha.client, ha.url+"/submit/file", ha.headers(), name, content, map[string]string{"environment_id": ha.environment}, &submitted); err != nil {
+		return "", err
+	}
+	if submitted.JobID == "" {
+		return "", errors.New("Hybrid Analysis returned no job ID")
+	}
+	return submitted.JobID, nil
+}
+
+func (ha *hybridAnalysisSandbox) Report(ctx context.Context, taskID string) (*SandboxReport, error) {
+	var state struct {
+		State string `json:"state"`
+		Error string `json:"error"`
+	}
+	if err := callJSON(ctx, ha.client, http.MethodGet, ha.url+"/report/"+url.PathEscape(taskID)+"/state", ha.headers(), nil, &state); err != nil {
+		return nil, err
+	}
+	switch state.State {
+	case "ERROR":
+		return nil, fmt.Errorf("%w: %s", errSandboxTaskFailed, state.Error)
+	case "SUCCESS":
+	default:
+		return nil, nil
+	}
+
+	var summary struct {
+		ThreatScore int    `json:"threat_score"`
+		Family      string `json:"vx_family"`
+		Signatures  []struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+			ThreatLevel int    `json:"threat_level"`
+			AttckID     string `json:"attck_id"`
+		} `json:"signatures"`
+		MitreAttcks []struct {
+			AttckID string `json:"attck_id"`
+		} `json:"mitre_attcks"`
+		Hosts          []string `json:"hosts"`
+		Domains        []string `json:"domains"`
+		ExtractedFiles []struct {
+			SHA256 string `json:"sha256"`
+		} `json:"extracted_files"`
+	}
+	if err := getLargeJSON(ctx, ha.client, ha.url+"/report/"+url.PathEscape(taskID)+"/summary", ha.headers(), &summary); err != nil {
+		return nil, err
+	}
+
+	report := newSandboxReport(summary.ThreatScore)
+	report.Family = summary.Family
+	for _, entry := range summary.Signatures {
+		report.Signatures = append(report.Signatures, SandboxSignature{
+			Name:        entry.Name,
+			Description: entry.Description,
+			Severity:    entry.ThreatLevel,
+			Techniques:  report.addTechniques(entry.AttckID),
+		})
+	}
+	for _, technique := range summary.MitreAttcks {
+		report.addTechniques(technique.AttckID)
+	}
+	report.Addresses = appendUnique(report.Addresses, maxSandboxReportValues, summary.Hosts...)
+	report.Domains = appendUnique(report.Domains, maxSandboxReportValues, summary.Domains...)
+	for _, file := range summary.ExtractedFiles {
+		report.Dropped = appendUnique(report.Dropped, maxSandboxReportValues, file.SHA256)
+	}
+	return report, nil
+}
+
+func newSandboxReport(score int) *SandboxReport {
+	return &SandboxReport{
+		Score:      max(0, min(score, 100)),
+		Signatures: make([]SandboxSignature, 0),
+		Techniques: make([]string, 0),
+		Addresses:  make([]string, 0),
+		Domains:    make([]string, 0),
+		URLs:       make([]string, 0),
+		Dropped:    make([]string, 0),
+	}
+}
+
+// addTechniques adds the valid ATT&CK technique IDs among values to the report and returns them
+func (r *SandboxReport) addTechniques(values ...string) []string {
+	techniques := make([]string, 0, len(values))
+	for _, value := range values {
+		if technique := strings.ToUpper(strings.TrimSpace(value)); attackTechniqueID.MatchString(technique) {
+			techniques = appendUnique(techniques, maxSandboxReportValues, technique)
+		}
+	}
+	r.Techniques = appendUnique(r.Techniques, maxSandboxReportValues, techniques...)
+	return techniques
+}
+
+// jsonStrings reads a value that sandboxes encode as a string, a list of strings, a list of
+// objects with the string in field, or an object keyed by the strings
+func jsonStrings(raw json.RawMessage, field string) []string {
+	if len(raw) == 0 {
+		return nil
+	}
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		if single == "" {
+			return nil
+		}
+		return []string{single}
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return list
+	}
+	var objects []map[string]interface{}
+	if json.Unmarshal(raw, &objects) == nil {
+		values := make([]string, 0, len(objects))
+		for _, object := range objects {
+			if value, ok := object[field].(string); ok && value != "" {
+				values = append(values, value)
+			}
+		}
+		return values
+	}
+	var keyed map[string]json.RawMessage
+	if json.Unmarshal(raw, &keyed) == nil {
+		values := make([]string, 0, len(keyed))
+		for key := range keyed {
+			values = append(values, key)
+		}
+		sort.Strings(values)
+		return values
+	}
+	return nil
+}
+
+// postSample uploads content as multipart field "file" with extra form fields and decodes the
+// JSON response
+func postSample(ctx context.Context, client *http.Client, endpoint string, headers map[string]string, name string, content []byte, fields map[string]string, out interface{}) error {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for key, value := range fields {
+		if err := writer.WriteField(key, value); err != nil {
+			return err
+		}
+	}
+	if name == "" {
+		sum := sha256.Sum256(content)
+		name = hex.EncodeToString(sum[:])
+	}
+	part, err := writer.CreateFormFile("file", name)
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(content); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &responderAPIError{status: resp.StatusCode, body: strings.TrimSpace(string(respBody))}
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// getLargeJSON decodes a report too large for callJSON's limit as it streams in
+func getLargeJSON(ctx context.Context, client *http.Client, endpoint string, headers map[string]string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &responderAPIError{status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, sandboxMaxReport)).Decode(out)
+}
+
+// HTTP Handlers
+func (s *APIServer) listDetonationsHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > maxSandboxListed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxSandboxListed)})
+		return
+	}
+	detonations, err := s.threatDetector.sandbox.Detonations(c.Request.Context(), strings.ToLower(c.Query("sha256")), c.Query("scan_id"), limit)
+	switch {
+	case errors.Is(err, errSandboxDisabled):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, gin.H{"detonations": detonations, "count": len(detonations)})
+	}
+}
+
+func (s *APIServer) getDetonationHandler(c *gin.Context) {
+	detonation, err := s.threatDetector.sandbox.Detonation(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, errSandboxDisabled):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	case errors.Is(err, errDetonationNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, detonation)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Vulnerability scan versions: each vulnerability scan of a target is kept as a numbered version,
+// so two runs can be compared
+const scanVersionsSchema = `
+CREATE TABLE IF NOT EXISTS vulnerability_scans (
+	tenant          TEXT NOT NULL,
+	target          TEXT NOT NULL,
+	version         INTEGER NOT NULL,
+	scan_id         TEXT NOT NULL,
+	scanned_at      TIMESTAMPTZ NOT NULL,
+	vulnerabilities JSONB NOT NULL,
+	PRIMARY KEY (tenant, target, version)
+);
+CREATE INDEX IF NOT EXISTS vulnerability_scans_scan ON vulnerability_scans (tenant, scan_id);
+`
+
+const maxScanVersionsListed = 100
+
+var (
+	errScanVersionNotFound = errors.New("scan not found for this target")
+	errNoScanVersions      = errors.New("no vulnerability scans recorded for this target")
+)
+
+// ScanVersion is one recorded vulnerability scan of a target
+type ScanVersion struct {
+	Version         int                  `json:"version"`
+	ScanID          string               `json:"scan_id"`
+	ScannedAt       time.Time            `json:"scanned_at"`
+	Vulnerabilities int                  `json:"vulnerabilities"` // CVEs on affected systems
+	entries         []VulnerabilityEntry // loaded for diffs only
+}
+
+// VulnerabilityEntry is one CVE on one affected system, the unit scans are compared by
+type VulnerabilityEntry struct {
+	CVE            string      `json:"cve"`
+	System         string      `json:"system"`
+	Severity       ThreatLevel `json:"severity"`
+	Score          float64     `json:"score"`
+	KnownExploited bool        `json:"known_exploited,omitempty"`
+	Remediation    string      `json:"remediation,omitempty"`
+	FindingID      string      `json:"finding_id"`
+	OpenSince      *time.Time  `json:"open_since,omitempty"` // persistent entries: the first scan of their unbroken run
+	ScansOpen      int         `json:"scans_open,omitempty"` // persistent entries: consecutive scans reporting them
+}
+
+func (e VulnerabilityEntry) key() string {
+	return e.CVE + "|" + e.System
+}
+
+// ScanDiff compares two vulnerability scans of a target
+type ScanDiff struct {
+	Target     string               `json:"target"`
+	From       *ScanVersion         `json:"from"` // nil when the target was scanned once
+	To         ScanVersion          `json:"to"`
+	Introduced []VulnerabilityEntry `json:"introduced"`
+	Fixed      []VulnerabilityEntry `json:"fixed"`
+	Persistent []VulnerabilityEntry `json:"persistent"`
+	Summary    map[string]int       `json:"summary"`
+}
+
+func vulnerabilityEntries(vulns []Vulnerability) []VulnerabilityEntry {
+	entries := make([]VulnerabilityEntry, 0, len(vulns))
+	for _, vuln := range vulns {
+		for _, system := range vuln.AffectedSystems {
+			entries = append(entries, VulnerabilityEntry{
+				CVE:            vuln.CVE,
+				System:         system,
+				Severity:       vuln.Severity,
+				Score:          vuln.Score,
+				KnownExploited: vuln.KnownExploited,
+				Remediation:    vuln.Remediation,
+				FindingID:      findingID(strings.Join([]string{"cve", vuln.CVE, system}, "|")),
+			})
+		}
+	}
+	return entries
+}
+
+// sortEntries orders entries most severe first
+func sortEntries(entries []VulnerabilityEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score > entries[j].Score
+		}
+		return entries[i].key() < entries[j].key()
+	})
+}
+
+// ScanVersions keeps the most recent vulnerability scans of each target in Postgres
+type ScanVersions struct {
+	db          *sql.DB
+	keep        int // versions kept per target
+	schemaReady atomic.Bool
+}
+
+func NewScanVersions(db *sql.DB, keep int) *ScanVersions {
+	return &ScanVersions{db: db, keep: keep}
+}
+
+func (sv *ScanVersions) ensureSchema(ctx context.Context) error {
+	if sv.schemaReady.Load() {
+		return nil
+	}
+	if _, err := sv.db.ExecContext(ctx, scanVersionsSchema); err != nil {
+		return fmt.Errorf("failed to create scan version schema: %w", err)
+	}
+	sv.schemaReady.Store(true)
+	return nil
+}
+
+// Record stores a vulnerability scan as the target's next version and drops versions beyond
+// those kept. Scans of software lists without a target are not versioned.
+func (sv *ScanVersions) Record(ctx context.Context, req *ThreatDetectionRequest, response *ThreatDetectionResponse) {
+	if req.ScanType != "vulnerability" || req.Target == "" {
+		return
+	}
+	if err := sv.ensureSchema(ctx); err != nil {
+		log.Printf("Scan %s not versioned: %v", response.ScanID, err)
+		return
+	}
+	data, err := json.Marshal(vulnerabilityEntries(response.Vulnerabilities))
+	if err != nil {
+		log.Printf("Scan %s not versioned: %v", response.ScanID, err)
+		return
+	}
+
+	tenant := tenantFromContext(ctx)
+	var version int
+	// A concurrent scan of the same target can take the version first; try once more
+	for attempt := 0; attempt < 2; attempt++ {
+		err = sv.db.QueryRowContext(ctx, `
+			INSERT INTO vulnerability_scans (tenant, target, version, scan_id, scanned_at, vulnerabilities)
+			SELECT $1, $2, COALESCE(MAX(version), 0) + 1, $3, $4, $5
+			FROM vulnerability_scans WHERE tenant = $1 AND target = $2
+			RETURNING version`,
+			tenant, req.Target, response.ScanID, response.Timestamp.UTC(), data).Scan(&version)
+		var pqErr *pq.Error
+		if !errors.As(err, &pqErr) || pqErr.Code != "23505" { // unique_violation
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("Scan %s not versioned: %v", response.ScanID, err)
+		return
+	}
+	if version > sv.keep {
+		if _, err := sv.db.ExecContext(ctx,
+			`DELETE FROM vulnerability_scans WHERE tenant = $1 AND target = $2 AND version <= $3`,
+			tenant, req.Target, version-sv.keep); err != nil {
+			log.Printf("Old versions of %s not pruned: %v", req.Target, err)
+		}
+	}
+}
+
+// Versions lists a target's recorded scans, newest first
+func (sv *ScanVersions) Versions(ctx context.Context, target string) ([]ScanVersion, error) {
+	if err := sv.ensureSchema(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := sv.db.QueryContext(ctx, `
+		SELECT version, scan_id, scanned_at, jsonb_array_length(vulnerabilities)
+		FROM vulnerability_scans WHERE tenant = $1 AND target = $2
+		ORDER BY version DESC LIMIT $3`,
+		tenantFromContext(ctx), target, maxScanVersionsListed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list scans: %w", err)
+	}
+	defer rows.Close()
+
+	versions := make([]ScanVersion, 0)
+	for rows.Next() {
+		var version ScanVersion
+		if err := rows.Scan(&version.Version, &version.ScanID, &version.ScannedAt, &version.Vulnerabilities); err != nil {
+			return nil, err
+		}
+		version.ScannedAt = version.ScannedAt.UTC()
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// history loads a target's scans up to the one identified by scanID, or the latest, newest first
+func (sv *ScanVersions) history(ctx context.Context, target, scanID string) ([]ScanVersion, error) {
+	query := `
+		SELECT version, scan_id, scanned_at, vulnerabilities FROM vulnerability_scans
+		WHERE tenant = $1 AND target = $2 ORDER BY version DESC`
+	args := []interface{}{tenantFromContext(ctx), target}
+	if scanID != "" {
+		query = `
+			SELECT version, scan_id, scanned_at, vulnerabilities FROM vulnerability_scans
+			WHERE tenant = $1 AND target = $2
+				AND version <= (SELECT version FROM vulnerability_scans WHERE tenant = $1 AND target = $2 AND scan_id = $3 ORDER BY version DESC LIMIT 1)
+			ORDER BY version DESC`
+		args = append(args, scanID)
+	}
+	rows, err := sv.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load scans: %w", err)
+	}
+	defer rows.Close()
+
+	versions := make([]ScanVersion, 0)
+	for rows.Next() {
+		var version ScanVersion
+		var data []byte
+		if err := rows.Scan(&version.Version, &version.ScanID, &version.ScannedAt, &data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &version.entries); err != nil {
+			return nil, fmt.Errorf("invalid scan %s: %w", version.ScanID, err)
+		}
+		version.ScannedAt = version.ScannedAt.UTC()
+		version.Vulnerabilities = len(version.entries)
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// Diff compares two scans of a target: by default its latest scan with the one before it, and
+// otherwise the scans named by fromID and toID. Persistent vulnerabilities carry how long they
+// have been reported without a break.
+func (sv *ScanVersions) Diff(ctx context.Context, target, fromID, toID string) (*ScanDiff, error) {
+	if err := sv.ensureSchema(ctx); err != nil {
+		return nil, err
+	}
+	versions, err := sv.history(ctx, target, toID)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		if toID != "" {
+			return nil, fmt.Errorf("%w: %s", errScanVersionNotFound, toID)
+		}
+		return nil, errNoScanVersions
+	}
+
+	to := versions[0]
+	var from *ScanVersion
+	older := versions[1:]
+	if fromID != "" {
+		for i := range older {
+			if older[i].ScanID == fromID {
+				from = &older[i]
+				break
+			}
+		}
+		if from == nil {
+			return nil, fmt.Errorf("%w: %s is not an earlier scan than %s", errScanVersionNotFound, fromID, to.ScanID)
+		}
+	} else if len(older) > 0 {
+		from = &older[0]
+	}
+
+	diff := &ScanDiff{
+		Target:     target,
+		From:       from,
+		To:         to,
+		Introduced: make([]VulnerabilityEntry, 0),
+		Fixed:      make([]VulnerabilityEntry, 0),
+		Persistent: make([]VulnerabilityEntry, 0),
+	}
+	before := make(map[string]bool)
+	if from != nil {
+		for _, entry := range from.entries {
+			before[entry.key()] = true
+		}
+	}
+	reported := make([]map[string]bool, len(older))
+	for i, version := range older {
+		reported[i] = make(map[string]bool, len(version.entries))
+		for _, entry := range version.entries {
+			reported[i][entry.key()] = true
+		}
+	}
+	after := make(map[string]bool, len(to.entries))
+	for _, entry := range to.entries {
+		after[entry.key()] = true
+		if !before[entry.key()] {
+			diff.Introduced = append(diff.Introduced, entry)
+			continue
+		}
+		// Walk back from the newer scan while each earlier one still reports the entry
+		since, count := to.ScannedAt, 1
+		for i, version := range older {
+			if !reported[i][entry.key()] {
+				break
+			}
+			since, count = version.ScannedAt, count+1
+		}
+		entry.OpenSince, entry.ScansOpen = &since, count
+		diff.Persistent = append(diff.Persistent, entry)
+	}
+	if from != nil {
+		for _, entry := range from.entries {
+			if !after[entry.key()] {
+				diff.Fixed = append(diff.Fixed, entry)
+			}
+		}
+	}
+
+	sortEntries(diff.Introduced)
+	sortEntries(diff.Fixed)
+	sortEntries(diff.Persistent)
+	diff.Summary = map[string]int{
+		"introduced": len(diff.Introduced),
+		"fixed":      len(diff.Fixed),
+		"persistent": len(diff.Persistent),
+	}
+	for _, entry := range diff.Introduced {
+		diff.Summary["introduced_"+string(entry.Severity)]++
+	}
+	for _, entry := range diff.Fixed {
+		diff.Summary["fixed_"+string(entry.Severity)]++
+	}
+	return diff, nil
+}
+
+// HTTP Handlers
+func (s *APIServer) scanDiffHandler(c *gin.Context) {
+	target := c.Query("target")
+	if target == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "target is required"})
+		return
+	}
+	diff, err := s.threatDetector.scanVersions.Diff(c.Request.Context(), target, c.Query("from"), c.Query("to"))
+	switch {
+	case errors.Is(err, errScanVersionNotFound), errors.Is(err, errNoScanVersions):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, diff)
+	}
+}
+
+func (s *APIServer) scanVersionsHandler(c *gin.Context) {
+	target := c.Query("target")
+	if target == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "target is required"})
+		return
+	}
+	versions, err := s.threatDetector.scanVersions.Versions(c.Request.Context(), target)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"target": target, "versions": versions, "count": len(versions)})
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Scan queries: completed analyses in the hot history, filtered by their own fields and by the
+// indicators they raised
+const (
+	defaultScanQueryLookback = 30 * 24 * time.Hour
+	defaultScanPageSize      = 50
+	maxScanPageSize          = 500
+)
+
+// scanSortColumns maps the sort parameter to scan_history columns
+var scanSortColumns = map[string]string{
+	"timestamp":       "s.observed_at",
+	"risk_score":      "s.risk_score",
+	"indicators":      "s.indicators",
+	"vulnerabilities": "s.vulnerabilities",
+}
+
+// ScanQuery selects scans of the context's tenant. Severity, threat types, and technique match
+// one indicator of the scan together.
+type ScanQuery struct {
+	From        time.Time
+	To          time.Time
+	ScanType    string
+	Target      string
+	MinRisk     float64
+	Severity    ThreatLevel  // indicators at or above this severity
+	ThreatTypes []ThreatType // any of these types
+	Technique   string       // MITRE ATT&CK technique, including its sub-techniques
+	Sort        string
+	Ascending   bool
+	Limit       int
+	Offset      int
+}
+
+// ScanSummary is a stored scan with the indicators it raised rolled up
+type ScanSummary struct {
+	ScanID          string       `json:"scan_id"`
+	ScanType        string       `json:"scan_type"`
+	Target          string       `json:"target,omitempty"`
+	Timestamp       time.Time    `json:"timestamp"`
+	RiskScore       float64      `json:"risk_score"`
+	Indicators      int          `json:"indicators"`
+	Vulnerabilities int          `json:"vulnerabilities"`
+	Severity        ThreatLevel  `json:"severity,omitempty"` // of its most severe indicator
+	ThreatTypes     []ThreatType `json:"threat_types"`
+	Techniques      []string     `json:"mitre_attack"`
+}
+
+type ScanPage struct {
+	Scans      []ScanSummary `json:"scans"`
+	Total      int           `json:"total"`
+	Limit      int           `json:"limit"`
+	Offset     int           `json:"offset"`
+	NextOffset *int          `json:"next_offset,omitempty"`
+}
+
+// Scans returns a page of matching scans from the hot history; archived scans are reachable
+// through Query
+func (hs *HistoryStore) Scans(ctx context.Context, q ScanQuery) (*ScanPage, error) {
+	if err := hs.ensureSchema(ctx); err != nil {
+		return nil, err
+	}
+
+	conditions := []string{"s.tenant = $1", "s.observed_at >= $2", "s.observed_at < $3"}
+	args := []interface{}{tenantFromContext(ctx), q.From, q.To}
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, strings.ReplaceAll(condition, "?", fmt.Sprintf("$%d", len(args))))
+	}
+	if q.ScanType != "" {
+		add("s.scan_type = ?", q.ScanType)
+	}
+	if q.Target != "" {
+		add("s.target = ?", q.Target)
+	}
+	if q.MinRisk > 0 {
+		add("s.risk_score >= ?", q.MinRisk)
+	}
+
+	indicator := make([]string, 0, 3)
+	if q.Severity != "" {
+		levels := make([]string, 0, len(severityRank))
+		for level, rank := range severityRank {
+			if rank >= severityRank[q.Severity] {
+				levels = append(levels, string(level))
+			}
+		}
+		args = append(args, pq.Array(levels))
+		indicator = append(indicator, fmt.Sprintf("i.severity = ANY($%d)", len(args)))
+	}
+	if len(q.ThreatTypes) > 0 {
+		types := make([]string, len(q.ThreatTypes))
+		for i, threatType := range q.ThreatTypes {
+			types[i] = string(threatType)
+		}
+		args = append(args, pq.Array(types))
+		indicator = append(indicator, fmt.Sprintf("i.type = ANY($%d)", len(args)))
+	}
+	if q.Technique != "" {
+		args = append(args, q.Technique)
+		indicator = append(indicator, fmt.Sprintf("(i.mitre_attack = $%d OR i.mitre_attack LIKE $%d || '.%%')", len(args), len(args)))
+	}
+	if len(indicator) > 0 {
+		conditions = append(conditions, fmt.Sprintf(
+			"EXISTS (SELECT 1 FROM indicator_history i WHERE i.tenant = s.tenant AND i.scan_id = s.scan_id AND %s)",
+			strings.Join(indicator, " AND ")))
+	}
+	where := strings.Join(conditions, " AND ")
+
+	page := &ScanPage{Scans: make([]ScanSummary, 0), Limit: q.Limit, Offset: q.Offset}
+	if err := hs.db.QueryRowContext(ctx, `SELECT count(*) FROM scan_history s WHERE `+where, args...).Scan(&page.Total); err != nil {
+		return nil, fmt.Errorf("failed to count scans: %w", err)
+	}
+	if q.Offset >= page.Total {
+		return page, nil
+	}
+
+	order := "DESC"
+	if q.Ascending {
+		order = "ASC"
+	}
+	rows, err := hs.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT s.scan_id, s.scan_type, s.target, s.observed_at, s.risk_score, s.indicators, s.vulnerabilities,
+			COALESCE(r.severities, '{}'), COALESCE(r.types, '{}'), COALESCE(r.techniques, '{}')
+		FROM scan_history s
+		LEFT JOIN LATERAL (
+			SELECT array_agg(DISTINCT i.severity) AS severities, array_agg(DISTINCT i.type) AS types,
+				array_agg(DISTINCT i.mitre_attack) FILTER (WHERE i.mitre_attack <> '') AS techniques
+			FROM indicator_history i WHERE i.tenant = s.tenant AND i.scan_id = s.scan_id
+		) r ON TRUE
+		WHERE %s
+		ORDER BY %s %s, s.observed_at %s, s.scan_id
+		LIMIT %d OFFSET %d`, where, scanSortColumns[q.Sort], order, order, q.Limit, q.Offset), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query scans: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var scan ScanSummary
+		var severities, types []string
+		if err := rows.Scan(&scan.ScanID, &scan.ScanType, &scan.Target, &scan.Timestamp, &scan.RiskScore, &scan.Indicators,
+			&scan.Vulnerabilities, pq.Array(&severities), pq.Array(&types), pq.Array(&scan.Techniques)); err != nil {
+			return nil, err
+		}
+		scan.Timestamp = scan.Timestamp.UTC()
+		for _, severity := range severities {
+			if scan.Severity == "" || severityRank[ThreatLevel(severity)] > severityRank[scan.Severity] {
+				scan.Severity = ThreatLevel(severity)
+			}
+		}
+		scan.ThreatTypes = make([]ThreatType, len(types))
+		for i, threatType := range types {
+			scan.ThreatTypes[i] = ThreatType(threatType)
+		}
+		page.Scans = append(page.Scans, scan)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if next := q.Offset + len(page.Scans); next < page.Total {
+		page.NextOffset = &next
+	}
+	return page, nil
+}
+
+func (s *APIServer) listScansHandler(c *gin.Context) {
+	q := ScanQuery{
+		To:       time.Now().UTC(),
+		ScanType: c.Query("scan_type"),
+		Target:   c.Query("target"),
+		Severity: ThreatLevel(c.Query("severity")),
+		Sort:     c.DefaultQuery("sort", "timestamp"),
+		Limit:    defaultScanPageSize,
+	}
+	if to := c.Query("to"); to != "" {
+		parsed, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be an RFC 3339 time"})
+			return
+		}
+		q.To = parsed.UTC()
+	}
+	q.From = q.To.Add(-defaultScanQueryLookback)
+	if from := c.Query("from"); from != "" {
+		parsed, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 time"})
+			return
+		}
+		q.From = parsed.UTC()
+	}
+	if !q.From.Before(q.To) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+	if q.Severity != "" && !validThreatLevels[q.Severity] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "severity must be critical, high, medium, or low"})
+		return
+	}
+	if types := c.Query("type"); types != "" {
+		for _, threatType := range strings.Split(types, ",") {
+			q.ThreatTypes = append(q.ThreatTypes, ThreatType(strings.TrimSpace(threatType)))
+		}
+	}
+	if technique := strings.ToUpper(c.Query("mitre")); technique != "" {
+		if _, err := strconv.Atoi(strings.ReplaceAll(strings.TrimPrefix(technique, "T"), ".", "")); err != nil || !strings.HasPrefix(technique, "T") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "mitre must be an ATT&CK technique ID such as T1110 or T1078.002"})
+			return
+		}
+		q.Technique = technique
+	}
+	if minRisk := c.Query("min_risk"); minRisk != "" {
+		parsed, err := strconv.ParseFloat(minRisk, 64)
+		if err != nil || parsed < 0 || parsed > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "min_risk must be between 0 and 100"})
+			return
+		}
+		q.MinRisk = parsed
+	}
+	if _, ok := scanSortColumns[q.Sort]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be timestamp, risk_score, indicators, or vulnerabilities"})
+		return
+	}
+	switch c.DefaultQuery("order", "desc") {
+	case "asc":
+		q.Ascending = true
+	case "desc":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": `order must be "asc" or "desc"`})
+		return
+	}
+	if limit := c.Query("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 || parsed > maxScanPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxScanPageSize)})
+			return
+		}
+		q.Limit = parsed
+	}
+	if offset := c.Query("offset"); offset != "" {
+		parsed, err := strconv.Atoi(offset)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset must not be negative"})
+			return
+		}
+		q.Offset = parsed
+	}
+
+	page, err := s.threatDetector.history.Scans(c.Request.Context(), q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+func (s *APIServer) getScanHandler(c *gin.Context) {
+	scan, err := s.threatDetector.LoadScan(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, errScanNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, scan)
+	}
+}
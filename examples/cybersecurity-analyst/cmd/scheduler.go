@@ -0,0 +1,662 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Scheduled scans (cron)
+const (
+	scanSchedulesKey        = "scan_schedules"          // hash of schedule ID -> ScanSchedule JSON
+	scanScheduleNextKey     = "scan_schedules:next"     // hash of schedule ID -> next run, Unix seconds
+	scanScheduleFindingsKey = "scan_schedules:findings" // hash of schedule ID -> finding keys of the last completed run
+	scanRunsKeyPrefix       = "scan_schedules:runs:"    // capped list of ScheduledScanRun JSON per schedule, newest first
+	scanRunLockPrefix       = "scan_schedules:lock:"
+	scanRunsMax             = 100
+	schedulerPollInterval   = 30 * time.Second
+	scheduledScanTimeout    = 10 * time.Minute
+	scanAlertTimeout        = 10 * time.Second
+)
+
+var (
+	errInvalidSchedule  = errors.New("invalid scan schedule")
+	errScheduleNotFound = errors.New("scan schedule not found")
+	errScheduleConflict = errors.New("scan schedule already exists")
+
+	scheduleIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+)
+
+var (
+	scheduledScans = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_scheduled_scans_total",
+			Help: "Scheduled scan runs by scan type and outcome (completed, failed)",
+		},
+		[]string{"scan_type", "status"},
+	)
+
+	scheduledScanNewFindings = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_scheduled_scan_new_findings_total",
+			Help: "Findings absent from a schedule's previous run, by kind (threat, vulnerability)",
+		},
+		[]string{"scan_type", "kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(scheduledScans)
+	prometheus.MustRegister(scheduledScanNewFindings)
+}
+
+// ScanSchedule runs a stored scan request on a cron schedule
+type ScanSchedule struct {
+	ID        string                 `json:"id"`
+	Name      string                 `json:"name,omitempty"`
+	Cron      string                 `json:"cron" binding:"required"`
+	Timezone  string                 `json:"timezone,omitempty"` // IANA zone the cron expression is evaluated in; UTC when empty
+	Scan      ThreatDetectionRequest `json:"scan"`               // request template; each run gets its own scan_id
+	Paused    bool                   `json:"paused"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+}
+
+type ScanScheduleStatus struct {
+	ScanSchedule
+	NextRun *time.Time        `json:"next_run,omitempty"`
+	LastRun *ScheduledScanRun `json:"last_run,omitempty"`
+}
+
+type ScheduledScanRun struct {
+	ScanID             string                   `json:"scan_id"`
+	ScheduleID         string                   `json:"schedule_id"`
+	StartedAt          time.Time                `json:"started_at"`
+	Status             string                   `json:"status"` // "completed" or "failed"
+	Error              string                   `json:"error,omitempty"`
+	Baseline           bool                     `json:"baseline,omitempty"` // first completed run; its findings are recorded without alerting
+	NewThreats         []ThreatIndicator        `json:"new_threats"`
+	NewVulnerabilities []Vulnerability          `json:"new_vulnerabilities"`
+	Result             *ThreatDetectionResponse `json:"result,omitempty"`
+}
+
+// ScanScheduler runs due schedules, keeps their run history, and alerts on findings that were
+// not present in the previous run. Schedules live in Redis, and each due run is claimed with
+// SETNX, so several replicas can share the same schedules without running a scan twice.
+type ScanScheduler struct {
+	redis      *redis.Client
+	detector   *ThreatDetector
+	client     *http.Client
+	webhookURL string
+	slots      chan struct{}
+}
+
+func NewScanScheduler(redisClient *redis.Client, detector *ThreatDetector, webhookURL string, concurrency int) *ScanScheduler {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &ScanScheduler{
+		redis:      redisClient,
+		detector:   detector,
+		client:     &http.Client{Timeout: scanAlertTimeout},
+		webhookURL: webhookURL,
+		slots:      make(chan struct{}, concurrency),
+	}
+}
+
+// Start checks for due schedules until ctx is cancelled. The returned WaitGroup completes once
+// the scans already started have finished.
+func (ss *ScanScheduler) Start(ctx context.Context) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(schedulerPollInterval)
+		defer ticker.Stop()
+
+		for {
+			ss.runDue(ctx, &wg)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return &wg
+}
+
+// runDue starts the due schedules of every tenant
+func (ss *ScanScheduler) runDue(ctx context.Context, wg *sync.WaitGroup) {
+	for _, tenant := range ss.detector.tenants.IDs() {
+		if ctx.Err() != nil {
+			return
+		}
+		ss.runTenantDue(withTenant(ctx, tenant), wg)
+	}
+}
+
+func (ss *ScanScheduler) runTenantDue(ctx context.Context, wg *sync.WaitGroup) {
+	schedules, err := ss.load(ctx)
+	if err != nil {
+		log.Printf("Scan scheduler: %v", err)
+		return
+	}
+	next, err := ss.redis.HGetAll(ctx, tenantKey(ctx, scanScheduleNextKey)).Result()
+	if err != nil {
+		log.Printf("Scan scheduler: failed to load next runs: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, schedule := range schedules {
+		due, err := strconv.ParseInt(next[schedule.ID], 10, 64)
+		if schedule.Paused || err != nil || due > now.Unix() {
+			continue
+		}
+
+		lock := tenantKey(ctx, fmt.Sprintf("%s%s:%d", scanRunLockPrefix, schedule.ID, due))
+		claimed, err := ss.redis.SetNX(ctx, lock, config.AppName, time.Hour).Result()
+		if err != nil || !claimed {
+			continue
+		}
+		// Missed runs are not replayed: the next run is computed from now
+		if err := ss.scheduleNext(ctx, schedule, now); err != nil {
+			log.Printf("Scan scheduler: %v", err)
+		}
+
+		select {
+		case ss.slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wg.Add(1)
+		go func(schedule ScanSchedule) {
+			defer wg.Done()
+			defer func() { <-ss.slots }()
+			ss.run(ctx, schedule)
+		}(schedule)
+	}
+}
+
+func (ss *ScanScheduler) run(ctx context.Context, schedule ScanSchedule) {
+	req := schedule.Scan
+	req.ScanID = fmt.Sprintf("%s_%d", schedule.ID, time.Now().Unix())
+	run := ScheduledScanRun{
+		ScanID:             req.ScanID,
+		ScheduleID:         schedule.ID,
+		StartedAt:          time.Now().UTC(),
+		NewThreats:         make([]ThreatIndicator, 0),
+		NewVulnerabilities: make([]Vulnerability, 0),
+	}
+
+	scanCtx, cancel := context.WithTimeout(ctx, scheduledScanTimeout)
+	defer cancel()
+	response, err := ss.detector.AnalyzeTraffic(scanCtx, &req)
+
+	// History is recorded even when shutdown cancelled the scan
+	recordCtx, cancelRecord := context.WithTimeout(withTenant(context.Background(), tenantFromContext(ctx)), 5*time.Second)
+	defer cancelRecord()
+
+	if err != nil {
+		run.Status = "failed"
+		run.Error = err.Error()
+		log.Printf("Scheduled scan %s (%s) failed: %v", schedule.ID, req.ScanID, err)
+	} else {
+		run.Status = "completed"
+		run.Result = response
+		if err := ss.detectNewFindings(recordCtx, &run, response); err != nil {
+			log.Printf("Scheduled scan %s: %v", schedule.ID, err)
+		}
+	}
+	scheduledScans.WithLabelValues(req.ScanType, run.Status).Inc()
+	scheduledScanNewFindings.WithLabelValues(req.ScanType, "threat").Add(float64(len(run.NewThreats)))
+	scheduledScanNewFindings.WithLabelValues(req.ScanType, "vulnerability").Add(float64(len(run.NewVulnerabilities)))
+
+	ss.record(recordCtx, run)
+	if len(run.NewThreats) > 0 || len(run.NewVulnerabilities) > 0 {
+		ss.alert(withTenant(context.Background(), tenantFromContext(ctx)), schedule, run)
+	}
+}
+
+// detectNewFindings compares the run's findings with those of the schedule's previous completed
+// run, then stores them as the baseline for the next one
+func (ss *ScanScheduler) detectNewFindings(ctx context.Context, run *ScheduledScanRun, response *ThreatDetectionResponse) error {
+	previous := make(map[string]bool)
+	data, err := ss.redis.HGet(ctx, tenantKey(ctx, scanScheduleFindingsKey), run.ScheduleID).Result()
+	switch {
+	case err == redis.Nil:
+		run.Baseline = true
+	case err != nil:
+		return fmt.Errorf("failed to load previous findings: %w", err)
+	default:
+		var keys []string
+		if err := json.Unmarshal([]byte(data), &keys); err != nil {
+			return fmt.Errorf("invalid previous findings: %w", err)
+		}
+		for _, key := range keys {
+			previous[key] = true
+		}
+	}
+
+	current := make(map[string]bool)
+	for _, threat := range response.ThreatIndicators {
+		key := threatFindingKey(threat)
+		if !current[key] && !run.Baseline && !previous[key] {
+			run.NewThreats = append(run.NewThreats, threat)
+		}
+		current[key] = true
+	}
+	for _, vuln := range response.Vulnerabilities {
+		key := "cve:" + vuln.CVE
+		if !current[key] && !run.Baseline && !previous[key] {
+			run.NewVulnerabilities = append(run.NewVulnerabilities, vuln)
+		}
+		current[key] = true
+	}
+
+	keys := make([]string, 0, len(current))
+	for key := range current {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	encoded, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	if err := ss.redis.HSet(ctx, tenantKey(ctx, scanScheduleFindingsKey), run.ScheduleID, encoded).Err(); err != nil {
+		return fmt.Errorf("failed to store findings: %w", err)
+	}
+	return nil
+}
+
+// threatFindingKey identifies an indicator across runs; confidence and evidence vary between
+// runs of the same finding, so they are left out
+func threatFindingKey(threat ThreatIndicator) string {
+	return strings.Join([]string{"threat", string(threat.Type), threat.Description, threat.SourceIP, threat.DestIP}, "|")
+}
+
+func (ss *ScanScheduler) record(ctx context.Context, run ScheduledScanRun) {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return
+	}
+
+	key := tenantKey(ctx, scanRunsKeyPrefix+run.ScheduleID)
+	pipe := ss.redis.TxPipeline()
+	pipe.LPush(ctx, key, data)
+	pipe.LTrim(ctx, key, 0, scanRunsMax-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record scheduled scan %s: %v", run.ScanID, err)
+	}
+}
+
+// alert logs new findings and posts them to SCAN_ALERT_WEBHOOK_URL. The payload's "text" field
+// makes it usable with Slack and Teams incoming webhooks as is.
+func (ss *ScanScheduler) alert(ctx context.Context, schedule ScanSchedule, run ScheduledScanRun) {
+	name := schedule.Name
+	if name == "" {
+		name = schedule.ID
+	}
+	target := schedule.Scan.Target
+	switch {
+	case len(schedule.Scan.Assets) > 0:
+		target = strings.Join(schedule.Scan.Assets, ", ")
+	case target == "" && schedule.Scan.ScanType == "vulnerability" && len(schedule.Scan.Software) == 0:
+		target = "all assets"
+	}
+	text := fmt.Sprintf("Scheduled scan %s of %s found %d new threat(s) and %d new vulnerability(ies)",
+		name, target, len(run.NewThreats), len(run.NewVulnerabilities))
+	log.Print(text)
+	if ss.webhookURL == "" {
+		return
+	}
+
+	payload := map[string]interface{}{
+		"text":                text,
+		"schedule_id":         schedule.ID,
+		"tenant":              tenantField(ctx),
+		"scan_id":             run.ScanID,
+		"target":              schedule.Scan.Target,
+		"risk_score":          run.Result.RiskScore,
+		"new_threats":         run.NewThreats,
+		"new_vulnerabilities": run.NewVulnerabilities,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ss.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Scan alert for %s failed: %v", schedule.ID, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ss.client.Do(req)
+	if err != nil {
+		log.Printf("Scan alert for %s failed: %v", schedule.ID, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Scan alert for %s failed: webhook returned status %d", schedule.ID, resp.StatusCode)
+	}
+}
+
+func (ss *ScanScheduler) load(ctx context.Context) ([]ScanSchedule, error) {
+	items, err := ss.redis.HGetAll(ctx, tenantKey(ctx, scanSchedulesKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load scan schedules: %w", err)
+	}
+
+	schedules := make([]ScanSchedule, 0, len(items))
+	for id, item := range items {
+		var schedule ScanSchedule
+		if err := json.Unmarshal([]byte(item), &schedule); err != nil {
+			log.Printf("Skipping invalid scan schedule %s: %v", id, err)
+			continue
+		}
+		schedules = append(schedules, schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].ID < schedules[j].ID })
+	return schedules, nil
+}
+
+// nextRun returns the schedule's first run after t, or the zero time if it never runs again
+func (schedule ScanSchedule) nextRun(t time.Time) (time.Time, error) {
+	cron, err := parseCron(schedule.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	loc := time.UTC
+	if schedule.Timezone != "" {
+		if loc, err = time.LoadLocation(schedule.Timezone); err != nil {
+			return time.Time{}, fmt.Errorf("unknown timezone %q", schedule.Timezone)
+		}
+	}
+	return cron.next(t.In(loc)), nil
+}
+
+func (ss *ScanScheduler) scheduleNext(ctx context.Context, schedule ScanSchedule, after time.Time) error {
+	next, err := schedule.nextRun(after)
+	if err != nil {
+		return err
+	}
+	if next.IsZero() {
+		return ss.redis.HDel(ctx, tenantKey(ctx, scanScheduleNextKey), schedule.ID).Err()
+	}
+	return ss.redis.HSet(ctx, tenantKey(ctx, scanScheduleNextKey), schedule.ID, next.Unix()).Err()
+}
+
+func (ss *ScanScheduler) Schedules(ctx context.Context) ([]ScanScheduleStatus, error) {
+	schedules, err := ss.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]ScanScheduleStatus, 0, len(schedules))
+	for _, schedule := range schedules {
+		statuses = append(statuses, ss.status(ctx, schedule))
+	}
+	return statuses, nil
+}
+
+func (ss *ScanScheduler) Schedule(ctx context.Context, id string) (*ScanScheduleStatus, error) {
+	data, err := ss.redis.HGet(ctx, tenantKey(ctx, scanSchedulesKey), id).Result()
+	if err == redis.Nil {
+		return nil, errScheduleNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load scan schedule: %w", err)
+	}
+
+	var schedule ScanSchedule
+	if err := json.Unmarshal([]byte(data), &schedule); err != nil {
+		return nil, fmt.Errorf("invalid scan schedule %s: %w", id, err)
+	}
+	status := ss.status(ctx, schedule)
+	return &status, nil
+}
+
+func (ss *ScanScheduler) status(ctx context.Context, schedule ScanSchedule) ScanScheduleStatus {
+	status := ScanScheduleStatus{ScanSchedule: schedule}
+	if next, err := ss.redis.HGet(ctx, tenantKey(ctx, scanScheduleNextKey), schedule.ID).Int64(); err == nil && !schedule.Paused {
+		t := time.Unix(next, 0).UTC()
+		status.NextRun = &t
+	}
+	if runs, err := ss.Runs(ctx, schedule.ID, 1); err == nil && len(runs) > 0 {
+		status.LastRun = &runs[0]
+	}
+	return status
+}
+
+// SaveSchedule validates and stores a schedule. Creating assigns an ID when none is given;
+// updating keeps the creation time and run history.
+func (ss *ScanScheduler) SaveSchedule(ctx context.Context, schedule ScanSchedule, create bool) (*ScanScheduleStatus, error) {
+	now := time.Now().UTC()
+	if create && schedule.ID == "" {
+		schedule.ID = fmt.Sprintf("sched_%d", now.UnixNano())
+	}
+	if err := validateSchedule(schedule); err != nil {
+		return nil, err
+	}
+	next, err := schedule.nextRun(now)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidSchedule, err)
+	}
+	if next.IsZero() {
+		return nil, fmt.Errorf("%w: cron expression %q never matches", errInvalidSchedule, schedule.Cron)
+	}
+	schedule.Scan.ScanID = ""
+	schedule.UpdatedAt = now
+
+	if create {
+		schedule.CreatedAt = now
+		data, err := json.Marshal(schedule)
+		if err != nil {
+			return nil, err
+		}
+		created, err := ss.redis.HSetNX(ctx, tenantKey(ctx, scanSchedulesKey), schedule.ID, data).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to store scan schedule: %w", err)
+		}
+		if !created {
+			return nil, fmt.Errorf("%w: %s", errScheduleConflict, schedule.ID)
+		}
+	} else {
+		existing, err := ss.Schedule(ctx, schedule.ID)
+		if err != nil {
+			return nil, err
+		}
+		schedule.CreatedAt = existing.CreatedAt
+		data, err := json.Marshal(schedule)
+		if err != nil {
+			return nil, err
+		}
+		if err := ss.redis.HSet(ctx, tenantKey(ctx, scanSchedulesKey), schedule.ID, data).Err(); err != nil {
+			return nil, fmt.Errorf("failed to store scan schedule: %w", err)
+		}
+	}
+
+	if err := ss.redis.HSet(ctx, tenantKey(ctx, scanScheduleNextKey), schedule.ID, next.Unix()).Err(); err != nil {
+		return nil, fmt.Errorf("failed to schedule next run: %w", err)
+	}
+	status := ss.status(ctx, schedule)
+	return &status, nil
+}
+
+func validateSchedule(schedule ScanSchedule) error {
+	if !scheduleIDPattern.MatchString(schedule.ID) {
+		return fmt.Errorf("%w: id must be 1-128 letters, digits, '_', '.', or '-'", errInvalidSchedule)
+	}
+
+	scan := schedule.Scan
+	switch scan.ScanType {
+	case "vulnerability":
+		// Assets are resolved when the scan runs; with none named, every registered asset is scanned
+	case "network":
+		if len(scan.Packets) == 0 && len(scan.LogEvents) == 0 && !isHostTarget(scan.Target) {
+			return fmt.Errorf("%w: network scans need a host or network target, packets, or log_events", errInvalidSchedule)
+		}
+	case "behavioral":
+		if len(scan.Packets) == 0 && len(scan.LogEvents) == 0 {
+			return fmt.Errorf("%w: behavioral scans need packets or log_events to analyze", errInvalidSchedule)
+		}
+	default:
+		return fmt.Errorf("%w: scan_type must be network, vulnerability, or behavioral", errInvalidSchedule)
+	}
+	return nil
+}
+
+// DeleteSchedule removes a schedule along with its run history
+func (ss *ScanScheduler) DeleteSchedule(ctx context.Context, id string) (bool, error) {
+	removed, err := ss.redis.HDel(ctx, tenantKey(ctx, scanSchedulesKey), id).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete scan schedule: %w", err)
+	}
+	if removed == 0 {
+		return false, nil
+	}
+
+	pipe := ss.redis.TxPipeline()
+	pipe.HDel(ctx, tenantKey(ctx, scanScheduleNextKey), id)
+	pipe.HDel(ctx, tenantKey(ctx, scanScheduleFindingsKey), id)
+	pipe.Del(ctx, tenantKey(ctx, scanRunsKeyPrefix+id))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return true, fmt.Errorf("failed to delete run history: %w", err)
+	}
+	return true, nil
+}
+
+// Runs returns the schedule's newest runs
+func (ss *ScanScheduler) Runs(ctx context.Context, id string, limit int) ([]ScheduledScanRun, error) {
+	exists, err := ss.redis.HExists(ctx, tenantKey(ctx, scanSchedulesKey), id).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load scan schedule: %w", err)
+	}
+	if !exists {
+		return nil, errScheduleNotFound
+	}
+
+	items, err := ss.redis.LRange(ctx, tenantKey(ctx, scanRunsKeyPrefix+id), 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load scan history: %w", err)
+	}
+
+	runs := make([]ScheduledScanRun, 0, len(items))
+	for _, item := range items {
+		var run ScheduledScanRun
+		if err := json.Unmarshal([]byte(item), &run); err == nil {
+			runs = append(runs, run)
+		}
+	}
+	return runs, nil
+}
+
+// HTTP Handlers
+func (s *APIServer) listSchedulesHandler(c *gin.Context) {
+	schedules, err := s.scheduler.Schedules(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"schedules": schedules, "count": len(schedules)})
+}
+
+func (s *APIServer) getScheduleHandler(c *gin.Context) {
+	schedule, err := s.scheduler.Schedule(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, errScheduleNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scan schedule not found"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, schedule)
+	}
+}
+
+func (s *APIServer) createScheduleHandler(c *gin.Context) {
+	var schedule ScanSchedule
+	if err := c.ShouldBindJSON(&schedule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.saveSchedule(c, schedule, true, http.StatusCreated)
+}
+
+func (s *APIServer) updateScheduleHandler(c *gin.Context) {
+	var schedule ScanSchedule
+	if err := c.ShouldBindJSON(&schedule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if schedule.ID != "" && schedule.ID != c.Param("id") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "schedule id does not match the URL"})
+		return
+	}
+	schedule.ID = c.Param("id")
+
+	s.saveSchedule(c, schedule, false, http.StatusOK)
+}
+
+func (s *APIServer) saveSchedule(c *gin.Context, schedule ScanSchedule, create bool, status int) {
+	saved, err := s.scheduler.SaveSchedule(c.Request.Context(), schedule, create)
+	switch {
+	case errors.Is(err, errInvalidSchedule):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errScheduleNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scan schedule not found"})
+	case errors.Is(err, errScheduleConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(status, saved)
+	}
+}
+
+func (s *APIServer) deleteScheduleHandler(c *gin.Context) {
+	found, err := s.scheduler.DeleteSchedule(c.Request.Context(), c.Param("id"))
+	switch {
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case !found:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scan schedule not found"})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func (s *APIServer) scheduleRunsHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit < 1 || limit > scanRunsMax {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", scanRunsMax)})
+		return
+	}
+
+	runs, err := s.scheduler.Runs(c.Request.Context(), c.Param("id"), limit)
+	switch {
+	case errors.Is(err, errScheduleNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scan schedule not found"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, gin.H{"runs": runs, "count": len(runs)})
+	}
+}
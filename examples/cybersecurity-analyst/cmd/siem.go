@@ -0,0 +1,658 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SIEM forwarding (Splunk HEC, Elasticsearch, QRadar LEEF over syslog)
+const (
+	siemQueueSize       = 10000
+	siemMaxAttempts     = 5
+	siemInitialBackoff  = time.Second
+	siemMaxBackoff      = 30 * time.Second
+	siemShutdownTimeout = 10 * time.Second
+	siemRequestTimeout  = 30 * time.Second
+)
+
+var (
+	siemEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_siem_events_total",
+			Help: "Events handled per SIEM destination by outcome (delivered, failed, dropped)",
+		},
+		[]string{"destination", "status"},
+	)
+
+	siemDeliveryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "cybersecurity_siem_delivery_duration_seconds",
+			Help:    "Time to deliver a batch to a SIEM destination, including retries",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"destination"},
+	)
+
+	siemRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_siem_retries_total",
+			Help: "Batch delivery retries per SIEM destination",
+		},
+		[]string{"destination"},
+	)
+
+	siemQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cybersecurity_siem_queue_depth",
+			Help: "Events waiting to be forwarded per SIEM destination",
+		},
+		[]string{"destination"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(siemEvents)
+	prometheus.MustRegister(siemDeliveryDuration)
+	prometheus.MustRegister(siemRetries)
+	prometheus.MustRegister(siemQueueDepth)
+}
+
+// SIEMEvent is a threat indicator or a high-risk scan result as forwarded to a SIEM
+type SIEMEvent struct {
+	ID        string           `json:"id"`
+	Timestamp time.Time        `json:"timestamp"`
+	Kind      string           `json:"kind"`   // "threat_indicator" or "scan_result"
+	Origin    string           `json:"origin"` // scan type, "capture", or "flow"
+	ScanID    string           `json:"scan_id,omitempty"`
+	Tenant    string           `json:"tenant,omitempty"` // set for tenants other than the default
+	Indicator *ThreatIndicator `json:"indicator,omitempty"`
+	Scan      *SIEMScanResult  `json:"scan,omitempty"`
+}
+
+type SIEMScanResult struct {
+	Target          string   `json:"target,omitempty"`
+	RiskScore       float64  `json:"risk_score"`
+	ThreatCount     int      `json:"threat_count"`
+	Vulnerabilities []string `json:"vulnerabilities"` // CVE IDs
+	Recommendations []string `json:"recommendations"`
+}
+
+// severity returns the event's threat level; scan results are rated by risk score
+func (e SIEMEvent) severity() ThreatLevel {
+	if e.Indicator != nil {
+		return e.Indicator.Severity
+	}
+	switch {
+	case e.Scan.RiskScore >= 90:
+		return Critical
+	case e.Scan.RiskScore >= 70:
+		return High
+	case e.Scan.RiskScore >= 40:
+		return Medium
+	default:
+		return Low
+	}
+}
+
+// siemDestination delivers a batch of events. Errors wrapped in errSIEMPermanent are not retried.
+type siemDestination interface {
+	Name() string
+	Send(ctx context.Context, events []SIEMEvent) error
+}
+
+var errSIEMPermanent = errors.New("permanent delivery failure")
+
+// SIEMForwarder queues events per destination and delivers them in batches, so a slow or
+// unavailable SIEM delays only its own queue
+type SIEMForwarder struct {
+	outputs      []*siemOutput
+	batchSize    int
+	flushEvery   time.Duration
+	minRiskScore float64
+	sequence     atomic.Uint64
+}
+
+type siemOutput struct {
+	destination siemDestination
+	queue       chan SIEMEvent
+
+	mu          sync.Mutex
+	delivered   int64
+	failed      int64
+	dropped     int64
+	lastError   string
+	lastSuccess time.Time
+}
+
+// SIEMDestinationStatus reports delivery counters for one destination
+type SIEMDestinationStatus struct {
+	Name        string    `json:"name"`
+	Queued      int       `json:"queued"`
+	Delivered   int64     `json:"delivered"`
+	Failed      int64     `json:"failed"`
+	Dropped     int64     `json:"dropped"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+}
+
+func NewSIEMForwarder(destinations []siemDestination, batchSize int, flushEvery time.Duration, minRiskScore float64) *SIEMForwarder {
+	f := &SIEMForwarder{
+		batchSize:    batchSize,
+		flushEvery:   flushEvery,
+		minRiskScore: minRiskScore,
+	}
+	if f.batchSize <= 0 {
+		f.batchSize = 100
+	}
+	if f.flushEvery <= 0 {
+		f.flushEvery = 5 * time.Second
+	}
+	for _, destination := range destinations {
+		f.outputs = append(f.outputs, &siemOutput{destination: destination, queue: make(chan SIEMEvent, siemQueueSize)})
+	}
+	return f
+}
+
+// siemDestinationsFromConfig builds the destinations that have been configured
+func siemDestinationsFromConfig() []siemDestination {
+	destinations := make([]siemDestination, 0)
+	if config.SplunkHECURL != "" {
+		destinations = append(destinations, &splunkHEC{
+			url:    strings.TrimRight(config.SplunkHECURL, "/") + "/services/collector/event",
+			token:  config.SplunkHECToken,
+			index:  config.SplunkIndex,
+			client: &http.Client{Timeout: siemRequestTimeout},
+		})
+	}
+	if config.ElasticsearchURL != "" {
+		destinations = append(destinations, &elasticsearchBulk{
+			url:    strings.TrimRight(config.ElasticsearchURL, "/") + "/_bulk",
+			index:  config.ElasticsearchIndex,
+			apiKey: config.ElasticsearchAPIKey,
+			client: &http.Client{Timeout: siemRequestTimeout},
+		})
+	}
+	if config.QRadarSyslogAddr != "" {
+		hostname, _ := os.Hostname()
+		destinations = append(destinations, &qradarSyslog{
+			network:  config.QRadarSyslogProtocol,
+			addr:     config.QRadarSyslogAddr,
+			hostname: hostname,
+		})
+	}
+	return destinations
+}
+
+// Start runs one delivery loop per destination until ctx is canceled; queued events are then
+// flushed for up to siemShutdownTimeout
+func (f *SIEMForwarder) Start(ctx context.Context) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for _, output := range f.outputs {
+		wg.Add(1)
+		go func(output *siemOutput) {
+			defer wg.Done()
+			f.run(ctx, output)
+		}(output)
+	}
+
+	log.Printf("Forwarding threat events to %d SIEM destination(s)", len(f.outputs))
+	return &wg
+}
+
+// ForwardScan queues a scan's indicators, and the scan itself when its risk score reaches the
+// configured threshold, labelled with the context's tenant
+func (f *SIEMForwarder) ForwardScan(ctx context.Context, req *ThreatDetectionRequest, response *ThreatDetectionResponse) {
+	if f == nil || len(f.outputs) == 0 {
+		return
+	}
+
+	for i := range response.ThreatIndicators {
+		f.enqueue(SIEMEvent{
+			Timestamp: response.Timestamp,
+			Kind:      "threat_indicator",
+			Origin:    req.ScanType,
+			ScanID:    response.ScanID,
+			Tenant:    tenantField(ctx),
+			Indicator: &response.ThreatIndicators[i],
+		})
+	}
+
+	if response.RiskScore < f.minRiskScore {
+		return
+	}
+	vulns := make([]string, 0, len(response.Vulnerabilities))
+	for _, vuln := range response.Vulnerabilities {
+		vulns = append(vulns, vuln.CVE)
+	}
+	f.enqueue(SIEMEvent{
+		Timestamp: response.Timestamp,
+		Kind:      "scan_result",
+		Origin:    req.ScanType,
+		ScanID:    response.ScanID,
+		Tenant:    tenantField(ctx),
+		Scan: &SIEMScanResult{
+			Target:          req.Target,
+			RiskScore:       response.RiskScore,
+			ThreatCount:     len(response.ThreatIndicators),
+			Vulnerabilities: vulns,
+			Recommendations: response.Recommendations,
+		},
+	})
+}
+
+// ForwardIndicators queues indicators raised outside a scan, by live capture, flow collection,
+// or analysis streams
+func (f *SIEMForwarder) ForwardIndicators(origin string, threats []ThreatIndicator) {
+	if f == nil || len(f.outputs) == 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	for i := range threats {
+		f.enqueue(SIEMEvent{Timestamp: now, Kind: "threat_indicator", Origin: origin, Tenant: threats[i].Tenant, Indicator: &threats[i]})
+	}
+}
+
+// enqueue hands the event to every destination, dropping it for destinations whose queue is full
+func (f *SIEMForwarder) enqueue(event SIEMEvent) {
+	// IDs let destinations that support it (Elasticsearch) deduplicate retried deliveries
+	event.ID = fmt.Sprintf("%s-%d-%d", config.AppName, time.Now().UnixNano(), f.sequence.Add(1))
+	for _, output := range f.outputs {
+		select {
+		case output.queue <- event:
+		default:
+			output.record(0, 0, 1, nil)
+		}
+	}
+}
+
+func (f *SIEMForwarder) run(ctx context.Context, output *siemOutput) {
+	name := output.destination.Name()
+	ticker := time.NewTicker(f.flushEvery)
+	defer ticker.Stop()
+
+	batch := make([]SIEMEvent, 0, f.batchSize)
+	flush := func(ctx context.Context) {
+		if len(batch) > 0 {
+			f.deliver(ctx, output, batch)
+			batch = make([]SIEMEvent, 0, f.batchSize)
+		}
+		siemQueueDepth.WithLabelValues(name).Set(float64(len(output.queue)))
+	}
+
+	for {
+		select {
+		case event := <-output.queue:
+			batch = append(batch, event)
+			if len(batch) >= f.batchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		case <-ctx.Done():
+			// Deliver what is already queued, with a deadline of its own
+			drainCtx, cancel := context.WithTimeout(context.Background(), siemShutdownTimeout)
+			defer cancel()
+			for len(output.queue) > 0 {
+				batch = append(batch, <-output.queue)
+				if len(batch) >= f.batchSize {
+					flush(drainCtx)
+				}
+			}
+			flush(drainCtx)
+			return
+		}
+	}
+}
+
+// deliver sends a batch, retrying transient failures with exponential backoff
+func (f *SIEMForwarder) deliver(ctx context.Context, output *siemOutput, batch []SIEMEvent) {
+	name := output.destination.Name()
+	start := time.Now()
+	defer func() {
+		siemDeliveryDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	}()
+
+	backoff := siemInitialBackoff
+	var err error
+	for attempt := 1; attempt <= siemMaxAttempts; attempt++ {
+		if err = output.destination.Send(ctx, batch); err == nil {
+			output.record(len(batch), 0, 0, nil)
+			return
+		}
+		if errors.Is(err, errSIEMPermanent) || attempt == siemMaxAttempts {
+			break
+		}
+
+		siemRetries.WithLabelValues(name).Inc()
+		select {
+		case <-ctx.Done():
+			err = fmt.Errorf("%w (delivery abandoned: %v)", err, ctx.Err())
+			attempt = siemMaxAttempts
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > siemMaxBackoff {
+			backoff = siemMaxBackoff
+		}
+	}
+
+	log.Printf("Failed to forward %d events to %s: %v", len(batch), name, err)
+	output.record(0, len(batch), 0, err)
+}
+
+func (o *siemOutput) record(delivered, failed, dropped int, err error) {
+	name := o.destination.Name()
+	if delivered > 0 {
+		siemEvents.WithLabelValues(name, "delivered").Add(float64(delivered))
+	}
+	if failed > 0 {
+		siemEvents.WithLabelValues(name, "failed").Add(float64(failed))
+	}
+	if dropped > 0 {
+		siemEvents.WithLabelValues(name, "dropped").Add(float64(dropped))
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.delivered += int64(delivered)
+	o.failed += int64(failed)
+	o.dropped += int64(dropped)
+	if err != nil {
+		o.lastError = err.Error()
+	} else if delivered > 0 {
+		o.lastSuccess = time.Now().UTC()
+	}
+}
+
+// Status reports the delivery counters of every destination
+func (f *SIEMForwarder) Status() []SIEMDestinationStatus {
+	statuses := make([]SIEMDestinationStatus, 0)
+	if f == nil {
+		return statuses
+	}
+	for _, output := range f.outputs {
+		output.mu.Lock()
+		statuses = append(statuses, SIEMDestinationStatus{
+			Name:        output.destination.Name(),
+			Queued:      len(output.queue),
+			Delivered:   output.delivered,
+			Failed:      output.failed,
+			Dropped:     output.dropped,
+			LastError:   output.lastError,
+			LastSuccess: output.lastSuccess,
+		})
+		output.mu.Unlock()
+	}
+	return statuses
+}
+
+// postSIEM sends an HTTP request, classifying the response: 2xx succeeds, 408/429/5xx and network
+// errors are retried, and anything else is permanent
+func postSIEM(ctx context.Context, client *http.Client, url, contentType string, body []byte, auth string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errSIEMPermanent, err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return respBody, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	default:
+		return nil, fmt.Errorf("%w: status %d: %s", errSIEMPermanent, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+}
+
+// splunkHEC sends events to a Splunk HTTP Event Collector
+type splunkHEC struct {
+	url    string
+	token  string
+	index  string
+	client *http.Client
+}
+
+func (s *splunkHEC) Name() string { return "splunk" }
+
+func (s *splunkHEC) Send(ctx context.Context, events []SIEMEvent) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, event := range events {
+		envelope := map[string]interface{}{
+			"time":       float64(event.Timestamp.UnixNano()) / 1e9,
+			"source":     config.AppName,
+			"sourcetype": "cybersecurity:" + event.Kind,
+			"event":      event,
+		}
+		if s.index != "" {
+			envelope["index"] = s.index
+		}
+		if err := encoder.Encode(envelope); err != nil {
+			return fmt.Errorf("%w: %v", errSIEMPermanent, err)
+		}
+	}
+
+	_, err := postSIEM(ctx, s.client, s.url, "application/json", body.Bytes(), "Splunk "+s.token)
+	return err
+}
+
+// elasticsearchBulk indexes events with the bulk API, using event IDs as document IDs so a retried
+// batch does not create duplicates
+type elasticsearchBulk struct {
+	url    string
+	index  string
+	apiKey string
+	client *http.Client
+}
+
+type elasticsearchBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+func (e *elasticsearchBulk) Name() string { return "elasticsearch" }
+
+func (e *elasticsearchBulk) Send(ctx context.Context, events []SIEMEvent) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, event := range events {
+		action := map[string]interface{}{"index": map[string]string{"_index": e.index, "_id": event.ID}}
+		document := struct {
+			SIEMEvent
+			Timestamp time.Time `json:"@timestamp"`
+		}{event, event.Timestamp}
+		if err := encoder.Encode(action); err != nil {
+			return fmt.Errorf("%w: %v", errSIEMPermanent, err)
+		}
+		if err := encoder.Encode(document); err != nil {
+			return fmt.Errorf("%w: %v", errSIEMPermanent, err)
+		}
+	}
+
+	auth := ""
+	if e.apiKey != "" {
+		auth = "ApiKey " + e.apiKey
+	}
+	respBody, err := postSIEM(ctx, e.client, e.url, "application/x-ndjson", body.Bytes(), auth)
+	if err != nil {
+		return err
+	}
+
+	var result elasticsearchBulkResponse
+	if err := json.Unmarshal(respBody, &result); err != nil || !result.Errors {
+		return nil
+	}
+	retryable, rejected := 0, ""
+	for _, item := range result.Items {
+		for _, outcome := range item {
+			switch {
+			case outcome.Status == http.StatusTooManyRequests || outcome.Status >= 500:
+				retryable++
+			case outcome.Error != nil && rejected == "":
+				rejected = outcome.Error.Type + ": " + outcome.Error.Reason
+			}
+		}
+	}
+	if retryable > 0 {
+		return fmt.Errorf("%d documents were rejected temporarily", retryable)
+	}
+	if rejected != "" {
+		return fmt.Errorf("%w: %s", errSIEMPermanent, rejected)
+	}
+	return nil
+}
+
+// qradarSyslog sends LEEF 1.0 events over syslog (TCP with newline framing, or UDP)
+type qradarSyslog struct {
+	network  string
+	addr     string
+	hostname string
+	conn     net.Conn
+}
+
+func (q *qradarSyslog) Name() string { return "qradar" }
+
+func (q *qradarSyslog) Send(ctx context.Context, events []SIEMEvent) error {
+	if q.conn == nil {
+		dialer := net.Dialer{Timeout: siemRequestTimeout}
+		conn, err := dialer.DialContext(ctx, q.network, q.addr)
+		if err != nil {
+			return err
+		}
+		q.conn = conn
+	}
+
+	var messages bytes.Buffer
+	for _, event := range events {
+		messages.WriteString(q.message(event))
+		messages.WriteByte('\n')
+		if q.network == "udp" {
+			// One datagram per message
+			if err := q.write(messages.Bytes()); err != nil {
+				return err
+			}
+			messages.Reset()
+		}
+	}
+	if messages.Len() == 0 {
+		return nil
+	}
+	return q.write(messages.Bytes())
+}
+
+// write sends data, dropping the connection on failure so the retry reconnects
+func (q *qradarSyslog) write(data []byte) error {
+	q.conn.SetWriteDeadline(time.Now().Add(siemRequestTimeout))
+	if _, err := q.conn.Write(data); err != nil {
+		q.conn.Close()
+		q.conn = nil
+		return err
+	}
+	return nil
+}
+
+// message formats an RFC 3164 syslog line with a LEEF 1.0 payload
+func (q *qradarSyslog) message(event SIEMEvent) string {
+	severity := event.severity()
+	syslogSeverity, leefSeverity := 5, 3
+	switch severity {
+	case Critical:
+		syslogSeverity, leefSeverity = 2, 10
+	case High:
+		syslogSeverity, leefSeverity = 3, 8
+	case Medium:
+		syslogSeverity, leefSeverity = 4, 5
+	}
+
+	eventID := event.Kind
+	attributes := map[string]string{
+		"devTime":       event.Timestamp.UTC().Format("Jan 02 2006 15:04:05"),
+		"devTimeFormat": "MMM dd yyyy HH:mm:ss",
+		"sev":           fmt.Sprint(leefSeverity),
+		"cat":           event.Kind,
+		"origin":        event.Origin,
+		"scanId":        event.ScanID,
+		"tenant":        event.Tenant,
+		"eventId":       event.ID,
+	}
+	if event.Indicator != nil {
+		eventID = string(event.Indicator.Type)
+		attributes["cat"] = string(event.Indicator.Type)
+		attributes["src"] = event.Indicator.SourceIP
+		attributes["dst"] = event.Indicator.DestIP
+		attributes["severity"] = string(event.Indicator.Severity)
+		attributes["confidence"] = fmt.Sprintf("%.2f", event.Indicator.Confidence)
+		attributes["mitreAttack"] = event.Indicator.MITREAttack
+		attributes["description"] = event.Indicator.Description
+		attributes["evidence"] = strings.Join(event.Indicator.Evidence, "; ")
+	}
+	if event.Scan != nil {
+		attributes["dst"] = event.Scan.Target
+		attributes["riskScore"] = fmt.Sprintf("%.1f", event.Scan.RiskScore)
+		attributes["threatCount"] = fmt.Sprint(event.Scan.ThreatCount)
+		attributes["vulnerabilities"] = strings.Join(event.Scan.Vulnerabilities, ",")
+	}
+
+	keys := make([]string, 0, len(attributes))
+	for key, value := range attributes {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+leefValue(attributes[key]))
+	}
+
+	header := strings.Join([]string{"LEEF:1.0", leefHeader("AI Agents"), leefHeader(config.AppName), leefHeader(config.Version), leefHeader(eventID)}, "|")
+	priority := 16*8 + syslogSeverity // facility local0
+	return fmt.Sprintf("<%d>%s %s %s|%s", priority, event.Timestamp.UTC().Format(time.Stamp), q.hostname, header, strings.Join(pairs, "\t"))
+}
+
+func leefHeader(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "|", `\|`).Replace(value)
+}
+
+// leefValue strips the characters that delimit attributes and messages
+func leefValue(value string) string {
+	return strings.NewReplacer("\t", " ", "\n", " ", "\r", " ").Replace(value)
+}
+
+// HTTP Handlers
+func (s *APIServer) siemStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"destinations": s.threatDetector.siem.Status()})
+}
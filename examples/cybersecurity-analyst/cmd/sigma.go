@@ -0,0 +1,1024 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// Sigma rules for log-based detection
+const (
+	sigmaRulesKey     = "sigma_rules" // hash of rule ID -> rule YAML added through the API
+	maxSigmaRuleBytes = 1 << 20
+)
+
+var errInvalidSigmaRule = errors.New("invalid Sigma rule")
+
+var (
+	logEventsProcessed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_log_events_processed_total",
+			Help: "Total log events evaluated against Sigma rules",
+		},
+	)
+
+	sigmaRuleMatches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_sigma_rule_matches_total",
+			Help: "Total log events matched by Sigma rule",
+		},
+		[]string{"rule_id"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(logEventsProcessed)
+	prometheus.MustRegister(sigmaRuleMatches)
+}
+
+// Field names that commonly carry the client address in auth, process, and web-server logs
+var sourceIPFields = []string{"source_ip", "src_ip", "SourceIp", "IpAddress", "client_ip", "c-ip", "remote_addr", "ip"}
+
+type LogSource struct {
+	Category string `yaml:"category" json:"category,omitempty"`
+	Product  string `yaml:"product" json:"product,omitempty"`
+	Service  string `yaml:"service" json:"service,omitempty"`
+}
+
+// covers reports whether a rule written for ls applies to an event from source. Attributes the
+// event leaves empty are unknown and do not exclude the rule.
+func (ls LogSource) covers(source LogSource) bool {
+	matches := func(rule, event string) bool {
+		return rule == "" || event == "" || strings.EqualFold(rule, event)
+	}
+	return matches(ls.Category, source.Category) && matches(ls.Product, source.Product) && matches(ls.Service, source.Service)
+}
+
+type LogEvent struct {
+	Timestamp time.Time              `json:"timestamp"`
+	LogSource LogSource              `json:"logsource"`
+	Fields    map[string]interface{} `json:"fields" binding:"required"`
+}
+
+type SigmaRule struct {
+	ID             string                 `yaml:"id" json:"id"`
+	Title          string                 `yaml:"title" json:"title"`
+	Description    string                 `yaml:"description" json:"description,omitempty"`
+	Status         string                 `yaml:"status" json:"status,omitempty"`
+	Level          string                 `yaml:"level" json:"level"`
+	Tags           []string               `yaml:"tags" json:"tags,omitempty"`
+	LogSource      LogSource              `yaml:"logsource" json:"logsource"`
+	Detection      map[string]interface{} `yaml:"detection" json:"detection"`
+	FalsePositives []string               `yaml:"falsepositives" json:"falsepositives,omitempty"`
+	Action         string                 `yaml:"action" json:"-"` // rule collections are not supported
+}
+
+type SigmaRuleInfo struct {
+	SigmaRule
+	Origin    string          `json:"origin"` // "api" or the file the rule was loaded from
+	Signature ThreatSignature `json:"signature"`
+}
+
+// compiledSigmaRule is a Sigma rule converted to the matching engine: every value becomes an
+// anchored, case-insensitive regular expression (or a CIDR/numeric test), and the condition a
+// boolean function over the selections
+type compiledSigmaRule struct {
+	rule       SigmaRule
+	origin     string
+	source     string
+	selections map[string]sigmaSelection
+	condition  sigmaExpr
+	signature  ThreatSignature
+}
+
+// sigmaSelection matches when any of its conjunctions matches: a list of maps is an OR of maps
+type sigmaSelection [][]sigmaFieldMatcher
+
+// sigmaFieldMatcher tests one field; an empty field searches every field value (keywords)
+type sigmaFieldMatcher struct {
+	field string
+	tests []func(string) bool
+	all   bool // every value must match (the |all modifier), not just one
+	null  bool // the field must be absent or empty
+}
+
+type sigmaExpr func(selected func(name string) bool) bool
+
+// SigmaEngine evaluates log events against Sigma rules loaded from SIGMA_RULES_DIR and added
+// through the API. Each rule is also registered as a ThreatSignature of the detector.
+type SigmaEngine struct {
+	redis    *redis.Client
+	detector *ThreatDetector
+
+	mu    sync.RWMutex
+	rules map[string]*compiledSigmaRule
+}
+
+func NewSigmaEngine(redisClient *redis.Client, detector *ThreatDetector) *SigmaEngine {
+	return &SigmaEngine{
+		redis:    redisClient,
+		detector: detector,
+		rules:    make(map[string]*compiledSigmaRule),
+	}
+}
+
+// LoadDir compiles every .yml/.yaml file below dir; a rule that fails to compile is logged and skipped
+func (se *SigmaEngine) LoadDir(dir string) error {
+	loaded := 0
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || (filepath.Ext(file) != ".yml" && filepath.Ext(file) != ".yaml") {
+			return nil
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		rules, err := compileSigmaRules(string(data), file)
+		if err != nil {
+			log.Printf("Skipping Sigma rule %s: %v", file, err)
+			return nil
+		}
+		se.install(rules)
+		loaded += len(rules)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load Sigma rules from %s: %w", dir, err)
+	}
+
+	log.Printf("Loaded %d Sigma rules from %s", loaded, dir)
+	return nil
+}
+
+// Load restores the rules added through the API
+func (se *SigmaEngine) Load(ctx context.Context) error {
+	stored, err := se.redis.HGetAll(ctx, sigmaRulesKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to load Sigma rules: %w", err)
+	}
+
+	for id, source := range stored {
+		rules, err := compileSigmaRules(source, "api")
+		if err != nil {
+			log.Printf("Skipping stored Sigma rule %s: %v", id, err)
+			continue
+		}
+		se.install(rules)
+	}
+	return nil
+}
+
+// Add compiles one or more YAML documents and stores them; nothing is stored unless every rule compiles
+func (se *SigmaEngine) Add(ctx context.Context, source string) ([]SigmaRule, error) {
+	rules, err := compileSigmaRules(source, "api")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidSigmaRule, err)
+	}
+
+	pipe := se.redis.TxPipeline()
+	for _, rule := range rules {
+		pipe.HSet(ctx, sigmaRulesKey, rule.rule.ID, rule.source)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to store Sigma rules: %w", err)
+	}
+	se.install(rules)
+
+	added := make([]SigmaRule, 0, len(rules))
+	for _, rule := range rules {
+		added = append(added, rule.rule)
+	}
+	return added, nil
+}
+
+// Remove deletes a rule; rules loaded from SIGMA_RULES_DIR return to service on restart
+func (se *SigmaEngine) Remove(ctx context.Context, id string) (bool, error) {
+	if err := se.redis.HDel(ctx, sigmaRulesKey, id).Err(); err != nil {
+		return false, fmt.Errorf("failed to delete Sigma rule: %w", err)
+	}
+
+	se.mu.Lock()
+	_, ok := se.rules[id]
+	delete(se.rules, id)
+	se.mu.Unlock()
+
+	se.detector.mu.Lock()
+	delete(se.detector.signatures, "sigma:"+id)
+	se.detector.mu.Unlock()
+	return ok, nil
+}
+
+func (se *SigmaEngine) install(rules []*compiledSigmaRule) {
+	se.mu.Lock()
+	for _, rule := range rules {
+		se.rules[rule.rule.ID] = rule
+	}
+	se.mu.Unlock()
+
+	se.detector.mu.Lock()
+	for _, rule := range rules {
+		se.detector.signatures["sigma:"+rule.rule.ID] = rule.signature
+	}
+	se.detector.mu.Unlock()
+}
+
+func (se *SigmaEngine) Rules() []SigmaRuleInfo {
+	se.mu.RLock()
+	defer se.mu.RUnlock()
+
+	rules := make([]SigmaRuleInfo, 0, len(se.rules))
+	for _, rule := range se.rules {
+		rules = append(rules, SigmaRuleInfo{SigmaRule: rule.rule, Origin: rule.origin, Signature: rule.signature})
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+	return rules
+}
+
+// sigmaHit is the events one rule matched from one source address
+type sigmaHit struct {
+	rule   *compiledSigmaRule
+	source string
+	events []LogEvent
+}
+
+// Evaluate matches events against every rule, reporting one indicator per rule and source address
+func (se *SigmaEngine) Evaluate(events []LogEvent) []ThreatIndicator {
+	hits := se.match(events)
+	threats := make([]ThreatIndicator, 0, len(hits))
+	for _, h := range hits {
+		threats = append(threats, h.indicator())
+	}
+	return threats
+}
+
+// match groups the events each rule matches by source address, in the order first matched
+func (se *SigmaEngine) match(events []LogEvent) []*sigmaHit {
+	se.mu.RLock()
+	rules := make([]*compiledSigmaRule, 0, len(se.rules))
+	for _, rule := range se.rules {
+		rules = append(rules, rule)
+	}
+	se.mu.RUnlock()
+	sort.Slice(rules, func(i, j int) bool { return rules[i].rule.ID < rules[j].rule.ID })
+
+	hits := make(map[string]*sigmaHit)
+	order := make([]*sigmaHit, 0)
+
+	for _, event := range events {
+		for _, rule := range rules {
+			if !rule.matches(event) {
+				continue
+			}
+			sigmaRuleMatches.WithLabelValues(rule.rule.ID).Inc()
+
+			source := eventSourceIP(event)
+			key := rule.rule.ID + "|" + source
+			if hits[key] == nil {
+				hits[key] = &sigmaHit{rule: rule, source: source}
+				order = append(order, hits[key])
+			}
+			hits[key].events = append(hits[key].events, event)
+		}
+	}
+	return order
+}
+
+func (h *sigmaHit) indicator() ThreatIndicator {
+	sig := h.rule.signature
+	first := h.events[0]
+	evidence := []string{
+		fmt.Sprintf("Sigma rule %q (%s)", h.rule.rule.Title, h.rule.rule.ID),
+		fmt.Sprintf("Matched %d log event(s), first at %s", len(h.events), first.Timestamp.UTC().Format(time.RFC3339)),
+	}
+	if len(h.rule.rule.FalsePositives) > 0 {
+		evidence = append(evidence, "Known false positives: "+strings.Join(h.rule.rule.FalsePositives, "; "))
+	}
+
+	return ThreatIndicator{
+		Type:        sig.Type,
+		Severity:    sig.Severity,
+		Confidence:  sigmaConfidence(h.rule.rule.Status),
+		Description: h.rule.rule.Title,
+		SourceIP:    h.source,
+		MITREAttack: sig.MITREAttack,
+		Evidence:    evidence,
+		Observables: eventObservables(h.events),
+	}
+}
+
+func (r *compiledSigmaRule) matches(event LogEvent) bool {
+	if !r.rule.LogSource.covers(event.LogSource) {
+		return false
+	}
+
+	results := make(map[string]bool, len(r.selections))
+	return r.condition(func(name string) bool {
+		if matched, ok := results[name]; ok {
+			return matched
+		}
+		matched := r.selections[name].matches(event)
+		results[name] = matched
+		return matched
+	})
+}
+
+func (s sigmaSelection) matches(event LogEvent) bool {
+	for _, conjunction := range s {
+		matched := true
+		for _, matcher := range conjunction {
+			if !matcher.matches(event) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (m sigmaFieldMatcher) matches(event LogEvent) bool {
+	var values []string
+	if m.field == "" {
+		for _, value := range event.Fields {
+			values = append(values, flattenFieldValue(value)...)
+		}
+	} else if value, ok := lookupField(event.Fields, m.field); ok {
+		values = flattenFieldValue(value)
+	}
+
+	if m.null {
+		for _, value := range values {
+			if value != "" {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, test := range m.tests {
+		matched := false
+		for _, value := range values {
+			if test(value) {
+				matched = true
+				break
+			}
+		}
+		if matched && !m.all {
+			return true
+		}
+		if !matched && m.all {
+			return false
+		}
+	}
+	return m.all && len(m.tests) > 0
+}
+
+// lookupField finds a field by exact name, then case-insensitively, then as a dotted path into
+// nested objects
+func lookupField(fields map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := fields[name]; ok {
+		return value, true
+	}
+	for key, value := range fields {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	if head, rest, ok := strings.Cut(name, "."); ok {
+		if nested, ok := fields[head].(map[string]interface{}); ok {
+			return lookupField(nested, rest)
+		}
+	}
+	return nil, false
+}
+
+func flattenFieldValue(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return []string{""}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, flattenFieldValue(item)...)
+		}
+		return values
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+func eventSourceIP(event LogEvent) string {
+	for _, field := range sourceIPFields {
+		if value, ok := lookupField(event.Fields, field); ok {
+			if ip := net.ParseIP(fmt.Sprint(value)); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	return ""
+}
+
+// compileSigmaRules parses the YAML documents in source and converts each rule
+func compileSigmaRules(source, origin string) ([]*compiledSigmaRule, error) {
+	rules := make([]*compiledSigmaRule, 0)
+	for _, document := range splitYAMLDocuments(source) {
+		var rule SigmaRule
+		if err := yaml.Unmarshal([]byte(document), &rule); err != nil {
+			return nil, fmt.Errorf("invalid Sigma YAML: %w", err)
+		}
+		compiled, err := compileSigmaRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.ID, err)
+		}
+		compiled.origin = origin
+		compiled.source = document
+		rules = append(rules, compiled)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no Sigma rules found")
+	}
+	return rules, nil
+}
+
+func splitYAMLDocuments(source string) []string {
+	documents := make([]string, 0, 1)
+	var current strings.Builder
+	flush := func() {
+		if strings.TrimSpace(current.String()) != "" {
+			documents = append(documents, current.String())
+		}
+		current.Reset()
+	}
+	for _, line := range strings.SplitAfter(source, "\n") {
+		if strings.TrimSpace(line) == "---" {
+			flush()
+			continue
+		}
+		current.WriteString(line)
+	}
+	flush()
+	return documents
+}
+
+func compileSigmaRule(rule SigmaRule) (*compiledSigmaRule, error) {
+	if rule.ID == "" {
+		return nil, fmt.Errorf("id is required")
+	}
+	if rule.Action != "" {
+		return nil, fmt.Errorf("rule collections (action: %s) are not supported", rule.Action)
+	}
+	if len(rule.Detection) == 0 {
+		return nil, fmt.Errorf("detection is required")
+	}
+
+	compiled := &compiledSigmaRule{rule: rule, selections: make(map[string]sigmaSelection)}
+	conditions := make([]string, 0)
+	for name, definition := range rule.Detection {
+		switch name {
+		case "condition":
+			switch c := definition.(type) {
+			case string:
+				conditions = append(conditions, c)
+			case []interface{}:
+				for _, item := range c {
+					conditions = append(conditions, fmt.Sprint(item))
+				}
+			}
+		case "timeframe":
+			// Only used by aggregations, which are not supported
+		default:
+			selection, err := compileSelection(definition)
+			if err != nil {
+				return nil, fmt.Errorf("selection %s: %w", name, err)
+			}
+			compiled.selections[name] = selection
+		}
+	}
+	if len(conditions) == 0 {
+		return nil, fmt.Errorf("detection.condition is required")
+	}
+
+	// Several conditions are alternatives
+	exprs := make([]sigmaExpr, 0, len(conditions))
+	for _, condition := range conditions {
+		expr, err := parseSigmaCondition(condition, compiled.selections)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %w", condition, err)
+		}
+		exprs = append(exprs, expr)
+	}
+	compiled.condition = anyOf(exprs)
+	compiled.signature = sigmaSignature(rule)
+	compiled.signature.Pattern = strings.Join(conditions, " | ")
+	return compiled, nil
+}
+
+func compileSelection(definition interface{}) (sigmaSelection, error) {
+	switch d := definition.(type) {
+	case map[string]interface{}:
+		conjunction, err := compileFieldMap(d)
+		if err != nil {
+			return nil, err
+		}
+		return sigmaSelection{conjunction}, nil
+	case []interface{}:
+		selection := make(sigmaSelection, 0, len(d))
+		for _, item := range d {
+			if fields, ok := item.(map[string]interface{}); ok {
+				conjunction, err := compileFieldMap(fields)
+				if err != nil {
+					return nil, err
+				}
+				selection = append(selection, conjunction)
+				continue
+			}
+			// A list of plain values is a keyword search
+			matcher, err := compileFieldMatcher("", nil, item)
+			if err != nil {
+				return nil, err
+			}
+			selection = append(selection, []sigmaFieldMatcher{matcher})
+		}
+		return selection, nil
+	case nil:
+		return nil, fmt.Errorf("selection is empty")
+	default:
+		matcher, err := compileFieldMatcher("", nil, d)
+		if err != nil {
+			return nil, err
+		}
+		return sigmaSelection{{matcher}}, nil
+	}
+}
+
+func compileFieldMap(fields map[string]interface{}) ([]sigmaFieldMatcher, error) {
+	conjunction := make([]sigmaFieldMatcher, 0, len(fields))
+	for key, value := range fields {
+		parts := strings.Split(key, "|")
+		matcher, err := compileFieldMatcher(parts[0], parts[1:], value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", key, err)
+		}
+		conjunction = append(conjunction, matcher)
+	}
+	return conjunction, nil
+}
+
+func compileFieldMatcher(field string, modifiers []string, value interface{}) (sigmaFieldMatcher, error) {
+	matcher := sigmaFieldMatcher{field: field}
+
+	values, isList := value.([]interface{})
+	if !isList {
+		values = []interface{}{value}
+	}
+	if len(values) == 1 && values[0] == nil {
+		matcher.null = true
+		return matcher, nil
+	}
+
+	transform := ""
+	encode := false
+	for _, modifier := range modifiers {
+		switch modifier {
+		case "contains", "startswith", "endswith", "re", "cidr", "lt", "lte", "gt", "gte":
+			if transform != "" {
+				return matcher, fmt.Errorf("modifiers %s and %s cannot be combined", transform, modifier)
+			}
+			transform = modifier
+		case "all":
+			matcher.all = true
+		case "base64":
+			encode = true
+		default:
+			return matcher, fmt.Errorf("unsupported modifier %q", modifier)
+		}
+	}
+	if field == "" && transform == "" {
+		transform = "contains" // keywords match anywhere in a value
+	}
+
+	for _, v := range values {
+		s := fmt.Sprint(v)
+		if encode {
+			s = base64.StdEncoding.EncodeToString([]byte(s))
+		}
+		test, err := compileSigmaValue(transform, s)
+		if err != nil {
+			return matcher, err
+		}
+		matcher.tests = append(matcher.tests, test)
+	}
+	return matcher, nil
+}
+
+func compileSigmaValue(transform, value string) (func(string) bool, error) {
+	switch transform {
+	case "re":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	case "cidr":
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(s string) bool {
+			ip := net.ParseIP(s)
+			return ip != nil && network.Contains(ip)
+		}, nil
+	case "lt", "lte", "gt", "gte":
+		limit, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs a number: %w", transform, err)
+		}
+		return func(s string) bool {
+			n, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return false
+			}
+			switch transform {
+			case "lt":
+				return n < limit
+			case "lte":
+				return n <= limit
+			case "gt":
+				return n > limit
+			default:
+				return n >= limit
+			}
+		}, nil
+	}
+
+	pattern := sigmaWildcardPattern(value)
+	switch transform {
+	case "contains":
+		pattern = ".*" + pattern + ".*"
+	case "startswith":
+		pattern = pattern + ".*"
+	case "endswith":
+		pattern = ".*" + pattern
+	}
+	re, err := regexp.Compile("(?is)^" + pattern + "$")
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString, nil
+}
+
+// sigmaWildcardPattern converts a Sigma string, where * and ? are wildcards and a backslash
+// escapes them, into a regular expression
+func sigmaWildcardPattern(value string) string {
+	var pattern strings.Builder
+	runes := []rune(value)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case r == '\\' && i+1 < len(runes) && strings.ContainsRune(`*?\`, runes[i+1]):
+			pattern.WriteString(regexp.QuoteMeta(string(runes[i+1])))
+			i++
+		case r == '*':
+			pattern.WriteString(".*")
+		case r == '?':
+			pattern.WriteString(".")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return pattern.String()
+}
+
+// parseSigmaCondition parses the condition grammar: selection names (with * wildcards), "and",
+// "or", "not", parentheses, and "1 of" / "all of" a name pattern or "them"
+func parseSigmaCondition(condition string, selections map[string]sigmaSelection) (sigmaExpr, error) {
+	if strings.Contains(condition, "|") {
+		return nil, fmt.Errorf("aggregations are not supported")
+	}
+	tokens := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(condition))
+	p := &sigmaConditionParser{tokens: tokens, selections: selections}
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return expr, nil
+}
+
+type sigmaConditionParser struct {
+	tokens     []string
+	pos        int
+	selections map[string]sigmaSelection
+}
+
+func (p *sigmaConditionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *sigmaConditionParser) next() string {
+	token := p.tokens[p.pos]
+	p.pos++
+	return token
+}
+
+func (p *sigmaConditionParser) parseOr() (sigmaExpr, error) {
+	exprs := make([]sigmaExpr, 0, 1)
+	for {
+		expr, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if p.peek() != "or" {
+			return anyOf(exprs), nil
+		}
+		p.next()
+	}
+}
+
+func (p *sigmaConditionParser) parseAnd() (sigmaExpr, error) {
+	exprs := make([]sigmaExpr, 0, 1)
+	for {
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if p.peek() != "and" {
+			return allOf(exprs), nil
+		}
+		p.next()
+	}
+}
+
+func (p *sigmaConditionParser) parseNot() (sigmaExpr, error) {
+	if p.peek() == "not" {
+		p.next()
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(selected func(string) bool) bool { return !expr(selected) }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *sigmaConditionParser) parsePrimary() (sigmaExpr, error) {
+	switch token := p.peek(); token {
+	case "":
+		return nil, fmt.Errorf("unexpected end of condition")
+	case "(":
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.next()
+		return expr, nil
+	case "1", "any", "all":
+		p.next()
+		if p.peek() != "of" || p.pos+1 >= len(p.tokens) {
+			return nil, fmt.Errorf("expected \"%s of <selections>\"", token)
+		}
+		p.next()
+		names := p.resolve(p.next())
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no selections match %q", p.tokens[p.pos-1])
+		}
+		exprs := make([]sigmaExpr, 0, len(names))
+		for _, name := range names {
+			exprs = append(exprs, selectionExpr(name))
+		}
+		if token == "all" {
+			return allOf(exprs), nil
+		}
+		return anyOf(exprs), nil
+	case ")", "and", "or", "of":
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	default:
+		name := p.next()
+		if _, ok := p.selections[name]; !ok {
+			return nil, fmt.Errorf("unknown selection %q", name)
+		}
+		return selectionExpr(name), nil
+	}
+}
+
+// resolve expands "them" (all selections not starting with _) or a wildcard name pattern
+func (p *sigmaConditionParser) resolve(pattern string) []string {
+	names := make([]string, 0)
+	for name := range p.selections {
+		if strings.EqualFold(pattern, "them") {
+			if !strings.HasPrefix(name, "_") {
+				names = append(names, name)
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func selectionExpr(name string) sigmaExpr {
+	return func(selected func(string) bool) bool { return selected(name) }
+}
+
+func anyOf(exprs []sigmaExpr) sigmaExpr {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return func(selected func(string) bool) bool {
+		for _, expr := range exprs {
+			if expr(selected) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func allOf(exprs []sigmaExpr) sigmaExpr {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return func(selected func(string) bool) bool {
+		for _, expr := range exprs {
+			if !expr(selected) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+var attackTechniqueTag = regexp.MustCompile(`^attack\.(t\d{4}(?:\.\d{3})?)$`)
+
+// sigmaSignature maps rule metadata onto the detector's signature model: level to severity,
+// ATT&CK tags to the technique and threat type
+func sigmaSignature(rule SigmaRule) ThreatSignature {
+	sig := ThreatSignature{
+		ID:          "sigma:" + rule.ID,
+		Type:        Intrusion,
+		Severity:    Low,
+		Scope:       ScopeLog,
+		Description: rule.Title,
+		Source:      "sigma",
+	}
+	switch strings.ToLower(rule.Level) {
+	case "critical":
+		sig.Severity = Critical
+	case "high":
+		sig.Severity = High
+	case "medium":
+		sig.Severity = Medium
+	}
+
+	for _, tag := range rule.Tags {
+		tag = strings.ToLower(tag)
+		if m := attackTechniqueTag.FindStringSubmatch(tag); m != nil && sig.MITREAttack == "" {
+			sig.MITREAttack = strings.ToUpper(m[1])
+		}
+		switch {
+		case strings.HasPrefix(tag, "attack.t1110"):
+			sig.Type = Brute
+		case strings.HasPrefix(tag, "attack.t1498"), strings.HasPrefix(tag, "attack.t1499"):
+			sig.Type = DDoS
+		case tag == "attack.exfiltration", strings.HasPrefix(tag, "attack.t1048"), strings.HasPrefix(tag, "attack.t1041"):
+			sig.Type = DataExfil
+		case tag == "attack.execution" && sig.Type == Intrusion:
+			sig.Type = Malware
+		}
+	}
+	return sig
+}
+
+func sigmaConfidence(status string) float64 {
+	switch strings.ToLower(status) {
+	case "stable":
+		return 0.9
+	case "test":
+		return 0.75
+	default:
+		return 0.6
+	}
+}
+
+// HTTP Handlers
+type LogIngestRequest struct {
+	ScanID       string     `json:"scan_id"`
+	Target       string     `json:"target"`
+	Events       []LogEvent `json:"events" binding:"required,min=1,dive"`
+	DeepAnalysis bool       `json:"deep_analysis"`
+}
+
+func (s *APIServer) ingestLogsHandler(c *gin.Context) {
+	var body LogIngestRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req := ThreatDetectionRequest{
+		ScanID:       body.ScanID,
+		ScanType:     "log",
+		Target:       body.Target,
+		LogEvents:    body.Events,
+		DeepAnalysis: body.DeepAnalysis,
+	}
+	if req.ScanID == "" {
+		req.ScanID = fmt.Sprintf("logs_%d", time.Now().UnixNano())
+	}
+	for i := range req.LogEvents {
+		if req.LogEvents[i].Timestamp.IsZero() {
+			req.LogEvents[i].Timestamp = time.Now().UTC()
+		}
+	}
+
+	response, err := s.threatDetector.AnalyzeTraffic(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *APIServer) listSigmaRulesHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"rules": s.threatDetector.sigma.Rules()})
+}
+
+func (s *APIServer) addSigmaRulesHandler(c *gin.Context) {
+	source, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSigmaRuleBytes+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(source) > maxSigmaRuleBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Sigma rules are limited to 1 MB per request"})
+		return
+	}
+
+	rules, err := s.threatDetector.sigma.Add(c.Request.Context(), string(source))
+	if errors.Is(err, errInvalidSigmaRule) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"rules": rules})
+}
+
+func (s *APIServer) deleteSigmaRuleHandler(c *gin.Context) {
+	found, err := s.threatDetector.sigma.Remove(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sigma rule not found"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Threat signature management
+type SignatureScope string
+
+const (
+	ScopePayload    SignatureScope = "payload"    // Pattern is matched against packet payloads
+	ScopeURI        SignatureScope = "uri"        // Pattern is matched against decoded HTTP request URIs
+	ScopePacket     SignatureScope = "packet"     // Match holds IDS rule criteria
+	ScopeTLS        SignatureScope = "tls"        // Pattern is the JA3 MD5 or JA4 fingerprint of a TLS ClientHello
+	ScopeLog        SignatureScope = "log"        // Sigma rule, managed through /api/v1/sigma/rules
+	ScopeBehavioral SignatureScope = "behavioral" // Pattern names a detector implemented in code; read-only
+)
+
+const maxRequestLineBytes = 8192
+
+var (
+	errInvalidSignature  = errors.New("invalid signature")
+	errManagedSignature  = errors.New("signatures from Sigma rules are managed through /api/v1/sigma/rules")
+	errBuiltinSignature  = errors.New("built-in signatures can be overridden but not deleted")
+	errSignatureConflict = errors.New("signature already exists")
+	signatureIDPattern   = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,128}$`)
+	validThreatTypes     = map[ThreatType]bool{Malware: true, Intrusion: true, DDoS: true, DataExfil: true, Brute: true, SQLInjection: true, XSS: true}
+	validThreatLevels    = map[ThreatLevel]bool{Critical: true, High: true, Medium: true, Low: true}
+)
+
+type compiledSignature struct {
+	ThreatSignature
+	match   *compiledPacketMatch
+	pattern *regexp.Regexp
+}
+
+func (s *compiledSignature) matches(packet NetworkPacket, uri string, isRequest bool) bool {
+	switch {
+	case s.match != nil:
+		return s.match.matches(packet)
+	case s.Scope == ScopeURI:
+		return isRequest && s.pattern.MatchString(uri)
+	default:
+		return s.pattern.Match(packet.Payload)
+	}
+}
+
+// signatureIndex groups the signatures applied to packets by destination port. It is immutable
+// once built and replaced as a whole, so detection never sees a half-updated signature set.
+type signatureIndex struct {
+	byPort  map[int][]*compiledSignature
+	anyPort []*compiledSignature
+	tls     map[string][]*compiledSignature // by JA3 or JA4 fingerprint
+	count   int
+	uri     bool // whether any signature needs the request URI
+}
+
+func (idx *signatureIndex) candidates(port int) [][]*compiledSignature {
+	return [][]*compiledSignature{idx.byPort[port], idx.anyPort}
+}
+
+// SignatureReload reports the outcome of reloading signatures from Redis
+type SignatureReload struct {
+	Signatures int               `json:"signatures"`
+	Invalid    map[string]string `json:"invalid"` // stored signatures left out, by ID
+}
+
+// compileSignature validates a signature and compiles what it matches against packets. Log and
+// behavioral signatures are not applied to packets and compile to nil.
+func compileSignature(sig ThreatSignature) (*compiledSignature, error) {
+	switch sig.Scope {
+	case ScopePayload, ScopeURI:
+		if sig.Pattern == "" {
+			return nil, fmt.Errorf("%s signatures need a pattern", sig.Scope)
+		}
+		pattern, err := regexp.Compile(sig.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+		return &compiledSignature{ThreatSignature: sig, pattern: pattern}, nil
+	case ScopePacket:
+		if sig.Match == nil {
+			return nil, fmt.Errorf("packet signatures need match criteria")
+		}
+		match, err := compilePacketMatch(sig.Match)
+		if err != nil {
+			return nil, err
+		}
+		return &compiledSignature{ThreatSignature: sig, match: match}, nil
+	case ScopeTLS:
+		fingerprint, err := normalizeTLSFingerprint(sig.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		sig.Pattern = fingerprint
+		return &compiledSignature{ThreatSignature: sig}, nil
+	case ScopeLog, ScopeBehavioral:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown scope %q", sig.Scope)
+	}
+}
+
+// buildSignatureIndex compiles the signatures, returning the ones that fail by ID
+func buildSignatureIndex(signatures map[string]ThreatSignature) (*signatureIndex, map[string]error) {
+	ids := make([]string, 0, len(signatures))
+	for id := range signatures {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	idx := &signatureIndex{byPort: make(map[int][]*compiledSignature), tls: make(map[string][]*compiledSignature)}
+	invalid := make(map[string]error)
+	for _, id := range ids {
+		compiled, err := compileSignature(signatures[id])
+		if err != nil {
+			invalid[id] = err
+			continue
+		}
+		if compiled == nil {
+			continue
+		}
+		idx.count++
+		idx.uri = idx.uri || compiled.Scope == ScopeURI
+
+		if compiled.Scope == ScopeTLS {
+			idx.tls[compiled.Pattern] = append(idx.tls[compiled.Pattern], compiled)
+			continue
+		}
+		if compiled.match == nil || compiled.match.bidirectional || compiled.match.dstPortList == nil {
+			idx.anyPort = append(idx.anyPort, compiled)
+			continue
+		}
+		for _, port := range compiled.match.dstPortList {
+			idx.byPort[port] = append(idx.byPort[port], compiled)
+		}
+	}
+	return idx, invalid
+}
+
+// rebuildSignatureIndex recompiles the current signatures and swaps in the new index; a signature
+// that no longer compiles (e.g. after IDS_HOME_NET changed) is logged and left out
+func (td *ThreatDetector) rebuildSignatureIndex() {
+	td.indexMu.Lock()
+	defer td.indexMu.Unlock()
+
+	td.mu.RLock()
+	signatures := make(map[string]ThreatSignature, len(td.signatures))
+	for id, sig := range td.signatures {
+		signatures[id] = sig
+	}
+	td.mu.RUnlock()
+
+	idx, invalid := buildSignatureIndex(signatures)
+	for id, err := range invalid {
+		log.Printf("Signature %s disabled: %v", id, err)
+	}
+	td.packetSignatures.Store(idx)
+}
+
+// ReloadSignatures rebuilds the signature set from the built-in signatures and those stored in
+// Redis, keeping the loaded Sigma rules, and swaps it in at once. Stored signatures that fail to
+// compile are left out and reported.
+func (td *ThreatDetector) ReloadSignatures(ctx context.Context) (*SignatureReload, error) {
+	stored, err := td.redis.HGetAll(ctx, threatSignaturesKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load threat signatures: %w", err)
+	}
+
+	td.indexMu.Lock()
+	defer td.indexMu.Unlock()
+
+	signatures := builtinSignatures()
+	reload := &SignatureReload{Invalid: make(map[string]string)}
+	for id, data := range stored {
+		var sig ThreatSignature
+		if err := json.Unmarshal([]byte(data), &sig); err != nil {
+			reload.Invalid[id] = err.Error()
+			continue
+		}
+		signatures[id] = sig
+	}
+
+	idx, invalid := buildSignatureIndex(signatures)
+	for id, err := range invalid {
+		delete(signatures, id)
+		reload.Invalid[id] = err.Error()
+	}
+	for id, reason := range reload.Invalid {
+		log.Printf("Skipping stored signature %s: %s", id, reason)
+	}
+
+	// Sigma rules are not stored with the signatures; keep the ones currently loaded
+	td.mu.Lock()
+	for id, sig := range td.signatures {
+		if sig.Scope == ScopeLog {
+			signatures[id] = sig
+		}
+	}
+	td.signatures = signatures
+	reload.Signatures = len(signatures)
+	td.mu.Unlock()
+	td.packetSignatures.Store(idx)
+
+	log.Printf("Reloaded %d threat signatures (%d stored)", reload.Signatures, len(stored))
+	return reload, nil
+}
+
+// Signatures lists the signatures applied to the context's tenant, the shared ones it has not
+// disabled and its own, sorted by ID and optionally limited to one source or scope
+func (td *ThreatDetector) Signatures(ctx context.Context, source string, scope SignatureScope) []ThreatSignature {
+	tenant := td.tenants.state(ctx)
+	td.mu.RLock()
+	defer td.mu.RUnlock()
+
+	signatures := make([]ThreatSignature, 0, len(td.signatures))
+	keep := func(sig ThreatSignature) {
+		if (source == "" || sig.Source == source) && (scope == "" || sig.Scope == scope) {
+			signatures = append(signatures, sig)
+		}
+	}
+	for _, sig := range td.signatures {
+		if tenant == nil || !tenant.disabled[sig.ID] {
+			keep(sig)
+		}
+	}
+	if tenant != nil {
+		for _, sig := range tenant.Signatures {
+			keep(sig)
+		}
+	}
+	sort.Slice(signatures, func(i, j int) bool { return signatures[i].ID < signatures[j].ID })
+	return signatures
+}
+
+// Signature returns a signature applied to the context's tenant
+func (td *ThreatDetector) Signature(ctx context.Context, id string) (ThreatSignature, bool) {
+	tenant := td.tenants.state(ctx)
+	if tenant != nil {
+		for _, sig := range tenant.Signatures {
+			if sig.ID == id {
+				return sig, true
+			}
+		}
+		if tenant.disabled[id] {
+			return ThreatSignature{}, false
+		}
+	}
+
+	td.mu.RLock()
+	defer td.mu.RUnlock()
+
+	sig, ok := td.signatures[id]
+	return sig, ok
+}
+
+// normalizeSignature validates a custom signature and fills in its defaults
+func normalizeSignature(sig *ThreatSignature) error {
+	if !signatureIDPattern.MatchString(sig.ID) {
+		return fmt.Errorf("%w: id must be 1-128 letters, digits, or _.:-", errInvalidSignature)
+	}
+	if strings.HasPrefix(sig.ID, "sigma:") {
+		return errManagedSignature
+	}
+
+	if sig.Scope == "" {
+		sig.Scope = ScopePayload
+		if sig.Match != nil {
+			sig.Scope = ScopePacket
+		}
+	}
+	if sig.Severity == "" {
+		sig.Severity = Medium
+	}
+	if sig.Type == "" {
+		sig.Type = Intrusion
+	}
+	if !validThreatTypes[sig.Type] {
+		return fmt.Errorf("%w: unknown type %q", errInvalidSignature, sig.Type)
+	}
+	if !validThreatLevels[sig.Severity] {
+		return fmt.Errorf("%w: unknown severity %q", errInvalidSignature, sig.Severity)
+	}
+	if sig.Scope == ScopeLog {
+		return errManagedSignature
+	}
+	if sig.Scope == ScopeBehavioral {
+		return fmt.Errorf("%w: behavioral signatures describe built-in detectors and are read-only", errInvalidSignature)
+	}
+	if sig.Scope == ScopeTLS {
+		sig.Pattern = strings.ToLower(strings.TrimSpace(sig.Pattern))
+	}
+	if sig.Source != "ids" && sig.Source != "intel" {
+		sig.Source = "custom"
+	}
+	if _, err := compileSignature(*sig); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidSignature, err)
+	}
+	return nil
+}
+
+// SaveSignature validates and stores a custom signature, replacing any with the same ID unless
+// create is set, and swaps in a recompiled index
+func (td *ThreatDetector) SaveSignature(ctx context.Context, sig ThreatSignature, create bool) (ThreatSignature, error) {
+	existing, exists := td.Signature(ctx, sig.ID)
+	if existing.Scope == ScopeLog {
+		return sig, errManagedSignature
+	}
+	if existing.Scope == ScopeBehavioral {
+		return sig, fmt.Errorf("%w: behavioral signatures describe built-in detectors and are read-only", errInvalidSignature)
+	}
+	if create && exists {
+		return sig, errSignatureConflict
+	}
+	if err := normalizeSignature(&sig); err != nil {
+		return sig, err
+	}
+
+	data, err := json.Marshal(sig)
+	if err != nil {
+		return sig, err
+	}
+	if err := td.redis.HSet(ctx, threatSignaturesKey, sig.ID, data).Err(); err != nil {
+		return sig, fmt.Errorf("failed to store signature: %w", err)
+	}
+
+	td.mu.Lock()
+	td.signatures[sig.ID] = sig
+	td.mu.Unlock()
+	td.rebuildSignatureIndex()
+	return sig, nil
+}
+
+// DeleteSignature removes a stored signature. Deleting an override of a built-in signature
+// restores the default.
+func (td *ThreatDetector) DeleteSignature(ctx context.Context, id string) (bool, error) {
+	existing, exists := td.Signature(ctx, id)
+	if !exists {
+		return false, nil
+	}
+	if existing.Scope == ScopeLog {
+		return true, errManagedSignature
+	}
+
+	removed, err := td.redis.HDel(ctx, threatSignaturesKey, id).Result()
+	if err != nil {
+		return true, fmt.Errorf("failed to delete signature: %w", err)
+	}
+	builtin, isBuiltin := builtinSignatures()[id]
+	if removed == 0 && isBuiltin {
+		return true, errBuiltinSignature
+	}
+
+	td.mu.Lock()
+	if isBuiltin {
+		td.signatures[id] = builtin
+	} else {
+		delete(td.signatures, id)
+	}
+	td.mu.Unlock()
+	td.rebuildSignatureIndex()
+	return true, nil
+}
+
+// packetMatcher holds the packet signatures that apply to one tenant: the shared signatures it has
+// not disabled and its own. It is safe for concurrent use.
+type packetMatcher struct {
+	tenant  *tenantState
+	indexes []*signatureIndex
+	needURI bool
+	needTLS bool
+}
+
+// packetMatcher returns the context's matcher, or nil when no packet signatures apply
+func (td *ThreatDetector) packetMatcher(ctx context.Context) *packetMatcher {
+	m := &packetMatcher{tenant: td.tenants.state(ctx), indexes: make([]*signatureIndex, 0, 2)}
+	if idx := td.packetSignatures.Load(); idx != nil && idx.count > 0 {
+		m.indexes = append(m.indexes, idx)
+	}
+	if m.tenant != nil && m.tenant.index.count > 0 {
+		m.indexes = append(m.indexes, m.tenant.index)
+	}
+	if len(m.indexes) == 0 {
+		return nil
+	}
+	for _, idx := range m.indexes {
+		m.needURI = m.needURI || idx.uri
+		m.needTLS = m.needTLS || len(idx.tls) > 0
+	}
+	return m
+}
+
+type signatureHit struct {
+	sig    *compiledSignature
+	packet NetworkPacket // first match
+	hello  *TLSClientHello
+	count  int
+}
+
+// signatureHits are the matches of each signature and address pair, in order of first match
+type signatureHits struct {
+	hits  map[string]*signatureHit
+	order []string
+}
+
+func newSignatureHits() *signatureHits {
+	return &signatureHits{hits: make(map[string]*signatureHit)}
+}
+
+func (h *signatureHits) add(sig *compiledSignature, packet NetworkPacket, hello *TLSClientHello) {
+	key := sig.ID + "|" + packet.SourceIP + "|" + packet.DestIP
+	if h.hits[key] == nil {
+		h.hits[key] = &signatureHit{sig: sig, packet: packet, hello: hello}
+		h.order = append(h.order, key)
+	}
+	h.hits[key].count++
+}
+
+// merge adds the hits of packets that followed those already matched
+func (h *signatureHits) merge(other *signatureHits) {
+	for _, key := range other.order {
+		if hit := h.hits[key]; hit != nil {
+			hit.count += other.hits[key].count
+			continue
+		}
+		h.hits[key] = other.hits[key]
+		h.order = append(h.order, key)
+	}
+}
+
+func (m *packetMatcher) match(packets []NetworkPacket) *signatureHits {
+	hits := newSignatureHits()
+	for _, packet := range packets {
+		var uri string
+		var isRequest bool
+		if m.needURI {
+			uri, isRequest = httpRequestURI(packet.Payload)
+		}
+		var hello *TLSClientHello
+		if m.needTLS {
+			hello, _ = fingerprintClientHello(packet)
+		}
+
+		for _, idx := range m.indexes {
+			for _, group := range idx.candidates(packet.DestPort) {
+				for _, sig := range group {
+					if m.tenant != nil && m.tenant.disabled[sig.ID] || !sig.matches(packet, uri, isRequest) {
+						continue
+					}
+					hits.add(sig, packet, nil)
+				}
+			}
+			if hello == nil {
+				continue
+			}
+			for _, fingerprint := range []string{hello.JA3, hello.JA4} {
+				for _, sig := range idx.tls[fingerprint] {
+					if m.tenant != nil && m.tenant.disabled[sig.ID] {
+						continue
+					}
+					hits.add(sig, packet, hello)
+				}
+			}
+		}
+	}
+	return hits
+}
+
+// indicators reports one indicator per signature and address pair
+func (h *signatureHits) indicators() []ThreatIndicator {
+	threats := make([]ThreatIndicator, 0, len(h.hits))
+	for _, key := range h.order {
+		hit := h.hits[key]
+		description := hit.sig.Description
+		if description == "" {
+			description = hit.sig.ID
+		}
+		threat := ThreatIndicator{
+			Type:        hit.sig.Type,
+			Severity:    hit.sig.Severity,
+			Confidence:  0.8,
+			Description: description,
+			SourceIP:    hit.packet.SourceIP,
+			DestIP:      hit.packet.DestIP,
+			MITREAttack: hit.sig.MITREAttack,
+			Evidence: []string{
+				fmt.Sprintf("Signature %s (%s)", hit.sig.ID, hit.sig.Scope),
+				fmt.Sprintf("Matched %d packet(s), first %s:%d -> %s:%d", hit.count, hit.packet.SourceIP, hit.packet.SourcePort, hit.packet.DestIP, hit.packet.DestPort),
+			},
+		}
+		if hit.hello != nil {
+			threat.Evidence = append(threat.Evidence, fmt.Sprintf("ClientHello %s, JA3 %s, JA4 %s", hit.hello.Version, hit.hello.JA3, hit.hello.JA4))
+			if hit.hello.ServerName != "" {
+				threat.Evidence = append(threat.Evidence, "Server name: "+hit.hello.ServerName)
+				threat.Observables = []string{hit.hello.ServerName}
+			}
+		}
+		threats = append(threats, threat)
+	}
+	return threats
+}
+
+// httpRequestURI extracts and URL-decodes the target of an HTTP/1.x request line
+func httpRequestURI(payload []byte) (string, bool) {
+	line := payload
+	if len(line) > maxRequestLineBytes {
+		line = line[:maxRequestLineBytes]
+	}
+	end := bytes.IndexByte(line, '\n')
+	if end < 0 {
+		return "", false
+	}
+
+	parts := strings.Fields(string(line[:end]))
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		return "", false
+	}
+	uri, err := url.QueryUnescape(parts[1])
+	if err != nil {
+		return parts[1], true
+	}
+	return uri, true
+}
+
+// HTTP Handlers
+func (s *APIServer) listSignaturesHandler(c *gin.Context) {
+	signatures := s.threatDetector.Signatures(c.Request.Context(), c.Query("source"), SignatureScope(c.Query("scope")))
+	c.JSON(http.StatusOK, gin.H{"signatures": signatures, "count": len(signatures)})
+}
+
+func (s *APIServer) getSignatureHandler(c *gin.Context) {
+	sig, ok := s.threatDetector.Signature(c.Request.Context(), c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Signature not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, sig)
+}
+
+func (s *APIServer) createSignatureHandler(c *gin.Context) {
+	var sig ThreatSignature
+	if err := c.ShouldBindJSON(&sig); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.saveSignature(c, sig, true, http.StatusCreated)
+}
+
+func (s *APIServer) updateSignatureHandler(c *gin.Context) {
+	var sig ThreatSignature
+	if err := c.ShouldBindJSON(&sig); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if sig.ID != "" && sig.ID != c.Param("id") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "signature id does not match the URL"})
+		return
+	}
+	sig.ID = c.Param("id")
+
+	s.saveSignature(c, sig, false, http.StatusOK)
+}
+
+func (s *APIServer) saveSignature(c *gin.Context, sig ThreatSignature, create bool, status int) {
+	saved, err := s.threatDetector.SaveSignature(c.Request.Context(), sig, create)
+	switch {
+	case errors.Is(err, errInvalidSignature):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errManagedSignature), errors.Is(err, errSignatureConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(status, saved)
+	}
+}
+
+func (s *APIServer) deleteSignatureHandler(c *gin.Context) {
+	found, err := s.threatDetector.DeleteSignature(c.Request.Context(), c.Param("id"))
+	switch {
+	case !found:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Signature not found"})
+	case errors.Is(err, errManagedSignature), errors.Is(err, errBuiltinSignature):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func (s *APIServer) reloadSignaturesHandler(c *gin.Context) {
+	reload, err := s.threatDetector.ReloadSignatures(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, reload)
+}
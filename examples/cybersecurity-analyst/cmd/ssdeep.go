@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ssdeep context-triggered piecewise hashes, compatible with ssdeep 2.13+
+const (
+	ssdeepRollingWindow = 7
+	ssdeepMinBlockSize  = 3
+	ssdeepHashPrime     = 0x01000193
+	ssdeepHashInit      = 0x28021967
+	ssdeepLength        = 64
+	ssdeepAlphabet      = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+)
+
+var ssdeepPattern = regexp.MustCompile(`^[0-9]{1,10}:[A-Za-z0-9+/]{0,64}:[A-Za-z0-9+/]{0,64}$`)
+
+// ssdeepRoll is the rolling hash over the last ssdeepRollingWindow bytes that decides where
+// the input is split into pieces
+type ssdeepRoll struct {
+	window     [ssdeepRollingWindow]uint32
+	h1, h2, h3 uint32
+	n          uint32
+}
+
+func (r *ssdeepRoll) hash(c byte) uint32 {
+	r.h2 -= r.h1
+	r.h2 += ssdeepRollingWindow * uint32(c)
+	r.h1 += uint32(c)
+	r.h1 -= r.window[r.n%ssdeepRollingWindow]
+	r.window[r.n%ssdeepRollingWindow] = uint32(c)
+	r.n++
+	r.h3 <<= 5
+	r.h3 ^= uint32(c)
+	return r.h1 + r.h2 + r.h3
+}
+
+// ssdeepDigest returns the ssdeep hash of data as "blocksize:hash:hash"
+func ssdeepDigest(data []byte) string {
+	blockSize := uint32(ssdeepMinBlockSize)
+	for uint64(blockSize)*ssdeepLength < uint64(len(data)) {
+		blockSize *= 2
+	}
+
+	for {
+		var roll ssdeepRoll
+		h1, h2 := uint32(ssdeepHashInit), uint32(ssdeepHashInit)
+		sig1 := make([]byte, 0, ssdeepLength)
+		sig2 := make([]byte, 0, ssdeepLength/2)
+		var h uint32
+		for _, c := range data {
+			h1 = h1*ssdeepHashPrime ^ uint32(c)
+			h2 = h2*ssdeepHashPrime ^ uint32(c)
+			h = roll.hash(c)
+
+			// A piece ends where the rolling hash hits the trigger value; the last character
+			// keeps being overwritten once the hash is full
+			if h%blockSize == blockSize-1 {
+				if len(sig1) < ssdeepLength-1 {
+					sig1 = append(sig1, ssdeepAlphabet[h1%64])
+					h1 = ssdeepHashInit
+				} else {
+					sig1 = append(sig1[:ssdeepLength-1], ssdeepAlphabet[h1%64])
+				}
+			}
+			if h%(2*blockSize) == 2*blockSize-1 {
+				if len(sig2) < ssdeepLength/2-1 {
+					sig2 = append(sig2, ssdeepAlphabet[h2%64])
+					h2 = ssdeepHashInit
+				} else {
+					sig2 = append(sig2[:ssdeepLength/2-1], ssdeepAlphabet[h2%64])
+				}
+			}
+		}
+		if h != 0 {
+			sig1 = append(sig1[:min(len(sig1), ssdeepLength-1)], ssdeepAlphabet[h1%64])
+			sig2 = append(sig2[:min(len(sig2), ssdeepLength/2-1)], ssdeepAlphabet[h2%64])
+		}
+
+		// Too few pieces at this block size; halve it and hash again
+		if blockSize > ssdeepMinBlockSize && len(sig1) < ssdeepLength/2 {
+			blockSize /= 2
+			continue
+		}
+		return fmt.Sprintf("%d:%s:%s", blockSize, sig1, sig2)
+	}
+}
+
+type ssdeepHash struct {
+	blockSize uint64
+	sig1      string
+	sig2      string
+}
+
+func parseSSDeep(value string) (ssdeepHash, bool) {
+	if !ssdeepPattern.MatchString(value) {
+		return ssdeepHash{}, false
+	}
+	parts := strings.SplitN(value, ":", 3)
+	blockSize, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || blockSize == 0 {
+		return ssdeepHash{}, false
+	}
+	return ssdeepHash{
+		blockSize: blockSize,
+		sig1:      ssdeepEliminateSequences(parts[1]),
+		sig2:      ssdeepEliminateSequences(parts[2]),
+	}, true
+}
+
+// ssdeepEliminateSequences shortens runs of more than three identical characters, which carry
+// little information and would inflate the score
+func ssdeepEliminateSequences(s string) string {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if i >= 3 && s[i] == s[i-1] && s[i] == s[i-2] && s[i] == s[i-3] {
+			continue
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// ssdeepCompare scores the similarity of two ssdeep hashes from 0 (unrelated) to 100; only
+// hashes whose block sizes are equal or differ by a factor of two can be compared
+func ssdeepCompare(a, b string) int {
+	h1, ok1 := parseSSDeep(a)
+	h2, ok2 := parseSSDeep(b)
+	if !ok1 || !ok2 {
+		return 0
+	}
+	switch {
+	case h1.blockSize == h2.blockSize:
+		if h1.sig1 == h2.sig1 && h1.sig2 == h2.sig2 {
+			return 100
+		}
+		return max(ssdeepScore(h1.sig1, h2.sig1, h1.blockSize), ssdeepScore(h1.sig2, h2.sig2, h1.blockSize*2))
+	case h1.blockSize == h2.blockSize*2:
+		return ssdeepScore(h1.sig1, h2.sig2, h1.blockSize)
+	case h2.blockSize == h1.blockSize*2:
+		return ssdeepScore(h1.sig2, h2.sig1, h2.blockSize)
+	}
+	return 0
+}
+
+func ssdeepScore(s1, s2 string, blockSize uint64) int {
+	if len(s1) > ssdeepLength || len(s2) > ssdeepLength || !ssdeepCommonSubstring(s1, s2) {
+		return 0
+	}
+
+	score := ssdeepEditDistance(s1, s2) * ssdeepLength / (len(s1) + len(s2))
+	score = 100 * score / ssdeepLength
+	if score >= 100 {
+		return 0
+	}
+	score = 100 - score
+
+	// Small block sizes describe small inputs, where short matches say little; cap their score
+	if blockSize >= (99+ssdeepRollingWindow)/ssdeepRollingWindow*ssdeepMinBlockSize {
+		return score
+	}
+	return min(score, int(blockSize)/ssdeepMinBlockSize*min(len(s1), len(s2)))
+}
+
+// ssdeepCommonSubstring reports whether the strings share a run of ssdeepRollingWindow characters
+func ssdeepCommonSubstring(s1, s2 string) bool {
+	if len(s1) < ssdeepRollingWindow || len(s2) < ssdeepRollingWindow {
+		return false
+	}
+	windows := make(map[string]bool, len(s1))
+	for i := 0; i+ssdeepRollingWindow <= len(s1); i++ {
+		windows[s1[i:i+ssdeepRollingWindow]] = true
+	}
+	for i := 0; i+ssdeepRollingWindow <= len(s2); i++ {
+		if windows[s2[i:i+ssdeepRollingWindow]] {
+			return true
+		}
+	}
+	return false
+}
+
+// ssdeepEditDistance counts insertions and deletions as 1 and substitutions as 2
+func ssdeepEditDistance(s1, s2 string) int {
+	prev := make([]int, len(s2)+1)
+	cur := make([]int, len(s2)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s1); i++ {
+		cur[0] = i
+		for j := 1; j <= len(s2); j++ {
+			substitute := prev[j-1]
+			if s1[i-1] != s2[j-1] {
+				substitute += 2
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, substitute)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(s2)]
+}
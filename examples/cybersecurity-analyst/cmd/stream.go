@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Streaming analysis (WebSocket)
+const (
+	streamWindow         = time.Second // buffered packets and events are evaluated together, as in live capture
+	streamMaxMessage     = 1 << 20
+	streamMaxBuffered    = 10000 // packets plus events held per connection between windows
+	streamReplyQueue     = 64
+	streamPingInterval   = 30 * time.Second
+	streamPongWait       = 60 * time.Second
+	streamWriteWait      = 10 * time.Second
+	streamFlushTimeout   = 5 * time.Second
+	streamMessagePackets = "packets"
+	streamMessageEvents  = "events"
+)
+
+var (
+	streamConnections = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cybersecurity_stream_connections",
+			Help: "Open WebSocket analysis streams",
+		},
+	)
+
+	streamItems = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cybersecurity_stream_items_total",
+			Help: "Packets and log events received over analysis streams by kind and result (accepted, dropped)",
+		},
+		[]string{"kind", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(streamConnections)
+	prometheus.MustRegister(streamItems)
+}
+
+// StreamMessage is sent by clients; each carries a batch of packets or log events
+type StreamMessage struct {
+	Type    string          `json:"type"`         // "packets" or "events"
+	ID      string          `json:"id,omitempty"` // echoed in the ack
+	Packets []NetworkPacket `json:"packets,omitempty"`
+	Events  []LogEvent      `json:"events,omitempty"`
+}
+
+// StreamReply is sent to clients: an ack for each message, the indicators of each window that
+// raised any, or an error for a message that could not be used
+type StreamReply struct {
+	Type       string            `json:"type"` // "ack", "indicators", or "error"
+	ID         string            `json:"id,omitempty"`
+	Accepted   int               `json:"accepted,omitempty"`
+	Dropped    int               `json:"dropped,omitempty"` // items over the buffer limit; resend them later
+	Indicators []ThreatIndicator `json:"indicators,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Timestamp  time.Time         `json:"timestamp"`
+}
+
+// AnalysisStreams serves WebSocket connections that stream packets and log events for analysis
+type AnalysisStreams struct {
+	detector *ThreatDetector
+	upgrader websocket.Upgrader
+	slots    chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewAnalysisStreams accepts up to maxConnections streams at once. Browsers may only connect
+// from the API's own origin; clients that send no Origin header are not restricted.
+func NewAnalysisStreams(detector *ThreatDetector, maxConnections int) *AnalysisStreams {
+	if maxConnections < 1 {
+		maxConnections = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &AnalysisStreams{
+		detector: detector,
+		upgrader: websocket.Upgrader{ReadBufferSize: 64 << 10, WriteBufferSize: 64 << 10},
+		slots:    make(chan struct{}, maxConnections),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Close tells open streams the server is going away and waits for their final windows
+func (as *AnalysisStreams) Close() {
+	as.mu.Lock()
+	as.closed = true
+	as.mu.Unlock()
+	as.cancel()
+	as.wg.Wait()
+}
+
+func (as *AnalysisStreams) acquire() bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.closed {
+		return false
+	}
+	select {
+	case as.slots <- struct{}{}:
+		as.wg.Add(1)
+		return true
+	default:
+		return false
+	}
+}
+
+func (as *AnalysisStreams) release() {
+	<-as.slots
+	as.wg.Done()
+}
+
+// streamSession buffers what one client sends until the next window is evaluated. Only the
+// session's run loop writes to the connection.
+type streamSession struct {
+	conn     *websocket.Conn
+	detector *ThreatDetector
+	replies  chan StreamReply
+	done     chan struct{} // closed when the client disconnects
+	stopped  chan struct{} // closed when the run loop stops writing
+
+	mu      sync.Mutex
+	packets []NetworkPacket
+	events  []LogEvent
+}
+
+// read receives messages until the connection fails or closes
+func (ss *streamSession) read() {
+	defer close(ss.done)
+	ss.conn.SetReadLimit(streamMaxMessage)
+	ss.conn.SetReadDeadline(time.Now().Add(streamPongWait))
+	ss.conn.SetPongHandler(func(string) error {
+		return ss.conn.SetReadDeadline(time.Now().Add(streamPongWait))
+	})
+
+	for {
+		_, data, err := ss.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("Analysis stream closed: %v", err)
+			}
+			return
+		}
+		ss.conn.SetReadDeadline(time.Now().Add(streamPongWait))
+
+		var message StreamMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			ss.reply(StreamReply{Type: "error", Error: "invalid message: " + err.Error()})
+			continue
+		}
+		ss.reply(ss.accept(message))
+	}
+}
+
+// accept buffers a message's items up to streamMaxBuffered
+func (ss *streamSession) accept(message StreamMessage) StreamReply {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	room := streamMaxBuffered - len(ss.packets) - len(ss.events)
+	var accepted, total int
+	switch message.Type {
+	case streamMessagePackets:
+		total = len(message.Packets)
+		accepted = min(total, room)
+		ss.packets = append(ss.packets, message.Packets[:accepted]...)
+	case streamMessageEvents:
+		total = len(message.Events)
+		accepted = min(total, room)
+		now := time.Now().UTC()
+		for _, event := range message.Events[:accepted] {
+			if event.Fields == nil {
+				event.Fields = make(map[string]interface{})
+			}
+			if event.Timestamp.IsZero() {
+				event.Timestamp = now
+			}
+			ss.events = append(ss.events, event)
+		}
+	default:
+		return StreamReply{Type: "error", ID: message.ID, Error: `type must be "packets" or "events"`}
+	}
+
+	streamItems.WithLabelValues(message.Type, "accepted").Add(float64(accepted))
+	if total > accepted {
+		streamItems.WithLabelValues(message.Type, "dropped").Add(float64(total - accepted))
+	}
+	return StreamReply{Type: "ack", ID: message.ID, Accepted: accepted, Dropped: total - accepted}
+}
+
+// reply queues a reply for the run loop; a client that stops reading blocks its own reads
+func (ss *streamSession) reply(reply StreamReply) {
+	reply.Timestamp = time.Now().UTC()
+	select {
+	case ss.replies <- reply:
+	case <-ss.stopped:
+	}
+}
+
+func (ss *streamSession) drain() ([]NetworkPacket, []LogEvent) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	packets, events := ss.packets, ss.events
+	ss.packets, ss.events = nil, nil
+	return packets, events
+}
+
+func (ss *streamSession) write(reply StreamReply) error {
+	ss.conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+	return ss.conn.WriteJSON(reply)
+}
+
+// run evaluates the buffer every window and writes replies until the client disconnects or the
+// server shuts down. What is still buffered then is evaluated, so its indicators reach the SIEMs.
+func (ss *streamSession) run(ctx context.Context) {
+	window := time.NewTicker(streamWindow)
+	defer window.Stop()
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	defer func() {
+		close(ss.stopped)
+		flushCtx, cancel := context.WithTimeout(withTenant(context.Background(), tenantFromContext(ctx)), streamFlushTimeout)
+		defer cancel()
+		packets, events := ss.drain()
+		ss.detector.analyzeStream(flushCtx, "stream", packets, events)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			ss.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(streamWriteWait))
+			return
+		case <-ss.done:
+			return
+		case reply := <-ss.replies:
+			if err := ss.write(reply); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := ss.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteWait)); err != nil {
+				return
+			}
+		case <-window.C:
+			packets, events := ss.drain()
+			threats := ss.detector.analyzeStream(ctx, "stream", packets, events)
+			if len(threats) == 0 {
+				continue
+			}
+			if err := ss.write(StreamReply{Type: "indicators", Indicators: threats, Timestamp: time.Now().UTC()}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// analyzeStream evaluates one window of a WebSocket or gRPC stream for the context's tenant. Like
+// analyze scans, the default tenant's streamed packets are compared with host baselines without
+// training them; floods are tracked across windows in the tenant's DoS state.
+func (td *ThreatDetector) analyzeStream(ctx context.Context, origin string, packets []NetworkPacket, events []LogEvent) []ThreatIndicator {
+	threats := make([]ThreatIndicator, 0)
+	if len(packets) > 0 {
+		threats = append(threats, td.detectPacketThreats(ctx, packets)...)
+		threats = append(threats, td.ddos.Observe(ctx, packets)...)
+		if tenantFromContext(ctx) == defaultTenant {
+			threats = append(threats, td.baselines.Evaluate(ctx, packets)...)
+		}
+		packetsProcessed.Add(float64(len(packets)))
+	}
+	if len(events) > 0 {
+		td.geo.EnrichEvents(events)
+		threats = append(threats, td.sigma.Evaluate(events)...)
+		logEventsProcessed.Add(float64(len(events)))
+	}
+	threats = td.lists.Apply(ctx, threats)
+	threats = td.tenants.Apply(ctx, threats)
+	if len(threats) == 0 {
+		return threats
+	}
+
+	td.geo.Enrich(threats)
+	td.endpoints.Annotate(ctx, threats)
+	for _, threat := range threats {
+		threatsDetected.WithLabelValues(string(threat.Severity), string(threat.Type)).Inc()
+	}
+	td.recordDetections(ctx, threats)
+	td.campaigns.Record(ctx, origin, "", threats)
+	td.history.RecordIndicators(ctx, origin, "", threats)
+	td.siem.ForwardIndicators(origin, threats)
+	td.alerts.Route(ctx, origin, threats)
+	td.detections.Publish(ctx, origin, threats)
+	return threats
+}
+
+// HTTP Handlers
+func (s *APIServer) streamHandler(c *gin.Context) {
+	streams := s.streams
+	if !streams.acquire() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many open analysis streams"})
+		return
+	}
+	defer streams.release()
+
+	// The upgrader writes the error response when the handshake fails
+	conn, err := streams.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	streamConnections.Inc()
+	defer streamConnections.Dec()
+
+	session := &streamSession{
+		conn:     conn,
+		detector: s.threatDetector,
+		replies:  make(chan StreamReply, streamReplyQueue),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go session.read()
+	session.run(withTenant(streams.ctx, tenantFromContext(c.Request.Context())))
+}
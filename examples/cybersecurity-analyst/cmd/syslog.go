@@ -0,0 +1,889 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Syslog ingestion: firewalls, proxies, and WAFs send RFC 5424, RFC 3164, or CEF messages over
+// UDP, TCP, or TLS. Each sender is matched to a source registered through the API, whose parser
+// and field map turn its messages into log events for the Sigma rules.
+const (
+	syslogSourcesKey       = "syslog:sources" // hash of source ID -> SyslogSource JSON
+	syslogIndicatorsKey    = "syslog:indicators"
+	syslogRefreshInterval  = 30 * time.Second
+	syslogFlushInterval    = 5 * time.Second // received events are analyzed at least this often
+	maxSyslogBatch         = 10000
+	maxSyslogMessageBytes  = 64 * 1024
+	maxSyslogSenders       = 1000 // senders tracked for status
+	maxSyslogSources       = 1000
+	maxSyslogFieldMappings = 100
+)
+
+type SyslogParser string
+
+const (
+	ParserAuto    SyslogParser = "auto" // syslog header when present; CEF, JSON, or key=value body when recognized
+	ParserRFC5424 SyslogParser = "rfc5424"
+	ParserRFC3164 SyslogParser = "rfc3164"
+	ParserCEF     SyslogParser = "cef"
+	ParserKV      SyslogParser = "kv"
+	ParserJSON    SyslogParser = "json"
+)
+
+var (
+	errInvalidSyslogSource  = errors.New("invalid syslog source")
+	errSyslogSourceNotFound = errors.New("syslog source not found")
+	errUnparsableSyslog     = errors.New("unparsable syslog message")
+
+	syslogParsers = map[SyslogParser]bool{ParserAuto: true, ParserRFC5424: true, ParserRFC3164: true, ParserCEF: true, ParserKV: true, ParserJSON: true}
+
+	cefExtensionKey = regexp.MustCompile(`(?:^|\s)([A-Za-z0-9_.\[\]-]+)=`)
+	kvPair          = regexp.MustCompile(`([A-Za-z0-9_.-]+)=("(?:[^"\\]|\\.)*"|\S*)`)
+	syslogTag       = regexp.MustCompile(`^([\w./-]+)(?:\[(\w+)\])?:\s?`)
+
+	// cefFieldNames maps CEF extension keys to the field names Sigma rules use for firewall,
+	// proxy, and web server logs; the original keys are kept as well
+	cefFieldNames = map[string]string{
+		"src":                          "src_ip",
+		"dst":                          "dst_ip",
+		"spt":                          "src_port",
+		"dpt":                          "dst_port",
+		"shost":                        "src_host",
+		"dhost":                        "dst_host",
+		"smac":                         "src_mac",
+		"dmac":                         "dst_mac",
+		"suser":                        "src_user",
+		"duser":                        "dst_user",
+		"act":                          "action",
+		"proto":                        "protocol",
+		"app":                          "application",
+		"in":                           "bytes_in",
+		"out":                          "bytes_out",
+		"request":                      "c-uri",
+		"requestMethod":                "cs-method",
+		"requestClientApplication":     "c-useragent",
+		"requestContext":               "cs-referrer",
+		"requestCookies":               "cs-cookie",
+		"fname":                        "file_name",
+		"fileHash":                     "file_hash",
+		"msg":                          "message",
+		"outcome":                      "outcome",
+		"cat":                          "event_category",
+		"sourceTranslatedAddress":      "src_nat_ip",
+		"destinationTranslatedAddress": "dst_nat_ip",
+	}
+)
+
+var syslogMessages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cybersecurity_syslog_messages_total",
+		Help: "Syslog messages received by transport and result (parsed, failed, unregistered)",
+	},
+	[]string{"transport", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(syslogMessages)
+}
+
+// SyslogSource configures how messages from a sender address or network are parsed
+type SyslogSource struct {
+	ID        string            `json:"id"`
+	Address   string            `json:"address"` // sender IP address or CIDR network
+	Parser    SyslogParser      `json:"parser"`
+	Product   string            `json:"product,omitempty"`  // Sigma logsource product, e.g. "fortigate"
+	Category  string            `json:"category,omitempty"` // Sigma logsource category, e.g. "firewall", "proxy", "webserver"
+	Service   string            `json:"service,omitempty"`
+	FieldMap  map[string]string `json:"field_map,omitempty"` // vendor field -> normalized field, e.g. "srcip": "src_ip"
+	UpdatedAt time.Time         `json:"updated_at"`
+	network   *net.IPNet
+}
+
+// validate normalizes the source and parses its address
+func (ss *SyslogSource) validate() error {
+	ss.ID = strings.TrimSpace(ss.ID)
+	if ss.ID == "" || len(ss.ID) > 64 || strings.ContainsAny(ss.ID, " /") {
+		return fmt.Errorf("%w: id must be 1-64 characters without spaces or slashes", errInvalidSyslogSource)
+	}
+	address := strings.TrimSpace(ss.Address)
+	if ip := net.ParseIP(address); ip != nil {
+		address = ip.String() + "/32"
+		if ip.To4() == nil {
+			address = ip.String() + "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(address)
+	if err != nil {
+		return fmt.Errorf("%w: address %q is not an IP address or CIDR network", errInvalidSyslogSource, ss.Address)
+	}
+	ss.Address, ss.network = network.String(), network
+	if ss.Parser == "" {
+		ss.Parser = ParserAuto
+	}
+	if !syslogParsers[ss.Parser] {
+		return fmt.Errorf("%w: parser must be auto, rfc5424, rfc3164, cef, kv, or json", errInvalidSyslogSource)
+	}
+	if len(ss.FieldMap) > maxSyslogFieldMappings {
+		return fmt.Errorf("%w: at most %d field mappings", errInvalidSyslogSource, maxSyslogFieldMappings)
+	}
+	for from, to := range ss.FieldMap {
+		if strings.TrimSpace(from) == "" || strings.TrimSpace(to) == "" {
+			return fmt.Errorf("%w: field mappings need both names", errInvalidSyslogSource)
+		}
+	}
+	return nil
+}
+
+// syslogSources is a snapshot of the registered sources, most specific network first
+type syslogSources []*SyslogSource
+
+func (sources syslogSources) match(sender net.IP) *SyslogSource {
+	for _, source := range sources {
+		if source.network.Contains(sender) {
+			return source
+		}
+	}
+	return nil
+}
+
+// SyslogSenderStatus counts the messages of one sender address
+type SyslogSenderStatus struct {
+	Address   string    `json:"address"`
+	Source    string    `json:"source"` // ID of the matching source
+	Transport string    `json:"transport"`
+	Messages  uint64    `json:"messages"`
+	Errors    uint64    `json:"errors"`
+	LastError string    `json:"last_error,omitempty"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type SyslogStatus struct {
+	Enabled      bool                 `json:"enabled"`
+	Listeners    map[string]string    `json:"listeners"` // transport -> listen address
+	Senders      []SyslogSenderStatus `json:"senders"`
+	Unregistered uint64               `json:"unregistered"` // messages dropped from senders matching no source
+	Indicators   []ThreatIndicator    `json:"recent_indicators"`
+}
+
+// SyslogListener receives syslog on the configured transports and analyzes the events in
+// batches for the default tenant
+type SyslogListener struct {
+	redis     *redis.Client
+	detector  *ThreatDetector
+	listeners map[string]string // transport -> listen address
+	tlsConfig *tls.Config
+	sources   atomic.Pointer[syslogSources]
+
+	mu           sync.Mutex
+	pending      []LogEvent
+	senders      map[string]*SyslogSenderStatus
+	unregistered uint64
+}
+
+// NewSyslogListener prepares the transports whose address is set; TLS needs a certificate and
+// key, and verifies client certificates against clientCA when it is set
+func NewSyslogListener(redisClient *redis.Client, detector *ThreatDetector, udpAddr, tcpAddr, tlsAddr, certFile, keyFile, clientCA string) (*SyslogListener, error) {
+	sl := &SyslogListener{
+		redis:     redisClient,
+		detector:  detector,
+		listeners: make(map[string]string),
+		senders:   make(map[string]*SyslogSenderStatus),
+	}
+	sl.sources.Store(&syslogSources{})
+	for transport, addr := range map[string]string{"udp": udpAddr, "tcp": tcpAddr, "tls": tlsAddr} {
+		if addr != "" {
+			sl.listeners[transport] = addr
+		}
+	}
+	if tlsAddr == "" {
+		return sl, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("SYSLOG_TLS_CERT and SYSLOG_TLS_KEY: %w", err)
+	}
+	sl.tlsConfig = &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("SYSLOG_TLS_CLIENT_CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("SYSLOG_TLS_CLIENT_CA: no certificates in %s", clientCA)
+		}
+		sl.tlsConfig.ClientCAs, sl.tlsConfig.ClientAuth = pool, tls.RequireAndVerifyClientCert
+	}
+	return sl, nil
+}
+
+func (sl *SyslogListener) Enabled() bool {
+	return len(sl.listeners) > 0
+}
+
+// Start listens on the configured transports until ctx is cancelled; events still pending are
+// analyzed before it returns
+func (sl *SyslogListener) Start(ctx context.Context) (*sync.WaitGroup, error) {
+	if err := sl.Load(ctx); err != nil {
+		log.Printf("Syslog sources not loaded; retrying in %s: %v", syslogRefreshInterval, err)
+	}
+
+	var wg sync.WaitGroup
+	closers := make([]io.Closer, 0, len(sl.listeners))
+	for transport, addr := range sl.listeners {
+		if transport == "udp" {
+			conn, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to listen for syslog on udp %s: %w", addr, err)
+			}
+			closers = append(closers, conn)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sl.receiveUDP(ctx, conn)
+			}()
+			log.Printf("Receiving syslog on udp %s", conn.LocalAddr())
+			continue
+		}
+
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for syslog on %s %s: %w", transport, addr, err)
+		}
+		if transport == "tls" {
+			listener = tls.NewListener(listener, sl.tlsConfig)
+		}
+		closers = append(closers, listener)
+		wg.Add(1)
+		go func(transport string) {
+			defer wg.Done()
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+						return
+					}
+					log.Printf("Syslog %s listener accept failed: %v", transport, err)
+					continue
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					sl.receiveStream(ctx, transport, conn)
+				}()
+			}
+		}(transport)
+		log.Printf("Receiving syslog on %s %s", transport, listener.Addr())
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		flush := time.NewTicker(syslogFlushInterval)
+		defer flush.Stop()
+		refresh := time.NewTicker(syslogRefreshInterval)
+		defer refresh.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				sl.flush(context.Background())
+				return
+			case <-flush.C:
+				sl.flush(ctx)
+			case <-refresh.C:
+				if err := sl.Load(ctx); err != nil {
+					log.Printf("Keeping previous syslog sources: %v", err)
+				}
+			}
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}()
+	return &wg, nil
+}
+
+func (sl *SyslogListener) receiveUDP(ctx context.Context, conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, remote, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Syslog udp read failed: %v", err)
+			continue
+		}
+		var sender net.IP
+		if udpAddr, ok := remote.(*net.UDPAddr); ok {
+			sender = udpAddr.IP
+		}
+		sl.ingest(ctx, "udp", sender, bytes.TrimRight(buf[:n], "\r\n\x00"))
+	}
+}
+
+// receiveStream reads messages framed by octet counting (RFC 6587), as TLS senders do, or
+// terminated by newlines
+func (sl *SyslogListener) receiveStream(ctx context.Context, transport string, conn net.Conn) {
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	var sender net.IP
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		sender = tcpAddr.IP
+	}
+	reader := bufio.NewReaderSize(conn, maxSyslogMessageBytes)
+	for {
+		message, err := readSyslogFrame(reader)
+		if len(message) > 0 {
+			sl.ingest(ctx, transport, sender, message)
+		}
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Syslog %s connection from %s failed: %v", transport, conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// readSyslogFrame returns the next message of a stream; oversized newline-terminated messages
+// are skipped
+func readSyslogFrame(reader *bufio.Reader) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] >= '1' && first[0] <= '9' {
+		prefix, err := reader.ReadString(' ')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(prefix))
+		if err != nil || length > maxSyslogMessageBytes {
+			return nil, fmt.Errorf("invalid octet count %q", strings.TrimSpace(prefix))
+		}
+		message := make([]byte, length)
+		if _, err := io.ReadFull(reader, message); err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(message, "\r\n"), nil
+	}
+
+	line, err := reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		for errors.Is(err, bufio.ErrBufferFull) {
+			_, err = reader.ReadSlice('\n')
+		}
+		return nil, err
+	}
+	return append([]byte(nil), bytes.TrimRight(line, "\r\n\x00")...), err
+}
+
+// ingest parses a message with its sender's source and queues the event
+func (sl *SyslogListener) ingest(ctx context.Context, transport string, sender net.IP, message []byte) {
+	if len(message) == 0 {
+		return
+	}
+	source := sl.sources.Load().match(sender)
+	if source == nil {
+		syslogMessages.WithLabelValues(transport, "unregistered").Inc()
+		sl.mu.Lock()
+		sl.unregistered++
+		sl.mu.Unlock()
+		return
+	}
+
+	event, err := parseSyslogMessage(message, source, time.Now().UTC())
+	sl.recordSender(sender.String(), source.ID, transport, err)
+	if err != nil {
+		syslogMessages.WithLabelValues(transport, "failed").Inc()
+		return
+	}
+	syslogMessages.WithLabelValues(transport, "parsed").Inc()
+
+	sl.mu.Lock()
+	sl.pending = append(sl.pending, event)
+	full := len(sl.pending) >= maxSyslogBatch
+	sl.mu.Unlock()
+	if full {
+		sl.flush(ctx)
+	}
+}
+
+func (sl *SyslogListener) recordSender(address, source, transport string, err error) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	status, ok := sl.senders[address]
+	if !ok {
+		if len(sl.senders) >= maxSyslogSenders {
+			return
+		}
+		status = &SyslogSenderStatus{Address: address}
+		sl.senders[address] = status
+	}
+	status.Source, status.Transport = source, transport
+	status.Messages++
+	status.LastSeen = time.Now().UTC()
+	if err != nil {
+		status.Errors++
+		status.LastError = err.Error()
+	}
+}
+
+func (sl *SyslogListener) flush(ctx context.Context) {
+	sl.mu.Lock()
+	events := sl.pending
+	sl.pending = nil
+	sl.mu.Unlock()
+	if len(events) == 0 {
+		return
+	}
+
+	threats := sl.detector.analyzeStream(ctx, "syslog", nil, events)
+	pushIndicators(ctx, sl.redis, syslogIndicatorsKey, threats)
+}
+
+// Load replaces the source snapshot with the sources stored in Redis
+func (sl *SyslogListener) Load(ctx context.Context) error {
+	sources, err := sl.Sources(ctx)
+	if err != nil {
+		return err
+	}
+	snapshot := make(syslogSources, 0, len(sources))
+	for i := range sources {
+		if sources[i].validate() == nil {
+			snapshot = append(snapshot, &sources[i])
+		}
+	}
+	sort.SliceStable(snapshot, func(i, j int) bool {
+		a, _ := snapshot[i].network.Mask.Size()
+		b, _ := snapshot[j].network.Mask.Size()
+		return a > b
+	})
+	sl.sources.Store(&snapshot)
+	return nil
+}
+
+// Sources lists the registered sources by ID
+func (sl *SyslogListener) Sources(ctx context.Context) ([]SyslogSource, error) {
+	stored, err := sl.redis.HGetAll(ctx, syslogSourcesKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load syslog sources: %w", err)
+	}
+	sources := make([]SyslogSource, 0, len(stored))
+	for _, data := range stored {
+		var source SyslogSource
+		if json.Unmarshal([]byte(data), &source) == nil {
+			sources = append(sources, source)
+		}
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].ID < sources[j].ID })
+	return sources, nil
+}
+
+// SaveSource validates and stores a source, replacing the one with its ID; this replica uses it
+// at once and the others within syslogRefreshInterval
+func (sl *SyslogListener) SaveSource(ctx context.Context, source SyslogSource) (*SyslogSource, error) {
+	if err := source.validate(); err != nil {
+		return nil, err
+	}
+	if count, err := sl.redis.HLen(ctx, syslogSourcesKey).Result(); err == nil && count >= maxSyslogSources {
+		if exists, _ := sl.redis.HExists(ctx, syslogSourcesKey, source.ID).Result(); !exists {
+			return nil, fmt.Errorf("%w: at most %d sources", errInvalidSyslogSource, maxSyslogSources)
+		}
+	}
+	source.UpdatedAt = time.Now().UTC()
+	data, err := json.Marshal(source)
+	if err != nil {
+		return nil, err
+	}
+	if err := sl.redis.HSet(ctx, syslogSourcesKey, source.ID, data).Err(); err != nil {
+		return nil, fmt.Errorf("failed to store syslog source: %w", err)
+	}
+	if err := sl.Load(ctx); err != nil {
+		log.Printf("Syslog sources not reloaded: %v", err)
+	}
+	return &source, nil
+}
+
+func (sl *SyslogListener) DeleteSource(ctx context.Context, id string) error {
+	removed, err := sl.redis.HDel(ctx, syslogSourcesKey, id).Result()
+	if err != nil {
+		return fmt.Errorf("failed to delete syslog source: %w", err)
+	}
+	if removed == 0 {
+		return errSyslogSourceNotFound
+	}
+	if err := sl.Load(ctx); err != nil {
+		log.Printf("Syslog sources not reloaded: %v", err)
+	}
+	return nil
+}
+
+// Status reports the listeners, senders, and the most recent indicators
+func (sl *SyslogListener) Status(ctx context.Context, limit int) (*SyslogStatus, error) {
+	status := &SyslogStatus{Enabled: sl.Enabled(), Listeners: sl.listeners, Senders: make([]SyslogSenderStatus, 0)}
+	sl.mu.Lock()
+	for _, sender := range sl.senders {
+		status.Senders = append(status.Senders, *sender)
+	}
+	status.Unregistered = sl.unregistered
+	sl.mu.Unlock()
+	sort.Slice(status.Senders, func(i, j int) bool { return status.Senders[i].Address < status.Senders[j].Address })
+
+	indicators, err := recentIndicators(ctx, sl.redis, syslogIndicatorsKey, limit)
+	if err != nil {
+		return nil, err
+	}
+	status.Indicators = indicators
+	return status, nil
+}
+
+// parseSyslogMessage turns a message into a log event with the source's parser and field map.
+// Syslog header values become syslog_* fields and the free text becomes message.
+func parseSyslogMessage(data []byte, source *SyslogSource, received time.Time) (LogEvent, error) {
+	text := string(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	event := LogEvent{
+		Timestamp: received,
+		LogSource: LogSource{Category: source.Category, Product: source.Product, Service: source.Service},
+		Fields:    make(map[string]interface{}),
+	}
+
+	body := text
+	if strings.HasPrefix(text, "<") {
+		var err error
+		body, err = parseSyslogHeader(text, source.Parser, received, &event)
+		if err != nil {
+			return event, err
+		}
+	} else if source.Parser == ParserRFC5424 || source.Parser == ParserRFC3164 {
+		return event, fmt.Errorf("%w: no <PRI> header", errUnparsableSyslog)
+	}
+	event.Fields["message"] = body
+
+	parser := source.Parser
+	if parser == ParserAuto {
+		switch {
+		case strings.Contains(body, "CEF:"):
+			parser = ParserCEF
+		case strings.HasPrefix(strings.TrimSpace(body), "{"):
+			parser = ParserJSON
+		case len(kvPair.FindAllStringIndex(body, 2)) == 2:
+			parser = ParserKV
+		}
+	}
+	switch parser {
+	case ParserCEF:
+		if err := parseCEF(body, &event); err != nil {
+			return event, err
+		}
+	case ParserJSON:
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &fields); err != nil {
+			return event, fmt.Errorf("%w: %v", errUnparsableSyslog, err)
+		}
+		for key, value := range fields {
+			event.Fields[key] = value
+		}
+	case ParserKV:
+		for _, pair := range kvPair.FindAllStringSubmatch(body, -1) {
+			value := pair[2]
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+			event.Fields[pair[1]] = value
+		}
+	}
+
+	for from, to := range source.FieldMap {
+		if value, ok := lookupField(event.Fields, from); ok {
+			event.Fields[to] = value
+		}
+	}
+	return event, nil
+}
+
+// parseSyslogHeader reads the <PRI> and the RFC 5424 or RFC 3164 header into event and returns
+// the message text
+func parseSyslogHeader(text string, parser SyslogParser, received time.Time, event *LogEvent) (string, error) {
+	end := strings.IndexByte(text, '>')
+	priority, err := strconv.Atoi(text[1:max(end, 1)])
+	if end < 2 || end > 4 || err != nil || priority > 191 {
+		return "", fmt.Errorf("%w: invalid <PRI>", errUnparsableSyslog)
+	}
+	event.Fields["syslog_facility"] = priority / 8
+	event.Fields["syslog_severity"] = priority % 8
+	rest := text[end+1:]
+
+	if strings.HasPrefix(rest, "1 ") && parser != ParserRFC3164 {
+		return parseRFC5424(rest[2:], event)
+	}
+	if parser == ParserRFC5424 {
+		return "", fmt.Errorf("%w: not an RFC 5424 message", errUnparsableSyslog)
+	}
+
+	// RFC 3164: "Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG", leniently; many devices drop parts
+	if len(rest) >= 16 && rest[15] == ' ' {
+		if timestamp, err := time.ParseInLocation(time.Stamp, rest[:15], time.UTC); err == nil {
+			timestamp = timestamp.AddDate(received.Year(), 0, 0)
+			if timestamp.After(received.Add(24 * time.Hour)) {
+				timestamp = timestamp.AddDate(-1, 0, 0)
+			}
+			event.Timestamp = timestamp
+			rest = rest[16:]
+			if host, after, ok := strings.Cut(rest, " "); ok && !strings.HasSuffix(host, ":") {
+				event.Fields["syslog_host"] = host
+				rest = after
+			}
+		}
+	}
+	if tag := syslogTag.FindStringSubmatch(rest); tag != nil && !strings.HasPrefix(rest, "CEF:") {
+		event.Fields["syslog_app"] = tag[1]
+		if tag[2] != "" {
+			event.Fields["syslog_procid"] = tag[2]
+		}
+		rest = rest[len(tag[0]):]
+	}
+	return rest, nil
+}
+
+// parseRFC5424 reads "TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]". Structured
+// data parameters become "<sd-id>.<param>" fields.
+func parseRFC5424(header string, event *LogEvent) (string, error) {
+	parts := strings.SplitN(header, " ", 6)
+	if len(parts) < 6 {
+		return "", fmt.Errorf("%w: truncated RFC 5424 header", errUnparsableSyslog)
+	}
+	if parts[0] != "-" {
+		timestamp, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid timestamp %q", errUnparsableSyslog, parts[0])
+		}
+		event.Timestamp = timestamp.UTC()
+	}
+	for i, name := range []string{"syslog_host", "syslog_app", "syslog_procid", "syslog_msgid"} {
+		if parts[i+1] != "-" {
+			event.Fields[name] = parts[i+1]
+		}
+	}
+
+	rest := parts[5]
+	if strings.HasPrefix(rest, "-") {
+		return strings.TrimPrefix(strings.TrimPrefix(rest, "-"), " "), nil
+	}
+	for strings.HasPrefix(rest, "[") {
+		end := -1
+		for i, quoted := 1, false; i < len(rest); i++ {
+			switch {
+			case rest[i] == '\\':
+				i++
+			case rest[i] == '"':
+				quoted = !quoted
+			case rest[i] == ']' && !quoted:
+				end = i
+			}
+			if end >= 0 {
+				break
+			}
+		}
+		if end < 0 {
+			return "", fmt.Errorf("%w: unterminated structured data", errUnparsableSyslog)
+		}
+		element := rest[1:end]
+		id, params, _ := strings.Cut(element, " ")
+		for _, param := range kvPair.FindAllStringSubmatch(params, -1) {
+			value := strings.Trim(param[2], `"`)
+			value = strings.NewReplacer(`\"`, `"`, `\\`, `\`, `\]`, `]`).Replace(value)
+			event.Fields[id+"."+param[1]] = value
+		}
+		rest = rest[end+1:]
+	}
+	return strings.TrimPrefix(rest, " "), nil
+}
+
+// parseCEF reads "CEF:Version|Vendor|Product|Version|Signature ID|Name|Severity|Extension" from
+// the message text. Extension keys are kept and mapped to normalized names; cs1-cs6 and other
+// labeled custom fields are also stored under their labels.
+func parseCEF(body string, event *LogEvent) error {
+	start := strings.Index(body, "CEF:")
+	if start < 0 {
+		return fmt.Errorf("%w: no CEF header", errUnparsableSyslog)
+	}
+	header := make([]string, 0, 8)
+	var current strings.Builder
+	text := body[start+4:]
+	i := 0
+	for ; i < len(text) && len(header) < 7; i++ {
+		switch {
+		case text[i] == '\\' && i+1 < len(text) && (text[i+1] == '|' || text[i+1] == '\\'):
+			current.WriteByte(text[i+1])
+			i++
+		case text[i] == '|':
+			header = append(header, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(text[i])
+		}
+	}
+	if len(header) < 7 {
+		return fmt.Errorf("%w: CEF header needs 7 fields", errUnparsableSyslog)
+	}
+	for j, name := range []string{"cef_version", "cef_vendor", "cef_product", "cef_device_version", "cef_signature_id", "cef_name", "cef_severity"} {
+		event.Fields[name] = header[j]
+	}
+	event.Fields["message"] = header[5]
+
+	extension := text[i:]
+	matches := cefExtensionKey.FindAllStringSubmatchIndex(extension, -1)
+	values := make(map[string]string, len(matches))
+	for j, match := range matches {
+		end := len(extension)
+		if j+1 < len(matches) {
+			end = matches[j+1][0]
+		}
+		key := extension[match[2]:match[3]]
+		values[key] = strings.NewReplacer(`\=`, "=", `\\`, `\`, `\n`, "\n", `\r`, "\r").Replace(strings.TrimSpace(extension[match[1]:end]))
+	}
+	for key, value := range values {
+		event.Fields[key] = value
+		if normalized, ok := cefFieldNames[key]; ok {
+			event.Fields[normalized] = value
+		}
+		if label := values[key+"Label"]; label != "" {
+			event.Fields[label] = value
+		}
+	}
+	if received, ok := values["rt"]; ok {
+		if millis, err := strconv.ParseInt(received, 10, 64); err == nil {
+			event.Timestamp = time.UnixMilli(millis).UTC()
+		} else if timestamp, err := time.Parse("Jan 02 2006 15:04:05", received); err == nil {
+			event.Timestamp = timestamp.UTC()
+		}
+	}
+	return nil
+}
+
+// HTTP Handlers
+func (s *APIServer) syslogStatusHandler(c *gin.Context) {
+	status, err := s.syslog.Status(c.Request.Context(), 100)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+func (s *APIServer) listSyslogSourcesHandler(c *gin.Context) {
+	sources, err := s.syslog.Sources(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sources": sources, "count": len(sources)})
+}
+
+func (s *APIServer) saveSyslogSourceHandler(c *gin.Context) {
+	var source SyslogSource
+	if err := c.ShouldBindJSON(&source); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	source.ID = c.Param("id")
+
+	saved, err := s.syslog.SaveSource(c.Request.Context(), source)
+	switch {
+	case errors.Is(err, errInvalidSyslogSource):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, saved)
+	}
+}
+
+func (s *APIServer) deleteSyslogSourceHandler(c *gin.Context) {
+	err := s.syslog.DeleteSource(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, errSyslogSourceNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// parseSyslogHandler shows the event a message would become, with a registered source's
+// settings or with settings given in the request, without analyzing it
+func (s *APIServer) parseSyslogHandler(c *gin.Context) {
+	var req struct {
+		Message  string        `json:"message" binding:"required"`
+		SourceID string        `json:"source_id"`
+		Source   *SyslogSource `json:"source"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	source := &SyslogSource{ID: "test", Address: "0.0.0.0/0"}
+	switch {
+	case req.Source != nil:
+		source = req.Source
+		source.ID, source.Address = "test", "0.0.0.0/0"
+	case req.SourceID != "":
+		source = nil
+		for _, registered := range *s.syslog.sources.Load() {
+			if registered.ID == req.SourceID {
+				source = registered
+			}
+		}
+		if source == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": errSyslogSourceNotFound.Error()})
+			return
+		}
+	}
+	if err := source.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	event, err := parseSyslogMessage([]byte(req.Message), source, time.Now().UTC())
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, event)
+}
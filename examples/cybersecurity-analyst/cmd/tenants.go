@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// Multi-tenant isolation
+const (
+	defaultTenant         = "default" // the operator's own tenant; its data keeps the unprefixed keys
+	tenantHeader          = "X-Tenant-ID"
+	tenantsKey            = "tenants" // hash of tenant ID -> Tenant JSON
+	tenantKeyPrefix       = "tenant:" // every key holding a tenant's data starts with "tenant:<id>:"
+	tenantRefreshInterval = 30 * time.Second
+)
+
+var (
+	errInvalidTenant  = errors.New("invalid tenant")
+	errTenantNotFound = errors.New("tenant not found")
+	errTenantConflict = errors.New("tenant already exists")
+	errOperatorOnly   = errors.New("this endpoint is only available to the operator tenant")
+	errOperatorAnon   = errors.New("operator endpoints need API_KEYS or JWT_SECRET to be configured")
+
+	tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+)
+
+type tenantContextKey struct{}
+
+// withTenant returns a context whose detection, storage, and caching are scoped to the tenant
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// tenantFromContext returns the context's tenant; work started by the service itself, such as
+// live capture and flow collection, belongs to the default tenant
+func tenantFromContext(ctx context.Context) string {
+	if tenant, ok := ctx.Value(tenantContextKey{}).(string); ok && tenant != "" {
+		return tenant
+	}
+	return defaultTenant
+}
+
+// tenantKey namespaces a Redis key by the context's tenant, so one tenant's data can never be
+// read or overwritten through another tenant's keys
+func tenantKey(ctx context.Context, key string) string {
+	if tenant := tenantFromContext(ctx); tenant != defaultTenant {
+		return tenantKeyPrefix + tenant + ":" + key
+	}
+	return key
+}
+
+// tenantField is the tenant recorded on data kept in shared keys, such as alerts; it is empty for
+// the default tenant so records written before tenants existed stay visible to it
+func tenantField(ctx context.Context) string {
+	if tenant := tenantFromContext(ctx); tenant != defaultTenant {
+		return tenant
+	}
+	return ""
+}
+
+// Tenant is a customer served from this instance. Its findings, assets, schedules, lists,
+// alerts, and reports are kept apart from every other tenant's; shared signatures and Sigma rules
+// apply to all tenants unless disabled, alongside the tenant's own signatures.
+type Tenant struct {
+	ID                  string            `json:"id"`
+	Name                string            `json:"name,omitempty"`
+	MinConfidence       float64           `json:"min_confidence,omitempty"`        // indicators below this confidence are dropped
+	AlertMinSeverity    ThreatLevel       `json:"alert_min_severity,omitempty"`    // replaces ALERT_MIN_SEVERITY for the tenant
+	DisabledSignatures  []string          `json:"disabled_signatures,omitempty"`   // shared packet signatures not applied
+	Signatures          []ThreatSignature `json:"signatures,omitempty"`            // applied to the tenant's traffic only
+	ScanAllowedNetworks []string          `json:"scan_allowed_networks,omitempty"` // CIDRs nmap may scan for the tenant; none when empty
+	CreatedAt           time.Time         `json:"created_at"`
+	UpdatedAt           time.Time         `json:"updated_at"`
+}
+
+// tenantState is a tenant with its signatures compiled
+type tenantState struct {
+	Tenant
+	disabled     map[string]bool
+	index        *signatureIndex
+	scanNetworks []*net.IPNet
+}
+
+func newTenantState(tenant Tenant) *tenantState {
+	state := &tenantState{Tenant: tenant, disabled: make(map[string]bool)}
+	for _, id := range tenant.DisabledSignatures {
+		state.disabled[id] = true
+	}
+	signatures := make(map[string]ThreatSignature, len(tenant.Signatures))
+	for _, sig := range tenant.Signatures {
+		signatures[sig.ID] = sig
+	}
+	var invalid map[string]error
+	state.index, invalid = buildSignatureIndex(signatures)
+	for id, err := range invalid {
+		log.Printf("Signature %s of tenant %s disabled: %v", id, tenant.ID, err)
+	}
+	networks, err := parseScanNetworks(tenant.ScanAllowedNetworks)
+	if err != nil {
+		log.Printf("Scanning disabled for tenant %s: invalid scan_allowed_networks: %v", tenant.ID, err)
+	}
+	state.scanNetworks = networks
+	return state
+}
+
+// TenantRegistry holds the registered tenants. Lookups are served from an in-memory snapshot,
+// reloaded after every change and every tenantRefreshInterval to pick up changes made through
+// other replicas.
+type TenantRegistry struct {
+	redis   *redis.Client
+	tenants atomic.Pointer[map[string]*tenantState]
+	mu      sync.Mutex // serializes changes so a reload never undoes a newer one
+}
+
+func NewTenantRegistry(redisClient *redis.Client) *TenantRegistry {
+	tr := &TenantRegistry{redis: redisClient}
+	tr.tenants.Store(&map[string]*tenantState{})
+	return tr
+}
+
+// Start reloads the tenants periodically until ctx is cancelled
+func (tr *TenantRegistry) Start(ctx context.Context) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(tenantRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := tr.Load(ctx); err != nil {
+					log.Printf("Keeping previous tenants: %v", err)
+				}
+			}
+		}
+	}()
+	return &wg
+}
+
+// Load replaces the snapshot with the tenants stored in Redis
+func (tr *TenantRegistry) Load(ctx context.Context) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.load(ctx)
+}
+
+func (tr *TenantRegistry) load(ctx context.Context) error {
+	items, err := tr.redis.HGetAll(ctx, tenantsKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to load tenants: %w", err)
+	}
+	tenants := make(map[string]*tenantState, len(items))
+	for id, item := range items {
+		var tenant Tenant
+		if err := json.Unmarshal([]byte(item), &tenant); err != nil {
+			log.Printf("Skipping invalid tenant %s: %v", id, err)
+			continue
+		}
+		tenants[id] = newTenantState(tenant)
+	}
+	tr.tenants.Store(&tenants)
+	return nil
+}
+
+// Exists reports whether a tenant is the default tenant or registered
+func (tr *TenantRegistry) Exists(id string) bool {
+	if id == defaultTenant {
+		return true
+	}
+	_, ok := (*tr.tenants.Load())[id]
+	return ok
+}
+
+// state returns the context's registered tenant, or nil for the default tenant
+func (tr *TenantRegistry) state(ctx context.Context) *tenantState {
+	if tr == nil {
+		return nil
+	}
+	return (*tr.tenants.Load())[tenantFromContext(ctx)]
+}
+
+// IDs returns the default tenant followed by the registered tenants, sorted
+func (tr *TenantRegistry) IDs() []string {
+	tenants := *tr.tenants.Load()
+	ids := make([]string, 0, len(tenants)+1)
+	for id := range tenants {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return append([]string{defaultTenant}, ids...)
+}
+
+// Tenants lists the registered tenants, sorted by ID
+func (tr *TenantRegistry) Tenants() []Tenant {
+	tenants := *tr.tenants.Load()
+	list := make([]Tenant, 0, len(tenants))
+	for _, state := range tenants {
+		list = append(list, state.Tenant)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (tr *TenantRegistry) Tenant(id string) (*Tenant, bool) {
+	state, ok := (*tr.tenants.Load())[id]
+	if !ok {
+		return nil, false
+	}
+	tenant := state.Tenant
+	return &tenant, true
+}
+
+// Apply drops indicators below the tenant's confidence threshold and records the tenant on the
+// rest, so SIEMs and alert channels shared by all tenants can tell them apart
+func (tr *TenantRegistry) Apply(ctx context.Context, threats []ThreatIndicator) []ThreatIndicator {
+	state := tr.state(ctx)
+	if state == nil {
+		return threats
+	}
+	kept := threats[:0]
+	for _, threat := range threats {
+		if threat.Confidence < state.MinConfidence {
+			continue
+		}
+		threat.Tenant = state.ID
+		kept = append(kept, threat)
+	}
+	return kept
+}
+
+// SaveTenant stores a tenant, replacing an existing one unless create is set. Its signatures must
+// already have been validated.
+func (tr *TenantRegistry) SaveTenant(ctx context.Context, tenant Tenant, create bool) (*Tenant, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	now := time.Now().UTC()
+	tenant.UpdatedAt = now
+	tenant.CreatedAt = now
+	if existing, ok := (*tr.tenants.Load())[tenant.ID]; ok {
+		if create {
+			return nil, fmt.Errorf("%w: %s", errTenantConflict, tenant.ID)
+		}
+		tenant.CreatedAt = existing.CreatedAt
+	} else if !create {
+		return nil, errTenantNotFound
+	}
+
+	data, err := json.Marshal(tenant)
+	if err != nil {
+		return nil, err
+	}
+	if create {
+		created, err := tr.redis.HSetNX(ctx, tenantsKey, tenant.ID, data).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to store tenant: %w", err)
+		}
+		if !created {
+			return nil, fmt.Errorf("%w: %s", errTenantConflict, tenant.ID)
+		}
+	} else if err := tr.redis.HSet(ctx, tenantsKey, tenant.ID, data).Err(); err != nil {
+		return nil, fmt.Errorf("failed to store tenant: %w", err)
+	}
+
+	if err := tr.load(ctx); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return &tenant, nil
+}
+
+// DeleteTenant removes a tenant along with every key holding its data
+func (tr *TenantRegistry) DeleteTenant(ctx context.Context, id string) (bool, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	removed, err := tr.redis.HDel(ctx, tenantsKey, id).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete tenant: %w", err)
+	}
+	if removed == 0 {
+		return false, nil
+	}
+	if err := tr.load(ctx); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	iter := tr.redis.Scan(ctx, 0, tenantKeyPrefix+id+":*", 500).Iterator()
+	keys := make([]string, 0, 500)
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == cap(keys) {
+			if err := tr.redis.Unlink(ctx, keys...).Err(); err != nil {
+				return true, fmt.Errorf("failed to delete tenant data: %w", err)
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return true, fmt.Errorf("failed to delete tenant data: %w", err)
+	}
+	if len(keys) > 0 {
+		if err := tr.redis.Unlink(ctx, keys...).Err(); err != nil {
+			return true, fmt.Errorf("failed to delete tenant data: %w", err)
+		}
+	}
+	return true, nil
+}
+
+// validateTenant checks a tenant's settings and signatures. Tenant signatures may not reuse the
+// ID of a shared signature, and only shared packet signatures can be disabled.
+func (td *ThreatDetector) validateTenant(tenant *Tenant) error {
+	if !tenantIDPattern.MatchString(tenant.ID) {
+		return fmt.Errorf("%w: id must be 1-63 lowercase letters, digits, '_', or '-'", errInvalidTenant)
+	}
+	if tenant.ID == defaultTenant {
+		return fmt.Errorf("%w: the default tenant is built in", errInvalidTenant)
+	}
+	if tenant.MinConfidence < 0 || tenant.MinConfidence > 1 {
+		return fmt.Errorf("%w: min_confidence must be between 0 and 1", errInvalidTenant)
+	}
+	if tenant.AlertMinSeverity != "" && !validThreatLevels[tenant.AlertMinSeverity] {
+		return fmt.Errorf("%w: unknown alert_min_severity %q", errInvalidTenant, tenant.AlertMinSeverity)
+	}
+	if _, err := parseScanNetworks(tenant.ScanAllowedNetworks); err != nil {
+		return fmt.Errorf("%w: scan_allowed_networks %v", errInvalidTenant, err)
+	}
+
+	shared := context.Background()
+	for _, id := range tenant.DisabledSignatures {
+		if sig, ok := td.Signature(shared, id); ok && (sig.Scope == ScopeLog || sig.Scope == ScopeBehavioral) {
+			return fmt.Errorf("%w: %s is a %s signature; only packet signatures can be disabled", errInvalidTenant, id, sig.Scope)
+		}
+	}
+	seen := make(map[string]bool)
+	for i := range tenant.Signatures {
+		sig := &tenant.Signatures[i]
+		if err := normalizeSignature(sig); err != nil {
+			return fmt.Errorf("%w: signature %q: %v", errInvalidTenant, sig.ID, err)
+		}
+		if _, exists := td.Signature(shared, sig.ID); exists || seen[sig.ID] {
+			return fmt.Errorf("%w: signature id %s is already in use", errInvalidTenant, sig.ID)
+		}
+		seen[sig.ID] = true
+	}
+	return nil
+}
+
+// requireOperator limits a route to the default tenant: sensors, SIEM and SOAR integrations, and
+// the shared signature set serve every tenant and are managed by the operator. Without
+// authentication configured every caller would land in the default tenant, so anonymous callers
+// are refused.
+func requireOperator() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if clientFromContext(c).Method == "anonymous" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": errOperatorAnon.Error()})
+			return
+		}
+		if tenantFromContext(c.Request.Context()) != defaultTenant {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": errOperatorOnly.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// HTTP Handlers
+func (s *APIServer) listTenantsHandler(c *gin.Context) {
+	tenants := s.threatDetector.tenants.Tenants()
+	c.JSON(http.StatusOK, gin.H{"tenants": tenants, "count": len(tenants)})
+}
+
+func (s *APIServer) getTenantHandler(c *gin.Context) {
+	tenant, ok := s.threatDetector.tenants.Tenant(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tenant)
+}
+
+func (s *APIServer) createTenantHandler(c *gin.Context) {
+	var tenant Tenant
+	if err := c.ShouldBindJSON(&tenant); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.saveTenant(c, tenant, true, http.StatusCreated)
+}
+
+func (s *APIServer) updateTenantHandler(c *gin.Context) {
+	var tenant Tenant
+	if err := c.ShouldBindJSON(&tenant); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if tenant.ID != "" && tenant.ID != c.Param("id") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tenant id does not match the URL"})
+		return
+	}
+	tenant.ID = c.Param("id")
+
+	s.saveTenant(c, tenant, false, http.StatusOK)
+}
+
+func (s *APIServer) saveTenant(c *gin.Context, tenant Tenant, create bool, status int) {
+	err := s.threatDetector.validateTenant(&tenant)
+	var saved *Tenant
+	if err == nil {
+		saved, err = s.threatDetector.tenants.SaveTenant(c.Request.Context(), tenant, create)
+	}
+	switch {
+	case errors.Is(err, errInvalidTenant):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errTenantNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+	case errors.Is(err, errTenantConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(status, saved)
+	}
+}
+
+func (s *APIServer) deleteTenantHandler(c *gin.Context) {
+	id := c.Param("id")
+	found, err := s.threatDetector.tenants.DeleteTenant(c.Request.Context(), id)
+	if err == nil && found {
+		err = s.threatDetector.alerts.purgeTenant(c.Request.Context(), id)
+	}
+	switch {
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case !found:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+	default:
+		s.threatDetector.lists.forget(id)
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TLS ClientHello fingerprinting (JA3 and JA4)
+const (
+	maxTLSClients           = 1000 // distinct ClientHellos reported per analysis
+	maxTLSImportBytes       = 16 << 20
+	tlsExtServerName        = 0x0000
+	tlsExtSupportedGroups   = 0x000a
+	tlsExtECPointFormats    = 0x000b
+	tlsExtSignatureAlgs     = 0x000d
+	tlsExtALPN              = 0x0010
+	tlsExtSupportedVersions = 0x002b
+)
+
+var (
+	ja3Pattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	ja4Pattern = regexp.MustCompile(`^[tqd](13|12|11|10|s3|s2|d1|d2|d3|00)[di][0-9]{4}[0-9a-z]{2}_[0-9a-f]{12}_[0-9a-f]{12}$`)
+)
+
+var tlsVersionNames = map[uint16]string{
+	0x0304: "TLS 1.3", 0x0303: "TLS 1.2", 0x0302: "TLS 1.1", 0x0301: "TLS 1.0", 0x0300: "SSL 3.0",
+}
+
+var ja4Versions = map[uint16]string{
+	0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3", 0x0002: "s2",
+	0xfeff: "d1", 0xfefd: "d2", 0xfefc: "d3",
+}
+
+// TLSClientHello is a fingerprinted ClientHello; repeats on the same connection tuple are counted
+type TLSClientHello struct {
+	SourceIP   string   `json:"source_ip"`
+	DestIP     string   `json:"dest_ip"`
+	DestPort   int      `json:"dest_port"`
+	ServerName string   `json:"server_name,omitempty"`
+	ALPN       []string `json:"alpn,omitempty"`
+	Version    string   `json:"version"` // highest version offered
+	JA3        string   `json:"ja3"`
+	JA3Full    string   `json:"ja3_full"` // the string hashed into JA3
+	JA4        string   `json:"ja4"`
+	Count      int      `json:"count"`
+}
+
+type clientHello struct {
+	version           uint16
+	ciphers           []uint16
+	extensions        []uint16
+	groups            []uint16
+	pointFormats      []uint8
+	signatureAlgs     []uint16
+	supportedVersions []uint16
+	serverName        string
+	alpn              []string
+}
+
+// tlsReader reads big-endian fields, failing once the data runs short
+type tlsReader struct {
+	data []byte
+	ok   bool
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if !r.ok || n > len(r.data) {
+		r.ok = false
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tlsReader) u8() int {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *tlsReader) u16() int {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])<<8 | int(b[1])
+}
+
+func (r *tlsReader) u24() int {
+	b := r.bytes(3)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+// vec8 and vec16 read a length-prefixed vector
+func (r *tlsReader) vec8() *tlsReader {
+	return &tlsReader{data: r.bytes(r.u8()), ok: r.ok}
+}
+
+func (r *tlsReader) vec16() *tlsReader {
+	return &tlsReader{data: r.bytes(r.u16()), ok: r.ok}
+}
+
+func (r *tlsReader) u16s() []uint16 {
+	values := make([]uint16, 0, len(r.data)/2)
+	for r.ok && len(r.data) >= 2 {
+		values = append(values, uint16(r.u16()))
+	}
+	return values
+}
+
+// isGREASE reports the reserved values clients send to keep servers tolerant (RFC 8701);
+// both fingerprints ignore them
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	kept := make([]uint16, 0, len(values))
+	for _, value := range values {
+		if !isGREASE(value) {
+			kept = append(kept, value)
+		}
+	}
+	return kept
+}
+
+// parseClientHello parses a TLS record holding a complete ClientHello. ClientHellos split across
+// TCP segments are not reassembled.
+func parseClientHello(payload []byte) (*clientHello, bool) {
+	if len(payload) < 9 || payload[0] != 0x16 || payload[1] != 0x03 || payload[5] != 0x01 {
+		return nil, false
+	}
+	record := &tlsReader{data: payload[5:], ok: true}
+	record.u8() // handshake type
+	body := &tlsReader{data: record.bytes(record.u24()), ok: record.ok}
+
+	hello := &clientHello{version: uint16(body.u16())}
+	body.bytes(32) // random
+	body.vec8()    // session ID
+	hello.ciphers = body.vec16().u16s()
+	body.vec8() // compression methods
+	if !body.ok {
+		return nil, false
+	}
+	if len(body.data) == 0 {
+		return hello, true
+	}
+
+	extensions := body.vec16()
+	for extensions.ok && len(extensions.data) > 0 {
+		extType := uint16(extensions.u16())
+		data := extensions.vec16()
+		if !extensions.ok {
+			break
+		}
+		hello.extensions = append(hello.extensions, extType)
+
+		switch extType {
+		case tlsExtServerName:
+			names := data.vec16()
+			for names.ok && len(names.data) > 0 {
+				nameType := names.u8()
+				name := names.vec16()
+				if nameType == 0 && name.ok {
+					hello.serverName = strings.ToLower(string(name.data))
+					break
+				}
+			}
+		case tlsExtSupportedGroups:
+			hello.groups = data.vec16().u16s()
+		case tlsExtECPointFormats:
+			formats := data.vec8()
+			if formats.ok {
+				hello.pointFormats = append([]uint8(nil), formats.data...)
+			}
+		case tlsExtSignatureAlgs:
+			hello.signatureAlgs = data.vec16().u16s()
+		case tlsExtALPN:
+			protocols := data.vec16()
+			for protocols.ok && len(protocols.data) > 0 {
+				if protocol := protocols.vec8(); protocol.ok {
+					hello.alpn = append(hello.alpn, string(protocol.data))
+				}
+			}
+		case tlsExtSupportedVersions:
+			hello.supportedVersions = data.vec8().u16s()
+		}
+	}
+	return hello, extensions.ok
+}
+
+// maxVersion is the highest version offered, from supported_versions when the client sends it
+func (h *clientHello) maxVersion() uint16 {
+	version := h.version
+	if versions := withoutGREASE(h.supportedVersions); len(versions) > 0 {
+		version = 0
+		for _, v := range versions {
+			if v > version {
+				version = v
+			}
+		}
+	}
+	return version
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = strconv.Itoa(int(value))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = fmt.Sprintf("%04x", value)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ja3 returns the JA3 string and its MD5: version, ciphers, extensions, groups, and point formats
+func (h *clientHello) ja3() (string, string) {
+	formats := make([]uint16, len(h.pointFormats))
+	for i, format := range h.pointFormats {
+		formats[i] = uint16(format)
+	}
+	full := strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		joinDecimal(withoutGREASE(h.ciphers)),
+		joinDecimal(withoutGREASE(h.extensions)),
+		joinDecimal(withoutGREASE(h.groups)),
+		joinDecimal(formats),
+	}, ",")
+	sum := md5.Sum([]byte(full))
+	return full, hex.EncodeToString(sum[:])
+}
+
+func ja4Hash(value string) string {
+	if value == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func isAlphanumeric(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// ja4 returns the JA4 fingerprint of a ClientHello sent over TCP
+func (h *clientHello) ja4() string {
+	version, ok := ja4Versions[h.maxVersion()]
+	if !ok {
+		version = "00"
+	}
+	sni := "i"
+	if h.serverName != "" {
+		sni = "d"
+	}
+	ciphers := withoutGREASE(h.ciphers)
+	extensions := withoutGREASE(h.extensions)
+
+	alpn := "00"
+	if len(h.alpn) > 0 && h.alpn[0] != "" {
+		first, last := h.alpn[0][0], h.alpn[0][len(h.alpn[0])-1]
+		if isAlphanumeric(first) && isAlphanumeric(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			encoded := hex.EncodeToString([]byte(h.alpn[0]))
+			alpn = string([]byte{encoded[0], encoded[len(encoded)-1]})
+		}
+	}
+
+	sortedCiphers := append([]uint16(nil), ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+
+	// Server name and ALPN are already in the first part and are left out of the extension hash
+	hashed := make([]uint16, 0, len(extensions))
+	for _, ext := range extensions {
+		if ext != tlsExtServerName && ext != tlsExtALPN {
+			hashed = append(hashed, ext)
+		}
+	}
+	sort.Slice(hashed, func(i, j int) bool { return hashed[i] < hashed[j] })
+	extensionPart := joinHex(hashed)
+	if algs := withoutGREASE(h.signatureAlgs); len(algs) > 0 && extensionPart != "" {
+		extensionPart += "_" + joinHex(algs)
+	}
+
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s", version, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn,
+		ja4Hash(joinHex(sortedCiphers)), ja4Hash(extensionPart))
+}
+
+// fingerprintClientHello fingerprints a packet carrying a TLS ClientHello
+func fingerprintClientHello(packet NetworkPacket) (*TLSClientHello, bool) {
+	hello, ok := parseClientHello(packet.Payload)
+	if !ok {
+		return nil, false
+	}
+	full, ja3 := hello.ja3()
+	version, ok := tlsVersionNames[hello.maxVersion()]
+	if !ok {
+		version = fmt.Sprintf("0x%04x", hello.maxVersion())
+	}
+	return &TLSClientHello{
+		SourceIP:   packet.SourceIP,
+		DestIP:     packet.DestIP,
+		DestPort:   packet.DestPort,
+		ServerName: hello.serverName,
+		ALPN:       hello.alpn,
+		Version:    version,
+		JA3:        ja3,
+		JA3Full:    full,
+		JA4:        hello.ja4(),
+		Count:      1,
+	}, true
+}
+
+// tlsClientHellos fingerprints the ClientHellos in the packets, one entry per client, server, and
+// fingerprint
+func tlsClientHellos(packets []NetworkPacket) []TLSClientHello {
+	hellos := make([]TLSClientHello, 0)
+	index := make(map[string]int)
+	for _, packet := range packets {
+		hello, ok := fingerprintClientHello(packet)
+		if !ok {
+			continue
+		}
+		key := fmt.Sprintf("%s|%s|%d|%s|%s", hello.SourceIP, hello.DestIP, hello.DestPort, hello.ServerName, hello.JA4+hello.JA3)
+		if i, ok := index[key]; ok {
+			hellos[i].Count++
+			continue
+		}
+		if len(hellos) < maxTLSClients {
+			index[key] = len(hellos)
+			hellos = append(hellos, *hello)
+		}
+	}
+	return hellos
+}
+
+// normalizeTLSFingerprint validates a JA3 MD5 or JA4 fingerprint and returns it in lower case
+func normalizeTLSFingerprint(value string) (string, error) {
+	fingerprint := strings.ToLower(strings.TrimSpace(value))
+	if !ja3Pattern.MatchString(fingerprint) && !ja4Pattern.MatchString(fingerprint) {
+		return "", fmt.Errorf("%q is not a JA3 MD5 or JA4 fingerprint", value)
+	}
+	return fingerprint, nil
+}
+
+// TLSImportReport summarizes a fingerprint list import
+type TLSImportReport struct {
+	Fingerprints int               `json:"fingerprints"`
+	Imported     int               `json:"imported"`
+	Duplicates   int               `json:"duplicates"`
+	ErrorCount   int               `json:"error_count"`
+	Errors       []RuleImportError `json:"errors"`
+}
+
+func (r *TLSImportReport) addError(line int, err error) {
+	r.ErrorCount++
+	if len(r.Errors) < maxReportedRuleErrors {
+		r.Errors = append(r.Errors, RuleImportError{Line: line, Error: err.Error()})
+	}
+}
+
+// ImportTLSFingerprints stores a fingerprint intel list as TLS signatures. Each line holds a JA3
+// MD5 or JA4 fingerprint and, last, the malware family or tool it identifies, as in the abuse.ch
+// SSLBL JA3 list ("ja3_md5,first_seen,last_seen,reason"); lines starting with # are comments.
+// Fingerprints already imported are replaced, so a list can be re-imported as it is updated.
+func (td *ThreatDetector) ImportTLSFingerprints(ctx context.Context, r io.Reader, severity ThreatLevel) (*TLSImportReport, error) {
+	report := &TLSImportReport{Errors: make([]RuleImportError, 0)}
+
+	signatures := make(map[string]ThreatSignature)
+	order := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		report.Fingerprints++
+		fields := strings.Split(line, ",")
+		fingerprint, err := normalizeTLSFingerprint(strings.Trim(fields[0], `" `))
+		if err != nil {
+			report.addError(lineNumber, err)
+			continue
+		}
+		kind := "JA3"
+		if ja4Pattern.MatchString(fingerprint) {
+			kind = "JA4"
+		}
+		description := "Known malicious TLS client (" + kind + ")"
+		if len(fields) > 1 {
+			if family := strings.Trim(fields[len(fields)-1], `" `); family != "" {
+				description = family + " TLS client (" + kind + ")"
+			}
+		}
+
+		id := strings.ToLower(kind) + ":" + fingerprint
+		if _, ok := signatures[id]; ok {
+			report.Duplicates++
+			continue
+		}
+		signatures[id] = ThreatSignature{
+			ID:          id,
+			Type:        Malware,
+			Pattern:     fingerprint,
+			Scope:       ScopeTLS,
+			Severity:    severity,
+			MITREAttack: "T1573",
+			Description: description,
+			Source:      "intel",
+		}
+		order = append(order, id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read fingerprints: %w", err)
+	}
+
+	if len(order) > 0 {
+		pipe := td.redis.TxPipeline()
+		for _, id := range order {
+			data, err := json.Marshal(signatures[id])
+			if err != nil {
+				return nil, err
+			}
+			pipe.HSet(ctx, threatSignaturesKey, id, data)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to store signatures: %w", err)
+		}
+	}
+	report.Imported = len(order)
+
+	td.mu.Lock()
+	for _, id := range order {
+		td.signatures[id] = signatures[id]
+	}
+	td.mu.Unlock()
+	td.rebuildSignatureIndex()
+
+	log.Printf("Imported %d TLS fingerprints (%d duplicates, %d errors)", report.Imported, report.Duplicates, report.ErrorCount)
+	return report, nil
+}
+
+// HTTP Handlers
+func (s *APIServer) importTLSFingerprintsHandler(c *gin.Context) {
+	severity := ThreatLevel(c.DefaultQuery("severity", string(High)))
+	if !validThreatLevels[severity] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown severity %q", severity)})
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxTLSImportBytes)
+
+	var list io.Reader = c.Request.Body
+	if c.ContentType() == "multipart/form-data" {
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "multipart field \"file\" with a fingerprint list (max 16 MB) is required"})
+			return
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer file.Close()
+		list = file
+	}
+
+	report, err := s.threatDetector.ImportTLSFingerprints(c.Request.Context(), list, severity)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "fingerprint lists are limited to 16 MB"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
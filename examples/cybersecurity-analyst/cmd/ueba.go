@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// User and entity behavior analytics: per-user login profiles learned from successful logins
+const (
+	uebaProfileKeyPrefix = "ueba:profile:"      // UserProfile JSON per username
+	uebaProfileTTL       = 400 * 24 * time.Hour // outlives the dormancy period so reactivations are seen
+	uebaMemory           = 50                   // logins; older ones fade out of the hour-of-day profile
+	uebaRareHour         = 0.02                 // hours with a smaller share of logins are unusual
+	uebaMinTravelKm      = 500                  // closer locations are within GeoIP error
+	uebaMinTravelGap     = time.Minute
+	maxProfileValues     = 50 // countries, devices, and networks kept per user
+	earthRadiusKm        = 6371.0
+)
+
+var uebaIndicators = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cybersecurity_ueba_indicators_total",
+		Help: "Indicators raised from user login profiles by kind",
+	},
+	[]string{"kind"},
+)
+
+func init() {
+	prometheus.MustRegister(uebaIndicators)
+}
+
+// LoginLocation is where a successful login came from
+type LoginLocation struct {
+	IP        string    `json:"ip"`
+	Country   string    `json:"country,omitempty"`
+	City      string    `json:"city,omitempty"`
+	Latitude  float64   `json:"latitude,omitempty"`
+	Longitude float64   `json:"longitude,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+func (l *LoginLocation) located() bool {
+	return l != nil && (l.Latitude != 0 || l.Longitude != 0)
+}
+
+func (l *LoginLocation) String() string {
+	place := l.City
+	if place != "" && l.Country != "" {
+		place += ", "
+	}
+	place += l.Country
+	if place == "" {
+		return l.IP
+	}
+	return fmt.Sprintf("%s (%s)", l.IP, place)
+}
+
+// UserProfile is the learned login behavior of one account. Countries, devices, and source
+// networks map to when they were last seen, in Unix seconds.
+type UserProfile struct {
+	Username       string           `json:"username"`
+	FirstSeen      time.Time        `json:"first_seen"`
+	LastLogin      time.Time        `json:"last_login"`
+	Logins         int              `json:"logins"`
+	Hours          [24]float64      `json:"hours"` // share of logins per UTC hour of day
+	Countries      map[string]int64 `json:"countries"`
+	Devices        map[string]int64 `json:"devices"`
+	Networks       map[string]int64 `json:"networks"` // source /24 or /64
+	Services       map[string]int64 `json:"services"`
+	LastLocation   *LoginLocation   `json:"last_location,omitempty"`
+	PrivilegedUses int              `json:"privileged_uses"`
+	LastPrivileged *time.Time       `json:"last_privileged,omitempty"`
+}
+
+func newUserProfile(username string) *UserProfile {
+	return &UserProfile{
+		Username:  username,
+		Countries: make(map[string]int64),
+		Devices:   make(map[string]int64),
+		Networks:  make(map[string]int64),
+		Services:  make(map[string]int64),
+	}
+}
+
+// remember records a value as seen, evicting the longest unseen once the map is full
+func remember(values map[string]int64, value string, at time.Time) {
+	if value == "" {
+		return
+	}
+	if _, ok := values[value]; !ok && len(values) >= maxProfileValues {
+		oldest := ""
+		for candidate, seen := range values {
+			if oldest == "" || seen < values[oldest] {
+				oldest = candidate
+			}
+		}
+		delete(values, oldest)
+	}
+	if at.Unix() > values[value] {
+		values[value] = at.Unix()
+	}
+}
+
+func (p *UserProfile) learn(event AuthEvent, location *LoginLocation) {
+	if p.FirstSeen.IsZero() || event.Timestamp.Before(p.FirstSeen) {
+		p.FirstSeen = event.Timestamp
+	}
+	p.Logins++
+	alpha := math.Max(1/float64(p.Logins), 1.0/uebaMemory)
+	hour := event.Timestamp.UTC().Hour()
+	for h := range p.Hours {
+		p.Hours[h] *= 1 - alpha
+	}
+	p.Hours[hour] += alpha
+
+	remember(p.Devices, event.Device, event.Timestamp)
+	remember(p.Networks, sourceNetwork(event.SourceIP), event.Timestamp)
+	remember(p.Services, event.Service, event.Timestamp)
+	if location != nil {
+		remember(p.Countries, location.Country, event.Timestamp)
+	}
+	if event.Privileged {
+		p.PrivilegedUses++
+		if p.LastPrivileged == nil || event.Timestamp.After(*p.LastPrivileged) {
+			at := event.Timestamp
+			p.LastPrivileged = &at
+		}
+	}
+	if event.Timestamp.After(p.LastLogin) {
+		p.LastLogin = event.Timestamp
+		if location != nil {
+			p.LastLocation = location
+		}
+	}
+}
+
+// loginNovelty describes what about a login the profile has not seen before
+type loginNovelty struct {
+	device, country, network, hour bool
+}
+
+func (n loginNovelty) score() float64 {
+	score := 0.0
+	for _, novel := range []bool{n.device, n.country, n.network, n.hour} {
+		if novel {
+			score += 0.1
+		}
+	}
+	return score
+}
+
+func (p *UserProfile) novelty(event AuthEvent, location *LoginLocation, minLogins int) loginNovelty {
+	if p.Logins < minLogins {
+		return loginNovelty{}
+	}
+	novelty := loginNovelty{hour: p.Hours[event.Timestamp.UTC().Hour()] < uebaRareHour}
+	if event.Device != "" {
+		_, seen := p.Devices[event.Device]
+		novelty.device = !seen
+	}
+	if network := sourceNetwork(event.SourceIP); network != "" {
+		_, seen := p.Networks[network]
+		novelty.network = !seen
+	}
+	if location != nil && location.Country != "" {
+		_, seen := p.Countries[location.Country]
+		novelty.country = !seen
+	}
+	return novelty
+}
+
+func (n loginNovelty) evidence(event AuthEvent, location *LoginLocation) []string {
+	evidence := make([]string, 0, 4)
+	if n.device {
+		evidence = append(evidence, "First login from device "+event.Device)
+	}
+	if n.country {
+		evidence = append(evidence, "First login from "+location.Country)
+	}
+	if n.network {
+		evidence = append(evidence, "First login from network "+sourceNetwork(event.SourceIP))
+	}
+	if n.hour {
+		evidence = append(evidence, fmt.Sprintf("Login at %02d:00 UTC, an hour the account is rarely used", event.Timestamp.UTC().Hour()))
+	}
+	return evidence
+}
+
+// sourceNetwork groups addresses by /24 or /64, so DHCP churn within a network is not novel
+func sourceNetwork(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// distanceKm is the great-circle distance between two locations
+func distanceKm(a, b *LoginLocation) float64 {
+	lat1, lat2 := a.Latitude*math.Pi/180, b.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// UserBehaviorAnalytics learns per-user login profiles in Redis and raises indicators for
+// logins that do not fit them
+type UserBehaviorAnalytics struct {
+	redis        *redis.Client
+	geo          *GeoIP
+	dormantAfter time.Duration
+	maxSpeedKmh  float64
+	minLogins    int        // logins learned before unusual privilege use and novelty are judged
+	mu           sync.Mutex // serializes profile updates within this process
+}
+
+func NewUserBehaviorAnalytics(redisClient *redis.Client, geo *GeoIP, dormantAfter time.Duration, maxSpeedKmh float64, minLogins int) *UserBehaviorAnalytics {
+	return &UserBehaviorAnalytics{
+		redis:        redisClient,
+		geo:          geo,
+		dormantAfter: dormantAfter,
+		maxSpeedKmh:  maxSpeedKmh,
+		minLogins:    minLogins,
+	}
+}
+
+func (u *UserBehaviorAnalytics) profileKey(ctx context.Context, username string) string {
+	return tenantKey(ctx, uebaProfileKeyPrefix+username)
+}
+
+func (u *UserBehaviorAnalytics) locate(address string, at time.Time) *LoginLocation {
+	location := &LoginLocation{IP: address, At: at}
+	if info := u.geo.Lookup(address); info != nil {
+		location.Country = info.Country
+		location.City = info.City
+		location.Latitude = info.Latitude
+		location.Longitude = info.Longitude
+	}
+	return location
+}
+
+// Evaluate compares successful logins with their accounts' profiles, in time order, and then
+// learns from them. Logins older than an account's last login only train its profile.
+func (u *UserBehaviorAnalytics) Evaluate(ctx context.Context, events []AuthEvent) ([]ThreatIndicator, error) {
+	threats := make([]ThreatIndicator, 0)
+
+	logins := make([]AuthEvent, 0, len(events))
+	users := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, event := range events {
+		event.Username = strings.ToLower(strings.TrimSpace(event.Username))
+		if !event.Success || event.Username == "" {
+			continue
+		}
+		logins = append(logins, event)
+		if !seen[event.Username] {
+			seen[event.Username] = true
+			users = append(users, event.Username)
+		}
+	}
+	if len(logins) == 0 {
+		return threats, nil
+	}
+	sort.SliceStable(logins, func(i, j int) bool { return logins[i].Timestamp.Before(logins[j].Timestamp) })
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	keys := make([]string, len(users))
+	for i, user := range users {
+		keys[i] = u.profileKey(ctx, user)
+	}
+	values, err := u.redis.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user profiles: %w", err)
+	}
+	profiles := make(map[string]*UserProfile, len(users))
+	for i, user := range users {
+		profile := newUserProfile(user)
+		if data, ok := values[i].(string); ok {
+			json.Unmarshal([]byte(data), profile)
+		}
+		profiles[user] = profile
+	}
+
+	for _, event := range logins {
+		profile := profiles[event.Username]
+		location := u.locate(event.SourceIP, event.Timestamp)
+		if !event.Timestamp.Before(profile.LastLogin) {
+			threats = append(threats, u.check(profile, event, location)...)
+		}
+		profile.learn(event, location)
+	}
+
+	pipe := u.redis.Pipeline()
+	for user, profile := range profiles {
+		data, err := json.Marshal(profile)
+		if err != nil {
+			continue
+		}
+		pipe.Set(ctx, u.profileKey(ctx, user), data, uebaProfileTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to store user profiles: %w", err)
+	}
+	return threats, nil
+}
+
+// check raises indicators for one login against the profile learned before it. Confidence
+// rises with each way the login is new for the account.
+func (u *UserBehaviorAnalytics) check(profile *UserProfile, event AuthEvent, location *LoginLocation) []ThreatIndicator {
+	threats := make([]ThreatIndicator, 0)
+	novelty := profile.novelty(event, location, u.minLogins)
+	observed := novelty.evidence(event, location)
+	if event.Service != "" {
+		observed = append(observed, "Service: "+event.Service)
+	}
+
+	// Impossible travel: two logins further apart than anyone could travel in between
+	if previous := profile.LastLocation; previous.located() && location.located() && previous.IP != location.IP {
+		distance := distanceKm(previous, location)
+		gap := event.Timestamp.Sub(previous.At)
+		if gap < uebaMinTravelGap {
+			gap = uebaMinTravelGap
+		}
+		speed := distance / gap.Hours()
+		if distance >= uebaMinTravelKm && speed > u.maxSpeedKmh {
+			confidence := 0.6 + 0.2*math.Min(1, speed/u.maxSpeedKmh-1) + novelty.score()
+			evidence := []string{
+				fmt.Sprintf("Login as %s from %s at %s", event.Username, location, event.Timestamp.Format(time.RFC3339)),
+				fmt.Sprintf("Previous login from %s at %s", previous, previous.At.Format(time.RFC3339)),
+				fmt.Sprintf("%.0f km in %s requires %.0f km/h", distance, event.Timestamp.Sub(previous.At).Round(time.Second), speed),
+			}
+			threats = append(threats, u.indicator("impossible_travel", event, High, confidence, "Impossible travel", "T1078", append(evidence, observed...)))
+		}
+	}
+
+	// Dormant account reactivation: a login after a long silence
+	if !profile.LastLogin.IsZero() && event.Timestamp.Sub(profile.LastLogin) >= u.dormantAfter {
+		idle := event.Timestamp.Sub(profile.LastLogin)
+		severity := High
+		confidence := 0.6 + 0.1*math.Min(1, idle.Hours()/u.dormantAfter.Hours()-1) + novelty.score()
+		evidence := []string{
+			fmt.Sprintf("Login as %s from %s after %d days without one", event.Username, location, int(idle.Hours()/24)),
+			"Previous login " + profile.LastLogin.Format(time.RFC3339),
+		}
+		if event.Privileged {
+			severity = Critical
+			confidence += 0.1
+			evidence = append(evidence, "The login was granted administrative privileges")
+		}
+		threats = append(threats, u.indicator("dormant_account", event, severity, confidence, "Dormant account reactivated", "T1078", append(evidence, observed...)))
+	}
+
+	// Unusual privilege use: administrative rights for an account that has never used them
+	if event.Privileged && profile.Logins >= u.minLogins && profile.PrivilegedUses == 0 {
+		confidence := 0.55 + novelty.score()
+		evidence := []string{
+			fmt.Sprintf("Login as %s from %s was granted administrative privileges", event.Username, location),
+			fmt.Sprintf("None of the account's %d logins since %s used them", profile.Logins, profile.FirstSeen.Format("2006-01-02")),
+		}
+		threats = append(threats, u.indicator("unusual_privilege", event, High, confidence, "Unusual privilege use", "T1078.002", append(evidence, observed...)))
+	}
+	return threats
+}
+
+func (u *UserBehaviorAnalytics) indicator(kind string, event AuthEvent, severity ThreatLevel, confidence float64, description, technique string, evidence []string) ThreatIndicator {
+	uebaIndicators.WithLabelValues(kind).Inc()
+	return ThreatIndicator{
+		Type:        Anomaly,
+		Severity:    severity,
+		Confidence:  math.Min(confidence, 0.95),
+		Description: description,
+		SourceIP:    event.SourceIP,
+		DestIP:      event.DestIP,
+		MITREAttack: technique,
+		Evidence:    evidence,
+	}
+}
+
+func (u *UserBehaviorAnalytics) Profile(ctx context.Context, username string) (*UserProfile, error) {
+	data, err := u.redis.Get(ctx, u.profileKey(ctx, strings.ToLower(username))).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	profile := newUserProfile(username)
+	if err := json.Unmarshal([]byte(data), profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// Reset forgets a user's profile, e.g. after a role change; it is learned again from scratch
+func (u *UserBehaviorAnalytics) Reset(ctx context.Context, username string) (bool, error) {
+	removed, err := u.redis.Del(ctx, u.profileKey(ctx, strings.ToLower(username))).Result()
+	return removed > 0, err
+}
+
+// HTTP Handlers
+func (s *APIServer) getUserProfileHandler(c *gin.Context) {
+	profile, err := s.threatDetector.ueba.Profile(c.Request.Context(), c.Param("username"))
+	switch {
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case profile == nil:
+		c.JSON(http.StatusNotFound, gin.H{"error": "No profile for this user"})
+	default:
+		c.JSON(http.StatusOK, profile)
+	}
+}
+
+func (s *APIServer) resetUserProfileHandler(c *gin.Context) {
+	found, err := s.threatDetector.ueba.Reset(c.Request.Context(), c.Param("username"))
+	switch {
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case !found:
+		c.JSON(http.StatusNotFound, gin.H{"error": "No profile for this user"})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
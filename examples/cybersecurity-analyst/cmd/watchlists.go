@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CVE watchlists: CVEs synchronized from NVD that affect watched software open findings and
+// notify the watchlist's alert channels
+const (
+	watchlistsKey           = "cve:watchlists"           // hash of watchlist ID -> CVEWatchlist JSON
+	watchlistNotifiedPrefix = "cve:watchlists:notified:" // set of CVE IDs already reported per watchlist
+	watchlistMatchesMax     = 50
+	watchlistLookback       = 30 * 24 * time.Hour // CVEs published this long before a watchlist was created still match it
+	cveWatchlistOrigin      = "cve_watchlist"
+)
+
+var (
+	errInvalidWatchlist  = errors.New("invalid watchlist")
+	errWatchlistNotFound = errors.New("watchlist not found")
+)
+
+var cveWatchlistMatches = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cybersecurity_cve_watchlist_matches_total",
+		Help: "CVEs matched to watchlists by severity",
+	},
+	[]string{"severity"},
+)
+
+func init() {
+	prometheus.MustRegister(cveWatchlistMatches)
+}
+
+// WatchlistMatch is a CVE reported to a watchlist's subscribers
+type WatchlistMatch struct {
+	CVE            string      `json:"cve"`
+	Severity       ThreatLevel `json:"severity"`
+	CVSSScore      float64     `json:"cvss_score"`
+	EPSS           *EPSSScore  `json:"epss,omitempty"`
+	KnownExploited bool        `json:"known_exploited"`
+	Systems        []string    `json:"systems"` // watched asset IDs, or "software" for software listed on the watchlist
+	Findings       []string    `json:"findings"`
+	MatchedAt      time.Time   `json:"matched_at"`
+}
+
+// CVEWatchlist is software a team wants to hear about as soon as a CVE affecting it is published
+type CVEWatchlist struct {
+	ID          string                `json:"id"`
+	Name        string                `json:"name"`
+	Software    []SoftwareFingerprint `json:"software,omitempty"`     // a product without a version matches all of its CVEs
+	Assets      []string              `json:"assets,omitempty"`       // registered assets whose software is watched
+	MinSeverity ThreatLevel           `json:"min_severity,omitempty"` // CVEs below this severity are ignored
+	Channels    []string              `json:"channels,omitempty"`     // alert channels notified; those routed by severity when empty
+	Matches     []WatchlistMatch      `json:"matches"`                // most recent first
+	CreatedAt   time.Time             `json:"created_at"`
+	UpdatedAt   time.Time             `json:"updated_at"`
+}
+
+// watchTarget is one piece of watched software and the system reported for it
+type watchTarget struct {
+	fingerprint SoftwareFingerprint
+	system      string
+	asset       string
+}
+
+func (wl *CVEWatchlist) targets(assets map[string]Asset) []watchTarget {
+	targets := make([]watchTarget, 0, len(wl.Software))
+	for _, software := range wl.Software {
+		targets = append(targets, watchTarget{fingerprint: normalizeFingerprint(software), system: "software"})
+	}
+	for _, id := range wl.Assets {
+		for _, software := range assets[id].Software {
+			targets = append(targets, watchTarget{fingerprint: normalizeFingerprint(software), system: id, asset: id})
+		}
+	}
+	return targets
+}
+
+// CVEWatchlists stores each tenant's watchlists and checks synchronized CVEs against them
+type CVEWatchlists struct {
+	redis    *redis.Client
+	detector *ThreatDetector
+	epss     *EPSSClient
+	mu       sync.Mutex // serializes read-modify-write of watchlists within this process
+}
+
+func NewCVEWatchlists(redisClient *redis.Client, detector *ThreatDetector, epss *EPSSClient) *CVEWatchlists {
+	return &CVEWatchlists{redis: redisClient, detector: detector, epss: epss}
+}
+
+func (cw *CVEWatchlists) Watchlists(ctx context.Context) ([]CVEWatchlist, error) {
+	entries, err := cw.redis.HGetAll(ctx, tenantKey(ctx, watchlistsKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load watchlists: %w", err)
+	}
+	watchlists := make([]CVEWatchlist, 0, len(entries))
+	for id, data := range entries {
+		var watchlist CVEWatchlist
+		if err := json.Unmarshal([]byte(data), &watchlist); err != nil {
+			log.Printf("Skipping invalid watchlist %s: %v", id, err)
+			continue
+		}
+		watchlists = append(watchlists, watchlist)
+	}
+	sort.Slice(watchlists, func(i, j int) bool { return watchlists[i].ID < watchlists[j].ID })
+	return watchlists, nil
+}
+
+func (cw *CVEWatchlists) Watchlist(ctx context.Context, id string) (*CVEWatchlist, error) {
+	data, err := cw.redis.HGet(ctx, tenantKey(ctx, watchlistsKey), id).Result()
+	if err == redis.Nil {
+		return nil, errWatchlistNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load watchlist: %w", err)
+	}
+	var watchlist CVEWatchlist
+	if err := json.Unmarshal([]byte(data), &watchlist); err != nil {
+		return nil, fmt.Errorf("invalid watchlist %s: %w", id, err)
+	}
+	return &watchlist, nil
+}
+
+// SaveWatchlist validates and stores a watchlist. Updating keeps its creation time, so CVEs
+// published since then are still reported, and its recent matches.
+func (cw *CVEWatchlists) SaveWatchlist(ctx context.Context, watchlist CVEWatchlist, create bool) (*CVEWatchlist, error) {
+	if err := cw.validate(ctx, &watchlist); err != nil {
+		return nil, err
+	}
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	now := time.Now().UTC()
+	watchlist.UpdatedAt = now
+	if create {
+		watchlist.ID = fmt.Sprintf("watch_%d", now.UnixNano())
+		watchlist.CreatedAt = now
+		watchlist.Matches = make([]WatchlistMatch, 0)
+	} else {
+		existing, err := cw.Watchlist(ctx, watchlist.ID)
+		if err != nil {
+			return nil, err
+		}
+		watchlist.CreatedAt = existing.CreatedAt
+		watchlist.Matches = existing.Matches
+	}
+	if err := cw.store(ctx, &watchlist); err != nil {
+		return nil, err
+	}
+	return &watchlist, nil
+}
+
+func (cw *CVEWatchlists) validate(ctx context.Context, watchlist *CVEWatchlist) error {
+	watchlist.Name = strings.TrimSpace(watchlist.Name)
+	if watchlist.Name == "" {
+		return fmt.Errorf("%w: name is required", errInvalidWatchlist)
+	}
+	if len(watchlist.Software) == 0 && len(watchlist.Assets) == 0 {
+		return fmt.Errorf("%w: watchlists need software or assets", errInvalidWatchlist)
+	}
+	for _, software := range watchlist.Software {
+		if normalizeFingerprint(software).Product == "" {
+			return fmt.Errorf("%w: software entries need a cpe or product", errInvalidWatchlist)
+		}
+	}
+	for _, id := range watchlist.Assets {
+		if _, err := cw.detector.assets.Asset(ctx, id); err != nil {
+			return fmt.Errorf("%w: asset %s: %v", errInvalidWatchlist, id, err)
+		}
+	}
+	if watchlist.MinSeverity != "" {
+		level, err := parseSeverity(string(watchlist.MinSeverity))
+		if err != nil {
+			return fmt.Errorf("%w: min_severity: %v", errInvalidWatchlist, err)
+		}
+		watchlist.MinSeverity = level
+	}
+	for _, channel := range watchlist.Channels {
+		if !cw.detector.alerts.HasChannel(channel) {
+			return fmt.Errorf("%w: alert channel %q is not configured", errInvalidWatchlist, channel)
+		}
+	}
+	return nil
+}
+
+func (cw *CVEWatchlists) store(ctx context.Context, watchlist *CVEWatchlist) error {
+	data, err := json.Marshal(watchlist)
+	if err != nil {
+		return err
+	}
+	if err := cw.redis.HSet(ctx, tenantKey(ctx, watchlistsKey), watchlist.ID, data).Err(); err != nil {
+		return fmt.Errorf("failed to store watchlist: %w", err)
+	}
+	return nil
+}
+
+// DeleteWatchlist removes a watchlist; its findings stay open
+func (cw *CVEWatchlists) DeleteWatchlist(ctx context.Context, id string) (bool, error) {
+	pipe := cw.redis.TxPipeline()
+	removed := pipe.HDel(ctx, tenantKey(ctx, watchlistsKey), id)
+	pipe.Del(ctx, tenantKey(ctx, watchlistNotifiedPrefix+id))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, fmt.Errorf("failed to delete watchlist: %w", err)
+	}
+	return removed.Val() > 0, nil
+}
+
+// watchlistHit is a CVE newly matched to a watchlist, waiting to be reported
+type watchlistHit struct {
+	ctx       context.Context
+	watchlist CVEWatchlist
+	detail    CVEDetail
+	targets   []watchTarget
+	criteria  []*cpeCriterion
+}
+
+// Check reports synchronized CVEs to every tenant's watchlists they match. Each CVE is reported
+// to a watchlist once, by whichever replica claims it first.
+func (cw *CVEWatchlists) Check(ctx context.Context, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	type tenantWatchlists struct {
+		ctx        context.Context
+		watchlists []CVEWatchlist
+	}
+	watched := make([]tenantWatchlists, 0)
+	for _, tenant := range cw.detector.tenants.IDs() {
+		tenantCtx := withTenant(ctx, tenant)
+		watchlists, err := cw.Watchlists(tenantCtx)
+		if err != nil {
+			log.Printf("CVE watchlists of tenant %s not checked: %v", tenant, err)
+			continue
+		}
+		if len(watchlists) > 0 {
+			watched = append(watched, tenantWatchlists{ctx: tenantCtx, watchlists: watchlists})
+		}
+	}
+	if len(watched) == 0 {
+		return
+	}
+
+	details, err := cw.detector.cveDatabase.Details(ctx, ids)
+	if err != nil {
+		log.Printf("CVE watchlists not checked: %v", err)
+		return
+	}
+
+	hits := make([]watchlistHit, 0)
+	for _, tenant := range watched {
+		assets := make(map[string]Asset)
+		registered, err := cw.detector.assets.Assets(tenant.ctx)
+		if err != nil {
+			log.Printf("Watched assets of tenant %s not checked: %v", tenantFromContext(tenant.ctx), err)
+		}
+		for _, asset := range registered {
+			assets[asset.ID] = asset
+		}
+
+		for _, watchlist := range tenant.watchlists {
+			targets := watchlist.targets(assets)
+			for _, detail := range details {
+				if severityRank[detail.Severity] < severityRank[watchlist.MinSeverity] || detail.Published.Before(watchlist.CreatedAt.Add(-watchlistLookback)) {
+					continue
+				}
+				hit := watchlistHit{ctx: tenant.ctx, watchlist: watchlist, detail: detail}
+				for _, target := range targets {
+					if criterion := detail.match(target.fingerprint); criterion != nil {
+						hit.targets = append(hit.targets, target)
+						hit.criteria = append(hit.criteria, criterion)
+					}
+				}
+				if len(hit.targets) == 0 {
+					continue
+				}
+				claimed, err := cw.redis.SAdd(tenant.ctx, tenantKey(tenant.ctx, watchlistNotifiedPrefix+watchlist.ID), detail.ID).Result()
+				if err != nil || claimed == 0 {
+					continue
+				}
+				hits = append(hits, hit)
+			}
+		}
+	}
+	if len(hits) == 0 {
+		return
+	}
+
+	cves := make([]string, 0, len(hits))
+	for _, hit := range hits {
+		cves = append(cves, hit.detail.ID)
+	}
+	scores, err := cw.epss.Scores(ctx, cves)
+	if err != nil {
+		log.Printf("Watchlist notifications sent without EPSS scores: %v", err)
+	}
+	for _, hit := range hits {
+		cw.report(hit, scores)
+	}
+}
+
+// report opens a finding for each affected system and notifies the watchlist's subscribers
+func (cw *CVEWatchlists) report(hit watchlistHit, scores map[string]EPSSScore) {
+	ctx, detail := hit.ctx, hit.detail
+	match := WatchlistMatch{
+		CVE:            detail.ID,
+		Severity:       detail.Severity,
+		CVSSScore:      detail.CVSSScore,
+		KnownExploited: detail.KnownExploited,
+		Systems:        make([]string, 0, len(hit.targets)),
+		Findings:       make([]string, 0, len(hit.targets)),
+		MatchedAt:      time.Now().UTC(),
+	}
+	if score, ok := scores[detail.ID]; ok {
+		match.EPSS = &score
+	}
+
+	asset := ""
+	for i, target := range hit.targets {
+		if len(match.Systems) > 0 && match.Systems[len(match.Systems)-1] == target.system {
+			continue // another watched product of the same system
+		}
+		match.Systems = append(match.Systems, target.system)
+		if asset == "" {
+			asset = target.asset
+		}
+
+		remediation := hit.criteria[i].remediation(target.fingerprint)
+		if detail.KEVAction != "" {
+			remediation = detail.KEVAction + " (CISA KEV: exploited in the wild)"
+		}
+		finding, err := cw.detector.findings.Open(ctx, &Finding{
+			ID:          findingID(strings.Join([]string{"cve", detail.ID, target.system}, "|")),
+			Kind:        findingKindVulnerability,
+			Title:       fmt.Sprintf("%s on %s", detail.ID, target.system),
+			Severity:    detail.Severity,
+			CVE:         detail.ID,
+			System:      target.system,
+			Asset:       target.asset,
+			Remediation: remediation,
+		}, "reported by CVE watchlist "+hit.watchlist.ID)
+		if err != nil {
+			log.Printf("Finding for %s on %s not recorded: %v", detail.ID, target.system, err)
+			continue
+		}
+		match.Findings = append(match.Findings, finding.ID)
+	}
+
+	threat := ThreatIndicator{
+		Type:        Exposure,
+		Severity:    detail.Severity,
+		Confidence:  1.0,
+		Description: fmt.Sprintf("%s affects %s on watchlist %q", detail.ID, strings.Join(match.Systems, ", "), hit.watchlist.Name),
+		Evidence:    cveContext(detail, match.EPSS),
+		Asset:       asset,
+		Tenant:      tenantField(ctx),
+		CVE:         detail.ID,
+	}
+	if err := cw.detector.alerts.Notify(ctx, cveWatchlistOrigin, threat, hit.watchlist.Channels); err != nil {
+		log.Printf("Watchlist %s: alert for %s failed: %v", hit.watchlist.ID, detail.ID, err)
+	}
+	cveWatchlistMatches.WithLabelValues(string(detail.Severity)).Inc()
+	log.Printf("Watchlist %s: %s affects %s", hit.watchlist.ID, detail.ID, strings.Join(match.Systems, ", "))
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	watchlist, err := cw.Watchlist(ctx, hit.watchlist.ID)
+	if err != nil {
+		return // deleted in the meantime
+	}
+	watchlist.Matches = append([]WatchlistMatch{match}, watchlist.Matches...)
+	if len(watchlist.Matches) > watchlistMatchesMax {
+		watchlist.Matches = watchlist.Matches[:watchlistMatchesMax]
+	}
+	if err := cw.store(ctx, watchlist); err != nil {
+		log.Printf("Watchlist %s: %v", watchlist.ID, err)
+	}
+}
+
+// cveContext is the evidence sent with a watchlist notification: what the CVE is, how likely it
+// is to be exploited, and whether it already is
+func cveContext(detail CVEDetail, epss *EPSSScore) []string {
+	evidence := []string{fmt.Sprintf("CVSS %.1f (%s)", detail.CVSSScore, detail.Severity)}
+	if epss != nil {
+		evidence = append(evidence, epss.String())
+	} else {
+		evidence = append(evidence, "No EPSS score published yet")
+	}
+	if detail.KnownExploited {
+		kev := "CISA KEV: exploited in the wild"
+		if detail.KEVAdded != nil {
+			kev += " since " + detail.KEVAdded.Format("2006-01-02")
+		}
+		if detail.KEVDueDate != nil {
+			kev += "; federal due date " + detail.KEVDueDate.Format("2006-01-02")
+		}
+		if detail.RansomwareUse {
+			kev += "; used in ransomware campaigns"
+		}
+		evidence = append(evidence, kev)
+		if detail.KEVAction != "" {
+			evidence = append(evidence, "Required action: "+detail.KEVAction)
+		}
+	}
+	if detail.Description != "" {
+		evidence = append(evidence, detail.Description)
+	}
+	return evidence
+}
+
+// HTTP Handlers
+func (s *APIServer) listWatchlistsHandler(c *gin.Context) {
+	watchlists, err := s.threatDetector.watchlists.Watchlists(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"watchlists": watchlists, "count": len(watchlists)})
+}
+
+func (s *APIServer) getWatchlistHandler(c *gin.Context) {
+	watchlist, err := s.threatDetector.watchlists.Watchlist(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, errWatchlistNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, watchlist)
+	}
+}
+
+func (s *APIServer) createWatchlistHandler(c *gin.Context) {
+	var watchlist CVEWatchlist
+	if err := c.ShouldBindJSON(&watchlist); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s.saveWatchlist(c, watchlist, true, http.StatusCreated)
+}
+
+func (s *APIServer) updateWatchlistHandler(c *gin.Context) {
+	var watchlist CVEWatchlist
+	if err := c.ShouldBindJSON(&watchlist); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if watchlist.ID != "" && watchlist.ID != c.Param("id") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "watchlist id does not match the URL"})
+		return
+	}
+	watchlist.ID = c.Param("id")
+	s.saveWatchlist(c, watchlist, false, http.StatusOK)
+}
+
+func (s *APIServer) saveWatchlist(c *gin.Context, watchlist CVEWatchlist, create bool, status int) {
+	saved, err := s.threatDetector.watchlists.SaveWatchlist(c.Request.Context(), watchlist, create)
+	switch {
+	case errors.Is(err, errInvalidWatchlist):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errWatchlistNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(status, saved)
+	}
+}
+
+func (s *APIServer) deleteWatchlistHandler(c *gin.Context) {
+	found, err := s.threatDetector.watchlists.DeleteWatchlist(c.Request.Context(), c.Param("id"))
+	switch {
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case !found:
+		c.JSON(http.StatusNotFound, gin.H{"error": errWatchlistNotFound.Error()})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,124 @@
+// Package client is a Go client for the DevOps Orchestrator API.
+//
+// Request/response types and endpoint methods in zz_generated.go are generated from
+// ../api/openapi.json; regenerate after changing the API with:
+//
+//	go run ./cmd openapi > api/openapi.json && go generate ./client
+package client
+
+//go:generate go run gen.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client calls the orchestrator's HTTP API
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	headers    http.Header
+}
+
+type Option func(*Client)
+
+// WithHTTPClient replaces the default HTTP client
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.HTTPClient = httpClient
+	}
+}
+
+// WithHeader adds a header to every request, e.g. for an auth token
+func WithHeader(key, value string) Option {
+	return func(c *Client) {
+		c.headers.Add(key, value)
+	}
+}
+
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 5 * time.Minute},
+		headers:    make(http.Header),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// APIError is returned for non-2xx responses; Body holds the raw response so structured
+// errors (e.g. VariableValidationResponse on 422) can be decoded with json.Unmarshal
+type APIError struct {
+	StatusCode int
+	Message    string
+	Body       []byte
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("devops-orchestrator: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	endpoint := c.BaseURL + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	for key, values := range c.headers {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiErr := &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data)), Body: data}
+		var errBody ErrorResponse
+		if json.Unmarshal(data, &errBody) == nil && errBody.Error != "" {
+			apiErr.Message = errBody.Error
+		}
+		return apiErr
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return nil
+}
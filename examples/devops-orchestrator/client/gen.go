@@ -0,0 +1,287 @@
+//go:build ignore
+
+// gen.go generates zz_generated.go from ../api/openapi.json. It only understands the
+// subset of OpenAPI emitted by the orchestrator's BuildOpenAPISpec.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Enum                 []string           `json:"enum"`
+	Properties           map[string]*schema `json:"properties"`
+	Required             []string           `json:"required"`
+	Items                *schema            `json:"items"`
+	AdditionalProperties *schema            `json:"additionalProperties"`
+	AllOf                []*schema          `json:"allOf"`
+	Nullable             bool               `json:"nullable"`
+}
+
+type parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description"`
+	Schema      *schema `json:"schema"`
+}
+
+type mediaType struct {
+	Schema *schema `json:"schema"`
+}
+
+type operation struct {
+	OperationID string      `json:"operationId"`
+	Summary     string      `json:"summary"`
+	Parameters  []parameter `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]mediaType `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]struct {
+		Content map[string]mediaType `json:"content"`
+	} `json:"responses"`
+}
+
+type document struct {
+	Paths      map[string]map[string]*operation `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+var initialisms = map[string]string{"id": "ID", "url": "URL", "api": "API", "dns": "DNS", "dr": "DR", "http": "HTTP", "aws": "AWS", "gcp": "GCP"}
+
+func main() {
+	data, err := os.ReadFile("../api/openapi.json")
+	if err != nil {
+		log.Fatalf("failed to read OpenAPI document: %v", err)
+	}
+	var doc document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		log.Fatalf("failed to parse OpenAPI document: %v", err)
+	}
+
+	var body bytes.Buffer
+	writeTypes(&body, doc.Components.Schemas)
+	writeOperations(&body, doc.Paths)
+
+	imports := []string{"context", "net/http", "net/url"}
+	if strings.Contains(body.String(), "strconv.") {
+		imports = append(imports, "strconv")
+	}
+	if strings.Contains(body.String(), "time.Time") {
+		imports = append(imports, "time")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by gen.go from ../api/openapi.json; DO NOT EDIT.\n\n")
+	buf.WriteString("package client\n\nimport (\n")
+	for _, pkg := range imports {
+		fmt.Fprintf(&buf, "%q\n", pkg)
+	}
+	buf.WriteString(")\n\n")
+	buf.Write(body.Bytes())
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatalf("failed to format generated code: %v\n%s", err, buf.String())
+	}
+	if err := os.WriteFile("zz_generated.go", src, 0644); err != nil {
+		log.Fatalf("failed to write zz_generated.go: %v", err)
+	}
+}
+
+func writeTypes(buf *bytes.Buffer, schemas map[string]*schema) {
+	names := make([]string, 0, len(schemas))
+	for name := range schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		s := schemas[name]
+		if len(s.Enum) > 0 {
+			fmt.Fprintf(buf, "type %s string\n\nconst (\n", name)
+			for _, value := range s.Enum {
+				fmt.Fprintf(buf, "%s%s %s = %q\n", name, goName(value), name, value)
+			}
+			buf.WriteString(")\n\n")
+			continue
+		}
+
+		fmt.Fprintf(buf, "type %s struct {\n", name)
+		writeFields(buf, s)
+		buf.WriteString("}\n\n")
+	}
+}
+
+func writeFields(buf *bytes.Buffer, s *schema) {
+	required := make(map[string]bool)
+	for _, name := range s.Required {
+		required[name] = true
+	}
+
+	props := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		props = append(props, name)
+	}
+	sort.Strings(props)
+
+	for _, prop := range props {
+		tag := prop
+		if !required[prop] {
+			tag += ",omitempty"
+		}
+		fmt.Fprintf(buf, "%s %s `json:%q`\n", goName(prop), goType(s.Properties[prop]), tag)
+	}
+}
+
+func goType(s *schema) string {
+	if s == nil {
+		return "interface{}"
+	}
+	if s.Ref != "" {
+		return refName(s.Ref)
+	}
+	if len(s.AllOf) == 1 && s.AllOf[0].Ref != "" {
+		if s.Nullable {
+			return "*" + refName(s.AllOf[0].Ref)
+		}
+		return refName(s.AllOf[0].Ref)
+	}
+
+	// Nullable scalars are pointers so an explicit zero is sent rather than omitted
+	pointer := ""
+	if s.Nullable {
+		pointer = "*"
+	}
+
+	switch s.Type {
+	case "string":
+		if s.Format == "date-time" {
+			return "time.Time"
+		}
+		return pointer + "string"
+	case "integer":
+		return pointer + "int"
+	case "number":
+		return pointer + "float64"
+	case "boolean":
+		return pointer + "bool"
+	case "array":
+		return "[]" + goType(s.Items)
+	case "object":
+		if s.AdditionalProperties != nil {
+			return "map[string]" + goType(s.AdditionalProperties)
+		}
+		return "map[string]interface{}"
+	}
+	return "interface{}"
+}
+
+func writeOperations(buf *bytes.Buffer, paths map[string]map[string]*operation) {
+	type route struct {
+		method, path string
+		op           *operation
+	}
+	routes := make([]route, 0)
+	for path, methods := range paths {
+		for method, op := range methods {
+			routes = append(routes, route{method: strings.ToUpper(method), path: path, op: op})
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].op.OperationID < routes[j].op.OperationID })
+
+	for _, r := range routes {
+		name := goName(r.op.OperationID)
+		args := []string{"ctx context.Context"}
+		pathExpr := fmt.Sprintf("%q", r.path)
+		var queryParams []parameter
+
+		for _, p := range r.op.Parameters {
+			switch p.In {
+			case "path":
+				args = append(args, p.Name+" string")
+				pathExpr = strings.Replace(pathExpr, "{"+p.Name+"}", `" + url.PathEscape(`+p.Name+`) + "`, 1)
+			case "query":
+				queryParams = append(queryParams, p)
+			}
+		}
+		pathExpr = strings.TrimSuffix(pathExpr, ` + ""`)
+
+		if len(queryParams) > 0 {
+			fmt.Fprintf(buf, "// %sParams holds optional query parameters; zero values are omitted\n", name)
+			fmt.Fprintf(buf, "type %sParams struct {\n", name)
+			for _, p := range queryParams {
+				if p.Description != "" {
+					fmt.Fprintf(buf, "// %s\n", p.Description)
+				}
+				fmt.Fprintf(buf, "%s %s\n", goName(p.Name), goType(p.Schema))
+			}
+			buf.WriteString("}\n\n")
+			args = append(args, fmt.Sprintf("params *%sParams", name))
+		}
+
+		bodyExpr := "nil"
+		if r.op.RequestBody != nil {
+			args = append(args, "req *"+goType(r.op.RequestBody.Content["application/json"].Schema))
+			bodyExpr = "req"
+		}
+
+		respType := "map[string]interface{}"
+		for status, resp := range r.op.Responses {
+			if strings.HasPrefix(status, "2") {
+				respType = goType(resp.Content["application/json"].Schema)
+			}
+		}
+
+		fmt.Fprintf(buf, "// %s calls %s %s: %s\n", name, r.method, r.path, r.op.Summary)
+		fmt.Fprintf(buf, "func (c *Client) %s(%s) (*%s, error) {\n", name, strings.Join(args, ", "), respType)
+		buf.WriteString("query := url.Values{}\n")
+		if len(queryParams) > 0 {
+			buf.WriteString("if params != nil {\n")
+			for _, p := range queryParams {
+				field := "params." + goName(p.Name)
+				switch goType(p.Schema) {
+				case "int":
+					fmt.Fprintf(buf, "if %s != 0 {\nquery.Set(%q, strconv.Itoa(%s))\n}\n", field, p.Name, field)
+				case "bool":
+					fmt.Fprintf(buf, "if %s {\nquery.Set(%q, \"true\")\n}\n", field, p.Name)
+				default:
+					fmt.Fprintf(buf, "if %s != \"\" {\nquery.Set(%q, %s)\n}\n", field, p.Name, field)
+				}
+			}
+			buf.WriteString("}\n")
+		}
+		fmt.Fprintf(buf, "var out %s\n", respType)
+		fmt.Fprintf(buf, "if err := c.do(ctx, http.Method%s, %s, query, %s, &out); err != nil {\nreturn nil, err\n}\n",
+			goName(strings.ToLower(r.method)), pathExpr, bodyExpr)
+		buf.WriteString("return &out, nil\n}\n\n")
+	}
+}
+
+func refName(ref string) string {
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+// goName converts snake_case, kebab-case, or camelCase identifiers to exported Go names
+func goName(s string) string {
+	var out strings.Builder
+	for _, part := range strings.FieldsFunc(s, func(r rune) bool { return r == '_' || r == '-' || r == ' ' }) {
+		if initialism, ok := initialisms[strings.ToLower(part)]; ok {
+			out.WriteString(initialism)
+			continue
+		}
+		out.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return out.String()
+}
@@ -0,0 +1,1020 @@
+// Code generated by gen.go from ../api/openapi.json; DO NOT EDIT.
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type APIToken struct {
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	ID        string    `json:"id,omitempty"`
+	IssuedAt  time.Time `json:"issued_at,omitempty"`
+	IssuedBy  string    `json:"issued_by,omitempty"`
+	Principal string    `json:"principal,omitempty"`
+}
+
+type APITokenRequest struct {
+	ExpiresIn int    `json:"expires_in,omitempty"`
+	Principal string `json:"principal"`
+}
+
+type APITokenResponse struct {
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	ID        string    `json:"id,omitempty"`
+	Principal string    `json:"principal,omitempty"`
+	Token     string    `json:"token,omitempty"`
+}
+
+type APITokensResponse struct {
+	Principal string     `json:"principal,omitempty"`
+	Tokens    []APIToken `json:"tokens,omitempty"`
+}
+
+type AuditLogResponse struct {
+	Records []AuditRecord `json:"records,omitempty"`
+}
+
+type AuditRecord struct {
+	Action      string    `json:"action,omitempty"`
+	Allowed     bool      `json:"allowed,omitempty"`
+	Environment string    `json:"environment,omitempty"`
+	Principal   string    `json:"principal,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Resource    string    `json:"resource,omitempty"`
+	Status      int       `json:"status,omitempty"`
+	Timestamp   time.Time `json:"timestamp,omitempty"`
+}
+
+type Budget struct {
+	MonthlyLimit float64     `json:"monthly_limit"`
+	Name         string      `json:"name"`
+	Scope        BudgetScope `json:"scope"`
+	UpdatedAt    time.Time   `json:"updated_at,omitempty"`
+}
+
+type BudgetOverride struct {
+	ApprovedAt   time.Time   `json:"approved_at,omitempty"`
+	ApprovedBy   string      `json:"approved_by,omitempty"`
+	CostEstimate float64     `json:"cost_estimate,omitempty"`
+	Environment  Environment `json:"environment,omitempty"`
+	ID           string      `json:"id,omitempty"`
+	Reason       string      `json:"reason,omitempty"`
+	RequestID    string      `json:"request_id,omitempty"`
+	RequestedAt  time.Time   `json:"requested_at,omitempty"`
+	Status       string      `json:"status,omitempty"`
+	Team         string      `json:"team,omitempty"`
+}
+
+type BudgetOverrideApproval struct {
+	Approver string `json:"approver,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+type BudgetScope string
+
+const (
+	BudgetScopeTeam        BudgetScope = "team"
+	BudgetScopeEnvironment BudgetScope = "environment"
+)
+
+type BudgetStatus struct {
+	Budget    Budget  `json:"budget,omitempty"`
+	Month     string  `json:"month,omitempty"`
+	Remaining float64 `json:"remaining,omitempty"`
+	Spent     float64 `json:"spent,omitempty"`
+}
+
+type BudgetViolation struct {
+	CostEstimate   float64     `json:"cost_estimate,omitempty"`
+	Month          string      `json:"month,omitempty"`
+	MonthlyLimit   float64     `json:"monthly_limit,omitempty"`
+	Name           string      `json:"name,omitempty"`
+	OverrideID     string      `json:"override_id,omitempty"`
+	ProjectedSpend float64     `json:"projected_spend,omitempty"`
+	Scope          BudgetScope `json:"scope,omitempty"`
+	Spent          float64     `json:"spent,omitempty"`
+}
+
+type CloudFormationStack struct {
+	Capabilities []string `json:"capabilities,omitempty"`
+	Region       string   `json:"region,omitempty"`
+	StackName    string   `json:"stack_name"`
+	TemplateBody string   `json:"template_body,omitempty"`
+	TemplateURL  string   `json:"template_url,omitempty"`
+}
+
+type CloudProvider string
+
+const (
+	CloudProviderAWS    CloudProvider = "aws"
+	CloudProviderAzure  CloudProvider = "azure"
+	CloudProviderGCP    CloudProvider = "gcp"
+	CloudProviderOnPrem CloudProvider = "on-prem"
+)
+
+type ConfigChange struct {
+	Action   string `json:"action,omitempty"`
+	Key      string `json:"key,omitempty"`
+	NewValue string `json:"new_value,omitempty"`
+	OldValue string `json:"old_value,omitempty"`
+}
+
+type DORAMetrics struct {
+	Application               string      `json:"application,omitempty"`
+	ChangeFailureRate         float64     `json:"change_failure_rate,omitempty"`
+	DeploymentFrequencyPerDay float64     `json:"deployment_frequency_per_day,omitempty"`
+	Deployments               int         `json:"deployments,omitempty"`
+	Environment               Environment `json:"environment,omitempty"`
+	Failures                  int         `json:"failures,omitempty"`
+	LeadTimeSeconds           float64     `json:"lead_time_seconds,omitempty"`
+	MttrSeconds               float64     `json:"mttr_seconds,omitempty"`
+}
+
+type DORAMetricsResponse struct {
+	Metrics    []DORAMetrics `json:"metrics,omitempty"`
+	WindowDays int           `json:"window_days,omitempty"`
+}
+
+type DRRunbook struct {
+	ApplicationName string        `json:"application_name,omitempty"`
+	CloudProvider   CloudProvider `json:"cloud_provider,omitempty"`
+	Environment     Environment   `json:"environment,omitempty"`
+	FailoverRegion  string        `json:"failover_region,omitempty"`
+	GeneratedAt     time.Time     `json:"generated_at,omitempty"`
+	PrimaryRegion   string        `json:"primary_region,omitempty"`
+	RpoMinutes      int           `json:"rpo_minutes,omitempty"`
+	RtoMinutes      int           `json:"rto_minutes,omitempty"`
+	Source          string        `json:"source,omitempty"`
+	Steps           []RunbookStep `json:"steps,omitempty"`
+	Summary         string        `json:"summary,omitempty"`
+	Version         int           `json:"version,omitempty"`
+}
+
+type DeploymentControlRequest struct {
+	Reason string `json:"reason,omitempty"`
+	User   string `json:"user,omitempty"`
+}
+
+type DeploymentControlResponse struct {
+	DeploymentID  string  `json:"deployment_id,omitempty"`
+	PausedSeconds float64 `json:"paused_seconds,omitempty"`
+	Status        string  `json:"status,omitempty"`
+}
+
+type DeploymentDiff struct {
+	ConfigMapChanges []ConfigChange `json:"config_map_changes,omitempty"`
+	FirstDeployment  bool           `json:"first_deployment,omitempty"`
+	HasChanges       bool           `json:"has_changes,omitempty"`
+	Image            *ValueChange   `json:"image,omitempty"`
+	Replicas         *ReplicaChange `json:"replicas,omitempty"`
+	TerraformPlan    *PlanSummary   `json:"terraform_plan,omitempty"`
+	Version          *ValueChange   `json:"version,omitempty"`
+}
+
+type DeploymentRequest struct {
+	ApplicationName     string                  `json:"application_name,omitempty"`
+	CloudProvider       CloudProvider           `json:"cloud_provider,omitempty"`
+	CommitTime          time.Time               `json:"commit_time,omitempty"`
+	Config              map[string]interface{}  `json:"config,omitempty"`
+	DeploymentID        string                  `json:"deployment_id,omitempty"`
+	DryRun              bool                    `json:"dry_run,omitempty"`
+	Environment         Environment             `json:"environment,omitempty"`
+	HealthProbes        []HealthProbe           `json:"health_probes,omitempty"`
+	OnInterruption      string                  `json:"on_interruption,omitempty"`
+	OnRegionFailure     string                  `json:"on_region_failure,omitempty"`
+	PauseTimeoutSeconds int                     `json:"pause_timeout_seconds,omitempty"`
+	RegionOrdering      string                  `json:"region_ordering,omitempty"`
+	Regions             []RegionTarget          `json:"regions,omitempty"`
+	RequestedBy         string                  `json:"requested_by,omitempty"`
+	RetryPolicy         *RetryPolicy            `json:"retry_policy,omitempty"`
+	Rollback            bool                    `json:"rollback,omitempty"`
+	StepRetryPolicies   map[string]*RetryPolicy `json:"step_retry_policies,omitempty"`
+	Strategy            DeploymentStrategy      `json:"strategy,omitempty"`
+	Version             string                  `json:"version,omitempty"`
+}
+
+type DeploymentResponse struct {
+	DeploymentID     string          `json:"deployment_id,omitempty"`
+	DryRunDiff       *DeploymentDiff `json:"dry_run_diff,omitempty"`
+	DurationSeconds  float64         `json:"duration_seconds,omitempty"`
+	Environment      Environment     `json:"environment,omitempty"`
+	Interruptions    int             `json:"interruptions,omitempty"`
+	Logs             []string        `json:"logs,omitempty"`
+	Message          string          `json:"message,omitempty"`
+	PausedSeconds    float64         `json:"paused_seconds,omitempty"`
+	Postmortem       *Postmortem     `json:"postmortem,omitempty"`
+	Regions          []RegionStatus  `json:"regions,omitempty"`
+	ResourcesChanged int             `json:"resources_changed,omitempty"`
+	RollbackPlan     string          `json:"rollback_plan,omitempty"`
+	Status           string          `json:"status,omitempty"`
+	Timestamp        time.Time       `json:"timestamp,omitempty"`
+}
+
+type DeploymentStrategy string
+
+const (
+	DeploymentStrategyBlueGreen DeploymentStrategy = "blue-green"
+	DeploymentStrategyCanary    DeploymentStrategy = "canary"
+	DeploymentStrategyRolling   DeploymentStrategy = "rolling"
+	DeploymentStrategyRecreate  DeploymentStrategy = "recreate"
+)
+
+type DriftReport struct {
+	DetectedAt       time.Time       `json:"detected_at,omitempty"`
+	DriftedResources []ResourceDrift `json:"drifted_resources,omitempty"`
+	StackDriftStatus string          `json:"stack_drift_status,omitempty"`
+	StackName        string          `json:"stack_name,omitempty"`
+}
+
+type Environment string
+
+const (
+	EnvironmentProduction  Environment = "production"
+	EnvironmentStaging     Environment = "staging"
+	EnvironmentDevelopment Environment = "development"
+)
+
+type ErrorClass string
+
+const (
+	ErrorClassImagePull  ErrorClass = "image_pull"
+	ErrorClassThrottling ErrorClass = "throttling"
+	ErrorClassTimeout    ErrorClass = "timeout"
+	ErrorClassNetwork    ErrorClass = "network"
+	ErrorClassPermanent  ErrorClass = "permanent"
+)
+
+type ErrorResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+type FailedTest struct {
+	Message string `json:"message,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Suite   string `json:"suite,omitempty"`
+}
+
+type HealthProbe struct {
+	Command         string    `json:"command,omitempty"`
+	ExpectedStatus  int       `json:"expected_status,omitempty"`
+	Host            string    `json:"host,omitempty"`
+	IntervalSeconds int       `json:"interval_seconds,omitempty"`
+	Name            string    `json:"name,omitempty"`
+	Path            string    `json:"path,omitempty"`
+	Retries         *int      `json:"retries,omitempty"`
+	TimeoutSeconds  int       `json:"timeout_seconds,omitempty"`
+	Type            ProbeType `json:"type,omitempty"`
+}
+
+type IaCEngineType string
+
+const (
+	IaCEngineTypeTerraform      IaCEngineType = "terraform"
+	IaCEngineTypePulumi         IaCEngineType = "pulumi"
+	IaCEngineTypeCloudformation IaCEngineType = "cloudformation"
+)
+
+type InfrastructureRequest struct {
+	Action           string                   `json:"action,omitempty"`
+	BudgetOverrideID string                   `json:"budget_override_id,omitempty"`
+	CloudProvider    CloudProvider            `json:"cloud_provider,omitempty"`
+	Cloudformation   *CloudFormationStack     `json:"cloudformation,omitempty"`
+	Engine           IaCEngineType            `json:"engine,omitempty"`
+	Environment      Environment              `json:"environment,omitempty"`
+	PulumiProgram    *PulumiProgram           `json:"pulumi_program,omitempty"`
+	RequestID        string                   `json:"request_id,omitempty"`
+	RequestedBy      string                   `json:"requested_by,omitempty"`
+	Resources        []InfrastructureResource `json:"resources,omitempty"`
+	Stack            string                   `json:"stack,omitempty"`
+	Team             string                   `json:"team,omitempty"`
+	TerraformCode    string                   `json:"terraform_code,omitempty"`
+	Variables        map[string]interface{}   `json:"variables,omitempty"`
+}
+
+type InfrastructureResource struct {
+	Config map[string]interface{} `json:"config,omitempty"`
+	Name   string                 `json:"name,omitempty"`
+	Type   string                 `json:"type,omitempty"`
+}
+
+type InfrastructureResponse struct {
+	BudgetViolation     *BudgetViolation           `json:"budget_violation,omitempty"`
+	CostEstimateMonthly float64                    `json:"cost_estimate_monthly,omitempty"`
+	Drift               *DriftReport               `json:"drift,omitempty"`
+	DurationSeconds     float64                    `json:"duration_seconds,omitempty"`
+	Error               string                     `json:"error,omitempty"`
+	PlanOutput          string                     `json:"plan_output,omitempty"`
+	Recommendations     []string                   `json:"recommendations,omitempty"`
+	RequestID           string                     `json:"request_id,omitempty"`
+	ResourcesCreated    int                        `json:"resources_created,omitempty"`
+	ResourcesDeleted    int                        `json:"resources_deleted,omitempty"`
+	ResourcesUpdated    int                        `json:"resources_updated,omitempty"`
+	Status              string                     `json:"status,omitempty"`
+	Validation          *TerraformValidationReport `json:"validation,omitempty"`
+	Violations          []VariableViolation        `json:"violations,omitempty"`
+}
+
+type IntegrationTestConfig struct {
+	ComposeFile string          `json:"compose_file,omitempty"`
+	Containers  []TestContainer `json:"containers,omitempty"`
+	JunitReport string          `json:"junit_report,omitempty"`
+	MinPassRate float64         `json:"min_pass_rate,omitempty"`
+}
+
+type InventoryResource struct {
+	ID               string            `json:"id,omitempty"`
+	Managed          bool              `json:"managed,omitempty"`
+	Name             string            `json:"name,omitempty"`
+	OrphanReason     string            `json:"orphan_reason,omitempty"`
+	Orphaned         bool              `json:"orphaned,omitempty"`
+	Region           string            `json:"region,omitempty"`
+	Tags             map[string]string `json:"tags,omitempty"`
+	TerraformAddress string            `json:"terraform_address,omitempty"`
+	Type             string            `json:"type,omitempty"`
+}
+
+type InventoryResponse struct {
+	Account         string              `json:"account,omitempty"`
+	GeneratedAt     time.Time           `json:"generated_at,omitempty"`
+	Provider        CloudProvider       `json:"provider,omitempty"`
+	Recommendations []string            `json:"recommendations,omitempty"`
+	Resources       []InventoryResource `json:"resources,omitempty"`
+	Summary         InventorySummary    `json:"summary,omitempty"`
+}
+
+type InventorySummary struct {
+	Managed   int `json:"managed,omitempty"`
+	Orphaned  int `json:"orphaned,omitempty"`
+	Total     int `json:"total,omitempty"`
+	Unmanaged int `json:"unmanaged,omitempty"`
+}
+
+type PipelineRequest struct {
+	Branch      string            `json:"branch,omitempty"`
+	Environment Environment       `json:"environment,omitempty"`
+	PipelineID  string            `json:"pipeline_id,omitempty"`
+	Repository  string            `json:"repository,omitempty"`
+	Secrets     map[string]string `json:"secrets,omitempty"`
+	Stages      []PipelineStage   `json:"stages,omitempty"`
+}
+
+type PipelineResponse struct {
+	Artifacts       []string      `json:"artifacts,omitempty"`
+	DurationSeconds float64       `json:"duration_seconds,omitempty"`
+	Error           string        `json:"error,omitempty"`
+	PipelineID      string        `json:"pipeline_id,omitempty"`
+	StageResults    []StageResult `json:"stage_results,omitempty"`
+	Status          string        `json:"status,omitempty"`
+}
+
+type PipelineStage struct {
+	Commands        []string               `json:"commands,omitempty"`
+	IntegrationTest *IntegrationTestConfig `json:"integration_test,omitempty"`
+	Name            string                 `json:"name,omitempty"`
+	Timeout         int                    `json:"timeout,omitempty"`
+	Type            StageType              `json:"type,omitempty"`
+}
+
+type PlanSummary struct {
+	Available bool   `json:"available,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Output    string `json:"output,omitempty"`
+	ToAdd     int    `json:"to_add,omitempty"`
+	ToChange  int    `json:"to_change,omitempty"`
+	ToDestroy int    `json:"to_destroy,omitempty"`
+}
+
+type Postmortem struct {
+	ActionItems         []PostmortemActionItem `json:"action_items,omitempty"`
+	ApplicationName     string                 `json:"application_name,omitempty"`
+	ContributingFactors []string               `json:"contributing_factors,omitempty"`
+	DeploymentID        string                 `json:"deployment_id,omitempty"`
+	Environment         Environment            `json:"environment,omitempty"`
+	GeneratedAt         time.Time              `json:"generated_at,omitempty"`
+	ProbableCause       string                 `json:"probable_cause,omitempty"`
+	Source              string                 `json:"source,omitempty"`
+	Strategy            DeploymentStrategy     `json:"strategy,omitempty"`
+	Summary             string                 `json:"summary,omitempty"`
+	Timeline            []PostmortemEvent      `json:"timeline,omitempty"`
+}
+
+type PostmortemActionItem struct {
+	Description string `json:"description,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+	Priority    string `json:"priority,omitempty"`
+}
+
+type PostmortemEvent struct {
+	Event string `json:"event,omitempty"`
+	Time  string `json:"time,omitempty"`
+}
+
+type ProbeType string
+
+const (
+	ProbeTypeHTTP    ProbeType = "http"
+	ProbeTypeTcp     ProbeType = "tcp"
+	ProbeTypeCommand ProbeType = "command"
+)
+
+type PropertyDifference struct {
+	ActualValue    string `json:"actual_value,omitempty"`
+	DifferenceType string `json:"difference_type,omitempty"`
+	ExpectedValue  string `json:"expected_value,omitempty"`
+	PropertyPath   string `json:"property_path,omitempty"`
+}
+
+type PulumiProgram struct {
+	Secrets []string `json:"secrets,omitempty"`
+	Stack   string   `json:"stack,omitempty"`
+	WorkDir string   `json:"work_dir,omitempty"`
+	Yaml    string   `json:"yaml,omitempty"`
+}
+
+type RegionStatus struct {
+	Cluster         string   `json:"cluster,omitempty"`
+	DurationSeconds float64  `json:"duration_seconds,omitempty"`
+	Logs            []string `json:"logs,omitempty"`
+	Message         string   `json:"message,omitempty"`
+	Region          string   `json:"region,omitempty"`
+	Status          string   `json:"status,omitempty"`
+	Wave            int      `json:"wave,omitempty"`
+}
+
+type RegionTarget struct {
+	Cluster        string `json:"cluster,omitempty"`
+	HealthCheckURL string `json:"health_check_url,omitempty"`
+	Region         string `json:"region,omitempty"`
+	Wave           int    `json:"wave,omitempty"`
+}
+
+type ReplicaChange struct {
+	From int `json:"from,omitempty"`
+	To   int `json:"to,omitempty"`
+}
+
+type ResourceDrift struct {
+	Differences        []PropertyDifference `json:"differences,omitempty"`
+	DriftStatus        string               `json:"drift_status,omitempty"`
+	LogicalResourceID  string               `json:"logical_resource_id,omitempty"`
+	PhysicalResourceID string               `json:"physical_resource_id,omitempty"`
+	ResourceType       string               `json:"resource_type,omitempty"`
+}
+
+type RetryPolicy struct {
+	InitialBackoffMs int          `json:"initial_backoff_ms,omitempty"`
+	MaxAttempts      int          `json:"max_attempts,omitempty"`
+	MaxBackoffMs     int          `json:"max_backoff_ms,omitempty"`
+	Multiplier       float64      `json:"multiplier,omitempty"`
+	RetryableErrors  []ErrorClass `json:"retryable_errors,omitempty"`
+}
+
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleDeployer Role = "deployer"
+	RoleAdmin    Role = "admin"
+)
+
+type RoleBinding struct {
+	Environment string    `json:"environment"`
+	GrantedAt   time.Time `json:"granted_at,omitempty"`
+	GrantedBy   string    `json:"granted_by,omitempty"`
+	Principal   string    `json:"principal"`
+	Role        Role      `json:"role"`
+}
+
+type RoleBindingsResponse struct {
+	Bindings  []RoleBinding `json:"bindings,omitempty"`
+	Principal string        `json:"principal,omitempty"`
+}
+
+type RunbookDecisionRequest struct {
+	User string `json:"user,omitempty"`
+}
+
+type RunbookDecisionResponse struct {
+	Approved    bool   `json:"approved,omitempty"`
+	ExecutionID string `json:"execution_id,omitempty"`
+}
+
+type RunbookExecution struct {
+	ApplicationName string              `json:"application_name,omitempty"`
+	CompletedAt     time.Time           `json:"completed_at,omitempty"`
+	ConfirmBy       time.Time           `json:"confirm_by,omitempty"`
+	CurrentStep     int                 `json:"current_step,omitempty"`
+	DryRun          bool                `json:"dry_run,omitempty"`
+	ExecutionID     string              `json:"execution_id,omitempty"`
+	IncidentID      string              `json:"incident_id,omitempty"`
+	Logs            []string            `json:"logs,omitempty"`
+	RunbookVersion  int                 `json:"runbook_version,omitempty"`
+	StartedAt       time.Time           `json:"started_at,omitempty"`
+	Status          string              `json:"status,omitempty"`
+	StepResults     []RunbookStepResult `json:"step_results,omitempty"`
+}
+
+type RunbookExecutionRequest struct {
+	ConfirmationTimeoutSeconds int    `json:"confirmation_timeout_seconds,omitempty"`
+	DryRun                     bool   `json:"dry_run,omitempty"`
+	IncidentID                 string `json:"incident_id,omitempty"`
+	Version                    int    `json:"version,omitempty"`
+}
+
+type RunbookGeneration struct {
+	ApplicationName string     `json:"application_name,omitempty"`
+	CompletedAt     time.Time  `json:"completed_at,omitempty"`
+	Error           string     `json:"error,omitempty"`
+	GenerationID    string     `json:"generation_id,omitempty"`
+	RequestedAt     time.Time  `json:"requested_at,omitempty"`
+	Runbook         *DRRunbook `json:"runbook,omitempty"`
+	Status          string     `json:"status,omitempty"`
+}
+
+type RunbookRequest struct {
+	ApplicationName string        `json:"application_name"`
+	CloudProvider   CloudProvider `json:"cloud_provider,omitempty"`
+	Components      []string      `json:"components,omitempty"`
+	Environment     Environment   `json:"environment,omitempty"`
+	FailoverRegion  string        `json:"failover_region,omitempty"`
+	PrimaryRegion   string        `json:"primary_region,omitempty"`
+	RpoMinutes      int           `json:"rpo_minutes,omitempty"`
+	RtoMinutes      int           `json:"rto_minutes,omitempty"`
+}
+
+type RunbookStep struct {
+	Command              string          `json:"command,omitempty"`
+	Description          string          `json:"description,omitempty"`
+	Name                 string          `json:"name,omitempty"`
+	Order                int             `json:"order,omitempty"`
+	RequiresConfirmation bool            `json:"requires_confirmation,omitempty"`
+	RollbackCommand      string          `json:"rollback_command,omitempty"`
+	TimeoutSeconds       int             `json:"timeout_seconds,omitempty"`
+	Type                 RunbookStepType `json:"type,omitempty"`
+}
+
+type RunbookStepResult struct {
+	ConfirmedBy     string    `json:"confirmed_by,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds,omitempty"`
+	Name            string    `json:"name,omitempty"`
+	Order           int       `json:"order,omitempty"`
+	Output          string    `json:"output,omitempty"`
+	StartedAt       time.Time `json:"started_at,omitempty"`
+	Status          string    `json:"status,omitempty"`
+}
+
+type RunbookStepType string
+
+const (
+	RunbookStepTypeFailover      RunbookStepType = "failover"
+	RunbookStepTypeDNSChange     RunbookStepType = "dns_change"
+	RunbookStepTypeDataRestore   RunbookStepType = "data_restore"
+	RunbookStepTypeVerification  RunbookStepType = "verification"
+	RunbookStepTypeCommunication RunbookStepType = "communication"
+)
+
+type RunbookVersionsResponse struct {
+	ApplicationName string `json:"application_name,omitempty"`
+	Versions        []int  `json:"versions,omitempty"`
+}
+
+type StageResult struct {
+	DurationSeconds float64      `json:"duration_seconds,omitempty"`
+	Name            string       `json:"name,omitempty"`
+	Output          string       `json:"output,omitempty"`
+	Status          string       `json:"status,omitempty"`
+	TestResults     *TestResults `json:"test_results,omitempty"`
+	Type            StageType    `json:"type,omitempty"`
+}
+
+type StageType string
+
+const (
+	StageTypeCommand         StageType = "command"
+	StageTypeIntegrationTest StageType = "integration_test"
+	StageTypeDeploy          StageType = "deploy"
+)
+
+type TerraformDiagnostic struct {
+	Detail   string `json:"detail,omitempty"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Summary  string `json:"summary,omitempty"`
+}
+
+type TerraformValidationAttempt struct {
+	Attempt     int                   `json:"attempt,omitempty"`
+	Diagnostics []TerraformDiagnostic `json:"diagnostics,omitempty"`
+}
+
+type TerraformValidationReport struct {
+	Attempts []TerraformValidationAttempt `json:"attempts,omitempty"`
+	Repairs  int                          `json:"repairs,omitempty"`
+	Tflint   bool                         `json:"tflint,omitempty"`
+	Valid    bool                         `json:"valid,omitempty"`
+}
+
+type TestContainer struct {
+	Env   map[string]string `json:"env,omitempty"`
+	Image string            `json:"image,omitempty"`
+	Name  string            `json:"name,omitempty"`
+	Port  int               `json:"port,omitempty"`
+}
+
+type TestResults struct {
+	Errors      int          `json:"errors,omitempty"`
+	Failed      int          `json:"failed,omitempty"`
+	FailedTests []FailedTest `json:"failed_tests,omitempty"`
+	PassRate    float64      `json:"pass_rate,omitempty"`
+	Passed      int          `json:"passed,omitempty"`
+	Skipped     int          `json:"skipped,omitempty"`
+	Total       int          `json:"total,omitempty"`
+}
+
+type ValueChange struct {
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+type VariableValidationResponse struct {
+	Error      string              `json:"error,omitempty"`
+	Violations []VariableViolation `json:"violations,omitempty"`
+}
+
+type VariableViolation struct {
+	Detail   string `json:"detail,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Problem  string `json:"problem,omitempty"`
+	Variable string `json:"variable,omitempty"`
+}
+
+// AbortRunbookExecution calls POST /api/v1/dr/executions/{id}/abort: Abort a runbook execution at its confirmation checkpoint
+func (c *Client) AbortRunbookExecution(ctx context.Context, id string, req *RunbookDecisionRequest) (*RunbookDecisionResponse, error) {
+	query := url.Values{}
+	var out RunbookDecisionResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/dr/executions/"+url.PathEscape(id)+"/abort", query, req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ApproveBudgetOverride calls POST /api/v1/budgets/overrides/{id}/approve: Approve a budget override so a blocked apply can be resubmitted
+func (c *Client) ApproveBudgetOverride(ctx context.Context, id string, req *BudgetOverrideApproval) (*BudgetOverride, error) {
+	query := url.Values{}
+	var out BudgetOverride
+	if err := c.do(ctx, http.MethodPost, "/api/v1/budgets/overrides/"+url.PathEscape(id)+"/approve", query, req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CancelDeployment calls POST /api/v1/deploy/{id}/cancel: Cancel a queued or in-progress deployment
+func (c *Client) CancelDeployment(ctx context.Context, id string) (*DeploymentResponse, error) {
+	query := url.Values{}
+	var out DeploymentResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/deploy/"+url.PathEscape(id)+"/cancel", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ConfirmRunbookStep calls POST /api/v1/dr/executions/{id}/confirm: Confirm the runbook step awaiting operator approval
+func (c *Client) ConfirmRunbookStep(ctx context.Context, id string, req *RunbookDecisionRequest) (*RunbookDecisionResponse, error) {
+	query := url.Values{}
+	var out RunbookDecisionResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/dr/executions/"+url.PathEscape(id)+"/confirm", query, req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteRoleBinding calls DELETE /api/v1/rbac/bindings/{principal}/{environment}: Revoke a principal's role binding in an environment
+func (c *Client) DeleteRoleBinding(ctx context.Context, principal string, environment string) (*RoleBindingsResponse, error) {
+	query := url.Values{}
+	var out RoleBindingsResponse
+	if err := c.do(ctx, http.MethodDelete, "/api/v1/rbac/bindings/"+url.PathEscape(principal)+"/"+url.PathEscape(environment), query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Deploy calls POST /api/v1/deploy: Queue an application deployment (or dry run) for the worker pool
+func (c *Client) Deploy(ctx context.Context, req *DeploymentRequest) (*DeploymentResponse, error) {
+	query := url.Values{}
+	var out DeploymentResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/deploy", query, req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ExecuteRunbook calls POST /api/v1/dr/runbooks/{app}/execute: Start executing a DR runbook
+func (c *Client) ExecuteRunbook(ctx context.Context, app string, req *RunbookExecutionRequest) (*RunbookExecution, error) {
+	query := url.Values{}
+	var out RunbookExecution
+	if err := c.do(ctx, http.MethodPost, "/api/v1/dr/runbooks/"+url.PathEscape(app)+"/execute", query, req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GenerateRunbook calls POST /api/v1/dr/runbooks: Start generating a new DR runbook version; poll the generation for the runbook
+func (c *Client) GenerateRunbook(ctx context.Context, req *RunbookRequest) (*RunbookGeneration, error) {
+	query := url.Values{}
+	var out RunbookGeneration
+	if err := c.do(ctx, http.MethodPost, "/api/v1/dr/runbooks", query, req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetAuditLogParams holds optional query parameters; zero values are omitted
+type GetAuditLogParams struct {
+	// Maximum records to return, default 100
+	Limit int
+}
+
+// GetAuditLog calls GET /api/v1/rbac/audit: List recent audit records, newest first
+func (c *Client) GetAuditLog(ctx context.Context, params *GetAuditLogParams) (*AuditLogResponse, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.Limit != 0 {
+			query.Set("limit", strconv.Itoa(params.Limit))
+		}
+	}
+	var out AuditLogResponse
+	if err := c.do(ctx, http.MethodGet, "/api/v1/rbac/audit", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetBudget calls GET /api/v1/budgets/{scope}/{name}: Get a budget and its spend for the current month
+func (c *Client) GetBudget(ctx context.Context, scope string, name string) (*BudgetStatus, error) {
+	query := url.Values{}
+	var out BudgetStatus
+	if err := c.do(ctx, http.MethodGet, "/api/v1/budgets/"+url.PathEscape(scope)+"/"+url.PathEscape(name), query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetDORAMetricsParams holds optional query parameters; zero values are omitted
+type GetDORAMetricsParams struct {
+	// Only this application
+	Application string
+	// Only this environment
+	Environment string
+	// Window in days, 1-90, default 30
+	Days int
+}
+
+// GetDORAMetrics calls GET /api/v1/metrics/dora: Deployment frequency, lead time, change failure rate, and MTTR per application and environment
+func (c *Client) GetDORAMetrics(ctx context.Context, params *GetDORAMetricsParams) (*DORAMetricsResponse, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.Application != "" {
+			query.Set("application", params.Application)
+		}
+		if params.Environment != "" {
+			query.Set("environment", params.Environment)
+		}
+		if params.Days != 0 {
+			query.Set("days", strconv.Itoa(params.Days))
+		}
+	}
+	var out DORAMetricsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/v1/metrics/dora", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetDeployment calls GET /api/v1/deploy/{id}: Get a deployment's result, or its queued/in-progress status and logs
+func (c *Client) GetDeployment(ctx context.Context, id string) (*DeploymentResponse, error) {
+	query := url.Values{}
+	var out DeploymentResponse
+	if err := c.do(ctx, http.MethodGet, "/api/v1/deploy/"+url.PathEscape(id), query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetInfrastructureRequest calls GET /api/v1/infrastructure/requests/{id}: Get an infrastructure request's outcome; 202 while it is queued or running
+func (c *Client) GetInfrastructureRequest(ctx context.Context, id string) (*InfrastructureResponse, error) {
+	query := url.Values{}
+	var out InfrastructureResponse
+	if err := c.do(ctx, http.MethodGet, "/api/v1/infrastructure/requests/"+url.PathEscape(id), query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetInventoryParams holds optional query parameters; zero values are omitted
+type GetInventoryParams struct {
+	// aws, azure, or gcp
+	Provider string
+	// AWS profile, Azure subscription, or GCP project (required for gcp)
+	Account string
+	// Bypass the one-hour inventory cache
+	Refresh bool
+}
+
+// GetInventory calls GET /api/v1/infrastructure/inventory: List an account's cloud resources, marked managed/unmanaged against Terraform state, with orphans flagged
+func (c *Client) GetInventory(ctx context.Context, params *GetInventoryParams) (*InventoryResponse, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.Provider != "" {
+			query.Set("provider", params.Provider)
+		}
+		if params.Account != "" {
+			query.Set("account", params.Account)
+		}
+		if params.Refresh {
+			query.Set("refresh", "true")
+		}
+	}
+	var out InventoryResponse
+	if err := c.do(ctx, http.MethodGet, "/api/v1/infrastructure/inventory", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetPipeline calls GET /api/v1/pipelines/{id}: Get a pipeline run's status and stage results
+func (c *Client) GetPipeline(ctx context.Context, id string) (*PipelineResponse, error) {
+	query := url.Values{}
+	var out PipelineResponse
+	if err := c.do(ctx, http.MethodGet, "/api/v1/pipelines/"+url.PathEscape(id), query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetPostmortem calls GET /api/v1/deploy/{id}/postmortem: Get the postmortem drafted for a failed deployment
+func (c *Client) GetPostmortem(ctx context.Context, id string) (*Postmortem, error) {
+	query := url.Values{}
+	var out Postmortem
+	if err := c.do(ctx, http.MethodGet, "/api/v1/deploy/"+url.PathEscape(id)+"/postmortem", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetRoleBindings calls GET /api/v1/rbac/bindings/{principal}: List a principal's role bindings
+func (c *Client) GetRoleBindings(ctx context.Context, principal string) (*RoleBindingsResponse, error) {
+	query := url.Values{}
+	var out RoleBindingsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/v1/rbac/bindings/"+url.PathEscape(principal), query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetRunbookParams holds optional query parameters; zero values are omitted
+type GetRunbookParams struct {
+	// Runbook version, latest when omitted
+	Version int
+}
+
+// GetRunbook calls GET /api/v1/dr/runbooks/{app}: Get the latest or a specific DR runbook version
+func (c *Client) GetRunbook(ctx context.Context, app string, params *GetRunbookParams) (*DRRunbook, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.Version != 0 {
+			query.Set("version", strconv.Itoa(params.Version))
+		}
+	}
+	var out DRRunbook
+	if err := c.do(ctx, http.MethodGet, "/api/v1/dr/runbooks/"+url.PathEscape(app), query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetRunbookExecution calls GET /api/v1/dr/executions/{id}: Get DR runbook execution status
+func (c *Client) GetRunbookExecution(ctx context.Context, id string) (*RunbookExecution, error) {
+	query := url.Values{}
+	var out RunbookExecution
+	if err := c.do(ctx, http.MethodGet, "/api/v1/dr/executions/"+url.PathEscape(id), query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetRunbookGeneration calls GET /api/v1/dr/generations/{id}: Get a runbook generation's status, and the runbook once it completes
+func (c *Client) GetRunbookGeneration(ctx context.Context, id string) (*RunbookGeneration, error) {
+	query := url.Values{}
+	var out RunbookGeneration
+	if err := c.do(ctx, http.MethodGet, "/api/v1/dr/generations/"+url.PathEscape(id), query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// IssueToken calls POST /api/v1/rbac/tokens: Issue an API token for a principal
+func (c *Client) IssueToken(ctx context.Context, req *APITokenRequest) (*APITokenResponse, error) {
+	query := url.Values{}
+	var out APITokenResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/rbac/tokens", query, req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListRunbookVersions calls GET /api/v1/dr/runbooks/{app}/versions: List stored DR runbook versions
+func (c *Client) ListRunbookVersions(ctx context.Context, app string) (*RunbookVersionsResponse, error) {
+	query := url.Values{}
+	var out RunbookVersionsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/v1/dr/runbooks/"+url.PathEscape(app)+"/versions", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListTokens calls GET /api/v1/rbac/tokens/{principal}: List a principal's unexpired API tokens
+func (c *Client) ListTokens(ctx context.Context, principal string) (*APITokensResponse, error) {
+	query := url.Values{}
+	var out APITokensResponse
+	if err := c.do(ctx, http.MethodGet, "/api/v1/rbac/tokens/"+url.PathEscape(principal), query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ManageInfrastructure calls POST /api/v1/infrastructure: Queue a Terraform, Pulumi, or CloudFormation plan, apply, or destroy for the worker pool
+func (c *Client) ManageInfrastructure(ctx context.Context, req *InfrastructureRequest) (*InfrastructureResponse, error) {
+	query := url.Values{}
+	var out InfrastructureResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/infrastructure", query, req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PauseDeployment calls POST /api/v1/deploy/{id}/pause: Pause an in-flight rollout at its next step boundary
+func (c *Client) PauseDeployment(ctx context.Context, id string, req *DeploymentControlRequest) (*DeploymentControlResponse, error) {
+	query := url.Values{}
+	var out DeploymentControlResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/deploy/"+url.PathEscape(id)+"/pause", query, req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ResumeDeployment calls POST /api/v1/deploy/{id}/resume: Resume a paused rollout
+func (c *Client) ResumeDeployment(ctx context.Context, id string, req *DeploymentControlRequest) (*DeploymentControlResponse, error) {
+	query := url.Values{}
+	var out DeploymentControlResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/deploy/"+url.PathEscape(id)+"/resume", query, req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RevokeToken calls DELETE /api/v1/rbac/tokens/{principal}/{id}: Revoke one of a principal's API tokens
+func (c *Client) RevokeToken(ctx context.Context, principal string, id string) (*APITokensResponse, error) {
+	query := url.Values{}
+	var out APITokensResponse
+	if err := c.do(ctx, http.MethodDelete, "/api/v1/rbac/tokens/"+url.PathEscape(principal)+"/"+url.PathEscape(id), query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RunPipeline calls POST /api/v1/pipelines: Queue a CI/CD pipeline run for the worker pool
+func (c *Client) RunPipeline(ctx context.Context, req *PipelineRequest) (*PipelineResponse, error) {
+	query := url.Values{}
+	var out PipelineResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/pipelines", query, req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SetBudget calls PUT /api/v1/budgets: Create or update a monthly team or environment budget
+func (c *Client) SetBudget(ctx context.Context, req *Budget) (*Budget, error) {
+	query := url.Values{}
+	var out Budget
+	if err := c.do(ctx, http.MethodPut, "/api/v1/budgets", query, req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SetRoleBinding calls PUT /api/v1/rbac/bindings: Grant a principal a role in an environment (or "*" for all)
+func (c *Client) SetRoleBinding(ctx context.Context, req *RoleBinding) (*RoleBinding, error) {
+	query := url.Values{}
+	var out RoleBinding
+	if err := c.do(ctx, http.MethodPut, "/api/v1/rbac/bindings", query, req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
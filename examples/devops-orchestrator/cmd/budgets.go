@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// Cost budgets and override approvals
+type BudgetScope string
+
+const (
+	ScopeTeam        BudgetScope = "team"
+	ScopeEnvironment BudgetScope = "environment"
+)
+
+type Budget struct {
+	Scope        BudgetScope `json:"scope" binding:"required"`
+	Name         string      `json:"name" binding:"required"` // team name or environment
+	MonthlyLimit float64     `json:"monthly_limit" binding:"required"`
+	UpdatedAt    time.Time   `json:"updated_at"`
+}
+
+type BudgetStatus struct {
+	Budget    Budget  `json:"budget"`
+	Month     string  `json:"month"`
+	Spent     float64 `json:"spent"`
+	Remaining float64 `json:"remaining"`
+}
+
+// BudgetViolation is returned instead of applying when the estimate would exceed a budget
+type BudgetViolation struct {
+	Scope          BudgetScope `json:"scope"`
+	Name           string      `json:"name"`
+	Month          string      `json:"month"`
+	MonthlyLimit   float64     `json:"monthly_limit"`
+	Spent          float64     `json:"spent"` // by other stacks this month
+	CostEstimate   float64     `json:"cost_estimate"`
+	ProjectedSpend float64     `json:"projected_spend"`
+	OverrideID     string      `json:"override_id"`
+}
+
+type BudgetOverride struct {
+	ID           string      `json:"id"`
+	RequestID    string      `json:"request_id"`
+	Team         string      `json:"team,omitempty"`
+	Environment  Environment `json:"environment,omitempty"`
+	CostEstimate float64     `json:"cost_estimate"`
+	Status       string      `json:"status"` // "pending", "approved", "used"
+	RequestedAt  time.Time   `json:"requested_at"`
+	ApprovedBy   string      `json:"approved_by,omitempty"`
+	Reason       string      `json:"reason,omitempty"`
+	ApprovedAt   *time.Time  `json:"approved_at,omitempty"`
+}
+
+// BudgetOverrideApproval names the approver when RBAC is disabled; with RBAC the authenticated
+// principal is recorded instead
+type BudgetOverrideApproval struct {
+	Approver string `json:"approver,omitempty"`
+	Reason   string `json:"reason" binding:"required"`
+}
+
+const (
+	budgetOverrideTTL = 24 * time.Hour
+	budgetSpendTTL    = 400 * 24 * time.Hour
+)
+
+// reserveBudgetScript checks every budget of an apply and records its estimate in one step, so
+// concurrent applies can't both pass the check. Each spend key is a hash of estimates by requester
+// and stack, and a re-apply replaces that stack's earlier estimate. KEYS are the spend hashes; ARGV is the
+// stack, the estimate, the TTL in seconds, then each key's limit (negative for none). It returns
+// {index of the exceeded budget, spend by other stacks} or {0, previous estimates}.
+var reserveBudgetScript = redis.NewScript(`
+local stack, estimate = ARGV[1], tonumber(ARGV[2])
+for i, key in ipairs(KEYS) do
+  local limit = tonumber(ARGV[3 + i])
+  if limit >= 0 then
+    local spent = 0
+    for _, value in ipairs(redis.call('HVALS', key)) do
+      spent = spent + tonumber(value)
+    end
+    spent = spent - (tonumber(redis.call('HGET', key, stack)) or 0)
+    if spent + estimate > limit then
+      return {i, tostring(spent)}
+    end
+  end
+end
+local previous = {}
+for i, key in ipairs(KEYS) do
+  previous[i] = redis.call('HGET', key, stack) or ''
+  redis.call('HSET', key, stack, ARGV[2])
+  redis.call('EXPIRE', key, ARGV[3])
+end
+return {0, previous}
+`)
+
+// releaseBudgetScript restores the estimates a failed apply replaced, unless another apply of the
+// same stack has recorded its own since. ARGV is the stack, the released estimate, then each
+// key's previous estimate (empty for none).
+var releaseBudgetScript = redis.NewScript(`
+for i, key in ipairs(KEYS) do
+  if redis.call('HGET', key, ARGV[1]) == ARGV[2] then
+    if ARGV[2 + i] == '' then
+      redis.call('HDEL', key, ARGV[1])
+    else
+      redis.call('HSET', key, ARGV[1], ARGV[2 + i])
+    end
+  end
+end
+return 0
+`)
+
+// budgetReservation is an apply's estimate recorded against its budgets before it runs
+type budgetReservation struct {
+	keys     []string
+	stack    string
+	estimate string
+	previous []interface{}
+}
+
+type BudgetManager struct {
+	redis *redis.Client
+}
+
+func NewBudgetManager(redisClient *redis.Client) *BudgetManager {
+	return &BudgetManager{
+		redis: redisClient,
+	}
+}
+
+func (bm *BudgetManager) SetBudget(ctx context.Context, budget *Budget) error {
+	if budget.Scope != ScopeTeam && budget.Scope != ScopeEnvironment {
+		return fmt.Errorf("unsupported budget scope: %s", budget.Scope)
+	}
+	budget.UpdatedAt = time.Now()
+
+	data, err := json.Marshal(budget)
+	if err != nil {
+		return fmt.Errorf("failed to marshal budget: %w", err)
+	}
+	if err := bm.redis.Set(ctx, budgetKey(budget.Scope, budget.Name), data, 0).Err(); err != nil {
+		return fmt.Errorf("failed to store budget: %w", err)
+	}
+	return nil
+}
+
+// GetStatus returns the budget and this month's spend, or nil if no budget is configured
+func (bm *BudgetManager) GetStatus(ctx context.Context, scope BudgetScope, name string) (*BudgetStatus, error) {
+	budget, err := bm.getBudget(ctx, scope, name)
+	if err != nil || budget == nil {
+		return nil, err
+	}
+
+	month := currentBudgetMonth()
+	estimates, err := bm.redis.HVals(ctx, budgetSpendKey(scope, name, month)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get budget spend: %w", err)
+	}
+	spent := 0.0
+	for _, estimate := range estimates {
+		amount, _ := strconv.ParseFloat(estimate, 64)
+		spent += amount
+	}
+
+	return &BudgetStatus{
+		Budget:    *budget,
+		Month:     month,
+		Spent:     spent,
+		Remaining: budget.MonthlyLimit - spent,
+	}, nil
+}
+
+func (bm *BudgetManager) getBudget(ctx context.Context, scope BudgetScope, name string) (*Budget, error) {
+	data, err := bm.redis.Get(ctx, budgetKey(scope, name)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get budget: %w", err)
+	}
+
+	var budget Budget
+	if err := json.Unmarshal(data, &budget); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal budget: %w", err)
+	}
+	return &budget, nil
+}
+
+// Reserve records costEstimate against every applicable budget's monthly spend, as the estimate
+// of the request's stack, unless it would push a budget over its limit; then it returns a
+// violation instead. A matching approved override lets the apply proceed and is consumed. A
+// reservation whose apply fails is undone with Release.
+func (bm *BudgetManager) Reserve(ctx context.Context, req *InfrastructureRequest, costEstimate float64) (*budgetReservation, *BudgetViolation, error) {
+	scopes := budgetScopes(req)
+	month := currentBudgetMonth()
+	reservation := &budgetReservation{
+		keys:     make([]string, len(scopes)),
+		stack:    budgetStack(req),
+		estimate: strconv.FormatFloat(costEstimate, 'f', -1, 64),
+	}
+	limits := make([]float64, len(scopes))
+	budgets := make([]*Budget, len(scopes))
+	for i, scope := range scopes {
+		budget, err := bm.getBudget(ctx, scope.scope, scope.name)
+		if err != nil {
+			return nil, nil, err
+		}
+		reservation.keys[i] = budgetSpendKey(scope.scope, scope.name, month)
+		budgets[i] = budget
+		limits[i] = -1
+		if budget != nil {
+			limits[i] = budget.MonthlyLimit
+		}
+	}
+
+	exceeded, spent, err := bm.reserve(ctx, reservation, limits)
+	if err != nil {
+		return nil, nil, err
+	}
+	if exceeded < 0 {
+		return reservation, nil, nil
+	}
+
+	violation := &BudgetViolation{
+		Scope:          scopes[exceeded].scope,
+		Name:           scopes[exceeded].name,
+		Month:          month,
+		MonthlyLimit:   budgets[exceeded].MonthlyLimit,
+		Spent:          spent,
+		CostEstimate:   costEstimate,
+		ProjectedSpend: spent + costEstimate,
+	}
+
+	if req.BudgetOverrideID != "" {
+		used, err := bm.consumeOverride(ctx, req, costEstimate)
+		if err != nil {
+			return nil, nil, err
+		}
+		if used {
+			log.Printf("Budget override %s used for %s/%s", req.BudgetOverrideID, violation.Scope, violation.Name)
+			for i := range limits {
+				limits[i] = -1
+			}
+			if _, _, err := bm.reserve(ctx, reservation, limits); err != nil {
+				return nil, nil, err
+			}
+			return reservation, nil, nil
+		}
+	}
+
+	override, err := bm.requestOverride(ctx, req, costEstimate)
+	if err != nil {
+		return nil, nil, err
+	}
+	violation.OverrideID = override.ID
+	budgetViolations.WithLabelValues(string(violation.Scope)).Inc()
+
+	return nil, violation, nil
+}
+
+// reserve runs reserveBudgetScript; it returns the index of the exceeded budget and the spend by
+// other stacks against it, or -1 once the estimate is recorded
+func (bm *BudgetManager) reserve(ctx context.Context, reservation *budgetReservation, limits []float64) (int, float64, error) {
+	args := []interface{}{reservation.stack, reservation.estimate, int(budgetSpendTTL.Seconds())}
+	for _, limit := range limits {
+		args = append(args, limit)
+	}
+
+	result, err := reserveBudgetScript.Run(ctx, bm.redis, reservation.keys, args...).Slice()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to reserve budget: %w", err)
+	}
+	if len(result) != 2 {
+		return 0, 0, fmt.Errorf("unexpected budget reservation result: %v", result)
+	}
+
+	if exceeded, _ := result[0].(int64); exceeded > 0 {
+		spentText, _ := result[1].(string)
+		spent, _ := strconv.ParseFloat(spentText, 64)
+		return int(exceeded) - 1, spent, nil
+	}
+	reservation.previous, _ = result[1].([]interface{})
+	return -1, 0, nil
+}
+
+// Release undoes a reservation whose apply failed, restoring the stack's previous estimates
+func (bm *BudgetManager) Release(ctx context.Context, reservation *budgetReservation) {
+	if reservation == nil || len(reservation.keys) == 0 {
+		return
+	}
+
+	args := append([]interface{}{reservation.stack, reservation.estimate}, reservation.previous...)
+	if err := releaseBudgetScript.Run(context.WithoutCancel(ctx), bm.redis, reservation.keys, args...).Err(); err != nil {
+		log.Printf("Failed to release budget reservation for %s: %v", reservation.stack, err)
+	}
+}
+
+func (bm *BudgetManager) requestOverride(ctx context.Context, req *InfrastructureRequest, costEstimate float64) (*BudgetOverride, error) {
+	override := &BudgetOverride{
+		ID:           fmt.Sprintf("override_%d", time.Now().UnixNano()),
+		RequestID:    req.RequestID,
+		Team:         req.Team,
+		Environment:  req.Environment,
+		CostEstimate: costEstimate,
+		Status:       "pending",
+		RequestedAt:  time.Now(),
+	}
+	if err := bm.saveOverride(ctx, override); err != nil {
+		return nil, err
+	}
+	return override, nil
+}
+
+// ApproveOverride marks a pending override approved so the apply can be resubmitted with it
+func (bm *BudgetManager) ApproveOverride(ctx context.Context, id string, approval *BudgetOverrideApproval) (*BudgetOverride, error) {
+	override, err := bm.GetOverride(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if override == nil {
+		return nil, fmt.Errorf("override not found")
+	}
+	if override.Status != "pending" {
+		return nil, fmt.Errorf("override is %s", override.Status)
+	}
+
+	now := time.Now()
+	override.Status = "approved"
+	override.ApprovedBy = approval.Approver
+	override.Reason = approval.Reason
+	override.ApprovedAt = &now
+
+	if err := bm.saveOverride(ctx, override); err != nil {
+		return nil, err
+	}
+	return override, nil
+}
+
+func (bm *BudgetManager) GetOverride(ctx context.Context, id string) (*BudgetOverride, error) {
+	data, err := bm.redis.Get(ctx, budgetOverrideKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get budget override: %w", err)
+	}
+
+	var override BudgetOverride
+	if err := json.Unmarshal(data, &override); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal budget override: %w", err)
+	}
+	return &override, nil
+}
+
+// consumeOverride uses an approved override once, provided it covers the same scope and cost
+func (bm *BudgetManager) consumeOverride(ctx context.Context, req *InfrastructureRequest, costEstimate float64) (bool, error) {
+	override, err := bm.GetOverride(ctx, req.BudgetOverrideID)
+	if err != nil || override == nil {
+		return false, err
+	}
+	if override.Status != "approved" || override.Team != req.Team || override.Environment != req.Environment ||
+		costEstimate > override.CostEstimate {
+		return false, nil
+	}
+
+	// SETNX makes the override single-use even under concurrent applies
+	claimed, err := bm.redis.SetNX(ctx, budgetOverrideKey(override.ID)+":used", req.RequestID, budgetOverrideTTL).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim budget override: %w", err)
+	}
+	if !claimed {
+		return false, nil
+	}
+
+	override.Status = "used"
+	if err := bm.saveOverride(ctx, override); err != nil {
+		log.Printf("Failed to mark budget override %s used: %v", override.ID, err)
+	}
+	return true, nil
+}
+
+func (bm *BudgetManager) saveOverride(ctx context.Context, override *BudgetOverride) error {
+	data, err := json.Marshal(override)
+	if err != nil {
+		return fmt.Errorf("failed to marshal budget override: %w", err)
+	}
+	if err := bm.redis.Set(ctx, budgetOverrideKey(override.ID), data, budgetOverrideTTL).Err(); err != nil {
+		return fmt.Errorf("failed to store budget override: %w", err)
+	}
+	return nil
+}
+
+type budgetScopeName struct {
+	scope BudgetScope
+	name  string
+}
+
+func budgetScopes(req *InfrastructureRequest) []budgetScopeName {
+	scopes := make([]budgetScopeName, 0, 2)
+	if req.Team != "" {
+		scopes = append(scopes, budgetScopeName{ScopeTeam, req.Team})
+	}
+	if req.Environment != "" {
+		scopes = append(scopes, budgetScopeName{ScopeEnvironment, string(req.Environment)})
+	}
+	return scopes
+}
+
+// budgetStack identifies what an apply provisions in the monthly spend: the request's stack,
+// else its CloudFormation stack, else the request itself. The stack name comes from the client,
+// so it is scoped by the requester; otherwise naming another team's stack would replace its
+// estimate and free up their spend.
+func budgetStack(req *InfrastructureRequest) string {
+	stack := "request:" + req.RequestID
+	if req.Stack != "" {
+		stack = req.Stack
+	} else if req.CloudFormation != nil && req.CloudFormation.StackName != "" {
+		stack = fmt.Sprintf("cloudformation:%s:%s", req.CloudFormation.Region, req.CloudFormation.StackName)
+	}
+	return fmt.Sprintf("%q/%s", req.RequestedBy, stack)
+}
+
+func currentBudgetMonth() string {
+	return time.Now().UTC().Format("2006-01")
+}
+
+func budgetKey(scope BudgetScope, name string) string {
+	return fmt.Sprintf("budget:%s:%s", scope, name)
+}
+
+// budgetSpendKey is a hash of a month's applied estimates by requester and stack
+func budgetSpendKey(scope BudgetScope, name, month string) string {
+	return fmt.Sprintf("budget_stack_spend:%s:%s:%s", scope, name, month)
+}
+
+func budgetOverrideKey(id string) string {
+	return fmt.Sprintf("budget_override:%s", id)
+}
+
+// HTTP Handlers
+func (s *APIServer) setBudgetHandler(c *gin.Context) {
+	var budget Budget
+	if err := c.ShouldBindJSON(&budget); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.budgetManager.SetBudget(c.Request.Context(), &budget); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, budget)
+}
+
+func (s *APIServer) getBudgetHandler(c *gin.Context) {
+	status, err := s.budgetManager.GetStatus(c.Request.Context(), BudgetScope(c.Param("scope")), c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if status == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "budget not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+func (s *APIServer) approveBudgetOverrideHandler(c *gin.Context) {
+	var approval BudgetOverrideApproval
+	if err := c.ShouldBindJSON(&approval); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if s.rbac.Enabled() || approval.Approver == "" {
+		approval.Approver = principal(c)
+	}
+
+	override, err := s.budgetManager.ApproveOverride(c.Request.Context(), c.Param("id"), &approval)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, override)
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// Slack ChatOps deploy commands
+const (
+	chatOpsApproveAction = "deploy_approve"
+	chatOpsAbortAction   = "deploy_abort"
+	chatOpsStatusEvery   = 5 * time.Second
+)
+
+// ChatOpsDeployment tracks a Slack-requested deployment from approval through completion
+type ChatOpsDeployment struct {
+	Request     DeploymentRequest `json:"request"`
+	Command     string            `json:"command"`
+	Channel     string            `json:"channel"`
+	MessageTS   string            `json:"message_ts"`
+	RequestedBy string            `json:"requested_by"`
+	ApprovedBy  string            `json:"approved_by,omitempty"`
+	Status      string            `json:"status"` // "pending", "running", "success", "failed", "aborted"
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// DeployIntent is the structured form of a free-text deploy command
+type DeployIntent struct {
+	ApplicationName string             `json:"application_name"`
+	Version         string             `json:"version"`
+	Environment     Environment        `json:"environment"`
+	Strategy        DeploymentStrategy `json:"strategy"`
+}
+
+var deployCommandPattern = regexp.MustCompile(`^(\S+)\s+v?(\S+)\s+to\s+(\S+)(?:\s+(\S+))?$`)
+
+type ChatOpsManager struct {
+	redis        *redis.Client
+	claudeClient *ClaudeClient
+	slack        *SlackClient
+	queue        *DeploymentQueue
+	rbac         *RBACManager
+}
+
+func NewChatOpsManager(redisClient *redis.Client, claudeClient *ClaudeClient, slack *SlackClient, queue *DeploymentQueue, rbac *RBACManager) *ChatOpsManager {
+	return &ChatOpsManager{
+		redis:        redisClient,
+		claudeClient: claudeClient,
+		slack:        slack,
+		queue:        queue,
+		rbac:         rbac,
+	}
+}
+
+// HandleCommand parses a slash command and posts it to the channel for approval
+func (cm *ChatOpsManager) HandleCommand(ctx context.Context, text, user, channel, responseURL string) {
+	intent, err := cm.claudeClient.ParseDeployCommand(ctx, text)
+	if err != nil {
+		log.Printf("Claude deploy command parsing failed, using pattern: %v", err)
+		intent, err = parseDeployCommand(text)
+	}
+	if err != nil {
+		cm.slack.RespondEphemeral(ctx, responseURL, fmt.Sprintf("Couldn't understand `%s`: %v\nTry `/deploy myapp v1.2 to staging canary`.", text, err))
+		return
+	}
+
+	deployment := &ChatOpsDeployment{
+		Request: DeploymentRequest{
+			DeploymentID:    fmt.Sprintf("deploy_%d", time.Now().UnixNano()),
+			ApplicationName: intent.ApplicationName,
+			Version:         intent.Version,
+			Environment:     intent.Environment,
+			Strategy:        intent.Strategy,
+			Config:          map[string]interface{}{},
+		},
+		Command:     text,
+		Channel:     channel,
+		RequestedBy: user,
+		Status:      "pending",
+		CreatedAt:   time.Now(),
+	}
+
+	ts, err := cm.slack.PostMessage(ctx, channel, "", deployment.summary(), deployment.blocks())
+	if err != nil {
+		log.Printf("Failed to post ChatOps approval message: %v", err)
+		cm.slack.RespondEphemeral(ctx, responseURL, "Failed to post the deployment for approval: "+err.Error())
+		return
+	}
+	deployment.MessageTS = ts
+
+	if err := cm.save(ctx, deployment); err != nil {
+		log.Printf("Failed to save ChatOps deployment: %v", err)
+	}
+}
+
+// HandleAction applies an approve/abort button press
+func (cm *ChatOpsManager) HandleAction(ctx context.Context, actionID, deploymentID, user string) error {
+	deployment, err := cm.load(ctx, deploymentID)
+	if err != nil {
+		return err
+	}
+	if deployment == nil {
+		return fmt.Errorf("deployment %s not found", deploymentID)
+	}
+
+	// Slack users are bound to roles as "slack:<user id>" principals
+	record := AuditRecord{
+		Principal:   "slack:" + user,
+		Action:      actionID,
+		Environment: string(deployment.Request.Environment),
+		Resource:    "chatops:" + deploymentID,
+	}
+	if cm.rbac.Enabled() {
+		perm := Permission{Role: RoleDeployer, Environment: string(deployment.Request.Environment)}
+		if err := cm.rbac.Authorize(ctx, record.Principal, perm); err != nil {
+			record.Reason = err.Error()
+			cm.rbac.Audit(ctx, record)
+			return err
+		}
+	}
+	record.Allowed = true
+	defer cm.rbac.Audit(ctx, record)
+
+	switch actionID {
+	case chatOpsApproveAction:
+		if deployment.Status != "pending" {
+			return fmt.Errorf("deployment is already %s", deployment.Status)
+		}
+		if deployment.Request.Environment == Production && user == deployment.RequestedBy {
+			return fmt.Errorf("production deployments must be approved by someone other than the requester")
+		}
+		won, decision, err := cm.decide(ctx, deploymentID, "approved")
+		if err != nil {
+			return err
+		}
+		if !won {
+			return fmt.Errorf("deployment was already %s", decision)
+		}
+		deployment.Status = "running"
+		deployment.ApprovedBy = user
+		deployment.Request.RequestedBy = "slack:" + deployment.RequestedBy
+		if err := cm.save(ctx, deployment); err != nil {
+			return err
+		}
+		cm.updateMessage(ctx, deployment)
+		go cm.run(deployment)
+
+	case chatOpsAbortAction:
+		if deployment.Status == "pending" {
+			won, decision, err := cm.decide(ctx, deploymentID, "aborted")
+			if err != nil {
+				return err
+			}
+			if won {
+				deployment.Status = "aborted"
+				if err := cm.save(ctx, deployment); err != nil {
+					return err
+				}
+				cm.updateMessage(ctx, deployment)
+				return nil
+			}
+			if decision != "approved" {
+				return fmt.Errorf("deployment was already %s", decision)
+			}
+			// Approved at the same moment; cancel the run the approval just started
+			deployment.Status = "running"
+		}
+
+		switch deployment.Status {
+		case "running":
+			if err := cm.queue.Cancel(ctx, deploymentID); err != nil {
+				return err
+			}
+			cm.slack.PostMessage(ctx, deployment.Channel, deployment.MessageTS, fmt.Sprintf("Abort requested by <@%s>", user), nil)
+		default:
+			return fmt.Errorf("deployment is already %s", deployment.Status)
+		}
+
+	default:
+		return fmt.Errorf("unknown action %s", actionID)
+	}
+
+	return nil
+}
+
+// decide records the first approve or abort of a pending deployment. Two button presses can both
+// load it as pending, so only the caller whose SETNX wins may act; the others get the decision made.
+func (cm *ChatOpsManager) decide(ctx context.Context, deploymentID, decision string) (bool, string, error) {
+	key := fmt.Sprintf("chatops:decision:%s", deploymentID)
+	won, err := cm.redis.SetNX(ctx, key, decision, 7*24*time.Hour).Result()
+	if err != nil {
+		return false, "", fmt.Errorf("failed to record chatops decision: %w", err)
+	}
+	if won {
+		return true, decision, nil
+	}
+
+	existing, err := cm.redis.Get(ctx, key).Result()
+	if err != nil {
+		return false, "", fmt.Errorf("failed to get chatops decision: %w", err)
+	}
+	return false, existing, nil
+}
+
+// run queues an approved deployment for the worker pool, threading new log lines into the
+// channel as whichever worker picks it up reports progress
+func (cm *ChatOpsManager) run(deployment *ChatOpsDeployment) {
+	ctx := context.Background()
+	id := deployment.Request.DeploymentID
+
+	response, err := cm.queue.Enqueue(ctx, &deployment.Request)
+	if err != nil {
+		response = &DeploymentResponse{DeploymentID: id, Status: "failed", Message: err.Error()}
+	}
+
+	ticker := time.NewTicker(chatOpsStatusEvery)
+	defer ticker.Stop()
+
+	posted := 0
+	for response.Status == "queued" || response.Status == "in_progress" {
+		<-ticker.C
+
+		latest, err := cm.queue.Status(ctx, id)
+		if err != nil || latest == nil {
+			log.Printf("Failed to get status of ChatOps deployment %s: %v", id, err)
+			continue
+		}
+		response = latest
+
+		if len(response.Logs) <= posted {
+			continue
+		}
+		text := "```\n" + strings.Join(response.Logs[posted:], "\n") + "\n```"
+		if _, err := cm.slack.PostMessage(ctx, deployment.Channel, deployment.MessageTS, text, nil); err != nil {
+			log.Printf("Failed to post ChatOps status update: %v", err)
+			continue
+		}
+		posted = len(response.Logs)
+	}
+
+	deployment.Status = response.Status
+	if response.Status == "failed" && cm.queue.Cancelled(ctx, id) {
+		deployment.Status = "aborted"
+	}
+
+	final := fmt.Sprintf("Deployment %s: *%s* - %s", id, deployment.Status, response.Message)
+	if response.Postmortem != nil {
+		final += fmt.Sprintf("\nPostmortem draft: `GET /api/v1/deploy/%s/postmortem`", id)
+	}
+	cm.slack.PostMessage(ctx, deployment.Channel, deployment.MessageTS, final, nil)
+
+	if err := cm.save(ctx, deployment); err != nil {
+		log.Printf("Failed to save ChatOps deployment: %v", err)
+	}
+	cm.updateMessage(ctx, deployment)
+}
+
+func (cm *ChatOpsManager) updateMessage(ctx context.Context, deployment *ChatOpsDeployment) {
+	if err := cm.slack.UpdateMessage(ctx, deployment.Channel, deployment.MessageTS, deployment.summary(), deployment.blocks()); err != nil {
+		log.Printf("Failed to update ChatOps message: %v", err)
+	}
+}
+
+func (cm *ChatOpsManager) save(ctx context.Context, deployment *ChatOpsDeployment) error {
+	data, err := json.Marshal(deployment)
+	if err != nil {
+		return fmt.Errorf("failed to marshal chatops deployment: %w", err)
+	}
+	key := fmt.Sprintf("chatops:deployment:%s", deployment.Request.DeploymentID)
+	if err := cm.redis.Set(ctx, key, data, 7*24*time.Hour).Err(); err != nil {
+		return fmt.Errorf("failed to store chatops deployment: %w", err)
+	}
+	return nil
+}
+
+func (cm *ChatOpsManager) load(ctx context.Context, deploymentID string) (*ChatOpsDeployment, error) {
+	data, err := cm.redis.Get(ctx, fmt.Sprintf("chatops:deployment:%s", deploymentID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chatops deployment: %w", err)
+	}
+
+	var deployment ChatOpsDeployment
+	if err := json.Unmarshal(data, &deployment); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal chatops deployment: %w", err)
+	}
+	return &deployment, nil
+}
+
+func (d *ChatOpsDeployment) summary() string {
+	return fmt.Sprintf("%s v%s to %s (%s) requested by <@%s>: %s",
+		d.Request.ApplicationName, d.Request.Version, d.Request.Environment, d.Request.Strategy, d.RequestedBy, d.Status)
+}
+
+// blocks renders the approval message; buttons are shown only while an action is possible
+func (d *ChatOpsDeployment) blocks() []interface{} {
+	text := fmt.Sprintf("*Deploy %s v%s* to *%s* using *%s*\nRequested by <@%s>: `%s`\nStatus: *%s*",
+		d.Request.ApplicationName, d.Request.Version, d.Request.Environment, d.Request.Strategy,
+		d.RequestedBy, d.Command, d.Status)
+	if d.ApprovedBy != "" {
+		text += fmt.Sprintf(" (approved by <@%s>)", d.ApprovedBy)
+	}
+
+	blocks := []interface{}{
+		map[string]interface{}{
+			"type": "section",
+			"text": map[string]interface{}{"type": "mrkdwn", "text": text},
+		},
+	}
+
+	button := func(actionID, label, style string) map[string]interface{} {
+		return map[string]interface{}{
+			"type":      "button",
+			"action_id": actionID,
+			"value":     d.Request.DeploymentID,
+			"style":     style,
+			"text":      map[string]interface{}{"type": "plain_text", "text": label},
+		}
+	}
+
+	switch d.Status {
+	case "pending":
+		blocks = append(blocks, map[string]interface{}{
+			"type":     "actions",
+			"elements": []interface{}{button(chatOpsApproveAction, "Approve", "primary"), button(chatOpsAbortAction, "Abort", "danger")},
+		})
+	case "running":
+		blocks = append(blocks, map[string]interface{}{
+			"type":     "actions",
+			"elements": []interface{}{button(chatOpsAbortAction, "Abort", "danger")},
+		})
+	}
+
+	return blocks
+}
+
+// parseDeployCommand handles the canonical "<app> <version> to <environment> [strategy]" form
+func parseDeployCommand(text string) (*DeployIntent, error) {
+	match := deployCommandPattern.FindStringSubmatch(strings.TrimSpace(text))
+	if match == nil {
+		return nil, fmt.Errorf("expected \"<app> <version> to <environment> [strategy]\"")
+	}
+	return normalizeDeployIntent(&DeployIntent{
+		ApplicationName: match[1],
+		Version:         match[2],
+		Environment:     Environment(match[3]),
+		Strategy:        DeploymentStrategy(match[4]),
+	})
+}
+
+func normalizeDeployIntent(intent *DeployIntent) (*DeployIntent, error) {
+	if intent.ApplicationName == "" || intent.Version == "" {
+		return nil, fmt.Errorf("application and version are required")
+	}
+	intent.Version = strings.TrimPrefix(intent.Version, "v")
+
+	switch strings.ToLower(string(intent.Environment)) {
+	case "prod", "production":
+		intent.Environment = Production
+	case "stage", "staging":
+		intent.Environment = Staging
+	case "dev", "development":
+		intent.Environment = Development
+	default:
+		return nil, fmt.Errorf("unknown environment %q", intent.Environment)
+	}
+
+	switch strings.ToLower(string(intent.Strategy)) {
+	case "":
+		intent.Strategy = RollingUpdate
+	case "canary":
+		intent.Strategy = Canary
+	case "blue-green", "bluegreen", "blue_green":
+		intent.Strategy = BlueGreen
+	case "rolling", "rolling-update":
+		intent.Strategy = RollingUpdate
+	case "recreate":
+		intent.Strategy = Recreate
+	default:
+		return nil, fmt.Errorf("unknown strategy %q", intent.Strategy)
+	}
+
+	return intent, nil
+}
+
+// ParseDeployCommand asks Claude to extract a deploy intent from free text
+func (c *ClaudeClient) ParseDeployCommand(ctx context.Context, text string) (*DeployIntent, error) {
+	prompt := fmt.Sprintf(`Extract the deployment request from this chat command:
+
+%q
+
+Respond with JSON only:
+{"application_name": "...", "version": "...", "environment": "production|staging|development", "strategy": "blue-green|canary|rolling|recreate or empty if not stated"}`, text)
+
+	response, err := c.complete(ctx, "You convert ChatOps commands into structured deployment requests.", prompt, 300)
+	if err != nil {
+		return nil, err
+	}
+
+	var intent DeployIntent
+	if err := json.Unmarshal([]byte(extractJSON(response)), &intent); err != nil {
+		return nil, fmt.Errorf("failed to parse deploy intent: %w", err)
+	}
+	return normalizeDeployIntent(&intent)
+}
+
+// HTTP Handlers
+func (s *APIServer) slackCommandHandler(c *gin.Context) {
+	form, ok := s.verifiedSlackForm(c)
+	if !ok {
+		return
+	}
+
+	text, user, channel, responseURL := form.Get("text"), form.Get("user_id"), form.Get("channel_id"), form.Get("response_url")
+	go s.chatOps.HandleCommand(context.Background(), text, user, channel, responseURL)
+
+	// Slack requires an acknowledgement within three seconds; parsing continues in the background
+	c.JSON(http.StatusOK, gin.H{"response_type": "ephemeral", "text": fmt.Sprintf("Preparing `%s` for approval...", text)})
+}
+
+func (s *APIServer) slackInteractionHandler(c *gin.Context) {
+	form, ok := s.verifiedSlackForm(c)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Type string `json:"type"`
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+		Actions []struct {
+			ActionID string `json:"action_id"`
+			Value    string `json:"value"`
+		} `json:"actions"`
+		ResponseURL string `json:"response_url"`
+	}
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid interaction payload"})
+		return
+	}
+
+	for _, action := range payload.Actions {
+		if err := s.chatOps.HandleAction(c.Request.Context(), action.ActionID, action.Value, payload.User.ID); err != nil {
+			go s.chatOps.slack.RespondEphemeral(context.Background(), payload.ResponseURL, err.Error())
+		}
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// verifiedSlackForm checks the Slack signature over the raw body and returns the parsed form
+func (s *APIServer) verifiedSlackForm(c *gin.Context) (url.Values, bool) {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	if err := s.chatOps.slack.VerifySignature(c.GetHeader("X-Slack-Request-Timestamp"), c.GetHeader("X-Slack-Signature"), body); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return form, true
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Step checkpoints for crash-safe resumption
+const (
+	OnInterruptionResume   = "resume"   // skip steps completed before the crash and continue (default)
+	OnInterruptionRollback = "rollback" // revert completed steps and fail the deployment
+
+	// A deployment that keeps taking its worker down is rolled back instead of resumed again
+	maxDeploymentInterruptions = 3
+	checkpointTTL              = 7 * 24 * time.Hour
+)
+
+// stepCheckpoint records the strategy steps a deployment has completed. When a worker dies, the
+// queue hands the deployment to another worker, which skips the recorded steps. Region jobs share
+// their parent's checkpoint, so it is safe for concurrent use.
+type stepCheckpoint struct {
+	do           *DeploymentOrchestrator
+	deploymentID string
+
+	mu        sync.Mutex
+	completed map[string]int64 // step ID -> completion time (UnixNano)
+
+	// Earlier executions of this deployment that never finished
+	interruptions int
+}
+
+// loadCheckpoint registers a new execution of the deployment and returns the steps completed by
+// earlier, interrupted executions
+func (do *DeploymentOrchestrator) loadCheckpoint(ctx context.Context, deploymentID string) (*stepCheckpoint, error) {
+	executions, err := do.redis.Incr(ctx, checkpointExecutionsKey(deploymentID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to register deployment execution: %w", err)
+	}
+	do.redis.Expire(ctx, checkpointExecutionsKey(deploymentID), checkpointTTL)
+
+	steps, err := do.redis.HGetAll(ctx, checkpointKey(deploymentID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load deployment checkpoint: %w", err)
+	}
+
+	cp := &stepCheckpoint{
+		do:            do,
+		deploymentID:  deploymentID,
+		completed:     make(map[string]int64, len(steps)),
+		interruptions: int(executions) - 1,
+	}
+	for step, completedAt := range steps {
+		cp.completed[step], _ = strconv.ParseInt(completedAt, 10, 64)
+	}
+	return cp, nil
+}
+
+// done reports whether an interrupted execution already completed the step
+func (cp *stepCheckpoint) done(step string) bool {
+	if cp == nil {
+		return false
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	_, ok := cp.completed[step]
+	return ok
+}
+
+// record persists a completed step. It outlives the step's context: a step that finished must
+// never run again, even if the deployment is cancelled right after.
+func (cp *stepCheckpoint) record(step string) {
+	if cp == nil {
+		return
+	}
+	completedAt := time.Now().UnixNano()
+	cp.mu.Lock()
+	cp.completed[step] = completedAt
+	cp.mu.Unlock()
+
+	ctx := context.Background()
+	key := checkpointKey(cp.deploymentID)
+	pipe := cp.do.redis.TxPipeline()
+	pipe.HSet(ctx, key, step, strconv.FormatInt(completedAt, 10))
+	pipe.Expire(ctx, key, checkpointTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to checkpoint step %q of %s: %v", step, cp.deploymentID, err)
+	}
+}
+
+// steps returns the completed steps, most recent first
+func (cp *stepCheckpoint) steps() []string {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	steps := make([]string, 0, len(cp.completed))
+	for step := range cp.completed {
+		steps = append(steps, step)
+	}
+	sort.Slice(steps, func(i, j int) bool { return cp.completed[steps[i]] > cp.completed[steps[j]] })
+	return steps
+}
+
+// clear drops the checkpoint once the deployment has a final result
+func (cp *stepCheckpoint) clear(ctx context.Context) {
+	if err := cp.do.redis.Del(ctx, checkpointKey(cp.deploymentID), checkpointExecutionsKey(cp.deploymentID)).Err(); err != nil {
+		log.Printf("Failed to clear checkpoint of %s: %v", cp.deploymentID, err)
+	}
+}
+
+// resumeOrRollback decides how an interrupted deployment continues. It returns an error, after
+// reverting the completed steps, when the deployment must not be resumed.
+func (do *DeploymentOrchestrator) resumeOrRollback(ctx context.Context, req *DeploymentRequest, job *DeploymentJob) error {
+	cp := job.checkpoint
+	completed := cp.steps()
+
+	reason := ""
+	switch {
+	case req.OnInterruption == OnInterruptionRollback:
+		reason = "on_interruption is rollback"
+	case cp.interruptions >= maxDeploymentInterruptions:
+		reason = fmt.Sprintf("interrupted %d times", cp.interruptions)
+	}
+
+	if reason == "" {
+		job.logf("⟳ Resuming after interruption %d with %d step(s) already completed", cp.interruptions, len(completed))
+		return nil
+	}
+
+	job.logf("⟳ Interrupted (%s), rolling back %d completed step(s)", reason, len(completed))
+	for _, step := range completed {
+		job.logf("↺ Reverting: %s", step)
+		time.Sleep(50 * time.Millisecond) // Simulate work
+	}
+	return fmt.Errorf("deployment interrupted and rolled back: %s", reason)
+}
+
+// stepID names a step uniquely within a deployment, prefixing steps of region jobs with the region
+func (cp *stepCheckpoint) stepID(job *DeploymentJob, description string) string {
+	if cp != nil && strings.HasPrefix(job.ID, cp.deploymentID+"/") {
+		return fmt.Sprintf("[%s] %s", strings.TrimPrefix(job.ID, cp.deploymentID+"/"), description)
+	}
+	return description
+}
+
+func checkpointKey(deploymentID string) string {
+	return fmt.Sprintf("deployment_checkpoint:%s", deploymentID)
+}
+
+func checkpointExecutionsKey(deploymentID string) string {
+	return fmt.Sprintf("deployment_executions:%s", deploymentID)
+}
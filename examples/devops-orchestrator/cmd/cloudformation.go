@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CloudFormation stacks, for AWS teams that can't run Terraform
+const (
+	EngineCloudFormation IaCEngineType = "cloudformation"
+
+	cfnPollInterval = 10 * time.Second
+	cfnTimeout      = time.Hour
+)
+
+type CloudFormationStack struct {
+	StackName    string   `json:"stack_name" binding:"required"`
+	TemplateBody string   `json:"template_body,omitempty"`
+	TemplateURL  string   `json:"template_url,omitempty"`
+	Region       string   `json:"region,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"` // e.g. CAPABILITY_IAM, CAPABILITY_NAMED_IAM
+}
+
+type DriftReport struct {
+	StackName        string          `json:"stack_name"`
+	StackDriftStatus string          `json:"stack_drift_status"` // IN_SYNC, DRIFTED, UNKNOWN
+	DriftedResources []ResourceDrift `json:"drifted_resources"`
+	DetectedAt       time.Time       `json:"detected_at"`
+}
+
+type ResourceDrift struct {
+	LogicalResourceID  string               `json:"logical_resource_id"`
+	PhysicalResourceID string               `json:"physical_resource_id"`
+	ResourceType       string               `json:"resource_type"`
+	DriftStatus        string               `json:"drift_status"` // MODIFIED, DELETED
+	Differences        []PropertyDifference `json:"differences,omitempty"`
+}
+
+type PropertyDifference struct {
+	PropertyPath   string `json:"property_path"`
+	ExpectedValue  string `json:"expected_value"`
+	ActualValue    string `json:"actual_value"`
+	DifferenceType string `json:"difference_type"` // ADD, REMOVE, NOT_EQUAL
+}
+
+// Engines that support more than plan/apply/destroy implement these
+type driftDetector interface {
+	DetectDrift(ctx context.Context, req *InfrastructureRequest) (*DriftReport, error)
+}
+
+type stackRollbacker interface {
+	Rollback(ctx context.Context, req *InfrastructureRequest) error
+}
+
+type cfnChange struct {
+	ResourceChange struct {
+		Action            string `json:"Action"` // Add, Modify, Remove
+		LogicalResourceID string `json:"LogicalResourceId"`
+		ResourceType      string `json:"ResourceType"`
+		Replacement       string `json:"Replacement"`
+	} `json:"ResourceChange"`
+}
+
+// cloudFormationEngine plans with change sets and applies by executing them; stack parameters
+// come from the request variables
+type cloudFormationEngine struct{}
+
+func (e *cloudFormationEngine) Prepare(ctx context.Context, req *InfrastructureRequest) error {
+	if req.CloudProvider != "" && req.CloudProvider != AWS {
+		return fmt.Errorf("the cloudformation engine requires cloud_provider aws")
+	}
+	stack := req.CloudFormation
+	if stack == nil || stack.StackName == "" {
+		return fmt.Errorf("cloudformation.stack_name is required for the cloudformation engine")
+	}
+	if req.Action != "plan" && req.Action != "apply" {
+		return nil
+	}
+	if (stack.TemplateBody == "") == (stack.TemplateURL == "") {
+		return fmt.Errorf("cloudformation requires exactly one of template_body or template_url")
+	}
+
+	args, cleanup, err := e.templateArgs(stack)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return e.cli(ctx, stack, append([]string{"validate-template"}, args...), nil)
+}
+
+// Plan creates a change set, returns its changes as the plan output, then discards it
+func (e *cloudFormationEngine) Plan(ctx context.Context, req *InfrastructureRequest) (string, error) {
+	changeSet, changes, created, err := e.createChangeSet(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	stack := req.CloudFormation
+
+	// A CREATE change set on a new stack leaves an empty REVIEW_IN_PROGRESS stack behind, so remove
+	// the stack itself; a stack that existed before, even one still in review, is left alone
+	if created {
+		e.cli(ctx, stack, []string{"delete-stack", "--stack-name", stack.StackName}, nil)
+	} else if changeSet != "" {
+		e.cli(ctx, stack, []string{"delete-change-set", "--stack-name", stack.StackName, "--change-set-name", changeSet}, nil)
+	}
+
+	return renderChangeSet(stack.StackName, changes), nil
+}
+
+func (e *cloudFormationEngine) Apply(ctx context.Context, req *InfrastructureRequest) (IaCChanges, error) {
+	changeSet, changes, _, err := e.createChangeSet(ctx, req)
+	if err != nil {
+		return IaCChanges{}, err
+	}
+	if changeSet == "" {
+		return IaCChanges{}, nil
+	}
+	stack := req.CloudFormation
+
+	if err := e.cli(ctx, stack, []string{"execute-change-set", "--stack-name", stack.StackName, "--change-set-name", changeSet}, nil); err != nil {
+		return IaCChanges{}, err
+	}
+	status, reason, err := e.waitForStack(ctx, stack)
+	if err != nil {
+		return IaCChanges{}, err
+	}
+	if status != "CREATE_COMPLETE" && status != "UPDATE_COMPLETE" {
+		return IaCChanges{}, fmt.Errorf("stack %s ended in %s (CloudFormation rolled back): %s", stack.StackName, status, reason)
+	}
+
+	var result IaCChanges
+	for _, c := range changes {
+		switch c.ResourceChange.Action {
+		case "Add":
+			result.Created++
+		case "Modify":
+			result.Updated++
+		case "Remove":
+			result.Deleted++
+		}
+	}
+	return result, nil
+}
+
+func (e *cloudFormationEngine) Destroy(ctx context.Context, req *InfrastructureRequest) (IaCChanges, error) {
+	stack := req.CloudFormation
+
+	var resources struct {
+		StackResourceSummaries []json.RawMessage `json:"StackResourceSummaries"`
+	}
+	if err := e.cli(ctx, stack, []string{"list-stack-resources", "--stack-name", stack.StackName}, &resources); err != nil {
+		return IaCChanges{}, err
+	}
+
+	if err := e.cli(ctx, stack, []string{"delete-stack", "--stack-name", stack.StackName}, nil); err != nil {
+		return IaCChanges{}, err
+	}
+	if err := e.cli(ctx, stack, []string{"wait", "stack-delete-complete", "--stack-name", stack.StackName}, nil); err != nil {
+		return IaCChanges{}, err
+	}
+	return IaCChanges{Deleted: len(resources.StackResourceSummaries)}, nil
+}
+
+// Rollback returns a stack to its last stable state, using whichever operation its status allows.
+// rollback-stack only accepts a failed create or update; a completed update is undone by applying
+// the previous template, which CloudFormation doesn't keep.
+func (e *cloudFormationEngine) Rollback(ctx context.Context, req *InfrastructureRequest) error {
+	stack := req.CloudFormation
+	status, _, err := e.stackStatus(ctx, stack)
+	if err != nil {
+		return err
+	}
+
+	var args []string
+	switch {
+	case status == "UPDATE_IN_PROGRESS":
+		args = []string{"cancel-update-stack", "--stack-name", stack.StackName}
+	case status == "UPDATE_ROLLBACK_FAILED":
+		args = []string{"continue-update-rollback", "--stack-name", stack.StackName}
+	case status == "CREATE_FAILED" || status == "UPDATE_FAILED":
+		args = []string{"rollback-stack", "--stack-name", stack.StackName}
+	case status == "UPDATE_COMPLETE":
+		return fmt.Errorf("stack %s is UPDATE_COMPLETE; apply the previous template to roll it back", stack.StackName)
+	default:
+		return fmt.Errorf("stack %s cannot be rolled back from %s", stack.StackName, status)
+	}
+
+	if err := e.cli(ctx, stack, args, nil); err != nil {
+		return err
+	}
+	status, reason, err := e.waitForStack(ctx, stack)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(status, "_FAILED") {
+		return fmt.Errorf("rollback of %s ended in %s: %s", stack.StackName, status, reason)
+	}
+	return nil
+}
+
+// DetectDrift runs drift detection and reports resources whose live config differs from the template
+func (e *cloudFormationEngine) DetectDrift(ctx context.Context, req *InfrastructureRequest) (*DriftReport, error) {
+	stack := req.CloudFormation
+
+	var detection struct {
+		StackDriftDetectionID string `json:"StackDriftDetectionId"`
+	}
+	if err := e.cli(ctx, stack, []string{"detect-stack-drift", "--stack-name", stack.StackName}, &detection); err != nil {
+		return nil, err
+	}
+
+	var status struct {
+		DetectionStatus       string `json:"DetectionStatus"`
+		DetectionStatusReason string `json:"DetectionStatusReason"`
+		StackDriftStatus      string `json:"StackDriftStatus"`
+	}
+	deadline := time.Now().Add(cfnTimeout)
+	for {
+		if err := e.cli(ctx, stack, []string{"describe-stack-drift-detection-status", "--stack-drift-detection-id", detection.StackDriftDetectionID}, &status); err != nil {
+			return nil, err
+		}
+		if status.DetectionStatus != "DETECTION_IN_PROGRESS" {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("drift detection for %s timed out", stack.StackName)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(cfnPollInterval):
+		}
+	}
+	if status.DetectionStatus == "DETECTION_FAILED" {
+		return nil, fmt.Errorf("drift detection for %s failed: %s", stack.StackName, status.DetectionStatusReason)
+	}
+
+	var drifts struct {
+		StackResourceDrifts []struct {
+			LogicalResourceID        string `json:"LogicalResourceId"`
+			PhysicalResourceID       string `json:"PhysicalResourceId"`
+			ResourceType             string `json:"ResourceType"`
+			StackResourceDriftStatus string `json:"StackResourceDriftStatus"`
+			PropertyDifferences      []struct {
+				PropertyPath   string `json:"PropertyPath"`
+				ExpectedValue  string `json:"ExpectedValue"`
+				ActualValue    string `json:"ActualValue"`
+				DifferenceType string `json:"DifferenceType"`
+			} `json:"PropertyDifferences"`
+		} `json:"StackResourceDrifts"`
+	}
+	args := []string{"describe-stack-resource-drifts", "--stack-name", stack.StackName, "--stack-resource-drift-status-filters", "MODIFIED", "DELETED"}
+	if err := e.cli(ctx, stack, args, &drifts); err != nil {
+		return nil, err
+	}
+
+	report := &DriftReport{
+		StackName:        stack.StackName,
+		StackDriftStatus: status.StackDriftStatus,
+		DriftedResources: make([]ResourceDrift, 0, len(drifts.StackResourceDrifts)),
+		DetectedAt:       time.Now(),
+	}
+	for _, d := range drifts.StackResourceDrifts {
+		drift := ResourceDrift{
+			LogicalResourceID:  d.LogicalResourceID,
+			PhysicalResourceID: d.PhysicalResourceID,
+			ResourceType:       d.ResourceType,
+			DriftStatus:        d.StackResourceDriftStatus,
+		}
+		for _, p := range d.PropertyDifferences {
+			drift.Differences = append(drift.Differences, PropertyDifference(p))
+		}
+		report.DriftedResources = append(report.DriftedResources, drift)
+	}
+	return report, nil
+}
+
+// createChangeSet creates a change set for the request and waits for it. It returns an empty
+// change set name when the template makes no changes, and whether the stack didn't exist until
+// this call created it.
+func (e *cloudFormationEngine) createChangeSet(ctx context.Context, req *InfrastructureRequest) (string, []cfnChange, bool, error) {
+	stack := req.CloudFormation
+
+	status, _, err := e.stackStatus(ctx, stack)
+	if err != nil {
+		return "", nil, false, err
+	}
+	changeSetType := "UPDATE"
+	if status == "" || status == "REVIEW_IN_PROGRESS" {
+		changeSetType = "CREATE"
+	}
+
+	templateArgs, cleanup, err := e.templateArgs(stack)
+	if err != nil {
+		return "", nil, false, err
+	}
+	defer cleanup()
+
+	parameters := make([]map[string]string, 0, len(req.Variables))
+	for key, value := range req.Variables {
+		parameters = append(parameters, map[string]string{"ParameterKey": key, "ParameterValue": stackParameterValue(value)})
+	}
+	paramJSON, err := json.Marshal(parameters)
+	if err != nil {
+		return "", nil, false, fmt.Errorf("failed to marshal stack parameters: %w", err)
+	}
+
+	changeSet := fmt.Sprintf("orchestrator-%d", time.Now().UnixNano())
+	args := append([]string{"create-change-set",
+		"--stack-name", stack.StackName,
+		"--change-set-name", changeSet,
+		"--change-set-type", changeSetType,
+		"--parameters", string(paramJSON),
+	}, templateArgs...)
+	if len(stack.Capabilities) > 0 {
+		args = append(append(args, "--capabilities"), stack.Capabilities...)
+	}
+	if err := e.cli(ctx, stack, args, nil); err != nil {
+		return "", nil, false, err
+	}
+
+	describeArgs := []string{"describe-change-set", "--stack-name", stack.StackName, "--change-set-name", changeSet}
+	waitErr := e.cli(ctx, stack, append([]string{"wait", "change-set-create-complete"}, describeArgs[1:]...), nil)
+
+	var described struct {
+		Status       string      `json:"Status"`
+		StatusReason string      `json:"StatusReason"`
+		Changes      []cfnChange `json:"Changes"`
+	}
+	if err := e.cli(ctx, stack, describeArgs, &described); err != nil {
+		return "", nil, false, err
+	}
+
+	if described.Status == "FAILED" {
+		// An unchanged template is reported as a failed change set rather than an empty one
+		if strings.Contains(described.StatusReason, "didn't contain changes") || strings.Contains(described.StatusReason, "No updates") {
+			e.cli(ctx, stack, []string{"delete-change-set", "--stack-name", stack.StackName, "--change-set-name", changeSet}, nil)
+			return "", nil, false, nil
+		}
+		return "", nil, false, fmt.Errorf("change set for %s failed: %s", stack.StackName, described.StatusReason)
+	}
+	if waitErr != nil {
+		return "", nil, false, waitErr
+	}
+
+	return changeSet, described.Changes, status == "", nil
+}
+
+// stackParameterValue formats a request variable as a stack parameter value; lists become the
+// comma-separated form CommaDelimitedList and List<> parameters take
+func stackParameterValue(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// stackStatus returns "" when the stack doesn't exist
+func (e *cloudFormationEngine) stackStatus(ctx context.Context, stack *CloudFormationStack) (string, string, error) {
+	var out struct {
+		Stacks []struct {
+			StackStatus       string `json:"StackStatus"`
+			StackStatusReason string `json:"StackStatusReason"`
+		} `json:"Stacks"`
+	}
+	err := e.cli(ctx, stack, []string{"describe-stacks", "--stack-name", stack.StackName}, &out)
+	if err != nil {
+		if strings.Contains(err.Error(), "does not exist") {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	if len(out.Stacks) == 0 {
+		return "", "", nil
+	}
+	return out.Stacks[0].StackStatus, out.Stacks[0].StackStatusReason, nil
+}
+
+// waitForStack polls until the stack leaves every *_IN_PROGRESS state
+func (e *cloudFormationEngine) waitForStack(ctx context.Context, stack *CloudFormationStack) (string, string, error) {
+	deadline := time.Now().Add(cfnTimeout)
+	for {
+		status, reason, err := e.stackStatus(ctx, stack)
+		if err != nil {
+			return "", "", err
+		}
+		if !strings.HasSuffix(status, "_IN_PROGRESS") {
+			return status, reason, nil
+		}
+		if time.Now().After(deadline) {
+			return status, reason, fmt.Errorf("stack %s still %s after %s", stack.StackName, status, cfnTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return "", "", ctx.Err()
+		case <-time.After(cfnPollInterval):
+		}
+	}
+}
+
+// templateArgs writes an inline template to a temp file, since templates easily exceed argv limits
+func (e *cloudFormationEngine) templateArgs(stack *CloudFormationStack) ([]string, func(), error) {
+	if stack.TemplateURL != "" {
+		return []string{"--template-url", stack.TemplateURL}, func() {}, nil
+	}
+
+	dir, err := os.MkdirTemp("", "cfn-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create template dir: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	path := filepath.Join(dir, "template")
+	if err := os.WriteFile(path, []byte(stack.TemplateBody), 0o600); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to write template: %w", err)
+	}
+	return []string{"--template-body", "file://" + path}, cleanup, nil
+}
+
+func (e *cloudFormationEngine) cli(ctx context.Context, stack *CloudFormationStack, args []string, out interface{}) error {
+	args = append([]string{"cloudformation"}, args...)
+	args = append(args, "--output", "json")
+	if stack.Region != "" {
+		args = append(args, "--region", stack.Region)
+	}
+	return runCloudCLI(ctx, config.AWSBin, args, out)
+}
+
+func renderChangeSet(stackName string, changes []cfnChange) string {
+	if len(changes) == 0 {
+		return fmt.Sprintf("Stack %s: no changes.", stackName)
+	}
+
+	symbols := map[string]string{"Add": "+", "Modify": "~", "Remove": "-"}
+	var b strings.Builder
+	fmt.Fprintf(&b, "CloudFormation change set for stack %s:\n\n", stackName)
+	counts := map[string]int{}
+	for _, c := range changes {
+		rc := c.ResourceChange
+		counts[rc.Action]++
+		line := fmt.Sprintf("  %s %s (%s)", symbols[rc.Action], rc.LogicalResourceID, rc.ResourceType)
+		if rc.Replacement == "True" || rc.Replacement == "Conditional" {
+			line += fmt.Sprintf(" [replacement: %s]", strings.ToLower(rc.Replacement))
+		}
+		b.WriteString(line + "\n")
+	}
+	fmt.Fprintf(&b, "\nPlan: %d to add, %d to change, %d to destroy.", counts["Add"], counts["Modify"], counts["Remove"])
+	return b.String()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DORA metrics
+const (
+	doraRetention     = 90 * 24 * time.Hour
+	doraDefaultWindow = 30
+	doraRefreshEvery  = 5 * time.Minute
+)
+
+// doraEvent is one finished deployment as recorded for DORA metrics
+type doraEvent struct {
+	DeploymentID string     `json:"deployment_id"`
+	Status       string     `json:"status"`
+	Rollback     bool       `json:"rollback,omitempty"`
+	CommitTime   *time.Time `json:"commit_time,omitempty"`
+	FinishedAt   time.Time  `json:"finished_at"`
+}
+
+type DORAMetrics struct {
+	Application string      `json:"application"`
+	Environment Environment `json:"environment"`
+	Deployments int         `json:"deployments"`
+	// Successful deployments per day over the window
+	DeploymentFrequency float64 `json:"deployment_frequency_per_day"`
+	// Median commit-to-deploy time of successful deployments that reported commit_time
+	LeadTimeSeconds float64 `json:"lead_time_seconds"`
+	// Share of changes that failed or were rolled back
+	ChangeFailureRate float64 `json:"change_failure_rate"`
+	// Mean time from a failed change to the next successful deployment
+	MTTRSeconds float64 `json:"mttr_seconds"`
+	Failures    int     `json:"failures"`
+}
+
+type DORAMetricsResponse struct {
+	WindowDays int           `json:"window_days"`
+	Metrics    []DORAMetrics `json:"metrics"`
+}
+
+var (
+	doraDeploymentFrequency = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "devops_dora_deployment_frequency_per_day",
+			Help: "Successful deployments per day over the last 30 days",
+		},
+		[]string{"application", "environment"},
+	)
+
+	doraLeadTime = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "devops_dora_lead_time_seconds",
+			Help: "Median lead time for changes over the last 30 days",
+		},
+		[]string{"application", "environment"},
+	)
+
+	doraChangeFailureRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "devops_dora_change_failure_rate",
+			Help: "Change failure rate over the last 30 days",
+		},
+		[]string{"application", "environment"},
+	)
+
+	doraMTTR = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "devops_dora_mttr_seconds",
+			Help: "Mean time to restore over the last 30 days",
+		},
+		[]string{"application", "environment"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(doraDeploymentFrequency)
+	prometheus.MustRegister(doraLeadTime)
+	prometheus.MustRegister(doraChangeFailureRate)
+	prometheus.MustRegister(doraMTTR)
+}
+
+// recordDORAEvent stores a finished deployment and refreshes its application's gauges
+func (do *DeploymentOrchestrator) recordDORAEvent(ctx context.Context, req *DeploymentRequest, response *DeploymentResponse) {
+	finished := time.Now()
+	data, err := json.Marshal(doraEvent{
+		DeploymentID: req.DeploymentID,
+		Status:       response.Status,
+		Rollback:     req.Rollback,
+		CommitTime:   req.CommitTime,
+		FinishedAt:   finished,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal DORA event: %v", err)
+		return
+	}
+
+	key := doraKey(req.ApplicationName, req.Environment)
+	pipe := do.redis.TxPipeline()
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(finished.Unix()), Member: data})
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(finished.Add(-doraRetention).Unix(), 10))
+	pipe.SAdd(ctx, "dora_services", doraService(req.ApplicationName, req.Environment))
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record DORA event: %v", err)
+		return
+	}
+
+	do.refreshDORAGauges(ctx, req.ApplicationName, req.Environment)
+}
+
+// DORAMetrics computes metrics over the last windowDays for every application/environment matching
+// the filters (empty filters match all)
+func (do *DeploymentOrchestrator) DORAMetrics(ctx context.Context, application string, env Environment, windowDays int) ([]DORAMetrics, error) {
+	services, err := do.redis.SMembers(ctx, "dora_services").Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+	sort.Strings(services)
+
+	metrics := make([]DORAMetrics, 0)
+	for _, service := range services {
+		app, environment := parseDORAService(service)
+		if (application != "" && app != application) || (env != "" && environment != env) {
+			continue
+		}
+
+		m, err := do.computeDORA(ctx, app, environment, windowDays)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, *m)
+	}
+	return metrics, nil
+}
+
+// StartDORARefresh keeps every replica's gauges current, including as deployments age out of the
+// window, until ctx is cancelled
+func (do *DeploymentOrchestrator) StartDORARefresh(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(doraRefreshEvery)
+		defer ticker.Stop()
+		for {
+			do.refreshAllDORAGauges(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (do *DeploymentOrchestrator) refreshAllDORAGauges(ctx context.Context) {
+	services, err := do.redis.SMembers(ctx, "dora_services").Result()
+	if err != nil {
+		log.Printf("Failed to list DORA services: %v", err)
+		return
+	}
+	for _, service := range services {
+		app, env := parseDORAService(service)
+		do.refreshDORAGauges(ctx, app, env)
+	}
+}
+
+func (do *DeploymentOrchestrator) refreshDORAGauges(ctx context.Context, application string, env Environment) {
+	m, err := do.computeDORA(ctx, application, env, doraDefaultWindow)
+	if err != nil {
+		log.Printf("Failed to compute DORA metrics: %v", err)
+		return
+	}
+	doraDeploymentFrequency.WithLabelValues(application, string(env)).Set(m.DeploymentFrequency)
+	doraLeadTime.WithLabelValues(application, string(env)).Set(m.LeadTimeSeconds)
+	doraChangeFailureRate.WithLabelValues(application, string(env)).Set(m.ChangeFailureRate)
+	doraMTTR.WithLabelValues(application, string(env)).Set(m.MTTRSeconds)
+}
+
+func (do *DeploymentOrchestrator) computeDORA(ctx context.Context, application string, env Environment, windowDays int) (*DORAMetrics, error) {
+	since := time.Now().Add(-time.Duration(windowDays) * 24 * time.Hour)
+	items, err := do.redis.ZRangeByScore(ctx, doraKey(application, env), &redis.ZRangeBy{
+		Min: strconv.FormatInt(since.Unix(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DORA events: %w", err)
+	}
+
+	events := make([]doraEvent, 0, len(items))
+	for _, item := range items {
+		var event doraEvent
+		if err := json.Unmarshal([]byte(item), &event); err == nil {
+			events = append(events, event)
+		}
+	}
+
+	m := computeDORAMetrics(events, windowDays)
+	m.Application = application
+	m.Environment = env
+	return m, nil
+}
+
+// computeDORAMetrics derives the four metrics from events in time order. A change (non-rollback
+// deployment) fails if it fails outright or the next deployment rolls it back; it is restored by
+// the next successful deployment of any kind.
+func computeDORAMetrics(events []doraEvent, windowDays int) *DORAMetrics {
+	m := &DORAMetrics{Deployments: len(events)}
+
+	var successes, changes int
+	var leadTimes []float64
+	var restoreTotal float64
+	var restorations int
+
+	for i, event := range events {
+		if event.Status == "success" {
+			successes++
+		}
+		if event.Rollback {
+			continue
+		}
+		changes++
+
+		if event.Status == "success" && event.CommitTime != nil && event.FinishedAt.After(*event.CommitTime) {
+			leadTimes = append(leadTimes, event.FinishedAt.Sub(*event.CommitTime).Seconds())
+		}
+
+		failed := event.Status == "failed" || (i+1 < len(events) && events[i+1].Rollback)
+		if !failed {
+			continue
+		}
+		m.Failures++
+
+		// Failures not yet restored within the window don't count towards MTTR
+		for _, next := range events[i+1:] {
+			if next.Status == "success" {
+				restoreTotal += next.FinishedAt.Sub(event.FinishedAt).Seconds()
+				restorations++
+				break
+			}
+		}
+	}
+
+	if windowDays > 0 {
+		m.DeploymentFrequency = float64(successes) / float64(windowDays)
+	}
+	if changes > 0 {
+		m.ChangeFailureRate = float64(m.Failures) / float64(changes)
+	}
+	if restorations > 0 {
+		m.MTTRSeconds = restoreTotal / float64(restorations)
+	}
+	if len(leadTimes) > 0 {
+		sort.Float64s(leadTimes)
+		m.LeadTimeSeconds = leadTimes[len(leadTimes)/2]
+	}
+	return m
+}
+
+func doraKey(application string, env Environment) string {
+	return fmt.Sprintf("dora_events:%s:%s", application, env)
+}
+
+func doraService(application string, env Environment) string {
+	return fmt.Sprintf("%s|%s", application, env)
+}
+
+func parseDORAService(service string) (string, Environment) {
+	i := strings.LastIndex(service, "|")
+	if i < 0 {
+		return service, ""
+	}
+	return service[:i], Environment(service[i+1:])
+}
+
+// HTTP Handlers
+func (s *APIServer) doraMetricsHandler(c *gin.Context) {
+	days := doraDefaultWindow
+	if v := c.Query("days"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 || parsed > int(doraRetention.Hours()/24) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 90"})
+			return
+		}
+		days = parsed
+	}
+
+	metrics, err := s.deploymentOrchestrator.DORAMetrics(c.Request.Context(), c.Query("application"), Environment(c.Query("environment")), days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, DORAMetricsResponse{WindowDays: days, Metrics: metrics})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Deployment state tracking and dry-run diffs
+type DeployedState struct {
+	Version    string            `json:"version"`
+	Image      string            `json:"image,omitempty"`
+	Replicas   int               `json:"replicas"`
+	ConfigMap  map[string]string `json:"config_map,omitempty"`
+	DeployedAt time.Time         `json:"deployed_at"`
+}
+
+type ValueChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type ReplicaChange struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+type ConfigChange struct {
+	Key      string `json:"key"`
+	Action   string `json:"action"` // "added", "removed", "modified"
+	OldValue string `json:"old_value,omitempty"`
+	NewValue string `json:"new_value,omitempty"`
+}
+
+// PlanSummary is the result of terraform plan; when Terraform couldn't plan, Available is false
+// and Error says why
+type PlanSummary struct {
+	Available bool   `json:"available"`
+	ToAdd     int    `json:"to_add"`
+	ToChange  int    `json:"to_change"`
+	ToDestroy int    `json:"to_destroy"`
+	Output    string `json:"output"`
+	Error     string `json:"error,omitempty"`
+}
+
+type DeploymentDiff struct {
+	FirstDeployment  bool           `json:"first_deployment"`
+	VersionChange    *ValueChange   `json:"version,omitempty"`
+	ImageChange      *ValueChange   `json:"image,omitempty"`
+	ReplicaChange    *ReplicaChange `json:"replicas,omitempty"`
+	ConfigMapChanges []ConfigChange `json:"config_map_changes"`
+	TerraformPlan    *PlanSummary   `json:"terraform_plan,omitempty"`
+	HasChanges       bool           `json:"has_changes"`
+}
+
+const terraformPlanTimeout = 10 * time.Minute
+
+// desiredState extracts the target state from a deployment request's config
+func desiredState(req *DeploymentRequest) *DeployedState {
+	state := &DeployedState{
+		Version:   req.Version,
+		Image:     configString(req.Config, "image"),
+		Replicas:  configInt(req.Config, "replicas"),
+		ConfigMap: make(map[string]string),
+	}
+
+	if cm, ok := req.Config["config_map"].(map[string]interface{}); ok {
+		for key, value := range cm {
+			state.ConfigMap[key] = fmt.Sprint(value)
+		}
+	}
+
+	return state
+}
+
+// ComputeDiff compares a request against the last applied state for its application and environment
+func (do *DeploymentOrchestrator) ComputeDiff(ctx context.Context, req *DeploymentRequest) (*DeploymentDiff, error) {
+	current, err := do.loadDeployedState(ctx, req.ApplicationName, req.Environment)
+	if err != nil {
+		return nil, err
+	}
+	desired := desiredState(req)
+
+	diff := &DeploymentDiff{
+		ConfigMapChanges: make([]ConfigChange, 0),
+	}
+	if current == nil {
+		diff.FirstDeployment = true
+		current = &DeployedState{ConfigMap: map[string]string{}}
+	}
+
+	if current.Version != desired.Version {
+		diff.VersionChange = &ValueChange{From: current.Version, To: desired.Version}
+	}
+	if desired.Image != "" && current.Image != desired.Image {
+		diff.ImageChange = &ValueChange{From: current.Image, To: desired.Image}
+	}
+	if desired.Replicas > 0 && current.Replicas != desired.Replicas {
+		diff.ReplicaChange = &ReplicaChange{From: current.Replicas, To: desired.Replicas}
+	}
+	diff.ConfigMapChanges = diffConfigMaps(current.ConfigMap, desired.ConfigMap)
+
+	if code := configString(req.Config, "terraform_code"); code != "" {
+		diff.TerraformPlan = planTerraform(ctx, code)
+	}
+
+	diff.HasChanges = diff.VersionChange != nil || diff.ImageChange != nil || diff.ReplicaChange != nil ||
+		len(diff.ConfigMapChanges) > 0 ||
+		(diff.TerraformPlan != nil && diff.TerraformPlan.ToAdd+diff.TerraformPlan.ToChange+diff.TerraformPlan.ToDestroy > 0)
+
+	return diff, nil
+}
+
+func diffConfigMaps(current, desired map[string]string) []ConfigChange {
+	changes := make([]ConfigChange, 0)
+
+	for key, newValue := range desired {
+		oldValue, exists := current[key]
+		switch {
+		case !exists:
+			changes = append(changes, ConfigChange{Key: key, Action: "added", NewValue: newValue})
+		case oldValue != newValue:
+			changes = append(changes, ConfigChange{Key: key, Action: "modified", OldValue: oldValue, NewValue: newValue})
+		}
+	}
+	for key, oldValue := range current {
+		if _, exists := desired[key]; !exists {
+			changes = append(changes, ConfigChange{Key: key, Action: "removed", OldValue: oldValue})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// planTerraform runs terraform plan on the code in a scratch module, against the backend the code
+// configures (or empty local state without one)
+func planTerraform(ctx context.Context, code string) *PlanSummary {
+	if terraformAvailable() != nil {
+		return &PlanSummary{Error: fmt.Sprintf("%s not found, so the code was not planned", config.TerraformBin)}
+	}
+	ctx, cancel := context.WithTimeout(ctx, terraformPlanTimeout)
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "terraform-plan-")
+	if err != nil {
+		return &PlanSummary{Error: fmt.Sprintf("failed to create plan workspace: %v", err)}
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, "main.tf"), []byte(code), 0o600); err != nil {
+		return &PlanSummary{Error: fmt.Sprintf("failed to write Terraform code: %v", err)}
+	}
+
+	if stdout, stderr, err := runValidator(ctx, dir, config.TerraformBin, "init", "-input=false", "-no-color"); err != nil {
+		detail := strings.TrimSpace(stderr)
+		if detail == "" {
+			detail = strings.TrimSpace(stdout)
+		}
+		return &PlanSummary{Error: "terraform init failed: " + detail}
+	}
+
+	stdout, stderr, err := runValidator(ctx, dir, config.TerraformBin, "plan", "-json", "-input=false", "-lock=false", "-no-color")
+	summary := parsePlanJSON(stdout)
+	if err != nil && summary.Error == "" {
+		summary.Error = fmt.Sprintf("terraform plan failed: %v: %s", err, strings.TrimSpace(stderr))
+	}
+	if summary.Error != "" {
+		summary.Available = false
+	}
+	return summary
+}
+
+// parsePlanJSON reads the machine-readable UI of terraform plan -json: planned changes become the
+// output, the change summary the counts, and error diagnostics the error
+func parsePlanJSON(output string) *PlanSummary {
+	summary := &PlanSummary{}
+	var lines, errs []string
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var message struct {
+			Message string `json:"@message"`
+			Type    string `json:"type"`
+			Changes struct {
+				Add    int `json:"add"`
+				Change int `json:"change"`
+				Remove int `json:"remove"`
+			} `json:"changes"`
+			Diagnostic struct {
+				Severity string `json:"severity"`
+				Summary  string `json:"summary"`
+				Detail   string `json:"detail"`
+			} `json:"diagnostic"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			continue
+		}
+		switch message.Type {
+		case "planned_change", "resource_drift":
+			lines = append(lines, message.Message)
+		case "change_summary":
+			lines = append(lines, message.Message)
+			summary.Available = true
+			summary.ToAdd, summary.ToChange, summary.ToDestroy = message.Changes.Add, message.Changes.Change, message.Changes.Remove
+		case "diagnostic":
+			if message.Diagnostic.Severity == "error" {
+				errs = append(errs, strings.TrimSpace(message.Diagnostic.Summary+": "+message.Diagnostic.Detail))
+			}
+		}
+	}
+	summary.Output = strings.Join(lines, "\n")
+	summary.Error = strings.Join(errs, "; ")
+	return summary
+}
+
+func (do *DeploymentOrchestrator) loadDeployedState(ctx context.Context, application string, env Environment) (*DeployedState, error) {
+	data, err := do.redis.Get(ctx, deployedStateKey(application, env)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load deployed state: %w", err)
+	}
+
+	var state DeployedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal deployed state: %w", err)
+	}
+	return &state, nil
+}
+
+func (do *DeploymentOrchestrator) saveDeployedState(ctx context.Context, req *DeploymentRequest) {
+	state := desiredState(req)
+	state.DeployedAt = time.Now()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("Failed to marshal deployed state: %v", err)
+		return
+	}
+
+	if err := do.redis.Set(ctx, deployedStateKey(req.ApplicationName, req.Environment), data, 0).Err(); err != nil {
+		log.Printf("Failed to save deployed state: %v", err)
+	}
+}
+
+func deployedStateKey(application string, env Environment) string {
+	return fmt.Sprintf("deployment_state:%s:%s", application, env)
+}
+
+func configString(cfg map[string]interface{}, key string) string {
+	if value, ok := cfg[key].(string); ok {
+		return value
+	}
+	return ""
+}
+
+func configInt(cfg map[string]interface{}, key string) int {
+	switch value := cfg[key].(type) {
+	case float64:
+		return int(value)
+	case int:
+		return value
+	case string:
+		n, _ := strconv.Atoi(value)
+		return n
+	}
+	return 0
+}
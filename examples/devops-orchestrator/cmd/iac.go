@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optpreview"
+)
+
+// Pluggable infrastructure-as-code engines
+type IaCEngineType string
+
+const (
+	EngineTerraform IaCEngineType = "terraform"
+	EnginePulumi    IaCEngineType = "pulumi"
+)
+
+type IaCChanges struct {
+	Created int
+	Updated int
+	Deleted int
+}
+
+// IaCEngine runs plan/apply/destroy for one IaC tool. Prepare resolves and validates the program
+// on the request (e.g. generating Terraform with Claude) before any action runs.
+type IaCEngine interface {
+	Prepare(ctx context.Context, req *InfrastructureRequest) error
+	Plan(ctx context.Context, req *InfrastructureRequest) (string, error)
+	Apply(ctx context.Context, req *InfrastructureRequest) (IaCChanges, error)
+	Destroy(ctx context.Context, req *InfrastructureRequest) (IaCChanges, error)
+}
+
+// PulumiProgram selects the Pulumi program for a request: either an inline Pulumi YAML program
+// or a project directory under PULUMI_WORK_ROOT
+type PulumiProgram struct {
+	YAML    string   `json:"yaml,omitempty"`
+	WorkDir string   `json:"work_dir,omitempty"` // relative to PULUMI_WORK_ROOT
+	Stack   string   `json:"stack,omitempty"`    // defaults to the request environment, then "dev"
+	Secrets []string `json:"secrets,omitempty"`  // variables stored as secret config, besides those named like credentials
+}
+
+// terraformEngine is the default engine
+type terraformEngine struct {
+	im *InfrastructureManager
+}
+
+func (e *terraformEngine) Prepare(ctx context.Context, req *InfrastructureRequest) error {
+	if req.TerraformCode == "" {
+		code, report, err := e.im.generateValidTerraform(ctx, req)
+		if err != nil {
+			return err
+		}
+		req.TerraformCode = code
+		req.validation = report
+	}
+
+	// Reject missing or mistyped variables before Terraform runs
+	return ValidateTerraformVariables(req.TerraformCode, req.Variables)
+}
+
+func (e *terraformEngine) Plan(ctx context.Context, req *InfrastructureRequest) (string, error) {
+	return e.im.executeTerraformPlan(req.TerraformCode, req.Variables), nil
+}
+
+func (e *terraformEngine) Apply(ctx context.Context, req *InfrastructureRequest) (IaCChanges, error) {
+	created, updated, deleted := e.im.executeTerraformApply(req.TerraformCode, req.Variables)
+	return IaCChanges{Created: created, Updated: updated, Deleted: deleted}, nil
+}
+
+func (e *terraformEngine) Destroy(ctx context.Context, req *InfrastructureRequest) (IaCChanges, error) {
+	return IaCChanges{Deleted: e.im.executeTerraformDestroy(req.TerraformCode, req.Variables)}, nil
+}
+
+// pulumiEngine drives Pulumi through its Automation API. Every run works on a private copy of the
+// program, so concurrent requests never share stack settings, and sensitive variables are stored
+// as secret config.
+type pulumiEngine struct{}
+
+// sensitiveConfigKeys mark variables stored as secret config even when pulumi_program.secrets
+// doesn't list them
+var sensitiveConfigKeys = []string{"password", "secret", "token", "key", "credential", "private"}
+
+func (e *pulumiEngine) Prepare(ctx context.Context, req *InfrastructureRequest) error {
+	if req.PulumiProgram == nil || (req.PulumiProgram.YAML == "" && req.PulumiProgram.WorkDir == "") {
+		return fmt.Errorf("pulumi_program with yaml or work_dir is required for the pulumi engine")
+	}
+	if req.PulumiProgram.YAML != "" && req.PulumiProgram.WorkDir != "" {
+		return fmt.Errorf("pulumi_program accepts yaml or work_dir, not both")
+	}
+	if req.PulumiProgram.WorkDir != "" {
+		if _, err := pulumiProgramDir(req.PulumiProgram.WorkDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *pulumiEngine) Plan(ctx context.Context, req *InfrastructureRequest) (string, error) {
+	var output string
+	err := e.withStack(ctx, req, func(stack auto.Stack) error {
+		result, err := stack.Preview(ctx, optpreview.Diff())
+		output = result.StdOut
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+func (e *pulumiEngine) Apply(ctx context.Context, req *InfrastructureRequest) (IaCChanges, error) {
+	var changes IaCChanges
+	err := e.withStack(ctx, req, func(stack auto.Stack) error {
+		result, err := stack.Up(ctx)
+		if err != nil {
+			return err
+		}
+		changes = pulumiChanges(result.Summary)
+		return nil
+	})
+	return changes, err
+}
+
+func (e *pulumiEngine) Destroy(ctx context.Context, req *InfrastructureRequest) (IaCChanges, error) {
+	var changes IaCChanges
+	err := e.withStack(ctx, req, func(stack auto.Stack) error {
+		result, err := stack.Destroy(ctx)
+		if err != nil {
+			return err
+		}
+		changes = pulumiChanges(result.Summary)
+		return nil
+	})
+	return changes, err
+}
+
+// withStack selects (or creates) the request's stack in a private workspace, sets the request's
+// variables as stack config, and runs fn against it. The workspace, including the stack settings
+// file the config is written to, is removed afterwards.
+func (e *pulumiEngine) withStack(ctx context.Context, req *InfrastructureRequest, fn func(stack auto.Stack) error) error {
+	workDir, cleanup, err := pulumiWorkspace(req.PulumiProgram)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	stack, err := auto.UpsertStackLocalSource(ctx, pulumiStack(req), workDir,
+		auto.EnvVars(map[string]string{"PULUMI_SKIP_UPDATE_CHECK": "true"}))
+	if err != nil {
+		return fmt.Errorf("failed to select pulumi stack: %w", err)
+	}
+
+	stackConfig, err := pulumiConfig(req)
+	if err != nil {
+		return err
+	}
+	if err := stack.SetAllConfig(ctx, stackConfig); err != nil {
+		return fmt.Errorf("failed to set pulumi config: %w", err)
+	}
+	return fn(stack)
+}
+
+// pulumiConfig turns the request's variables into stack config. Plain strings are passed as-is;
+// other values as JSON so Pulumi can parse structured config.
+func pulumiConfig(req *InfrastructureRequest) (auto.ConfigMap, error) {
+	secrets := make(map[string]bool, len(req.PulumiProgram.Secrets))
+	for _, key := range req.PulumiProgram.Secrets {
+		secrets[key] = true
+	}
+
+	stackConfig := make(auto.ConfigMap, len(req.Variables))
+	for key, value := range req.Variables {
+		v, ok := value.(string)
+		if !ok {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for variable %s: %w", key, err)
+			}
+			v = string(data)
+		}
+		stackConfig[key] = auto.ConfigValue{Value: v, Secret: secrets[key] || sensitiveConfigKey(key)}
+	}
+	return stackConfig, nil
+}
+
+func sensitiveConfigKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, part := range sensitiveConfigKeys {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
+
+func pulumiChanges(summary auto.UpdateSummary) IaCChanges {
+	if summary.ResourceChanges == nil {
+		return IaCChanges{}
+	}
+	changes := *summary.ResourceChanges
+	return IaCChanges{
+		Created: changes["create"],
+		Updated: changes["update"] + changes["replace"],
+		Deleted: changes["delete"],
+	}
+}
+
+func pulumiStack(req *InfrastructureRequest) string {
+	if req.PulumiProgram.Stack != "" {
+		return req.PulumiProgram.Stack
+	}
+	if req.Environment != "" {
+		return string(req.Environment)
+	}
+	return "dev"
+}
+
+// inlinePulumiProgram reports whether a request runs Pulumi YAML supplied in the request rather
+// than a project under PULUMI_WORK_ROOT
+func inlinePulumiProgram(engine IaCEngineType, program *PulumiProgram) bool {
+	return engine == EnginePulumi && program != nil && program.YAML != ""
+}
+
+// pulumiProgramDir resolves a work_dir inside PULUMI_WORK_ROOT; without a root, only inline
+// programs run
+func pulumiProgramDir(workDir string) (string, error) {
+	if config.PulumiWorkRoot == "" {
+		return "", fmt.Errorf("pulumi_program.work_dir requires PULUMI_WORK_ROOT to be set")
+	}
+	dir, err := workspacePath(config.PulumiWorkRoot, workDir)
+	if err != nil {
+		return "", fmt.Errorf("pulumi_program.work_dir: %w", err)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("pulumi_program.work_dir: %s is not a directory", workDir)
+	}
+	return dir, nil
+}
+
+// pulumiWorkspace creates a private temp dir holding a copy of the program directory, or the
+// inline YAML program; cleanup removes it
+func pulumiWorkspace(program *PulumiProgram) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "pulumi-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create pulumi workspace: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	if program.WorkDir != "" {
+		src, err := pulumiProgramDir(program.WorkDir)
+		if err == nil {
+			err = copyProgram(src, dir)
+		}
+		if err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("failed to copy pulumi program: %w", err)
+		}
+		return dir, cleanup, nil
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "Pulumi.yaml"), []byte(program.YAML), 0o600); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to write pulumi program: %w", err)
+	}
+	return dir, cleanup, nil
+}
+
+// copyProgram copies a program directory into dst, keeping symlinks as links
+func copyProgram(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(target, 0o700)
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !entry.Type().IsRegular():
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// Cloud resource inventory
+const (
+	inventoryCacheTTL       = time.Hour
+	awsInventoryConcurrency = 8 // regions queried at once
+
+	// awsConfigInventoryQuery selects every resource AWS Config has recorded in a region
+	awsConfigInventoryQuery = "SELECT resourceId, resourceName, resourceType, awsRegion, arn, tags"
+)
+
+// ownershipTags mark a resource as owned by someone even if Terraform doesn't manage it
+var ownershipTags = []string{"owner", "team", "managed-by", "managed_by", "created-by", "project"}
+
+type InventoryResource struct {
+	ID               string            `json:"id"` // ARN, Azure resource ID, or GCP asset name
+	Name             string            `json:"name"`
+	Type             string            `json:"type"`
+	Region           string            `json:"region,omitempty"`
+	Tags             map[string]string `json:"tags,omitempty"`
+	Managed          bool              `json:"managed"`
+	TerraformAddress string            `json:"terraform_address,omitempty"`
+	Orphaned         bool              `json:"orphaned"`
+	OrphanReason     string            `json:"orphan_reason,omitempty"`
+}
+
+type InventorySummary struct {
+	Total     int `json:"total"`
+	Managed   int `json:"managed"`
+	Unmanaged int `json:"unmanaged"`
+	Orphaned  int `json:"orphaned"`
+}
+
+type InventoryResponse struct {
+	Provider        CloudProvider       `json:"provider"`
+	Account         string              `json:"account,omitempty"`
+	Resources       []InventoryResource `json:"resources"`
+	Summary         InventorySummary    `json:"summary"`
+	Recommendations []string            `json:"recommendations"`
+	GeneratedAt     time.Time           `json:"generated_at"`
+}
+
+// orphanFinding is the recommendation engine's verdict on one unmanaged resource
+type orphanFinding struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+type InventoryManager struct {
+	redis        *redis.Client
+	claudeClient *ClaudeClient
+}
+
+func NewInventoryManager(redisClient *redis.Client, claudeClient *ClaudeClient) *InventoryManager {
+	return &InventoryManager{
+		redis:        redisClient,
+		claudeClient: claudeClient,
+	}
+}
+
+// Discover lists the resources in a provider account, classifies them against Terraform state,
+// and flags orphans. Results are cached for an hour unless refresh is set.
+func (inv *InventoryManager) Discover(ctx context.Context, provider CloudProvider, account string, refresh bool) (*InventoryResponse, error) {
+	cacheKey := fmt.Sprintf("inventory:%s:%s", provider, account)
+	if !refresh {
+		if data, err := inv.redis.Get(ctx, cacheKey).Bytes(); err == nil {
+			var cached InventoryResponse
+			if json.Unmarshal(data, &cached) == nil {
+				return &cached, nil
+			}
+		}
+	}
+
+	resources, warnings, err := listCloudResources(ctx, provider, account)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := loadTerraformState(config.TerraformStateDir)
+	if err != nil {
+		return nil, err
+	}
+	for i := range resources {
+		if address, ok := state.match(resources[i].ID); ok {
+			resources[i].Managed = true
+			resources[i].TerraformAddress = address
+		}
+	}
+
+	response := &InventoryResponse{
+		Provider:        provider,
+		Account:         account,
+		Resources:       resources,
+		Recommendations: append(make([]string, 0), warnings...),
+		GeneratedAt:     time.Now(),
+	}
+	inv.flagOrphans(ctx, response)
+
+	for _, r := range response.Resources {
+		response.Summary.Total++
+		if r.Managed {
+			response.Summary.Managed++
+		} else {
+			response.Summary.Unmanaged++
+		}
+		if r.Orphaned {
+			response.Summary.Orphaned++
+		}
+	}
+
+	if data, err := json.Marshal(response); err == nil {
+		if err := inv.redis.Set(ctx, cacheKey, data, inventoryCacheTTL).Err(); err != nil {
+			log.Printf("Failed to cache inventory: %v", err)
+		}
+	}
+
+	return response, nil
+}
+
+// flagOrphans asks Claude which unmanaged resources look abandoned; without Claude, unmanaged
+// resources carrying no ownership tag are flagged
+func (inv *InventoryManager) flagOrphans(ctx context.Context, response *InventoryResponse) {
+	var unmanaged []InventoryResource
+	for _, r := range response.Resources {
+		if !r.Managed {
+			unmanaged = append(unmanaged, r)
+		}
+	}
+	if len(unmanaged) == 0 {
+		return
+	}
+
+	findings, recommendations, err := inv.claudeClient.FindOrphanedResources(ctx, response.Provider, unmanaged)
+	if err != nil {
+		log.Printf("Claude orphan detection failed, using ownership tags: %v", err)
+		findings = nil
+		for _, r := range unmanaged {
+			if !hasOwnershipTag(r.Tags) {
+				findings = append(findings, orphanFinding{ID: r.ID, Reason: "not in Terraform state and has no ownership tag"})
+			}
+		}
+		if len(findings) > 0 {
+			recommendations = []string{fmt.Sprintf("Review %d unmanaged, untagged resources for cleanup or import them into Terraform", len(findings))}
+		}
+	}
+
+	reasons := make(map[string]string, len(findings))
+	for _, f := range findings {
+		reasons[f.ID] = f.Reason
+	}
+	for i := range response.Resources {
+		r := &response.Resources[i]
+		if reason, ok := reasons[r.ID]; ok && !r.Managed {
+			r.Orphaned = true
+			r.OrphanReason = reason
+		}
+	}
+	response.Recommendations = append(response.Recommendations, recommendations...)
+}
+
+func hasOwnershipTag(tags map[string]string) bool {
+	for key := range tags {
+		for _, owner := range ownershipTags {
+			if strings.EqualFold(key, owner) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// listCloudResources enumerates an account through the provider's CLI, which handles
+// credentials and pagination the same way operators already use it. Warnings name the parts of
+// the account that could not be listed completely.
+func listCloudResources(ctx context.Context, provider CloudProvider, account string) ([]InventoryResource, []string, error) {
+	switch provider {
+	case AWS:
+		return listAWSResources(ctx, account)
+
+	case Azure:
+		args := []string{"resource", "list", "--output", "json"}
+		if account != "" {
+			args = append(args, "--subscription", account)
+		}
+		var out []struct {
+			ID       string            `json:"id"`
+			Name     string            `json:"name"`
+			Type     string            `json:"type"`
+			Location string            `json:"location"`
+			Tags     map[string]string `json:"tags"`
+		}
+		if err := runCloudCLI(ctx, config.AzureBin, args, &out); err != nil {
+			return nil, nil, err
+		}
+
+		resources := make([]InventoryResource, 0, len(out))
+		for _, item := range out {
+			resources = append(resources, InventoryResource{ID: item.ID, Name: item.Name, Type: item.Type, Region: item.Location, Tags: item.Tags})
+		}
+		return resources, nil, nil
+
+	case GCP:
+		if account == "" {
+			return nil, nil, fmt.Errorf("account (GCP project ID) is required for gcp inventory")
+		}
+		args := []string{"asset", "search-all-resources", "--scope=projects/" + account, "--format=json"}
+		var out []struct {
+			Name        string            `json:"name"`
+			AssetType   string            `json:"assetType"`
+			DisplayName string            `json:"displayName"`
+			Location    string            `json:"location"`
+			Labels      map[string]string `json:"labels"`
+		}
+		if err := runCloudCLI(ctx, config.GCloudBin, args, &out); err != nil {
+			return nil, nil, err
+		}
+
+		resources := make([]InventoryResource, 0, len(out))
+		for _, item := range out {
+			resources = append(resources, InventoryResource{ID: item.Name, Name: item.DisplayName, Type: item.AssetType, Region: item.Location, Tags: item.Labels})
+		}
+		return resources, nil, nil
+	}
+
+	return nil, nil, fmt.Errorf("inventory is not supported for provider: %s", provider)
+}
+
+// listAWSResources queries AWS Config in every region enabled for the account. Unlike the tagging
+// API, Config also records resources that were never tagged. Regions where Config isn't recording
+// fall back to the tagging API and are reported in the warnings, as are regions that failed.
+func listAWSResources(ctx context.Context, account string) ([]InventoryResource, []string, error) {
+	var profile []string
+	if account != "" {
+		profile = []string{"--profile", account}
+	}
+
+	// Without --all-regions, describe-regions lists only the enabled regions
+	var out struct {
+		Regions []struct {
+			RegionName string `json:"RegionName"`
+		} `json:"Regions"`
+	}
+	if err := runCloudCLI(ctx, config.AWSBin, append([]string{"ec2", "describe-regions", "--output", "json"}, profile...), &out); err != nil {
+		return nil, nil, err
+	}
+
+	type regionInventory struct {
+		resources []InventoryResource
+		warning   string
+		err       error
+	}
+	regions := make([]regionInventory, len(out.Regions))
+	slots := make(chan struct{}, awsInventoryConcurrency)
+	var wg sync.WaitGroup
+	for i, region := range out.Regions {
+		wg.Add(1)
+		go func(i int, region string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			r := &regions[i]
+			r.resources, r.warning, r.err = listAWSRegion(ctx, region, profile)
+		}(i, region.RegionName)
+	}
+	wg.Wait()
+
+	resources := make([]InventoryResource, 0)
+	warnings := make([]string, 0)
+	seen := make(map[string]bool)
+	failed := 0
+	for i, region := range regions {
+		if region.err != nil {
+			warnings = append(warnings, fmt.Sprintf("Could not list resources in %s: %v", out.Regions[i].RegionName, region.err))
+			failed++
+			continue
+		}
+		if region.warning != "" {
+			warnings = append(warnings, region.warning)
+		}
+		// Global resources such as IAM roles may be recorded in several regions
+		for _, r := range region.resources {
+			if !seen[r.ID] {
+				seen[r.ID] = true
+				resources = append(resources, r)
+			}
+		}
+	}
+	if failed > 0 && failed == len(regions) {
+		return nil, nil, regions[0].err
+	}
+	return resources, warnings, nil
+}
+
+// listAWSRegion lists one region through AWS Config, or through the tagging API with a warning
+// when no configuration recorder is recording there
+func listAWSRegion(ctx context.Context, region string, profile []string) ([]InventoryResource, string, error) {
+	regionArgs := append([]string{"--region", region, "--output", "json"}, profile...)
+
+	var status struct {
+		ConfigurationRecordersStatus []struct {
+			Recording bool `json:"recording"`
+		} `json:"ConfigurationRecordersStatus"`
+	}
+	if err := runCloudCLI(ctx, config.AWSBin, append([]string{"configservice", "describe-configuration-recorder-status"}, regionArgs...), &status); err != nil {
+		return nil, "", err
+	}
+	recording := false
+	for _, recorder := range status.ConfigurationRecordersStatus {
+		recording = recording || recorder.Recording
+	}
+	if !recording {
+		resources, err := listAWSTaggedResources(ctx, regionArgs)
+		return resources, fmt.Sprintf("AWS Config is not recording in %s, so only tagged resources were listed there; enable a configuration recorder to include untagged ones", region), err
+	}
+
+	// The CLI follows NextToken and merges every page into Results
+	var out struct {
+		Results []string `json:"Results"`
+	}
+	args := append([]string{"configservice", "select-resource-config", "--expression", awsConfigInventoryQuery}, regionArgs...)
+	if err := runCloudCLI(ctx, config.AWSBin, args, &out); err != nil {
+		return nil, "", err
+	}
+
+	resources := make([]InventoryResource, 0, len(out.Results))
+	for _, result := range out.Results {
+		var item struct {
+			ResourceID   string `json:"resourceId"`
+			ResourceName string `json:"resourceName"`
+			ResourceType string `json:"resourceType"`
+			AWSRegion    string `json:"awsRegion"`
+			ARN          string `json:"arn"`
+			Tags         []struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+			} `json:"tags"`
+		}
+		// Config also records its own compliance results as resources
+		if json.Unmarshal([]byte(result), &item) != nil || strings.HasPrefix(item.ResourceType, "AWS::Config::") {
+			continue
+		}
+		r := InventoryResource{ID: item.ARN, Name: item.ResourceName, Type: item.ResourceType, Region: item.AWSRegion, Tags: make(map[string]string)}
+		if r.ID == "" {
+			r.ID = item.ResourceID
+		}
+		if r.Name == "" {
+			r.Name = item.ResourceID
+		}
+		for _, tag := range item.Tags {
+			r.Tags[tag.Key] = tag.Value
+			if tag.Key == "Name" {
+				r.Name = tag.Value
+			}
+		}
+		resources = append(resources, r)
+	}
+	return resources, "", nil
+}
+
+// listAWSTaggedResources lists the resources the tagging API knows in one region: those that
+// carry, or once carried, a tag
+func listAWSTaggedResources(ctx context.Context, regionArgs []string) ([]InventoryResource, error) {
+	var out struct {
+		ResourceTagMappingList []struct {
+			ResourceARN string `json:"ResourceARN"`
+			Tags        []struct {
+				Key   string `json:"Key"`
+				Value string `json:"Value"`
+			} `json:"Tags"`
+		} `json:"ResourceTagMappingList"`
+	}
+	if err := runCloudCLI(ctx, config.AWSBin, append([]string{"resourcegroupstaggingapi", "get-resources"}, regionArgs...), &out); err != nil {
+		return nil, err
+	}
+
+	resources := make([]InventoryResource, 0, len(out.ResourceTagMappingList))
+	for _, item := range out.ResourceTagMappingList {
+		r := InventoryResource{ID: item.ResourceARN, Tags: make(map[string]string)}
+		// arn:partition:service:region:account:resource-type/resource-id
+		if parts := strings.SplitN(item.ResourceARN, ":", 6); len(parts) == 6 {
+			r.Region = parts[3]
+			r.Type = parts[2]
+			if i := strings.IndexAny(parts[5], "/:"); i >= 0 {
+				r.Type += ":" + parts[5][:i]
+			}
+			r.Name = parts[5][strings.LastIndexAny(parts[5], "/:")+1:]
+		}
+		for _, tag := range item.Tags {
+			r.Tags[tag.Key] = tag.Value
+			if tag.Key == "Name" {
+				r.Name = tag.Value
+			}
+		}
+		resources = append(resources, r)
+	}
+	return resources, nil
+}
+
+func runCloudCLI(ctx context.Context, bin string, args []string, out interface{}) error {
+	cmd := exec.CommandContext(ctx, bin, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", filepath.Base(bin), strings.Join(args[:2], " "), err, strings.TrimSpace(stderr.String()))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(output, out); err != nil {
+		return fmt.Errorf("failed to parse %s output: %w", filepath.Base(bin), err)
+	}
+	return nil
+}
+
+// terraformState indexes the identifiers of every managed resource in a set of state files
+type terraformState struct {
+	addresses map[string]string // lower-cased id/arn/self_link -> resource address
+}
+
+// loadTerraformState reads every *.tfstate under dir; an unset dir means nothing is managed
+func loadTerraformState(dir string) (*terraformState, error) {
+	state := &terraformState{addresses: make(map[string]string)}
+	if dir == "" {
+		return state, nil
+	}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".tfstate") {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var file struct {
+			Resources []struct {
+				Module    string `json:"module"`
+				Mode      string `json:"mode"`
+				Type      string `json:"type"`
+				Name      string `json:"name"`
+				Instances []struct {
+					Attributes map[string]interface{} `json:"attributes"`
+				} `json:"instances"`
+			} `json:"resources"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			log.Printf("Skipping unreadable Terraform state %s: %v", path, err)
+			return nil
+		}
+
+		for _, res := range file.Resources {
+			if res.Mode != "managed" {
+				continue
+			}
+			address := res.Type + "." + res.Name
+			if res.Module != "" {
+				address = res.Module + "." + address
+			}
+			for _, inst := range res.Instances {
+				for _, attr := range []string{"id", "arn", "self_link"} {
+					if v, ok := inst.Attributes[attr].(string); ok && v != "" {
+						state.addresses[strings.ToLower(v)] = address
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Terraform state: %w", err)
+	}
+	return state, nil
+}
+
+// match finds the state entry for a cloud resource ID. GCP asset names
+// ("//compute.googleapis.com/projects/p/zones/z/instances/vm") are matched on their path suffix.
+func (s *terraformState) match(id string) (string, bool) {
+	id = strings.ToLower(id)
+	if address, ok := s.addresses[id]; ok {
+		return address, true
+	}
+	// Some AWS resources only record their short ID (e.g. i-0abc) in state
+	if strings.HasPrefix(id, "arn:") {
+		if address, ok := s.addresses[id[strings.LastIndexAny(id, "/:")+1:]]; ok {
+			return address, true
+		}
+	}
+	if strings.HasPrefix(id, "//") {
+		path := id[strings.Index(id[2:], "/")+3:]
+		for stateID, address := range s.addresses {
+			if stateID == path || strings.HasSuffix(stateID, "/"+path) {
+				return address, true
+			}
+		}
+	}
+	return "", false
+}
+
+// FindOrphanedResources asks Claude which unmanaged resources look abandoned
+func (c *ClaudeClient) FindOrphanedResources(ctx context.Context, provider CloudProvider, resources []InventoryResource) ([]orphanFinding, []string, error) {
+	sort.Slice(resources, func(i, j int) bool { return resources[i].ID < resources[j].ID })
+	listing, err := json.Marshal(resources)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prompt := fmt.Sprintf(`These %s resources exist in the account but are not in any Terraform state:
+
+%s
+
+Identify resources that look orphaned (leftover test resources, unattached volumes/IPs, snapshots of deleted resources, no owner). Respond with JSON only:
+{"orphaned": [{"id": "...", "reason": "..."}], "recommendations": ["..."]}`, provider, listing)
+
+	response, err := c.complete(ctx, "You are a cloud cost and hygiene reviewer.", prompt, 2000)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var result struct {
+		Orphaned        []orphanFinding `json:"orphaned"`
+		Recommendations []string        `json:"recommendations"`
+	}
+	if err := json.Unmarshal([]byte(extractJSON(response)), &result); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse orphan findings: %w", err)
+	}
+	return result.Orphaned, result.Recommendations, nil
+}
+
+// HTTP Handlers
+func (s *APIServer) inventoryHandler(c *gin.Context) {
+	provider := CloudProvider(c.Query("provider"))
+	if provider != AWS && provider != Azure && provider != GCP {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "provider must be one of aws, azure, gcp"})
+		return
+	}
+
+	response, err := s.inventoryManager.Discover(c.Request.Context(), provider, c.Query("account"), c.Query("refresh") == "true")
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
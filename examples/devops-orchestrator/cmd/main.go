@@ -9,13 +9,18 @@ Tech: Go 1.21, Claude 3.5 Sonnet, Terraform, Ansible, Kubernetes Operator
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -28,15 +33,48 @@ import (
 
 // Configuration
 type Config struct {
-	AppName        string
-	Version        string
-	Port           string
-	RedisURL       string
-	ClaudeAPIKey   string
-	ClaudeModel    string
-	TerraformBin   string
-	AnsibleBin     string
-	MaxConcurrent  int
+	AppName       string
+	Version       string
+	Port          string
+	RedisURL      string
+	ClaudeAPIKey  string
+	ClaudeModel   string
+	TerraformBin  string
+	AnsibleBin    string
+	RunbookShell  string
+	DockerBin     string
+	AWSBin        string
+	AzureBin      string
+	GCloudBin     string
+	TFLintBin     string // optional linter for generated Terraform; skipped when not installed
+	MaxConcurrent int
+	PauseTimeout  time.Duration
+	Workers       int // deployment workers per replica; 0 runs an API-only replica
+
+	// A DR runbook step left unconfirmed for this long aborts its execution
+	RunbookConfirmationTimeout time.Duration
+
+	// Times Claude may repair generated Terraform that fails validation before the request fails
+	TerraformRepairAttempts int
+
+	// Command health probes any deployer may run, one per line; other command probes need admin
+	ProbeCommandsFile string
+
+	// Directory of *.tfstate files used to tell managed resources from unmanaged ones in the inventory
+	TerraformStateDir string
+
+	// Comma-separated variables passed to pipeline stages besides PATH, HOME, and TMPDIR
+	PipelineEnv string
+
+	// Directory holding the Pulumi projects requests may name in pulumi_program.work_dir
+	PulumiWorkRoot string
+
+	SlackBotToken      string
+	SlackSigningSecret string
+
+	// RBAC is enforced once an admin token is set; it authenticates as the built-in "admin" principal
+	RBACAdminToken string
+	RBACTokenTTL   time.Duration // lifetime of issued tokens that don't set expires_in
 }
 
 var config = Config{
@@ -46,9 +84,35 @@ var config = Config{
 	RedisURL:      getEnv("REDIS_URL", "redis://localhost:6379"),
 	ClaudeAPIKey:  getEnv("CLAUDE_API_KEY", "your-api-key-here"),
 	ClaudeModel:   "claude-3-5-sonnet-20241022",
-	TerraformBin:  "/usr/local/bin/terraform",
+	TerraformBin:  getEnv("TERRAFORM_BIN", "/usr/local/bin/terraform"),
+	TFLintBin:     getEnv("TFLINT_BIN", "tflint"),
 	AnsibleBin:    "/usr/local/bin/ansible-playbook",
+	RunbookShell:  getEnv("RUNBOOK_SHELL", "/bin/sh"),
+	DockerBin:     getEnv("DOCKER_BIN", "/usr/bin/docker"),
+	AWSBin:        getEnv("AWS_BIN", "aws"),
+	AzureBin:      getEnv("AZURE_BIN", "az"),
+	GCloudBin:     getEnv("GCLOUD_BIN", "gcloud"),
 	MaxConcurrent: 200,
+	PauseTimeout:  30 * time.Minute,
+	Workers:       getEnvInt("DEPLOYMENT_WORKERS", 10),
+
+	RunbookConfirmationTimeout: time.Duration(getEnvInt("RUNBOOK_CONFIRMATION_TIMEOUT_MINUTES", 30)) * time.Minute,
+
+	TerraformRepairAttempts: getEnvInt("TERRAFORM_REPAIR_ATTEMPTS", 3),
+
+	ProbeCommandsFile: getEnv("PROBE_COMMANDS_FILE", ""),
+
+	TerraformStateDir: getEnv("TERRAFORM_STATE_DIR", ""),
+
+	PipelineEnv: getEnv("PIPELINE_ENV", ""),
+
+	PulumiWorkRoot: getEnv("PULUMI_WORK_ROOT", ""),
+
+	SlackBotToken:      getEnv("SLACK_BOT_TOKEN", ""),
+	SlackSigningSecret: getEnv("SLACK_SIGNING_SECRET", ""),
+
+	RBACAdminToken: getEnv("RBAC_ADMIN_TOKEN", ""),
+	RBACTokenTTL:   time.Duration(getEnvInt("RBAC_TOKEN_TTL_DAYS", 90)) * 24 * time.Hour,
 }
 
 // Metrics
@@ -77,19 +141,44 @@ var (
 		[]string{"resource_type", "action"},
 	)
 
+	budgetViolations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "devops_budget_violations_total",
+			Help: "Infrastructure applies blocked by a cost budget",
+		},
+		[]string{"scope"},
+	)
+
 	pipelineExecutions = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "devops_pipeline_executions_total",
 			Help: "Total CI/CD pipeline executions",
 		},
 	)
+
+	deploymentsQueued = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "devops_deployments_queued_total",
+			Help: "Total deployments enqueued for the worker pool",
+		},
+	)
+
+	deploymentWorkersBusy = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "devops_deployment_workers_busy",
+			Help: "Deployment workers currently executing a deployment",
+		},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(deploymentsTotal)
 	prometheus.MustRegister(deploymentDuration)
 	prometheus.MustRegister(infrastructureChanges)
+	prometheus.MustRegister(budgetViolations)
 	prometheus.MustRegister(pipelineExecutions)
+	prometheus.MustRegister(deploymentsQueued)
+	prometheus.MustRegister(deploymentWorkersBusy)
 }
 
 // Data Models
@@ -113,98 +202,180 @@ const (
 type DeploymentStrategy string
 
 const (
-	BlueGreen      DeploymentStrategy = "blue-green"
-	Canary         DeploymentStrategy = "canary"
-	RollingUpdate  DeploymentStrategy = "rolling"
-	Recreate       DeploymentStrategy = "recreate"
+	BlueGreen     DeploymentStrategy = "blue-green"
+	Canary        DeploymentStrategy = "canary"
+	RollingUpdate DeploymentStrategy = "rolling"
+	Recreate      DeploymentStrategy = "recreate"
 )
 
 type DeploymentRequest struct {
-	DeploymentID    string             `json:"deployment_id"`
-	ApplicationName string             `json:"application_name"`
-	Version         string             `json:"version"`
-	Environment     Environment        `json:"environment"`
-	CloudProvider   CloudProvider      `json:"cloud_provider"`
-	Strategy        DeploymentStrategy `json:"strategy"`
+	DeploymentID    string                 `json:"deployment_id"`
+	ApplicationName string                 `json:"application_name"`
+	Version         string                 `json:"version"`
+	Environment     Environment            `json:"environment"`
+	CloudProvider   CloudProvider          `json:"cloud_provider"`
+	Strategy        DeploymentStrategy     `json:"strategy"`
 	Config          map[string]interface{} `json:"config"`
-	Rollback        bool               `json:"rollback,omitempty"`
-	DryRun          bool               `json:"dry_run,omitempty"`
+	Rollback        bool                   `json:"rollback,omitempty"`
+	DryRun          bool                   `json:"dry_run,omitempty"`
+	RequestedBy     string                 `json:"requested_by,omitempty"` // set from the authenticated principal
+	CommitTime      *time.Time             `json:"commit_time,omitempty"`  // when the change was committed, for DORA lead time
+
+	// Multi-region fan-out; when empty the strategy runs once
+	Regions         []RegionTarget `json:"regions,omitempty"`
+	RegionOrdering  string         `json:"region_ordering,omitempty"`   // "sequential" (default) or "waves"
+	OnRegionFailure string         `json:"on_region_failure,omitempty"` // "rollback" (default) or "halt"
+
+	// Probes run between strategy steps; a probe that never passes fails the deployment
+	HealthProbes []HealthProbe `json:"health_probes,omitempty"`
+
+	// Retries for transient step failures; step policies are keyed by step
+	// ("create_environment", "deploy", "switch_traffic", "shift_traffic", "update_replica", "stop", "start", "decommission")
+	RetryPolicy       *RetryPolicy            `json:"retry_policy,omitempty"`
+	StepRetryPolicies map[string]*RetryPolicy `json:"step_retry_policies,omitempty"`
+
+	// A paused rollout is aborted once paused for longer than this (default 30 minutes)
+	PauseTimeoutSeconds int `json:"pause_timeout_seconds,omitempty"`
+
+	// What a worker does with a deployment whose previous worker died mid-rollout:
+	// "resume" (default) from the last completed step, or "rollback"
+	OnInterruption string `json:"on_interruption,omitempty"`
 }
 
 type InfrastructureRequest struct {
-	RequestID     string                 `json:"request_id"`
-	Action        string                 `json:"action"` // "plan", "apply", "destroy"
-	CloudProvider CloudProvider          `json:"cloud_provider"`
+	RequestID     string                   `json:"request_id"`
+	Action        string                   `json:"action"` // "plan", "apply", "destroy"; cloudformation also "drift", "rollback"
+	CloudProvider CloudProvider            `json:"cloud_provider"`
 	Resources     []InfrastructureResource `json:"resources"`
-	TerraformCode string                 `json:"terraform_code,omitempty"`
-	Variables     map[string]interface{} `json:"variables"`
+	TerraformCode string                   `json:"terraform_code,omitempty"`
+	Variables     map[string]interface{}   `json:"variables"`
+
+	// IaC engine, "terraform" (default), "pulumi", or "cloudformation"; pulumi runs PulumiProgram and
+	// cloudformation runs CloudFormation instead of TerraformCode
+	Engine         IaCEngineType        `json:"engine,omitempty"`
+	PulumiProgram  *PulumiProgram       `json:"pulumi_program,omitempty"`
+	CloudFormation *CloudFormationStack `json:"cloudformation,omitempty"`
+
+	// Budget enforcement on apply; re-applying a stack replaces the requester's earlier estimate for
+	// it in the monthly spend. Stack defaults to the CloudFormation stack, then the request ID.
+	Team             string      `json:"team,omitempty"`
+	Environment      Environment `json:"environment,omitempty"`
+	BudgetOverrideID string      `json:"budget_override_id,omitempty"`
+	Stack            string      `json:"stack,omitempty"`
+	RequestedBy      string      `json:"requested_by,omitempty"` // set from the authenticated principal
+
+	// Set by the terraform engine when it generated and validated the code
+	validation *TerraformValidationReport
 }
 
 type InfrastructureResource struct {
-	Type       string                 `json:"type"` // "compute", "network", "storage", "database"
-	Name       string                 `json:"name"`
-	Config     map[string]interface{} `json:"config"`
+	Type   string                 `json:"type"` // "compute", "network", "storage", "database"
+	Name   string                 `json:"name"`
+	Config map[string]interface{} `json:"config"`
 }
 
 type PipelineRequest struct {
-	PipelineID   string            `json:"pipeline_id"`
-	Repository   string            `json:"repository"`
-	Branch       string            `json:"branch"`
-	Stages       []PipelineStage   `json:"stages"`
-	Environment  Environment       `json:"environment"`
-	Secrets      map[string]string `json:"secrets,omitempty"`
+	PipelineID  string            `json:"pipeline_id"`
+	Repository  string            `json:"repository"`
+	Branch      string            `json:"branch"`
+	Stages      []PipelineStage   `json:"stages"`
+	Environment Environment       `json:"environment"`
+	Secrets     map[string]string `json:"secrets,omitempty"`
 }
 
 type PipelineStage struct {
-	Name     string   `json:"name"`
-	Commands []string `json:"commands"`
-	Timeout  int      `json:"timeout"` // seconds
+	Name            string                 `json:"name"`
+	Type            StageType              `json:"type,omitempty"` // "command" (default), "integration_test", "deploy"
+	Commands        []string               `json:"commands"`
+	Timeout         int                    `json:"timeout"` // seconds
+	IntegrationTest *IntegrationTestConfig `json:"integration_test,omitempty"`
 }
 
 type DeploymentResponse struct {
-	DeploymentID     string    `json:"deployment_id"`
-	Status           string    `json:"status"` // "success", "failed", "in_progress"
-	Message          string    `json:"message"`
-	Timestamp        time.Time `json:"timestamp"`
-	ResourcesChanged int       `json:"resources_changed"`
-	RollbackPlan     string    `json:"rollback_plan,omitempty"`
-	Logs             []string  `json:"logs"`
-	Duration         float64   `json:"duration_seconds"`
+	DeploymentID     string          `json:"deployment_id"`
+	Status           string          `json:"status"` // "queued", "in_progress", "success", "failed", "dry_run"
+	Environment      Environment     `json:"environment,omitempty"`
+	Message          string          `json:"message"`
+	Timestamp        time.Time       `json:"timestamp"`
+	ResourcesChanged int             `json:"resources_changed"`
+	RollbackPlan     string          `json:"rollback_plan,omitempty"`
+	DryRunDiff       *DeploymentDiff `json:"dry_run_diff,omitempty"`
+	Postmortem       *Postmortem     `json:"postmortem,omitempty"`
+	Regions          []RegionStatus  `json:"regions,omitempty"`
+	PausedSeconds    float64         `json:"paused_seconds,omitempty"`
+	Interruptions    int             `json:"interruptions,omitempty"` // times a worker died mid-deployment
+	Logs             []string        `json:"logs"`
+	Duration         float64         `json:"duration_seconds"`
 }
 
 type InfrastructureResponse struct {
-	RequestID        string                   `json:"request_id"`
-	Status           string                   `json:"status"`
-	PlanOutput       string                   `json:"plan_output,omitempty"`
-	ResourcesCreated int                      `json:"resources_created"`
-	ResourcesUpdated int                      `json:"resources_updated"`
-	ResourcesDeleted int                      `json:"resources_deleted"`
-	CostEstimate     float64                  `json:"cost_estimate_monthly"`
-	Recommendations  []string                 `json:"recommendations"`
-	Duration         float64                  `json:"duration_seconds"`
+	RequestID        string           `json:"request_id"`
+	Status           string           `json:"status"` // "queued", "running", then the outcome, e.g. "applied" or "failed"
+	Error            string           `json:"error,omitempty"`
+	PlanOutput       string           `json:"plan_output,omitempty"`
+	ResourcesCreated int              `json:"resources_created"`
+	ResourcesUpdated int              `json:"resources_updated"`
+	ResourcesDeleted int              `json:"resources_deleted"`
+	CostEstimate     float64          `json:"cost_estimate_monthly"`
+	BudgetViolation  *BudgetViolation `json:"budget_violation,omitempty"`
+	Drift            *DriftReport     `json:"drift,omitempty"`
+	Recommendations  []string         `json:"recommendations"`
+	Duration         float64          `json:"duration_seconds"`
+
+	// Validation of Claude-generated Terraform; status is "validation_failed" when repairs ran out
+	Validation *TerraformValidationReport `json:"validation,omitempty"`
+
+	// Variables the generated Terraform rejected; status is "invalid_variables"
+	Violations []VariableViolation `json:"violations,omitempty"`
+}
+
+// finished reports whether the request has an outcome; queued and running requests don't
+func (response *InfrastructureResponse) finished() bool {
+	return response.Status != "queued" && response.Status != "running"
+}
+
+// statusCode is 202 until the request has run, then the code its outcome maps to
+func (response *InfrastructureResponse) statusCode() int {
+	switch response.Status {
+	case "queued", "running":
+		return http.StatusAccepted
+	case "budget_exceeded":
+		return http.StatusForbidden
+	case "invalid_variables", "validation_failed":
+		return http.StatusUnprocessableEntity
+	case "validation_unavailable":
+		return http.StatusServiceUnavailable
+	case "failed":
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
 }
 
 type PipelineResponse struct {
-	PipelineID   string            `json:"pipeline_id"`
-	Status       string            `json:"status"`
-	StageResults []StageResult     `json:"stage_results"`
-	Duration     float64           `json:"duration_seconds"`
-	Artifacts    []string          `json:"artifacts"`
+	PipelineID   string        `json:"pipeline_id"`
+	Status       string        `json:"status"` // "queued", "running", "success", "failed"
+	Error        string        `json:"error,omitempty"`
+	StageResults []StageResult `json:"stage_results"`
+	Duration     float64       `json:"duration_seconds"`
+	Artifacts    []string      `json:"artifacts"`
 }
 
 type StageResult struct {
-	Name     string   `json:"name"`
-	Status   string   `json:"status"`
-	Output   string   `json:"output"`
-	Duration float64  `json:"duration_seconds"`
+	Name        string       `json:"name"`
+	Type        StageType    `json:"type"`
+	Status      string       `json:"status"` // "success", "failed", "skipped"
+	Output      string       `json:"output"`
+	TestResults *TestResults `json:"test_results,omitempty"`
+	Duration    float64      `json:"duration_seconds"`
 }
 
 // Services
 type DeploymentOrchestrator struct {
-	redis        *redis.Client
-	claudeClient *ClaudeClient
-	mu           sync.RWMutex
-	activeJobs   map[string]*DeploymentJob
+	redis          *redis.Client
+	claudeClient   *ClaudeClient
+	infrastructure *InfrastructureManager
+	mu             sync.RWMutex
+	activeJobs     map[string]*DeploymentJob
 }
 
 type DeploymentJob struct {
@@ -212,13 +383,33 @@ type DeploymentJob struct {
 	Status    string
 	StartTime time.Time
 	Logs      []string
+	gate      *pauseGate
+	logMu     sync.Mutex
+
+	// Steps completed by this and earlier, interrupted executions; nil for dry runs
+	checkpoint *stepCheckpoint
+}
+
+// logf appends a job log line; logs are read concurrently by ChatOps status updates
+func (job *DeploymentJob) logf(format string, args ...interface{}) {
+	job.logMu.Lock()
+	defer job.logMu.Unlock()
+	job.Logs = append(job.Logs, fmt.Sprintf(format, args...))
 }
 
-func NewDeploymentOrchestrator(redisClient *redis.Client, claudeClient *ClaudeClient) *DeploymentOrchestrator {
+// logs returns a copy of the job's log lines
+func (job *DeploymentJob) logs() []string {
+	job.logMu.Lock()
+	defer job.logMu.Unlock()
+	return append([]string(nil), job.Logs...)
+}
+
+func NewDeploymentOrchestrator(redisClient *redis.Client, claudeClient *ClaudeClient, infrastructure *InfrastructureManager) *DeploymentOrchestrator {
 	return &DeploymentOrchestrator{
-		redis:        redisClient,
-		claudeClient: claudeClient,
-		activeJobs:   make(map[string]*DeploymentJob),
+		redis:          redisClient,
+		claudeClient:   claudeClient,
+		infrastructure: infrastructure,
+		activeJobs:     make(map[string]*DeploymentJob),
 	}
 }
 
@@ -235,39 +426,78 @@ func (do *DeploymentOrchestrator) ExecuteDeployment(ctx context.Context, req *De
 		Status:    "in_progress",
 		StartTime: time.Now(),
 		Logs:      make([]string, 0),
+		gate:      newPauseGate(do.redis, req.DeploymentID),
 	}
 
 	do.mu.Lock()
 	do.activeJobs[req.DeploymentID] = job
 	do.mu.Unlock()
+	defer func() {
+		do.mu.Lock()
+		delete(do.activeJobs, req.DeploymentID)
+		do.mu.Unlock()
+	}()
 
 	response := &DeploymentResponse{
 		DeploymentID: req.DeploymentID,
+		Environment:  req.Environment,
 		Timestamp:    time.Now(),
 		Logs:         make([]string, 0),
 	}
 
 	// Log deployment start
-	job.Logs = append(job.Logs, fmt.Sprintf("Starting %s deployment for %s v%s", req.Strategy, req.ApplicationName, req.Version))
+	job.logf("Starting %s deployment for %s v%s", req.Strategy, req.ApplicationName, req.Version)
 
-	// Dry run check
+	// Dry run: report the concrete changes instead of executing the strategy
 	if req.DryRun {
-		job.Logs = append(job.Logs, "DRY RUN MODE - No actual changes will be made")
+		job.logf("DRY RUN MODE - No actual changes will be made")
+
+		diff, err := do.ComputeDiff(ctx, req)
+		if err != nil {
+			job.Status = "failed"
+			response.Status = "failed"
+			response.Message = err.Error()
+		} else {
+			job.Status = "dry_run"
+			response.Status = "dry_run"
+			response.DryRunDiff = diff
+			if diff.HasChanges {
+				response.Message = "Dry run complete - changes detected"
+			} else {
+				response.Message = "Dry run complete - no changes"
+			}
+		}
+
+		response.Logs = job.logs()
+		response.Duration = time.Since(start).Seconds()
+		do.cacheDeployment(ctx, req.DeploymentID, response)
+		return response, nil
 	}
 
-	// Execute deployment strategy
-	var err error
-	switch req.Strategy {
-	case BlueGreen:
-		err = do.executeBlueGreenDeployment(ctx, req, job)
-	case Canary:
-		err = do.executeCanaryDeployment(ctx, req, job)
-	case RollingUpdate:
-		err = do.executeRollingDeployment(ctx, req, job)
-	case Recreate:
-		err = do.executeRecreateDeployment(ctx, req, job)
-	default:
-		err = fmt.Errorf("unsupported deployment strategy: %s", req.Strategy)
+	// Pick up where an interrupted execution of this deployment left off
+	checkpoint, err := do.loadCheckpoint(ctx, req.DeploymentID)
+	if err != nil {
+		return nil, err
+	}
+	job.checkpoint = checkpoint
+	response.Interruptions = checkpoint.interruptions
+	if checkpoint.interruptions > 0 {
+		err = do.resumeOrRollback(ctx, req, job)
+	}
+
+	// Execute deployment strategy, fanning out across regions when requested
+	if err == nil {
+		if len(req.Regions) > 0 {
+			err = do.executeMultiRegion(ctx, req, job, response)
+		} else {
+			err = do.runStrategy(ctx, req, job)
+		}
+	}
+	// Record the outcome even when the deployment was cancelled through ctx
+	ctx = context.WithoutCancel(ctx)
+	job.gate.finish(ctx)
+	if state, err := job.gate.state(ctx); err == nil && state.total > 0 {
+		response.PausedSeconds = state.total.Seconds()
 	}
 
 	if err != nil {
@@ -281,6 +511,7 @@ func (do *DeploymentOrchestrator) ExecuteDeployment(ctx context.Context, req *De
 		response.Message = "Deployment completed successfully"
 		response.ResourcesChanged = 5 // Simulated
 		deploymentsTotal.WithLabelValues("success", string(req.Environment), string(req.CloudProvider)).Inc()
+		do.saveDeployedState(ctx, req)
 	}
 
 	// Generate rollback plan using Claude
@@ -291,77 +522,114 @@ func (do *DeploymentOrchestrator) ExecuteDeployment(ctx context.Context, req *De
 		}
 	}
 
-	response.Logs = job.Logs
+	response.Logs = job.logs()
 	response.Duration = time.Since(start).Seconds()
 
+	// Draft a postmortem for failures before recording this deployment in the change history
+	if response.Status == "failed" {
+		response.Postmortem = do.GeneratePostmortem(ctx, req, response, job.StartTime)
+	}
+	do.recordHistory(ctx, req, response)
+	if !req.DryRun {
+		do.recordDORAEvent(ctx, req, response)
+	}
+
 	// Cache deployment history
 	do.cacheDeployment(ctx, req.DeploymentID, response)
+	checkpoint.clear(ctx)
 
 	return response, nil
 }
 
+func (do *DeploymentOrchestrator) runStrategy(ctx context.Context, req *DeploymentRequest, job *DeploymentJob) error {
+	switch req.Strategy {
+	case BlueGreen:
+		return do.executeBlueGreenDeployment(ctx, req, job)
+	case Canary:
+		return do.executeCanaryDeployment(ctx, req, job)
+	case RollingUpdate:
+		return do.executeRollingDeployment(ctx, req, job)
+	case Recreate:
+		return do.executeRecreateDeployment(ctx, req, job)
+	default:
+		return fmt.Errorf("unsupported deployment strategy: %s", req.Strategy)
+	}
+}
+
 func (do *DeploymentOrchestrator) executeBlueGreenDeployment(ctx context.Context, req *DeploymentRequest, job *DeploymentJob) error {
-	steps := []string{
-		"Creating green environment",
-		"Deploying application to green environment",
-		"Running health checks on green",
-		"Switching traffic to green environment",
-		"Monitoring for 5 minutes",
-		"Decommissioning blue environment",
+	if err := do.runStep(ctx, req, job, "create_environment", "Creating green environment", simulateStep(100*time.Millisecond)); err != nil {
+		return err
+	}
+	if err := do.runStep(ctx, req, job, "deploy", "Deploying application to green environment", simulateStep(100*time.Millisecond)); err != nil {
+		return err
 	}
 
-	for _, step := range steps {
-		job.Logs = append(job.Logs, fmt.Sprintf("✓ %s", step))
-		time.Sleep(100 * time.Millisecond) // Simulate work
+	// Green must be healthy before it receives traffic
+	if err := do.runHealthProbes(ctx, req, job, "green environment"); err != nil {
+		return err
 	}
 
-	return nil
+	if err := do.runStep(ctx, req, job, "switch_traffic", "Switching traffic to green environment", simulateStep(100*time.Millisecond)); err != nil {
+		return err
+	}
+
+	if err := do.runHealthProbes(ctx, req, job, "post-switch"); err != nil {
+		return err
+	}
+
+	return do.runStep(ctx, req, job, "decommission", "Decommissioning blue environment", simulateStep(100*time.Millisecond))
 }
 
 func (do *DeploymentOrchestrator) executeCanaryDeployment(ctx context.Context, req *DeploymentRequest, job *DeploymentJob) error {
-	steps := []string{
-		"Deploying canary version (10% traffic)",
-		"Monitoring canary metrics (error rate, latency)",
-		"Increasing traffic to 25%",
-		"Increasing traffic to 50%",
-		"Increasing traffic to 100%",
-		"Deployment complete",
+	if err := do.runStep(ctx, req, job, "deploy", "Deploying canary version", simulateStep(100*time.Millisecond)); err != nil {
+		return err
 	}
 
-	for _, step := range steps {
-		job.Logs = append(job.Logs, fmt.Sprintf("✓ %s", step))
-		time.Sleep(100 * time.Millisecond)
+	for _, traffic := range []int{10, 25, 50, 100} {
+		if err := do.runStep(ctx, req, job, "shift_traffic", fmt.Sprintf("Routing %d%% traffic to canary", traffic), simulateStep(100*time.Millisecond)); err != nil {
+			return err
+		}
+
+		if err := do.runHealthProbes(ctx, req, job, fmt.Sprintf("canary at %d%%", traffic)); err != nil {
+			return err
+		}
 	}
 
+	job.logf("✓ Deployment complete")
 	return nil
 }
 
 func (do *DeploymentOrchestrator) executeRollingDeployment(ctx context.Context, req *DeploymentRequest, job *DeploymentJob) error {
 	replicas := 5
 	for i := 1; i <= replicas; i++ {
-		job.Logs = append(job.Logs, fmt.Sprintf("✓ Updating replica %d/%d", i, replicas))
-		time.Sleep(100 * time.Millisecond)
+		if err := do.runStep(ctx, req, job, "update_replica", fmt.Sprintf("Updating replica %d/%d", i, replicas), simulateStep(100*time.Millisecond)); err != nil {
+			return err
+		}
+
+		if err := do.runHealthProbes(ctx, req, job, fmt.Sprintf("replica %d/%d", i, replicas)); err != nil {
+			return err
+		}
 	}
 
-	job.Logs = append(job.Logs, "✓ All replicas updated successfully")
+	job.logf("✓ All replicas updated successfully")
 	return nil
 }
 
 func (do *DeploymentOrchestrator) executeRecreateDeployment(ctx context.Context, req *DeploymentRequest, job *DeploymentJob) error {
-	steps := []string{
-		"Stopping old version",
-		"Waiting for graceful shutdown",
-		"Deploying new version",
-		"Starting new version",
-		"Health check passed",
+	steps := []struct{ key, description string }{
+		{"stop", "Stopping old version"},
+		{"stop", "Waiting for graceful shutdown"},
+		{"deploy", "Deploying new version"},
+		{"start", "Starting new version"},
 	}
 
 	for _, step := range steps {
-		job.Logs = append(job.Logs, fmt.Sprintf("✓ %s", step))
-		time.Sleep(100 * time.Millisecond)
+		if err := do.runStep(ctx, req, job, step.key, step.description, simulateStep(100*time.Millisecond)); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return do.runHealthProbes(ctx, req, job, "new version")
 }
 
 func (do *DeploymentOrchestrator) cacheDeployment(ctx context.Context, deploymentID string, response *DeploymentResponse) {
@@ -381,36 +649,59 @@ func (do *DeploymentOrchestrator) cacheDeployment(ctx context.Context, deploymen
 // Infrastructure Manager
 type InfrastructureManager struct {
 	claudeClient *ClaudeClient
+	budgets      *BudgetManager
+	engines      map[IaCEngineType]IaCEngine
 }
 
-func NewInfrastructureManager(claudeClient *ClaudeClient) *InfrastructureManager {
-	return &InfrastructureManager{
+func NewInfrastructureManager(claudeClient *ClaudeClient, budgets *BudgetManager) *InfrastructureManager {
+	im := &InfrastructureManager{
 		claudeClient: claudeClient,
+		budgets:      budgets,
+	}
+	im.engines = map[IaCEngineType]IaCEngine{
+		EngineTerraform:      &terraformEngine{im: im},
+		EnginePulumi:         &pulumiEngine{},
+		EngineCloudFormation: &cloudFormationEngine{},
 	}
+	return im
 }
 
 func (im *InfrastructureManager) ManageInfrastructure(ctx context.Context, req *InfrastructureRequest) (*InfrastructureResponse, error) {
 	start := time.Now()
 
 	response := &InfrastructureResponse{
-		RequestID:        req.RequestID,
-		Recommendations:  make([]string, 0),
+		RequestID:       req.RequestID,
+		Recommendations: make([]string, 0),
 	}
 
-	// Generate Terraform code using Claude if not provided
-	terraformCode := req.TerraformCode
-	if terraformCode == "" {
-		var err error
-		terraformCode, err = im.claudeClient.GenerateTerraformCode(ctx, req.Resources, req.CloudProvider)
-		if err != nil {
-			return nil, fmt.Errorf("failed to generate Terraform code: %w", err)
+	engineType := req.Engine
+	if engineType == "" {
+		engineType = EngineTerraform
+	}
+	engine, ok := im.engines[engineType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported IaC engine: %s", req.Engine)
+	}
+
+	if err := engine.Prepare(ctx, req); err != nil {
+		var tfErr *TerraformValidationError
+		if errors.As(err, &tfErr) {
+			response.Status = "validation_failed"
+			response.Validation = tfErr.Report
+			response.Duration = time.Since(start).Seconds()
+			return response, nil
 		}
+		return nil, err
 	}
+	response.Validation = req.validation
 
-	// Execute Terraform action
+	// Execute IaC action
 	switch req.Action {
 	case "plan":
-		planOutput := im.executeTerraformPlan(terraformCode, req.Variables)
+		planOutput, err := engine.Plan(ctx, req)
+		if err != nil {
+			return nil, err
+		}
 		response.PlanOutput = planOutput
 		response.Status = "plan_complete"
 
@@ -421,21 +712,83 @@ func (im *InfrastructureManager) ManageInfrastructure(ctx context.Context, req *
 		}
 
 	case "apply":
-		created, updated, deleted := im.executeTerraformApply(terraformCode, req.Variables)
-		response.ResourcesCreated = created
-		response.ResourcesUpdated = updated
-		response.ResourcesDeleted = deleted
+		// Enforce team/environment budgets against the plan's cost estimate before applying; the
+		// estimate is reserved against them until the apply succeeds or fails
+		var reservation *budgetReservation
+		if len(budgetScopes(req)) > 0 {
+			planOutput, err := engine.Plan(ctx, req)
+			if err != nil {
+				return nil, err
+			}
+			costEstimate, err := im.claudeClient.EstimateInfrastructureCost(ctx, planOutput, req.CloudProvider)
+			if err != nil {
+				return nil, fmt.Errorf("failed to estimate cost for budget check: %w", err)
+			}
+			response.CostEstimate = costEstimate
+
+			var violation *BudgetViolation
+			reservation, violation, err = im.budgets.Reserve(ctx, req, costEstimate)
+			if err != nil {
+				return nil, fmt.Errorf("failed to check budget: %w", err)
+			}
+			if violation != nil {
+				response.Status = "budget_exceeded"
+				response.BudgetViolation = violation
+				response.Duration = time.Since(start).Seconds()
+				return response, nil
+			}
+		}
+
+		changes, err := engine.Apply(ctx, req)
+		if err != nil {
+			im.budgets.Release(ctx, reservation)
+			return nil, err
+		}
+		response.ResourcesCreated = changes.Created
+		response.ResourcesUpdated = changes.Updated
+		response.ResourcesDeleted = changes.Deleted
 		response.Status = "applied"
 
 		// Update metrics
 		for _, resource := range req.Resources {
-			infrastructureChanges.WithLabelValues(resource.Type, "created").Add(float64(created))
+			infrastructureChanges.WithLabelValues(resource.Type, "created").Add(float64(changes.Created))
 		}
 
 	case "destroy":
-		deleted := im.executeTerraformDestroy(terraformCode, req.Variables)
-		response.ResourcesDeleted = deleted
+		changes, err := engine.Destroy(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		response.ResourcesDeleted = changes.Deleted
 		response.Status = "destroyed"
+
+	case "drift":
+		detector, ok := engine.(driftDetector)
+		if !ok {
+			return nil, fmt.Errorf("the %s engine does not support drift detection", engineType)
+		}
+		report, err := detector.DetectDrift(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		response.Drift = report
+		response.Status = "drift_detected"
+		if report.StackDriftStatus == "IN_SYNC" {
+			response.Status = "in_sync"
+		}
+
+	case "rollback":
+		rollbacker, ok := engine.(stackRollbacker)
+		if !ok {
+			return nil, fmt.Errorf("the %s engine does not support rollback", engineType)
+		}
+		if err := rollbacker.Rollback(ctx, req); err != nil {
+			return nil, err
+		}
+		response.Status = "rolled_back"
+
+	default:
+		return nil, fmt.Errorf("unsupported action: %s", req.Action)
 	}
 
 	// Get optimization recommendations from Claude
@@ -474,15 +827,95 @@ func (im *InfrastructureManager) executeTerraformDestroy(code string, variables
 
 // Claude AI Integration
 type ClaudeClient struct {
-	apiKey string
-	model  string
+	apiKey     string
+	model      string
+	httpClient *http.Client
 }
 
 func NewClaudeClient(apiKey, model string) *ClaudeClient {
 	return &ClaudeClient{
 		apiKey: apiKey,
 		model:  model,
+		httpClient: &http.Client{
+			Timeout: 120 * time.Second,
+		},
+	}
+}
+
+type claudeMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type claudeRequest struct {
+	Model     string          `json:"model"`
+	MaxTokens int             `json:"max_tokens"`
+	System    string          `json:"system,omitempty"`
+	Messages  []claudeMessage `json:"messages"`
+}
+
+type claudeResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+}
+
+// complete sends a single-turn prompt to the Claude Messages API and returns the text reply
+func (c *ClaudeClient) complete(ctx context.Context, system, prompt string, maxTokens int) (string, error) {
+	body, err := json.Marshal(claudeRequest{
+		Model:     c.model,
+		MaxTokens: maxTokens,
+		System:    system,
+		Messages:  []claudeMessage{{Role: "user", Content: prompt}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal claude request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", "https://api.anthropic.com/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create claude request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-API-Key", c.apiKey)
+	httpReq.Header.Set("anthropic-version", "2023-06-01")
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("failed to call claude api: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("claude api error (status %d): %s", resp.StatusCode, string(respBody))
+	}
+
+	var claudeResp claudeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&claudeResp); err != nil {
+		return "", fmt.Errorf("failed to decode claude response: %w", err)
+	}
+
+	var text strings.Builder
+	for _, block := range claudeResp.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+
+	return text.String(), nil
+}
+
+// extractJSON returns the outermost JSON object embedded in a model reply
+func extractJSON(text string) string {
+	start := strings.Index(text, "{")
+	end := strings.LastIndex(text, "}")
+	if start == -1 || end < start {
+		return ""
 	}
+	return text[start : end+1]
 }
 
 func (c *ClaudeClient) GenerateRollbackPlan(ctx context.Context, req *DeploymentRequest) (string, error) {
@@ -532,12 +965,26 @@ func (c *ClaudeClient) GetInfrastructureRecommendations(ctx context.Context, res
 type APIServer struct {
 	deploymentOrchestrator *DeploymentOrchestrator
 	infrastructureManager  *InfrastructureManager
+	runbookManager         *RunbookManager
+	budgetManager          *BudgetManager
+	pipelineRunner         *PipelineRunner
+	chatOps                *ChatOpsManager
+	deploymentQueue        *DeploymentQueue
+	rbac                   *RBACManager
+	inventoryManager       *InventoryManager
 }
 
-func NewAPIServer(do *DeploymentOrchestrator, im *InfrastructureManager) *APIServer {
+func NewAPIServer(do *DeploymentOrchestrator, dq *DeploymentQueue, im *InfrastructureManager, rm *RunbookManager, bm *BudgetManager, pr *PipelineRunner, co *ChatOpsManager, rbac *RBACManager, inv *InventoryManager) *APIServer {
 	return &APIServer{
 		deploymentOrchestrator: do,
+		deploymentQueue:        dq,
 		infrastructureManager:  im,
+		runbookManager:         rm,
+		budgetManager:          bm,
+		pipelineRunner:         pr,
+		chatOps:                co,
+		rbac:                   rbac,
+		inventoryManager:       inv,
 	}
 }
 
@@ -550,16 +997,30 @@ func (s *APIServer) deployHandler(c *gin.Context) {
 	}
 
 	if req.DeploymentID == "" {
-		req.DeploymentID = fmt.Sprintf("deploy_%d", time.Now().Unix())
+		req.DeploymentID = fmt.Sprintf("deploy_%d", time.Now().UnixNano())
+	}
+	if s.rbac.Enabled() || req.RequestedBy == "" {
+		req.RequestedBy = principal(c)
 	}
 
-	response, err := s.deploymentOrchestrator.ExecuteDeployment(c.Request.Context(), &req)
+	// With RBAC, deployAccess has already required admin for unlisted command probes; without it
+	// nobody is authenticated, so only allowlisted commands may run
+	if probe := unlistedCommandProbe(req.HealthProbes); probe != nil && !s.rbac.Enabled() {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("command probe %q is not in PROBE_COMMANDS_FILE; other commands need RBAC and the admin role", probe.Command)})
+		return
+	}
+
+	response, err := s.deploymentQueue.Enqueue(c.Request.Context(), &req)
+	if errors.Is(err, errDeploymentExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, response)
+	c.JSON(http.StatusAccepted, response)
 }
 
 func (s *APIServer) infrastructureHandler(c *gin.Context) {
@@ -571,16 +1032,65 @@ func (s *APIServer) infrastructureHandler(c *gin.Context) {
 	}
 
 	if req.RequestID == "" {
-		req.RequestID = fmt.Sprintf("infra_%d", time.Now().Unix())
+		req.RequestID = fmt.Sprintf("infra_%d", time.Now().UnixNano())
+	}
+	if s.rbac.Enabled() || req.RequestedBy == "" {
+		req.RequestedBy = principal(c)
+	}
+
+	// Supplied Terraform is checked now; generated Terraform can only be checked by the worker, and
+	// is refused up front when it couldn't be validated there
+	if req.Engine == "" || req.Engine == EngineTerraform {
+		if req.TerraformCode == "" {
+			if err := terraformAvailable(); err != nil {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		var validationErr *VariableValidationError
+		if req.TerraformCode != "" && errors.As(ValidateTerraformVariables(req.TerraformCode, req.Variables), &validationErr) {
+			c.JSON(http.StatusUnprocessableEntity, VariableValidationResponse{
+				Error:      validationErr.Error(),
+				Violations: validationErr.Violations,
+			})
+			return
+		}
+	}
+	// With RBAC, infrastructureAccess has already required admin for inline programs; without it
+	// nobody is authenticated, so only programs under PULUMI_WORK_ROOT may run
+	if inlinePulumiProgram(req.Engine, req.PulumiProgram) && !s.rbac.Enabled() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "inline pulumi_program.yaml needs RBAC and the admin role; use work_dir"})
+		return
+	}
+	if req.Engine == EnginePulumi && req.PulumiProgram != nil && req.PulumiProgram.WorkDir != "" {
+		if _, err := pulumiProgramDir(req.PulumiProgram.WorkDir); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 	}
 
-	response, err := s.infrastructureManager.ManageInfrastructure(c.Request.Context(), &req)
+	response, err := s.deploymentQueue.EnqueueInfrastructure(c.Request.Context(), &req)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, response)
+	c.JSON(http.StatusAccepted, response)
+}
+
+func (s *APIServer) getInfrastructureHandler(c *gin.Context) {
+	response, err := s.deploymentQueue.InfrastructureStatus(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if response == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "infrastructure request not found"})
+		return
+	}
+
+	c.JSON(response.statusCode(), response)
 }
 
 func (s *APIServer) healthCheckHandler(c *gin.Context) {
@@ -598,8 +1108,22 @@ func (s *APIServer) metricsHandler(c *gin.Context) {
 
 // Main application
 func main() {
+	// "devops-orchestrator openapi" prints the OpenAPI document used to generate ../client
+	if len(os.Args) > 1 && os.Args[1] == "openapi" {
+		spec, err := json.MarshalIndent(BuildOpenAPISpec((&APIServer{}).routes()), "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to build OpenAPI document: %v", err)
+		}
+		fmt.Println(string(spec))
+		return
+	}
+
 	log.Printf("Starting %s v%s", config.AppName, config.Version)
 
+	if err := loadProbeCommands(config.ProbeCommandsFile); err != nil {
+		log.Fatalf("Invalid PROBE_COMMANDS_FILE: %v", err)
+	}
+
 	// Initialize Redis
 	redisOpts, err := redis.ParseURL(config.RedisURL)
 	if err != nil {
@@ -618,11 +1142,23 @@ func main() {
 	claudeClient := NewClaudeClient(config.ClaudeAPIKey, config.ClaudeModel)
 
 	// Initialize services
-	deploymentOrchestrator := NewDeploymentOrchestrator(redisClient, claudeClient)
-	infrastructureManager := NewInfrastructureManager(claudeClient)
+	budgetManager := NewBudgetManager(redisClient)
+	infrastructureManager := NewInfrastructureManager(claudeClient, budgetManager)
+	deploymentOrchestrator := NewDeploymentOrchestrator(redisClient, claudeClient, infrastructureManager)
+	runbookManager := NewRunbookManager(redisClient, claudeClient)
+	pipelineRunner := NewPipelineRunner(redisClient)
+	deploymentQueue := NewDeploymentQueue(redisClient, deploymentOrchestrator, pipelineRunner, infrastructureManager)
+	rbacManager := NewRBACManager(redisClient, config.RBACAdminToken)
+	inventoryManager := NewInventoryManager(redisClient, claudeClient)
+	chatOps := NewChatOpsManager(redisClient, claudeClient, NewSlackClient(config.SlackBotToken, config.SlackSigningSecret), deploymentQueue, rbacManager)
+
+	// Start deployment workers
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	workers := deploymentQueue.Start(workerCtx, config.Workers)
+	deploymentOrchestrator.StartDORARefresh(workerCtx)
 
 	// Initialize API server
-	apiServer := NewAPIServer(deploymentOrchestrator, infrastructureManager)
+	apiServer := NewAPIServer(deploymentOrchestrator, deploymentQueue, infrastructureManager, runbookManager, budgetManager, pipelineRunner, chatOps, rbacManager, inventoryManager)
 
 	// Setup Gin router
 	router := gin.Default()
@@ -630,8 +1166,14 @@ func main() {
 	// Routes
 	router.GET("/health", apiServer.healthCheckHandler)
 	router.GET("/metrics", apiServer.metricsHandler)
-	router.POST("/api/v1/deploy", apiServer.deployHandler)
-	router.POST("/api/v1/infrastructure", apiServer.infrastructureHandler)
+	router.GET("/docs", apiServer.docsHandler)
+
+	// Slack posts form-encoded, signed bodies, so these are kept out of the JSON API spec
+	router.POST("/api/v1/slack/commands", apiServer.slackCommandHandler)
+	router.POST("/api/v1/slack/interactions", apiServer.slackInteractionHandler)
+	for _, route := range apiServer.routes() {
+		router.Handle(route.Method, route.Path, apiServer.authorize(route), route.Handler)
+	}
 	router.GET("/", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"service":       config.AppName,
@@ -650,8 +1192,10 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
-	// Graceful shutdown
+	// Graceful shutdown; main returns once workers and Redis are done
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		sigint := make(chan os.Signal, 1)
 		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
 		<-sigint
@@ -665,6 +1209,10 @@ func main() {
 			log.Printf("Server shutdown error: %v", err)
 		}
 
+		// Let in-flight work finish; unstarted work stays in the stream for other replicas
+		stopWorkers()
+		workers.Wait()
+
 		redisClient.Close()
 		log.Println("Server stopped")
 	}()
@@ -674,6 +1222,7 @@ func main() {
 	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Server failed to start: %v", err)
 	}
+	<-stopped
 }
 
 func getEnv(key, defaultValue string) string {
@@ -682,3 +1231,10 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API route table and OpenAPI document
+type apiRoute struct {
+	Method      string
+	Path        string // gin-style path, e.g. /api/v1/dr/runbooks/:app
+	OperationID string
+	Summary     string
+	Tag         string
+	Query       []queryParam
+	Request     interface{} // zero value of the JSON request body, nil if none
+	Response    interface{} // zero value of the JSON response body
+	Status      int
+	Errors      map[int]interface{} // structured error bodies beyond ErrorResponse, by status
+	Access      accessFunc          // RBAC rule enforced by APIServer.authorize; nil requires global admin
+	Handler     gin.HandlerFunc
+}
+
+type queryParam struct {
+	Name        string
+	Type        string // "string", "integer", "boolean"
+	Description string
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// routes is the single source of truth for the public API; main registers these handlers
+// and the OpenAPI document served at /docs is derived from the same table
+func (s *APIServer) routes() []apiRoute {
+	return []apiRoute{
+		{
+			Method: "POST", Path: "/api/v1/deploy", OperationID: "deploy", Tag: "deployments",
+			Summary: "Queue an application deployment (or dry run) for the worker pool",
+			Request: DeploymentRequest{}, Response: DeploymentResponse{}, Status: http.StatusAccepted,
+			Errors:  map[int]interface{}{http.StatusConflict: ErrorResponse{}},
+			Access:  deployAccess,
+			Handler: s.deployHandler,
+		},
+		{
+			Method: "GET", Path: "/api/v1/deploy/:id", OperationID: "getDeployment", Tag: "deployments",
+			Summary:  "Get a deployment's result, or its queued/in-progress status and logs",
+			Response: DeploymentResponse{}, Status: http.StatusOK,
+			Access:  s.requireForDeployment(RoleViewer),
+			Handler: s.getDeploymentHandler,
+		},
+		{
+			Method: "POST", Path: "/api/v1/deploy/:id/cancel", OperationID: "cancelDeployment", Tag: "deployments",
+			Summary:  "Cancel a queued or in-progress deployment",
+			Response: DeploymentResponse{}, Status: http.StatusAccepted,
+			Access:  s.requireForDeployment(RoleDeployer),
+			Handler: s.cancelDeploymentHandler,
+		},
+		{
+			Method: "GET", Path: "/api/v1/deploy/:id/postmortem", OperationID: "getPostmortem", Tag: "deployments",
+			Summary:  "Get the postmortem drafted for a failed deployment",
+			Response: Postmortem{}, Status: http.StatusOK,
+			Access:  s.requireForDeployment(RoleViewer),
+			Handler: s.getPostmortemHandler,
+		},
+		{
+			Method: "POST", Path: "/api/v1/deploy/:id/pause", OperationID: "pauseDeployment", Tag: "deployments",
+			Summary: "Pause an in-flight rollout at its next step boundary",
+			Request: DeploymentControlRequest{}, Response: DeploymentControlResponse{}, Status: http.StatusOK,
+			Access:  s.requireForDeployment(RoleDeployer),
+			Handler: s.deploymentControlHandler(true),
+		},
+		{
+			Method: "POST", Path: "/api/v1/deploy/:id/resume", OperationID: "resumeDeployment", Tag: "deployments",
+			Summary: "Resume a paused rollout",
+			Request: DeploymentControlRequest{}, Response: DeploymentControlResponse{}, Status: http.StatusOK,
+			Access:  s.requireForDeployment(RoleDeployer),
+			Handler: s.deploymentControlHandler(false),
+		},
+		{
+			Method: "GET", Path: "/api/v1/metrics/dora", OperationID: "getDORAMetrics", Tag: "deployments",
+			Summary: "Deployment frequency, lead time, change failure rate, and MTTR per application and environment",
+			Query: []queryParam{
+				{Name: "application", Type: "string", Description: "Only this application"},
+				{Name: "environment", Type: "string", Description: "Only this environment"},
+				{Name: "days", Type: "integer", Description: "Window in days, 1-90, default 30"},
+			},
+			Response: DORAMetricsResponse{}, Status: http.StatusOK,
+			Access:  requireGlobal(RoleViewer),
+			Handler: s.doraMetricsHandler,
+		},
+		{
+			Method: "POST", Path: "/api/v1/infrastructure", OperationID: "manageInfrastructure", Tag: "infrastructure",
+			Summary: "Queue a Terraform, Pulumi, or CloudFormation plan, apply, or destroy for the worker pool",
+			Request: InfrastructureRequest{}, Response: InfrastructureResponse{}, Status: http.StatusAccepted,
+			Errors: map[int]interface{}{
+				http.StatusUnprocessableEntity: VariableValidationResponse{},
+			},
+			Access:  infrastructureAccess,
+			Handler: s.infrastructureHandler,
+		},
+		{
+			Method: "GET", Path: "/api/v1/infrastructure/requests/:id", OperationID: "getInfrastructureRequest", Tag: "infrastructure",
+			Summary:  "Get an infrastructure request's outcome; 202 while it is queued or running",
+			Response: InfrastructureResponse{}, Status: http.StatusOK,
+			Errors: map[int]interface{}{
+				http.StatusForbidden:           InfrastructureResponse{},
+				http.StatusUnprocessableEntity: InfrastructureResponse{},
+				http.StatusInternalServerError: InfrastructureResponse{},
+				http.StatusServiceUnavailable:  InfrastructureResponse{},
+			},
+			Access:  requireGlobal(RoleViewer),
+			Handler: s.getInfrastructureHandler,
+		},
+		{
+			Method: "GET", Path: "/api/v1/infrastructure/inventory", OperationID: "getInventory", Tag: "infrastructure",
+			Summary: "List an account's cloud resources, marked managed/unmanaged against Terraform state, with orphans flagged",
+			Query: []queryParam{
+				{Name: "provider", Type: "string", Description: "aws, azure, or gcp"},
+				{Name: "account", Type: "string", Description: "AWS profile, Azure subscription, or GCP project (required for gcp)"},
+				{Name: "refresh", Type: "boolean", Description: "Bypass the one-hour inventory cache"},
+			},
+			Response: InventoryResponse{}, Status: http.StatusOK,
+			Access:  requireGlobal(RoleViewer),
+			Handler: s.inventoryHandler,
+		},
+		{
+			Method: "POST", Path: "/api/v1/pipelines", OperationID: "runPipeline", Tag: "pipelines",
+			Summary: "Queue a CI/CD pipeline run for the worker pool",
+			Request: PipelineRequest{}, Response: PipelineResponse{}, Status: http.StatusAccepted,
+			Access:  requireGlobal(RoleDeployer),
+			Handler: s.pipelineHandler,
+		},
+		{
+			Method: "GET", Path: "/api/v1/pipelines/:id", OperationID: "getPipeline", Tag: "pipelines",
+			Summary:  "Get a pipeline run's status and stage results",
+			Response: PipelineResponse{}, Status: http.StatusOK,
+			Access:  requireGlobal(RoleViewer),
+			Handler: s.getPipelineHandler,
+		},
+		{
+			Method: "PUT", Path: "/api/v1/budgets", OperationID: "setBudget", Tag: "budgets",
+			Summary: "Create or update a monthly team or environment budget",
+			Request: Budget{}, Response: Budget{}, Status: http.StatusOK,
+			Access:  requireGlobal(RoleAdmin),
+			Handler: s.setBudgetHandler,
+		},
+		{
+			Method: "GET", Path: "/api/v1/budgets/:scope/:name", OperationID: "getBudget", Tag: "budgets",
+			Summary:  "Get a budget and its spend for the current month",
+			Response: BudgetStatus{}, Status: http.StatusOK,
+			Access:  requireGlobal(RoleViewer),
+			Handler: s.getBudgetHandler,
+		},
+		{
+			Method: "POST", Path: "/api/v1/budgets/overrides/:id/approve", OperationID: "approveBudgetOverride", Tag: "budgets",
+			Summary: "Approve a budget override so a blocked apply can be resubmitted",
+			Request: BudgetOverrideApproval{}, Response: BudgetOverride{}, Status: http.StatusOK,
+			Access:  requireGlobal(RoleAdmin),
+			Handler: s.approveBudgetOverrideHandler,
+		},
+		{
+			Method: "PUT", Path: "/api/v1/rbac/bindings", OperationID: "setRoleBinding", Tag: "rbac",
+			Summary: "Grant a principal a role in an environment (or \"*\" for all)",
+			Request: RoleBinding{}, Response: RoleBinding{}, Status: http.StatusOK,
+			Access:  requireGlobal(RoleAdmin),
+			Handler: s.setRoleBindingHandler,
+		},
+		{
+			Method: "GET", Path: "/api/v1/rbac/bindings/:principal", OperationID: "getRoleBindings", Tag: "rbac",
+			Summary:  "List a principal's role bindings",
+			Response: RoleBindingsResponse{}, Status: http.StatusOK,
+			Access:  requireGlobal(RoleAdmin),
+			Handler: s.getRoleBindingsHandler,
+		},
+		{
+			Method: "DELETE", Path: "/api/v1/rbac/bindings/:principal/:environment", OperationID: "deleteRoleBinding", Tag: "rbac",
+			Summary:  "Revoke a principal's role binding in an environment",
+			Response: RoleBindingsResponse{}, Status: http.StatusOK,
+			Access:  requireGlobal(RoleAdmin),
+			Handler: s.deleteRoleBindingHandler,
+		},
+		{
+			Method: "POST", Path: "/api/v1/rbac/tokens", OperationID: "issueToken", Tag: "rbac",
+			Summary: "Issue an API token for a principal",
+			Request: APITokenRequest{}, Response: APITokenResponse{}, Status: http.StatusCreated,
+			Access:  requireGlobal(RoleAdmin),
+			Handler: s.issueTokenHandler,
+		},
+		{
+			Method: "GET", Path: "/api/v1/rbac/tokens/:principal", OperationID: "listTokens", Tag: "rbac",
+			Summary:  "List a principal's unexpired API tokens",
+			Response: APITokensResponse{}, Status: http.StatusOK,
+			Access:  requireGlobal(RoleAdmin),
+			Handler: s.getTokensHandler,
+		},
+		{
+			Method: "DELETE", Path: "/api/v1/rbac/tokens/:principal/:id", OperationID: "revokeToken", Tag: "rbac",
+			Summary:  "Revoke one of a principal's API tokens",
+			Response: APITokensResponse{}, Status: http.StatusOK,
+			Errors:  map[int]interface{}{http.StatusNotFound: ErrorResponse{}},
+			Access:  requireGlobal(RoleAdmin),
+			Handler: s.revokeTokenHandler,
+		},
+		{
+			Method: "GET", Path: "/api/v1/rbac/audit", OperationID: "getAuditLog", Tag: "rbac",
+			Summary:  "List recent audit records, newest first",
+			Query:    []queryParam{{Name: "limit", Type: "integer", Description: "Maximum records to return, default 100"}},
+			Response: AuditLogResponse{}, Status: http.StatusOK,
+			Access:  requireGlobal(RoleAdmin),
+			Handler: s.auditLogHandler,
+		},
+		{
+			Method: "POST", Path: "/api/v1/dr/runbooks", OperationID: "generateRunbook", Tag: "disaster-recovery",
+			Summary: "Start generating a new DR runbook version; poll the generation for the runbook",
+			Request: RunbookRequest{}, Response: RunbookGeneration{}, Status: http.StatusAccepted,
+			Access:  requireGlobal(RoleAdmin),
+			Handler: s.generateRunbookHandler,
+		},
+		{
+			Method: "GET", Path: "/api/v1/dr/generations/:id", OperationID: "getRunbookGeneration", Tag: "disaster-recovery",
+			Summary:  "Get a runbook generation's status, and the runbook once it completes",
+			Response: RunbookGeneration{}, Status: http.StatusOK,
+			Access:  requireGlobal(RoleViewer),
+			Handler: s.getRunbookGenerationHandler,
+		},
+		{
+			Method: "GET", Path: "/api/v1/dr/runbooks/:app", OperationID: "getRunbook", Tag: "disaster-recovery",
+			Summary:  "Get the latest or a specific DR runbook version",
+			Query:    []queryParam{{Name: "version", Type: "integer", Description: "Runbook version, latest when omitted"}},
+			Response: DRRunbook{}, Status: http.StatusOK,
+			Access:  requireGlobal(RoleViewer),
+			Handler: s.getRunbookHandler,
+		},
+		{
+			Method: "GET", Path: "/api/v1/dr/runbooks/:app/versions", OperationID: "listRunbookVersions", Tag: "disaster-recovery",
+			Summary:  "List stored DR runbook versions",
+			Response: RunbookVersionsResponse{}, Status: http.StatusOK,
+			Access:  requireGlobal(RoleViewer),
+			Handler: s.listRunbookVersionsHandler,
+		},
+		{
+			Method: "POST", Path: "/api/v1/dr/runbooks/:app/execute", OperationID: "executeRunbook", Tag: "disaster-recovery",
+			Summary: "Start executing a DR runbook",
+			Request: RunbookExecutionRequest{}, Response: RunbookExecution{}, Status: http.StatusAccepted,
+			Access:  requireGlobal(RoleAdmin),
+			Handler: s.executeRunbookHandler,
+		},
+		{
+			Method: "GET", Path: "/api/v1/dr/executions/:id", OperationID: "getRunbookExecution", Tag: "disaster-recovery",
+			Summary:  "Get DR runbook execution status",
+			Response: RunbookExecution{}, Status: http.StatusOK,
+			Access:  requireGlobal(RoleViewer),
+			Handler: s.getRunbookExecutionHandler,
+		},
+		{
+			Method: "POST", Path: "/api/v1/dr/executions/:id/confirm", OperationID: "confirmRunbookStep", Tag: "disaster-recovery",
+			Summary: "Confirm the runbook step awaiting operator approval",
+			Request: RunbookDecisionRequest{}, Response: RunbookDecisionResponse{}, Status: http.StatusOK,
+			Errors:  map[int]interface{}{http.StatusConflict: ErrorResponse{}},
+			Access:  requireGlobal(RoleAdmin),
+			Handler: s.decideRunbookStepHandler(true),
+		},
+		{
+			Method: "POST", Path: "/api/v1/dr/executions/:id/abort", OperationID: "abortRunbookExecution", Tag: "disaster-recovery",
+			Summary: "Abort a runbook execution at its confirmation checkpoint",
+			Request: RunbookDecisionRequest{}, Response: RunbookDecisionResponse{}, Status: http.StatusOK,
+			Errors:  map[int]interface{}{http.StatusConflict: ErrorResponse{}},
+			Access:  requireGlobal(RoleAdmin),
+			Handler: s.decideRunbookStepHandler(false),
+		},
+	}
+}
+
+// enumValues lists the allowed values of string enum types exposed by the API
+var enumValues = map[reflect.Type][]string{
+	reflect.TypeOf(CloudProvider("")):      {string(AWS), string(Azure), string(GCP), string(OnPrem)},
+	reflect.TypeOf(Environment("")):        {string(Production), string(Staging), string(Development)},
+	reflect.TypeOf(DeploymentStrategy("")): {string(BlueGreen), string(Canary), string(RollingUpdate), string(Recreate)},
+	reflect.TypeOf(BudgetScope("")):        {string(ScopeTeam), string(ScopeEnvironment)},
+	reflect.TypeOf(ProbeType("")):          {string(ProbeHTTP), string(ProbeTCP), string(ProbeCommand)},
+	reflect.TypeOf(ErrorClass("")):         {string(ErrorImagePull), string(ErrorThrottling), string(ErrorTimeout), string(ErrorNetwork), string(ErrorPermanent)},
+	reflect.TypeOf(StageType("")):          {string(StageCommand), string(StageIntegrationTest), string(StageDeploy)},
+	reflect.TypeOf(IaCEngineType("")):      {string(EngineTerraform), string(EnginePulumi), string(EngineCloudFormation)},
+	reflect.TypeOf(Role("")):               {string(RoleViewer), string(RoleDeployer), string(RoleAdmin)},
+	reflect.TypeOf(RunbookStepType("")):    {string(StepFailover), string(StepDNSChange), string(StepDataRestore), string(StepVerification), string(StepCommunication)},
+}
+
+var ginPathParam = regexp.MustCompile(`:([A-Za-z_]+)`)
+
+// BuildOpenAPISpec derives an OpenAPI 3 document from the route table and its request/response structs
+func BuildOpenAPISpec(routes []apiRoute) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]map[string]interface{}{}
+
+	schemaRef(reflect.TypeOf(ErrorResponse{}), schemas)
+
+	for _, route := range routes {
+		path := ginPathParam.ReplaceAllString(route.Path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+
+		parameters := make([]interface{}, 0)
+		for _, match := range ginPathParam.FindAllStringSubmatch(route.Path, -1) {
+			parameters = append(parameters, map[string]interface{}{
+				"name": match[1], "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, q := range route.Query {
+			parameters = append(parameters, map[string]interface{}{
+				"name": q.Name, "in": "query", "required": false, "description": q.Description,
+				"schema": map[string]interface{}{"type": q.Type},
+			})
+		}
+
+		operation := map[string]interface{}{
+			"operationId": route.OperationID,
+			"summary":     route.Summary,
+			"tags":        []string{route.Tag},
+			"responses": map[string]interface{}{
+				statusKey(route.Status): map[string]interface{}{
+					"description": http.StatusText(route.Status),
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": schemaRef(reflect.TypeOf(route.Response), schemas)},
+					},
+				},
+				"default": map[string]interface{}{
+					"description": "Error",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/ErrorResponse"}},
+					},
+				},
+			},
+		}
+		responses := operation["responses"].(map[string]interface{})
+		for status, body := range route.Errors {
+			responses[statusKey(status)] = map[string]interface{}{
+				"description": http.StatusText(status),
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemaRef(reflect.TypeOf(body), schemas)},
+				},
+			}
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if route.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemaRef(reflect.TypeOf(route.Request), schemas)},
+				},
+			}
+		}
+
+		paths[path][strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "DevOps Orchestrator API",
+			"version":     config.Version,
+			"description": "Deployment orchestration, infrastructure automation, and disaster recovery",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": "http://localhost:" + config.Port}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		// Enforced only when RBAC_ADMIN_TOKEN is configured
+		"security": []interface{}{map[string]interface{}{"bearerAuth": []string{}}},
+	}
+}
+
+func statusKey(status int) string {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return strconv.Itoa(status)
+}
+
+// schemaRef returns an inline schema or a $ref, registering named struct and enum types in schemas
+func schemaRef(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t == nil {
+		return map[string]interface{}{"type": "object"}
+	}
+
+	nullable := false
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		nullable = true
+	}
+
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	if values, ok := enumValues[t]; ok {
+		if _, exists := schemas[t.Name()]; !exists {
+			schemas[t.Name()] = map[string]interface{}{"type": "string", "enum": values}
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+
+	// A pointer to a scalar distinguishes an explicit zero from an omitted field
+	scalar := func(typ string) map[string]interface{} {
+		if nullable {
+			return map[string]interface{}{"type": typ, "nullable": true}
+		}
+		return map[string]interface{}{"type": typ}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return scalar("string")
+	case reflect.Bool:
+		return scalar("boolean")
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return scalar("integer")
+	case reflect.Float32, reflect.Float64:
+		return scalar("number")
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaRef(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaRef(t.Elem(), schemas)}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		if _, exists := schemas[t.Name()]; !exists {
+			schemas[t.Name()] = map[string]interface{}{} // placeholder guards recursive types
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if nullable {
+			return map[string]interface{}{"allOf": []interface{}{ref}, "nullable": true}
+		}
+		return ref
+	}
+
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := make([]string, 0)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = schemaRef(field.Type, schemas)
+		if strings.Contains(field.Tag.Get("binding"), "required") {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (s *APIServer) docsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, BuildOpenAPISpec(s.routes()))
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// Pause and resume for in-flight rollouts
+type DeploymentControlRequest struct {
+	User   string `json:"user"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type DeploymentControlResponse struct {
+	DeploymentID  string  `json:"deployment_id"`
+	Status        string  `json:"status"`
+	PausedSeconds float64 `json:"paused_seconds"`
+}
+
+const (
+	pausePollInterval = 2 * time.Second
+	pauseStateTTL     = 24 * time.Hour
+)
+
+// Pause state lives in a Redis hash per deployment (paused_at, paused_by, reason, total_ms of
+// earlier pauses, finished), so any replica can pause or resume whichever worker runs the rollout.
+// pauseScript refuses finished or already paused deployments; ARGV is now (ms), user, reason, TTL.
+var pauseScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], 'finished') == 1 then
+  return 'deployment is no longer in progress'
+end
+if redis.call('HEXISTS', KEYS[1], 'paused_at') == 1 then
+  return 'deployment is already paused'
+end
+redis.call('HSET', KEYS[1], 'paused_at', ARGV[1], 'paused_by', ARGV[2], 'reason', ARGV[3])
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+return ''
+`)
+
+// resumeScript adds the pause to total_ms and clears it; ARGV is now (ms)
+var resumeScript = redis.NewScript(`
+local pausedAt = redis.call('HGET', KEYS[1], 'paused_at')
+if not pausedAt then
+  return 'deployment is not paused'
+end
+redis.call('HINCRBY', KEYS[1], 'total_ms', tonumber(ARGV[1]) - tonumber(pausedAt))
+redis.call('HDEL', KEYS[1], 'paused_at', 'paused_by', 'reason')
+return ''
+`)
+
+// controlConflict is a pause, resume, or runbook decision the current state doesn't allow
+type controlConflict string
+
+func (c controlConflict) Error() string {
+	return string(c)
+}
+
+type pauseState struct {
+	paused   bool
+	pausedAt time.Time
+	pausedBy string
+	reason   string
+	total    time.Duration // including the current pause
+}
+
+// pauseGate is shared by a deployment's job and its per-region jobs; executors poll it between
+// steps and block while the deployment is paused
+type pauseGate struct {
+	redis *redis.Client
+	key   string
+}
+
+func newPauseGate(redisClient *redis.Client, deploymentID string) *pauseGate {
+	return &pauseGate{redis: redisClient, key: pauseKey(deploymentID)}
+}
+
+// finish stops accepting pauses once the rollout has completed
+func (g *pauseGate) finish(ctx context.Context) {
+	if err := g.redis.HSet(ctx, g.key, "finished", "1").Err(); err != nil {
+		log.Printf("Failed to mark pause state finished: %v", err)
+	}
+	g.redis.Expire(ctx, g.key, pauseStateTTL)
+}
+
+func (g *pauseGate) state(ctx context.Context) (*pauseState, error) {
+	return loadPauseState(ctx, g.redis, g.key)
+}
+
+// wait blocks while the deployment is paused; it returns an error when the pause outlasts
+// timeout so the deployment is aborted rather than left half-rolled-out indefinitely. A Redis
+// error is logged and lets the step run, as a paused deployment can't be told from one whose
+// pause state is unreadable.
+func (g *pauseGate) wait(ctx context.Context, job *DeploymentJob, timeout time.Duration) error {
+	if g == nil {
+		return nil
+	}
+
+	logged := false
+	for {
+		state, err := g.state(ctx)
+		if err != nil {
+			job.logf("⚠ %v", err)
+			return nil
+		}
+		if !state.paused {
+			if logged {
+				job.logf("▶ Resumed")
+			}
+			return nil
+		}
+
+		deadline := state.pausedAt.Add(timeout)
+		if !logged {
+			job.logf("⏸ Paused by %s: %s (auto-abort at %s)", state.pausedBy, state.reason, deadline.Format(time.RFC3339))
+			logged = true
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("deployment paused for longer than %s, auto-aborted", timeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pausePollInterval):
+		}
+	}
+}
+
+func loadPauseState(ctx context.Context, redisClient *redis.Client, key string) (*pauseState, error) {
+	fields, err := redisClient.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pause state: %w", err)
+	}
+
+	state := &pauseState{pausedBy: fields["paused_by"], reason: fields["reason"]}
+	totalMs, _ := strconv.ParseInt(fields["total_ms"], 10, 64)
+	state.total = time.Duration(totalMs) * time.Millisecond
+	if pausedAt, err := strconv.ParseInt(fields["paused_at"], 10, 64); err == nil {
+		state.paused = true
+		state.pausedAt = time.UnixMilli(pausedAt)
+		state.total += time.Since(state.pausedAt)
+	}
+	return state, nil
+}
+
+func pauseKey(deploymentID string) string {
+	return fmt.Sprintf("deployment_pause:%s", deploymentID)
+}
+
+func (req *DeploymentRequest) pauseTimeout() time.Duration {
+	if req.PauseTimeoutSeconds > 0 {
+		return time.Duration(req.PauseTimeoutSeconds) * time.Second
+	}
+	return config.PauseTimeout
+}
+
+// Pause halts an in-flight deployment at its next step boundary, on whichever worker runs it.
+// It returns nil if the deployment is unknown.
+func (q *DeploymentQueue) Pause(ctx context.Context, deploymentID, user, reason string) (*DeploymentControlResponse, error) {
+	return q.control(ctx, deploymentID, pauseScript, user, reason, int(pauseStateTTL.Seconds()))
+}
+
+func (q *DeploymentQueue) Resume(ctx context.Context, deploymentID string) (*DeploymentControlResponse, error) {
+	return q.control(ctx, deploymentID, resumeScript)
+}
+
+func (q *DeploymentQueue) control(ctx context.Context, deploymentID string, script *redis.Script, args ...interface{}) (*DeploymentControlResponse, error) {
+	status, err := q.Status(ctx, deploymentID)
+	if err != nil || status == nil {
+		return nil, err
+	}
+	if status.Status != "queued" && status.Status != "in_progress" {
+		return nil, controlConflict("deployment is no longer in progress")
+	}
+
+	key := pauseKey(deploymentID)
+	args = append([]interface{}{time.Now().UnixMilli()}, args...)
+	refusal, err := script.Run(ctx, q.redis, []string{key}, args...).Text()
+	if err != nil {
+		return nil, fmt.Errorf("failed to update pause state: %w", err)
+	}
+	if refusal != "" {
+		return nil, controlConflict(refusal)
+	}
+
+	state, err := loadPauseState(ctx, q.redis, key)
+	if err != nil {
+		return nil, err
+	}
+	response := &DeploymentControlResponse{
+		DeploymentID:  deploymentID,
+		Status:        status.Status,
+		PausedSeconds: state.total.Seconds(),
+	}
+	if state.paused {
+		response.Status = "paused"
+	}
+	return response, nil
+}
+
+func (do *DeploymentOrchestrator) activeJob(deploymentID string) *DeploymentJob {
+	do.mu.RLock()
+	defer do.mu.RUnlock()
+	return do.activeJobs[deploymentID]
+}
+
+// JobLogs returns a snapshot of a deployment job's logs, or nil if the job is unknown
+func (do *DeploymentOrchestrator) JobLogs(deploymentID string) []string {
+	job := do.activeJob(deploymentID)
+	if job == nil {
+		return nil
+	}
+	return job.logs()
+}
+
+// HTTP Handlers
+func (s *APIServer) deploymentControlHandler(pause bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body DeploymentControlRequest
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&body); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		if s.rbac.Enabled() {
+			body.User = principal(c)
+		}
+
+		var response *DeploymentControlResponse
+		var err error
+		if pause {
+			response, err = s.deploymentQueue.Pause(c.Request.Context(), c.Param("id"), body.User, body.Reason)
+		} else {
+			response, err = s.deploymentQueue.Resume(c.Request.Context(), c.Param("id"))
+		}
+		var conflict controlConflict
+		if errors.As(err, &conflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if response == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "deployment not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, response)
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// CI/CD pipeline execution
+type StageType string
+
+const (
+	StageCommand         StageType = "command"
+	StageIntegrationTest StageType = "integration_test"
+	StageDeploy          StageType = "deploy"
+)
+
+// IntegrationTestConfig describes the ephemeral dependencies and test results of an integration_test stage
+type IntegrationTestConfig struct {
+	ComposeFile string          `json:"compose_file,omitempty"`  // docker-compose file, relative to the workspace
+	Containers  []TestContainer `json:"containers,omitempty"`    // testcontainers-style single containers
+	JUnitReport string          `json:"junit_report"`            // JUnit XML written by the test commands
+	MinPassRate float64         `json:"min_pass_rate,omitempty"` // 0-1, default 1 (all tests pass)
+}
+
+// TestContainer is started with a random host port; tests find it via NAME_HOST and NAME_PORT
+type TestContainer struct {
+	Name  string            `json:"name"`
+	Image string            `json:"image"`
+	Port  int               `json:"port"` // container port to expose and wait on
+	Env   map[string]string `json:"env,omitempty"`
+}
+
+type TestResults struct {
+	Total       int          `json:"total"`
+	Passed      int          `json:"passed"`
+	Failed      int          `json:"failed"`
+	Errors      int          `json:"errors"`
+	Skipped     int          `json:"skipped"`
+	PassRate    float64      `json:"pass_rate"`
+	FailedTests []FailedTest `json:"failed_tests,omitempty"`
+}
+
+type FailedTest struct {
+	Suite   string `json:"suite"`
+	Name    string `json:"name"`
+	Message string `json:"message,omitempty"`
+}
+
+type PipelineRunner struct {
+	redis *redis.Client
+}
+
+func NewPipelineRunner(redisClient *redis.Client) *PipelineRunner {
+	return &PipelineRunner{
+		redis: redisClient,
+	}
+}
+
+// ExecutePipeline runs stages in order. A failed stage skips the rest; deploy stages are
+// additionally gated on every earlier integration_test stage meeting its pass rate.
+func (pr *PipelineRunner) ExecutePipeline(ctx context.Context, req *PipelineRequest) (*PipelineResponse, error) {
+	start := time.Now()
+	pipelineExecutions.Inc()
+
+	response := &PipelineResponse{
+		PipelineID:   req.PipelineID,
+		Status:       "success",
+		StageResults: make([]StageResult, 0, len(req.Stages)),
+		Artifacts:    make([]string, 0),
+	}
+
+	workspace, err := pr.prepareWorkspace(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workspace)
+
+	env := pipelineEnv()
+	for key, value := range req.Secrets {
+		env = append(env, key+"="+value)
+	}
+
+	var failure string
+	for _, stage := range req.Stages {
+		if failure != "" {
+			output := "skipped: " + failure
+			if stage.Type == StageDeploy {
+				output = "gated: " + failure
+			}
+			response.StageResults = append(response.StageResults, StageResult{
+				Name: stage.Name, Type: stage.stageType(), Status: "skipped", Output: output,
+			})
+			continue
+		}
+
+		result := pr.runStage(ctx, req, stage, workspace, env)
+		response.StageResults = append(response.StageResults, result)
+		if result.Status == "failed" {
+			failure = fmt.Sprintf("stage %q failed", stage.Name)
+			if result.TestResults != nil {
+				failure = fmt.Sprintf("integration tests in %q passed %.0f%% (minimum %.0f%%)",
+					stage.Name, result.TestResults.PassRate*100, stage.minPassRate()*100)
+			}
+			response.Status = "failed"
+		}
+	}
+
+	response.Duration = time.Since(start).Seconds()
+	pr.cachePipeline(ctx, response)
+
+	return response, nil
+}
+
+// pipelineEnv is the environment stage commands start from: PATH, HOME, TMPDIR, and the variables
+// named in PIPELINE_ENV. The orchestrator's own credentials are never passed on, since stage output
+// is readable by any viewer.
+func pipelineEnv() []string {
+	names := append([]string{"PATH", "HOME", "TMPDIR"}, strings.Split(config.PipelineEnv, ",")...)
+	env := make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if value, ok := os.LookupEnv(name); ok && name != "" {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// validRepository refuses repository values git would read as an option or run through a
+// remote helper
+func validRepository(repository string) error {
+	if strings.HasPrefix(repository, "-") || strings.HasPrefix(strings.ToLower(repository), "ext::") {
+		return fmt.Errorf("repository %q is not a git URL or path", repository)
+	}
+	return nil
+}
+
+func (pr *PipelineRunner) prepareWorkspace(ctx context.Context, req *PipelineRequest) (string, error) {
+	if err := validRepository(req.Repository); err != nil {
+		return "", err
+	}
+	workspace, err := os.MkdirTemp("", "pipeline-"+req.PipelineID+"-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create workspace: %w", err)
+	}
+	if req.Repository == "" {
+		return workspace, nil
+	}
+
+	args := []string{"clone", "--depth", "1"}
+	if req.Branch != "" {
+		args = append(args, "--branch", req.Branch)
+	}
+	args = append(args, "--", req.Repository, workspace)
+	if output, err := exec.CommandContext(ctx, "git", args...).CombinedOutput(); err != nil {
+		os.RemoveAll(workspace)
+		return "", fmt.Errorf("failed to clone %s: %v: %s", req.Repository, err, strings.TrimSpace(string(output)))
+	}
+	return workspace, nil
+}
+
+func (pr *PipelineRunner) runStage(ctx context.Context, req *PipelineRequest, stage PipelineStage, workspace string, env []string) StageResult {
+	start := time.Now()
+	result := StageResult{Name: stage.Name, Type: stage.stageType()}
+
+	timeout := time.Duration(stage.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	var err error
+	if stage.Type == StageIntegrationTest {
+		result.TestResults, err = pr.runIntegrationTest(ctx, req, stage, workspace, env, &output)
+	} else {
+		err = runCommands(ctx, stage.Commands, workspace, env, &output)
+	}
+
+	result.Status = "success"
+	if err != nil {
+		result.Status = "failed"
+		fmt.Fprintf(&output, "\n%v\n", err)
+	}
+	result.Output = output.String()
+	result.Duration = time.Since(start).Seconds()
+	return result
+}
+
+// runIntegrationTest starts the stage's dependencies, runs its tests, and always tears the
+// dependencies down. Test command failures alone do not fail the stage; the pass rate does.
+func (pr *PipelineRunner) runIntegrationTest(ctx context.Context, req *PipelineRequest, stage PipelineStage, workspace string, env []string, output *bytes.Buffer) (*TestResults, error) {
+	cfg := stage.IntegrationTest
+	if cfg == nil || cfg.JUnitReport == "" {
+		return nil, fmt.Errorf("integration_test stage requires integration_test.junit_report")
+	}
+
+	project := sanitizeProjectName(fmt.Sprintf("%s-%s", req.PipelineID, stage.Name))
+	teardownCtx, cancelTeardown := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancelTeardown()
+
+	if cfg.ComposeFile != "" {
+		composeFile, err := workspacePath(workspace, cfg.ComposeFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compose_file: %w", err)
+		}
+		fmt.Fprintf(output, "$ docker compose up (%s)\n", cfg.ComposeFile)
+		if err := runDocker(ctx, workspace, output, "compose", "-p", project, "-f", composeFile, "up", "-d", "--wait"); err != nil {
+			return nil, fmt.Errorf("failed to start compose dependencies: %w", err)
+		}
+		defer runDocker(teardownCtx, workspace, output, "compose", "-p", project, "-f", composeFile, "down", "-v", "--remove-orphans")
+	}
+
+	for _, container := range cfg.Containers {
+		name := project + "-" + container.Name
+		hostPort, err := startTestContainer(ctx, workspace, name, container, output)
+		if err != nil {
+			return nil, err
+		}
+		defer runDocker(teardownCtx, workspace, output, "rm", "-f", "-v", name)
+
+		prefix := strings.ToUpper(strings.ReplaceAll(container.Name, "-", "_"))
+		env = append(env, prefix+"_HOST=127.0.0.1", fmt.Sprintf("%s_PORT=%s", prefix, hostPort))
+	}
+
+	if err := runCommands(ctx, stage.Commands, workspace, env, output); err != nil {
+		fmt.Fprintf(output, "test commands exited with error: %v\n", err)
+	}
+
+	reportPath, err := workspacePath(workspace, cfg.JUnitReport)
+	if err != nil {
+		return nil, fmt.Errorf("invalid junit_report: %w", err)
+	}
+	report, err := os.ReadFile(reportPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JUnit report: %w", err)
+	}
+	results, err := parseJUnitReport(report)
+	if err != nil {
+		return nil, err
+	}
+
+	if results.PassRate < stage.minPassRate() {
+		return results, fmt.Errorf("pass rate %.1f%% below minimum %.1f%%", results.PassRate*100, stage.minPassRate()*100)
+	}
+	return results, nil
+}
+
+// workspacePath resolves a path from the request inside the workspace. Symlinks are followed first,
+// so a file committed to the repository can't point the orchestrator at anything outside it.
+func workspacePath(workspace, path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return "", fmt.Errorf("%s must be relative to the workspace", path)
+	}
+	root, err := filepath.EvalSymlinks(workspace)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, path))
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the workspace", path)
+	}
+	return resolved, nil
+}
+
+func startTestContainer(ctx context.Context, workspace, name string, container TestContainer, output *bytes.Buffer) (string, error) {
+	args := []string{"run", "-d", "--name", name, "-p", fmt.Sprintf("127.0.0.1::%d", container.Port)}
+	for key, value := range container.Env {
+		args = append(args, "-e", key+"="+value)
+	}
+	args = append(args, container.Image)
+
+	fmt.Fprintf(output, "$ docker run %s (%s)\n", container.Image, name)
+	if err := runDocker(ctx, workspace, output, args...); err != nil {
+		return "", fmt.Errorf("failed to start container %s: %w", container.Name, err)
+	}
+
+	portOutput, err := exec.CommandContext(ctx, config.DockerBin, "port", name, fmt.Sprint(container.Port)).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve port for %s: %w", container.Name, err)
+	}
+	mapping := strings.TrimSpace(strings.Split(string(portOutput), "\n")[0])
+	hostPort := mapping[strings.LastIndex(mapping, ":")+1:]
+
+	if hostPort == "" {
+		return "", fmt.Errorf("container %s published no host port for %d; it probably exited", container.Name, container.Port)
+	}
+
+	// Wait until the dependency accepts connections
+	for {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:"+hostPort, time.Second)
+		if err == nil {
+			conn.Close()
+			return hostPort, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("container %s never accepted connections on port %d", container.Name, container.Port)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+func runDocker(ctx context.Context, workspace string, output *bytes.Buffer, args ...string) error {
+	cmd := exec.CommandContext(ctx, config.DockerBin, args...)
+	cmd.Dir = workspace
+	cmd.Stdout = output
+	cmd.Stderr = output
+	return cmd.Run()
+}
+
+func runCommands(ctx context.Context, commands []string, workspace string, env []string, output *bytes.Buffer) error {
+	for _, command := range commands {
+		fmt.Fprintf(output, "$ %s\n", command)
+		cmd := exec.CommandContext(ctx, config.RunbookShell, "-c", command)
+		cmd.Dir = workspace
+		cmd.Env = env
+		cmd.Stdout = output
+		cmd.Stderr = output
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("command %q failed: %w", command, err)
+		}
+	}
+	return nil
+}
+
+// JUnit XML, either a <testsuites> root or a single <testsuite>
+type junitTestSuites struct {
+	Suites []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name   string           `xml:"name,attr"`
+	Cases  []junitTestCase  `xml:"testcase"`
+	Suites []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestCase struct {
+	Name    string        `xml:"name,attr"`
+	Failure *junitMessage `xml:"failure"`
+	Error   *junitMessage `xml:"error"`
+	Skipped *junitMessage `xml:"skipped"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+func parseJUnitReport(data []byte) (*TestResults, error) {
+	var root struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("failed to parse JUnit report: %w", err)
+	}
+
+	var suites []junitTestSuite
+	if root.XMLName.Local == "testsuite" {
+		var suite junitTestSuite
+		if err := xml.Unmarshal(data, &suite); err != nil {
+			return nil, fmt.Errorf("failed to parse JUnit report: %w", err)
+		}
+		suites = []junitTestSuite{suite}
+	} else {
+		var all junitTestSuites
+		if err := xml.Unmarshal(data, &all); err != nil {
+			return nil, fmt.Errorf("failed to parse JUnit report: %w", err)
+		}
+		suites = all.Suites
+	}
+
+	results := &TestResults{}
+	var walk func(suites []junitTestSuite)
+	walk = func(suites []junitTestSuite) {
+		for _, suite := range suites {
+			for _, tc := range suite.Cases {
+				results.Total++
+				switch {
+				case tc.Failure != nil:
+					results.Failed++
+					results.FailedTests = append(results.FailedTests, FailedTest{Suite: suite.Name, Name: tc.Name, Message: tc.Failure.Message})
+				case tc.Error != nil:
+					results.Errors++
+					results.FailedTests = append(results.FailedTests, FailedTest{Suite: suite.Name, Name: tc.Name, Message: tc.Error.Message})
+				case tc.Skipped != nil:
+					results.Skipped++
+				default:
+					results.Passed++
+				}
+			}
+			walk(suite.Suites)
+		}
+	}
+	walk(suites)
+
+	if executed := results.Total - results.Skipped; executed > 0 {
+		results.PassRate = float64(results.Passed) / float64(executed)
+	}
+	return results, nil
+}
+
+// finished reports whether the run has a final result; queued and running runs don't
+func (response *PipelineResponse) finished() bool {
+	return response.Status != "queued" && response.Status != "running"
+}
+
+func (stage PipelineStage) stageType() StageType {
+	if stage.Type == "" {
+		return StageCommand
+	}
+	return stage.Type
+}
+
+func (stage PipelineStage) minPassRate() float64 {
+	if stage.IntegrationTest == nil || stage.IntegrationTest.MinPassRate <= 0 {
+		return 1
+	}
+	return stage.IntegrationTest.MinPassRate
+}
+
+func sanitizeProjectName(name string) string {
+	name = strings.ToLower(name)
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, name)
+}
+
+func (pr *PipelineRunner) cachePipeline(ctx context.Context, response *PipelineResponse) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Failed to marshal pipeline response: %v", err)
+		return
+	}
+
+	if err := pr.redis.Set(ctx, fmt.Sprintf("pipeline:%s", response.PipelineID), data, 7*24*time.Hour).Err(); err != nil {
+		log.Printf("Failed to cache pipeline: %v", err)
+	}
+}
+
+func (pr *PipelineRunner) GetPipeline(ctx context.Context, pipelineID string) (*PipelineResponse, error) {
+	data, err := pr.redis.Get(ctx, fmt.Sprintf("pipeline:%s", pipelineID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pipeline: %w", err)
+	}
+
+	var response PipelineResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pipeline: %w", err)
+	}
+	return &response, nil
+}
+
+// HTTP Handlers
+func (s *APIServer) pipelineHandler(c *gin.Context) {
+	var req PipelineRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.PipelineID == "" {
+		req.PipelineID = fmt.Sprintf("pipeline_%d", time.Now().UnixNano())
+	}
+	if err := validRepository(req.Repository); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response, err := s.deploymentQueue.EnqueuePipeline(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, response)
+}
+
+func (s *APIServer) getPipelineHandler(c *gin.Context) {
+	response, err := s.pipelineRunner.GetPipeline(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if response == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pipeline not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
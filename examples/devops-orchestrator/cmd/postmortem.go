@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// Deployment history and failure postmortems
+const deploymentHistoryLimit = 20
+
+type DeploymentHistoryEntry struct {
+	DeploymentID string             `json:"deployment_id"`
+	Version      string             `json:"version"`
+	Strategy     DeploymentStrategy `json:"strategy"`
+	RequestedBy  string             `json:"requested_by,omitempty"`
+	Status       string             `json:"status"`
+	Message      string             `json:"message,omitempty"`
+	Timestamp    time.Time          `json:"timestamp"`
+}
+
+type PostmortemEvent struct {
+	Time  string `json:"time"`
+	Event string `json:"event"`
+}
+
+type PostmortemActionItem struct {
+	Description string `json:"description"`
+	Owner       string `json:"owner,omitempty"`
+	Priority    string `json:"priority"` // "high", "medium", "low"
+}
+
+type Postmortem struct {
+	DeploymentID        string                 `json:"deployment_id"`
+	ApplicationName     string                 `json:"application_name"`
+	Environment         Environment            `json:"environment"`
+	Strategy            DeploymentStrategy     `json:"strategy"`
+	Summary             string                 `json:"summary"`
+	Timeline            []PostmortemEvent      `json:"timeline"`
+	ProbableCause       string                 `json:"probable_cause"`
+	ContributingFactors []string               `json:"contributing_factors"`
+	ActionItems         []PostmortemActionItem `json:"action_items"`
+	Source              string                 `json:"source"` // "claude" or "template"
+	GeneratedAt         time.Time              `json:"generated_at"`
+}
+
+// GeneratePostmortem drafts a postmortem for a failed deployment from its logs and the
+// application's recent change history
+func (do *DeploymentOrchestrator) GeneratePostmortem(ctx context.Context, req *DeploymentRequest, response *DeploymentResponse, startTime time.Time) *Postmortem {
+	history, err := do.recentHistory(ctx, req.ApplicationName, req.Environment)
+	if err != nil {
+		log.Printf("Failed to load deployment history for postmortem: %v", err)
+	}
+
+	postmortem, err := do.claudeClient.GeneratePostmortem(ctx, req, response, startTime, history)
+	if err != nil {
+		log.Printf("Claude postmortem generation failed, using template: %v", err)
+		postmortem = templatePostmortem(req, response, startTime)
+	}
+
+	postmortem.DeploymentID = req.DeploymentID
+	postmortem.ApplicationName = req.ApplicationName
+	postmortem.Environment = req.Environment
+	postmortem.Strategy = req.Strategy
+	postmortem.GeneratedAt = time.Now()
+
+	return postmortem
+}
+
+// recordHistory prepends a finished deployment to its application's change history
+func (do *DeploymentOrchestrator) recordHistory(ctx context.Context, req *DeploymentRequest, response *DeploymentResponse) {
+	data, err := json.Marshal(DeploymentHistoryEntry{
+		DeploymentID: req.DeploymentID,
+		Version:      req.Version,
+		Strategy:     req.Strategy,
+		RequestedBy:  req.RequestedBy,
+		Status:       response.Status,
+		Message:      response.Message,
+		Timestamp:    response.Timestamp,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal deployment history: %v", err)
+		return
+	}
+
+	key := deploymentHistoryKey(req.ApplicationName, req.Environment)
+	pipe := do.redis.TxPipeline()
+	pipe.LPush(ctx, key, data)
+	pipe.LTrim(ctx, key, 0, deploymentHistoryLimit-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record deployment history: %v", err)
+	}
+}
+
+func (do *DeploymentOrchestrator) recentHistory(ctx context.Context, application string, env Environment) ([]DeploymentHistoryEntry, error) {
+	items, err := do.redis.LRange(ctx, deploymentHistoryKey(application, env), 0, deploymentHistoryLimit-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load deployment history: %w", err)
+	}
+
+	history := make([]DeploymentHistoryEntry, 0, len(items))
+	for _, item := range items {
+		var entry DeploymentHistoryEntry
+		if err := json.Unmarshal([]byte(item), &entry); err != nil {
+			continue
+		}
+		history = append(history, entry)
+	}
+	return history, nil
+}
+
+// GetDeployment loads a cached deployment record
+func (do *DeploymentOrchestrator) GetDeployment(ctx context.Context, deploymentID string) (*DeploymentResponse, error) {
+	data, err := do.redis.Get(ctx, fmt.Sprintf("deployment:%s", deploymentID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deployment: %w", err)
+	}
+
+	var response DeploymentResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal deployment: %w", err)
+	}
+	return &response, nil
+}
+
+func deploymentHistoryKey(application string, env Environment) string {
+	return fmt.Sprintf("deployment_history:%s:%s", application, env)
+}
+
+// templatePostmortem is used when Claude is unavailable; it reconstructs the timeline from the job logs
+func templatePostmortem(req *DeploymentRequest, response *DeploymentResponse, startTime time.Time) *Postmortem {
+	timeline := []PostmortemEvent{
+		{Time: startTime.Format(time.RFC3339), Event: fmt.Sprintf("%s deployment of %s v%s started", req.Strategy, req.ApplicationName, req.Version)},
+	}
+	for _, line := range response.Logs {
+		timeline = append(timeline, PostmortemEvent{Event: line})
+	}
+	timeline = append(timeline, PostmortemEvent{
+		Time:  startTime.Add(time.Duration(response.Duration * float64(time.Second))).Format(time.RFC3339),
+		Event: "Deployment failed: " + response.Message,
+	})
+
+	return &Postmortem{
+		Summary:             fmt.Sprintf("Deployment %s of %s v%s to %s failed.", req.DeploymentID, req.ApplicationName, req.Version, req.Environment),
+		Timeline:            timeline,
+		ProbableCause:       response.Message,
+		ContributingFactors: []string{},
+		ActionItems: []PostmortemActionItem{
+			{Description: "Confirm the failure cause from the deployment logs and service metrics", Priority: "high"},
+			{Description: "Verify the previous version is healthy or complete the rollback plan", Priority: "high"},
+			{Description: "Add a pre-deployment check that would have caught this failure", Priority: "medium"},
+		},
+		Source: "template",
+	}
+}
+
+// GeneratePostmortem asks Claude for a structured postmortem draft
+func (c *ClaudeClient) GeneratePostmortem(ctx context.Context, req *DeploymentRequest, response *DeploymentResponse, startTime time.Time, history []DeploymentHistoryEntry) (*Postmortem, error) {
+	historyJSON, _ := json.MarshalIndent(history, "", "  ")
+
+	prompt := fmt.Sprintf(`A deployment failed. Draft a blameless postmortem.
+
+Application: %s
+Version: %s
+Environment: %s
+Cloud provider: %s
+Strategy: %s
+Started: %s
+Duration: %.1fs
+Error: %s
+
+Job logs:
+%s
+
+Recent change history for this application and environment (newest first):
+%s
+
+Respond with JSON only:
+{
+  "summary": "Two or three sentence summary of the incident",
+  "timeline": [{"time": "RFC3339 timestamp or relative offset", "event": "What happened"}],
+  "probable_cause": "Most likely root cause",
+  "contributing_factors": ["Factor"],
+  "action_items": [{"description": "Concrete follow-up", "owner": "Team or role", "priority": "high|medium|low"}]
+}`,
+		req.ApplicationName, req.Version, req.Environment, req.CloudProvider, req.Strategy,
+		startTime.Format(time.RFC3339), response.Duration, response.Message,
+		strings.Join(response.Logs, "\n"), string(historyJSON))
+
+	text, err := c.complete(ctx, "You are a senior site reliability engineer writing deployment postmortems.", prompt, 3000)
+	if err != nil {
+		return nil, err
+	}
+
+	var postmortem Postmortem
+	if err := json.Unmarshal([]byte(extractJSON(text)), &postmortem); err != nil {
+		return nil, fmt.Errorf("failed to parse postmortem: %w", err)
+	}
+	if postmortem.Summary == "" {
+		return nil, fmt.Errorf("claude returned a postmortem without a summary")
+	}
+	postmortem.Source = "claude"
+
+	return &postmortem, nil
+}
+
+// HTTP Handlers
+func (s *APIServer) getPostmortemHandler(c *gin.Context) {
+	deployment, err := s.deploymentOrchestrator.GetDeployment(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if deployment == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "deployment not found"})
+		return
+	}
+	if deployment.Postmortem == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no postmortem for deployment with status %q", deployment.Status)})
+		return
+	}
+
+	c.JSON(http.StatusOK, deployment.Postmortem)
+}
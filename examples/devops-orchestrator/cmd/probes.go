@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Deployment health probes
+type ProbeType string
+
+const (
+	ProbeHTTP    ProbeType = "http"
+	ProbeTCP     ProbeType = "tcp"
+	ProbeCommand ProbeType = "command"
+)
+
+type HealthProbe struct {
+	Name            string    `json:"name,omitempty"`
+	Type            ProbeType `json:"type"`
+	Host            string    `json:"host,omitempty"` // base URL for http, host:port for tcp
+	Path            string    `json:"path,omitempty"`
+	ExpectedStatus  int       `json:"expected_status,omitempty"` // http only, default 200
+	Command         string    `json:"command,omitempty"`
+	TimeoutSeconds  int       `json:"timeout_seconds,omitempty"`  // per attempt, default 5
+	Retries         *int      `json:"retries,omitempty"`          // additional attempts, default 3; 0 tries once
+	IntervalSeconds int       `json:"interval_seconds,omitempty"` // between attempts, default 2
+}
+
+const defaultProbeRetries = 3
+
+// allowedProbeCommands are the command probes any deployer may run, loaded from PROBE_COMMANDS_FILE.
+// A command probe runs shell on the orchestrator host, so any other command needs the admin role.
+var allowedProbeCommands = map[string]bool{}
+
+// loadProbeCommands reads the allowlist, one command per line; blank lines and # comments are skipped
+func loadProbeCommands(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open probe command allowlist: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		command := strings.TrimSpace(scanner.Text())
+		if command == "" || strings.HasPrefix(command, "#") {
+			continue
+		}
+		allowedProbeCommands[command] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read probe command allowlist: %w", err)
+	}
+	return nil
+}
+
+// unlistedCommandProbe returns the first command probe that isn't on the allowlist, or nil
+func unlistedCommandProbe(probes []HealthProbe) *HealthProbe {
+	for i, probe := range probes {
+		if probe.Type == ProbeCommand && !allowedProbeCommands[strings.TrimSpace(probe.Command)] {
+			return &probes[i]
+		}
+	}
+	return nil
+}
+
+// runHealthProbes runs every probe configured on the request, retrying each until it passes.
+// A probe that never passes fails the deployment.
+func (do *DeploymentOrchestrator) runHealthProbes(ctx context.Context, req *DeploymentRequest, job *DeploymentJob, stage string) error {
+	if len(req.HealthProbes) == 0 {
+		job.logf("- No health probes configured (%s)", stage)
+		return nil
+	}
+
+	for _, probe := range req.HealthProbes {
+		if err := runProbe(ctx, probe, job, stage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runProbe(ctx context.Context, probe HealthProbe, job *DeploymentJob, stage string) error {
+	timeout := time.Duration(probe.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	retries := defaultProbeRetries
+	if probe.Retries != nil && *probe.Retries >= 0 {
+		retries = *probe.Retries
+	}
+	interval := time.Duration(probe.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	name := probe.Name
+	if name == "" {
+		name = string(probe.Type)
+	}
+
+	var err error
+	for attempt := 1; attempt <= retries+1; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		err = checkProbe(attemptCtx, probe)
+		cancel()
+
+		if err == nil {
+			job.logf("✓ Health probe %s passed (%s, attempt %d)", name, stage, attempt)
+			return nil
+		}
+		job.logf("✗ Health probe %s failed (%s, attempt %d/%d): %v", name, stage, attempt, retries+1, err)
+
+		if attempt <= retries {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+	}
+
+	return fmt.Errorf("health probe %s never became healthy during %s: %w", name, stage, err)
+}
+
+func checkProbe(ctx context.Context, probe HealthProbe) error {
+	switch probe.Type {
+	case ProbeHTTP:
+		expected := probe.ExpectedStatus
+		if expected == 0 {
+			expected = http.StatusOK
+		}
+		url := strings.TrimRight(probe.Host, "/") + "/" + strings.TrimLeft(probe.Path, "/")
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return fmt.Errorf("invalid probe URL: %w", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != expected {
+			return fmt.Errorf("status %d, expected %d", resp.StatusCode, expected)
+		}
+		return nil
+
+	case ProbeTCP:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", probe.Host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case ProbeCommand:
+		output, err := exec.CommandContext(ctx, config.RunbookShell, "-c", probe.Command).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported probe type: %s", probe.Type)
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// Deployment queue and worker pool
+const (
+	deploymentStream      = "deployments:queue"
+	deploymentGroup       = "deployment-workers"
+	deploymentStreamLen   = 10000
+	deploymentHeartbeat   = 5 * time.Second
+	deploymentClaimIdle   = time.Minute // a message idle this long belongs to a dead worker
+	deploymentReadTimeout = 5 * time.Second
+	deploymentOwnerTTL    = 7 * 24 * time.Hour // an ID stays claimed well past its progress record
+)
+
+var errDeploymentExists = errors.New("deployment ID is already in use")
+
+// Kinds of work carried on the stream; a message without a kind is a deployment
+const (
+	jobDeployment     = "deployment"
+	jobPipeline       = "pipeline"
+	jobInfrastructure = "infrastructure"
+)
+
+// DeploymentQueue hands deployments, pipeline runs, and infrastructure actions from the API to
+// workers through a Redis stream consumer group. Any replica can enqueue; any replica running
+// workers can execute, so the API path never blocks on a rollout, a test suite, a stack update,
+// or the Terraform processes behind them.
+type DeploymentQueue struct {
+	redis          *redis.Client
+	orchestrator   *DeploymentOrchestrator
+	pipelines      *PipelineRunner
+	infrastructure *InfrastructureManager
+	consumerID     string
+}
+
+func NewDeploymentQueue(redisClient *redis.Client, orchestrator *DeploymentOrchestrator, pipelines *PipelineRunner, infrastructure *InfrastructureManager) *DeploymentQueue {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "worker"
+	}
+	return &DeploymentQueue{
+		redis:          redisClient,
+		orchestrator:   orchestrator,
+		pipelines:      pipelines,
+		infrastructure: infrastructure,
+		consumerID:     fmt.Sprintf("%s-%d", host, os.Getpid()),
+	}
+}
+
+// Enqueue publishes a deployment for the worker pool and records it as queued. The deployment ID is
+// claimed first, so a request can't take over the progress and controls of an existing deployment.
+func (q *DeploymentQueue) Enqueue(ctx context.Context, req *DeploymentRequest) (*DeploymentResponse, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal deployment request: %w", err)
+	}
+
+	ownerKey := fmt.Sprintf("deployment_owner:%s", req.DeploymentID)
+	claimed, err := q.redis.SetNX(ctx, ownerKey, req.RequestedBy, deploymentOwnerTTL).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim deployment ID: %w", err)
+	}
+	if !claimed {
+		return nil, errDeploymentExists
+	}
+
+	response := &DeploymentResponse{
+		DeploymentID: req.DeploymentID,
+		Status:       "queued",
+		Environment:  req.Environment,
+		Message:      "Deployment queued for execution",
+		Timestamp:    time.Now(),
+		Logs:         make([]string, 0),
+	}
+	q.saveProgress(ctx, response)
+
+	err = q.redis.XAdd(ctx, &redis.XAddArgs{
+		Stream: deploymentStream,
+		MaxLen: deploymentStreamLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"kind":          jobDeployment,
+			"deployment_id": req.DeploymentID,
+			"request":       string(data),
+		},
+	}).Err()
+	if err != nil {
+		q.redis.Del(ctx, ownerKey)
+		return nil, fmt.Errorf("failed to enqueue deployment: %w", err)
+	}
+
+	deploymentsQueued.Inc()
+	return response, nil
+}
+
+// EnqueuePipeline publishes a pipeline run for the worker pool and records it as queued
+func (q *DeploymentQueue) EnqueuePipeline(ctx context.Context, req *PipelineRequest) (*PipelineResponse, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal pipeline request: %w", err)
+	}
+
+	response := &PipelineResponse{
+		PipelineID:   req.PipelineID,
+		Status:       "queued",
+		StageResults: make([]StageResult, 0),
+		Artifacts:    make([]string, 0),
+	}
+	q.pipelines.cachePipeline(ctx, response)
+
+	err = q.redis.XAdd(ctx, &redis.XAddArgs{
+		Stream: deploymentStream,
+		MaxLen: deploymentStreamLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"kind":        jobPipeline,
+			"pipeline_id": req.PipelineID,
+			"request":     string(data),
+		},
+	}).Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to enqueue pipeline: %w", err)
+	}
+	return response, nil
+}
+
+// EnqueueInfrastructure publishes an infrastructure action for the worker pool and records it as queued
+func (q *DeploymentQueue) EnqueueInfrastructure(ctx context.Context, req *InfrastructureRequest) (*InfrastructureResponse, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal infrastructure request: %w", err)
+	}
+
+	response := &InfrastructureResponse{
+		RequestID:       req.RequestID,
+		Status:          "queued",
+		Recommendations: make([]string, 0),
+	}
+	q.saveInfrastructure(ctx, response)
+
+	err = q.redis.XAdd(ctx, &redis.XAddArgs{
+		Stream: deploymentStream,
+		MaxLen: deploymentStreamLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"kind":       jobInfrastructure,
+			"request_id": req.RequestID,
+			"request":    string(data),
+		},
+	}).Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to enqueue infrastructure request: %w", err)
+	}
+	return response, nil
+}
+
+// InfrastructureStatus returns an infrastructure request's result, or its queued/running
+// snapshot. It returns nil if the request is unknown.
+func (q *DeploymentQueue) InfrastructureStatus(ctx context.Context, requestID string) (*InfrastructureResponse, error) {
+	data, err := q.redis.Get(ctx, infrastructureKey(requestID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get infrastructure request: %w", err)
+	}
+
+	var response InfrastructureResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal infrastructure request: %w", err)
+	}
+	return &response, nil
+}
+
+// Status returns the final result of a deployment if it has finished, otherwise its latest
+// queued/in_progress snapshot. It returns nil if the deployment is unknown.
+func (q *DeploymentQueue) Status(ctx context.Context, deploymentID string) (*DeploymentResponse, error) {
+	response, err := q.orchestrator.GetDeployment(ctx, deploymentID)
+	if err != nil || response != nil {
+		return response, err
+	}
+
+	data, err := q.redis.Get(ctx, fmt.Sprintf("deployment_progress:%s", deploymentID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deployment progress: %w", err)
+	}
+
+	var progress DeploymentResponse
+	if err := json.Unmarshal(data, &progress); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal deployment progress: %w", err)
+	}
+	return &progress, nil
+}
+
+// Cancel asks whichever worker holds the deployment to abort it; a deployment still in the
+// queue is dropped when a worker picks it up
+func (q *DeploymentQueue) Cancel(ctx context.Context, deploymentID string) error {
+	if err := q.redis.Set(ctx, cancelKey(deploymentID), "1", 24*time.Hour).Err(); err != nil {
+		return fmt.Errorf("failed to cancel deployment: %w", err)
+	}
+	return nil
+}
+
+func (q *DeploymentQueue) Cancelled(ctx context.Context, deploymentID string) bool {
+	n, err := q.redis.Exists(ctx, cancelKey(deploymentID)).Result()
+	return err == nil && n > 0
+}
+
+// Start launches the worker pool; workers stop taking new deployments when ctx is cancelled
+// and the returned WaitGroup completes once in-flight deployments have finished
+func (q *DeploymentQueue) Start(ctx context.Context, workers int) *sync.WaitGroup {
+	var wg sync.WaitGroup
+
+	err := q.redis.XGroupCreateMkStream(ctx, deploymentStream, deploymentGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		log.Printf("Failed to create deployment consumer group: %v", err)
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(consumer string) {
+			defer wg.Done()
+			q.work(ctx, consumer)
+		}(fmt.Sprintf("%s-%d", q.consumerID, i))
+	}
+
+	log.Printf("Started %d deployment workers", workers)
+	return &wg
+}
+
+// work claims one deployment at a time, so a busy worker never holds messages another idle
+// worker (on this or any other replica) could be running
+func (q *DeploymentQueue) work(ctx context.Context, consumer string) {
+	for ctx.Err() == nil {
+		msg, err := q.next(ctx, consumer)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Deployment worker %s: %v", consumer, err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch msg.Values["kind"] {
+		case jobPipeline:
+			q.executePipeline(consumer, *msg)
+		case jobInfrastructure:
+			q.executeInfrastructure(consumer, *msg)
+		default:
+			q.execute(consumer, *msg)
+		}
+	}
+}
+
+// next reclaims a deployment abandoned by a crashed worker before reading new ones
+func (q *DeploymentQueue) next(ctx context.Context, consumer string) (*redis.XMessage, error) {
+	claimed, _, err := q.redis.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   deploymentStream,
+		Group:    deploymentGroup,
+		Consumer: consumer,
+		MinIdle:  deploymentClaimIdle,
+		Start:    "0",
+		Count:    1,
+	}).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to reclaim deployments: %w", err)
+	}
+	if len(claimed) > 0 {
+		log.Printf("Deployment worker %s reclaimed message %s", consumer, claimed[0].ID)
+		return &claimed[0], nil
+	}
+
+	streams, err := q.redis.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    deploymentGroup,
+		Consumer: consumer,
+		Streams:  []string{deploymentStream, ">"},
+		Count:    1,
+		Block:    deploymentReadTimeout,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deployments: %w", err)
+	}
+	for _, stream := range streams {
+		if len(stream.Messages) > 0 {
+			return &stream.Messages[0], nil
+		}
+	}
+	return nil, nil
+}
+
+// execute runs a claimed deployment to completion. It deliberately ignores the pool's shutdown
+// context: a rollout is never abandoned half-way, only by an explicit Cancel.
+func (q *DeploymentQueue) execute(consumer string, msg redis.XMessage) {
+	ctx := context.Background()
+	defer q.redis.XAck(ctx, deploymentStream, deploymentGroup, msg.ID)
+
+	raw, _ := msg.Values["request"].(string)
+	var req DeploymentRequest
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		log.Printf("Dropping malformed deployment message %s: %v", msg.ID, err)
+		return
+	}
+
+	// A worker that died between saving the result and acknowledging the message leaves nothing to do
+	if finished, err := q.orchestrator.GetDeployment(ctx, req.DeploymentID); err == nil && finished != nil {
+		return
+	}
+
+	if q.Cancelled(ctx, req.DeploymentID) {
+		q.orchestrator.cacheDeployment(ctx, req.DeploymentID, &DeploymentResponse{
+			DeploymentID: req.DeploymentID,
+			Status:       "failed",
+			Environment:  req.Environment,
+			Message:      "Deployment cancelled before execution",
+			Timestamp:    time.Now(),
+			Logs:         make([]string, 0),
+		})
+		return
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	go q.heartbeat(cancel, consumer, msg.ID, &req, done)
+
+	deploymentWorkersBusy.Inc()
+	response, err := q.orchestrator.ExecuteDeployment(runCtx, &req)
+	deploymentWorkersBusy.Dec()
+	close(done)
+
+	if err != nil {
+		q.orchestrator.cacheDeployment(ctx, req.DeploymentID, &DeploymentResponse{
+			DeploymentID: req.DeploymentID,
+			Status:       "failed",
+			Environment:  req.Environment,
+			Message:      err.Error(),
+			Timestamp:    time.Now(),
+			Logs:         make([]string, 0),
+		})
+		return
+	}
+	log.Printf("Deployment worker %s finished %s: %s", consumer, req.DeploymentID, response.Status)
+}
+
+// heartbeat keeps the message claimed by this worker, publishes progress snapshots, and
+// cancels the deployment when a Cancel is requested from any replica
+func (q *DeploymentQueue) heartbeat(cancel context.CancelFunc, consumer, messageID string, req *DeploymentRequest, done <-chan struct{}) {
+	ctx := context.Background()
+	deploymentID := req.DeploymentID
+	ticker := time.NewTicker(deploymentHeartbeat)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for {
+		q.saveProgress(ctx, &DeploymentResponse{
+			DeploymentID: deploymentID,
+			Status:       "in_progress",
+			Environment:  req.Environment,
+			Message:      fmt.Sprintf("Running on %s", consumer),
+			Timestamp:    time.Now(),
+			Duration:     time.Since(start).Seconds(),
+			Logs:         q.orchestrator.JobLogs(deploymentID),
+		})
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		q.renewClaim(ctx, consumer, messageID)
+
+		if q.Cancelled(ctx, deploymentID) {
+			log.Printf("Cancelling deployment %s", deploymentID)
+			cancel()
+		}
+	}
+}
+
+// executePipeline runs a claimed pipeline to completion. A pipeline reclaimed from a dead worker
+// starts over, since its workspace went with that worker.
+func (q *DeploymentQueue) executePipeline(consumer string, msg redis.XMessage) {
+	ctx := context.Background()
+	// The request carries the pipeline's secrets, so it isn't left in the stream once handled
+	defer q.redis.XDel(ctx, deploymentStream, msg.ID)
+	defer q.redis.XAck(ctx, deploymentStream, deploymentGroup, msg.ID)
+
+	raw, _ := msg.Values["request"].(string)
+	var req PipelineRequest
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		log.Printf("Dropping malformed pipeline message %s: %v", msg.ID, err)
+		return
+	}
+
+	if previous, err := q.pipelines.GetPipeline(ctx, req.PipelineID); err == nil && previous != nil && previous.finished() {
+		return
+	}
+	q.pipelines.cachePipeline(ctx, &PipelineResponse{
+		PipelineID:   req.PipelineID,
+		Status:       "running",
+		StageResults: make([]StageResult, 0),
+		Artifacts:    make([]string, 0),
+	})
+
+	stop := q.keepClaimed(consumer, msg.ID)
+	deploymentWorkersBusy.Inc()
+	response, err := q.pipelines.ExecutePipeline(ctx, &req)
+	deploymentWorkersBusy.Dec()
+	stop()
+
+	if err != nil {
+		q.pipelines.cachePipeline(ctx, &PipelineResponse{
+			PipelineID:   req.PipelineID,
+			Status:       "failed",
+			Error:        err.Error(),
+			StageResults: make([]StageResult, 0),
+			Artifacts:    make([]string, 0),
+		})
+		return
+	}
+	log.Printf("Deployment worker %s finished pipeline %s: %s", consumer, req.PipelineID, response.Status)
+}
+
+// executeInfrastructure runs a claimed plan, apply, destroy, drift check, or rollback and records
+// its outcome. One reclaimed from a dead worker runs again; the engines pick up from the stack's state.
+func (q *DeploymentQueue) executeInfrastructure(consumer string, msg redis.XMessage) {
+	ctx := context.Background()
+	// Variables often carry credentials, so the request isn't left in the stream once handled
+	defer q.redis.XDel(ctx, deploymentStream, msg.ID)
+	defer q.redis.XAck(ctx, deploymentStream, deploymentGroup, msg.ID)
+
+	raw, _ := msg.Values["request"].(string)
+	var req InfrastructureRequest
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		log.Printf("Dropping malformed infrastructure message %s: %v", msg.ID, err)
+		return
+	}
+
+	if previous, err := q.InfrastructureStatus(ctx, req.RequestID); err == nil && previous != nil && previous.finished() {
+		return
+	}
+	q.saveInfrastructure(ctx, &InfrastructureResponse{
+		RequestID:       req.RequestID,
+		Status:          "running",
+		Recommendations: make([]string, 0),
+	})
+
+	stop := q.keepClaimed(consumer, msg.ID)
+	deploymentWorkersBusy.Inc()
+	response, err := q.infrastructure.ManageInfrastructure(ctx, &req)
+	deploymentWorkersBusy.Dec()
+	stop()
+
+	if err != nil {
+		response = &InfrastructureResponse{
+			RequestID:       req.RequestID,
+			Status:          "failed",
+			Error:           err.Error(),
+			Recommendations: make([]string, 0),
+		}
+		var validationErr *VariableValidationError
+		if errors.As(err, &validationErr) {
+			response.Status = "invalid_variables"
+			response.Violations = validationErr.Violations
+		}
+		if errors.Is(err, errTerraformUnavailable) {
+			response.Status = "validation_unavailable"
+		}
+	}
+	q.saveInfrastructure(ctx, response)
+	log.Printf("Deployment worker %s finished infrastructure request %s: %s", consumer, req.RequestID, response.Status)
+}
+
+// keepClaimed renews the claim on a message until the returned stop function is called
+func (q *DeploymentQueue) keepClaimed(consumer, messageID string) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(deploymentHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				q.renewClaim(context.Background(), consumer, messageID)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// renewClaim re-claims our own message, resetting its idle time so other workers don't steal it
+func (q *DeploymentQueue) renewClaim(ctx context.Context, consumer, messageID string) {
+	q.redis.XClaimJustID(ctx, &redis.XClaimArgs{
+		Stream:   deploymentStream,
+		Group:    deploymentGroup,
+		Consumer: consumer,
+		Messages: []string{messageID},
+	})
+}
+
+func (q *DeploymentQueue) saveProgress(ctx context.Context, response *DeploymentResponse) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Failed to marshal deployment progress: %v", err)
+		return
+	}
+	if err := q.redis.Set(ctx, fmt.Sprintf("deployment_progress:%s", response.DeploymentID), data, 24*time.Hour).Err(); err != nil {
+		log.Printf("Failed to save deployment progress: %v", err)
+	}
+}
+
+func (q *DeploymentQueue) saveInfrastructure(ctx context.Context, response *InfrastructureResponse) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Failed to marshal infrastructure response: %v", err)
+		return
+	}
+	if err := q.redis.Set(ctx, infrastructureKey(response.RequestID), data, 7*24*time.Hour).Err(); err != nil {
+		log.Printf("Failed to save infrastructure response: %v", err)
+	}
+}
+
+func infrastructureKey(requestID string) string {
+	return fmt.Sprintf("infrastructure:%s", requestID)
+}
+
+func cancelKey(deploymentID string) string {
+	return fmt.Sprintf("deployment_cancel:%s", deploymentID)
+}
+
+// HTTP Handlers
+func (s *APIServer) getDeploymentHandler(c *gin.Context) {
+	response, err := s.deploymentQueue.Status(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if response == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "deployment not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *APIServer) cancelDeploymentHandler(c *gin.Context) {
+	deploymentID := c.Param("id")
+
+	response, err := s.deploymentQueue.Status(c.Request.Context(), deploymentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if response == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "deployment not found"})
+		return
+	}
+	if response.Status != "queued" && response.Status != "in_progress" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("deployment already %s", response.Status)})
+		return
+	}
+
+	if err := s.deploymentQueue.Cancel(c.Request.Context(), deploymentID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, response)
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// Role-based access control
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleDeployer Role = "deployer"
+	RoleAdmin    Role = "admin"
+)
+
+// AllEnvironments scopes a binding to every environment and to routes that aren't environment-specific
+const AllEnvironments = "*"
+
+const (
+	rbacAdminPrincipal = "admin"
+	principalKey       = "principal"
+	auditLogLimit      = 10000
+)
+
+var roleRank = map[Role]int{RoleViewer: 1, RoleDeployer: 2, RoleAdmin: 3}
+
+type RoleBinding struct {
+	Principal   string    `json:"principal" binding:"required"`
+	Environment string    `json:"environment" binding:"required"` // an Environment or "*"
+	Role        Role      `json:"role" binding:"required"`
+	GrantedBy   string    `json:"granted_by,omitempty"`
+	GrantedAt   time.Time `json:"granted_at"`
+}
+
+type RoleBindingsResponse struct {
+	Principal string        `json:"principal"`
+	Bindings  []RoleBinding `json:"bindings"`
+}
+
+type APITokenRequest struct {
+	Principal string `json:"principal" binding:"required"`
+	ExpiresIn int    `json:"expires_in,omitempty"` // seconds; RBAC_TOKEN_TTL_DAYS when unset
+}
+
+// APITokenResponse carries the only copy of the token; just its hash is stored, and ID names it
+// for listing and revocation
+type APITokenResponse struct {
+	ID        string    `json:"id"`
+	Principal string    `json:"principal"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// APIToken describes an issued token without the token itself
+type APIToken struct {
+	ID        string    `json:"id"`
+	Principal string    `json:"principal"`
+	IssuedBy  string    `json:"issued_by,omitempty"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type APITokensResponse struct {
+	Principal string     `json:"principal"`
+	Tokens    []APIToken `json:"tokens"`
+}
+
+type AuditRecord struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Principal   string    `json:"principal"`
+	Action      string    `json:"action"`
+	Environment string    `json:"environment,omitempty"`
+	Resource    string    `json:"resource"`
+	Allowed     bool      `json:"allowed"`
+	Status      int       `json:"status,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+type AuditLogResponse struct {
+	Records []AuditRecord `json:"records"`
+}
+
+// Permission is what a request needs: at least Role, in Environment ("*" for global routes)
+type Permission struct {
+	Role        Role
+	Environment string
+}
+
+// accessFunc resolves the permission a request needs, possibly from its body or the deployment it targets
+type accessFunc func(c *gin.Context) (Permission, error)
+
+type RBACManager struct {
+	redis      *redis.Client
+	adminToken string
+}
+
+func NewRBACManager(redisClient *redis.Client, adminToken string) *RBACManager {
+	return &RBACManager{
+		redis:      redisClient,
+		adminToken: adminToken,
+	}
+}
+
+// Enabled reports whether RBAC is enforced; it is off until RBAC_ADMIN_TOKEN is configured
+func (rm *RBACManager) Enabled() bool {
+	return rm.adminToken != ""
+}
+
+// Authenticate maps a bearer token to its principal
+func (rm *RBACManager) Authenticate(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", fmt.Errorf("missing bearer token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(rm.adminToken)) == 1 {
+		return rbacAdminPrincipal, nil
+	}
+
+	principal, err := rm.redis.Get(ctx, tokenKey(tokenID(token))).Result()
+	if err == redis.Nil {
+		return "", fmt.Errorf("invalid token")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up token: %w", err)
+	}
+	return principal, nil
+}
+
+// Authorize checks that principal holds perm.Role in perm.Environment, counting "*" bindings
+func (rm *RBACManager) Authorize(ctx context.Context, principal string, perm Permission) error {
+	if principal == rbacAdminPrincipal {
+		return nil
+	}
+
+	bindings, err := rm.redis.HGetAll(ctx, bindingsKey(principal)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to load role bindings: %w", err)
+	}
+
+	granted := roleRank[Role(bindings[AllEnvironments])]
+	if perm.Environment != AllEnvironments && roleRank[Role(bindings[perm.Environment])] > granted {
+		granted = roleRank[Role(bindings[perm.Environment])]
+	}
+	if granted < roleRank[perm.Role] {
+		return fmt.Errorf("%s requires role %s in environment %s", principal, perm.Role, perm.Environment)
+	}
+	return nil
+}
+
+func (rm *RBACManager) SetBinding(ctx context.Context, binding *RoleBinding) error {
+	if _, ok := roleRank[binding.Role]; !ok {
+		return fmt.Errorf("unknown role: %s", binding.Role)
+	}
+	if binding.Environment != AllEnvironments && !validEnvironment(Environment(binding.Environment)) {
+		return fmt.Errorf("unknown environment: %s", binding.Environment)
+	}
+	binding.GrantedAt = time.Now()
+
+	data, err := json.Marshal(binding)
+	if err != nil {
+		return fmt.Errorf("failed to marshal role binding: %w", err)
+	}
+	pipe := rm.redis.TxPipeline()
+	pipe.HSet(ctx, bindingsKey(binding.Principal), binding.Environment, string(binding.Role))
+	pipe.HSet(ctx, bindingDetailsKey(binding.Principal), binding.Environment, data)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to store role binding: %w", err)
+	}
+	return nil
+}
+
+func (rm *RBACManager) DeleteBinding(ctx context.Context, principal, environment string) error {
+	pipe := rm.redis.TxPipeline()
+	pipe.HDel(ctx, bindingsKey(principal), environment)
+	pipe.HDel(ctx, bindingDetailsKey(principal), environment)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to delete role binding: %w", err)
+	}
+	return nil
+}
+
+func (rm *RBACManager) Bindings(ctx context.Context, principal string) ([]RoleBinding, error) {
+	details, err := rm.redis.HGetAll(ctx, bindingDetailsKey(principal)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load role bindings: %w", err)
+	}
+
+	bindings := make([]RoleBinding, 0, len(details))
+	for _, data := range details {
+		var binding RoleBinding
+		if err := json.Unmarshal([]byte(data), &binding); err != nil {
+			continue
+		}
+		bindings = append(bindings, binding)
+	}
+	return bindings, nil
+}
+
+// IssueToken creates a new API token for principal that expires after ttl
+func (rm *RBACManager) IssueToken(ctx context.Context, principal, issuedBy string, ttl time.Duration) (string, *APIToken, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := "dvo_" + hex.EncodeToString(raw)
+
+	now := time.Now()
+	issued := &APIToken{
+		ID:        tokenID(token),
+		Principal: principal,
+		IssuedBy:  issuedBy,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(ttl),
+	}
+	data, err := json.Marshal(issued)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal token: %w", err)
+	}
+	pipe := rm.redis.TxPipeline()
+	pipe.Set(ctx, tokenKey(issued.ID), principal, ttl)
+	pipe.HSet(ctx, tokensKey(principal), issued.ID, data)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", nil, fmt.Errorf("failed to store token: %w", err)
+	}
+	return token, issued, nil
+}
+
+// Tokens lists a principal's unexpired tokens, oldest first, forgetting expired ones
+func (rm *RBACManager) Tokens(ctx context.Context, principal string) ([]APIToken, error) {
+	details, err := rm.redis.HGetAll(ctx, tokensKey(principal)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tokens: %w", err)
+	}
+
+	now := time.Now()
+	tokens := make([]APIToken, 0, len(details))
+	expired := make([]string, 0)
+	for id, data := range details {
+		var token APIToken
+		if err := json.Unmarshal([]byte(data), &token); err != nil {
+			continue
+		}
+		if !token.ExpiresAt.After(now) {
+			expired = append(expired, id)
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+	if len(expired) > 0 {
+		rm.redis.HDel(ctx, tokensKey(principal), expired...)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].IssuedAt.Before(tokens[j].IssuedAt) })
+	return tokens, nil
+}
+
+// RevokeToken deletes one of principal's tokens by ID; it reports false if there was none
+func (rm *RBACManager) RevokeToken(ctx context.Context, principal, id string) (bool, error) {
+	owner, err := rm.redis.Get(ctx, tokenKey(id)).Result()
+	if err != nil && err != redis.Nil {
+		return false, fmt.Errorf("failed to look up token: %w", err)
+	}
+
+	pipe := rm.redis.TxPipeline()
+	var deleted *redis.IntCmd
+	if err == nil && owner == principal {
+		deleted = pipe.Del(ctx, tokenKey(id))
+	}
+	forgotten := pipe.HDel(ctx, tokensKey(principal), id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, fmt.Errorf("failed to revoke token: %w", err)
+	}
+	return (deleted != nil && deleted.Val() > 0) || forgotten.Val() > 0, nil
+}
+
+// Audit appends a record to the audit log; failures are logged rather than failing the request
+func (rm *RBACManager) Audit(ctx context.Context, record AuditRecord) {
+	record.Timestamp = time.Now()
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Failed to marshal audit record: %v", err)
+		return
+	}
+
+	pipe := rm.redis.TxPipeline()
+	pipe.LPush(ctx, "audit_log", data)
+	pipe.LTrim(ctx, "audit_log", 0, auditLogLimit-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to write audit record: %v", err)
+	}
+}
+
+func (rm *RBACManager) AuditLog(ctx context.Context, limit int) ([]AuditRecord, error) {
+	items, err := rm.redis.LRange(ctx, "audit_log", 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	records := make([]AuditRecord, 0, len(items))
+	for _, item := range items {
+		var record AuditRecord
+		if err := json.Unmarshal([]byte(item), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// tokenID is the hash a token is stored under
+func tokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func tokenKey(id string) string {
+	return fmt.Sprintf("rbac:token:%s", id)
+}
+
+// tokensKey is a hash of a principal's issued tokens by ID
+func tokensKey(principal string) string {
+	return fmt.Sprintf("rbac:tokens:%s", principal)
+}
+
+func bindingsKey(principal string) string {
+	return fmt.Sprintf("rbac:bindings:%s", principal)
+}
+
+func bindingDetailsKey(principal string) string {
+	return fmt.Sprintf("rbac:binding_details:%s", principal)
+}
+
+func validEnvironment(env Environment) bool {
+	return env == Production || env == Staging || env == Development
+}
+
+// Access rules used in the route table
+
+func requireGlobal(role Role) accessFunc {
+	return func(c *gin.Context) (Permission, error) {
+		return Permission{Role: role, Environment: AllEnvironments}, nil
+	}
+}
+
+// requireForBody scopes the permission to the "environment" field of the JSON body; a request
+// without one needs the role in every environment
+func requireForBody(role Role) accessFunc {
+	return func(c *gin.Context) (Permission, error) {
+		env, _, err := peekBody(c)
+		if err != nil {
+			return Permission{}, err
+		}
+		return Permission{Role: role, Environment: env}, nil
+	}
+}
+
+// requireForDeployment scopes the permission to the environment of the deployment named by :id
+func (s *APIServer) requireForDeployment(role Role) accessFunc {
+	return func(c *gin.Context) (Permission, error) {
+		response, err := s.deploymentQueue.Status(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			return Permission{}, err
+		}
+		if response == nil || response.Environment == "" {
+			return Permission{Role: role, Environment: AllEnvironments}, nil
+		}
+		return Permission{Role: role, Environment: string(response.Environment)}, nil
+	}
+}
+
+// infrastructureAccess lets deployers plan, apply, and roll back in their environments and viewers
+// check drift; destroy needs admin. An inline Pulumi YAML program can run commands on the
+// orchestrator host, even in a preview, so it needs admin too.
+func infrastructureAccess(c *gin.Context) (Permission, error) {
+	var body struct {
+		Environment   string         `json:"environment"`
+		Action        string         `json:"action"`
+		Engine        IaCEngineType  `json:"engine"`
+		PulumiProgram *PulumiProgram `json:"pulumi_program"`
+	}
+	if err := peekJSON(c, &body); err != nil {
+		return Permission{}, err
+	}
+	env := body.Environment
+	if env == "" {
+		env = AllEnvironments
+	}
+	if inlinePulumiProgram(body.Engine, body.PulumiProgram) {
+		return Permission{Role: RoleAdmin, Environment: env}, nil
+	}
+	switch body.Action {
+	case "destroy":
+		return Permission{Role: RoleAdmin, Environment: env}, nil
+	case "drift":
+		return Permission{Role: RoleViewer, Environment: env}, nil
+	}
+	return Permission{Role: RoleDeployer, Environment: env}, nil
+}
+
+// deployAccess lets deployers deploy in their environments; a command probe outside
+// PROBE_COMMANDS_FILE runs arbitrary shell on the orchestrator host, so it needs admin
+func deployAccess(c *gin.Context) (Permission, error) {
+	var body struct {
+		Environment  string        `json:"environment"`
+		HealthProbes []HealthProbe `json:"health_probes"`
+	}
+	if err := peekJSON(c, &body); err != nil {
+		return Permission{}, err
+	}
+	if body.Environment == "" {
+		body.Environment = AllEnvironments
+	}
+	if unlistedCommandProbe(body.HealthProbes) != nil {
+		return Permission{Role: RoleAdmin, Environment: body.Environment}, nil
+	}
+	return Permission{Role: RoleDeployer, Environment: body.Environment}, nil
+}
+
+// peekBody reads the environment and action from a JSON body and restores it for the handler
+func peekBody(c *gin.Context) (env, action string, err error) {
+	var body struct {
+		Environment string `json:"environment"`
+		Action      string `json:"action"`
+	}
+	if err := peekJSON(c, &body); err != nil {
+		return "", "", err
+	}
+	if body.Environment == "" {
+		body.Environment = AllEnvironments
+	}
+	return body.Environment, body.Action, nil
+}
+
+// peekJSON decodes what it can of a JSON body into v and restores the body for the handler
+func peekJSON(c *gin.Context, v interface{}) error {
+	data, err := c.GetRawData()
+	if err != nil {
+		return err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(data))
+
+	if len(data) > 0 {
+		json.Unmarshal(data, v)
+	}
+	return nil
+}
+
+// principal returns the authenticated caller, or "anonymous" when RBAC is disabled
+func principal(c *gin.Context) string {
+	if p := c.GetString(principalKey); p != "" {
+		return p
+	}
+	return "anonymous"
+}
+
+// HTTP Handlers
+
+// authorize is the RBAC middleware for a route: it authenticates the bearer token, enforces the
+// route's access rule, and audits every mutating request with its principal
+func (s *APIServer) authorize(route apiRoute) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		record := AuditRecord{Action: route.OperationID, Resource: c.Request.URL.Path}
+		audit := route.Method != http.MethodGet
+
+		if !s.rbac.Enabled() {
+			if audit {
+				c.Next()
+				record.Principal, record.Allowed, record.Status = principal(c), true, c.Writer.Status()
+				s.rbac.Audit(c.Request.Context(), record)
+			}
+			return
+		}
+
+		deny := func(status int, err error) {
+			record.Reason = err.Error()
+			record.Status = status
+			s.rbac.Audit(c.Request.Context(), record)
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		}
+
+		p, err := s.rbac.Authenticate(c.Request.Context(), strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+		record.Principal = p
+		if err != nil {
+			deny(http.StatusUnauthorized, err)
+			return
+		}
+		c.Set(principalKey, p)
+
+		perm := Permission{Role: RoleAdmin, Environment: AllEnvironments}
+		if route.Access != nil {
+			if perm, err = route.Access(c); err != nil {
+				deny(http.StatusBadRequest, err)
+				return
+			}
+		}
+		record.Environment = perm.Environment
+
+		if err := s.rbac.Authorize(c.Request.Context(), p, perm); err != nil {
+			deny(http.StatusForbidden, err)
+			return
+		}
+
+		c.Next()
+
+		if audit {
+			record.Allowed, record.Status = true, c.Writer.Status()
+			s.rbac.Audit(c.Request.Context(), record)
+		}
+	}
+}
+
+func (s *APIServer) setRoleBindingHandler(c *gin.Context) {
+	var binding RoleBinding
+	if err := c.ShouldBindJSON(&binding); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	binding.GrantedBy = principal(c)
+
+	if err := s.rbac.SetBinding(c.Request.Context(), &binding); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, binding)
+}
+
+func (s *APIServer) getRoleBindingsHandler(c *gin.Context) {
+	bindings, err := s.rbac.Bindings(c.Request.Context(), c.Param("principal"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, RoleBindingsResponse{Principal: c.Param("principal"), Bindings: bindings})
+}
+
+func (s *APIServer) deleteRoleBindingHandler(c *gin.Context) {
+	if err := s.rbac.DeleteBinding(c.Request.Context(), c.Param("principal"), c.Param("environment")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.getRoleBindingsHandler(c)
+}
+
+func (s *APIServer) issueTokenHandler(c *gin.Context) {
+	var req APITokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.ExpiresIn < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must be positive"})
+		return
+	}
+	ttl := config.RBACTokenTTL
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+
+	token, issued, err := s.rbac.IssueToken(c.Request.Context(), req.Principal, principal(c), ttl)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, APITokenResponse{ID: issued.ID, Principal: req.Principal, Token: token, ExpiresAt: issued.ExpiresAt})
+}
+
+func (s *APIServer) getTokensHandler(c *gin.Context) {
+	tokens, err := s.rbac.Tokens(c.Request.Context(), c.Param("principal"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, APITokensResponse{Principal: c.Param("principal"), Tokens: tokens})
+}
+
+func (s *APIServer) revokeTokenHandler(c *gin.Context) {
+	revoked, err := s.rbac.RevokeToken(c.Request.Context(), c.Param("principal"), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !revoked {
+		c.JSON(http.StatusNotFound, gin.H{"error": "token not found"})
+		return
+	}
+
+	s.getTokensHandler(c)
+}
+
+func (s *APIServer) auditLogHandler(c *gin.Context) {
+	limit := 100
+	if v := c.Query("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = parsed
+	}
+	if limit > auditLogLimit {
+		limit = auditLogLimit
+	}
+
+	records, err := s.rbac.AuditLog(c.Request.Context(), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, AuditLogResponse{Records: records})
+}
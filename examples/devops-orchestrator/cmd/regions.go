@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Multi-region fan-out deployments
+const (
+	OrderingSequential = "sequential" // one region at a time, in request order
+	OrderingWaves      = "waves"      // regions grouped by wave; a wave's regions deploy in parallel
+
+	OnFailureRollback = "rollback" // halt remaining waves and roll back completed regions
+	OnFailureHalt     = "halt"     // halt remaining waves, leave completed regions in place
+)
+
+type RegionTarget struct {
+	Region         string `json:"region"`
+	Cluster        string `json:"cluster,omitempty"`
+	Wave           int    `json:"wave,omitempty"`
+	HealthCheckURL string `json:"health_check_url,omitempty"`
+}
+
+type RegionStatus struct {
+	Region   string   `json:"region"`
+	Cluster  string   `json:"cluster,omitempty"`
+	Wave     int      `json:"wave"`
+	Status   string   `json:"status"` // "pending", "success", "failed", "skipped", "rolled_back"
+	Message  string   `json:"message,omitempty"`
+	Logs     []string `json:"logs"`
+	Duration float64  `json:"duration_seconds"`
+
+	healthCheckURL string
+}
+
+// executeMultiRegion deploys to each region wave by wave, gating each region on its health check.
+// A failed region halts later waves and, under the rollback policy, reverts completed regions.
+func (do *DeploymentOrchestrator) executeMultiRegion(ctx context.Context, req *DeploymentRequest, job *DeploymentJob, response *DeploymentResponse) error {
+	waves := regionWaves(req)
+	statuses := make([]*RegionStatus, 0, len(req.Regions))
+	for _, wave := range waves {
+		for _, status := range wave {
+			statuses = append(statuses, status)
+		}
+	}
+	defer func() {
+		response.Regions = make([]RegionStatus, len(statuses))
+		for i, status := range statuses {
+			response.Regions[i] = *status
+		}
+	}()
+
+	policy := req.OnRegionFailure
+	if policy == "" {
+		policy = OnFailureRollback
+	}
+
+	var failed *RegionStatus
+	for i, wave := range waves {
+		job.logf("Starting wave %d/%d (%d regions)", i+1, len(waves), len(wave))
+
+		var wg sync.WaitGroup
+		for _, status := range wave {
+			wg.Add(1)
+			go func(status *RegionStatus) {
+				defer wg.Done()
+				do.deployRegion(ctx, req, job, status)
+			}(status)
+		}
+		wg.Wait()
+
+		for _, status := range wave {
+			for _, line := range status.Logs {
+				job.logf("[%s] %s", status.Region, line)
+			}
+			if status.Status == "failed" && failed == nil {
+				failed = status
+			}
+		}
+		if failed != nil {
+			break
+		}
+	}
+
+	if failed == nil {
+		return nil
+	}
+
+	for _, status := range statuses {
+		if status.Status == "pending" {
+			status.Status = "skipped"
+			status.Message = fmt.Sprintf("halted after %s failed", failed.Region)
+		}
+	}
+	job.logf("✗ Region %s failed, halting remaining waves", failed.Region)
+
+	if policy == OnFailureRollback {
+		for _, status := range statuses {
+			if status.Status == "success" {
+				do.rollbackRegion(ctx, req, status)
+				job.logf("[%s] ↺ Rolled back to previous version", status.Region)
+			}
+		}
+	}
+
+	return fmt.Errorf("region %s failed: %s", failed.Region, failed.Message)
+}
+
+func (do *DeploymentOrchestrator) deployRegion(ctx context.Context, req *DeploymentRequest, job *DeploymentJob, status *RegionStatus) {
+	start := time.Now()
+	defer func() { status.Duration = time.Since(start).Seconds() }()
+
+	regionReq := *req
+	regionReq.Config = make(map[string]interface{}, len(req.Config)+2)
+	for key, value := range req.Config {
+		regionReq.Config[key] = value
+	}
+	regionReq.Config["region"] = status.Region
+	if status.Cluster != "" {
+		regionReq.Config["cluster"] = status.Cluster
+	}
+
+	regionJob := &DeploymentJob{
+		ID:         fmt.Sprintf("%s/%s", req.DeploymentID, status.Region),
+		Status:     "in_progress",
+		StartTime:  start,
+		Logs:       make([]string, 0),
+		gate:       job.gate,
+		checkpoint: job.checkpoint,
+	}
+	status.Status = "in_progress"
+
+	if err := do.runStrategy(ctx, &regionReq, regionJob); err != nil {
+		status.Status = "failed"
+		status.Message = err.Error()
+		status.Logs = regionJob.logs()
+		return
+	}
+
+	if err := checkRegionHealth(ctx, status.healthCheckURL); err != nil {
+		regionJob.logf("✗ Health gate failed: %v", err)
+		status.Status = "failed"
+		status.Message = err.Error()
+		status.Logs = regionJob.logs()
+		return
+	}
+	regionJob.logf("✓ Health gate passed")
+
+	status.Status = "success"
+	status.Logs = regionJob.logs()
+}
+
+func (do *DeploymentOrchestrator) rollbackRegion(ctx context.Context, req *DeploymentRequest, status *RegionStatus) {
+	steps := []string{
+		"Restoring previous version",
+		"Verifying previous version health",
+	}
+	for _, step := range steps {
+		status.Logs = append(status.Logs, fmt.Sprintf("↺ %s", step))
+		time.Sleep(50 * time.Millisecond) // Simulate work
+	}
+	status.Status = "rolled_back"
+}
+
+// checkRegionHealth gates a region on its health check URL returning 2xx, when one is configured
+func checkRegionHealth(ctx context.Context, healthCheckURL string) error {
+	if healthCheckURL == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthCheckURL, nil)
+	if err != nil {
+		return fmt.Errorf("invalid health check URL: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("health check request failed: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("health check returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// regionWaves groups the request's regions into execution order
+func regionWaves(req *DeploymentRequest) [][]*RegionStatus {
+	if req.RegionOrdering != OrderingWaves {
+		waves := make([][]*RegionStatus, 0, len(req.Regions))
+		for i, target := range req.Regions {
+			waves = append(waves, []*RegionStatus{newRegionStatus(target, i+1)})
+		}
+		return waves
+	}
+
+	byWave := make(map[int][]*RegionStatus)
+	for _, target := range req.Regions {
+		byWave[target.Wave] = append(byWave[target.Wave], newRegionStatus(target, target.Wave))
+	}
+	numbers := make([]int, 0, len(byWave))
+	for number := range byWave {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	waves := make([][]*RegionStatus, 0, len(numbers))
+	for _, number := range numbers {
+		waves = append(waves, byWave[number])
+	}
+	return waves
+}
+
+func newRegionStatus(target RegionTarget, wave int) *RegionStatus {
+	return &RegionStatus{
+		Region:  target.Region,
+		Cluster: target.Cluster,
+		Wave:    wave,
+		Status:  "pending",
+		Logs:    make([]string, 0),
+
+		healthCheckURL: target.HealthCheckURL,
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Step retry policies with exponential backoff
+type ErrorClass string
+
+const (
+	ErrorImagePull  ErrorClass = "image_pull"
+	ErrorThrottling ErrorClass = "throttling"
+	ErrorTimeout    ErrorClass = "timeout"
+	ErrorNetwork    ErrorClass = "network"
+	ErrorPermanent  ErrorClass = "permanent"
+)
+
+type RetryPolicy struct {
+	MaxAttempts      int          `json:"max_attempts,omitempty"`       // including the first, default 3
+	InitialBackoffMs int          `json:"initial_backoff_ms,omitempty"` // default 1000
+	MaxBackoffMs     int          `json:"max_backoff_ms,omitempty"`     // default 30000
+	Multiplier       float64      `json:"multiplier,omitempty"`         // default 2
+	RetryableErrors  []ErrorClass `json:"retryable_errors,omitempty"`   // default all transient classes
+}
+
+// StepError lets a step report its error class explicitly instead of relying on message matching
+type StepError struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *StepError) Error() string { return e.Err.Error() }
+func (e *StepError) Unwrap() error { return e.Err }
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts:      3,
+	InitialBackoffMs: 1000,
+	MaxBackoffMs:     30000,
+	Multiplier:       2,
+	RetryableErrors:  []ErrorClass{ErrorImagePull, ErrorThrottling, ErrorTimeout, ErrorNetwork},
+}
+
+// runStep executes one strategy step under the retry policy configured for it, logging every
+// retry to the job. step is the policy key (e.g. "deploy", "switch_traffic").
+func (do *DeploymentOrchestrator) runStep(ctx context.Context, req *DeploymentRequest, job *DeploymentJob, step, description string, fn func(context.Context) error) error {
+	// Steps an interrupted execution of this deployment already completed are not repeated
+	id := job.checkpoint.stepID(job, description)
+	if job.checkpoint.done(id) {
+		job.logf("↷ %s (completed before interruption)", description)
+		return nil
+	}
+
+	if err := job.gate.wait(ctx, job, req.pauseTimeout()); err != nil {
+		job.logf("✗ %s: %v", description, err)
+		return err
+	}
+
+	policy := req.retryPolicy(step)
+
+	var err error
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		if err = fn(ctx); err == nil {
+			job.checkpoint.record(id)
+			job.logf("✓ %s", description)
+			return nil
+		}
+
+		class := classifyError(err)
+		if !policy.retryable(class) || attempt == policy.MaxAttempts {
+			break
+		}
+
+		backoff := policy.backoff(attempt)
+		job.logf("↻ %s failed (%s: %v), retrying in %s (attempt %d/%d)",
+			description, class, err, backoff, attempt+1, policy.MaxAttempts)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+
+	job.logf("✗ %s: %v", description, err)
+	return fmt.Errorf("%s: %w", description, err)
+}
+
+// retryPolicy merges the step's policy over the request default and built-in defaults
+func (req *DeploymentRequest) retryPolicy(step string) RetryPolicy {
+	policy := defaultRetryPolicy
+	for _, override := range []*RetryPolicy{req.RetryPolicy, req.StepRetryPolicies[step]} {
+		if override == nil {
+			continue
+		}
+		if override.MaxAttempts > 0 {
+			policy.MaxAttempts = override.MaxAttempts
+		}
+		if override.InitialBackoffMs > 0 {
+			policy.InitialBackoffMs = override.InitialBackoffMs
+		}
+		if override.MaxBackoffMs > 0 {
+			policy.MaxBackoffMs = override.MaxBackoffMs
+		}
+		if override.Multiplier > 0 {
+			policy.Multiplier = override.Multiplier
+		}
+		if len(override.RetryableErrors) > 0 {
+			policy.RetryableErrors = override.RetryableErrors
+		}
+	}
+	return policy
+}
+
+func (p RetryPolicy) retryable(class ErrorClass) bool {
+	for _, retryable := range p.RetryableErrors {
+		if retryable == class {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the wait before the attempt following the given one
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := float64(p.InitialBackoffMs)
+	for i := 1; i < attempt; i++ {
+		backoff *= p.Multiplier
+	}
+	if backoff > float64(p.MaxBackoffMs) {
+		backoff = float64(p.MaxBackoffMs)
+	}
+	return time.Duration(backoff) * time.Millisecond
+}
+
+func classifyError(err error) ErrorClass {
+	var stepErr *StepError
+	if errors.As(err, &stepErr) {
+		return stepErr.Class
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorTimeout
+	}
+
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "imagepullbackoff"), strings.Contains(msg, "errimagepull"), strings.Contains(msg, "pull image"):
+		return ErrorImagePull
+	case strings.Contains(msg, "throttl"), strings.Contains(msg, "rate exceeded"), strings.Contains(msg, "too many requests"), strings.Contains(msg, "429"):
+		return ErrorThrottling
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "timed out"):
+		return ErrorTimeout
+	case strings.Contains(msg, "connection refused"), strings.Contains(msg, "connection reset"), strings.Contains(msg, "no such host"):
+		return ErrorNetwork
+	}
+	return ErrorPermanent
+}
+
+// simulateStep stands in for a real platform call
+func simulateStep(duration time.Duration) func(context.Context) error {
+	return func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(duration):
+			return nil
+		}
+	}
+}
@@ -0,0 +1,843 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// Disaster Recovery Runbooks
+type RunbookStepType string
+
+const (
+	StepFailover      RunbookStepType = "failover"
+	StepDNSChange     RunbookStepType = "dns_change"
+	StepDataRestore   RunbookStepType = "data_restore"
+	StepVerification  RunbookStepType = "verification"
+	StepCommunication RunbookStepType = "communication"
+)
+
+// Runbook settings
+const (
+	runbookGenerationTimeout = 5 * time.Minute
+	runbookGenerationTTL     = 24 * time.Hour
+	runbookDecisionPoll      = 2 * time.Second
+)
+
+// A confirmation checkpoint lives in a Redis hash per execution (waiting, then approved and
+// decided_by once an operator answers), so a confirm or abort can land on any replica while the
+// replica running the execution polls for it. decideScript refuses executions that are not
+// waiting or already have an answer; ARGV is approved (1 or 0) and user.
+var decideScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], 'waiting') == 0 then
+  return 'execution is not awaiting confirmation'
+end
+if redis.call('HEXISTS', KEYS[1], 'decided_by') == 1 then
+  return 'a decision is already pending for this execution'
+end
+redis.call('HSET', KEYS[1], 'approved', ARGV[1], 'decided_by', ARGV[2])
+return ''
+`)
+
+// takeDecisionScript returns and clears the answer to a checkpoint, or nil if there is none yet.
+// With ARGV[1] set to 1 it also closes an unanswered checkpoint, so later decisions are refused.
+var takeDecisionScript = redis.NewScript(`
+local decision = redis.call('HMGET', KEYS[1], 'approved', 'decided_by')
+if decision[2] then
+  redis.call('DEL', KEYS[1])
+  return decision
+end
+if ARGV[1] == '1' then
+  redis.call('DEL', KEYS[1])
+end
+return false
+`)
+
+type RunbookRequest struct {
+	ApplicationName string        `json:"application_name" binding:"required"`
+	Environment     Environment   `json:"environment"`
+	CloudProvider   CloudProvider `json:"cloud_provider"`
+	PrimaryRegion   string        `json:"primary_region"`
+	FailoverRegion  string        `json:"failover_region"`
+	Components      []string      `json:"components"` // e.g. "postgres", "redis", "route53:example.com"
+	RTOMinutes      int           `json:"rto_minutes"`
+	RPOMinutes      int           `json:"rpo_minutes"`
+}
+
+type RunbookStep struct {
+	Order                int             `json:"order"`
+	Name                 string          `json:"name"`
+	Type                 RunbookStepType `json:"type"`
+	Description          string          `json:"description"`
+	Command              string          `json:"command,omitempty"`
+	RollbackCommand      string          `json:"rollback_command,omitempty"`
+	RequiresConfirmation bool            `json:"requires_confirmation"`
+	TimeoutSeconds       int             `json:"timeout_seconds"`
+}
+
+type DRRunbook struct {
+	ApplicationName string        `json:"application_name"`
+	Version         int           `json:"version"`
+	Environment     Environment   `json:"environment"`
+	CloudProvider   CloudProvider `json:"cloud_provider"`
+	PrimaryRegion   string        `json:"primary_region"`
+	FailoverRegion  string        `json:"failover_region"`
+	RTOMinutes      int           `json:"rto_minutes"`
+	RPOMinutes      int           `json:"rpo_minutes"`
+	Summary         string        `json:"summary"`
+	Steps           []RunbookStep `json:"steps"`
+	Source          string        `json:"source"` // "claude" or "template"
+	GeneratedAt     time.Time     `json:"generated_at"`
+}
+
+type RunbookExecutionRequest struct {
+	Version    int    `json:"version,omitempty"` // 0 selects the latest version
+	IncidentID string `json:"incident_id"`
+	DryRun     bool   `json:"dry_run,omitempty"`
+
+	// A step left unconfirmed for longer than this aborts the execution (default 30 minutes)
+	ConfirmationTimeoutSeconds int `json:"confirmation_timeout_seconds,omitempty"`
+}
+
+type RunbookStepResult struct {
+	Order       int       `json:"order"`
+	Name        string    `json:"name"`
+	Status      string    `json:"status"` // "success", "failed", "skipped"
+	Output      string    `json:"output,omitempty"`
+	ConfirmedBy string    `json:"confirmed_by,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	Duration    float64   `json:"duration_seconds"`
+}
+
+type RunbookExecution struct {
+	ExecutionID     string              `json:"execution_id"`
+	ApplicationName string              `json:"application_name"`
+	RunbookVersion  int                 `json:"runbook_version"`
+	IncidentID      string              `json:"incident_id,omitempty"`
+	DryRun          bool                `json:"dry_run"`
+	Status          string              `json:"status"` // "running", "awaiting_confirmation", "completed", "failed", "aborted"
+	CurrentStep     int                 `json:"current_step"`
+	ConfirmBy       *time.Time          `json:"confirm_by,omitempty"` // when an unconfirmed step aborts the execution
+	StepResults     []RunbookStepResult `json:"step_results"`
+	Logs            []string            `json:"logs"`
+	StartedAt       time.Time           `json:"started_at"`
+	CompletedAt     *time.Time          `json:"completed_at,omitempty"`
+}
+
+// RunbookGeneration tracks a runbook Claude is writing in the background; Runbook is set once
+// the generation completes
+type RunbookGeneration struct {
+	GenerationID    string     `json:"generation_id"`
+	ApplicationName string     `json:"application_name"`
+	Status          string     `json:"status"` // "generating", "completed", "failed"
+	Runbook         *DRRunbook `json:"runbook,omitempty"`
+	Error           string     `json:"error,omitempty"`
+	RequestedAt     time.Time  `json:"requested_at"`
+	CompletedAt     *time.Time `json:"completed_at,omitempty"`
+}
+
+type RunbookVersionsResponse struct {
+	ApplicationName string `json:"application_name"`
+	Versions        []int  `json:"versions"`
+}
+
+// RunbookDecisionRequest names the operator when RBAC is disabled; with RBAC the authenticated
+// principal is recorded instead
+type RunbookDecisionRequest struct {
+	User string `json:"user,omitempty"`
+}
+
+type RunbookDecisionResponse struct {
+	ExecutionID string `json:"execution_id"`
+	Approved    bool   `json:"approved"`
+}
+
+type runbookDecision struct {
+	approved bool
+	user     string
+}
+
+type RunbookManager struct {
+	redis        *redis.Client
+	claudeClient *ClaudeClient
+	mu           sync.RWMutex
+	executions   map[string]*RunbookExecution
+}
+
+func NewRunbookManager(redisClient *redis.Client, claudeClient *ClaudeClient) *RunbookManager {
+	return &RunbookManager{
+		redis:        redisClient,
+		claudeClient: claudeClient,
+		executions:   make(map[string]*RunbookExecution),
+	}
+}
+
+// StartGeneration records a pending generation and writes the runbook in the background, since
+// Claude takes longer to answer than an API request may stay open
+func (rm *RunbookManager) StartGeneration(ctx context.Context, req *RunbookRequest) (*RunbookGeneration, error) {
+	generation := &RunbookGeneration{
+		GenerationID:    fmt.Sprintf("drgen_%d", time.Now().UnixNano()),
+		ApplicationName: req.ApplicationName,
+		Status:          "generating",
+		RequestedAt:     time.Now(),
+	}
+	if err := rm.saveGeneration(ctx, generation); err != nil {
+		return nil, err
+	}
+
+	go rm.runGeneration(generation, req)
+
+	return generation, nil
+}
+
+func (rm *RunbookManager) runGeneration(generation *RunbookGeneration, req *RunbookRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), runbookGenerationTimeout)
+	defer cancel()
+
+	runbook, err := rm.GenerateRunbook(ctx, req)
+	now := time.Now()
+	generation.CompletedAt = &now
+	if err != nil {
+		generation.Status = "failed"
+		generation.Error = err.Error()
+	} else {
+		generation.Status = "completed"
+		generation.Runbook = runbook
+	}
+
+	if err := rm.saveGeneration(context.Background(), generation); err != nil {
+		log.Printf("Failed to record runbook generation %s: %v", generation.GenerationID, err)
+	}
+}
+
+// GetGeneration returns a runbook generation, or nil if it is unknown or has expired
+func (rm *RunbookManager) GetGeneration(ctx context.Context, generationID string) (*RunbookGeneration, error) {
+	data, err := rm.redis.Get(ctx, fmt.Sprintf("runbook_generation:%s", generationID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get runbook generation: %w", err)
+	}
+
+	var generation RunbookGeneration
+	if err := json.Unmarshal(data, &generation); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal runbook generation: %w", err)
+	}
+	return &generation, nil
+}
+
+func (rm *RunbookManager) saveGeneration(ctx context.Context, generation *RunbookGeneration) error {
+	data, err := json.Marshal(generation)
+	if err != nil {
+		return fmt.Errorf("failed to marshal runbook generation: %w", err)
+	}
+	if err := rm.redis.Set(ctx, fmt.Sprintf("runbook_generation:%s", generation.GenerationID), data, runbookGenerationTTL).Err(); err != nil {
+		return fmt.Errorf("failed to save runbook generation: %w", err)
+	}
+	return nil
+}
+
+// GenerateRunbook asks Claude for a runbook and stores it as the next version for the application
+func (rm *RunbookManager) GenerateRunbook(ctx context.Context, req *RunbookRequest) (*DRRunbook, error) {
+	runbook, err := rm.claudeClient.GenerateDRRunbook(ctx, req)
+	if err != nil {
+		log.Printf("Claude runbook generation failed, using template: %v", err)
+		runbook = templateDRRunbook(req)
+	}
+
+	version, err := rm.redis.Incr(ctx, fmt.Sprintf("runbook:%s:version", req.ApplicationName)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate runbook version: %w", err)
+	}
+	runbook.Version = int(version)
+	runbook.GeneratedAt = time.Now()
+
+	data, err := json.Marshal(runbook)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal runbook: %w", err)
+	}
+	if err := rm.redis.Set(ctx, rm.runbookKey(req.ApplicationName, runbook.Version), data, 0).Err(); err != nil {
+		return nil, fmt.Errorf("failed to store runbook: %w", err)
+	}
+
+	return runbook, nil
+}
+
+// GetRunbook loads a stored runbook version; version 0 returns the latest
+func (rm *RunbookManager) GetRunbook(ctx context.Context, application string, version int) (*DRRunbook, error) {
+	if version == 0 {
+		latest, err := rm.redis.Get(ctx, fmt.Sprintf("runbook:%s:version", application)).Int()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get latest runbook version: %w", err)
+		}
+		version = latest
+	}
+
+	data, err := rm.redis.Get(ctx, rm.runbookKey(application, version)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get runbook: %w", err)
+	}
+
+	var runbook DRRunbook
+	if err := json.Unmarshal(data, &runbook); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal runbook: %w", err)
+	}
+
+	return &runbook, nil
+}
+
+// ListVersions returns the stored version numbers for an application, oldest first
+func (rm *RunbookManager) ListVersions(ctx context.Context, application string) ([]int, error) {
+	latest, err := rm.redis.Get(ctx, fmt.Sprintf("runbook:%s:version", application)).Int()
+	if err == redis.Nil {
+		return []int{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest runbook version: %w", err)
+	}
+
+	versions := make([]int, 0, latest)
+	for v := 1; v <= latest; v++ {
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// StartExecution begins running a runbook in the background and returns the execution record
+func (rm *RunbookManager) StartExecution(ctx context.Context, application string, req *RunbookExecutionRequest) (*RunbookExecution, error) {
+	runbook, err := rm.GetRunbook(ctx, application, req.Version)
+	if err != nil {
+		return nil, err
+	}
+	if runbook == nil {
+		return nil, fmt.Errorf("no runbook found for %s", application)
+	}
+
+	execution := &RunbookExecution{
+		ExecutionID:     fmt.Sprintf("drexec_%d", time.Now().UnixNano()),
+		ApplicationName: application,
+		RunbookVersion:  runbook.Version,
+		IncidentID:      req.IncidentID,
+		DryRun:          req.DryRun,
+		Status:          "running",
+		StepResults:     make([]RunbookStepResult, 0, len(runbook.Steps)),
+		Logs:            make([]string, 0),
+		StartedAt:       time.Now(),
+	}
+
+	rm.mu.Lock()
+	rm.executions[execution.ExecutionID] = execution
+	rm.mu.Unlock()
+
+	go rm.runExecution(execution, runbook, req.confirmationTimeout())
+
+	return rm.snapshot(execution), nil
+}
+
+func (req *RunbookExecutionRequest) confirmationTimeout() time.Duration {
+	if req.ConfirmationTimeoutSeconds > 0 {
+		return time.Duration(req.ConfirmationTimeoutSeconds) * time.Second
+	}
+	return config.RunbookConfirmationTimeout
+}
+
+// needsConfirmation reports whether an operator must approve the step before it runs. Steps with
+// a command always do, whatever the runbook says, because Claude wrote the command.
+func (step RunbookStep) needsConfirmation() bool {
+	return step.RequiresConfirmation || step.Command != ""
+}
+
+func (rm *RunbookManager) runExecution(execution *RunbookExecution, runbook *DRRunbook, confirmationTimeout time.Duration) {
+	ctx := context.Background()
+	rm.appendLog(execution, fmt.Sprintf("Executing DR runbook v%d for %s", runbook.Version, runbook.ApplicationName))
+	if execution.DryRun {
+		rm.appendLog(execution, "DRY RUN MODE - Commands will be logged but not executed")
+	}
+
+	for _, step := range runbook.Steps {
+		rm.mu.Lock()
+		execution.CurrentStep = step.Order
+		rm.mu.Unlock()
+
+		result := RunbookStepResult{
+			Order:     step.Order,
+			Name:      step.Name,
+			StartedAt: time.Now(),
+		}
+
+		if step.needsConfirmation() {
+			confirmBy := time.Now().Add(confirmationTimeout)
+			rm.mu.Lock()
+			execution.Status = "awaiting_confirmation"
+			execution.ConfirmBy = &confirmBy
+			rm.mu.Unlock()
+			rm.appendLog(execution, fmt.Sprintf("⏸ Step %d (%s) awaiting operator confirmation (auto-abort at %s)", step.Order, step.Name, confirmBy.Format(time.RFC3339)))
+			rm.persistExecution(ctx, execution)
+
+			decision, decided, err := rm.awaitDecision(ctx, execution, step.Order, confirmationTimeout)
+			if err != nil {
+				result.Status = "skipped"
+				rm.recordStep(execution, result)
+				rm.appendLog(execution, fmt.Sprintf("✗ Execution aborted: %v", err))
+				rm.finish(ctx, execution, "aborted")
+				return
+			}
+			if !decided {
+				result.Status = "skipped"
+				rm.recordStep(execution, result)
+				rm.appendLog(execution, fmt.Sprintf("✗ Execution aborted: step %d was not confirmed within %s", step.Order, confirmationTimeout))
+				rm.finish(ctx, execution, "aborted")
+				return
+			}
+			if !decision.approved {
+				result.Status = "skipped"
+				result.ConfirmedBy = decision.user
+				rm.recordStep(execution, result)
+				rm.appendLog(execution, fmt.Sprintf("✗ Execution aborted by %s at step %d", decision.user, step.Order))
+				rm.finish(ctx, execution, "aborted")
+				return
+			}
+			result.ConfirmedBy = decision.user
+			rm.mu.Lock()
+			execution.Status = "running"
+			execution.ConfirmBy = nil
+			rm.mu.Unlock()
+			rm.appendLog(execution, fmt.Sprintf("Step %d confirmed by %s", step.Order, decision.user))
+		}
+
+		output, err := rm.executeStep(ctx, step, execution.DryRun)
+		result.Output = output
+		result.Duration = time.Since(result.StartedAt).Seconds()
+
+		if err != nil {
+			result.Status = "failed"
+			rm.recordStep(execution, result)
+			rm.appendLog(execution, fmt.Sprintf("✗ Step %d (%s) failed: %v", step.Order, step.Name, err))
+			rm.finish(ctx, execution, "failed")
+			return
+		}
+
+		result.Status = "success"
+		rm.recordStep(execution, result)
+		rm.appendLog(execution, fmt.Sprintf("✓ %s", step.Name))
+		rm.persistExecution(ctx, execution)
+	}
+
+	rm.finish(ctx, execution, "completed")
+}
+
+func (rm *RunbookManager) executeStep(ctx context.Context, step RunbookStep, dryRun bool) (string, error) {
+	if step.Command == "" {
+		return "manual step - no command", nil
+	}
+	if dryRun {
+		return fmt.Sprintf("would run: %s", step.Command), nil
+	}
+
+	timeout := time.Duration(step.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Minute
+	}
+	stepCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(stepCtx, config.RunbookShell, "-c", step.Command).CombinedOutput()
+	return string(output), err
+}
+
+// awaitDecision opens a confirmation checkpoint for the step and polls it until an operator
+// confirms or aborts. It reports false when timeout passes without a decision, after which Decide
+// refuses new ones.
+func (rm *RunbookManager) awaitDecision(ctx context.Context, execution *RunbookExecution, step int, timeout time.Duration) (runbookDecision, bool, error) {
+	key := runbookDecisionKey(execution.ExecutionID)
+	pipe := rm.redis.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.HSet(ctx, key, "waiting", step)
+	pipe.Expire(ctx, key, timeout+time.Minute)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return runbookDecision{}, false, fmt.Errorf("failed to open confirmation checkpoint: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		expired := !time.Now().Before(deadline)
+		decision, decided, err := rm.takeDecision(ctx, key, expired)
+		if err != nil {
+			return runbookDecision{}, false, err
+		}
+		if decided || expired {
+			return decision, decided, nil
+		}
+
+		wait := runbookDecisionPoll
+		if remaining := time.Until(deadline); remaining < wait {
+			wait = remaining
+		}
+		time.Sleep(wait)
+	}
+}
+
+func (rm *RunbookManager) takeDecision(ctx context.Context, key string, expired bool) (runbookDecision, bool, error) {
+	closing := "0"
+	if expired {
+		closing = "1"
+	}
+	values, err := takeDecisionScript.Run(ctx, rm.redis, []string{key}, closing).Slice()
+	if err == redis.Nil {
+		return runbookDecision{}, false, nil
+	}
+	if err != nil {
+		return runbookDecision{}, false, fmt.Errorf("failed to read confirmation decision: %w", err)
+	}
+	approved, _ := values[0].(string)
+	user, _ := values[1].(string)
+	return runbookDecision{approved: approved == "1", user: user}, true, nil
+}
+
+// Decide records an operator confirmation or abort for an execution waiting on a checkpoint, on
+// whichever replica runs it
+func (rm *RunbookManager) Decide(ctx context.Context, executionID string, approved bool, user string) error {
+	value := "0"
+	if approved {
+		value = "1"
+	}
+	refusal, err := decideScript.Run(ctx, rm.redis, []string{runbookDecisionKey(executionID)}, value, user).Text()
+	if err != nil {
+		return fmt.Errorf("failed to record decision: %w", err)
+	}
+	if refusal != "" {
+		return controlConflict(refusal)
+	}
+	return nil
+}
+
+func runbookDecisionKey(executionID string) string {
+	return fmt.Sprintf("runbook_decision:%s", executionID)
+}
+
+// GetExecution returns the live execution state, falling back to the persisted copy
+func (rm *RunbookManager) GetExecution(ctx context.Context, executionID string) (*RunbookExecution, error) {
+	rm.mu.RLock()
+	execution, ok := rm.executions[executionID]
+	rm.mu.RUnlock()
+	if ok {
+		return rm.snapshot(execution), nil
+	}
+
+	data, err := rm.redis.Get(ctx, fmt.Sprintf("runbook_execution:%s", executionID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get execution: %w", err)
+	}
+
+	var stored RunbookExecution
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal execution: %w", err)
+	}
+	return &stored, nil
+}
+
+func (rm *RunbookManager) appendLog(execution *RunbookExecution, line string) {
+	rm.mu.Lock()
+	execution.Logs = append(execution.Logs, line)
+	rm.mu.Unlock()
+}
+
+func (rm *RunbookManager) recordStep(execution *RunbookExecution, result RunbookStepResult) {
+	rm.mu.Lock()
+	execution.StepResults = append(execution.StepResults, result)
+	rm.mu.Unlock()
+}
+
+func (rm *RunbookManager) finish(ctx context.Context, execution *RunbookExecution, status string) {
+	now := time.Now()
+	rm.mu.Lock()
+	execution.Status = status
+	execution.CompletedAt = &now
+	execution.ConfirmBy = nil
+	rm.mu.Unlock()
+
+	// Once persisted, GetExecution serves the finished execution from Redis
+	if err := rm.persistExecution(ctx, execution); err != nil {
+		return
+	}
+	rm.mu.Lock()
+	delete(rm.executions, execution.ExecutionID)
+	rm.mu.Unlock()
+}
+
+func (rm *RunbookManager) snapshot(execution *RunbookExecution) *RunbookExecution {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	copied := *execution
+	copied.StepResults = append([]RunbookStepResult(nil), execution.StepResults...)
+	copied.Logs = append([]string(nil), execution.Logs...)
+	return &copied
+}
+
+func (rm *RunbookManager) persistExecution(ctx context.Context, execution *RunbookExecution) error {
+	data, err := json.Marshal(rm.snapshot(execution))
+	if err != nil {
+		log.Printf("Failed to marshal runbook execution: %v", err)
+		return err
+	}
+
+	cacheKey := fmt.Sprintf("runbook_execution:%s", execution.ExecutionID)
+	if err := rm.redis.Set(ctx, cacheKey, data, 30*24*time.Hour).Err(); err != nil {
+		log.Printf("Failed to persist runbook execution: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (rm *RunbookManager) runbookKey(application string, version int) string {
+	return fmt.Sprintf("runbook:%s:v%d", application, version)
+}
+
+// templateDRRunbook builds a conservative runbook when Claude is unavailable
+func templateDRRunbook(req *RunbookRequest) *DRRunbook {
+	steps := []RunbookStep{
+		{Name: "Declare incident and notify stakeholders", Type: StepCommunication, Description: "Open the incident channel and page the on-call owner", RequiresConfirmation: true},
+		{Name: "Freeze deployments", Type: StepFailover, Description: "Block new deployments for the application until recovery completes"},
+		{Name: fmt.Sprintf("Scale up standby in %s", req.FailoverRegion), Type: StepFailover, Description: "Bring failover capacity to production size", RequiresConfirmation: true},
+	}
+	for _, component := range req.Components {
+		steps = append(steps, RunbookStep{
+			Name:                 fmt.Sprintf("Restore %s from latest backup", component),
+			Type:                 StepDataRestore,
+			Description:          fmt.Sprintf("Restore %s to a point within the %d minute RPO", component, req.RPOMinutes),
+			RequiresConfirmation: true,
+		})
+	}
+	steps = append(steps,
+		RunbookStep{Name: "Verify failover health", Type: StepVerification, Description: "Confirm health checks and error rates in the failover region"},
+		RunbookStep{Name: "Switch DNS to failover region", Type: StepDNSChange, Description: "Update DNS records to point at the failover endpoints", RequiresConfirmation: true},
+		RunbookStep{Name: "Post recovery status", Type: StepCommunication, Description: "Announce recovery and schedule the postmortem"},
+	)
+	for i := range steps {
+		steps[i].Order = i + 1
+	}
+
+	return &DRRunbook{
+		ApplicationName: req.ApplicationName,
+		Environment:     req.Environment,
+		CloudProvider:   req.CloudProvider,
+		PrimaryRegion:   req.PrimaryRegion,
+		FailoverRegion:  req.FailoverRegion,
+		RTOMinutes:      req.RTOMinutes,
+		RPOMinutes:      req.RPOMinutes,
+		Summary:         fmt.Sprintf("Fail %s over from %s to %s", req.ApplicationName, req.PrimaryRegion, req.FailoverRegion),
+		Steps:           steps,
+		Source:          "template",
+	}
+}
+
+// GenerateDRRunbook asks Claude for a structured disaster-recovery runbook
+func (c *ClaudeClient) GenerateDRRunbook(ctx context.Context, req *RunbookRequest) (*DRRunbook, error) {
+	reqJSON, _ := json.MarshalIndent(req, "", "  ")
+
+	prompt := fmt.Sprintf(`Write a disaster-recovery runbook for this application:
+
+%s
+
+Respond with JSON only:
+{
+  "summary": "One paragraph recovery strategy",
+  "steps": [
+    {
+      "name": "Short step name",
+      "type": "failover|dns_change|data_restore|verification|communication",
+      "description": "What the operator does and why",
+      "command": "Shell command to run, or empty for manual steps",
+      "rollback_command": "Command that reverses the step, or empty",
+      "requires_confirmation": true,
+      "timeout_seconds": 300
+    }
+  ]
+}
+
+Order the steps as they must be executed. Require confirmation before any destructive,
+traffic-shifting, or data-restore step; every step with a command is confirmed before it runs. Meet an RTO of %d minutes and an RPO of %d minutes.`,
+		string(reqJSON), req.RTOMinutes, req.RPOMinutes)
+
+	text, err := c.complete(ctx, "You are a senior site reliability engineer writing disaster-recovery runbooks.", prompt, 4000)
+	if err != nil {
+		return nil, err
+	}
+
+	var generated struct {
+		Summary string        `json:"summary"`
+		Steps   []RunbookStep `json:"steps"`
+	}
+	if err := json.Unmarshal([]byte(extractJSON(text)), &generated); err != nil {
+		return nil, fmt.Errorf("failed to parse runbook: %w", err)
+	}
+	if len(generated.Steps) == 0 {
+		return nil, fmt.Errorf("claude returned a runbook without steps")
+	}
+	for i := range generated.Steps {
+		generated.Steps[i].Order = i + 1
+		generated.Steps[i].RequiresConfirmation = generated.Steps[i].needsConfirmation()
+	}
+
+	return &DRRunbook{
+		ApplicationName: req.ApplicationName,
+		Environment:     req.Environment,
+		CloudProvider:   req.CloudProvider,
+		PrimaryRegion:   req.PrimaryRegion,
+		FailoverRegion:  req.FailoverRegion,
+		RTOMinutes:      req.RTOMinutes,
+		RPOMinutes:      req.RPOMinutes,
+		Summary:         generated.Summary,
+		Steps:           generated.Steps,
+		Source:          "claude",
+	}, nil
+}
+
+// Runbook HTTP handlers
+func (s *APIServer) generateRunbookHandler(c *gin.Context) {
+	var req RunbookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	generation, err := s.runbookManager.StartGeneration(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, generation)
+}
+
+func (s *APIServer) getRunbookGenerationHandler(c *gin.Context) {
+	generation, err := s.runbookManager.GetGeneration(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if generation == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "runbook generation not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, generation)
+}
+
+func (s *APIServer) getRunbookHandler(c *gin.Context) {
+	version := 0
+	if v := c.Query("version"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "version must be an integer"})
+			return
+		}
+		version = parsed
+	}
+
+	runbook, err := s.runbookManager.GetRunbook(c.Request.Context(), c.Param("app"), version)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if runbook == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "runbook not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, runbook)
+}
+
+func (s *APIServer) listRunbookVersionsHandler(c *gin.Context) {
+	app := c.Param("app")
+	versions, err := s.runbookManager.ListVersions(c.Request.Context(), app)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, RunbookVersionsResponse{
+		ApplicationName: app,
+		Versions:        versions,
+	})
+}
+
+func (s *APIServer) executeRunbookHandler(c *gin.Context) {
+	var req RunbookExecutionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	execution, err := s.runbookManager.StartExecution(c.Request.Context(), c.Param("app"), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, execution)
+}
+
+func (s *APIServer) getRunbookExecutionHandler(c *gin.Context) {
+	execution, err := s.runbookManager.GetExecution(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if execution == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "execution not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, execution)
+}
+
+func (s *APIServer) decideRunbookStepHandler(approved bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body RunbookDecisionRequest
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&body); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		if s.rbac.Enabled() || body.User == "" {
+			body.User = principal(c)
+		}
+
+		err := s.runbookManager.Decide(c.Request.Context(), c.Param("id"), approved, body.User)
+		var conflict controlConflict
+		if errors.As(err, &conflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, RunbookDecisionResponse{ExecutionID: c.Param("id"), Approved: approved})
+	}
+}
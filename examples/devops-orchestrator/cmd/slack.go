@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Slack Web API client
+type SlackClient struct {
+	botToken      string
+	signingSecret string
+	httpClient    *http.Client
+}
+
+func NewSlackClient(botToken, signingSecret string) *SlackClient {
+	return &SlackClient{
+		botToken:      botToken,
+		signingSecret: signingSecret,
+		httpClient:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// VerifySignature checks Slack's v0 request signature and rejects requests older than five minutes
+func (s *SlackClient) VerifySignature(timestamp, signature string, body []byte) error {
+	if s.signingSecret == "" {
+		return fmt.Errorf("slack signing secret not configured")
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid request timestamp")
+	}
+	if math.Abs(float64(time.Now().Unix()-ts)) > 5*60 {
+		return fmt.Errorf("request timestamp too old")
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.signingSecret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("invalid request signature")
+	}
+	return nil
+}
+
+// PostMessage posts to a channel, or into a thread when threadTS is set, and returns the message ts
+func (s *SlackClient) PostMessage(ctx context.Context, channel, threadTS, text string, blocks []interface{}) (string, error) {
+	payload := map[string]interface{}{
+		"channel": channel,
+		"text":    text,
+	}
+	if threadTS != "" {
+		payload["thread_ts"] = threadTS
+	}
+	if blocks != nil {
+		payload["blocks"] = blocks
+	}
+
+	var result struct {
+		TS string `json:"ts"`
+	}
+	if err := s.call(ctx, "chat.postMessage", payload, &result); err != nil {
+		return "", err
+	}
+	return result.TS, nil
+}
+
+func (s *SlackClient) UpdateMessage(ctx context.Context, channel, ts, text string, blocks []interface{}) error {
+	payload := map[string]interface{}{
+		"channel": channel,
+		"ts":      ts,
+		"text":    text,
+		"blocks":  blocks,
+	}
+	return s.call(ctx, "chat.update", payload, nil)
+}
+
+// RespondEphemeral replies to a slash command through its response_url
+func (s *SlackClient) RespondEphemeral(ctx context.Context, responseURL, text string) error {
+	body, _ := json.Marshal(map[string]string{"response_type": "ephemeral", "text": text})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, responseURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to respond to slack: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *SlackClient) call(ctx context.Context, method string, payload interface{}, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://slack.com/api/"+method, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+s.botToken)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("slack %s failed: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return fmt.Errorf("failed to decode slack %s response: %w", method, err)
+	}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return fmt.Errorf("failed to decode slack %s response: %w", method, err)
+	}
+	if !envelope.OK {
+		return fmt.Errorf("slack %s returned error: %s", method, envelope.Error)
+	}
+	if out != nil {
+		return json.Unmarshal(raw, out)
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Validation and repair of Claude-generated Terraform
+type TerraformDiagnostic struct {
+	Source   string `json:"source"`   // "init", "validate", or "tflint"
+	Severity string `json:"severity"` // "error" or "warning"
+	Summary  string `json:"summary"`
+	Detail   string `json:"detail,omitempty"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+}
+
+type TerraformValidationAttempt struct {
+	Attempt     int                   `json:"attempt"`
+	Diagnostics []TerraformDiagnostic `json:"diagnostics"`
+}
+
+// TerraformValidationReport records each validation pass over generated code; Claude repaired the
+// code between consecutive attempts
+type TerraformValidationReport struct {
+	Valid    bool                         `json:"valid"`
+	Repairs  int                          `json:"repairs"`
+	TFLint   bool                         `json:"tflint"` // whether tflint ran in addition to terraform validate
+	Attempts []TerraformValidationAttempt `json:"attempts"`
+}
+
+// errTerraformUnavailable is returned when generated code can't be validated; unvalidated code is never run
+var errTerraformUnavailable = errors.New("generated Terraform can't be validated")
+
+// TerraformValidationError is returned when generated code still fails validation after all repairs
+type TerraformValidationError struct {
+	Report *TerraformValidationReport
+}
+
+func (e *TerraformValidationError) Error() string {
+	return fmt.Sprintf("generated Terraform failed validation after %d repair attempt(s)", e.Report.Repairs)
+}
+
+// generateValidTerraform generates code for the request's resources and runs it through terraform
+// init/validate (and tflint when installed), asking Claude to fix any errors up to
+// TERRAFORM_REPAIR_ATTEMPTS times
+func (im *InfrastructureManager) generateValidTerraform(ctx context.Context, req *InfrastructureRequest) (string, *TerraformValidationReport, error) {
+	if err := terraformAvailable(); err != nil {
+		return "", nil, err
+	}
+
+	code, err := im.claudeClient.GenerateTerraformCode(ctx, req.Resources, req.CloudProvider)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate Terraform code: %w", err)
+	}
+
+	report := &TerraformValidationReport{Attempts: make([]TerraformValidationAttempt, 0)}
+
+	for {
+		diagnostics, tflint, err := validateTerraformCode(ctx, code)
+		if err != nil {
+			return "", nil, err
+		}
+		report.TFLint = tflint
+		report.Attempts = append(report.Attempts, TerraformValidationAttempt{
+			Attempt:     len(report.Attempts) + 1,
+			Diagnostics: diagnostics,
+		})
+
+		errs := terraformErrors(diagnostics)
+		if len(errs) == 0 {
+			report.Valid = true
+			return code, report, nil
+		}
+		if report.Repairs >= config.TerraformRepairAttempts {
+			return "", nil, &TerraformValidationError{Report: report}
+		}
+
+		code, err = im.claudeClient.RepairTerraformCode(ctx, code, errs, req.CloudProvider)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to repair Terraform code: %w", err)
+		}
+		report.Repairs++
+	}
+}
+
+// terraformAvailable reports whether generated code can be validated on this host
+func terraformAvailable() error {
+	if _, err := exec.LookPath(config.TerraformBin); err != nil {
+		return fmt.Errorf("%w: %s not found", errTerraformUnavailable, config.TerraformBin)
+	}
+	return nil
+}
+
+// validateTerraformCode runs the validators in a scratch module. Init failures (e.g. an unknown
+// provider) are reported as diagnostics since they are just as repairable as validate errors.
+func validateTerraformCode(ctx context.Context, code string) ([]TerraformDiagnostic, bool, error) {
+	dir, err := os.MkdirTemp("", "terraform-validate-")
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create validation workspace: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.WriteFile(filepath.Join(dir, "main.tf"), []byte(code), 0o600); err != nil {
+		return nil, false, fmt.Errorf("failed to write Terraform code: %w", err)
+	}
+
+	if stdout, stderr, err := runValidator(ctx, dir, config.TerraformBin, "init", "-backend=false", "-input=false", "-no-color"); err != nil {
+		detail := strings.TrimSpace(stderr)
+		if detail == "" {
+			detail = strings.TrimSpace(stdout)
+		}
+		return []TerraformDiagnostic{{
+			Source:   "init",
+			Severity: "error",
+			Summary:  "terraform init failed",
+			Detail:   detail,
+		}}, false, nil
+	}
+
+	diagnostics, err := terraformValidate(ctx, dir)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if _, err := exec.LookPath(config.TFLintBin); err != nil {
+		return diagnostics, false, nil
+	}
+	lint, err := tflint(ctx, dir)
+	if err != nil {
+		return nil, false, err
+	}
+	return append(diagnostics, lint...), true, nil
+}
+
+func terraformValidate(ctx context.Context, dir string) ([]TerraformDiagnostic, error) {
+	// validate exits non-zero for invalid code but still writes its JSON result to stdout
+	stdout, stderr, _ := runValidator(ctx, dir, config.TerraformBin, "validate", "-json", "-no-color")
+
+	var result struct {
+		Diagnostics []struct {
+			Severity string `json:"severity"`
+			Summary  string `json:"summary"`
+			Detail   string `json:"detail"`
+			Range    *struct {
+				Filename string `json:"filename"`
+				Start    struct {
+					Line int `json:"line"`
+				} `json:"start"`
+			} `json:"range"`
+		} `json:"diagnostics"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse terraform validate output: %v: %s", err, strings.TrimSpace(stderr))
+	}
+
+	diagnostics := make([]TerraformDiagnostic, 0, len(result.Diagnostics))
+	for _, d := range result.Diagnostics {
+		diagnostic := TerraformDiagnostic{
+			Source:   "validate",
+			Severity: d.Severity,
+			Summary:  d.Summary,
+			Detail:   d.Detail,
+		}
+		if d.Range != nil {
+			diagnostic.File = d.Range.Filename
+			diagnostic.Line = d.Range.Start.Line
+		}
+		diagnostics = append(diagnostics, diagnostic)
+	}
+	return diagnostics, nil
+}
+
+func tflint(ctx context.Context, dir string) ([]TerraformDiagnostic, error) {
+	// tflint exits non-zero when it finds issues, so only unparseable output is a failure
+	stdout, stderr, _ := runValidator(ctx, dir, config.TFLintBin, "--format=json", "--no-color")
+
+	type tflintRange struct {
+		Filename string `json:"filename"`
+		Start    struct {
+			Line int `json:"line"`
+		} `json:"start"`
+	}
+	var result struct {
+		Issues []struct {
+			Rule struct {
+				Name     string `json:"name"`
+				Severity string `json:"severity"`
+			} `json:"rule"`
+			Message string      `json:"message"`
+			Range   tflintRange `json:"range"`
+		} `json:"issues"`
+		Errors []struct {
+			Message  string       `json:"message"`
+			Severity string       `json:"severity"`
+			Range    *tflintRange `json:"range"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse tflint output: %v: %s", err, strings.TrimSpace(stderr))
+	}
+
+	diagnostics := make([]TerraformDiagnostic, 0, len(result.Issues)+len(result.Errors))
+	for _, issue := range result.Issues {
+		severity := "warning"
+		if issue.Rule.Severity == "error" {
+			severity = "error"
+		}
+		diagnostics = append(diagnostics, TerraformDiagnostic{
+			Source:   "tflint",
+			Severity: severity,
+			Summary:  issue.Rule.Name,
+			Detail:   issue.Message,
+			File:     issue.Range.Filename,
+			Line:     issue.Range.Start.Line,
+		})
+	}
+	for _, e := range result.Errors {
+		diagnostic := TerraformDiagnostic{Source: "tflint", Severity: "error", Summary: e.Message}
+		if e.Range != nil {
+			diagnostic.File = e.Range.Filename
+			diagnostic.Line = e.Range.Start.Line
+		}
+		diagnostics = append(diagnostics, diagnostic)
+	}
+	return diagnostics, nil
+}
+
+func runValidator(ctx context.Context, dir, bin string, args ...string) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "TF_IN_AUTOMATION=1")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+func terraformErrors(diagnostics []TerraformDiagnostic) []TerraformDiagnostic {
+	errs := make([]TerraformDiagnostic, 0)
+	for _, d := range diagnostics {
+		if d.Severity == "error" {
+			errs = append(errs, d)
+		}
+	}
+	return errs
+}
+
+// RepairTerraformCode asks Claude to fix the given validation errors and returns the corrected code
+func (c *ClaudeClient) RepairTerraformCode(ctx context.Context, code string, errs []TerraformDiagnostic, provider CloudProvider) (string, error) {
+	var problems strings.Builder
+	for _, d := range errs {
+		location := ""
+		if d.Line > 0 {
+			location = fmt.Sprintf(" (%s:%d)", d.File, d.Line)
+		}
+		fmt.Fprintf(&problems, "- [%s]%s %s: %s\n", d.Source, location, d.Summary, d.Detail)
+	}
+
+	prompt := fmt.Sprintf(`This Terraform module for %s fails validation.
+
+main.tf:
+%s
+
+Errors:
+%s
+Fix every error without changing the resources the module creates. Respond with the complete corrected main.tf only, no explanation.`, provider, code, problems.String())
+
+	response, err := c.complete(ctx, "You are a Terraform expert who fixes invalid HCL.", prompt, 4000)
+	if err != nil {
+		return "", err
+	}
+
+	repaired := extractHCL(response)
+	if repaired == "" {
+		return "", fmt.Errorf("claude returned no Terraform code")
+	}
+	return repaired, nil
+}
+
+// extractHCL strips the Markdown code fence a model reply may wrap code in
+func extractHCL(text string) string {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "```") {
+		if i := strings.Index(text, "\n"); i >= 0 {
+			text = text[i+1:]
+		}
+		if i := strings.LastIndex(text, "```"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+	}
+	if text == "" {
+		return ""
+	}
+	return text + "\n"
+}
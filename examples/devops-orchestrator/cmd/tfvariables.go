@@ -0,0 +1,529 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Terraform variable declaration parsing and request validation
+type TerraformVariable struct {
+	Name          string   `json:"name"`
+	Type          string   `json:"type"` // declared type expression, "any" when omitted
+	Required      bool     `json:"required"`
+	AllowedValues []string `json:"allowed_values,omitempty"`
+}
+
+type VariableViolation struct {
+	Variable string `json:"variable"`
+	Problem  string `json:"problem"` // "missing", "type_mismatch", "not_allowed", "undeclared"
+	Expected string `json:"expected,omitempty"`
+	Detail   string `json:"detail"`
+}
+
+// VariableValidationError is returned before any Terraform action runs; the handler maps it to 422
+type VariableValidationError struct {
+	Violations []VariableViolation `json:"violations"`
+}
+
+func (e *VariableValidationError) Error() string {
+	return fmt.Sprintf("%d invalid Terraform variable(s)", len(e.Violations))
+}
+
+type VariableValidationResponse struct {
+	Error      string              `json:"error"`
+	Violations []VariableViolation `json:"violations"`
+}
+
+var (
+	variableBlockStart = regexp.MustCompile(`(?m)^\s*variable\s+"([^"]+)"\s*\{`)
+	containsCondition  = regexp.MustCompile(`contains\(\s*\[([^\]]*)\]\s*,\s*var\.([A-Za-z0-9_-]+)\s*\)`)
+)
+
+// ValidateTerraformVariables checks request variables against the code's variable declarations
+func ValidateTerraformVariables(code string, variables map[string]interface{}) error {
+	declared, err := parseTerraformVariables(code)
+	if err != nil {
+		return fmt.Errorf("failed to parse Terraform variable declarations: %w", err)
+	}
+
+	violations := make([]VariableViolation, 0)
+	byName := make(map[string]bool, len(declared))
+
+	for _, v := range declared {
+		byName[v.Name] = true
+		value, supplied := variables[v.Name]
+
+		if !supplied || value == nil {
+			if v.Required {
+				violations = append(violations, VariableViolation{
+					Variable: v.Name, Problem: "missing", Expected: v.Type,
+					Detail: "variable has no default and must be supplied",
+				})
+			}
+			continue
+		}
+
+		typ, err := parseTypeExpr(v.Type)
+		if err != nil {
+			return fmt.Errorf("variable %q: %w", v.Name, err)
+		}
+		if err := typ.check(value, ""); err != nil {
+			violations = append(violations, VariableViolation{
+				Variable: v.Name, Problem: "type_mismatch", Expected: v.Type, Detail: err.Error(),
+			})
+			continue
+		}
+
+		if len(v.AllowedValues) > 0 && !containsString(v.AllowedValues, fmt.Sprint(value)) {
+			violations = append(violations, VariableViolation{
+				Variable: v.Name, Problem: "not_allowed", Expected: strings.Join(v.AllowedValues, ", "),
+				Detail: fmt.Sprintf("%v is not an allowed value", value),
+			})
+		}
+	}
+
+	for name := range variables {
+		if !byName[name] {
+			violations = append(violations, VariableViolation{
+				Variable: name, Problem: "undeclared", Detail: "no variable block declares this variable",
+			})
+		}
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	sort.Slice(violations, func(i, j int) bool { return violations[i].Variable < violations[j].Variable })
+	return &VariableValidationError{Violations: violations}
+}
+
+// parseTerraformVariables extracts variable blocks from HCL source
+func parseTerraformVariables(code string) ([]TerraformVariable, error) {
+	variables := make([]TerraformVariable, 0)
+
+	for _, loc := range variableBlockStart.FindAllStringSubmatchIndex(code, -1) {
+		name := code[loc[2]:loc[3]]
+		end, err := matchingBrace(code, loc[1]-1)
+		if err != nil {
+			return nil, fmt.Errorf("variable %q: %w", name, err)
+		}
+		body := code[loc[1]:end]
+
+		v := TerraformVariable{Name: name, Type: "any", Required: true}
+		if expr, ok := topLevelAttribute(body, "type"); ok {
+			v.Type = expr
+		}
+		if _, ok := topLevelAttribute(body, "default"); ok {
+			v.Required = false
+		}
+		for _, match := range containsCondition.FindAllStringSubmatch(body, -1) {
+			if match[2] != name {
+				continue
+			}
+			for _, item := range strings.Split(match[1], ",") {
+				if item = strings.Trim(strings.TrimSpace(item), `"`); item != "" {
+					v.AllowedValues = append(v.AllowedValues, item)
+				}
+			}
+		}
+
+		variables = append(variables, v)
+	}
+
+	return variables, nil
+}
+
+// matchingBrace returns the index of the brace closing the one at open, skipping strings and comments
+func matchingBrace(src string, open int) (int, error) {
+	depth := 0
+	for i := open; i < len(src); i++ {
+		switch {
+		case src[i] == '"':
+			for i++; i < len(src) && src[i] != '"'; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+		case src[i] == '#' || strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end == -1 {
+				return 0, fmt.Errorf("unterminated comment")
+			}
+			i += end + 3
+		case src[i] == '{':
+			depth++
+		case src[i] == '}':
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unbalanced braces")
+}
+
+// topLevelAttribute returns the expression assigned to name directly in body (not in nested blocks)
+func topLevelAttribute(body, name string) (string, bool) {
+	depth := 0
+	for i := 0; i < len(body); i++ {
+		switch c := body[i]; {
+		case c == '"':
+			for i++; i < len(body) && body[i] != '"'; i++ {
+				if body[i] == '\\' {
+					i++
+				}
+			}
+		case c == '#' || strings.HasPrefix(body[i:], "//"):
+			for i < len(body) && body[i] != '\n' {
+				i++
+			}
+		case c == '{' || c == '(' || c == '[':
+			depth++
+		case c == '}' || c == ')' || c == ']':
+			depth--
+		case depth == 0 && strings.HasPrefix(body[i:], name) && (i == 0 || isSpace(body[i-1])):
+			rest := strings.TrimLeft(body[i+len(name):], " \t")
+			if !strings.HasPrefix(rest, "=") || strings.HasPrefix(rest, "==") {
+				continue
+			}
+			return readExpression(strings.TrimLeft(rest[1:], " \t")), true
+		}
+	}
+	return "", false
+}
+
+// readExpression reads up to the end of line, continuing across lines while brackets are open
+func readExpression(src string) string {
+	depth := 0
+	for i := 0; i < len(src); i++ {
+		switch src[i] {
+		case '"':
+			for i++; i < len(src) && src[i] != '"'; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+		case '{', '(', '[':
+			depth++
+		case '}', ')', ']':
+			depth--
+		case '\n':
+			if depth <= 0 {
+				return strings.TrimSpace(src[:i])
+			}
+		}
+	}
+	return strings.TrimSpace(src)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Terraform type constraints
+type tfType struct {
+	kind     string             // "any", "string", "number", "bool", "list", "set", "map", "object", "tuple"
+	elem     *tfType            // list, set, map
+	attrs    map[string]*tfType // object
+	optional map[string]bool    // object attributes wrapped in optional()
+	elems    []*tfType          // tuple
+}
+
+func parseTypeExpr(expr string) (*tfType, error) {
+	p := &typeParser{src: expr}
+	typ, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid type %q: %w", expr, err)
+	}
+	return typ, nil
+}
+
+type typeParser struct {
+	src string
+	pos int
+}
+
+func (p *typeParser) skip() {
+	for p.pos < len(p.src) && (isSpace(p.src[p.pos]) || p.src[p.pos] == ',') {
+		p.pos++
+	}
+}
+
+func (p *typeParser) ident() string {
+	p.skip()
+	start := p.pos
+	for p.pos < len(p.src) && (p.src[p.pos] == '_' || p.src[p.pos] == '-' ||
+		(p.src[p.pos] >= 'a' && p.src[p.pos] <= 'z') || (p.src[p.pos] >= 'A' && p.src[p.pos] <= 'Z') ||
+		(p.src[p.pos] >= '0' && p.src[p.pos] <= '9')) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *typeParser) expect(c byte) error {
+	p.skip()
+	if p.pos >= len(p.src) || p.src[p.pos] != c {
+		return fmt.Errorf("expected %q at offset %d", c, p.pos)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *typeParser) peek() byte {
+	p.skip()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *typeParser) parse() (*tfType, error) {
+	kind := p.ident()
+	switch kind {
+	case "any", "string", "number", "bool":
+		return &tfType{kind: kind}, nil
+
+	case "list", "set", "map":
+		if err := p.expect('('); err != nil {
+			return nil, err
+		}
+		elem, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		return &tfType{kind: kind, elem: elem}, p.expect(')')
+
+	case "tuple":
+		if err := p.expect('('); err != nil {
+			return nil, err
+		}
+		if err := p.expect('['); err != nil {
+			return nil, err
+		}
+		typ := &tfType{kind: kind}
+		for p.peek() != ']' {
+			elem, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			typ.elems = append(typ.elems, elem)
+		}
+		p.pos++
+		return typ, p.expect(')')
+
+	case "object":
+		if err := p.expect('('); err != nil {
+			return nil, err
+		}
+		if err := p.expect('{'); err != nil {
+			return nil, err
+		}
+		typ := &tfType{kind: kind, attrs: map[string]*tfType{}, optional: map[string]bool{}}
+		for p.peek() != '}' {
+			name := p.ident()
+			if name == "" {
+				return nil, fmt.Errorf("expected attribute name at offset %d", p.pos)
+			}
+			if err := p.expect('='); err != nil {
+				return nil, err
+			}
+			attr, optional, err := p.parseAttribute()
+			if err != nil {
+				return nil, err
+			}
+			typ.attrs[name] = attr
+			typ.optional[name] = optional
+		}
+		p.pos++
+		return typ, p.expect(')')
+	}
+
+	return nil, fmt.Errorf("unknown type %q", kind)
+}
+
+// parseAttribute parses an object attribute type, unwrapping optional(type[, default])
+func (p *typeParser) parseAttribute() (*tfType, bool, error) {
+	start := p.pos
+	if p.ident() != "optional" {
+		p.pos = start
+		typ, err := p.parse()
+		return typ, false, err
+	}
+
+	if err := p.expect('('); err != nil {
+		return nil, false, err
+	}
+	typ, err := p.parse()
+	if err != nil {
+		return nil, false, err
+	}
+	// Skip an optional default value up to the closing parenthesis
+	depth := 0
+	for ; p.pos < len(p.src); p.pos++ {
+		switch p.src[p.pos] {
+		case '(', '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		case ')':
+			if depth == 0 {
+				p.pos++
+				return typ, true, nil
+			}
+			depth--
+		}
+	}
+	return nil, false, fmt.Errorf("unterminated optional()")
+}
+
+func (t *tfType) String() string {
+	switch t.kind {
+	case "list", "set", "map":
+		return fmt.Sprintf("%s(%s)", t.kind, t.elem)
+	case "tuple", "object":
+		return t.kind
+	}
+	return t.kind
+}
+
+// check reports whether a JSON-decoded value converts to the type, following Terraform's
+// automatic conversions (e.g. "5" to number, true to string)
+func (t *tfType) check(value interface{}, path string) error {
+	mismatch := func() error {
+		if path == "" {
+			return fmt.Errorf("expected %s, got %s", t, jsonKind(value))
+		}
+		return fmt.Errorf("%s: expected %s, got %s", path, t, jsonKind(value))
+	}
+
+	switch t.kind {
+	case "any":
+		return nil
+
+	case "string":
+		switch value.(type) {
+		case string, float64, bool:
+			return nil
+		}
+		return mismatch()
+
+	case "number":
+		switch v := value.(type) {
+		case float64:
+			return nil
+		case string:
+			if _, err := strconv.ParseFloat(v, 64); err == nil {
+				return nil
+			}
+		}
+		return mismatch()
+
+	case "bool":
+		switch v := value.(type) {
+		case bool:
+			return nil
+		case string:
+			if v == "true" || v == "false" {
+				return nil
+			}
+		}
+		return mismatch()
+
+	case "list", "set":
+		items, ok := value.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		for i, item := range items {
+			if err := t.elem.check(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "tuple":
+		items, ok := value.([]interface{})
+		if !ok || len(items) != len(t.elems) {
+			return mismatch()
+		}
+		for i, item := range items {
+			if err := t.elems[i].check(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "map":
+		entries, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		for key, item := range entries {
+			if err := t.elem.check(item, fmt.Sprintf("%s[%q]", path, key)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "object":
+		entries, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		names := make([]string, 0, len(t.attrs))
+		for name := range t.attrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			attrPath := strings.TrimPrefix(path+"."+name, ".")
+			item, present := entries[name]
+			if !present {
+				if t.optional[name] {
+					continue
+				}
+				return fmt.Errorf("%s: required attribute missing", attrPath)
+			}
+			if err := t.attrs[name].check(item, attrPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return mismatch()
+}
+
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "bool"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}